@@ -14,7 +14,7 @@ import (
 func ParseCommandLine(opts *util.Options, args []string) (errors []string) {
 
 	errors = make([]string, 0, 1)
-	valueRegex := regexp.MustCompile(`^--([\w-]+)=(\w+)$`)
+	valueRegex := regexp.MustCompile(`^--([\w-]+)=(.+)$`)
 	boolRegex := regexp.MustCompile(`^--([\w-]+)$`)
 	shortBoolRegex := regexp.MustCompile(`^-(\w)$`)
 	foundCommand := false
@@ -111,3 +111,18 @@ func validateCustomOptions(opts *util.Options, validValueOpts, validBoolOpts []s
 	}
 	return
 }
+
+// Apply the --limit-rate option (push / fetch) if present, overriding the configured limit
+// for the direction of transfer
+func applyLimitRateOption(limit *int64) error {
+	rate, ok := util.GlobalOptions.StringOpts["limit-rate"]
+	if !ok {
+		return nil
+	}
+	n, err := util.ParseTransferRate(rate)
+	if err != nil {
+		return fmt.Errorf("git-lob: invalid option --limit-rate=%v, must be a rate e.g. 500K or 2MB", rate)
+	}
+	*limit = n
+	return nil
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Get the provider for the --remote option of archive-history & restore-archive, nil if not given
+func getArchiveRemoteProvider(repo *core.Repo) (provider providers.SyncProvider, remoteName string, ret int) {
+	remoteName, ok := util.GlobalOptions.StringOpts["remote"]
+	if !ok {
+		return nil, "", 0
+	}
+	provider, err := repo.GetProvider(remoteName)
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return nil, "", 6
+	}
+	if err = provider.ValidateConfig(remoteName); err != nil {
+		util.LogConsoleErrorf("Remote %v has configuration problems:\n%v\n", remoteName, err)
+		return nil, "", 6
+	}
+	return provider, remoteName, 0
+}
+
+// Archive history command line tool
+func ArchiveHistory(repo *core.Repo) int {
+
+	// git-lob archive-history [--remote=<remote>] [--dry-run] <ref-range> <archive-file>
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"}, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) != 2 {
+		util.LogConsoleError("git-lob: archive-history needs a range of history & a file to archive it to")
+		return 9
+	}
+	refspec := core.ParseGitRefSpec(util.GlobalOptions.Args[0])
+	archiveFile := util.GlobalOptions.Args[1]
+	provider, remoteName, ret := getArchiveRemoteProvider(repo)
+	if ret != 0 {
+		return ret
+	}
+	if provider != nil {
+		defer provider.Release()
+	}
+
+	var lastProgressLen int
+	callback := func(data *core.ArchiveCallbackData) (quit bool) {
+		switch data.Type {
+		case core.ArchiveWorking:
+			util.LogConsoleSpinner("Searching: ")
+		case core.ArchiveStored:
+			msg := fmt.Sprintf("Archiving: %d/%d (%d%%)", data.Done, data.Total, data.Done*100/data.Total)
+			util.LogConsoleOverwrite(msg, lastProgressLen)
+			lastProgressLen = len(msg)
+		}
+		return false
+	}
+
+	util.LogConsolef("Finding binaries used only by %v...\n", refspec)
+	manifest, err := repo.ArchiveHistory(refspec, archiveFile, provider, remoteName, util.GlobalOptions.DryRun, callback)
+	util.LogConsoleSpinnerFinish("Searching: ")
+	if lastProgressLen > 0 {
+		util.LogConsole("")
+	}
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: archive error - %v\n", err.Error())
+		return 12
+	}
+
+	if len(manifest.LOBs) == 0 {
+		util.LogConsolef("No binaries are used only by %v, nothing to archive.\n", refspec)
+	} else if util.GlobalOptions.DryRun {
+		util.LogConsolef("%d binaries (%v) would be archived to %v.\n", len(manifest.LOBs), util.FormatSize(manifest.TotalSize()), archiveFile)
+		util.LogConsole("Run this command again without --dry-run to archive them.")
+	} else {
+		util.LogConsolef("%d binaries (%v) archived to %v & removed from the local store", len(manifest.LOBs), util.FormatSize(manifest.TotalSize()), archiveFile)
+		if provider != nil {
+			util.LogConsolef(" and %v", remoteName)
+		}
+		util.LogConsole(".")
+		util.LogConsolef("Keep the archive safe, restore it with 'git lob restore-archive %v'.\n", archiveFile)
+	}
+	return 0
+}
+
+func ArchiveHistoryHelp() {
+	util.LogConsole(`Usage: git-lob archive-history [options] <ref-range> <archive-file>
+
+  Moves the binaries which only an old range of history uses into an archive
+  file, for cheap offline storage, & removes them from the local binary store
+  (and a remote with --remote). Restore them with 'git lob restore-archive' if
+  you need the old history again.
+
+  <ref-range> is a range of commits such as v1.0..v2.0, or a single ref to
+  archive all history up to & including it. Binaries are archived when they
+  were added by a commit in the range and no commit outside the range, on any
+  branch, tag or remote branch, uses them; HEAD can't be in the range.
+
+  Every binary to archive must be complete locally, so fetch the range first
+  (e.g. 'git lob fetch origin v1.0..v2.0'). The archive is a tar file which
+  starts with a manifest (git-lob-archive.json) listing the binaries in it.
+  Nothing is deleted until the whole archive has been written.
+
+Options:
+  --remote=<remote>  Also remove the archived binaries from this remote (smart
+                     remotes only). Other clones will no longer be able to
+                     fetch them, so make sure nobody needs the old history.
+  --dry-run          Report what would be archived without changing anything
+  --quiet, -q        Print less output
+  --verbose, -v      Print more output
+
+`)
+}
+
+// Restore archive command line tool
+func RestoreArchive(repo *core.Repo) int {
+
+	// git-lob restore-archive [--remote=<remote>] [--dry-run] <archive-file>
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"}, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) != 1 {
+		util.LogConsoleError("git-lob: restore-archive needs exactly one archive file")
+		return 9
+	}
+	archiveFile := util.GlobalOptions.Args[0]
+	provider, remoteName, ret := getArchiveRemoteProvider(repo)
+	if ret != 0 {
+		return ret
+	}
+	if provider != nil {
+		defer provider.Release()
+	}
+
+	var restored, uploaded, failed int
+	var lastProgressLen int
+	callback := func(data *core.ArchiveCallbackData) (quit bool) {
+		switch data.Type {
+		case core.ArchiveWorking:
+			util.LogConsoleSpinner("Extracting: ")
+			return false
+		case core.ArchiveStored:
+			restored++
+		case core.ArchiveUploaded:
+			restored++
+			uploaded++
+		case core.ArchiveError:
+			failed++
+			util.LogConsoleErrorf("\rUnable to restore %v: %v\n", data.SHA, data.Error.Error())
+		}
+		msg := fmt.Sprintf("Restoring: %d/%d (%d%%)", data.Done, data.Total, data.Done*100/data.Total)
+		util.LogConsoleOverwrite(msg, lastProgressLen)
+		lastProgressLen = len(msg)
+		return false
+	}
+
+	manifest, err := repo.RestoreArchive(archiveFile, provider, remoteName, util.GlobalOptions.DryRun, callback)
+	util.LogConsoleSpinnerFinish("Extracting: ")
+	if lastProgressLen > 0 {
+		util.LogConsole("")
+	}
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: restore error - %v\n", err.Error())
+		return 12
+	}
+	if util.GlobalOptions.DryRun {
+		util.LogConsolef("%v contains %d binaries (%v) used by %v, archived %v.\n", archiveFile, len(manifest.LOBs),
+			util.FormatSize(manifest.TotalSize()), manifest.RefSpec, manifest.Created.Format("2006-01-02"))
+		util.LogConsole("Run this command again without --dry-run to restore them.")
+		return 0
+	}
+	util.LogConsolef("%d binaries restored to the local store", restored)
+	if provider != nil {
+		util.LogConsolef(", %d uploaded to %v", uploaded, remoteName)
+	}
+	util.LogConsole(".")
+	if failed > 0 {
+		util.LogConsolef("%d binaries could not be restored.\n", failed)
+		return 12
+	}
+	return 0
+}
+
+func RestoreArchiveHelp() {
+	util.LogConsole(`Usage: git-lob restore-archive [options] <archive-file>
+
+  Puts the binaries in an archive written by 'git lob archive-history' back
+  into the local binary store (and the shared store, if you use one), checking
+  each one against its SHA, so that the old history can be checked out again.
+  With --remote they're also uploaded to a remote, for other clones to fetch.
+
+Options:
+  --remote=<remote>  Also upload the restored binaries to this remote
+  --dry-run          Report what the archive contains without restoring it
+  --quiet, -q        Print less output
+  --verbose, -v      Print more output
+
+`)
+}
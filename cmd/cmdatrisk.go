@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// At risk command line tool
+func AtRisk(repo *core.Repo) int {
+
+	// git-lob at-risk [remote...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+
+	var remoteNames []string
+	for _, remoteName := range util.GlobalOptions.Args {
+		if !repo.IsGitRemote(remoteName) {
+			util.LogConsoleErrorf("'%v' is not a git remote\n", remoteName)
+			return 9
+		}
+		remoteNames = append(remoteNames, remoteName)
+	}
+
+	anyRemoteErrors := false
+	callback := func(data *core.AtRiskCallbackData) (quit bool) {
+		// Ensure we clear previous progress
+		util.LogConsolef("\r")
+		switch data.Type {
+		case core.AtRiskCheckingRemote:
+			util.LogConsolef("Checking %v for %d binaries not present locally...\n", data.RemoteName, data.Count)
+		case core.AtRiskRemoteError:
+			util.LogConsoleErrorf("Unable to check %v: %v\n", data.RemoteName, data.Error.Error())
+			anyRemoteErrors = true
+		case core.AtRiskMissing:
+			util.LogConsolef("%v %v\n", data.LOBSHA, data.Path)
+			util.LogConsolef("  Added: %v(%v) [%v] %v\n", data.CommitSummary.CommitterName, data.CommitSummary.CommitterEmail,
+				data.CommitSummary.ShortSHA, data.CommitSummary.Subject)
+		case core.AtRiskWorking:
+			// nothing, just spinner below
+		}
+		// Display progress always (fixed line width always large enough)
+		util.LogConsoleSpinner("Searching: ")
+		// Always continue
+		return false
+	}
+	util.LogConsole("Checking all binaries referenced by branches & tags...")
+	shas, err := repo.FindAtRisk(remoteNames, callback)
+	util.LogConsoleSpinnerFinish("Searching: ")
+	if err != nil {
+		util.LogErrorf("Unable to check binaries: %v\n", err.Error())
+		return 3
+	}
+	if anyRemoteErrors {
+		util.LogConsole("Some remotes could not be checked, binaries stored only there are reported above.")
+	}
+	if len(shas) > 0 {
+		util.LogConsolef("%d binaries are not present locally or on any remote, see above.\n", len(shas))
+		util.LogConsole("Unless they can be found elsewhere (e.g. where they were added), this content is lost.")
+		return 12
+	}
+	util.LogConsole("All referenced binaries are stored locally or on a remote")
+	return 0
+}
+
+func AtRiskHelp() {
+	util.LogConsole(`Usage: git-lob at-risk [options] [remote...]
+
+  Reports binaries which are referenced by a commit on any branch or tag, but
+  whose content is not stored locally or on any remote. Unless the content can
+  be found somewhere else, for example on the machine of the person who added
+  it, it has been lost. Run this before decommissioning a machine or binary
+  store to make sure nothing is only stored there.
+
+  For each binary, reports the most recent commit which added it, so you know
+  who to chase up.
+
+  Binaries are checked locally first, then on each remote only if they still
+  haven't been found. Smart servers which allow you to prune are asked for a
+  list of all their binaries in one request rather than checking each one.
+
+  Exits with code 12 if any binaries are at risk.
+
+Parameters:
+  remote...     Optional list of remotes to check. By default checks all
+                remotes which have a git-lob provider configured.
+
+Options:
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
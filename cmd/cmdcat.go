@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Cat command line tool
+func Cat(repo *core.Repo) int {
+	// Content goes to stdout, so everything else must not
+	util.LogAllConsoleOutputToStdErr()
+
+	// git-lob cat [--output=<file>] [--fetch] <path>[@<ref>]|<sha>
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"output"}, []string{"fetch"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) != 1 {
+		util.LogConsoleError("Must supply exactly one <path>[@<ref>] or SHA")
+		return 9
+	}
+	if util.GlobalOptions.BoolOpts.Contains("fetch") {
+		util.GlobalOptions.AutoFetchEnabled = true
+	}
+
+	arg := util.GlobalOptions.Args[0]
+	var sha string
+	if core.IsLOBSHA(arg) && !util.FileExists(arg) {
+		sha = strings.ToLower(arg)
+	} else {
+		var relpath, ref string
+		var err error
+		sha, relpath, ref, err = repo.GetLOBSHAForPathAtRef(arg)
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 9
+		}
+		util.LogDebugf("%v in %v is %v\n", relpath, ref, sha)
+	}
+
+	var out io.Writer = os.Stdout
+	outputFile, hasOutput := util.GlobalOptions.StringOpts["output"]
+	var f *os.File
+	if hasOutput {
+		// Write somewhere temporary first, so a failure doesn't leave a partial file
+		var err error
+		f, err = os.Create(filepath.Join(filepath.Dir(outputFile), "."+filepath.Base(outputFile)+".tmp"))
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: unable to create %v: %v\n", outputFile, err)
+			return 12
+		}
+		defer func() {
+			f.Close()
+			os.Remove(f.Name())
+		}()
+		out = f
+	}
+
+	_, err := repo.RetrieveLOB(sha, out)
+	if err != nil {
+		if core.IsNotFoundError(err) && !util.GlobalOptions.AutoFetchEnabled {
+			util.LogConsoleErrorf("git-lob: content of %v is not available locally, use --fetch to download it\n", sha)
+		} else {
+			util.LogConsoleErrorf("git-lob: unable to read %v: %v\n", sha, err)
+		}
+		return 12
+	}
+	if f != nil {
+		if err = f.Close(); err == nil {
+			os.Remove(outputFile)
+			err = os.Rename(f.Name(), outputFile)
+		}
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: unable to write %v: %v\n", outputFile, err)
+			return 12
+		}
+	}
+	return 0
+}
+
+func CatHelp() {
+	util.LogConsole(`Usage: git-lob cat [options] <path>[@<ref>]
+       git-lob cat [options] <sha>
+
+  Writes the content of a binary to stdout, as a file was committed at any
+  ref (HEAD if not given), without checking it out. For example, to extract
+  an old version of a texture:
+
+    git lob cat art/hero.png@v1.2 > hero-v1.2.png
+
+  <path> is relative to the current directory, & doesn't have to exist in
+  the working copy. <ref> can be anything git understands, e.g. a branch,
+  tag, commit SHA or HEAD~3. A binary can also be given by its SHA.
+
+  If the content isn't in the local binary store, it's only downloaded if
+  git-lob.autofetch is enabled or --fetch is used.
+
+Options:
+  --output=<file>  Write the content to a file instead of stdout. The file is
+                   only replaced once all the content has been written.
+  --fetch          Download the content if it isn't stored locally, from the
+                   remotes auto-fetch would use (see git-lob.autofetch in 'git
+                   lob help config')
+  --quiet, -q      Print less output
+  --verbose, -v    Print more output
+`)
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Check config command line tool
+func CheckConfig(repo *core.Repo) int {
+
+	// git-lob check-config [--remote=<remote>]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"}, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) > 0 {
+		util.LogConsoleError("Too many arguments; use --remote=<remote> to choose a remote")
+		return 9
+	}
+
+	var remotes []string
+	if remoteName, ok := util.GlobalOptions.StringOpts["remote"]; ok {
+		if !repo.IsGitRemote(remoteName) {
+			util.LogConsoleError(remoteName, "is not a valid remote name")
+			return 9
+		}
+		remotes = []string{remoteName}
+	} else {
+		var err error
+		remotes, err = repo.GetGitLOBRemotes()
+		if err != nil {
+			util.LogConsoleError("Unable to list remotes:", err.Error())
+			return 12
+		}
+		if len(remotes) == 0 {
+			util.LogConsoleError("No remotes have binary storage configured (git-lob-provider), see 'git lob help remotes'")
+			return 6
+		}
+	}
+
+	failed := 0
+	for _, remoteName := range remotes {
+		util.LogConsolef("Checking remote %v:\n", remoteName)
+		callback := func(step *core.RemoteCheckStep) {
+			var outcome string
+			switch {
+			case step.Error != nil:
+				outcome = "FAILED"
+			case step.Skipped:
+				outcome = "skipped"
+			default:
+				outcome = "OK"
+			}
+			msg := "  " + step.Name + ": " + outcome
+			if step.Detail != "" {
+				msg += " (" + step.Detail + ")"
+			}
+			util.LogConsole(msg)
+			if step.Error != nil {
+				// Errors can be several lines
+				util.LogConsole("    " + strings.Replace(step.Error.Error(), "\n", "\n    ", -1))
+			}
+		}
+		if !repo.CheckRemote(remoteName, callback) {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		util.LogConsoleErrorf("%d of %d remotes failed the check\n", failed, len(remotes))
+		return 6
+	}
+	return 0
+}
+
+func CheckConfigHelp() {
+	util.LogConsole(`Usage: git-lob check-config [options]
+
+  Tests that binaries can be stored on a remote, so that setup problems show
+  up with a clear explanation rather than as errors part way through a push or
+  fetch. Each of these steps is reported:
+
+    Validate configuration  The remote's git-lob-provider & other settings
+    Connect                 Connects to the remote, if the provider makes a
+                            connection which can be tested on its own
+    Upload probe            Uploads a tiny binary made just for the check
+    Download probe          Downloads it back again, bypassing any cache
+    Verify probe            Checks that what was downloaded is intact
+    Delete probe            Deletes it from the remote, if the provider can
+
+  If a step fails, the rest aren't attempted, except that the probe is always
+  deleted once it's been uploaded. Exits with a non-zero code if any remote
+  fails the check.
+
+Options:
+  --remote=<remote>  The remote to check. By default all the remotes with
+                     binary storage configured are checked.
+  --quiet, -q        Print less output
+  --verbose, -v      Print more output
+`)
+}
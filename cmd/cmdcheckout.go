@@ -7,12 +7,22 @@ import (
 	"github.com/atlassian/git-lob/util"
 )
 
-func Checkout() int {
+func Checkout(repo *core.Repo) int {
 
 	// git-lob checkout [options] [<pathspec>...]
 
-	// no custom options
+	// Custom options aren't validated since pull passes through fetch options
 	optDryRun := util.GlobalOptions.DryRun
+	linkMode, err := getLinkModeOption(core.LinkModeCopy)
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
+	workspace, err := getWorkspaceOption(repo)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 9
+	}
 
 	// All extra arguments must be <pathspec>
 	var pathspecs []string
@@ -21,10 +31,26 @@ func Checkout() int {
 		pathspecs = append(pathspecs, p)
 	}
 
+	if optDryRun {
+		return checkoutDryRun(repo, workspace, pathspecs)
+	}
+
 	var filesCheckedOut int
 	var filesFailed int
 	var filesUpToDate int
+	// Large files can take a while to write, so show progress through them
+	var fileProgress *util.ItemProgressReporter
+	progress := func(data *util.ProgressCallbackData) (abort bool) {
+		if fileProgress == nil || fileProgress.Desc != data.Desc {
+			fileProgress = util.NewItemProgressReporter("Checking out", data.Desc)
+		}
+		return fileProgress.Callback(data)
+	}
 	callback := func(t util.ProgressCallbackType, filelob *core.FileLOB, err error) {
+		if fileProgress != nil {
+			fileProgress.Finish(t == util.ProgressTransferBytes)
+			fileProgress = nil
+		}
 		switch t {
 		case util.ProgressSkip:
 			filesUpToDate++
@@ -35,17 +61,13 @@ func Checkout() int {
 			util.LogConsoleError("ERROR:", err.Error())
 			filesFailed++
 		case util.ProgressTransferBytes:
-			if optDryRun {
-				util.LogConsoleDebug(filelob.Filename, "needs check out.")
-			} else {
-				util.LogConsoleDebug(filelob.Filename, "checked out.")
-			}
+			util.LogConsoleDebug(filelob.Filename, "checked out.")
 			filesCheckedOut++
 		}
 
 	}
 
-	err := core.Checkout(pathspecs, optDryRun, callback)
+	err = repo.CheckoutWorkspaceWithProgress(workspace, pathspecs, false, linkMode, callback, progress)
 
 	if err != nil {
 		util.LogConsoleErrorf("git-lob: checkout error - %v\n", err.Error())
@@ -53,16 +75,9 @@ func Checkout() int {
 	}
 
 	// Report final state
-	if optDryRun {
-		util.LogConsole(filesCheckedOut, "files need updating")
-		if filesCheckedOut > 0 {
-			util.LogConsole("Run this command again without --dry-run to update these files.")
-		}
-	} else {
-		util.LogConsole(filesCheckedOut, "files were updated")
-		if filesFailed > 0 {
-			util.LogConsole("WARNING:", filesFailed, "failed to be updated, check errors above")
-		}
+	util.LogConsole(filesCheckedOut, "files were updated")
+	if filesFailed > 0 {
+		util.LogConsole("WARNING:", filesFailed, "failed to be updated, check errors above")
 	}
 
 	if filesFailed > 0 {
@@ -72,6 +87,55 @@ func Checkout() int {
 	return 0
 }
 
+// Report what checkout would do & how much it would write & download, without changing anything
+func checkoutDryRun(repo *core.Repo, workspace *core.Workspace, pathspecs []string) int {
+	callback := func(filelob *core.FileLOB, source core.CheckoutFileSource, size int64) {
+		sizeDesc := "unknown size"
+		if size >= 0 {
+			sizeDesc = util.FormatSize(size)
+		}
+		switch source {
+		case core.CheckoutFileLocal:
+			util.LogConsolef("%v would be checked out (%v)\n", filelob.Filename, sizeDesc)
+		case core.CheckoutFileFetch:
+			util.LogConsolef("%v would be fetched & checked out (%v)\n", filelob.Filename, sizeDesc)
+		case core.CheckoutFileUnavailable:
+			util.LogConsolef("%v content not available, placeholder would be kept [%v]\n", filelob.Filename, filelob.SHA[:7])
+		}
+	}
+	estimate, err := repo.EstimateCheckoutWorkspace(workspace, pathspecs, callback)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: checkout error - %v\n", err.Error())
+		return 7
+	}
+
+	util.LogConsolef("%d files need updating, %v to write\n", estimate.Files-estimate.FilesUnavailable, util.FormatSize(estimate.BytesToWrite))
+	if estimate.LOBsMissing > 0 {
+		util.LogConsolef("%d binaries are missing locally", estimate.LOBsMissing)
+		if estimate.LOBsToFetch > 0 {
+			util.LogConsolef(", %d would be fetched automatically (%v to download)", estimate.LOBsToFetch, util.FormatSize(estimate.BytesToDownload))
+		}
+		util.LogConsole("")
+	}
+	if estimate.LOBsSizeUnknown > 0 {
+		util.LogConsolef("Sizes above exclude %d binaries whose size is unknown until fetched or rebuilt\n", estimate.LOBsSizeUnknown)
+	}
+	if estimate.FilesUnavailable > 0 {
+		util.LogConsolef("%d files would be left as placeholders, use 'git lob fetch' first\n", estimate.FilesUnavailable)
+	}
+	if estimate.BytesFree >= 0 {
+		util.LogConsolef("%v of disk space needed, %v available\n", util.FormatSize(estimate.BytesNeeded()), util.FormatSize(estimate.BytesFree))
+		if !estimate.HasEnoughDiskSpace() {
+			util.LogConsolef("WARNING: not enough disk space, %v more is needed. Specify <pathspec> or --workspace to populate fewer files.\n",
+				util.FormatSize(estimate.BytesNeeded()-estimate.BytesFree))
+		}
+	}
+	if estimate.Files > estimate.FilesUnavailable {
+		util.LogConsole("Run this command again without --dry-run to update these files.")
+	}
+	return 0
+}
+
 func CheckoutHelp() {
 	util.LogConsole(`Usage: git-lob checkout [options] [<pathspec>...]
 
@@ -97,8 +161,9 @@ func CheckoutHelp() {
 
   git-lob: <sha>
 
-  Where <sha> is the identifier of the content of the binary file. Once you
-  have downloaded the content (e.g. via 'git lob fetch'), you can then use
+  Where <sha> is the identifier of the content of the binary file, prefixed
+  with 'sha256:' if it was stored with git-lob.hash-algorithm = sha256. Once
+  you have downloaded the content (e.g. via 'git lob fetch'), you can then use
   'git lob checkout' to fill in these blanks.
 
   Specify <pathspec> to limit the checking to particular files or directories.
@@ -106,7 +171,18 @@ func CheckoutHelp() {
   Options:
     --quiet, -q   Print less output
     --verbose, -v Print more output
-    --dry-run     Don't actually change any files, just report
+    --dry-run     Don't actually change any files, just report which files
+                  would be populated, which binaries are missing locally and
+                  would be fetched automatically (see git-lob.autofetch in
+                  'git lob help config'), and the total bytes which would be
+                  written & downloaded, with a warning if there isn't enough
+                  free disk space for them
+    --link=reflink|hardlink
+                  Share storage with the local binary store instead of copying
+                  where possible, see 'git lob dedupe-working-copy --help'
+    --workspace=<name>
+                  Only populate files in the named workspace, see
+                  'git lob fetch --help'
 
 `)
 }
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Get the --link option for checkout/dedupe commands, or defaultMode if not specified
+func getLinkModeOption(defaultMode core.LinkMode) (core.LinkMode, error) {
+	optLink, ok := util.GlobalOptions.StringOpts["link"]
+	if !ok {
+		return defaultMode, nil
+	}
+	return core.ParseLinkMode(optLink)
+}
+
+func DedupeWorkingCopy(repo *core.Repo) int {
+
+	// git-lob dedupe-working-copy [--link=reflink|hardlink] [<pathspec>...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"link"}, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	linkMode, err := getLinkModeOption(core.LinkModeReflink)
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
+	if linkMode == core.LinkModeCopy {
+		util.LogConsoleError("git-lob: --link must be reflink or hardlink for dedupe-working-copy")
+		return 9
+	}
+	optDryRun := util.GlobalOptions.DryRun
+
+	// All extra arguments must be <pathspec>
+	var pathspecs []string
+	for _, arg := range util.GlobalOptions.Args {
+		pathspecs = append(pathspecs, filepath.Clean(arg))
+	}
+
+	var filesLinked, filesAlreadyLinked, filesSkipped, filesFailed int
+	var bytesSaved int64
+	callback := func(data *core.DedupeCallbackData) (quit bool) {
+		switch data.Type {
+		case core.DedupeLinked:
+			if optDryRun {
+				util.LogConsoleDebug(data.Filename, "can be linked.")
+			} else {
+				util.LogConsoleDebugf("%v linked (%v).\n", data.Filename, data.Mode)
+			}
+			filesLinked++
+			bytesSaved += data.Size
+		case core.DedupeAlreadyLinked:
+			filesAlreadyLinked++
+		case core.DedupeSkipped:
+			util.LogConsoleDebugf("%v skipped: %v\n", data.Filename, data.Desc)
+			filesSkipped++
+		case core.DedupeError:
+			util.LogConsoleError("ERROR:", data.Desc)
+			filesFailed++
+		}
+		return false
+	}
+
+	err = repo.DedupeWorkingCopy(pathspecs, linkMode, optDryRun, callback)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: dedupe error - %v\n", err.Error())
+		return 12
+	}
+
+	if optDryRun {
+		util.LogConsolef("%d files (%v) can be linked to the binary store\n", filesLinked, util.FormatSize(bytesSaved))
+		if filesLinked > 0 {
+			util.LogConsole("Run this command again without --dry-run to link these files.")
+		}
+	} else {
+		util.LogConsolef("%d files (%v) were linked to the binary store\n", filesLinked, util.FormatSize(bytesSaved))
+	}
+	if filesAlreadyLinked > 0 {
+		util.LogConsole(filesAlreadyLinked, "files were already hard linked")
+	}
+	if filesSkipped > 0 {
+		util.LogConsole(filesSkipped, "files were left as separate copies (use --verbose for details)")
+	}
+	if filesFailed > 0 {
+		util.LogConsole("WARNING:", filesFailed, "failed to be linked, check errors above")
+		return 10
+	}
+	return 0
+}
+
+func DedupeWorkingCopyHelp() {
+	util.LogConsole(`Usage: git-lob dedupe-working-copy [options] [<pathspec>...]
+
+  Reduce disk usage by making binary files in the working copy share storage
+  with the local binary store, instead of being a second copy of the same data.
+
+  By default, files are replaced with copy-on-write clones (reflinks) of the
+  stored content. This requires a filesystem which supports them, e.g. APFS on
+  Mac OS X, or btrfs / XFS on Linux. Clones are completely safe; editing the
+  working copy file never changes the stored content.
+
+  With --link=hardlink, files are hard linked to the stored content when
+  clones are not supported. Hard links make both copies the same file, so
+  they're made read-only to stop in-place edits corrupting the binary store;
+  applications which save by replacing the file work as normal. Stored content
+  which is hard linked is always checked before it's used again, and fetched
+  again if it was modified anyway. Executable files are never hard linked, and
+  hard links are not used on Windows or with a shared store.
+
+  Only binaries stored in a single uncompressed chunk (smaller than 32MB) can
+  be linked. Files are only replaced if their content exactly matches the
+  stored binary; locally modified files and placeholders are left alone.
+
+  'git lob checkout' and 'git lob pull' accept the same --link option to link
+  new files as they're checked out. Files written by 'git checkout' itself are
+  always separate copies, run this command afterwards to link them.
+
+  Specify <pathspec> to limit the linking to particular files or directories.
+
+Options:
+  --link=reflink   Use copy-on-write clones only (default)
+  --link=hardlink  Use clones where possible, hard links otherwise
+  --quiet, -q      Print less output
+  --verbose, -v    Print more output, including why files were skipped
+  --dry-run        Don't change any files, just report what could be linked
+
+`)
+}
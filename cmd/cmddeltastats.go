@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Delta stats command line tool
+func DeltaStats(repo *core.Repo) int {
+
+	// git-lob delta-stats [--reset] [--benchmark [--pairs=<n>]]
+
+	// Validate custom options
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"pairs"}, []string{"reset", "benchmark"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+
+	if util.GlobalOptions.BoolOpts.Contains("benchmark") {
+		pairs := 10
+		if optPairs, ok := util.GlobalOptions.StringOpts["pairs"]; ok {
+			n, err := strconv.Atoi(optPairs)
+			if err != nil || n <= 0 {
+				util.LogConsoleErrorf("Invalid --pairs value '%v'\n", optPairs)
+				return 9
+			}
+			pairs = n
+		}
+		return benchmarkDeltaAlgorithms(repo, pairs)
+	}
+
+	if util.GlobalOptions.BoolOpts.Contains("reset") {
+		if util.GlobalOptions.DryRun {
+			util.LogConsole("Would delete all delta stats")
+			return 0
+		}
+		err := repo.ResetDeltaStats()
+		if err != nil {
+			util.LogConsoleErrorf("Unable to delete delta stats: %v\n", err.Error())
+			return 3
+		}
+		util.LogConsole("Delta stats deleted, thresholds will be learned again")
+		return 0
+	}
+
+	stats, err := repo.LoadDeltaStats()
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 3
+	}
+	if !util.GlobalOptions.AdaptiveDeltaSize {
+		util.LogConsole("Adaptive delta sizes are not enabled (git-lob.delta-size-adaptive), fixed sizes are in use")
+	}
+	thresholds := stats.GetAllThresholds(time.Now())
+	if len(thresholds) == 0 {
+		util.LogConsole("No delta savings have been recorded yet")
+		return 0
+	}
+	util.LogConsolef("%-12v %10v %10v  %v\n", "Extension", "Samples", "Saving", "Deltas tried above")
+	for _, t := range thresholds {
+		ext := t.Extension
+		if ext == "" {
+			ext = "(none)"
+		}
+		var threshold string
+		switch {
+		case !t.Learned:
+			threshold = fmt.Sprintf("(learning, using %v push / %v fetch)",
+				util.FormatSize(util.GlobalOptions.PushDeltasAboveSize), util.FormatSize(util.GlobalOptions.FetchDeltasAboveSize))
+		case t.Never:
+			threshold = "(never, deltas don't save enough)"
+		default:
+			threshold = util.FormatSize(t.Threshold)
+		}
+		util.LogConsolef("%-12v %10.1f %9.0f%%  %v\n", ext, t.Samples, t.AverageSavings*100, threshold)
+	}
+
+	return 0
+}
+
+// Compare the delta algorithms on versions of files in the local store
+func benchmarkDeltaAlgorithms(repo *core.Repo, pairs int) int {
+	util.LogConsolef("Comparing delta algorithms on up to %d pairs of versions...\n", pairs)
+	results, err := repo.BenchmarkDeltaAlgorithms(pairs)
+	if err != nil {
+		util.LogConsoleErrorf("Unable to benchmark delta algorithms: %v\n", err.Error())
+		return 12
+	}
+	ret := 0
+	util.LogConsolef("%-10v %6v %10v %10v %8v %10v %10v\n", "Algorithm", "Pairs", "Size", "Deltas", "Saving", "Generate", "Apply")
+	for _, r := range results {
+		var saving float64
+		if r.TargetSize > 0 {
+			saving = 100 * (1 - float64(r.DeltaSize)/float64(r.TargetSize))
+		}
+		util.LogConsolef("%-10v %6d %10v %10v %7.0f%% %10v %10v\n", r.Algorithm, r.Pairs, util.FormatSize(r.TargetSize),
+			util.FormatSize(r.DeltaSize), saving, r.GenerateTime.Round(time.Millisecond), r.ApplyTime.Round(time.Millisecond))
+	}
+	for _, r := range results {
+		for _, e := range r.Errors {
+			util.LogConsoleErrorf("%v failed on %v\n", r.Algorithm, e)
+			ret = 12
+		}
+	}
+	if len(results) > 0 && results[0].Pairs == 0 && len(results[0].Errors) == 0 {
+		util.LogConsole("No pairs of versions found; deltas are only compared for older versions of files which are still in the local store")
+	}
+	util.LogConsolef("Using %v (git-lob.delta-algorithm), if the remote supports it\n", util.GlobalOptions.DeltaAlgorithm)
+	return ret
+}
+
+func DeltaStatsHelp() {
+	util.LogConsole(`Usage: git-lob delta-stats [options]
+
+  Reports the delta savings observed on push & fetch for each file extension,
+  and the size above which deltas are tried for them as a result. Only
+  recorded when git-lob.delta-size-adaptive is enabled; see 'git lob help
+  config'.
+
+  Thresholds are learned per extension from the size classes (powers of 2)
+  where deltas saved at least 25% on average; recent pushes & fetches count
+  for more than older ones. Until enough has been seen of an extension the
+  fixed git-lob.push-delta-size / git-lob.fetch-delta-size are used.
+
+  With --benchmark, instead compares the delta algorithms available here
+  (see git-lob.delta-algorithm in 'git lob help config') on older versions
+  of files in the local store against their newest versions, reporting the
+  total size of the deltas & how long they took to generate & apply.
+
+Options:
+  --reset       Delete all recorded stats, to learn thresholds from scratch
+  --benchmark   Compare delta algorithms on this repo's binaries
+  --pairs=<n>   With --benchmark, the most pairs of versions to compare
+                (default 10)
+  --dry-run     With --reset, don't delete, just report
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Doctor command line tool
+func Doctor(repo *core.Repo) int {
+
+	// git-lob doctor [--remote=<remote>] [--no-remote]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"}, []string{"no-remote"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) > 0 {
+		util.LogConsoleError("Too many arguments; use --remote=<remote> to choose a remote")
+		return 9
+	}
+
+	var remoteName string
+	if optRemote, ok := util.GlobalOptions.StringOpts["remote"]; ok {
+		if !repo.IsGitRemote(optRemote) {
+			util.LogConsoleError(optRemote, "is not a valid remote name")
+			return 9
+		}
+		remoteName = optRemote
+	} else if !util.GlobalOptions.BoolOpts.Contains("no-remote") {
+		if defaultRemote := repo.GetGitDefaultRemoteForPush(); repo.IsGitRemote(defaultRemote) {
+			remoteName = defaultRemote
+		}
+	}
+
+	var passed, warnings, failed int
+	callback := func(check *core.DoctorCheck) {
+		var outcome string
+		switch check.Status {
+		case core.DoctorCheckPassed:
+			outcome = "PASS"
+			passed++
+		case core.DoctorCheckWarning:
+			outcome = "WARN"
+			warnings++
+		case core.DoctorCheckFailed:
+			outcome = "FAIL"
+			failed++
+		default:
+			outcome = "skip"
+		}
+		msg := "[" + outcome + "] " + check.Name
+		detail := strings.Split(check.Detail, "\n")
+		if detail[0] != "" {
+			msg += " (" + detail[0] + ")"
+		}
+		util.LogConsole(msg)
+		// Detail can be several lines, e.g. files
+		for _, line := range detail[1:] {
+			util.LogConsole("       " + line)
+		}
+		if check.Hint != "" {
+			util.LogConsole("       Fix: " + strings.Replace(check.Hint, "\n", "\n            ", -1))
+		}
+	}
+	repo.RunDoctorChecks(remoteName, callback)
+
+	util.LogConsolef("%d passed, %d warnings, %d failed\n", passed, warnings, failed)
+	if failed > 0 {
+		return 12
+	}
+	return 0
+}
+
+func DoctorHelp() {
+	util.LogConsole(`Usage: git-lob doctor [options]
+
+  Checks the whole git-lob setup of this repo & reports what's wrong with a
+  hint on how to fix it. Each check passes, warns or fails:
+
+    Filter configured       The lob filter is in git config, without which
+                            tracked files are silently stored in git
+    .gitattributes patterns Tracked patterns can match files & keep git from
+                            converting line endings
+    Committed files         No files matching tracked patterns were committed
+                            at HEAD without the filter
+    Working copy            No files are still placeholders because their
+                            binaries weren't available when checked out
+    Local binary store      The binary store in .git/git-lob can be written
+    Shared binary store     The shared store can be written & hard linked
+                            into this repo (git-lob.sharedstore)
+    Remote                  Binaries can be uploaded & downloaded, as with
+                            'git-lob check-config'
+    Full history            The repo isn't a shallow clone
+
+  Exits with an error if any check fails; warnings don't count.
+
+Options:
+  --remote=<remote>  Check this remote instead of the default push remote
+  --no-remote        Don't check a remote, e.g. when working offline
+  --quiet, -q        Print less output
+  --verbose, -v      Print more output
+
+`)
+}
@@ -1,7 +1,8 @@
 package cmd
 
 import (
-	"regexp"
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -10,30 +11,59 @@ import (
 	"github.com/atlassian/git-lob/util"
 )
 
+// Get the workspace selected by the --workspace option, or nil if not specified
+func getWorkspaceOption(repo *core.Repo) (*core.Workspace, error) {
+	name, ok := util.GlobalOptions.StringOpts["workspace"]
+	if !ok {
+		return nil, nil
+	}
+	return repo.GetWorkspace(name)
+}
+
 // Fetch command line tool
-func Fetch() int {
+func Fetch(repo *core.Repo) int {
 
-	// git-lob fetch [--prune] [--force] [<remote> [<ref>...]]
+	// git-lob fetch [--prune|--no-prune] [--force] [--metadata-only] [--workspace=<name>] [--limit-rate=<rate>]
+	//     [--since=<date>] [--until=<date>] [--max-commits=<n>] [<remote> [<ref>...]]
 
 	// Validate custom options
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"prune", "force"})
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"workspace", "limit-rate", "since", "until", "max-commits"},
+		[]string{"prune", "no-prune", "force", "metadata-only"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
 	}
+	if err := applyLimitRateOption(&util.GlobalOptions.MaxDownloadRate); err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
+	if err := applyFetchWindowOptions(util.GlobalOptions); err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 9
+	}
+	workspace, err := getWorkspaceOption(repo)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 9
+	}
+	if workspace != nil {
+		// Workspace replaces fetch-include & fetch-exclude settings
+		workspace.ApplyToOptions(util.GlobalOptions)
+	}
 
-	optPrune := util.GlobalOptions.BoolOpts.Contains("prune")
+	optPrune := postFetchPruneOption()
 	optForce := util.GlobalOptions.BoolOpts.Contains("force")
 	optDryRun := util.GlobalOptions.DryRun
+	util.GlobalOptions.FetchMetadataOnly = util.GlobalOptions.BoolOpts.Contains("metadata-only")
 
-	// Determine remote
-	var remoteName string
+	// Determine remote(s)
+	var remoteNames []string
 	// Ordered list of the commmits we're going to ls-tree to find binaries
 	var refspecs []*core.GitRefSpec
 
 	if len(util.GlobalOptions.Args) > 0 {
 		// first parameter must be remote if there are arguments
-		remoteName = util.GlobalOptions.Args[0]
+		remoteNames = []string{util.GlobalOptions.Args[0]}
 
 		// Remaining args are refspecs
 		if len(util.GlobalOptions.Args) > 1 {
@@ -44,6 +74,9 @@ func Fetch() int {
 				if r.RangeOp == "..." {
 					util.LogConsoleError("git-lob: '...' range operator is not supported for fetch, only '..'")
 					return 7
+				} else if r.IsRange() && describeFetchWindow(util.GlobalOptions) != "" {
+					util.LogConsoleError("git-lob: ranges can't be combined with --since, --until or --max-commits")
+					return 7
 				} else if r.IsRange() && r.IsEmptyRange() {
 					util.LogConsoleErrorf("Warning: %v is an empty range, did you mean to use %v^..%v ?\n", r, r.Ref1, r.Ref2)
 				}
@@ -52,25 +85,41 @@ func Fetch() int {
 			}
 		}
 
+	} else if len(util.GlobalOptions.FetchRemotes) > 0 {
+		remoteNames = util.GlobalOptions.FetchRemotes
 	} else {
-		remoteName = core.GetGitDefaultRemoteForPull()
+		remoteNames = []string{repo.GetGitDefaultRemoteForPull()}
 	}
 
 	// check the remote config to make sure it's valid
-	provider, err := providers.GetProviderForRemote(remoteName)
-	if err != nil {
-		util.LogConsoleErrorf("git-lob: %v\n", err)
-		return 6
-	}
-	if err = provider.ValidateConfig(remoteName); err != nil {
-		util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
-		return 6
+	var remotes []*core.FetchRemote
+	for _, remoteName := range remoteNames {
+		provider, err := repo.GetProvider(remoteName)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: %v\n", err)
+			return 6
+		}
+		if err = provider.ValidateConfig(remoteName); err != nil {
+			util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+			return 6
+		}
+		remotes = append(remotes, &core.FetchRemote{Name: remoteName, Provider: provider})
 	}
+	remoteDesc := strings.Join(remoteNames, ", ")
 
+	windowDesc := describeFetchWindow(util.GlobalOptions)
 	if len(refspecs) > 0 {
-		util.LogConsole("Fetching binaries for", refspecs, "from", remoteName)
+		util.LogConsole("Fetching binaries for", refspecs, "from", remoteDesc)
+	} else if windowDesc == "" {
+		util.LogConsole("Fetching recent binaries from", remoteDesc)
 	} else {
-		util.LogConsole("Fetching recent binaries from", remoteName)
+		util.LogConsole("Fetching binaries from", remoteDesc)
+	}
+	if windowDesc != "" {
+		util.LogConsole("Limited to", windowDesc)
+	}
+	if workspace != nil {
+		util.LogConsole("Limited to workspace", workspace)
 	}
 
 	// Do the actual fetching in a Goroutine, because we want to update the download rate & time estimates
@@ -78,21 +127,40 @@ func Fetch() int {
 	// If we only updated when callbacks happened (ie when data was transferred), if the data transfer halts
 	// then we'd never update the rates / time estimates.
 
+	if optPrune && !optDryRun && cacheHistoryForPostFetchPrune(repo) {
+		// Prune looks at the same commits, only walk their history once
+		defer repo.ClearRecentHistoryCache()
+	}
+
+	var hookSummary *core.TransferHookSummary
+	if !optDryRun {
+		hookSummary = core.NewTransferHookSummary(remoteNames, refSpecStrings(refspecs))
+		if !runPreTransferHook(repo, core.TransferHookPreFetch, hookSummary) {
+			return 12
+		}
+	}
+
 	var fetcherr error
+	// Ctrl+C stops after the file in progress, keeping what was fetched
+	releaseInterrupt := util.CancelOnInterrupt()
+	defer releaseInterrupt()
 
 	// 100 items in the queue should be good enough, this means that it won't block
 	callbackChan := make(chan *util.ProgressCallbackData, 100)
-	go func(provider providers.SyncProvider, remoteName string, refspecs []*core.GitRefSpec, dryRun, force bool,
+	go func(remotes []*core.FetchRemote, refspecs []*core.GitRefSpec, dryRun, force bool,
 		progresschan chan<- *util.ProgressCallbackData) {
 
 		// Progress callback just passes the result back to the channel
-		progress := func(data *util.ProgressCallbackData) (abort bool) {
+		var progress util.ProgressCallback = func(data *util.ProgressCallbackData) (abort bool) {
 			progresschan <- data
 
 			return false
 		}
+		if hookSummary != nil {
+			progress = core.TrackTransferHookSummary(hookSummary, progress)
+		}
 
-		err := core.Fetch(provider, remoteName, refspecs, dryRun, force, progress)
+		err := repo.FetchFromRemotes(remotes, refspecs, dryRun, force, progress)
 
 		close(progresschan)
 
@@ -100,11 +168,18 @@ func Fetch() int {
 			fetcherr = err
 		}
 
-	}(provider, remoteName, refspecs, optDryRun, optForce, callbackChan)
+	}(remotes, refspecs, optDryRun, optForce, callbackChan)
 
 	// Report progress on operation every 0.5s
 	fetchCounts := util.ReportProgressToConsole(callbackChan, "Fetch", time.Millisecond*500)
+	if hookSummary != nil {
+		runPostTransferHook(repo, core.TransferHookPostFetch, hookSummary, fetcherr)
+	}
 
+	if fetcherr != nil && util.IsCancelled() {
+		util.LogConsoleError("Fetch from", remoteDesc, "was interrupted; binaries downloaded completely are kept, fetch again for the rest")
+		return 130
+	}
 	if fetcherr != nil {
 		util.LogError("git-lob: fetch error(s):\n%v", fetcherr.Error())
 		return 12
@@ -112,7 +187,7 @@ func Fetch() int {
 
 	if optPrune && !optDryRun {
 		util.LogConsole("Performing post-fetch prune...")
-		PostFetchPullPrune()
+		PostFetchPullPrune(repo)
 	}
 
 	if util.GlobalOptions.DryRun {
@@ -123,27 +198,79 @@ func Fetch() int {
 		if fetchCounts.ErrorCount > 0 {
 			util.LogConsole("WARNING: non-fatal errors were encountered, not all data was retrieved.")
 		} else if fetchCounts.NotFoundCount > 0 {
-			util.LogConsole("WARNING: some requested data was not available on remote", remoteName)
+			util.LogConsole("WARNING: some requested data was not available on remote", remoteDesc)
+		} else if util.GlobalOptions.FetchMetadataOnly {
+			util.LogConsole("Successfully fetched metadata from", remoteDesc)
 		} else {
-			util.LogConsole("Successfully fetched binaries from", remoteName)
+			util.LogConsole("Successfully fetched binaries from", remoteDesc)
 		}
-
+		PostTransferSharedStoreGC(repo)
 	}
 
 	return 0
 }
 
+// Set the window of commits to fetch from --since, --until & --max-commits
+func applyFetchWindowOptions(opts *util.Options) error {
+	now := time.Now()
+	if since, ok := opts.StringOpts["since"]; ok {
+		t, err := util.ParseDateOrAge(since, now)
+		if err != nil {
+			return fmt.Errorf("Invalid --since: %v", err.Error())
+		}
+		opts.FetchSince = t
+	}
+	if until, ok := opts.StringOpts["until"]; ok {
+		t, err := util.ParseDateOrAge(until, now)
+		if err != nil {
+			return fmt.Errorf("Invalid --until: %v", err.Error())
+		}
+		opts.FetchUntil = t
+	}
+	if !opts.FetchSince.IsZero() && !opts.FetchUntil.IsZero() && opts.FetchUntil.Before(opts.FetchSince) {
+		return fmt.Errorf("--until must not be earlier than --since")
+	}
+	if maxCommits, ok := opts.StringOpts["max-commits"]; ok {
+		n, err := strconv.Atoi(maxCommits)
+		if err != nil || n < 1 {
+			return fmt.Errorf("Invalid --max-commits: %v, must be a positive number", maxCommits)
+		}
+		opts.FetchMaxCommits = n
+	}
+	return nil
+}
+
+// Describe the window of commits to fetch, blank if not limited
+func describeFetchWindow(opts *util.Options) string {
+	const dateFormat = "2006-01-02 15:04"
+	var desc []string
+	if !opts.FetchSince.IsZero() {
+		desc = append(desc, "commits since "+opts.FetchSince.Format(dateFormat))
+	}
+	if !opts.FetchUntil.IsZero() {
+		desc = append(desc, "commits until "+opts.FetchUntil.Format(dateFormat))
+	}
+	if opts.FetchMaxCommits > 0 {
+		desc = append(desc, fmt.Sprintf("the latest %d commits on each ref", opts.FetchMaxCommits))
+	}
+	return strings.Join(desc, ", ")
+}
+
 // Low-level LOB fetch command
-func FetchLob() int {
+func FetchLob(repo *core.Repo) int {
 
-	// git-lob fetch-lob [--force] <remote> <sha>...
+	// git-lob fetch-lob [--force] [--limit-rate=<rate>] <remote> <sha>...
 
 	// Validate custom options
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"force", "f"})
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"limit-rate"}, []string{"force", "f"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
 	}
+	if err := applyLimitRateOption(&util.GlobalOptions.MaxDownloadRate); err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
 
 	if len(util.GlobalOptions.Args) < 2 {
 		util.LogConsoleError("Too few arguments; must supply remote and at least one SHA")
@@ -159,7 +286,7 @@ func FetchLob() int {
 	remoteName = util.GlobalOptions.Args[0]
 
 	// check the remote config to make sure it's valid
-	provider, err := providers.GetProviderForRemote(remoteName)
+	provider, err := repo.GetProvider(remoteName)
 	if err != nil {
 		util.LogConsoleError(err.Error())
 		return 6
@@ -172,9 +299,8 @@ func FetchLob() int {
 	// Remaining args are SHAs
 	shas := util.GlobalOptions.Args[1:]
 	// Validate that they are SHAs
-	shaRegex := regexp.MustCompile("^[A-Fa-f0-9]{40}$")
 	for _, sha := range shas {
-		if !shaRegex.MatchString(sha) {
+		if !core.IsLOBSHA(sha) {
 			util.LogConsoleErrorf("Invalid SHA: %v\n", sha)
 			return 9
 		}
@@ -203,7 +329,7 @@ func FetchLob() int {
 
 		var err error
 		for _, sha := range shas {
-			err = core.FetchSingle(sha, provider, remoteName, force, progress)
+			err = repo.FetchSingle(sha, provider, remoteName, force, progress)
 			if err != nil {
 				break
 			}
@@ -249,14 +375,29 @@ func FetchHelp() {
   configured) ready to be checked out into your working copy either with
   'git checkout', or 'git-lob pull'.
 
+  Each binary is checked against its SHA before it goes into the store. If
+  what was downloaded doesn't match, it's moved to git-lob/quarantine in the
+  git dir (.quarantine in a shared store) & downloaded again.
+
+  Fetch, push and mark-pushed also work in bare repositories, for example a
+  mirror kept up to date with 'git fetch --mirror', which store binaries in
+  git-lob/ inside the repository. Commands which need a working copy (such
+  as checkout and pull) aren't available there.
+
 Parameters:
   <remote>: The remote to download from. This should correspond to the 
             name of a remote (no direct URLs permitted) which is configured
             in .git/config. See REMOTES below for more details, additional
             config parameters are required in the remote.
 
-            If no remote is specified, the remote that your current branch 
+            If no remote is specified, the remotes in git-lob.fetch-remotes
+            are used in order of priority, each only for the binaries the
+            ones before it don't have (e.g. a LAN cache, then the main
+            remote). If that isn't set, the remote that your current branch
             is tracking will be used, or origin if tracking is not configured.
+            As for git, branch.<name>.pushRemote & remote.pushDefault don't
+            affect fetching, so binaries can be fetched from upstream &
+            pushed to a fork.
      <ref>: Which reference(s) we should make sure binaries downloaded for. 
             You can specify zero, one, or many refs, but these refs must be
             present locally (ie already fetched with plain git). git-lob
@@ -279,7 +420,33 @@ Options:
                 already present locally. 
   --prune       As well as downloading files referenced by 'recent' commits, 
                 delete any local files you already have which now fall outside
-                this definition of 'recent'. See RECENT COMMITS below.
+                this definition of 'recent'. See RECENT COMMITS below. The
+                history of recent commits is only examined once for both,
+                which saves time in large repositories. Set
+                git-lob.fetch-prune to always do this.
+  --no-prune    Don't prune, even if git-lob.fetch-prune is set
+  --metadata-only
+                Only download the metadata for binaries, not their content.
+                Commands like 'git lob missing' work as usual, and content is
+                downloaded from this remote when each binary is first checked
+                out, so jobs which only need a few binaries (e.g. CI) don't
+                download the rest. Until the next fetch without this option,
+                content of any binary whose metadata is present is fetched on
+                checkout, as if git-lob.autofetch were enabled.
+  --workspace=<name>
+                Only download binaries in the named workspace. See WORKSPACES
+                below.
+  --limit-rate=<rate>
+                Limit the total download rate, e.g. 500K or 2MB (per second),
+                so as not to saturate a shared connection. Overrides 
+                git-lob.max-download-rate.
+  --since=<date>
+  --until=<date>
+                Only download binaries needed by commits made in this window,
+                instead of recent commits. See COMMIT WINDOWS below.
+  --max-commits=<n>
+                Only download binaries needed by the latest <n> commits on
+                each ref, instead of recent commits.
   --quiet, -q   Print less output
   --verbose, -v Print more output
   --dry-run     Don't actually download anything, just report
@@ -299,6 +466,50 @@ Recent commits means:
   * Any ancestors of those branches/tags within git-lob.fetch-commits-other
     days of its last commit date
 
+COMMIT WINDOWS
+
+--since, --until and --max-commits replace the definition of recent commits
+for one fetch, for example a CI job which only needs the binaries used in the
+last 48 hours:
+
+  git lob fetch --since=48h
+
+Binaries are downloaded for every commit in the window on HEAD and on each
+branch (local and remote) or tag with commits in it; or if refs are given, on
+those refs only (ranges aren't allowed). Dates can be YYYY-MM-DD, optionally
+followed by hh:mm[:ss] in local time, or an age like 48h, 2d or 1w. Only the
+first parent of merges is followed, so the commits are those you'd see on
+each branch itself.
+
+WORKSPACES
+
+Large repositories can define named subsets of their binaries in a .gitlob
+file committed in the root of the repository, so that each team only needs
+to download what they work on. For example:
+
+  [workspace "art"]
+      include = art/characters, art/shared/*.psd
+      exclude = art/characters/archive
+      max-size = 500MB
+      priority = art/shared, art/characters/hero
+
+  include   Paths to fetch, comma separated. Same wildcard rules as
+            git-lob.fetch-include. Default is all paths.
+  exclude   Paths not to fetch, same rules as git-lob.fetch-exclude
+  max-size  Binaries larger than this are not downloaded. Default no limit.
+  priority  Paths to download first, highest priority first, so that the most
+            important binaries are available soonest.
+
+Selecting a workspace replaces the git-lob.fetch-include/exclude settings.
+'git lob checkout' and 'git lob pull' also accept --workspace, to only
+populate files in that workspace.
+
+INTERRUPTING
+
+Pressing Ctrl-C (or sending SIGTERM) stops the fetch cleanly: binaries which
+were downloaded completely are kept & partly downloaded files are removed, so
+fetching again only downloads the rest. Press Ctrl-C again to stop immediately.
+
 REMOTES
   Type 'git lob help remotes' for details
 
@@ -332,6 +543,10 @@ Parameters:
 Options:
   --force, -f   Always download files even if the provider believes the file is 
                 already present locally. 
+  --limit-rate=<rate>
+                Limit the total download rate, e.g. 500K or 2MB (per second),
+                so as not to saturate a shared connection. Overrides 
+                git-lob.max-download-rate.
   --quiet, -q   Print less output
   --verbose, -v Print more output
 
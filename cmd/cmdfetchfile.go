@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Fetch file command line tool
+func FetchFile(repo *core.Repo) int {
+
+	// git-lob fetch-file [--remote=<remote>] [--no-checkout] [--force] [--limit-rate=<rate>] [--link=<mode>]
+	//                    <path>[@<ref>] [<ref>]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote", "limit-rate", "link"}, []string{"no-checkout", "force", "f"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if err := applyLimitRateOption(&util.GlobalOptions.MaxDownloadRate); err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
+	linkMode, err := getLinkModeOption(core.LinkModeCopy)
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
+	if len(util.GlobalOptions.Args) < 1 || len(util.GlobalOptions.Args) > 2 {
+		util.LogConsoleError("Must supply a <path>[@<ref>], or a <path> and a <ref>")
+		return 9
+	}
+	optForce := util.GlobalOptions.BoolOpts.Contains("force") || util.GlobalOptions.BoolOpts.Contains("f")
+	optNoCheckout := util.GlobalOptions.BoolOpts.Contains("no-checkout")
+
+	path := util.GlobalOptions.Args[0]
+	pathAtRef := path
+	if len(util.GlobalOptions.Args) > 1 {
+		pathAtRef = path + "@" + util.GlobalOptions.Args[1]
+	}
+	sha, relpath, ref, err := repo.GetLOBSHAForPathAtRef(pathAtRef)
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
+	// The path on its own, without any @<ref>
+	path, _ = repo.SplitPathAtRef(pathAtRef)
+
+	remoteName, ok := util.GlobalOptions.StringOpts["remote"]
+	if !ok {
+		remoteName = repo.GetGitDefaultRemoteForPull()
+	}
+	provider, err := repo.GetProvider(remoteName)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 6
+	}
+	if err = provider.ValidateConfig(remoteName); err != nil {
+		util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+		return 6
+	}
+	defer provider.Release()
+
+	util.LogConsolef("Fetching %v in %v (%v) from %v\n", relpath, ref, sha[:7], remoteName)
+	var current bool
+	var fetcherr error
+	callbackChan := make(chan *util.ProgressCallbackData, 100)
+	go func() {
+		progress := func(data *util.ProgressCallbackData) (abort bool) {
+			callbackChan <- data
+			return false
+		}
+		current, fetcherr = repo.FetchFile(relpath, sha, provider, remoteName, optForce, progress)
+		close(callbackChan)
+	}()
+	util.ReportProgressToConsole(callbackChan, "Fetch", time.Millisecond*500)
+	if core.IsNotFoundError(fetcherr) {
+		util.LogConsoleErrorf("git-lob: %v\n", fetcherr.Error())
+		return 12
+	} else if fetcherr != nil {
+		util.LogErrorf("git-lob: fetch error(s):\n%v\n", fetcherr.Error())
+		return 12
+	}
+
+	if optNoCheckout {
+		util.LogConsolef("Fetched %v, use 'git lob checkout %v' to put it in the working copy\n", relpath, path)
+		return 0
+	}
+	// Only the version the working copy refers to is put in place
+	if !current {
+		util.LogConsolef("Fetched %v; not checked out since the working copy has a different version, use 'git lob cat %v' to read it\n",
+			relpath, pathAtRef)
+		return 0
+	}
+	var checkedOut, failed bool
+	callback := func(t util.ProgressCallbackType, filelob *core.FileLOB, err error) {
+		switch t {
+		case util.ProgressTransferBytes:
+			checkedOut = true
+		case util.ProgressNotFound, util.ProgressError:
+			util.LogConsoleError(err.Error())
+			failed = true
+		}
+	}
+	err = repo.CheckoutWithLinkMode([]string{path}, false, linkMode, callback)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: checkout error - %v\n", err.Error())
+		return 7
+	}
+	if failed {
+		return 10
+	}
+	if checkedOut {
+		util.LogConsolef("Fetched & checked out %v\n", relpath)
+	} else {
+		util.LogConsolef("Fetched %v; the working copy file was left alone since it has been modified\n", relpath)
+	}
+	return 0
+}
+
+func FetchFileHelp() {
+	util.LogConsole(`Usage: git-lob fetch-file [options] <path>[@<ref>] [<ref>]
+
+  Downloads the binary for a single file, without fetching anything else, and
+  puts it in the working copy in place of its placeholder. Useful when you
+  only need one missing asset rather than a whole fetch of recent history.
+
+  The ref can be given after the path, or after an '@' (e.g. art/hero.png@v2);
+  it defaults to HEAD. The file doesn't have to exist in the working copy.
+  The binary is only checked out if it's the version the working copy refers
+  to (at HEAD) and the file is still a placeholder or is missing; otherwise
+  use 'git lob cat' to read it.
+
+Parameters:
+  <path>: The file, relative to the current directory
+   <ref>: The branch, tag or commit to fetch the file's binary for
+
+Options:
+  --remote=<remote>
+                The remote to fetch from. Default is the default remote for
+                pull (branch.*.remote for the current branch, or origin).
+  --no-checkout Just fetch the binary into the local store
+  --force, -f   Download the binary even if it's already stored locally
+  --limit-rate=<rate>
+                Limit the download rate, e.g. 500K or 2MB (per second).
+                Overrides git-lob.max-download-rate.
+  --link=reflink|hardlink
+                Share storage with the binary store, as for checkout
+  --quiet, -q   Print less output
+  --verbose, -v Print more output`)
+}
@@ -7,7 +7,7 @@ import (
 	"github.com/atlassian/git-lob/util"
 )
 
-func SmudgeFilter() int {
+func SmudgeFilter(repo *core.Repo) int {
 	// Make sure we never write log output to stdout, filter uses it for content
 	util.LogAllConsoleOutputToStdErr()
 	// Optional filename context that can be passed
@@ -17,9 +17,9 @@ func SmudgeFilter() int {
 	} else {
 		filename = "[Unknown filename]"
 	}
-	return core.SmudgeFilterWithReaderWriter(os.Stdin, os.Stdout, filename)
+	return repo.SmudgeFilterWithReaderWriter(os.Stdin, os.Stdout, filename)
 }
-func CleanFilter() int {
+func CleanFilter(repo *core.Repo) int {
 	// Make sure we never write log output to stdout, filter uses it for content
 	util.LogAllConsoleOutputToStdErr()
 	// Optional filename context that can be passed
@@ -29,7 +29,18 @@ func CleanFilter() int {
 	} else {
 		filename = "[Unknown filename]"
 	}
-	return core.CleanFilterWithReaderWriter(os.Stdin, os.Stdout, filename)
+	return repo.CleanFilterWithReaderWriter(os.Stdin, os.Stdout, filename)
+}
+
+func FilterProcess(repo *core.Repo) int {
+	// Make sure we never write log output to stdout, filter uses it for content
+	util.LogAllConsoleOutputToStdErr()
+	err := repo.FilterProcess(os.Stdin, os.Stdout)
+	if err != nil {
+		util.LogErrorf("git-lob: filter process error: %v\n", err)
+		return 3
+	}
+	return 0
 }
 
 func SmudgeFilterHelp() {
@@ -59,9 +70,38 @@ func CleanFilterHelp() {
   Not intended to be called directly, see README.md for how to configure
   the filter for your repository.
 
+  Files larger than git-lob.warn-above-size get a warning, and files larger
+  than git-lob.reject-above-size aren't stored at all (the filter fails).
+  Files smaller than git-lob.hint-below-size get a hint that they might be
+  better stored in git itself. See 'git lob help config'.
+
+  Files listed in .gitlobignore at the root of the repo are committed to git
+  as they are, even though .gitattributes sends them through the filter.
+  It uses the same pattern syntax as .gitignore, e.g. to keep small
+  reference images in git when *.png is tracked:
+
+    test/fixtures/**/*.png
+
 Options:
   --quiet, -q          Print less output
   --verbose, -v        Print more output
   --dry-run            Don't actually delete anything, just report
 `)
 }
+func FilterProcessHelp() {
+	util.LogConsole(`Usage: git-lob filter-process [options]
+
+  Runs both the clean & smudge filters (see filter-clean & filter-smudge) for
+  every file git needs to filter, using git's long-running filter process
+  protocol. This is much faster than starting git-lob for each file when
+  checking out or adding many files, especially on Windows.
+
+  Not intended to be called directly, see README.md for how to configure
+  the filter for your repository. Requires git 2.11 or later; older versions
+  ignore it and use the clean & smudge filters instead.
+
+Options:
+  --quiet, -q          Print less output
+  --verbose, -v        Print more output
+`)
+}
@@ -5,16 +5,18 @@ import (
 	"strings"
 
 	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/util"
 )
 
 // Fsck command line tool
-func Fsck() int {
+func Fsck(repo *core.Repo) int {
 
-	// git-lob fsck [--deep] [--shared]
+	// git-lob fsck [--deep] [--shared] [--delete | --repair [--remote=<remote>]]
 
 	// Validate custom options
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"deep", "d", "shared", "s", "delete", "x"})
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"},
+		[]string{"deep", "d", "shared", "s", "delete", "x", "repair"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
@@ -23,6 +25,14 @@ func Fsck() int {
 	optDeep := util.GlobalOptions.BoolOpts.Contains("deep") || util.GlobalOptions.BoolOpts.Contains("d")
 	optShared := util.GlobalOptions.BoolOpts.Contains("shared") || util.GlobalOptions.BoolOpts.Contains("s")
 	optDelete := util.GlobalOptions.BoolOpts.Contains("delete") || util.GlobalOptions.BoolOpts.Contains("x")
+	optRepair := util.GlobalOptions.BoolOpts.Contains("repair")
+	optRemote, remoteSpecified := util.GlobalOptions.StringOpts["remote"]
+	if remoteSpecified && !optRepair {
+		util.LogConsoleError("git-lob: --remote can only be used with --repair")
+		return 9
+	}
+	// Repairing always deletes bad files
+	optDelete = optDelete || optRepair
 
 	if optShared {
 		// Check we have a shared store
@@ -40,6 +50,31 @@ func Fsck() int {
 		shas = util.GlobalOptions.Args
 	}
 
+	var provider providers.SyncProvider
+	if optRepair {
+		remoteName := optRemote
+		if remoteName == "" {
+			remoteName = repo.GetGitDefaultRemoteForPull()
+		}
+		var err error
+		provider, err = repo.GetProvider(remoteName)
+		if err == nil {
+			err = provider.ValidateConfig(remoteName)
+		}
+		if err != nil {
+			if remoteSpecified {
+				util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+				return 6
+			}
+			// Can still repair from the shared store
+			util.LogConsoleErrorf("Warning: can't fetch from %v to repair binaries: %v\n", remoteName, err)
+			provider = nil
+		} else {
+			defer provider.Release()
+		}
+		optRemote = remoteName
+	}
+
 	callback := func(data *core.FsckCallbackData) (quit bool) {
 		// Ensure we clear previous progress
 		util.LogConsolef("\r")
@@ -50,6 +85,10 @@ func Fsck() int {
 			util.LogErrorf(" * %v: content is corrupt (deleted: %v)\n", data.SHA[:7], optDelete)
 		case core.FsckWrongSize:
 			util.LogErrorf(" * %v: file is wrong size (%v deleted: %v)\n", data.SHA[:7], data.Desc, optDelete)
+		case core.FsckRepaired:
+			util.LogConsolef(" * %v: repaired from %v\n", data.SHA[:7], data.Desc)
+		case core.FsckUnrecoverable:
+			util.LogErrorf(" * %v: unable to repair, %v\n", data.SHA[:7], data.Desc)
 		case core.FsckWorking:
 			// Do nothing, just progress below
 		}
@@ -59,7 +98,29 @@ func Fsck() int {
 		return false
 	}
 	// Add newlines to messages since progress doesn't
-	err := core.Fsck(optDeep, optShared, optDelete, shas, callback)
+	if optRepair {
+		repaired, unrecoverable, err := repo.FsckRepair(optDeep, optShared, shas, provider, optRemote, callback)
+		if err != nil {
+			util.LogConsoleErrorf("\n%v\n", err.Error())
+			return 12
+		}
+		if len(repaired) == 0 && len(unrecoverable) == 0 {
+			util.LogConsole("\nCompleted successfully, no problems found")
+			return 0
+		}
+		util.LogConsolef("\nRepaired %d binaries, %d unrecoverable\n", len(repaired), len(unrecoverable))
+		for _, sha := range repaired {
+			util.LogConsoleDebug("  Repaired:", sha)
+		}
+		for _, sha := range unrecoverable {
+			util.LogConsole("  Unrecoverable:", sha)
+		}
+		if len(unrecoverable) > 0 {
+			return 12
+		}
+		return 0
+	}
+	err := repo.Fsck(optDeep, optShared, optDelete, shas, callback)
 	if err != nil {
 		util.LogConsoleError("\nError(s) in fsck, see above.")
 		return 12
@@ -90,6 +151,12 @@ func FsckHelp() {
   incorrectly sized chunks, and content where the SHA doesn't agree (only
   checked with the --deep option) are deleted.
 
+  The --repair option goes further: as well as deleting invalid files, each
+  binary with problems is relinked from the shared store if that has a good
+  copy, otherwise fetched again from a remote, then checked again. Binaries
+  which still aren't right are listed as unrecoverable at the end, and any
+  bad files left are deleted.
+
   This command doesn't check your working copy, use 'git lob missing' to check
   why a binary file is still a placeholder.
 
@@ -109,6 +176,11 @@ Options:
                 internally inconsistent; e.g. invalid meta files, partial 
                 chunks, and all files where --deep is used and SHA doesn't 
                 agree with content.
+  --repair      Delete invalid files as --delete, then recover binaries with
+                problems from the shared store or by fetching them again
+  --remote=<remote>
+                The remote to fetch from for --repair. Default is the remote
+                tracked by the current branch, or 'origin'.
   --quiet, -q   Print less output
   --verbose, -v Print more output
 
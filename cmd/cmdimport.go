@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Import command line tool
+func Import(repo *core.Repo) int {
+
+	// git-lob import [--to=<path>] [--no-track] [--force] [--dry-run] <dir>
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"to"}, []string{"no-track", "force", "f"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) != 1 {
+		util.LogConsoleError("git-lob: import needs exactly one folder to import")
+		return 9
+	}
+	srcDir := util.GlobalOptions.Args[0]
+	destDir := util.GlobalOptions.StringOpts["to"]
+	optTrack := !util.GlobalOptions.BoolOpts.Contains("no-track")
+	optForce := util.GlobalOptions.BoolOpts.Contains("force") || util.GlobalOptions.BoolOpts.Contains("f")
+	optDryRun := util.GlobalOptions.DryRun
+
+	var imported, skipped, failed int
+	var importedSize int64
+	var lastProgressLen int
+	callback := func(data *core.ImportCallbackData) (quit bool) {
+		switch data.Type {
+		case core.ImportStored:
+			imported++
+			importedSize += data.Size
+			if optDryRun {
+				util.LogConsoleDebug("Would import", data.Filename)
+			} else {
+				util.LogDebugf("Imported %v as %v\n", data.Filename, data.SHA)
+			}
+		case core.ImportSkipped:
+			skipped++
+			util.LogConsoleErrorf("\rSkipped %v: %v\n", data.Filename, data.Desc)
+		case core.ImportError:
+			failed++
+			util.LogConsoleErrorf("\rUnable to import %v: %v\n", data.Filename, data.Error.Error())
+		}
+		msg := fmt.Sprintf("Importing: %d/%d (%d%%)", data.Done, data.Total, data.Done*100/data.Total)
+		util.LogConsoleOverwrite(msg, lastProgressLen)
+		lastProgressLen = len(msg)
+		return false
+	}
+
+	result, err := repo.ImportFiles(srcDir, destDir, optTrack, optForce, optDryRun, callback)
+	if lastProgressLen > 0 {
+		util.LogConsole("")
+	}
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: import error - %v\n", err.Error())
+		return 12
+	}
+
+	for _, pattern := range result.TrackedPatterns {
+		if optDryRun {
+			util.LogConsole("Would track", pattern)
+		} else {
+			util.LogConsole("Tracking", pattern)
+		}
+	}
+	if optDryRun {
+		util.LogConsolef("%d files (%v) would be imported\n", imported, util.FormatSize(importedSize))
+		if imported > 0 {
+			util.LogConsole("Run this command again without --dry-run to import them.")
+		}
+	} else if imported > 0 {
+		util.LogConsolef("Imported %d files (%v) & staged them, commit to add them to the repository\n", imported, util.FormatSize(importedSize))
+		util.LogConsole("Files in the working copy are placeholders until you commit & run 'git lob checkout'")
+	} else {
+		util.LogConsole("No files were imported")
+	}
+	if skipped > 0 {
+		util.LogConsolef("%d files were skipped\n", skipped)
+	}
+	if failed > 0 {
+		util.LogConsolef("%d files could not be imported\n", failed)
+		return 12
+	}
+	if !optDryRun {
+		warnIfFilterNotConfigured(repo)
+	}
+	return 0
+}
+
+func ImportHelp() {
+	util.LogConsole(`Usage: git-lob import [options] <dir>
+
+  Import a folder of binaries into git-lob in one go, which is much quicker
+  than adding thousands of files with 'git add'. Every file under <dir> is
+  stored in the binary store, its placeholder is written into the working
+  copy at the same path under the destination folder, and the placeholders
+  are staged ready to commit.
+
+  The destination is <dir> itself if it's in the working copy, or the folder
+  given with --to. Files there are replaced by their placeholders; their
+  content is safe in the binary store, and 'git lob checkout' fills it back
+  in once the import is committed.
+
+  Files which wouldn't be stored by git-lob according to .gitattributes are
+  tracked by adding a pattern for their extension (or their path if they
+  don't have one), see 'git lob track'.
+
+Options:
+  --to=<path>   Folder in the working copy to import into; required if <dir>
+                isn't in the working copy
+  --no-track    Don't change .gitattributes; files it doesn't already store
+                in git-lob are skipped
+  --force, -f   Replace files already in the destination folder. By default
+                they're skipped.
+  --dry-run     Report what would be imported without changing anything
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Get the remote to use for locks & its provider, from --remote or config
+// Returns a non-zero exit code on error
+func getLockRemoteProvider(repo *core.Repo) (string, providers.SyncProvider, int) {
+	remoteName, ok := util.GlobalOptions.StringOpts["remote"]
+	if !ok || remoteName == "" {
+		remoteName = repo.GetLockRemote()
+	}
+	provider, err := repo.GetProvider(remoteName)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return remoteName, nil, 6
+	}
+	if err = provider.ValidateConfig(remoteName); err != nil {
+		util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+		return remoteName, nil, 6
+	}
+	return remoteName, provider, 0
+}
+
+// Lock command line tool
+func Lock(repo *core.Repo) int {
+
+	// git-lob lock [--remote=<remote>] <path>...
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"}, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) == 0 {
+		util.LogConsoleError("Too few arguments; must supply at least one path to lock")
+		return 9
+	}
+	remoteName, provider, ret := getLockRemoteProvider(repo)
+	if ret != 0 {
+		return ret
+	}
+	defer provider.Release()
+
+	ret = 0
+	for _, path := range util.GlobalOptions.Args {
+		lock, err := repo.LockFile(provider, remoteName, path)
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			ret = 12
+			continue
+		}
+		util.LogConsolef("Locked %v on %v\n", lock.Path, remoteName)
+	}
+	return ret
+}
+
+// Unlock command line tool
+func Unlock(repo *core.Repo) int {
+
+	// git-lob unlock [--force] [--remote=<remote>] <path>...
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"}, []string{"force", "f"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) == 0 {
+		util.LogConsoleError("Too few arguments; must supply at least one path to unlock")
+		return 9
+	}
+	optForce := util.GlobalOptions.BoolOpts.Contains("force") || util.GlobalOptions.BoolOpts.Contains("f")
+	remoteName, provider, ret := getLockRemoteProvider(repo)
+	if ret != 0 {
+		return ret
+	}
+	defer provider.Release()
+
+	ret = 0
+	for _, path := range util.GlobalOptions.Args {
+		err := repo.UnlockFile(provider, remoteName, path, optForce)
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			ret = 12
+			continue
+		}
+		util.LogConsolef("Unlocked %v on %v\n", path, remoteName)
+	}
+	return ret
+}
+
+// Locks command line tool
+func Locks(repo *core.Repo) int {
+
+	// git-lob locks [--cached] [--remote=<remote>]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"}, []string{"cached"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) > 0 {
+		util.LogConsoleError("Too many arguments")
+		return 9
+	}
+
+	var locks []*providers.FileLock
+	var remoteName string
+	if util.GlobalOptions.BoolOpts.Contains("cached") {
+		remoteName = util.GlobalOptions.StringOpts["remote"]
+		if remoteName == "" {
+			remoteName = repo.GetLockRemote()
+		}
+		locks = repo.GetCachedLocks(remoteName)
+	} else {
+		var provider providers.SyncProvider
+		var ret int
+		remoteName, provider, ret = getLockRemoteProvider(repo)
+		if ret != 0 {
+			return ret
+		}
+		var err error
+		locks, err = repo.RefreshLocks(provider, remoteName)
+		provider.Release()
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 12
+		}
+	}
+
+	if len(locks) == 0 {
+		util.LogConsole("No files are locked on", remoteName)
+		return 0
+	}
+	width := 0
+	for _, lock := range locks {
+		if len(lock.Path) > width {
+			width = len(lock.Path)
+		}
+	}
+	for _, lock := range locks {
+		owner := lock.Owner
+		if lock.Mine {
+			owner += " (you)"
+		}
+		util.LogConsolef("%-*v  %v  since %v\n", width, lock.Path, owner, lock.LockedAt.Local().Format(time.RFC822))
+	}
+	return 0
+}
+
+func LockHelp() {
+	util.LogConsole(`Usage: git-lob lock [options] <path>...
+
+  Lock files so that nobody else can commit changes to them until you unlock
+  them, for binaries which can't be merged. Lock a file before you start
+  changing it; if someone else already has, you'll be told who.
+
+  Locks are held on a remote, which must use the smart provider. This is the
+  remote in git-lob.lock-remote if set, otherwise the default push remote.
+
+  Other users are warned when they add changes to a file you've locked, or
+  can't add them at all if they set git-lob.lock-check to 'refuse', based on
+  the locks last retrieved by 'git lob lock', 'unlock' or 'locks'.
+
+Options:
+  --remote=<remote>
+                Use the locks on this remote instead
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
+
+func UnlockHelp() {
+	util.LogConsole(`Usage: git-lob unlock [options] <path>...
+
+  Release your locks on files, once you've pushed your changes to them, so
+  that others can change them. See 'git lob lock'.
+
+Options:
+  --force, -f   Release a lock held by someone else, e.g. if they've left
+                the project. Only allowed for users in the server's
+                lock-admins setting.
+  --remote=<remote>
+                Use the locks on this remote instead
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
+
+func LocksHelp() {
+	util.LogConsole(`Usage: git-lob locks [options]
+
+  List the files locked on the remote, who locked them and when, and update
+  the locks used to check changes to files when they're added. See
+  'git lob lock'.
+
+Options:
+  --cached      List the locks last retrieved instead of asking the remote
+  --remote=<remote>
+                Use the locks on this remote instead
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Ls-files command line tool
+func LsFiles(repo *core.Repo) int {
+
+	// git-lob ls-files [--ref=<ref>] [--format=<template>] [<pathspec>...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"ref", "format"}, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	ref := "HEAD"
+	if optRef, ok := util.GlobalOptions.StringOpts["ref"]; ok {
+		if !repo.GitRefOrSHAIsValid(optRef) {
+			util.LogConsoleErrorf("Invalid --ref '%v'\n", optRef)
+			return 9
+		}
+		ref = optRef
+	}
+	var tmpl *template.Template
+	if optFormat, ok := util.GlobalOptions.StringOpts["format"]; ok {
+		var err error
+		tmpl, err = template.New("format").Parse(optFormat)
+		if err != nil {
+			util.LogConsoleErrorf("Invalid --format: %v\n", err.Error())
+			return 9
+		}
+	}
+	var pathspecs []string
+	for _, arg := range util.GlobalOptions.Args {
+		pathspecs = append(pathspecs, filepath.Clean(arg))
+	}
+
+	files, err := repo.ListLOBFiles(ref, pathspecs)
+	if err != nil {
+		util.LogConsoleErrorf("Unable to list files: %v\n", err.Error())
+		return 12
+	}
+
+	if tmpl != nil {
+		// Straight to stdout regardless of --quiet, this is for scripts
+		out := bufio.NewWriter(os.Stdout)
+		defer out.Flush()
+		for _, file := range files {
+			if err := tmpl.Execute(out, file); err != nil {
+				util.LogConsoleErrorf("Unable to format %v: %v\n", file.Path, err.Error())
+				return 12
+			}
+			out.WriteString("\n")
+		}
+		return 0
+	}
+
+	for _, file := range files {
+		size, chunks := "-", "-"
+		if file.Size >= 0 {
+			size = util.FormatSize(file.Size)
+			chunks = strconv.Itoa(file.Chunks)
+		}
+		status := "missing"
+		if file.Present {
+			status = "present"
+		}
+		util.LogConsolef("%v %10v %6v %-7v %v\n", file.SHA, size, chunks, status, file.Path)
+	}
+	return 0
+}
+
+func LsFilesHelp() {
+	util.LogConsole(`Usage: git-lob ls-files [options] [<pathspec>...]
+
+  Lists the files in the working copy which are stored by git-lob, with the
+  SHA of each binary, its size, the number of chunks it's stored in and
+  whether it's present in the local binary store (or missing, e.g. because
+  it hasn't been fetched). Size & chunks are '-' if the binary's metadata
+  isn't stored locally.
+
+  Lists the files committed at HEAD, which is what checkout populates the
+  working copy with, limited to pathspecs if given.
+
+Options:
+  --ref=<ref>        List the files stored by git-lob at another branch, tag
+                     or commit instead of HEAD
+  --format=<format>  Print each file with a Go template instead, e.g.
+                     '{{.SHA}} {{.Path}}'. Fields are .Path (relative to the
+                     root of the repo), .SHA, .Size (bytes, -1 if unknown),
+                     .Chunks (0 if unknown) and .Present (true or false)
+  --quiet, -q        Print less output
+  --verbose, -v      Print more output
+
+`)
+}
@@ -6,11 +6,17 @@ import (
 	"runtime/debug"
 	"strings"
 
+	"github.com/atlassian/git-lob/core"
 	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/providers/smart"
 	"github.com/atlassian/git-lob/util"
 )
 
+// Commands which can't be used in a bare repository
+var workingCopyCommands = util.NewStringSetFromSlice([]string{
+	"track", "untrack", "import", "checkout", "pull", "dedupe-working-copy", "missing",
+	"rewrite-placeholders"})
+
 // Actual implementation of main()
 func MainImpl() int {
 
@@ -38,6 +44,8 @@ func MainImpl() int {
 	providers.InitCoreProviders()
 	smart.InitCoreProviders()
 	defer util.ShutDownLogging()
+	// Close connections kept open for reuse
+	defer smart.ReleasePooledTransports()
 
 	if len(errors) > 0 {
 		util.LogConsoleError(strings.Join(errors, "\n"))
@@ -47,62 +55,266 @@ func MainImpl() int {
 
 	// Check we're in a git repo and if not fail early
 	// Unless help requested, in which case allow from anywhere
-	_, _, err := util.GetRepoRoot()
+	// Everything else works on the repository in the current directory
+	var repo *core.Repo
+	wd, err := os.Getwd()
+	if err == nil {
+		repo, err = core.NewRepo(wd, util.GlobalOptions, util.DefaultLogger)
+	}
 	if err != nil && !util.GlobalOptions.HelpRequested &&
-		util.GlobalOptions.Command != "help" {
+		util.GlobalOptions.Command != "help" && util.GlobalOptions.Command != "proxy-connect" {
 		util.LogConsole(err.Error())
 		return 33
 	}
+	// Bare repos (e.g. mirrors) can fetch & push binaries, but have no working copy
+	if err == nil && repo.Bare && !util.GlobalOptions.HelpRequested &&
+		workingCopyCommands.Contains(util.GlobalOptions.Command) {
+		util.LogConsolef("'%v' needs a working copy, but this is a bare repository\n", util.GlobalOptions.Command)
+		return 33
+	}
+	// Clean up after interrupted processes now & again; not in filters, git is waiting on them
+	if err == nil && !util.GlobalOptions.HelpRequested && !util.GlobalOptions.DryRun &&
+		!strings.HasPrefix(util.GlobalOptions.Command, "filter-") &&
+		util.GlobalOptions.Command != "help" && util.GlobalOptions.Command != "unlock-store" &&
+		util.GlobalOptions.Command != "proxy-connect" {
+		repo.RunHousekeepingIfDue()
+	}
 
 	switch util.GlobalOptions.Command {
+	case "at-risk":
+		if util.GlobalOptions.HelpRequested {
+			AtRiskHelp()
+			return 0
+		}
+		return AtRisk(repo)
+	case "unlock-store":
+		if util.GlobalOptions.HelpRequested {
+			UnlockStoreHelp()
+			return 0
+		}
+		return UnlockStore(repo)
+	case "stats":
+		if util.GlobalOptions.HelpRequested {
+			StatsHelp()
+			return 0
+		}
+		return Stats(repo)
+	case "usage":
+		if util.GlobalOptions.HelpRequested {
+			UsageHelp()
+			return 0
+		}
+		return Usage(repo)
+	case "ls-files":
+		if util.GlobalOptions.HelpRequested {
+			LsFilesHelp()
+			return 0
+		}
+		return LsFiles(repo)
+	case "verify-signatures":
+		if util.GlobalOptions.HelpRequested {
+			VerifySignaturesHelp()
+			return 0
+		}
+		return VerifySignatures(repo)
+	case "which":
+		if util.GlobalOptions.HelpRequested {
+			WhichHelp()
+			return 0
+		}
+		return Which(repo)
+	case "why":
+		if util.GlobalOptions.HelpRequested {
+			WhyHelp()
+			return 0
+		}
+		return Why(repo)
+	case "cat":
+		if util.GlobalOptions.HelpRequested {
+			CatHelp()
+			return 0
+		}
+		return Cat(repo)
+	case "lock":
+		if util.GlobalOptions.HelpRequested {
+			LockHelp()
+			return 0
+		}
+		return Lock(repo)
+	case "unlock":
+		if util.GlobalOptions.HelpRequested {
+			UnlockHelp()
+			return 0
+		}
+		return Unlock(repo)
+	case "locks":
+		if util.GlobalOptions.HelpRequested {
+			LocksHelp()
+			return 0
+		}
+		return Locks(repo)
+	case "track":
+		if util.GlobalOptions.HelpRequested {
+			TrackHelp()
+			return 0
+		}
+		return Track(repo)
+	case "untrack":
+		if util.GlobalOptions.HelpRequested {
+			UntrackHelp()
+			return 0
+		}
+		return Untrack(repo)
+	case "import":
+		if util.GlobalOptions.HelpRequested {
+			ImportHelp()
+			return 0
+		}
+		return Import(repo)
+	case "rewrite-placeholders":
+		if util.GlobalOptions.HelpRequested {
+			RewritePlaceholdersHelp()
+			return 0
+		}
+		return RewritePlaceholders(repo)
 	case "checkout":
 		if util.GlobalOptions.HelpRequested {
 			CheckoutHelp()
 			return 0
 		}
-		return Checkout()
+		return Checkout(repo)
 	case "prune":
 		if util.GlobalOptions.HelpRequested {
 			PruneHelp()
 			return 0
 		}
-		return Prune()
+		return Prune(repo)
 	case "prune-shared":
 		if util.GlobalOptions.HelpRequested {
 			PruneSharedHelp()
 			return 0
 		}
-		return PruneShared()
+		return PruneShared(repo)
+	case "prune-remote":
+		if util.GlobalOptions.HelpRequested {
+			PruneRemoteHelp()
+			return 0
+		}
+		return PruneRemote(repo)
+	case "shrink":
+		if util.GlobalOptions.HelpRequested {
+			ShrinkHelp()
+			return 0
+		}
+		return Shrink(repo)
+	case "upgrade-store":
+		if util.GlobalOptions.HelpRequested {
+			UpgradeStoreHelp()
+			return 0
+		}
+		return UpgradeStore(repo)
+	case "archive-history":
+		if util.GlobalOptions.HelpRequested {
+			ArchiveHistoryHelp()
+			return 0
+		}
+		return ArchiveHistory(repo)
+	case "restore-archive":
+		if util.GlobalOptions.HelpRequested {
+			RestoreArchiveHelp()
+			return 0
+		}
+		return RestoreArchive(repo)
+	case "store-layout":
+		if util.GlobalOptions.HelpRequested {
+			StoreLayoutHelp()
+			return 0
+		}
+		return StoreLayout(repo)
+	case "move-store":
+		if util.GlobalOptions.HelpRequested {
+			MoveStoreHelp()
+			return 0
+		}
+		return MoveStore(repo)
+	case "dedupe-working-copy":
+		if util.GlobalOptions.HelpRequested {
+			DedupeWorkingCopyHelp()
+			return 0
+		}
+		return DedupeWorkingCopy(repo)
+	case "delta-stats":
+		if util.GlobalOptions.HelpRequested {
+			DeltaStatsHelp()
+			return 0
+		}
+		return DeltaStats(repo)
 	case "fetch":
 		if util.GlobalOptions.HelpRequested {
 			FetchHelp()
 			return 0
 		}
-		return Fetch()
+		return Fetch(repo)
+	case "replicate":
+		if util.GlobalOptions.HelpRequested {
+			ReplicateHelp()
+			return 0
+		}
+		return Replicate(repo)
+	case "size-limit":
+		if util.GlobalOptions.HelpRequested {
+			SizeLimitHelp()
+			return 0
+		}
+		return SizeLimit(repo)
+	case "prefetch":
+		if util.GlobalOptions.HelpRequested {
+			PrefetchHelp()
+			return 0
+		}
+		return Prefetch(repo)
+	case "preview":
+		if util.GlobalOptions.HelpRequested {
+			PreviewHelp()
+			return 0
+		}
+		return Preview(repo)
+	case "fetch-file":
+		if util.GlobalOptions.HelpRequested {
+			FetchFileHelp()
+			return 0
+		}
+		return FetchFile(repo)
 	case "fetch-lob":
 		if util.GlobalOptions.HelpRequested {
 			FetchLobHelp()
 			return 0
 		}
-		return FetchLob()
+		return FetchLob(repo)
 	case "filter-smudge":
 		if util.GlobalOptions.HelpRequested {
 			SmudgeFilterHelp()
 			return 0
 		}
-		return SmudgeFilter()
+		return SmudgeFilter(repo)
 	case "filter-clean":
 		if util.GlobalOptions.HelpRequested {
 			CleanFilterHelp()
 			return 0
 		}
-		return CleanFilter()
+		return CleanFilter(repo)
+	case "filter-process":
+		if util.GlobalOptions.HelpRequested {
+			FilterProcessHelp()
+			return 0
+		}
+		return FilterProcess(repo)
 	case "fsck":
 		if util.GlobalOptions.HelpRequested {
 			FsckHelp()
 			return 0
 		}
-		return Fsck()
+		return Fsck(repo)
 	case "help":
 		// Support help as a command since 'git lob --help' uses git's help system
 		// You have to use "git-lob --help" otherwise
@@ -116,45 +328,81 @@ func MainImpl() int {
 			MissingHelp()
 			return 0
 		}
-		return Missing()
+		return Missing(repo)
 	case "provider":
 		return ProviderDetails()
+	case "remote-ls":
+		if util.GlobalOptions.HelpRequested {
+			RemoteLsHelp()
+			return 0
+		}
+		return RemoteLs(repo)
+	case "check-config":
+		if util.GlobalOptions.HelpRequested {
+			CheckConfigHelp()
+			return 0
+		}
+		return CheckConfig(repo)
+	case "doctor":
+		if util.GlobalOptions.HelpRequested {
+			DoctorHelp()
+			return 0
+		}
+		return Doctor(repo)
+	case "proxy-connect":
+		if util.GlobalOptions.HelpRequested {
+			ProxyConnectHelp()
+			return 0
+		}
+		return ProxyConnect()
 	case "pull":
 		if util.GlobalOptions.HelpRequested {
 			PullHelp()
 			return 0
 		}
-		return Pull()
+		return Pull(repo)
 	case "push":
 		if util.GlobalOptions.HelpRequested {
 			PushHelp()
 			return 0
 		}
-		return Push()
+		return Push(repo)
 	case "push-lob":
 		if util.GlobalOptions.HelpRequested {
 			PushLobHelp()
 			return 0
 		}
-		return PushLob()
+		return PushLob(repo)
 	case "mark-pushed":
 		if util.GlobalOptions.HelpRequested {
 			MarkPushedHelp()
 			return 0
 		}
-		return MarkPushed()
+		return MarkPushed(repo)
 	case "reset-pushed":
 		if util.GlobalOptions.HelpRequested {
 			ResetPushedHelp()
 			return 0
 		}
-		return ResetPushed()
+		return ResetPushed(repo)
 	case "last-pushed":
 		if util.GlobalOptions.HelpRequested {
 			LastPushedHelp()
 			return 0
 		}
-		return LastPushed()
+		return LastPushed(repo)
+	case "push-state":
+		if util.GlobalOptions.HelpRequested {
+			PushStateHelp()
+			return 0
+		}
+		return PushState(repo)
+	case "reconcile-pushed":
+		if util.GlobalOptions.HelpRequested {
+			ReconcilePushedHelp()
+			return 0
+		}
+		return ReconcilePushed(repo)
 	default:
 		if util.GlobalOptions.HelpRequested {
 			Help()
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"bufio"
+	"os"
 	"strings"
 
 	"github.com/atlassian/git-lob/core"
@@ -8,12 +10,12 @@ import (
 )
 
 // Missing command line tool
-func Missing() int {
+func Missing(repo *core.Repo) int {
 
-	// git-lob missing [--ignore-available] [--checkout] [path...]
+	// git-lob missing [--ignore-available] [--checkout] [--fix [--yes]] [path...]
 
 	// Validate custom options
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"ignore-available", "i", "checkout", "c"})
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"ignore-available", "i", "checkout", "c", "fix", "yes", "y"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
@@ -21,6 +23,12 @@ func Missing() int {
 
 	optIgnoreAvailable := util.GlobalOptions.BoolOpts.Contains("ignore-available") || util.GlobalOptions.BoolOpts.Contains("i")
 	optCheckout := util.GlobalOptions.BoolOpts.Contains("checkout") || util.GlobalOptions.BoolOpts.Contains("c")
+	optFix := util.GlobalOptions.BoolOpts.Contains("fix")
+	optYes := util.GlobalOptions.BoolOpts.Contains("yes") || util.GlobalOptions.BoolOpts.Contains("y")
+	if optYes && !optFix {
+		util.LogConsoleError("--yes is only valid with --fix")
+		return 9
+	}
 
 	var paths []string
 	if len(util.GlobalOptions.Args) > 0 {
@@ -39,9 +47,20 @@ func Missing() int {
 				anyMissing = true
 			}
 
+		case core.MissingOnDemand:
+			if !optIgnoreAvailable {
+				util.LogConsolef("%v content will be fetched on checkout\n", data.Path)
+				anyMissing = true
+			}
 		case core.MissingFixed:
 			util.LogConsolef("%v checked out\n", data.Path)
 			anyMissing = true
+		case core.MissingRecovered:
+			util.LogConsolef("%v fetched from %v & checked out\n", data.Path, data.Source)
+			anyMissing = true
+		case core.MissingSubstituted:
+			util.LogConsolef("%v replaced with the version from %v & staged\n", data.Path, data.CommitSummary.ShortSHA)
+			anyMissing = true
 		case core.MissingModified:
 			util.LogErrorf("%v is locally modified with no content, delete or reset/checkout to resolve\n", data.Path)
 			anyMissing = true
@@ -63,7 +82,20 @@ func Missing() int {
 		return false
 	}
 	// Add newlines to messages since progress doesn't
-	core.Missing(optCheckout, paths, callback)
+	if optFix {
+		confirm := func(path string, summary *core.GitCommitSummary) bool {
+			util.LogConsolef("\r%v has no content anywhere. The latest version available is from:\n", path)
+			util.LogConsolef("  %v(%v) [%v] %v\n", summary.CommitterName, summary.CommitterEmail,
+				summary.ShortSHA, summary.Subject)
+			if optYes {
+				return true
+			}
+			return confirmOnConsole("Replace it with that version & stage it?")
+		}
+		repo.MissingFix(paths, confirm, callback)
+	} else {
+		repo.Missing(optCheckout, paths, callback)
+	}
 	util.LogConsoleSpinnerFinish("Searching: ")
 	if anyErrors {
 		return 12
@@ -75,6 +107,19 @@ func Missing() int {
 	}
 	return 0
 }
+
+// Ask a yes/no question on the console, no unless the answer starts with y
+// Always no with --noninteractive
+func confirmOnConsole(question string) bool {
+	if util.GlobalOptions.NonInteractive {
+		util.LogConsolef("%v [y/N] n (--noninteractive)\n", question)
+		return false
+	}
+	util.LogConsolef("%v [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y")
+}
+
 func MissingHelp() {
 	util.LogConsole(`Usage: git-lob missing [options] [path...]
 
@@ -94,8 +139,20 @@ Parameters:
 Options:
   --ignore-available, -i  Ignore placeholders where content is available 
                           locally, it just isn't checked out right now.
+                          Also ignores content which will be fetched on
+                          checkout after 'git lob fetch --metadata-only'.
   --checkout, -c          If we find content available, expand the placeholder
-                          to the full content as per 'git lob checkout'.
+                          to the full content as per 'git lob checkout',
+                          fetching it first after --metadata-only fetches.
+  --fix                   As --checkout, but also try to fetch content which
+                          isn't available from every remote configured for
+                          git-lob (the shared store is always tried). If no
+                          remote has it either, offer to replace the file with
+                          the latest version from its history which is
+                          available, staging the change so it can be
+                          committed (not if the placeholder was modified). Fixed files are refreshed in the index.
+  --yes, -y               With --fix, replace files with other versions
+                          without asking
   --quiet, -q             Print less output
   --verbose, -v           Print more output
 
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Move store command line tool
+func MoveStore(repo *core.Repo) int {
+
+	// git-lob move-store [--shared] [--dry-run] <path>
+	// git-lob move-store --relink [--dry-run]
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"shared", "relink"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	optShared := util.GlobalOptions.BoolOpts.Contains("shared")
+	dryRun := util.GlobalOptions.DryRun
+
+	if util.GlobalOptions.BoolOpts.Contains("relink") {
+		if len(util.GlobalOptions.Args) > 0 || optShared {
+			util.LogConsoleError("--relink does not take a path or --shared")
+			return 9
+		}
+		n, err := repo.RelinkSharedStore(dryRun)
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 12
+		}
+		if dryRun {
+			util.LogConsolef("%d files would have been linked to the shared store.\n", n)
+		} else {
+			util.LogConsolef("%d files linked to the shared store.\n", n)
+		}
+		return 0
+	}
+
+	if len(util.GlobalOptions.Args) != 1 {
+		util.LogConsoleError("move-store takes one argument, the path to move the store to")
+		return 9
+	}
+	dest := util.GlobalOptions.Args[0]
+	storeName := "local"
+	move := repo.MoveLocalStore
+	if optShared {
+		if util.GlobalOptions.SharedStore == "" {
+			util.LogConsoleError("No shared store is configured (git-lob.sharedstore)")
+			return 9
+		}
+		storeName = "shared"
+		move = repo.MoveSharedStore
+	}
+
+	var lastProgressLen int
+	callback := func(filesDone, totalFiles int, bytesDone, totalBytes int64) {
+		msg := fmt.Sprintf("Copying files: %d/%d (%v/%v)", filesDone, totalFiles,
+			util.FormatSize(bytesDone), util.FormatSize(totalBytes))
+		util.LogConsoleOverwrite(msg, lastProgressLen)
+		lastProgressLen = len(msg)
+	}
+	result, err := move(dest, dryRun, callback)
+	if lastProgressLen > 0 {
+		util.LogConsole("")
+	}
+	if err != nil {
+		util.LogConsoleErrorf("Unable to move the %v store: %v\n", storeName, err.Error())
+		return 12
+	}
+	if dryRun {
+		util.LogConsolef("The %v store would have been moved from %v to %v (%d files, %v).\n", storeName,
+			result.From, result.To, result.Files, util.FormatSize(result.Bytes))
+		if result.BytesFree >= 0 && result.BytesFree < result.Bytes {
+			util.LogConsolef("WARNING: only %v is available there, which isn't enough unless it's on the same filesystem.\n",
+				util.FormatSize(result.BytesFree))
+		}
+		return 0
+	}
+	util.LogConsolef("The %v store has moved from %v to %v (%d files, %v).\n", storeName,
+		result.From, result.To, result.Files, util.FormatSize(result.Bytes))
+	if result.Relinked > 0 {
+		util.LogConsolef("%d files linked to the shared store again.\n", result.Relinked)
+	}
+	if optShared {
+		util.LogConsole("Other repositories using the shared store should run 'git lob move-store --relink'",
+			"if they don't use the same git-lob.sharedstore setting.")
+	}
+	return 0
+}
+
+func MoveStoreHelp() {
+	util.LogConsole(`Usage: git-lob move-store [options] <path>
+       git-lob move-store --relink [options]
+
+  Moves the local binary store, or the shared store with --shared, to a new
+  path, e.g. on a bigger drive. The path must not exist, or be an empty
+  folder.
+
+  A store on the same filesystem is simply renamed. Otherwise every file is
+  copied, the copies are checked & only then are the originals deleted, so if
+  anything goes wrong the store stays where it was.
+
+  The local store is always found at .git/git-lob/content, so a link to the
+  new location is left there (on Windows, creating it needs Developer Mode or
+  administrator rights). Move it back there to remove the link.
+
+  Moving the shared store updates git-lob.sharedstore in the git config which
+  set it (the repository's or your user config). Do this while no other
+  repositories using it are running git-lob. Other repositories which set
+  git-lob.sharedstore themselves need it updating by hand.
+
+  Binaries in the local store are hard links to the shared store. Once either
+  has moved, files which have become separate copies are linked again if
+  they're on the same filesystem. Run with --relink in other repositories
+  using the shared store to do the same for them.
+
+Options:
+  --shared      Move the shared store instead of the local one
+  --relink      Just link local files to the shared store where they're
+                separate copies
+  --dry-run     Don't actually move anything, just report
+  --quiet, -q   Print less output
+  --verbose, -v Print more output`)
+}
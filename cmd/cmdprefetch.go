@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Prefetch command line tool
+func Prefetch(repo *core.Repo) int {
+
+	// git-lob prefetch [--daemon] [--limit-rate=<rate>] [<remote>...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"limit-rate"}, []string{"daemon"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	// The prefetch rate is on top of any overall limit
+	prefetchRate := util.GlobalOptions.PrefetchRate
+	if prefetchRate > 0 && (util.GlobalOptions.MaxDownloadRate == 0 || prefetchRate < util.GlobalOptions.MaxDownloadRate) {
+		util.GlobalOptions.MaxDownloadRate = prefetchRate
+	}
+	if err := applyLimitRateOption(&util.GlobalOptions.MaxDownloadRate); err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
+	optDaemon := util.GlobalOptions.BoolOpts.Contains("daemon")
+
+	remoteNames := util.GlobalOptions.Args
+	if len(remoteNames) == 0 {
+		if len(util.GlobalOptions.FetchRemotes) > 0 {
+			remoteNames = util.GlobalOptions.FetchRemotes
+		} else {
+			remoteNames = []string{repo.GetGitDefaultRemoteForPull()}
+		}
+	}
+	var remotes []*core.FetchRemote
+	for _, remoteName := range remoteNames {
+		provider, err := repo.GetProvider(remoteName)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: %v\n", err)
+			return 6
+		}
+		if err = provider.ValidateConfig(remoteName); err != nil {
+			util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+			return 6
+		}
+		defer provider.Release()
+		remotes = append(remotes, &core.FetchRemote{Name: remoteName, Provider: provider})
+	}
+	remoteDesc := strings.Join(remoteNames, ", ")
+
+	if optDaemon {
+		return prefetchDaemon(repo, remotes, remoteDesc)
+	}
+
+	util.LogConsole("Prefetching recent binaries from", remoteDesc)
+	var downloaded int
+	var yielded bool
+	var prefetcherr error
+	// 100 items in the queue should be good enough, this means that it won't block
+	callbackChan := make(chan *util.ProgressCallbackData, 100)
+	go func(remotes []*core.FetchRemote, progresschan chan<- *util.ProgressCallbackData) {
+		progress := func(data *util.ProgressCallbackData) (abort bool) {
+			progresschan <- data
+			return false
+		}
+		downloaded, yielded, prefetcherr = repo.Prefetch(remotes, progress)
+		close(progresschan)
+	}(remotes, callbackChan)
+	util.ReportProgressToConsole(callbackChan, "Prefetch", time.Millisecond*500)
+
+	if prefetcherr != nil {
+		util.LogConsoleErrorf("git-lob: prefetch error(s):\n%v\n", prefetcherr.Error())
+		return 12
+	}
+	if yielded {
+		util.LogConsolef("Stopped after %d binaries since a fetch is running\n", downloaded)
+	}
+	return 0
+}
+
+// Run prefetch in the foreground until interrupted
+func prefetchDaemon(repo *core.Repo, remotes []*core.FetchRemote, remoteDesc string) int {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+
+	util.LogConsolef("Prefetching recent binaries from %v every %v, until interrupted\n",
+		remoteDesc, util.GlobalOptions.PrefetchInterval)
+	// No progress, this runs in the background
+	callback := func(data *util.ProgressCallbackData) (abort bool) {
+		if data.Type == util.ProgressError {
+			util.LogErrorf("Prefetch error: %v\n", data.Desc)
+		}
+		return false
+	}
+	report := func(downloaded int, err error) {
+		now := time.Now().Format("2006-01-02 15:04:05")
+		if err != nil {
+			util.LogConsoleErrorf("%v: prefetch error: %v\n", now, err.Error())
+		} else if downloaded > 0 {
+			util.LogConsolef("%v: prefetched %d binaries\n", now, downloaded)
+		}
+	}
+	err := repo.PrefetchDaemon(remotes, stop, callback, report)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err.Error())
+		return 12
+	}
+	return 0
+}
+
+func PrefetchHelp() {
+	util.LogConsole(`Usage: git-lob prefetch [options] [<remote>...]
+
+  Downloads binaries for recent commits ahead of time, in the background
+
+  With git-lob.autofetch, binaries are downloaded when checkout needs them,
+  which holds up the checkout. Prefetch downloads the same binaries that
+  'git lob fetch' would without refs (see git-lob.fetch-refs etc in 'git lob
+  help config') which aren't already stored locally, so they're there when
+  you switch to a recent branch. Unlike fetch, it doesn't update push state.
+
+  Downloads are limited to git-lob.prefetch-rate (1MB per second by default),
+  so as not to get in the way of other work. Binaries are downloaded a few at a
+  time, & prefetch gives way to 'git lob fetch' & pull, stopping if one is
+  running rather than downloading the same binaries at the same time.
+
+  --daemon keeps running in the foreground until interrupted, checking every
+  git-lob.prefetch-interval (10 minutes by default) whether HEAD or any recent
+  ref has changed, & if so prefetching once nothing has changed the index for
+  a short while. For example, to run it in the background:
+
+    git lob prefetch --daemon > /dev/null &
+
+  Only one daemon can run for a repository.
+
+Parameters:
+  <remote>: Remotes to prefetch from, in order of priority. Default is the
+            same as fetch (git-lob.fetch-remotes or the tracked remote).
+
+Options:
+  --daemon            Keep prefetching until interrupted
+  --limit-rate=<rate> Limit the download rate, e.g. 500K or 2MB (per second),
+                      instead of git-lob.prefetch-rate
+  --quiet, -q         Print less output
+  --verbose, -v       Print more output
+`)
+}
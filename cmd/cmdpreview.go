@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Preview command line tool
+func Preview(repo *core.Repo) int {
+	// Previews may go to stdout, so everything else must not
+	util.LogAllConsoleOutputToStdErr()
+
+	// git-lob preview [--output=<file>] [--remote=<remote>] [--fetch] <path>[@<ref>]|<sha>
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"output", "remote"}, []string{"fetch"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) != 1 {
+		util.LogConsoleError("Must supply exactly one <path>[@<ref>] or SHA")
+		return 9
+	}
+	optFetch := util.GlobalOptions.BoolOpts.Contains("fetch")
+
+	arg := util.GlobalOptions.Args[0]
+	var sha string
+	if core.IsLOBSHA(arg) && !util.FileExists(arg) {
+		sha = strings.ToLower(arg)
+	} else {
+		var relpath, ref string
+		var err error
+		sha, relpath, ref, err = repo.GetLOBSHAForPathAtRef(arg)
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 9
+		}
+		util.LogDebugf("%v in %v is %v\n", relpath, ref, sha)
+	}
+
+	// Just the preview is downloaded if we don't have it, which is the point
+	if optFetch || !repo.HasLocalLOBPreview(sha) {
+		remoteName, ok := util.GlobalOptions.StringOpts["remote"]
+		if !ok {
+			remoteName = repo.GetGitDefaultRemoteForPull()
+		}
+		provider, err := repo.GetProvider(remoteName)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: %v\n", err)
+			return 6
+		}
+		if err = provider.ValidateConfig(remoteName); err != nil {
+			util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+			return 6
+		}
+		err = repo.FetchLOBPreview(sha, provider, remoteName, optFetch)
+		provider.Release()
+		if err != nil {
+			if core.IsNotFoundError(err) {
+				util.LogConsoleErrorf("git-lob: there's no preview of %v, locally or on %v\n", sha, remoteName)
+			} else {
+				util.LogConsoleErrorf("git-lob: unable to download the preview of %v from %v: %v\n", sha, remoteName, err)
+			}
+			return 12
+		}
+	}
+	data, err := repo.ReadLocalLOBPreview(sha)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: unable to read the preview of %v: %v\n", sha, err)
+		return 12
+	}
+
+	if outputFile, ok := util.GlobalOptions.StringOpts["output"]; ok {
+		// Write somewhere temporary first, so a failure doesn't leave a partial file
+		tmpFile := filepath.Join(filepath.Dir(outputFile), "."+filepath.Base(outputFile)+".tmp")
+		f, err := os.Create(tmpFile)
+		if err == nil {
+			_, err = f.Write(data)
+			if closeerr := f.Close(); err == nil {
+				err = closeerr
+			}
+		}
+		if err == nil {
+			os.Remove(outputFile)
+			err = os.Rename(tmpFile, outputFile)
+		}
+		if err != nil {
+			os.Remove(tmpFile)
+			util.LogConsoleErrorf("git-lob: unable to write %v: %v\n", outputFile, err)
+			return 12
+		}
+		return 0
+	}
+	// Piped or redirected, e.g. to an image viewer which reads stdin
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		if _, err = os.Stdout.Write(data); err != nil {
+			util.LogConsoleErrorf("git-lob: unable to write preview: %v\n", err)
+			return 12
+		}
+		return 0
+	}
+
+	path, err := repo.PreparePreviewForViewing(sha, data)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: unable to write preview for viewing: %v\n", err)
+		return 12
+	}
+	cmd := repo.GetPreviewViewerCommand(path)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		util.LogConsoleErrorf("git-lob: unable to open %v in a viewer (git-lob.preview-viewer): %v\n", path, err)
+		return 12
+	}
+	return 0
+}
+
+func PreviewHelp() {
+	util.LogConsole(`Usage: git-lob preview [options] <path>[@<ref>]
+       git-lob preview [options] <sha>
+
+  Shows the preview of a binary, e.g. a thumbnail of an image, as a file was
+  committed at any ref (HEAD if not given), so that changes can be reviewed
+  without downloading the full assets. Previews are generated when binaries
+  are stored, by the command configured for their file extension in
+  git-lob.preview.<ext>; see 'git lob help config'.
+
+  If the preview isn't stored locally, just the preview is downloaded from
+  the remote. It's opened in git-lob.preview-viewer, or the default viewer
+  for its type, unless stdout is redirected, in which case it's written to
+  stdout:
+
+    git lob preview art/hero.png@feature > hero-thumb.png
+
+  <path> is relative to the current directory, & doesn't have to exist in
+  the working copy. A binary can also be given by its SHA.
+
+Options:
+  --output=<file>  Write the preview to a file instead of displaying it
+  --remote=<remote>
+                   The remote to download the preview from. Default is the
+                   default remote for pull (branch.*.remote for the current
+                   branch, or origin).
+  --fetch          Download the preview even if it's stored locally
+  --quiet, -q      Print less output
+  --verbose, -v    Print more output
+`)
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"encoding/json"
+	"os"
 	"strings"
 
 	"github.com/atlassian/git-lob/core"
@@ -16,6 +18,10 @@ var pruneCallbackImpl = func(t core.PruneCallbackType, lobsha string) {
 		util.LogDebugf("Prune: retaining %v (date)\n", lobsha)
 	case core.PruneRetainNotPushed:
 		util.LogDebugf("Prune: retaining %v (not pushed)\n", lobsha)
+	case core.PruneRetainByHold:
+		util.LogDebugf("Prune: retaining %v (retention hold)\n", lobsha)
+	case core.PruneRetainByPolicy:
+		util.LogDebugf("Prune: retaining %v (retention policy)\n", lobsha)
 	case core.PruneRetainReferenced:
 		util.LogDebugf("Prune: retaining %v (referenced)\n", lobsha)
 	case core.PruneDeleted:
@@ -31,8 +37,8 @@ var pruneCallbackImpl = func(t core.PruneCallbackType, lobsha string) {
 	util.LogConsoleSpinner("Processing: ")
 }
 
-func Prune() int {
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"unreferenced", "u", "safe", "k"})
+func Prune(repo *core.Repo) int {
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"unreferenced", "u", "safe", "k", "interactive", "i", "json"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
@@ -40,30 +46,78 @@ func Prune() int {
 
 	optOnlyUnreferenced := util.GlobalOptions.BoolOpts.Contains("unreferenced") || util.GlobalOptions.BoolOpts.Contains("u")
 	optSafeMode := util.GlobalOptions.BoolOpts.Contains("safe") || util.GlobalOptions.BoolOpts.Contains("k")
+	optInteractive := util.GlobalOptions.BoolOpts.Contains("interactive") || util.GlobalOptions.BoolOpts.Contains("i")
+	optJSON := util.GlobalOptions.BoolOpts.Contains("json")
 
-	if optOnlyUnreferenced && optSafeMode {
+	if optOnlyUnreferenced && optSafeMode && !optJSON {
 		util.LogConsole("The --safe option does nothing in --unreferenced mode because unreferenced\nbinaries are never pushed")
 	}
+	if optOnlyUnreferenced && optInteractive {
+		util.LogConsoleError("The --interactive option can't be used with --unreferenced")
+		return 9
+	}
+	if optJSON && (!util.GlobalOptions.DryRun || optInteractive) {
+		util.LogConsoleError("The --json option can only be used with --dry-run, and not with --interactive")
+		return 9
+	}
 
 	// Upgrade to safe mode if configured
 	optSafeMode = optSafeMode || util.GlobalOptions.PruneSafeMode
 
+	// Nothing but the JSON on stdout for scripts
+	callback := pruneCallbackImpl
+	logConsole := util.LogConsole
+	finishSpinner := func() { util.LogConsoleSpinnerFinish("Processing: ") }
+	if optJSON {
+		callback = pruneQuietCallbackImpl
+		logConsole = func(msgs ...interface{}) {}
+		finishSpinner = func() {}
+	}
+
 	var shas []string
 	var err error
 	if optOnlyUnreferenced {
 		// Only purge unreferenced
-		util.LogConsole("Pruning unreferenced binaries...")
-		shas, err = core.PruneUnreferenced(util.GlobalOptions.DryRun, pruneCallbackImpl)
+		logConsole("Pruning unreferenced binaries...")
+		shas, err = repo.PruneUnreferenced(util.GlobalOptions.DryRun, callback)
+		finishSpinner()
+		if err != nil {
+			util.LogErrorf("Prune failed: %v\n", err)
+			return 3
+		}
+	} else if optInteractive {
+		// Find out what would be purged, then only purge that if the user agrees
+		util.LogConsole("Finding old binaries...")
+		shas, err = repo.PruneOld(true, optSafeMode, func(t core.PruneCallbackType, lobsha string) {
+			util.LogConsoleSpinner("Processing: ")
+		})
 		util.LogConsoleSpinnerFinish("Processing: ")
 		if err != nil {
 			util.LogErrorf("Prune failed: %v\n", err)
 			return 3
 		}
+		if len(shas) == 0 {
+			util.LogConsole("Nothing to prune.")
+			return 0
+		}
+		if !reviewPruneCandidates(repo, shas) {
+			util.LogConsole("Nothing was deleted.")
+			return 0
+		}
+		if !util.GlobalOptions.DryRun {
+			util.LogConsole("Pruning old binaries...")
+			shas, err = repo.PruneOldReviewed(optSafeMode, shas, pruneCallbackImpl)
+			util.LogConsoleSpinnerFinish("Processing: ")
+			if err != nil {
+				util.LogErrorf("Prune failed: %v\n", err)
+				return 3
+			}
+		}
 	} else {
 		// Purge old & unreferenced
-		util.LogConsole("Pruning old binaries...")
-		shas, err = core.PruneOld(util.GlobalOptions.DryRun, optSafeMode, pruneCallbackImpl)
-		util.LogConsoleSpinnerFinish("Processing: ")
+		logConsole("Pruning old binaries...")
+		shas, err = repo.PruneOld(util.GlobalOptions.DryRun, optSafeMode, callback)
+		finishSpinner()
 		if err != nil {
 			util.LogErrorf("Prune failed: %v\n", err)
 			return 3
@@ -71,8 +125,19 @@ func Prune() int {
 
 	}
 	if util.GlobalOptions.DryRun {
-		util.LogConsolef("%d binaries would have been deleted.\n", len(shas))
-		util.LogConsole("Run command again without --dry-run to actually perform the deletion.")
+		if optInteractive {
+			util.LogConsolef("%d binaries would have been deleted.\n", len(shas))
+		} else {
+			candidates, err := repo.GetPruneCandidates(shas)
+			if err != nil {
+				util.LogConsoleErrorf("Unable to find out which commits use binaries: %v\n", err.Error())
+				return 3
+			}
+			if !reportPruneDryRun(candidates, optJSON) {
+				return 12
+			}
+		}
+		logConsole("Run command again without --dry-run to actually perform the deletion.")
 	} else {
 		util.LogConsolef("%d binaries were deleted.\n", len(shas))
 	}
@@ -81,10 +146,95 @@ func Prune() int {
 
 }
 
-func PruneShared() int {
+// Callback for prune when only JSON is output; still logs what happens, but never to the console
+var pruneQuietCallbackImpl = func(t core.PruneCallbackType, lobsha string) {
+	if t == core.PruneDeleted {
+		util.LogDebugf("Prune: would delete %v (dry run)\n", lobsha)
+	}
+}
+
+// List exactly what a dry run would have pruned, with sizes, reasons & the commits which use each
+// binary, for review (or archiving) before deleting for real. Returns false if output failed
+func reportPruneDryRun(candidates []*core.PruneCandidate, jsonOutput bool) bool {
+	if jsonOutput {
+		data, err := json.MarshalIndent(candidates, "", "  ")
+		if err != nil {
+			util.LogConsoleErrorf("Unable to write prune details: %v\n", err.Error())
+			return false
+		}
+		// Straight to stdout regardless of --quiet, this is for scripts
+		os.Stdout.Write(data)
+		os.Stdout.Write([]byte("\n"))
+		return true
+	}
+	var total int64
+	for _, c := range candidates {
+		path := c.Path
+		if path == "" {
+			path = "(not used by any commit)"
+		}
+		util.LogConsolef("%v %12v  %-12v  %v\n", c.SHA, util.FormatSize(c.Size), c.Reason, path)
+		if len(c.Commits) > 0 {
+			commits := make([]string, 0, len(c.Commits))
+			for _, commit := range c.Commits {
+				commits = append(commits, commit[:7])
+			}
+			util.LogConsolef("    added by %v\n", strings.Join(commits, ", "))
+		}
+		total += c.Size
+	}
+	util.LogConsolef("%d binaries (%v) would have been deleted.\n", len(candidates), util.FormatSize(total))
+	return true
+}
+
+// List binaries which would be pruned by path with their sizes & ask whether to go ahead
+// Always returns true in dry run mode, without asking
+func reviewPruneCandidates(repo *core.Repo, shas []string) bool {
+	candidates, err := repo.GetPruneCandidates(shas)
+	if err != nil {
+		util.LogConsoleErrorf("Unable to find out which files binaries belong to: %v\n", err.Error())
+		return false
+	}
+	var total int64
+	for i := 0; i < len(candidates); {
+		// Candidates are in path order, summarise each path then list versions
+		path := candidates[i].Path
+		var pathTotal int64
+		j := i
+		for ; j < len(candidates) && candidates[j].Path == path; j++ {
+			pathTotal += candidates[j].Size
+		}
+		if path == "" {
+			path = "(not used by any commit)"
+		}
+		util.LogConsolef("  %v: %d version(s), %v\n", path, j-i, util.FormatSize(pathTotal))
+		for ; i < j; i++ {
+			util.LogConsolef("      %v %12v\n", candidates[i].SHA, util.FormatSize(candidates[i].Size))
+		}
+		total += pathTotal
+	}
+	util.LogConsolef("%d binaries, %v in total.\n", len(candidates), util.FormatSize(total))
+	if util.GlobalOptions.DryRun {
+		return true
+	}
+	return confirmOnConsole("Delete these binaries?")
+}
+
+func PruneShared(repo *core.Repo) int {
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"json"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	optJSON := util.GlobalOptions.BoolOpts.Contains("json")
+	if optJSON && !util.GlobalOptions.DryRun {
+		util.LogConsoleError("The --json option can only be used with --dry-run")
+		return 9
+	}
 
 	// Quick pre-flight check
-	shared := core.GetSharedLOBRoot()
+	shared := repo.GetSharedLOBRoot()
 	if shared == "" {
 		util.LogConsoleError("No shared store has been configured for this repo, cannot prune it.")
 		return 9
@@ -92,21 +242,31 @@ func PruneShared() int {
 		util.LogConsoleErrorf("Configured shared store '%v' doesn't exist, cannot prune.\n", shared)
 		return 9
 	}
-	util.LogConsole("Pruning shared store...")
-	shas, err := core.PruneSharedStore(util.GlobalOptions.DryRun, pruneCallbackImpl)
-	util.LogConsoleSpinnerFinish("Processing: ")
+	var shas []string
+	var err error
+	if optJSON {
+		shas, err = repo.PruneSharedStore(true, pruneQuietCallbackImpl)
+	} else {
+		util.LogConsole("Pruning shared store...")
+		shas, err = repo.PruneSharedStore(util.GlobalOptions.DryRun, pruneCallbackImpl)
+		util.LogConsoleSpinnerFinish("Processing: ")
+	}
 	if err != nil {
 		util.LogErrorf("Prune failed: %v\n", err)
 		return 3
 	}
 	if util.GlobalOptions.DryRun {
-		if util.GlobalOptions.Verbose {
-			util.LogConsolef("%d LOBs would have been deleted:\n", len(shas))
-			util.LogConsole(strings.Join(shas, "\n"))
-		} else {
-			util.LogConsolef("%d LOBs would have been deleted.\n", len(shas))
+		candidates, err := repo.GetSharedPruneCandidates(shas)
+		if err != nil {
+			util.LogConsoleErrorf("Unable to find out which commits use binaries: %v\n", err.Error())
+			return 3
+		}
+		if !reportPruneDryRun(candidates, optJSON) {
+			return 12
+		}
+		if !optJSON {
+			util.LogConsole("Run command again without --dry-run to actually perform the deletion.")
 		}
-		util.LogConsole("Run command again without --dry-run to actually perform the deletion.")
 	} else {
 		if util.GlobalOptions.Verbose {
 			util.LogConsolef("%d LOBs were deleted:\n", len(shas))
@@ -118,14 +278,105 @@ func PruneShared() int {
 	return 0
 }
 
+func PruneRemote(repo *core.Repo) int {
+
+	// git-lob prune-remote [--dry-run] <remote>
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) != 1 {
+		util.LogConsoleError("Must supply a single remote to prune")
+		return 9
+	}
+	remoteName := util.GlobalOptions.Args[0]
+
+	// check the remote config to make sure it's valid
+	provider, err := repo.GetProvider(remoteName)
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 6
+	}
+	if err = provider.ValidateConfig(remoteName); err != nil {
+		util.LogConsoleErrorf("Remote %v has configuration problems:\n%v\n", remoteName, err)
+		return 6
+	}
+	defer provider.Release()
+
+	var retained, held int
+	callback := func(t core.PruneCallbackType, lobsha string) {
+		switch t {
+		case core.PruneRetainByDate:
+			retained++
+		case core.PruneRetainByHold:
+			held++
+		}
+		pruneCallbackImpl(t, lobsha)
+	}
+
+	util.LogConsole("Pruning unreferenced binaries on", remoteName+"...")
+	shas, err := repo.PruneRemote(provider, remoteName, util.GlobalOptions.DryRun, callback)
+	util.LogConsoleSpinnerFinish("Processing: ")
+	if err != nil {
+		util.LogErrorf("Prune failed: %v\n", err)
+		return 3
+	}
+	if util.GlobalOptions.DryRun {
+		util.LogConsolef("%d binaries would have been deleted from %v.\n", len(shas), remoteName)
+		util.LogConsole("Run command again without --dry-run to actually perform the deletion.")
+	} else {
+		util.LogConsolef("%d binaries were deleted from %v.\n", len(shas), remoteName)
+	}
+	if retained > 0 {
+		util.LogConsolef("%d unreferenced binaries were kept by the server because they were uploaded recently.\n", retained)
+	}
+	if held > 0 {
+		util.LogConsolef("%d unreferenced binaries can't be deleted yet because %v is in write-once retention mode.\n", held, remoteName)
+	}
+	return 0
+}
+
 // Perform the default prune after fetching or pulling
 // Only call this if pruning was requested & not dry running
-func PostFetchPullPrune() ([]string, error) {
-	shas, err := core.PruneOld(false, util.GlobalOptions.PruneSafeMode, pruneCallbackImpl)
+// Whether fetch & pull should prune afterwards, from --prune / --no-prune & git-lob.fetch-prune
+func postFetchPruneOption() bool {
+	if util.GlobalOptions.BoolOpts.Contains("no-prune") {
+		return false
+	}
+	return util.GlobalOptions.BoolOpts.Contains("prune") || util.GlobalOptions.FetchPrune
+}
+
+// Keep the recent history walked by fetch for the prune which follows it, walking back far enough
+// for the retention periods too. Returns whether the caller should clear the cache afterwards
+func cacheHistoryForPostFetchPrune(repo *core.Repo) bool {
+	minDays := util.GlobalOptions.RetentionCommitsPeriodHEAD
+	if util.GlobalOptions.RetentionCommitsPeriodOther > minDays {
+		minDays = util.GlobalOptions.RetentionCommitsPeriodOther
+	}
+	return repo.CacheRecentHistory(minDays)
+}
+
+func PostFetchPullPrune(repo *core.Repo) ([]string, error) {
+	shas, err := repo.PruneOld(false, util.GlobalOptions.PruneSafeMode, pruneCallbackImpl)
 	util.LogConsoleSpinnerFinish("Processing: ")
 	return shas, err
 }
 
+// Prune the shared store after a push or fetch, if it's due (git-lob.sharedstore-gc-days)
+func PostTransferSharedStoreGC(repo *core.Repo) {
+	result, err := repo.RunSharedStoreGCIfDue(pruneQuietCallbackImpl)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: shared store maintenance failed: %v\n", err.Error())
+		return
+	}
+	if result != nil {
+		util.LogConsolef("Shared store maintenance removed %d unused binaries, reclaiming %v\n",
+			len(result.Deleted), util.FormatSize(result.Reclaimed))
+	}
+}
+
 func PruneHelp() {
 	util.LogConsole(`Usage: git-lob prune [options]
 
@@ -135,6 +386,8 @@ func PruneHelp() {
     1. It is referenced by a reachable commit which is inside the 'retention 
        period' as defined below OR
     2. It is referenced by a commit for which the binaries haven't been pushed
+       OR
+    3. It is kept by one of the retention policies below
 
   To put that another way, a binary WILL BE PRUNED if:
     1. It is not referenced by any reachable commit, or only by a reachable 
@@ -142,14 +395,24 @@ func PruneHelp() {
     2. If referenced by an older commit, it has been pushed (i.e. the local
        copy is not the only one)
 
+  Use 'git lob why <sha|path>' to find out which of these applies to a binary.
+
 Options:
   --safe, -k           Before deleting old binaries that we think we've pushed,
                        doubly verify with the remote that it has a copy
                        Also see git-lob.prune-safe config setting
   --unreferenced, -u   Only prune totally unreferenced binaries, not old ones
+  --interactive, -i    List the binaries which would be deleted by path, with
+                       their sizes, and ask before deleting them. With
+                       --dry-run just list them.
   --quiet, -q          Print less output
   --verbose, -v        Print more output
-  --dry-run            Don't actually delete anything, just report
+  --dry-run            Don't actually delete anything, just list each binary
+                       which would be deleted with its size, why it would be
+                       deleted ('out of range' or 'unreferenced'), its path &
+                       the commits which added it
+  --json               With --dry-run, output the list as JSON instead of text,
+                       e.g. to archive the binaries before deleting them
 
 REACHABLE COMMITS & THE RETENTION PERIOD
 
@@ -166,6 +429,19 @@ REACHABLE COMMITS & THE RETENTION PERIOD
   in the 'prune' section.
 
 
+RETENTION POLICIES
+
+  On top of the retention period, old binaries can also be kept by these
+  settings, whether they've been pushed or not:
+    * git-lob.prune-keep-versions: keep this many of the latest versions of
+      each path, across all branches & tags
+    * git-lob.prune-keep-tags: keep everything used by tags matching these
+      patterns (comma separated, e.g. 'release/*, v*')
+    * git-lob.prune-keep-size: keep binaries smaller than this size, even if
+      no commit uses them (e.g. '100K')
+
+  None of these apply when using --unreferenced.
+
 DEFINITION OF "PUSHED"
   A binary is considered 'pushed' if it has been pushed to 'origin'. You can
   change the remote which is checked via the setting
@@ -203,10 +479,43 @@ func PruneSharedHelp() {
   store which have no other links left in the file system. This is relatively
   quick compared to the repo prune since it doesn't require checking any
   git repos.
+
+  It can also be done automatically after push & fetch now and again, see
+  git-lob.sharedstore-gc-days in 'git lob help config'.
   
+Options:
+  --quiet, -q          Print less output
+  --verbose, -v        Print more output
+  --dry-run            Don't actually delete anything, just list each binary
+                       which would be deleted with its size, & the commits in
+                       this repo which added it, if any
+  --json               With --dry-run, output the list as JSON instead of text
+`)
+}
+
+func PruneRemoteHelp() {
+	util.LogConsole(`Usage: git-lob prune-remote [options] <remote>
+
+  Removes binaries from the remote binary store which are not referenced by
+  any commit on the branches & tags which have been pushed to the remote.
+
+  The branches & tags are read from the remote itself, and every commit they
+  point to must already be present locally, so run 'git fetch <remote>' first.
+  Binaries used only by commits which have never been pushed to git will be
+  deleted, so make sure everyone has pushed their work.
+
+  Only 'smart' remotes can be pruned, and the server must allow you to do it;
+  for git-lob-serve, see the prune-admins setting in doc/git-lob-serve.md.
+  The server keeps binaries uploaded recently even if unreferenced, because
+  the commits using them may not have been pushed to git yet (7 days by
+  default, see the prune-grace-days setting). Servers in write-once retention
+  mode (see retention-days) also keep every binary until its retention period
+  is over; these are reported as held rather than deleted.
+
 Options:
   --quiet, -q          Print less output
   --verbose, -v        Print more output
   --dry-run            Don't actually delete anything, just report
+
 `)
 }
@@ -1,38 +1,149 @@
 package cmd
 
 import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/atlassian/git-lob/core"
 	"github.com/atlassian/git-lob/util"
 )
 
-func Pull() int {
+func Pull(repo *core.Repo) int {
 	// extract the 'prune' option & perform it AFTER the checkout instead of in the Fetch
 	// this is so that user can abort the prune if they want (or carry on working)
-	optPrune := util.GlobalOptions.BoolOpts.Contains("prune")
-	if optPrune {
-		util.GlobalOptions.BoolOpts.Remove("prune")
+	optPrune := postFetchPruneOption()
+	util.GlobalOptions.BoolOpts.Remove("prune")
+	util.GlobalOptions.BoolOpts.Remove("no-prune")
+	util.GlobalOptions.FetchPrune = false
+	if optPrune && !util.GlobalOptions.DryRun && cacheHistoryForPostFetchPrune(repo) {
+		// Prune looks at the same commits as the fetch, only walk their history once
+		defer repo.ClearRecentHistoryCache()
+	}
+	// Likewise the 'link' option is only for the checkout
+	optLink, hasLink := util.GlobalOptions.StringOpts["link"]
+	if hasLink {
+		delete(util.GlobalOptions.StringOpts, "link")
 	}
-	fetchret := Fetch()
-	if fetchret != 0 {
-		// Fetch failed, abort
-		return fetchret
+	// And 'rebase-safe' is for pull itself
+	optRebaseSafe := util.GlobalOptions.BoolOpts.Contains("rebase-safe")
+	if optRebaseSafe {
+		util.GlobalOptions.BoolOpts.Remove("rebase-safe")
 	}
-	// Now run checkout but with no args
+
 	oldArgs := util.GlobalOptions.Args
-	util.GlobalOptions.Args = []string{}
-	ret := Checkout()
+	var ret int
+	if optRebaseSafe {
+		ret = pullRebaseSafe(repo, optLink, hasLink)
+	} else {
+		fetchret := Fetch(repo)
+		if fetchret != 0 {
+			// Fetch failed, abort
+			return fetchret
+		}
+		// Now run checkout but with no args
+		util.GlobalOptions.Args = []string{}
+		if hasLink {
+			util.GlobalOptions.StringOpts["link"] = optLink
+		}
+		ret = Checkout(repo)
+	}
 	util.GlobalOptions.Args = oldArgs
 
 	if optPrune && !util.GlobalOptions.DryRun {
 		// NOW do the prune
 		util.LogConsole("Performing post-pull prune...")
 		util.LogConsole("You can abort this process or carry on working now, pull is complete")
-		PostFetchPullPrune()
+		PostFetchPullPrune(repo)
 	}
 
 	return ret
 
 }
 
+// Pull with 'git pull --rebase', fetching binaries for the incoming commits before the working
+// copy is changed so that they're checked out by git, then only checking out files whose
+// placeholders changed afterwards (any git couldn't, e.g. binaries not on the remote yet)
+func pullRebaseSafe(repo *core.Repo, optLink string, hasLink bool) int {
+
+	// git-lob pull --rebase-safe [<remote> [<branch>]]
+
+	if len(util.GlobalOptions.Args) > 2 {
+		util.LogConsoleError("Too many arguments; --rebase-safe takes at most a remote and a branch")
+		return 9
+	}
+	upstreamRemote, upstreamBranch := repo.GetGitUpstreamBranch(repo.GetGitCurrentBranch())
+	var remoteName, branch string
+	if len(util.GlobalOptions.Args) > 0 {
+		remoteName = util.GlobalOptions.Args[0]
+		if len(util.GlobalOptions.Args) > 1 {
+			branch = util.GlobalOptions.Args[1]
+		} else if remoteName == upstreamRemote {
+			branch = upstreamBranch
+		}
+	} else {
+		remoteName, branch = upstreamRemote, upstreamBranch
+	}
+	if remoteName == "" || branch == "" {
+		util.LogConsoleError("git-lob: the current branch isn't tracking a branch of this remote, please specify the remote & branch to pull")
+		return 7
+	}
+
+	oldHead, err := repo.GitRefToFullSHA("HEAD")
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 7
+	}
+	if err = repo.GitFetch(remoteName); err != nil {
+		util.LogConsoleErrorf("git-lob: git fetch %v failed: %v\n", remoteName, err)
+		return 12
+	}
+	incoming, err := repo.GitRefToFullSHA(fmt.Sprintf("refs/remotes/%v/%v", remoteName, branch))
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 7
+	}
+	if incoming != oldHead {
+		// Binaries for the incoming commits only
+		util.GlobalOptions.Args = []string{remoteName, fmt.Sprintf("%v..%v", oldHead, incoming)}
+		fetchret := Fetch(repo)
+		if fetchret != 0 {
+			return fetchret
+		}
+	}
+	if util.GlobalOptions.DryRun {
+		return 0
+	}
+
+	if err = repo.GitPullRebase(remoteName, branch); err != nil {
+		util.LogConsoleErrorf("git-lob: git pull --rebase failed: %v\n", err)
+		util.LogConsoleError("Once you've resolved any conflicts & finished the rebase, run 'git lob checkout'")
+		return 12
+	}
+	newHead, err := repo.GitRefToFullSHA("HEAD")
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 7
+	}
+	changed, err := repo.GetGitLOBFilesChangedBetween(oldHead, newHead)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 7
+	}
+	if len(changed) == 0 {
+		util.LogConsole("No binary files were changed by the pull")
+		return 0
+	}
+	// Paths are relative to the root but checkout takes them relative to the current dir
+	util.GlobalOptions.Args = make([]string, 0, len(changed))
+	for _, file := range changed {
+		util.GlobalOptions.Args = append(util.GlobalOptions.Args, filepath.Join(repo.Root, file))
+	}
+	if hasLink {
+		util.GlobalOptions.StringOpts["link"] = optLink
+	}
+	return Checkout(repo)
+}
+
 func PullHelp() {
 	util.LogConsole(`Usage: git-lob pull [options] [<remote> [<ref>...]]
 
@@ -50,6 +161,20 @@ func PullHelp() {
   See 'git lob fetch --help' for full details of the options & parameters you
   can pass to this command, they are the same. Also see
   'git lob checkout --help' for information on how the second stage works.
+  The checkout --link option can also be passed to this command, and
+  --workspace limits both the fetch & the checkout to that workspace.
+
+  With --rebase-safe this command runs 'git pull --rebase' as well, for the
+  remote & branch your current branch tracks unless you specify them:
+
+    git lob pull --rebase-safe [<remote> [<branch>]]
+
+  It runs 'git fetch', then fetches the binaries for the incoming commits
+  before 'git pull --rebase' changes your working copy, so that git can check
+  them out. Afterwards only the binary files the pull changed are checked out
+  again, rather than checking every file in the working copy, which saves a
+  lot of time in large repositories. If the rebase stops because of
+  conflicts, run 'git lob checkout' once you've finished it.
 
 `)
 }
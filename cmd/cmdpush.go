@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"fmt"
-	"regexp"
 	"strings"
 	"time"
 
@@ -12,21 +11,64 @@ import (
 )
 
 // Push command line tool
-func Push() int {
+func Push(repo *core.Repo) int {
 
-	// git-lob push [--all] [--recheck] [--force] [<remote> [<ref>...]]
+	// git-lob push [--all] [--recheck] [--force] [--verify[=deep]] [--limit-rate=<rate>]
+	//              [--include=<paths>] [--exclude=<paths>] [<remote> [<ref>...]]
+	// git-lob push --resume [--verify[=deep]] [--limit-rate=<rate>] [<remote>]
+	// git-lob push --flush-queue [--verify[=deep]] [--limit-rate=<rate>] [<remote>]
 
 	// Validate custom options
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"all", "a", "recheck", "r", "force", "f"})
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"limit-rate", "verify", "include", "exclude"}, []string{"all", "a", "recheck", "r", "force", "f", "resume", "verify", "flush-queue"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
 	}
+	if err := applyLimitRateOption(&util.GlobalOptions.MaxUploadRate); err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
+	if util.GlobalOptions.BoolOpts.Contains("verify") {
+		util.GlobalOptions.PushVerify = core.PushVerifyQuick
+	} else if verify, ok := util.GlobalOptions.StringOpts["verify"]; ok {
+		switch verify {
+		case core.PushVerifyQuick, core.PushVerifyDeep:
+			util.GlobalOptions.PushVerify = verify
+		default:
+			util.LogConsoleErrorf("git-lob: invalid option --verify=%v, must be quick or deep\n", verify)
+			return 9
+		}
+	}
 
 	optAll := util.GlobalOptions.BoolOpts.Contains("all") || util.GlobalOptions.BoolOpts.Contains("a")
 	optRecheck := util.GlobalOptions.BoolOpts.Contains("recheck") || util.GlobalOptions.BoolOpts.Contains("r")
 	optForce := util.GlobalOptions.BoolOpts.Contains("force") || util.GlobalOptions.BoolOpts.Contains("f")
+	optResume := util.GlobalOptions.BoolOpts.Contains("resume")
+	optFlushQueue := util.GlobalOptions.BoolOpts.Contains("flush-queue")
 	optDryRun := util.GlobalOptions.DryRun
+	optInclude, hasInclude := util.GlobalOptions.StringOpts["include"]
+	optExclude, hasExclude := util.GlobalOptions.StringOpts["exclude"]
+
+	// Resuming pushes what the interrupted push was pushing, in the same way
+	if optResume && (optAll || optRecheck || optForce || hasInclude || hasExclude || len(util.GlobalOptions.Args) > 1) {
+		util.LogConsoleError("git-lob: --resume cannot be used with refs, --all, --recheck, --force, --include or --exclude")
+		return 7
+	}
+	// Flushing pushes what was queued, as it was queued
+	if optFlushQueue {
+		if optResume || optAll || optRecheck || optForce || hasInclude || hasExclude || len(util.GlobalOptions.Args) > 1 {
+			util.LogConsoleError("git-lob: --flush-queue cannot be used with refs, --resume, --all, --recheck, --force, --include or --exclude")
+			return 7
+		}
+		return flushPushQueues(repo)
+	}
+	// Path filters on the command line replace those in config
+	if hasInclude {
+		util.GlobalOptions.PushIncludePaths = splitPathsOption(optInclude)
+	}
+	if hasExclude {
+		util.GlobalOptions.PushExcludePaths = splitPathsOption(optExclude)
+	}
 
 	// Determine remote
 	var remoteName string
@@ -57,11 +99,11 @@ func Push() int {
 		}
 
 	} else {
-		remoteName = core.GetGitDefaultRemoteForPush()
+		remoteName = repo.GetGitDefaultRemoteForPush()
 	}
 
 	// check the remote config to make sure it's valid
-	provider, err := providers.GetProviderForRemote(remoteName)
+	provider, err := repo.GetProvider(remoteName)
 	if err != nil {
 		util.LogConsoleErrorf("git-lob: %v\n", err)
 		return 6
@@ -71,10 +113,16 @@ func Push() int {
 		return 6
 	}
 
-	if len(refspecs) == 0 {
+	if optResume {
+		if !repo.HasPushJournal(remoteName) {
+			util.LogConsoleErrorf("git-lob: there is no interrupted push to %v to resume\n", remoteName)
+			return 7
+		}
+		util.LogConsole("Resuming interrupted push of binaries to", remoteName)
+	} else if len(refspecs) == 0 {
 		// No refspecs specified, so determine default
 		if optAll {
-			branches, err := core.GetGitLocalBranches()
+			branches, err := repo.GetGitLocalBranches()
 			if err != nil {
 				util.LogErrorf("git-lob: unable to get local branch list - %v\n", err)
 				return 7
@@ -93,7 +141,7 @@ func Push() int {
 				}
 			} else {
 				// determine refspec from current branch & push settings
-				branches := core.GetGitPushDefaultBranches(remoteName)
+				branches := repo.GetGitPushDefaultBranches(remoteName)
 				for _, s := range branches {
 					refspecs = append(refspecs, &core.GitRefSpec{s, "", ""})
 				}
@@ -101,27 +149,65 @@ func Push() int {
 		}
 	}
 
-	if len(refspecs) == 0 {
+	if !optResume && len(refspecs) == 0 {
 		util.LogConsole("No default refs to push based on config, current HEAD & tracking branches")
 		util.LogConsole("Specify --all or a specific ref/branch to push something")
 		return 0
 	}
 
-	util.LogConsole("Pushing binaries for", refspecs, "to", remoteName)
+	// Queue the push instead when offline
+	if !optResume {
+		if queue, ret := queuePushIfOffline(repo, provider, remoteName, refspecs, optDryRun, optForce, optRecheck); queue {
+			return ret
+		}
+		if queued, _ := repo.GetQueuedPushes(remoteName); len(queued) > 0 {
+			util.LogConsolef("%d push(es) to %v queued while offline haven't been made yet, use 'git lob push --flush-queue' to make them\n",
+				len(queued), remoteName)
+		}
+	}
+
+	if !optResume {
+		util.LogConsole("Pushing binaries for", refspecs, "to", remoteName)
+		if len(util.GlobalOptions.PushIncludePaths) > 0 || len(util.GlobalOptions.PushExcludePaths) > 0 {
+			util.LogConsole("Only pushing binaries in selected paths, commits will not be recorded as pushed")
+		}
+	}
 
 	// Warn about long calculation processes
-	if optRecheck {
+	if optResume {
+		// nothing to calculate for the interrupted part
+	} else if repo.HasPushJournal(remoteName) {
+		util.LogConsole("Previous push to", remoteName, "was interrupted, files it uploaded will be skipped")
+		util.LogConsole("Use 'git lob push --resume' next time to also skip calculating what to push")
+	} else if optRecheck {
 		util.LogConsole("Re-checking all history as requested, this may take a while on large repos")
-	} else if !core.HasPushedBinaryState(remoteName) {
+	} else if !repo.HasPushedBinaryState(remoteName) {
 		util.LogConsole("No cached state for this remote, first time may take a while on large repos")
 	}
 
+	// Record what's being pushed for the remote's secondaries first, so it's replicated even if
+	// replication can't start afterwards (an interrupted push recorded it already)
+	if !optDryRun && !optResume {
+		recordPendingReplication(repo, remoteName, refspecs, optForce, optRecheck)
+	}
+
+	var hookSummary *core.TransferHookSummary
+	if !optDryRun {
+		hookSummary = core.NewTransferHookSummary([]string{remoteName}, refSpecStrings(refspecs))
+		if !runPreTransferHook(repo, core.TransferHookPrePush, hookSummary) {
+			return 12
+		}
+	}
+
 	// Do the actual pushing in Goroutine, because we want to update the download rate & time estimates
 	// on a regular schedule, regardless of whether any actual callbacks are received
 	// If we only updated when callbacks happened (ie when data was transferred), if the data transfer halts
 	// then we'd never update the rates / time estimates.
 
 	var pusherr error
+	// Ctrl+C stops after the file in progress, keeping what was pushed
+	releaseInterrupt := util.CancelOnInterrupt()
+	defer releaseInterrupt()
 
 	// 100 items in the queue should be good enough, this means that it won't block
 	callbackChan := make(chan *util.ProgressCallbackData, 100)
@@ -129,13 +215,21 @@ func Push() int {
 		progresschan chan<- *util.ProgressCallbackData) {
 
 		// Progress callback just passes the result back to the channel
-		progress := func(data *util.ProgressCallbackData) (abort bool) {
+		var progress util.ProgressCallback = func(data *util.ProgressCallbackData) (abort bool) {
 			progresschan <- data
 
 			return false
 		}
+		if hookSummary != nil {
+			progress = core.TrackTransferHookSummary(hookSummary, progress)
+		}
 
-		err := core.Push(provider, remoteName, refspecs, dryRun, force, recheck, progress)
+		var err error
+		if optResume {
+			err = repo.ResumePush(provider, remoteName, dryRun, progress)
+		} else {
+			err = repo.Push(provider, remoteName, refspecs, dryRun, force, recheck, progress)
+		}
 
 		close(progresschan)
 
@@ -148,7 +242,17 @@ func Push() int {
 	// Update the console once every half second regardless of how many callbacks
 	// (or zero callbacks, so we can reduce xfer rate)
 	pushCounts := util.ReportProgressToConsole(callbackChan, "Push", time.Millisecond*500)
+	if hookSummary != nil {
+		runPostTransferHook(repo, core.TransferHookPostPush, hookSummary, pusherr)
+	}
 
+	if pusherr != nil && util.IsCancelled() {
+		util.LogConsoleError("Push to", remoteName, "was interrupted; commits whose binaries were all uploaded are recorded as pushed")
+		if !optDryRun {
+			util.LogConsoleError("Use 'git lob push --resume' to carry on where it stopped")
+		}
+		return 130
+	}
 	if pusherr != nil {
 		util.LogErrorf("git-lob: push error(s):\n%v\n", pusherr.Error())
 		return 12
@@ -167,21 +271,215 @@ func Push() int {
 		}
 	}
 	provider.Release()
+	if !util.GlobalOptions.DryRun {
+		PostTransferSharedStoreGC(repo)
+		startReplication(repo, remoteName)
+	}
+
+	return 0
+}
+
+// Record a push as pending replication to the remote's secondaries, if it has any; only warns
+// if it can't since the push itself can still be made
+func recordPendingReplication(repo *core.Repo, remoteName string, refspecs []*core.GitRefSpec, force, recheck bool) {
+	if _, err := repo.RecordPendingReplication(remoteName, refspecs, force, recheck); err != nil {
+		util.LogConsoleErrorf("Warning: unable to record replication of this push - %v\n", err.Error())
+	}
+}
+
+// Queue a push instead of making it if git-lob.offline says so, returning whether it was queued
+// (or would have been, for a dry run) & the exit code if it was
+func queuePushIfOffline(repo *core.Repo, provider providers.SyncProvider, remoteName string, refspecs []*core.GitRefSpec,
+	dryRun, force, recheck bool) (queue bool, ret int) {
+
+	switch util.GlobalOptions.Offline {
+	case "true":
+		util.LogConsole("Working offline (git-lob.offline), not connecting to", remoteName)
+	case "auto":
+		err := core.CheckRemoteConnection(provider, remoteName)
+		if err == nil {
+			return false, 0
+		}
+		util.LogConsoleErrorf("Unable to reach %v, working offline: %v\n", remoteName, err.Error())
+	default:
+		return false, 0
+	}
+	provider.Release()
+	if dryRun {
+		util.LogConsole("Would queue push of binaries for", refspecs, "to", remoteName)
+		return true, 0
+	}
+	push, err := repo.QueuePush(remoteName, refspecs, force, recheck)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: unable to queue push - %v\n", err.Error())
+		return true, 12
+	}
+	util.LogConsolef("Queued push of binaries for %v to %v (queued %v)\n", push.Refspecs, remoteName, push.Queued.Format("2006-01-02 15:04"))
+	// Replicated as queued, once the queue is flushed
+	recordPendingReplication(repo, remoteName, refspecs, force, recheck)
+	util.LogConsole("Use 'git lob push --flush-queue' to make queued pushes once you're back online")
+	return true, 0
+}
 
+// Make the pushes queued while offline, to the remote given or all remotes
+func flushPushQueues(repo *core.Repo) int {
+	var remoteNames []string
+	if len(util.GlobalOptions.Args) > 0 {
+		remoteNames = util.GlobalOptions.Args[:1]
+	} else {
+		var err error
+		remoteNames, err = repo.GetRemotesWithQueuedPushes()
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: unable to read push queues - %v\n", err.Error())
+			return 12
+		}
+	}
+	var flushed bool
+	for _, remoteName := range remoteNames {
+		queued, err := repo.GetQueuedPushes(remoteName)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: %v\n", err.Error())
+			return 12
+		}
+		if len(queued) == 0 {
+			continue
+		}
+		flushed = true
+		if ret := flushPushQueue(repo, remoteName, queued); ret != 0 {
+			return ret
+		}
+	}
+	if !flushed {
+		util.LogConsole("No pushes are queued")
+	}
 	return 0
 }
 
+// Make the pushes queued for one remote
+func flushPushQueue(repo *core.Repo, remoteName string, queued []*core.QueuedPush) int {
+	provider, err := repo.GetProvider(remoteName)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 6
+	}
+	if err = provider.ValidateConfig(remoteName); err != nil {
+		util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+		return 6
+	}
+	defer provider.Release()
+	util.LogConsolef("Making %d queued push(es) to %v\n", len(queued), remoteName)
+
+	var refspecs []string
+	for _, push := range queued {
+		refspecs = append(refspecs, push.Refspecs...)
+	}
+	var hookSummary *core.TransferHookSummary
+	if !util.GlobalOptions.DryRun {
+		hookSummary = core.NewTransferHookSummary([]string{remoteName}, refspecs)
+		if !runPreTransferHook(repo, core.TransferHookPrePush, hookSummary) {
+			return 12
+		}
+	}
+
+	var pusherr error
+	releaseInterrupt := util.CancelOnInterrupt()
+	defer releaseInterrupt()
+	callbackChan := make(chan *util.ProgressCallbackData, 100)
+	go func() {
+		var progress util.ProgressCallback = func(data *util.ProgressCallbackData) (abort bool) {
+			callbackChan <- data
+			return false
+		}
+		if hookSummary != nil {
+			progress = core.TrackTransferHookSummary(hookSummary, progress)
+		}
+		started := func(push *core.QueuedPush) {
+			callbackChan <- &util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Pushing binaries for %v (queued %v)",
+				push.Refspecs, push.Queued.Format("2006-01-02 15:04")), 0, 0, 0, 0, nil}
+		}
+		pusherr = repo.FlushPushQueue(provider, remoteName, util.GlobalOptions.DryRun, started, progress)
+		close(callbackChan)
+	}()
+	pushCounts := util.ReportProgressToConsole(callbackChan, "Push", time.Millisecond*500)
+	if hookSummary != nil {
+		runPostTransferHook(repo, core.TransferHookPostPush, hookSummary, pusherr)
+	}
+
+	if pusherr != nil {
+		util.LogErrorf("git-lob: push error(s):\n%v\n", pusherr.Error())
+		util.LogConsoleError("Pushes which weren't made are still queued")
+		return 12
+	}
+	if util.GlobalOptions.DryRun {
+		util.LogConsole("Done, run again without --dry-run to make the queued pushes")
+	} else if pushCounts.ErrorCount > 0 || pushCounts.NotFoundCount > 0 {
+		util.LogConsole("WARNING: not all data was pushed, push again to re-try")
+	} else {
+		util.LogConsole("Successfully made queued pushes to", remoteName)
+	}
+	if !util.GlobalOptions.DryRun {
+		PostTransferSharedStoreGC(repo)
+		startReplication(repo, remoteName)
+	}
+	return 0
+}
+
+// Split a comma separated list of paths given as an option
+func splitPathsOption(opt string) []string {
+	var ret []string
+	for _, p := range strings.Split(opt, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// Get refspecs as given, for transfer hooks
+func refSpecStrings(refspecs []*core.GitRefSpec) []string {
+	ret := make([]string, 0, len(refspecs))
+	for _, refspec := range refspecs {
+		ret = append(ret, refspec.String())
+	}
+	return ret
+}
+
+// Run the hook before a push or fetch, returning false if it failed so the transfer should stop
+func runPreTransferHook(repo *core.Repo, hook string, summary *core.TransferHookSummary) bool {
+	if err := repo.RunTransferHook(hook, summary); err != nil {
+		util.LogConsoleErrorf("git-lob: stopped by the %v hook:\n%v\n", hook, err.Error())
+		return false
+	}
+	return true
+}
+
+// Run the hook after a push or fetch, which only warns if it fails since the transfer is done
+func runPostTransferHook(repo *core.Repo, hook string, summary *core.TransferHookSummary, transferErr error) {
+	summary.Success = transferErr == nil
+	if transferErr != nil {
+		summary.Error = transferErr.Error()
+	}
+	if err := repo.RunTransferHook(hook, summary); err != nil {
+		util.LogConsoleErrorf("Warning: %v\n", err.Error())
+	}
+}
+
 // Low level push command line tool
-func PushLob() int {
+func PushLob(repo *core.Repo) int {
 
-	// git-lob push-lob [--force] <remote> <sha>...
+	// git-lob push-lob [--force] [--limit-rate=<rate>] <remote> <sha>...
 
 	// Validate custom options
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"force", "f"})
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"limit-rate"}, []string{"force", "f"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
 	}
+	if err := applyLimitRateOption(&util.GlobalOptions.MaxUploadRate); err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
 
 	if len(util.GlobalOptions.Args) < 2 {
 		util.LogConsoleError("Too few arguments; must supply remote and at least one SHA")
@@ -194,7 +492,7 @@ func PushLob() int {
 	remoteName := util.GlobalOptions.Args[0]
 
 	// check the remote config to make sure it's valid
-	provider, err := providers.GetProviderForRemote(remoteName)
+	provider, err := repo.GetProvider(remoteName)
 	if err != nil {
 		util.LogConsoleError(err.Error())
 		return 6
@@ -207,9 +505,8 @@ func PushLob() int {
 	// Remaining args are SHAs
 	shas := util.GlobalOptions.Args[1:]
 	// Validate that they are SHAs
-	shaRegex := regexp.MustCompile("^[A-Fa-f0-9]{40}$")
 	for _, sha := range shas {
-		if !shaRegex.MatchString(sha) {
+		if !core.IsLOBSHA(sha) {
 			util.LogConsoleErrorf("Invalid SHA: %v\n", sha)
 			return 9
 		}
@@ -234,13 +531,7 @@ func PushLob() int {
 			return false
 		}
 
-		var err error
-		for _, sha := range shas {
-			err = core.PushSingle(sha, provider, remoteName, force, progress)
-			if err != nil {
-				break
-			}
-		}
+		err := repo.PushMultiple(shas, nil, provider, remoteName, force, progress)
 
 		close(progresschan)
 
@@ -288,9 +579,12 @@ Parameters:
             in .git/config. See REMOTES below for more details, additional
             config parameters are required in the remote.
 
-            If no remote is specified, branch.*.remote configuration for the
-            current branch is consulted to determine where to push. If the 
-            configuration is missing, it defaults to origin.
+            If no remote is specified, the same configuration as git uses
+            determines where to push: branch.<name>.pushRemote for the
+            current branch, then remote.pushDefault, then branch.<name>.remote.
+            If none of these are set, it defaults to origin. So in triangular
+            workflows (fetching from upstream & pushing to a fork) binaries
+            are pushed where commits are.
      <ref>: Which local reference(s) up to which we should make sure binaries
             are uploaded for. You can specify zero, one, or many local refs.
             There is no destination ref as in git push.
@@ -316,10 +610,72 @@ Options:
                 See HISTORY CHECKING below for more details.
   --force, -f   Always upload files even if the provider believes the file is 
                 already present on the remote. You shouldn't need this.
+  --resume      Carry on with a push to <remote> which was interrupted, 
+                without calculating again what needs to be pushed. Only the 
+                files which weren't uploaded yet are sent. Cannot be used with
+                refs or other options except --verify, --limit-rate & 
+                --dry-run. See INTERRUPTED PUSHES below.
+  --flush-queue Make the pushes queued while working offline, to <remote>
+                or to every remote with queued pushes, oldest first. Cannot
+                be used with refs or other options except --verify,
+                --limit-rate & --dry-run. See WORKING OFFLINE below.
+  --verify[=deep]
+                After uploading the binaries for each commit, read them back
+                from the remote before recording the commit as pushed, to
+                catch storage problems straight away. --verify checks that
+                the metadata matches and every file is there at the right
+                size; --verify=deep downloads everything again and checks the
+                content SHA, which is slow but thorough. Overrides
+                git-lob.push-verify.
+  --limit-rate=<rate>
+                Limit the total upload rate, e.g. 500K or 2MB (per second), 
+                so as not to saturate a shared connection. Overrides 
+                git-lob.max-upload-rate.
+  --include=<paths>
+                Only push binaries in matching paths, comma separated, e.g. 
+                --include=art/final to publish finished art but not local
+                scratch renders. Wildcards match as for git-lob.fetch-include.
+                Overrides git-lob.push-include.
+  --exclude=<paths>
+                Do not push binaries in matching paths, same rules as
+                --include. Overrides git-lob.push-exclude.
+                Because some binaries may not have been pushed, commits are
+                not recorded as pushed when --include or --exclude is used
+                (or configured), so the next push checks them again.
   --quiet, -q   Print less output
   --verbose, -v Print more output
   --dry-run     Don't actually push anything, just report
 
+INTERRUPTED PUSHES
+
+While pushing, git-lob keeps a journal of what it's pushing for each remote
+and which files have been uploaded so far. If the push is interrupted (e.g.
+the connection drops or you press Ctrl-C), the next push to that remote skips
+the files which were already uploaded. 'git lob push --resume' goes further
+and carries on exactly where the interrupted push left off, without searching
+history again, which can take a while on large repos. The journal is removed
+once a push completes.
+
+Pressing Ctrl-C (or sending SIGTERM) stops the push once the file being
+uploaded is finished or abandoned, so that the journal & the record of
+pushed commits are left consistent; press Ctrl-C again to stop immediately.
+
+WORKING OFFLINE
+
+When git-lob.offline is true, push doesn't connect to the remote, it records
+what it would push in a queue instead; with git-lob.offline = auto it only
+does that if the remote can't be reached. Refs are recorded as the commits
+they point to at the time, so branches can move on before the queue is
+flushed. When you're back online, 'git lob push --flush-queue' makes the
+queued pushes in order; any which fail stay queued for next time. Queued
+pushes aren't made by a plain 'git lob push', which reminds you they exist.
+
+REPLICATION
+
+When remote.<remote>.git-lob-replicate-to lists secondary remotes, each push
+to <remote> is also pushed to them afterwards, in the background by default.
+See 'git lob replicate --help'.
+
 HISTORY CHECKING
 
 When pushing binaries for a given ref, git-lob performs a search for commits
@@ -336,7 +692,13 @@ These records are updated whenever you git-lob push/pull. We do not use git's
 own remote branch refs to track this, because pushing commits can be done
 completely separately from binaries so we can't rely on that information.
 So pushing and pulling branches in git has no effect on this state, only
-git-lob push/pull.
+git-lob push/pull. Each push updates these records in a single transaction,
+so an interrupted push never leaves them half-updated; what it did finish is
+recovered by the next push, or by 'git lob push-state verify --fix'.
+
+If you rewrite history that was already pushed (e.g. an interactive rebase),
+'git lob reconcile-pushed' moves these records to the rewritten commits; push
+does this itself when a recorded commit no longer exists.
 
 If for some reason these records are wrong, and you need to push binaries
 for a bigger range of commits, you can do this 2 ways:
@@ -371,6 +733,9 @@ func PushLobHelp() {
   This is a low-level alternative to the main push command, allowing
   you to manually upload a specific binary identified by its SHA.
   Files already on the remote are still skipped unless you use --force.
+  Like push, binaries larger than git-lob.push-delta-size are uploaded as
+  deltas to smart servers which already have another version of the same
+  file, falling back on uploading them in full if that fails.
 
   Does not check or update the remote state cache recording what we
   think has already been pushed to this remote.
@@ -388,6 +753,10 @@ Parameters:
 Options:
   --force, -f   Always upload files even if the provider believes the file is 
                 already present on the remote. You shouldn't need this.
+  --limit-rate=<rate>
+                Limit the total upload rate, e.g. 500K or 2MB (per second), 
+                so as not to saturate a shared connection. Overrides 
+                git-lob.max-upload-rate.
   --quiet, -q   Print less output
   --verbose, -v Print more output
 
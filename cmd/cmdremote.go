@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/atlassian/git-lob/core"
@@ -9,11 +10,11 @@ import (
 )
 
 // Command line low-level tool to manually mark a remote/commit combo as pushed
-func MarkPushed() int {
+func MarkPushed(repo *core.Repo) int {
 	// git-lob mark-pushed <remote> <ref>...
+	// git-lob mark-pushed --from-fetch [--dry-run] <remote> [<ref>...]
 
-	// Validate custom options (none)
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{})
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"from-fetch"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
@@ -26,10 +27,13 @@ func MarkPushed() int {
 	// first parameter must be remote
 	remoteName := util.GlobalOptions.Args[0]
 	// Check valid remote
-	if !core.IsGitRemote(remoteName) {
+	if !repo.IsGitRemote(remoteName) {
 		util.LogConsoleError(remoteName, "is not a valid remote name")
 		return 9
 	}
+	if util.GlobalOptions.BoolOpts.Contains("from-fetch") {
+		return markPushedFromFetch(repo, remoteName, util.GlobalOptions.Args[1:])
+	}
 
 	if len(util.GlobalOptions.Args) > 1 {
 		// Remaining args are refs
@@ -42,7 +46,7 @@ func MarkPushed() int {
 				// already a full sha
 				expandedrefs = append(expandedrefs, ref)
 			} else {
-				expanded, err := core.GitRefToFullSHA(ref)
+				expanded, err := repo.GitRefToFullSHA(ref)
 				if err != nil {
 					util.LogConsoleErrorf("Invalid ref '%v': %v\n", ref, err.Error())
 					return 12
@@ -55,7 +59,7 @@ func MarkPushed() int {
 		util.LogConsole("Marking", remoteName, "as pushed at", refs)
 
 		for i, sha := range expandedrefs {
-			err := core.MarkBinariesAsPushed(remoteName, sha, "")
+			err := repo.MarkBinariesAsPushed(remoteName, sha, "")
 			if err != nil {
 				util.LogErrorf("Unable to mark %v as pushed at %v (%v): %v\n", remoteName, sha, refs[i], err.Error())
 			} else {
@@ -63,7 +67,7 @@ func MarkPushed() int {
 			}
 		}
 	} else {
-		err := core.MarkAllBinariesPushed(remoteName)
+		err := repo.MarkAllBinariesPushed(remoteName)
 		if err != nil {
 			util.LogErrorf("Unable to mark %v as pushed: %v\n", remoteName, err.Error())
 		} else {
@@ -75,6 +79,55 @@ func MarkPushed() int {
 
 }
 
+// Mark commits as pushed as a fetch from the remote would have
+func markPushedFromFetch(repo *core.Repo, remoteName string, refs []string) int {
+	provider, err := repo.GetProvider(remoteName)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 6
+	}
+	if err = provider.ValidateConfig(remoteName); err != nil {
+		util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+		return 6
+	}
+	defer provider.Release()
+	var refspecs []*core.GitRefSpec
+	for _, ref := range refs {
+		refspecs = append(refspecs, core.ParseGitRefSpec(ref))
+	}
+
+	releaseInterrupt := util.CancelOnInterrupt()
+	defer releaseInterrupt()
+	progress := func(data *util.ProgressCallbackData) (abort bool) {
+		if data.Type == util.ProgressCalculate {
+			util.LogConsole(data.Desc)
+		}
+		return false
+	}
+	if len(refs) == 0 {
+		util.LogConsole("Checking binaries at recent refs are on", remoteName)
+	} else {
+		util.LogConsole("Checking binaries at", refs, "are on", remoteName)
+	}
+	commits, err := repo.MarkPushedFromFetch(&core.FetchRemote{Name: remoteName, Provider: provider}, refspecs, util.GlobalOptions.DryRun, progress)
+	if err != nil {
+		util.LogConsoleErrorf("Unable to mark %v as pushed: %v\n", remoteName, err.Error())
+		return 12
+	}
+	if len(commits) == 0 {
+		util.LogConsole("Nothing can be marked as pushed, earlier commits have binaries which aren't on", remoteName)
+		return 0
+	}
+	for _, sha := range commits {
+		if util.GlobalOptions.DryRun {
+			util.LogConsolef("Would mark %v as pushed at %v\n", remoteName, sha)
+		} else {
+			util.LogConsolef("Marked %v as pushed at %v\n", remoteName, sha)
+		}
+	}
+	return 0
+}
+
 func MarkPushedHelp() {
 	util.LogConsole(`Usage: git-lob mark-pushed [options] <remote> [<ref>...]
 
@@ -91,15 +144,24 @@ func MarkPushedHelp() {
   to all the binaries you have locally. Without doing this, the first push
   of binaries to this fork will take much longer as it scans all history.
 
+  With --from-fetch, commits are only marked as pushed if a fetch of the
+  same refs from the remote would have marked them (see
+  git-lob.fetch-updates-push-state in 'git lob help config'), checking the
+  remote has every binary they need, but nothing is downloaded. Use it to
+  update the remote state cache on your own terms when fetch is set not to.
+
 Parameters:
   <remote>: The name of the remote.
 
      <ref>: One or more refs or commit SHAs at which to record as pushed. 
             Any ancestors of this ref are also assumed to be pushed. 
             If you don't supply any refs, all refs are marked pushed (which
-            is what you might do when adding a fork)
+            is what you might do when adding a fork). With --from-fetch
+            no refs means the recent refs a plain 'git lob fetch' fetches.
 
 Options:
+  --from-fetch  Only mark the commits a fetch of <ref>s would have
+  --dry-run     With --from-fetch, report what would be marked
   --quiet, -q   Print less output
   --verbose, -v Print more output
 
@@ -108,7 +170,7 @@ Options:
 }
 
 // Command line low-level tool to manually reset the pushed state of a remote
-func ResetPushed() int {
+func ResetPushed(repo *core.Repo) int {
 	// git-lob reset-pushed <remote>
 
 	// Validate custom options (none)
@@ -126,12 +188,12 @@ func ResetPushed() int {
 	remoteName := util.GlobalOptions.Args[0]
 
 	// Check valid remote
-	if !core.IsGitRemote(remoteName) {
+	if !repo.IsGitRemote(remoteName) {
 		util.LogConsoleError(remoteName, "is not a valid remote name")
 		return 9
 	}
 
-	err := core.ResetPushedBinaryState(remoteName)
+	err := repo.ResetPushedBinaryState(remoteName)
 	if err != nil {
 		util.LogError("Unable to reset pushed marker for", remoteName, ": ", err.Error())
 		return 12
@@ -166,7 +228,7 @@ Options:
 }
 
 // Command line low-level tool to report the last pushed ancestor of a ref
-func LastPushed() int {
+func LastPushed(repo *core.Repo) int {
 	// git-lob last-pushed <remote> <ref>
 
 	// Validate custom options (none)
@@ -183,20 +245,20 @@ func LastPushed() int {
 	// first parameter must be remote
 	remoteName := util.GlobalOptions.Args[0]
 	// Check valid remote
-	if !core.IsGitRemote(remoteName) {
+	if !repo.IsGitRemote(remoteName) {
 		util.LogConsoleError(remoteName, "is not a valid remote name")
 		return 9
 	}
 
 	ref := util.GlobalOptions.Args[1]
 	// Convert the ref into a SHA
-	commitSHA, err := core.GitRefToFullSHA(ref)
+	commitSHA, err := repo.GitRefToFullSHA(ref)
 	if err != nil {
 		util.LogConsoleErrorf("Invalid ref: %v: %v\n", ref, err.Error())
 		return 9
 	}
 
-	last, err := core.FindLatestAncestorWhereBinariesPushed(remoteName, commitSHA)
+	last, err := repo.FindLatestAncestorWhereBinariesPushed(remoteName, commitSHA)
 	if err != nil {
 		util.LogErrorf("Unable to locate last pushed commit for %v at %v: %v\n", remoteName, ref, err.Error())
 		return 12
@@ -236,3 +298,176 @@ Options:
 
 `)
 }
+
+// Command line low-level tool to check & repair the pushed state of remotes
+func PushState(repo *core.Repo) int {
+	// git-lob push-state verify [--fix] [<remote>...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"fix"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+
+	if len(util.GlobalOptions.Args) < 1 || util.GlobalOptions.Args[0] != "verify" {
+		util.LogConsoleError("Must supply a push-state command; the only command is 'verify'")
+		return 9
+	}
+	optFix := util.GlobalOptions.BoolOpts.Contains("fix")
+	remotes := util.GlobalOptions.Args[1:]
+	if len(remotes) == 0 {
+		var err error
+		remotes, err = repo.GetGitRemotes()
+		if err != nil {
+			util.LogConsoleErrorf("Unable to get remotes: %v\n", err.Error())
+			return 12
+		}
+	}
+	for _, remoteName := range remotes {
+		if !repo.IsGitRemote(remoteName) {
+			util.LogConsoleError(remoteName, "is not a valid remote name")
+			return 9
+		}
+	}
+
+	ret := 0
+	for _, remoteName := range remotes {
+		problems, err := repo.VerifyPushState(remoteName, optFix)
+		for _, problem := range problems {
+			util.LogConsolef(" * %v: %v\n", remoteName, problem)
+		}
+		if err != nil {
+			util.LogConsoleErrorf("Unable to repair push state for %v: %v\n", remoteName, err.Error())
+			ret = 12
+		} else if len(problems) == 0 {
+			util.LogConsolef("Push state for %v is OK\n", remoteName)
+		} else if optFix {
+			util.LogConsolef("Repaired push state for %v\n", remoteName)
+		} else if ret == 0 {
+			ret = 1
+		}
+	}
+	if ret == 1 {
+		util.LogConsole("Use --fix to repair")
+	}
+	return ret
+
+}
+
+func PushStateHelp() {
+	util.LogConsole(`Usage: git-lob push-state verify [options] [<remote>...]
+
+  Checks the cached pushed state for remotes for problems, & repairs them
+
+  git-lob records which commits have had their binaries pushed to each remote
+  so it doesn't have to check the whole history when pushing (see HISTORY
+  CHECKING in 'git lob push --help'). Each push updates it in one transaction,
+  so if a push is interrupted the commits it had finished are not recorded
+  until its transaction is recovered, which the next push does automatically.
+
+  This command reports interrupted pushes, corrupt push state, updates which
+  were not applied and commits which no longer exist (e.g. after a rebase).
+  None of these prevent pushing, but they can make the next push check more
+  history than it needs to. Unlike 'git lob push --recheck', repairing doesn't
+  throw away the pushed state.
+
+  Exits with status 1 if problems were found but not repaired.
+
+Parameters:
+  <remote>: The name of a remote to check. Default is all remotes.
+
+Options:
+  --fix         Repair the problems found
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+
+}
+
+// Command line low-level tool to remap pushed state after history is rewritten
+func ReconcilePushed(repo *core.Repo) int {
+	// git-lob reconcile-pushed [--dry-run] [<remote>...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	remotes := util.GlobalOptions.Args
+	if len(remotes) == 0 {
+		var err error
+		remotes, err = repo.GetGitRemotes()
+		if err != nil {
+			util.LogConsoleErrorf("Unable to get remotes: %v\n", err.Error())
+			return 12
+		}
+	}
+	for _, remoteName := range remotes {
+		if !repo.IsGitRemote(remoteName) {
+			util.LogConsoleError(remoteName, "is not a valid remote name")
+			return 9
+		}
+	}
+
+	dryRun := util.GlobalOptions.DryRun
+	for _, remoteName := range remotes {
+		result, err := repo.ReconcilePushedState(remoteName, dryRun)
+		if err != nil {
+			util.LogConsoleErrorf("Unable to reconcile push state for %v: %v\n", remoteName, err.Error())
+			return 12
+		}
+		var remapped []string
+		for stale := range result.Remapped {
+			remapped = append(remapped, stale)
+		}
+		sort.Strings(remapped)
+		for _, stale := range remapped {
+			util.LogConsolef(" * %v: %v was rewritten as %v\n", remoteName, stale[:7], result.Remapped[stale][:7])
+		}
+		for _, stale := range result.Kept {
+			util.LogConsolef(" * %v: %v is no longer on any branch; kept, since what replaced it adds other binaries\n", remoteName, stale[:7])
+		}
+		for _, stale := range result.Dropped {
+			util.LogConsolef(" * %v: %v no longer exists & will be removed\n", remoteName, stale[:7])
+		}
+		if !result.Changed() {
+			util.LogConsolef("Push state for %v is up to date\n", remoteName)
+		} else if dryRun {
+			util.LogConsolef("Push state for %v would have been updated\n", remoteName)
+		} else {
+			util.LogConsolef("Updated push state for %v (%d remapped, %d removed)\n", remoteName, len(result.Remapped), len(result.Dropped))
+		}
+	}
+	return 0
+}
+
+func ReconcilePushedHelp() {
+	util.LogConsole(`Usage: git-lob reconcile-pushed [options] [<remote>...]
+
+  Updates the pushed state for remotes after history has been rewritten, e.g.
+  by an interactive rebase, squash or amend.
+
+  The commits git-lob records as pushed (see HISTORY CHECKING in 'git lob push
+  --help') may no longer be on any branch after a rebase, or may have been
+  removed from the repository, which makes the next push check much more
+  history than it needs to. Each such commit is remapped to the commit its
+  branch was rewritten as, found from the branch reflogs, provided every
+  binary added by the new commit's history was added by the old one's, so
+  was pushed with it. Those which can't be remapped are left as they are
+  while they exist, and removed once they don't.
+
+  Push does this automatically when a commit recorded as pushed no longer
+  exists.
+
+Parameters:
+  <remote>: The name of a remote to reconcile. Default is all remotes.
+
+Options:
+  --dry-run     Just report what would change
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+
+}
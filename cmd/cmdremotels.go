@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Remote ls command line tool
+func RemoteLs(repo *core.Repo) int {
+
+	// git-lob remote-ls [--orphans | --summary] [<remote>]
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"orphans", "summary"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	optOrphans := util.GlobalOptions.BoolOpts.Contains("orphans")
+	optSummary := util.GlobalOptions.BoolOpts.Contains("summary")
+	if optOrphans && optSummary {
+		util.LogConsoleError("git-lob: --orphans and --summary can't be used together")
+		return 9
+	}
+	if len(util.GlobalOptions.Args) > 1 {
+		util.LogConsoleError("Too many arguments; only one remote can be listed at a time")
+		return 9
+	}
+
+	var remoteName string
+	if len(util.GlobalOptions.Args) > 0 {
+		remoteName = util.GlobalOptions.Args[0]
+		if !repo.IsGitRemote(remoteName) {
+			util.LogConsoleError(remoteName, "is not a valid remote name")
+			return 9
+		}
+	} else {
+		remoteName = repo.GetGitDefaultRemoteForPush()
+	}
+	provider, err := repo.GetProvider(remoteName)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+		return 6
+	}
+	defer provider.Release()
+
+	listing, err := repo.ListRemote(provider, remoteName, func() {
+		util.LogConsoleSpinner("Listing: ")
+	})
+	util.LogConsoleSpinnerFinish("Listing: ")
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: unable to list %v: %v\n", remoteName, err.Error())
+		return 12
+	}
+
+	if !optSummary {
+		for _, lob := range listing.LOBs {
+			if lob.Referenced {
+				if !optOrphans {
+					util.LogConsolef("%v %10v\n", lob.SHA, util.FormatSize(lob.Size))
+				}
+			} else {
+				util.LogConsolef("%v %10v orphan\n", lob.SHA, util.FormatSize(lob.Size))
+			}
+		}
+	}
+
+	orphans := listing.Orphans()
+	var orphanSize int64
+	for _, lob := range orphans {
+		orphanSize += lob.Size
+	}
+	util.LogConsoleSummary(fmt.Sprintf("%v stores %d binaries, %v in total", remoteName, len(listing.LOBs), util.FormatSize(listing.TotalSize())))
+	if len(orphans) > 0 {
+		util.LogConsoleSummary(fmt.Sprintf("%d binaries (%v) are not referenced by any local branch or tag", len(orphans), util.FormatSize(orphanSize)))
+	}
+	if listing.OtherFiles > 0 {
+		util.LogConsoleSummary(fmt.Sprintf("%d other files (%v) are shared chunks or temporary files", listing.OtherFiles, util.FormatSize(listing.OtherSize)))
+	}
+	return 0
+}
+
+func RemoteLsHelp() {
+	util.LogConsole(`Usage: git-lob remote-ls [options] [<remote>]
+
+  Lists the binaries stored on a remote, with the space each one uses there,
+  & reports the total space used on the remote.
+
+  Binaries which no commit on any local branch or tag refers to are marked as
+  orphans; they only take up space on the remote, e.g. because the commits
+  which used them were never pushed or were rewritten. Run 'git fetch' first so
+  that commits others have pushed are known, otherwise the binaries they use
+  are reported as orphans too. Smart remotes can remove orphans with 'git lob
+  prune-remote'.
+
+  Only remotes whose provider can list what's stored can be used, e.g.
+  filesystem, s3, sftp & smart servers which allow you to prune.
+
+Parameters:
+  <remote>      The remote to list, by default the remote you push to
+
+Options:
+  --orphans     Only list orphans
+  --summary     Only report the totals
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+`)
+}
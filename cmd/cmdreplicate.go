@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Replicate command line tool
+func Replicate(repo *core.Repo) int {
+
+	// git-lob replicate [<secondary>...]
+	// git-lob replicate --pending [--limit-rate=<rate>] [<secondary>...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"limit-rate"}, []string{"pending"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if err := applyLimitRateOption(&util.GlobalOptions.MaxUploadRate); err != nil {
+		util.LogConsoleError(err.Error())
+		return 9
+	}
+
+	secondaries := util.GlobalOptions.Args
+	if len(secondaries) == 0 {
+		var err error
+		secondaries, err = repo.GetRemotesWithPendingReplication()
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: unable to read pending replication - %v\n", err.Error())
+			return 12
+		}
+	}
+
+	var found bool
+	for _, secondary := range secondaries {
+		pending, err := repo.GetPendingReplication(secondary)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: %v\n", err.Error())
+			return 12
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		found = true
+		if util.GlobalOptions.BoolOpts.Contains("pending") {
+			if ret := replicatePending(repo, secondary); ret != 0 {
+				return ret
+			}
+			continue
+		}
+		util.LogConsolef("%d push(es) to replicate to %v:\n", len(pending), secondary)
+		for _, push := range pending {
+			util.LogConsolef("  %v (recorded %v)\n", push.Refspecs, push.Queued.Format("2006-01-02 15:04"))
+		}
+	}
+	if !found {
+		util.LogConsole("No replication is pending")
+	} else if !util.GlobalOptions.BoolOpts.Contains("pending") {
+		util.LogConsole("Use 'git lob replicate --pending' to make them now")
+	}
+	return 0
+}
+
+// Replicate a push to the secondaries of a remote once it's been made, in the background unless
+// git-lob.replicate-background is false. Failures only warn, since what's left stays pending
+func startReplication(repo *core.Repo, remoteName string) {
+	secondaries := repo.GetReplicaRemotes(remoteName)
+	if len(secondaries) == 0 {
+		return
+	}
+	if !util.GlobalOptions.ReplicateBackground {
+		for _, secondary := range secondaries {
+			if replicatePending(repo, secondary) != 0 {
+				util.LogConsoleErrorf("Warning: replication to %v is still pending, use 'git lob replicate --pending' to retry\n", secondary)
+			}
+		}
+		return
+	}
+	err := startBackgroundReplication(repo, secondaries)
+	if err != nil {
+		util.LogConsoleErrorf("Warning: unable to start replication to %v: %v\n", strings.Join(secondaries, ", "), err.Error())
+		util.LogConsoleError("Use 'git lob replicate --pending' to replicate")
+		return
+	}
+	util.LogConsolef("Replicating to %v in the background, see %v\n", strings.Join(secondaries, ", "), getReplicationLogFile(repo))
+}
+
+// Gets the file background replication writes its output to
+func getReplicationLogFile(repo *core.Repo) string {
+	return filepath.Join(repo.GitDir, "git-lob", "state", "replication.log")
+}
+
+// Run 'git-lob replicate --pending' for secondaries in another process, which carries on after
+// this one exits
+func startBackgroundReplication(repo *core.Repo, secondaries []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logfile := getReplicationLogFile(repo)
+	err = os.MkdirAll(filepath.Dir(logfile), 0755)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// The child has its own handle
+	defer out.Close()
+	fmt.Fprintf(out, "%v Replicating to %v\n", time.Now().Format("2006-01-02 15:04:05"), strings.Join(secondaries, ", "))
+	cmd := exec.Command(exe, append([]string{"replicate", "--pending"}, secondaries...)...)
+	cmd.Dir = repo.WorkDir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	// Not waited for
+	return cmd.Process.Release()
+}
+
+// Make the pushes pending replication to one secondary
+func replicatePending(repo *core.Repo, secondary string) int {
+	provider, err := repo.GetProvider(secondary)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 6
+	}
+	if err = provider.ValidateConfig(secondary); err != nil {
+		util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", secondary, err)
+		return 6
+	}
+	defer provider.Release()
+	util.LogConsole("Replicating binaries to", secondary)
+
+	var replicating bool
+	var replerr error
+	releaseInterrupt := util.CancelOnInterrupt()
+	defer releaseInterrupt()
+	callbackChan := make(chan *util.ProgressCallbackData, 100)
+	go func() {
+		progress := func(data *util.ProgressCallbackData) (abort bool) {
+			callbackChan <- data
+			return false
+		}
+		started := func(push *core.QueuedPush) {
+			callbackChan <- &util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Pushing binaries for %v (recorded %v)",
+				push.Refspecs, push.Queued.Format("2006-01-02 15:04")), 0, 0, 0, 0, nil}
+		}
+		replicating, replerr = repo.ReplicatePending(provider, secondary, util.GlobalOptions.DryRun, started, progress)
+		close(callbackChan)
+	}()
+	pushCounts := util.ReportProgressToConsole(callbackChan, "Replicate", time.Millisecond*500)
+
+	if replerr != nil {
+		util.LogErrorf("git-lob: replication error(s):\n%v\n", replerr.Error())
+		util.LogConsoleError("Pushes which weren't replicated are still pending")
+		return 12
+	}
+	if !replicating {
+		util.LogConsole("Another process is already replicating to", secondary)
+	} else if util.GlobalOptions.DryRun {
+		util.LogConsole("Done, run again without --dry-run to replicate")
+	} else if pushCounts.ErrorCount > 0 || pushCounts.NotFoundCount > 0 {
+		util.LogConsole("WARNING: not all data was replicated, use 'git lob replicate --pending' to re-try")
+	} else {
+		util.LogConsole("Successfully replicated binaries to", secondary)
+	}
+	return 0
+}
+
+func ReplicateHelp() {
+	util.LogConsole(`Usage: git-lob replicate [options] [<secondary>...]
+
+  Lists the pushes still to be replicated to secondary remotes, or with
+  --pending makes them now, oldest first.
+
+  A remote can be configured to replicate to one or more secondary remotes:
+
+    [remote "origin"]
+        git-lob-replicate-to = backup offsite
+
+  Everything pushed to origin is then also pushed to backup & offsite, from
+  the local store, giving redundancy without separate scripts. Each push is
+  recorded as pending replication to every secondary before it's made, and
+  removed once it has been pushed to that secondary, so nothing is missed if
+  replication fails or is interrupted.
+
+  By default replication runs in a background process once the push has
+  finished, writing its output to .git/git-lob/state/replication.log. Set
+  git-lob.replicate-background = false to replicate before push returns.
+  Only one process replicates to each secondary at a time.
+
+Parameters:
+  <secondary>: The secondary remotes to list or replicate to; by default all
+               those with pending replication.
+
+Options:
+  --pending     Make the pushes still pending replication now
+  --limit-rate=<rate>
+                Limit the total upload rate, e.g. 500K or 2MB (per second).
+                Overrides git-lob.max-upload-rate.
+  --dry-run     Don't actually push anything, just report
+  --quiet, -q   Print less output
+  --verbose, -v Print more output`)
+}
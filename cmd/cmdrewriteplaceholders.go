@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+const defaultRewritePlaceholdersMessage = "Store binaries committed without the git-lob filter"
+
+// Rewrite placeholders command line tool
+func RewritePlaceholders(repo *core.Repo) int {
+
+	// git-lob rewrite-placeholders [--message=<msg>] [--no-commit] [--dry-run]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"message"}, []string{"no-commit"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) > 0 {
+		util.LogConsoleError("git-lob: rewrite-placeholders doesn't take any arguments")
+		return 9
+	}
+	message, ok := util.GlobalOptions.StringOpts["message"]
+	if !ok {
+		message = defaultRewritePlaceholdersMessage
+	}
+	optNoCommit := util.GlobalOptions.BoolOpts.Contains("no-commit")
+	optDryRun := util.GlobalOptions.DryRun
+
+	result, err := repo.RewritePlaceholders(message, optNoCommit, optDryRun)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: rewrite-placeholders error - %v\n", err.Error())
+		if result == nil {
+			return 12
+		}
+	}
+
+	for _, file := range result.Files {
+		switch file.Type {
+		case core.PlaceholderRewriteStored:
+			if optDryRun {
+				util.LogConsolef("Would store %v (%v)\n", file.Filename, util.FormatSize(file.Size))
+			} else {
+				util.LogConsolef("Stored %v (%v) as %v\n", file.Filename, util.FormatSize(file.Size), file.SHA)
+			}
+		case core.PlaceholderRewriteRestored:
+			if optDryRun {
+				util.LogConsolef("Would restore %v from %v\n", file.Filename, file.SHA)
+			} else {
+				util.LogConsolef("Restored %v from %v\n", file.Filename, file.SHA)
+			}
+		case core.PlaceholderRewriteMissing:
+			util.LogConsoleErrorf("Unable to restore %v: %v isn't in the local store\n", file.Filename, file.SHA)
+		case core.PlaceholderRewriteError:
+			util.LogConsoleErrorf("Unable to rewrite %v: %v\n", file.Filename, file.Error.Error())
+		}
+	}
+	if err != nil {
+		return 12
+	}
+
+	stored := result.Count(core.PlaceholderRewriteStored)
+	restored := result.Count(core.PlaceholderRewriteRestored)
+	missing := result.Count(core.PlaceholderRewriteMissing)
+	failed := result.Count(core.PlaceholderRewriteError)
+	if stored+restored == 0 {
+		if missing+failed == 0 {
+			util.LogConsole("All files are consistent with .gitattributes, nothing to rewrite")
+		}
+	} else if optDryRun {
+		util.LogConsolef("%d files would be stored in git-lob & %d placeholders restored\n", stored, restored)
+		util.LogConsole("Run this command again without --dry-run to rewrite them.")
+	} else if result.Commit != "" {
+		util.LogConsolef("Stored %d files in git-lob & restored %d placeholders in commit %v\n", stored, restored, result.Commit)
+	} else {
+		util.LogConsolef("Stored %d files in git-lob & restored %d placeholders, commit to keep the changes\n", stored, restored)
+	}
+	if missing > 0 {
+		util.LogConsolef("%d placeholders could not be restored, use 'git lob fetch' to download their binaries & run this again\n", missing)
+	}
+	if failed > 0 {
+		util.LogConsolef("%d files could not be rewritten\n", failed)
+		return 12
+	}
+	if !optDryRun && stored > 0 {
+		warnIfFilterNotConfigured(repo)
+	}
+	return 0
+}
+
+func RewritePlaceholdersHelp() {
+	util.LogConsole(`Usage: git-lob rewrite-placeholders [options]
+
+  Fix files committed without the git-lob filter, which is what happens when
+  someone clones and commits without git-lob installed. Every file in the
+  index is checked against .gitattributes:
+
+  * Files which should be stored in git-lob but were committed as their raw
+    content are stored in the binary store and replaced by placeholders
+  * Placeholders committed for files which git-lob doesn't store are replaced
+    by the content of the binary, if it's in the local store
+
+  The result is committed as a new commit, with a report of every file
+  rewritten. History isn't changed; the raw content stays in the earlier
+  commits. Files listed in .gitlobignore are meant to be committed verbatim,
+  so they're left alone.
+
+  There mustn't be any other changes staged when committing.
+
+Options:
+  --message=<msg>  Message for the commit. Default is "` + defaultRewritePlaceholdersMessage + `"
+  --no-commit      Stage the rewritten files without committing them
+  --dry-run        Report what would be rewritten without changing anything
+  --quiet, -q      Print less output
+  --verbose, -v    Print more output
+
+`)
+}
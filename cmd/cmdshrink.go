@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Shrink command line tool
+func Shrink(repo *core.Repo) int {
+
+	// git-lob shrink [--remove] [--dry-run] [<remote>]
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"remove", "r"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	optRemove := util.GlobalOptions.BoolOpts.Contains("remove") || util.GlobalOptions.BoolOpts.Contains("r")
+
+	var remoteName string
+	switch len(util.GlobalOptions.Args) {
+	case 0:
+		remoteName = repo.GetGitDefaultRemoteForPush()
+	case 1:
+		remoteName = util.GlobalOptions.Args[0]
+	default:
+		util.LogConsoleError("At most one remote may be supplied")
+		return 9
+	}
+
+	// check the remote config to make sure it's valid
+	provider, err := repo.GetProvider(remoteName)
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 6
+	}
+	if err = provider.ValidateConfig(remoteName); err != nil {
+		util.LogConsoleErrorf("Remote %v has configuration problems:\n%v\n", remoteName, err)
+		return 6
+	}
+	defer provider.Release()
+
+	var deltas, removed, notOnRemote, failed int
+	callback := func(data *core.ShrinkCallbackData) (quit bool) {
+		// Include this stuff in the log because it's important
+		util.LogConsoleDebugf("\r") // to reset any progress spinner but don't want \r in log
+		switch data.Type {
+		case core.ShrinkDelta:
+			deltas++
+			util.LogDebugf("Shrink: %v (%v) to %v delta against %v\n", data.LOBSHA, data.Path,
+				util.FormatSize(data.DeltaSize), data.BaseSHA)
+		case core.ShrinkRemoved:
+			removed++
+			util.LogDebugf("Shrink: removed %v (%v)\n", data.LOBSHA, data.Path)
+		case core.ShrinkRetainNotOnRemote:
+			notOnRemote++
+			util.LogDebugf("Shrink: retaining %v (%v), not on %v\n", data.LOBSHA, data.Path, remoteName)
+		case core.ShrinkError:
+			failed++
+			util.LogConsoleErrorf("\rUnable to shrink %v (%v): %v\n", data.LOBSHA, data.Path, data.Error.Error())
+		case core.ShrinkWorking:
+			// nothing, just spinner below
+		}
+		// Always continue spinner
+		util.LogConsoleSpinner("Processing: ")
+		return false
+	}
+
+	util.LogConsole("Shrinking old versions of binaries stored on", remoteName+"...")
+	reclaimed, err := repo.Shrink(provider, remoteName, optRemove, util.GlobalOptions.DryRun, callback)
+	util.LogConsoleSpinnerFinish("Processing: ")
+	if err != nil {
+		util.LogErrorf("Shrink failed: %v\n", err)
+		return 3
+	}
+	if util.GlobalOptions.DryRun {
+		util.LogConsolef("%d binaries would have been replaced by deltas and %d removed, reclaiming %v.\n",
+			deltas, removed, util.FormatSize(reclaimed))
+		util.LogConsole("Run command again without --dry-run to actually shrink the binary store.")
+	} else {
+		util.LogConsolef("%d binaries were replaced by deltas and %d removed, reclaiming %v.\n",
+			deltas, removed, util.FormatSize(reclaimed))
+	}
+	if notOnRemote > 0 {
+		util.LogConsolef("%d old binaries were kept because they're not on %v, push them first.\n", notOnRemote, remoteName)
+	}
+	if failed > 0 {
+		return 12
+	}
+	return 0
+}
+
+func ShrinkHelp() {
+	util.LogConsole(`Usage: git-lob shrink [options] [<remote>]
+
+  Reclaims space in the local binary store by shrinking old versions of
+  binaries, which are kept so you can check out older commits.
+
+  Each old version of a file is replaced with a delta against the newest
+  version of the same file, so that it can still be rebuilt locally when it's
+  needed again, without downloading anything. If the delta would not be any
+  smaller, or --remove is used, the old version is removed instead, and will be
+  fetched again if needed.
+
+  Only binaries which are confirmed to be present on the remote are shrunk, so
+  nothing is lost. The newest version of every file, and everything needed to
+  check out your current HEAD, is always kept intact.
+
+  'git lob prune' removes deltas along with anything else it would remove.
+
+Parameters:
+  remote        The remote to check binaries are present on. Defaults to the
+                remote of the current branch, or origin.
+
+Options:
+  --remove, -r  Remove old versions rather than replacing them with deltas
+  --dry-run     Don't actually shrink anything, just report
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Size limit command line tool
+func SizeLimit(repo *core.Repo) int {
+
+	// git-lob size-limit report [--file-limit=<size>] [--commit-limit=<size>] [--remote=<remote>] <range>
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"file-limit", "commit-limit", "remote"}, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) != 2 || util.GlobalOptions.Args[0] != "report" {
+		util.LogConsoleError("Usage: git-lob size-limit report [options] <range>, e.g. origin/master..HEAD")
+		return 9
+	}
+	fileLimit := util.GlobalOptions.SizeLimitFile
+	commitLimit := util.GlobalOptions.SizeLimitCommit
+	for opt, limit := range map[string]*int64{"file-limit": &fileLimit, "commit-limit": &commitLimit} {
+		if s, ok := util.GlobalOptions.StringOpts[opt]; ok {
+			n, err := util.ParseSize(s)
+			if err != nil {
+				util.LogConsoleErrorf("git-lob: invalid option --%v=%v, must be a size e.g. 100K or 2GB\n", opt, s)
+				return 9
+			}
+			*limit = n
+		}
+	}
+	if fileLimit == 0 && commitLimit == 0 {
+		util.LogConsoleError("No size limits are set; set git-lob.size-limit-file or git-lob.size-limit-commit, or use --file-limit or --commit-limit")
+		return 9
+	}
+
+	var provider providers.SyncProvider
+	remoteName, hasRemote := util.GlobalOptions.StringOpts["remote"]
+	if hasRemote {
+		var err error
+		provider, err = repo.GetProvider(remoteName)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: %v\n", err)
+			return 6
+		}
+		if err = provider.ValidateConfig(remoteName); err != nil {
+			util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+			return 6
+		}
+		defer provider.Release()
+	}
+
+	callback := func(data *util.ProgressCallbackData) (abort bool) {
+		if data.Type == util.ProgressCalculate {
+			util.LogConsole(data.Desc)
+		}
+		return false
+	}
+	refspec := core.ParseGitRefSpec(util.GlobalOptions.Args[1])
+	report, err := repo.CheckSizeLimits(refspec, fileLimit, commitLimit, provider, remoteName, callback)
+	if err != nil {
+		util.LogConsoleErrorf("Unable to check size limits: %v\n", err.Error())
+		return 12
+	}
+
+	for _, file := range report.FilesOverLimit {
+		util.LogConsoleErrorf("%v: %v is %v, over the limit of %v per file\n", file.Commit[:7], file.Path,
+			util.FormatSize(file.Size), util.FormatSize(fileLimit))
+	}
+	for _, commit := range report.CommitsOverLimit {
+		util.LogConsoleErrorf("%v: adds %v of binaries, over the limit of %v per commit:\n", commit.Commit[:7],
+			util.FormatSize(commit.Size), util.FormatSize(commitLimit))
+		for _, file := range commit.Files {
+			if file.Size >= 0 {
+				util.LogConsoleErrorf("  %v (%v)\n", file.Path, util.FormatSize(file.Size))
+			}
+		}
+	}
+	for _, file := range report.Unknown {
+		util.LogConsoleErrorf("%v: size of %v (%v) is unknown\n", file.Commit[:7], file.Path, file.SHA)
+	}
+	if len(report.Unknown) > 0 {
+		if hasRemote {
+			util.LogConsoleErrorf("%v doesn't have the metadata for these binaries\n", remoteName)
+		} else {
+			util.LogConsoleError("Use --remote=<remote> to download the metadata for these binaries")
+		}
+	}
+	if !report.OK() {
+		return 1
+	}
+	util.LogConsolef("%d commit(s) adding binaries are within the size limits\n", len(report.Commits))
+	return 0
+}
+
+func SizeLimitHelp() {
+	util.LogConsole(`Usage: git-lob size-limit report [options] <range>
+
+  Checks the binaries added by the commits in a range against size budgets,
+  e.g. in CI for a pull request:
+
+    git lob size-limit report --remote=origin origin/master..HEAD
+
+  Prints each binary larger than the per file limit & each commit whose
+  binaries total more than the per commit limit, and exits with status 1 if
+  there are any, or if the size of a binary can't be found out.
+
+  Limits are set with git-lob.size-limit-file & git-lob.size-limit-commit,
+  or the options below. Merges aren't counted, only the commits which added
+  the binaries.
+
+  Sizes come from metadata in the local binary store, or placeholders with
+  git-lob.placeholder-metadata, so the binaries themselves aren't needed.
+  Use --remote to download the metadata which isn't stored locally.
+
+Parameters:
+  <range>: The commits to check, <ref1>..<ref2> for those reachable from
+           ref2 but not ref1, or a single ref for its whole history.
+
+Options:
+  --file-limit=<size>    The largest binary a commit may add, e.g. 50MB.
+                         Overrides git-lob.size-limit-file; 0 for no limit.
+  --commit-limit=<size>  The largest total size of the binaries a commit may
+                         add. Overrides git-lob.size-limit-commit; 0 for no
+                         limit.
+  --remote=<remote>      Download missing metadata from this remote
+  --quiet, -q            Print less output
+  --verbose, -v          Print more output`)
+}
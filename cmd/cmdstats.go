@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Stats command line tool
+func Stats(repo *core.Repo) int {
+
+	// git-lob stats [--since=<date>] [--top=<n>] [--json] [refspec...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"since", "top"}, []string{"json"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+
+	top := 10
+	if optTop, ok := util.GlobalOptions.StringOpts["top"]; ok {
+		n, err := strconv.Atoi(optTop)
+		if err != nil || n < 0 {
+			util.LogConsoleErrorf("Invalid --top value '%v'\n", optTop)
+			return 9
+		}
+		top = n
+	}
+	since := util.GlobalOptions.StringOpts["since"]
+	jsonOutput := util.GlobalOptions.BoolOpts.Contains("json")
+
+	callback := func() (quit bool) {
+		if !jsonOutput {
+			util.LogConsoleSpinner("Analysing history: ")
+		}
+		return false
+	}
+	stats, err := repo.GetLOBStats(util.GlobalOptions.Args, since, top, callback)
+	if !jsonOutput {
+		util.LogConsoleSpinnerFinish("Analysing history: ")
+	}
+	if err != nil {
+		util.LogConsoleErrorf("Unable to analyse history: %v\n", err.Error())
+		return 3
+	}
+
+	if jsonOutput {
+		data, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			util.LogConsoleErrorf("Unable to write stats: %v\n", err.Error())
+			return 12
+		}
+		// Straight to stdout regardless of --quiet, this is for scripts
+		os.Stdout.Write(data)
+		os.Stdout.Write([]byte("\n"))
+		return 0
+	}
+
+	util.LogConsolef("Binaries: %d, total size %v\n", stats.Count, util.FormatSize(stats.Size))
+	if stats.Missing > 0 {
+		util.LogConsolef("  %d binaries are not stored locally so their size is not included\n", stats.Missing)
+	}
+	if stats.Count == 0 {
+		return 0
+	}
+
+	util.LogConsole("\nGrowth per month:")
+	util.LogConsolef("  %-8v %8v %12v\n", "Month", "Binaries", "Size")
+	for _, m := range stats.Months {
+		util.LogConsolef("  %-8v %8d %12v\n", m.Month, m.Count, util.FormatSize(m.Size))
+	}
+
+	util.LogConsole("\nLargest binaries:")
+	for _, f := range stats.Largest {
+		util.LogConsolef("  %12v  %v  %v\n", util.FormatSize(f.Size), f.SHA[:7], f.Path)
+	}
+
+	util.LogConsole("\nMost frequently changed:")
+	for _, p := range stats.MostChanged {
+		util.LogConsolef("  %4d versions %12v  %v\n", p.Versions, util.FormatSize(p.Size), p.Path)
+	}
+
+	util.LogConsole("\nDirectories:")
+	for _, d := range stats.Directories {
+		util.LogConsolef("  %12v %6d binaries  %v\n", util.FormatSize(d.Size), d.Count, d.Path)
+	}
+	return 0
+}
+
+func StatsHelp() {
+	util.LogConsole(`Usage: git-lob stats [options] [refspec...]
+
+  Walks history and reports on the binaries added to it: how many there are and
+  their total size, how much was added each month, the largest binaries, the
+  paths which have changed most often and the totals for each directory.
+
+  Each binary is counted once, against the month it was first added in and the
+  path it was most recently added at. Directory totals include subdirectories.
+  Sizes come from the local binary store, so binaries which haven't been
+  fetched are counted but their size isn't known.
+
+Parameters:
+  refspec...    Optional refs or ranges to walk (as for git log), e.g. 'master'
+                or 'v1.0..v2.0'. By default walks all branches & tags.
+
+Options:
+  --since=<date>  Only include commits more recent than this date; any date
+                  format git log accepts, e.g. '2015-01-01' or '6 months ago'
+  --top=<n>       How many of the largest binaries, most changed paths and
+                  directories to list (default 10, 0 for all)
+  --json          Output the stats as JSON instead of text
+  --quiet, -q     Print less output
+  --verbose, -v   Print more output
+
+`)
+}
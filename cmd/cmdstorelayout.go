@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+var storeLayoutNames = map[string]int{
+	"original": core.LOBStoreLayoutOriginal,
+	"compact":  core.LOBStoreLayoutCompact,
+}
+
+// Store layout command line tool
+func StoreLayout(repo *core.Repo) int {
+
+	// git-lob store-layout [--shared] [--dry-run] [original|compact]
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"shared"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) > 1 {
+		util.LogConsoleError("store-layout takes at most one argument, 'original' or 'compact'")
+		return 9
+	}
+
+	root := repo.GetLocalLOBRoot()
+	storeName := "local"
+	if util.GlobalOptions.BoolOpts.Contains("shared") {
+		if util.GlobalOptions.SharedStore == "" {
+			util.LogConsoleError("No shared store is configured (git-lob.sharedstore)")
+			return 9
+		}
+		root = repo.GetSharedLOBRoot()
+		storeName = "shared"
+	}
+
+	current := core.GetLOBStoreLayout(root)
+	if len(util.GlobalOptions.Args) == 0 {
+		for name, layout := range storeLayoutNames {
+			if layout == current {
+				util.LogConsolef("The %v store uses the %v layout.\n", storeName, name)
+			}
+		}
+		return 0
+	}
+
+	layout, ok := storeLayoutNames[util.GlobalOptions.Args[0]]
+	if !ok {
+		util.LogConsoleErrorf("Unknown store layout '%v', use 'original' or 'compact'\n", util.GlobalOptions.Args[0])
+		return 9
+	}
+
+	var lastProgressLen int
+	var n int
+	callback := func(path string) {
+		n++
+		util.LogDebugf("Moving %v\n", path)
+		msg := fmt.Sprintf("Moving files: %d", n)
+		util.LogConsoleOverwrite(msg, lastProgressLen)
+		lastProgressLen = len(msg)
+	}
+	moved, err := core.MigrateLOBStoreLayout(root, layout, util.GlobalOptions.DryRun, callback)
+	if lastProgressLen > 0 {
+		util.LogConsole("")
+	}
+	if err != nil {
+		util.LogConsoleErrorf("Unable to migrate the %v store: %v\n", storeName, err.Error())
+		util.LogConsole("Run the command again to finish migrating it, binaries remain readable meanwhile.")
+		return 12
+	}
+	if util.GlobalOptions.DryRun {
+		util.LogConsolef("%d files would have been moved to the %v layout.\n", moved, util.GlobalOptions.Args[0])
+	} else {
+		util.LogConsolef("The %v store now uses the %v layout, %d files moved.\n", storeName, util.GlobalOptions.Args[0], moved)
+	}
+	return 0
+}
+
+func StoreLayoutHelp() {
+	util.LogConsole(`Usage: git-lob store-layout [options] [original|compact]
+
+  Reports the layout of the local binary store, or migrates it to another
+  layout.
+
+  The original layout names files after the hex SHA of each binary, which
+  makes for long paths; repositories in deep folders can exceed the path
+  length limit on Windows (MAX_PATH). The compact layout encodes SHAs in lower
+  case base32 instead, which makes names a fifth shorter without risking
+  collisions on case-insensitive filesystems.
+
+  The layout only affects how binaries are stored locally; remotes, and other
+  clones, are unaffected. Binaries stay readable throughout a migration, and
+  if it's interrupted, run the command again to carry on where it left off.
+
+  Migrate the shared store (git-lob.sharedstore) with --shared; do this while
+  no other repositories using it are running git-lob.
+
+Options:
+  --shared      Use the shared store instead of the local one
+  --dry-run     Don't actually move anything, just report
+  --quiet, -q   Print less output
+  --verbose, -v Print more output`)
+}
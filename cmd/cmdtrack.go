@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Track command line tool
+func Track(repo *core.Repo) int {
+
+	// git-lob track [--restage] [<pattern>...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"restage"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	optRestage := util.GlobalOptions.BoolOpts.Contains("restage")
+	patterns := util.GlobalOptions.Args
+
+	if len(patterns) == 0 {
+		if optRestage {
+			util.LogConsoleError("git-lob: --restage needs the patterns to restage")
+			return 9
+		}
+		tracked, err := repo.GetTrackedPatterns()
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 12
+		}
+		if len(tracked) == 0 {
+			util.LogConsole("No paths are stored by git-lob, use 'git lob track <pattern>' to add some")
+		} else {
+			util.LogConsole("Paths stored by git-lob (from .gitattributes):")
+			for _, pattern := range tracked {
+				util.LogConsole("   ", pattern)
+			}
+		}
+		warnIfFilterNotConfigured(repo)
+		return 0
+	}
+
+	if optRestage && !repo.IsLOBFilterConfigured() {
+		// Restaging would put the whole files in git
+		warnIfFilterNotConfigured(repo)
+		util.LogConsoleError("git-lob: can't restage files until the filter is configured")
+		return 7
+	}
+
+	if util.GlobalOptions.DryRun {
+		for _, pattern := range patterns {
+			util.LogConsole("Would track", pattern)
+		}
+	} else {
+		added, err := repo.TrackPatterns(patterns)
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 9
+		}
+		addedSet := util.NewStringSet()
+		for _, pattern := range added {
+			addedSet.Add(pattern)
+			util.LogConsole("Tracking", pattern)
+		}
+		for _, pattern := range patterns {
+			if !addedSet.Contains(pattern) {
+				util.LogConsole(pattern, "is already tracked")
+			}
+		}
+		if !optRestage {
+			warnIfFilterNotConfigured(repo)
+		}
+	}
+
+	if optRestage {
+		files, err := repo.GetGitFilesMatchingPatterns(patterns)
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 12
+		}
+		if util.GlobalOptions.DryRun {
+			for _, file := range files {
+				util.LogConsole("Would restage", file)
+			}
+			return 0
+		}
+		if len(files) > 0 {
+			util.LogConsolef("Restaging %d committed files, this may take a while\n", len(files))
+		}
+		restaged, err := repo.RestageFiles(files)
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 12
+		}
+		for _, file := range restaged {
+			util.LogConsoleDebug("Restaged", file)
+		}
+		if len(restaged) > 0 {
+			util.LogConsolef("Restaged %d files, commit them to store their content in git-lob\n", len(restaged))
+		} else {
+			util.LogConsole("No committed files to restage")
+		}
+	}
+	return 0
+}
+
+// Untrack command line tool
+func Untrack(repo *core.Repo) int {
+
+	// git-lob untrack <pattern>...
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	patterns := util.GlobalOptions.Args
+	if len(patterns) == 0 {
+		util.LogConsoleError("Too few arguments; must supply at least one pattern")
+		return 9
+	}
+
+	if util.GlobalOptions.DryRun {
+		for _, pattern := range patterns {
+			util.LogConsole("Would untrack", pattern)
+		}
+		return 0
+	}
+	removed, err := repo.UntrackPatterns(patterns)
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 12
+	}
+	removedSet := util.NewStringSet()
+	for _, pattern := range removed {
+		removedSet.Add(pattern)
+		util.LogConsole("Untracking", pattern)
+	}
+	for _, pattern := range patterns {
+		if !removedSet.Contains(pattern) {
+			util.LogConsole(pattern, "was not tracked")
+		}
+	}
+	if len(removed) > 0 {
+		util.LogConsole("Files already committed stay in git-lob until they're added to git again")
+	}
+	return 0
+}
+
+// Warn that files won't really be stored by git-lob if the filter isn't configured
+func warnIfFilterNotConfigured(repo *core.Repo) {
+	if repo.IsLOBFilterConfigured() {
+		return
+	}
+	util.LogConsoleErrorf(`Warning: the '%v' filter is not configured in git config, so tracked files
+will be stored in git as normal. Add this to ~/.gitconfig or .git/config:
+
+[filter "%v"]
+  clean = "git-lob filter-clean %%f"
+  smudge = "git-lob filter-smudge %%f"
+  process = "git-lob filter-process"
+  required = true
+
+`, core.LOBFilterName, core.LOBFilterName)
+}
+
+func TrackHelp() {
+	util.LogConsole(`Usage: git-lob track [options] [<pattern>...]
+
+  Start storing files matching path patterns in git-lob, by adding them to
+  .gitattributes at the root of the repository with the git-lob filter, e.g.
+
+    git lob track "*.psd" "art/final/**"
+
+  Patterns use .gitattributes rules and are relative to the root of the
+  repository; a pattern without a / matches a file name in any directory.
+  Quote patterns so your shell doesn't expand them. Commit .gitattributes
+  so that everyone stores the same files in git-lob.
+
+  To keep some files matching a broad pattern in git instead (e.g. small
+  reference images), list them in .gitlobignore at the root of the repo,
+  which uses .gitignore syntax; commit it too.
+
+  With no patterns, lists the patterns already tracked.
+
+  Also checks that the git-lob filter is configured in git config, since
+  without it tracked files are silently stored in git as normal.
+
+Options:
+  --restage     Files matching the patterns which were committed before they
+                were tracked are still stored in git; add them to the index
+                again so that the filter stores their content in git-lob when
+                you next commit. Only works on files in the working copy.
+  --dry-run     Report what would be done without changing anything
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
+
+func UntrackHelp() {
+	util.LogConsole(`Usage: git-lob untrack [options] <pattern>...
+
+  Stop storing files matching path patterns in git-lob, by removing the
+  git-lob filter from them in .gitattributes at the root of the repository.
+  Patterns must be given exactly as they appear in .gitattributes (see
+  'git lob track' with no patterns); any other attributes are kept.
+
+  Files which were already committed are still stored in git-lob until
+  they're added to git again.
+
+Options:
+  --dry-run     Report what would be done without changing anything
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
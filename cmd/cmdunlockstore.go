@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Unlock store command line tool
+func UnlockStore(repo *core.Repo) int {
+
+	// git-lob unlock-store [--older-than=<age>]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"older-than"}, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+
+	olderThan := core.DefaultStaleAge
+	if optAge, ok := util.GlobalOptions.StringOpts["older-than"]; ok {
+		age, err := parseAge(optAge)
+		if err != nil {
+			util.LogConsoleErrorf("Invalid --older-than value '%v', must be e.g. 2h or 7d\n", optAge)
+			return 9
+		}
+		olderThan = age
+	}
+
+	if util.GlobalOptions.DryRun {
+		util.LogConsole("Finding stale temporary files & locks (dry run)...")
+	} else {
+		util.LogConsole("Removing stale temporary files & locks...")
+	}
+	var temps, chunks, locks int
+	callback := func(f *core.StaleFile) {
+		switch f.Type {
+		case core.StaleTemp:
+			temps++
+		case core.StaleOrphanChunk:
+			chunks++
+		case core.StaleLock:
+			locks++
+		}
+		util.LogConsoleDebugf("  %v (%v)\n", f.Path, util.FormatSize(f.Size))
+	}
+	removed, err := repo.RemoveStaleFiles(olderThan, util.GlobalOptions.DryRun, callback)
+	if err != nil {
+		util.LogConsoleErrorf("Unable to check for stale files: %v\n", err.Error())
+		return 12
+	}
+	var size int64
+	for _, f := range removed {
+		size += f.Size
+	}
+
+	verb := "Removed"
+	if util.GlobalOptions.DryRun {
+		verb = "Would remove"
+	}
+	if len(removed) == 0 {
+		util.LogConsole("Nothing to remove")
+		return 0
+	}
+	util.LogConsolef("%v %d temporary files, %d orphaned chunks & %d stale locks, reclaiming %v\n",
+		verb, temps, chunks, locks, util.FormatSize(size))
+	return 0
+}
+
+// Parse an age like 30m, 2h or 7d
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, strconv.ErrSyntax
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return d, err
+}
+
+func UnlockStoreHelp() {
+	util.LogConsole(`Usage: git-lob unlock-store [options]
+
+  Removes things left behind by git-lob processes which were interrupted,
+  e.g. killed or when a machine lost power, and reports the space reclaimed:
+
+  * Temporary files in the system temp dir (chunks being stored, deltas) and
+    in the binary stores (partial downloads & uploads, state being saved)
+  * Chunks in the local binary store of binaries whose metadata was never
+    written, because storing or fetching them was interrupted
+  * Locks in the shared store and on push state whose holder is no longer
+    running, or has stopped updating them
+
+  Temporary files & chunks are only removed once they haven't been changed
+  for a while, so that nothing still running is affected. Locks are removed
+  as soon as they're found to be abandoned.
+
+  This also happens automatically once a day, unless git-lob.housekeeping is
+  set to false.
+
+Options:
+  --older-than=<age>  Only remove temporary files & chunks older than this,
+                      e.g. 30m, 2h or 7d. Default 1d.
+  --dry-run           Report what would be removed without removing anything
+  --quiet, -q         Print less output
+  --verbose, -v       Print more output, including each file removed
+
+`)
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Upgrade store command line tool
+func UpgradeStore(repo *core.Repo) int {
+
+	// git-lob upgrade-store [--finish | --rollback] [--dry-run]
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"finish", "rollback"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	optFinish := util.GlobalOptions.BoolOpts.Contains("finish")
+	optRollback := util.GlobalOptions.BoolOpts.Contains("rollback")
+	if optFinish && optRollback {
+		util.LogConsoleError("Cannot use --finish and --rollback together")
+		return 9
+	}
+	if len(util.GlobalOptions.Args) > 0 {
+		util.LogConsoleError("upgrade-store does not take any arguments")
+		return 9
+	}
+
+	if optFinish {
+		if util.GlobalOptions.DryRun {
+			util.LogConsole("Would delete the original files of converted binaries.")
+			return 0
+		}
+		n, err := repo.FinishUpgradeStore()
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 12
+		}
+		util.LogConsolef("Upgrade finished, original files of %d converted binaries deleted.\n", n)
+		return 0
+	}
+
+	var lastProgressLen int
+	progress := func(data *core.UpgradeStoreCallbackData, verb string) {
+		msg := fmt.Sprintf("%v: %d/%d (%d%%)", verb, data.Done, data.Total, data.Done*100/data.Total)
+		util.LogConsoleOverwrite(msg, lastProgressLen)
+		lastProgressLen = len(msg)
+	}
+
+	if optRollback {
+		if util.GlobalOptions.DryRun {
+			util.LogConsole("Would restore the original files of converted binaries.")
+			return 0
+		}
+		n, err := repo.RollbackUpgradeStore(func(data *core.UpgradeStoreCallbackData) (quit bool) {
+			progress(data, "Rolling back")
+			return false
+		})
+		util.LogConsole("")
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 12
+		}
+		util.LogConsolef("Upgrade rolled back, %d binaries restored to their original format.\n", n)
+		return 0
+	}
+
+	var converted, skipped, failed int
+	var oldSize, newSize int64
+	callback := func(data *core.UpgradeStoreCallbackData) (quit bool) {
+		switch data.Type {
+		case core.UpgradeStoreConverted:
+			converted++
+			oldSize += data.OldSize
+			newSize += data.NewSize
+			util.LogDebugf("Upgrade: converted %v (%v to %v)\n", data.LOBSHA,
+				util.FormatSize(data.OldSize), util.FormatSize(data.NewSize))
+		case core.UpgradeStoreSkipped:
+			skipped++
+			util.LogDebugf("Upgrade: skipped %v, not complete locally\n", data.LOBSHA)
+		case core.UpgradeStoreError:
+			failed++
+			util.LogConsoleErrorf("\rUnable to convert %v: %v\n", data.LOBSHA, data.Error.Error())
+		}
+		progress(data, "Converting")
+		return false
+	}
+
+	util.LogConsolef("Converting binaries to chunking '%v', compression '%v'...\n",
+		util.GlobalOptions.Chunking, util.GlobalOptions.Compression)
+	err := repo.UpgradeStore(util.GlobalOptions.DryRun, callback)
+	util.LogConsole("")
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 12
+	}
+	if util.GlobalOptions.DryRun {
+		util.LogConsolef("%d binaries (%v) would have been converted.\n", converted, util.FormatSize(oldSize))
+		if converted > 0 {
+			util.LogConsole("Run command again without --dry-run to convert them.")
+		}
+	} else if converted == 0 && !repo.IsUpgradeStoreInProgress() {
+		util.LogConsole("All binaries are already stored with the current settings.")
+	} else {
+		util.LogConsolef("%d binaries converted, %v now stored as %v.\n", converted, util.FormatSize(oldSize), util.FormatSize(newSize))
+		util.LogConsole("Original files are kept until you run 'git lob upgrade-store --finish',")
+		util.LogConsole("or you can restore them with 'git lob upgrade-store --rollback'.")
+	}
+	if skipped > 0 {
+		util.LogConsolef("%d binaries were skipped because they're not complete locally.\n", skipped)
+	}
+	if failed > 0 {
+		util.LogConsole("Run the command again to retry the binaries which could not be converted.")
+		return 12
+	}
+	return 0
+}
+
+func UpgradeStoreHelp() {
+	util.LogConsole(`Usage: git-lob upgrade-store [options]
+
+  Converts binaries already in the local binary store to the current storage
+  settings, git-lob.chunking, git-lob.chunk-size and git-lob.compression (see
+  'git lob help config'), which otherwise only apply to binaries stored from
+  then on.
+
+  Committed placeholders only identify the content of each binary, so they
+  don't change; they keep working throughout, and binaries in any format can
+  be checked out. Binaries which are already stored with the current settings,
+  or which are not complete locally, are left alone.
+
+  The upgrade is staged: the original files of each converted binary are kept
+  until you finish the upgrade with --finish, so you can --rollback to restore
+  them instead. If the upgrade is interrupted, run the command again to carry
+  on where it left off. An upgrade must be finished or rolled back before you
+  can upgrade to different settings.
+
+  Repositories using a shared store (git-lob.sharedstore) can't be upgraded.
+
+Options:
+  --finish      Delete the original files of converted binaries, which means
+                the upgrade can no longer be rolled back
+  --rollback    Restore the original files of every converted binary
+  --dry-run     Don't actually convert anything, just report
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
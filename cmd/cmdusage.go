@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Usage command line tool
+func Usage(repo *core.Repo) int {
+
+	// git-lob usage [--days=<n>] [--monthly] [--remote=<name>] [--json]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"days", "remote"}, []string{"monthly", "json"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+
+	days := 30
+	if optDays, ok := util.GlobalOptions.StringOpts["days"]; ok {
+		n, err := strconv.Atoi(optDays)
+		if err != nil || n < 0 {
+			util.LogConsoleErrorf("Invalid --days value '%v'\n", optDays)
+			return 9
+		}
+		days = n
+	}
+	remoteName := util.GlobalOptions.StringOpts["remote"]
+	monthly := util.GlobalOptions.BoolOpts.Contains("monthly")
+	jsonOutput := util.GlobalOptions.BoolOpts.Contains("json")
+
+	ledger, err := repo.LoadTransferUsage()
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 3
+	}
+	var since time.Time
+	if days > 0 {
+		// Today counts as one of the days
+		since = time.Now().AddDate(0, 0, 1-days)
+	}
+	entries := ledger.Summarise(since, remoteName, monthly)
+
+	if jsonOutput {
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			util.LogConsoleErrorf("Unable to write usage: %v\n", err.Error())
+			return 12
+		}
+		// Straight to stdout regardless of --quiet, this is for scripts
+		os.Stdout.Write(data)
+		os.Stdout.Write([]byte("\n"))
+		return 0
+	}
+
+	if len(entries) == 0 {
+		util.LogConsole("No transfers recorded")
+		return 0
+	}
+	periodTitle := "Day"
+	if monthly {
+		periodTitle = "Month"
+	}
+	util.LogConsolef("  %-10v %-20v %12v %12v\n", periodTitle, "Remote", "Downloaded", "Uploaded")
+	totals := make(map[string]*core.TransferUsage)
+	var remotes []string
+	for _, e := range entries {
+		util.LogConsolef("  %-10v %-20v %12v %12v\n", e.Period, e.Remote, util.FormatSize(e.Downloaded), util.FormatSize(e.Uploaded))
+		total, ok := totals[e.Remote]
+		if !ok {
+			total = &core.TransferUsage{}
+			totals[e.Remote] = total
+			remotes = append(remotes, e.Remote)
+		}
+		total.Downloaded += e.Downloaded
+		total.Uploaded += e.Uploaded
+	}
+	sort.Strings(remotes)
+	util.LogConsole("\nTotals:")
+	for _, remote := range remotes {
+		util.LogConsolef("  %-10v %-20v %12v %12v\n", "", remote, util.FormatSize(totals[remote].Downloaded), util.FormatSize(totals[remote].Uploaded))
+	}
+	return 0
+}
+
+func UsageHelp() {
+	util.LogConsole(`Usage: git-lob usage [options]
+
+  Reports how much binary data has been downloaded from & uploaded to each
+  remote by this repository, per day or month. This can help if you pay for
+  data transferred out of cloud storage.
+
+  Push, fetch, pull and binaries fetched automatically on checkout all add to
+  a ledger kept locally in the repository, which isn't shared with anyone else.
+  Only files which were transferred completely are counted, and deltas count as
+  their own size rather than the size of the binary.
+
+Options:
+  --days=<n>       Report the last n days, including today. Default 30, 0
+                   reports everything recorded.
+  --monthly        Report totals per month instead of per day
+  --remote=<name>  Only report transfers for this remote
+  --json           Output the usage as JSON instead of text
+  --quiet, -q      Print less output
+  --verbose, -v    Print more output
+
+`)
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Verify-signatures command line tool
+func VerifySignatures(repo *core.Repo) int {
+
+	// git-lob verify-signatures [--ref=<ref>] [<pathspec>...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"ref"}, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	ref := "HEAD"
+	if optRef, ok := util.GlobalOptions.StringOpts["ref"]; ok {
+		if !repo.GitRefOrSHAIsValid(optRef) {
+			util.LogConsoleErrorf("Invalid --ref '%v'\n", optRef)
+			return 9
+		}
+		ref = optRef
+	}
+	var pathspecs []string
+	for _, arg := range util.GlobalOptions.Args {
+		pathspecs = append(pathspecs, filepath.Clean(arg))
+	}
+
+	var good, unsigned, bad, missing int
+	callback := func(file *core.LOBFileInfo, result *core.LOBSignatureResult) {
+		if result == nil {
+			missing++
+			util.LogConsolef("missing  %v\n", file.Path)
+			return
+		}
+		switch result.Status {
+		case core.LOBSignatureGood:
+			good++
+			util.LogConsolef("good     %v (%v)\n", file.Path, result.Signer)
+		case core.LOBSignatureUnsigned:
+			unsigned++
+			util.LogConsolef("unsigned %v\n", file.Path)
+		default:
+			bad++
+			util.LogConsolef("BAD      %v: %v\n", file.Path, result.Problem)
+		}
+	}
+	err := repo.VerifyLOBSignaturesAtRef(ref, pathspecs, callback)
+	if err != nil {
+		util.LogConsoleErrorf("Unable to verify signatures: %v\n", err.Error())
+		return 12
+	}
+	util.LogConsolef("%d good, %d unsigned, %d bad signatures", good, unsigned, bad)
+	if missing > 0 {
+		util.LogConsolef(", %d not checked because their metadata isn't stored locally", missing)
+	}
+	util.LogConsole("")
+	if unsigned > 0 || bad > 0 {
+		return 12
+	}
+	return 0
+}
+
+func VerifySignaturesHelp() {
+	util.LogConsole(`Usage: git-lob verify-signatures [options] [<pathspec>...]
+
+  Checks the signatures of the binaries for the files stored by git-lob at
+  HEAD (limited to pathspecs if given), so that you can prove where they came
+  from. Binaries are signed when they're stored if git-lob.sign is set, with
+  the same key as signed git commits (user.signingkey & gpg.format). The
+  signature travels with the binary through pushes & fetches.
+
+  A signature is good if it was made with a key in your GPG keyring which
+  isn't marked as never trusted, or for SSH signatures, a key listed in
+  gpg.ssh.allowedSignersFile. Binaries whose metadata hasn't been fetched
+  can't be checked & are reported as missing.
+
+  Exits with an error if any binary is unsigned or has a bad signature. Set
+  git-lob.verify-signatures to refuse such binaries on fetch & checkout too.
+
+Options:
+  --ref=<ref>        Check the binaries at another branch, tag or commit
+                     instead of HEAD
+  --quiet, -q        Print less output
+  --verbose, -v      Print more output
+
+`)
+}
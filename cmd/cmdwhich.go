@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Which command line tool
+func Which(repo *core.Repo) int {
+
+	// git-lob which <sha|path>...
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) == 0 {
+		util.LogConsoleError("Too few arguments; must supply at least one SHA or path")
+		return 9
+	}
+
+	// Resolve all arguments first so that mistakes are reported before checking remotes
+	var shas []string
+	for _, arg := range util.GlobalOptions.Args {
+		if core.IsLOBSHA(arg) && !util.FileExists(arg) {
+			shas = append(shas, strings.ToLower(arg))
+			continue
+		}
+		sha, err := repo.GetLOBSHAForPath(arg)
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 9
+		}
+		shas = append(shas, sha)
+	}
+
+	remoteNames, err := repo.GetGitLOBRemotes()
+	if err != nil {
+		util.LogConsoleError(err.Error())
+		return 12
+	}
+	// Align the results
+	width := len("local")
+	for _, remoteName := range remoteNames {
+		if len(remoteName) > width {
+			width = len(remoteName)
+		}
+	}
+
+	for i, sha := range shas {
+		util.LogConsole(sha, util.GlobalOptions.Args[i])
+		fetchSource := repo.GetFetchSource(sha)
+		for _, location := range repo.FindLOBLocations(sha, remoteNames) {
+			name := location.RemoteName
+			if name == "" {
+				name = "local"
+			}
+			var status string
+			if location.Error != nil {
+				status = "unable to check: " + location.Error.Error()
+			} else if location.Complete {
+				status = "complete"
+			} else {
+				status = "missing"
+			}
+			if location.RemoteName != "" && location.RemoteName == fetchSource {
+				status += " (fetched from here)"
+			}
+			util.LogConsolef("  %-*v %v\n", width, name, status)
+		}
+	}
+	if len(remoteNames) == 0 {
+		util.LogConsole("No remotes are configured to store binaries (see 'git lob help remotes')")
+	}
+	return 0
+}
+
+func WhichHelp() {
+	util.LogConsole(`Usage: git-lob which [options] <sha|path>...
+
+  Reports whether the local binary store and each remote with binary storage
+  configured (git-lob-provider) have the complete content of a binary, using
+  each remote's own checks. Use this to find out why push or fetch reports
+  binaries as not found on a remote, especially when you use several remotes
+  (see git-lob.fetch-remotes in 'git lob help config').
+
+  Binaries can be given by SHA, or by the path of a file in the working copy,
+  which refers to the binary in its placeholder, or if the content is checked
+  out, the binary committed for it in HEAD.
+
+  Also says which remote each binary was fetched from, if it's known.
+
+Options:
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
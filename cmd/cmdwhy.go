@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Why command line tool
+func Why(repo *core.Repo) int {
+
+	// git-lob why <sha|path>
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) != 1 {
+		util.LogConsoleError("Must supply a single SHA or path")
+		return 9
+	}
+	arg := util.GlobalOptions.Args[0]
+	sha := strings.ToLower(arg)
+	if !core.IsLOBSHA(arg) || util.FileExists(arg) {
+		var err error
+		sha, err = repo.GetLOBSHAForPath(arg)
+		if err != nil {
+			util.LogConsoleError(err.Error())
+			return 9
+		}
+	}
+
+	result, err := repo.ExplainLOB(sha, func(t core.PruneCallbackType, lobsha string) {
+		util.LogConsoleSpinner("Processing: ")
+	})
+	util.LogConsoleSpinnerFinish("Processing: ")
+	if err != nil {
+		util.LogConsoleErrorf("Unable to explain %v: %v\n", sha, err.Error())
+		return 12
+	}
+
+	util.LogConsole(sha)
+	if result.Stored {
+		util.LogConsolef("  Stored locally (%v)\n", util.FormatSize(result.Size))
+	} else {
+		util.LogConsole("  Not stored locally")
+	}
+
+	if len(result.AddedBy) == 0 {
+		util.LogConsole("  No commit in any branch or tag adds it")
+	} else {
+		util.LogConsole("  Added by:")
+		for _, commit := range result.AddedBy {
+			util.LogConsolef("    %v %v (%v)\n", commit.Commit[:7], commit.Path, commit.Subject)
+		}
+	}
+
+	if len(result.Refs) == 0 {
+		util.LogConsole("  Not used by HEAD or any ref within the history prune keeps")
+	} else {
+		util.LogConsole("  Used by:")
+		for _, ref := range result.Refs {
+			if ref.AtTip {
+				util.LogConsolef("    %v (at its tip)\n", ref.Name)
+			} else {
+				util.LogConsolef("    %v (within the last %d days of its history)\n", ref.Name, ref.Days)
+			}
+		}
+	}
+
+	if len(result.Pushed) > 0 {
+		util.LogConsole("  Pushed:")
+		var remoteNames []string
+		for remoteName, _ := range result.Pushed {
+			remoteNames = append(remoteNames, remoteName)
+		}
+		sort.Strings(remoteNames)
+		for _, remoteName := range remoteNames {
+			if result.Pushed[remoteName] {
+				util.LogConsolef("    %v: yes\n", remoteName)
+			} else {
+				util.LogConsolef("    %v: no\n", remoteName)
+			}
+		}
+	}
+
+	switch {
+	case !result.Stored:
+		util.LogConsole("  Prune: nothing to delete")
+	case result.WouldPrune:
+		util.LogConsole("  Prune: would delete it")
+	default:
+		util.LogConsole("  Prune: would keep it because")
+		for _, t := range result.PruneRetained {
+			switch t {
+			case core.PruneRetainByDate:
+				util.LogConsole("    it's used by HEAD or a recent ref, or their recent history")
+			case core.PruneRetainNotPushed:
+				util.LogConsolef("    a commit which adds it hasn't been pushed to %v\n", result.PruneRemote)
+			case core.PruneRetainByPolicy:
+				util.LogConsole("    a retention policy (git-lob.prune-keep-*) applies")
+			}
+		}
+	}
+	return 0
+}
+
+func WhyHelp() {
+	util.LogConsole(`Usage: git-lob why [options] <sha|path>
+
+  Explains why 'git lob prune' keeps a binary, or that it would delete it,
+  e.g. when prune doesn't free as much space as expected. Reports:
+
+  * Whether the binary is stored locally, and the commits which added it
+  * HEAD & the refs which use it, at their tip or within the history prune
+    keeps for them (git-lob.retention-period-*)
+  * Whether a commit which added it has been pushed to each remote with
+    binary storage, according to the push state
+  * Whether prune would delete it, and if not, why not
+
+  Whether prune checks for unpushed binaries on a particular remote depends
+  on git-lob.prune-check-remote. Use 'git lob which' to check whether remotes
+  actually have the content.
+
+  The binary can be given by SHA, or by the path of a file in the working
+  copy, as for 'git lob which'.
+
+Options:
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+`)
+}
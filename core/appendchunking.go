@@ -0,0 +1,216 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Append chunking (git-lob.append-chunking)
+// Many large files, like audio banks or log-like containers, only ever grow by appending, yet with
+// fixed chunking every version is stored in full. With append chunking, storing a file from the
+// working copy looks up the version of the same path in the index, and if the new content starts
+// with the same chunks it's stored as chunk objects (see chunking.go) split at the same size, so the
+// chunks the versions have in common are only stored once. Chunks of a previous version stored in
+// fixed chunks are hard linked rather than copied. If even the first chunk differs the file is
+// stored as normal, so files which don't grow this way are unaffected.
+
+// Store a LOB from a file in the working copy (relative to the root of the repo), as StoreLOB but
+// reusing the leading chunks of the version in the index if git-lob.append-chunking is enabled
+func (r *Repo) StoreLOBForFile(in io.Reader, leader []byte, filename string) (*LOBInfo, error) {
+	var previous string
+	if filename != "" && r.appendChunkingEnabled() {
+		previous = r.getGitIndexLOBForPath(filename)
+	}
+	return r.storeLOB(in, leader, previous, r.Options.HashAlgorithm)
+}
+
+// Chunk objects aren't compressed, and content-defined chunking shares chunks anyway
+func (r *Repo) appendChunkingEnabled() bool {
+	return r.Options.AppendChunking && r.Options.Chunking == ChunkingFixed &&
+		r.Options.Compression == CompressionNone
+}
+
+// Get the LOB which the index has a placeholder for at a path relative to the root of the repo,
+// "" if it doesn't have one
+func (r *Repo) getGitIndexLOBForPath(filename string) string {
+	placeholder, _ := r.getGitIndexPlaceholderForPath(filename)
+	if placeholder == nil {
+		return ""
+	}
+	return placeholder.SHA
+}
+
+// Get the placeholder the index has at a path relative to the root of the repo, both what it says
+// & its exact content; nil if it doesn't have one
+func (r *Repo) getGitIndexPlaceholderForPath(filename string) (*LOBPlaceholder, []byte) {
+	entries, err := r.getGitIndexEntries(r.Root, ":(literal)"+filepath.ToSlash(filename))
+	if err != nil || len(entries) != 1 || !isLOBPlaceholderSize(entries[0].Size) {
+		return nil, nil
+	}
+	contents, err := r.readGitBlobs(r.Root, []string{entries[0].Object})
+	if err != nil {
+		return nil, nil
+	}
+	content := contents[entries[0].Object]
+	placeholder, ok := parseLOBPlaceholder(content)
+	if !ok {
+		return nil, nil
+	}
+	return placeholder, content
+}
+
+// Get the size a LOB was split into chunks at, if it's one which can be appended to: stored
+// uncompressed, in chunks of the same size apart from the last. Returns 0 if not
+func getAppendChunkSize(info *LOBInfo) int64 {
+	if info.Compression != CompressionNone || info.NumChunks == 0 {
+		return 0
+	}
+	if info.Version != LOBInfoVersionChunkObjects {
+		return getLOBFixedChunkSize(info)
+	}
+	size := info.Chunks[0].Size
+	for _, c := range info.Chunks[:len(info.Chunks)-1] {
+		if c.Size != size {
+			// Content-defined chunks
+			return 0
+		}
+	}
+	return size
+}
+
+// Store a LOB underneath a LOB root, reusing the chunks it starts with which are the same as the
+// LOB previous, see above. Falls back on storing it according to settings if there are none
+func (r *Repo) storeLOBInBaseDirAppended(basedir string, in io.Reader, leader []byte, previous, hashAlgorithm string) (*LOBInfo, error) {
+	prev, err := r.getLOBInfoInBaseDir(previous, basedir)
+	var chunkSize int64
+	if err == nil {
+		chunkSize = getAppendChunkSize(prev)
+	}
+	if chunkSize == 0 {
+		return r.storeLOBInBaseDirWithSettings(basedir, in, leader, hashAlgorithm)
+	}
+
+	rd := io.MultiReader(bytes.NewReader(leader), in)
+	buf := make([]byte, chunkSize)
+	eof := false
+	readChunk := func() ([]byte, error) {
+		c, err := io.ReadFull(rd, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+			err = nil
+		}
+		return buf[:c], err
+	}
+	data, err := readChunk()
+	if err != nil {
+		return nil, fmt.Errorf("I/O error reading chunk 0: %v", err)
+	}
+	chunksha := calculateSHA(hashAlgorithm, data)
+	if !r.lobChunkMatches(basedir, prev, 0, data, chunksha, hashAlgorithm) {
+		// Not appended to, nothing to gain
+		return r.storeLOBInBaseDirWithSettings(basedir, io.MultiReader(bytes.NewReader(data), rd), nil, hashAlgorithm)
+	}
+
+	sha := newHash(hashAlgorithm)
+	var chunks []LOBChunk
+	// Chunk objects we created, to remove if not used after all
+	var created []string
+	var totalSize int64
+	cleanup := func() {
+		for _, c := range created {
+			os.Remove(r.GetChunkObjectPathInBaseDir(basedir, c))
+		}
+	}
+	leading := true
+	for len(data) > 0 {
+		sha.Write(data)
+		var linkFrom string
+		if leading && r.lobChunkMatches(basedir, prev, len(chunks), data, chunksha, hashAlgorithm) {
+			if prev.Version != LOBInfoVersionChunkObjects {
+				linkFrom = r.getLOBChunkPathInBaseDirForInfo(basedir, prev, len(chunks))
+			}
+		} else {
+			leading = false
+		}
+		isnew, err := r.storeChunkObjectInBaseDir(basedir, chunksha, data, linkFrom)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		if isnew {
+			created = append(created, chunksha)
+		}
+		chunks = append(chunks, LOBChunk{SHA: chunksha, Size: int64(len(data))})
+		totalSize += int64(len(data))
+		if eof {
+			break
+		}
+		data, err = readChunk()
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("I/O error reading chunk %d: %v", len(chunks), err)
+		}
+		chunksha = calculateSHA(hashAlgorithm, data)
+	}
+
+	shaStr := fmt.Sprintf("%x", string(sha.Sum(nil)))
+	info := &LOBInfo{SHA: shaStr, Size: totalSize, NumChunks: len(chunks),
+		Version: LOBInfoVersionChunkObjects, Chunks: chunks}
+
+	existing, err := r.keepExistingLOBStorage(basedir, info)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if existing != nil {
+		cleanup()
+		return existing, nil
+	}
+
+	err = r.StoreLOBInfoInBaseDir(basedir, info)
+	if err != nil {
+		return nil, err
+	}
+	r.Log.Debugf("Stored %v reusing the leading chunks of %v\n", shaStr, previous)
+	return info, nil
+}
+
+// Whether the content of a chunk of a LOB in basedir is data, whose SHA is chunksha
+func (r *Repo) lobChunkMatches(basedir string, info *LOBInfo, chunkIdx int, data []byte, chunksha, hashAlgorithm string) bool {
+	if chunkIdx >= info.NumChunks {
+		return false
+	}
+	if info.Version == LOBInfoVersionChunkObjects && GetLOBSHAAlgorithm(info.SHA) == hashAlgorithm {
+		// Chunk objects are identified by the same hash as their LOB
+		c := info.Chunks[chunkIdx]
+		return c.SHA == chunksha && c.Size == int64(len(data))
+	}
+	return fileContentEquals(r.getLOBChunkPathInBaseDirForInfo(basedir, info, chunkIdx), data)
+}
+
+// Whether the content of a file is exactly data
+func fileContentEquals(path string, data []byte) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.Size() != int64(len(data)) {
+		return false
+	}
+	buf := make([]byte, BUFSIZE)
+	for len(data) > 0 {
+		n := len(buf)
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := io.ReadFull(f, buf[:n]); err != nil || !bytes.Equal(buf[:n], data[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
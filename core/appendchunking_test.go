@@ -0,0 +1,103 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Append chunking", func() {
+	root := filepath.Join(os.TempDir(), "AppendChunkingTest")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		GlobalOptions.AppendChunking = true
+		GlobalOptions.ChunkSize = 1000
+	})
+	AfterEach(func() {
+		GlobalOptions.AppendChunking = false
+		GlobalOptions.ChunkSize = 0
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+	})
+
+	getRandomData := func(sz int, seed int64) []byte {
+		data := make([]byte, sz)
+		r := rand.New(rand.NewSource(seed))
+		for i := range data {
+			data[i] = byte(r.Intn(256))
+		}
+		return data
+	}
+	// No filter is configured, so the placeholder is staged as it is
+	stagePlaceholder := func(filename string, info *LOBInfo) {
+		Expect(ioutil.WriteFile(filename, []byte(getLOBPlaceholderContent(info.SHA)), 0644)).To(BeNil())
+		RunGitCommandForTest(true, "add", filename)
+	}
+	expectRetrieves := func(info *LOBInfo, data []byte) {
+		var buf bytes.Buffer
+		_, err := testRepo().RetrieveLOB(info.SHA, &buf)
+		Expect(err).To(BeNil(), "Should retrieve LOB")
+		Expect(buf.Bytes()).To(Equal(data))
+	}
+
+	It("Reuses the leading chunks of the version in the index", func() {
+		v1 := getRandomData(3500, 1)
+		info1, err := testRepo().StoreLOBForFile(bytes.NewReader(v1), nil, "audio.bin")
+		Expect(err).To(BeNil())
+		Expect(info1.Version).To(Equal(LOBInfoVersionFixedChunkSize), "Nothing in the index to reuse")
+		stagePlaceholder("audio.bin", info1)
+
+		v2 := append(append([]byte(nil), v1...), getRandomData(2000, 2)...)
+		info2, err := testRepo().StoreLOBForFile(bytes.NewReader(v2[100:]), v2[:100], "audio.bin")
+		Expect(err).To(BeNil())
+		Expect(info2.Version).To(Equal(LOBInfoVersionChunkObjects))
+		Expect(info2.NumChunks).To(Equal(6))
+		for i := 0; i < 3; i++ {
+			Expect(info2.Chunks[i].SHA).To(Equal(calculateSHA(GetLOBSHAAlgorithm(info2.SHA), v1[i*1000:(i+1)*1000])))
+			prevstat, err := os.Stat(testRepo().GetLOBChunkPathInBaseDir(testRepo().GetLocalLOBRoot(), info1.SHA, i))
+			Expect(err).To(BeNil())
+			stat, err := os.Stat(testRepo().GetChunkObjectPathInBaseDir(testRepo().GetLocalLOBRoot(), info2.Chunks[i].SHA))
+			Expect(err).To(BeNil())
+			Expect(os.SameFile(prevstat, stat)).To(BeTrue(), "Chunk %d should be linked from the previous version", i)
+		}
+		expectRetrieves(info2, v2)
+		stagePlaceholder("audio.bin", info2)
+
+		v3 := append(append([]byte(nil), v2...), getRandomData(700, 3)...)
+		info3, err := testRepo().StoreLOBForFile(bytes.NewReader(v3), nil, "audio.bin")
+		Expect(err).To(BeNil())
+		Expect(info3.Chunks[:5]).To(Equal(info2.Chunks[:5]), "Chunk objects of the previous version should be reused")
+		expectRetrieves(info3, v3)
+	})
+
+	It("Stores as normal if the start of the file has changed", func() {
+		v1 := getRandomData(3500, 1)
+		info1, err := testRepo().StoreLOBForFile(bytes.NewReader(v1), nil, "audio.bin")
+		Expect(err).To(BeNil())
+		stagePlaceholder("audio.bin", info1)
+
+		v2 := append(getRandomData(10, 4), v1...)
+		info2, err := testRepo().StoreLOBForFile(bytes.NewReader(v2), nil, "audio.bin")
+		Expect(err).To(BeNil())
+		Expect(info2.Version).To(Equal(LOBInfoVersionFixedChunkSize))
+		expectRetrieves(info2, v2)
+
+		GlobalOptions.AppendChunking = false
+		v3 := append(append([]byte(nil), v1...), getRandomData(100, 5)...)
+		info3, err := testRepo().StoreLOBForFile(bytes.NewReader(v3), nil, "audio.bin")
+		Expect(err).To(BeNil())
+		Expect(info3.Version).To(Equal(LOBInfoVersionFixedChunkSize), "Only when git-lob.append-chunking is enabled")
+	})
+})
@@ -0,0 +1,500 @@
+package core
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// History archives
+// Long-lived projects accumulate binaries which only very old commits use. Archiving a range of
+// history writes every binary which nothing outside that range needs into a single tar file for
+// cheap offline storage, then removes them from the local store (and optionally a remote). The
+// tar starts with a manifest listing the binaries & their files, followed by the files themselves
+// with the same relative paths they have on a remote, so restoring is just a matter of putting
+// them back.
+
+// Format of the archive manifest
+const ArchiveManifestVersion = 1
+
+// Name of the manifest, the first entry in an archive
+const archiveManifestName = "git-lob-archive.json"
+
+type ArchiveCallbackType int
+
+const (
+	// Still working out which binaries to archive
+	ArchiveWorking ArchiveCallbackType = iota
+	// Binary was written to the archive, or restored from it
+	ArchiveStored ArchiveCallbackType = iota
+	// Restored binary was uploaded to the remote
+	ArchiveUploaded ArchiveCallbackType = iota
+	// Binary could not be restored or uploaded
+	ArchiveError ArchiveCallbackType = iota
+)
+
+// Collected callback data for archiving & restoring
+type ArchiveCallbackData struct {
+	// What happened
+	Type ArchiveCallbackType
+	// The binary it happened to (not ArchiveWorking)
+	SHA string
+	// Size of the binary
+	Size int64
+	// Number of binaries processed so far (including this one) & in total
+	Done  int
+	Total int
+	// Error for ArchiveError
+	Error error
+}
+
+// What an archive contains
+type ArchiveManifest struct {
+	// See ArchiveManifestVersion
+	Version int
+	// When the archive was written
+	Created time.Time
+	// The range of history archived, as given & as commits (From is "" for all history up to To)
+	RefSpec string
+	From    string `json:",omitempty"`
+	To      string
+	// Binaries in the archive
+	LOBs []*ArchivedLOB
+}
+
+// A binary in an archive
+type ArchivedLOB struct {
+	SHA  string
+	Size int64
+	// Files of the binary in the archive, relative to the root of a store with / separators
+	// Chunk objects shared by several binaries are only in the archive once, but listed for each
+	Files []string
+}
+
+// Total size of the binaries in an archive
+func (self *ArchiveManifest) TotalSize() int64 {
+	var ret int64
+	for _, lob := range self.LOBs {
+		ret += lob.Size
+	}
+	return ret
+}
+
+// Run git & call back for every binary referenced by a '+' line of the diffs it prints
+func (r *Repo) scanGitOutputForLOBReferences(args []string, stdin io.Reader, callback func(sha string)) error {
+	cmd := r.command("git", args...)
+	cmd.Stdin = stdin
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.New("Unable to query git log for binary references: " + err.Error())
+	}
+	scanner := bufio.NewScanner(stdout)
+	err = cmd.Start()
+	if err != nil {
+		return errors.New("Unable to query git log for binary references: " + err.Error())
+	}
+	for scanner.Scan() {
+		if sha := lobReferenceFromDiffLine(scanner.Text()); sha != "" {
+			callback(sha)
+		}
+	}
+	err = cmd.Wait()
+	if err != nil {
+		return errors.New("Unable to query git log for binary references: " + err.Error())
+	}
+	return nil
+}
+
+// Get the binaries needed only by commits in a range of history (all history up to & including
+// a ref if refspec isn't a range), i.e. added in the range & not needed to check out any commit
+// reachable from a ref which is outside it. HEAD must not be in the range.
+func (r *Repo) GetLOBsOnlyInHistoryRange(refspec *GitRefSpec, callback func()) ([]string, error) {
+	if refspec.IsRange() && refspec.RangeOp != ".." {
+		return nil, errors.New("Only the '..' range operator can be used to archive history")
+	}
+	rangeArg := refspec.String()
+	out, err := r.command("git", "rev-list", rangeArg).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list commits in %v: %v", rangeArg, err.Error())
+	}
+	inRange := util.NewStringSetFromSlice(strings.Fields(string(out)))
+	if inRange.Cardinality() == 0 {
+		return []string{}, nil
+	}
+	if head, err := r.GitRefToFullSHA("HEAD"); err == nil && inRange.Contains(head) {
+		return nil, fmt.Errorf("HEAD is in %v, only history you no longer have checked out can be archived", rangeArg)
+	}
+
+	// Binaries added in the range
+	candidates := util.NewStringSet()
+	err = r.scanGitOutputForLOBReferences([]string{"log", "--no-color", "--oneline", "-p", "-G", SHALineRegexStr, rangeArg}, nil,
+		func(sha string) {
+			callback()
+			candidates.Add(sha)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// Every other commit, & the ones which are children of commits in the range
+	out, err = r.command("git", "rev-list", "--all", "--parents").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list commits: %v", err.Error())
+	}
+	var outside bytes.Buffer
+	var boundary []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || inRange.Contains(fields[0]) {
+			continue
+		}
+		outside.WriteString(fields[0])
+		outside.WriteString("\n")
+		for _, parent := range fields[1:] {
+			if inRange.Contains(parent) {
+				boundary = append(boundary, fields[0])
+				break
+			}
+		}
+	}
+
+	// Commits outside the range need what they add, plus whatever they inherit from the range,
+	// which is all in the snapshots of the commits on its boundary
+	needed := util.NewStringSet()
+	if outside.Len() > 0 {
+		err = r.scanGitOutputForLOBReferences([]string{"log", "--no-walk=unsorted", "--stdin", "--no-color", "--oneline", "-p", "-G", SHALineRegexStr},
+			&outside, func(sha string) {
+				callback()
+				needed.Add(sha)
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, commit := range boundary {
+		callback()
+		shas, err := r.GetGitAllLOBsToCheckoutAtCommit(commit, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, sha := range shas {
+			needed.Add(sha)
+		}
+	}
+
+	var ret []string
+	for sha := range candidates.Difference(needed).Iter() {
+		ret = append(ret, sha)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Archive the binaries needed only by a range of history (see GetLOBsOnlyInHistoryRange) into a
+// tar file at archiveFile, then delete them from the local store & from a remote if provider is
+// not nil (only smart remotes can delete binaries). Every binary must be complete locally.
+func (r *Repo) ArchiveHistory(refspec *GitRefSpec, archiveFile string, provider providers.SyncProvider, remoteName string,
+	dryRun bool, callback func(data *ArchiveCallbackData) (quit bool)) (*ArchiveManifest, error) {
+
+	var smartProvider providers.SmartSyncProvider
+	if provider != nil {
+		smartProvider = providers.UpgradeToSmartSyncProvider(provider)
+		if smartProvider == nil {
+			return nil, fmt.Errorf("Remote %v uses the '%v' provider, binaries can only be removed from 'smart' remotes", remoteName, provider.TypeID())
+		}
+	}
+	if util.FileExists(archiveFile) {
+		return nil, fmt.Errorf("%v already exists", archiveFile)
+	}
+
+	shas, err := r.GetLOBsOnlyInHistoryRange(refspec, func() { callback(&ArchiveCallbackData{Type: ArchiveWorking}) })
+	if err != nil {
+		return nil, err
+	}
+	manifest := &ArchiveManifest{Version: ArchiveManifestVersion, Created: time.Now(), RefSpec: refspec.String()}
+	if refspec.IsRange() {
+		manifest.From, _ = r.GitRefToFullSHA(refspec.Ref1)
+		manifest.To, _ = r.GitRefToFullSHA(refspec.Ref2)
+	} else {
+		manifest.To, _ = r.GitRefToFullSHA(refspec.Ref1)
+	}
+
+	// Everything must be here & intact before anything is written, let alone deleted
+	root := r.GetLocalLOBRoot()
+	var missing []string
+	for _, sha := range shas {
+		callback(&ArchiveCallbackData{Type: ArchiveWorking})
+		files, info, err := r.getLOBFilesForSHA(sha, root, true, true)
+		if err != nil {
+			if IsIntegrityError(err) {
+				return nil, fmt.Errorf("Binary %v is corrupt, run 'git lob fsck' to repair it", sha)
+			}
+			missing = append(missing, sha)
+			continue
+		}
+		lob := &ArchivedLOB{SHA: sha, Size: info.Size}
+		for _, f := range files {
+			lob.Files = append(lob.Files, filepath.ToSlash(f))
+		}
+		manifest.LOBs = append(manifest.LOBs, lob)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%d binaries in %v are not complete locally, fetch them first (e.g. git lob fetch <remote> %v)",
+			len(missing), refspec.String(), refspec.String())
+	}
+	if dryRun || len(manifest.LOBs) == 0 {
+		return manifest, nil
+	}
+
+	err = writeArchive(archiveFile, manifest, root, callback)
+	if err != nil {
+		return nil, err
+	}
+
+	if smartProvider != nil {
+		deleted, retained, held, err := smartProvider.PruneLOBs(remoteName, shas, false)
+		if err != nil {
+			return manifest, fmt.Errorf("Archive written but unable to remove binaries from %v: %v", remoteName, err.Error())
+		}
+		if len(deleted) > 0 {
+			err = r.forgetRemoteKnownLOBs(remoteName)
+			if err != nil {
+				r.Log.Debugf("Unable to forget binaries known to be on %v: %v\n", remoteName, err.Error())
+			}
+		}
+		if len(retained)+len(held) > 0 {
+			r.Log.Debugf("%v kept %d archived binaries\n", remoteName, len(retained)+len(held))
+		}
+	}
+	for _, sha := range shas {
+		err = r.DeleteLOB(sha)
+		if err != nil {
+			r.Log.Errorf("Unable to delete archived binary %v: %v\n", sha, err.Error())
+		}
+	}
+	r.pruneLocalChunkObjects()
+	// Disposable copies, which may include binaries just deleted
+	r.purgeSmudgeCache(true)
+	return manifest, nil
+}
+
+// Write the manifest & the files of every binary in it from basedir to a tar file
+// Written to a temporary file first, so that a partial archive never looks complete
+func writeArchive(archiveFile string, manifest *ArchiveManifest, basedir string,
+	callback func(data *ArchiveCallbackData) (quit bool)) error {
+
+	tmpFile := archiveFile + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to create %v: %v", archiveFile, err.Error())
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmpFile)
+		return fmt.Errorf("Unable to write %v: %v", archiveFile, err.Error())
+	}
+
+	w := bufio.NewWriter(f)
+	tw := tar.NewWriter(w)
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fail(err)
+	}
+	err = tw.WriteHeader(&tar.Header{Name: archiveManifestName, Mode: 0644, Size: int64(len(manifestBytes)), ModTime: manifest.Created})
+	if err == nil {
+		_, err = tw.Write(manifestBytes)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	written := util.NewStringSet()
+	for i, lob := range manifest.LOBs {
+		for _, name := range lob.Files {
+			if !written.Add(name) {
+				continue
+			}
+			err = addFileToArchive(tw, name, getLOBStoreFilePath(basedir, filepath.FromSlash(name)))
+			if err != nil {
+				return fail(err)
+			}
+		}
+		if callback(&ArchiveCallbackData{Type: ArchiveStored, SHA: lob.SHA, Size: lob.Size, Done: i + 1, Total: len(manifest.LOBs)}) {
+			return fail(errors.New("cancelled"))
+		}
+	}
+
+	err = tw.Close()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return fail(err)
+	}
+	f.Close()
+	return os.Rename(tmpFile, archiveFile)
+}
+
+func addFileToArchive(tw *tar.Writer, name, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, src)
+	return err
+}
+
+// Read the manifest of an archive
+func ReadArchiveManifest(archiveFile string) (*ArchiveManifest, error) {
+	f, err := os.Open(archiveFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readArchiveManifest(tar.NewReader(bufio.NewReader(f)), archiveFile)
+}
+
+func readArchiveManifest(tr *tar.Reader, archiveFile string) (*ArchiveManifest, error) {
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != archiveManifestName {
+		return nil, fmt.Errorf("%v is not a git-lob archive", archiveFile)
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %v: %v", archiveFile, err.Error())
+	}
+	manifest := &ArchiveManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("%v has an invalid manifest: %v", archiveFile, err.Error())
+	}
+	if manifest.Version > ArchiveManifestVersion {
+		return nil, fmt.Errorf("%v was written by a newer version of git-lob", archiveFile)
+	}
+	return manifest, nil
+}
+
+// Restore the binaries in an archive to the local store (and the shared store, if one is used),
+// verifying each one, then upload them to a remote if provider is not nil
+// Binaries which can't be restored or uploaded are reported to callback as ArchiveError & the
+// rest carry on; an error is returned if the archive itself can't be read
+func (r *Repo) RestoreArchive(archiveFile string, provider providers.SyncProvider, remoteName string, dryRun bool,
+	callback func(data *ArchiveCallbackData) (quit bool)) (*ArchiveManifest, error) {
+
+	f, err := os.Open(archiveFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(bufio.NewReader(f))
+	manifest, err := readArchiveManifest(tr, archiveFile)
+	if err != nil || dryRun {
+		return manifest, err
+	}
+
+	basedir := r.GetLocalLOBRoot()
+	if r.IsUsingSharedStorage() {
+		basedir = r.GetSharedLOBRoot()
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("Unable to read %v: %v", archiveFile, err.Error())
+		}
+		callback(&ArchiveCallbackData{Type: ArchiveWorking})
+		err = r.restoreArchiveFile(tr, hdr, basedir)
+		if err != nil {
+			return manifest, fmt.Errorf("Unable to restore %v from %v: %v", hdr.Name, archiveFile, err.Error())
+		}
+	}
+
+	var filenames map[string]string
+	pushCallback := func(*util.ProgressCallbackData) bool { return false }
+	if provider != nil {
+		var recordUsage func()
+		pushCallback, recordUsage = r.trackTransferUsage(remoteName, true, pushCallback)
+		defer recordUsage()
+		shas := make([]string, 0, len(manifest.LOBs))
+		for _, lob := range manifest.LOBs {
+			shas = append(shas, lob.SHA)
+		}
+		filenames = r.getLOBFilenamesForPush(shas, nil, provider)
+	}
+	for i, lob := range manifest.LOBs {
+		data := &ArchiveCallbackData{Type: ArchiveStored, SHA: lob.SHA, Size: lob.Size, Done: i + 1, Total: len(manifest.LOBs)}
+		err := r.CheckLOBFilesForSHA(lob.SHA, r.GetLocalLOBRoot(), true)
+		if err == nil && provider != nil {
+			err = r.pushSingle(lob.SHA, filenames[lob.SHA], provider, remoteName, false, pushCallback)
+			if err == nil {
+				data.Type = ArchiveUploaded
+			}
+		}
+		if err != nil {
+			data.Type = ArchiveError
+			data.Error = err
+		}
+		if callback(data) {
+			break
+		}
+	}
+	return manifest, nil
+}
+
+// Restore a single file from an archive into a store
+func (r *Repo) restoreArchiveFile(rd io.Reader, hdr *tar.Header, basedir string) error {
+	// Only accept the files of binaries, so nothing can be written outside the store
+	rel := filepath.FromSlash(hdr.Name)
+	if _, ok := getLOBStoreFileSHA(rel); !ok || convertLOBStoreRelativePath(rel, LOBStoreLayoutOriginal) != rel {
+		return errors.New("not a file of a binary")
+	}
+	dest := r.getLOBStoreFilePathCreatingDir(basedir, rel)
+	if !util.FileExistsAndIsOfSize(dest, hdr.Size) {
+		tmp := dest + ".restoring"
+		out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, rd)
+		out.Close()
+		if err == nil {
+			os.Remove(dest)
+			err = os.Rename(tmp, dest)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if r.IsUsingSharedStorage() {
+		return r.linkSharedLOBFilename(dest)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Archive", func() {
+	root := filepath.Join(os.TempDir(), "ArchiveTest")
+	archiveFile := filepath.Join(os.TempDir(), "ArchiveTest.tar")
+	var oldwd string
+	var lobs []*LOBInfo
+	var contents [][]byte
+	nocallback := func(data *ArchiveCallbackData) bool { return false }
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		CreateInitialCommitForTest(root)
+		lobs = nil
+		contents = nil
+		for i := 0; i < 4; i++ {
+			content := bytes.Repeat([]byte{byte('a' + i)}, 1000*(i+1))
+			info, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+			Expect(err).To(BeNil())
+			lobs = append(lobs, info)
+			contents = append(contents, content)
+		}
+		// v1 adds 0 & 1, v2 replaces 0 with 2, HEAD replaces 2 with 3; 1 is used throughout
+		CreateCommitReferencingLOBsForTest(root, map[string]string{lobs[0].SHA: "a.bin", lobs[1].SHA: "b.bin"})
+		RunGitCommandForTest(true, "tag", "v1")
+		CreateCommitReferencingLOBsForTest(root, map[string]string{lobs[2].SHA: "a.bin"})
+		RunGitCommandForTest(true, "tag", "v2")
+		CreateCommitReferencingLOBsForTest(root, map[string]string{lobs[3].SHA: "a.bin"})
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		os.Remove(archiveFile)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+	})
+
+	It("Finds binaries used only by a range of history", func() {
+		shas, err := testRepo().GetLOBsOnlyInHistoryRange(ParseGitRefSpec("v1"), func() {})
+		Expect(err).To(BeNil())
+		Expect(shas).To(Equal([]string{lobs[0].SHA}), "Binaries still used later should not be included")
+		shas, err = testRepo().GetLOBsOnlyInHistoryRange(ParseGitRefSpec("v1..v2"), func() {})
+		Expect(err).To(BeNil())
+		Expect(shas).To(Equal([]string{lobs[2].SHA}))
+
+		// A branch off the range still uses what it inherited
+		maint := RunGitCommandForTest(true, "commit-tree", "v1^{tree}", "-p", "v1", "-m", "Maintenance")
+		RunGitCommandForTest(true, "branch", "maint", strings.TrimSpace(maint))
+		shas, err = testRepo().GetLOBsOnlyInHistoryRange(ParseGitRefSpec("v1"), func() {})
+		Expect(err).To(BeNil())
+		Expect(shas).To(BeEmpty())
+
+		_, err = testRepo().GetLOBsOnlyInHistoryRange(ParseGitRefSpec("v2..HEAD"), func() {})
+		Expect(err).ToNot(BeNil(), "HEAD can't be archived")
+	})
+
+	It("Archives & restores", func() {
+		manifest, err := testRepo().ArchiveHistory(ParseGitRefSpec("v2"), archiveFile, nil, "", true, nocallback)
+		Expect(err).To(BeNil())
+		Expect(manifest.LOBs).To(HaveLen(2))
+		Expect(FileExists(archiveFile)).To(BeFalse(), "Dry run should not write an archive")
+
+		manifest, err = testRepo().ArchiveHistory(ParseGitRefSpec("v2"), archiveFile, nil, "", false, nocallback)
+		Expect(err).To(BeNil())
+		Expect(manifest.TotalSize()).To(Equal(lobs[0].Size + lobs[2].Size))
+		Expect(FileExists(archiveFile)).To(BeTrue())
+		for _, i := range []int{0, 2} {
+			_, err = testRepo().GetLOBInfo(lobs[i].SHA)
+			Expect(err).ToNot(BeNil(), "Archived binaries should be removed")
+		}
+		_, err = testRepo().GetLOBInfo(lobs[1].SHA)
+		Expect(err).To(BeNil(), "Binaries still in use should be kept")
+
+		_, err = testRepo().ArchiveHistory(ParseGitRefSpec("v2"), archiveFile, nil, "", false, nocallback)
+		Expect(err).ToNot(BeNil(), "Should not overwrite an archive")
+
+		read, err := ReadArchiveManifest(archiveFile)
+		Expect(err).To(BeNil())
+		Expect(read.RefSpec).To(Equal("v2"))
+		Expect(read.LOBs).To(HaveLen(2))
+
+		var restored []string
+		_, err = testRepo().RestoreArchive(archiveFile, nil, "", false, func(data *ArchiveCallbackData) bool {
+			if data.Type == ArchiveStored {
+				restored = append(restored, data.SHA)
+			}
+			Expect(data.Type).ToNot(Equal(ArchiveError))
+			return false
+		})
+		Expect(err).To(BeNil())
+		Expect(restored).To(ConsistOf(lobs[0].SHA, lobs[2].SHA))
+		for _, i := range []int{0, 2} {
+			var buf bytes.Buffer
+			_, err = testRepo().RetrieveLOB(lobs[i].SHA, &buf)
+			Expect(err).To(BeNil())
+			Expect(buf.Bytes()).To(Equal(contents[i]))
+		}
+	})
+})
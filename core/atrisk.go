@@ -0,0 +1,187 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+type AtRiskCallbackType int
+
+const (
+	// Process is just working through data (progress update)
+	AtRiskWorking AtRiskCallbackType = iota
+	// Starting to check a remote for binaries not present locally (Count = number to check)
+	AtRiskCheckingRemote AtRiskCallbackType = iota
+	// A remote could not be checked, binaries only stored there will be reported as at risk
+	AtRiskRemoteError AtRiskCallbackType = iota
+	// Binary referenced by a reachable commit is neither local nor on any remote checked
+	// Path & CommitSummary identify the most recent commit which added it
+	AtRiskMissing AtRiskCallbackType = iota
+)
+
+// Collected callback data for an at risk operation
+type AtRiskCallbackData struct {
+	// What stage of the process this is for
+	Type AtRiskCallbackType
+	// SHA of the binary for AtRiskMissing
+	LOBSHA string
+	// Path of the file which referenced it (relative to repo root) for AtRiskMissing
+	Path string
+	// Commit summary for AtRiskMissing
+	CommitSummary *GitCommitSummary
+	// Remote for AtRiskCheckingRemote & AtRiskRemoteError
+	RemoteName string
+	// Number of binaries still to be found, for AtRiskCheckingRemote
+	Count int
+	// Error details for AtRiskRemoteError
+	Error error
+}
+
+// Find binaries which are referenced by commits reachable from any branch or tag, but whose
+// content is neither in the local store nor on any of the remotes named (or all remotes with
+// a git-lob provider configured, if none are named). This is data which will be lost for good
+// unless it can be found somewhere else, e.g. on the machine of the person who committed it.
+// The local store is checked first, then each remote in turn for only what hasn't been found
+// yet, so remotes are asked about as few binaries as possible.
+// Returns the SHAs which are at risk
+func (r *Repo) FindAtRisk(remoteNames []string, callback func(data *AtRiskCallbackData) (quit bool)) ([]string, error) {
+	// Most recent commit & file which added each binary, in reverse chronological order
+	referenced, err := r.getAllLOBsReferencedInHistory(callback)
+	if err != nil {
+		return []string{}, err
+	}
+
+	// Everything not complete locally (including --metadata-only) needs looking for
+	var remaining []string
+	for _, ref := range referenced {
+		if callback(&AtRiskCallbackData{Type: AtRiskWorking}) {
+			return []string{}, nil
+		}
+		if r.CheckLOBFilesForSHA(ref.SHA, r.GetLocalLOBRoot(), false) != nil {
+			remaining = append(remaining, ref.SHA)
+		}
+	}
+
+	if len(remoteNames) == 0 && len(remaining) > 0 {
+		remoteNames, err = r.GetGitLOBRemotes()
+		if err != nil {
+			return []string{}, err
+		}
+	}
+	for _, remoteName := range remoteNames {
+		if len(remaining) == 0 {
+			break
+		}
+		if callback(&AtRiskCallbackData{Type: AtRiskCheckingRemote, RemoteName: remoteName, Count: len(remaining)}) {
+			return []string{}, nil
+		}
+		provider, err := r.GetProvider(remoteName)
+		if err != nil {
+			if callback(&AtRiskCallbackData{Type: AtRiskRemoteError, RemoteName: remoteName, Error: err}) {
+				return []string{}, nil
+			}
+			continue
+		}
+		found, quit := r.findLOBsOnRemote(remaining, provider, remoteName, callback)
+		provider.Release()
+		if quit {
+			return []string{}, nil
+		}
+		var notfound []string
+		for _, sha := range remaining {
+			if !found.Contains(sha) {
+				notfound = append(notfound, sha)
+			}
+		}
+		remaining = notfound
+	}
+
+	atRisk := util.NewStringSetFromSlice(remaining)
+	ret := make([]string, 0, len(remaining))
+	for _, ref := range referenced {
+		if !atRisk.Contains(ref.SHA) {
+			continue
+		}
+		ret = append(ret, ref.SHA)
+		summary, err := r.GetGitCommitSummary(ref.Commit)
+		if err != nil {
+			summary = &GitCommitSummary{SHA: ref.Commit, ShortSHA: ref.Commit[:7]}
+		}
+		if callback(&AtRiskCallbackData{Type: AtRiskMissing, LOBSHA: ref.SHA, Path: ref.Filename, CommitSummary: summary}) {
+			break
+		}
+	}
+	return ret, nil
+}
+
+// A binary referenced in history, with the most recent commit & file which added it
+type atRiskLOBRef struct {
+	SHA      string
+	Commit   string
+	Filename string
+}
+
+// Get every binary added by a commit reachable from any ref, most recently added first
+func (r *Repo) getAllLOBsReferencedInHistory(callback func(data *AtRiskCallbackData) (quit bool)) ([]*atRiskLOBRef, error) {
+	cmd := r.command("git", "log", "--all", `--format=commitsha: %H %P`, "-p", "-G", SHALineRegexStr)
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
+	}
+	var ret []*atRiskLOBRef
+	seen := util.NewStringSet()
+	quit, err := walkGitLogOutputForLOBReferences(outp, true, false, nil, nil, func(commitLOB *CommitLOBRef) (bool, error) {
+		for _, filelob := range commitLOB.FileLOBs {
+			if seen.Add(filelob.SHA) {
+				ret = append(ret, &atRiskLOBRef{filelob.SHA, commitLOB.Commit, filelob.Filename})
+			}
+		}
+		return callback(&AtRiskCallbackData{Type: AtRiskWorking}), nil
+	})
+	if quit || err != nil {
+		// Don't leave git blocked writing output nobody is reading
+		cmd.Process.Kill()
+	}
+	cmd.Wait()
+	return ret, err
+}
+
+// Find which of a list of binaries are complete on a remote
+// Smart servers which allow listing their binaries are asked for everything in one request,
+// then only binaries they have any files for are checked individually
+func (r *Repo) findLOBsOnRemote(shas []string, provider providers.SyncProvider, remoteName string,
+	callback func(data *AtRiskCallbackData) (quit bool)) (found util.StringSet, quit bool) {
+
+	found = util.NewStringSet()
+	candidates := shas
+	if smartProvider := providers.UpgradeToSmartSyncProvider(provider); smartProvider != nil {
+		listed, err := smartProvider.ListLOBs(remoteName)
+		if err == nil {
+			listedSet := util.NewStringSetFromSlice(listed)
+			candidates = nil
+			for _, sha := range shas {
+				if listedSet.Contains(sha) {
+					candidates = append(candidates, sha)
+				}
+			}
+		} else {
+			r.Log.Debugf("Unable to list binaries on %v, checking each instead: %v\n", remoteName, err.Error())
+		}
+	}
+	for _, sha := range candidates {
+		if callback(&AtRiskCallbackData{Type: AtRiskWorking, RemoteName: remoteName}) {
+			return found, true
+		}
+		if r.CheckRemoteLOBFilesForSHA(sha, provider, remoteName) == nil {
+			found.Add(sha)
+		}
+	}
+	return found, false
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("AtRisk", func() {
+	root := filepath.Join(os.TempDir(), "AtRiskTest")
+	originBinStore := filepath.Join(os.TempDir(), "AtRiskOriginBinStoreTest")
+	var oldwd string
+	filespercommit := [][]string{
+		[]string{"img1.png", filepath.Join("movies", "movie1.mov")},
+		[]string{"img2.png"},
+	}
+	var shaspercommit [][]string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		os.MkdirAll(originBinStore, 0755)
+
+		// 'broken' has no path so can't be checked, 'plain' doesn't use git-lob at all
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		Expect(err).To(BeNil(), "Should not error trying to open config file")
+		f.WriteString(fmt.Sprintf(`
+[remote "origin"]
+    url = file:///dummy/origin
+    git-lob-path = %v
+    git-lob-provider = filesystem
+[remote "broken"]
+    url = file:///dummy/broken
+    git-lob-provider = filesystem
+[remote "plain"]
+    url = http://dummy/plain
+`, strings.Replace(originBinStore, "\\", "/", -1)))
+		f.Close()
+		LoadConfig(GlobalOptions)
+		InitCoreProviders()
+
+		shaspercommit = CreateManyCommitsForTest(filespercommit, 0, func(filename string, i int) int64 { return 500 })
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		err = ForceRemoveAll(originBinStore)
+		if err != nil {
+			Fail(err.Error())
+		}
+		// Reset git config
+		GlobalOptions = NewOptions()
+	})
+
+	It("Finds binaries not stored locally or on any remote", func() {
+		provider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil())
+		callback := func(data *ProgressCallbackData) (abort bool) { return false }
+		// First binary pushed, second only local, third only local
+		Expect(testRepo().PushSingle(shaspercommit[0][0], provider, "origin", false, callback)).To(BeNil())
+
+		var missing []*AtRiskCallbackData
+		var checked, remoteErrors []string
+		atRiskCallback := func(data *AtRiskCallbackData) (quit bool) {
+			switch data.Type {
+			case AtRiskMissing:
+				missing = append(missing, data)
+			case AtRiskCheckingRemote:
+				checked = append(checked, data.RemoteName)
+			case AtRiskRemoteError:
+				remoteErrors = append(remoteErrors, data.RemoteName)
+			}
+			return false
+		}
+		shas, err := testRepo().FindAtRisk(nil, atRiskCallback)
+		Expect(err).To(BeNil())
+		Expect(shas).To(BeEmpty(), "Nothing at risk while all local")
+		Expect(checked).To(BeEmpty(), "Remotes shouldn't be checked when all local")
+
+		// Lose the first 2 from the local store
+		testRepo().DeleteLOB(shaspercommit[0][0])
+		testRepo().DeleteLOB(shaspercommit[0][1])
+		shas, err = testRepo().FindAtRisk(nil, atRiskCallback)
+		Expect(err).To(BeNil())
+		Expect(shas).To(Equal([]string{shaspercommit[0][1]}), "Only binary not pushed should be at risk")
+		Expect(missing).To(HaveLen(1))
+		Expect(missing[0].LOBSHA).To(Equal(shaspercommit[0][1]))
+		Expect(missing[0].Path).To(Equal(filepath.ToSlash(filespercommit[0][1])))
+		Expect(missing[0].CommitSummary.Subject).To(Equal("Commit 0"), "Should report commit which added it")
+		Expect(checked).To(ConsistOf("origin", "broken"), "Should check remotes with providers only")
+		Expect(remoteErrors).To(Equal([]string{"broken"}), "Should report remotes which can't be checked")
+
+		// Checking only a remote which doesn't have it
+		missing, checked, remoteErrors = nil, nil, nil
+		shas, err = testRepo().FindAtRisk([]string{"broken"}, atRiskCallback)
+		Expect(err).To(BeNil())
+		Expect(shas).To(ConsistOf(shaspercommit[0][0], shaspercommit[0][1]), "Pushed binary at risk if its remote isn't checked")
+		Expect(checked).To(Equal([]string{"broken"}))
+	})
+})
@@ -14,69 +14,42 @@ import (
 type CheckoutCallback func(t util.ProgressCallbackType, filelob *FileLOB, err error)
 
 // Populate local placeholders with real content, if available. Do entire working copy unless limited to pathspecs
-func Checkout(pathspecs []string, dryRun bool, callback CheckoutCallback) error {
-	// We're going to scan for missing git-lob content not just by checking the working copy, but
-	// getting the expected content from git first. This is in case the working copy has had files
-	// deleted for example. We still check the content of the working copy if the file IS there
-	// in order to not overwrite modified files.
+func (r *Repo) Checkout(pathspecs []string, dryRun bool, callback CheckoutCallback) error {
+	return r.CheckoutWithLinkMode(pathspecs, dryRun, LinkModeCopy, callback)
+}
 
-	util.LogDebug("Checking for missing binary files in working copy")
+// Populate local placeholders with real content, if available. Do entire working copy unless limited to pathspecs
+// If linkMode is not LinkModeCopy, files share storage with the local LOB store where possible (see DedupeWorkingCopy)
+func (r *Repo) CheckoutWithLinkMode(pathspecs []string, dryRun bool, linkMode LinkMode, callback CheckoutCallback) error {
+	return r.CheckoutWorkspace(nil, pathspecs, dryRun, linkMode, callback)
+}
 
-	// firstly convert any pathspecs to the root of the repo, in case this is being executed in a sub-folder
-	reporoot, _, err := util.GetRepoRoot()
-	if err != nil {
-		return err
-	}
-	curdir, err := os.Getwd()
-	if err != nil {
-		return err
-	}
-	var rootedpathspecs []string
-	for _, p := range pathspecs {
-		var abs string
-		if filepath.IsAbs(p) {
-			abs = p
-		} else {
-			abs = filepath.Join(curdir, p)
-		}
-		reltoroot, err := filepath.Rel(reporoot, abs)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Unable to make %v relative to repo root %v", p, reporoot))
-		}
-		rootedpathspecs = append(rootedpathspecs, reltoroot)
-	}
+// Populate local placeholders with real content, if available, for files in a workspace
+// Files outside the workspace are left alone. ws may be nil to do entire working copy
+// Can be further limited to pathspecs, linkMode as CheckoutWithLinkMode
+func (r *Repo) CheckoutWorkspace(ws *Workspace, pathspecs []string, dryRun bool, linkMode LinkMode, callback CheckoutCallback) error {
+	return r.CheckoutWorkspaceWithProgress(ws, pathspecs, dryRun, linkMode, callback, nil)
+}
 
-	// Get what git thinks we should have
-	filelobs, err := GetGitAllFilesAndLOBsToCheckoutAtCommit("HEAD", rootedpathspecs, nil)
-	if err != nil {
-		return err
-	}
-	var modifiedfiles []string
-	for _, filelob := range filelobs {
-		// Check each file, and if it's missing or contains the placeholder text, replace it with content
-		// Otherwise, assume it's been locally modified and leave it alone (user can override this with git reset/checkout if they want)
-		absfile := filepath.Join(reporoot, filelob.Filename)
-		stat, err := os.Stat(absfile)
-		replaceContent := false
-		if err == nil {
-			// File existed, check content (smoke test on size)
-			if stat.Size() == int64(SHALineLen) {
-				// File existed and is right size for placeholder, so check contents
-				placeholderContent := getLOBPlaceholderContent(filelob.SHA)
-				filebytes, err := ioutil.ReadFile(absfile)
-				if err == nil && string(filebytes) == placeholderContent {
-					// File content is placeholder, so replace
-					replaceContent = true
-				}
-			}
-		} else {
-			// File did not exist
-			replaceContent = true
-		}
+// Populate local placeholders like CheckoutWorkspace, also reporting progress through the content
+// of each file as it's written to progress (if not nil), with Desc being the file name. callback is
+// still called when each file is complete
+func (r *Repo) CheckoutWorkspaceWithProgress(ws *Workspace, pathspecs []string, dryRun bool, linkMode LinkMode,
+	callback CheckoutCallback, progress util.ProgressCallback) error {
+	r.Log.Debug("Checking for missing binary files in working copy")
 
+	var modifiedfiles []string
+	err := r.walkFilesToCheckout(ws, pathspecs, func(absfile string, filelob *FileLOB, replaceContent bool) {
 		if replaceContent {
 			if !dryRun {
-				err = checkoutFile(absfile, filelob.SHA)
+				var fileProgress util.ProgressCallback
+				if progress != nil {
+					fileProgress = func(data *util.ProgressCallbackData) bool {
+						data.Desc = filelob.Filename
+						return progress(data)
+					}
+				}
+				err := r.checkoutFile(absfile, filelob.SHA, linkMode, fileProgress)
 				if err != nil {
 					if IsNotFoundError(err) {
 						// most common issue, log nicely
@@ -102,7 +75,9 @@ func Checkout(pathspecs []string, dryRun bool, callback CheckoutCallback) error
 		} else {
 			callback(util.ProgressSkip, filelob, nil)
 		}
-
+	})
+	if err != nil {
+		return err
 	}
 
 	var retErr error
@@ -111,32 +86,222 @@ func Checkout(pathspecs []string, dryRun bool, callback CheckoutCallback) error
 		// make sure that it is so) confuses git because the cached stat() info it stores no longer agrees with the file
 		// So 'git status' would report the files modified even though 'git diff' wouldn't. Confusing for the user!
 		// Cause git to refresh its index
-		retErr = GitRefreshIndexForFiles(modifiedfiles)
+		retErr = r.GitRefreshIndexForFiles(modifiedfiles)
 	}
 
 	if retErr == nil {
-		util.LogDebug("Successfully checked the working copy")
+		r.Log.Debug("Successfully checked the working copy")
 	}
 
 	return retErr
 
 }
 
-// Checkout a single file to a specific path
-func checkoutFile(path, sha string) error {
+// Call back for each binary file in HEAD which checkout would consider (limited to ws & pathspecs
+// as CheckoutWorkspace), with whether its content needs replacing because it's missing or a placeholder
+func (r *Repo) walkFilesToCheckout(ws *Workspace, pathspecs []string, callback func(absfile string, filelob *FileLOB, replaceContent bool)) error {
+	// We're going to scan for missing git-lob content not just by checking the working copy, but
+	// getting the expected content from git first. This is in case the working copy has had files
+	// deleted for example. We still check the content of the working copy if the file IS there
+	// in order to not overwrite modified files.
+
+	// firstly convert any pathspecs to the root of the repo, in case this is being executed in a sub-folder
+	reporoot, rootedpathspecs, err := r.getPathspecsRelativeToRepoRoot(pathspecs)
+	if err != nil {
+		return err
+	}
+
+	// Get what git thinks we should have
+	filelobs, err := r.GetGitAllFilesAndLOBsToCheckoutAtCommit("HEAD", rootedpathspecs, nil)
+	if err != nil {
+		return err
+	}
+	for _, filelob := range filelobs {
+		if ws != nil && !ws.Contains(filelob.Filename) {
+			continue
+		}
+		// Check each file, and if it's missing or contains the placeholder text, replace it with content
+		// Otherwise, assume it's been locally modified and leave it alone (user can override this with git reset/checkout if they want)
+		absfile := filepath.Join(reporoot, filelob.Filename)
+		stat, err := os.Stat(absfile)
+		replaceContent := false
+		if err == nil {
+			// File existed, check content (smoke test on size)
+			if isLOBPlaceholderSize(stat.Size()) {
+				// File existed and is right size for placeholder, so check contents
+				filebytes, err := ioutil.ReadFile(absfile)
+				if placeholder, ok := parseLOBPlaceholder(filebytes); err == nil && ok && placeholder.SHA == filelob.SHA {
+					// File content is placeholder, so replace
+					replaceContent = true
+				}
+			}
+		} else {
+			// File did not exist
+			replaceContent = true
+		}
+		callback(absfile, filelob, replaceContent)
+	}
+	return nil
+}
+
+// Where the content for a file would come from on checkout, see EstimateCheckoutWorkspace
+type CheckoutFileSource int
+
+const (
+	// Content is complete in the local binary store
+	CheckoutFileLocal CheckoutFileSource = iota
+	// Content would be fetched automatically first (git-lob.autofetch, or 'fetch --metadata-only')
+	CheckoutFileFetch CheckoutFileSource = iota
+	// Content is not available, the placeholder would be left as it is
+	CheckoutFileUnavailable CheckoutFileSource = iota
+)
+
+// Callback for each file which would be populated by a checkout
+// size is the size of the file content, or -1 if unknown (see CheckoutEstimate.LOBsSizeUnknown)
+type CheckoutEstimateCallback func(filelob *FileLOB, source CheckoutFileSource, size int64)
+
+// Estimated cost of a checkout, see EstimateCheckoutWorkspace
+type CheckoutEstimate struct {
+	// Number of files which would be populated (placeholders & deleted files)
+	Files int
+	// Of those, how many could not be because the content isn't available
+	FilesUnavailable int
+	// Bytes which would be written to the working copy, excluding content of unknown size
+	BytesToWrite int64
+	// Number of distinct binaries needed which are not complete in the local store
+	LOBsMissing int
+	// Of those, how many would be fetched automatically
+	LOBsToFetch int
+	// Number of binaries needed whose size is unknown, because their metadata hasn't been fetched
+	// or they've been shrunk (see Shrink)
+	LOBsSizeUnknown int
+	// Bytes which would be downloaded for LOBsToFetch, excluding those of unknown size
+	// Smart servers may send less than this (deltas & chunks already present are not downloaded)
+	BytesToDownload int64
+	// Bytes available on the filesystem holding the working copy, or -1 if that can't be determined
+	BytesFree int64
+}
+
+// Bytes of disk space the checkout needs: what's written to the working copy plus what's
+// downloaded to the binary store. This assumes both are on the same filesystem, so errs on the
+// side of caution if the store is elsewhere; it also excludes content of unknown size
+func (e *CheckoutEstimate) BytesNeeded() int64 {
+	return e.BytesToWrite + e.BytesToDownload
+}
+
+// Whether the filesystem holding the working copy has room for the checkout (true if unknown)
+func (e *CheckoutEstimate) HasEnoughDiskSpace() bool {
+	return e.BytesFree < 0 || e.BytesNeeded() <= e.BytesFree
+}
+
+// Work out what CheckoutWorkspace would do without changing anything: which files would be
+// populated, which binaries are missing locally & would be fetched automatically, and how many
+// bytes would be written & downloaded, & how much disk space is free for them. Only the local
+// store is consulted, not any remote
+// Arguments are as CheckoutWorkspace, callback is made for each file which would be populated
+func (r *Repo) EstimateCheckoutWorkspace(ws *Workspace, pathspecs []string, callback CheckoutEstimateCallback) (*CheckoutEstimate, error) {
+	type lobState struct {
+		source CheckoutFileSource
+		size   int64
+	}
+	lobStates := make(map[string]*lobState)
+	estimate := &CheckoutEstimate{}
+	err := r.walkFilesToCheckout(ws, pathspecs, func(absfile string, filelob *FileLOB, replaceContent bool) {
+		if !replaceContent {
+			return
+		}
+		state, ok := lobStates[filelob.SHA]
+		if !ok {
+			state = &lobState{CheckoutFileLocal, -1}
+			info, err := r.GetLOBInfo(filelob.SHA)
+			deltaPath, _ := r.findLocalLOBDelta(filelob.SHA)
+			if err != nil && deltaPath != "" {
+				// Shrunk, so would be rebuilt from its local delta; size unknown until then
+				estimate.LOBsSizeUnknown++
+			} else if err != nil {
+				// Checkout only fetches LOBs it has no metadata for with git-lob.autofetch
+				estimate.LOBsMissing++
+				state.source = CheckoutFileUnavailable
+				if IsNotFoundError(err) && r.Options.AutoFetchEnabled {
+					state.source = CheckoutFileFetch
+					estimate.LOBsToFetch++
+					estimate.LOBsSizeUnknown++
+				}
+			} else {
+				state.size = info.Size
+				if r.CheckLOBFilesForSHA(filelob.SHA, r.GetLocalLOBRoot(), false) != nil {
+					estimate.LOBsMissing++
+					state.source = CheckoutFileUnavailable
+					// Content is always fetched on demand after 'fetch --metadata-only'
+					if r.Options.AutoFetchEnabled || r.GetLazyFetchRemote() != "" {
+						state.source = CheckoutFileFetch
+						estimate.LOBsToFetch++
+						estimate.BytesToDownload += getLOBStoredSize(info)
+					}
+				}
+			}
+			lobStates[filelob.SHA] = state
+		}
+		estimate.Files++
+		if state.source == CheckoutFileUnavailable {
+			estimate.FilesUnavailable++
+		} else if state.size > 0 {
+			estimate.BytesToWrite += state.size
+		}
+		callback(filelob, state.source, state.size)
+	})
+	if err != nil {
+		return nil, err
+	}
+	estimate.BytesFree = -1
+	estimate.BytesFree, err = util.GetFreeDiskSpace(r.Root)
+	if err != nil {
+		r.Log.Debugf("Unable to determine free disk space: %v\n", err.Error())
+		estimate.BytesFree = -1
+	}
+	return estimate, nil
+}
+
+// Checkout a single file to a specific path, reporting progress of copying content if not nil
+func (r *Repo) checkoutFile(path, sha string, linkMode LinkMode, progress util.ProgressCallback) error {
+	if linkMode != LinkModeCopy {
+		used, err := r.linkLOBContent(sha, path, linkMode, 0644)
+		if err == nil {
+			r.Log.Debugf("Checked out %v as %v of stored content\n", path, used)
+			return nil
+		}
+		// Fall back on copying
+		r.Log.Debugf("Unable to link %v to stored content, copying instead: %v\n", path, err.Error())
+	}
 	err := os.MkdirAll(filepath.Dir(path), 0755)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Can't create parent directory of %v: %v\n", path, err.Error()))
 	}
+	// Keep the placeholder that's there (it may have metadata) in case we can't get the content
+	placeholderContent := []byte(getLOBPlaceholderContent(sha))
+	if stat, err := os.Stat(path); err == nil && isLOBPlaceholderSize(stat.Size()) {
+		filebytes, err := ioutil.ReadFile(path)
+		if placeholder, ok := parseLOBPlaceholder(filebytes); err == nil && ok && placeholder.SHA == sha {
+			placeholderContent = filebytes
+		}
+	}
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Can't open %v for writing: %v", path, err.Error()))
 	}
 	defer f.Close()
-	_, err = RetrieveLOB(sha, f)
+	_, err = r.RetrieveLOBWithProgress(sha, f, progress)
+	if err != nil && r.Options.AutoRepair && IsIntegrityError(err) {
+		// Corrupt content was written before it could be detected; it's been replaced, so try again
+		if err = f.Truncate(0); err == nil {
+			if _, err = f.Seek(0, os.SEEK_SET); err == nil {
+				_, err = r.RetrieveLOBWithProgress(sha, f, progress)
+			}
+		}
+	}
 	if err != nil {
 		// We already truncated the file so we need to re-write the placeholder contents
-		ioutil.WriteFile(path, []byte(getLOBPlaceholderContent(sha)), 0644)
+		ioutil.WriteFile(path, placeholderContent, 0644)
 		return err
 	}
 
@@ -156,7 +156,7 @@ var _ = Describe("Checkout", func() {
 
 		}
 		// Dry run test
-		err := Checkout(nil, true, testCallback)
+		err := testRepo().Checkout(nil, true, testCallback)
 		Expect(err).To(BeNil(), "Shouldn't fail calling checkout")
 		Expect(filesOK).To(BeEquivalentTo(len(filenames)), "All files should need to be updated")
 		Expect(filesSkipped).To(BeEquivalentTo(0), "No files should be skipped")
@@ -173,7 +173,7 @@ var _ = Describe("Checkout", func() {
 		filesSkipped = 0
 		filesFailed = 0
 		filesNotFound = 0
-		err = Checkout(nil, false, testCallback)
+		err = testRepo().Checkout(nil, false, testCallback)
 		Expect(err).To(BeNil(), "Shouldn't fail calling checkout")
 		Expect(filesOK).To(BeEquivalentTo(len(filenames)), "All files should be updated")
 		Expect(filesSkipped).To(BeEquivalentTo(0), "No files should be skipped")
@@ -191,7 +191,7 @@ var _ = Describe("Checkout", func() {
 		filesSkipped = 0
 		filesFailed = 0
 		filesNotFound = 0
-		err = Checkout(nil, false, testCallback)
+		err = testRepo().Checkout(nil, false, testCallback)
 		Expect(err).To(BeNil(), "Shouldn't fail calling 2nd checkout")
 		Expect(filesOK).To(BeEquivalentTo(0), "No files should be updated")
 		Expect(filesSkipped).To(BeEquivalentTo(len(filenames)), "All files should be skipped")
@@ -212,12 +212,35 @@ var _ = Describe("Checkout", func() {
 		}
 
 	})
+	It("Reports byte progress by file while checking out", func() {
+		var filesOK int
+		testCallback := func(t ProgressCallbackType, filelob *FileLOB, err error) {
+			if t == ProgressTransferBytes {
+				filesOK++
+			}
+		}
+		progressDone := make(map[string]int64)
+		progress := func(data *ProgressCallbackData) (abort bool) {
+			progressDone[data.Desc] = data.ItemBytesDone
+			return false
+		}
+		err := testRepo().CheckoutWorkspaceWithProgress(nil, nil, false, LinkModeCopy, testCallback, progress)
+		Expect(err).To(BeNil(), "Shouldn't fail calling checkout")
+		Expect(filesOK).To(BeEquivalentTo(len(filenames)), "All files should be updated")
+		Expect(progressDone).To(HaveLen(len(filenames)), "Should report progress by file name")
+		for i, file := range filenames {
+			Expect(progressDone[filepath.ToSlash(file)]).To(BeEquivalentTo(sizeForFile(i)), "Progress for %v should reach its size", file)
+			stat, err := os.Stat(file)
+			Expect(err).To(BeNil(), fmt.Sprintf("File %v should exist", file))
+			Expect(stat.Size()).To(BeEquivalentTo(sizeForFile(i)), fmt.Sprintf("File %v should be checked out & correct size", file))
+		}
+	})
 	It("Deals with missing stored files gracefully & recovers later", func() {
 		// Use the second branch as a way to simulate files coming in & out of scope
 		// Hard to test this fully without setting up a git filter which we can't do in a test because binary is not built
 		// Filter may or may not exist
 		// First checkout current branch stuff (don't check)
-		Checkout(nil, false, func(t ProgressCallbackType, filelob *FileLOB, err error) {})
+		testRepo().Checkout(nil, false, func(t ProgressCallbackType, filelob *FileLOB, err error) {})
 		// We shouldn't have any files from another branch to start with
 		for _, file := range extracommitfilenames {
 			// All should be correct size
@@ -241,12 +264,12 @@ var _ = Describe("Checkout", func() {
 
 			// Also, temporarily make the content unavailable by renaming it
 			// We know there's only 1 chunk here
-			f := filepath.Join(GetLocalLOBDir(sha), getLOBMetaFilename(sha))
+			f := filepath.Join(testRepo().GetLocalLOBDir(sha), getLOBMetaFilename(sha))
 			err = os.Rename(f, f+"_bak")
 			if err != nil {
 				Fail("Error moving data: " + err.Error())
 			}
-			f = filepath.Join(GetLocalLOBDir(sha), getLOBChunkFilename(sha, 0))
+			f = filepath.Join(testRepo().GetLocalLOBDir(sha), getLOBChunkFilename(sha, 0))
 			err = os.Rename(f, f+"_bak")
 			if err != nil {
 				Fail("Error moving data: " + err.Error())
@@ -270,7 +293,7 @@ var _ = Describe("Checkout", func() {
 			}
 
 		}
-		err = Checkout(nil, false, testCallback)
+		err = testRepo().Checkout(nil, false, testCallback)
 		Expect(err).To(BeNil(), "Shouldn't fail checking out 2nd branch")
 		Expect(filesOK).To(BeEquivalentTo(0), "No files should be updated because data is missing")
 		Expect(filesNotFound).To(BeEquivalentTo(len(extracommitfilenames)), "All files should be missing")
@@ -279,12 +302,12 @@ var _ = Describe("Checkout", func() {
 		// now put files back
 		for i, _ := range extracommitfilenames {
 			sha := extracommitshas[i]
-			f := filepath.Join(GetLocalLOBDir(sha), getLOBMetaFilename(sha))
+			f := filepath.Join(testRepo().GetLocalLOBDir(sha), getLOBMetaFilename(sha))
 			err = os.Rename(f+"_bak", f)
 			if err != nil {
 				Fail("Error moving data: " + err.Error())
 			}
-			f = filepath.Join(GetLocalLOBDir(sha), getLOBChunkFilename(sha, 0))
+			f = filepath.Join(testRepo().GetLocalLOBDir(sha), getLOBChunkFilename(sha, 0))
 			err = os.Rename(f+"_bak", f)
 			if err != nil {
 				Fail("Error moving data: " + err.Error())
@@ -292,13 +315,67 @@ var _ = Describe("Checkout", func() {
 		}
 		// Checkout should now work
 		filesNotFound = 0
-		err = Checkout(nil, false, testCallback)
+		err = testRepo().Checkout(nil, false, testCallback)
 		Expect(err).To(BeNil(), "Shouldn't fail checking out 2nd branch")
 		Expect(filesOK).To(BeEquivalentTo(len(extracommitfilenames)), "All files should now be updated because data is available")
 		Expect(filesNotFound).To(BeEquivalentTo(0), "No files should be missing")
 		Expect(filesFailed).To(BeEquivalentTo(0), "No files should have failed")
 
 	})
+	It("Estimates checkout without changing anything", func() {
+		var totalSize int64
+		for i, _ := range filenames {
+			totalSize += sizeForFile(i)
+		}
+		// Lose the content of the second file & metadata too for the third
+		shaForFile := func(file string) string {
+			b, err := ioutil.ReadFile(file)
+			Expect(err).To(BeNil())
+			return string(b[len(SHAPrefix):])
+		}
+		sha1, sha2 := shaForFile(filenames[1]), shaForFile(filenames[2])
+		Expect(os.Remove(filepath.Join(testRepo().GetLocalLOBDir(sha1), getLOBChunkFilename(sha1, 0)))).To(BeNil())
+		Expect(os.Remove(filepath.Join(testRepo().GetLocalLOBDir(sha2), getLOBChunkFilename(sha2, 0)))).To(BeNil())
+		Expect(os.Remove(filepath.Join(testRepo().GetLocalLOBDir(sha2), getLOBMetaFilename(sha2)))).To(BeNil())
+
+		oldAutoFetch := GlobalOptions.AutoFetchEnabled
+		defer func() { GlobalOptions.AutoFetchEnabled = oldAutoFetch }()
+		sources := make(map[string]CheckoutFileSource)
+		callback := func(filelob *FileLOB, source CheckoutFileSource, size int64) {
+			sources[filelob.Filename] = source
+		}
+
+		GlobalOptions.AutoFetchEnabled = false
+		estimate, err := testRepo().EstimateCheckoutWorkspace(nil, nil, callback)
+		Expect(err).To(BeNil(), "Shouldn't fail estimating checkout")
+		Expect(estimate.Files).To(Equal(len(filenames)), "All files should need populating")
+		Expect(estimate.FilesUnavailable).To(Equal(2), "Files with missing content can't be populated")
+		Expect(estimate.BytesToWrite).To(BeEquivalentTo(totalSize - sizeForFile(1) - sizeForFile(2)))
+		Expect(estimate.LOBsMissing).To(Equal(2))
+		Expect(estimate.LOBsToFetch).To(Equal(0), "Nothing fetched without autofetch")
+		Expect(sources[filepath.ToSlash(filenames[0])]).To(Equal(CheckoutFileLocal))
+		Expect(sources[filepath.ToSlash(filenames[1])]).To(Equal(CheckoutFileUnavailable))
+		Expect(estimate.BytesFree).To(BeNumerically(">", 0), "Should find free disk space")
+		Expect(estimate.HasEnoughDiskSpace()).To(BeTrue())
+		estimate.BytesFree = estimate.BytesNeeded() - 1
+		Expect(estimate.HasEnoughDiskSpace()).To(BeFalse(), "Should detect insufficient disk space")
+
+		GlobalOptions.AutoFetchEnabled = true
+		estimate, err = testRepo().EstimateCheckoutWorkspace(nil, nil, callback)
+		Expect(err).To(BeNil(), "Shouldn't fail estimating checkout")
+		Expect(estimate.FilesUnavailable).To(Equal(0), "Missing content would be fetched")
+		Expect(estimate.LOBsToFetch).To(Equal(2))
+		Expect(estimate.LOBsSizeUnknown).To(Equal(1), "Size unknown without metadata")
+		Expect(estimate.BytesToDownload).To(BeEquivalentTo(sizeForFile(1)))
+		Expect(estimate.BytesToWrite).To(BeEquivalentTo(totalSize - sizeForFile(2)))
+		Expect(sources[filepath.ToSlash(filenames[2])]).To(Equal(CheckoutFileFetch))
+
+		for _, file := range filenames {
+			stat, err := os.Stat(file)
+			Expect(err).To(BeNil(), fmt.Sprintf("File %v should still exist", file))
+			Expect(stat.Size()).To(BeEquivalentTo(SHALineLen), fmt.Sprintf("File %v should be unchanged", file))
+		}
+	})
 	It("Respects pathspecs", func() {
 		var filesDone []string
 		var filesSkipped int
@@ -326,7 +403,7 @@ var _ = Describe("Checkout", func() {
 			"some/folder/nested/file32.dat",
 			"second/folder/file6.dat",
 		}
-		err := Checkout(pathspecs, false, testCallback)
+		err := testRepo().Checkout(pathspecs, false, testCallback)
 		Expect(err).To(BeNil(), "Shouldn't fail calling checkout with pathspecs")
 		Expect(filesDone).To(ConsistOf(correctFiles), "Files updated should match path specs")
 		Expect(filesSkipped).To(BeEquivalentTo(0), "No files should be skipped")
@@ -366,7 +443,7 @@ var _ = Describe("Checkout", func() {
 				"some/folder/nested/file31.dat",
 				"some/folder/nested/file32.dat",
 			}
-			err := Checkout(pathspecs, false, testCallback)
+			err := testRepo().Checkout(pathspecs, false, testCallback)
 			Expect(err).To(BeNil(), "Shouldn't fail calling checkout with pathspecs")
 			Expect(filesDone).To(ConsistOf(correctFiles), "Files updated should match path specs")
 			Expect(filesSkipped).To(BeEquivalentTo(0), "No files should be skipped")
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// How one step of CheckRemote went
+type RemoteCheckStep struct {
+	// What the step does, e.g. "Upload probe"
+	Name string
+	// Extra information about what happened
+	Detail string
+	// Set if the step doesn't apply to this remote's provider, which isn't a failure
+	Skipped bool
+	// Set if the step failed
+	Error error
+}
+
+// Test a remote end-to-end: validate its config, connect, upload a tiny probe binary, download it
+// back, check it's intact then delete it again where the provider supports that. Each step is
+// reported to callback when done; steps after a failure aren't attempted, except that the probe is
+// always deleted once it's been uploaded. Returns whether all the steps succeeded
+func (r *Repo) CheckRemote(remoteName string, callback func(step *RemoteCheckStep)) bool {
+	ok := true
+	report := func(step *RemoteCheckStep) bool {
+		if step.Error != nil {
+			ok = false
+		}
+		callback(step)
+		return step.Error == nil
+	}
+
+	provider, err := r.GetProvider(remoteName)
+	step := &RemoteCheckStep{Name: "Validate configuration", Error: err}
+	if err == nil {
+		step.Detail = fmt.Sprintf("provider '%v'", provider.TypeID())
+		if cachePath := providers.GetCachePathForRemote(r.Options, remoteName); cachePath != "" {
+			step.Detail += fmt.Sprintf(", cached in %v", cachePath)
+		}
+	}
+	if !report(step) {
+		return false
+	}
+	defer provider.Release()
+
+	step = &RemoteCheckStep{Name: "Connect"}
+	if smart := providers.UpgradeToSmartSyncProvider(provider); smart != nil {
+		// Needs a connection & capabilities to be negotiated
+		var algorithm string
+		algorithm, step.Error = smart.DeltaAlgorithm(remoteName)
+		if step.Error == nil {
+			version, _ := smart.ProtocolVersion(remoteName)
+			step.Detail = fmt.Sprintf("protocol version %d, server deltas use '%v'", version, algorithm)
+		}
+	} else {
+		step.Skipped = true
+		step.Detail = "provider connects for each transfer"
+	}
+	if !report(step) {
+		return false
+	}
+
+	tempDir, err := ioutil.TempDir("", "git-lob-check")
+	if err != nil {
+		report(&RemoteCheckStep{Name: "Upload probe", Error: fmt.Errorf("Unable to create temporary folder: %v", err.Error())})
+		return false
+	}
+	defer os.RemoveAll(tempDir)
+	uploadDir := filepath.Join(tempDir, "upload")
+	downloadDir := filepath.Join(tempDir, "download")
+
+	// Unique content so that the probe can't already be on the remote, or be shared with a real binary
+	host, _ := os.Hostname()
+	content := fmt.Sprintf("git-lob remote check probe\n%v %v %v\n", host, os.Getpid(), time.Now().UnixNano())
+	info, err := r.StoreLOBInBaseDir(uploadDir, bytes.NewReader([]byte(content)), nil)
+	if err != nil {
+		report(&RemoteCheckStep{Name: "Upload probe", Error: fmt.Errorf("Unable to create probe: %v", err.Error())})
+		return false
+	}
+	files := []string{GetLOBMetaRelativePath(info.SHA)}
+	for i := 0; i < info.NumChunks; i++ {
+		files = append(files, getLOBChunkRelativePathForInfo(info, i))
+	}
+
+	step = &RemoteCheckStep{Name: "Upload probe", Detail: fmt.Sprintf("%v, %d files", info.SHA, len(files))}
+	step.Error = provider.Upload(remoteName, files, uploadDir, true, nil)
+	if !report(step) {
+		// May have been partly uploaded
+		r.deleteRemoteCheckProbe(provider, remoteName, info.SHA, files)
+		return false
+	}
+
+	step = &RemoteCheckStep{Name: "Download probe"}
+	var notFound []string
+	downloadCallback := func(filename string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+		if progressType == util.ProgressNotFound {
+			notFound = append(notFound, filename)
+		}
+		return false
+	}
+	// Forced so that a cache doesn't stand in for the remote
+	step.Error = provider.Download(remoteName, files, downloadDir, true, downloadCallback)
+	if step.Error == nil && len(notFound) > 0 {
+		step.Error = fmt.Errorf("Remote doesn't have %v straight after uploading it", notFound)
+	}
+	if report(step) {
+		step = &RemoteCheckStep{Name: "Verify probe"}
+		for _, file := range files {
+			uploaded, _ := ioutil.ReadFile(filepath.Join(uploadDir, file))
+			downloaded, err := ioutil.ReadFile(filepath.Join(downloadDir, file))
+			if err != nil || !bytes.Equal(uploaded, downloaded) {
+				step.Error = fmt.Errorf("Content of %v downloaded doesn't match what was uploaded", file)
+				break
+			}
+		}
+		if step.Error == nil {
+			step.Detail = fmt.Sprintf("%d bytes intact", len(content))
+		}
+		report(step)
+	}
+
+	report(r.deleteRemoteCheckProbe(provider, remoteName, info.SHA, files))
+	return ok
+}
+
+// Delete the probe uploaded by CheckRemote, from the cache too if the remote has one
+func (r *Repo) deleteRemoteCheckProbe(provider providers.SyncProvider, remoteName, sha string, files []string) *RemoteCheckStep {
+	step := &RemoteCheckStep{Name: "Delete probe"}
+	if cachePath := providers.GetCachePathForRemote(r.Options, remoteName); cachePath != "" {
+		for _, file := range files {
+			os.Remove(filepath.Join(cachePath, file))
+			// Folders too if that leaves them empty (fails harmlessly if not)
+			for dir := filepath.Dir(file); dir != "."; dir = filepath.Dir(dir) {
+				if os.Remove(filepath.Join(cachePath, dir)) != nil {
+					break
+				}
+			}
+		}
+	}
+	if deleting := providers.UpgradeToDeletingSyncProvider(provider); deleting != nil {
+		step.Error = deleting.Delete(remoteName, files)
+	} else if smart := providers.UpgradeToSmartSyncProvider(provider); smart != nil {
+		_, retained, held, err := smart.PruneLOBs(remoteName, []string{sha}, false)
+		switch {
+		case err != nil:
+			// Not being allowed to prune doesn't stop anything else working
+			step.Skipped = true
+			step.Detail = fmt.Sprintf("remote won't delete it: %v", err.Error())
+		case len(retained) > 0 || len(held) > 0:
+			step.Detail = "remote is retaining it for now, it'll be removed by a later prune"
+		}
+	} else {
+		step.Skipped = true
+		step.Detail = fmt.Sprintf("not supported by provider '%v', %v can be deleted", provider.TypeID(), sha)
+	}
+	return step
+}
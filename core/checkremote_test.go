@@ -0,0 +1,78 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Check remote", func() {
+	root := filepath.Join(os.TempDir(), "CheckRemoteTest")
+	remotepath := filepath.Join(root, "remote")
+	cachepath := filepath.Join(root, "cache")
+	var oldOptions Options
+	var steps []*RemoteCheckStep
+	callback := func(step *RemoteCheckStep) {
+		steps = append(steps, step)
+	}
+	BeforeEach(func() {
+		oldOptions = *GlobalOptions
+		GlobalOptions.GitConfig = map[string]string{
+			"remote.origin.git-lob-provider":      "filesystem",
+			"remote.origin.git-lob-path":          remotepath,
+			"remote.broken.git-lob-provider":      "filesystem",
+			"remote.offline.git-lob-provider":     "mock",
+			"remote.offline.git-lob-url":          "mock://CheckRemoteTest",
+			"remote.offline.git-lob-mock-offline": "true",
+		}
+		os.MkdirAll(remotepath, 0755)
+		InitCoreProviders()
+		steps = nil
+	})
+	AfterEach(func() {
+		*GlobalOptions = oldOptions
+		os.RemoveAll(root)
+	})
+
+	It("Checks a working remote & cleans up", func() {
+		GlobalOptions.GitConfig["remote.origin.git-lob-cache-path"] = cachepath
+		Expect(testRepo().CheckRemote("origin", callback)).To(BeTrue())
+		var names []string
+		for _, step := range steps {
+			names = append(names, step.Name)
+			Expect(step.Error).To(BeNil(), "%v should succeed", step.Name)
+			Expect(step.Skipped).To(Equal(step.Name == "Connect"), "Only connect should be skipped for filesystem")
+		}
+		Expect(names).To(Equal([]string{"Validate configuration", "Connect", "Upload probe",
+			"Download probe", "Verify probe", "Delete probe"}))
+
+		// Nothing left behind on the remote or in the cache
+		for _, dir := range []string{remotepath, cachepath} {
+			var leftover []string
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && path != dir {
+					leftover = append(leftover, path)
+				}
+				return nil
+			})
+			Expect(leftover).To(BeEmpty(), "Should have deleted probe from %v", dir)
+		}
+	})
+
+	It("Reports the step which fails", func() {
+		Expect(testRepo().CheckRemote("broken", callback)).To(BeFalse())
+		Expect(steps).To(HaveLen(1))
+		Expect(steps[0].Name).To(Equal("Validate configuration"))
+		Expect(steps[0].Error.Error()).To(ContainSubstring("git-lob-path"))
+
+		steps = nil
+		Expect(testRepo().CheckRemote("offline", callback)).To(BeFalse())
+		Expect(steps).To(HaveLen(3))
+		Expect(steps[2].Name).To(Equal("Upload probe"))
+		Expect(steps[2].Error.Error()).To(ContainSubstring("Unable to connect"))
+	})
+})
@@ -0,0 +1,410 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Content-defined chunking splits LOBs at points determined by the content itself (using a
+// rolling hash), rather than every ChunkSize bytes. An edit in one place of a large file then
+// only changes the chunks around it, because later boundaries move with the content.
+// Each chunk is stored once as a 'chunk object' addressed by the SHA of its own content, so
+// all the LOBs which contain it share storage, and only new chunks need to be pushed & fetched.
+
+const (
+	// Chunking settings for git-lob.chunking
+	ChunkingFixed          = ""
+	ChunkingContentDefined = "content"
+)
+
+const (
+	// Original metadata format; NumChunks chunks of ChunkSize named <sha>_<n>
+	LOBInfoVersionFixedChunks = 0
+	// Metadata lists content-defined chunks, stored as chunk objects
+	LOBInfoVersionChunkObjects = 2
+	// Like LOBInfoVersionFixedChunks, but with ChunkSize recorded because it's not the default
+	// Older versions of git-lob would read these chunks with the wrong size, so refuse them instead
+	LOBInfoVersionFixedChunkSize = 3
+	// Newest format this version of git-lob can read
+	LOBInfoVersionLatest = LOBInfoVersionFixedChunkSize
+)
+
+// Directory under a LOB root where chunk objects are stored, splayed by SHA like LOBs
+const ChunkObjectDir = "chunks"
+
+// Limits for content-defined chunks. Boundaries are found when the top ContentChunkAverageBits
+// bits of the rolling hash are zero, giving chunks of about 2^ContentChunkAverageBits bytes
+// These must not change once binaries have been stored or chunks will no longer be shared
+// with existing binaries; they're only 'var' rather than 'const' to allow tests to modify
+var (
+	ContentChunkMinSize     = int64(512 * 1024)
+	ContentChunkMaxSize     = int64(8 * 1024 * 1024)
+	ContentChunkAverageBits = uint(21)
+)
+
+// A single content-defined chunk of a LOB
+type LOBChunk struct {
+	// SHA of the content of this chunk
+	SHA string
+	// Size of the content of this chunk
+	Size int64
+}
+
+var chunkObjectFilenameRegex = regexp.MustCompile("^(?:" + LOBSHARegexFragment + ")$")
+
+// Random values for each byte for the rolling 'gear' hash
+// Generated from a fixed seed; like the chunk limits, this must never change
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64
+	seed := uint64(0x6769742d6c6f6221)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Find the length of the first content-defined chunk in data, which must either run
+// to the end of the content or be at least ContentChunkMaxSize long
+func findContentChunkBoundary(data []byte) int {
+	n := int64(len(data))
+	if n <= ContentChunkMinSize {
+		return len(data)
+	}
+	limit := n
+	if limit > ContentChunkMaxSize {
+		limit = ContentChunkMaxSize
+	}
+	// The gear hash shifts left each byte, so the top bits depend on the last 64 bytes
+	mask := ^uint64(0) << (64 - ContentChunkAverageBits)
+	var hash uint64
+	// Start hashing a window before the minimum so that boundaries only depend on local content
+	start := ContentChunkMinSize - 64
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i < limit; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if i+1 >= ContentChunkMinSize && hash&mask == 0 {
+			return int(i + 1)
+		}
+	}
+	return int(limit)
+}
+
+// Splits a stream into content-defined chunks
+type contentChunker struct {
+	in  io.Reader
+	buf []byte
+	// Length of data in buf
+	len int
+	// Length of the chunk previously returned, still at the start of buf
+	consumed int
+	eof      bool
+}
+
+func newContentChunker(in io.Reader) *contentChunker {
+	return &contentChunker{in: in, buf: make([]byte, ContentChunkMaxSize)}
+}
+
+// Get the next chunk; the data is only valid until the next call
+// Returns io.EOF when there are no more chunks
+func (self *contentChunker) Next() ([]byte, error) {
+	// Discard the previous chunk
+	copy(self.buf, self.buf[self.consumed:self.len])
+	self.len -= self.consumed
+	self.consumed = 0
+	// Fill the buffer so that the longest possible chunk can be found
+	for self.len < len(self.buf) && !self.eof {
+		c, err := self.in.Read(self.buf[self.len:])
+		self.len += c
+		if err == io.EOF {
+			self.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if self.len == 0 {
+		return nil, io.EOF
+	}
+	self.consumed = findContentChunkBoundary(self.buf[:self.len])
+	return self.buf[:self.consumed], nil
+}
+
+// Get a relative file name for a chunk object (no dirs created as not rooted)
+func GetChunkObjectRelativePath(chunksha string) string {
+	return filepath.Join(ChunkObjectDir, getLOBRelativeDir(chunksha), chunksha)
+}
+
+// Gets the absolute path to a chunk object from a base dir (creates the directory)
+func (r *Repo) GetChunkObjectPathInBaseDir(basedir, chunksha string) string {
+	return r.getLOBStoreFilePathCreatingDir(basedir, GetChunkObjectRelativePath(chunksha))
+}
+
+// Get a relative file name for a chunk of a LOB, wherever the format of the LOB stores it
+func getLOBChunkRelativePathForInfo(info *LOBInfo, chunkIdx int) string {
+	if info.Version == LOBInfoVersionChunkObjects {
+		return GetChunkObjectRelativePath(info.Chunks[chunkIdx].SHA)
+	}
+	return GetLOBChunkRelativePath(info.SHA, chunkIdx)
+}
+
+// Gets the absolute path to a chunk of a LOB from a base dir, wherever the format of the LOB stores it
+func (r *Repo) getLOBChunkPathInBaseDirForInfo(basedir string, info *LOBInfo, chunkIdx int) string {
+	if info.Version == LOBInfoVersionChunkObjects {
+		return r.GetChunkObjectPathInBaseDir(basedir, info.Chunks[chunkIdx].SHA)
+	}
+	return r.GetLOBChunkPathInBaseDir(basedir, info.SHA, chunkIdx)
+}
+
+// Check that metadata which describes its chunks explicitly is consistent
+func validateLOBChunks(info *LOBInfo) error {
+	if info.Version > LOBInfoVersionLatest {
+		return fmt.Errorf("Metadata format %d for %v is not supported, it was stored by a newer version of git-lob", info.Version, info.SHA)
+	}
+	if info.Version == LOBInfoVersionFixedChunkSize {
+		if info.ChunkSize <= 0 {
+			return fmt.Errorf("Metadata for %v has an invalid chunk size %d", info.SHA, info.ChunkSize)
+		}
+		if expected := int((info.Size + info.ChunkSize - 1) / info.ChunkSize); info.NumChunks != expected {
+			return fmt.Errorf("Metadata for %v lists %d chunks, expected %d of %d bytes", info.SHA, info.NumChunks, expected, info.ChunkSize)
+		}
+		return nil
+	}
+	if info.Version != LOBInfoVersionChunkObjects {
+		return nil
+	}
+	if len(info.Chunks) != info.NumChunks {
+		return fmt.Errorf("Metadata for %v lists %d chunks, expected %d", info.SHA, len(info.Chunks), info.NumChunks)
+	}
+	var total int64
+	for _, c := range info.Chunks {
+		if !chunkObjectFilenameRegex.MatchString(c.SHA) {
+			return fmt.Errorf("Metadata for %v has an invalid chunk SHA '%v'", info.SHA, c.SHA)
+		}
+		total += c.Size
+	}
+	if total != info.Size {
+		return fmt.Errorf("Metadata for %v has chunks totalling %d bytes, expected %d", info.SHA, total, info.Size)
+	}
+	return nil
+}
+
+// Write a chunk object to basedir, unless it's already there
+// If linkFrom is a file in basedir with the same content (e.g. a chunk of another LOB), it's hard
+// linked instead of writing data again
+// Returns whether the chunk object was newly created
+func (r *Repo) storeChunkObjectInBaseDir(basedir, chunksha string, data []byte, linkFrom string) (bool, error) {
+	destFile := r.GetChunkObjectPathInBaseDir(basedir, chunksha)
+	if r.IsUsingSharedStorage() && basedir == r.GetSharedLOBRoot() {
+		// Chunk objects are pruned like binaries, so don't let it go before it's linked
+		l, err := r.lockSharedStoreSHA(chunksha)
+		if err != nil {
+			return false, err
+		}
+		defer l.Release()
+	}
+	created := false
+	if !util.FileExistsAndIsOfSize(destFile, int64(len(data))) && linkFrom != "" {
+		os.Remove(destFile)
+		if err := CreateHardLink(linkFrom, destFile); err == nil {
+			created = true
+		} else {
+			r.Log.Debugf("Unable to link chunk object %v from %v, writing it: %v\n", chunksha, linkFrom, err)
+		}
+	}
+	if !created && !util.FileExistsAndIsOfSize(destFile, int64(len(data))) {
+		outf, err := ioutil.TempFile(filepath.Dir(destFile), "tempchunk")
+		if err != nil {
+			return false, fmt.Errorf("Unable to create chunk object %v: %v", chunksha, err)
+		}
+		_, err = outf.Write(data)
+		outf.Close()
+		if err != nil {
+			os.Remove(outf.Name())
+			return false, fmt.Errorf("I/O error writing chunk object %v: %v", chunksha, err)
+		}
+		// delete any existing (incorrectly sized) file since will probably not be allowed to rename over it
+		os.Remove(destFile)
+		err = os.Rename(outf.Name(), destFile)
+		if err != nil {
+			os.Remove(outf.Name())
+			return false, err
+		}
+		created = true
+	}
+
+	// This may have stored in shared storage, so link if required
+	if r.IsUsingSharedStorage() && basedir == r.GetSharedLOBRoot() {
+		return created, r.linkSharedLOBFilename(destFile)
+	}
+	return created, nil
+}
+
+// Read from a stream and calculate SHA, while also writing content to content-defined chunks
+// leader is a slice of bytes that has already been read (probe for SHA)
+// Store underneath a specified LOB root. Chunks which are already stored (as part of any
+// other LOB) are not written again.
+func (r *Repo) StoreLOBInBaseDirContentDefined(basedir string, in io.Reader, leader []byte) (*LOBInfo, error) {
+	return r.storeLOBInBaseDirContentDefinedWithHash(basedir, in, leader, r.Options.HashAlgorithm)
+}
+
+// Chunk objects are identified with the same hash algorithm as the LOB
+func (r *Repo) storeLOBInBaseDirContentDefinedWithHash(basedir string, in io.Reader, leader []byte, hashAlgorithm string) (*LOBInfo, error) {
+	sha := newHash(hashAlgorithm)
+	chunker := newContentChunker(io.MultiReader(bytes.NewReader(leader), in))
+	var chunks []LOBChunk
+	// Chunk objects we created, to remove if not used after all
+	var created []string
+	var totalSize int64
+	cleanup := func() {
+		for _, c := range created {
+			os.Remove(r.GetChunkObjectPathInBaseDir(basedir, c))
+		}
+	}
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			cleanup()
+			return nil, errors.New(fmt.Sprintf("I/O error reading chunk %d: %v", len(chunks), err))
+		}
+		sha.Write(data)
+		chunksha := calculateSHA(hashAlgorithm, data)
+		isnew, err := r.storeChunkObjectInBaseDir(basedir, chunksha, data, "")
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		if isnew {
+			created = append(created, chunksha)
+		}
+		chunks = append(chunks, LOBChunk{SHA: chunksha, Size: int64(len(data))})
+		totalSize += int64(len(data))
+	}
+
+	shaStr := fmt.Sprintf("%x", string(sha.Sum(nil)))
+	info := &LOBInfo{SHA: shaStr, Size: totalSize, NumChunks: len(chunks),
+		Version: LOBInfoVersionChunkObjects, Chunks: chunks}
+
+	existing, err := r.keepExistingLOBStorage(basedir, info)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if existing != nil {
+		cleanup()
+		return existing, nil
+	}
+
+	err = r.StoreLOBInfoInBaseDir(basedir, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Get the SHAs of all the chunk objects referenced by LOBs stored in a base dir
+func (r *Repo) getReferencedChunkObjectsInBaseDir(basedir string) (util.StringSet, error) {
+	ret := util.NewStringSet()
+	lobshas, err := getAllLOBSHAsInDir(basedir)
+	if err != nil {
+		return ret, err
+	}
+	for sha := range lobshas.Iter() {
+		info, err := r.getLOBInfoInBaseDir(sha, basedir)
+		if err != nil {
+			if IsNotFoundError(err) {
+				// Chunks without meta, nothing referenced
+				continue
+			}
+			// Can't tell what's referenced, so mustn't delete anything
+			return ret, fmt.Errorf("Unable to read metadata for %v: %v", sha, err.Error())
+		}
+		for _, c := range info.Chunks {
+			ret.Add(c.SHA)
+		}
+	}
+	return ret, nil
+}
+
+// Call back for every chunk object stored in a base dir
+func walkChunkObjectsInBaseDir(basedir string, callback func(chunksha, path string)) error {
+	root := filepath.Join(basedir, ChunkObjectDir)
+	if !util.DirExists(root) {
+		return nil
+	}
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if chunksha, _, ok := parseChunkObjectStoreFilename(fi.Name()); ok {
+			callback(chunksha, path)
+		}
+		return nil
+	})
+}
+
+// Delete the chunk objects in a base dir which are no longer referenced by any LOB stored there
+// Chunk objects are shared between LOBs so aren't deleted along with a LOB; call this after
+// deleting LOBs. Chunk objects modified at or after keepSince are kept even if unreferenced, e.g.
+// because they're under a write-once retention hold (zero time to keep none)
+// Returns the SHAs of the chunk objects deleted (or which would be, if dryRun)
+func (r *Repo) PruneChunkObjectsInBaseDir(basedir string, dryRun bool, keepSince time.Time) ([]string, error) {
+	return r.pruneChunkObjectsInBaseDir(basedir, dryRun, nil, keepSince)
+}
+
+// Prune chunk objects in a base dir, also keeping those in keep (e.g. referenced from elsewhere)
+// & those modified at or after keepSince (unless zero)
+func (r *Repo) pruneChunkObjectsInBaseDir(basedir string, dryRun bool, keep util.StringSet, keepSince time.Time) ([]string, error) {
+	if !util.DirExists(filepath.Join(basedir, ChunkObjectDir)) {
+		// Content-defined chunking never used
+		return nil, nil
+	}
+	referenced, err := r.getReferencedChunkObjectsInBaseDir(basedir)
+	if err != nil {
+		return nil, err
+	}
+	if keep != nil {
+		referenced = referenced.Union(keep)
+	}
+	var ret []string
+	err = walkChunkObjectsInBaseDir(basedir, func(chunksha, path string) {
+		if referenced.Contains(chunksha) {
+			return
+		}
+		if !keepSince.IsZero() {
+			if fi, err := os.Stat(path); err != nil || !fi.ModTime().Before(keepSince) {
+				return
+			}
+		}
+		ret = append(ret, chunksha)
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				// don't abort for 1 failure, report & carry on
+				r.Log.Errorf("Unable to delete file %v: %v\n", path, err)
+			}
+		}
+	})
+	if err != nil {
+		return ret, fmt.Errorf("Unable to read chunk objects in %v: %v", basedir, err.Error())
+	}
+	return ret, nil
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Content-defined chunking", func() {
+	var oldMin, oldMax int64
+	var oldBits uint
+	BeforeEach(func() {
+		// Small chunks so tests are quick
+		oldMin, oldMax, oldBits = ContentChunkMinSize, ContentChunkMaxSize, ContentChunkAverageBits
+		ContentChunkMinSize = 1024
+		ContentChunkMaxSize = 16 * 1024
+		ContentChunkAverageBits = 12
+	})
+	AfterEach(func() {
+		ContentChunkMinSize, ContentChunkMaxSize, ContentChunkAverageBits = oldMin, oldMax, oldBits
+	})
+
+	getRandomData := func(sz int, seed int64) []byte {
+		data := make([]byte, sz)
+		r := rand.New(rand.NewSource(seed))
+		for i := range data {
+			data[i] = byte(r.Intn(256))
+		}
+		return data
+	}
+	getChunks := func(data []byte) [][]byte {
+		var ret [][]byte
+		chunker := newContentChunker(bytes.NewReader(data))
+		for {
+			chunk, err := chunker.Next()
+			if err != nil {
+				break
+			}
+			ret = append(ret, append([]byte(nil), chunk...))
+		}
+		return ret
+	}
+
+	It("Splits at points determined by content", func() {
+		data := getRandomData(200*1024, 1)
+		chunks := getChunks(data)
+		Expect(bytes.Join(chunks, nil)).To(Equal(data), "Chunks should make up the original data")
+		for i, c := range chunks {
+			Expect(len(c)).To(BeNumerically("<=", ContentChunkMaxSize), "Chunk %d too large", i)
+			if i < len(chunks)-1 {
+				Expect(len(c)).To(BeNumerically(">=", ContentChunkMinSize), "Chunk %d too small", i)
+			}
+		}
+		Expect(len(chunks)).To(BeNumerically(">", 10), "Should be split into chunks of around the average size")
+
+		// Insert some bytes near the start; only the chunks around it should change
+		edited := append(append(append([]byte(nil), data[:10000]...), []byte("an edit")...), data[10000:]...)
+		editedChunks := getChunks(edited)
+		original := make(map[string]bool)
+		for _, c := range chunks {
+			original[string(c)] = true
+		}
+		var shared int
+		for _, c := range editedChunks {
+			if original[string(c)] {
+				shared++
+			}
+		}
+		Expect(shared).To(BeNumerically(">=", len(editedChunks)-2), "Only chunks around the edit should differ")
+
+		Expect(getChunks(nil)).To(BeEmpty(), "Empty data should have no chunks")
+		Expect(getChunks([]byte("small"))).To(Equal([][]byte{[]byte("small")}), "Small data should be one chunk")
+	})
+
+	Describe("Storing in a base dir", func() {
+		basedir := filepath.Join(os.TempDir(), "ChunkingTest")
+		AfterEach(func() {
+			os.RemoveAll(basedir)
+		})
+
+		It("Stores chunk objects shared between LOBs", func() {
+			data := getRandomData(100*1024, 2)
+			info, err := testRepo().StoreLOBInBaseDirContentDefined(basedir, bytes.NewReader(data[100:]), data[:100])
+			Expect(err).To(BeNil(), "Should store LOB")
+			Expect(info.Version).To(Equal(LOBInfoVersionChunkObjects))
+			Expect(info.Size).To(BeEquivalentTo(len(data)))
+			Expect(info.NumChunks).To(Equal(len(info.Chunks)))
+			Expect(info.NumChunks).To(BeNumerically(">", 1))
+			stored, err := testRepo().getLOBInfoInBaseDir(info.SHA, basedir)
+			Expect(err).To(BeNil(), "Should read stored metadata")
+			Expect(stored).To(Equal(info), "Metadata should round-trip")
+
+			var buf bytes.Buffer
+			Expect(testRepo().GetLOBCompleteContentInBaseDir(basedir, info.SHA, &buf)).To(BeNil())
+			Expect(buf.Bytes()).To(Equal(data), "Should read back content")
+			buf.Reset()
+			_, err = testRepo().copyLOBContentRangeInBaseDir(basedir, info, 5000, 20000, &buf)
+			Expect(err).To(BeNil(), "Should read range spanning chunks")
+			Expect(buf.Bytes()).To(Equal(data[5000:25000]))
+
+			files, _, err := testRepo().GetLOBFilesForSHA(info.SHA, basedir, true, true)
+			Expect(err).To(BeNil(), "Should pass integrity check")
+			Expect(files).To(HaveLen(info.NumChunks + 1))
+			Expect(files[1]).To(Equal(GetChunkObjectRelativePath(info.Chunks[0].SHA)), "Chunks should be listed as chunk objects")
+			lobs, err := GetAllLOBSHAsInBaseDir(basedir)
+			Expect(err).To(BeNil())
+			Expect(lobs.Contains(info.SHA)).To(BeTrue())
+			Expect(lobs.Cardinality()).To(Equal(1), "Chunk objects should not be mistaken for LOBs")
+
+			// A new version with an edit in the middle shares most chunk objects
+			edited := append(append(append([]byte(nil), data[:50000]...), []byte("an edit")...), data[50000:]...)
+			editedinfo, err := testRepo().StoreLOBInBaseDirContentDefined(basedir, bytes.NewReader(edited), nil)
+			Expect(err).To(BeNil(), "Should store edited LOB")
+			originalChunks := NewStringSet()
+			for _, c := range info.Chunks {
+				originalChunks.Add(c.SHA)
+			}
+			var shared int
+			for _, c := range editedinfo.Chunks {
+				if originalChunks.Contains(c.SHA) {
+					shared++
+				}
+			}
+			Expect(shared).To(BeNumerically(">=", editedinfo.NumChunks-2), "Most chunk objects should be shared")
+
+			// Deleting a LOB leaves chunk objects until pruned, & only unshared ones are pruned
+			Expect(testRepo().DeleteLOBInBaseDir(info.SHA, basedir)).To(BeNil())
+			Expect(FileExists(testRepo().GetChunkObjectPathInBaseDir(basedir, info.Chunks[0].SHA))).To(BeTrue(), "Chunk objects shouldn't be deleted with LOB")
+			pruned, err := testRepo().PruneChunkObjectsInBaseDir(basedir, false, time.Now().Add(-time.Hour))
+			Expect(err).To(BeNil())
+			Expect(pruned).To(BeEmpty(), "Chunk objects modified since keepSince should be kept")
+			pruned, err = testRepo().PruneChunkObjectsInBaseDir(basedir, false, time.Time{})
+			Expect(err).To(BeNil(), "Should prune chunk objects")
+			Expect(len(pruned)).To(Equal(info.NumChunks-shared), "Only chunk objects no longer used should be pruned")
+			buf.Reset()
+			Expect(testRepo().GetLOBCompleteContentInBaseDir(basedir, editedinfo.SHA, &buf)).To(BeNil(), "Remaining LOB should be intact")
+			Expect(buf.Bytes()).To(Equal(edited))
+		})
+
+		It("Rejects inconsistent or newer metadata", func() {
+			data := getRandomData(10*1024, 3)
+			info, err := testRepo().StoreLOBInBaseDirContentDefined(basedir, bytes.NewReader(data), nil)
+			Expect(err).To(BeNil())
+			metafile := testRepo().GetLOBMetaPathInBaseDir(basedir, info.SHA)
+			for _, bad := range []string{
+				`{"SHA":"` + info.SHA + `","Size":10240,"NumChunks":1,"Version":99}`,
+				`{"SHA":"` + info.SHA + `","Size":10240,"NumChunks":2,"Version":2,"Chunks":[{"SHA":"` + info.SHA + `","Size":10240}]}`,
+				`{"SHA":"` + info.SHA + `","Size":10240,"NumChunks":1,"Version":2,"Chunks":[{"SHA":"../../escape","Size":10240}]}`,
+			} {
+				Expect(ioutil.WriteFile(metafile, []byte(bad), 0644)).To(BeNil())
+				_, err = testRepo().getLOBInfoInBaseDir(info.SHA, basedir)
+				Expect(err).ToNot(BeNil(), "Should reject %v", bad)
+			}
+		})
+	})
+
+	Describe("Storing in a repo", func() {
+		root := filepath.Join(os.TempDir(), "ChunkingRepoTest")
+		var oldwd string
+		BeforeEach(func() {
+			CreateGitRepoForTest(root)
+			oldwd, _ = os.Getwd()
+			os.Chdir(root)
+			GlobalOptions.Chunking = ChunkingContentDefined
+		})
+		AfterEach(func() {
+			GlobalOptions.Chunking = ChunkingFixed
+			os.Chdir(oldwd)
+			err := ForceRemoveAll(root)
+			if err != nil {
+				Fail(err.Error())
+			}
+		})
+
+		It("Retrieves LOBs stored with content-defined chunks", func() {
+			data := getRandomData(50*1024, 4)
+			info, err := testRepo().StoreLOB(bytes.NewReader(data), nil)
+			Expect(err).To(BeNil(), "Should store LOB")
+			Expect(info.Version).To(Equal(LOBInfoVersionChunkObjects), "git-lob.chunking should be used")
+			var buf bytes.Buffer
+			_, err = testRepo().RetrieveLOB(info.SHA, &buf)
+			Expect(err).To(BeNil(), "Should retrieve LOB")
+			Expect(buf.Bytes()).To(Equal(data))
+			buf.Reset()
+			_, err = testRepo().RetrieveLOBRange(info.SHA, 30000, 100, &buf)
+			Expect(err).To(BeNil(), "Should retrieve range")
+			Expect(buf.Bytes()).To(Equal(data[30000:30100]))
+
+			// Existing LOBs stored with fixed chunks are kept as they are
+			GlobalOptions.Chunking = ChunkingFixed
+			fixeddata := getRandomData(1000, 5)
+			fixedinfo, err := testRepo().StoreLOB(bytes.NewReader(fixeddata), nil)
+			Expect(err).To(BeNil())
+			GlobalOptions.Chunking = ChunkingContentDefined
+			again, err := testRepo().StoreLOB(bytes.NewReader(fixeddata), nil)
+			Expect(err).To(BeNil())
+			Expect(again).To(Equal(fixedinfo), "Complete LOB stored with fixed chunks should be kept")
+			Expect(FileExists(filepath.Join(testRepo().GetLocalLOBRoot(), GetChunkObjectRelativePath(fixedinfo.SHA)))).To(BeFalse(), "Unused chunk object should be removed")
+		})
+	})
+
+})
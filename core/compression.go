@@ -0,0 +1,326 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/klauspost/compress/zstd"
+)
+
+// Codecs which can be used to compress stored chunks
+const (
+	// Chunks are stored uncompressed (default, and the format of all stores prior to compression support)
+	CompressionNone = ""
+	// Chunks are stored as a sequence of independently compressed zstd frames (seekable)
+	CompressionZstd = "zstd"
+	// Chunks are stored as a sequence of independent gzip members (seekable)
+	// Slower & larger than zstd, but readable with standard tools
+	CompressionGzip = "gzip"
+)
+
+// Amount of uncompressed content held in each compressed frame
+// Frames are compressed independently so a ranged read only has to decompress the
+// frames it overlaps, rather than everything from the start of the chunk
+// This is only 'var' rather than 'const' to allow tests to modify
+var CompressionFrameSize = int64(1024 * 1024)
+
+var (
+	zstdEncoder   *zstd.Encoder
+	zstdDecoder   *zstd.Decoder
+	zstdInitOnce  sync.Once
+	zstdInitError error
+)
+
+// Returns whether a codec name is one we know how to read & write
+func IsSupportedCompression(codec string) bool {
+	switch codec {
+	case CompressionNone, CompressionZstd, CompressionGzip:
+		return true
+	}
+	return false
+}
+
+func initZstd() error {
+	zstdInitOnce.Do(func() {
+		// EncodeAll/DecodeAll are safe for concurrent use so one of each will do
+		// Frame checksums are enabled so every frame can be verified independently
+		zstdEncoder, zstdInitError = zstd.NewWriter(nil, zstd.WithEncoderCRC(true), zstd.WithEncoderConcurrency(1))
+		if zstdInitError != nil {
+			return
+		}
+		zstdDecoder, zstdInitError = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdInitError
+}
+
+// Compress a single frame of content with a given codec, appending to dst
+func compressFrame(codec string, dst, src []byte) ([]byte, error) {
+	switch codec {
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, fmt.Errorf("Unable to initialise zstd compressor: %v", err.Error())
+		}
+		return zstdEncoder.EncodeAll(src, dst), nil
+	case CompressionGzip:
+		buf := bytes.NewBuffer(dst)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(src); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("Unsupported compression codec '%v'", codec)
+}
+
+// Decompress a single frame of content with a given codec, appending to dst
+func decompressFrame(codec string, dst, src []byte) ([]byte, error) {
+	switch codec {
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, fmt.Errorf("Unable to initialise zstd decompressor: %v", err.Error())
+		}
+		return zstdDecoder.DecodeAll(src, dst)
+	case CompressionGzip:
+		// The gzip trailer includes a CRC of the content so this verifies the frame too
+		r, err := gzip.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		r.Multistream(false)
+		buf := bytes.NewBuffer(dst)
+		if _, err = io.Copy(buf, r); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("Unsupported compression codec '%v'", codec)
+}
+
+// Writes content as a series of independently compressed frames of a fixed
+// uncompressed size, recording the compressed size of each so that the
+// frames can be located again later (the seek index)
+type seekableFrameWriter struct {
+	out       io.Writer
+	codec     string
+	frameSize int64
+	buf       []byte
+	compbuf   []byte
+	// Compressed size of each frame written so far
+	Frames []int64
+	// Total compressed bytes written so far
+	Written int64
+}
+
+func newSeekableFrameWriter(out io.Writer, codec string, frameSize int64) *seekableFrameWriter {
+	return &seekableFrameWriter{out: out, codec: codec, frameSize: frameSize,
+		buf: make([]byte, 0, frameSize)}
+}
+
+func (self *seekableFrameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		space := int(self.frameSize) - len(self.buf)
+		if space > len(p) {
+			space = len(p)
+		}
+		self.buf = append(self.buf, p[:space]...)
+		p = p[space:]
+		written += space
+		if int64(len(self.buf)) == self.frameSize {
+			if err := self.flushFrame(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (self *seekableFrameWriter) flushFrame() error {
+	if len(self.buf) == 0 {
+		return nil
+	}
+	var err error
+	self.compbuf, err = compressFrame(self.codec, self.compbuf[:0], self.buf)
+	if err != nil {
+		return err
+	}
+	c, err := self.out.Write(self.compbuf)
+	if err != nil {
+		return fmt.Errorf("I/O error writing compressed frame: %v wrote %d bytes of %d", err, c, len(self.compbuf))
+	}
+	self.Frames = append(self.Frames, int64(c))
+	self.Written += int64(c)
+	self.buf = self.buf[:0]
+	return nil
+}
+
+// Write any partially filled final frame; does not close the underlying writer
+func (self *seekableFrameWriter) Close() error {
+	return self.flushFrame()
+}
+
+// Get the uncompressed size of the content of a given chunk
+func getLOBChunkContentSize(info *LOBInfo, chunkIdx int) int64 {
+	if info.Version == LOBInfoVersionChunkObjects {
+		return info.Chunks[chunkIdx].Size
+	}
+	chunkSize := getLOBFixedChunkSize(info)
+	if chunkIdx+1 < info.NumChunks {
+		return chunkSize
+	} else {
+		if info.NumChunks == 1 {
+			return info.Size
+		} else {
+			return info.Size - (int64(info.NumChunks-1) * chunkSize)
+		}
+	}
+}
+
+// Get the index of the chunk which contains offset in the content of a LOB, & the offset
+// at which that chunk starts
+func getLOBChunkForOffset(info *LOBInfo, offset int64) (int, int64) {
+	if info.Version != LOBInfoVersionChunkObjects {
+		chunkSize := getLOBFixedChunkSize(info)
+		i := int(offset / chunkSize)
+		return i, int64(i) * chunkSize
+	}
+	var chunkStart int64
+	for i, c := range info.Chunks {
+		if offset < chunkStart+c.Size {
+			return i, chunkStart
+		}
+		chunkStart += c.Size
+	}
+	return len(info.Chunks), chunkStart
+}
+
+// Get the size on disk (or on a remote) of all the chunks of a LOB
+func getLOBStoredSize(info *LOBInfo) int64 {
+	if info.Compression == CompressionNone {
+		return info.Size
+	}
+	var sz int64
+	for i := 0; i < info.NumChunks; i++ {
+		sz += getLOBExpectedChunkSize(info, i)
+	}
+	return sz
+}
+
+// Copy part of the content of a single stored chunk file to out, decompressing if required
+// start & length are relative to the uncompressed content of the chunk
+// For compressed chunks the seek index in info is used to skip directly to the
+// first frame which overlaps start, so only the frames in range are decompressed
+func copyLOBChunkContentRange(chunkFile string, info *LOBInfo, chunkIdx int, start, length int64, out io.Writer) (int64, error) {
+	f, err := os.OpenFile(chunkFile, os.O_RDONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading LOB file %v: %v", chunkFile, err)
+	}
+	defer f.Close()
+
+	if info.Compression == CompressionNone {
+		if start > 0 {
+			_, err = f.Seek(start, os.SEEK_SET)
+			if err != nil {
+				return 0, fmt.Errorf("Error seeking in LOB file %v: %v", chunkFile, err)
+			}
+		}
+		return io.CopyN(out, f, length)
+	}
+
+	if chunkIdx >= len(info.Frames) || info.FrameSize <= 0 {
+		return 0, NewIntegrityErrorWithAdditionalMessage([]string{info.SHA}, "Seek index is missing or incomplete in metadata")
+	}
+	frames := info.Frames[chunkIdx]
+	contentSize := getLOBChunkContentSize(info, chunkIdx)
+	firstFrame := int(start / info.FrameSize)
+	var compressedOffset int64
+	for i := 0; i < firstFrame && i < len(frames); i++ {
+		compressedOffset += frames[i]
+	}
+	_, err = f.Seek(compressedOffset, os.SEEK_SET)
+	if err != nil {
+		return 0, fmt.Errorf("Error seeking in LOB file %v: %v", chunkFile, err)
+	}
+
+	var compbuf, framebuf []byte
+	var copied int64
+	for i := firstFrame; copied < length; i++ {
+		if i >= len(frames) {
+			return copied, NewIntegrityErrorWithAdditionalMessage([]string{info.SHA},
+				fmt.Sprintf("Seek index for chunk %d has too few frames", chunkIdx))
+		}
+		if int64(cap(compbuf)) < frames[i] {
+			compbuf = make([]byte, frames[i])
+		}
+		compbuf = compbuf[:frames[i]]
+		_, err = io.ReadFull(f, compbuf)
+		if err != nil {
+			return copied, fmt.Errorf("Error reading frame %d of LOB file %v: %v", i, chunkFile, err)
+		}
+		framebuf, err = decompressFrame(info.Compression, framebuf[:0], compbuf)
+		if err != nil {
+			return copied, NewIntegrityErrorWithAdditionalMessage([]string{info.SHA},
+				fmt.Sprintf("Frame %d of %v is corrupt: %v", i, chunkFile, err.Error()))
+		}
+		frameStart := int64(i) * info.FrameSize
+		expectedFrameSize := contentSize - frameStart
+		if expectedFrameSize > info.FrameSize {
+			expectedFrameSize = info.FrameSize
+		}
+		if int64(len(framebuf)) != expectedFrameSize {
+			return copied, NewIntegrityErrorWithAdditionalMessage([]string{info.SHA},
+				fmt.Sprintf("Frame %d of %v decompressed to %d bytes, expected %d", i, chunkFile, len(framebuf), expectedFrameSize))
+		}
+		// Trim frame to the requested range
+		data := framebuf
+		if start > frameStart {
+			data = data[start-frameStart:]
+		}
+		if int64(len(data)) > length-copied {
+			data = data[:length-copied]
+		}
+		c, err := out.Write(data)
+		copied += int64(c)
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// Copy a range of the content of a LOB stored in basedir to out, reading only the chunks
+// (and for compressed LOBs, only the frames) which overlap the range
+func (r *Repo) copyLOBContentRangeInBaseDir(basedir string, info *LOBInfo, offset, length int64, out io.Writer) (int64, error) {
+	if offset < 0 || length < 0 || offset+length > info.Size {
+		return 0, errors.New(fmt.Sprintf("Range %d-%d is outside the bounds of LOB %v (size %d)", offset, offset+length, info.SHA, info.Size))
+	}
+	var copied int64
+	first, chunkStart := getLOBChunkForOffset(info, offset)
+	for i := first; i < info.NumChunks && copied < length; i++ {
+		start := offset + copied - chunkStart
+		chunkSize := getLOBChunkContentSize(info, i)
+		n := chunkSize - start
+		if n > length-copied {
+			n = length - copied
+		}
+		chunkStart += chunkSize
+		chunkFile := r.getLOBChunkPathInBaseDirForInfo(basedir, info, i)
+		c, err := copyLOBChunkContentRange(chunkFile, info, i, start, n, out)
+		copied += c
+		if err != nil {
+			return copied, err
+		}
+		if c != n {
+			return copied, fmt.Errorf("Error, read %d bytes from %v but expected %d", c, chunkFile, n)
+		}
+	}
+	return copied, nil
+}
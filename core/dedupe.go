@@ -0,0 +1,332 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// How working copy files may share storage with the local LOB store
+type LinkMode int
+
+const (
+	// Working copy files are independent copies of the stored content (default)
+	LinkModeCopy LinkMode = iota
+	// Use copy-on-write clones (reflinks) of stored content where the filesystem supports them
+	// This is always safe, modifying the working copy file never affects the store
+	LinkModeReflink LinkMode = iota
+	// As LinkModeReflink, but fall back on hard links where clones are not supported
+	// Hard linked stored content is made read-only, & checked before it's used again in case it
+	// was modified in place anyway; never used with a shared store, where it'd affect every repo
+	LinkModeHardlink LinkMode = iota
+)
+
+func (m LinkMode) String() string {
+	switch m {
+	case LinkModeReflink:
+		return "reflink"
+	case LinkModeHardlink:
+		return "hardlink"
+	}
+	return "copy"
+}
+
+// Parse a link mode from an option value (copy, reflink or hardlink)
+func ParseLinkMode(s string) (LinkMode, error) {
+	switch s {
+	case "", "copy":
+		return LinkModeCopy, nil
+	case "reflink":
+		return LinkModeReflink, nil
+	case "hardlink":
+		return LinkModeHardlink, nil
+	}
+	return LinkModeCopy, fmt.Errorf("Invalid link mode '%v', must be copy, reflink or hardlink", s)
+}
+
+type DedupeCallbackType int
+
+const (
+	// File now shares storage with the LOB store (or would, in dry run mode)
+	DedupeLinked DedupeCallbackType = iota
+	// File already shares storage with the LOB store
+	DedupeAlreadyLinked DedupeCallbackType = iota
+	// File was left as a separate copy (Desc = reason)
+	DedupeSkipped DedupeCallbackType = iota
+	// Error while linking a file, it is left untouched (Desc = error)
+	DedupeError DedupeCallbackType = iota
+)
+
+// Collected callback data for a dedupe operation
+type DedupeCallbackData struct {
+	Type DedupeCallbackType
+	// File relative to the repo root
+	Filename string
+	// SHA of the LOB for this file
+	SHA string
+	// Size of the file
+	Size int64
+	// How the file shares storage, if linked
+	Mode LinkMode
+	// Reason for skipping or error message
+	Desc string
+}
+
+// Convert pathspecs relative to WorkDir into pathspecs relative to the repo root
+func (r *Repo) getPathspecsRelativeToRepoRoot(pathspecs []string) (reporoot string, rootedpathspecs []string, err error) {
+	reporoot = r.Root
+	for _, p := range pathspecs {
+		reltoroot, err := filepath.Rel(reporoot, r.absPath(p))
+		if err != nil {
+			return "", nil, errors.New(fmt.Sprintf("Unable to make %v relative to repo root %v", p, reporoot))
+		}
+		rootedpathspecs = append(rootedpathspecs, reltoroot)
+	}
+	return reporoot, rootedpathspecs, nil
+}
+
+// Determine whether a stored LOB can share storage with a working copy file
+// Only single-chunk, uncompressed LOBs are byte-for-byte identical to the file content
+func canLinkLOBContent(info *LOBInfo) (ok bool, reason string) {
+	if info.Version == LOBInfoVersionChunkObjects {
+		// Chunk objects may be shared with other LOBs, too risky if the file is edited in place
+		return false, "stored as content-defined chunks"
+	}
+	if info.NumChunks != 1 {
+		return false, fmt.Sprintf("stored in %d chunks", info.NumChunks)
+	}
+	if info.Compression != CompressionNone {
+		return false, "stored compressed"
+	}
+	return true, ""
+}
+
+// Replace dest with a clone or hard link of the stored content for a LOB, according to mode
+// perm is the permission the working copy file should have
+// Returns the link mode actually used; if storage could not be shared an error is
+// returned and dest is untouched, the caller should fall back on copying if required
+func (r *Repo) linkLOBContent(sha, dest string, mode LinkMode, perm os.FileMode) (LinkMode, error) {
+	if mode == LinkModeCopy {
+		return LinkModeCopy, errors.New("Linking not enabled")
+	}
+	info, err := r.prepareLOBForRetrieve(sha)
+	if err != nil {
+		return LinkModeCopy, err
+	}
+	if ok, reason := canLinkLOBContent(info); !ok {
+		return LinkModeCopy, fmt.Errorf("Cannot link content for %v, %v", sha, reason)
+	}
+	chunk := r.GetLocalLOBChunkPath(sha, 0)
+
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return LinkModeCopy, errors.New(fmt.Sprintf("Can't create parent directory of %v: %v\n", dest, err.Error()))
+	}
+	// Link to a temp file alongside dest then rename over it, so dest is never left partial
+	tmp := filepath.Join(filepath.Dir(dest), fmt.Sprintf(".%v.git-lob-link", filepath.Base(dest)))
+	os.Remove(tmp)
+
+	used := LinkModeReflink
+	err = CreateReflink(chunk, tmp)
+	if err == nil {
+		// A clone is a new file so can have its own permissions
+		err = os.Chmod(tmp, perm)
+	} else if mode == LinkModeHardlink {
+		r.Log.Debugf("Reflink not possible for %v, trying hard link: %v\n", dest, err.Error())
+		// Hard links share permissions with the store as well as content
+		// Never link executables, that would change the mode git sees
+		// Stored content is made read-only so in-place edits of the working copy fail rather
+		// than silently corrupting the store; editors which save by replacing the file are fine
+		// That's only safe for this repo's own store, a shared store file is used by every repo
+		if util.IsWindows() {
+			// Read-only files can't be deleted on Windows, which would break prune
+			return LinkModeCopy, fmt.Errorf("Cannot hard link %v, not supported on Windows", dest)
+		}
+		if r.IsUsingSharedStorage() {
+			return LinkModeCopy, fmt.Errorf("Cannot hard link %v, not supported with a shared store", dest)
+		}
+		if perm&0111 != 0 {
+			return LinkModeCopy, fmt.Errorf("Cannot hard link %v, file is executable", dest)
+		}
+		used = LinkModeHardlink
+		err = os.Chmod(chunk, 0444)
+		if err == nil {
+			err = CreateHardLink(chunk, tmp)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return LinkModeCopy, fmt.Errorf("Cannot link %v to stored content: %v", dest, err.Error())
+	}
+
+	// Make sure what we're about to put in place is the right size before replacing anything
+	if !util.FileExistsAndIsOfSize(tmp, info.Size) {
+		os.Remove(tmp)
+		return LinkModeCopy, fmt.Errorf("Linked content for %v is the wrong size", dest)
+	}
+	os.Remove(dest)
+	err = os.Rename(tmp, dest)
+	if err != nil {
+		os.Remove(tmp)
+		return LinkModeCopy, fmt.Errorf("Unable to replace %v with linked content: %v", dest, err.Error())
+	}
+	return used, nil
+}
+
+// Determine whether a stored chunk may be hard linked to working copy files (see LinkModeHardlink)
+// With a shared store, local chunks are hard links to it instead, never to working copy files
+func (r *Repo) isLOBChunkHardLinked(info *LOBInfo, chunk string) bool {
+	if ok, _ := canLinkLOBContent(info); !ok || r.IsUsingSharedStorage() {
+		return false
+	}
+	links, err := GetHardLinkCount(chunk)
+	return err == nil && links > 1
+}
+
+// Check stored content which is hard linked to working copy files still matches its SHA
+// Being read-only doesn't stop everything modifying it in place, e.g. a chmod first
+// Returns an IntegrityError if it's been modified
+func (r *Repo) checkHardLinkedLOBContent(info *LOBInfo, chunk string) error {
+	if !r.isLOBChunkHardLinked(info, chunk) {
+		return nil
+	}
+	filesha, err := calculateFileSHAWithHash(chunk, GetLOBSHAAlgorithm(info.SHA))
+	if err != nil {
+		return err
+	}
+	if filesha != info.SHA {
+		return NewIntegrityErrorWithAdditionalMessage([]string{info.SHA},
+			fmt.Sprintf("%v is hard linked to the working copy & has been modified", chunk))
+	}
+	return nil
+}
+
+// Calculate the SHA of a file's content, as it would be identified if stored now
+func (r *Repo) calculateFileSHA(path string) (string, error) {
+	return calculateFileSHAWithHash(path, r.Options.HashAlgorithm)
+}
+
+// Calculate the SHA of a file's content with a given hash algorithm
+func calculateFileSHAWithHash(path, hashAlgorithm string) (string, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sha := newHash(hashAlgorithm)
+	_, err = io.Copy(sha, f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", string(sha.Sum(nil))), nil
+}
+
+// Make working copy binaries share storage with the local LOB store, by replacing them with
+// copy-on-write clones or (if mode is LinkModeHardlink) hard links of the stored content
+// Only files whose content exactly matches the stored LOB are changed, locally modified
+// files & placeholders are left alone. Do entire working copy unless limited to pathspecs
+// callback = for progress and per-file results, return quit to abort
+func (r *Repo) DedupeWorkingCopy(pathspecs []string, mode LinkMode, dryRun bool, callback func(data *DedupeCallbackData) (quit bool)) error {
+	if mode == LinkModeCopy {
+		return errors.New("Link mode must be reflink or hardlink to dedupe the working copy")
+	}
+	reporoot, rootedpathspecs, err := r.getPathspecsRelativeToRepoRoot(pathspecs)
+	if err != nil {
+		return err
+	}
+
+	filelobs, err := r.GetGitAllFilesAndLOBsToCheckoutAtCommit("HEAD", rootedpathspecs, nil)
+	if err != nil {
+		return err
+	}
+	var modifiedfiles []string
+	for _, filelob := range filelobs {
+		absfile := filepath.Join(reporoot, filelob.Filename)
+		data := &DedupeCallbackData{Filename: filelob.Filename, SHA: filelob.SHA, Mode: mode}
+		r.dedupeWorkingCopyFile(absfile, data, mode, dryRun)
+		if data.Type == DedupeLinked && !dryRun {
+			modifiedfiles = append(modifiedfiles, filelob.Filename)
+		}
+		if callback(data) {
+			break
+		}
+	}
+
+	if len(modifiedfiles) > 0 {
+		// Content is identical but stat info isn't, so refresh git's index (see Checkout)
+		return r.GitRefreshIndexForFiles(modifiedfiles)
+	}
+	return nil
+}
+
+// Dedupe a single working copy file, filling in the result in data
+func (r *Repo) dedupeWorkingCopyFile(absfile string, data *DedupeCallbackData, mode LinkMode, dryRun bool) {
+	data.Type = DedupeSkipped
+	stat, err := os.Lstat(absfile)
+	if err != nil {
+		data.Desc = "not present in working copy"
+		return
+	}
+	if !stat.Mode().IsRegular() {
+		data.Desc = "not a regular file"
+		return
+	}
+	info, err := r.GetLOBInfo(data.SHA)
+	if err != nil {
+		data.Desc = "content not available locally"
+		return
+	}
+	data.Size = info.Size
+	if stat.Size() != info.Size {
+		// Placeholder or locally modified
+		data.Desc = "does not match stored content"
+		return
+	}
+	if ok, reason := canLinkLOBContent(info); !ok {
+		data.Desc = reason
+		return
+	}
+	if err = r.CheckLOBFilesForSHA(data.SHA, r.GetLocalLOBRoot(), false); err != nil {
+		if IsIntegrityError(err) {
+			// Hard linked content which was modified in place
+			data.Type = DedupeError
+			data.Desc = err.Error()
+			return
+		}
+		data.Desc = "stored content is incomplete"
+		return
+	}
+	chunk := r.GetLocalLOBChunkPath(data.SHA, 0)
+	if chunkstat, err := os.Stat(chunk); err == nil && os.SameFile(stat, chunkstat) {
+		data.Type = DedupeAlreadyLinked
+		data.Mode = LinkModeHardlink
+		return
+	}
+	// Never replace anything which isn't byte-for-byte what we've stored
+	filesha, err := calculateFileSHAWithHash(absfile, GetLOBSHAAlgorithm(data.SHA))
+	if err != nil {
+		data.Type = DedupeError
+		data.Desc = fmt.Sprintf("Unable to read %v: %v", data.Filename, err.Error())
+		return
+	}
+	if filesha != data.SHA {
+		data.Desc = "locally modified"
+		return
+	}
+	if dryRun {
+		data.Type = DedupeLinked
+		return
+	}
+	used, err := r.linkLOBContent(data.SHA, absfile, mode, stat.Mode().Perm())
+	if err != nil {
+		data.Type = DedupeError
+		data.Desc = err.Error()
+		return
+	}
+	data.Type = DedupeLinked
+	data.Mode = used
+}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Dedupe", func() {
+	root := filepath.Join(os.TempDir(), "DedupeTest")
+	var oldwd string
+	filenames := []string{
+		"file1.dat",
+		filepath.Join("some", "folder", "file2.dat"),
+		filepath.Join("some", "folder", "modified.dat"),
+	}
+	var infos []*LOBInfo
+
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+
+		infos = nil
+		for _, file := range filenames {
+			err := os.MkdirAll(filepath.Dir(file), 0755)
+			if err != nil {
+				Fail(err.Error())
+			}
+			infos = append(infos, CreateAndStoreLOBFileForTest(1000, file))
+			RunGitCommandForTest(true, "add", file)
+		}
+		RunGitCommandForTest(true, "commit", "-m", "Initial")
+		// Populate the working copy with separate copies
+		Expect(testRepo().Checkout(nil, false, func(t ProgressCallbackType, filelob *FileLOB, err error) {})).To(BeNil())
+		// Modify one file in place, keeping the size the same
+		data, err := ioutil.ReadFile(filenames[2])
+		Expect(err).To(BeNil())
+		data[10] ^= 0xff
+		Expect(ioutil.WriteFile(filenames[2], data, 0644)).To(BeNil())
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+	})
+
+	It("Links unmodified working copy files to the store", func() {
+		results := make(map[string]*DedupeCallbackData)
+		callback := func(data *DedupeCallbackData) (quit bool) {
+			results[data.Filename] = data
+			return false
+		}
+
+		// Filters aren't configured so git sees content vs placeholders, but linking mustn't change that
+		statusBefore := RunGitCommandForTest(true, "status", "--porcelain")
+
+		// Dry run changes nothing
+		err := testRepo().DedupeWorkingCopy(nil, LinkModeHardlink, true, callback)
+		Expect(err).To(BeNil(), "Shouldn't fail calling dedupe")
+		Expect(results).To(HaveLen(3))
+		Expect(results[filenames[0]].Type).To(Equal(DedupeLinked))
+		Expect(results[filenames[1]].Type).To(Equal(DedupeLinked))
+		Expect(results[filenames[2]].Type).To(Equal(DedupeSkipped), "Modified file should be skipped")
+		Expect(results[filenames[2]].Desc).To(Equal("locally modified"))
+		wcstat, _ := os.Stat(filenames[0])
+		chunkstat, _ := os.Stat(testRepo().GetLocalLOBChunkPath(infos[0].SHA, 0))
+		Expect(os.SameFile(wcstat, chunkstat)).To(BeFalse(), "Dry run should not link")
+
+		results = make(map[string]*DedupeCallbackData)
+		err = testRepo().DedupeWorkingCopy(nil, LinkModeHardlink, false, callback)
+		Expect(err).To(BeNil(), "Shouldn't fail calling dedupe")
+		for i := 0; i < 2; i++ {
+			data := results[filenames[i]]
+			Expect(data.Type).To(Equal(DedupeLinked), "%v should be linked: %v", filenames[i], data.Desc)
+			wcstat, _ = os.Stat(filenames[i])
+			chunkstat, _ = os.Stat(testRepo().GetLocalLOBChunkPath(infos[i].SHA, 0))
+			if data.Mode == LinkModeHardlink {
+				Expect(os.SameFile(wcstat, chunkstat)).To(BeTrue(), "%v should be hard linked", filenames[i])
+				Expect(wcstat.Mode().Perm()).To(BeEquivalentTo(0444), "Hard linked file should be read-only")
+			}
+			sha, err := testRepo().calculateFileSHA(filenames[i])
+			Expect(err).To(BeNil())
+			Expect(sha).To(Equal(infos[i].SHA), "Content should be unchanged")
+		}
+		sha, _ := testRepo().calculateFileSHA(filenames[2])
+		Expect(sha).ToNot(Equal(infos[2].SHA), "Modified file should be untouched")
+
+		// git status shouldn't have been affected
+		Expect(RunGitCommandForTest(true, "status", "--porcelain")).To(Equal(statusBefore))
+
+		// Deep check of the store still passes
+		for _, info := range infos {
+			Expect(testRepo().CheckLOBFilesForSHA(info.SHA, testRepo().GetLocalLOBRoot(), true)).To(BeNil())
+		}
+	})
+
+	It("Links files on checkout", func() {
+		os.Remove(filenames[0])
+		var filesOK int
+		err := testRepo().CheckoutWithLinkMode(nil, false, LinkModeHardlink, func(t ProgressCallbackType, filelob *FileLOB, err error) {
+			if t == ProgressTransferBytes {
+				filesOK++
+			}
+		})
+		Expect(err).To(BeNil(), "Shouldn't fail calling checkout")
+		Expect(filesOK).To(Equal(1), "Only the missing file should be checked out")
+		sha, err := testRepo().calculateFileSHA(filenames[0])
+		Expect(err).To(BeNil())
+		Expect(sha).To(Equal(infos[0].SHA), "Checked out content should be correct")
+
+		// Running dedupe now should report it as already linked if hard linked
+		results := make(map[string]*DedupeCallbackData)
+		err = testRepo().DedupeWorkingCopy([]string{filenames[0]}, LinkModeHardlink, true, func(data *DedupeCallbackData) (quit bool) {
+			results[data.Filename] = data
+			return false
+		})
+		Expect(err).To(BeNil())
+		Expect(results).To(HaveLen(1))
+		Expect(results[filenames[0]].Type).ToNot(Equal(DedupeSkipped), "Checked out file should be linked or linkable")
+	})
+
+	It("Checks hard linked content before it's used again", func() {
+		oldAutoRepair := GlobalOptions.AutoRepair
+		defer func() { GlobalOptions.AutoRepair = oldAutoRepair }()
+		GlobalOptions.AutoRepair = false
+
+		stat, _ := os.Stat(filenames[0])
+		used, err := testRepo().linkLOBContent(infos[0].SHA, filenames[0], LinkModeHardlink, stat.Mode().Perm())
+		Expect(err).To(BeNil(), "Should link file")
+		if used != LinkModeHardlink {
+			// Clones are independent of the store, so there's nothing to check
+			return
+		}
+		chunk := testRepo().GetLocalLOBChunkPath(infos[0].SHA, 0)
+		chunkstat, _ := os.Stat(chunk)
+		Expect(chunkstat.Mode().Perm()).To(BeEquivalentTo(0444), "Stored content should be read-only")
+		Expect(testRepo().CheckLOBFilesForSHA(infos[0].SHA, testRepo().GetLocalLOBRoot(), false)).To(BeNil(), "Unmodified content should pass")
+
+		// Edit in place anyway, keeping the size the same
+		Expect(os.Chmod(filenames[0], 0644)).To(BeNil())
+		data, err := ioutil.ReadFile(filenames[0])
+		Expect(err).To(BeNil())
+		data[10] ^= 0xff
+		Expect(ioutil.WriteFile(filenames[0], data, 0644)).To(BeNil())
+
+		err = testRepo().CheckLOBFilesForSHA(infos[0].SHA, testRepo().GetLocalLOBRoot(), false)
+		Expect(IsIntegrityError(err)).To(BeTrue(), "Quick check should hash hard linked content: %v", err)
+		_, err = testRepo().prepareLOBForRetrieve(infos[0].SHA)
+		Expect(IsIntegrityError(err)).To(BeTrue(), "Modified content shouldn't be retrieved: %v", err)
+		dest := filepath.Join(root, "relinked.dat")
+		_, err = testRepo().linkLOBContent(infos[0].SHA, dest, LinkModeHardlink, 0644)
+		Expect(err).ToNot(BeNil(), "Modified content shouldn't be linked again")
+		Expect(FileExists(dest)).To(BeFalse())
+
+		results := make(map[string]*DedupeCallbackData)
+		err = testRepo().DedupeWorkingCopy([]string{filenames[0]}, LinkModeHardlink, true, func(data *DedupeCallbackData) (quit bool) {
+			results[data.Filename] = data
+			return false
+		})
+		Expect(err).To(BeNil())
+		Expect(results[filenames[0]].Type).To(Equal(DedupeError), "Should report the modified store")
+	})
+
+	It("Never links multi-chunk or compressed content", func() {
+		Expect(canLinkLOBContent(&LOBInfo{NumChunks: 1})).To(BeTrue())
+		ok, _ := canLinkLOBContent(&LOBInfo{NumChunks: 2})
+		Expect(ok).To(BeFalse())
+		ok, _ = canLinkLOBContent(&LOBInfo{NumChunks: 1, Compression: CompressionZstd})
+		Expect(ok).To(BeFalse())
+		_, err := ParseLinkMode("symlink")
+		Expect(err).ToNot(BeNil())
+	})
+})
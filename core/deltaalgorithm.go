@@ -0,0 +1,621 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/cloudflare/bm"
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/klauspost/compress/zstd"
+	"github.com/atlassian/git-lob/providers"
+)
+
+// Algorithms which can generate & apply binary deltas between versions of a LOB
+const (
+	// Bentley/McIlroy long common strings (cloudflare/bm); the original format which every
+	// smart server supports, and the default
+	DeltaAlgorithmBM = "bm"
+	// zstd with the base content as a raw dictionary, like 'zstd --patch-from'; slower to
+	// generate but new content is compressed too
+	DeltaAlgorithmZstd = "zstd"
+	// VCDIFF deltas made by the xdelta3 tool, which must be installed
+	DeltaAlgorithmXdelta3 = "xdelta3"
+)
+
+// An engine which generates & applies deltas between the content of 2 LOBs
+// Deltas always cover the entire content, not individual chunks
+type DeltaAlgorithm interface {
+	// Name used in git-lob.delta-algorithm & to agree the algorithm with smart servers
+	Name() string
+	// Whether this algorithm can be used here (e.g. any tool it needs is installed)
+	Available() bool
+	// Write a delta which rebuilds target from base to out
+	// Returns the size of the delta
+	Generate(base, target *LOBContent, out io.Writer) (int64, error)
+	// Rebuild content from a delta against base, which is the complete base content in a file,
+	// writing it to out. Returns the size of the content written
+	Apply(base *os.File, baseSize int64, delta io.Reader, out io.Writer) (int64, error)
+}
+
+// The content of a stored LOB, read in ranges so that it never has to be held in memory
+type LOBContent struct {
+	repo    *Repo
+	basedir string
+	info    *LOBInfo
+}
+
+func (r *Repo) getLOBContentInBaseDir(basedir, sha string) (*LOBContent, error) {
+	info, err := r.getLOBInfoInBaseDir(sha, basedir)
+	if err != nil {
+		return nil, err
+	}
+	return &LOBContent{repo: r, basedir: basedir, info: info}, nil
+}
+
+// Total size of the content
+func (self *LOBContent) Size() int64 {
+	return self.info.Size
+}
+
+// Write length bytes of the content starting at offset to out
+func (self *LOBContent) CopyRange(offset, length int64, out io.Writer) error {
+	n, err := self.repo.copyLOBContentRangeInBaseDir(self.basedir, self.info, offset, length, out)
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return fmt.Errorf("Incorrect number of bytes read for LOB %v - expected %d actual %d", self.info.SHA, length, n)
+	}
+	return nil
+}
+
+// Write the content to a temporary file, for algorithms which need a complete file
+// Caller must close & remove the file
+func (self *LOBContent) CopyToTempFile() (*os.File, error) {
+	f, err := ioutil.TempFile("", fmt.Sprintf("tempdeltacontent%v", self.info.SHA))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening temp file for writing: %v", err.Error())
+	}
+	bufout := bufio.NewWriter(f)
+	err = self.CopyRange(0, self.info.Size, bufout)
+	if err == nil {
+		err = bufout.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+var (
+	deltaAlgorithms map[string]DeltaAlgorithm = map[string]DeltaAlgorithm{
+		DeltaAlgorithmBM:      &bmDeltaAlgorithm{},
+		DeltaAlgorithmZstd:    &zstdDeltaAlgorithm{},
+		DeltaAlgorithmXdelta3: &xdelta3DeltaAlgorithm{},
+	}
+)
+
+// Registers a delta algorithm for later use
+// Must only be called from the main thread, not thread safe
+// Repeat calls for algorithms with the same name will overrule previous
+func RegisterDeltaAlgorithm(alg DeltaAlgorithm) {
+	deltaAlgorithms[alg.Name()] = alg
+}
+
+// Retrieve a delta algorithm by name, returns an error if unknown or not available here
+func GetDeltaAlgorithm(name string) (DeltaAlgorithm, error) {
+	alg, ok := deltaAlgorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown delta algorithm '%v'", name)
+	}
+	if !alg.Available() {
+		return nil, fmt.Errorf("Delta algorithm '%v' is not available here", name)
+	}
+	return alg, nil
+}
+
+// Get the names of all the delta algorithms which are available here, sorted
+func GetAvailableDeltaAlgorithms() []string {
+	var ret []string
+	for name, alg := range deltaAlgorithms {
+		if alg.Available() {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Get the algorithm deltas are exchanged with a smart remote, checking it can be used here
+func getDeltaAlgorithmForRemote(provider providers.SmartSyncProvider, remoteName string) (string, error) {
+	algorithm, err := provider.DeltaAlgorithm(remoteName)
+	if err != nil {
+		return "", err
+	}
+	_, err = GetDeltaAlgorithm(algorithm)
+	return algorithm, err
+}
+
+// Work out the range of the base to use as the dictionary for a window of the target, for
+// algorithms which compare windows so memory use is bounded. The dictionary is the base around
+// the same offset, extended by half a window either side; content which moved further than that
+// is stored as new content instead
+func getDeltaDictionaryRange(offset, length, window, baseSize int64) (start, end int64) {
+	start = offset - window/2
+	if start < 0 {
+		start = 0
+	}
+	end = offset + length + window/2
+	if end > baseSize {
+		end = baseSize
+	}
+	if start > end {
+		start = end
+	}
+	return start, end
+}
+
+// Size of each window of the target content compared by the bm algorithm. LOBs which fit in one
+// window get exactly the same delta as when the whole content was compared in one go.
+// This is only 'var' rather than 'const' to allow tests to modify
+var deltaWindowSize = int64(32 * 1024 * 1024)
+
+// Bentley/McIlroy deltas
+// Format (as cloudflare/bm): a varint length > 0 followed by that many bytes of literal
+// content, or a 0 followed by varints for the offset & length of a range to copy from the base
+type bmDeltaAlgorithm struct{}
+
+func (*bmDeltaAlgorithm) Name() string {
+	return DeltaAlgorithmBM
+}
+
+func (*bmDeltaAlgorithm) Available() bool {
+	return true
+}
+
+func (*bmDeltaAlgorithm) Generate(base, target *LOBContent, out io.Writer) (int64, error) {
+	var basebuf, windowdelta bytes.Buffer
+	var deltaSize int64
+	for offset := int64(0); offset < target.Size(); offset += deltaWindowSize {
+		length := target.Size() - offset
+		if length > deltaWindowSize {
+			length = deltaWindowSize
+		}
+		dictStart, dictEnd := getDeltaDictionaryRange(offset, length, deltaWindowSize, base.Size())
+		basebuf.Reset()
+		err := base.CopyRange(dictStart, dictEnd-dictStart, &basebuf)
+		if err != nil {
+			return 0, fmt.Errorf("Error getting base file content for delta: %v", err.Error())
+		}
+		comp := bm.NewCompressor()
+		// Use SetDictionary to set on compressor, this computes the hashes
+		comp.SetDictionary(&bm.Dictionary{Dict: basebuf.Bytes()})
+		windowdelta.Reset()
+		comp.SetWriter(&windowdelta)
+		err = target.CopyRange(offset, length, comp)
+		if err != nil {
+			return 0, fmt.Errorf("Error getting target file content for delta: %v", err.Error())
+		}
+		// Now do the actual compression of this window
+		err = comp.Close()
+		if err != nil {
+			return 0, fmt.Errorf("Error during compression of delta: %v", err.Error())
+		}
+		// References are relative to the window's dictionary, make them relative to the whole base
+		n, err := rebaseLOBDeltaReferences(&windowdelta, dictStart, out)
+		deltaSize += n
+		if err != nil {
+			return deltaSize, fmt.Errorf("Error writing delta: %v", err.Error())
+		}
+	}
+	return deltaSize, nil
+}
+
+func (*bmDeltaAlgorithm) Apply(base *os.File, baseSize int64, delta io.Reader, out io.Writer) (int64, error) {
+	in := bufio.NewReader(delta)
+	var written int64
+	for {
+		u, err := binary.ReadUvarint(in)
+		if err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+		if u > 0 {
+			n, err := io.CopyN(out, in, int64(u))
+			written += n
+			if err == io.EOF {
+				return written, io.ErrUnexpectedEOF
+			} else if err != nil {
+				return written, err
+			}
+			continue
+		}
+		refoffset, err := binary.ReadUvarint(in)
+		if err != nil {
+			return written, err
+		}
+		reflength, err := binary.ReadUvarint(in)
+		if err != nil {
+			return written, err
+		}
+		if refoffset > uint64(baseSize) || reflength > uint64(baseSize)-refoffset {
+			return written, fmt.Errorf("Delta references %d bytes at offset %d, outside base of size %d", reflength, refoffset, baseSize)
+		}
+		n, err := io.Copy(out, io.NewSectionReader(base, int64(refoffset), int64(reflength)))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func writeLOBDeltaVarint(out io.Writer, v uint64) (int64, error) {
+	var buf [binary.MaxVarintLen64]byte
+	n, err := out.Write(buf[:binary.PutUvarint(buf[:], v)])
+	return int64(n), err
+}
+
+// Copy a bm delta from in to out, adding offset to all the base references
+// Returns the number of bytes written
+func rebaseLOBDeltaReferences(in *bytes.Buffer, offset int64, out io.Writer) (int64, error) {
+	var written int64
+	for in.Len() > 0 {
+		u, err := binary.ReadUvarint(in)
+		if err != nil {
+			return written, err
+		}
+		n, err := writeLOBDeltaVarint(out, u)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if u > 0 {
+			c, err := io.CopyN(out, in, int64(u))
+			written += c
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		refoffset, err := binary.ReadUvarint(in)
+		if err != nil {
+			return written, err
+		}
+		reflength, err := binary.ReadUvarint(in)
+		if err != nil {
+			return written, err
+		}
+		for _, v := range []uint64{refoffset + uint64(offset), reflength} {
+			n, err = writeLOBDeltaVarint(out, v)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Size of each window of the target content compared by the zstd algorithm. Smaller than bm's
+// because zstd only finds matches a limited distance back into its dictionary
+// This is only 'var' rather than 'const' to allow tests to modify
+var zstdDeltaWindowSize = int64(8 * 1024 * 1024)
+
+// zstd deltas
+// Format: for each window of the target, varints for the offset & length of the range of the
+// base used as the dictionary & the size of the zstd frame which follows, then the frame
+type zstdDeltaAlgorithm struct{}
+
+func (*zstdDeltaAlgorithm) Name() string {
+	return DeltaAlgorithmZstd
+}
+
+func (*zstdDeltaAlgorithm) Available() bool {
+	return true
+}
+
+// The zstd window needs to cover the dictionary as well as the content
+func getZstdDeltaWindowSize(size int64) int {
+	w := zstd.MinWindowSize
+	for int64(w) < size && w < zstd.MaxWindowSize {
+		w <<= 1
+	}
+	return w
+}
+
+func (*zstdDeltaAlgorithm) Generate(base, target *LOBContent, out io.Writer) (int64, error) {
+	var basebuf, targetbuf bytes.Buffer
+	var frame []byte
+	var deltaSize int64
+	for offset := int64(0); offset < target.Size(); offset += zstdDeltaWindowSize {
+		length := target.Size() - offset
+		if length > zstdDeltaWindowSize {
+			length = zstdDeltaWindowSize
+		}
+		dictStart, dictEnd := getDeltaDictionaryRange(offset, length, zstdDeltaWindowSize, base.Size())
+		basebuf.Reset()
+		err := base.CopyRange(dictStart, dictEnd-dictStart, &basebuf)
+		if err != nil {
+			return 0, fmt.Errorf("Error getting base file content for delta: %v", err.Error())
+		}
+		targetbuf.Reset()
+		err = target.CopyRange(offset, length, &targetbuf)
+		if err != nil {
+			return 0, fmt.Errorf("Error getting target file content for delta: %v", err.Error())
+		}
+		// Only the best level looks far enough back to find most matches in the dictionary
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderDictRaw(1, basebuf.Bytes()),
+			zstd.WithWindowSize(getZstdDeltaWindowSize(int64(basebuf.Len()+targetbuf.Len()))),
+			zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return 0, fmt.Errorf("Unable to initialise zstd compressor: %v", err.Error())
+		}
+		frame = enc.EncodeAll(targetbuf.Bytes(), frame[:0])
+		enc.Close()
+		for _, v := range []uint64{uint64(dictStart), uint64(dictEnd - dictStart), uint64(len(frame))} {
+			n, err := writeLOBDeltaVarint(out, v)
+			deltaSize += n
+			if err != nil {
+				return deltaSize, fmt.Errorf("Error writing delta: %v", err.Error())
+			}
+		}
+		n, err := out.Write(frame)
+		deltaSize += int64(n)
+		if err != nil {
+			return deltaSize, fmt.Errorf("Error writing delta: %v", err.Error())
+		}
+	}
+	return deltaSize, nil
+}
+
+func (*zstdDeltaAlgorithm) Apply(base *os.File, baseSize int64, delta io.Reader, out io.Writer) (int64, error) {
+	in := bufio.NewReader(delta)
+	var basebuf bytes.Buffer
+	var frame, content []byte
+	var written int64
+	for {
+		dictStart, err := binary.ReadUvarint(in)
+		if err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+		dictLength, err := binary.ReadUvarint(in)
+		if err != nil {
+			return written, err
+		}
+		frameLength, err := binary.ReadUvarint(in)
+		if err != nil {
+			return written, err
+		}
+		if dictStart > uint64(baseSize) || dictLength > uint64(baseSize)-dictStart {
+			return written, fmt.Errorf("Delta references %d bytes at offset %d, outside base of size %d", dictLength, dictStart, baseSize)
+		}
+		// A window's frame can't be bigger than the worst case compression of a window
+		if frameLength > uint64(zstdDeltaWindowSize)*2 {
+			return written, fmt.Errorf("Invalid zstd delta frame size %d", frameLength)
+		}
+		basebuf.Reset()
+		_, err = io.Copy(&basebuf, io.NewSectionReader(base, int64(dictStart), int64(dictLength)))
+		if err != nil {
+			return written, err
+		}
+		if uint64(cap(frame)) < frameLength {
+			frame = make([]byte, frameLength)
+		}
+		frame = frame[:frameLength]
+		_, err = io.ReadFull(in, frame)
+		if err != nil {
+			return written, err
+		}
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderDictRaw(1, basebuf.Bytes()), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return written, fmt.Errorf("Unable to initialise zstd decompressor: %v", err.Error())
+		}
+		content, err = dec.DecodeAll(frame, content[:0])
+		dec.Close()
+		if err != nil {
+			return written, err
+		}
+		n, err := out.Write(content)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// xdelta3 deltas (VCDIFF), using the external tool so both ends must have it installed
+type xdelta3DeltaAlgorithm struct{}
+
+func (*xdelta3DeltaAlgorithm) Name() string {
+	return DeltaAlgorithmXdelta3
+}
+
+func (*xdelta3DeltaAlgorithm) Available() bool {
+	_, err := exec.LookPath("xdelta3")
+	return err == nil
+}
+
+// Counts the bytes written through it
+type deltaCountingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (self *deltaCountingWriter) Write(p []byte) (int, error) {
+	n, err := self.w.Write(p)
+	self.n += int64(n)
+	return n, err
+}
+
+func runXdelta3(stdin io.Reader, stdout io.Writer, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("xdelta3", args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("xdelta3 failed: %v %v", err.Error(), stderr.String())
+	}
+	return nil
+}
+
+func (*xdelta3DeltaAlgorithm) Generate(base, target *LOBContent, out io.Writer) (int64, error) {
+	basef, err := base.CopyToTempFile()
+	if err != nil {
+		return 0, fmt.Errorf("Error getting base file content for delta: %v", err.Error())
+	}
+	defer os.Remove(basef.Name())
+	defer basef.Close()
+	targetf, err := target.CopyToTempFile()
+	if err != nil {
+		return 0, fmt.Errorf("Error getting target file content for delta: %v", err.Error())
+	}
+	defer os.Remove(targetf.Name())
+	defer targetf.Close()
+
+	counter := &deltaCountingWriter{w: out}
+	// Let the source window cover the whole base, so matches are found wherever they moved
+	err = runXdelta3(nil, counter, "-e", "-c", "-q", "-B", fmt.Sprintf("%d", getXdelta3SourceWindow(base.Size())),
+		"-s", basef.Name(), targetf.Name())
+	return counter.n, err
+}
+
+func (*xdelta3DeltaAlgorithm) Apply(base *os.File, baseSize int64, delta io.Reader, out io.Writer) (int64, error) {
+	counter := &deltaCountingWriter{w: out}
+	err := runXdelta3(delta, counter, "-d", "-c", "-q", "-B", fmt.Sprintf("%d", getXdelta3SourceWindow(baseSize)),
+		"-s", base.Name())
+	return counter.n, err
+}
+
+// xdelta3 only accepts source windows from 16KB to 2GB
+func getXdelta3SourceWindow(baseSize int64) int64 {
+	switch {
+	case baseSize < 16*1024:
+		return 16 * 1024
+	case baseSize > 2*1024*1024*1024:
+		return 2 * 1024 * 1024 * 1024
+	}
+	return baseSize
+}
+
+// Results of benchmarking one delta algorithm
+type DeltaBenchmarkResult struct {
+	Algorithm string
+	// Number of pairs of versions a delta was generated & applied for
+	Pairs int
+	// Total size of the target versions & of their deltas
+	TargetSize, DeltaSize int64
+	// Total time taken to generate & apply the deltas
+	GenerateTime, ApplyTime time.Duration
+	// Pairs which failed, which aren't counted above
+	Errors []string
+}
+
+// Compare the delta algorithms available here on up to maxPairs pairs of versions of the same
+// files in the local store (an older version against the newest), so that a repo can choose the
+// algorithm which suits its binaries best. Every delta is applied again & checked.
+// Returns results in the same order as GetAvailableDeltaAlgorithms
+func (r *Repo) BenchmarkDeltaAlgorithms(maxPairs int) ([]*DeltaBenchmarkResult, error) {
+	candidates, err := r.getShrinkCandidates(func(data *ShrinkCallbackData) bool { return false })
+	if err != nil {
+		return nil, err
+	}
+	var results []*DeltaBenchmarkResult
+	for _, name := range GetAvailableDeltaAlgorithms() {
+		results = append(results, &DeltaBenchmarkResult{Algorithm: name})
+	}
+	basedir := r.GetLocalLOBRoot()
+	pairs := 0
+	for _, candidate := range candidates {
+		if pairs >= maxPairs {
+			break
+		}
+		// Pairs we'd never exchange deltas for aren't interesting
+		base, err := r.getLOBContentInBaseDir(basedir, candidate.BaseSHA)
+		if err != nil || r.CheckLOBFilesForSHA(candidate.BaseSHA, basedir, false) != nil {
+			continue
+		}
+		target, err := r.getLOBContentInBaseDir(basedir, candidate.SHA)
+		if err != nil || r.CheckLOBFilesForSHA(candidate.SHA, basedir, false) != nil {
+			continue
+		}
+		if target.Size() == 0 || !r.isWithinDeltaMaxSize(target.Size()) {
+			continue
+		}
+		pairs++
+		basef, err := base.CopyToTempFile()
+		if err != nil {
+			return results, err
+		}
+		for _, result := range results {
+			err := benchmarkDeltaAlgorithm(result, base, target, basef)
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%v (%v..%v): %v",
+					candidate.Filename, candidate.BaseSHA[:7], candidate.SHA[:7], err.Error()))
+			}
+		}
+		basef.Close()
+		os.Remove(basef.Name())
+	}
+	return results, nil
+}
+
+// Generate & apply one delta with an algorithm, adding to its results if successful
+func benchmarkDeltaAlgorithm(result *DeltaBenchmarkResult, base, target *LOBContent, basef *os.File) error {
+	alg, err := GetDeltaAlgorithm(result.Algorithm)
+	if err != nil {
+		return err
+	}
+	deltaf, err := ioutil.TempFile("", "tempdeltabenchmark")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(deltaf.Name())
+	defer deltaf.Close()
+
+	start := time.Now()
+	bufout := bufio.NewWriter(deltaf)
+	deltaSize, err := alg.Generate(base, target, bufout)
+	if err == nil {
+		err = bufout.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	generateTime := time.Since(start)
+
+	_, err = deltaf.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	shacalc := NewLOBHashForSHA(target.info.SHA)
+	size, err := alg.Apply(basef, base.Size(), bufio.NewReader(deltaf), shacalc)
+	if err != nil {
+		return err
+	}
+	applyTime := time.Since(start)
+	if testsha := fmt.Sprintf("%x", string(shacalc.Sum(nil))); size != target.Size() || testsha != target.info.SHA {
+		return fmt.Errorf("Applying the delta did not recreate the content (expected %v size %d, actual %v size %d)",
+			target.info.SHA, target.Size(), testsha, size)
+	}
+
+	result.Pairs++
+	result.TargetSize += target.Size()
+	result.DeltaSize += deltaSize
+	result.GenerateTime += generateTime
+	result.ApplyTime += applyTime
+	return nil
+}
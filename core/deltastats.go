@@ -0,0 +1,299 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Adaptive delta thresholds (git-lob.delta-size-adaptive)
+// Every delta we prepare on push or fetch is an observation of how much a delta saves
+// compared to transferring the whole stored LOB. These are recorded per file class
+// (extension) and size class (power of 2) in a small local stats DB, with older
+// observations counting for less, and used to learn the size above which deltas are
+// worth it for each extension. Deltas which don't save much just waste server CPU.
+
+// Observations lose half their weight after this many days, so we re-learn as files change
+var DeltaStatsHalfLifeDays = 30.0
+
+// Weighted number of observations in a size class before we trust its average
+var DeltaStatsMinSamples = 3.0
+
+// Fraction of the stored size a delta must save on average to be worth preparing
+var DeltaStatsMinSavings = 0.25
+
+// Never try deltas for files smaller than this in adaptive mode, even to learn
+var DeltaStatsMinSize int64 = 64 * 1024
+
+// Observed delta savings for files of one extension in one size class
+type DeltaStatsBucket struct {
+	// Weighted number of observations
+	Samples float64
+	// Weighted sum of fractional savings (1 - delta size / stored size)
+	Savings float64
+	// When weights were last brought up to date
+	Updated time.Time
+}
+
+// All observed delta savings, by extension then size class
+type DeltaStats struct {
+	Classes map[string]map[int]*DeltaStatsBucket
+}
+
+// Learned delta threshold for one extension, for reporting
+type DeltaThresholdInfo struct {
+	// Lower case extension including '.', or "" for files without one
+	Extension string
+	// Weighted number of observations across all size classes
+	Samples float64
+	// Average fractional savings across all size classes
+	AverageSavings float64
+	// Size above which deltas are tried; only valid if Learned
+	Threshold int64
+	// Whether we have enough observations to have learned a threshold
+	Learned bool
+	// Whether deltas were not worth it at any size observed (Learned only)
+	Never bool
+}
+
+func (r *Repo) getDeltaStatsFile() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "delta_stats")
+}
+
+// Get the file class (lower case extension) used for delta stats
+func getDeltaStatsClass(filename string) string {
+	return strings.ToLower(filepath.Ext(filename))
+}
+
+// Get the size class (floor of log2 of the size) used for delta stats
+func getDeltaStatsSizeClass(size int64) int {
+	sizeClass := 0
+	for size > 1 {
+		size = size >> 1
+		sizeClass++
+	}
+	return sizeClass
+}
+
+// Bring a bucket's weights up to date, reducing weight of old observations
+func (self *DeltaStatsBucket) decay(now time.Time) {
+	if self.Updated.IsZero() || !now.After(self.Updated) {
+		self.Updated = now
+		return
+	}
+	days := now.Sub(self.Updated).Hours() / 24
+	factor := math.Pow(0.5, days/DeltaStatsHalfLifeDays)
+	self.Samples *= factor
+	self.Savings *= factor
+	self.Updated = now
+}
+
+// Is there enough recent data in this bucket to trust it?
+func (self *DeltaStatsBucket) isKnown(now time.Time) bool {
+	b := *self
+	b.decay(now)
+	// Round so that observations aren't forgotten as soon as they start to decay
+	return math.Floor(b.Samples+0.5) >= DeltaStatsMinSamples
+}
+
+// Are deltas worth it in this bucket? Only meaningful if isKnown
+func (self *DeltaStatsBucket) isWorthwhile() bool {
+	return self.Samples > 0 && self.Savings/self.Samples >= DeltaStatsMinSavings
+}
+
+// Load delta stats from the repo (empty if none recorded yet)
+func (r *Repo) LoadDeltaStats() (*DeltaStats, error) {
+	stats := &DeltaStats{Classes: make(map[string]map[int]*DeltaStatsBucket)}
+	data, err := ioutil.ReadFile(r.getDeltaStatsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stats, nil
+		}
+		return stats, err
+	}
+	err = json.Unmarshal(data, stats)
+	if err != nil {
+		return &DeltaStats{Classes: make(map[string]map[int]*DeltaStatsBucket)},
+			fmt.Errorf("Unable to read delta stats in %v: %v", r.getDeltaStatsFile(), err.Error())
+	}
+	if stats.Classes == nil {
+		stats.Classes = make(map[string]map[int]*DeltaStatsBucket)
+	}
+	return stats, nil
+}
+
+// Save delta stats to the repo
+func (r *Repo) SaveDeltaStats(stats *DeltaStats) error {
+	file := r.getDeltaStatsFile()
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first so an interrupted write can't lose existing stats
+	tmpfile := file + ".tmp"
+	err = ioutil.WriteFile(tmpfile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, file)
+}
+
+// Delete all recorded delta stats, so thresholds are learned from scratch
+func (r *Repo) ResetDeltaStats() error {
+	r.cachedDeltaStats = nil
+	err := os.Remove(r.getDeltaStatsFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Get the stats for this process, loading if necessary
+// Problems reading the stats just mean we start learning again
+func (r *Repo) getCachedDeltaStats() *DeltaStats {
+	if r.cachedDeltaStats == nil {
+		var err error
+		r.cachedDeltaStats, err = r.LoadDeltaStats()
+		if err != nil {
+			r.Log.Errorf("%v, starting again\n", err.Error())
+		}
+	}
+	return r.cachedDeltaStats
+}
+
+// Record an observation of delta savings for a file
+func (self *DeltaStats) Record(filename string, storedSize, deltaSize int64, now time.Time) {
+	if storedSize <= 0 {
+		return
+	}
+	class := getDeltaStatsClass(filename)
+	buckets, ok := self.Classes[class]
+	if !ok {
+		buckets = make(map[int]*DeltaStatsBucket)
+		self.Classes[class] = buckets
+	}
+	sizeClass := getDeltaStatsSizeClass(storedSize)
+	bucket, ok := buckets[sizeClass]
+	if !ok {
+		bucket = &DeltaStatsBucket{}
+		buckets[sizeClass] = bucket
+	}
+	bucket.decay(now)
+	// A delta bigger than the file itself is as bad as we need to record
+	savings := math.Max(-1.0, 1.0-float64(deltaSize+ApproximateMetadataSize)/float64(storedSize))
+	bucket.Samples += 1.0
+	bucket.Savings += savings
+}
+
+// Get the learned delta threshold for a file class
+func (self *DeltaStats) GetThreshold(class string, now time.Time) *DeltaThresholdInfo {
+	ret := &DeltaThresholdInfo{Extension: class}
+	buckets := self.Classes[class]
+	var sizeClasses []int
+	var totalSavings float64
+	for sizeClass, bucket := range buckets {
+		b := *bucket
+		b.decay(now)
+		ret.Samples += b.Samples
+		totalSavings += b.Savings
+		sizeClasses = append(sizeClasses, sizeClass)
+	}
+	if ret.Samples > 0 {
+		ret.AverageSavings = totalSavings / ret.Samples
+	}
+	// Walk down from the largest size class; the threshold is the bottom of the smallest
+	// size class above which deltas were always worthwhile. Size classes we don't know
+	// enough about yet don't affect this
+	sort.Sort(sort.Reverse(sort.IntSlice(sizeClasses)))
+	for _, sizeClass := range sizeClasses {
+		bucket := *buckets[sizeClass]
+		if !bucket.isKnown(now) {
+			continue
+		}
+		bucket.decay(now)
+		if !bucket.isWorthwhile() {
+			if !ret.Learned {
+				ret.Never = true
+			}
+			ret.Learned = true
+			break
+		}
+		ret.Learned = true
+		ret.Threshold = int64(1) << uint(sizeClass)
+	}
+	return ret
+}
+
+// Get the learned delta thresholds for all file classes, sorted by extension
+func (self *DeltaStats) GetAllThresholds(now time.Time) []*DeltaThresholdInfo {
+	var classes []string
+	for class := range self.Classes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	ret := make([]*DeltaThresholdInfo, 0, len(classes))
+	for _, class := range classes {
+		ret = append(ret, self.GetThreshold(class, now))
+	}
+	return ret
+}
+
+// Decide whether deltas should be tried for a file based on learned thresholds
+// staticThreshold is used if we haven't learned anything for this kind of file
+func (self *DeltaStats) ShouldTryDelta(filename string, storedSize, staticThreshold int64, now time.Time) bool {
+	if storedSize < DeltaStatsMinSize {
+		return false
+	}
+	class := getDeltaStatsClass(filename)
+	sizeClass := getDeltaStatsSizeClass(storedSize)
+	threshold := self.GetThreshold(class, now)
+	if bucket, ok := self.Classes[class][sizeClass]; ok && bucket.isKnown(now) {
+		return !threshold.Never && storedSize >= threshold.Threshold
+	}
+	if threshold.Learned && !threshold.Never {
+		// Also try the size class just below the threshold, so that it can come down
+		return sizeClass >= getDeltaStatsSizeClass(threshold.Threshold)-1
+	}
+	return storedSize > staticThreshold
+}
+
+// Whether a file is small enough to try a delta at all (git-lob.delta-max-size)
+func (r *Repo) isWithinDeltaMaxSize(size int64) bool {
+	return r.Options.DeltaMaxSize <= 0 || size <= r.Options.DeltaMaxSize
+}
+
+// Decide whether to try a delta for a file on push or fetch
+// staticThreshold is git-lob.push-delta-size or git-lob.fetch-delta-size
+func (r *Repo) shouldTryDelta(filename string, size, storedSize, staticThreshold int64) bool {
+	if !r.isWithinDeltaMaxSize(size) {
+		return false
+	}
+	if !r.Options.AdaptiveDeltaSize {
+		return size > staticThreshold
+	}
+	return r.getCachedDeltaStats().ShouldTryDelta(filename, storedSize, staticThreshold, time.Now())
+}
+
+// Record the savings of a delta prepared on push or fetch, if learning thresholds
+func (r *Repo) recordDeltaSavings(filename string, storedSize, deltaSize int64) {
+	if !r.Options.AdaptiveDeltaSize {
+		return
+	}
+	stats := r.getCachedDeltaStats()
+	stats.Record(filename, storedSize, deltaSize, time.Now())
+	// Not fatal, we'll just learn more slowly
+	err := r.SaveDeltaStats(stats)
+	if err != nil {
+		r.Log.Errorf("Unable to save delta stats: %v\n", err.Error())
+	}
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Delta stats", func() {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	const MB = int64(1024 * 1024)
+
+	It("Learns thresholds per extension", func() {
+		stats := &DeltaStats{Classes: make(map[string]map[int]*DeltaStatsBucket)}
+		Expect(stats.ShouldTryDelta("file.psd", 2*MB, MB, now)).To(BeTrue(), "Should use static threshold with no stats")
+		Expect(stats.ShouldTryDelta("file.psd", MB/2, MB, now)).To(BeFalse(), "Should use static threshold with no stats")
+		Expect(stats.ShouldTryDelta("file.psd", 1024, 0, now)).To(BeFalse(), "Should never try tiny files")
+
+		// PSDs delta well at 256K+
+		for i := 0; i < 3; i++ {
+			stats.Record("a/file.PSD", 300*1024, 10*1024, now)
+			stats.Record("b/file.psd", 3*MB, 100*1024, now)
+		}
+		// Zips don't delta well at any size
+		for i := 0; i < 3; i++ {
+			stats.Record("file.zip", 3*MB, 3*MB, now)
+		}
+		// Wavs only delta well when large
+		for i := 0; i < 3; i++ {
+			stats.Record("file.wav", 300*1024, 250*1024, now)
+			stats.Record("file.wav", 20*MB, MB, now)
+		}
+
+		psd := stats.GetThreshold(".psd", now)
+		Expect(psd.Learned).To(BeTrue())
+		Expect(psd.Never).To(BeFalse())
+		Expect(psd.Threshold).To(BeEquivalentTo(256*1024), "Threshold should be the bottom of the smallest good size class")
+		Expect(psd.Samples).To(BeNumerically("~", 6, 0.001))
+		Expect(stats.ShouldTryDelta("file.psd", 400*1024, MB, now)).To(BeTrue(), "Should use learned threshold below static")
+		Expect(stats.ShouldTryDelta("file.psd", 200*1024, MB, now)).To(BeTrue(), "Should try size class just below threshold to learn")
+		Expect(stats.ShouldTryDelta("file.psd", 100*1024, MB, now)).To(BeFalse(), "Should not try well below threshold")
+
+		zip := stats.GetThreshold(".zip", now)
+		Expect(zip.Learned).To(BeTrue())
+		Expect(zip.Never).To(BeTrue(), "Zip deltas are never worthwhile")
+		Expect(stats.ShouldTryDelta("file.zip", 3*MB, MB, now)).To(BeFalse())
+		Expect(stats.ShouldTryDelta("file.zip", 100*MB, MB, now)).To(BeTrue(), "Unknown sizes use static threshold")
+
+		wav := stats.GetThreshold(".wav", now)
+		Expect(wav.Never).To(BeFalse())
+		Expect(wav.Threshold).To(BeEquivalentTo(16 * MB))
+		Expect(stats.ShouldTryDelta("file.wav", 300*1024, 0, now)).To(BeFalse(), "Known poor size class should not be tried")
+		Expect(stats.ShouldTryDelta("file.wav", 17*MB, 0, now)).To(BeTrue())
+
+		all := stats.GetAllThresholds(now)
+		Expect(all).To(HaveLen(3))
+		Expect(all[0].Extension).To(Equal(".psd"))
+		Expect(all[1].Extension).To(Equal(".wav"))
+		Expect(all[2].Extension).To(Equal(".zip"))
+	})
+
+	It("Gives old observations less weight", func() {
+		stats := &DeltaStats{Classes: make(map[string]map[int]*DeltaStatsBucket)}
+		for i := 0; i < 4; i++ {
+			stats.Record("file.zip", 3*MB, 3*MB, now)
+		}
+		Expect(stats.GetThreshold(".zip", now).Never).To(BeTrue())
+		later := now.Add(time.Duration(DeltaStatsHalfLifeDays*24) * time.Hour)
+		info := stats.GetThreshold(".zip", later)
+		Expect(info.Samples).To(BeNumerically("~", 2, 0.001), "Samples should halve after half life")
+		Expect(info.Learned).To(BeFalse(), "Should learn again when observations are old")
+		// New observations outweigh old ones
+		for i := 0; i < 6; i++ {
+			stats.Record("file.zip", 3*MB, 100*1024, later)
+		}
+		info = stats.GetThreshold(".zip", later)
+		Expect(info.Never).To(BeFalse())
+		Expect(info.Threshold).To(BeEquivalentTo(2 * MB))
+	})
+
+	Describe("Storing in a repo", func() {
+		root := filepath.Join(os.TempDir(), "DeltaStatsTest")
+		var oldwd string
+		BeforeEach(func() {
+			CreateGitRepoForTest(root)
+			oldwd, _ = os.Getwd()
+			os.Chdir(root)
+		})
+		AfterEach(func() {
+			os.Chdir(oldwd)
+			err := ForceRemoveAll(root)
+			if err != nil {
+				Fail(err.Error())
+			}
+		})
+
+		It("Saves & loads stats", func() {
+			stats, err := testRepo().LoadDeltaStats()
+			Expect(err).To(BeNil(), "No stats should not be an error")
+			Expect(stats.Classes).To(BeEmpty())
+			for i := 0; i < 3; i++ {
+				stats.Record("file.psd", 3*MB, 100*1024, now)
+			}
+			Expect(testRepo().SaveDeltaStats(stats)).To(BeNil())
+			loaded, err := testRepo().LoadDeltaStats()
+			Expect(err).To(BeNil())
+			Expect(loaded.GetThreshold(".psd", now)).To(Equal(stats.GetThreshold(".psd", now)))
+
+			Expect(testRepo().ResetDeltaStats()).To(BeNil())
+			loaded, err = testRepo().LoadDeltaStats()
+			Expect(err).To(BeNil())
+			Expect(loaded.Classes).To(BeEmpty(), "Reset should delete stats")
+		})
+
+		It("Records savings only when adaptive", func() {
+			oldAdaptive := GlobalOptions.AdaptiveDeltaSize
+			defer func() {
+				GlobalOptions.AdaptiveDeltaSize = oldAdaptive
+				testRepo().ResetDeltaStats()
+			}()
+			GlobalOptions.AdaptiveDeltaSize = false
+			testRepo().recordDeltaSavings("file.psd", 3*MB, 100*1024)
+			Expect(FileExists(testRepo().getDeltaStatsFile())).To(BeFalse(), "Should not record when not adaptive")
+			Expect(testRepo().shouldTryDelta("file.psd", 100*1024, 100*1024, MB)).To(BeFalse(), "Should use static threshold")
+
+			GlobalOptions.AdaptiveDeltaSize = true
+			testRepo().ResetDeltaStats()
+			for i := 0; i < 3; i++ {
+				testRepo().recordDeltaSavings("file.psd", 100*1024, 1024)
+			}
+			Expect(FileExists(testRepo().getDeltaStatsFile())).To(BeTrue(), "Should record when adaptive")
+			Expect(testRepo().shouldTryDelta("file.psd", 100*1024, 100*1024, MB)).To(BeTrue(), "Should use learned threshold")
+		})
+
+		It("Never tries deltas above the max size", func() {
+			oldMax := GlobalOptions.DeltaMaxSize
+			defer func() {
+				GlobalOptions.DeltaMaxSize = oldMax
+			}()
+			GlobalOptions.DeltaMaxSize = 100 * MB
+			Expect(testRepo().shouldTryDelta("file.psd", 100*MB, 100*MB, MB)).To(BeTrue(), "Max size itself should be tried")
+			Expect(testRepo().shouldTryDelta("file.psd", 100*MB+1, 50*MB, MB)).To(BeFalse(), "Should not try above max size")
+			GlobalOptions.DeltaMaxSize = 0
+			Expect(testRepo().shouldTryDelta("file.psd", 100*MB+1, 50*MB, MB)).To(BeTrue(), "0 should be unlimited")
+		})
+	})
+})
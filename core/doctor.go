@@ -0,0 +1,357 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type DoctorCheckStatus int
+
+const (
+	// Nothing wrong
+	DoctorCheckPassed DoctorCheckStatus = iota
+	// Works, but probably not as intended
+	DoctorCheckWarning DoctorCheckStatus = iota
+	// Broken, binaries won't be stored or retrieved properly
+	DoctorCheckFailed DoctorCheckStatus = iota
+	// Doesn't apply to this repo
+	DoctorCheckSkipped DoctorCheckStatus = iota
+)
+
+// The outcome of one of the checks made by RunDoctorChecks
+type DoctorCheck struct {
+	// What was checked, e.g. "Filter configured"
+	Name   string
+	Status DoctorCheckStatus
+	// What was found, may be several lines
+	Detail string
+	// How to fix it, for warnings & failures
+	Hint string
+}
+
+// Max number of files to name in a check's detail; the rest are just counted
+const doctorMaxFilesListed = 10
+
+// Check the whole setup of git-lob in the current repo: the filter config, the patterns in
+// .gitattributes, what's been committed & checked out, the binary stores, a remote (which may
+// be "" to skip it) & whether the repo is shallow. Each check is reported to callback when
+// done. Returns whether none of the checks failed; warnings don't count as failures
+func (r *Repo) RunDoctorChecks(remoteName string, callback func(check *DoctorCheck)) bool {
+	ok := true
+	checks := []func() *DoctorCheck{
+		r.doctorCheckFilter,
+		r.doctorCheckAttributes,
+		r.doctorCheckCommittedFiles,
+		r.doctorCheckWorkingCopy,
+		r.doctorCheckLocalStore,
+		r.doctorCheckSharedStore,
+		func() *DoctorCheck { return r.doctorCheckRemote(remoteName) },
+		r.doctorCheckShallow,
+	}
+	for _, check := range checks {
+		result := check()
+		if result.Status == DoctorCheckFailed {
+			ok = false
+		}
+		callback(result)
+	}
+	return ok
+}
+
+// List some files in a check's detail
+func describeDoctorFiles(files []string) string {
+	var lines []string
+	for i, file := range files {
+		if i == doctorMaxFilesListed {
+			lines = append(lines, fmt.Sprintf("...and %d more", len(files)-i))
+			break
+		}
+		lines = append(lines, file)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *Repo) doctorCheckFilter() *DoctorCheck {
+	check := &DoctorCheck{Name: "Filter configured"}
+	if r.IsLOBFilterConfigured() {
+		if r.Options.GitConfig[fmt.Sprintf("filter.%v.process", LOBFilterName)] != "" {
+			check.Detail = "using filter-process"
+		}
+		return check
+	}
+	check.Status = DoctorCheckFailed
+	check.Detail = fmt.Sprintf("the '%v' filter is not in git config, so tracked files are stored in git as normal", LOBFilterName)
+	check.Hint = fmt.Sprintf(`Add this to ~/.gitconfig or .git/config:
+[filter "%v"]
+  clean = "git-lob filter-clean %%f"
+  smudge = "git-lob filter-smudge %%f"
+  process = "git-lob filter-process"
+  required = true`, LOBFilterName)
+	return check
+}
+
+func (r *Repo) doctorCheckAttributes() *DoctorCheck {
+	check := &DoctorCheck{Name: ".gitattributes patterns"}
+	lines, err := r.readGitAttributesLines()
+	if err != nil {
+		check.Status = DoctorCheckFailed
+		check.Detail = err.Error()
+		return check
+	}
+	var tracked int
+	var problems []string
+	for i, line := range lines {
+		pattern, attrs := parseGitAttributesLine(line)
+		istracked := false
+		binary := false
+		for _, attr := range attrs {
+			switch {
+			case isTrackAttribute(attr):
+				istracked = true
+			case attr == "-crlf" || attr == "-text" || attr == "binary":
+				binary = true
+			}
+		}
+		if !istracked {
+			continue
+		}
+		tracked++
+		switch {
+		case strings.HasPrefix(pattern, "!"):
+			problems = append(problems, fmt.Sprintf("line %d: negative pattern '%v' is ignored by git", i+1, pattern))
+		case strings.HasSuffix(pattern, "/"):
+			problems = append(problems, fmt.Sprintf("line %d: '%v' only matches directories, so no files; use '%v**'", i+1, pattern, pattern))
+		case !binary:
+			problems = append(problems, fmt.Sprintf("line %d: '%v' doesn't have -crlf, so git may convert line endings", i+1, pattern))
+		}
+	}
+	if len(problems) > 0 {
+		check.Status = DoctorCheckWarning
+		check.Detail = strings.Join(problems, "\n")
+		check.Hint = "Fix these lines in .gitattributes, or use 'git lob untrack' & 'git lob track' to add them again"
+		return check
+	}
+	if tracked == 0 {
+		check.Status = DoctorCheckWarning
+		check.Detail = "no files are tracked in git-lob"
+		check.Hint = "Use 'git lob track <pattern>' to store files in git-lob"
+		return check
+	}
+	check.Detail = fmt.Sprintf("%d patterns tracked", tracked)
+	return check
+}
+
+// Get all the files at HEAD, relative to the repo root
+func (r *Repo) getGitFilesAtHEAD() (map[string]bool, error) {
+	// ls-tree doesn't support glob pathspecs, so filter afterwards
+	cmd := r.command("git", "ls-tree", "-r", "-z", "--name-only", "--full-tree", "HEAD")
+	cmd.Dir = r.Root
+	outp, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error calling 'git ls-tree': %v", err.Error())
+	}
+	ret := make(map[string]bool)
+	for _, file := range strings.Split(string(outp), "\x00") {
+		if file != "" {
+			ret[file] = true
+		}
+	}
+	return ret, nil
+}
+
+// Get the files at HEAD matching tracked patterns which were committed as their real content
+// rather than placeholders (apart from those in .gitlobignore), & the number of files which are stored in git-lob
+func (r *Repo) getGitFilesCommittedWithoutFilter() (raw []string, stored int, err error) {
+	patterns, err := r.GetTrackedPatterns()
+	if err != nil {
+		return nil, 0, err
+	}
+	files, err := r.GetGitFilesMatchingPatterns(patterns)
+	if err != nil {
+		return nil, 0, err
+	}
+	committed, err := r.getGitFilesAtHEAD()
+	if err != nil {
+		return nil, 0, err
+	}
+	filelobs, err := r.GetGitAllFilesAndLOBsToCheckoutAtCommit("HEAD", nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	placeholders := make(map[string]bool, len(filelobs))
+	for _, filelob := range filelobs {
+		placeholders[filelob.Filename] = true
+	}
+	for _, file := range files {
+		if committed[file] && !placeholders[file] && !r.IsLOBIgnored(file) {
+			raw = append(raw, file)
+		}
+	}
+	return raw, len(filelobs), nil
+}
+
+func (r *Repo) doctorCheckCommittedFiles() *DoctorCheck {
+	check := &DoctorCheck{Name: "Committed files"}
+	if !r.GitRefOrSHAIsValid("HEAD") {
+		check.Status = DoctorCheckSkipped
+		check.Detail = "nothing committed yet"
+		return check
+	}
+	raw, stored, err := r.getGitFilesCommittedWithoutFilter()
+	if err != nil {
+		check.Status = DoctorCheckFailed
+		check.Detail = err.Error()
+		return check
+	}
+	if len(raw) > 0 {
+		check.Status = DoctorCheckWarning
+		check.Detail = fmt.Sprintf("%d files matching tracked patterns were committed to git without the filter\n%v",
+			len(raw), describeDoctorFiles(raw))
+		check.Hint = "Configure the filter, then 'git lob track --restage' & commit to store them in git-lob"
+		return check
+	}
+	check.Detail = fmt.Sprintf("%d files stored in git-lob at HEAD", stored)
+	return check
+}
+
+// Files in the working copy which are still placeholders rather than their content
+func (r *Repo) doctorCheckWorkingCopy() *DoctorCheck {
+	check := &DoctorCheck{Name: "Working copy"}
+	if !r.GitRefOrSHAIsValid("HEAD") {
+		check.Status = DoctorCheckSkipped
+		check.Detail = "nothing committed yet"
+		return check
+	}
+	filelobs, err := r.GetGitAllFilesAndLOBsToCheckoutAtCommit("HEAD", nil, nil)
+	if err != nil {
+		check.Status = DoctorCheckFailed
+		check.Detail = err.Error()
+		return check
+	}
+	var placeholders []string
+	for _, filelob := range filelobs {
+		path := filepath.Join(r.Root, filelob.Filename)
+		stat, err := os.Stat(path)
+		if err != nil || !isLOBPlaceholderSize(stat.Size()) {
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if _, isplaceholder := parseLOBPlaceholder(content); isplaceholder {
+			placeholders = append(placeholders, filelob.Filename)
+		}
+	}
+	if len(placeholders) > 0 {
+		check.Status = DoctorCheckWarning
+		check.Detail = fmt.Sprintf("%d files are placeholders rather than their content\n%v",
+			len(placeholders), describeDoctorFiles(placeholders))
+		check.Hint = "Run 'git lob fetch' to download the binaries & check them out, or 'git lob checkout' if they're already stored"
+		return check
+	}
+	return check
+}
+
+// Test that a directory can be written to
+func checkDirWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, "doctor")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (r *Repo) doctorCheckLocalStore() *DoctorCheck {
+	check := &DoctorCheck{Name: "Local binary store"}
+	root := filepath.Join(r.GitDir, "git-lob", "content")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		check.Status = DoctorCheckFailed
+		check.Detail = err.Error()
+		check.Hint = "Check the permissions of .git/git-lob"
+		return check
+	}
+	if err := checkDirWritable(root); err != nil {
+		check.Status = DoctorCheckFailed
+		check.Detail = fmt.Sprintf("can't write to %v: %v", root, err.Error())
+		check.Hint = fmt.Sprintf("Check the owner & permissions of %v", root)
+		return check
+	}
+	check.Detail = root
+	return check
+}
+
+// The shared store must be writable & on the same volume as the repo, since binaries are
+// hard linked from it into the local store
+func (r *Repo) doctorCheckSharedStore() *DoctorCheck {
+	check := &DoctorCheck{Name: "Shared binary store"}
+	sharedRoot := r.GetSharedLOBRoot()
+	if sharedRoot == "" {
+		check.Status = DoctorCheckSkipped
+		check.Detail = "git-lob.sharedstore not set"
+		return check
+	}
+	fail := func(detail, hint string) *DoctorCheck {
+		check.Status = DoctorCheckFailed
+		check.Detail = detail
+		check.Hint = hint
+		return check
+	}
+	f, err := ioutil.TempFile(sharedRoot, "doctor")
+	if err != nil {
+		return fail(fmt.Sprintf("can't write to %v: %v", sharedRoot, err.Error()),
+			fmt.Sprintf("Check the owner & permissions of %v", sharedRoot))
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	link := filepath.Join(r.GetLocalLOBRoot(), filepath.Base(f.Name()))
+	if err := CreateHardLink(f.Name(), link); err != nil {
+		return fail(fmt.Sprintf("can't hard link from %v into the repo: %v", sharedRoot, err.Error()),
+			"git-lob.sharedstore must be on the same volume as the repo, on a file system which supports hard links")
+	}
+	os.Remove(link)
+	check.Detail = sharedRoot
+	return check
+}
+
+func (r *Repo) doctorCheckRemote(remoteName string) *DoctorCheck {
+	check := &DoctorCheck{Name: "Remote connectivity"}
+	if remoteName == "" {
+		check.Status = DoctorCheckSkipped
+		check.Detail = "no remote"
+		return check
+	}
+	check.Name = fmt.Sprintf("Remote '%v'", remoteName)
+	var failed *RemoteCheckStep
+	var steps []string
+	r.CheckRemote(remoteName, func(step *RemoteCheckStep) {
+		if step.Error != nil && failed == nil {
+			failed = step
+		} else if !step.Skipped {
+			steps = append(steps, step.Name)
+		}
+	})
+	if failed != nil {
+		check.Status = DoctorCheckFailed
+		check.Detail = fmt.Sprintf("%v failed: %v", failed.Name, failed.Error.Error())
+		check.Hint = fmt.Sprintf("Run 'git lob check-config --remote=%v' for details, & see 'git lob help remotes'", remoteName)
+		return check
+	}
+	check.Detail = strings.Join(steps, ", ") + " OK"
+	return check
+}
+
+func (r *Repo) doctorCheckShallow() *DoctorCheck {
+	check := &DoctorCheck{Name: "Full history"}
+	shallow := r.GetGitShallowCommits()
+	if len(shallow) > 0 {
+		check.Status = DoctorCheckWarning
+		check.Detail = fmt.Sprintf("the repo is a shallow clone with %d boundary commits, so binaries in older history can't be found", len(shallow))
+		check.Hint = "Run 'git fetch --unshallow' if you need to push or prune binaries from older history"
+	}
+	return check
+}
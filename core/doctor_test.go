@@ -0,0 +1,103 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Doctor", func() {
+	root := filepath.Join(os.TempDir(), "DoctorTest")
+	sharedroot := filepath.Join(os.TempDir(), "DoctorTestShared")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		LoadConfig(GlobalOptions)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		os.RemoveAll(sharedroot)
+		GlobalOptions = NewOptions()
+	})
+
+	runChecks := func() (map[string]*DoctorCheck, bool) {
+		checks := make(map[string]*DoctorCheck)
+		ok := testRepo().RunDoctorChecks("", func(check *DoctorCheck) {
+			checks[check.Name] = check
+		})
+		return checks, ok
+	}
+
+	It("Reports problems with hints", func() {
+		shas := CreateManyCommitsForTest([][]string{[]string{"img1.png", "img2.png"}}, 0, func(filename string, i int) int64 { return 200 })
+		// Binary not available, so still a placeholder
+		Expect(testRepo().DeleteLOB(shas[0][1])).To(BeNil())
+		Expect(ioutil.WriteFile("img1.png", []byte("Real content"), 0644)).To(BeNil())
+		Expect(ioutil.WriteFile(".gitattributes", []byte("*.png filter=lob -crlf\nart/ filter=lob -crlf\n*.psd filter=lob\n"), 0644)).To(BeNil())
+		Expect(ioutil.WriteFile("raw.png", []byte("Committed without the filter"), 0644)).To(BeNil())
+		RunGitCommandForTest(true, "add", ".gitattributes", "raw.png")
+		RunGitCommandForTest(true, "commit", "-m", "Raw")
+		head := RunGitCommandForTest(true, "rev-parse", "HEAD")
+		Expect(ioutil.WriteFile(filepath.Join(".git", "shallow"), []byte(head), 0644)).To(BeNil())
+
+		checks, ok := runChecks()
+		Expect(ok).To(BeFalse(), "Filter isn't configured")
+		Expect(checks).To(HaveLen(8))
+		Expect(checks["Filter configured"].Status).To(Equal(DoctorCheckFailed))
+		Expect(checks["Filter configured"].Hint).To(ContainSubstring("filter-process"))
+		Expect(checks["Filter configured"].Hint).To(ContainSubstring(fmt.Sprintf(`[filter "%v"]`, LOBFilterName)))
+		Expect(checks["Filter configured"].Hint).ToNot(ContainSubstring("%!"), "Hint should be formatted correctly")
+		Expect(checks[".gitattributes patterns"].Status).To(Equal(DoctorCheckWarning))
+		Expect(checks[".gitattributes patterns"].Detail).To(ContainSubstring("line 2: 'art/' only matches directories"))
+		Expect(checks[".gitattributes patterns"].Detail).To(ContainSubstring("line 3: '*.psd' doesn't have -crlf"))
+		Expect(checks["Committed files"].Status).To(Equal(DoctorCheckWarning))
+		Expect(checks["Committed files"].Detail).To(ContainSubstring("1 files"))
+		Expect(checks["Committed files"].Detail).To(ContainSubstring("raw.png"))
+		Expect(checks["Working copy"].Status).To(Equal(DoctorCheckWarning))
+		Expect(checks["Working copy"].Detail).To(ContainSubstring("img2.png"))
+		Expect(checks["Working copy"].Detail).ToNot(ContainSubstring("img1.png"))
+		Expect(checks["Local binary store"].Status).To(Equal(DoctorCheckPassed))
+		Expect(checks["Shared binary store"].Status).To(Equal(DoctorCheckSkipped))
+		Expect(checks["Remote connectivity"].Status).To(Equal(DoctorCheckSkipped))
+		Expect(checks["Full history"].Status).To(Equal(DoctorCheckWarning))
+		Expect(checks["Full history"].Hint).To(ContainSubstring("--unshallow"))
+	})
+
+	It("Passes a healthy repo", func() {
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_APPEND, 0644)
+		Expect(err).To(BeNil())
+		f.WriteString(fmt.Sprintf(`
+[filter "%v"]
+    clean = "git-lob filter-clean %%f"
+    smudge = "git-lob filter-smudge %%f"
+`, LOBFilterName))
+		f.Close()
+		os.MkdirAll(sharedroot, 0755)
+		LoadConfig(GlobalOptions)
+		GlobalOptions.SharedStore = sharedroot
+		Expect(ioutil.WriteFile(".gitattributes", []byte("*.png filter=lob -crlf\n"), 0644)).To(BeNil())
+		Expect(exec.Command("git", "add", ".gitattributes").Run()).To(BeNil())
+		CreateManyCommitsForTest([][]string{[]string{"img1.png"}}, 0, func(filename string, i int) int64 { return 200 })
+		Expect(testRepo().Checkout(nil, false, func(t ProgressCallbackType, filelob *FileLOB, err error) {})).To(BeNil())
+
+		checks, ok := runChecks()
+		Expect(ok).To(BeTrue())
+		for name, check := range checks {
+			Expect(check.Status == DoctorCheckPassed || check.Status == DoctorCheckSkipped).To(BeTrue(), name+": "+check.Detail)
+		}
+		Expect(checks["Shared binary store"].Status).To(Equal(DoctorCheckPassed))
+		Expect(checks["Committed files"].Detail).To(Equal("1 files stored in git-lob at HEAD"))
+	})
+})
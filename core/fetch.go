@@ -1,19 +1,46 @@
 package core
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/util"
 )
 
+// A remote to fetch from, see FetchFromRemotes
+type FetchRemote struct {
+	Name     string
+	Provider providers.SyncProvider
+}
+
+// When fetch marks commits as pushed to the remote it fetched from (git-lob.fetch-updates-push-state)
+const (
+	// Fetch never changes the push state
+	FetchPushStateNever = "never"
+	// Only when all binaries of unpushed ancestors are on the remote & nothing was missing (default)
+	FetchPushStateSafe = "safe"
+	// Whenever a fetch finishes, without checking
+	FetchPushStateAlways = "always"
+)
+
 // Implementation of fetch
-func Fetch(provider providers.SyncProvider, remoteName string, refspecs []*GitRefSpec, dryRun, force bool,
+func (r *Repo) Fetch(provider providers.SyncProvider, remoteName string, refspecs []*GitRefSpec, dryRun, force bool,
+	callback util.ProgressCallback) error {
+	return r.FetchFromRemotes([]*FetchRemote{&FetchRemote{remoteName, provider}}, refspecs, dryRun, force, callback)
+}
+
+// Fetch from a list of remotes in order of priority (see git-lob.fetch-remotes); binaries
+// the first remote doesn't have, or which couldn't be fetched from it, are fetched from the
+// next & so on. Which remote each binary came from is recorded (see GetFetchSource)
+func (r *Repo) FetchFromRemotes(remotes []*FetchRemote, refspecs []*GitRefSpec, dryRun, force bool,
 	callback util.ProgressCallback) error {
 	// We need to build a list of commits ranges at which we want to ensure binaries are present locally
 	// We can't build the list of binaries solely from the log, because  not all binaries needed may have been
@@ -21,138 +48,50 @@ func Fetch(provider providers.SyncProvider, remoteName string, refspecs []*GitRe
 	// a 'git log -G' query for subsequent LOB changes. This is faster than doing ls-tree for every individual commit
 	// and eliminating duplicates.
 
-	util.LogDebugf("Fetching from %v via %v\n", remoteName, provider.TypeID())
-
-	var fileLobsNeeded []*FileLOB
-	var fetchranges []*GitRefSpec
-	if len(refspecs) == 0 {
-		// No refs specified, use 'Recent' fetch algorithm
-		if util.GlobalOptions.Verbose {
-			callback(&util.ProgressCallbackData{util.ProgressCalculate, "Calculating recent commits...",
-				int64(0), int64(1), 0, 0})
-		}
-		// Get HEAD LOBs first
-		headfilelobs, earliestCommit, err := GetGitAllFileLOBsToCheckoutAtCommitAndRecent("HEAD", util.GlobalOptions.FetchCommitsPeriodHEAD,
-			util.GlobalOptions.FetchIncludePaths, util.GlobalOptions.FetchExcludePaths)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Error determining recent HEAD commits: %v", err.Error()))
-		}
-		if util.GlobalOptions.Verbose {
-			callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * HEAD: %d binary references", len(headfilelobs)),
-				0, 0, 0, 0})
-		}
-		fileLobsNeeded = headfilelobs
-		headSHA, err := GitRefToFullSHA("HEAD")
+	callback = util.CancellableProgressCallback(callback)
+	// Push state is only updated for the first remote, see below
+	primary := remotes[0]
+	for _, remote := range remotes {
+		r.Log.Debugf("Fetching from %v via %v\n", remote.Name, remote.Provider.TypeID())
+	}
+	// Background prefetching gives way to explicit fetches, see Prefetch
+	if !dryRun {
+		l, err := r.lockFetch()
 		if err != nil {
-			return errors.New(fmt.Sprintf("Error determining HEAD sha: %v", err.Error()))
+			return err
 		}
-		fetchranges = append(fetchranges, &GitRefSpec{fmt.Sprintf("^%v", earliestCommit), "..", headSHA})
-		if util.GlobalOptions.FetchRefsPeriodDays > 0 {
-			// Find recent other refs (only include remote branches for this remote)
-			recentrefs, err := GetGitRecentRefs(util.GlobalOptions.FetchRefsPeriodDays, true, remoteName)
-			if err != nil {
-				return errors.New(fmt.Sprintf("Error determining recent refs: %v", err.Error()))
-			}
-			// Now each other ref, they should be in reverse date order from GetGitRecentRefs so we're doing
-			// things by priority, HEAD first then most recent
-			refSHAsDone := util.NewStringSet()
-			refSHAsDone.Add(headSHA)
-			for i, ref := range recentrefs {
-				// Don't duplicate work when >1 ref has the same SHA
-				// Most common with HEAD if not detached but also tags
-				if refSHAsDone.Contains(ref.CommitSHA) {
-					continue
-				}
-				refSHAsDone.Add(ref.CommitSHA)
-
-				recentreflobs, earliestCommit, err := GetGitAllFileLOBsToCheckoutAtCommitAndRecent(ref.Name, util.GlobalOptions.FetchCommitsPeriodOther,
-					util.GlobalOptions.FetchIncludePaths, util.GlobalOptions.FetchExcludePaths)
-				if err != nil {
-					return errors.New(fmt.Sprintf("Error determining recent commits on %v: %v", ref, err.Error()))
-				}
-				if util.GlobalOptions.Verbose {
-					callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * %v: %d binary references", ref, len(recentreflobs)),
-						int64(i), int64(len(refspecs)), 0, 0})
-				}
-				fileLobsNeeded = append(fileLobsNeeded, recentreflobs...)
-
-				fetchranges = append(fetchranges, &GitRefSpec{fmt.Sprintf("^%v", earliestCommit), "..", ref.CommitSHA})
-			}
-
-		}
-	} else {
-		// Get LOBs directly from specified refs/ranges
-		for i, refspec := range refspecs {
-			if util.GlobalOptions.Verbose {
-				callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Calculating data to fetch for %v", refspec),
-					int64(i), int64(len(refspecs)), 0, 0})
-			}
-			reffileshas, err := GetGitAllFilesAndLOBsToCheckoutInRefSpec(refspec, util.GlobalOptions.FetchIncludePaths, util.GlobalOptions.FetchExcludePaths)
-			if err != nil {
-				return errors.New(fmt.Sprintf("Error determining LOBs to fetch for %v: %v", refspec, err.Error()))
-			}
-			if util.GlobalOptions.Verbose {
-				callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * %v: %d binary references", refspec, len(refspecs)),
-					int64(i), int64(len(refspecs)), 0, 0})
-			}
-			fileLobsNeeded = append(fileLobsNeeded, reffileshas...)
+		defer l.Release()
+	}
 
-			if refspec.IsRange() {
-				fetchranges = append(fetchranges, refspec)
-			} else {
-				fetchranges = append(fetchranges, &GitRefSpec{fmt.Sprintf("^%v", refspec.Ref1), "..", refspec.Ref1})
-			}
-		}
+	fileLobsNeeded, fetchranges, err := r.getFetchRangeFileLOBs(remotes, refspecs, callback)
+	if err != nil {
+		return err
 	}
 
+	// Before we actually fetch anything, work out which commits we can mark as pushed afterwards
 	var commitsToMarkPushedAfterFetching []string
-	// Before we actually fetch anything, check if we can bulk mark things as pushed
-	// Common case - first fetch after clone, user hasn't done any local work
-	if !InitSuccessfullyPushedCacheIfAppropriate() {
-		// Otherwise, let's see whether we can move the pushed state forward as we fetch
-		// Remember, we can have 'gaps' in the history for LOBs if enough time passed since last fetch
-		// that the earliest fetch doesn't cover the whole period since the last fetch
-		// So the cases where we can move the push markers forward are:
-		// 1. There's nothing to push before the first commit we're fetching, OR
-		// 2. The intervening 'unpushed' commits already exist on the remote
-		for _, fetchrange := range fetchranges {
-			anyCommitsUnpushed := false
-			allUnpushedCommitsAreOnRemote := true
-			unpushedCallback := func(commit *CommitLOBRef) (quit bool, err error) {
-				anyCommitsUnpushed = true
-				for _, sha := range commit.LobSHAs {
-					// check remote
-					remoteerr := CheckRemoteLOBFilesForSHA(sha, provider, remoteName)
-					if remoteerr != nil {
-						// LOB doesn't exist on remote so this is genuinely unpushed
-						allUnpushedCommitsAreOnRemote = false
-						return true, remoteerr
-					}
-				}
-				return false, nil
-			}
-			// These are all ranges, Ref1 being exclusive so that's where we measure from
-			WalkGitCommitLOBsToPush(remoteName, fetchrange.Ref1, false, unpushedCallback)
-			if !anyCommitsUnpushed || allUnpushedCommitsAreOnRemote {
-				pushedsha := fetchrange.Ref2
-				if !GitRefIsFullSHA(pushedsha) {
-					// Was probably a manual ref, convert to SHA
-					pushedsha, _ = GitRefToFullSHA(pushedsha)
-				}
+	switch r.Options.FetchUpdatesPushState {
+	case FetchPushStateNever:
+		r.Log.Debugf("Not marking commits as pushed to %v after fetch (git-lob.fetch-updates-push-state = never)\n", primary.Name)
+	case FetchPushStateAlways:
+		if !r.InitSuccessfullyPushedCacheIfAppropriate() {
+			for _, fetchrange := range fetchranges {
+				pushedsha, _ := r.GitRefToFullSHA(fetchrange.Ref2)
 				commitsToMarkPushedAfterFetching = append(commitsToMarkPushedAfterFetching, pushedsha)
-				util.LogDebugf("Will mark %v as pushed after fetch since there are no unpushed LOBs in ancestors that aren't on %v\n", fetchrange.Ref2, remoteName)
-			} else {
-				util.LogDebugf("%v will not be marked as pushed after fetch since there are unpushed LOBs in ancestors that aren't on %v\n", fetchrange.Ref2, remoteName)
 			}
 		}
-
+	default:
+		// Common case - first fetch after clone, user hasn't done any local work
+		if !r.InitSuccessfullyPushedCacheIfAppropriate() {
+			commitsToMarkPushedAfterFetching = r.getCommitsSafeToMarkPushedAfterFetch(primary, fetchranges)
+		}
 	}
 
 	fetchAnyNotFound := false
 
 	if len(fileLobsNeeded) == 0 {
 		callback(&util.ProgressCallbackData{util.ProgressCalculate, "No binaries to download.",
-			int64(len(refspecs)), int64(len(refspecs)), 0, 0})
+			int64(len(refspecs)), int64(len(refspecs)), 0, 0, nil})
 	} else {
 
 		// Duplicates are not eliminated by methods we call, for efficiency
@@ -166,7 +105,12 @@ func Fetch(provider providers.SyncProvider, remoteName string, refspecs []*GitRe
 			// Eliminate any that are OK locally
 			// It's safe to delete as you iterate in Go! refreshing :)
 			for sha, _ := range lobsToDownload {
-				if !IsLOBMissing(sha, false) {
+				if r.Options.FetchMetadataOnly {
+					// Only need the metadata, content is fetched on checkout
+					if _, err := r.GetLOBInfo(sha); err == nil {
+						delete(lobsToDownload, sha)
+					}
+				} else if !r.IsLOBMissing(sha, false) {
 					delete(lobsToDownload, sha)
 				}
 			}
@@ -174,55 +118,425 @@ func Fetch(provider providers.SyncProvider, remoteName string, refspecs []*GitRe
 
 		if len(lobsToDownload) == 0 {
 			callback(&util.ProgressCallbackData{util.ProgressCalculate, "No binaries to download.",
-				int64(len(refspecs)), int64(len(refspecs)), 0, 0})
+				int64(len(refspecs)), int64(len(refspecs)), 0, 0, nil})
+			if !dryRun {
+				r.endLazyFetchAfterFullFetch()
+			}
 			return nil
 		} else {
 			callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("%d binaries to download.", len(lobsToDownload)),
-				int64(len(refspecs)), int64(len(refspecs)), 0, 0})
+				int64(len(refspecs)), int64(len(refspecs)), 0, 0, nil})
 		}
 		if !dryRun {
-			fetchCallback := func(data *util.ProgressCallbackData) (abort bool) {
-				if data.Type == util.ProgressNotFound {
+			sources, anyNotFound, err := r.fetchLOBsFromRemotes(lobsToDownload, remotes, force, callback)
+			if err != nil {
+				return err
+			}
+			if util.IsCancelled() {
+				// What was fetched is stored, but not all of it, so nothing can be marked as pushed
+				return util.ErrCancelled
+			}
+			// Only the first remote's push state was checked, & binaries which came from other remotes
+			// may not be on it (we may need to push them)
+			fetchAnyNotFound = anyNotFound
+			for _, remoteName := range sources {
+				if remoteName != primary.Name {
 					fetchAnyNotFound = true
 				}
-				// passthrough to external callback
-				return callback(data)
 			}
+		}
+	}
+
+	r.Log.Debugf("Successfully fetched from %v via %v\n", primary.Name, primary.Provider.TypeID())
+	if !dryRun {
+		r.endLazyFetchAfterFullFetch()
+	}
+
+	// Now mark as pushed if appropriate
+	// If any files were not found on the remote, don't do this (we may get them locally later & need to push them)
+	// unless we've been told to always do it
+	if !fetchAnyNotFound || r.Options.FetchUpdatesPushState == FetchPushStateAlways {
+		if err := r.markPushedAfterFetch(primary.Name, commitsToMarkPushedAfterFetching); err != nil {
+			r.Log.Errorf("Error marking commits as pushed after fetch for %v: %v\n", primary.Name, err.Error())
+		}
+	}
+
+	return nil
+
+}
 
-			err := fetchLOBs(lobsToDownload, provider, remoteName, force, fetchCallback)
+// Get the LOBs needed to fetch refspecs, or recent refs if there are none (or the fetch window
+// if set), along with the ranges of commits they're from
+func (r *Repo) getFetchRangeFileLOBs(remotes []*FetchRemote, refspecs []*GitRefSpec, callback util.ProgressCallback) ([]*FileLOB, []*GitRefSpec, error) {
+	var fileLobsNeeded []*FileLOB
+	var fetchranges []*GitRefSpec
+	if r.isFetchWindowSet() {
+		// --since, --until or --max-commits replace the recent commits heuristics
+		var err error
+		fileLobsNeeded, fetchranges, err = r.getFetchWindowFileLOBs(remotes, refspecs, callback)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if len(refspecs) == 0 {
+		// No refs specified, use 'Recent' fetch algorithm
+		var err error
+		fileLobsNeeded, fetchranges, err = r.getRecentFileLOBs(remotes, callback)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		// Get LOBs directly from specified refs/ranges
+		for i, refspec := range refspecs {
+			if r.Options.Verbose {
+				callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Calculating data to fetch for %v", refspec),
+					int64(i), int64(len(refspecs)), 0, 0, nil})
+			}
+			reffileshas, err := r.GetGitAllFilesAndLOBsToCheckoutInRefSpec(refspec, r.Options.FetchIncludePaths, r.Options.FetchExcludePaths)
 			if err != nil {
-				return err
+				return nil, nil, errors.New(fmt.Sprintf("Error determining LOBs to fetch for %v: %v", refspec, err.Error()))
+			}
+			if r.Options.Verbose {
+				callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * %v: %d binary references", refspec, len(refspecs)),
+					int64(i), int64(len(refspecs)), 0, 0, nil})
+			}
+			fileLobsNeeded = append(fileLobsNeeded, reffileshas...)
+
+			if refspec.IsRange() {
+				fetchranges = append(fetchranges, refspec)
+			} else {
+				fetchranges = append(fetchranges, &GitRefSpec{fmt.Sprintf("^%v", refspec.Ref1), "..", refspec.Ref1})
 			}
+		}
+	}
+	return fileLobsNeeded, fetchranges, nil
+}
 
+// Get the ends of fetched ranges of commits which can safely be marked as pushed to a remote
+// once their binaries have been fetched from it
+func (r *Repo) getCommitsSafeToMarkPushedAfterFetch(remote *FetchRemote, fetchranges []*GitRefSpec) []string {
+	var ret []string
+	// Remember, we can have 'gaps' in the history for LOBs if enough time passed since last fetch
+	// that the earliest fetch doesn't cover the whole period since the last fetch
+	// So the cases where we can move the push markers forward are:
+	// 1. There's nothing to push before the first commit we're fetching, OR
+	// 2. The intervening 'unpushed' commits already exist on the remote
+	for _, fetchrange := range fetchranges {
+		anyCommitsUnpushed := false
+		allUnpushedCommitsAreOnRemote := true
+		unpushedCallback := func(commit *CommitLOBRef) (quit bool, err error) {
+			anyCommitsUnpushed = true
+			for _, sha := range commit.LobSHAs {
+				// check remote
+				remoteerr := r.CheckRemoteLOBFilesForSHA(sha, remote.Provider, remote.Name)
+				if remoteerr != nil {
+					// LOB doesn't exist on remote so this is genuinely unpushed
+					allUnpushedCommitsAreOnRemote = false
+					return true, remoteerr
+				}
+			}
+			return false, nil
+		}
+		// These are all ranges, Ref1 being exclusive so that's where we measure from
+		r.WalkGitCommitLOBsToPush(remote.Name, fetchrange.Ref1, false, []string{}, []string{}, unpushedCallback)
+		if !anyCommitsUnpushed || allUnpushedCommitsAreOnRemote {
+			pushedsha := fetchrange.Ref2
+			if !GitRefIsFullSHA(pushedsha) {
+				// Was probably a manual ref, convert to SHA
+				pushedsha, _ = r.GitRefToFullSHA(pushedsha)
+			}
+			ret = append(ret, pushedsha)
+			r.Log.Debugf("Will mark %v as pushed after fetch since there are no unpushed LOBs in ancestors that aren't on %v\n", fetchrange.Ref2, remote.Name)
+		} else {
+			r.Log.Debugf("%v will not be marked as pushed after fetch since there are unpushed LOBs in ancestors that aren't on %v\n", fetchrange.Ref2, remote.Name)
 		}
 	}
+	return ret
+}
 
-	util.LogDebugf("Successfully fetched from %v via %v\n", remoteName, provider.TypeID())
+// Mark commits as pushed to a remote after fetching them
+func (r *Repo) markPushedAfterFetch(remoteName string, commits []string) error {
+	if len(commits) == 0 {
+		return nil
+	}
+	pushState, err := r.BeginPushStateTransaction(remoteName)
+	if err != nil {
+		return err
+	}
+	for _, c := range commits {
+		err := pushState.MarkBinariesAsPushed(c, "")
+		if err != nil {
+			r.Log.Errorf("Error marking %v as pushed after fetch for %v: %v\n", c, remoteName, err.Error())
+		}
+	}
+	err = pushState.Commit()
+	if err != nil {
+		return err
+	}
+	// resolve any redundant state that creates
+	r.CleanupPushState(remoteName)
+	return nil
+}
 
-	// Now mark as pushed if appropriate
-	// If any files were not found on the remote, don't do this (we may get them locally later & need to push them)
-	if !fetchAnyNotFound && len(commitsToMarkPushedAfterFetching) > 0 {
-		for _, c := range commitsToMarkPushedAfterFetching {
-			err := MarkBinariesAsPushed(remoteName, c, "")
+// Mark commits as pushed to a remote as a fetch of refspecs (or recent refs if there are none)
+// from it would with git-lob.fetch-updates-push-state = safe, without fetching anything; e.g.
+// when fetch is set not to update the push state. The binaries needed at the fetched commits
+// must all be on the remote: those fetched from it are assumed to be, others are checked.
+// Returns the commits marked (or which would be for a dry run)
+func (r *Repo) MarkPushedFromFetch(remote *FetchRemote, refspecs []*GitRefSpec, dryRun bool, callback util.ProgressCallback) ([]string, error) {
+	callback = util.CancellableProgressCallback(callback)
+	fileLobsNeeded, fetchranges, err := r.getFetchRangeFileLOBs([]*FetchRemote{remote}, refspecs, callback)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	fetchSources := r.readFetchSources()
+	for sha, _ := range ConvertFileLOBSliceToMap(fileLobsNeeded) {
+		if util.IsCancelled() {
+			return nil, util.ErrCancelled
+		}
+		if fetchSources[sha] == remote.Name {
+			continue
+		}
+		if r.CheckRemoteLOBFilesForSHA(sha, remote.Provider, remote.Name) != nil {
+			missing = append(missing, sha)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%d binaries needed at the fetched commits aren't on %v, e.g. %v", len(missing), remote.Name, missing[0])
+	}
+	commits := r.getCommitsSafeToMarkPushedAfterFetch(remote, fetchranges)
+	if !dryRun {
+		err = r.markPushedAfterFetch(remote.Name, commits)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return commits, nil
+}
+
+// Get the LOBs needed for recent commits on HEAD & recent refs, for a fetch without refs (see
+// git-lob.fetch-refs, git-lob.fetch-commits-head & git-lob.fetch-commits-other), along with
+// the ranges of commits they're from
+func (r *Repo) getRecentFileLOBs(remotes []*FetchRemote, callback util.ProgressCallback) ([]*FileLOB, []*GitRefSpec, error) {
+	if r.Options.Verbose {
+		callback(&util.ProgressCallbackData{util.ProgressCalculate, "Calculating recent commits...",
+			int64(0), int64(1), 0, 0, nil})
+	}
+	// Get HEAD LOBs first
+	headfilelobs, earliestCommit, err := r.GetGitAllFileLOBsToCheckoutAtCommitAndRecent("HEAD", r.Options.FetchCommitsPeriodHEAD,
+		r.Options.FetchIncludePaths, r.Options.FetchExcludePaths)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Error determining recent HEAD commits: %v", err.Error()))
+	}
+	if r.Options.Verbose {
+		callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * HEAD: %d binary references", len(headfilelobs)),
+			0, 0, 0, 0, nil})
+	}
+	fileLobsNeeded := headfilelobs
+	headSHA, err := r.GitRefToFullSHA("HEAD")
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Error determining HEAD sha: %v", err.Error()))
+	}
+	fetchranges := []*GitRefSpec{&GitRefSpec{fmt.Sprintf("^%v", earliestCommit), "..", headSHA}}
+	if r.Options.FetchRefsPeriodDays > 0 {
+		// Find recent other refs (only include remote branches for the remotes we're fetching from)
+		var recentrefs []*GitRef
+		for _, remote := range remotes {
+			refs, err := r.GetGitRecentRefs(r.Options.FetchRefsPeriodDays, true, remote.Name)
 			if err != nil {
-				util.LogErrorf("Error marking %v as pushed after fetch for %v: %v", c, remoteName, err.Error())
+				return nil, nil, errors.New(fmt.Sprintf("Error determining recent refs: %v", err.Error()))
 			}
+			recentrefs = append(recentrefs, refs...)
 		}
-		// resolve any redundant state that creates
-		CleanupPushState(remoteName)
+		// Now each other ref, they should be in reverse date order from GetGitRecentRefs so we're doing
+		// things by priority, HEAD first then most recent
+		refSHAsDone := util.NewStringSet()
+		refSHAsDone.Add(headSHA)
+		for i, ref := range recentrefs {
+			// Don't duplicate work when >1 ref has the same SHA
+			// Most common with HEAD if not detached but also tags
+			if refSHAsDone.Contains(ref.CommitSHA) {
+				continue
+			}
+			refSHAsDone.Add(ref.CommitSHA)
+
+			recentreflobs, earliestCommit, err := r.GetGitAllFileLOBsToCheckoutAtCommitAndRecent(ref.Name, r.Options.FetchCommitsPeriodOther,
+				r.Options.FetchIncludePaths, r.Options.FetchExcludePaths)
+			if err != nil {
+				return nil, nil, errors.New(fmt.Sprintf("Error determining recent commits on %v: %v", ref, err.Error()))
+			}
+			if r.Options.Verbose {
+				callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * %v: %d binary references", ref, len(recentreflobs)),
+					int64(i), int64(len(recentrefs)), 0, 0, nil})
+			}
+			fileLobsNeeded = append(fileLobsNeeded, recentreflobs...)
+
+			fetchranges = append(fetchranges, &GitRefSpec{fmt.Sprintf("^%v", earliestCommit), "..", ref.CommitSHA})
+		}
+
 	}
+	return fileLobsNeeded, fetchranges, nil
+}
 
-	return nil
+// Whether fetch is limited to a window of commits (--since, --until & --max-commits)
+func (r *Repo) isFetchWindowSet() bool {
+	opts := r.Options
+	return !opts.FetchSince.IsZero() || !opts.FetchUntil.IsZero() || opts.FetchMaxCommits > 0
+}
+
+// Get the files & binaries needed to check out any commit in the fetch window, on the refs given or if
+// none, HEAD & every branch / tag with commits in the window. Also returns the range of commits
+// covered on each ref
+func (r *Repo) getFetchWindowFileLOBs(remotes []*FetchRemote, refspecs []*GitRefSpec,
+	callback util.ProgressCallback) ([]*FileLOB, []*GitRefSpec, error) {
+	opts := r.Options
+	var refs []string
+	if len(refspecs) > 0 {
+		for _, refspec := range refspecs {
+			if refspec.IsRange() {
+				return nil, nil, fmt.Errorf("Ranges like %v can't be combined with --since, --until or --max-commits", refspec)
+			}
+			refs = append(refs, refspec.Ref1)
+		}
+	} else {
+		refs = append(refs, "HEAD")
+		// No point looking at refs whose latest commit is before the window
+		numdays := -1
+		if !opts.FetchSince.IsZero() {
+			numdays = int(time.Since(opts.FetchSince).Hours()/24) + 1
+		}
+		for _, remote := range remotes {
+			recentrefs, err := r.GetGitRecentRefs(numdays, true, remote.Name)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Error determining recent refs: %v", err.Error())
+			}
+			for _, ref := range recentrefs {
+				refs = append(refs, ref.Name)
+			}
+		}
+	}
 
+	var filelobs []*FileLOB
+	var fetchranges []*GitRefSpec
+	latestSHAsDone := util.NewStringSet()
+	for i, ref := range refs {
+		commits, err := r.GetGitFirstParentCommitsInWindow(ref, opts.FetchSince, opts.FetchUntil, opts.FetchMaxCommits)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error determining commits on %v: %v", ref, err.Error())
+		}
+		// Refs with the same latest commit in the window have the same commits in it
+		if len(commits) == 0 || !latestSHAsDone.Add(commits[0]) {
+			continue
+		}
+		// Both ends inclusive
+		window := &GitRefSpec{commits[len(commits)-1], "..", commits[0]}
+		reflobs, err := r.GetGitAllFilesAndLOBsToCheckoutInRefSpec(window, opts.FetchIncludePaths, opts.FetchExcludePaths)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error determining binaries to fetch for %v: %v", ref, err.Error())
+		}
+		if opts.Verbose {
+			callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * %v: %d commits, %d binary references", ref, len(commits), len(reflobs)),
+				int64(i), int64(len(refs)), 0, 0, nil})
+		}
+		filelobs = append(filelobs, reflobs...)
+		fetchranges = append(fetchranges, window)
+	}
+	return filelobs, fetchranges, nil
+}
+
+// Fetch LOBs from each remote in turn, asking each only for those which the ones before didn't
+// provide. Binaries not found on one remote are only reported as not found if no remote has
+// them, and a remote which fails is only an error if it's the last
+// Returns the remote which provided each LOB & whether any weren't found anywhere
+func (r *Repo) fetchLOBsFromRemotes(lobshas map[string]string, remotes []*FetchRemote, force bool,
+	callback util.ProgressCallback) (sources map[string]string, anyNotFound bool, _err error) {
+
+	sources = make(map[string]string)
+	remaining := lobshas
+	for i, remote := range remotes {
+		last := i == len(remotes)-1
+		notFound := false
+		fetchCallback := func(data *util.ProgressCallbackData) (abort bool) {
+			if data.Type == util.ProgressNotFound {
+				notFound = true
+				if !last {
+					// Next remote may have it
+					return false
+				}
+			}
+			// passthrough to external callback
+			return callback(data)
+		}
+		if len(remotes) > 1 {
+			callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Fetching %d binaries from %v", len(remaining), remote.Name),
+				0, 0, 0, 0, nil})
+		}
+
+		var err error
+		if r.Options.FetchMetadataOnly {
+			err = r.fetchMetadataOnly(remaining, remote.Provider, remote.Name, force, fetchCallback)
+		} else {
+			err = r.fetchLOBs(remaining, remote.Provider, remote.Name, force, fetchCallback)
+		}
+
+		// Record what we got even if there was an error, some may have been fetched
+		stillNeeded := make(map[string]string)
+		for sha, filename := range remaining {
+			if r.isLOBFetched(sha) {
+				sources[sha] = remote.Name
+			} else {
+				stillNeeded[sha] = filename
+			}
+		}
+		if recorderr := r.recordFetchSources(sources); recorderr != nil {
+			r.Log.Errorf("Unable to record where binaries were fetched from: %v\n", recorderr.Error())
+		}
+		remaining = stillNeeded
+		anyNotFound = notFound
+
+		if err != nil {
+			if last || util.IsCancelled() {
+				return sources, anyNotFound, err
+			}
+			r.Log.Errorf("Fetch from %v failed, trying %v: %v\n", remote.Name, remotes[i+1].Name, err.Error())
+			callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Unable to fetch from %v, trying %v", remote.Name, remotes[i+1].Name),
+				0, 0, 0, 0, nil})
+		}
+		if len(remaining) == 0 {
+			break
+		}
+	}
+	return sources, anyNotFound, nil
+}
+
+// Has a LOB been fetched, as far as fetch is concerned (only metadata if FetchMetadataOnly)
+func (r *Repo) isLOBFetched(sha string) bool {
+	if r.Options.FetchMetadataOnly {
+		_, err := r.GetLOBInfo(sha)
+		return err == nil
+	}
+	return !r.IsLOBMissing(sha, false)
 }
 
 // Internal method for fetching
-func fetchLOBs(lobshas map[string]string, provider providers.SyncProvider, remoteName string, force bool, callback util.ProgressCallback) error {
+func (r *Repo) fetchLOBs(lobshas map[string]string, provider providers.SyncProvider, remoteName string, force bool, callback util.ProgressCallback) error {
+	callback, recordUsage := r.trackTransferUsage(remoteName, false, callback)
+	defer recordUsage()
+	err := r.fetchLOBsWithRetries(lobshas, provider, remoteName, force, FetchCorruptRetries, callback)
+	// Previews are only a convenience, so they go last
+	r.fetchLOBPreviewsIfEnabled(lobshas, provider, remoteName, force, callback)
+	return err
+}
+
+// Fetch LOBs, downloading those whose content doesn't match their SHA again up to retries times
+func (r *Repo) fetchLOBsWithRetries(lobshas map[string]string, provider providers.SyncProvider, remoteName string, force bool,
+	retries int, callback util.ProgressCallback) error {
 	// Download metafiles first
 	// This will allow us to estimate the time required
 	callback(&util.ProgressCallbackData{util.ProgressCalculate, "Downloading metadata",
-		0, 0, 0, 0})
-	err := fetchMetadata(lobshas, provider, remoteName, force, callback)
+		0, 0, 0, 0, nil})
+	err := r.fetchMetadata(lobshas, provider, remoteName, force, callback)
 	if err != nil {
 		return err
 	}
@@ -234,12 +548,19 @@ func fetchLOBs(lobshas map[string]string, provider providers.SyncProvider, remot
 	var deltas []*LOBDelta
 	var deltaTotalBytes int64
 	var deltaSavings int64
+	var skippedTooLarge int
+	// Binaries not downloaded because of git-lob.verify-signatures
+	var unverified []string
+	// Binaries whose chunks are downloaded, to verify before they go in the store
+	var contentshas []string
+	destDir := r.getFetchDestination()
 	smartProvider := providers.UpgradeToSmartSyncProvider(provider)
 
 	callback(&util.ProgressCallbackData{util.ProgressCalculate, "Calculating content files to download",
-		0, 0, 0, 0})
-	for sha, filename := range lobshas {
-		info, err := GetLOBInfo(sha)
+		0, 0, 0, 0, nil})
+	for _, sha := range orderLOBsForFetch(lobshas, r.Options.FetchPriorityPaths) {
+		filename := lobshas[sha]
+		info, err := r.GetLOBInfo(sha)
 		if err != nil {
 			// If we could not get the lob data, it means that we could not download the meta file
 			// it's OK for this to happen since the remote may not have all the data we need (e.g.
@@ -248,67 +569,145 @@ func fetchLOBs(lobshas map[string]string, provider providers.SyncProvider, remot
 			// We notified earlier
 			continue
 		}
+		if err := r.checkLOBSignature(info); err != nil {
+			// Don't download content nobody trusted vouches for
+			unverified = append(unverified, err.Error())
+			callback(&util.ProgressCallbackData{util.ProgressError, err.Error(), 0, 0, 0, 0, nil})
+			continue
+		}
+		if r.Options.FetchMaxSize > 0 && info.Size > r.Options.FetchMaxSize {
+			r.Log.Debugf("Not fetching %v (%v), larger than size limit\n", filename, util.FormatSize(info.Size))
+			skippedTooLarge++
+			continue
+		}
 		// If this is a smart provider, try to download deltas where appropriate
-		if info.Size > util.GlobalOptions.FetchDeltasAboveSize && smartProvider != nil {
+		if smartProvider != nil && r.shouldTryDelta(filename, info.Size, getLOBStoredSize(info), r.Options.FetchDeltasAboveSize) {
 			// This doesn't download, just prepares and gets size
-			delta := prepareFetchDelta(sha, filename, smartProvider, remoteName)
+			delta := r.prepareFetchDelta(sha, filename, smartProvider, remoteName)
 			if delta != nil {
 				deltas = append(deltas, delta)
 				deltaTotalBytes += delta.DeltaSize
-				deltaSavings += info.Size - (delta.DeltaSize + ApproximateMetadataSize)
+				deltaSavings += getLOBStoredSize(info) - (delta.DeltaSize + ApproximateMetadataSize)
+				r.recordDeltaSavings(filename, getLOBStoredSize(info), delta.DeltaSize)
 				// We'll do a delta for this so don't continue to determine files
 				continue
 			}
 		}
 		// fallback to basic file download
-		filesTotalBytes += info.Size
-		for i := 0; i < info.NumChunks; i++ {
-			// get relative filename for download purposes
-			files = append(files, GetLOBChunkRelativePath(sha, i))
-		}
+		// Chunks are downloaded as stored on the remote, which may be compressed
+		contentshas = append(contentshas, sha)
+		filesTotalBytes += addLOBChunksToDownload(info, destDir, force, &files)
+	}
+	if skippedTooLarge > 0 {
+		callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Skipping %d binaries larger than %v",
+			skippedTooLarge, util.FormatSize(r.Options.FetchMaxSize)), 0, 0, 0, 0, nil})
 	}
 	totalBytes := filesTotalBytes + deltaTotalBytes
 	callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Metadata done, downloading content (%v)", util.FormatSize(totalBytes)),
-		0, 0, 0, 0})
+		0, 0, 0, 0, nil})
+	contentlobs := make(map[string]string, len(contentshas))
+	for _, sha := range contentshas {
+		contentlobs[sha] = lobshas[sha]
+	}
+	if cold := r.countLOBsInColdStorage(contentlobs, provider, remoteName); cold > 0 {
+		callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Warning: %d binaries are in cold storage on %v, downloading them may be slower & cost more",
+			cold, remoteName), 0, 0, 0, 0, nil})
+	}
 	if deltaSavings > 0 {
 		callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Saving %v by fetching deltas", util.FormatSize(deltaSavings)),
-			0, 0, 0, 0})
+			0, 0, 0, 0, nil})
 	}
 
 	// Download content now
 	if smartProvider != nil && len(deltas) > 0 {
 		// First try deltas, if any fail fall back on regular download
-		failedDeltas := fetchDeltas(deltas, deltaTotalBytes, smartProvider, remoteName, force, callback)
+		failedDeltas := r.fetchDeltas(deltas, deltaTotalBytes, smartProvider, remoteName, force, callback)
+		if util.IsCancelled() {
+			// Deltas which didn't make it failed because of that, don't download them in full
+			failedDeltas = nil
+		}
 		if len(failedDeltas) > 0 {
 			for _, delta := range failedDeltas {
 				// Slightly costly but this should be rare for prepare to work and download not to
-				info, err := GetLOBInfo(delta.TargetSHA)
+				info, err := r.GetLOBInfo(delta.TargetSHA)
 				if err != nil {
 					return fmt.Errorf("LOB info for %v went missing, this should be impossible: %v", delta.TargetSHA, err.Error())
 				}
-				filesTotalBytes += info.Size
-				for i := 0; i < info.NumChunks; i++ {
-					// get relative filename for download purposes
-					files = append(files, GetLOBChunkRelativePath(info.SHA, i))
-				}
+				contentshas = append(contentshas, delta.TargetSHA)
+				filesTotalBytes += addLOBChunksToDownload(info, destDir, true, &files)
 			}
 		}
 	}
-	return fetchContentFiles(files, filesTotalBytes, provider, remoteName, force, callback)
+	corrupt, err := r.fetchContentFiles(files, contentshas, filesTotalBytes, provider, remoteName, force, callback)
+	if err == nil && util.IsCancelled() {
+		// What was downloaded completely has been stored, the rest is fetched next time
+		err = util.ErrCancelled
+	}
+	if len(unverified) > 0 {
+		if err != nil {
+			unverified = append([]string{err.Error()}, unverified...)
+		}
+		err = errors.New(strings.Join(unverified, "\n"))
+	}
+	if len(corrupt) == 0 {
+		return err
+	}
+	var errorList []string
+	if err != nil {
+		errorList = append(errorList, err.Error())
+	}
+	retry := make(map[string]string)
+	for _, sha := range corrupt {
+		retry[sha] = lobshas[sha]
+		if retries > 0 {
+			callback(&util.ProgressCallbackData{util.ProgressError, fmt.Sprintf("Content downloaded for %v did not match its SHA, downloading again", sha[:7]),
+				0, 0, 0, 0, nil})
+		}
+	}
+	if retries > 0 && !util.IsCancelled() {
+		// Force, so metadata is downloaded again too
+		err = r.fetchLOBsWithRetries(retry, provider, remoteName, true, retries-1, callback)
+		if err != nil {
+			errorList = append(errorList, err.Error())
+		}
+	} else {
+		errorList = append(errorList, fmt.Sprintf("Content downloaded for %d binaries did not match their SHA, moved to %v: %v",
+			len(corrupt), r.GetQuarantineRoot(), strings.Join(corrupt, ", ")))
+	}
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+	return nil
+}
 
+// Add the chunks of a LOB which need downloading to files, returning their size
+// Unless force, chunks already in destDir (e.g. chunk objects shared with other LOBs) are skipped
+func addLOBChunksToDownload(info *LOBInfo, destDir string, force bool, files *[]string) int64 {
+	var sz int64
+	for i := 0; i < info.NumChunks; i++ {
+		// get relative filename for download purposes
+		relchunk := getLOBChunkRelativePathForInfo(info, i)
+		expectedSize := getLOBExpectedChunkSize(info, i)
+		if !force && util.FileExistsAndIsOfSize(getLOBStoreFilePath(destDir, relchunk), expectedSize) {
+			continue
+		}
+		*files = append(*files, relchunk)
+		sz += expectedSize
+	}
+	return sz
 }
 
-func prepareFetchDelta(lobsha, filename string, provider providers.SmartSyncProvider, remoteName string) *LOBDelta {
-	othershas, err := GetGitAllLOBHistoryForFile(filename, lobsha)
+func (r *Repo) prepareFetchDelta(lobsha, filename string, provider providers.SmartSyncProvider, remoteName string) *LOBDelta {
+	othershas, err := r.GetGitAllLOBHistoryForFile(filename, lobsha)
 	if err != nil {
-		util.LogErrorf("Unable to prepare delta for %v(%v): %v\n", lobsha, filename, err.Error())
+		r.Log.Errorf("Unable to prepare delta for %v(%v): %v\n", lobsha, filename, err.Error())
 		return nil
 	}
 	// This is all the possible base shas, but we can only use ones we have locally too
 	// Right now we're not trying to cope with ordered downloads where we might have newer ones part way through fetch (too fiddly)
 	var localbaseshas []string
 	for _, sha := range othershas {
-		if !IsLOBMissing(sha, false) {
+		if !r.IsLOBMissing(sha, false) {
 			localbaseshas = append(localbaseshas, sha)
 		}
 	}
@@ -316,10 +715,15 @@ func prepareFetchDelta(lobsha, filename string, provider providers.SmartSyncProv
 		// no base shas, cannot do this
 		return nil
 	}
+	algorithm, err := getDeltaAlgorithmForRemote(provider, remoteName)
+	if err != nil {
+		r.Log.Errorf("Unable to prepare delta for %v(%v): %v\n", lobsha, filename, err.Error())
+		return nil
+	}
 	// Now ask the server to pick a sha, generate a delta, cache it and tell us how big it is
 	sz, chosenbasesha, err := provider.PrepareDeltaForDownload(remoteName, lobsha, localbaseshas)
 	if err != nil {
-		util.LogErrorf("Unable to prepare delta %v(%v): %v\n", lobsha, filename, err.Error())
+		r.Log.Errorf("Unable to prepare delta %v(%v): %v\n", lobsha, filename, err.Error())
 		return nil
 	}
 	// No common base to use
@@ -330,106 +734,370 @@ func prepareFetchDelta(lobsha, filename string, provider providers.SmartSyncProv
 		BaseSHA:   chosenbasesha,
 		TargetSHA: lobsha,
 		DeltaSize: sz,
+		Algorithm: algorithm,
+	}
+}
+
+// Internal method for fetching only metadata, leaving content to be fetched from the
+// same remote when it's first checked out
+func (r *Repo) fetchMetadataOnly(lobshas map[string]string, provider providers.SyncProvider, remoteName string, force bool, callback util.ProgressCallback) error {
+	callback, recordUsage := r.trackTransferUsage(remoteName, false, callback)
+	defer recordUsage()
+	callback(&util.ProgressCallbackData{util.ProgressCalculate, "Downloading metadata only",
+		0, 0, 0, 0, nil})
+	err := r.fetchMetadata(lobshas, provider, remoteName, force, callback)
+	// Record the remote even on partial failure, some metadata may have been downloaded
+	if stateerr := r.setLazyFetchRemote(remoteName); stateerr != nil {
+		r.Log.Errorf("Unable to record %v for fetching content on checkout: %v\n", remoteName, stateerr.Error())
+	}
+	if err != nil {
+		return err
+	}
+	r.fetchLOBPreviewsIfEnabled(lobshas, provider, remoteName, force, callback)
+	callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Metadata done, content will be fetched from %v on checkout", remoteName),
+		0, 0, 0, 0, nil})
+	return nil
+}
+
+// Get the file which records the remote to fetch content from on checkout, after 'fetch --metadata-only'
+func (r *Repo) getLazyFetchStateFile() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "lazy_fetch_remote")
+}
+
+// Record the remote to fetch content from on checkout, after 'fetch --metadata-only'
+func (r *Repo) setLazyFetchRemote(remoteName string) error {
+	file := r.getLazyFetchStateFile()
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(remoteName+"\n"), 0644)
+}
+
+// Stop fetching content on checkout once a fetch has downloaded content as usual, rather than
+// leaving it on for good after a single 'fetch --metadata-only'
+func (r *Repo) endLazyFetchAfterFullFetch() {
+	if r.Options.FetchMetadataOnly {
+		return
+	}
+	err := os.Remove(r.getLazyFetchStateFile())
+	if err != nil && !os.IsNotExist(err) {
+		r.Log.Errorf("Unable to stop fetching content on checkout: %v\n", err.Error())
+	}
+}
+
+// Get the remote to fetch content from on checkout because 'fetch --metadata-only' was
+// used, or "" if it hasn't been
+func (r *Repo) GetLazyFetchRemote() string {
+	data, err := ioutil.ReadFile(r.getLazyFetchStateFile())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Get the file which records which remote each binary was fetched from
+func (r *Repo) getFetchSourcesStateFile() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "fetch_sources")
+}
+
+// Read which remote each binary was fetched from, by LOB SHA
+// One line per fetch: <sha> <remote>, later lines replacing earlier ones for the same binary
+func (r *Repo) readFetchSources() map[string]string {
+	ret := make(map[string]string)
+	data, err := ioutil.ReadFile(r.getFetchSourcesStateFile())
+	if err != nil {
+		return ret
+	}
+	var lines int
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && IsLOBSHA(fields[0]) {
+			ret[fields[0]] = fields[1]
+			lines++
+		}
+	}
+	// Fetches are appended, so compact once most lines have been replaced
+	if lines > fetchSourcesCompactMinLines && lines > 2*len(ret) {
+		if err := r.compactFetchSources(ret); err != nil {
+			r.Log.Debugf("Unable to compact %v: %v\n", r.getFetchSourcesStateFile(), err.Error())
+		}
 	}
+	return ret
+}
+
+// Don't compact the fetch sources file until it has at least this many lines
+const fetchSourcesCompactMinLines = 1000
+
+// Record which remote binaries were fetched from, appending to what was recorded before
+func (r *Repo) recordFetchSources(sources map[string]string) error {
+	if len(sources) == 0 {
+		return nil
+	}
+	shas := make([]string, 0, len(sources))
+	for sha := range sources {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+	var buf bytes.Buffer
+	for _, sha := range shas {
+		fmt.Fprintf(&buf, "%v %v\n", sha, sources[sha])
+	}
+	file := r.getFetchSourcesStateFile()
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// In one write so concurrent fetches don't interleave lines
+	_, err = f.Write(buf.Bytes())
+	closeerr := f.Close()
+	if err == nil {
+		err = closeerr
+	}
+	return err
+}
+
+// Rewrite the fetch sources file with one line per binary, forgetting any binaries which have
+// since been deleted
+func (r *Repo) compactFetchSources(all map[string]string) error {
+	shas := make([]string, 0, len(all))
+	for sha := range all {
+		if util.FileExists(r.GetLocalLOBMetaPath(sha)) {
+			shas = append(shas, sha)
+		}
+	}
+	sort.Strings(shas)
+	var buf bytes.Buffer
+	for _, sha := range shas {
+		fmt.Fprintf(&buf, "%v %v\n", sha, all[sha])
+	}
+	file := r.getFetchSourcesStateFile()
+	tmpfile := file + ".tmp"
+	err := ioutil.WriteFile(tmpfile, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, file)
+}
+
+// Get the remote a binary was fetched from, or "" if it's not known (e.g. it was stored locally)
+func (r *Repo) GetFetchSource(sha string) string {
+	return r.readFetchSources()[sha]
+}
+
+// Is the content of a LOB left to be fetched on checkout, because only its metadata was fetched?
+func (r *Repo) isLOBContentOnDemand(sha string) bool {
+	if r.GetLazyFetchRemote() == "" {
+		return false
+	}
+	_, err := r.GetLOBInfo(sha)
+	return err == nil
 }
 
 // Internal method for fetching
-func fetchMetadata(lobshas map[string]string, provider providers.SyncProvider, remoteName string, force bool, callback util.ProgressCallback) error {
+func (r *Repo) fetchMetadata(lobshas map[string]string, provider providers.SyncProvider, remoteName string, force bool, callback util.ProgressCallback) error {
 	// Use average metafile bytes as estimate of download, usually < 100 bytes of JSON
 	metaTotalBytes := int64(len(lobshas) * ApproximateMetadataSize)
 	var metafilesDone int
 	metacallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
 		// Don't bother to track partial completion, only 100 bytes each
-		if progressType == util.ProgressSkip || progressType == util.ProgressNotFound {
+		if progressType == util.ProgressRetry {
+			return callback(&util.ProgressCallbackData{progressType, fileInProgress, 0, 0,
+				int64(metafilesDone * ApproximateMetadataSize), metaTotalBytes,
+				retryDetail(bytesDone, totalBytes)})
+		} else if progressType == util.ProgressSkip || progressType == util.ProgressNotFound {
 			metafilesDone++
 			callback(&util.ProgressCallbackData{progressType, fileInProgress, totalBytes, totalBytes,
-				int64(metafilesDone * ApproximateMetadataSize), metaTotalBytes})
+				int64(metafilesDone * ApproximateMetadataSize), metaTotalBytes, nil})
 			// Remote did not have this file
 		} else {
 			if bytesDone == totalBytes {
 				// finished
 				metafilesDone++
 				callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, totalBytes, totalBytes,
-					int64(metafilesDone * ApproximateMetadataSize), metaTotalBytes})
+					int64(metafilesDone * ApproximateMetadataSize), metaTotalBytes, nil})
+			}
+		}
+		return util.IsCancelled()
+	}
+	// Download to shared if using shared area (we link later)
+	destDir := r.getFetchDestination()
+	// Metadata of incomplete LOBs is normally only downloaded if it's a different size, but
+	// metadata for compressed LOBs can be the same size yet describe chunks compressed
+	// differently to the remote's (e.g. zstd vs gzip). Ours is only replaced once the remote's
+	// has been downloaded, see refetchCompressedMetadata
+	var refetch []string
+	if !force {
+		for sha, _ := range lobshas {
+			info, err := r.getLOBInfoInBaseDir(sha, destDir)
+			if err == nil && info.Compression != CompressionNone {
+				refetch = append(refetch, sha)
 			}
 		}
-		return false
 	}
+	refetchSet := util.NewStringSetFromSlice(refetch)
 	// Download all meta files
 	var metafilesToDownload []string
 	for sha, _ := range lobshas {
-		// Note get relative file name
-		metafilesToDownload = append(metafilesToDownload, GetLOBMetaRelativePath(sha))
+		if !refetchSet.Contains(sha) {
+			// Note get relative file name
+			metafilesToDownload = append(metafilesToDownload, GetLOBMetaRelativePath(sha))
+		}
 	}
-	// Download to shared if using shared area (we link later)
-	destDir := getFetchDestination()
-	err := provider.Download(remoteName, metafilesToDownload, destDir, force, metacallback)
+	err := downloadMetadataFiles(provider, remoteName, metafilesToDownload, destDir, force, metacallback)
 
 	// If shared store, link any metadata we downloaded into local
-	if IsUsingSharedStorage() {
-		for _, sha := range lobshas {
+	if r.IsUsingSharedStorage() {
+		for sha, _ := range lobshas {
 			// filenames are relative (for download)
-			localfile := GetLocalLOBMetaPath(sha)
-			sharedfile := getSharedLOBMetaPath(sha)
-			if (force || !util.FileExists(localfile)) && util.FileExists(sharedfile) {
-				linkerr := linkSharedLOBFilename(sharedfile)
+			localfile := r.GetLocalLOBMetaPath(sha)
+			sharedfile := r.getSharedLOBMetaPath(sha)
+			if force || !util.FileExists(localfile) {
+				_, linkerr := r.linkSharedLOBFilenameIfPresent(sharedfile, -1)
 				if linkerr != nil {
 					// we want to continue so don't return this
-					util.LogErrorf("Failed to link shared file %v into local repo: %v\n", sharedfile, linkerr.Error())
+					r.Log.Errorf("Failed to link shared file %v into local repo: %v\n", sharedfile, linkerr.Error())
 				}
 			}
 		}
 	}
+	if len(refetch) > 0 && !util.IsCancelled() {
+		refetcherr := r.refetchCompressedMetadata(refetch, provider, remoteName, destDir, metacallback)
+		if err == nil {
+			err = refetcherr
+		}
+	}
 	// Deal with errors afterwards so we linked partial successes
 	if err != nil {
 		return err
 	}
+	if util.IsCancelled() {
+		return util.ErrCancelled
+	}
 
 	return nil
 }
 
-func getFetchDestination() string {
+// Download metadata files, in batches if the provider supports it
+func downloadMetadataFiles(provider providers.SyncProvider, remoteName string, files []string, destDir string,
+	force bool, callback providers.SyncProgressCallback) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if batchProvider := providers.UpgradeToBatchMetadataSyncProvider(provider); batchProvider != nil {
+		// Many fewer round trips when there are lots of small binaries
+		return batchProvider.DownloadMetadataBatch(remoteName, files, destDir, force, callback)
+	}
+	return provider.Download(remoteName, files, destDir, force, callback)
+}
+
+// Download the remote's metadata for LOBs which we have compressed metadata for to the staging
+// area, & replace ours with each one which is readable; if the download fails or is interrupted
+// the metadata we had is kept
+func (r *Repo) refetchCompressedMetadata(shas []string, provider providers.SyncProvider, remoteName, destDir string,
+	callback providers.SyncProgressCallback) error {
+	stagingRoot := r.getFetchStagingRoot()
+	err := os.MkdirAll(stagingRoot, 0755)
+	if err != nil {
+		return err
+	}
+	tmpdir, err := ioutil.TempDir(stagingRoot, "meta")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	var files []string
+	for _, sha := range shas {
+		files = append(files, GetLOBMetaRelativePath(sha))
+	}
+	err = downloadMetadataFiles(provider, remoteName, files, tmpdir, true, callback)
+	// Replace whatever was downloaded even if there was an error
+	for _, sha := range shas {
+		if _, infoerr := r.getLOBInfoInBaseDir(sha, tmpdir); infoerr != nil {
+			// Not downloaded, or not usable
+			continue
+		}
+		if replaceerr := r.replaceFetchedMetadata(sha, r.GetLOBMetaPathInBaseDir(tmpdir, sha), destDir); replaceerr != nil {
+			r.Log.Errorf("Unable to replace metadata for %v: %v\n", sha, replaceerr.Error())
+		}
+	}
+	return err
+}
+
+// Move downloaded metadata into the store over what was there, re-linking it from the shared store
+func (r *Repo) replaceFetchedMetadata(sha, downloaded, destDir string) error {
+	dest := r.GetLOBMetaPathInBaseDir(destDir, sha)
+	if !r.IsUsingSharedStorage() {
+		return os.Rename(downloaded, dest)
+	}
+	l, err := r.lockSharedStoreSHA(sha)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	if err = os.Rename(downloaded, dest); err != nil {
+		return err
+	}
+	return r.linkSharedLOBFilename(dest)
+}
+
+func (r *Repo) getFetchDestination() string {
 	// Download to shared if using shared area (we link later)
-	if IsUsingSharedStorage() {
-		return GetSharedLOBRoot()
+	if r.IsUsingSharedStorage() {
+		return r.GetSharedLOBRoot()
 	} else {
-		return GetLocalLOBRoot()
+		return r.GetLocalLOBRoot()
 	}
 }
 
-func fetchContentFiles(files []string, filesTotalBytes int64, provider providers.SyncProvider,
-	remoteName string, force bool, callback util.ProgressCallback) error {
+// Download content files for LOBs to the staging area, then move those of LOBs whose content
+// matches their SHA into the store (see storeFetchedLOBs). Returns the SHAs of LOBs which didn't
+func (r *Repo) fetchContentFiles(files []string, shas []string, filesTotalBytes int64, provider providers.SyncProvider,
+	remoteName string, force bool, callback util.ProgressCallback) (corrupt []string, _err error) {
 	var lastFilename string
 	var lastFileBytes int64
 	var bytesFromFilesDoneSoFar int64
 	contentcallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
 
 		var ret bool
+		if progressType == util.ProgressRetry {
+			// File is being downloaded again from the start, so partial progress doesn't count
+			if lastFilename == fileInProgress {
+				lastFilename = ""
+			}
+			return callback(&util.ProgressCallbackData{progressType, fileInProgress, 0, 0,
+				bytesFromFilesDoneSoFar, filesTotalBytes,
+				retryDetail(bytesDone, totalBytes)})
+		}
 		if lastFilename != fileInProgress && lastFilename != "" {
 			// we obviously never got a 100% call for previous file
 			bytesFromFilesDoneSoFar += lastFileBytes
 			ret = callback(&util.ProgressCallbackData{util.ProgressTransferBytes, lastFilename, lastFileBytes, lastFileBytes,
-				bytesFromFilesDoneSoFar, filesTotalBytes})
+				bytesFromFilesDoneSoFar, filesTotalBytes, nil})
 			lastFilename = ""
 		}
 		if progressType == util.ProgressSkip || progressType == util.ProgressNotFound {
 			bytesFromFilesDoneSoFar += totalBytes
 			ret = callback(&util.ProgressCallbackData{progressType, fileInProgress, totalBytes, totalBytes,
-				bytesFromFilesDoneSoFar, filesTotalBytes})
+				bytesFromFilesDoneSoFar, filesTotalBytes, nil})
 		} else {
 
 			if bytesDone == totalBytes {
 				// finished
 				bytesFromFilesDoneSoFar += totalBytes
 				ret = callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, bytesDone, totalBytes,
-					bytesFromFilesDoneSoFar, filesTotalBytes})
+					bytesFromFilesDoneSoFar, filesTotalBytes, nil})
 				lastFilename = ""
 			} else {
 				// partly progressed file
 				lastFilename = fileInProgress
 				lastFileBytes = totalBytes
 				ret = callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, bytesDone, totalBytes,
-					bytesFromFilesDoneSoFar + bytesDone, filesTotalBytes})
+					bytesFromFilesDoneSoFar + bytesDone, filesTotalBytes, nil})
 
 			}
 
@@ -437,52 +1105,68 @@ func fetchContentFiles(files []string, filesTotalBytes int64, provider providers
 
 		return ret
 	}
-	destDir := getFetchDestination()
-	err := provider.Download(remoteName, files, destDir, force, contentcallback)
+	destDir := r.getFetchDestination()
+	stagingDir := r.getFetchStagingRoot()
+	err := provider.Download(remoteName, files, stagingDir, force, contentcallback)
 	if err == nil && lastFilename != "" {
 		// we obviously never got a 100% progress call for final file
 		callback(&util.ProgressCallbackData{util.ProgressTransferBytes, lastFilename, lastFileBytes, lastFileBytes,
-			filesTotalBytes, filesTotalBytes})
+			filesTotalBytes, filesTotalBytes, nil})
 		lastFilename = ""
 	}
+	// Verify even if there was an error, some may have been downloaded
+	if len(shas) > 0 {
+		callback(&util.ProgressCallbackData{util.ProgressCalculate, "Verifying downloaded content", 0, 0, filesTotalBytes, filesTotalBytes, nil})
+		corrupt = r.storeFetchedLOBs(shas, stagingDir, destDir)
+	}
 	// Also if shared store, link meta into local
 	// Link any we successfully downloaded
-	if IsUsingSharedStorage() {
-		localroot := GetLocalLOBRoot()
-		sharedroot := GetSharedLOBRoot()
+	if r.IsUsingSharedStorage() && len(files) > 0 {
+		localroot := r.GetLocalLOBRoot()
+		sharedroot := r.GetSharedLOBRoot()
+		// Progress is reported in files rather than bytes for this phase
+		linkDesc := "Files from shared store"
+		numFiles := int64(len(files))
+		callback(&util.ProgressCallbackData{util.ProgressLinking, linkDesc, 0, numFiles,
+			filesTotalBytes, filesTotalBytes, nil})
 		for _, relfile := range files {
 			// filenames are relative (for download)
-			localfile := filepath.Join(localroot, relfile)
-			sharedfile := filepath.Join(sharedroot, relfile)
-			if (force || !util.FileExists(localfile)) && util.FileExists(sharedfile) {
-				linkerr := linkSharedLOBFilename(sharedfile)
+			localfile := getLOBStoreFilePath(localroot, relfile)
+			sharedfile := getLOBStoreFilePath(sharedroot, relfile)
+			if force || !util.FileExists(localfile) {
+				_, linkerr := r.linkSharedLOBFilenameIfPresent(sharedfile, -1)
 				if linkerr != nil {
 					// we want to continue so don't return this
-					util.LogErrorf("Failed to link shared file %v into local repo: %v\n", sharedfile, linkerr.Error())
+					r.Log.Errorf("Failed to link shared file %v into local repo: %v\n", sharedfile, linkerr.Error())
 				}
 			}
 		}
+		callback(&util.ProgressCallbackData{util.ProgressLinking, linkDesc, numFiles, numFiles,
+			filesTotalBytes, filesTotalBytes, nil})
 	}
 
-	return err
+	return corrupt, err
 }
 
 // Fetch via deltas which have already been picked & prepared on the server. Any that fail for any reason are added
 // to the faileddeltas return list and will be re-tried using the standard download
-func fetchDeltas(deltas []*LOBDelta, deltaTotalBytes int64, provider providers.SmartSyncProvider, remoteName string,
+func (r *Repo) fetchDeltas(deltas []*LOBDelta, deltaTotalBytes int64, provider providers.SmartSyncProvider, remoteName string,
 	force bool, callback util.ProgressCallback) (faileddeltas []*LOBDelta) {
 
 	var failed []*LOBDelta
 	var bytesDoneSoFar int64
 	for _, delta := range deltas {
+		if util.IsCancelled() {
+			break
+		}
 
-		err := fetchSingleDelta(delta, bytesDoneSoFar, deltaTotalBytes, provider, remoteName, force, callback)
+		err := r.fetchSingleDelta(delta, bytesDoneSoFar, deltaTotalBytes, provider, remoteName, force, callback)
 		bytesDoneSoFar += delta.DeltaSize
 		if err != nil {
 			failed = append(failed, delta)
 			msg := fmt.Sprintf("Error applying %v: %v. Falling back to non-delta download", getDeltaProgressDesc(delta), err.Error())
 			callback(&util.ProgressCallbackData{util.ProgressError, msg, delta.DeltaSize, delta.DeltaSize,
-				bytesDoneSoFar, deltaTotalBytes})
+				bytesDoneSoFar, deltaTotalBytes, nil})
 		}
 
 	}
@@ -494,7 +1178,7 @@ func getDeltaProgressDesc(delta *LOBDelta) string {
 	return fmt.Sprintf("Delta %v..%v", delta.BaseSHA[:7], delta.TargetSHA[:7])
 }
 
-func fetchSingleDelta(delta *LOBDelta, bytesSoFar int64, deltaTotalBytes int64, provider providers.SmartSyncProvider, remoteName string,
+func (r *Repo) fetchSingleDelta(delta *LOBDelta, bytesSoFar int64, deltaTotalBytes int64, provider providers.SmartSyncProvider, remoteName string,
 	force bool, callback util.ProgressCallback) error {
 
 	// Description for progress
@@ -502,7 +1186,7 @@ func fetchSingleDelta(delta *LOBDelta, bytesSoFar int64, deltaTotalBytes int64,
 
 	// Initial 0% call
 	callback(&util.ProgressCallbackData{util.ProgressTransferBytes, desc, 0, delta.DeltaSize,
-		bytesSoFar, deltaTotalBytes})
+		bytesSoFar, deltaTotalBytes, nil})
 
 	// We could pipe download output directly into ApplyDelta via a goroutine
 	// But for simplicity of fail states, use a temp file
@@ -519,7 +1203,7 @@ func fetchSingleDelta(delta *LOBDelta, bytesSoFar int64, deltaTotalBytes int64,
 		if bytesDone != totalBytes {
 			// only do part progress in here, do final outside to ensure it always happens regardless
 			ret = callback(&util.ProgressCallbackData{util.ProgressTransferBytes, desc, bytesDone, totalBytes,
-				bytesSoFar + bytesDone, deltaTotalBytes})
+				bytesSoFar + bytesDone, deltaTotalBytes, nil})
 
 		}
 
@@ -538,14 +1222,20 @@ func fetchSingleDelta(delta *LOBDelta, bytesSoFar int64, deltaTotalBytes int64,
 	}
 	defer deltain.Close()
 	// Apply to shared or local
-	err = ApplyLOBDeltaInBaseDir(getFetchDestination(), delta.BaseSHA, delta.TargetSHA, deltain)
+	phasecallback := func(phase util.ProgressCallbackType, bytesDone, totalBytes int64) {
+		callback(&util.ProgressCallbackData{phase, desc, bytesDone, totalBytes,
+			bytesSoFar + delta.DeltaSize, deltaTotalBytes, nil})
+	}
+	err = r.ApplyLOBDeltaInBaseDirWithAlgorithm(r.getFetchDestination(), delta.Algorithm, delta.BaseSHA, delta.TargetSHA, deltain, phasecallback)
 	if err != nil {
 		return err
 	}
 
 	// Also if downloading to shared store, link into local
-	if IsUsingSharedStorage() {
-		ok := recoverLocalLOBFilesFromSharedStore(delta.TargetSHA)
+	if r.IsUsingSharedStorage() {
+		phasecallback(util.ProgressLinking, 0, 1)
+		ok := r.recoverLocalLOBFilesFromSharedStore(delta.TargetSHA)
+		phasecallback(util.ProgressLinking, 1, 1)
 		if !ok {
 			return fmt.Errorf("%v was applied to shared store but linking to local failed", desc)
 		}
@@ -553,35 +1243,90 @@ func fetchSingleDelta(delta *LOBDelta, bytesSoFar int64, deltaTotalBytes int64,
 
 	// yay, call final 100%
 	callback(&util.ProgressCallbackData{util.ProgressTransferBytes, desc, delta.DeltaSize, delta.DeltaSize,
-		bytesSoFar + delta.DeltaSize, deltaTotalBytes})
+		bytesSoFar + delta.DeltaSize, deltaTotalBytes, nil})
 
 	return nil
 
 }
 
 // Fetch the files required for a single LOB
-func FetchSingle(lobsha string, provider providers.SyncProvider, remoteName string, force bool, callback util.ProgressCallback) error {
+func (r *Repo) FetchSingle(lobsha string, provider providers.SyncProvider, remoteName string, force bool, callback util.ProgressCallback) error {
 
-	var lobToDownload map[string]string
-	if force || IsLOBMissing(lobsha, false) {
+	lobToDownload := make(map[string]string)
+	if force || r.IsLOBMissing(lobsha, false) {
 		// We don't know the filename, this is forced
 		lobToDownload[lobsha] = ""
 	}
 
 	if len(lobToDownload) > 0 {
-		return fetchLOBs(lobToDownload, provider, remoteName, force, callback)
+		return r.fetchLOBs(lobToDownload, provider, remoteName, force, callback)
 	} else {
 		return nil
 	}
 }
 
+// Fetch the binary committed for a single file (relpath relative to the repo root, see
+// GetLOBSHAForPathAtRef) from a remote, without fetching anything else
+// Returns whether it's the version the working copy refers to (at HEAD), so can be checked out,
+// & an error if the remote doesn't have it
+func (r *Repo) FetchFile(relpath, lobsha string, provider providers.SyncProvider, remoteName string, force bool,
+	callback util.ProgressCallback) (current bool, _err error) {
+	notFound := false
+	err := r.FetchSingle(lobsha, provider, remoteName, force, func(data *util.ProgressCallbackData) (abort bool) {
+		if data.Type == util.ProgressNotFound {
+			notFound = true
+		}
+		return callback(data)
+	})
+	if err != nil {
+		return false, err
+	}
+	if notFound || r.IsLOBMissing(lobsha, false) {
+		return false, NewNotFoundError(fmt.Sprintf("%v is not available on %v", lobsha, remoteName), relpath)
+	}
+	headsha, err := r.getLOBSHAForPathAtCommit(relpath, "HEAD")
+	return err == nil && headsha == lobsha, nil
+}
+
+// Get the remotes to auto-fetch a LOB's content from, in order of priority
+// Content should come from wherever its metadata came from, then from the remote recorded by
+// 'fetch --metadata-only', then git-lob.fetch-remotes, or just the default remote
+func (r *Repo) getAutoFetchRemotes(lobsha string) []string {
+	var ret []string
+	for _, remoteName := range []string{r.GetFetchSource(lobsha), r.GetLazyFetchRemote()} {
+		if remoteName != "" {
+			ret = append(ret, remoteName)
+		}
+	}
+	ret = append(ret, r.Options.FetchRemotes...)
+	if len(ret) == 0 {
+		ret = append(ret, r.GetGitDefaultRemoteForPull())
+	}
+	util.StringRemoveDuplicates(&ret)
+	return ret
+}
+
 // Auto-fetch a single LOB from the default locations
 // If the required files are not found this won't cause an error
-func AutoFetch(lobsha string, reportProgress bool) error {
-	remoteName := GetGitDefaultRemoteForPull()
-	util.LogDebugf("Trying to auto-fetch %v from %v\n", lobsha, remoteName)
+func (r *Repo) AutoFetch(lobsha string, reportProgress bool) error {
+	var fetcherr error
+	for _, remoteName := range r.getAutoFetchRemotes(lobsha) {
+		fetcherr = r.autoFetchFromRemote(lobsha, remoteName, reportProgress)
+		if fetcherr == nil && !r.IsLOBMissing(lobsha, false) {
+			if err := r.recordFetchSources(map[string]string{lobsha: remoteName}); err != nil {
+				r.Log.Errorf("Unable to record where %v was fetched from: %v\n", lobsha, err.Error())
+			}
+			return nil
+		}
+	}
+	return fetcherr
+}
+
+// Auto-fetch a single LOB from a remote
+func (r *Repo) autoFetchFromRemote(lobsha, remoteName string, reportProgress bool) error {
+	r.Log.Debugf("Trying to auto-fetch %v from %v\n", lobsha, remoteName)
 	// check the remote config to make sure it's valid
-	provider, err := providers.GetProviderForRemote(remoteName)
+	provider, err := r.GetProvider(remoteName)
 	if err != nil {
 		return err
 	}
@@ -603,7 +1348,7 @@ func AutoFetch(lobsha string, reportProgress bool) error {
 				return false
 			}
 
-			err := FetchSingle(lobsha, provider, remoteName, false, progress)
+			err := r.FetchSingle(lobsha, provider, remoteName, false, progress)
 
 			close(progresschan)
 
@@ -614,19 +1359,25 @@ func AutoFetch(lobsha string, reportProgress bool) error {
 		}(lobsha, provider, remoteName, callbackChan)
 
 		// Report progress on operation every 0.5s
-		util.ReportProgressToConsole(callbackChan, "Fetch", time.Millisecond*500)
+		r.Log.ReportProgressToConsole(callbackChan, "Fetch", time.Millisecond*500)
 		// Because no final newline from report progress
-		util.LogConsole("")
+		r.Log.Console("")
 	} else {
 		// no progress, just do it
-		fetcherr = FetchSingle(lobsha, provider, remoteName, false, func(data *util.ProgressCallbackData) (abort bool) { return false })
+		fetcherr = r.FetchSingle(lobsha, provider, remoteName, false, func(data *util.ProgressCallbackData) (abort bool) { return false })
 	}
 
 	if fetcherr == nil {
-		util.LogDebugf("Successfully fetched %v from %v\n", lobsha, remoteName)
+		r.Log.Debugf("Successfully fetched %v from %v\n", lobsha, remoteName)
 	} else {
-		util.LogDebugf("Failed to auto fetch %v from %v: %v\n", lobsha, remoteName, fetcherr)
+		r.Log.Debugf("Failed to auto fetch %v from %v: %v\n", lobsha, remoteName, fetcherr)
 	}
 
 	return fetcherr
 }
+
+// Get the retry details from a provider's ProgressRetry callback, which passes the number of
+// the retry & the maximum number of retries as bytesDone & totalBytes
+func retryDetail(bytesDone, totalBytes int64) *util.ProgressRetryDetail {
+	return &util.ProgressRetryDetail{int(bytesDone), int(totalBytes)}
+}
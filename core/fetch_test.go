@@ -35,6 +35,10 @@ var _ = Describe("Fetch", func() {
 			CreateGitRepoForTest(root)
 			oldwd, _ = os.Getwd()
 			os.Chdir(root)
+			lobshas = nil
+			correctLOBsMaster = nil
+			correctLOBsFeature1 = nil
+			correctLOBsFeature2 = nil
 
 			defaultOptions := NewOptions()
 
@@ -197,7 +201,7 @@ var _ = Describe("Fetch", func() {
 			InitCoreProviders()
 
 			// move data, so we have no data locally & it's all on remote
-			err = os.Rename(GetLocalLOBRoot(), originBinStore)
+			err = os.Rename(testRepo().GetLocalLOBRoot(), originBinStore)
 			Expect(err).To(BeNil(), "Should not error moving local store to remote")
 
 		})
@@ -221,7 +225,7 @@ var _ = Describe("Fetch", func() {
 		It("High level fetch test", func() {
 			// Detailed querying of recent refs etc is already tested in git_test.go
 			// Just do the high-level tests here to make sure that correct files are moved about
-			provider, err := GetProviderForRemote("origin")
+			provider, err := testRepo().GetProvider("origin")
 			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
 
 			var filesTransferred int
@@ -244,12 +248,12 @@ var _ = Describe("Fetch", func() {
 				return false
 			}
 			// dry run first, with no params so all recents
-			err = Fetch(provider, "origin", []*GitRefSpec{}, true, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, true, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
-			Expect(FileExists(GetLocalLOBMetaPath(correctLOBsMaster[0]))).To(BeFalse(), "Should not have downloaded anything")
+			Expect(FileExists(testRepo().GetLocalLOBMetaPath(correctLOBsMaster[0]))).To(BeFalse(), "Should not have downloaded anything")
 
 			// Now do it
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			// Get unique SHAs for all recent refs
 			uniques := append(correctLOBsMaster, correctLOBsFeature1...)
@@ -260,19 +264,19 @@ var _ = Describe("Fetch", func() {
 			Expect(filesSkipped).To(BeEquivalentTo(0), "Should be no files skipped")
 			Expect(filesFailed).To(BeEquivalentTo(0), "Should be no files failed")
 			Expect(filesNotFound).To(BeEquivalentTo(0), "Should be no files not found")
-			CheckLOBsExistForTest(correctLOBsMaster, GetLocalLOBRoot())
-			CheckLOBsExistForTest(correctLOBsFeature1, GetLocalLOBRoot())
-			CheckLOBsExistForTest(correctLOBsFeature2, GetLocalLOBRoot())
+			CheckLOBsExistForTest(correctLOBsMaster, testRepo().GetLocalLOBRoot())
+			CheckLOBsExistForTest(correctLOBsFeature1, testRepo().GetLocalLOBRoot())
+			CheckLOBsExistForTest(correctLOBsFeature2, testRepo().GetLocalLOBRoot())
 
 			// Should also have updated push state for origin since local store was blank
-			mastersha, _ := GitRefToFullSHA("master")
-			pushedSHA, err := FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+			mastersha, _ := testRepo().GitRefToFullSHA("master")
+			pushedSHA, err := testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
 			Expect(err).To(BeNil(), "Should not be error finding latest pushed")
 			Expect(pushedSHA).To(Equal(mastersha), "Should be marked as fully pushed after initial fetch")
 
 			// Now do it again & confirm it does nothing
 			filesTransferred = 0
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			Expect(filesTransferred).To(BeEquivalentTo(0), "Should be no files transferred")
 			Expect(filesSkipped).To(BeEquivalentTo(0), "Should be no files skipped because no need to try to download them")
@@ -280,7 +284,7 @@ var _ = Describe("Fetch", func() {
 			Expect(filesNotFound).To(BeEquivalentTo(0), "Should be no files not found")
 
 			// Now repeat & force
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, true, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, true, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			Expect(filesTransferred).To(BeEquivalentTo(expectedFiles), "Should be all files transferred again (force)")
 			Expect(filesSkipped).To(BeEquivalentTo(0), "Should be no files skipped because no need to try to download them")
@@ -288,9 +292,9 @@ var _ = Describe("Fetch", func() {
 			Expect(filesNotFound).To(BeEquivalentTo(0), "Should be no files not found")
 
 			// Delete again & do single ref
-			ForceRemoveAll(GetLocalLOBRoot())
+			ForceRemoveAll(testRepo().GetLocalLOBRoot())
 			filesTransferred = 0
-			err = Fetch(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			// Count should be the files required *at* master, not in history ie file1-5.txt
 			Expect(filesTransferred).To(BeEquivalentTo(5*2), "Should be just master files transferred")
@@ -299,10 +303,10 @@ var _ = Describe("Fetch", func() {
 			Expect(filesNotFound).To(BeEquivalentTo(0), "Should be no files not found")
 
 			// Test missing on remote, should error but still continue
-			ForceRemoveAll(GetLocalLOBRoot())
+			ForceRemoveAll(testRepo().GetLocalLOBRoot())
 			RemoveLOBsForTest(correctLOBsFeature1, originBinStore)
 			filesTransferred = 0
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching even though some missing")
 			Expect(filesTransferred).To(BeEquivalentTo(expectedFiles-len(correctLOBsFeature1)*2), "Should be all files transferred again (force)")
 			Expect(filesSkipped).To(BeEquivalentTo(0), "Should be no files skipped because no need to try to download them")
@@ -310,6 +314,315 @@ var _ = Describe("Fetch", func() {
 			Expect(filesNotFound).To(BeEquivalentTo(len(correctLOBsFeature1)), "Should be some files not found (count = SHAs not files)")
 
 		})
+		It("Fetches into a bare repository", func() {
+			// e.g. a mirror kept up to date with 'git fetch --mirror'
+			mirrorRoot := filepath.Join(os.TempDir(), "FetchMirrorTest")
+			defer ForceRemoveAll(mirrorRoot)
+			RunGitCommandForTest(true, "clone", "--bare", root, mirrorRoot)
+			originBinStoreGit := strings.Replace(originBinStore, "\\", "/", -1)
+			RunGitCommandForTest(true, "--git-dir", mirrorRoot, "config", "remote.origin.git-lob-path", originBinStoreGit)
+			RunGitCommandForTest(true, "--git-dir", mirrorRoot, "config", "remote.origin.git-lob-provider", "filesystem")
+			os.Chdir(mirrorRoot)
+			gitdir, _ := filepath.EvalSymlinks(mirrorRoot)
+			Expect(IsBareRepo()).To(BeTrue())
+			Expect(testRepo().GetLocalLOBRoot()).To(Equal(filepath.Join(gitdir, "git-lob", "content")), "Should store binaries in the repository")
+			defaultOptions := NewOptions()
+			GlobalOptions = NewOptions()
+			LoadConfig(GlobalOptions)
+			GlobalOptions.FetchCommitsPeriodHEAD = defaultOptions.FetchCommitsPeriodHEAD
+			GlobalOptions.FetchCommitsPeriodOther = defaultOptions.FetchCommitsPeriodOther
+			GlobalOptions.FetchRefsPeriodDays = defaultOptions.FetchRefsPeriodDays
+
+			provider, err := testRepo().GetProvider("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			var filesTransferred int
+			callback := func(data *ProgressCallbackData) (abort bool) {
+				if data.Type == ProgressTransferBytes && data.ItemBytesDone == data.ItemBytes {
+					filesTransferred++
+				}
+				Expect(data.Type).ToNot(Equal(ProgressError), "No files should fail")
+				return false
+			}
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(filesTransferred).To(BeEquivalentTo(5*2), "Should be just master files transferred")
+			filelobs, err := testRepo().GetGitAllFilesAndLOBsToCheckoutAtCommit("master", nil, nil)
+			Expect(err).To(BeNil())
+			var masterLOBs []string
+			for _, filelob := range filelobs {
+				masterLOBs = append(masterLOBs, filelob.SHA)
+			}
+			CheckLOBsExistForTest(masterLOBs, testRepo().GetLocalLOBRoot())
+
+			// Recent refs are the mirror's branches
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			CheckLOBsExistForTest(correctLOBsMaster, testRepo().GetLocalLOBRoot())
+			CheckLOBsExistForTest(correctLOBsFeature1, testRepo().GetLocalLOBRoot())
+			CheckLOBsExistForTest(correctLOBsFeature2, testRepo().GetLocalLOBRoot())
+			Expect(FileExists(testRepo().GetLocalLOBMetaPath(correctLOBsMaster[0]))).To(BeTrue())
+			Expect(FileExists(filepath.Join(root, ".git", "git-lob", "content", GetLOBMetaRelativePath(correctLOBsMaster[0])))).To(BeFalse(), "Should not have fetched into the working copy")
+
+			// Push state is kept in the repository too
+			mastersha, _ := testRepo().GitRefToFullSHA("master")
+			pushedSHA, err := testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+			Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+			Expect(pushedSHA).To(Equal(mastersha), "Should be marked as fully pushed after initial fetch")
+			Expect(DirExists(filepath.Join(gitdir, "git-lob", "state", "remotes", "origin"))).To(BeTrue())
+			Expect(DirExists(filepath.Join(root, ".git", "git-lob", "state", "remotes", "origin"))).To(BeFalse())
+
+			// & can be marked from what's on the remote
+			Expect(testRepo().ResetPushedBinaryState("origin")).To(BeNil())
+			commits, err := testRepo().MarkPushedFromFetch(&FetchRemote{"origin", provider}, []*GitRefSpec{}, false, callback)
+			Expect(err).To(BeNil(), "Should mark pushed from fetch in a bare repository")
+			Expect(commits).ToNot(BeEmpty())
+			pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+			Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+			Expect(pushedSHA).To(Equal(mastersha), "Should be marked as pushed from fetch")
+		})
+		It("Fetches binaries for a window of commits", func() {
+			provider, err := testRepo().GetProvider("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			var filesTransferred int
+			callback := func(data *ProgressCallbackData) (abort bool) {
+				if data.Type == ProgressTransferBytes && data.ItemBytesDone == data.ItemBytes {
+					filesTransferred++
+				}
+				return false
+			}
+			feature1Tip, err := testRepo().GetGitCommitSummary("feature/1")
+			Expect(err).To(BeNil())
+
+			// Only the tip of feature/1 is in the last few days, nothing on HEAD
+			GlobalOptions.FetchSince = feature1Tip.CommitDate.Add(-time.Hour)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(filesTransferred).To(BeEquivalentTo(len(correctLOBsFeature1)*2), "Should only fetch feature/1 tip")
+			CheckLOBsExistForTest(correctLOBsFeature1, testRepo().GetLocalLOBRoot())
+
+			// Until the commit before the tip on feature/1 only
+			ForceRemoveAll(testRepo().GetLocalLOBRoot())
+			filesTransferred = 0
+			GlobalOptions.FetchSince = feature1Tip.CommitDate.Add(-time.Hour * 24)
+			GlobalOptions.FetchUntil = feature1Tip.CommitDate.Add(-time.Hour)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "feature/1"}}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(filesTransferred).To(BeEquivalentTo(3*2), "Should only fetch included commit")
+			CheckLOBsExistForTest([]string{lobshas[8], lobshas[2], lobshas[5]}, testRepo().GetLocalLOBRoot())
+			Expect(FileExists(testRepo().GetLocalLOBMetaPath(lobshas[9]))).To(BeFalse(), "Should not fetch tip")
+
+			// Latest 2 commits on master; both versions of file5.txt & the rest at the tip
+			ForceRemoveAll(testRepo().GetLocalLOBRoot())
+			filesTransferred = 0
+			GlobalOptions.FetchSince = time.Time{}
+			GlobalOptions.FetchUntil = time.Time{}
+			GlobalOptions.FetchMaxCommits = 2
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(filesTransferred).To(BeEquivalentTo(6*2), "Should fetch latest 2 commits")
+			CheckLOBsExistForTest([]string{lobshas[14], lobshas[15]}, testRepo().GetLocalLOBRoot())
+
+			// Ranges have their own window
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{ParseGitRefSpec("start..master")}, false, false, callback)
+			Expect(err).ToNot(BeNil(), "Should not allow ranges with a window")
+		})
+		It("Prefetches recent binaries, giving way to fetch", func() {
+			provider, err := testRepo().GetProvider("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			remotes := []*FetchRemote{&FetchRemote{"origin", provider}}
+			callback := func(data *ProgressCallbackData) (abort bool) { return false }
+			uniques := append(correctLOBsMaster, correctLOBsFeature1...)
+			uniques = append(uniques, correctLOBsFeature2...)
+			StringRemoveDuplicates(&uniques)
+			oldBatchSize := PrefetchBatchSize
+			defer func() { PrefetchBatchSize = oldBatchSize }()
+			PrefetchBatchSize = 3
+
+			// Fetch in progress
+			fetchlock, err := testRepo().lockFetch()
+			Expect(err).To(BeNil())
+			downloaded, yielded, err := testRepo().Prefetch(remotes, callback)
+			fetchlock.Release()
+			Expect(err).To(BeNil())
+			Expect(yielded).To(BeTrue(), "Should give way to fetch")
+			Expect(downloaded).To(Equal(0))
+
+			downloaded, yielded, err = testRepo().Prefetch(remotes, callback)
+			Expect(err).To(BeNil())
+			Expect(yielded).To(BeFalse())
+			Expect(downloaded).To(Equal(len(uniques)), "Should prefetch same binaries as fetch")
+			CheckLOBsExistForTest(uniques, testRepo().GetLocalLOBRoot())
+			downloaded, _, err = testRepo().Prefetch(remotes, callback)
+			Expect(err).To(BeNil())
+			Expect(downloaded).To(Equal(0), "Nothing more to prefetch")
+
+			// Daemon prefetches when the repo is idle
+			ForceRemoveAll(testRepo().GetLocalLOBRoot())
+			oldIdleTime := PrefetchIdleTime
+			defer func() { PrefetchIdleTime = oldIdleTime }()
+			PrefetchIdleTime = 0
+			stop := make(chan struct{})
+			var reported []int
+			report := func(downloaded int, err error) {
+				Expect(err).To(BeNil())
+				reported = append(reported, downloaded)
+				close(stop)
+			}
+			err = testRepo().PrefetchDaemon(remotes, stop, callback, report)
+			Expect(err).To(BeNil())
+			Expect(reported).To(Equal([]int{len(uniques)}))
+			CheckLOBsExistForTest(uniques, testRepo().GetLocalLOBRoot())
+		})
+		It("Fetches metadata only & content on checkout", func() {
+			provider, err := testRepo().GetProvider("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			var filesTransferred int
+			callback := func(data *ProgressCallbackData) (abort bool) {
+				if data.Type == ProgressTransferBytes && data.ItemBytesDone == data.ItemBytes {
+					filesTransferred++
+				}
+				return false
+			}
+			Expect(testRepo().GetLazyFetchRemote()).To(Equal(""), "Content should not be fetched on checkout by default")
+
+			GlobalOptions.FetchMetadataOnly = true
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(filesTransferred).To(BeEquivalentTo(5), "Should be just master metadata transferred")
+			Expect(testRepo().GetLazyFetchRemote()).To(Equal("origin"), "Should record remote to fetch content from")
+			masterfilelobs, err := testRepo().GetGitAllFilesAndLOBsToCheckoutAtCommit("master", nil, nil)
+			Expect(err).To(BeNil())
+			var mastershas []string
+			for _, filelob := range masterfilelobs {
+				sha := filelob.SHA
+				mastershas = append(mastershas, sha)
+				_, err = testRepo().GetLOBInfo(sha)
+				Expect(err).To(BeNil(), "Metadata should be present")
+				Expect(testRepo().IsLOBMissing(sha, false)).To(BeTrue(), "Content should not be present")
+				Expect(testRepo().isLOBContentOnDemand(sha)).To(BeTrue(), "Content should be fetched on demand")
+			}
+			// Again should do nothing since metadata is present
+			filesTransferred = 0
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(filesTransferred).To(BeEquivalentTo(0), "Should be nothing transferred")
+			GlobalOptions.FetchMetadataOnly = false
+
+			// Content is fetched when first needed, even without git-lob.autofetch
+			Expect(GlobalOptions.AutoFetchEnabled).To(BeFalse())
+			var buf bytes.Buffer
+			_, err = testRepo().RetrieveLOB(mastershas[0], &buf)
+			Expect(err).To(BeNil(), "Should fetch content on demand")
+			Expect(testRepo().IsLOBMissing(mastershas[0], false)).To(BeFalse(), "Content should now be present")
+			Expect(testRepo().IsLOBMissing(mastershas[1], false)).To(BeTrue(), "Other content should not be fetched")
+
+			// Until content is fetched as usual
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(testRepo().GetLazyFetchRemote()).To(Equal(""), "Full fetch should stop fetching content on checkout")
+			Expect(testRepo().IsLOBMissing(mastershas[1], false)).To(BeFalse(), "Content should be fetched")
+		})
+		It("Quarantines corrupt downloads & downloads them again", func() {
+			provider, err := testRepo().GetProvider("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			masterfilelobs, err := testRepo().GetGitAllFilesAndLOBsToCheckoutAtCommit("master", nil, nil)
+			Expect(err).To(BeNil())
+			badsha := masterfilelobs[0].SHA
+			badchunk := testRepo().GetLOBChunkPathInBaseDir(originBinStore, badsha, 0)
+			goodcontent, err := ioutil.ReadFile(badchunk)
+			Expect(err).To(BeNil())
+			// Same size, so only the SHA can tell
+			badcontent := append([]byte{}, goodcontent...)
+			badcontent[0] ^= 0xff
+			Expect(ioutil.WriteFile(badchunk, badcontent, 0644)).To(BeNil())
+
+			var badTransfers, errorsReported int
+			callback := func(data *ProgressCallbackData) (abort bool) {
+				if data.Type == ProgressTransferBytes && data.ItemBytesDone == data.ItemBytes && strings.Contains(data.Desc, badsha) &&
+					strings.HasSuffix(data.Desc, "_0") {
+					badTransfers++
+				} else if data.Type == ProgressError {
+					errorsReported++
+				}
+				return false
+			}
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, callback)
+			Expect(err).ToNot(BeNil(), "Should report corrupt content")
+			Expect(err.Error()).To(ContainSubstring(badsha))
+			Expect(badTransfers).To(Equal(2), "Corrupt content should be downloaded again")
+			Expect(errorsReported).To(Equal(1), "Should report downloading again")
+			Expect(testRepo().IsLOBMissing(badsha, false)).To(BeTrue(), "Corrupt content should not be in the store")
+			Expect(FileExists(testRepo().GetLocalLOBChunkPath(badsha, 0))).To(BeFalse(), "Corrupt content should not be in the store")
+			for _, filelob := range masterfilelobs[1:] {
+				Expect(testRepo().CheckLOBFilesForSHA(filelob.SHA, testRepo().GetLocalLOBRoot(), true)).To(BeNil(), "Good content should be stored")
+			}
+			quarantined, err := filepath.Glob(filepath.Join(testRepo().GetQuarantineRoot(), "*", badsha, "*"))
+			Expect(err).To(BeNil())
+			Expect(quarantined).To(ContainElement(HaveSuffix(badsha+"_0")), "Corrupt chunk should be quarantined")
+			Expect(quarantined).To(ContainElement(HaveSuffix(badsha+"_meta")), "Metadata should be kept with it")
+			quarantinedContent, _ := ioutil.ReadFile(quarantined[0])
+			Expect(quarantinedContent).To(Equal(badcontent))
+
+			// Once the remote is fixed it's fetched as normal
+			Expect(ioutil.WriteFile(badchunk, goodcontent, 0644)).To(BeNil())
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(testRepo().CheckLOBFilesForSHA(badsha, testRepo().GetLocalLOBRoot(), true)).To(BeNil(), "Content should now be stored")
+			staged, _ := filepath.Glob(filepath.Join(testRepo().getFetchStagingRoot(), "*", "*", "*"))
+			Expect(staged).To(BeEmpty(), "Nothing should be left staged")
+		})
+
+		It("Fetches the binary for a single file", func() {
+			provider, err := testRepo().GetProvider("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			callback := func(data *ProgressCallbackData) (abort bool) { return false }
+			current, err := testRepo().FetchFile("file5.txt", lobshas[15], provider, "origin", false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(current).To(BeTrue(), "HEAD version should be current")
+			Expect(testRepo().IsLOBMissing(lobshas[15], false)).To(BeFalse(), "Should be fetched")
+			Expect(testRepo().IsLOBMissing(lobshas[14], false)).To(BeTrue(), "Nothing else should be fetched")
+
+			current, err = testRepo().FetchFile("file5.txt", lobshas[14], provider, "origin", false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(current).To(BeFalse(), "Older version shouldn't be current")
+			Expect(testRepo().IsLOBMissing(lobshas[14], false)).To(BeFalse(), "Should be fetched")
+
+			Expect(testRepo().DeleteLOBInBaseDir(lobshas[13], originBinStore)).To(BeNil())
+			_, err = testRepo().FetchFile("file6.txt", lobshas[13], provider, "origin", false, callback)
+			Expect(IsNotFoundError(err)).To(BeTrue(), "Should report binaries the remote doesn't have")
+		})
+
+		It("Keeps compressed metadata until the remote's has been downloaded", func() {
+			provider, err := testRepo().GetProvider("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			masterfilelobs, err := testRepo().GetGitAllFilesAndLOBsToCheckoutAtCommit("master", nil, nil)
+			Expect(err).To(BeNil())
+			sha := masterfilelobs[0].SHA
+			remoteinfo, err := testRepo().getLOBInfoInBaseDir(sha, originBinStore)
+			Expect(err).To(BeNil())
+			localinfo := *remoteinfo
+			localinfo.Compression = CompressionZstd
+			localinfo.FrameSize = 1024
+			Expect(testRepo().StoreLOBInfo(&localinfo)).To(BeNil())
+			callback := func(data *ProgressCallbackData) (abort bool) { return false }
+
+			// Not on the remote, so there's nothing to replace it with
+			remotemeta := testRepo().GetLOBMetaPathInBaseDir(originBinStore, sha)
+			Expect(os.Rename(remotemeta, remotemeta+".moved")).To(BeNil())
+			testRepo().fetchMetadata(map[string]string{sha: ""}, provider, "origin", false, callback)
+			info, err := testRepo().GetLOBInfo(sha)
+			Expect(err).To(BeNil(), "Metadata should be kept")
+			Expect(info.Compression).To(Equal(CompressionZstd))
+
+			Expect(os.Rename(remotemeta+".moved", remotemeta)).To(BeNil())
+			err = testRepo().fetchMetadata(map[string]string{sha: ""}, provider, "origin", false, callback)
+			Expect(err).To(BeNil())
+			info, err = testRepo().GetLOBInfo(sha)
+			Expect(err).To(BeNil())
+			Expect(info).To(Equal(remoteinfo), "Remote's metadata should replace ours")
+			staged, _ := filepath.Glob(filepath.Join(testRepo().getFetchStagingRoot(), "*"))
+			Expect(staged).To(BeEmpty(), "Nothing should be left staged")
+		})
 
 	})
 
@@ -404,7 +717,7 @@ var _ = Describe("Fetch", func() {
 			InitCoreProviders()
 
 			// move data, so we have no data locally & it's all on remote
-			err = os.Rename(GetLocalLOBRoot(), originBinStore)
+			err = os.Rename(testRepo().GetLocalLOBRoot(), originBinStore)
 			Expect(err).To(BeNil(), "Should not error moving local store to remote")
 
 		})
@@ -426,7 +739,7 @@ var _ = Describe("Fetch", func() {
 			GlobalOptions = NewOptions()
 		})
 		It("Fetch test for push state", func() {
-			provider, err := GetProviderForRemote("origin")
+			provider, err := testRepo().GetProvider("origin")
 			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
 
 			var filesTransferred int
@@ -450,25 +763,25 @@ var _ = Describe("Fetch", func() {
 			}
 			// Firstly we'll fetch at commit 0 just for local
 			RunGitCommandForTest(true, "checkout", setupOutputs[0].Commit)
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			Expect(filesTransferred).To(BeEquivalentTo(len(setupOutputs[0].LobSHAs)*2), "File count check should be right")
 			filesTransferred = 0
 			// This should have initialised ALL the push state (because no local LOBs) including all other branches, so reset it
 			// then manually set it to [0]. We're trying to replicate the case where more than one fetch has taken place when the
 			// git repo has had new commits pulled
-			err = ResetPushedBinaryState("origin")
+			err = testRepo().ResetPushedBinaryState("origin")
 			Expect(err).To(BeNil(), "Should be no error resetting pushed state")
-			MarkBinariesAsPushed("origin", setupOutputs[0].Commit, "")
-			pushed, err := FindLatestAncestorWhereBinariesPushed("origin", "master")
+			testRepo().MarkBinariesAsPushed("origin", setupOutputs[0].Commit, "")
+			pushed, err := testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
 			Expect(err).To(BeNil(), "Should be no error finding pushed ancestor")
 			Expect(pushed).To(Equal(setupOutputs[0].Commit), "Reset pushed state should work")
 			// now fetch for commit 1, this should update the push state to this SHA
 			RunGitCommandForTest(true, "checkout", setupOutputs[1].Commit)
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			Expect(filesTransferred).To(BeEquivalentTo(len(setupOutputs[1].LobSHAs)*2), "File count check should be right")
-			pushed, err = FindLatestAncestorWhereBinariesPushed("origin", "master")
+			pushed, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
 			Expect(err).To(BeNil(), "Should be no error finding pushed ancestor")
 			Expect(pushed).To(Equal(setupOutputs[1].Commit), "Fetch should have updated pushed state to the latest fetched point")
 			filesTransferred = 0
@@ -477,10 +790,10 @@ var _ = Describe("Fetch", func() {
 			// Commit 5 is > 2 days ahead of previous commit so this will only fetch 5
 			// but will actually get 2 sets; the change at 5 and the change before 5
 			RunGitCommandForTest(true, "checkout", setupOutputs[5].Commit)
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			Expect(filesTransferred).To(BeEquivalentTo(len(setupOutputs[5].LobSHAs)*4), "File count check should be right (2 commits)")
-			pushed, err = FindLatestAncestorWhereBinariesPushed("origin", "master")
+			pushed, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
 			Expect(err).To(BeNil(), "Should be no error finding pushed ancestor")
 			Expect(pushed).To(Equal(setupOutputs[5].Commit), "Fetch should have updated pushed state to the latest fetched point because files in gap are already on remote")
 			filesTransferred = 0
@@ -489,16 +802,16 @@ var _ = Describe("Fetch", func() {
 			// this should mean that the push state is not moved, because we need to keep checking until someone pushes the missing LOB
 			// (might be this client or any other)
 			// Put the pushed state back to 1
-			ResetPushedBinaryState("origin")
-			MarkBinariesAsPushed("origin", setupOutputs[1].Commit, "")
+			testRepo().ResetPushedBinaryState("origin")
+			testRepo().MarkBinariesAsPushed("origin", setupOutputs[1].Commit, "")
 			// this test is for a missing file in the GAP, not a file we would fetch
 			origRemoteBinary := filepath.Join(originBinStore, GetLOBChunkRelativePath(setupOutputs[3].LobSHAs[0], 0))
 			renamedRemoteBinary := origRemoteBinary + "_old"
 			os.Rename(origRemoteBinary, renamedRemoteBinary)
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			Expect(filesTransferred).To(BeEquivalentTo(0), "Should be nothing new to fetch (already done)")
-			pushed, err = FindLatestAncestorWhereBinariesPushed("origin", "master")
+			pushed, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
 			Expect(err).To(BeNil(), "Should be no error finding pushed ancestor")
 			Expect(pushed).To(Equal(setupOutputs[1].Commit), "Fetch should not have updated pushed state because remote files were missing in the gap")
 			filesTransferred = 0
@@ -516,11 +829,11 @@ var _ = Describe("Fetch", func() {
 			origRemoteBinary = filepath.Join(originBinStore, GetLOBChunkRelativePath(setupOutputs[6].LobSHAs[0], 0))
 			renamedRemoteBinary = origRemoteBinary + "_old"
 			os.Rename(origRemoteBinary, renamedRemoteBinary)
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			Expect(filesTransferred).To(BeEquivalentTo(len(setupOutputs[6].LobSHAs)*2+len(setupOutputs[7].LobSHAs)*2-1),
 				"Should be 2 more commits to fetch, minus one which is missing")
-			pushed, err = FindLatestAncestorWhereBinariesPushed("origin", "master")
+			pushed, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
 			Expect(err).To(BeNil(), "Should be no error finding pushed ancestor")
 			Expect(pushed).To(Equal(setupOutputs[1].Commit), "Fetch should not have updated pushed state because remote files were missing in the gap")
 			filesTransferred = 0
@@ -528,15 +841,59 @@ var _ = Describe("Fetch", func() {
 			os.Rename(renamedRemoteBinary, origRemoteBinary)
 
 			// now confirm that once the missing files are resolved, push state updates
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			Expect(filesTransferred).To(BeEquivalentTo(1), "Should fetch the 1 file that was missing")
-			pushed, err = FindLatestAncestorWhereBinariesPushed("origin", "master")
+			pushed, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
 			Expect(err).To(BeNil(), "Should be no error finding pushed ancestor")
 			Expect(pushed).To(Equal(setupOutputs[7].Commit), "Fetch should now have updated the push state to master")
 			filesTransferred = 0
 
 		})
+		It("Follows the push state policy & marks pushed from fetch", func() {
+			provider, err := testRepo().GetProvider("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			callback := func(data *ProgressCallbackData) (abort bool) { return false }
+			remote := &FetchRemote{"origin", provider}
+			RunGitCommandForTest(true, "checkout", setupOutputs[0].Commit)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			testRepo().ResetPushedBinaryState("origin")
+			testRepo().MarkBinariesAsPushed("origin", setupOutputs[0].Commit, "")
+
+			GlobalOptions.FetchUpdatesPushState = FetchPushStateNever
+			RunGitCommandForTest(true, "checkout", setupOutputs[1].Commit)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			pushed, _ := testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
+			Expect(pushed).To(Equal(setupOutputs[0].Commit), "Fetch should not update push state when told never to")
+
+			commits, err := testRepo().MarkPushedFromFetch(remote, []*GitRefSpec{}, true, callback)
+			Expect(err).To(BeNil())
+			Expect(commits).To(Equal([]string{setupOutputs[1].Commit}))
+			pushed, _ = testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
+			Expect(pushed).To(Equal(setupOutputs[0].Commit), "Dry run should not update push state")
+			_, err = testRepo().MarkPushedFromFetch(remote, []*GitRefSpec{}, false, callback)
+			Expect(err).To(BeNil())
+			pushed, _ = testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
+			Expect(pushed).To(Equal(setupOutputs[1].Commit), "Should mark what fetch would have")
+
+			// A binary needed at master is missing from the remote
+			RunGitCommandForTest(true, "checkout", "master")
+			origRemoteBinary := filepath.Join(originBinStore, GetLOBChunkRelativePath(setupOutputs[6].LobSHAs[0], 0))
+			os.Rename(origRemoteBinary, origRemoteBinary+"_old")
+			_, err = testRepo().MarkPushedFromFetch(remote, []*GitRefSpec{}, false, callback)
+			Expect(err).ToNot(BeNil(), "Should not mark commits whose binaries aren't on the remote")
+			pushed, _ = testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
+			Expect(pushed).To(Equal(setupOutputs[1].Commit))
+
+			GlobalOptions.FetchUpdatesPushState = FetchPushStateAlways
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			pushed, _ = testRepo().FindLatestAncestorWhereBinariesPushed("origin", "master")
+			Expect(pushed).To(Equal(setupOutputs[7].Commit), "Fetch should always update push state when told to")
+			os.Rename(origRemoteBinary+"_old", origRemoteBinary)
+		})
 	})
 
 	Context("Delta fetch test", func() {
@@ -619,17 +976,17 @@ var _ = Describe("Fetch", func() {
 			sha2 := setupOutputs[1].FileLOBs[0].SHA
 			sha3 := setupOutputs[2].FileLOBs[0].SHA
 			var delta12, delta13, delta23 bytes.Buffer
-			_, err = GenerateLOBDelta(sha1, sha2, &delta12)
+			_, err = testRepo().GenerateLOBDelta(sha1, sha2, &delta12)
 			Expect(err).To(BeNil(), "Should not error trying to generate delta")
-			_, err = GenerateLOBDelta(sha2, sha3, &delta23)
+			_, err = testRepo().GenerateLOBDelta(sha2, sha3, &delta23)
 			Expect(err).To(BeNil(), "Should not error trying to generate delta")
-			_, err = GenerateLOBDelta(sha1, sha3, &delta13)
+			_, err = testRepo().GenerateLOBDelta(sha1, sha3, &delta13)
 			Expect(err).To(BeNil(), "Should not error trying to generate delta")
-			meta1, err := ioutil.ReadFile(GetLocalLOBMetaPath(sha1))
+			meta1, err := ioutil.ReadFile(testRepo().GetLocalLOBMetaPath(sha1))
 			Expect(err).To(BeNil(), "Should not error trying to read metafile")
-			meta2, err := ioutil.ReadFile(GetLocalLOBMetaPath(sha2))
+			meta2, err := ioutil.ReadFile(testRepo().GetLocalLOBMetaPath(sha2))
 			Expect(err).To(BeNil(), "Should not error trying to read metafile")
-			meta3, err := ioutil.ReadFile(GetLocalLOBMetaPath(sha3))
+			meta3, err := ioutil.ReadFile(testRepo().GetLocalLOBMetaPath(sha3))
 			Expect(err).To(BeNil(), "Should not error trying to read metafile")
 			metamap := map[string][]byte{
 				sha1: meta1, // need to include this so dummy remote knows it exists
@@ -646,9 +1003,9 @@ var _ = Describe("Fetch", func() {
 
 			// now delete the second 2 revisions of LOBs, keeping only the first one
 			// and relying on deltas from the dummy server for the other 2
-			err = DeleteLOB(sha2)
+			err = testRepo().DeleteLOB(sha2)
 			Expect(err).To(BeNil(), "Should not error trying to delete LOB")
-			err = DeleteLOB(sha3)
+			err = testRepo().DeleteLOB(sha3)
 			Expect(err).To(BeNil(), "Should not error trying to delete LOB")
 
 			fileshas = append(fileshas, sha1, sha2, sha3)
@@ -690,19 +1047,19 @@ var _ = Describe("Fetch", func() {
 				messages = append(messages, data.Desc)
 				return false
 			}
-			provider, err := GetProviderForRemote("origin")
+			provider, err := testRepo().GetProvider("origin")
 			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
 
 			// dry run first, with no params so all recents
-			err = Fetch(provider, "origin", []*GitRefSpec{}, true, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, true, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
-			Expect(FileExists(GetLocalLOBMetaPath(setupOutputs[1].FileLOBs[0].SHA))).To(BeFalse(), "Should not have downloaded anything")
+			Expect(FileExists(testRepo().GetLocalLOBMetaPath(setupOutputs[1].FileLOBs[0].SHA))).To(BeFalse(), "Should not have downloaded anything")
 
 			// First try fetching the entire range
 			// Should try to generate deltas 1-2 and 1-3 in this case, because we only have SHA 1 locally
 			// *technically* if we did things in order all the time we could use 1-2 and 2-3 in one fetch but that's more complex
 			// results in some duplication when fetching many updates to the same file probably, but not worth it yet
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			//fmt.Println(messages)
 			Expect(filesTransferred).To(BeEquivalentTo(2*2), "Should be correct number of files to transfer (meta + content)")
@@ -713,12 +1070,12 @@ var _ = Describe("Fetch", func() {
 				setupOutputs[1].FileLOBs[0].SHA,
 				setupOutputs[2].FileLOBs[0].SHA,
 			}
-			CheckLOBsExistForTest(lobstocheck, GetLocalLOBRoot())
+			CheckLOBsExistForTest(lobstocheck, testRepo().GetLocalLOBRoot())
 			filesTransferred = 0
 			// now let's delete LOB 3 and fetch again so it uses 2-3 delta
-			err = DeleteLOB(fileshas[2])
+			err = testRepo().DeleteLOB(fileshas[2])
 			Expect(err).To(BeNil(), "Should not error trying to delete LOB")
-			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			err = testRepo().Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error fetching")
 			//fmt.Println(messages)
 			Expect(filesTransferred).To(BeEquivalentTo(1*2), "Should be correct number of files to transfer (meta + content)")
@@ -728,8 +1085,125 @@ var _ = Describe("Fetch", func() {
 			lobstocheck = []string{
 				setupOutputs[2].FileLOBs[0].SHA,
 			}
-			CheckLOBsExistForTest(lobstocheck, GetLocalLOBRoot())
+			CheckLOBsExistForTest(lobstocheck, testRepo().GetLocalLOBRoot())
+
+		})
+
+	})
+
+	Context("Fetch from several remotes", func() {
+		root := filepath.Join(os.TempDir(), "FetchTest")
+		cacheBinStore := filepath.Join(os.TempDir(), "FetchCacheBinStoreTest")
+		originBinStore := filepath.Join(os.TempDir(), "FetchOriginBinStoreTest")
+		var oldwd string
+		var lobshas []string
+		var remotes []*FetchRemote
+
+		BeforeEach(func() {
+			CreateGitRepoForTest(root)
+			oldwd, _ = os.Getwd()
+			os.Chdir(root)
+
+			lobshas = nil
+			for i := 0; i < 4; i++ {
+				info := CreateAndStoreLOBFileForTest(300, filepath.Join(root, fmt.Sprintf("file%d.txt", i)))
+				lobshas = append(lobshas, info.SHA)
+			}
+
+			f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+			Expect(err).To(BeNil(), "Should not error trying to open config file")
+			f.WriteString(fmt.Sprintf(`
+[remote "cache"]
+    git-lob-path = %v
+    git-lob-provider = filesystem
+[remote "origin"]
+    git-lob-path = %v
+    git-lob-provider = filesystem
+[git-lob]
+    fetch-remotes = cache, origin
+`, strings.Replace(cacheBinStore, "\\", "/", -1), strings.Replace(originBinStore, "\\", "/", -1)))
+			f.Close()
+			LoadConfig(GlobalOptions)
+			InitCoreProviders()
+
+			// Origin has everything, the cache only the first 2
+			err = exec.Command("cp", "-r", testRepo().GetLocalLOBRoot(), cacheBinStore).Run()
+			Expect(err).To(BeNil(), "Should not error copying local store to cache")
+			for _, sha := range lobshas[2:] {
+				Expect(testRepo().DeleteLOBInBaseDir(sha, cacheBinStore)).To(BeNil())
+			}
+			err = os.Rename(testRepo().GetLocalLOBRoot(), originBinStore)
+			Expect(err).To(BeNil(), "Should not error moving local store to remote")
+			remotes = nil
+			for _, remoteName := range GlobalOptions.FetchRemotes {
+				provider, err := testRepo().GetProvider(remoteName)
+				Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+				remotes = append(remotes, &FetchRemote{Name: remoteName, Provider: provider})
+			}
+		})
+		AfterEach(func() {
+			os.Chdir(oldwd)
+			for _, dir := range []string{root, cacheBinStore, originBinStore} {
+				err := ForceRemoveAll(dir)
+				if err != nil {
+					Fail(err.Error())
+				}
+			}
+			// Reset any option changes
+			GlobalOptions = NewOptions()
+		})
 
+		It("Fails over to the next remote & records sources", func() {
+			Expect(GlobalOptions.FetchRemotes).To(Equal([]string{"cache", "origin"}))
+			var filesNotFound int
+			callback := func(data *ProgressCallbackData) (abort bool) {
+				if data.Type == ProgressNotFound {
+					filesNotFound++
+				}
+				return false
+			}
+			lobs := make(map[string]string)
+			for i, sha := range lobshas {
+				lobs[sha] = fmt.Sprintf("file%d.txt", i)
+			}
+			sources, anyNotFound, err := testRepo().fetchLOBsFromRemotes(lobs, remotes, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(anyNotFound).To(BeFalse(), "Origin should have what the cache doesn't")
+			Expect(filesNotFound).To(BeEquivalentTo(0), "Missing from cache shouldn't be reported")
+			CheckLOBsExistForTest(lobshas, testRepo().GetLocalLOBRoot())
+			for i, sha := range lobshas {
+				expected := "cache"
+				if i >= 2 {
+					expected = "origin"
+				}
+				Expect(sources[sha]).To(Equal(expected))
+				Expect(testRepo().GetFetchSource(sha)).To(Equal(expected), "Source should be recorded")
+			}
+			Expect(testRepo().getAutoFetchRemotes(lobshas[3])).To(Equal([]string{"origin", "cache"}))
+
+			// SHA-256 binaries are recorded too
+			sha256 := strings.Repeat("ab", SHA256Len/2)
+			Expect(testRepo().recordFetchSources(map[string]string{sha256: "origin"})).To(BeNil())
+			Expect(testRepo().GetFetchSource(sha256)).To(Equal("origin"))
+			// Later fetches replace earlier ones, & once the file is compacted deleted binaries are forgotten
+			Expect(testRepo().DeleteLOB(lobshas[0])).To(BeNil())
+			for i := 0; i <= fetchSourcesCompactMinLines; i++ {
+				Expect(testRepo().recordFetchSources(map[string]string{lobshas[1]: "cache", lobshas[2]: "cache"})).To(BeNil())
+			}
+			Expect(testRepo().GetFetchSource(lobshas[2])).To(Equal("cache"))
+			Expect(testRepo().GetFetchSource(lobshas[0])).To(Equal(""))
+			Expect(testRepo().GetFetchSource(sha256)).To(Equal(""))
+			data, err := ioutil.ReadFile(testRepo().getFetchSourcesStateFile())
+			Expect(err).To(BeNil())
+			Expect(strings.Count(string(data), "\n")).To(BeNumerically("<=", len(lobshas)), "Should have been compacted")
+
+			// Not anywhere
+			Expect(testRepo().DeleteLOBInBaseDir(lobshas[0], cacheBinStore)).To(BeNil())
+			Expect(testRepo().DeleteLOBInBaseDir(lobshas[0], originBinStore)).To(BeNil())
+			_, anyNotFound, err = testRepo().fetchLOBsFromRemotes(map[string]string{lobshas[0]: "file0.txt"}, remotes, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(anyNotFound).To(BeTrue())
+			Expect(filesNotFound).To(BeEquivalentTo(1), "Should only be reported once")
 		})
 
 	})
@@ -833,6 +1307,6 @@ type DummyFetchTransportFactory struct {
 func (self *DummyFetchTransportFactory) WillHandleUrl(u *url.URL) bool {
 	return u.Scheme == "dummy"
 }
-func (self *DummyFetchTransportFactory) Connect(u *url.URL) (smart.Transport, error) {
+func (self *DummyFetchTransportFactory) Connect(u *url.URL, root string, opts *Options, log *Logger) (smart.Transport, error) {
 	return &DummyFetchTransport{self.MetaContentMap, self.DeltaContentMap}, nil
 }
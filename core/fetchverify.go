@@ -0,0 +1,234 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Verification of fetched content
+// Chunks are downloaded to a staging area first & only moved into the store once the whole
+// binary they belong to has been checked against its SHA, so that a corrupt download never
+// poisons the store. Binaries which don't match are moved to a quarantine folder, where they
+// can be looked at later, & downloaded again.
+
+// How many times to download a binary again after its content didn't match its SHA
+var FetchCorruptRetries = 1
+
+// Where chunks are downloaded to before they've been verified
+// Always in this repo, even with a shared store, so that repos fetching at the same time never
+// verify or move each other's partly downloaded files. The shared store has to be on the same
+// filesystem as the repo for linking, so chunks are still moved into it with a rename
+func (r *Repo) getFetchStagingRoot() string {
+	return filepath.Join(r.GitDir, "git-lob", "incoming")
+}
+
+// Where binaries whose downloaded content didn't match their SHA are kept
+func (r *Repo) GetQuarantineRoot() string {
+	if r.IsUsingSharedStorage() {
+		return filepath.Join(r.GetSharedLOBRoot(), ".quarantine")
+	}
+	return filepath.Join(r.GitDir, "git-lob", "quarantine")
+}
+
+// Verify binaries whose chunks were downloaded to stagingRoot, moving the chunks of those whose
+// content matches their SHA into destRoot & the rest to quarantine
+// Chunks which weren't downloaded are read from destRoot. Binaries which are still missing chunks
+// (e.g. not found on the remote) are left alone, so that staged chunks can be used next time
+// Returns the SHAs of the binaries which were quarantined
+func (r *Repo) storeFetchedLOBs(shas []string, stagingRoot, destRoot string) (corrupt []string) {
+	// Check everything before moving anything; chunk objects can be shared between binaries
+	var good []*LOBInfo
+	var bad []*LOBInfo
+	for _, sha := range shas {
+		info, complete, err := r.verifyFetchedLOB(sha, stagingRoot, destRoot)
+		if err != nil {
+			r.Log.Errorf("Content downloaded for %v is corrupt: %v\n", sha, err.Error())
+			bad = append(bad, info)
+		} else if complete {
+			good = append(good, info)
+		}
+	}
+	for _, info := range good {
+		for i := 0; i < info.NumChunks; i++ {
+			rel := getLOBChunkRelativePathForInfo(info, i)
+			staged := filepath.Join(stagingRoot, rel)
+			if !util.FileExists(staged) {
+				// Wasn't downloaded, or another binary sharing the chunk object moved it
+				continue
+			}
+			dest := getLOBStoreFilePath(destRoot, rel)
+			err := r.moveFetchedFileIntoStore(staged, dest, destRoot)
+			if err != nil {
+				r.Log.Errorf("Unable to move %v into the store: %v\n", staged, err.Error())
+			}
+		}
+	}
+	for _, info := range bad {
+		r.quarantineFetchedLOB(info, stagingRoot, destRoot)
+		corrupt = append(corrupt, info.SHA)
+	}
+	return corrupt
+}
+
+// Verify a binary whose missing chunks were downloaded to stagingRoot & move them into destRoot
+// if its content matches its SHA, for stores outside a repo which have no quarantine (e.g. a
+// server caching another store); its metadata must already be in destRoot
+// Returns an error if the content is corrupt or incomplete, in which case nothing is moved &
+// the caller should delete what it downloaded
+func (r *Repo) StoreFetchedLOBInBaseDir(sha, stagingRoot, destRoot string) error {
+	info, complete, err := r.verifyFetchedLOB(sha, stagingRoot, destRoot)
+	if err != nil {
+		return err
+	}
+	if !complete {
+		return fmt.Errorf("Content downloaded for %v is incomplete", sha)
+	}
+	for i := 0; i < info.NumChunks; i++ {
+		rel := getLOBChunkRelativePathForInfo(info, i)
+		staged := filepath.Join(stagingRoot, rel)
+		if !util.FileExists(staged) {
+			continue
+		}
+		err = r.moveFetchedFileIntoStore(staged, getLOBStoreFilePath(destRoot, rel), destRoot)
+		if err != nil {
+			return fmt.Errorf("Unable to move %v into the store: %v", staged, err.Error())
+		}
+	}
+	return nil
+}
+
+// Check a chunk object downloaded to stagingRoot against its SHA & move it into destRoot if it
+// matches; chunk objects are stored raw, so their content is what their SHA identifies
+func (r *Repo) StoreFetchedChunkObjectInBaseDir(chunksha, stagingRoot, destRoot string) error {
+	rel := GetChunkObjectRelativePath(chunksha)
+	staged := filepath.Join(stagingRoot, rel)
+	f, err := os.Open(staged)
+	if err != nil {
+		return fmt.Errorf("Error reading chunk object %v: %v", staged, err.Error())
+	}
+	shaRecalc := NewLOBHashForSHA(chunksha)
+	_, err = io.Copy(shaRecalc, f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Error reading chunk object %v: %v", staged, err.Error())
+	}
+	if fmt.Sprintf("%x", string(shaRecalc.Sum(nil))) != chunksha {
+		return NewIntegrityError([]string{chunksha})
+	}
+	err = r.moveFetchedFileIntoStore(staged, getLOBStoreFilePath(destRoot, rel), destRoot)
+	if err != nil {
+		return fmt.Errorf("Unable to move %v into the store: %v", staged, err.Error())
+	}
+	return nil
+}
+
+// Move a verified file into the store, holding its lock if that's the shared store so that it
+// isn't replaced while another repo is checking or linking it
+func (r *Repo) moveFetchedFileIntoStore(staged, dest, destRoot string) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	if r.IsUsingSharedStorage() && destRoot == r.GetSharedLOBRoot() {
+		l, err := r.lockSharedStoreFile(dest)
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+	}
+	return os.Rename(staged, dest)
+}
+
+// Check the content of a binary downloaded to stagingRoot against its SHA, reading any chunks which
+// weren't downloaded from destRoot
+// Returns complete = false if any chunk isn't present in either or none were downloaded, & an
+// error if the content is corrupt
+func (r *Repo) verifyFetchedLOB(sha, stagingRoot, destRoot string) (info *LOBInfo, complete bool, _err error) {
+	info, err := r.getLOBInfoInBaseDir(sha, destRoot)
+	if err != nil {
+		// Metadata wasn't fetched, already reported
+		return nil, false, nil
+	}
+	files := make([]string, info.NumChunks)
+	anyStaged := false
+	for i := 0; i < info.NumChunks; i++ {
+		rel := getLOBChunkRelativePathForInfo(info, i)
+		expectedSize := getLOBExpectedChunkSize(info, i)
+		files[i] = filepath.Join(stagingRoot, rel)
+		if util.FileExistsAndIsOfSize(files[i], expectedSize) {
+			anyStaged = true
+		} else {
+			files[i] = getLOBStoreFilePath(destRoot, rel)
+			if !util.FileExistsAndIsOfSize(files[i], expectedSize) {
+				return info, false, nil
+			}
+		}
+	}
+	if !anyStaged {
+		// Nothing of ours to check
+		return info, false, nil
+	}
+	shaRecalc := NewLOBHashForSHA(sha)
+	for i, file := range files {
+		// Compressed chunks are decompressed, which also verifies each frame's checksum
+		_, err = copyLOBChunkContentRange(file, info, i, 0, getLOBChunkContentSize(info, i), shaRecalc)
+		if err != nil {
+			return info, false, err
+		}
+	}
+	shaRecalcStr := fmt.Sprintf("%x", string(shaRecalc.Sum(nil)))
+	if shaRecalcStr != sha {
+		return info, false, NewIntegrityError([]string{sha})
+	}
+	return info, true, nil
+}
+
+// Move the downloaded chunks of a corrupt binary to a new folder in the quarantine, along with a
+// copy of its metadata
+// Folders are <time>/<sha>, so that the quarantine never looks like part of a store
+func (r *Repo) quarantineFetchedLOB(info *LOBInfo, stagingRoot, destRoot string) {
+	dir := filepath.Join(r.GetQuarantineRoot(), time.Now().Format("20060102150405"), info.SHA)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		r.Log.Errorf("Unable to create quarantine folder %v: %v\n", dir, err.Error())
+	}
+	for i := 0; i < info.NumChunks; i++ {
+		staged := filepath.Join(stagingRoot, getLOBChunkRelativePathForInfo(info, i))
+		if !util.FileExists(staged) {
+			continue
+		}
+		err = os.Rename(staged, filepath.Join(dir, filepath.Base(staged)))
+		if err != nil {
+			// Must not be used next time whatever happens
+			r.Log.Errorf("Unable to quarantine %v, deleting: %v\n", staged, err.Error())
+			os.Remove(staged)
+		}
+	}
+	metafile := r.GetLOBMetaPathInBaseDir(destRoot, info.SHA)
+	err = copyFileForQuarantine(metafile, filepath.Join(dir, filepath.Base(metafile)))
+	if err != nil {
+		r.Log.Debugf("Unable to copy %v to quarantine: %v\n", metafile, err.Error())
+	}
+}
+
+func copyFileForQuarantine(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeerr := out.Close(); err == nil {
+		err = closeerr
+	}
+	return err
+}
@@ -1,8 +1,14 @@
 package core
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/atlassian/git-lob/util"
 )
@@ -13,33 +19,196 @@ import (
 const SHAPrefix = "git-lob: "
 const SHALen = 40
 const SHALineLen = len(SHAPrefix) + SHALen
-const SHALineRegexStr = "^git-lob: [A-Fa-f0-9]{40}$"
-const SHALineMatchRegexStr = "^git-lob: ([0-9A-Fa-f]{40})$"
+
+// SHA-256 binaries are identified in placeholders as sha256:<sha>, so those are longer
+const SHA256Prefix = "sha256:"
+const SHA256LineLen = len(SHAPrefix) + len(SHA256Prefix) + SHA256Len
+
+// Matches the identifier in a placeholder, either kind; use parseLOBPlaceholderSHA on it
+// Extended regex so that git can use it too (e.g. git log -G)
+const SHAPlaceholderRegexFragment = "[A-Fa-f0-9]{40}|sha256:[A-Fa-f0-9]{64}"
+const SHALineRegexStr = "^git-lob: (" + SHAPlaceholderRegexFragment + ")$"
+const SHALineMatchRegexStr = SHALineRegexStr
+
+// Placeholders can optionally have a second line with the size & type of the content
+// (git-lob.placeholder-metadata), e.g. 'git-lob-meta: size=1048576 type=png'
+// Older versions only look at the first line so still understand these placeholders
+const PlaceholderMetaPrefix = "git-lob-meta: "
+
+// Longest type tag included in placeholder metadata
+const placeholderTypeMaxLen = 16
+
+// Longest a placeholder can be, including metadata
+const MaxLOBPlaceholderLen = SHA256LineLen + 1 + len(PlaceholderMetaPrefix) + len("size=") + 20 + len(" type=") + placeholderTypeMaxLen
+
+var placeholderMetaRegex = regexp.MustCompile(`^` + PlaceholderMetaPrefix + `size=(\d+)(?: type=([a-z0-9]{1,16}))?$`)
+
+// What a placeholder says about a binary
+type LOBPlaceholder struct {
+	SHA string
+	// Size of the content, or -1 if the placeholder has no metadata
+	Size int64
+	// Short type tag (lower case file extension), blank if unknown
+	Type string
+}
 
 func getLOBPlaceholderContent(sha string) string {
-	return SHAPrefix + sha
+	return SHAPrefix + getLOBPlaceholderSHA(sha)
+}
+
+// Get the placeholder for a binary stored from filename, including metadata if
+// git-lob.placeholder-metadata is enabled; files whose content hasn't changed keep the placeholder
+// they have, with or without metadata (see storeLOBForCleanFile)
+func (r *Repo) getLOBPlaceholderContentForFile(sha string, size int64, filename string) string {
+	if !r.Options.PlaceholderMetadata {
+		return getLOBPlaceholderContent(sha)
+	}
+	meta := fmt.Sprintf("%vsize=%d", PlaceholderMetaPrefix, size)
+	if tag := getPlaceholderTypeTag(filename); tag != "" {
+		meta += " type=" + tag
+	}
+	return getLOBPlaceholderContent(sha) + "\n" + meta
+}
+
+// Type tag for a file in placeholder metadata, its extension if that's short & simple
+func getPlaceholderTypeTag(filename string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	if len(ext) == 0 || len(ext) > placeholderTypeMaxLen {
+		return ""
+	}
+	for _, c := range ext {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// Is a size the size of a placeholder of either kind, with or without metadata?
+func isLOBPlaceholderSize(size int64) bool {
+	return size >= int64(SHALineLen) && size <= int64(MaxLOBPlaceholderLen)
+}
+
+// Parse the entire content of a file as a placeholder; unlike matchLOBPlaceholder the
+// content must be nothing but a placeholder, with or without metadata
+func parseLOBPlaceholder(content []byte) (*LOBPlaceholder, bool) {
+	if !isLOBPlaceholderSize(int64(len(content))) {
+		return nil, false
+	}
+	lines := strings.SplitN(string(content), "\n", 2)
+	match := shaLineRegex.FindStringSubmatch(lines[0])
+	if match == nil {
+		return nil, false
+	}
+	ret := &LOBPlaceholder{SHA: parseLOBPlaceholderSHA(match[1]), Size: -1}
+	if len(lines) == 1 {
+		return ret, true
+	}
+	meta := placeholderMetaRegex.FindStringSubmatch(lines[1])
+	if meta == nil {
+		return nil, false
+	}
+	size, err := strconv.ParseInt(meta[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	ret.Size = size
+	ret.Type = meta[2]
+	return ret, true
+}
+
+// Make room for size bytes in a file we're about to write, if it's a regular file, so
+// that large binaries are less fragmented & running out of space is found out early
+// Writing then overwrites from the start; the file ends up the same size either way
+// Returns whether the file was preallocated, see undoPreallocateFile
+func (r *Repo) preallocateFile(w io.Writer, size int64) bool {
+	f, ok := w.(*os.File)
+	if !ok || size <= 0 {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	if pos, err := f.Seek(0, io.SeekCurrent); err != nil || pos != 0 || fi.Size() != 0 {
+		return false
+	}
+	if err := f.Truncate(size); err != nil {
+		r.Log.Debugf("Unable to preallocate %v: %v\n", util.FormatSize(size), err)
+		return false
+	}
+	return true
 }
 
-func SmudgeFilterWithReaderWriter(in io.Reader, out io.Writer, filename string) int {
-	util.LogDebug("Running smudge filter for ", filename)
+// Empty a preallocated file again so something else can be written instead
+func undoPreallocateFile(w io.Writer) {
+	f := w.(*os.File)
+	f.Truncate(0)
+	f.Seek(0, io.SeekStart)
+}
+
+var shaLineRegex = regexp.MustCompile(SHALineMatchRegexStr)
+
+// Get the binary SHA from the start of some content if it's a placeholder of either kind
+func matchLOBPlaceholder(buf []byte) (string, bool) {
+	for _, l := range []int{SHA256LineLen, SHALineLen} {
+		if len(buf) >= l {
+			if match := shaLineRegex.FindStringSubmatch(string(buf[:l])); match != nil {
+				return parseLOBPlaceholderSHA(match[1]), true
+			}
+		}
+	}
+	return "", false
+}
+
+func (r *Repo) SmudgeFilterWithReaderWriter(in io.Reader, out io.Writer, filename string) int {
+	r.Log.Debug("Running smudge filter for ", filename)
 
-	shaRegex := regexp.MustCompile(SHALineMatchRegexStr)
 	// read committed content from stdin
 	// write actual file content to stdout if a git-lob SHA
-	buf := make([]byte, SHALineLen)
-	c, err := in.Read(buf)
-	if c == SHALineLen {
-		if match := shaRegex.FindStringSubmatch(string(buf)); match != nil {
-			sha := match[1]
-			lobinfo, err := RetrieveLOB(sha, out)
+	// Read enough for a placeholder with metadata, but small files may be shorter
+	buf := make([]byte, MaxLOBPlaceholderLen+1)
+	c, err := io.ReadFull(in, buf)
+	if c >= SHALineLen {
+		if sha, ok := matchLOBPlaceholder(buf[:c]); ok {
+			preallocated := false
+			if placeholder, ok := parseLOBPlaceholder(buf[:c]); ok {
+				preallocated = r.preallocateFile(out, placeholder.Size)
+			}
+			if r.smudgeCacheEnabled() {
+				if size, ok := r.restoreFromSmudgeCache(sha, out); ok {
+					if preallocated {
+						// Don't trust the placeholder to have had the right size
+						out.(*os.File).Truncate(size)
+					}
+					r.Log.Debugf("Successfully smudged %v: %v from smudge cache %v\n", filename, util.FormatSize(size), sha)
+					return 0
+				}
+			}
+			var cacheEntry *smudgeCacheEntry
+			if r.smudgeCacheEnabled() && r.isWorthSmudgeCaching(sha) {
+				cacheEntry = r.newSmudgeCacheEntry()
+			}
+			// git can take a while to restore a large file, show that it's happening
+			progress := r.Log.NewItemProgressReporter("git-lob: Restoring", filename)
+			lobinfo, err := r.RetrieveLOBWithProgress(sha, cacheEntry.Writer(out), progress.Callback)
+			progress.Finish(err == nil)
 			if err == nil {
-				util.LogDebugf("Successfully smudged %v: %v in %v chunks from %v\n", filename, util.FormatSize(lobinfo.Size), lobinfo.NumChunks, sha)
+				cacheEntry.Commit(sha, lobinfo.Size)
+				if preallocated {
+					out.(*os.File).Truncate(lobinfo.Size)
+				}
+				r.Log.Debugf("Successfully smudged %v: %v in %v chunks from %v\n", filename, util.FormatSize(lobinfo.Size), lobinfo.NumChunks, sha)
 				return 0
 			} else {
+				cacheEntry.Discard()
+				if preallocated {
+					undoPreallocateFile(out)
+				}
 				if IsNotFoundError(err) {
-					util.LogErrorf("%v: content not available, placeholder used [%v]\n", filename, sha[:7])
+					r.Log.Errorf("%v: content not available, placeholder used [%v]\n", filename, sha[:7])
 				} else {
-					util.LogErrorf("Error obtaining %v for %v: %v\n", sha, filename, err)
+					r.Log.Errorf("Error obtaining %v for %v: %v\n", sha, filename, err)
 				}
 				// fall through to below which will just write the SHA line to the working copy
 			}
@@ -50,54 +219,220 @@ func SmudgeFilterWithReaderWriter(in io.Reader, out io.Writer, filename string)
 	out.Write(buf[:c])
 	_, err = io.Copy(out, in)
 	if err != nil {
-		util.LogErrorf("Error copying stdin->stdout for %v: %v\n", filename, err)
+		r.Log.Errorf("Error copying stdin->stdout for %v: %v\n", filename, err)
 		return 3
 	}
 
 	return 0
 }
 
-func CleanFilterWithReaderWriter(in io.Reader, out io.Writer, filename string) int {
-	util.LogDebug("Running clean filter for ", filename)
-	shaRegex := regexp.MustCompile(SHALineMatchRegexStr)
+func (r *Repo) CleanFilterWithReaderWriter(in io.Reader, out io.Writer, filename string) int {
+	r.Log.Debug("Running clean filter for ", filename)
 	// read working copy content from stdin
 	// First check if this is an unexpanded LOB SHA (not downloaded)
-	buf := make([]byte, SHALineLen)
-	c, err := in.Read(buf)
-	if c == SHALineLen {
-		if match := shaRegex.FindStringSubmatch(string(buf)); match != nil {
-			sha := match[1]
-			util.LogDebugf("Unexpanded LOB file content at %v, not storing\n", filename)
+	buf := make([]byte, SHA256LineLen)
+	c, err := io.ReadFull(in, buf)
+	if c >= SHALineLen {
+		if sha, ok := matchLOBPlaceholder(buf[:c]); ok {
+			r.Log.Debugf("Unexpanded LOB file content at %v, not storing\n", filename)
 			// Yes, unexpanded SHA, just write
 			out.Write(buf[:c])
 			_, err = io.Copy(out, in)
 			if err == nil {
-				util.LogDebug("Successful clean filter for ", filename)
+				r.Log.Debug("Successful clean filter for ", filename)
 				return 0
 			} else {
-				util.LogErrorf("Error writing unexpanded LOB for %v/%v in clean filter: %v\n", filename, sha, err)
+				r.Log.Errorf("Error writing unexpanded LOB for %v/%v in clean filter: %v\n", filename, sha, err)
 				return 3
 			}
 
 		}
 	}
+	// Paths listed in .gitlobignore go into git as they are
+	if r.IsLOBIgnored(filename) {
+		r.Log.Debugf("%v is listed in %v, committing content verbatim\n", filename, LOBIgnoreFilename)
+		out.Write(buf[:c])
+		if _, err = io.Copy(out, in); err != nil {
+			r.Log.Errorf("Error copying stdin->stdout for %v: %v\n", filename, err)
+			return 3
+		}
+		return 0
+	}
 	// Otherwise if we got here, this is just binary data we need to hash
-	lobinfo, err := StoreLOB(in, buf[:c])
+	// Don't store anything too large to commit; the file is usually there to check first, so
+	// we don't have to read it all to find out
+	var guard *sizeGuardReader
+	if rejectSize := r.Options.RejectAboveSize; rejectSize > 0 {
+		if fi, err := os.Stat(r.absPath(filename)); err == nil && fi.Mode().IsRegular() && fi.Size() > rejectSize {
+			r.logCleanFileRejected(filename, fi.Size())
+			return 7
+		}
+		guard = &sizeGuardReader{r: in, limit: rejectSize, remaining: rejectSize - int64(c)}
+		in = guard
+	}
+	// Someone else may be changing this file; if it's clearly changed don't store it at all
+	lock := r.getOthersLockForFile(filename)
+	if lock != nil {
+		size := int64(-1)
+		if fi, err := os.Stat(r.absPath(filename)); err == nil && fi.Mode().IsRegular() {
+			size = fi.Size()
+		}
+		if !r.checkLockBeforeStore(filename, size, lock) {
+			return 6
+		}
+	}
+	// If it won't be stored as a plain copy, keep it in the smudge cache in case git wants it
+	// back soon, e.g. 'git stash'; a clone of the working copy file is free if possible
+	var cacheEntry *smudgeCacheEntry
+	src := in
+	if r.smudgeCacheEnabled() && !r.isStoringPlainContent() {
+		cacheEntry = r.newSmudgeCacheEntryFromReflink(r.absPath(filename))
+		if cacheEntry == nil {
+			cacheEntry = r.newSmudgeCacheEntry()
+		}
+		if cacheEntry != nil {
+			w := cacheEntry.Writer(ioutil.Discard)
+			w.Write(buf[:c])
+			src = io.TeeReader(in, w)
+		}
+	}
+	lobinfo, shaLine, err := r.storeLOBForCleanFile(src, buf[:c], filename)
 
 	if err != nil {
-		util.LogErrorf("Error storing LOB from %v in clean filter: %v\n", filename, err)
+		cacheEntry.Discard()
+		if guard != nil && guard.exceeded {
+			r.logCleanFileRejected(filename, -1)
+			return 7
+		}
+		r.Log.Errorf("Error storing LOB from %v in clean filter: %v\n", filename, err)
 		return 4
 	}
+	cacheEntry.Commit(lobinfo.SHA, lobinfo.Size)
+
+	r.checkCleanFileSize(filename, lobinfo)
+	r.generateLOBPreviewOrWarn(lobinfo.SHA, filename)
+
+	if lock != nil && !r.checkLockBeforeCommit(filename, lobinfo.SHA) {
+		return 6
+	}
 
 	// Write SHA code to output
-	shaLine := getLOBPlaceholderContent(lobinfo.SHA)
 	_, err = io.WriteString(out, shaLine)
 	if err != nil {
-		util.LogErrorf("Error writing LOB SHA for %v to index in clean filter: %v\n", filename, err)
+		r.Log.Errorf("Error writing LOB SHA for %v to index in clean filter: %v\n", filename, err)
 		return 5
 	}
 
-	util.LogDebug("Successful clean filter for ", filename)
+	r.Log.Debug("Successful clean filter for ", filename)
 
 	return 0
 }
+
+// Store content being cleaned & get the placeholder to write to the index for it
+// git cleans files again whenever they're touched, so if the index already has a placeholder for
+// the file & the content hasn't changed, that placeholder is used exactly as it is, even if new
+// content would be identified with another hash algorithm now (git-lob.hash-algorithm has changed
+// since) or it has metadata when git-lob.placeholder-metadata is off, or vice versa (see
+// isPlaceholderCompatible); otherwise git would show the file as modified, & commit it as a new
+// binary if the algorithm changed. So the content is hashed with the algorithm of the binary in
+// the index, & only identified according to git-lob.hash-algorithm if it turns out to have changed
+func (r *Repo) storeLOBForCleanFile(in io.Reader, leader []byte, filename string) (*LOBInfo, string, error) {
+	hashAlgorithm := r.Options.HashAlgorithm
+	var committed *LOBPlaceholder
+	var committedContent []byte
+	var previous string
+	if filename != "" {
+		committed, committedContent = r.getGitIndexPlaceholderForPath(filename)
+	}
+	if committed != nil {
+		hashAlgorithm = GetLOBSHAAlgorithm(committed.SHA)
+		if r.appendChunkingEnabled() {
+			previous = committed.SHA
+		}
+	}
+	info, err := r.storeLOB(in, leader, previous, hashAlgorithm)
+	if err != nil {
+		return nil, "", err
+	}
+	if committed != nil && info.SHA == committed.SHA {
+		if isPlaceholderCompatible(committed, info) {
+			return info, string(committedContent), nil
+		}
+		// Same binary, but the placeholder's metadata is wrong
+		return info, r.getLOBPlaceholderContentForFile(info.SHA, info.Size, filename), nil
+	}
+	if hashAlgorithm != r.Options.HashAlgorithm {
+		// Changed, so it's a new binary; the copy stored to find that out isn't referenced
+		// by anything, so it's removed by prune
+		info, err = r.storeLOBCopyWithHash(info.SHA, previous, r.Options.HashAlgorithm)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return info, r.getLOBPlaceholderContentForFile(info.SHA, info.Size, filename), nil
+}
+
+// Store the content of a binary already in the store again, with its SHA calculated with another
+// hash algorithm
+func (r *Repo) storeLOBCopyWithHash(sha, previous, hashAlgorithm string) (*LOBInfo, error) {
+	rd, w := io.Pipe()
+	go func() {
+		_, err := r.RetrieveLOB(sha, w)
+		w.CloseWithError(err)
+	}()
+	info, err := r.storeLOB(rd, nil, previous, hashAlgorithm)
+	// Stop retrieving if storing failed part way
+	rd.Close()
+	return info, err
+}
+
+// Reader which fails once more than a number of bytes have been read (git-lob.reject-above-size)
+type sizeGuardReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+	exceeded  bool
+}
+
+func (self *sizeGuardReader) Read(p []byte) (int, error) {
+	n, err := self.r.Read(p)
+	self.remaining -= int64(n)
+	if self.remaining < 0 {
+		self.exceeded = true
+		return n, fmt.Errorf("Content is larger than %v", util.FormatSize(self.limit))
+	}
+	return n, err
+}
+
+// Report that a file is too large to be added, size -1 if not known
+func (r *Repo) logCleanFileRejected(filename string, size int64) {
+	desc := "larger than " + util.FormatSize(r.Options.RejectAboveSize)
+	if size >= 0 {
+		desc = util.FormatSize(size)
+	}
+	r.Log.Errorf("%v is %v, which is above git-lob.reject-above-size so it can't be added. "+
+		"If you really meant to add it, raise the limit.\n", filename, desc)
+}
+
+// Warn about files which are suspiciously large, or so small they may be better off in git
+// (git-lob.warn-above-size & git-lob.hint-below-size); only when they've changed, since git
+// runs the clean filter on unchanged files too
+func (r *Repo) checkCleanFileSize(filename string, lobinfo *LOBInfo) {
+	warnSize := r.Options.WarnAboveSize
+	hintSize := r.Options.HintBelowSize
+	tooLarge := warnSize > 0 && lobinfo.Size > warnSize
+	tooSmall := hintSize > 0 && lobinfo.Size < hintSize
+	if !tooLarge && !tooSmall {
+		return
+	}
+	if committed, err := r.getLOBSHAForPathAtCommit(filepath.ToSlash(filename), "HEAD"); err == nil && committed == lobinfo.SHA {
+		return
+	}
+	if tooLarge {
+		r.Log.Errorf("Warning: %v is %v, are you sure it should be committed? (git-lob.warn-above-size)\n",
+			filename, util.FormatSize(lobinfo.Size))
+	} else {
+		r.Log.Errorf("Hint: %v is only %v, it may be better stored in git itself; see 'git lob untrack' (git-lob.hint-below-size)\n",
+			filename, util.FormatSize(lobinfo.Size))
+	}
+}
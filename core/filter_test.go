@@ -2,8 +2,14 @@ package core
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
@@ -39,7 +45,7 @@ in a string
 that we should absolutely not mess with`
 			inBuffer := bytes.NewBufferString(nonLOBString)
 			var outBuffer bytes.Buffer
-			res := SmudgeFilterWithReaderWriter(inBuffer, &outBuffer, "testfile.txt")
+			res := testRepo().SmudgeFilterWithReaderWriter(inBuffer, &outBuffer, "testfile.txt")
 			Expect(res).To(Equal(0), "smudge filter should succeed")
 			Expect(outBuffer.String()).To(BeEquivalentTo(nonLOBString), "non LOB should not be modified by smudge")
 		})
@@ -50,7 +56,7 @@ that we should absolutely not mess with`
 			lobString := SHAPrefix + "0123456789abcdef0123456789abcdef01234567"
 			inBuffer := bytes.NewBufferString(lobString)
 			var outBuffer bytes.Buffer
-			res := SmudgeFilterWithReaderWriter(inBuffer, &outBuffer, "testfile.txt")
+			res := testRepo().SmudgeFilterWithReaderWriter(inBuffer, &outBuffer, "testfile.txt")
 			Expect(res).To(Equal(0), "smudge filter should succeed")
 			Expect(outBuffer.String()).To(BeEquivalentTo(lobString), "non existent LOB should not be modified by smudge")
 		})
@@ -60,7 +66,7 @@ that we should absolutely not mess with`
 			lobString := SHAPrefix + lobinfo.SHA
 			inBuffer := bytes.NewBufferString(lobString)
 			var outBuffer bytes.Buffer
-			res := SmudgeFilterWithReaderWriter(inBuffer, &outBuffer, "testfile.txt")
+			res := testRepo().SmudgeFilterWithReaderWriter(inBuffer, &outBuffer, "testfile.txt")
 			Expect(res).To(Equal(0), "smudge filter should succeed")
 			Expect(outBuffer.Len()).To(BeEquivalentTo(lobinfo.Size), "extracted LOB data should be correct size")
 		})
@@ -70,13 +76,90 @@ that we should absolutely not mess with`
 			lobString := SHAPrefix + lobinfo.SHA
 			inBuffer := bytes.NewBufferString(lobString)
 			var outBuffer bytes.Buffer
-			res := SmudgeFilterWithReaderWriter(inBuffer, &outBuffer, "testfile.txt")
+			res := testRepo().SmudgeFilterWithReaderWriter(inBuffer, &outBuffer, "testfile.txt")
 			Expect(res).To(Equal(0), "smudge filter should succeed")
 			Expect(outBuffer.Len()).To(BeEquivalentTo(lobinfo.Size), "extracted LOB data should be correct size")
 		})
 
 	})
 
+	Describe("Smudge cache", func() {
+		AfterEach(func() {
+			GlobalOptions.SmudgeCacheTTL = 0
+			GlobalOptions.Compression = ""
+		})
+
+		It("restores recently cleaned content without the store", func() {
+			GlobalOptions.SmudgeCacheTTL = time.Minute
+			// Plain content is never cached, the store is as fast
+			testFileName := "small.dat"
+			info := CreateSmallTestLOBFileForStoring(testFileName)
+			in, _ := os.OpenFile(testFileName, os.O_RDONLY, 0644)
+			var outBuffer bytes.Buffer
+			Expect(testRepo().CleanFilterWithReaderWriter(in, &outBuffer, testFileName)).To(Equal(0), "clean filter should succeed")
+			in.Close()
+			_, err := os.Stat(testRepo().getSmudgeCacheFile(info.SHA))
+			Expect(os.IsNotExist(err)).To(BeTrue(), "Plain content should not be cached")
+
+			GlobalOptions.Compression = CompressionGzip
+			testFileName = "small2.dat"
+			info = CreateSmallTestLOBFileForStoring(testFileName)
+			content, _ := ioutil.ReadFile(testFileName)
+			in, _ = os.OpenFile(testFileName, os.O_RDONLY, 0644)
+			outBuffer.Reset()
+			Expect(testRepo().CleanFilterWithReaderWriter(in, &outBuffer, testFileName)).To(Equal(0), "clean filter should succeed")
+			in.Close()
+			Expect(outBuffer.String()).To(BeEquivalentTo(SHAPrefix + info.SHA))
+
+			// Remove from store, smudge should still work
+			testRepo().DeleteLOB(info.SHA)
+			outBuffer.Reset()
+			res := testRepo().SmudgeFilterWithReaderWriter(bytes.NewBufferString(SHAPrefix+info.SHA), &outBuffer, testFileName)
+			Expect(res).To(Equal(0), "smudge filter should succeed")
+			Expect(outBuffer.Bytes()).To(Equal(content), "Should restore content from cache")
+
+			// Corrupt entries are never used, & removed
+			ioutil.WriteFile(testRepo().getSmudgeCacheFile(info.SHA), []byte("Not the right content"), 0644)
+			outBuffer.Reset()
+			res = testRepo().SmudgeFilterWithReaderWriter(bytes.NewBufferString(SHAPrefix+info.SHA), &outBuffer, testFileName)
+			Expect(res).To(Equal(0), "smudge filter should succeed")
+			Expect(outBuffer.String()).To(BeEquivalentTo(SHAPrefix+info.SHA), "Should fall back on placeholder")
+			_, err = os.Stat(testRepo().getSmudgeCacheFile(info.SHA))
+			Expect(os.IsNotExist(err)).To(BeTrue(), "Invalid entry should be removed")
+		})
+
+		It("caches smudged content & expires entries", func() {
+			GlobalOptions.SmudgeCacheTTL = time.Minute
+			GlobalOptions.Compression = CompressionGzip
+			testFileName := "small.dat"
+			info := CreateSmallTestLOBFileForStoring(testFileName)
+			content, _ := ioutil.ReadFile(testFileName)
+			f, _ := os.Open(testFileName)
+			_, err := testRepo().StoreLOB(f, nil)
+			f.Close()
+			Expect(err).To(BeNil())
+
+			var outBuffer bytes.Buffer
+			res := testRepo().SmudgeFilterWithReaderWriter(bytes.NewBufferString(SHAPrefix+info.SHA), &outBuffer, testFileName)
+			Expect(res).To(Equal(0), "smudge filter should succeed")
+			Expect(outBuffer.Bytes()).To(Equal(content))
+			cached, err := ioutil.ReadFile(testRepo().getSmudgeCacheFile(info.SHA))
+			Expect(err).To(BeNil(), "Compressed content should be cached when smudged")
+			Expect(cached).To(Equal(content))
+
+			// Expired entries are not used
+			old := time.Now().Add(-2 * time.Minute)
+			os.Chtimes(testRepo().getSmudgeCacheFile(info.SHA), old, old)
+			testRepo().DeleteLOB(info.SHA)
+			outBuffer.Reset()
+			res = testRepo().SmudgeFilterWithReaderWriter(bytes.NewBufferString(SHAPrefix+info.SHA), &outBuffer, testFileName)
+			Expect(res).To(Equal(0), "smudge filter should succeed")
+			Expect(outBuffer.String()).To(BeEquivalentTo(SHAPrefix+info.SHA), "Expired entry should not be used")
+			_, err = os.Stat(testRepo().getSmudgeCacheFile(info.SHA))
+			Expect(os.IsNotExist(err)).To(BeTrue(), "Expired entry should be removed")
+		})
+	})
+
 	Describe("Clean filter", func() {
 
 		It("doesn't change unexpanded LOB content", func() {
@@ -85,7 +168,7 @@ that we should absolutely not mess with`
 			lobString := SHAPrefix + "0123456789abcdef0123456789abcdef01234567"
 			inBuffer := bytes.NewBufferString(lobString)
 			var outBuffer bytes.Buffer
-			res := CleanFilterWithReaderWriter(inBuffer, &outBuffer, "testfile.txt")
+			res := testRepo().CleanFilterWithReaderWriter(inBuffer, &outBuffer, "testfile.txt")
 			Expect(res).To(Equal(0), "clean filter should succeed")
 			Expect(outBuffer.String()).To(BeEquivalentTo(lobString), "unexpanded LOB should not be modified by clean")
 
@@ -96,14 +179,300 @@ that we should absolutely not mess with`
 			info := CreateSmallTestLOBFileForStoring(testFileName)
 			in, _ := os.OpenFile(testFileName, os.O_RDONLY, 0644)
 			var outBuffer bytes.Buffer
-			res := CleanFilterWithReaderWriter(in, &outBuffer, "testfile.txt")
+			res := testRepo().CleanFilterWithReaderWriter(in, &outBuffer, "testfile.txt")
 			Expect(res).To(Equal(0), "clean filter should succeed")
 			Expect(outBuffer.String()).To(BeEquivalentTo(SHAPrefix+info.SHA), "clean filter should output SHA reference")
-			readinfo, _ := GetLOBInfo(info.SHA)
+			readinfo, _ := testRepo().GetLOBInfo(info.SHA)
 			Expect(readinfo).To(Equal(info))
 
 		})
 
+		It("rejects content above reject-above-size", func() {
+			oldOptions := *GlobalOptions
+			defer func() { *GlobalOptions = oldOptions }()
+			GlobalOptions.RejectAboveSize = 1000
+
+			// Streamed content, no file to check first
+			var outBuffer bytes.Buffer
+			res := testRepo().CleanFilterWithReaderWriter(bytes.NewReader(make([]byte, 5000)), &outBuffer, "notafile.dat")
+			Expect(res).To(Equal(7), "clean filter should reject content above the limit")
+			Expect(outBuffer.Len()).To(Equal(0), "no reference should be output")
+
+			// File checked before reading
+			testFileName := path.Join(root, "large.dat")
+			ioutil.WriteFile(testFileName, make([]byte, 2000), 0644)
+			in, _ := os.OpenFile(testFileName, os.O_RDONLY, 0644)
+			res = testRepo().CleanFilterWithReaderWriter(in, &outBuffer, testFileName)
+			in.Close()
+			Expect(res).To(Equal(7), "clean filter should reject file above the limit")
+			Expect(outBuffer.Len()).To(Equal(0), "no reference should be output")
+
+			// Under the limit is fine
+			res = testRepo().CleanFilterWithReaderWriter(bytes.NewReader(make([]byte, 1000)), &outBuffer, "small.dat")
+			Expect(res).To(Equal(0), "clean filter should accept content up to the limit")
+			Expect(outBuffer.String()).To(HavePrefix(SHAPrefix))
+		})
+
+		It("passes through files listed in .gitlobignore", func() {
+			ioutil.WriteFile(path.Join(root, LOBIgnoreFilename), []byte(`# Reference images
+test/fixtures/**/*.png
+!test/fixtures/large/
+small-*.jpg
+build/
+`), 0644)
+			for filename, ignored := range map[string]bool{
+				"test/fixtures/ref.png":        true,
+				"test/fixtures/a/b/ref.png":    true,
+				"test/fixtures/large/ref.png":  true, // can't re-include a directory
+				"test/fixtures/ref.psd":        false,
+				"other/test/fixtures/ref.png":  false,
+				"art/small-icon.jpg":           true,
+				"art/large-icon.jpg":           false,
+				"build/out/image.png":          true,
+				"src/build":                    false, // only directories
+				"src/build/image.png":          true,
+				"small-icon.jpg/not-a-jpg.png": true,
+			} {
+				Expect(testRepo().IsLOBIgnored(filename)).To(Equal(ignored), filename)
+			}
+
+			content := []byte("small reference image")
+			var outBuffer bytes.Buffer
+			res := testRepo().CleanFilterWithReaderWriter(bytes.NewReader(content), &outBuffer, "test/fixtures/ref.png")
+			Expect(res).To(Equal(0), "clean filter should succeed")
+			Expect(outBuffer.Bytes()).To(Equal(content), "content should be committed verbatim")
+			outBuffer.Reset()
+			res = testRepo().CleanFilterWithReaderWriter(bytes.NewReader(content), &outBuffer, "art/hero.png")
+			Expect(res).To(Equal(0), "clean filter should succeed")
+			Expect(outBuffer.String()).To(HavePrefix(SHAPrefix))
+		})
+
+	})
+
+	Describe("Previews", func() {
+
+		It("generates previews with the command for the file's extension", func() {
+			oldOptions := *GlobalOptions
+			defer func() { *GlobalOptions = oldOptions }()
+			GlobalOptions.PreviewCommands = map[string]string{
+				"png": `head -c 4; printf " $GIT_LOB_PREVIEW_PATH"`,
+				"psd": "exit 1",
+				"tga": "cat",
+			}
+			GlobalOptions.PreviewMaxSize = 100
+
+			clean := func(filename string, content []byte) string {
+				var outBuffer bytes.Buffer
+				res := testRepo().CleanFilterWithReaderWriter(bytes.NewReader(content), &outBuffer, filename)
+				Expect(res).To(Equal(0), "clean filter should succeed even if there's no preview")
+				return strings.TrimPrefix(outBuffer.String(), SHAPrefix)
+			}
+			sha := clean("art/hero.PNG", bytes.Repeat([]byte("abcd"), 100))
+			Expect(testRepo().HasLocalLOBPreview(sha)).To(BeTrue(), "preview should be generated, extension is case-insensitive")
+			preview, err := testRepo().ReadLocalLOBPreview(sha)
+			Expect(err).To(BeNil())
+			Expect(string(preview)).To(Equal("abcd art/hero.PNG"), "command should get the content & path")
+
+			sha = clean("art/layers.psd", bytes.Repeat([]byte("efgh"), 100))
+			Expect(testRepo().HasLocalLOBPreview(sha)).To(BeFalse(), "failed command should leave no preview")
+			sha = clean("art/texture.tga", bytes.Repeat([]byte("ijkl"), 100))
+			Expect(testRepo().HasLocalLOBPreview(sha)).To(BeFalse(), "preview over git-lob.preview-max-size should be discarded")
+			sha = clean("data/file.dat", bytes.Repeat([]byte("mnop"), 100))
+			Expect(testRepo().HasLocalLOBPreview(sha)).To(BeFalse(), "no command, no preview")
+			_, err = testRepo().ReadLocalLOBPreview(sha)
+			Expect(IsNotFoundError(err)).To(BeTrue())
+
+			Expect(getPreviewExtension([]byte("\x89PNG\r\n\x1a\n..."))).To(Equal(".png"))
+			Expect(getPreviewExtension([]byte("\xff\xd8\xff\xe0..."))).To(Equal(".jpg"))
+			Expect(getPreviewExtension([]byte(`<?xml version="1.0"?><svg></svg>`))).To(Equal(".svg"))
+		})
+
+	})
+
+	Describe("SHA-256 binaries", func() {
+		AfterEach(func() {
+			GlobalOptions = NewOptions()
+		})
+
+		It("stores new binaries with SHA-256 & still reads SHA-1 ones", func() {
+			oldcontent := "Content stored before switching to SHA-256"
+			var outBuffer bytes.Buffer
+			Expect(testRepo().CleanFilterWithReaderWriter(bytes.NewBufferString(oldcontent), &outBuffer, "old.dat")).To(Equal(0), "clean filter should succeed")
+			oldsha := fmt.Sprintf("%x", sha1.Sum([]byte(oldcontent)))
+			oldplaceholder := outBuffer.String()
+			Expect(oldplaceholder).To(Equal(SHAPrefix+oldsha), "SHA-1 should be used by default")
+
+			GlobalOptions.HashAlgorithm = HashAlgorithmSHA256
+			newcontent := "Content stored after switching to SHA-256"
+			outBuffer.Reset()
+			Expect(testRepo().CleanFilterWithReaderWriter(bytes.NewBufferString(newcontent), &outBuffer, "new.dat")).To(Equal(0), "clean filter should succeed")
+			newsha := fmt.Sprintf("%x", sha256.Sum256([]byte(newcontent)))
+			newplaceholder := outBuffer.String()
+			Expect(newplaceholder).To(Equal(SHAPrefix+"sha256:"+newsha), "Placeholder should identify the algorithm")
+			Expect(len(newplaceholder)).To(Equal(SHA256LineLen))
+			Expect(testRepo().CheckLOBFilesForSHA(newsha, testRepo().GetLocalLOBRoot(), true)).To(BeNil(), "Deep check should use SHA-256")
+			Expect(testRepo().CheckLOBFilesForSHA(oldsha, testRepo().GetLocalLOBRoot(), true)).To(BeNil(), "Deep check should still use SHA-1 for old binaries")
+
+			// Unexpanded placeholders of both kinds pass through the clean filter
+			for _, placeholder := range []string{oldplaceholder, newplaceholder} {
+				outBuffer.Reset()
+				Expect(testRepo().CleanFilterWithReaderWriter(bytes.NewBufferString(placeholder), &outBuffer, "placeholder.dat")).To(Equal(0), "clean filter should succeed")
+				Expect(outBuffer.String()).To(Equal(placeholder), "unexpanded LOB should not be modified by clean")
+			}
+			// And both are smudged
+			outBuffer.Reset()
+			Expect(testRepo().SmudgeFilterWithReaderWriter(bytes.NewBufferString(newplaceholder), &outBuffer, "new.dat")).To(Equal(0), "smudge filter should succeed")
+			Expect(outBuffer.String()).To(Equal(newcontent))
+			outBuffer.Reset()
+			Expect(testRepo().SmudgeFilterWithReaderWriter(bytes.NewBufferString(oldplaceholder), &outBuffer, "old.dat")).To(Equal(0), "smudge filter should succeed")
+			Expect(outBuffer.String()).To(Equal(oldcontent))
+
+			// Committed placeholders of both kinds are found in git
+			ioutil.WriteFile("old.dat", []byte(oldplaceholder), 0644)
+			ioutil.WriteFile("new.dat", []byte(newplaceholder), 0644)
+			RunGitCommandForTest(true, "add", "old.dat", "new.dat")
+			RunGitCommandForTest(true, "commit", "-m", "Both kinds")
+			filelobs, err := testRepo().GetGitAllFilesAndLOBsToCheckoutAtCommit("HEAD", nil, nil)
+			Expect(err).To(BeNil())
+			Expect(ConvertFileLOBSliceToMap(filelobs)).To(Equal(map[string]string{oldsha: "old.dat", newsha: "new.dat"}))
+			commits, err := testRepo().GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, nil)
+			Expect(err).To(BeNil())
+			Expect(commits).To(HaveLen(1))
+			Expect(commits[0].LobSHAs).To(ConsistOf(oldsha, newsha))
+		})
+
+		It("keeps committed placeholders for unchanged content when the setting changes", func() {
+			clean := func(filename, content string) string {
+				var outBuffer bytes.Buffer
+				Expect(testRepo().CleanFilterWithReaderWriter(bytes.NewBufferString(content), &outBuffer, filename)).To(Equal(0), "clean filter should succeed")
+				return outBuffer.String()
+			}
+			sha1content := "Content committed with SHA-1"
+			sha1placeholder := clean("a.bin", sha1content)
+			Expect(sha1placeholder).To(Equal(SHAPrefix + fmt.Sprintf("%x", sha1.Sum([]byte(sha1content)))))
+			GlobalOptions.HashAlgorithm = HashAlgorithmSHA256
+			sha256content := "Content committed with SHA-256"
+			sha256placeholder := clean("b.bin", sha256content)
+			Expect(sha256placeholder).To(HavePrefix(SHAPrefix + SHA256Prefix))
+			ioutil.WriteFile("a.bin", []byte(sha1placeholder), 0644)
+			ioutil.WriteFile("b.bin", []byte(sha256placeholder), 0644)
+			RunGitCommandForTest(true, "add", "a.bin", "b.bin")
+			RunGitCommandForTest(true, "commit", "-m", "Both kinds")
+
+			// Cleaning the same content again (e.g. after touching it) gives exactly what's committed
+			Expect(clean("a.bin", sha1content)).To(Equal(sha1placeholder), "SHA-1 placeholder should be kept with SHA-256 configured")
+			GlobalOptions.HashAlgorithm = HashAlgorithmSHA1
+			Expect(clean("b.bin", sha256content)).To(Equal(sha256placeholder), "SHA-256 placeholder should be kept with SHA-1 configured")
+
+			// Changed content is identified with the configured algorithm
+			GlobalOptions.HashAlgorithm = HashAlgorithmSHA256
+			changed := "Content changed after switching to SHA-256"
+			changedsha := fmt.Sprintf("%x", sha256.Sum256([]byte(changed)))
+			Expect(clean("a.bin", changed)).To(Equal(SHAPrefix + SHA256Prefix + changedsha))
+			Expect(testRepo().CheckLOBFilesForSHA(changedsha, testRepo().GetLocalLOBRoot(), true)).To(BeNil(), "Changed content should be stored with SHA-256")
+		})
+	})
+
+	Describe("Placeholder metadata", func() {
+		AfterEach(func() {
+			GlobalOptions = NewOptions()
+		})
+
+		It("adds size & type to placeholders & still reads those without", func() {
+			oldcontent := "Content stored without placeholder metadata"
+			var outBuffer bytes.Buffer
+			Expect(testRepo().CleanFilterWithReaderWriter(bytes.NewBufferString(oldcontent), &outBuffer, "old.dat")).To(Equal(0), "clean filter should succeed")
+			oldsha := fmt.Sprintf("%x", sha1.Sum([]byte(oldcontent)))
+			oldplaceholder := outBuffer.String()
+			Expect(oldplaceholder).To(Equal(SHAPrefix+oldsha), "Metadata should be off by default")
+
+			GlobalOptions.PlaceholderMetadata = true
+			newcontent := "Content stored with placeholder metadata"
+			outBuffer.Reset()
+			Expect(testRepo().CleanFilterWithReaderWriter(bytes.NewBufferString(newcontent), &outBuffer, "images/New.PNG")).To(Equal(0), "clean filter should succeed")
+			newsha := fmt.Sprintf("%x", sha1.Sum([]byte(newcontent)))
+			newplaceholder := outBuffer.String()
+			Expect(newplaceholder).To(Equal(fmt.Sprintf("%v%v\ngit-lob-meta: size=%d type=png", SHAPrefix, newsha, len(newcontent))))
+
+			placeholder, ok := parseLOBPlaceholder([]byte(newplaceholder))
+			Expect(ok).To(BeTrue())
+			Expect(placeholder).To(Equal(&LOBPlaceholder{SHA: newsha, Size: int64(len(newcontent)), Type: "png"}))
+			placeholder, ok = parseLOBPlaceholder([]byte(oldplaceholder))
+			Expect(ok).To(BeTrue())
+			Expect(placeholder).To(Equal(&LOBPlaceholder{SHA: oldsha, Size: -1}), "Old placeholders have no metadata")
+			_, ok = parseLOBPlaceholder([]byte(oldplaceholder + "\nsomething else"))
+			Expect(ok).To(BeFalse(), "Anything else after the SHA line isn't a placeholder")
+			// No type tag without a simple extension
+			Expect(testRepo().getLOBPlaceholderContentForFile(newsha, 10, "Makefile")).To(Equal(SHAPrefix + newsha + "\ngit-lob-meta: size=10"))
+
+			// Unexpanded placeholders pass through the clean filter & are smudged
+			outBuffer.Reset()
+			Expect(testRepo().CleanFilterWithReaderWriter(bytes.NewBufferString(newplaceholder), &outBuffer, "images/New.PNG")).To(Equal(0), "clean filter should succeed")
+			Expect(outBuffer.String()).To(Equal(newplaceholder), "unexpanded LOB should not be modified by clean")
+			outBuffer.Reset()
+			Expect(testRepo().SmudgeFilterWithReaderWriter(bytes.NewBufferString(newplaceholder), &outBuffer, "images/New.PNG")).To(Equal(0), "smudge filter should succeed")
+			Expect(outBuffer.String()).To(Equal(newcontent))
+
+			// Smudging to a file preallocates it, but the content decides the final size
+			f, err := os.Create("smudged.dat")
+			Expect(err).To(BeNil())
+			wrongsize := strings.Replace(newplaceholder, fmt.Sprintf("size=%d", len(newcontent)), "size=100000", 1)
+			Expect(testRepo().SmudgeFilterWithReaderWriter(bytes.NewBufferString(wrongsize), f, "smudged.dat")).To(Equal(0), "smudge filter should succeed")
+			f.Close()
+			smudged, _ := ioutil.ReadFile("smudged.dat")
+			Expect(string(smudged)).To(Equal(newcontent))
+
+			// Committed placeholders of both kinds are found in git
+			ioutil.WriteFile("old.dat", []byte(oldplaceholder), 0644)
+			ioutil.WriteFile("new.png", []byte(newplaceholder), 0644)
+			RunGitCommandForTest(true, "add", "old.dat", "new.png")
+			RunGitCommandForTest(true, "commit", "-m", "Both kinds")
+			filelobs, err := testRepo().GetGitAllFilesAndLOBsToCheckoutAtCommit("HEAD", nil, nil)
+			Expect(err).To(BeNil())
+			Expect(ConvertFileLOBSliceToMap(filelobs)).To(Equal(map[string]string{oldsha: "old.dat", newsha: "new.png"}))
+			commits, err := testRepo().GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, nil)
+			Expect(err).To(BeNil())
+			Expect(commits).To(HaveLen(1))
+			Expect(commits[0].LobSHAs).To(ConsistOf(oldsha, newsha))
+
+			// Converting a placeholder to have metadata isn't a new reference
+			oldmeta := testRepo().getLOBPlaceholderContentForFile(oldsha, int64(len(oldcontent)), "old.dat")
+			ioutil.WriteFile("old.dat", []byte(oldmeta), 0644)
+			RunGitCommandForTest(true, "commit", "-a", "-m", "Add metadata")
+			filelobs, err = testRepo().GetGitAllFilesAndLOBsToCheckoutAtCommit("HEAD", nil, nil)
+			Expect(err).To(BeNil())
+			Expect(ConvertFileLOBSliceToMap(filelobs)).To(Equal(map[string]string{oldsha: "old.dat", newsha: "new.png"}))
+			sha, err := testRepo().GetLOBSHAForPath("old.dat")
+			Expect(err).To(BeNil())
+			Expect(sha).To(Equal(oldsha), "Placeholder with metadata in working copy should be recognised")
+		})
+
+		It("only adds metadata to placeholders when the content changes", func() {
+			clean := func(filename, content string) string {
+				var outBuffer bytes.Buffer
+				Expect(testRepo().CleanFilterWithReaderWriter(bytes.NewBufferString(content), &outBuffer, filename)).To(Equal(0), "clean filter should succeed")
+				return outBuffer.String()
+			}
+			content := "Content committed without placeholder metadata"
+			placeholder := clean("image.png", content)
+			ioutil.WriteFile("image.png", []byte(placeholder), 0644)
+			RunGitCommandForTest(true, "add", "image.png")
+			RunGitCommandForTest(true, "commit", "-m", "No metadata")
+
+			GlobalOptions.PlaceholderMetadata = true
+			Expect(clean("image.png", content)).To(Equal(placeholder), "Unchanged content should keep its placeholder")
+			changed := "Content changed with placeholder metadata"
+			changedsha := fmt.Sprintf("%x", sha1.Sum([]byte(changed)))
+			metaplaceholder := clean("image.png", changed)
+			Expect(metaplaceholder).To(Equal(fmt.Sprintf("%v%v\ngit-lob-meta: size=%d type=png", SHAPrefix, changedsha, len(changed))))
+
+			// And the other way around
+			ioutil.WriteFile("image.png", []byte(metaplaceholder), 0644)
+			RunGitCommandForTest(true, "commit", "-a", "-m", "Metadata")
+			GlobalOptions.PlaceholderMetadata = false
+			Expect(clean("image.png", changed)).To(Equal(metaplaceholder), "Unchanged content should keep its metadata")
+			Expect(clean("image.png", content)).To(Equal(placeholder), "Changed content shouldn't have metadata")
+		})
 	})
 
 })
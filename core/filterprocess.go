@@ -0,0 +1,268 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Git's long-running filter process protocol (gitattributes 'filter.<driver>.process'), so that
+// one git-lob process cleans & smudges every file git needs instead of starting one per file
+// Everything is sent as pkt-lines: a 4 digit hex length (including itself) then data, with
+// 0000 as a flush packet to end a list or some content
+
+// Largest amount of data in one pkt-line
+const pktLineMaxDataLen = 65516
+
+// Read a single pkt-line; returns the data, or flush = true for a flush packet
+func readPktLine(r io.Reader) (data []byte, flush bool, err error) {
+	var lenbuf [4]byte
+	if _, err := io.ReadFull(r, lenbuf[:]); err != nil {
+		return nil, false, err
+	}
+	var l int
+	if _, err := fmt.Sscanf(string(lenbuf[:]), "%04x", &l); err != nil {
+		return nil, false, fmt.Errorf("Invalid pkt-line length %q", string(lenbuf[:]))
+	}
+	if l == 0 {
+		return nil, true, nil
+	}
+	if l < 4 || l-4 > pktLineMaxDataLen {
+		return nil, false, fmt.Errorf("Invalid pkt-line length %d", l)
+	}
+	data = make([]byte, l-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, false, err
+	}
+	return data, false, nil
+}
+
+// Read pkt-lines of text up to a flush packet, without trailing newlines
+func readPktLineList(r io.Reader) ([]string, error) {
+	var ret []string
+	for {
+		data, flush, err := readPktLine(r)
+		if err != nil {
+			return ret, err
+		}
+		if flush {
+			return ret, nil
+		}
+		ret = append(ret, strings.TrimSuffix(string(data), "\n"))
+	}
+}
+
+func writePktLine(w io.Writer, data []byte) error {
+	if _, err := fmt.Fprintf(w, "%04x", len(data)+4); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func writePktLineFlush(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+// Write lines of text as pkt-lines followed by a flush packet
+func writePktLineList(w io.Writer, lines ...string) error {
+	for _, line := range lines {
+		if err := writePktLine(w, []byte(line+"\n")); err != nil {
+			return err
+		}
+	}
+	return writePktLineFlush(w)
+}
+
+// Reads content sent as pkt-lines up to the flush packet which ends it, as a stream
+type pktLineContentReader struct {
+	r    io.Reader
+	buf  []byte
+	done bool
+}
+
+func (p *pktLineContentReader) Read(b []byte) (int, error) {
+	n := 0
+	// Fill as much as we can, so that callers reading the start of the content (e.g. to
+	// look for a placeholder) get all of it even if git split it over packets
+	for n < len(b) {
+		if len(p.buf) == 0 {
+			if p.done {
+				break
+			}
+			data, flush, err := readPktLine(p.r)
+			if err != nil {
+				return n, err
+			}
+			if flush {
+				p.done = true
+				break
+			}
+			p.buf = data
+		}
+		c := copy(b[n:], p.buf)
+		p.buf = p.buf[c:]
+		n += c
+	}
+	if n == 0 && p.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Writes content as pkt-lines, preceded by a successful status the first time anything is
+// written so that a filter which fails before writing any content can still report an error
+type pktLineContentWriter struct {
+	w       io.Writer
+	buf     []byte
+	started bool
+}
+
+func (p *pktLineContentWriter) start() error {
+	if p.started {
+		return nil
+	}
+	p.started = true
+	return writePktLineList(p.w, "status=success")
+}
+
+func (p *pktLineContentWriter) Write(b []byte) (int, error) {
+	if err := p.start(); err != nil {
+		return 0, err
+	}
+	n := len(b)
+	for len(b) > 0 {
+		c := pktLineMaxDataLen - len(p.buf)
+		if c > len(b) {
+			c = len(b)
+		}
+		p.buf = append(p.buf, b[:c]...)
+		b = b[c:]
+		if len(p.buf) == pktLineMaxDataLen {
+			if err := writePktLine(p.w, p.buf); err != nil {
+				return 0, err
+			}
+			p.buf = p.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Finish the content, with the final status of the filter
+func (p *pktLineContentWriter) finish(success bool) error {
+	if !p.started && !success {
+		// Nothing written, so just the error
+		return writePktLineList(p.w, "status=error")
+	}
+	if err := p.start(); err != nil {
+		return err
+	}
+	if len(p.buf) > 0 {
+		if err := writePktLine(p.w, p.buf); err != nil {
+			return err
+		}
+		p.buf = p.buf[:0]
+	}
+	if err := writePktLineFlush(p.w); err != nil {
+		return err
+	}
+	if success {
+		// Empty list, status stays as success
+		return writePktLineFlush(p.w)
+	}
+	return writePktLineList(p.w, "status=error")
+}
+
+// Run the clean & smudge filters for git over the long-running filter process protocol until
+// git closes the input. Individual files which can't be filtered are reported to git as errors
+// but don't stop the process; an error is only returned if the protocol itself fails
+func (r *Repo) FilterProcess(in io.Reader, out io.Writer) error {
+	bufin := bufio.NewReader(in)
+	bufout := bufio.NewWriter(out)
+
+	// Handshake
+	welcome, err := readPktLineList(bufin)
+	if err != nil {
+		return fmt.Errorf("Error reading filter process handshake: %v", err)
+	}
+	if len(welcome) == 0 || welcome[0] != "git-filter-client" {
+		return fmt.Errorf("Unexpected filter process handshake: %v", welcome)
+	}
+	versionSupported := false
+	for _, line := range welcome[1:] {
+		if line == "version=2" {
+			versionSupported = true
+		}
+	}
+	if !versionSupported {
+		return errors.New("Filter process protocol version 2 is not supported by git")
+	}
+	if err = writePktLineList(bufout, "git-filter-server", "version=2"); err != nil {
+		return err
+	}
+	// git waits for this before sending its capabilities
+	if err = bufout.Flush(); err != nil {
+		return err
+	}
+	gitcaps, err := readPktLineList(bufin)
+	if err != nil {
+		return fmt.Errorf("Error reading filter process capabilities: %v", err)
+	}
+	var caps []string
+	for _, c := range gitcaps {
+		if c == "capability=clean" || c == "capability=smudge" {
+			caps = append(caps, c)
+		}
+	}
+	if err = writePktLineList(bufout, caps...); err != nil {
+		return err
+	}
+	if err = bufout.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		headers, err := readPktLineList(bufin)
+		if err == io.EOF && len(headers) == 0 {
+			// git has finished
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Error reading filter process command: %v", err)
+		}
+		var command, pathname string
+		for _, h := range headers {
+			if strings.HasPrefix(h, "command=") {
+				command = strings.TrimPrefix(h, "command=")
+			} else if strings.HasPrefix(h, "pathname=") {
+				pathname = strings.TrimPrefix(h, "pathname=")
+			}
+		}
+
+		contentIn := &pktLineContentReader{r: bufin}
+		contentOut := &pktLineContentWriter{w: bufout}
+		var ret int
+		switch command {
+		case "clean":
+			ret = r.CleanFilterWithReaderWriter(contentIn, contentOut, pathname)
+		case "smudge":
+			ret = r.SmudgeFilterWithReaderWriter(contentIn, contentOut, pathname)
+		default:
+			r.Log.Errorf("Unsupported filter process command %q for %v\n", command, pathname)
+			ret = 1
+		}
+		// The filter may not have read everything, e.g. if it failed
+		if _, err = io.Copy(ioutil.Discard, contentIn); err != nil {
+			return fmt.Errorf("Error reading content of %v from filter process: %v", pathname, err)
+		}
+		if err = contentOut.finish(ret == 0); err != nil {
+			return err
+		}
+		if err = bufout.Flush(); err != nil {
+			return err
+		}
+	}
+}
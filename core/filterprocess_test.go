@@ -0,0 +1,100 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Filter process", func() {
+
+	root := filepath.Join(os.TempDir(), "FilterProcessTest")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+	})
+
+	// Send a command as git would
+	writeCommand := func(w *bytes.Buffer, command, pathname string, content []byte) {
+		writePktLineList(w, "command="+command, "pathname="+pathname)
+		for len(content) > 0 {
+			n := len(content)
+			if n > pktLineMaxDataLen {
+				n = pktLineMaxDataLen
+			}
+			writePktLine(w, content[:n])
+			content = content[n:]
+		}
+		writePktLineFlush(w)
+	}
+	readContent := func(r *bytes.Buffer) []byte {
+		content, err := ioutil.ReadAll(&pktLineContentReader{r: r})
+		Expect(err).To(BeNil(), "Should be no error reading content")
+		return content
+	}
+	readList := func(r *bytes.Buffer) []string {
+		list, err := readPktLineList(r)
+		Expect(err).To(BeNil(), "Should be no error reading list")
+		return list
+	}
+
+	It("Cleans & smudges files over the filter process protocol", func() {
+		// Bigger than one pkt-line
+		content := make([]byte, 100000)
+		rand.Read(content)
+
+		var in bytes.Buffer
+		writePktLineList(&in, "git-filter-client", "version=2")
+		writePktLineList(&in, "capability=clean", "capability=smudge", "capability=delay")
+		writeCommand(&in, "clean", "file.bin", content)
+		var out bytes.Buffer
+		Expect(testRepo().FilterProcess(&in, &out)).To(BeNil(), "Filter process shouldn't fail")
+		Expect(readList(&out)).To(Equal([]string{"git-filter-server", "version=2"}))
+		Expect(readList(&out)).To(Equal([]string{"capability=clean", "capability=smudge"}), "Should only agree to capabilities we support")
+		Expect(readList(&out)).To(Equal([]string{"status=success"}))
+		placeholder := readContent(&out)
+		sha, ok := matchLOBPlaceholder(placeholder)
+		Expect(ok).To(BeTrue(), "Clean should output a placeholder")
+		Expect(readList(&out)).To(BeEmpty(), "Status should be unchanged")
+		Expect(out.Len()).To(Equal(0), "Should be nothing else written")
+
+		in.Reset()
+		writePktLineList(&in, "git-filter-client", "version=2")
+		writePktLineList(&in, "capability=clean", "capability=smudge")
+		writeCommand(&in, "smudge", "file.bin", placeholder)
+		writeCommand(&in, "unknown", "file.bin", []byte("some content"))
+		writeCommand(&in, "smudge", "other.txt", []byte("not a placeholder"))
+		out.Reset()
+		Expect(testRepo().FilterProcess(&in, &out)).To(BeNil(), "Filter process shouldn't fail")
+		readList(&out)
+		readList(&out)
+		Expect(readList(&out)).To(Equal([]string{"status=success"}))
+		Expect(readContent(&out)).To(Equal(content), "Smudge should output the stored content of %v", sha)
+		Expect(readList(&out)).To(BeEmpty(), "Status should be unchanged")
+		Expect(readList(&out)).To(Equal([]string{"status=error"}), "Unknown commands should fail without stopping the process")
+		Expect(readList(&out)).To(Equal([]string{"status=success"}))
+		Expect(string(readContent(&out))).To(Equal("not a placeholder"))
+		Expect(readList(&out)).To(BeEmpty(), "Status should be unchanged")
+		Expect(out.Len()).To(Equal(0), "Should be nothing else written")
+	})
+
+	It("Rejects unsupported versions", func() {
+		var in, out bytes.Buffer
+		writePktLineList(&in, "git-filter-client", "version=3")
+		Expect(testRepo().FilterProcess(&in, &out)).ToNot(BeNil())
+	})
+})
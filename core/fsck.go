@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/util"
 )
 
@@ -22,8 +23,15 @@ const (
 	// A binary is corrupt - either the metadata is invalid, or the SHA doesn't match the content (only detected with --deep) (desc = SHA)
 	// The files will be deleted if --delete was specified
 	FsckCorruptData FsckCallbackType = iota
+	// A binary with problems was repaired (desc = where it was recovered from, "shared store" or remote name)
+	FsckRepaired FsckCallbackType = iota
+	// A binary with problems couldn't be repaired; its bad files have been deleted (desc = reason)
+	FsckUnrecoverable FsckCallbackType = iota
 )
 
+// Where a binary was recovered from if it was relinked from the shared store (see FsckRepaired)
+const FsckSourceSharedStore = "shared store"
+
 // Collected callback data for a fsck operation
 type FsckCallbackData struct {
 	// What stage of the process this is for, preparing, transferring or skipping something
@@ -44,7 +52,7 @@ type FsckCallbackData struct {
 // callback = for progress and file errors, return quit to abort (also skips deleting current item)
 // The returned error will be nil if no files had any issues but the process will continue (with callbacks)
 // even when missing/bad files are encountered until all have been checked
-func Fsck(deep, shared, deleteBadFiles bool, shas []string, callback func(data *FsckCallbackData) (quit bool)) error {
+func (r *Repo) Fsck(deep, shared, deleteBadFiles bool, shas []string, callback func(data *FsckCallbackData) (quit bool)) error {
 
 	// When listing all LOBs it returns a set to eliminate dupes so use this across both
 	// cheaper to construct a set from small number of arguments than a slice from potentially
@@ -53,9 +61,9 @@ func Fsck(deep, shared, deleteBadFiles bool, shas []string, callback func(data *
 	if len(shas) == 0 {
 		var err error
 		if shared {
-			shaSet, err = getAllSharedLOBSHAs()
+			shaSet, err = r.getAllSharedLOBSHAs()
 		} else {
-			shaSet, err = getAllLocalLOBSHAs()
+			shaSet, err = r.getAllLocalLOBSHAs()
 		}
 		if err != nil {
 			return err
@@ -66,15 +74,15 @@ func Fsck(deep, shared, deleteBadFiles bool, shas []string, callback func(data *
 
 	var basedir string
 	if shared {
-		basedir = GetSharedLOBRoot()
+		basedir = r.GetSharedLOBRoot()
 	} else {
-		basedir = GetLocalLOBRoot()
+		basedir = r.GetLocalLOBRoot()
 	}
 	i := 0
 	var errorList []string
 	for sha := range shaSet.Iter() {
 		percent := int(float32(i+1) * 100 / float32(len(shaSet)))
-		err := CheckLOBFilesForSHA(sha, basedir, deep)
+		err := r.CheckLOBFilesForSHA(sha, basedir, deep)
 		var quit bool
 		if err != nil {
 			switch e := err.(type) {
@@ -84,10 +92,10 @@ func Fsck(deep, shared, deleteBadFiles bool, shas []string, callback func(data *
 				quit = callback(&FsckCallbackData{FsckCorruptData, sha, sha, percent})
 				if !quit && deleteBadFiles {
 					// Delete all files for this LOB
-					delerr := DeleteLOBInBaseDir(sha, basedir)
+					delerr := r.DeleteLOBInBaseDir(sha, basedir)
 					if delerr != nil {
 						// Log but don't abort for this
-						util.LogErrorf("fsck error: Unable to delete bad LOB %v from %v: %v", sha, basedir, delerr.Error())
+						r.Log.Errorf("fsck error: Unable to delete bad LOB %v from %v: %v", sha, basedir, delerr.Error())
 					}
 				}
 			case *WrongSizeError:
@@ -98,7 +106,7 @@ func Fsck(deep, shared, deleteBadFiles bool, shas []string, callback func(data *
 					delerr := os.Remove(e.Filename)
 					if delerr != nil {
 						// Log but don't abort for this
-						util.LogErrorf("fsck error: Unable to delete %v: %v", e.Filename, delerr.Error())
+						r.Log.Errorf("fsck error: Unable to delete %v: %v", e.Filename, delerr.Error())
 					}
 				}
 			default:
@@ -123,3 +131,92 @@ func Fsck(deep, shared, deleteBadFiles bool, shas []string, callback func(data *
 	return nil
 
 }
+
+// Validate the local binary store like Fsck, but repair problems instead of just reporting them
+// Each binary with problems has its bad files deleted, then is relinked from the shared store if that has
+// a good copy, otherwise fetched again from remoteName (nothing is fetched if provider is nil).
+// Binaries which still have problems afterwards are unrecoverable & any bad files left are deleted.
+// Problems are reported to callback as for Fsck, followed by FsckRepaired or FsckUnrecoverable
+// Returns the SHAs repaired & unrecoverable; error is only returned if fsck had to be aborted
+func (r *Repo) FsckRepair(deep, shared bool, shas []string, provider providers.SyncProvider, remoteName string,
+	callback func(data *FsckCallbackData) (quit bool)) (repaired, unrecoverable []string, err error) {
+
+	// Collect binaries with problems, in order
+	var bad []string
+	badSet := util.NewStringSet()
+	quit := false
+	fsckerr := r.Fsck(deep, shared, false, shas, func(data *FsckCallbackData) bool {
+		if data.Type != FsckWorking && !badSet.Contains(data.SHA) {
+			badSet.Add(data.SHA)
+			bad = append(bad, data.SHA)
+		}
+		quit = callback(data)
+		return quit
+	})
+	if fsckerr != nil && len(bad) == 0 {
+		// Not a problem with a binary, so fsck was aborted
+		return nil, nil, fsckerr
+	}
+
+	var basedir string
+	if shared {
+		basedir = r.GetSharedLOBRoot()
+	} else {
+		basedir = r.GetLocalLOBRoot()
+	}
+	for i, sha := range bad {
+		if quit {
+			break
+		}
+		percent := int(float32(i+1) * 100 / float32(len(bad)))
+		source, err := r.repairLOB(sha, basedir, deep, shared, provider, remoteName)
+		if err != nil {
+			unrecoverable = append(unrecoverable, sha)
+			quit = callback(&FsckCallbackData{FsckUnrecoverable, sha, err.Error(), percent})
+		} else {
+			repaired = append(repaired, sha)
+			quit = callback(&FsckCallbackData{FsckRepaired, sha, source, percent})
+		}
+	}
+	return repaired, unrecoverable, nil
+}
+
+// Repair a binary which had problems
+// Returns where it was recovered from, or an error if it couldn't be recovered (bad files are deleted)
+func (r *Repo) repairLOB(sha, basedir string, deep, shared bool, provider providers.SyncProvider, remoteName string) (string, error) {
+	// Only delete the files in basedir to start with; deleting the binary would also delete
+	// files in the shared store which nothing else links to, which may be the good copy
+	if err := deleteLOBFilesInStore(sha, basedir); err != nil {
+		return "", err
+	}
+	// Links to the shared store are only made if the shared files are the right size, but they
+	// could still be corrupt
+	if !shared && r.IsUsingSharedStorage() && r.CheckLOBFilesForSHA(sha, r.GetSharedLOBRoot(), deep) == nil {
+		r.recoverLocalLOBFilesFromSharedStore(sha)
+		if r.CheckLOBFilesForSHA(sha, basedir, deep) == nil {
+			return FsckSourceSharedStore, nil
+		}
+	}
+	var err error
+	if provider == nil {
+		err = errors.New("no good copy in the shared store and no remote to fetch from")
+	} else {
+		// Force, since the files we have can't be trusted
+		err = r.FetchSingle(sha, provider, remoteName, true, func(data *util.ProgressCallbackData) (abort bool) {
+			return false
+		})
+		if err != nil {
+			err = fmt.Errorf("unable to fetch from %v: %v", remoteName, err.Error())
+		} else {
+			err = r.CheckLOBFilesForSHA(sha, basedir, deep)
+			if err == nil {
+				return remoteName, nil
+			}
+		}
+	}
+	// Don't leave anything bad behind
+	if delerr := r.DeleteLOBInBaseDir(sha, basedir); delerr != nil {
+		r.Log.Errorf("fsck error: Unable to delete bad LOB %v from %v: %v", sha, basedir, delerr.Error())
+	}
+	return "", err
+}
@@ -6,9 +6,11 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
 	. "github.com/atlassian/git-lob/util"
 )
 
@@ -78,13 +80,13 @@ var _ = Describe("Fsck", func() {
 			return false
 		}
 		// First check all is well (shallow)
-		err := Fsck(false, false, false, nil, callback)
+		err := testRepo().Fsck(false, false, false, nil, callback)
 		Expect(err).To(BeNil(), "Shouldn't be an error calling Fsck (shallow)")
 		Expect(corruptFiles).To(BeEmpty(), "Should be no corrupt files (shallow)")
 		Expect(missingFiles).To(BeEmpty(), "Should be no missing files (shallow)")
 		Expect(wrongSizeFiles).To(BeEmpty(), "Should be no wrong size files (shallow)")
 		// check again (deep)
-		err = Fsck(true, false, false, nil, callback)
+		err = testRepo().Fsck(true, false, false, nil, callback)
 		Expect(err).To(BeNil(), "Shouldn't be an error calling Fsck (deep)")
 		Expect(corruptFiles).To(BeEmpty(), "Should be no corrupt files (deep)")
 		Expect(missingFiles).To(BeEmpty(), "Should be no missing files (deep)")
@@ -94,10 +96,10 @@ var _ = Describe("Fsck", func() {
 		var backupFile string
 		var fileToBreak string
 		// Make meta file missing
-		fileToBreak = GetLocalLOBMetaPath(smallLOBs[0])
+		fileToBreak = testRepo().GetLocalLOBMetaPath(smallLOBs[0])
 		backupFile = fileToBreak + "_bak"
 		os.Rename(fileToBreak, backupFile)
-		err = Fsck(false, false, false, nil, callback)
+		err = testRepo().Fsck(false, false, false, nil, callback)
 		Expect(err).ToNot(BeNil(), "Should be an error calling Fsck (shallow)")
 		Expect(corruptFiles).To(BeEmpty(), "Should be no corrupt files (shallow)")
 		Expect(missingFiles).To(ConsistOf([]string{smallLOBs[0]}), "Detect missing file (shallow)")
@@ -105,20 +107,20 @@ var _ = Describe("Fsck", func() {
 		// restore, then break a chunk & test again
 		os.Rename(backupFile, fileToBreak)
 		missingFiles = nil
-		fileToBreak = GetLocalLOBChunkPath(smallLOBs[0], 0)
+		fileToBreak = testRepo().GetLocalLOBChunkPath(smallLOBs[0], 0)
 		backupFile = fileToBreak + "_bak"
 		os.Rename(fileToBreak, backupFile)
-		err = Fsck(false, false, false, nil, callback)
+		err = testRepo().Fsck(false, false, false, nil, callback)
 		Expect(err).ToNot(BeNil(), "Should be an error calling Fsck (shallow)")
 		Expect(corruptFiles).To(BeEmpty(), "Should be no corrupt files (shallow)")
 		Expect(missingFiles).To(ConsistOf([]string{smallLOBs[0]}), "Detect missing file (shallow)")
 		Expect(wrongSizeFiles).To(BeEmpty(), "Should be no wrong size files (shallow)")
 		// now try with a secondary chunk (leave smallLOBs[0] broken to test multiples)
 		missingFiles = nil
-		fileToBreak = GetLocalLOBChunkPath(largeLOBs[1], 1)
+		fileToBreak = testRepo().GetLocalLOBChunkPath(largeLOBs[1], 1)
 		backupFile = fileToBreak + "_bak"
 		os.Rename(fileToBreak, backupFile)
-		err = Fsck(false, false, false, nil, callback)
+		err = testRepo().Fsck(false, false, false, nil, callback)
 		Expect(err).ToNot(BeNil(), "Should be an error calling Fsck (shallow)")
 		Expect(corruptFiles).To(BeEmpty(), "Should be no corrupt files (shallow)")
 		Expect(missingFiles).To(ConsistOf([]string{smallLOBs[0], largeLOBs[1]}), "Detect missing file (shallow)")
@@ -129,11 +131,11 @@ var _ = Describe("Fsck", func() {
 
 		// Now test corruption of smallLOB[1] metadata
 		// smallLOBs[0] still has missing data
-		fileToBreak = GetLocalLOBMetaPath(smallLOBs[1])
+		fileToBreak = testRepo().GetLocalLOBMetaPath(smallLOBs[1])
 		backupFile = fileToBreak + "_bak"
 		os.Rename(fileToBreak, backupFile)
 		ioutil.WriteFile(fileToBreak, []byte("{ Broken }"), 0644)
-		err = Fsck(false, false, false, nil, callback)
+		err = testRepo().Fsck(false, false, false, nil, callback)
 		Expect(err).ToNot(BeNil(), "Should be an error calling Fsck (shallow)")
 		Expect(corruptFiles).To(ConsistOf([]string{smallLOBs[1]}), "Detect corrupt file (shallow)")
 		Expect(missingFiles).To(ConsistOf([]string{smallLOBs[0]}), "Detect missing file (shallow)")
@@ -145,15 +147,15 @@ var _ = Describe("Fsck", func() {
 		corruptFiles = nil
 
 		// Now test 'wrong size' detection
-		fileToBreak = GetLocalLOBChunkPath(smallLOBs[2], 0)
-		fileToBreak2 := GetLocalLOBChunkPath(largeLOBs[0], 1)
+		fileToBreak = testRepo().GetLocalLOBChunkPath(smallLOBs[2], 0)
+		fileToBreak2 := testRepo().GetLocalLOBChunkPath(largeLOBs[0], 1)
 		backupFile = fileToBreak + "_bak"
 		backupFile2 := fileToBreak2 + "_bak"
 		os.Rename(fileToBreak, backupFile)
 		os.Rename(fileToBreak2, backupFile2)
 		ioutil.WriteFile(fileToBreak, []byte{0, 1, 2, 3, 4}, 0644)
 		ioutil.WriteFile(fileToBreak2, []byte{0, 1, 2, 3, 4}, 0644)
-		err = Fsck(false, false, false, nil, callback)
+		err = testRepo().Fsck(false, false, false, nil, callback)
 		Expect(err).ToNot(BeNil(), "Should be an error calling Fsck (shallow)")
 		Expect(wrongSizeFiles).To(ConsistOf([]string{smallLOBs[2], largeLOBs[0]}), "Detect wrong size file (shallow)")
 		Expect(missingFiles).To(ConsistOf([]string{smallLOBs[0]}), "Detect missing file (shallow)")
@@ -167,8 +169,8 @@ var _ = Describe("Fsck", func() {
 		wrongSizeFiles = nil
 
 		// Now break the data by keeping it the right size but overwrite a few bytes with different data
-		fileToBreak = GetLocalLOBChunkPath(smallLOBs[2], 0)
-		fileToBreak2 = GetLocalLOBChunkPath(largeLOBs[0], 1)
+		fileToBreak = testRepo().GetLocalLOBChunkPath(smallLOBs[2], 0)
+		fileToBreak2 = testRepo().GetLocalLOBChunkPath(largeLOBs[0], 1)
 		f, _ := os.OpenFile(fileToBreak, os.O_RDWR, 0644)
 		f.Write([]byte{5, 4, 3, 2, 1})
 		f.Close()
@@ -176,14 +178,14 @@ var _ = Describe("Fsck", func() {
 		f.Write([]byte{5, 4, 3, 2, 1})
 		f.Close()
 		// Prove that a shallow test won't pick up this change
-		err = Fsck(false, false, false, nil, callback)
+		err = testRepo().Fsck(false, false, false, nil, callback)
 		Expect(err).ToNot(BeNil(), "Should be an error calling Fsck (shallow)")
 		Expect(corruptFiles).To(BeEmpty(), "Corrupt files should not be detected by shallow test")
 		Expect(missingFiles).To(ConsistOf([]string{smallLOBs[0]}), "Detect missing file (shallow)")
 		Expect(wrongSizeFiles).To(BeEmpty(), "Should be no wrong size files (shallow)")
 		missingFiles = nil
 		// Now show a deep test will find it
-		err = Fsck(true, false, false, nil, callback)
+		err = testRepo().Fsck(true, false, false, nil, callback)
 		Expect(err).ToNot(BeNil(), "Should be an error calling Fsck (deep)")
 		Expect(corruptFiles).To(ConsistOf([]string{smallLOBs[2], largeLOBs[0]}), "Deep fsck should detect corrupt file")
 		Expect(missingFiles).To(ConsistOf([]string{smallLOBs[0]}), "Detect missing file (deep)")
@@ -192,7 +194,7 @@ var _ = Describe("Fsck", func() {
 		corruptFiles = nil
 
 		// Check specific check for SHAs works (check only for small LOBs)
-		err = Fsck(true, false, false, smallLOBs, callback)
+		err = testRepo().Fsck(true, false, false, smallLOBs, callback)
 		Expect(err).ToNot(BeNil(), "Should be an error calling Fsck (deep)")
 		Expect(corruptFiles).To(ConsistOf([]string{smallLOBs[2]}), "Deep fsck but only for small LOBs")
 		Expect(missingFiles).To(ConsistOf([]string{smallLOBs[0]}), "Detect missing file (deep)")
@@ -203,9 +205,9 @@ var _ = Describe("Fsck", func() {
 		// Now test deletion
 		// Make a chunk the wrong size to test only that chunk gets deleted
 		// also smallLOBs[2], largeLOBs[0] still corrupt from previous
-		fileToBreak = GetLocalLOBChunkPath(largeLOBs[1], 2)
+		fileToBreak = testRepo().GetLocalLOBChunkPath(largeLOBs[1], 2)
 		ioutil.WriteFile(fileToBreak, []byte{0, 1, 2, 3, 4, 5}, 0644)
-		err = Fsck(true, false, true, nil, callback)
+		err = testRepo().Fsck(true, false, true, nil, callback)
 		Expect(err).ToNot(BeNil(), "Should be an error calling Fsck (deep)")
 		Expect(corruptFiles).To(ConsistOf([]string{smallLOBs[2], largeLOBs[0]}), "Deep fsck should detect corrupt file")
 		Expect(missingFiles).To(ConsistOf([]string{smallLOBs[0]}), "Detect missing file (deep)")
@@ -217,29 +219,29 @@ var _ = Describe("Fsck", func() {
 				continue
 			}
 			if i == 2 {
-				Expect(FileExists(GetLocalLOBMetaPath(s))).To(BeFalse(), "Corrupt file should be deleted")
-				Expect(FileExists(GetLocalLOBChunkPath(s, 0))).To(BeFalse(), "Corrupt file should be deleted")
+				Expect(FileExists(testRepo().GetLocalLOBMetaPath(s))).To(BeFalse(), "Corrupt file should be deleted")
+				Expect(FileExists(testRepo().GetLocalLOBChunkPath(s, 0))).To(BeFalse(), "Corrupt file should be deleted")
 			} else {
-				Expect(FileExists(GetLocalLOBMetaPath(s))).To(BeTrue(), fmt.Sprintf("Small meta file %d should still exist", i))
-				Expect(FileExists(GetLocalLOBChunkPath(s, 0))).To(BeTrue(), fmt.Sprintf("Small chunk file %d should still exist", i))
+				Expect(FileExists(testRepo().GetLocalLOBMetaPath(s))).To(BeTrue(), fmt.Sprintf("Small meta file %d should still exist", i))
+				Expect(FileExists(testRepo().GetLocalLOBChunkPath(s, 0))).To(BeTrue(), fmt.Sprintf("Small chunk file %d should still exist", i))
 			}
 		}
-		Expect(FileExists(GetLocalLOBChunkPath(largeLOBs[1], 2))).To(BeFalse(), "Wrong size file should be deleted")
-		Expect(FileExists(GetLocalLOBMetaPath(largeLOBs[1]))).To(BeTrue(), "Metadata of wrong size chunk file should still exist")
-		Expect(FileExists(GetLocalLOBChunkPath(largeLOBs[1], 0))).To(BeTrue(), "Earlier chunks of wrong size file should still exist")
-		Expect(FileExists(GetLocalLOBChunkPath(largeLOBs[1], 1))).To(BeTrue(), "Earlier chunks of wrong size file should still exist")
-		Expect(FileExists(GetLocalLOBMetaPath(largeLOBs[0]))).To(BeFalse(), "Corrupt file should be deleted")
-		Expect(FileExists(GetLocalLOBChunkPath(largeLOBs[0], 0))).To(BeFalse(), "Corrupt file should be deleted")
-		Expect(FileExists(GetLocalLOBChunkPath(largeLOBs[0], 1))).To(BeFalse(), "Corrupt file should be deleted")
+		Expect(FileExists(testRepo().GetLocalLOBChunkPath(largeLOBs[1], 2))).To(BeFalse(), "Wrong size file should be deleted")
+		Expect(FileExists(testRepo().GetLocalLOBMetaPath(largeLOBs[1]))).To(BeTrue(), "Metadata of wrong size chunk file should still exist")
+		Expect(FileExists(testRepo().GetLocalLOBChunkPath(largeLOBs[1], 0))).To(BeTrue(), "Earlier chunks of wrong size file should still exist")
+		Expect(FileExists(testRepo().GetLocalLOBChunkPath(largeLOBs[1], 1))).To(BeTrue(), "Earlier chunks of wrong size file should still exist")
+		Expect(FileExists(testRepo().GetLocalLOBMetaPath(largeLOBs[0]))).To(BeFalse(), "Corrupt file should be deleted")
+		Expect(FileExists(testRepo().GetLocalLOBChunkPath(largeLOBs[0], 0))).To(BeFalse(), "Corrupt file should be deleted")
+		Expect(FileExists(testRepo().GetLocalLOBChunkPath(largeLOBs[0], 1))).To(BeFalse(), "Corrupt file should be deleted")
 		missingFiles = nil
 		corruptFiles = nil
 		wrongSizeFiles = nil
 
 		// test shared
 		GlobalOptions.SharedStore = shared
-		err = os.Rename(GetLocalLOBRoot(), shared)
+		err = os.Rename(testRepo().GetLocalLOBRoot(), shared)
 		Expect(err).To(BeNil(), fmt.Sprintf("Should be no error renaming to shared"))
-		err = Fsck(false, true, false, nil, callback)
+		err = testRepo().Fsck(false, true, false, nil, callback)
 		Expect(err).ToNot(BeNil(), "Should be an error calling Fsck (shared)")
 		Expect(corruptFiles).To(BeEmpty(), "No corruptions (they were deleted")
 		Expect(missingFiles).To(ConsistOf([]string{smallLOBs[0], largeLOBs[1]}), "Detect missing file, including deleted wrong size files (shared)")
@@ -249,3 +251,92 @@ var _ = Describe("Fsck", func() {
 	})
 
 })
+
+var _ = Describe("Fsck repair", func() {
+
+	root := filepath.Join(os.TempDir(), "FsckRepairTest")
+	shared := filepath.Join(os.TempDir(), "FsckRepairShared")
+	originBinStore := filepath.Join(os.TempDir(), "FsckRepairOriginBinStore")
+	var oldwd string
+	var lobs []string
+
+	BeforeEach(func() {
+		oldwd, _ = os.Getwd()
+		CreateGitRepoForTest(root)
+		os.Chdir(root)
+		os.MkdirAll(originBinStore, 0755)
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_APPEND, 0644)
+		Expect(err).To(BeNil())
+		f.WriteString(fmt.Sprintf(`
+[remote "origin"]
+    url = file:///dummy/origin
+    git-lob-path = %v
+    git-lob-provider = filesystem
+`, strings.Replace(originBinStore, "\\", "/", -1)))
+		f.Close()
+		LoadConfig(GlobalOptions)
+		InitCoreProviders()
+		os.MkdirAll(shared, 0755)
+		GlobalOptions.SharedStore = shared
+
+		lobs = nil
+		for i := 0; i < 5; i++ {
+			info := CreateAndStoreLOBFileForTest(int64(rand.Intn(300)+50), "anything.dat")
+			lobs = append(lobs, info.SHA)
+		}
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		for _, dir := range []string{root, shared, originBinStore} {
+			err := ForceRemoveAll(dir)
+			if err != nil {
+				Fail(err.Error())
+			}
+		}
+		GlobalOptions = NewOptions()
+	})
+
+	It("Repairs from the shared store & remote", func() {
+		provider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil())
+		// The last binary is only stored locally
+		for _, sha := range lobs[:4] {
+			Expect(testRepo().PushSingle(sha, provider, "origin", false, func(data *ProgressCallbackData) (abort bool) { return false })).To(BeNil())
+		}
+
+		// Corrupt, but only in the local store (wrong sizes are relinked by Fsck already)
+		file := testRepo().GetLocalLOBChunkPath(lobs[0], 0)
+		content, _ := ioutil.ReadFile(file)
+		os.Remove(file)
+		content[0]++
+		ioutil.WriteFile(file, content, 0644)
+		// Corrupt, and the shared store is the same file
+		for _, sha := range []string{lobs[1], lobs[4]} {
+			f, _ := os.OpenFile(testRepo().GetLocalLOBChunkPath(sha, 0), os.O_RDWR, 0644)
+			f.Write([]byte{5, 4, 3, 2, 1})
+			f.Close()
+		}
+		ioutil.WriteFile(testRepo().GetLocalLOBMetaPath(lobs[2]), []byte("{ Broken }"), 0644)
+
+		sources := make(map[string]string)
+		var unrecoverableReported []string
+		repaired, unrecoverable, err := testRepo().FsckRepair(true, false, nil, provider, "origin", func(data *FsckCallbackData) bool {
+			switch data.Type {
+			case FsckRepaired:
+				sources[data.SHA] = data.Desc
+			case FsckUnrecoverable:
+				unrecoverableReported = append(unrecoverableReported, data.SHA)
+			}
+			return false
+		})
+		Expect(err).To(BeNil(), "Shouldn't be an error calling FsckRepair")
+		Expect(repaired).To(ConsistOf(lobs[0], lobs[1], lobs[2]))
+		Expect(sources).To(Equal(map[string]string{lobs[0]: FsckSourceSharedStore, lobs[1]: "origin", lobs[2]: "origin"}))
+		Expect(unrecoverable).To(Equal([]string{lobs[4]}))
+		Expect(unrecoverableReported).To(Equal(unrecoverable))
+		Expect(FileExists(testRepo().GetLocalLOBMetaPath(lobs[4]))).To(BeFalse(), "Unrecoverable binary should be deleted")
+
+		Expect(testRepo().Fsck(true, false, false, nil, func(data *FsckCallbackData) bool { return false })).To(BeNil(), "Store should be good after repairing")
+		Expect(testRepo().Fsck(true, true, false, nil, func(data *FsckCallbackData) bool { return false })).To(BeNil(), "Shared store should be good after repairing")
+	})
+})
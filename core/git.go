@@ -2,12 +2,16 @@ package core
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"os/exec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -84,6 +88,8 @@ type CommitLOBRef struct {
 	LobSHAs []string
 	// LOBs with file names
 	FileLOBs []*FileLOB
+	// Only set if the log format included commitdate, see walkGitLogOutputForLOBReferences
+	CommitDate time.Time
 }
 
 func (self *CommitLOBRef) String() string {
@@ -111,7 +117,7 @@ func ConvertFileLOBSliceToMap(slice []*FileLOB) map[string]string {
 // First call will be startSHA & its parent
 // Parent will be blank string if there are no more parents & walk will stop after
 // Optimises internally to call Git only for batches of 50
-func WalkGitHistory(startSHA string, callback func(currentSHA, parentSHA string) (quit bool, err error)) error {
+func (r *Repo) WalkGitHistory(startSHA string, callback func(currentSHA, parentSHA string) (quit bool, err error)) error {
 
 	quit := false
 	currentLogHEAD := startSHA
@@ -119,7 +125,7 @@ func WalkGitHistory(startSHA string, callback func(currentSHA, parentSHA string)
 	for !quit {
 		// get 250 parents
 		// format as <SHA> <PARENT> so we can detect the end of history
-		cmd := exec.Command("git", "log", "--first-parent", "--topo-order",
+		cmd := r.command("git", "log", "--first-parent", "--topo-order",
 			"-n", "250", "--format=%H %P", currentLogHEAD)
 
 		outp, err := cmd.StdoutPipe()
@@ -164,14 +170,54 @@ func WalkGitHistory(startSHA string, callback func(currentSHA, parentSHA string)
 // Walks all ancestors including second+ parents, in topological order
 // remoteName can be a specific remote or "*" to count pushed ton *any* remote as OK
 // If recheck=true then existing pushed records are ignored (all commits are walked)
-func WalkGitCommitLOBsToPushForRefSpec(remoteName string, refspec *GitRefSpec, recheck bool, callback func(commitLOB *CommitLOBRef) (quit bool, err error)) error {
+// includePaths and excludePaths are optional lists of path filters, commits are only walked if they
+// reference LOBs in matching paths, & only those LOBs are included
+func (r *Repo) WalkGitCommitLOBsToPushForRefSpec(remoteName string, refspec *GitRefSpec, recheck bool, includePaths, excludePaths []string,
+	callback func(commitLOB *CommitLOBRef) (quit bool, err error)) error {
 	if refspec.IsRange() {
 		// Walk a specific range
-		return walkGitCommitsReferencingLOBsInRange(refspec.Ref1, refspec.Ref2, true, false, []string{}, []string{}, callback)
+		return r.walkGitCommitsReferencingLOBsInRange(refspec.Ref1, refspec.Ref2, true, false, includePaths, excludePaths,
+			r.skipGitShallowBoundaries(callback))
 
 	} else {
 		// Walk everything that hasn't been pushed before Ref1
-		return WalkGitCommitLOBsToPush(remoteName, refspec.Ref1, recheck, callback)
+		return r.WalkGitCommitLOBsToPush(remoteName, refspec.Ref1, recheck, includePaths, excludePaths, callback)
+	}
+}
+
+// Get the commits at the boundary of a shallow clone (git clone --depth) or grafted history
+// (git fetch --depth), whose parents aren't in the repo. Empty if the repo isn't shallow
+func (r *Repo) GetGitShallowCommits() []string {
+	data, err := ioutil.ReadFile(filepath.Join(r.GitDir, "shallow"))
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if GitRefIsFullSHA(line) {
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
+
+// Git shows shallow boundary commits as adding every file in their tree, since their parents are
+// missing. Those binaries weren't really added there & came from the remote anyway, along with
+// the commit, so boundaries are treated as roots of history: already pushed when pushing, & with
+// nothing before them when looking back at recent history
+func (r *Repo) skipGitShallowBoundaries(callback func(commitLOB *CommitLOBRef) (quit bool, err error)) func(commitLOB *CommitLOBRef) (quit bool, err error) {
+	shallow := r.GetGitShallowCommits()
+	if len(shallow) == 0 {
+		return callback
+	}
+	boundaries := util.NewStringSetFromSlice(shallow)
+	return func(commitLOB *CommitLOBRef) (quit bool, err error) {
+		if boundaries.Contains(commitLOB.Commit) {
+			r.Log.Debugf("Skipping shallow clone boundary %v\n", commitLOB.Commit)
+			return false, nil
+		}
+		return callback(commitLOB)
 	}
 }
 
@@ -179,13 +225,16 @@ func WalkGitCommitLOBsToPushForRefSpec(remoteName string, refspec *GitRefSpec, r
 // Walks forwards from the oldest commit to the latest commit (including 'ref' if it includes LOBs)
 // Walks all ancestors including second+ parents, in topological order
 // remoteName can be a specific remote or "*" to count pushed ton *any* remote as OK
-func WalkGitCommitLOBsToPush(remoteName, ref string, recheck bool, callback func(commitLOB *CommitLOBRef) (quit bool, err error)) error {
+// includePaths and excludePaths are optional lists of path filters, as WalkGitCommitLOBsToPushForRefSpec
+func (r *Repo) WalkGitCommitLOBsToPush(remoteName, ref string, recheck bool, includePaths, excludePaths []string,
+	callback func(commitLOB *CommitLOBRef) (quit bool, err error)) error {
 	// We use git's ability to log all new commits up to ref but exclude any ancestors of pushed
 	var pushedSHAs []string
 	// If rechecking, then we just log the whole thing
 	if !recheck {
-		pushedSHAs = GetPushedCommits(remoteName)
+		pushedSHAs = r.GetPushedCommits(remoteName)
 	}
+	callback = r.skipGitShallowBoundaries(callback)
 	// Loop to allow retry
 	for {
 		args := []string{"log", `--format=commitsha: %H %P`, "-p",
@@ -200,7 +249,7 @@ func WalkGitCommitLOBsToPush(remoteName, ref string, recheck bool, callback func
 		}
 
 		// format as <SHA> <PARENT> so we progressively work backward
-		cmd := exec.Command("git", args...)
+		cmd := r.command("git", args...)
 
 		outp, err := cmd.StdoutPipe()
 		if err != nil {
@@ -208,7 +257,7 @@ func WalkGitCommitLOBsToPush(remoteName, ref string, recheck bool, callback func
 		}
 		cmd.Start()
 
-		quit, err := walkGitLogOutputForLOBReferences(outp, true, false, []string{}, []string{}, callback)
+		quit, err := walkGitLogOutputForLOBReferences(outp, true, false, includePaths, excludePaths, callback)
 
 		if quit || err != nil {
 			// Early abort
@@ -217,13 +266,21 @@ func WalkGitCommitLOBsToPush(remoteName, ref string, recheck bool, callback func
 
 		procerr := cmd.Wait()
 		if procerr != nil {
-			if len(pushedSHAs) > 0 {
-				// This can happen because one of the pushedSHAs has been completely removed from the repo
-				// consolidate SHAs and try again, this deletes any non-existent SHAs
-				consolidated := consolidateCommitsToLatestDescendants(pushedSHAs)
+			if len(pushedSHAs) > 0 && remoteName != "*" {
+				// This can happen because one of the pushedSHAs has been completely removed from the repo,
+				// e.g. after a rebase; remap them to the commits which replaced them or remove them, and try again
+				result, rerr := r.ReconcilePushedState(remoteName, false)
+				if rerr == nil && result.Changed() {
+					r.Log.Debugf("Reconciled push state for %v after history was rewritten: %d remapped, %d removed\n",
+						remoteName, len(result.Remapped), len(result.Dropped))
+					pushedSHAs = r.GetPushedCommits(remoteName)
+					// retry
+					continue
+				}
+			} else if len(pushedSHAs) > 0 {
+				// Combined state for all remotes, just leave out what doesn't exist any more
+				consolidated := r.consolidateCommitsToLatestDescendants(pushedSHAs)
 				if len(consolidated) != len(pushedSHAs) {
-					// Store the refined state
-					WritePushedState(remoteName, consolidated)
 					pushedSHAs = consolidated
 					// retry
 					continue
@@ -237,7 +294,8 @@ func WalkGitCommitLOBsToPush(remoteName, ref string, recheck bool, callback func
 }
 
 // Internal utility for walking git-log output for git-lob references & calling callback
-// Log output must be formated like this: `--format=commitsha: %H %P`
+// Log output must be formated like this: `--format=commitsha: %H %P`, optionally followed by
+// `%ncommitdate: %ct` to record the commit date
 // outp must be output from a running git log task
 func walkGitLogOutputForLOBReferences(outp io.Reader, additions, removals bool,
 	includePaths, excludePaths []string, callback func(commitLOB *CommitLOBRef) (quit bool, err error)) (quit bool, err error) {
@@ -262,15 +320,16 @@ func walkGitLogOutputForLOBReferences(outp io.Reader, additions, removals bool,
 	// Use 1 regex to capture all for speed
 	var lobregex *regexp.Regexp
 	if additions && !removals {
-		lobregex = regexp.MustCompile(`^\+git-lob: ([A-Fa-f0-9]{40})`)
+		lobregex = regexp.MustCompile(`^\+git-lob: (` + SHAPlaceholderRegexFragment + `)`)
 	} else if removals && !additions {
-		lobregex = regexp.MustCompile(`^\-git-lob: ([A-Fa-f0-9]{40})`)
+		lobregex = regexp.MustCompile(`^\-git-lob: (` + SHAPlaceholderRegexFragment + `)`)
 	} else {
-		lobregex = regexp.MustCompile(`^[\+\-]git-lob: ([A-Fa-f0-9]{40})`)
+		lobregex = regexp.MustCompile(`^[\+\-]git-lob: (` + SHAPlaceholderRegexFragment + `)`)
 	}
 	fileHeaderRegex := regexp.MustCompile(`diff --git a\/(.+?)\s+b\/(.+)`)
 	fileMergeHeaderRegex := regexp.MustCompile(`diff --cc (.+)`)
 	commitHeaderRegex := regexp.MustCompile(`^commitsha: ([A-Fa-f0-9]{40})(?: ([A-Fa-f0-9]{40}))*`)
+	commitDateRegex := regexp.MustCompile(`^commitdate: (\d+)`)
 
 	scanner := bufio.NewScanner(outp)
 
@@ -296,6 +355,9 @@ func walkGitLogOutputForLOBReferences(outp io.Reader, additions, removals bool,
 				currentCommit = nil
 			}
 			currentCommit = &CommitLOBRef{Commit: sha, Parents: parentSHAs}
+		} else if match := commitDateRegex.FindStringSubmatch(line); match != nil && currentCommit != nil {
+			secs, _ := strconv.ParseInt(match[1], 10, 64)
+			currentCommit.CommitDate = time.Unix(secs, 0)
 		} else if match := fileHeaderRegex.FindStringSubmatch(line); match != nil {
 			// Finding a regular file header
 			// Pertinent file name depends on whether we're listening to additions or removals
@@ -311,7 +373,7 @@ func walkGitLogOutputForLOBReferences(outp io.Reader, additions, removals bool,
 			currentFileIncluded = util.FilenamePassesIncludeExcludeFilter(currentFilename, includePaths, excludePaths)
 		} else if match := lobregex.FindStringSubmatch(line); match != nil {
 			// This is a LOB reference (+/- already matched in variant of regex)
-			sha := match[1]
+			sha := parseLOBPlaceholderSHA(match[1])
 			// Use filename context to include/exclude if paths were used
 			if currentFileIncluded {
 				currentCommit.LobSHAs = append(currentCommit.LobSHAs, sha)
@@ -336,33 +398,54 @@ func walkGitLogOutputForLOBReferences(outp io.Reader, additions, removals bool,
 }
 
 // Gets the default push remote for the working dir
-// Determined from branch.*.remote configuration for the
-// current branch if present, or defaults to origin.
-func GetGitDefaultRemoteForPush() string {
-
-	remote, ok := util.GlobalOptions.GitConfig[fmt.Sprintf("branch.%v.remote", GetGitCurrentBranch())]
-	if ok {
-		return remote
+// As for git, branch.<name>.pushRemote for the current branch, then remote.pushDefault, then
+// branch.<name>.remote, or defaults to origin. So in triangular workflows, e.g. fetching from
+// upstream & pushing to a fork, binaries are pushed wherever commits are.
+func (r *Repo) GetGitDefaultRemoteForPush() string {
+	branch := r.GetGitCurrentBranch()
+	for _, key := range []string{getGitBranchConfigKey(branch, "pushremote"), "remote.pushdefault",
+		getGitBranchConfigKey(branch, "remote")} {
+		if remoteName := r.getGitConfigRemoteName(key); remoteName != "" {
+			return remoteName
+		}
 	}
 	return "origin"
-
 }
 
 // Gets the default fetch remote for the working dir
-// Determined from tracking state of current branch
-// if present, or defaults to origin.
-func GetGitDefaultRemoteForPull() string {
-
-	remoteName, _ := GetGitUpstreamBranch(GetGitCurrentBranch())
+// As for git, branch.<name>.remote for the current branch (push remotes don't affect it), then
+// the remote of its tracking branch if present, or defaults to origin.
+func (r *Repo) GetGitDefaultRemoteForPull() string {
+	branch := r.GetGitCurrentBranch()
+	if remoteName := r.getGitConfigRemoteName(getGitBranchConfigKey(branch, "remote")); remoteName != "" {
+		return remoteName
+	}
+	remoteName, _ := r.GetGitUpstreamBranch(branch)
 	if remoteName != "" {
 		return remoteName
 	}
 	return "origin"
 }
 
+// Gets the key of a branch.<name>.<setting> in Options.GitConfig, where keys are
+// lower case
+func getGitBranchConfigKey(branch, setting string) string {
+	return strings.ToLower(fmt.Sprintf("branch.%v.%v", branch, setting))
+}
+
+// Gets a remote name from git config, "" if not set or it's "." (the local repo, which can't
+// store binaries)
+func (r *Repo) getGitConfigRemoteName(key string) string {
+	remoteName := strings.Trim(strings.TrimSpace(r.Options.GitConfig[key]), `"`)
+	if remoteName == "." {
+		return ""
+	}
+	return remoteName
+}
+
 // Get a list of git remotes
-func GetGitRemotes() ([]string, error) {
-	cmd := exec.Command("git", "remote")
+func (r *Repo) GetGitRemotes() ([]string, error) {
+	cmd := r.command("git", "remote")
 	outp, err := cmd.StdoutPipe()
 	if err != nil {
 		return []string{}, fmt.Errorf("Error calling 'git remote': %v", err.Error())
@@ -378,8 +461,8 @@ func GetGitRemotes() ([]string, error) {
 
 }
 
-func IsGitRemote(remoteName string) bool {
-	remotes, err := GetGitRemotes()
+func (r *Repo) IsGitRemote(remoteName string) bool {
+	remotes, err := r.GetGitRemotes()
 	if err != nil {
 		return false
 	}
@@ -388,18 +471,16 @@ func IsGitRemote(remoteName string) bool {
 	return ret
 }
 
-var cachedCurrentBranch string
-
 // Get the name of the current branch
-func GetGitCurrentBranch() string {
+func (r *Repo) GetGitCurrentBranch() string {
 	// Use cache, we never switch branches ourselves within lifetime so save some
 	// repeat calls if queried more than once
-	if cachedCurrentBranch == "" {
-		cmd := exec.Command("git", "branch")
+	if r.cachedCurrentBranch == "" {
+		cmd := r.command("git", "branch")
 
 		outp, err := cmd.StdoutPipe()
 		if err != nil {
-			util.LogErrorf("Unable to get current branch: %v", err.Error())
+			r.Log.Errorf("Unable to get current branch: %v", err.Error())
 			return ""
 		}
 		cmd.Start()
@@ -409,7 +490,7 @@ func GetGitCurrentBranch() string {
 			line := scanner.Text()
 
 			if line[0] == '*' {
-				cachedCurrentBranch = line[2:]
+				r.cachedCurrentBranch = line[2:]
 				found = true
 				break
 			}
@@ -419,11 +500,11 @@ func GetGitCurrentBranch() string {
 		// There's a special case in a newly initialised repository where 'git branch' returns nothing at all
 		// In this case the branch really is 'master'
 		if !found {
-			cachedCurrentBranch = "master"
+			r.cachedCurrentBranch = "master"
 		}
 	}
 
-	return cachedCurrentBranch
+	return r.cachedCurrentBranch
 
 }
 
@@ -465,12 +546,12 @@ func GitRefIsSHA(ref string) bool {
 	return IsSHARegex.MatchString(ref)
 }
 
-func GitRefToFullSHA(ref string) (string, error) {
+func (r *Repo) GitRefToFullSHA(ref string) (string, error) {
 	if GitRefIsFullSHA(ref) {
 		return ref, nil
 	}
 	// Otherwise use Git to expand to full 40 character SHA
-	cmd := exec.Command("git", "rev-parse", ref)
+	cmd := r.command("git", "rev-parse", ref)
 	outp, err := cmd.Output()
 	if err != nil {
 		return ref, fmt.Errorf("Unknown or ambiguous ref %v", ref)
@@ -479,10 +560,10 @@ func GitRefToFullSHA(ref string) (string, error) {
 }
 
 // Returns whether a ref or SHA refers to a valid, existing commit or not by asking git to resolve it
-func GitRefOrSHAIsValid(refOrSHA string) bool {
+func (r *Repo) GitRefOrSHAIsValid(refOrSHA string) bool {
 	// --verify doesn't actually verify commit object is valid, will return OK if it's just any 40-char SHA
 	// Need to use <sha>^{commit} to verify it's a commit
-	err := exec.Command("git", "rev-parse", "--verify",
+	err := r.command("git", "rev-parse", "--verify",
 		fmt.Sprintf("%v^{commit}", refOrSHA)).Run()
 	return err == nil
 }
@@ -490,8 +571,8 @@ func GitRefOrSHAIsValid(refOrSHA string) bool {
 // Return a list of all local branches
 // Also FYI caches the current branch while we're at it so it's zero-cost to call
 // GetGitCurrentBranch after this
-func GetGitLocalBranches() ([]string, error) {
-	cmd := exec.Command("git", "branch")
+func (r *Repo) GetGitLocalBranches() ([]string, error) {
+	cmd := r.command("git", "branch")
 
 	outp, err := cmd.StdoutPipe()
 	if err != nil {
@@ -499,7 +580,7 @@ func GetGitLocalBranches() ([]string, error) {
 	}
 	cmd.Start()
 	scanner := bufio.NewScanner(outp)
-	foundcurrent := cachedCurrentBranch != ""
+	foundcurrent := r.cachedCurrentBranch != ""
 	var ret []string
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -508,7 +589,7 @@ func GetGitLocalBranches() ([]string, error) {
 			ret = append(ret, branch)
 			// While we're at it, cache current branch
 			if !foundcurrent && line[0] == '*' {
-				cachedCurrentBranch = branch
+				r.cachedCurrentBranch = branch
 				foundcurrent = true
 			}
 
@@ -523,8 +604,8 @@ func GetGitLocalBranches() ([]string, error) {
 
 // Return a list of all remote branches for a given remote
 // Note this doesn't retrieve mappings between local and remote branches, just a simple list
-func GetGitRemoteBranches(remoteName string) ([]string, error) {
-	cmd := exec.Command("git", "branch", "-r")
+func (r *Repo) GetGitRemoteBranches(remoteName string) ([]string, error) {
+	cmd := r.command("git", "branch", "-r")
 
 	outp, err := cmd.StdoutPipe()
 	if err != nil {
@@ -554,10 +635,34 @@ func GetGitRemoteBranches(remoteName string) ([]string, error) {
 
 }
 
+// Return the branches & tags which actually exist on a remote right now (map of ref->commit SHA)
+// Unlike GetGitRemoteBranches this contacts the remote rather than using remote tracking branches
+// Annotated tags are resolved to the commit they point at
+func (r *Repo) GetGitRemoteRefs(remoteName string) (map[string]string, error) {
+	cmd := r.command("git", "ls-remote", "--heads", "--tags", remoteName)
+	outp, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list refs on remote %v: %v", remoteName, err.Error())
+	}
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(outp))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		sha, ref := fields[0], fields[1]
+		// Peeled tags come after the tag itself, so override the tag object SHA
+		ref = strings.TrimSuffix(ref, "^{}")
+		ret[ref] = sha
+	}
+	return ret, nil
+}
+
 // Return a list of branches to push by default, based on push.default and local/remote branches
 // See push.default docs at https://www.kernel.org/pub/software/scm/git/docs/git-config.html
-func GetGitPushDefaultBranches(remoteName string) []string {
-	pushdef := util.GlobalOptions.GitConfig["push.default"]
+func (r *Repo) GetGitPushDefaultBranches(remoteName string) []string {
+	pushdef := r.Options.GitConfig["push.default"]
 	if pushdef == "" {
 		// Use the git 2.0 'simple' default
 		pushdef = "simple"
@@ -565,12 +670,12 @@ func GetGitPushDefaultBranches(remoteName string) []string {
 
 	if pushdef == "matching" {
 		// Multiple branches, but only where remote branch name matches
-		localbranches, err := GetGitLocalBranches()
+		localbranches, err := r.GetGitLocalBranches()
 		if err != nil {
 			// will be logged, safe return
 			return []string{}
 		}
-		remotebranches, err := GetGitRemoteBranches(remoteName)
+		remotebranches, err := r.GetGitRemoteBranches(remoteName)
 		if err != nil {
 			// will be logged, safe return
 			return []string{}
@@ -588,12 +693,12 @@ func GetGitPushDefaultBranches(remoteName string) []string {
 		return ret
 	} else if pushdef == "current" || pushdef == "upstream" || pushdef == "simple" {
 		// Current, upstream, simple (in ascending complexity)
-		currentBranch := GetGitCurrentBranch()
+		currentBranch := r.GetGitCurrentBranch()
 		if pushdef == "current" {
 			return []string{currentBranch}
 		}
 		// For upstream & simple we need to know what the upstream branch is
-		upstreamRemote, upstreamBranch := GetGitUpstreamBranch(currentBranch)
+		upstreamRemote, upstreamBranch := r.GetGitUpstreamBranch(currentBranch)
 		// Only proceed if the upstream is on this remote
 		if upstreamRemote == remoteName && upstreamBranch != "" {
 			if pushdef == "upstream" {
@@ -616,13 +721,13 @@ func GetGitPushDefaultBranches(remoteName string) []string {
 
 // Get the upstream branch for a given local branch, as defined in what 'git pull' would do by default
 // returns the remote name and the remote branch separately for ease of use
-func GetGitUpstreamBranch(localbranch string) (remoteName, remoteBranch string) {
+func (r *Repo) GetGitUpstreamBranch(localbranch string) (remoteName, remoteBranch string) {
 	// Super-verbose mode gives us tracking branch info
-	cmd := exec.Command("git", "branch", "-vv")
+	cmd := r.command("git", "branch", "-vv")
 
 	outp, err := cmd.StdoutPipe()
 	if err != nil {
-		util.LogErrorf("Unable to get list branches: %v", err.Error())
+		r.Log.Errorf("Unable to get list branches: %v", err.Error())
 		return "", ""
 	}
 	cmd.Start()
@@ -655,33 +760,71 @@ func GetGitUpstreamBranch(localbranch string) (remoteName, remoteBranch string)
 
 }
 
+// Run a git command whose output the user should see & which may need their input (e.g. fetch, pull)
+func (r *Repo) runGitCommandOnConsole(args ...string) error {
+	cmd := r.command("git", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Fetch commits from a remote with 'git fetch', showing its output
+func (r *Repo) GitFetch(remoteName string) error {
+	return r.runGitCommandOnConsole("fetch", remoteName)
+}
+
+// Rebase the current branch onto a branch of a remote with 'git pull --rebase', showing its output
+func (r *Repo) GitPullRebase(remoteName, remoteBranch string) error {
+	return r.runGitCommandOnConsole("pull", "--rebase", remoteName, remoteBranch)
+}
+
+// Get the files whose git-lob placeholders were added or changed between 2 commits (sha or ref),
+// i.e. the binary files which would need checking out when moving from one to the other
+// Files which were deleted in 'to' are not included. Filenames are relative to the repo root
+func (r *Repo) GetGitLOBFilesChangedBetween(from, to string) ([]string, error) {
+	cmd := r.command("git", "diff", "--name-only", "-z", "--no-renames", "--diff-filter=d",
+		"-G", SHALineRegexStr, from, to)
+	outp, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list files changed between %v and %v: %v", from, to, err.Error())
+	}
+	var ret []string
+	for _, filename := range strings.Split(string(outp), "\x00") {
+		if filename != "" {
+			ret = append(ret, filename)
+		}
+	}
+	return ret, nil
+}
+
 // Returns list of commits which have LOB SHAs referenced in them, in a given commit range
 // Commits will be in ASCENDING order (parents before children) unlike WalkGitHistory
 // Either of from, to or both can be blank to have an unbounded range of commits based on current HEAD
 // It is required that if both are supplied, 'from' is an ancestor of 'to'
 // Range is exclusive of 'from' and inclusive of 'to'
-func GetGitCommitsReferencingLOBsInRange(from, to string, includePaths, excludePaths []string) ([]*CommitLOBRef, error) {
+func (r *Repo) GetGitCommitsReferencingLOBsInRange(from, to string, includePaths, excludePaths []string) ([]*CommitLOBRef, error) {
 	// We want '+' lines
-	return getGitCommitsReferencingLOBsInRange(from, to, true, false, includePaths, excludePaths)
+	return r.getGitCommitsReferencingLOBsInRange(from, to, true, false, includePaths, excludePaths)
 }
 
 // Returns list of commits which have LOB SHAs referenced in them, in a given commit range
 // Range is exclusive of 'from' and inclusive of 'to'
 // additions/removals controls whether we report only diffs with '+' lines of git-lob, '-' lines, or both
-func getGitCommitsReferencingLOBsInRange(from, to string, additions, removals bool, includePaths, excludePaths []string) ([]*CommitLOBRef, error) {
+func (r *Repo) getGitCommitsReferencingLOBsInRange(from, to string, additions, removals bool, includePaths, excludePaths []string) ([]*CommitLOBRef, error) {
 	var ret []*CommitLOBRef
 	callback := func(commit *CommitLOBRef) (quit bool, err error) {
 		ret = append(ret, commit)
 		return false, nil
 	}
-	err := walkGitCommitsReferencingLOBsInRange(from, to, additions, removals, includePaths, excludePaths, callback)
+	err := r.walkGitCommitsReferencingLOBsInRange(from, to, additions, removals, includePaths, excludePaths, callback)
 	return ret, err
 }
 
 // Walks a list of commits in ascending order which have LOB SHAs referenced in them, in a given commit range
 // Range is exclusive of 'from' and inclusive of 'to'
 // additions/removals controls whether we report only diffs with '+' lines of git-lob, '-' lines, or both
-func walkGitCommitsReferencingLOBsInRange(from, to string, additions, removals bool, includePaths, excludePaths []string,
+func (r *Repo) walkGitCommitsReferencingLOBsInRange(from, to string, additions, removals bool, includePaths, excludePaths []string,
 	callback func(commit *CommitLOBRef) (quit bool, err error)) error {
 
 	args := []string{"log", `--format=commitsha: %H %P`, "-p",
@@ -700,7 +843,7 @@ func walkGitCommitsReferencingLOBsInRange(from, to string, additions, removals b
 		// if from & to are both blank, just use default behaviour of git log
 	}
 
-	cmd := exec.Command("git", args...)
+	cmd := r.command("git", args...)
 	outp, err := cmd.StdoutPipe()
 	if err != nil {
 		return errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
@@ -724,7 +867,7 @@ func walkGitCommitsReferencingLOBsInRange(from, to string, additions, removals b
 // while GetGitCommitsReferencingLOBsInRange wouldn't mention those.
 // Note that git ranges are start AND end inclusive in this case.
 // Note that duplicate SHAs are not eliminated for efficiency, you must do it if you need it
-func GetGitAllLOBsToCheckoutInRefSpec(refspec *GitRefSpec, includePaths, excludePaths []string) ([]string, error) {
+func (r *Repo) GetGitAllLOBsToCheckoutInRefSpec(refspec *GitRefSpec, includePaths, excludePaths []string) ([]string, error) {
 
 	var snapshotref string
 	if refspec.IsRange() {
@@ -737,7 +880,7 @@ func GetGitAllLOBsToCheckoutInRefSpec(refspec *GitRefSpec, includePaths, exclude
 		snapshotref = refspec.Ref1
 	}
 
-	ret, err := GetGitAllLOBsToCheckoutAtCommit(snapshotref, includePaths, excludePaths)
+	ret, err := r.GetGitAllLOBsToCheckoutAtCommit(snapshotref, includePaths, excludePaths)
 	if err != nil {
 		return ret, err
 	}
@@ -749,7 +892,7 @@ func GetGitAllLOBsToCheckoutInRefSpec(refspec *GitRefSpec, includePaths, exclude
 		// to go back to that state
 		// git log is range start exclusive, but that's actually OK since a -git-lob diff line
 		// represents the state one commit earlier, giving us an inclusive start range
-		commits, err := getGitCommitsReferencingLOBsInRange(refspec.Ref1, refspec.Ref2, false, true, includePaths, excludePaths)
+		commits, err := r.getGitCommitsReferencingLOBsInRange(refspec.Ref1, refspec.Ref2, false, true, includePaths, excludePaths)
 		if err != nil {
 			return ret, err
 		}
@@ -774,7 +917,7 @@ func GetGitAllLOBsToCheckoutInRefSpec(refspec *GitRefSpec, includePaths, exclude
 // while GetGitCommitsReferencingLOBsInRange wouldn't mention those.
 // Note that git ranges are start AND end inclusive in this case.
 // Note that duplicate SHAs are not eliminated for efficiency, you must do it if you need it
-func GetGitAllFilesAndLOBsToCheckoutInRefSpec(refspec *GitRefSpec, includePaths, excludePaths []string) ([]*FileLOB, error) {
+func (r *Repo) GetGitAllFilesAndLOBsToCheckoutInRefSpec(refspec *GitRefSpec, includePaths, excludePaths []string) ([]*FileLOB, error) {
 
 	var snapshotref string
 	if refspec.IsRange() {
@@ -787,7 +930,7 @@ func GetGitAllFilesAndLOBsToCheckoutInRefSpec(refspec *GitRefSpec, includePaths,
 		snapshotref = refspec.Ref1
 	}
 
-	ret, err := GetGitAllFilesAndLOBsToCheckoutAtCommit(snapshotref, includePaths, excludePaths)
+	ret, err := r.GetGitAllFilesAndLOBsToCheckoutAtCommit(snapshotref, includePaths, excludePaths)
 	if err != nil {
 		return ret, err
 	}
@@ -799,7 +942,7 @@ func GetGitAllFilesAndLOBsToCheckoutInRefSpec(refspec *GitRefSpec, includePaths,
 		// to go back to that state
 		// git log is range start exclusive, but that's actually OK since a -git-lob diff line
 		// represents the state one commit earlier, giving us an inclusive start range
-		commits, err := getGitCommitsReferencingLOBsInRange(refspec.Ref1, refspec.Ref2, false, true, includePaths, excludePaths)
+		commits, err := r.getGitCommitsReferencingLOBsInRange(refspec.Ref1, refspec.Ref2, false, true, includePaths, excludePaths)
 		if err != nil {
 			return ret, err
 		}
@@ -822,10 +965,17 @@ func GetGitAllFilesAndLOBsToCheckoutInRefSpec(refspec *GitRefSpec, includePaths,
 // as well as a list of LOBs, returns the commit SHA of the earliest change that was included in the scan.
 // Since this is the first *change* included (which would be removing the previous SHA), the earliest LOB
 // SHA included is from the *parent* of this commit.
-func GetGitAllLOBsToCheckoutAtCommitAndRecent(commit string, days int, includePaths,
+func (r *Repo) GetGitAllLOBsToCheckoutAtCommitAndRecent(commit string, days int, includePaths,
 	excludePaths []string) (lobs []string, earliestChangeCommit string, reterr error) {
+	if r.recentHistoryCache != nil {
+		filelobs, earliest, err := r.getCachedFileLOBsToCheckoutAtCommitAndRecent(commit, days, includePaths, excludePaths)
+		for _, filelob := range filelobs {
+			lobs = append(lobs, filelob.SHA)
+		}
+		return lobs, earliest, err
+	}
 	// All LOBs at the commit itself
-	shasAtCommit, err := GetGitAllLOBsToCheckoutAtCommit(commit, includePaths, excludePaths)
+	shasAtCommit, err := r.GetGitAllLOBsToCheckoutAtCommit(commit, includePaths, excludePaths)
 	if err != nil {
 		return nil, "", err
 	}
@@ -834,7 +984,7 @@ func GetGitAllLOBsToCheckoutAtCommitAndRecent(commit string, days int, includePa
 	if days == 0 {
 		earliest := commit
 		if !GitRefIsFullSHA(earliest) {
-			earliest, _ = GitRefToFullSHA(earliest)
+			earliest, _ = r.GitRefToFullSHA(earliest)
 		}
 		return shasAtCommit, earliest, nil
 	} else {
@@ -845,7 +995,7 @@ func GetGitAllLOBsToCheckoutAtCommitAndRecent(commit string, days int, includePa
 			earliestCommit = lobcommit.Commit
 			return false, nil
 		}
-		err := walkGitAllLOBsInRecentCommits(commit, days, includePaths, excludePaths, callback)
+		err := r.walkGitAllLOBsInRecentCommits(commit, days, includePaths, excludePaths, callback)
 
 		return ret, earliestCommit, err
 	}
@@ -859,10 +1009,13 @@ func GetGitAllLOBsToCheckoutAtCommitAndRecent(commit string, days int, includePa
 // as well as a list of LOBs, returns the commit SHA of the earliest change that was included in the scan.
 // Since this is the first *change* included (which would be removing the previous SHA), the earliest LOB
 // SHA included is from the *parent* of this commit.
-func GetGitAllFileLOBsToCheckoutAtCommitAndRecent(commit string, days int, includePaths,
+func (r *Repo) GetGitAllFileLOBsToCheckoutAtCommitAndRecent(commit string, days int, includePaths,
 	excludePaths []string) (filelobs []*FileLOB, earliestChangeCommit string, reterr error) {
+	if r.recentHistoryCache != nil {
+		return r.getCachedFileLOBsToCheckoutAtCommitAndRecent(commit, days, includePaths, excludePaths)
+	}
 	// All LOBs at the commit itself
-	fileshasAtCommit, err := GetGitAllFilesAndLOBsToCheckoutAtCommit(commit, includePaths, excludePaths)
+	fileshasAtCommit, err := r.GetGitAllFilesAndLOBsToCheckoutAtCommit(commit, includePaths, excludePaths)
 	if err != nil {
 		return nil, "", err
 	}
@@ -871,7 +1024,7 @@ func GetGitAllFileLOBsToCheckoutAtCommitAndRecent(commit string, days int, inclu
 	if days == 0 {
 		earliest := commit
 		if !GitRefIsFullSHA(earliest) {
-			earliest, _ = GitRefToFullSHA(earliest)
+			earliest, _ = r.GitRefToFullSHA(earliest)
 		}
 		return fileshasAtCommit, earliest, nil
 	} else {
@@ -882,7 +1035,7 @@ func GetGitAllFileLOBsToCheckoutAtCommitAndRecent(commit string, days int, inclu
 			earliestCommit = lobcommit.Commit
 			return false, nil
 		}
-		err := walkGitAllLOBsInRecentCommits(commit, days, includePaths, excludePaths, callback)
+		err := r.walkGitAllLOBsInRecentCommits(commit, days, includePaths, excludePaths, callback)
 
 		return ret, earliestCommit, err
 	}
@@ -890,10 +1043,10 @@ func GetGitAllFileLOBsToCheckoutAtCommitAndRecent(commit string, days int, inclu
 }
 
 // Walk backwards in history looking for all ancestors and references to LOBs in the '-' side of the diff
-func walkGitAllLOBsInRecentCommits(startcommit string, days int, includePaths, excludePaths []string,
+func (r *Repo) walkGitAllLOBsInRecentCommits(startcommit string, days int, includePaths, excludePaths []string,
 	callback func(lobcommit *CommitLOBRef) (quit bool, err error)) error {
 	// get the commit date
-	commitDetails, err := GetGitCommitSummary(startcommit)
+	commitDetails, err := r.GetGitCommitSummary(startcommit)
 	if err != nil {
 		return err
 	}
@@ -903,12 +1056,12 @@ func walkGitAllLOBsInRecentCommits(startcommit string, days int, includePaths, e
 	// we're looking for *previous* SHAs, which means we're looking for diffs
 	// with a '-' line. So SHAs replaced in the latest commit are old versions too
 	// that we haven't included yet in fileshasAtCommit
-	args := []string{"log", `--format=commitsha: %H %P`, "-p",
+	args := []string{"log", `--format=commitsha: %H %P%ncommitdate: %ct`, "-p",
 		fmt.Sprintf("--since=%v", FormatGitDate(sinceDate)),
 		"-G", SHALineRegexStr,
 		startcommit}
 
-	cmd := exec.Command("git", args...)
+	cmd := r.command("git", args...)
 	outp, err := cmd.StdoutPipe()
 	if err != nil {
 		return errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
@@ -916,26 +1069,228 @@ func walkGitAllLOBsInRecentCommits(startcommit string, days int, includePaths, e
 	cmd.Start()
 
 	// Looking backwards, so removals
-	walkGitLogOutputForLOBReferences(outp, false, true, includePaths, excludePaths, callback)
+	walkGitLogOutputForLOBReferences(outp, false, true, includePaths, excludePaths,
+		r.skipGitShallowBoundaries(callback))
 
 	cmd.Wait()
 
 	return nil
 }
 
+// Get the SHAs of the commits on the first-parent history of a ref which were committed within a
+// window, latest first. Zero times mean no limit at that end, as does maxCount 0
+func (r *Repo) GetGitFirstParentCommitsInWindow(ref string, since, until time.Time, maxCount int) ([]string, error) {
+	args := []string{"rev-list", "--first-parent"}
+	if !since.IsZero() {
+		args = append(args, fmt.Sprintf("--since=%v", FormatGitDate(since)))
+	}
+	if !until.IsZero() {
+		args = append(args, fmt.Sprintf("--until=%v", FormatGitDate(until)))
+	}
+	if maxCount > 0 {
+		args = append(args, fmt.Sprintf("--max-count=%d", maxCount))
+	}
+	args = append(args, ref, "--")
+	outp, err := r.command("git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to call git rev-list for %v: %v", ref, err.Error())
+	}
+	return strings.Fields(string(outp)), nil
+}
+
+// Recent history walked back from a commit, kept in Repo.recentHistoryCache
+type recentLOBHistory struct {
+	// How many days back from the commit date the walk went
+	days       int
+	commitDate time.Time
+	// All binaries at the commit itself, unfiltered
+	atCommit []*FileLOB
+	// Commits which changed binaries, with the '-' side of the diff, unfiltered
+	changes []*CommitLOBRef
+}
+
+// Keep the results of walking recent history from each commit (see
+// GetGitAllLOBsToCheckoutAtCommitAndRecent) until ClearRecentHistoryCache, so that operations in
+// the same process looking at the same commits, e.g. fetch followed by prune, only walk history
+// once. Walks which go back at all go back at least minDays, so that a later operation which looks
+// further back than an earlier one (e.g. retention periods longer than fetch periods) doesn't have
+// to walk again.
+// Returns false if the cache was already in use, in which case the caller shouldn't clear it
+func (r *Repo) CacheRecentHistory(minDays int) bool {
+	if r.recentHistoryCache != nil {
+		if minDays > r.recentHistoryCacheMinDays {
+			r.recentHistoryCacheMinDays = minDays
+		}
+		return false
+	}
+	r.recentHistoryCache = make(map[string]*recentLOBHistory)
+	r.recentHistoryCacheMinDays = minDays
+	return true
+}
+
+// Stop caching recent history, see CacheRecentHistory
+func (r *Repo) ClearRecentHistoryCache() {
+	r.recentHistoryCache = nil
+	r.recentHistoryCacheMinDays = 0
+}
+
+// Implementation of GetGitAllFileLOBsToCheckoutAtCommitAndRecent when caching recent history
+// Each commit's history is walked once without include/exclude paths, which are applied afterwards
+func (r *Repo) getCachedFileLOBsToCheckoutAtCommitAndRecent(commit string, days int, includePaths,
+	excludePaths []string) ([]*FileLOB, string, error) {
+	sha := commit
+	if !GitRefIsFullSHA(sha) {
+		var err error
+		sha, err = r.GitRefToFullSHA(commit)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	history, ok := r.recentHistoryCache[sha]
+	if !ok || history.days < days {
+		walkdays := days
+		if walkdays > 0 && walkdays < r.recentHistoryCacheMinDays {
+			walkdays = r.recentHistoryCacheMinDays
+		}
+		var err error
+		history, err = r.walkRecentLOBHistory(sha, walkdays)
+		if err != nil {
+			return nil, "", err
+		}
+		r.recentHistoryCache[sha] = history
+	} else {
+		r.Log.Debugf("Using history of %v already walked for %dd\n", sha, history.days)
+	}
+
+	var ret []*FileLOB
+	for _, filelob := range history.atCommit {
+		if util.FilenamePassesIncludeExcludeFilter(filelob.Filename, includePaths, excludePaths) {
+			ret = append(ret, filelob)
+		}
+	}
+	earliestCommit := sha
+	if days > 0 {
+		// Uncached walks report the ref as given if nothing changed
+		earliestCommit = commit
+		// Same as git log --since, see walkGitAllLOBsInRecentCommits
+		sinceDate := history.commitDate.AddDate(0, 0, -days)
+		for _, change := range history.changes {
+			if change.CommitDate.Before(sinceDate) {
+				continue
+			}
+			// Like the walk, only commits which changed included files count
+			included := false
+			for _, filelob := range change.FileLOBs {
+				if util.FilenamePassesIncludeExcludeFilter(filelob.Filename, includePaths, excludePaths) {
+					ret = append(ret, filelob)
+					included = true
+				}
+			}
+			if included {
+				earliestCommit = change.Commit
+			}
+		}
+	}
+	return ret, earliestCommit, nil
+}
+
+// Snapshot a commit & walk its history for days, unfiltered, for Repo.recentHistoryCache
+func (r *Repo) walkRecentLOBHistory(sha string, days int) (*recentLOBHistory, error) {
+	commitDetails, err := r.GetGitCommitSummary(sha)
+	if err != nil {
+		return nil, err
+	}
+	ret := &recentLOBHistory{days: days, commitDate: commitDetails.CommitDate}
+	ret.atCommit, err = r.GetGitAllFilesAndLOBsToCheckoutAtCommit(sha, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if days > 0 {
+		callback := func(lobcommit *CommitLOBRef) (quit bool, err error) {
+			ret.changes = append(ret.changes, lobcommit)
+			return false, nil
+		}
+		err = r.walkGitAllLOBsInRecentCommits(sha, days, nil, nil, callback)
+	}
+	return ret, err
+}
+
 // Return a slice of LOB SHAs representing versions of filename, ordered by latest first
 // history is from all heads not just checked out
 // if shatoskip is supplied, this sha is excluded from the return if found
-func GetGitAllLOBHistoryForFile(filename, shatoskip string) ([]string, error) {
+func (r *Repo) GetGitAllLOBHistoryForFile(filename, shatoskip string) ([]string, error) {
+	commits, err := r.getGitLOBHistoryCommitsForFile(filename, "")
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, commitLOB := range commits {
+		sha := commitLOB.FileLOBs[0].SHA
+		if sha != shatoskip {
+			ret = append(ret, sha)
+		}
+	}
+	return ret, nil
+}
 
-	// Scan ALL history for this filename that includes a git-lob marker
-	// not just history from checked out
-	args := []string{"log", `--format=commitsha: %H %P`, "-p",
-		"--all", "--topo-order", // ALL history in reverse order
+// Find a filename each of a batch of LOBs has been committed as, from the latest commit which
+// added it. History is walked once for the whole batch, from refs, or from all heads if refs is
+// empty, and stops when every LOB has been found. LOBs no commit adds are left out of the map
+func (r *Repo) GetGitFilenamesForLOBs(shas, refs []string) (map[string]string, error) {
+	ret := make(map[string]string, len(shas))
+	if len(shas) == 0 {
+		return ret, nil
+	}
+	wanted := util.NewStringSetFromSlice(shas)
+	args := []string{"-c", "core.quotepath=false", "log", `--format=commitsha: %H %P`, "-p"}
+	if len(refs) == 0 {
+		args = append(args, "--all")
+	} else {
+		args = append(args, refs...)
+	}
+	args = append(args, "--topo-order", "-G", SHALineRegexStr, "--")
+
+	cmd := r.command("git", args...)
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find filenames for LOBs: %v", err.Error())
+	}
+	cmd.Start()
+	callback := func(commitLOB *CommitLOBRef) (quit bool, err error) {
+		for _, filelob := range commitLOB.FileLOBs {
+			if _, found := ret[filelob.SHA]; !found && wanted.Contains(filelob.SHA) {
+				ret[filelob.SHA] = filelob.Filename
+			}
+		}
+		return len(ret) == wanted.Cardinality(), nil
+	}
+	quit, _ := walkGitLogOutputForLOBReferences(outp, true, false, nil, nil, callback)
+	if quit {
+		// Don't make git finish the rest of history
+		cmd.Process.Kill()
+	}
+	cmd.Wait()
+
+	return ret, nil
+}
+
+// Return the commits which added versions of filename, each with the single FileLOB added, ordered
+// by latest first. History is walked from ref, or from all heads if ref is blank
+func (r *Repo) getGitLOBHistoryCommitsForFile(filename, ref string) ([]*CommitLOBRef, error) {
+
+	// Scan history for this filename that includes a git-lob marker
+	args := []string{"log", `--format=commitsha: %H %P`, "-p"}
+	if ref == "" {
+		// ALL history not just from checked out
+		args = append(args, "--all")
+	} else {
+		args = append(args, ref)
+	}
+	args = append(args, "--topo-order", // in reverse order
 		"-G", SHALineRegexStr,
-		"--", filename}
+		"--", filename)
 
-	cmd := exec.Command("git", args...)
+	cmd := r.command("git", args...)
 	outp, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
@@ -943,14 +1298,11 @@ func GetGitAllLOBHistoryForFile(filename, shatoskip string) ([]string, error) {
 	cmd.Start()
 
 	// We'll just look for additions ever, walking backwards
-	var ret []string
+	var ret []*CommitLOBRef
 	callback := func(commitLOB *CommitLOBRef) (quit bool, err error) {
 		// Already filtered by filename so there can only be one entry, but be sure
 		if len(commitLOB.FileLOBs) == 1 {
-			sha := commitLOB.FileLOBs[0].SHA
-			if sha != shatoskip {
-				ret = append(ret, sha)
-			}
+			ret = append(ret, commitLOB)
 		}
 		return false, nil
 	}
@@ -963,25 +1315,25 @@ func GetGitAllLOBHistoryForFile(filename, shatoskip string) ([]string, error) {
 }
 
 // Get all the binary files & their LOB SHAs that you would need to check out at a given commit (not changed in that commit)
-func GetGitAllFilesAndLOBsToCheckoutAtCommit(commit string, includePaths, excludePaths []string) ([]*FileLOB, error) {
+func (r *Repo) GetGitAllFilesAndLOBsToCheckoutAtCommit(commit string, includePaths, excludePaths []string) ([]*FileLOB, error) {
 	var ret []*FileLOB
-	err := WalkGitAllLOBsToCheckoutAtCommit(commit, includePaths, excludePaths, func(filelob *FileLOB) {
+	err := r.WalkGitAllLOBsToCheckoutAtCommit(commit, includePaths, excludePaths, func(filelob *FileLOB) {
 		ret = append(ret, filelob)
 	})
 	return ret, err
 }
 
 // Get all the LOB SHAs that you would need to check out at a given commit (not changed in that commit)
-func GetGitAllLOBsToCheckoutAtCommit(commit string, includePaths, excludePaths []string) ([]string, error) {
+func (r *Repo) GetGitAllLOBsToCheckoutAtCommit(commit string, includePaths, excludePaths []string) ([]string, error) {
 	var ret []string
-	err := WalkGitAllLOBsToCheckoutAtCommit(commit, includePaths, excludePaths, func(filelob *FileLOB) {
+	err := r.WalkGitAllLOBsToCheckoutAtCommit(commit, includePaths, excludePaths, func(filelob *FileLOB) {
 		ret = append(ret, filelob.SHA)
 	})
 	return ret, err
 }
 
 // Utility function to walk through all the LOBs which are present if checked out at a specific commit
-func WalkGitAllLOBsToCheckoutAtCommit(commit string, includePaths, excludePaths []string,
+func (r *Repo) WalkGitAllLOBsToCheckoutAtCommit(commit string, includePaths, excludePaths []string,
 	callback func(filelob *FileLOB)) error {
 
 	// Snapshot using ls-tree
@@ -991,7 +1343,7 @@ func WalkGitAllLOBsToCheckoutAtCommit(commit string, includePaths, excludePaths
 		"--full-tree", // start at the root regardless of where we are in it
 		commit}
 
-	lstreecmd := exec.Command("git", args...)
+	lstreecmd := r.command("git", args...)
 	outp, err := lstreecmd.StdoutPipe()
 	if err != nil {
 		return errors.New(fmt.Sprintf("Unable to call git ls-tree: %v", err.Error()))
@@ -1000,13 +1352,14 @@ func WalkGitAllLOBsToCheckoutAtCommit(commit string, includePaths, excludePaths
 	lstreecmd.Start()
 	lstreescanner := bufio.NewScanner(outp)
 
-	// We will look for objects that are *exactly* the size of the git-lob line
-	regex := regexp.MustCompile(fmt.Sprintf(`^\d+\s+blob\s+([0-9a-zA-Z]{40})\s+%d\s+(.*)$`, SHALineLen))
-	// This will give us object SHAs of content which is exactly the right size, we must
+	// We will look for objects that are the size of a git-lob placeholder (either kind, with or
+	// without metadata)
+	regex := regexp.MustCompile(`^\d+\s+blob\s+([0-9a-zA-Z]{40})\s+(\d+)\s+(.*)$`)
+	// This will give us object SHAs of content which is the right size, we must
 	// then use cat-file (in batch mode) to get the content & parse out anything that's really
 	// a git-lob reference.
 	// Start git cat-file in parallel and feed its stdin
-	catfilecmd := exec.Command("git", "cat-file", "--batch")
+	catfilecmd := r.command("git", "cat-file", "--batch")
 	catout, err := catfilecmd.StdoutPipe()
 	if err != nil {
 		return errors.New(fmt.Sprintf("Unable to call git cat-file: %v", err.Error()))
@@ -1018,19 +1371,22 @@ func WalkGitAllLOBsToCheckoutAtCommit(commit string, includePaths, excludePaths
 	}
 	defer catin.Close()
 	catfilecmd.Start()
-	catscanner := bufio.NewScanner(catout)
+	catreader := bufio.NewReader(catout)
 
 	for lstreescanner.Scan() {
 		line := lstreescanner.Text()
 		if match := regex.FindStringSubmatch(line); match != nil {
 			objsha := match[1]
-			filename := match[2]
+			size, _ := strconv.ParseInt(match[2], 10, 64)
+			filename := match[3]
+			if !isLOBPlaceholderSize(size) {
+				continue
+			}
 			// Apply filter
 			if !util.FilenamePassesIncludeExcludeFilter(filename, includePaths, excludePaths) {
 				continue
 			}
 			// Now feed object sha to cat-file to get git-lob SHA if any
-			// remember we're already only finding files of exactly the right size (49 bytes)
 			_, err := catin.Write([]byte(objsha))
 			if err != nil {
 				return errors.New(fmt.Sprintf("Unable to write to cat-file stream: %v", err.Error()))
@@ -1040,18 +1396,19 @@ func WalkGitAllLOBsToCheckoutAtCommit(commit string, includePaths, excludePaths
 				return errors.New(fmt.Sprintf("Unable to write to cat-file stream: %v", err.Error()))
 			}
 
-			// Now read back response - first line is report of object sha, type & size
-			// second line is content in our case
-			if !catscanner.Scan() || !catscanner.Scan() {
-				return errors.New(fmt.Sprintf("Couldn't read response from cat-file stream: %v", catscanner.Err()))
+			// Now read back response - first line is report of object sha, type & size,
+			// then exactly that much content (which may include newlines) and a newline
+			if _, err := catreader.ReadString('\n'); err != nil {
+				return errors.New(fmt.Sprintf("Couldn't read response from cat-file stream: %v", err))
+			}
+			content := make([]byte, size+1)
+			if _, err := io.ReadFull(catreader, content); err != nil {
+				return errors.New(fmt.Sprintf("Couldn't read response from cat-file stream: %v", err))
 			}
 
-			// object SHA is the last 40 characters, after the prefix
-			line := catscanner.Text()
-			if len(line) == SHALineLen {
-				lobsha := line[len(SHAPrefix):]
+			if placeholder, ok := parseLOBPlaceholder(content[:size]); ok {
 				// call callback to process result
-				callback(&FileLOB{filename, lobsha})
+				callback(&FileLOB{filename, placeholder.SHA})
 			}
 
 		}
@@ -1082,8 +1439,8 @@ func FormatGitDate(t time.Time) string {
 }
 
 // Get summary information about a commit
-func GetGitCommitSummary(commit string) (*GitCommitSummary, error) {
-	cmd := exec.Command("git", "show", "-s",
+func (r *Repo) GetGitCommitSummary(commit string) (*GitCommitSummary, error) {
+	cmd := r.command("git", "show", "-s",
 		`--format=%H|%h|%P|%ai|%ci|%ae|%an|%ce|%cn|%s`, commit)
 
 	out, err := cmd.CombinedOutput()
@@ -1124,10 +1481,10 @@ func GetGitCommitSummary(commit string) (*GitCommitSummary, error) {
 // You can also set numdays to -1 to not have any limit but still get them in reverse order
 // remoteName is optional but if specified and includeRemoteBranches is true, will only include
 // remote branches on that remote
-func GetGitRecentRefs(numdays int, includeRemoteBranches bool, remoteName string) ([]*GitRef, error) {
+func (r *Repo) GetGitRecentRefs(numdays int, includeRemoteBranches bool, remoteName string) ([]*GitRef, error) {
 	// Include %(objectname) AND %(*objectname), the latter only returns something if it's a tag
 	// and that will be the dereferenced SHA ie the actual commit SHA instead of the tag SHA
-	cmd := exec.Command("git", "for-each-ref",
+	cmd := r.command("git", "for-each-ref",
 		`--sort=-committerdate`,
 		`--format=%(refname) %(objectname) %(*objectname)`,
 		"refs")
@@ -1175,7 +1532,7 @@ func GetGitRecentRefs(numdays int, includeRemoteBranches bool, remoteName string
 			// This is a ref we might use
 			if numdays >= 0 {
 				// Check the date
-				commit, err := GetGitCommitSummary(ref)
+				commit, err := r.GetGitCommitSummary(ref)
 				if err != nil {
 					return ret, err
 				}
@@ -1197,7 +1554,7 @@ func GetGitRecentRefs(numdays int, includeRemoteBranches bool, remoteName string
 // modifications for git-status and so can consider files modified when they're actually not
 // when we've changed things that the filter would consider unmodified when called via git-diff.
 // 'files' is a list of files with paths relative to the repo root
-func GitRefreshIndexForFiles(files []string) error {
+func (r *Repo) GitRefreshIndexForFiles(files []string) error {
 	var retErr error
 	// Since we don't know how many there will be, potentially split into many commands
 	errorFunc := func(args []string, output string, err error) (abort bool) {
@@ -1213,9 +1570,9 @@ func GitRefreshIndexForFiles(files []string) error {
 		}
 		return false // don't abort
 	}
-	// Need to make file list (which files are relative to repo root) relative to cwd for git's purposes
-	relfiles := util.MakeRepoFileListRelativeToCwd(files)
-	util.ExecForManyFilesSplitIfRequired(relfiles, errorFunc,
+	// Need to make file list (which files are relative to repo root) relative to WorkDir, where git runs
+	relfiles := util.MakeRepoFileListRelativeToDir(files, r.Root, r.WorkDir, r.Log)
+	util.ExecForManyFilesSplitIfRequired(r.WorkDir, relfiles, errorFunc,
 		"git", "update-index", "-q", "--really-refresh", "--")
 
 	return retErr
@@ -1252,8 +1609,8 @@ func ParseGitRefToTypeAndName(fullref string) (t GitRefType, name string) {
 }
 
 // get all refs in the repo (branches, tags, stashes)
-func GetGitAllRefs() ([]*GitRef, error) {
-	cmd := exec.Command("git", "show-ref", "--head", "--dereference")
+func (r *Repo) GetGitAllRefs() ([]*GitRef, error) {
+	cmd := r.command("git", "show-ref", "--head", "--dereference")
 	outp, err := cmd.StdoutPipe()
 	if err != nil {
 		return []*GitRef{}, fmt.Errorf("Failure in git-show-ref: %v", err.Error())
@@ -1309,23 +1666,23 @@ func GetGitAllRefs() ([]*GitRef, error) {
 }
 
 // Returns whether commit a (sha or ref) is an ancestor of commit b (sha or ref)
-func GitIsAncestor(a, b string) (bool, error) {
+func (r *Repo) GitIsAncestor(a, b string) (bool, error) {
 
 	if !GitRefIsSHA(a) {
 		var err error
-		a, err = GitRefToFullSHA(a)
+		a, err = r.GitRefToFullSHA(a)
 		if err != nil {
 			return false, err
 		}
 	}
 	if !GitRefIsSHA(b) {
 		var err error
-		b, err = GitRefToFullSHA(b)
+		b, err = r.GitRefToFullSHA(b)
 		if err != nil {
 			return false, err
 		}
 	}
-	cmd := exec.Command("git", "merge-base", a, b)
+	cmd := r.command("git", "merge-base", a, b)
 	outp, err := cmd.Output()
 	if err != nil {
 		return false, err
@@ -1338,10 +1695,10 @@ func GitIsAncestor(a, b string) (bool, error) {
 
 // Returns the 'best' ancestor of all the passed in refs (as a SHA)
 // If a ref is listed twice the 'best' ancestor will be itself
-func GetGitBestAncestor(refs []string) (ancestor string, err error) {
+func (r *Repo) GetGitBestAncestor(refs []string) (ancestor string, err error) {
 	args := []string{"merge-base"}
 	args = append(args, refs...)
-	cmd := exec.Command("git", args...)
+	cmd := r.command("git", args...)
 	outp, err := cmd.Output()
 	if err != nil {
 		return "", err
@@ -1351,8 +1708,8 @@ func GetGitBestAncestor(refs []string) (ancestor string, err error) {
 }
 
 // Gets the latest change to a specific LOB file at ref, returning the SHA and the commit details
-func GetGitLatestLOBChangeDetails(filename, ref string) (summary *GitCommitSummary, lobsha string, err error) {
-	cmd := exec.Command("git", "log", "-p",
+func (r *Repo) GetGitLatestLOBChangeDetails(filename, ref string) (summary *GitCommitSummary, lobsha string, err error) {
+	cmd := r.command("git", "log", "-p",
 		"-n", "1", // one commit
 		"-G", SHALineRegexStr, // if this file was ever embedded verbatim, ignore those
 		`--format=commit:%H|%h|%P|%ai|%ci|%ae|%an|%ce|%cn|%s`, // standard summary info
@@ -1365,7 +1722,7 @@ func GetGitLatestLOBChangeDetails(filename, ref string) (summary *GitCommitSumma
 	scanner := bufio.NewScanner(outp)
 	summary = &GitCommitSummary{}
 	lobsha = ""
-	lobsharegex := regexp.MustCompile(`^\+git-lob: ([A-Fa-f0-9]{40})`)
+	lobsharegex := regexp.MustCompile(`^\+git-lob: (` + SHAPlaceholderRegexFragment + `)`)
 	err = nil
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -1393,7 +1750,7 @@ func GetGitLatestLOBChangeDetails(filename, ref string) (summary *GitCommitSumma
 				return nil, "", errors.New(msg)
 			}
 		} else if match := lobsharegex.FindStringSubmatch(line); match != nil {
-			lobsha = match[1]
+			lobsha = parseLOBPlaceholderSHA(match[1])
 		}
 	}
 	return
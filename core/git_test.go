@@ -60,7 +60,7 @@ var _ = Describe("Git tests", func() {
 			var walkedParents = make([]string, 0, len(commitPoints))
 
 			walkedCount := 0
-			err := WalkGitHistory(headSHA, func(currentSHA, parentSHA string) (quit bool, err error) {
+			err := testRepo().WalkGitHistory(headSHA, func(currentSHA, parentSHA string) (quit bool, err error) {
 				walkedCommits = append(walkedCommits, currentSHA)
 				if parentSHA != "" {
 					walkedParents = append(walkedParents, parentSHA)
@@ -165,7 +165,7 @@ var _ = Describe("Git tests", func() {
 			CreateGitRepoForTest(root)
 			oldwd, _ = os.Getwd()
 			os.Chdir(root)
-			cachedCurrentBranch = ""
+			testRepo().cachedCurrentBranch = ""
 		})
 		AfterEach(func() {
 			os.Chdir(oldwd)
@@ -173,27 +173,52 @@ var _ = Describe("Git tests", func() {
 			if err != nil {
 				Fail(err.Error())
 			}
-			cachedCurrentBranch = ""
+			testRepo().cachedCurrentBranch = ""
 		})
 		It("Identifies current branch", func() {
-			Expect(GetGitCurrentBranch()).To(Equal("master"), "Before 1st commit should be master branch")
-			cachedCurrentBranch = ""
+			Expect(testRepo().GetGitCurrentBranch()).To(Equal("master"), "Before 1st commit should be master branch")
+			testRepo().cachedCurrentBranch = ""
 			exec.Command("git", "commit", "--allow-empty", "-m", "First commit").Run()
-			Expect(GetGitCurrentBranch()).To(Equal("master"), "After 1st commit should be master branch")
-			cachedCurrentBranch = ""
+			Expect(testRepo().GetGitCurrentBranch()).To(Equal("master"), "After 1st commit should be master branch")
+			testRepo().cachedCurrentBranch = ""
 			CreateBranchForTest("feature1")
 			CheckoutForTest("feature1")
-			Expect(GetGitCurrentBranch()).To(Equal("feature1"), "After creating new branch current branch should be updated")
+			Expect(testRepo().GetGitCurrentBranch()).To(Equal("feature1"), "After creating new branch current branch should be updated")
 			exec.Command("git", "commit", "--allow-empty", "-m", "Second commit").Run()
-			cachedCurrentBranch = ""
-			Expect(GetGitCurrentBranch()).To(Equal("feature1"), "After creating new branch & committing current branch should be updated")
+			testRepo().cachedCurrentBranch = ""
+			Expect(testRepo().GetGitCurrentBranch()).To(Equal("feature1"), "After creating new branch & committing current branch should be updated")
 			//cachedCurrentBranch = "" - note NOT clearing cache to test it
 			exec.Command("git", "checkout", "master").Run()
-			Expect(GetGitCurrentBranch()).To(Equal("feature1"), "Without clearing cache, current branch should be previous value")
-			cachedCurrentBranch = ""
-			Expect(GetGitCurrentBranch()).To(Equal("master"), "After clearing cache, current branch should be updated")
+			Expect(testRepo().GetGitCurrentBranch()).To(Equal("feature1"), "Without clearing cache, current branch should be previous value")
+			testRepo().cachedCurrentBranch = ""
+			Expect(testRepo().GetGitCurrentBranch()).To(Equal("master"), "After clearing cache, current branch should be updated")
 
 		})
+		It("Picks default push & fetch remotes as git does", func() {
+			oldOptions := *GlobalOptions
+			defer func() { *GlobalOptions = oldOptions }()
+			exec.Command("git", "commit", "--allow-empty", "-m", "First commit").Run()
+			CreateBranchForTest("Feature/X")
+			CheckoutForTest("Feature/X")
+			testRepo().cachedCurrentBranch = ""
+			// Keys are read in lower case
+			GlobalOptions.GitConfig = map[string]string{}
+			Expect(testRepo().GetGitDefaultRemoteForPush()).To(Equal("origin"))
+			Expect(testRepo().GetGitDefaultRemoteForPull()).To(Equal("origin"))
+			GlobalOptions.GitConfig["branch.feature/x.remote"] = "upstream"
+			Expect(testRepo().GetGitDefaultRemoteForPush()).To(Equal("upstream"))
+			Expect(testRepo().GetGitDefaultRemoteForPull()).To(Equal("upstream"))
+			GlobalOptions.GitConfig["remote.pushdefault"] = "fork"
+			Expect(testRepo().GetGitDefaultRemoteForPush()).To(Equal("fork"), "remote.pushDefault should override branch.<name>.remote")
+			Expect(testRepo().GetGitDefaultRemoteForPull()).To(Equal("upstream"), "remote.pushDefault should not affect fetching")
+			GlobalOptions.GitConfig["branch.feature/x.pushremote"] = "mine"
+			Expect(testRepo().GetGitDefaultRemoteForPush()).To(Equal("mine"), "branch.<name>.pushRemote should override remote.pushDefault")
+			Expect(testRepo().GetGitDefaultRemoteForPull()).To(Equal("upstream"), "branch.<name>.pushRemote should not affect fetching")
+			GlobalOptions.GitConfig["branch.feature/x.pushremote"] = "."
+			GlobalOptions.GitConfig["branch.feature/x.remote"] = "."
+			Expect(testRepo().GetGitDefaultRemoteForPush()).To(Equal("fork"), "the local repo isn't a remote")
+			Expect(testRepo().GetGitDefaultRemoteForPull()).To(Equal("origin"), "the local repo isn't a remote")
+		})
 
 	})
 	Describe("GetGitListBranches", func() {
@@ -224,7 +249,7 @@ var _ = Describe("Git tests", func() {
 			CreateBranchForTest("release/1.2")
 			CreateBranchForTest("something")
 
-			branches, err := GetGitLocalBranches()
+			branches, err := testRepo().GetGitLocalBranches()
 			Expect(err).To(BeNil(), "Should not error in GetGitLocalBranches")
 			Expect(branches).To(HaveLen(6), "Should be 6 branches")
 			Expect(branches).To(ContainElement("master"))
@@ -292,7 +317,7 @@ var _ = Describe("Git tests", func() {
 
 			// Create a bunch of local branches
 			// List remote branches
-			remoteBranches, err := GetGitRemoteBranches("origin")
+			remoteBranches, err := testRepo().GetGitRemoteBranches("origin")
 			Expect(err).To(BeNil(), "Should not error listing remote branches")
 			Expect(remoteBranches).To(HaveLen(4), "Should be 3 remote branches")
 			Expect(remoteBranches).To(ContainElement("master"), "Remote branch list check")
@@ -301,19 +326,19 @@ var _ = Describe("Git tests", func() {
 			Expect(remoteBranches).To(ContainElement("something"), "Remote branch list check")
 
 			// now check tracking
-			remote, branch := GetGitUpstreamBranch("master")
+			remote, branch := testRepo().GetGitUpstreamBranch("master")
 			Expect(remote).To(Equal("origin"), "Remote should be origin in tracking")
 			Expect(branch).To(Equal("master"), "Master should track master")
-			remote, branch = GetGitUpstreamBranch("feature/ABC")
+			remote, branch = testRepo().GetGitUpstreamBranch("feature/ABC")
 			Expect(remote).To(Equal("origin"), "Remote should be origin in tracking")
 			Expect(branch).To(Equal("feature/ABC"), "feature/ABC should track feature/ABC")
-			remote, branch = GetGitUpstreamBranch("feature/DEF")
+			remote, branch = testRepo().GetGitUpstreamBranch("feature/DEF")
 			Expect(remote).To(Equal("origin"), "Remote should be origin in tracking")
 			Expect(branch).To(Equal("feature/DEFchangedonremote"), "feature/DEF should track feature/DEFchangedonremote")
-			remote, branch = GetGitUpstreamBranch("something")
+			remote, branch = testRepo().GetGitUpstreamBranch("something")
 			Expect(remote).To(Equal(""), "Should be no remote for untracked branch")
 			Expect(branch).To(Equal(""), "Should be no branch for untracked branch")
-			remote, branch = GetGitUpstreamBranch("release/1.1")
+			remote, branch = testRepo().GetGitUpstreamBranch("release/1.1")
 			Expect(remote).To(Equal(""), "Should be no remote for untracked branch")
 			Expect(branch).To(Equal(""), "Should be no branch for untracked branch")
 
@@ -321,32 +346,32 @@ var _ = Describe("Git tests", func() {
 			// Make 2 local commits on master, test ahead only
 			exec.Command("git", "commit", "--allow-empty", "-m", "4th commit").Run()
 			exec.Command("git", "commit", "--allow-empty", "-m", "5th commit").Run()
-			remote, branch = GetGitUpstreamBranch("master")
+			remote, branch = testRepo().GetGitUpstreamBranch("master")
 			Expect(remote).To(Equal("origin"), "Remote should be origin in tracking when ahead")
 			Expect(branch).To(Equal("master"), "Master should track master when ahead")
 			// Push these to remote so we can test behind
 			exec.Command("git", "push", "origin", "master:master").Run()
 			// now reset 1 commit back so we're ahead 1, behind 1
 			exec.Command("git", "reset", "--hard", "HEAD^").Run()
-			remote, branch = GetGitUpstreamBranch("master")
+			remote, branch = testRepo().GetGitUpstreamBranch("master")
 			Expect(remote).To(Equal("origin"), "Remote should be origin in tracking when ahead and behind")
 			Expect(branch).To(Equal("master"), "Master should track master when ahead and behind")
 			// now reset 1 MORE commit back so we're behind 2
 			exec.Command("git", "reset", "--hard", "HEAD^").Run()
-			remote, branch = GetGitUpstreamBranch("master")
+			remote, branch = testRepo().GetGitUpstreamBranch("master")
 			Expect(remote).To(Equal("origin"), "Remote should be origin in tracking when behind")
 			Expect(branch).To(Equal("master"), "Master should track master when behind")
 
 		})
 
 		It("Lists remotes", func() {
-			remotes, err := GetGitRemotes()
+			remotes, err := testRepo().GetGitRemotes()
 			Expect(err).To(BeNil(), "Shouldn't be error listing remotes")
 			Expect(remotes).To(ConsistOf([]string{"origin", "fork1", "fork2"}), "Remote list should be correct")
 		})
 
 		It("Lists all refs correctly", func() {
-			refs, err := GetGitAllRefs()
+			refs, err := testRepo().GetGitAllRefs()
 			Expect(err).To(BeNil(), "Shouldn't be an error getting all refs")
 			expectedrefs := map[string]GitRefType{
 				"HEAD":                              GitRefTypeHEAD,
@@ -374,7 +399,7 @@ var _ = Describe("Git tests", func() {
 					b, _ := exec.Command("git", "rev-parse", fmt.Sprintf("%v^{commit}", ref.Name)).CombinedOutput()
 					expectedsha = strings.TrimSpace(string(b))
 				} else {
-					expectedsha, _ = GitRefToFullSHA(ref.Name)
+					expectedsha, _ = testRepo().GitRefToFullSHA(ref.Name)
 				}
 				Expect(ref.CommitSHA).To(Equal(expectedsha), "Commit SHA should be correct")
 			}
@@ -468,7 +493,7 @@ var _ = Describe("Git tests", func() {
 			It("Retrieves LOB references", func() {
 				// Now let's retrieve LOBs
 				// Entire history on current branch
-				commitlobs, err := GetGitCommitsReferencingLOBsInRange("", "", nil, nil)
+				commitlobs, err := testRepo().GetGitCommitsReferencingLOBsInRange("", "", nil, nil)
 				Expect(err).To(BeNil(), "Should not fail calling GetGitCommitsReferencingLOBsInRange")
 				// There are 6 commits on the master branch, but only 5 reference LOBs
 				Expect(commitlobs).To(HaveLen(5), "Master branch should have 5 commits referencing LOBs")
@@ -476,20 +501,20 @@ var _ = Describe("Git tests", func() {
 					Expect(commit.LobSHAs).To(Equal(correctSHAs[i]), "Commit %d should have correct SHAs", i)
 				}
 				// Just feature branch
-				commitlobs, err = GetGitCommitsReferencingLOBsInRange("tag3", "feature/1", nil, nil)
+				commitlobs, err = testRepo().GetGitCommitsReferencingLOBsInRange("tag3", "feature/1", nil, nil)
 				Expect(err).To(BeNil(), "Should not fail calling GetGitCommitsReferencingLOBsInRange")
 				// 2 commits from tag3 to feature/1, excluding tag3 itself
 				Expect(commitlobs).To(HaveLen(2), "Feature branch should have 2 commits referencing LOBs")
 				Expect(commitlobs[0].LobSHAs).To(Equal(correctSHAs[5]), "Commit should have correct SHAs")
 				Expect(commitlobs[1].LobSHAs).To(Equal(correctSHAs[6]), "Commit should have correct SHAs")
 				// Now just 'from' (on master)
-				commitlobs, err = GetGitCommitsReferencingLOBsInRange("tag4", "", nil, nil)
+				commitlobs, err = testRepo().GetGitCommitsReferencingLOBsInRange("tag4", "", nil, nil)
 				Expect(err).To(BeNil(), "Should not fail calling GetGitCommitsReferencingLOBsInRange")
 				// 1 commit from tag4 to master, excluding tag4 itself
 				Expect(commitlobs).To(HaveLen(1), "tag4 onwards is only 1 commit")
 				Expect(commitlobs[0].LobSHAs).To(Equal(correctSHAs[4]), "Commit should have correct SHAs")
 				// Now just 'to' (on master)
-				commitlobs, err = GetGitCommitsReferencingLOBsInRange("", "tag2", nil, nil)
+				commitlobs, err = testRepo().GetGitCommitsReferencingLOBsInRange("", "tag2", nil, nil)
 				Expect(err).To(BeNil(), "Should not fail calling GetGitCommitsReferencingLOBsInRange")
 				// 2 commits up to tag2 to master, excluding tag4 itself
 				Expect(commitlobs).To(HaveLen(2), "tag4 onwards is only 1 commit")
@@ -504,7 +529,7 @@ var _ = Describe("Git tests", func() {
 
 			It("Gets LOB references at varying ranges", func() {
 				// Get all LOBs referenced ever at master
-				shas, err := GetGitAllLOBsToCheckoutInRefSpec(&GitRefSpec{"tag1", "..", "master"}, nil, nil)
+				shas, err := testRepo().GetGitAllLOBsToCheckoutInRefSpec(&GitRefSpec{"tag1", "..", "master"}, nil, nil)
 				// Because it's a range this will also include any which were later overwritten
 				Expect(err).To(BeNil(), "Should be no error")
 				Expect(shas).To(ConsistOf(lobshas[:7]), "Start to master should include first 7 file SHAs")
@@ -512,7 +537,7 @@ var _ = Describe("Git tests", func() {
 				// At tag 2, file2.txt was overwritten with a different SHA so the previous SHA (lobshas[1]) should be missing
 				correct := lobshas[:1]
 				correct = append(correct, lobshas[2:7]...)
-				shas, err = GetGitAllLOBsToCheckoutInRefSpec(&GitRefSpec{"tag2", "..", "master"}, nil, nil)
+				shas, err = testRepo().GetGitAllLOBsToCheckoutInRefSpec(&GitRefSpec{"tag2", "..", "master"}, nil, nil)
 				Expect(err).To(BeNil(), "Should be no error")
 				Expect(shas).To(ConsistOf(correct), "tag2 to master should include first 7 file SHAs minus one overwritten SHA")
 
@@ -520,8 +545,28 @@ var _ = Describe("Git tests", func() {
 
 		})
 
+		Describe("Get LOB files changed between commits", func() {
+
+			It("Lists files whose placeholders changed", func() {
+				files, err := testRepo().GetGitLOBFilesChangedBetween("tag1", "tag3")
+				Expect(err).To(BeNil(), "Should be no error")
+				Expect(files).To(ConsistOf("file2.txt", "file3.txt", "file4.txt"))
+				files, err = testRepo().GetGitLOBFilesChangedBetween("tag3", "feature/1")
+				Expect(err).To(BeNil(), "Should be no error")
+				Expect(files).To(ConsistOf("file2.txt", "file3.txt", "file10.txt"))
+				// file5.txt doesn't exist on feature/1 so there's nothing to check out
+				files, err = testRepo().GetGitLOBFilesChangedBetween("master", "feature/1")
+				Expect(err).To(BeNil(), "Should be no error")
+				Expect(files).To(ConsistOf("file1.txt", "file2.txt", "file3.txt", "file10.txt"))
+				files, err = testRepo().GetGitLOBFilesChangedBetween("tag2", "tag2")
+				Expect(err).To(BeNil(), "Should be no error")
+				Expect(files).To(BeEmpty(), "Nothing changed")
+			})
+
+		})
+
 		It("Gets latest LOB change and commit summary", func() {
-			summary, lobsha, err := GetGitLatestLOBChangeDetails("file1.txt", "HEAD")
+			summary, lobsha, err := testRepo().GetGitLatestLOBChangeDetails("file1.txt", "HEAD")
 			Expect(err).To(BeNil(), "Should not be error getting latest change")
 			Expect(lobsha).To(Equal(lobshas[5]), "Should be correct LOB SHA")
 			Expect(summary.Subject).To(Equal("4th commit"), "Commit details should be retrieved")
@@ -557,9 +602,9 @@ var _ = Describe("Git tests", func() {
 			).Run()
 			now := time.Now()
 
-			commit, err := GetGitCommitSummary("HEAD")
+			commit, err := testRepo().GetGitCommitSummary("HEAD")
 			Expect(err).To(BeNil(), "Should not be error calling git show")
-			headsha, _ := GitRefToFullSHA("HEAD")
+			headsha, _ := testRepo().GitRefToFullSHA("HEAD")
 			Expect(commit.SHA).To(Equal(headsha), "SHA should be correct")
 			Expect(commit.ShortSHA).To(Equal(headsha[0:7]), "Short SHA should be correct")
 			Expect(commit.AuthorName).To(Equal("A N Author"), "Author should be correct")
@@ -581,9 +626,9 @@ var _ = Describe("Git tests", func() {
 			).Run()
 			now := time.Now()
 
-			commit, err := GetGitCommitSummary("HEAD")
+			commit, err := testRepo().GetGitCommitSummary("HEAD")
 			Expect(err).To(BeNil(), "Should not be error calling git show")
-			headsha, _ := GitRefToFullSHA("HEAD")
+			headsha, _ := testRepo().GitRefToFullSHA("HEAD")
 			Expect(commit.SHA).To(Equal(headsha), "SHA should be correct")
 			Expect(commit.ShortSHA).To(Equal(headsha[0:7]), "Short SHA should be correct")
 			Expect(commit.AuthorName).To(Equal("A N Author"), "Author should be correct")
@@ -618,7 +663,7 @@ var _ = Describe("Git tests", func() {
 		var refNamesToGitRefs = func(names []string) []*GitRef {
 			ret := make([]*GitRef, 0, len(names))
 			for _, name := range names {
-				sha, _ := GitRefToFullSHA(name)
+				sha, _ := testRepo().GitRefToFullSHA(name)
 				t := GitRefTypeLocalBranch
 				if strings.HasPrefix(name, "origin/") ||
 					strings.HasPrefix(name, "remote2/") {
@@ -806,42 +851,73 @@ var _ = Describe("Git tests", func() {
 			GlobalOptions = NewOptions()
 		})
 		It("Retrieves recent git refs & LOBs", func() {
-			recentrefs, err := GetGitRecentRefs(GlobalOptions.FetchRefsPeriodDays, false, "")
+			recentrefs, err := testRepo().GetGitRecentRefs(GlobalOptions.FetchRefsPeriodDays, false, "")
 			Expect(err).To(BeNil(), "Should not error calling GetGitRecentRefs")
 			Expect(recentrefs).To(ConsistOf(correctRefsNoRemotes), "Recent refs (local only) should be correct")
 
-			recentrefs, err = GetGitRecentRefs(GlobalOptions.FetchRefsPeriodDays, true, "")
+			recentrefs, err = testRepo().GetGitRecentRefs(GlobalOptions.FetchRefsPeriodDays, true, "")
 			Expect(err).To(BeNil(), "Should not error calling GetGitRecentRefs")
 			Expect(recentrefs).To(ConsistOf(correctRefsAll), "Recent refs (all) should be correct")
 
-			recentrefs, err = GetGitRecentRefs(GlobalOptions.FetchRefsPeriodDays, true, "origin")
+			recentrefs, err = testRepo().GetGitRecentRefs(GlobalOptions.FetchRefsPeriodDays, true, "origin")
 			Expect(err).To(BeNil(), "Should not error calling GetGitRecentRefs")
 			Expect(recentrefs).To(ConsistOf(correctRefsOriginOnly), "Recent refs (only origin remote) should be correct")
 
-			lobs, earliestCommit, err := GetGitAllLOBsToCheckoutAtCommitAndRecent("master", GlobalOptions.FetchCommitsPeriodHEAD, nil, nil)
+			lobs, earliestCommit, err := testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("master", GlobalOptions.FetchCommitsPeriodHEAD, nil, nil)
 			Expect(err).To(BeNil(), "Should not error getting lobs")
 			Expect(lobs).To(ConsistOf(correctLOBsMaster), fmt.Sprintf("LOBs on master should be correct; all LOBS were:\n%v", strings.Join(lobshas, "\n")))
 			Expect(earliestCommit).To(Equal(firstMasterCommit), "Earliest commit for master should be first commit")
 
 			// It's harder to visualise the feature branches because unchanged files from other branches are included
-			lobs, earliestCommit, err = GetGitAllLOBsToCheckoutAtCommitAndRecent("feature/1", GlobalOptions.FetchCommitsPeriodOther, nil, nil)
+			lobs, earliestCommit, err = testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("feature/1", GlobalOptions.FetchCommitsPeriodOther, nil, nil)
 			Expect(err).To(BeNil(), "Should not error getting lobs")
 			Expect(lobs).To(ConsistOf(correctLOBsFeature1), fmt.Sprintf("LOBs on feature/1 should be correct; all LOBS were:\n%v", strings.Join(lobshas, "\n")))
 			Expect(earliestCommit).To(Equal(firstFeature1Commit), "Earliest commit for feature1 should be first commit")
-			lobs, earliestCommit, err = GetGitAllLOBsToCheckoutAtCommitAndRecent("feature/2", GlobalOptions.FetchCommitsPeriodOther, nil, nil)
+			lobs, earliestCommit, err = testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("feature/2", GlobalOptions.FetchCommitsPeriodOther, nil, nil)
 			Expect(err).To(BeNil(), "Should not error getting lobs")
 			Expect(lobs).To(ConsistOf(correctLOBsFeature2), fmt.Sprintf("LOBs on feature/2 should be correct; all LOBS were:\n%v", strings.Join(lobshas, "\n")))
 			Expect(earliestCommit).To(Equal(firstFeature2Commit), "Earliest commit for feature2 should be first commit")
 
 			// Also check file history
-			shas, err := GetGitAllLOBHistoryForFile("file1.txt", "")
+			shas, err := testRepo().GetGitAllLOBHistoryForFile("file1.txt", "")
 			Expect(err).To(BeNil(), "Shouldn't be an error in GetGitAllLOBHistoryForFile")
 			Expect(shas).To(Equal([]string{lobshas[2], lobshas[0]}), "Should be correct SHAs in file history in right order (latest first)")
-			shas, err = GetGitAllLOBHistoryForFile("file1.txt", lobshas[2])
+			shas, err = testRepo().GetGitAllLOBHistoryForFile("file1.txt", lobshas[2])
 			Expect(err).To(BeNil(), "Shouldn't be an error in GetGitAllLOBHistoryForFile")
 			Expect(shas).To(Equal([]string{lobshas[0]}), "Should be correct SHAs in file history (exclude latest)")
 
 		})
+		It("Walks recent history once when caching", func() {
+			type recentResult struct {
+				LOBs     []string
+				Earliest string
+			}
+			// Several periods & filters for each ref, as fetch then prune would ask for
+			query := func() []recentResult {
+				var ret []recentResult
+				for _, ref := range []string{"master", "feature/1", "feature/2"} {
+					for _, days := range []int{0, 1, GlobalOptions.FetchCommitsPeriodHEAD} {
+						for _, include := range [][]string{nil, []string{"file1.txt"}} {
+							lobs, earliest, err := testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent(ref, days, include, nil)
+							Expect(err).To(BeNil())
+							ret = append(ret, recentResult{lobs, earliest})
+						}
+					}
+				}
+				return ret
+			}
+			uncached := query()
+
+			Expect(testRepo().CacheRecentHistory(GlobalOptions.FetchCommitsPeriodHEAD)).To(BeTrue(), "Should start caching")
+			Expect(testRepo().CacheRecentHistory(1)).To(BeFalse(), "Should already be caching")
+			Expect(query()).To(Equal(uncached), "Cached history should give the same results")
+			mastersha, _ := testRepo().GitRefToFullSHA("master")
+			Expect(testRepo().recentHistoryCache).To(HaveKey(mastersha))
+			Expect(testRepo().recentHistoryCache[mastersha].days).To(Equal(GlobalOptions.FetchCommitsPeriodHEAD), "Should walk back the minimum days at once")
+
+			testRepo().ClearRecentHistoryCache()
+			Expect(testRepo().recentHistoryCache).To(BeNil())
+		})
 
 	})
 
@@ -927,26 +1003,26 @@ var _ = Describe("Git tests", func() {
 			}
 
 			// All
-			lobs, err := GetGitAllLOBsToCheckoutAtCommit("HEAD", nil, nil)
+			lobs, err := testRepo().GetGitAllLOBsToCheckoutAtCommit("HEAD", nil, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			Expect(lobs).To(HaveLen(len(filenames)), "All the most recent LOBs should be included")
-			lobs, _, err = GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, nil, nil)
+			lobs, _, err = testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, nil, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommitAndRecent")
 			Expect(lobs).To(HaveLen(len(filenames)*2), "All LOBs including old versions should be included with no filtering")
-			commits, err := GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, nil)
+			commits, err := testRepo().GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitCommitsReferencingLOBsInRange")
 			Expect(commits).To(HaveLen(len(filenames)*2), "All commits should be included with no filtering")
 
 			// Include filtering, just dir
 			include := []string{"folder1", "folder with spaces"}
 			fileIdxs := []int{0, 1, 2, 3, 4}
-			lobs, err = GetGitAllLOBsToCheckoutAtCommit("HEAD", include, nil)
+			lobs, err = testRepo().GetGitAllLOBsToCheckoutAtCommit("HEAD", include, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			shouldHaveLOBFiles(lobs, fileIdxs, false, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommit -> Include: %v", include))
-			lobs, _, err = GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, include, nil)
+			lobs, _, err = testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, include, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommitAndRecent")
 			shouldHaveLOBFiles(lobs, fileIdxs, true, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommitAndRecent -> Include: %v", include))
-			commits, err = GetGitCommitsReferencingLOBsInRange("", "HEAD", include, nil)
+			commits, err = testRepo().GetGitCommitsReferencingLOBsInRange("", "HEAD", include, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitCommitsReferencingLOBsInRange")
 			Expect(commits).To(HaveLen(len(fileIdxs)*2), "Number of commits should be correct with filtering")
 			shouldHaveCommitsReferencingFiles(commits, fileIdxs, fmt.Sprintf("GetGitCommitsReferencingLOBsInRange -> Include: %v", include))
@@ -955,23 +1031,23 @@ var _ = Describe("Git tests", func() {
 			include = []string{"fold*"}
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			Expect(lobs).To(HaveLen(len(filenames)), "All the most recent LOBs should be included")
-			lobs, _, err = GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, nil, nil)
+			lobs, _, err = testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, nil, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommitAndRecent")
 			Expect(lobs).To(HaveLen(len(filenames)*2), "All LOBs including old versions should be included with no filtering")
-			commits, err = GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, nil)
+			commits, err = testRepo().GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitCommitsReferencingLOBsInRange")
 			Expect(commits).To(HaveLen(len(filenames)*2), "All commits should be included with no filtering")
 
 			// Include filtering, more wildcards
 			include = []string{filepath.Join("folder*", "*", "*.jpg"), filepath.Join("folder*", "*.jpg")}
 			fileIdxs = []int{2, 5, 9}
-			lobs, err = GetGitAllLOBsToCheckoutAtCommit("HEAD", include, nil)
+			lobs, err = testRepo().GetGitAllLOBsToCheckoutAtCommit("HEAD", include, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			shouldHaveLOBFiles(lobs, fileIdxs, false, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommit -> Include: %v", include))
-			lobs, _, err = GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, include, nil)
+			lobs, _, err = testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, include, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommitAndRecent")
 			shouldHaveLOBFiles(lobs, fileIdxs, true, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommitAndRecent -> Include: %v", include))
-			commits, err = GetGitCommitsReferencingLOBsInRange("", "HEAD", include, nil)
+			commits, err = testRepo().GetGitCommitsReferencingLOBsInRange("", "HEAD", include, nil)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitCommitsReferencingLOBsInRange")
 			Expect(commits).To(HaveLen(len(fileIdxs)*2), "Number of commits should be correct with exclude filtering")
 			shouldHaveCommitsReferencingFiles(commits, fileIdxs, fmt.Sprintf("GetGitCommitsReferencingLOBsInRange -> Include: %v", include))
@@ -979,13 +1055,13 @@ var _ = Describe("Git tests", func() {
 			// Exclude filtering, dir
 			exclude := []string{"folder1", "folder with spaces"}
 			fileIdxs = []int{5, 6, 7, 8, 9}
-			lobs, err = GetGitAllLOBsToCheckoutAtCommit("HEAD", nil, exclude)
+			lobs, err = testRepo().GetGitAllLOBsToCheckoutAtCommit("HEAD", nil, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			shouldHaveLOBFiles(lobs, fileIdxs, false, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommit -> Exclude: %v", exclude))
-			lobs, _, err = GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, nil, exclude)
+			lobs, _, err = testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, nil, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			shouldHaveLOBFiles(lobs, fileIdxs, true, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommitAndRecent -> Exclude: %v", exclude))
-			commits, err = GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, exclude)
+			commits, err = testRepo().GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitCommitsReferencingLOBsInRange")
 			Expect(commits).To(HaveLen(len(fileIdxs)*2), "Number of commits should be correct with exclude filtering")
 			shouldHaveCommitsReferencingFiles(commits, fileIdxs, fmt.Sprintf("GetGitCommitsReferencingLOBsInRange -> Exclude: %v", exclude))
@@ -993,13 +1069,13 @@ var _ = Describe("Git tests", func() {
 			// Exclude filtering, just wildcard at end
 			exclude = []string{filepath.Join("folder1", "test*")}
 			fileIdxs = []int{2, 3, 4, 5, 6, 7, 8, 9}
-			lobs, err = GetGitAllLOBsToCheckoutAtCommit("HEAD", nil, exclude)
+			lobs, err = testRepo().GetGitAllLOBsToCheckoutAtCommit("HEAD", nil, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			shouldHaveLOBFiles(lobs, fileIdxs, false, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommit -> Exclude: %v", exclude))
-			lobs, _, err = GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, nil, exclude)
+			lobs, _, err = testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, nil, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			shouldHaveLOBFiles(lobs, fileIdxs, true, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommitAndRecent -> Exclude: %v", exclude))
-			commits, err = GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, exclude)
+			commits, err = testRepo().GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitCommitsReferencingLOBsInRange")
 			Expect(commits).To(HaveLen(len(fileIdxs)*2), "Number of commits should be correct with exclude filtering")
 			shouldHaveCommitsReferencingFiles(commits, fileIdxs, fmt.Sprintf("GetGitCommitsReferencingLOBsInRange -> Exclude: %v", exclude))
@@ -1007,13 +1083,13 @@ var _ = Describe("Git tests", func() {
 			// Exclude filtering, more wildcards
 			exclude = []string{filepath.Join("folder*", "*", "*.jpg"), filepath.Join("folder*", "*.jpg")}
 			fileIdxs = []int{0, 1, 3, 4, 6, 7, 8}
-			lobs, err = GetGitAllLOBsToCheckoutAtCommit("HEAD", nil, exclude)
+			lobs, err = testRepo().GetGitAllLOBsToCheckoutAtCommit("HEAD", nil, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			shouldHaveLOBFiles(lobs, fileIdxs, false, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommit -> Exclude: %v", exclude))
-			lobs, _, err = GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, nil, exclude)
+			lobs, _, err = testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, nil, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			shouldHaveLOBFiles(lobs, fileIdxs, true, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommitAndRecent -> Exclude: %v", exclude))
-			commits, err = GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, exclude)
+			commits, err = testRepo().GetGitCommitsReferencingLOBsInRange("", "HEAD", nil, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitCommitsReferencingLOBsInRange")
 			Expect(commits).To(HaveLen(len(fileIdxs)*2), "Number of commits should be correct with exclude filtering")
 			shouldHaveCommitsReferencingFiles(commits, fileIdxs, fmt.Sprintf("GetGitCommitsReferencingLOBsInRange -> Exclude: %v", exclude))
@@ -1022,13 +1098,13 @@ var _ = Describe("Git tests", func() {
 			include = []string{"folder2"}
 			exclude = []string{filepath.Join("*", "*", "*.mov")}
 			fileIdxs = []int{5, 6, 8, 9}
-			lobs, err = GetGitAllLOBsToCheckoutAtCommit("HEAD", include, exclude)
+			lobs, err = testRepo().GetGitAllLOBsToCheckoutAtCommit("HEAD", include, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			shouldHaveLOBFiles(lobs, fileIdxs, false, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommit -> Include: %v Exclude: %v", include, exclude))
-			lobs, _, err = GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, include, exclude)
+			lobs, _, err = testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 10, include, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitAllLOBsToCheckoutAtCommit")
 			shouldHaveLOBFiles(lobs, fileIdxs, true, fmt.Sprintf("GetGitAllLOBsToCheckoutAtCommitAndRecent -> Include: %v Exclude: %v", include, exclude))
-			commits, err = GetGitCommitsReferencingLOBsInRange("", "HEAD", include, exclude)
+			commits, err = testRepo().GetGitCommitsReferencingLOBsInRange("", "HEAD", include, exclude)
 			Expect(err).To(BeNil(), "Should not be error calling GetGitCommitsReferencingLOBsInRange")
 			Expect(commits).To(HaveLen(len(fileIdxs)*2), "Number of commits should be correct with exclude filtering")
 			shouldHaveCommitsReferencingFiles(commits, fileIdxs, fmt.Sprintf("GetGitCommitsReferencingLOBsInRange -> Include: %v Exclude: %v", include, exclude))
@@ -1036,4 +1112,73 @@ var _ = Describe("Git tests", func() {
 		})
 	})
 
+	Context("Shallow clones", func() {
+		root := filepath.Join(os.TempDir(), "GitTest9")
+		originroot := filepath.Join(root, "origin")
+		shallowroot := filepath.Join(root, "shallow")
+		var oldwd string
+		lobshas := GetListOfRandomSHAsForTest(4)
+		BeforeEach(func() {
+			CreateGitRepoForTest(originroot)
+			oldwd, _ = os.Getwd()
+			os.Chdir(originroot)
+			// 3 commits each changing the same binary, the last one will be the boundary
+			for i := 0; i < 3; i++ {
+				ioutil.WriteFile(filepath.Join(originroot, "file1.txt"),
+					[]byte(fmt.Sprintf("git-lob: %v", lobshas[i])), 0644)
+				exec.Command("git", "add", "file1.txt").Run()
+				CommitAtDateForTest(time.Now().AddDate(0, 0, i-3), "", "", fmt.Sprintf("Commit %d", i))
+			}
+			outp, err := exec.Command("git", "clone", "--depth", "1", "file://"+filepath.ToSlash(originroot), shallowroot).CombinedOutput()
+			if err != nil {
+				Fail(fmt.Sprintf("Unable to create shallow clone: %v", string(outp)))
+			}
+			os.Chdir(shallowroot)
+		})
+		AfterEach(func() {
+			os.Chdir(oldwd)
+			err := ForceRemoveAll(root)
+			if err != nil {
+				Fail(err.Error())
+			}
+		})
+
+		It("Treats shallow boundaries as roots", func() {
+			boundary, err := testRepo().GitRefToFullSHA("HEAD")
+			Expect(err).To(BeNil())
+			Expect(testRepo().GetGitShallowCommits()).To(Equal([]string{boundary}))
+
+			var pushCommits []*CommitLOBRef
+			callback := func(commit *CommitLOBRef) (quit bool, err error) {
+				pushCommits = append(pushCommits, commit)
+				return false, nil
+			}
+			err = testRepo().WalkGitCommitLOBsToPush("origin", "HEAD", true, nil, nil, callback)
+			Expect(err).To(BeNil())
+			Expect(pushCommits).To(BeEmpty(), "Boundary came from the remote, shouldn't need pushing")
+
+			// New commits on top still need pushing
+			ioutil.WriteFile(filepath.Join(shallowroot, "file1.txt"),
+				[]byte(fmt.Sprintf("git-lob: %v", lobshas[3])), 0644)
+			exec.Command("git", "add", "file1.txt").Run()
+			CommitAtDateForTest(time.Now(), "", "", "Shallow commit")
+			head, _ := testRepo().GitRefToFullSHA("HEAD")
+			err = testRepo().WalkGitCommitLOBsToPush("origin", "HEAD", true, nil, nil, callback)
+			Expect(err).To(BeNil())
+			Expect(pushCommits).To(HaveLen(1))
+			Expect(pushCommits[0].Commit).To(Equal(head))
+			Expect(pushCommits[0].LobSHAs).To(Equal([]string{lobshas[3]}))
+
+			// Recent history stops at the boundary
+			lobs, earliest, err := testRepo().GetGitAllLOBsToCheckoutAtCommitAndRecent("HEAD", 30, nil, nil)
+			Expect(err).To(BeNil())
+			Expect(lobs).To(ConsistOf(lobshas[3], lobshas[2]))
+			Expect(earliest).To(Equal(head))
+
+			// Not shallow
+			os.Chdir(originroot)
+			Expect(testRepo().GetGitShallowCommits()).To(BeEmpty())
+		})
+	})
+
 })
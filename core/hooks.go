@@ -0,0 +1,159 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/go-homedir"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Transfer hooks
+// Pipelines can be triggered by pushes & fetches of binaries, e.g. to warm caches, invalidate a
+// CDN or post to chat. Before & after each transfer git-lob runs .git/hooks/lob-<name> if it's
+// executable, then the command in git-lob.hook.<name> if set, with a JSON summary of the
+// transfer on stdin. A pre hook which fails stops the transfer; post hooks can only warn.
+
+const (
+	TransferHookPrePush   = "pre-push"
+	TransferHookPostPush  = "post-push"
+	TransferHookPreFetch  = "pre-fetch"
+	TransferHookPostFetch = "post-fetch"
+)
+
+// Prefix of hook scripts in the hooks dir, so they can't be confused with git's own hooks
+const transferHookFilePrefix = "lob-"
+
+// What a transfer hook is given on stdin, as JSON
+type TransferHookSummary struct {
+	// Name of the hook being run, e.g. "post-push"
+	Hook string `json:"hook"`
+	// Remotes transferred to or from
+	Remotes []string `json:"remotes"`
+	// Refs or ranges as given for the transfer, empty for the defaults
+	Refs []string `json:"refs"`
+	// SHAs of binaries transferred in full (post hooks only), sorted
+	SHAs []string `json:"shas"`
+	// Number of binaries transferred as deltas (post hooks only)
+	Deltas int `json:"deltas"`
+	// Bytes transferred (post hooks only)
+	Bytes int64 `json:"bytes"`
+	// Whether the transfer succeeded (post hooks only)
+	Success bool `json:"success"`
+	// Why it didn't, if it failed
+	Error string `json:"error,omitempty"`
+
+	shas  util.StringSet
+	mutex sync.Mutex
+}
+
+// Stored LOB files are named <sha>_meta or <sha>_<chunk>
+var transferredLOBFileRegex = regexp.MustCompile("^(" + LOBSHARegexFragment + ")_(?:meta|\\d+)$")
+
+func NewTransferHookSummary(remotes []string, refs []string) *TransferHookSummary {
+	return &TransferHookSummary{Remotes: remotes, Refs: refs, SHAs: []string{}, shas: util.NewStringSet()}
+}
+
+// Wrap a progress callback to record the binaries & bytes transferred in summary
+func TrackTransferHookSummary(summary *TransferHookSummary, callback util.ProgressCallback) util.ProgressCallback {
+	return func(data *util.ProgressCallbackData) (abort bool) {
+		if data.Type == util.ProgressTransferBytes && data.ItemBytes > 0 && data.ItemBytesDone == data.ItemBytes {
+			summary.mutex.Lock()
+			summary.Bytes += data.ItemBytes
+			if match := transferredLOBFileRegex.FindStringSubmatch(filepath.Base(data.Desc)); match != nil {
+				summary.shas.Add(match[1])
+			} else if strings.HasPrefix(data.Desc, "Delta ") {
+				summary.Deltas++
+			}
+			summary.mutex.Unlock()
+		}
+		return callback(data)
+	}
+}
+
+// Get the directory hook scripts are in, core.hooksPath or .git/hooks
+func (r *Repo) getTransferHooksDir() string {
+	if hooksPath := strings.TrimSpace(r.Options.GitConfig["core.hookspath"]); hooksPath != "" {
+		if expanded, err := homedir.Expand(hooksPath); err == nil {
+			hooksPath = expanded
+		}
+		if !filepath.IsAbs(hooksPath) {
+			// Relative to the working copy, like git
+			hooksPath = filepath.Join(r.Root, hooksPath)
+		}
+		return hooksPath
+	}
+	return filepath.Join(r.GitDir, "hooks")
+}
+
+// Get the commands to run for a hook, the hook script then the configured command
+func (r *Repo) getTransferHookCommands(hook string) []*exec.Cmd {
+	var ret []*exec.Cmd
+	script := filepath.Join(r.getTransferHooksDir(), transferHookFilePrefix+hook)
+	if stat, err := os.Stat(script); err == nil && !stat.IsDir() {
+		if runtime.GOOS == "windows" {
+			// Hooks are shell scripts, like git's own on Windows
+			ret = append(ret, r.command("sh", script))
+		} else if stat.Mode()&0111 != 0 {
+			ret = append(ret, r.command(script))
+		} else {
+			r.Log.Debugf("Ignoring %v because it isn't executable\n", script)
+		}
+	}
+	if command, ok := r.Options.TransferHooks[hook]; ok {
+		if runtime.GOOS == "windows" {
+			ret = append(ret, r.command("cmd", "/C", command))
+		} else {
+			ret = append(ret, r.command("sh", "-c", command))
+		}
+	}
+	return ret
+}
+
+// Run the scripts & commands for a hook (one of the TransferHook* constants) with summary
+// on stdin. Hook output goes to stderr so it doesn't get mixed up with git-lob's own output.
+// Returns an error if any of them failed, after running them all
+func (r *Repo) RunTransferHook(hook string, summary *TransferHookSummary) error {
+	cmds := r.getTransferHookCommands(hook)
+	if len(cmds) == 0 {
+		return nil
+	}
+	summary.mutex.Lock()
+	summary.Hook = hook
+	summary.SHAs = make([]string, 0, summary.shas.Cardinality())
+	for sha := range summary.shas.Iter() {
+		summary.SHAs = append(summary.SHAs, sha)
+	}
+	sort.Strings(summary.SHAs)
+	input, err := json.Marshal(summary)
+	summary.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, cmd := range cmds {
+		cmd.Dir = r.Root
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), "GIT_LOB_HOOK="+hook)
+		r.Log.Debugf("Running %v hook: %v\n", hook, strings.Join(cmd.Args, " "))
+		if err := cmd.Run(); err != nil {
+			errs = append(errs, fmt.Sprintf("%v hook '%v' failed: %v", hook, strings.Join(cmd.Args, " "), err.Error()))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
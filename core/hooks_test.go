@@ -0,0 +1,84 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Transfer hooks", func() {
+	root := filepath.Join(os.TempDir(), "TransferHooksTest")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		GlobalOptions = NewOptions()
+	})
+
+	It("Runs hook scripts & configured commands with a summary", func() {
+		os.MkdirAll(filepath.Join(".git", "hooks"), 0755)
+		Expect(ioutil.WriteFile(filepath.Join(".git", "hooks", "lob-post-push"), []byte("#!/bin/sh\ncat > script.json\n"), 0755)).To(BeNil())
+		RunGitCommandForTest(true, "config", "git-lob.hook.post-push", `cat > "command-$GIT_LOB_HOOK.json"`)
+		LoadConfig(GlobalOptions)
+
+		sha1 := strings.Repeat("a", 40)
+		sha2 := strings.Repeat("b", 40)
+		summary := NewTransferHookSummary([]string{"origin"}, []string{"master"})
+		var received int
+		callback := TrackTransferHookSummary(summary, func(data *ProgressCallbackData) bool {
+			received++
+			return false
+		})
+		callback(&ProgressCallbackData{ProgressTransferBytes, filepath.Join("bbb", "bbb", sha2+"_0"), 50, 100, 50, 300, nil})
+		callback(&ProgressCallbackData{ProgressTransferBytes, filepath.Join("bbb", "bbb", sha2+"_0"), 100, 100, 100, 300, nil})
+		callback(&ProgressCallbackData{ProgressTransferBytes, filepath.Join("aaa", "aaa", sha1+"_meta"), 40, 40, 140, 300, nil})
+		callback(&ProgressCallbackData{ProgressSkip, filepath.Join("ccc", "ccc", strings.Repeat("c", 40)+"_meta"), 40, 40, 180, 300, nil})
+		callback(&ProgressCallbackData{ProgressTransferBytes, "Delta ddddddd..eeeeeee", 120, 120, 300, 300, nil})
+		Expect(received).To(Equal(5), "Callbacks should be passed on")
+
+		Expect(testRepo().RunTransferHook(TransferHookPostPush, summary)).To(BeNil())
+		for _, file := range []string{"script.json", "command-post-push.json"} {
+			data, err := ioutil.ReadFile(file)
+			Expect(err).To(BeNil(), file)
+			var received TransferHookSummary
+			Expect(json.Unmarshal(data, &received)).To(BeNil())
+			Expect(received.Hook).To(Equal("post-push"))
+			Expect(received.Remotes).To(Equal([]string{"origin"}))
+			Expect(received.Refs).To(Equal([]string{"master"}))
+			Expect(received.SHAs).To(Equal([]string{sha1, sha2}))
+			Expect(received.Deltas).To(Equal(1))
+			Expect(received.Bytes).To(BeEquivalentTo(260))
+		}
+
+		// No hooks for fetch
+		Expect(testRepo().RunTransferHook(TransferHookPostFetch, summary)).To(BeNil())
+	})
+
+	It("Reports failing hooks", func() {
+		RunGitCommandForTest(true, "config", "git-lob.hook.pre-fetch", "exit 3")
+		RunGitCommandForTest(true, "config", "git-lob.hook.post-fetch", `grep -q '"error":"Remote is down"'`)
+		LoadConfig(GlobalOptions)
+
+		summary := NewTransferHookSummary([]string{"origin", "backup"}, nil)
+		err := testRepo().RunTransferHook(TransferHookPreFetch, summary)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("pre-fetch hook"))
+
+		summary.Error = "Remote is down"
+		Expect(testRepo().RunTransferHook(TransferHookPostFetch, summary)).To(BeNil(), "Should get the error on stdin")
+	})
+})
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+	"github.com/atlassian/git-lob/util/lock"
+)
+
+// Processes which are interrupted (killed, crashed, power lost) leave things behind which are
+// never used again: temporary chunks & deltas in the system temp dir, partial downloads &
+// state files in the binary store, chunks of binaries whose metadata was never written, and
+// locks. These are removed once they're old enough that nothing can still be writing them,
+// both automatically now & again (git-lob.housekeeping) & by 'git lob unlock-store'.
+
+// Temporaries older than this are removed by default
+const DefaultStaleAge = 24 * time.Hour
+
+// How often housekeeping runs automatically
+var HousekeepingInterval = 24 * time.Hour
+
+// Temporary files (& dirs) git-lob creates in the system temp dir
+var staleSystemTempRegex = regexp.MustCompile(`^(?:tempchunk|tempdelta|tempdeltacontent|tempdeltabenchmark|tempcompress|uploaddelta|deltadownload|git-lob-upgrade|git-lob-verify)[0-9a-f_]+$`)
+
+// Temporary files git-lob & providers create in binary stores; also state files being replaced
+var staleStoreTempRegex = regexp.MustCompile(`^(?:(?:tempchunk|tempdelta|tempdownload|tempupload|tmp)[0-9a-f_]+|.+\.tmp)$`)
+
+type StaleFileType int
+
+const (
+	// Temporary file or dir left by an interrupted process
+	StaleTemp StaleFileType = iota
+	// Chunk in the local store of a binary with no metadata, left by an interrupted store or fetch
+	StaleOrphanChunk StaleFileType = iota
+	// Lock whose holder has gone away
+	StaleLock StaleFileType = iota
+)
+
+// Something left behind by an interrupted process
+type StaleFile struct {
+	Path string
+	Type StaleFileType
+	// Bytes used (total for a dir)
+	Size int64
+}
+
+// Find & remove temporaries & orphaned chunks not modified for olderThan, and abandoned locks
+// (decided by their heartbeat, or for shared store OS locks whether anyone holds them, see
+// util/lock), in the system temp dir, the local binary store & the shared store. callback is
+// called for each (may be nil)
+// Returns what was removed, or with dryRun what would have been
+func (r *Repo) RemoveStaleFiles(olderThan time.Duration, dryRun bool, callback func(f *StaleFile)) ([]*StaleFile, error) {
+	var ret []*StaleFile
+	cutoff := time.Now().Add(-olderThan)
+	found := func(f *StaleFile) {
+		if !dryRun {
+			var err error
+			switch f.Type {
+			case StaleLock:
+				removed := false
+				if isSharedStoreSHALockFile(f.Path) {
+					removed = lock.RemoveOSLockIfUnheld(f.Path)
+				} else {
+					removed = lock.BreakIfStale(f.Path)
+				}
+				if !removed {
+					// Picked up again in the meantime
+					return
+				}
+			case StaleTemp:
+				err = os.RemoveAll(f.Path)
+			default:
+				err = os.Remove(f.Path)
+			}
+			if err != nil {
+				r.Log.Errorf("Unable to remove %v: %v\n", f.Path, err.Error())
+				return
+			}
+		}
+		r.Log.Debugf("Removed stale %v (%v)\n", f.Path, util.FormatSize(f.Size))
+		ret = append(ret, f)
+		if callback != nil {
+			callback(f)
+		}
+	}
+
+	// System temp dir, only the top level & only things which are obviously ours
+	if entries, err := ioutil.ReadDir(os.TempDir()); err == nil {
+		for _, fi := range entries {
+			if staleSystemTempRegex.MatchString(fi.Name()) && fi.ModTime().Before(cutoff) {
+				path := filepath.Join(os.TempDir(), fi.Name())
+				size := fi.Size()
+				if fi.IsDir() {
+					size = getDirSize(path)
+				}
+				found(&StaleFile{Path: path, Type: StaleTemp, Size: size})
+			}
+		}
+	}
+
+	// Everything in <gitdir>/git-lob: binaries, deltas & state
+	localRoot := filepath.Join(r.GitDir, "git-lob")
+	err := r.removeStaleFilesInStore(localRoot, cutoff, r.GetLocalLOBRoot(), found)
+	if err != nil {
+		return ret, err
+	}
+	if r.IsUsingSharedStorage() {
+		// Orphaned chunks in the shared store are left to 'prune-shared', repos link them
+		err = r.removeStaleFilesInStore(r.GetSharedLOBRoot(), cutoff, "", found)
+	}
+	return ret, err
+}
+
+// Orphaned chunks are only looked for under chunkRoot, if not blank
+func (r *Repo) removeStaleFilesInStore(root string, cutoff time.Time, chunkRoot string, found func(f *StaleFile)) error {
+	if !util.DirExists(root) {
+		return nil
+	}
+	// Collect first, removing while walking confuses Walk
+	var stale []*StaleFile
+	stagingPrefix := r.getFetchStagingRoot() + string(filepath.Separator)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Something else removed it, carry on
+			return nil
+		}
+		if fi.IsDir() {
+			if fi.Name() == sharedStoreLockDir {
+				// Shared store locks, names are SHAs apart from the gc lock
+				locks, _ := ioutil.ReadDir(path)
+				for _, l := range locks {
+					lockpath := filepath.Join(path, l.Name())
+					if isSharedStoreSHALockFile(lockpath) {
+						// OS locks, left behind by holders which crashed; only removed if unheld
+						if !l.IsDir() && l.ModTime().Before(cutoff) {
+							stale = append(stale, &StaleFile{Path: lockpath, Type: StaleLock, Size: l.Size()})
+						}
+					} else if !l.IsDir() && lock.IsStale(lockpath) {
+						stale = append(stale, &StaleFile{Path: lockpath, Type: StaleLock, Size: l.Size()})
+					}
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := fi.Name()
+		switch {
+		case strings.HasSuffix(name, pushStateLockSuffix):
+			if lock.IsStale(path) {
+				stale = append(stale, &StaleFile{Path: path, Type: StaleLock, Size: fi.Size()})
+			}
+		case strings.HasPrefix(path, stagingPrefix):
+			// Downloaded chunks of binaries which were never completed, e.g. not found on the remote
+			if fi.ModTime().Before(cutoff) {
+				stale = append(stale, &StaleFile{Path: path, Type: StaleTemp, Size: fi.Size()})
+			}
+		case staleStoreTempRegex.MatchString(name):
+			if fi.ModTime().Before(cutoff) {
+				stale = append(stale, &StaleFile{Path: path, Type: StaleTemp, Size: fi.Size()})
+			}
+		case chunkRoot != "" && strings.HasPrefix(path, chunkRoot) && fi.ModTime().Before(cutoff):
+			if sha, suffix, _, ok := parseLOBStoreFilename(name); ok && suffix != "meta" {
+				if !util.FileExists(getLOBStoreFilePath(chunkRoot, GetLOBMetaRelativePath(sha))) {
+					stale = append(stale, &StaleFile{Path: path, Type: StaleOrphanChunk, Size: fi.Size()})
+				}
+			}
+		}
+		return nil
+	})
+	for _, f := range stale {
+		found(f)
+	}
+	return err
+}
+
+// Total size of the files in a dir
+func getDirSize(dir string) int64 {
+	var ret int64
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			ret += fi.Size()
+		}
+		return nil
+	})
+	return ret
+}
+
+func (r *Repo) getHousekeepingStateFile() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "last_housekeeping")
+}
+
+// Remove stale files (see RemoveStaleFiles) if that hasn't been done for HousekeepingInterval
+// Called when git-lob starts, so it's quick unless it's due & never reports anything on the console
+func (r *Repo) RunHousekeepingIfDue() {
+	if !r.Options.Housekeeping {
+		return
+	}
+	statefile := r.getHousekeepingStateFile()
+	if fi, err := os.Stat(statefile); err == nil && time.Since(fi.ModTime()) < HousekeepingInterval {
+		return
+	}
+	if !util.DirExists(filepath.Join(r.GitDir, "git-lob")) {
+		// Never used git-lob in this repo, nothing to do
+		return
+	}
+	// Mark as done first, so that concurrent processes don't all do it
+	os.MkdirAll(filepath.Dir(statefile), 0755)
+	if err := ioutil.WriteFile(statefile, []byte(time.Now().Format(time.RFC3339)), 0644); err != nil {
+		r.Log.Debugf("Unable to record housekeeping time: %v\n", err.Error())
+		return
+	}
+	removed, err := r.RemoveStaleFiles(DefaultStaleAge, false, nil)
+	if err != nil {
+		r.Log.Debugf("Housekeeping error: %v\n", err.Error())
+	}
+	if len(removed) > 0 {
+		var size int64
+		for _, f := range removed {
+			size += f.Size
+		}
+		r.Log.Debugf("Housekeeping removed %d stale files (%v)\n", len(removed), util.FormatSize(size))
+	}
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Housekeeping", func() {
+	root := filepath.Join(os.TempDir(), "HousekeepingTest")
+	var oldwd string
+	var staleFiles, freshFiles []string
+	old := time.Now().Add(-48 * time.Hour)
+	// Create a file, old or new
+	createFile := func(path string, size int, stale bool) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		Expect(ioutil.WriteFile(path, make([]byte, size), 0644)).To(BeNil())
+		if stale {
+			os.Chtimes(path, old, old)
+			staleFiles = append(staleFiles, path)
+		} else {
+			freshFiles = append(freshFiles, path)
+		}
+	}
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		staleFiles, freshFiles = nil, nil
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		for _, f := range append(staleFiles, freshFiles...) {
+			os.Remove(f)
+		}
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		GlobalOptions = NewOptions()
+	})
+
+	It("Removes stale temporaries, orphaned chunks & locks", func() {
+		info, err := testRepo().StoreLOB(bytes.NewReader([]byte("Binary which should be kept")), []byte(""))
+		Expect(err).To(BeNil())
+		for _, f := range []string{testRepo().GetLocalLOBMetaPath(info.SHA), testRepo().GetLocalLOBChunkPath(info.SHA, 0)} {
+			os.Chtimes(f, old, old)
+		}
+		orphansha := "1234567890123456789012345678901234567890"
+
+		createFile(filepath.Join(os.TempDir(), "tempchunk123456"), 1000, true)
+		createFile(filepath.Join(os.TempDir(), "tempchunk654321"), 1000, false)
+		createFile(filepath.Join(testRepo().GetLocalLOBDir(orphansha), "tempdownload987"), 100, true)
+		createFile(filepath.Join(GetGitDir(), "git-lob", "state", "remotes.tmp"), 10, true)
+		createFile(testRepo().GetLocalLOBChunkPath(orphansha, 0), 200, true)
+		createFile(testRepo().GetLocalLOBChunkPath(orphansha, 1), 200, false)
+		// Push state lock held by a process on another machine which stopped
+		lockfile := testRepo().getRemoteStateCacheFile("origin") + pushStateLockSuffix
+		createFile(lockfile, 0, false)
+		freshFiles = freshFiles[:len(freshFiles)-1]
+		ioutil.WriteFile(lockfile, []byte(`{"PID":1,"Host":"some-other-host","Acquired":"2015-01-01T00:00:00Z"}`), 0644)
+		os.Chtimes(lockfile, old, old)
+
+		var reported []*StaleFile
+		callback := func(f *StaleFile) { reported = append(reported, f) }
+		removed, err := testRepo().RemoveStaleFiles(DefaultStaleAge, true, callback)
+		Expect(err).To(BeNil())
+		Expect(removed).To(Equal(reported))
+		// The system temp dir may have other stale files from earlier runs, only check ours
+		sizes := make(map[string]int64)
+		for _, f := range removed {
+			sizes[f.Path] = f.Size
+		}
+		for _, f := range staleFiles {
+			Expect(sizes).To(HaveKey(f))
+			Expect(FileExists(f)).To(BeTrue(), "Dry run shouldn't remove %v", f)
+		}
+		Expect(sizes).To(HaveKey(lockfile))
+		Expect(sizes[testRepo().GetLocalLOBChunkPath(orphansha, 0)]).To(BeEquivalentTo(200))
+		for _, f := range freshFiles {
+			Expect(sizes).ToNot(HaveKey(f))
+		}
+
+		_, err = testRepo().RemoveStaleFiles(DefaultStaleAge, false, nil)
+		Expect(err).To(BeNil())
+		for _, f := range append(staleFiles, lockfile) {
+			Expect(FileExists(f)).To(BeFalse(), "%v should have been removed", f)
+		}
+		for _, f := range freshFiles {
+			Expect(FileExists(f)).To(BeTrue(), "%v is too recent to remove", f)
+		}
+		Expect(testRepo().CheckLOBFilesForSHA(info.SHA, testRepo().GetLocalLOBRoot(), true)).To(BeNil(), "Complete binaries should be untouched however old")
+	})
+
+	It("Runs automatically once per interval", func() {
+		testRepo().GetLocalLOBRoot()
+		createFile(filepath.Join(GetGitDir(), "git-lob", "state", "first.tmp"), 10, true)
+		testRepo().RunHousekeepingIfDue()
+		Expect(FileExists(staleFiles[0])).To(BeFalse(), "Should run first time")
+
+		createFile(filepath.Join(GetGitDir(), "git-lob", "state", "second.tmp"), 10, true)
+		testRepo().RunHousekeepingIfDue()
+		Expect(FileExists(staleFiles[1])).To(BeTrue(), "Shouldn't run again until the interval is up")
+
+		GlobalOptions.Housekeeping = false
+		os.Remove(testRepo().getHousekeepingStateFile())
+		testRepo().RunHousekeepingIfDue()
+		Expect(FileExists(staleFiles[1])).To(BeTrue(), "Shouldn't run when disabled")
+	})
+})
@@ -0,0 +1,334 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Bulk import
+// Adding thousands of binaries with 'git add' runs the clean filter on every one of them, which is
+// slow. Importing stores a directory of binaries in the binary store directly, writes their
+// placeholders into the working copy & stages those in batches, tracking the types of file which
+// aren't stored by git-lob yet so that they're treated like any other binary from then on.
+
+type ImportCallbackType int
+
+const (
+	// File was stored & its placeholder written to the working copy
+	ImportStored ImportCallbackType = iota
+	// File was not imported, see Desc
+	ImportSkipped ImportCallbackType = iota
+	// File could not be imported
+	ImportError ImportCallbackType = iota
+)
+
+// Collected callback data for an import
+type ImportCallbackData struct {
+	// What happened
+	Type ImportCallbackType
+	// Path of the file in the working copy, relative to the root of the repo
+	Filename string
+	// The binary stored (ImportStored, not on a dry run)
+	SHA string
+	// Size of the file
+	Size int64
+	// Number of files processed so far (including this one) & in total
+	Done  int
+	Total int
+	// Why the file was skipped
+	Desc string
+	// Error for ImportError
+	Error error
+}
+
+// What an import did
+type ImportResult struct {
+	// Patterns added to .gitattributes
+	TrackedPatterns []string
+	// Files staged (or which would be on a dry run), relative to the root of the repo
+	StagedFiles []string
+}
+
+// A file found to import
+type importFile struct {
+	// Absolute path of the file to import
+	Source string
+	// Path in the working copy, relative to the root of the repo with / separators
+	Filename string
+	Info     os.FileInfo
+}
+
+// Import all the files under srcDir into git-lob, writing placeholders for them at the same paths
+// under destDir in the working copy (srcDir itself if destDir is ""), & staging them
+// If track is true, patterns for files which aren't stored by git-lob are added to .gitattributes
+// (by extension, or the path if there isn't one), otherwise those files are skipped. Existing
+// files at the destination are only replaced if force is true.
+func (r *Repo) ImportFiles(srcDir, destDir string, track, force, dryRun bool,
+	callback func(data *ImportCallbackData) (quit bool)) (*ImportResult, error) {
+
+	root := r.Root
+	srcAbs := r.absPath(srcDir)
+	if stat, err := os.Stat(srcAbs); err != nil || !stat.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", srcDir)
+	}
+	destAbs := srcAbs
+	if destDir != "" {
+		destAbs = r.absPath(destDir)
+	}
+	destRel, err := filepath.Rel(root, destAbs)
+	if err != nil || destRel == ".." || strings.HasPrefix(destRel, ".."+string(filepath.Separator)) {
+		if destDir == "" {
+			return nil, fmt.Errorf("%v is not in the working copy, use --to to choose a folder in it to import into", srcDir)
+		}
+		return nil, fmt.Errorf("%v is not in the working copy", destDir)
+	}
+	destRel = filepath.ToSlash(destRel)
+	if destRel == ".git" || strings.HasPrefix(destRel, ".git/") {
+		return nil, fmt.Errorf("Can't import into %v", destAbs)
+	}
+
+	files, err := r.findFilesToImport(srcAbs, destRel)
+	if err != nil {
+		return nil, err
+	}
+	result := &ImportResult{}
+	if len(files) == 0 {
+		return result, nil
+	}
+
+	untracked, err := r.getPathsNotStoredInLOB(root, files)
+	if err != nil {
+		return nil, err
+	}
+	if track {
+		patterns, covered := getImportTrackPatterns(untracked)
+		if dryRun {
+			existing, err := r.GetTrackedPatterns()
+			if err != nil {
+				return nil, err
+			}
+			existingSet := util.NewStringSetFromSlice(existing)
+			for _, pattern := range patterns {
+				if !existingSet.Contains(pattern) {
+					result.TrackedPatterns = append(result.TrackedPatterns, pattern)
+				}
+			}
+		} else {
+			result.TrackedPatterns, err = r.TrackPatterns(patterns)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, filename := range covered {
+			untracked.Remove(filename)
+		}
+	}
+
+	for i, file := range files {
+		data := &ImportCallbackData{Filename: file.Filename, Size: file.Info.Size(), Done: i + 1, Total: len(files)}
+		if untracked.Contains(file.Filename) {
+			data.Type = ImportSkipped
+			data.Desc = "not stored by git-lob according to .gitattributes"
+		} else if desc, err := r.importFileToWorkingCopy(root, file, force, dryRun, data); err != nil {
+			data.Type = ImportError
+			data.Error = err
+		} else if desc != "" {
+			data.Type = ImportSkipped
+			data.Desc = desc
+		} else {
+			data.Type = ImportStored
+			result.StagedFiles = append(result.StagedFiles, file.Filename)
+		}
+		if callback(data) {
+			break
+		}
+	}
+
+	if dryRun || len(result.StagedFiles) == 0 {
+		return result, nil
+	}
+	staging := result.StagedFiles
+	if len(result.TrackedPatterns) > 0 {
+		staging = append([]string{".gitattributes"}, staging...)
+	}
+	// Placeholders pass through the clean filter unchanged, so adding them is quick
+	err = r.runGitCommandOnFiles(root, []string{"--literal-pathspecs", "add", "--"}, staging)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// Find the regular files under srcAbs, in path order, with their paths in the working copy
+// Symlinks aren't followed, and anything in .git folders is left out
+func (r *Repo) findFilesToImport(srcAbs, destRel string) ([]*importFile, error) {
+	var ret []*importFile
+	err := filepath.Walk(srcAbs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			r.Log.Debugf("Not importing %v, not a regular file\n", path)
+			return nil
+		}
+		rel, err := filepath.Rel(srcAbs, path)
+		if err != nil {
+			return err
+		}
+		filename := filepath.ToSlash(rel)
+		if destRel != "." {
+			filename = destRel + "/" + filename
+		}
+		ret = append(ret, &importFile{Source: path, Filename: filename, Info: info})
+		return nil
+	})
+	return ret, err
+}
+
+// Get which files wouldn't be stored by git-lob according to .gitattributes
+func (r *Repo) getPathsNotStoredInLOB(root string, files []*importFile) (util.StringSet, error) {
+	filenames := make([]string, 0, len(files))
+	for _, file := range files {
+		filenames = append(filenames, file.Filename)
+	}
+	stored, err := r.getPathsStoredInLOB(root, filenames)
+	if err != nil {
+		return nil, err
+	}
+	ret := util.NewStringSet()
+	for _, filename := range filenames {
+		if !stored.Contains(filename) {
+			ret.Add(filename)
+		}
+	}
+	return ret, nil
+}
+
+// Get which files (relative to the root of the repo) would be stored by git-lob according
+// to .gitattributes
+func (r *Repo) getPathsStoredInLOB(root string, filenames []string) (util.StringSet, error) {
+	ret := util.NewStringSet()
+	var in bytes.Buffer
+	for _, filename := range filenames {
+		in.WriteString(filename)
+		in.WriteByte(0)
+	}
+	cmd := r.command("git", "check-attr", "-z", "--stdin", "filter")
+	cmd.Dir = root
+	cmd.Stdin = &in
+	outp, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error calling 'git check-attr': %v", err.Error())
+	}
+	// Output is <path> NUL <attribute> NUL <value> NUL for each path
+	fields := strings.Split(string(outp), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		if fields[i+2] == LOBFilterName {
+			ret.Add(fields[i])
+		}
+	}
+	return ret, nil
+}
+
+// Get .gitattributes patterns to store files in git-lob, by extension where they have one,
+// & the files they're for. Files which can't have a pattern (e.g. paths with spaces) are left out
+func getImportTrackPatterns(filenames util.StringSet) (patterns []string, covered []string) {
+	added := util.NewStringSet()
+	for filename := range filenames.Iter() {
+		base := filename[strings.LastIndex(filename, "/")+1:]
+		var pattern string
+		if ext := filepath.Ext(base); ext != "" && ext != base {
+			pattern = "*" + ext
+		} else {
+			// Anchored to the root of the repo
+			pattern = "/" + filename
+		}
+		if strings.IndexAny(pattern, " \t") != -1 {
+			continue
+		}
+		covered = append(covered, filename)
+		if added.Add(pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	return patterns, covered
+}
+
+// Store a file & write its placeholder into the working copy, filling in data.SHA
+// Returns why the file was skipped if it was
+func (r *Repo) importFileToWorkingCopy(root string, file *importFile, force, dryRun bool, data *ImportCallbackData) (skipped string, err error) {
+	dest := filepath.Join(root, filepath.FromSlash(file.Filename))
+	inPlace := false
+	if stat, err := os.Stat(dest); err == nil {
+		if stat.IsDir() {
+			return "", fmt.Errorf("%v is a folder in the working copy", file.Filename)
+		}
+		inPlace = os.SameFile(stat, file.Info)
+		if !inPlace && !force {
+			return "already exists in the working copy (use --force to replace it)", nil
+		}
+	}
+	if dryRun {
+		return "", nil
+	}
+
+	// Files which are already placeholders, e.g. copied from a clone without the content, stay as they are
+	var placeholder string
+	if isLOBPlaceholderSize(file.Info.Size()) {
+		content, err := ioutil.ReadFile(file.Source)
+		if err != nil {
+			return "", err
+		}
+		if p, ok := parseLOBPlaceholder(content); ok {
+			data.SHA = p.SHA
+			placeholder = string(content)
+		}
+	}
+	if placeholder == "" {
+		f, err := os.Open(file.Source)
+		if err != nil {
+			return "", err
+		}
+		info, err := r.StoreLOBForFile(f, nil, file.Filename)
+		f.Close()
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Unable to store %v: %v", file.Source, err.Error()))
+		}
+		data.SHA = info.SHA
+		placeholder = r.getLOBPlaceholderContentForFile(info.SHA, info.Size, file.Filename)
+		r.generateLOBPreviewOrWarn(info.SHA, file.Filename)
+	}
+
+	// Write alongside & rename over, rather than writing into an existing file which may be
+	// hard linked to the binary store
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return "", err
+	}
+	tmp := dest + ".gitlobimport"
+	err = ioutil.WriteFile(tmp, []byte(placeholder), file.Info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmp, dest)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return "", nil
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Import", func() {
+	root := filepath.Join(os.TempDir(), "ImportTest")
+	src := filepath.Join(os.TempDir(), "ImportTestSource")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		LoadConfig(GlobalOptions)
+		os.MkdirAll(filepath.Join(src, "sub"), 0755)
+		CreateRandomFileForTest(1000, filepath.Join(src, "img1.png"))
+		CreateRandomFileForTest(2000, filepath.Join(src, "sub", "movie1.mov"))
+		CreateRandomFileForTest(500, filepath.Join(src, "sub", "README"))
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		for _, dir := range []string{root, src} {
+			err := ForceRemoveAll(dir)
+			if err != nil {
+				Fail(err.Error())
+			}
+		}
+		GlobalOptions = NewOptions()
+	})
+
+	It("Imports a folder into the working copy", func() {
+		var stored []string
+		callback := func(data *ImportCallbackData) bool {
+			Expect(data.Type).To(Equal(ImportStored))
+			Expect(data.Total).To(Equal(3))
+			stored = append(stored, data.Filename)
+			return false
+		}
+		result, err := testRepo().ImportFiles(src, "art", true, false, false, callback)
+		Expect(err).To(BeNil())
+		Expect(stored).To(Equal([]string{"art/img1.png", "art/sub/README", "art/sub/movie1.mov"}))
+		Expect(result.TrackedPatterns).To(Equal([]string{"*.mov", "*.png", "/art/sub/README"}))
+		Expect(result.StagedFiles).To(Equal(stored))
+
+		content, err := ioutil.ReadFile(filepath.Join(root, "art", "sub", "movie1.mov"))
+		Expect(err).To(BeNil())
+		placeholder, ok := parseLOBPlaceholder(content)
+		Expect(ok).To(BeTrue(), "Working copy should contain a placeholder")
+		_, err = testRepo().GetLOBInfo(placeholder.SHA)
+		Expect(err).To(BeNil(), "Binary should be in the store")
+
+		staged := RunGitCommandForTest(true, "diff", "--cached", "--name-only")
+		Expect(strings.Fields(staged)).To(Equal([]string{".gitattributes", "art/img1.png", "art/sub/README", "art/sub/movie1.mov"}))
+	})
+
+	It("Skips untracked & existing files unless asked not to", func() {
+		Expect(ioutil.WriteFile(".gitattributes", []byte("*.png filter=lob -crlf\n"), 0644)).To(BeNil())
+		os.MkdirAll(filepath.Join(root, "art"), 0755)
+		Expect(ioutil.WriteFile(filepath.Join(root, "art", "img1.png"), []byte("existing"), 0644)).To(BeNil())
+
+		var skipped []string
+		callback := func(data *ImportCallbackData) bool {
+			if data.Type == ImportSkipped {
+				skipped = append(skipped, data.Filename)
+			}
+			return false
+		}
+		result, err := testRepo().ImportFiles(src, "art", false, false, false, callback)
+		Expect(err).To(BeNil())
+		Expect(result.TrackedPatterns).To(BeEmpty())
+		Expect(result.StagedFiles).To(BeEmpty())
+		Expect(skipped).To(Equal([]string{"art/img1.png", "art/sub/README", "art/sub/movie1.mov"}))
+		content, _ := ioutil.ReadFile(filepath.Join(root, "art", "img1.png"))
+		Expect(string(content)).To(Equal("existing"))
+
+		skipped = nil
+		result, err = testRepo().ImportFiles(src, "art", false, true, true, callback)
+		Expect(err).To(BeNil())
+		Expect(result.StagedFiles).To(Equal([]string{"art/img1.png"}))
+		content, _ = ioutil.ReadFile(filepath.Join(root, "art", "img1.png"))
+		Expect(string(content)).To(Equal("existing"), "Dry run should not change anything")
+
+		_, err = testRepo().ImportFiles(src, "", true, false, false, callback)
+		Expect(err).ToNot(BeNil(), "Folders outside the working copy need a destination")
+	})
+})
@@ -8,6 +8,8 @@ import (
 	"os"
 	"syscall"
 	"unsafe"
+
+	"github.com/atlassian/git-lob/util"
 )
 
 // Create a hard link to a file
@@ -15,11 +17,12 @@ import (
 func CreateHardLink(target, link string) error {
 	kern32 := syscall.NewLazyDLL("kernel32.dll")
 	proc := kern32.NewProc("CreateHardLinkW")
-	link16, err := syscall.UTF16PtrFromString(link)
+	// Store paths can be longer than MAX_PATH
+	link16, err := syscall.UTF16PtrFromString(util.LongPath(link))
 	if err != nil {
 		return err
 	}
-	target16, err := syscall.UTF16PtrFromString(target)
+	target16, err := syscall.UTF16PtrFromString(util.LongPath(target))
 	if err != nil {
 		return err
 	}
@@ -42,7 +45,7 @@ func GetHardLinkCount(target string) (linkCount int, err error) {
 	// GetFileInformationByHandle, it just doesn't expose the number of links right
 	// now, since they don't support hard links on Windows
 	// For this reason we can use Go's file open commands & pass the fd to the Win API
-	file, err := os.OpenFile(target, os.O_RDONLY, 0644)
+	file, err := os.OpenFile(util.LongPath(target), os.O_RDONLY, 0644)
 	if err != nil {
 		return 0, err
 	}
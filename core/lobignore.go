@@ -0,0 +1,181 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files committed verbatim
+// .gitattributes patterns are often broad (e.g. *.png), which catches small files that are
+// better off in git itself, like reference images for tests. Rather than contorting the
+// attributes, paths can be listed in a .gitlobignore file at the root of the repo, with the
+// same syntax as .gitignore, and the clean filter passes them through to git unchanged.
+
+// Name of the file in the root of the working copy listing paths the clean filter passes through
+const LOBIgnoreFilename = ".gitlobignore"
+
+// A pattern from a .gitlobignore file
+type lobIgnorePattern struct {
+	regex *regexp.Regexp
+	// '!' re-includes paths an earlier pattern matched
+	negate bool
+	// Trailing '/' only matches directories
+	dirOnly bool
+}
+
+// Patterns last read, reloaded if the file changes (the filter process handles many files)
+type lobIgnorePatternCache struct {
+	sync.Mutex
+	path     string
+	modTime  time.Time
+	size     int64
+	patterns []*lobIgnorePattern
+}
+
+// Whether a file, relative to the root of the repo, is listed in .gitlobignore & so should be
+// committed verbatim rather than stored by git-lob
+func (r *Repo) IsLOBIgnored(filename string) bool {
+	patterns := r.getLOBIgnorePatterns(filepath.Join(r.Root, LOBIgnoreFilename))
+	if len(patterns) == 0 {
+		return false
+	}
+	return lobIgnoreMatches(patterns, filepath.ToSlash(filepath.Clean(filename)))
+}
+
+// Get the patterns in a .gitlobignore file, nil if there isn't one
+func (r *Repo) getLOBIgnorePatterns(path string) []*lobIgnorePattern {
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	r.lobIgnoreCache.Lock()
+	defer r.lobIgnoreCache.Unlock()
+	if r.lobIgnoreCache.path == path && r.lobIgnoreCache.modTime.Equal(fi.ModTime()) && r.lobIgnoreCache.size == fi.Size() {
+		return r.lobIgnoreCache.patterns
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		r.Log.Errorf("Unable to read %v: %v\n", path, err.Error())
+		return nil
+	}
+	r.lobIgnoreCache.path = path
+	r.lobIgnoreCache.modTime = fi.ModTime()
+	r.lobIgnoreCache.size = fi.Size()
+	r.lobIgnoreCache.patterns = r.parseLOBIgnorePatterns(content)
+	return r.lobIgnoreCache.patterns
+}
+
+// Parse .gitignore style patterns
+func (r *Repo) parseLOBIgnorePatterns(content []byte) []*lobIgnorePattern {
+	var ret []*lobIgnorePattern
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		// Trailing spaces are ignored unless escaped
+		if !strings.HasSuffix(line, "\\ ") {
+			line = strings.TrimRight(line, " \t")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := &lobIgnorePattern{}
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		// Patterns with a slash are relative to the root, others match at any level
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else {
+			line = "**/" + line
+		}
+		regex, err := regexp.Compile("^" + lobIgnoreGlobToRegex(line) + "$")
+		if err != nil {
+			r.Log.Errorf("Invalid pattern in %v: %v\n", LOBIgnoreFilename, scanner.Text())
+			continue
+		}
+		pattern.regex = regex
+		ret = append(ret, pattern)
+	}
+	return ret
+}
+
+// Convert a glob with gitignore's ** to a regular expression
+func lobIgnoreGlobToRegex(glob string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			// Any number of directories, including none
+			buf.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "**":
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.Index(glob[i+1:], "]")
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			buf.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return buf.String()
+}
+
+// Whether a / separated path is matched by patterns; as for .gitignore, the last pattern which
+// matches wins, and a file can't be re-included if a directory it's in is matched
+func lobIgnoreMatches(patterns []*lobIgnorePattern, path string) bool {
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		if lobIgnoreMatchesPath(patterns, strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return lobIgnoreMatchesPath(patterns, path, false)
+}
+
+func lobIgnoreMatchesPath(patterns []*lobIgnorePattern, path string, isDir bool) bool {
+	matched := false
+	for _, pattern := range patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.regex.MatchString(path) {
+			matched = !pattern.negate
+		}
+	}
+	return matched
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"regexp"
+	"strings"
+)
+
+// Binaries are identified by a hash of their content, in lower case hex. This has always been
+// SHA-1 but can be SHA-256 for binaries stored with git-lob.hash-algorithm = sha256. The two
+// are told apart by length, so a store (or remote) can hold both, and binaries committed
+// before the setting changed can still be read. Chunk objects use the same hash as the
+// binary they were stored for.
+
+// Hash algorithms for git-lob.hash-algorithm
+const (
+	HashAlgorithmSHA1   = "sha1"
+	HashAlgorithmSHA256 = "sha256"
+)
+
+// Length of a SHA-256 binary SHA (SHALen is the SHA-1 length)
+const SHA256Len = 64
+
+// Regex fragment matching a binary SHA of either kind
+const LOBSHARegexFragment = "[A-Fa-f0-9]{64}|[A-Fa-f0-9]{40}"
+
+var lobSHARegex = regexp.MustCompile("^(?:" + LOBSHARegexFragment + ")$")
+
+// Is a string a full binary SHA, of any hash algorithm?
+func IsLOBSHA(sha string) bool {
+	return lobSHARegex.MatchString(sha)
+}
+
+// Get the hash algorithm a binary SHA was calculated with
+func GetLOBSHAAlgorithm(sha string) string {
+	if len(sha) == SHA256Len {
+		return HashAlgorithmSHA256
+	}
+	return HashAlgorithmSHA1
+}
+
+func newHash(algorithm string) hash.Hash {
+	if algorithm == HashAlgorithmSHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// Create a hash for identifying new binaries, using the configured algorithm
+func (r *Repo) newLOBHash() hash.Hash {
+	return newHash(r.Options.HashAlgorithm)
+}
+
+// Create a hash to check content against an existing binary SHA, with the algorithm it used
+func NewLOBHashForSHA(sha string) hash.Hash {
+	return newHash(GetLOBSHAAlgorithm(sha))
+}
+
+// Calculate the SHA of some data with a hash algorithm
+func calculateSHA(algorithm string, data []byte) string {
+	h := newHash(algorithm)
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Get the identifier written to a placeholder for a binary SHA; SHA-256 ones include the
+// algorithm so that they can't be mistaken for anything older versions could read
+func getLOBPlaceholderSHA(sha string) string {
+	if GetLOBSHAAlgorithm(sha) == HashAlgorithmSHA256 {
+		return SHA256Prefix + sha
+	}
+	return sha
+}
+
+// Get the binary SHA from an identifier matched in a placeholder (see getLOBPlaceholderSHA)
+func parseLOBPlaceholderSHA(id string) string {
+	return strings.TrimPrefix(id, SHA256Prefix)
+}
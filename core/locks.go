@@ -0,0 +1,203 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/atlassian/git-lob/providers"
+)
+
+// File locking stops people changing the same unmergeable file at the same time. Locks are held
+// on a remote (smart servers only) by path, and the locks last seen on the remote are cached
+// locally so that the clean filter can check them when files are added, without having to
+// connect to the remote for every file.
+
+// What the clean filter does when a file locked by someone else is changed (git-lob.lock-check)
+const (
+	LockCheckWarn   = "warn"
+	LockCheckRefuse = "refuse"
+	LockCheckOff    = "off"
+)
+
+// Get the remote whose locks are used, git-lob.lock-remote or the default push remote
+func (r *Repo) GetLockRemote() string {
+	if r.Options.LockRemote != "" {
+		return r.Options.LockRemote
+	}
+	r.defaultLockRemoteOnce.Do(func() {
+		r.defaultLockRemote = r.GetGitDefaultRemoteForPush()
+	})
+	return r.defaultLockRemote
+}
+
+func getLockingProvider(provider providers.SyncProvider, remoteName string) (providers.SmartSyncProvider, error) {
+	smartProvider := providers.UpgradeToSmartSyncProvider(provider)
+	if smartProvider == nil {
+		return nil, fmt.Errorf("Remote %v uses the '%v' provider, only 'smart' remotes support locking", remoteName, provider.TypeID())
+	}
+	return smartProvider, nil
+}
+
+// Lock a file in the working copy on a remote so that only this user can commit changes to it
+// Returns the lock, which may be one this user already held
+func (r *Repo) LockFile(provider providers.SyncProvider, remoteName, path string) (*providers.FileLock, error) {
+	smartProvider, err := getLockingProvider(provider, remoteName)
+	if err != nil {
+		return nil, err
+	}
+	relpath, err := r.GetRepoRelativePath(path)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := smartProvider.LockFile(remoteName, relpath)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the cache up to date, but the lock is held anyway
+	if _, err := r.RefreshLocks(provider, remoteName); err != nil {
+		r.Log.Debugf("Unable to refresh locks after locking %v: %v\n", relpath, err.Error())
+	}
+	return lock, nil
+}
+
+// Release the lock on a file in the working copy on a remote; force breaks another user's
+// lock, if the remote allows this user to
+func (r *Repo) UnlockFile(provider providers.SyncProvider, remoteName, path string, force bool) error {
+	smartProvider, err := getLockingProvider(provider, remoteName)
+	if err != nil {
+		return err
+	}
+	relpath, err := r.GetRepoRelativePath(path)
+	if err != nil {
+		return err
+	}
+	err = smartProvider.UnlockFile(remoteName, relpath, force)
+	if err != nil {
+		return err
+	}
+	if _, err := r.RefreshLocks(provider, remoteName); err != nil {
+		r.Log.Debugf("Unable to refresh locks after unlocking %v: %v\n", relpath, err.Error())
+	}
+	return nil
+}
+
+// Get all the locks held on a remote & cache them for checking when files are added
+func (r *Repo) RefreshLocks(provider providers.SyncProvider, remoteName string) ([]*providers.FileLock, error) {
+	smartProvider, err := getLockingProvider(provider, remoteName)
+	if err != nil {
+		return nil, err
+	}
+	locks, err := smartProvider.ListLocks(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	return locks, r.writeCachedLocks(remoteName, locks)
+}
+
+func (r *Repo) getLocksCacheFile(remoteName string) string {
+	return filepath.Join(r.getRemoteStateCacheRoot(remoteName), "locks")
+}
+
+func (r *Repo) writeCachedLocks(remoteName string, locks []*providers.FileLock) error {
+	data, err := json.Marshal(locks)
+	if err != nil {
+		return err
+	}
+	file := r.getLocksCacheFile(remoteName)
+	tmpfile := file + ".tmp"
+	err = ioutil.WriteFile(tmpfile, data, 0644)
+	if err != nil {
+		return err
+	}
+	r.lockCheckCacheMutex.Lock()
+	delete(r.lockCheckCache, file)
+	r.lockCheckCacheMutex.Unlock()
+	return os.Rename(tmpfile, file)
+}
+
+// Get the locks last seen on a remote, none if they've never been retrieved
+func (r *Repo) GetCachedLocks(remoteName string) []*providers.FileLock {
+	data, err := ioutil.ReadFile(r.getLocksCacheFile(remoteName))
+	if err != nil {
+		return []*providers.FileLock{}
+	}
+	var locks []*providers.FileLock
+	if err = json.Unmarshal(data, &locks); err != nil {
+		r.Log.Debugf("Ignoring invalid lock cache for %v: %v\n", remoteName, err.Error())
+		return []*providers.FileLock{}
+	}
+	return locks
+}
+
+// Get the lock someone else holds on a file (relative to the root of the repo), according to the
+// locks last seen on the lock remote; nil if there isn't one or checks are off
+func (r *Repo) getOthersLockForFile(filename string) *providers.FileLock {
+	if r.Options.LockCheck == LockCheckOff {
+		return nil
+	}
+	remoteName := r.GetLockRemote()
+	file := r.getLocksCacheFile(remoteName)
+	r.lockCheckCacheMutex.Lock()
+	defer r.lockCheckCacheMutex.Unlock()
+	locks, ok := r.lockCheckCache[file]
+	if !ok {
+		locks = make(map[string]*providers.FileLock)
+		for _, l := range r.GetCachedLocks(remoteName) {
+			if !l.Mine {
+				locks[l.Path] = l
+			}
+		}
+		if r.lockCheckCache == nil {
+			r.lockCheckCache = make(map[string]map[string]*providers.FileLock)
+		}
+		r.lockCheckCache[file] = locks
+	}
+	return locks[filepath.ToSlash(filename)]
+}
+
+// Check, before storing it, whether a file which someone else has locked could be committed: it
+// can if checks only warn, or if it may be unchanged, which needs its size (-1 if not known) to be
+// the same as committed. Refusing here saves storing content which can't be committed
+func (r *Repo) checkLockBeforeStore(filename string, size int64, lock *providers.FileLock) bool {
+	if r.Options.LockCheck != LockCheckRefuse || size < 0 {
+		return true
+	}
+	relpath := filepath.ToSlash(filename)
+	if committed, err := r.getLOBSHAForPathAtCommit(relpath, "HEAD"); err == nil {
+		info, err := r.GetLOBInfo(committed)
+		if err != nil || info.Size == size {
+			// Can't tell without the content
+			return true
+		}
+	}
+	r.logLockedFileRefused(relpath, lock)
+	return false
+}
+
+// Check whether someone else holds the lock on a file (relative to the root of the repo) which
+// is being added with new content, according to the locks last seen on the lock remote
+// Warns or refuses depending on git-lob.lock-check; returns false if the change should be refused
+func (r *Repo) checkLockBeforeCommit(filename, sha string) bool {
+	lock := r.getOthersLockForFile(filename)
+	if lock == nil {
+		return true
+	}
+	relpath := filepath.ToSlash(filename)
+	// git runs the clean filter on unchanged files too, e.g. for 'git status' after a touch
+	if committed, err := r.getLOBSHAForPathAtCommit(relpath, "HEAD"); err == nil && committed == sha {
+		return true
+	}
+	if r.Options.LockCheck == LockCheckRefuse {
+		r.logLockedFileRefused(relpath, lock)
+		return false
+	}
+	r.Log.Errorf("Warning: %v is locked by %v, your changes may conflict with theirs\n", relpath, lock.Owner)
+	return true
+}
+
+func (r *Repo) logLockedFileRefused(relpath string, lock *providers.FileLock) {
+	r.Log.Errorf("%v is locked by %v, changes to it can't be committed (git-lob.lock-check is 'refuse')\n", relpath, lock.Owner)
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Locks", func() {
+	root := filepath.Join(os.TempDir(), "LocksTest")
+	var oldwd string
+	filespercommit := [][]string{
+		[]string{"img1.png", filepath.Join("art", "level1.psd")},
+	}
+	var shas []string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		LoadConfig(GlobalOptions)
+		GlobalOptions.LockRemote = "origin"
+
+		shas = CreateManyCommitsForTest(filespercommit, 0, func(filename string, i int) int64 { return 500 })[0]
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		// Reset git config, which also gives the next test a fresh Repo without the cached locks
+		GlobalOptions = NewOptions()
+	})
+
+	It("Checks changes against cached locks", func() {
+		Expect(testRepo().GetCachedLocks("origin")).To(BeEmpty(), "Should be no locks before they're retrieved")
+		Expect(testRepo().checkLockBeforeCommit(filepath.Join("art", "level1.psd"), shas[0])).To(BeTrue(), "Should allow anything with no locks")
+
+		now := time.Now()
+		Expect(testRepo().writeCachedLocks("origin", []*FileLock{
+			&FileLock{Path: "art/level1.psd", Owner: "steve", LockedAt: now},
+			&FileLock{Path: "img1.png", Owner: "me", LockedAt: now, Mine: true},
+		})).To(BeNil())
+		locks := testRepo().GetCachedLocks("origin")
+		Expect(locks).To(HaveLen(2))
+		Expect(locks[0].Owner).To(Equal("steve"))
+		Expect(locks[0].LockedAt.Equal(now)).To(BeTrue())
+
+		newsha := "1111111111111111111111111111111111111111"
+		Expect(testRepo().checkLockBeforeCommit(filepath.Join("art", "level1.psd"), newsha)).To(BeTrue(), "Should only warn by default")
+		Expect(testRepo().checkLockBeforeCommit("img1.png", newsha)).To(BeTrue(), "Should allow changes to my locked files")
+		GlobalOptions.LockCheck = LockCheckRefuse
+		Expect(testRepo().checkLockBeforeCommit(filepath.Join("art", "level1.psd"), newsha)).To(BeFalse(), "Should refuse changes to others' locked files")
+		Expect(testRepo().checkLockBeforeCommit(filepath.Join("art", "level1.psd"), shas[1])).To(BeTrue(), "Should allow unchanged files")
+		Expect(testRepo().checkLockBeforeCommit("img1.png", newsha)).To(BeTrue(), "Should allow changes to my locked files")
+		Expect(testRepo().checkLockBeforeCommit("other.png", newsha)).To(BeTrue(), "Should allow changes to unlocked files")
+
+		var outBuffer bytes.Buffer
+		in := bytes.NewBufferString("Changed content in a locked file")
+		Expect(testRepo().CleanFilterWithReaderWriter(in, &outBuffer, filepath.Join("art", "level1.psd"))).ToNot(Equal(0), "Clean filter should fail for locked files")
+		Expect(outBuffer.Len()).To(Equal(0), "Clean filter should not output a placeholder")
+
+		// A different size to what's committed is refused without storing anything
+		changed := []byte("Changed content of a different size")
+		Expect(ioutil.WriteFile(filepath.Join("art", "level1.psd"), changed, 0644)).To(BeNil())
+		outBuffer.Reset()
+		Expect(testRepo().CleanFilterWithReaderWriter(bytes.NewReader(changed), &outBuffer, filepath.Join("art", "level1.psd"))).ToNot(Equal(0), "Clean filter should fail for locked files")
+		Expect(testRepo().IsLOBMissing(fmt.Sprintf("%x", sha1.Sum(changed)), false)).To(BeTrue(), "Refused content should not be stored")
+
+		GlobalOptions.LockCheck = LockCheckOff
+		Expect(testRepo().checkLockBeforeCommit(filepath.Join("art", "level1.psd"), newsha)).To(BeTrue(), "Should allow anything when checks are off")
+		GlobalOptions.LockRemote = "upstream"
+		GlobalOptions.LockCheck = LockCheckRefuse
+		Expect(testRepo().checkLockBeforeCommit(filepath.Join("art", "level1.psd"), newsha)).To(BeTrue(), "Should only check the lock remote's locks")
+	})
+})
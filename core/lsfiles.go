@@ -0,0 +1,49 @@
+package core
+
+// A file stored by git-lob at a commit, see ListLOBFiles
+type LOBFileInfo struct {
+	// Path relative to the root of the repo, / separated
+	Path string
+	// LOB SHA
+	SHA string
+	// Size of the content, or -1 if unknown because the metadata isn't stored locally
+	Size int64
+	// Number of chunks the content is stored in, or 0 if unknown
+	Chunks int
+	// Whether the complete content is in the local binary store
+	Present bool
+}
+
+// List the files stored by git-lob at a ref (e.g. HEAD for the working copy), limited to
+// pathspecs if any, with whether each binary is stored locally. Only the local store is
+// consulted; binaries which aren't stored locally are reported with an unknown size unless
+// their metadata has been fetched
+func (r *Repo) ListLOBFiles(ref string, pathspecs []string) ([]*LOBFileInfo, error) {
+	_, rootedpathspecs, err := r.getPathspecsRelativeToRepoRoot(pathspecs)
+	if err != nil {
+		return nil, err
+	}
+	filelobs, err := r.GetGitAllFilesAndLOBsToCheckoutAtCommit(ref, rootedpathspecs, nil)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*LOBFileInfo, 0, len(filelobs))
+	// The same binary is often used by several files
+	known := make(map[string]*LOBFileInfo)
+	for _, filelob := range filelobs {
+		info, ok := known[filelob.SHA]
+		if !ok {
+			info = &LOBFileInfo{SHA: filelob.SHA, Size: -1}
+			if lobinfo, err := r.getLOBInfoInBaseDir(filelob.SHA, r.GetLocalLOBRoot()); err == nil {
+				info.Size = lobinfo.Size
+				info.Chunks = lobinfo.NumChunks
+				info.Present = !r.IsLOBMissing(filelob.SHA, false)
+			}
+			known[filelob.SHA] = info
+		}
+		file := *info
+		file.Path = filelob.Filename
+		ret = append(ret, &file)
+	}
+	return ret, nil
+}
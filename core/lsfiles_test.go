@@ -0,0 +1,71 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Ls-files", func() {
+	root := filepath.Join(os.TempDir(), "LsFilesTest")
+	var oldwd string
+	filespercommit := [][]string{
+		[]string{"img1.png", filepath.Join("movies", "movie1.mov")},
+		[]string{"img1.png", "img2.png"},
+	}
+	var shas [][]string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		LoadConfig(GlobalOptions)
+
+		shas = CreateManyCommitsForTest(filespercommit, 0, func(filename string, i int) int64 { return int64(500 + i*100) })
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		GlobalOptions = NewOptions()
+	})
+
+	It("Lists files at HEAD with local status", func() {
+		// Not stored locally
+		Expect(testRepo().DeleteLOB(shas[0][1])).To(BeNil())
+
+		files, err := testRepo().ListLOBFiles("HEAD", nil)
+		Expect(err).To(BeNil())
+		Expect(files).To(HaveLen(3))
+		Expect(*files[0]).To(Equal(LOBFileInfo{Path: "img1.png", SHA: shas[1][0], Size: 500, Chunks: 1, Present: true}))
+		Expect(*files[1]).To(Equal(LOBFileInfo{Path: "img2.png", SHA: shas[1][1], Size: 600, Chunks: 1, Present: true}))
+		Expect(*files[2]).To(Equal(LOBFileInfo{Path: "movies/movie1.mov", SHA: shas[0][1], Size: -1, Chunks: 0, Present: false}))
+
+		// Incomplete content
+		Expect(os.Remove(testRepo().GetLocalLOBChunkPath(shas[1][1], 0))).To(BeNil())
+		files, err = testRepo().ListLOBFiles("HEAD", []string{"img2.png"})
+		Expect(err).To(BeNil())
+		Expect(files).To(HaveLen(1))
+		Expect(*files[0]).To(Equal(LOBFileInfo{Path: "img2.png", SHA: shas[1][1], Size: 600, Chunks: 1, Present: false}))
+	})
+
+	It("Lists files at other refs & relative to the current dir", func() {
+		files, err := testRepo().ListLOBFiles("Tag0", nil)
+		Expect(err).To(BeNil())
+		Expect(files).To(HaveLen(2))
+		Expect(files[0].Path).To(Equal("img1.png"))
+		Expect(files[0].SHA).To(Equal(shas[0][0]))
+		Expect(files[1].Path).To(Equal("movies/movie1.mov"))
+
+		os.Chdir("movies")
+		files, err = testRepo().ListLOBFiles("HEAD", []string{"."})
+		os.Chdir(root)
+		Expect(err).To(BeNil())
+		Expect(files).To(HaveLen(1))
+		Expect(files[0].Path).To(Equal("movies/movie1.mov"))
+	})
+})
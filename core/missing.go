@@ -5,8 +5,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
 
+	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/util"
 )
 
@@ -28,6 +28,13 @@ const (
 	MissingModified MissingCallbackType = iota
 	// Some other error was encountered
 	MissingError MissingCallbackType = iota
+	// Placeholder present, only metadata fetched (--metadata-only), content will be fetched on checkout
+	MissingOnDemand MissingCallbackType = iota
+	// Placeholder WAS present, content fetched from a remote (Source) & checked out
+	MissingRecovered MissingCallbackType = iota
+	// Placeholder WAS present, replaced with another version from history (CommitSummary) which was
+	// available & staged; content for the original is still missing
+	MissingSubstituted MissingCallbackType = iota
 )
 
 // Collected callback data for a missing operation
@@ -40,20 +47,64 @@ type MissingCallbackData struct {
 	CommitSummary *GitCommitSummary
 	// Error details for MissingError
 	Error error
+	// Remote content was fetched from for MissingRecovered
+	Source string
+}
+
+// Asked before replacing a placeholder with another version of the file from history, as added by
+// summary; return true to replace it
+type MissingConfirmFunc func(path string, summary *GitCommitSummary) bool
+
+type missingOptions struct {
+	repo     *Repo
+	checkout bool
+	fix      bool
+	// nil if other versions shouldn't be used
+	confirmSubstitute MissingConfirmFunc
+	// Files fixed, relative to the repo root, for refreshing the index
+	fixedFiles []string
 }
 
 // Check for placeholders
-func Missing(checkout bool, paths []string, callback func(data *MissingCallbackData) (quit bool)) {
-	// Make sure we're in a git repo
-	_, _, err := util.GetRepoRoot()
-	if err != nil {
-		callback(&MissingCallbackData{Type: MissingError, Error: err})
+func (r *Repo) Missing(checkout bool, paths []string, callback func(data *MissingCallbackData) (quit bool)) {
+	r.missing(&missingOptions{repo: r, checkout: checkout}, paths, callback)
+}
+
+// Check for placeholders like Missing & try to fix them; those with content available are checked
+// out, otherwise the content is fetched from any remote that has it. As a last resort, if
+// confirmSubstitute is not nil & agrees, another version of the file from HEAD's history which is
+// available is checked out & staged instead, unless the placeholder was modified locally
+// Files which were fixed without a substitute are refreshed in the index
+func (r *Repo) MissingFix(paths []string, confirmSubstitute MissingConfirmFunc, callback func(data *MissingCallbackData) (quit bool)) {
+	opts := &missingOptions{repo: r, checkout: true, fix: true, confirmSubstitute: confirmSubstitute}
+	r.missing(opts, paths, callback)
+	if len(opts.fixedFiles) > 0 {
+		// Content now matches what git has, it just doesn't know yet
+		if err := r.GitRefreshIndexForFiles(opts.fixedFiles); err != nil {
+			callback(&MissingCallbackData{Type: MissingError, Error: err})
+		}
+	}
+}
+
+// Record a file checked out with the content it should have, if fixing
+func (self *missingOptions) addFixedFile(path string) {
+	if !self.fix {
 		return
 	}
+	if rootedfilename, err := self.repo.getMissingRootedFilename(path); err == nil {
+		self.fixedFiles = append(self.fixedFiles, rootedfilename)
+	}
+}
+
+// Get a path relative to the working dir relative to the repo root instead, for use in git
+func (r *Repo) getMissingRootedFilename(path string) (string, error) {
+	return filepath.Rel(r.Root, r.absPath(path))
+}
 
+func (r *Repo) missing(opts *missingOptions, paths []string, callback func(data *MissingCallbackData) (quit bool)) {
 	if len(paths) > 0 {
 		for _, path := range paths {
-			matches, err := filepath.Glob(path)
+			matches, err := r.globRelativeToWorkDir(path)
 			if err != nil {
 				if callback(&MissingCallbackData{Type: MissingError, Path: path,
 					Error: fmt.Errorf("Unable to glob %v: %v\n", path, err)}) {
@@ -61,7 +112,7 @@ func Missing(checkout bool, paths []string, callback func(data *MissingCallbackD
 				}
 			}
 			for _, match := range matches {
-				stat, err := os.Stat(match)
+				stat, err := os.Stat(r.absPath(match))
 				if err != nil {
 					if callback(&MissingCallbackData{Type: MissingError, Path: match,
 						Error: fmt.Errorf("Unable to stat %v: %v\n", match, err)}) {
@@ -71,9 +122,9 @@ func Missing(checkout bool, paths []string, callback func(data *MissingCallbackD
 				var quit bool
 				if stat.IsDir() {
 					// Matched a dir, so just cascade
-					quit = missingCheckDir(match, checkout, callback)
+					quit = r.missingCheckDir(match, opts, callback)
 				} else {
-					quit = missingCheckFile(match, stat, checkout, callback)
+					quit = r.missingCheckFile(match, stat, opts, callback)
 				}
 				if quit {
 					return
@@ -81,16 +132,16 @@ func Missing(checkout bool, paths []string, callback func(data *MissingCallbackD
 			}
 		}
 	} else {
-		// cascade from working dir
-		missingCheckDir(".", checkout, callback)
+		// cascade from WorkDir
+		r.missingCheckDir(".", opts, callback)
 	}
 
 	return
 }
 
 // Check the contents of a directory for placeholders
-// path is relative to the working dir & we'll use that as-is
-func missingCheckDir(dir string, checkout bool, callback func(data *MissingCallbackData) (quit bool)) (quit bool) {
+// path is relative to WorkDir & we'll use that as-is
+func (r *Repo) missingCheckDir(dir string, opts *missingOptions, callback func(data *MissingCallbackData) (quit bool)) (quit bool) {
 	// Never cascade into git dir
 	if filepath.Base(dir) == ".git" {
 		return false
@@ -101,7 +152,7 @@ func missingCheckDir(dir string, checkout bool, callback func(data *MissingCallb
 		return true
 	}
 
-	dirf, err := os.Open(dir)
+	dirf, err := os.Open(r.absPath(dir))
 	if err != nil {
 		return callback(&MissingCallbackData{Type: MissingError, Path: dir,
 			Error: fmt.Errorf("Unable to open dir %v: %v\n", dir, err)})
@@ -117,9 +168,9 @@ func missingCheckDir(dir string, checkout bool, callback func(data *MissingCallb
 	for _, entry := range contents {
 		relpath := filepath.Join(dir, entry.Name())
 		if entry.IsDir() {
-			quit = missingCheckDir(relpath, checkout, callback)
+			quit = r.missingCheckDir(relpath, opts, callback)
 		} else {
-			quit = missingCheckFile(relpath, entry, checkout, callback)
+			quit = r.missingCheckFile(relpath, entry, opts, callback)
 		}
 	}
 
@@ -127,52 +178,65 @@ func missingCheckDir(dir string, checkout bool, callback func(data *MissingCallb
 }
 
 // Check a file to see if it's a placeholder & what to do about it if so
-// path is relative to the working dir & we'll use that as-is
-func missingCheckFile(path string, fi os.FileInfo, checkout bool, callback func(data *MissingCallbackData) (quit bool)) (quit bool) {
+// path is relative to WorkDir & we'll use that as-is
+func (r *Repo) missingCheckFile(path string, fi os.FileInfo, opts *missingOptions, callback func(data *MissingCallbackData) (quit bool)) (quit bool) {
 	if callback(&MissingCallbackData{Type: MissingWorking, Path: path}) {
 		return true
 	}
 
 	// Smoke test on file size
-	if fi.Size() == int64(SHALineLen) {
+	if isLOBPlaceholderSize(fi.Size()) {
 		// It's the right size for a placeholder
-		filebytes, err := ioutil.ReadFile(path)
+		filebytes, err := ioutil.ReadFile(r.absPath(path))
 		if err != nil {
 			return callback(&MissingCallbackData{Type: MissingError, Path: path,
 				Error: fmt.Errorf("Unable to read file %v: %v\n", path, err)})
 		}
-		shaRegex := regexp.MustCompile(SHALineMatchRegexStr)
-		if match := shaRegex.FindStringSubmatch(string(filebytes)); match != nil {
+		if placeholder, ok := parseLOBPlaceholder(filebytes); ok {
 			// Definitely a placeholder
-			sha := match[1]
-			err := CheckLOBFilesForSHA(sha, GetLocalLOBRoot(), false)
+			sha := placeholder.SHA
+			err := r.CheckLOBFilesForSHA(sha, r.GetLocalLOBRoot(), false)
 			if err != nil {
 				if IsIntegrityError(err) {
 					if callback(&MissingCallbackData{Type: MissingCorrupt, Path: path}) {
 						return true
 					}
+				} else if IsNotFoundError(err) && r.isLOBContentOnDemand(sha) {
+					// Only metadata was fetched, content is on the remote
+					if opts.checkout {
+						err := r.checkoutFile(r.absPath(path), sha, LinkModeCopy, nil)
+						if err != nil {
+							return callback(&MissingCallbackData{Type: MissingError, Path: path,
+								Error: fmt.Errorf("Unable to fetch & checkout %v to file %v: %v\n", sha, path, err)})
+						}
+						opts.addFixedFile(path)
+						if callback(&MissingCallbackData{Type: MissingFixed, Path: path}) {
+							return true
+						}
+					} else if callback(&MissingCallbackData{Type: MissingOnDemand, Path: path}) {
+						return true
+					}
 				} else if IsNotFoundError(err) {
 					// LOB not available, find out who committed this or if it's modified
 					// extract latest change
 					// first, root the filename for use in Git since path is relative to working dir
-					root, _, err := util.GetRepoRoot()
+					rootedfilename, err := r.getMissingRootedFilename(path)
 					if err != nil {
 						callback(&MissingCallbackData{Type: MissingError, Path: path, Error: err})
 						return true // cannot continue
 					}
-					var absfilename string
-					if filepath.IsAbs(path) {
-						absfilename = path
-					} else {
-						wd, _ := os.Getwd()
-						absfilename = filepath.Join(wd, path)
-					}
-					rootedfilename, _ := filepath.Rel(root, absfilename)
-					summary, lobshaincommit, err := GetGitLatestLOBChangeDetails(rootedfilename, "HEAD")
+					summary, lobshaincommit, err := r.GetGitLatestLOBChangeDetails(rootedfilename, "HEAD")
 					if err != nil {
 						return callback(&MissingCallbackData{Type: MissingError, Path: path,
 							Error: fmt.Errorf("Unable to get latest commit for file %v: %v\n", path, err)})
 					}
+					if opts.fix {
+						// Never replace local modifications with something else
+						fixed, quit := r.missingFixFile(path, rootedfilename, sha, lobshaincommit == sha, opts, callback)
+						if fixed || quit {
+							return quit
+						}
+					}
 					if lobshaincommit == sha {
 						// unmodified, so blame case
 						if callback(&MissingCallbackData{Type: MissingBlamed, Path: path, CommitSummary: summary}) {
@@ -192,12 +256,13 @@ func missingCheckFile(path string, fi os.FileInfo, checkout bool, callback func(
 				}
 			} else {
 				// LOB is present
-				if checkout {
-					err := checkoutFile(path, sha)
+				if opts.checkout {
+					err := r.checkoutFile(r.absPath(path), sha, LinkModeCopy, nil)
 					if err != nil {
 						return callback(&MissingCallbackData{Type: MissingError, Path: path,
 							Error: fmt.Errorf("Unable to checkout %v to file %v: %v\n", sha, path, err)})
 					}
+					opts.addFixedFile(path)
 					// checked out OK
 					if callback(&MissingCallbackData{Type: MissingFixed, Path: path}) {
 						return true
@@ -216,3 +281,84 @@ func missingCheckFile(path string, fi os.FileInfo, checkout bool, callback func(
 	}
 	return false
 }
+
+// Try to fix a placeholder whose content isn't available, see MissingFix
+// rootedfilename is path relative to the repo root, substitute is whether another version may be used
+func (r *Repo) missingFixFile(path, rootedfilename, sha string, substitute bool, opts *missingOptions,
+	callback func(data *MissingCallbackData) (quit bool)) (fixed, quit bool) {
+
+	// The shared store has already been tried by CheckLOBFilesForSHA
+	for _, remoteName := range r.getMissingFixRemotes(sha) {
+		provider, err := r.GetProvider(remoteName)
+		if err != nil {
+			r.Log.Debugf("Not fetching %v from %v: %v\n", sha, remoteName, err.Error())
+			continue
+		}
+		err = r.FetchSingle(sha, provider, remoteName, false, func(data *util.ProgressCallbackData) (abort bool) { return false })
+		if err != nil || r.IsLOBMissing(sha, false) {
+			r.Log.Debugf("Unable to fetch %v from %v: %v\n", sha, remoteName, err)
+			continue
+		}
+		if err = r.recordFetchSources(map[string]string{sha: remoteName}); err != nil {
+			r.Log.Errorf("Unable to record where %v was fetched from: %v\n", sha, err.Error())
+		}
+		err = r.checkoutFile(r.absPath(path), sha, LinkModeCopy, nil)
+		if err != nil {
+			return false, callback(&MissingCallbackData{Type: MissingError, Path: path,
+				Error: fmt.Errorf("Unable to checkout %v to file %v: %v\n", sha, path, err)})
+		}
+		opts.addFixedFile(path)
+		return true, callback(&MissingCallbackData{Type: MissingRecovered, Path: path, Source: remoteName})
+	}
+
+	if !substitute || opts.confirmSubstitute == nil {
+		return false, false
+	}
+	history, err := r.getGitLOBHistoryCommitsForFile(rootedfilename, "HEAD")
+	if err != nil {
+		return false, callback(&MissingCallbackData{Type: MissingError, Path: path, Error: err})
+	}
+	for _, commitLOB := range history {
+		altsha := commitLOB.FileLOBs[0].SHA
+		if altsha == sha || r.IsLOBMissing(altsha, false) {
+			continue
+		}
+		// Latest available version is the only sensible substitute
+		summary, err := r.GetGitCommitSummary(commitLOB.Commit)
+		if err != nil {
+			return false, callback(&MissingCallbackData{Type: MissingError, Path: path, Error: err})
+		}
+		if !opts.confirmSubstitute(path, summary) {
+			return false, false
+		}
+		err = r.checkoutFile(r.absPath(path), altsha, LinkModeCopy, nil)
+		if err == nil {
+			// Stage it, the working copy no longer matches the commit
+			var outp []byte
+			outp, err = r.command("git", "add", "--", path).CombinedOutput()
+			if err != nil {
+				err = fmt.Errorf("%v\n%v", err.Error(), string(outp))
+			}
+		}
+		if err != nil {
+			return false, callback(&MissingCallbackData{Type: MissingError, Path: path,
+				Error: fmt.Errorf("Unable to substitute %v for file %v: %v\n", altsha, path, err)})
+		}
+		return true, callback(&MissingCallbackData{Type: MissingSubstituted, Path: path, CommitSummary: summary})
+	}
+	return false, false
+}
+
+// Get the remotes to try fetching missing content from; the usual auto-fetch remotes first, then
+// any other remote configured for git-lob
+func (r *Repo) getMissingFixRemotes(sha string) []string {
+	ret := r.getAutoFetchRemotes(sha)
+	remotes, _ := r.GetGitRemotes()
+	for _, remoteName := range remotes {
+		if providers.GetProviderNameForRemote(r.Options, remoteName) != "" {
+			ret = append(ret, remoteName)
+		}
+	}
+	util.StringRemoveDuplicates(&ret)
+	return ret
+}
@@ -1,12 +1,16 @@
 package core
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
 	. "github.com/atlassian/git-lob/util"
 )
 
@@ -60,22 +64,22 @@ var _ = Describe("Missing", func() {
 
 		// At this point all files are placeholders, because that's how SetupRepoForTest works (to avoid filters)
 		// Checkout all files before we break things
-		Expect(Checkout(nil, false, func(t ProgressCallbackType, filelob *FileLOB, err error) {})).To(BeNil())
+		Expect(testRepo().Checkout(nil, false, func(t ProgressCallbackType, filelob *FileLOB, err error) {})).To(BeNil())
 		// Now make some of these files placeholders
 		// Case 1. placeholder for missing data (small file and missing chunk) - blamed
 		// ./file1.bin
 		Expect(ioutil.WriteFile(setupInputs[2].Files[0], []byte(getLOBPlaceholderContent(setupOutputs[2].LobSHAs[0])), 0644)).To(BeNil())
-		Expect(ForceRemove(GetLocalLOBMetaPath(setupOutputs[2].LobSHAs[0]))).To(BeNil())     // remove meta
-		Expect(ForceRemove(GetLocalLOBChunkPath(setupOutputs[2].LobSHAs[0], 0))).To(BeNil()) // remove chunk 1
+		Expect(ForceRemove(testRepo().GetLocalLOBMetaPath(setupOutputs[2].LobSHAs[0]))).To(BeNil())     // remove meta
+		Expect(ForceRemove(testRepo().GetLocalLOBChunkPath(setupOutputs[2].LobSHAs[0], 0))).To(BeNil()) // remove chunk 1
 		// ./fld/large/large1.bin
 		Expect(ioutil.WriteFile(setupInputs[3].Files[0], []byte(getLOBPlaceholderContent(setupOutputs[3].LobSHAs[0])), 0644)).To(BeNil())
-		Expect(ForceRemove(GetLocalLOBChunkPath(setupOutputs[3].LobSHAs[0], 1))).To(BeNil()) // remove chunk 2 (partial)
+		Expect(ForceRemove(testRepo().GetLocalLOBChunkPath(setupOutputs[3].LobSHAs[0], 1))).To(BeNil()) // remove chunk 2 (partial)
 
 		// Case 2. placeholder for corrupt data
 		// for this one we just mess up the metadata
 		// ./fld/file4.bin
 		Expect(ioutil.WriteFile(setupInputs[1].Files[1], []byte(getLOBPlaceholderContent(setupOutputs[1].LobSHAs[1])), 0644)).To(BeNil())
-		Expect(ioutil.WriteFile(GetLocalLOBMetaPath(setupOutputs[1].LobSHAs[1]), []byte("{ garbage }"), 0644)).To(BeNil()) // corrupt meta
+		Expect(ioutil.WriteFile(testRepo().GetLocalLOBMetaPath(setupOutputs[1].LobSHAs[1]), []byte("{ garbage }"), 0644)).To(BeNil()) // corrupt meta
 
 		// Case 3. placeholder locally modified (random SHA)
 		// ./file4.bin
@@ -102,7 +106,7 @@ var _ = Describe("Missing", func() {
 			}
 			return false
 		}
-		Missing(false, nil, callback)
+		testRepo().Missing(false, nil, callback)
 		Expect(responses).To(HaveLen(5), "Should be 5 callbacks")
 		// Doing a direct comparison with commit summaries is unusable when it fails because time.Time spits out
 		// so much output it floods everything. So pick out specifics to test for
@@ -149,7 +153,7 @@ var _ = Describe("Missing", func() {
 
 		// Now do the same again but checkout=true
 		responses = nil
-		Missing(true, nil, callback)
+		testRepo().Missing(true, nil, callback)
 		Expect(responses).To(HaveLen(5), "Should be 5 callbacks")
 		// Case 1a
 		r = findResponseForPath(setupInputs[2].Files[0])
@@ -192,27 +196,27 @@ var _ = Describe("Missing", func() {
 			}
 			return false
 		}
-		Missing(false, []string{"fld"}, nameCallback)
+		testRepo().Missing(false, []string{"fld"}, nameCallback)
 		Expect(filenames).To(ConsistOf([]string{
 			filepath.Join("fld", "large", "large1.bin"),
 			filepath.Join("fld", "file4.bin")}), "Should have correct filtered responses")
 
 		// Now test using path matching - wildcard
 		filenames = nil
-		Missing(false, []string{"file*"}, nameCallback)
+		testRepo().Missing(false, []string{"file*"}, nameCallback)
 		// file5.bin has already been fixed, and shouldn't match anything in subdirs
 		Expect(filenames).To(ConsistOf([]string{
 			"file1.bin", "file4.bin"}), "Should have correct filtered responses")
 
 		// Now test using path matching - wildcard with folder
 		filenames = nil
-		Missing(false, []string{"*/*.bin"}, nameCallback)
+		testRepo().Missing(false, []string{"*/*.bin"}, nameCallback)
 		// only 1 level down
 		Expect(filenames).To(ConsistOf([]string{
 			filepath.Join("fld", "file4.bin")}), "Should have correct filtered responses")
 		//Now multiple matches
 		filenames = nil
-		Missing(false, []string{"fld", "file*.bin"}, nameCallback)
+		testRepo().Missing(false, []string{"fld", "file*.bin"}, nameCallback)
 		// This should match everything
 		Expect(filenames).To(ConsistOf([]string{
 			filepath.Join("fld", "large", "large1.bin"),
@@ -221,4 +225,88 @@ var _ = Describe("Missing", func() {
 		}), "Should have correct filtered responses")
 	})
 
+	It("Fixes missing content from remotes & other versions", func() {
+		// A remote which has content we don't
+		remoteStore := filepath.Join(os.TempDir(), "MissingTestRemoteStore")
+		defer ForceRemoveAll(remoteStore)
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		Expect(err).To(BeNil(), "Should not error trying to open config file")
+		f.WriteString(fmt.Sprintf(`
+[remote "origin"]
+    git-lob-path = %v
+    git-lob-provider = filesystem
+`, strings.Replace(remoteStore, "\\", "/", -1)))
+		f.Close()
+		oldOptions := *GlobalOptions
+		defer func() { *GlobalOptions = oldOptions }()
+		LoadConfig(GlobalOptions)
+		InitCoreProviders()
+
+		// ./fld/file3.bin is only on the remote
+		remotesha := setupOutputs[1].LobSHAs[0]
+		Expect(exec.Command("cp", "-r", testRepo().GetLocalLOBRoot(), remoteStore).Run()).To(BeNil())
+		Expect(testRepo().DeleteLOB(remotesha)).To(BeNil())
+		Expect(ioutil.WriteFile(setupInputs[1].Files[0], []byte(getLOBPlaceholderContent(remotesha)), 0644)).To(BeNil())
+		// ./file1.bin isn't on the remote either, but the version from commit 0 is available
+		Expect(testRepo().DeleteLOBInBaseDir(setupOutputs[2].LobSHAs[0], remoteStore)).To(BeNil())
+		// ./fld/large/large1.bin only has 1 version
+		Expect(testRepo().DeleteLOBInBaseDir(setupOutputs[3].LobSHAs[0], remoteStore)).To(BeNil())
+
+		var responses []*MissingCallbackData
+		callback := func(data *MissingCallbackData) (quit bool) {
+			if data.Type != MissingWorking {
+				responses = append(responses, data)
+			}
+			return false
+		}
+		findResponseForPath := func(path string) *MissingCallbackData {
+			for _, resp := range responses {
+				if resp.Path == path {
+					return resp
+				}
+			}
+			return nil
+		}
+
+		// Without confirmation nothing is substituted
+		testRepo().MissingFix(nil, func(path string, summary *GitCommitSummary) bool { return false }, callback)
+		r := findResponseForPath(setupInputs[1].Files[0])
+		Expect(r).ToNot(BeNil(), "Should find response for "+setupInputs[1].Files[0])
+		Expect(r.Type).To(BeEquivalentTo(MissingRecovered), "Should have been fetched")
+		Expect(r.Source).To(Equal("origin"))
+		Expect(testRepo().IsLOBMissing(remotesha, false)).To(BeFalse(), "Should now be in the local store")
+		stat, err := os.Stat(setupInputs[1].Files[0])
+		Expect(err).To(BeNil())
+		Expect(stat.Size()).ToNot(BeEquivalentTo(SHALineLen), "Should have been replaced with real data")
+		r = findResponseForPath(setupInputs[2].Files[0])
+		Expect(r).ToNot(BeNil(), "Should find response for "+setupInputs[2].Files[0])
+		Expect(r.Type).To(BeEquivalentTo(MissingBlamed), "Should be blamed when not confirmed")
+		r = findResponseForPath(setupInputs[5].Files[1])
+		Expect(r).ToNot(BeNil(), "Should find response for "+setupInputs[5].Files[1])
+		Expect(r.Type).To(BeEquivalentTo(MissingFixed), "Available file should have been fixed")
+
+		// Now confirm substitutes
+		indexBefore, err := exec.Command("git", "ls-files", "-s", "file1.bin").Output()
+		Expect(err).To(BeNil())
+		responses = nil
+		var confirmed []string
+		testRepo().MissingFix(nil, func(path string, summary *GitCommitSummary) bool {
+			confirmed = append(confirmed, path)
+			Expect(summary.SHA).To(Equal(setupOutputs[0].Commit), "Should offer latest available version")
+			return true
+		}, callback)
+		Expect(confirmed).To(Equal([]string{setupInputs[2].Files[0]}), "Only file with other versions should be offered")
+		r = findResponseForPath(setupInputs[2].Files[0])
+		Expect(r).ToNot(BeNil(), "Should find response for "+setupInputs[2].Files[0])
+		Expect(r.Type).To(BeEquivalentTo(MissingSubstituted), "Should be substituted")
+		Expect(r.CommitSummary.SHA).To(Equal(setupOutputs[0].Commit))
+		r = findResponseForPath(setupInputs[3].Files[0])
+		Expect(r).ToNot(BeNil(), "Should find response for "+setupInputs[3].Files[0])
+		Expect(r.Type).To(BeEquivalentTo(MissingBlamed), "Nothing to substitute")
+		// Substitute is staged
+		indexAfter, err := exec.Command("git", "ls-files", "-s", "file1.bin").Output()
+		Expect(err).To(BeNil())
+		Expect(string(indexAfter)).ToNot(Equal(string(indexBefore)), "Substitute should be staged")
+	})
+
 })
@@ -0,0 +1,371 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/go-homedir"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Moving stores
+// The local store lives at .git/git-lob/content & the shared store wherever git-lob.sharedstore
+// says; either can be moved somewhere else, e.g. to a bigger drive. A store on the same
+// filesystem is renamed in one go; otherwise every file is copied, checked against the original
+// & only then are the originals deleted, so a failed move leaves the store where it was. The
+// local store is moved by leaving a symbolic link to the new location at .git/git-lob/content,
+// so nothing which looks for it there needs to know. Moving the shared store updates
+// git-lob.sharedstore in whichever git config set it. Either way, local files which were hard
+// links to the shared store are linked to it again where they've become separate copies.
+// Other repositories using a shared store which was moved keep their own copies until they're
+// relinked too (see RelinkSharedStore).
+
+// The result of moving a store
+type MoveStoreResult struct {
+	// Where the store was & where it is now (or would be, in dry run mode)
+	From string
+	To   string
+	// Number of files & bytes in the store
+	Files int
+	Bytes int64
+	// Bytes free where the store is moving to, -1 if unknown
+	BytesFree int64
+	// Whether files had to be copied because the new location is on a different filesystem
+	Copied bool
+	// Number of local files linked to the shared store again
+	Relinked int
+}
+
+// Called back with progress while files are copied
+type MoveStoreCallback func(filesDone, totalFiles int, bytesDone, totalBytes int64)
+
+// A file in a store being moved
+type moveStoreFile struct {
+	rel  string
+	size int64
+	mode os.FileMode
+}
+
+// Gets the place the local store is linked from, which is where it is unless it's been moved
+func (r *Repo) getLocalLOBRootLink() string {
+	return filepath.Join(r.GitDir, "git-lob", "content")
+}
+
+// Move the local store to a new path (which must not exist, or be an empty folder)
+func (r *Repo) MoveLocalStore(dest string, dryRun bool, callback MoveStoreCallback) (*MoveStoreResult, error) {
+	link := r.getLocalLOBRootLink()
+	src, err := filepath.EvalSymlinks(r.GetLocalLOBRoot())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to locate local store: %v", err.Error())
+	}
+	linked := src != filepath.Clean(link)
+	dest = filepath.Clean(r.absPath(dest))
+	// Moving it back to .git/git-lob/content replaces the link
+	restoring := linked && dest == filepath.Clean(link)
+	if restoring && !dryRun {
+		if err := os.Remove(link); err != nil {
+			return nil, fmt.Errorf("Unable to remove link to local store: %v", err.Error())
+		}
+	}
+	result, err := r.moveLOBStore(src, dest, dryRun, callback)
+	if err != nil {
+		if restoring && !dryRun {
+			os.Symlink(src, link)
+		}
+		return nil, err
+	}
+	if dryRun || restoring {
+		return result, nil
+	}
+	if linked {
+		os.Remove(link)
+	}
+	err = os.Symlink(dest, link)
+	if err != nil {
+		return result, fmt.Errorf("Local store moved to %v but unable to link to it from %v: %v", dest, link, err.Error())
+	}
+	if r.IsUsingSharedStorage() {
+		result.Relinked, err = r.RelinkSharedStore(false)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Move the shared store to a new path (which must not exist, or be an empty folder) & update
+// git-lob.sharedstore to match
+func (r *Repo) MoveSharedStore(dest string, dryRun bool, callback MoveStoreCallback) (*MoveStoreResult, error) {
+	if !r.IsUsingSharedStorage() {
+		return nil, errors.New("Not using a shared store (git-lob.sharedstore)")
+	}
+	src, err := filepath.EvalSymlinks(r.GetSharedLOBRoot())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to locate shared store: %v", err.Error())
+	}
+	dest = filepath.Clean(r.absPath(dest))
+	result, err := r.moveLOBStore(src, dest, dryRun, callback)
+	if err != nil || dryRun {
+		return result, err
+	}
+	err = r.setSharedStoreConfig(dest)
+	if err != nil {
+		return result, fmt.Errorf("Shared store moved to %v but unable to update git-lob.sharedstore: %v", dest, err.Error())
+	}
+	r.Options.SharedStore = dest
+	result.Relinked, err = r.RelinkSharedStore(false)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// Set git-lob.sharedstore in the git config which sets it now, the repository's if neither does
+func (r *Repo) setSharedStoreConfig(path string) error {
+	args := []string{"config"}
+	repoConfig, _ := util.ReadConfigFile(filepath.Join(r.GitDir, "config"))
+	if _, ok := repoConfig["git-lob.sharedstore"]; !ok {
+		if home, err := homedir.Dir(); err == nil {
+			userConfig, _ := util.ReadConfigFile(filepath.Join(home, ".gitconfig"))
+			if _, ok := userConfig["git-lob.sharedstore"]; ok {
+				args = append(args, "--global")
+			}
+		}
+	}
+	args = append(args, "git-lob.sharedstore", filepath.ToSlash(path))
+	outp, err := r.command("git", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %v", err.Error(), strings.TrimSpace(string(outp)))
+	}
+	return nil
+}
+
+// Whether a folder has nothing in it
+func isDirEmpty(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	names, _ := f.Readdirnames(1)
+	return len(names) == 0
+}
+
+// Move the content of a store from src to dest
+func (r *Repo) moveLOBStore(src, dest string, dryRun bool, callback MoveStoreCallback) (*MoveStoreResult, error) {
+	if dest == src {
+		return nil, fmt.Errorf("Store is already at %v", dest)
+	}
+	if strings.HasPrefix(dest, src+string(filepath.Separator)) || strings.HasPrefix(src, dest+string(filepath.Separator)) {
+		return nil, fmt.Errorf("Cannot move store from %v to %v, one is inside the other", src, dest)
+	}
+	exists, isDir := util.FileOrDirExists(dest)
+	if exists && !isDir {
+		return nil, fmt.Errorf("%v already exists & is not a folder", dest)
+	}
+	if exists && !isDirEmpty(dest) {
+		return nil, fmt.Errorf("%v already exists & is not empty", dest)
+	}
+	files, err := listLOBStoreFiles(src)
+	if err != nil {
+		return nil, err
+	}
+	result := &MoveStoreResult{From: src, To: dest, Files: len(files), BytesFree: -1}
+	for _, f := range files {
+		result.Bytes += f.size
+	}
+	// Space is only needed if files have to be copied, but we can't tell until we try
+	for dir := filepath.Dir(dest); ; dir = filepath.Dir(dir) {
+		if util.DirExists(dir) {
+			if free, err := util.GetFreeDiskSpace(dir); err == nil {
+				result.BytesFree = free
+			}
+			break
+		}
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		os.Remove(dest)
+	}
+	err = os.Rename(src, dest)
+	if err == nil {
+		r.Log.Debugf("Renamed store %v to %v\n", src, dest)
+		return result, validateMovedLOBStore(dest, files)
+	}
+	// Probably a different filesystem
+	r.Log.Debugf("Unable to rename store %v to %v, copying instead: %v\n", src, dest, err.Error())
+	result.Copied = true
+	if result.BytesFree >= 0 && result.BytesFree < result.Bytes {
+		return nil, fmt.Errorf("Not enough space to move store to %v, %v needed but only %v available",
+			dest, util.FormatSize(result.Bytes), util.FormatSize(result.BytesFree))
+	}
+	err = copyLOBStoreFiles(src, dest, files, callback)
+	if err == nil {
+		err = validateMovedLOBStore(dest, files)
+	}
+	if err != nil {
+		// Leave the store where it was
+		os.RemoveAll(dest)
+		return nil, err
+	}
+	err = os.RemoveAll(src)
+	if err != nil {
+		return result, fmt.Errorf("Store copied to %v but unable to remove the original at %v: %v", dest, src, err.Error())
+	}
+	return result, nil
+}
+
+// List the files in a store, except shared store locks which belong to whoever holds them
+func listLOBStoreFiles(root string) ([]*moveStoreFile, error) {
+	var files []*moveStoreFile
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == sharedStoreLockDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, &moveStoreFile{rel: rel, size: fi.Size(), mode: fi.Mode()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list files in store %v: %v", root, err.Error())
+	}
+	return files, nil
+}
+
+// Copy all the files of a store to a new location
+func copyLOBStoreFiles(src, dest string, files []*moveStoreFile, callback MoveStoreCallback) error {
+	var total, done int64
+	for _, f := range files {
+		total += f.size
+	}
+	for i, f := range files {
+		err := copyLOBStoreFile(filepath.Join(src, f.rel), filepath.Join(dest, f.rel), f.mode)
+		if err != nil {
+			return fmt.Errorf("Unable to copy %v to %v: %v", f.rel, dest, err.Error())
+		}
+		done += f.size
+		if callback != nil {
+			callback(i+1, len(files), done, total)
+		}
+	}
+	return nil
+}
+
+func copyLOBStoreFile(src, dest string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Check every file of a store made it to its new location intact
+func validateMovedLOBStore(dest string, files []*moveStoreFile) error {
+	for _, f := range files {
+		if !util.FileExistsAndIsOfSize(filepath.Join(dest, f.rel), f.size) {
+			return fmt.Errorf("Moved store failed validation, %v is missing or the wrong size in %v", f.rel, dest)
+		}
+	}
+	return nil
+}
+
+// Replace files in the local store which are separate copies of files in the shared store with
+// hard links to them, e.g. after the shared store has been moved. Files on a different filesystem
+// to the shared store can't be linked, & are left as they are. Returns the number of files linked
+// (or which would be, in dry run mode)
+func (r *Repo) RelinkSharedStore(dryRun bool) (int, error) {
+	if !r.IsUsingSharedStorage() {
+		return 0, errors.New("Not using a shared store (git-lob.sharedstore)")
+	}
+	localroot := r.GetLocalLOBRoot()
+	files, err := listLOBStoreFiles(localroot)
+	if err != nil {
+		return 0, err
+	}
+	relinked := 0
+	for _, f := range files {
+		if _, ok := getLOBStoreFileSHA(f.rel); !ok {
+			continue
+		}
+		local := filepath.Join(localroot, f.rel)
+		shared := getLOBStoreFilePath(r.GetSharedLOBRoot(), convertLOBStoreRelativePath(f.rel, LOBStoreLayoutOriginal))
+		linked, err := r.relinkSharedLOBFile(shared, local, f.size, dryRun)
+		if err != nil {
+			return relinked, err
+		}
+		if linked {
+			relinked++
+		}
+	}
+	return relinked, nil
+}
+
+// Replace a local file with a hard link to the same file in the shared store, if it's a separate copy
+func (r *Repo) relinkSharedLOBFile(shared, local string, size int64, dryRun bool) (bool, error) {
+	l, err := r.lockSharedStoreFile(shared)
+	if err != nil {
+		return false, err
+	}
+	defer l.Release()
+	sharedfi, err := os.Stat(shared)
+	if err != nil || sharedfi.Size() != size {
+		return false, nil
+	}
+	localfi, err := os.Stat(local)
+	if err != nil || os.SameFile(sharedfi, localfi) {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+	// Link alongside first, so the local copy is only replaced if linking works
+	tmp := local + ".relink"
+	os.Remove(tmp)
+	if err := CreateHardLink(shared, tmp); err != nil {
+		r.Log.Debugf("Unable to link %v to %v, leaving it as a copy: %v\n", local, shared, err.Error())
+		return false, nil
+	}
+	err = os.Rename(tmp, local)
+	if err != nil {
+		os.Remove(tmp)
+		return false, fmt.Errorf("Unable to replace %v with a link to the shared store: %v", local, err.Error())
+	}
+	return true, nil
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Move store", func() {
+	root := filepath.Join(os.TempDir(), "MoveStoreTest")
+	sharedroot := filepath.Join(os.TempDir(), "MoveStoreTestShared")
+	newroot := filepath.Join(os.TempDir(), "MoveStoreTestNew")
+	var oldwd string
+	var contents [][]byte
+	var shas []string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+	})
+	AfterEach(func() {
+		GlobalOptions.SharedStore = ""
+		os.Chdir(oldwd)
+		ForceRemoveAll(root)
+		ForceRemoveAll(sharedroot)
+		ForceRemoveAll(newroot)
+	})
+	storeContent := func() {
+		contents = nil
+		shas = nil
+		for i := 0; i < 3; i++ {
+			content := make([]byte, 10000*(i+1))
+			rand.New(rand.NewSource(int64(i))).Read(content)
+			info, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+			Expect(err).To(BeNil())
+			contents = append(contents, content)
+			shas = append(shas, info.SHA)
+		}
+	}
+	expectContent := func(desc string) {
+		for i, sha := range shas {
+			var buf bytes.Buffer
+			_, err := testRepo().RetrieveLOB(sha, &buf)
+			Expect(err).To(BeNil(), desc)
+			Expect(buf.Bytes()).To(Equal(contents[i]), desc)
+		}
+	}
+
+	It("Moves the local store & links to it", func() {
+		storeContent()
+		link := filepath.Join(root, ".git", "git-lob", "content")
+		dest := filepath.Join(newroot, "store")
+
+		result, err := testRepo().MoveLocalStore(dest, true, nil)
+		Expect(err).To(BeNil())
+		Expect(result.Files).To(BeNumerically(">=", 6))
+		Expect(result.Bytes).To(BeNumerically(">", 60000))
+		Expect(DirExists(dest)).To(BeFalse(), "Dry run should not move anything")
+
+		result, err = testRepo().MoveLocalStore(dest, false, nil)
+		Expect(err).To(BeNil())
+		Expect(DirExists(dest)).To(BeTrue())
+		Expect(FileExists(filepath.Join(dest, GetLOBMetaRelativePath(shas[0])))).To(BeTrue())
+		target, err := os.Readlink(link)
+		Expect(err).To(BeNil(), "Should have left a link")
+		Expect(target).To(Equal(dest))
+		expectContent("Should read the moved store")
+
+		_, err = testRepo().MoveLocalStore(root, false, nil)
+		Expect(err).ToNot(BeNil(), "Should not move into a non-empty folder")
+
+		// Moving it back replaces the link
+		_, err = testRepo().MoveLocalStore(link, false, nil)
+		Expect(err).To(BeNil())
+		fi, err := os.Lstat(link)
+		Expect(err).To(BeNil())
+		Expect(fi.IsDir()).To(BeTrue(), "Should be a folder again, not a link")
+		Expect(DirExists(dest)).To(BeFalse())
+		expectContent("Should read the store back where it was")
+	})
+
+	It("Moves the shared store, updates config & relinks", func() {
+		GlobalOptions.SharedStore = sharedroot
+		os.MkdirAll(sharedroot, 0755)
+		storeContent()
+		dest := filepath.Join(newroot, "shared")
+
+		_, err := testRepo().MoveLocalStore(filepath.Join(newroot, "local"), true, nil)
+		Expect(err).To(BeNil())
+		result, err := testRepo().MoveSharedStore(dest, false, nil)
+		Expect(err).To(BeNil())
+		Expect(result.Relinked).To(Equal(0), "Renaming should keep hard links")
+		Expect(GlobalOptions.SharedStore).To(Equal(dest))
+		config, err := ReadConfigFile(filepath.Join(root, ".git", "config"))
+		Expect(err).To(BeNil())
+		Expect(config["git-lob.sharedstore"]).To(Equal(filepath.ToSlash(dest)))
+		Expect(DirExists(sharedroot)).To(BeFalse())
+		expectContent("Should read the moved shared store")
+
+		// Separate copies are linked again
+		local := testRepo().GetLocalLOBMetaPath(shas[1])
+		data, _ := ioutil.ReadFile(local)
+		os.Remove(local)
+		ioutil.WriteFile(local, data, 0644)
+		n, err := testRepo().RelinkSharedStore(true)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(1))
+		n, err = testRepo().RelinkSharedStore(false)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(1))
+		localfi, _ := os.Stat(local)
+		sharedfi, _ := os.Stat(testRepo().getSharedLOBMetaPath(shas[1]))
+		Expect(os.SameFile(localfi, sharedfi)).To(BeTrue())
+		expectContent("Should read relinked files")
+	})
+
+	It("Copies & validates stores", func() {
+		storeContent()
+		src := testRepo().GetLocalLOBRoot()
+		files, err := listLOBStoreFiles(src)
+		Expect(err).To(BeNil())
+		var copied int
+		err = copyLOBStoreFiles(src, newroot, files, func(filesDone, totalFiles int, bytesDone, totalBytes int64) {
+			copied = filesDone
+		})
+		Expect(err).To(BeNil())
+		Expect(copied).To(Equal(len(files)))
+		Expect(validateMovedLOBStore(newroot, files)).To(BeNil())
+		os.Truncate(filepath.Join(newroot, GetLOBChunkRelativePath(shas[2], 0)), 10)
+		Expect(validateMovedLOBStore(newroot, files)).ToNot(BeNil(), "Should notice a file which didn't copy properly")
+	})
+})
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+	"github.com/atlassian/git-lob/util/lock"
+)
+
+// Background prefetching ('git lob prefetch')
+// Auto-fetch downloads binaries when checkout needs them, which holds the checkout up. Prefetch
+// downloads the binaries a fetch without refs would (recent commits on HEAD & recent refs) ahead
+// of time instead, a batch at a time & at a limited rate (git-lob.prefetch-rate), so it can run
+// in the background; either once, or as a daemon which checks again whenever the recent refs
+// change & the repo isn't being used.
+// Explicit fetches hold the fetch lock for as long as they run. Prefetch only downloads while it
+// can take the lock, one batch at a time, so it gives way to them rather than racing them to
+// download the same binaries.
+
+// Number of binaries prefetch downloads each time it takes the fetch lock
+var PrefetchBatchSize = 10
+
+// How long an explicit fetch waits for the fetch lock (at most one prefetch batch, or another fetch)
+var FetchLockTimeout = 10 * time.Minute
+
+// The repo counts as in use if the index changed more recently than this, & the daemon waits
+var PrefetchIdleTime = 30 * time.Second
+
+// Gets the lock file held while fetching
+func (r *Repo) getFetchLockFile() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "fetch.lock")
+}
+
+// Gets the lock file held by the prefetch daemon, so only one runs per repo
+func (r *Repo) getPrefetchDaemonLockFile() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "prefetch.lock")
+}
+
+// Lock out prefetching while an explicit fetch runs, waiting for a prefetch batch to finish
+func (r *Repo) lockFetch() (*lock.Lock, error) {
+	l, err := lock.Acquire(r.getFetchLockFile(), FetchLockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to lock for fetch: %v", err.Error())
+	}
+	return l, nil
+}
+
+// Download binaries needed for recent commits which aren't stored locally, see above
+// Returns the number downloaded, & whether prefetch gave way to an explicit fetch before
+// downloading everything
+func (r *Repo) Prefetch(remotes []*FetchRemote, callback util.ProgressCallback) (downloaded int, yielded bool, _err error) {
+	filelobs, _, err := r.getRecentFileLOBs(remotes, callback)
+	if err != nil {
+		return 0, false, err
+	}
+	lobshas := ConvertFileLOBSliceToMap(filelobs)
+	var missing []string
+	for sha, _ := range lobshas {
+		if r.IsLOBMissing(sha, false) {
+			missing = append(missing, sha)
+		}
+	}
+	if len(missing) == 0 {
+		return 0, false, nil
+	}
+	// Same order each time, so an interrupted prefetch carries on where it left off
+	sort.Strings(missing)
+	callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("%d binaries to prefetch.", len(missing)),
+		0, 0, 0, 0, nil})
+
+	for start := 0; start < len(missing); start += PrefetchBatchSize {
+		l, err := lock.Acquire(r.getFetchLockFile(), 0)
+		if err != nil {
+			if lock.IsTimeoutError(err) || lock.IsDeadlockError(err) {
+				// An explicit fetch is running, which will download what it needs
+				r.Log.Debugf("Prefetch giving way to fetch: %v\n", err.Error())
+				return downloaded, true, nil
+			}
+			return downloaded, false, err
+		}
+		end := start + PrefetchBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		// A fetch may have got some in the meantime
+		batch := make(map[string]string)
+		for _, sha := range missing[start:end] {
+			if r.IsLOBMissing(sha, false) {
+				batch[sha] = lobshas[sha]
+			}
+		}
+		var sources map[string]string
+		if len(batch) > 0 {
+			sources, _, err = r.fetchLOBsFromRemotes(batch, remotes, false, callback)
+		}
+		l.Release()
+		downloaded += len(sources)
+		if err != nil {
+			return downloaded, false, err
+		}
+	}
+	return downloaded, false, nil
+}
+
+// Is the repo idle, i.e. nobody has changed the index (staged, committed, checked out) lately?
+func (r *Repo) isRepoIdleForPrefetch() bool {
+	fi, err := os.Stat(filepath.Join(r.GitDir, "index"))
+	return err != nil || time.Since(fi.ModTime()) >= PrefetchIdleTime
+}
+
+// Identifies the refs prefetch looks at, so the daemon can tell when they change
+func (r *Repo) getPrefetchRefsSignature(remotes []*FetchRemote) (string, error) {
+	headSHA, err := r.GitRefToFullSHA("HEAD")
+	if err != nil {
+		return "", err
+	}
+	sig := []string{headSHA}
+	if r.Options.FetchRefsPeriodDays > 0 {
+		for _, remote := range remotes {
+			refs, err := r.GetGitRecentRefs(r.Options.FetchRefsPeriodDays, true, remote.Name)
+			if err != nil {
+				return "", err
+			}
+			for _, ref := range refs {
+				sig = append(sig, ref.Name+":"+ref.CommitSHA)
+			}
+		}
+	}
+	return strings.Join(sig, "\n"), nil
+}
+
+// Prefetch every git-lob.prefetch-interval until stop is closed, when the recent refs have changed
+// since the last complete prefetch & the repo is idle. Only one daemon can run per repo
+// report is called after each prefetch with the number of binaries downloaded & any error
+func (r *Repo) PrefetchDaemon(remotes []*FetchRemote, stop <-chan struct{}, callback util.ProgressCallback,
+	report func(downloaded int, err error)) error {
+	daemonlock, err := lock.Acquire(r.getPrefetchDaemonLockFile(), 0)
+	if err != nil {
+		if lock.IsTimeoutError(err) {
+			return fmt.Errorf("Prefetch is already running for this repository (%v)", err.Error())
+		}
+		return err
+	}
+	defer daemonlock.Release()
+
+	lastsig := ""
+	for {
+		sig, err := r.getPrefetchRefsSignature(remotes)
+		if err != nil {
+			report(0, err)
+		} else if sig != lastsig && r.isRepoIdleForPrefetch() {
+			downloaded, yielded, err := r.Prefetch(remotes, callback)
+			report(downloaded, err)
+			if err == nil && !yielded {
+				lastsig = sig
+			}
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(r.Options.PrefetchInterval):
+		}
+	}
+}
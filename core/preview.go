@@ -0,0 +1,300 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Binary previews
+// Reviewing a change to an image or model shouldn't mean downloading the whole asset. If a
+// command is configured for a file's extension (git-lob.preview.<ext>), the clean filter runs it
+// with a new binary's content on stdin & keeps what it writes to stdout, e.g. a thumbnail, as
+// <sha>_preview alongside the metadata. Previews are pushed after the binaries they belong to,
+// fetched after content (or metadata) when git-lob.fetch-previews is set, & shown by 'git lob
+// preview', which downloads just the preview if need be. They're only ever a convenience, so
+// failing to make or transfer one warns rather than failing anything else.
+
+// Gets the command configured to generate previews of a file from its extension, "" if none
+func (r *Repo) GetPreviewCommand(filename string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	if ext == "" {
+		return ""
+	}
+	return r.Options.PreviewCommands[ext]
+}
+
+// Whether there's a preview of a LOB in the local store
+func (r *Repo) HasLocalLOBPreview(sha string) bool {
+	return util.FileExists(getLOBStoreFilePath(r.GetLocalLOBRoot(), GetLOBPreviewRelativePath(sha)))
+}
+
+// Read the preview of a LOB from the local store
+func (r *Repo) ReadLocalLOBPreview(sha string) ([]byte, error) {
+	path := getLOBStoreFilePath(r.GetLocalLOBRoot(), GetLOBPreviewRelativePath(sha))
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, NewNotFoundError(fmt.Sprintf("No preview of %v in the local store", sha), path)
+	}
+	return data, err
+}
+
+// Generate the preview of a stored LOB, if a command is configured for the file it came from
+// (a path relative to the root of the repo) & there isn't one already
+func (r *Repo) GenerateLOBPreview(sha, filename string) error {
+	command := r.GetPreviewCommand(filename)
+	if command == "" || r.HasLocalLOBPreview(sha) {
+		return nil
+	}
+	r.Log.Debugf("Generating preview of %v (%v) with: %v\n", filename, sha, command)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = r.command("cmd", "/C", command)
+	} else {
+		cmd = r.command("sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), "GIT_LOB_PREVIEW_PATH="+filepath.ToSlash(filename), "GIT_LOB_SHA="+sha)
+	out := &previewOutput{max: r.Options.PreviewMaxSize}
+	var stderr bytes.Buffer
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("Unable to run %v: %v", command, err.Error())
+	}
+	// Commands needn't read everything (e.g. just a header), so failing to write is fine
+	go func() {
+		r.RetrieveLOB(sha, stdin)
+		stdin.Close()
+	}()
+	if err = cmd.Wait(); err != nil {
+		return fmt.Errorf("%v failed: %v %v", command, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	if out.exceeded {
+		return fmt.Errorf("Preview is larger than %v (git-lob.preview-max-size)", util.FormatSize(out.max))
+	}
+	if out.buf.Len() == 0 {
+		return fmt.Errorf("%v produced no preview", command)
+	}
+	return r.writeLocalLOBPreview(sha, out.buf.Bytes())
+}
+
+// Receives the output of a preview command up to a size, discarding the rest so the command
+// doesn't fail on a broken pipe
+type previewOutput struct {
+	buf      bytes.Buffer
+	max      int64
+	exceeded bool
+}
+
+func (self *previewOutput) Write(p []byte) (int, error) {
+	if self.max > 0 && int64(self.buf.Len()+len(p)) > self.max {
+		self.exceeded = true
+	}
+	if !self.exceeded {
+		self.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// Write the preview of a LOB to the local store, via a temporary file so it's never partial
+func (r *Repo) writeLocalLOBPreview(sha string, data []byte) error {
+	path := r.GetLocalLOBPreviewPath(sha)
+	f, err := ioutil.TempFile(filepath.Dir(path), "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeerr := f.Close(); err == nil {
+		err = closeerr
+	}
+	if err == nil {
+		os.Remove(path)
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Unable to write preview of %v: %v", sha, err.Error())
+	}
+	return nil
+}
+
+// Generate the preview of a LOB just stored from a file, warning rather than failing if that
+// doesn't work
+func (r *Repo) generateLOBPreviewOrWarn(sha, filename string) {
+	if err := r.GenerateLOBPreview(sha, filename); err != nil {
+		r.Log.Errorf("Warning: unable to generate a preview of %v: %v\n", filename, err.Error())
+	}
+}
+
+// Upload the previews there are of LOBs, after the LOBs themselves. Failures are reported to
+// callback as warnings since previews are optional
+func (r *Repo) pushLOBPreviews(shas []string, provider providers.SyncProvider, remoteName string, force bool,
+	callback util.ProgressCallback) {
+
+	var files []string
+	for _, sha := range shas {
+		if r.HasLocalLOBPreview(sha) {
+			files = append(files, GetLOBPreviewRelativePath(sha))
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+	callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Uploading %d previews", len(files)),
+		0, 0, 0, 0, nil})
+	err := provider.Upload(remoteName, files, r.GetLocalLOBRoot(), force, func(filename string, progressType util.ProgressCallbackType,
+		bytesDone, totalBytes int64) (abort bool) {
+		return util.IsCancelled()
+	})
+	if err != nil && !util.IsCancelled() {
+		r.Log.Errorf("Unable to upload previews to %v: %v\n", remoteName, err.Error())
+		callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Warning: some previews could not be uploaded to %v", remoteName),
+			0, 0, 0, 0, nil})
+	}
+}
+
+// Download the previews of LOBs whose metadata we have, if the remote has them; there's nothing
+// to download for most. Returns the number downloaded
+func (r *Repo) fetchLOBPreviews(shas []string, provider providers.SyncProvider, remoteName string, force bool) (int, error) {
+	var files []string
+	for _, sha := range shas {
+		if (force || !r.HasLocalLOBPreview(sha)) && util.FileExists(getLOBStoreFilePath(r.GetLocalLOBRoot(), GetLOBMetaRelativePath(sha))) {
+			files = append(files, GetLOBPreviewRelativePath(sha))
+		}
+	}
+	if len(files) == 0 {
+		return 0, nil
+	}
+	var downloaded int
+	// Previews only go in the local store, they're not worth sharing
+	err := provider.Download(remoteName, files, r.GetLocalLOBRoot(), force, func(filename string, progressType util.ProgressCallbackType,
+		bytesDone, totalBytes int64) (abort bool) {
+		if progressType == util.ProgressTransferBytes && bytesDone == totalBytes {
+			downloaded++
+		}
+		return util.IsCancelled()
+	})
+	return downloaded, err
+}
+
+// Download previews after a fetch if git-lob.fetch-previews is set, warning of any failure
+func (r *Repo) fetchLOBPreviewsIfEnabled(lobshas map[string]string, provider providers.SyncProvider, remoteName string, force bool,
+	callback util.ProgressCallback) {
+
+	if !r.Options.FetchPreviews || util.IsCancelled() {
+		return
+	}
+	shas := make([]string, 0, len(lobshas))
+	for sha, _ := range lobshas {
+		shas = append(shas, sha)
+	}
+	callback(&util.ProgressCallbackData{util.ProgressCalculate, "Downloading previews", 0, 0, 0, 0, nil})
+	if _, err := r.fetchLOBPreviews(shas, provider, remoteName, force); err != nil && !util.IsCancelled() {
+		r.Log.Errorf("Unable to download previews from %v: %v\n", remoteName, err.Error())
+		callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Warning: some previews could not be downloaded from %v", remoteName),
+			0, 0, 0, 0, nil})
+	}
+}
+
+// Download the preview of a single LOB, along with its metadata if we don't have it. Returns
+// a NotFoundError if the remote has no preview of it
+func (r *Repo) FetchLOBPreview(sha string, provider providers.SyncProvider, remoteName string, force bool) error {
+	if !util.FileExists(getLOBStoreFilePath(r.GetLocalLOBRoot(), GetLOBMetaRelativePath(sha))) {
+		err := r.fetchMetadata(map[string]string{sha: ""}, provider, remoteName, false, func(data *util.ProgressCallbackData) (abort bool) {
+			return util.IsCancelled()
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = r.GetLOBInfo(sha); err != nil {
+			return err
+		}
+	}
+	n, err := r.fetchLOBPreviews([]string{sha}, provider, remoteName, force)
+	if err != nil {
+		return err
+	}
+	if n == 0 && !r.HasLocalLOBPreview(sha) {
+		return NewNotFoundError(fmt.Sprintf("%v has no preview of %v", remoteName, sha), GetLOBPreviewRelativePath(sha))
+	}
+	return nil
+}
+
+// Get the folder previews are copied to so they can be opened in a viewer
+func (r *Repo) getPreviewViewDir() string {
+	return filepath.Join(r.GitDir, "git-lob", "preview")
+}
+
+// Copy the preview of a LOB somewhere a viewer can open it, with an extension matching its
+// content type since viewers often go by that. Older copies are removed
+func (r *Repo) PreparePreviewForViewing(sha string, data []byte) (string, error) {
+	dir := r.getPreviewViewDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if old, err := filepath.Glob(filepath.Join(dir, "*")); err == nil {
+		for _, f := range old {
+			os.Remove(f)
+		}
+	}
+	path := filepath.Join(dir, sha+getPreviewExtension(data))
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Guess a file extension for a preview from its content
+func getPreviewExtension(data []byte) string {
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return ".jpg"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return ".gif"
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return ".webp"
+	case bytes.HasPrefix(data, []byte("%PDF-")):
+		return ".pdf"
+	case bytes.Contains(head, []byte("<svg")):
+		return ".svg"
+	}
+	return ".txt"
+}
+
+// Get the command which opens a file in a viewer, git-lob.preview-viewer or the platform's
+// default for the file type
+func (r *Repo) GetPreviewViewerCommand(path string) *exec.Cmd {
+	if viewer := r.Options.PreviewViewer; viewer != "" {
+		if runtime.GOOS == "windows" {
+			return r.command("cmd", "/C", viewer+` "`+path+`"`)
+		}
+		// As git does for core.editor, so the viewer can have arguments
+		return r.command("sh", "-c", viewer+` "$@"`, viewer, path)
+	}
+	switch runtime.GOOS {
+	case "windows":
+		return r.command("cmd", "/C", "start", "", path)
+	case "darwin":
+		return r.command("open", path)
+	default:
+		return r.command("xdg-open", path)
+	}
+}
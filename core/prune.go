@@ -2,11 +2,11 @@ package core
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"time"
@@ -26,6 +26,10 @@ const (
 	PruneRetainByDate PruneCallbackType = iota
 	// Prune is retaining LOB because commit is referencing it is not pushed
 	PruneRetainNotPushed PruneCallbackType = iota
+	// Prune is retaining LOB because the remote has it under a retention hold (write-once mode)
+	PruneRetainByHold PruneCallbackType = iota
+	// Prune is retaining LOB because of a retention policy (git-lob.prune-keep-*)
+	PruneRetainByPolicy PruneCallbackType = iota
 	// Prune is deleting LOB (because unreferenced or out of date range & pushed)
 	PruneDeleted PruneCallbackType = iota
 )
@@ -36,17 +40,22 @@ type PruneCallback func(t PruneCallbackType, lobsha string)
 
 var (
 	diffLOBReferenceRegex *regexp.Regexp
-	lobFilenameRegex      *regexp.Regexp
 )
 
 // Retrieve the full set of SHAs that currently have files locally (complete or not)
-func getAllLocalLOBSHAs() (util.StringSet, error) {
-	return getAllLOBSHAsInDir(GetLocalLOBRoot())
+func (r *Repo) getAllLocalLOBSHAs() (util.StringSet, error) {
+	return getAllLOBSHAsInDir(r.GetLocalLOBRoot())
 }
 
 // Retrieve the full set of SHAs that currently have files in the shared store (complete or not)
-func getAllSharedLOBSHAs() (util.StringSet, error) {
-	return getAllLOBSHAsInDir(GetSharedLOBRoot())
+func (r *Repo) getAllSharedLOBSHAs() (util.StringSet, error) {
+	return getAllLOBSHAsInDir(r.GetSharedLOBRoot())
+}
+
+// Retrieve the full set of SHAs that have files in any LOB root dir (complete or not)
+// Exposed so that servers storing LOBs in the same structure can use it
+func GetAllLOBSHAsInBaseDir(basedir string) (util.StringSet, error) {
+	return getAllLOBSHAsInDir(basedir)
 }
 
 func getAllLOBSHAsInDir(lobroot string) (util.StringSet, error) {
@@ -56,9 +65,6 @@ func getAllLOBSHAsInDir(lobroot string) (util.StringSet, error) {
 	// end up in there (e.g. .DS_Store), we use it to identify directories
 	// ioutil.ReadDir and filepath.Walk do sorting which is unnecessary & inefficient
 
-	if lobFilenameRegex == nil {
-		lobFilenameRegex = regexp.MustCompile(`^([A-Za-z0-9]{40})_(meta|\d+)$`)
-	}
 	// Readdir returns in 'directory order' which means we may not get files for same SHA together
 	// so use set to find uniques
 	ret := util.NewStringSet()
@@ -99,10 +105,8 @@ func getAllLOBSHAsInDir(lobroot string) (util.StringSet, error) {
 						return ret, errors.New(fmt.Sprintf("Unable to read innermost LOB dir: %v\n", err))
 					}
 					for _, lobname := range lobnames {
-						// Make sure it's really a LOB file
-						if match := lobFilenameRegex.FindStringSubmatch(lobname); match != nil {
-							// Regex pulls out the SHA
-							sha := match[1]
+						// Make sure it's really a LOB file, in either layout
+						if sha, _, _, ok := parseLOBStoreFilename(lobname); ok {
 							ret.Add(sha)
 						}
 					}
@@ -123,11 +127,11 @@ func lobReferenceFromDiffLine(line string) string {
 	// We only care about +, since - is stopping referencing a SHA
 	// important when it comes to purging old files
 	if diffLOBReferenceRegex == nil {
-		diffLOBReferenceRegex = regexp.MustCompile(`^\+git-lob: ([A-Za-z0-9]{40})$`)
+		diffLOBReferenceRegex = regexp.MustCompile(`^\+git-lob: (` + SHAPlaceholderRegexFragment + `)$`)
 	}
 
 	if match := diffLOBReferenceRegex.FindStringSubmatch(line); match != nil {
-		return match[1]
+		return parseLOBPlaceholderSHA(match[1])
 	}
 	return ""
 }
@@ -135,9 +139,9 @@ func lobReferenceFromDiffLine(line string) string {
 // Delete unreferenced binary files from local store
 // For a file to be deleted it needs to not be referenced by any (reachable) commit
 // Returns a list of SHAs that were deleted (unless dryRun = true)
-func PruneUnreferenced(dryRun bool, callback PruneCallback) ([]string, error) {
+func (r *Repo) PruneUnreferenced(dryRun bool, callback PruneCallback) ([]string, error) {
 	// Purging requires full git on the command line, no way around this really
-	cmd := exec.Command("git", "log", "--all", "--no-color", "--oneline", "-p", "-G", SHALineRegexStr)
+	cmd := r.command("git", "log", "--all", "--no-color", "--oneline", "-p", "-G", SHALineRegexStr)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return make([]string, 0), errors.New("Unable to query git log for binary references: " + err.Error())
@@ -162,7 +166,7 @@ func PruneUnreferenced(dryRun bool, callback PruneCallback) ([]string, error) {
 	cmd.Wait()
 
 	// Must also not prune anything that's added but uncommitted
-	cmd = exec.Command("git", "diff", "--cached", "--no-color", "-G", SHALineRegexStr)
+	cmd = r.command("git", "diff", "--cached", "--no-color", "-G", SHALineRegexStr)
 	stdout, err = cmd.StdoutPipe()
 	if err != nil {
 		return make([]string, 0), errors.New("Unable to query git index for binary references: " + err.Error())
@@ -180,7 +184,7 @@ func PruneUnreferenced(dryRun bool, callback PruneCallback) ([]string, error) {
 	}
 	cmd.Wait()
 
-	fileSHAs, err := getAllLocalLOBSHAs()
+	fileSHAs, err := r.getAllLocalLOBSHAs()
 	if err == nil {
 
 		var ret []string
@@ -190,10 +194,18 @@ func PruneUnreferenced(dryRun bool, callback PruneCallback) ([]string, error) {
 				ret = append(ret, string(sha))
 				callback(PruneDeleted, sha)
 				if !dryRun {
-					DeleteLOB(string(sha))
+					r.DeleteLOB(string(sha))
 				}
 			}
 		}
+		if !dryRun {
+			r.pruneLocalLOBDeltas(referencedSHAs)
+			// Disposable copies, which may include binaries just deleted
+			r.purgeSmudgeCache(true)
+		}
+		if !dryRun && len(ret) > 0 {
+			r.pruneLocalChunkObjects()
+		}
 		return ret, nil
 	} else {
 		return make([]string, 0), errors.New("Unable to get list of binary files: " + err.Error())
@@ -203,8 +215,18 @@ func PruneUnreferenced(dryRun bool, callback PruneCallback) ([]string, error) {
 
 // Remove LOBs from the local store if they fall outside the range we would normally fetch for
 // Returns a list of SHAs that were deleted (unless dryRun = true)
-// Unreferenced binaries are also deleted by this
-func PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
+// Unreferenced binaries are also deleted by this, unless kept by a retention policy
+func (r *Repo) PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
+	return r.pruneOld(dryRun, safeMode, nil, callback)
+}
+
+// Remove LOBs from the local store like PruneOld, but only those in reviewed (e.g. from a dry run
+// the user has confirmed); anything else which would now be pruned is kept
+func (r *Repo) PruneOldReviewed(safeMode bool, reviewed []string, callback PruneCallback) ([]string, error) {
+	return r.pruneOld(false, safeMode, util.NewStringSetFromSlice(reviewed), callback)
+}
+
+func (r *Repo) pruneOld(dryRun, safeMode bool, reviewed util.StringSet, callback PruneCallback) ([]string, error) {
 	refSHAsDone := util.NewStringSet()
 	// Build a list to keep, then delete all else (includes deleting unreferenced)
 	// Can't just look at diffs (just like fetch) since LOB changed 3 years ago but still valid = recent
@@ -225,7 +247,7 @@ func PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
 			callback(PruneWorking, "")
 			// This ref is itself included so perform usual 'all lobs at checkout + n days history' query
 			var lobs []string
-			lobs, earliestCommit, err = GetGitAllLOBsToCheckoutAtCommitAndRecent(commit, days, []string{}, []string{})
+			lobs, earliestCommit, err = r.GetGitAllLOBsToCheckoutAtCommitAndRecent(commit, days, []string{}, []string{})
 			if err != nil {
 				return fmt.Errorf("Error determining recent commits from %v: %v", commit, err.Error())
 			}
@@ -285,20 +307,20 @@ func PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
 		}
 
 		// Now walk all unpushed commits referencing LOBs that are earlier than this
-		err = WalkGitCommitLOBsToPush(remoteName, earliestCommit, false, walkHistoryFunc)
+		err = r.WalkGitCommitLOBsToPush(remoteName, earliestCommit, false, []string{}, []string{}, walkHistoryFunc)
 
 		return nil
 
 	}
 
 	// What remote(s) do we check for push? Defaults to "origin"
-	remoteName := util.GlobalOptions.PruneRemote
+	remoteName := r.Options.PruneRemote
 
 	// First, include HEAD (we always want to keep that)
-	util.LogConsoleDebugf("\r") // to reset any progress spinner but don't want \r in log
-	util.LogDebugf("Retaining HEAD and %dd of history\n", util.GlobalOptions.RetentionCommitsPeriodHEAD)
-	headsha, _ := GitRefToFullSHA("HEAD")
-	err := retainLOBs(headsha, util.GlobalOptions.RetentionCommitsPeriodHEAD, false, remoteName)
+	r.Log.ConsoleDebugf("\r") // to reset any progress spinner but don't want \r in log
+	r.Log.Debugf("Retaining HEAD and %dd of history\n", r.Options.RetentionCommitsPeriodHEAD)
+	headsha, _ := r.GitRefToFullSHA("HEAD")
+	err := retainLOBs(headsha, r.Options.RetentionCommitsPeriodHEAD, false, remoteName)
 	if err != nil {
 		return []string{}, err
 	}
@@ -307,12 +329,12 @@ func PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
 	// Get all refs - we get all refs and not just recent refs like fetch, because we should
 	// not purge binaries in old refs if they are not pushed. However we get them in date order
 	// so that we don't have to check date once we cross retention-period-refs threshold
-	refs, err := GetGitRecentRefs(-1, true, "")
+	refs, err := r.GetGitRecentRefs(-1, true, "")
 	if err != nil {
 		return []string{}, err
 	}
 	outsideRefRetention := false
-	earliestRefDate := time.Now().AddDate(0, 0, -util.GlobalOptions.RetentionRefsPeriod)
+	earliestRefDate := time.Now().AddDate(0, 0, -r.Options.RetentionRefsPeriod)
 	for _, ref := range refs {
 		callback(PruneWorking, "")
 		// Don't duplicate work when >1 ref has the same SHA
@@ -330,7 +352,7 @@ func PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
 			notPushedScanOnly = true
 		} else {
 			// check individual date
-			commit, err := GetGitCommitSummary(ref.CommitSHA)
+			commit, err := r.GetGitCommitSummary(ref.CommitSHA)
 			if err != nil {
 				// We can't tell when this was last committed, so be safe & assume it's recent
 			} else if commit.CommitDate.Before(earliestRefDate) {
@@ -342,12 +364,12 @@ func PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
 		}
 
 		if !notPushedScanOnly {
-			util.LogConsoleDebugf("\r") // to reset any progress spinner but don't want \r in log
-			util.LogDebugf("Retaining %v and %dd of history\n", ref.Name, util.GlobalOptions.RetentionCommitsPeriodOther)
+			r.Log.ConsoleDebugf("\r") // to reset any progress spinner but don't want \r in log
+			r.Log.Debugf("Retaining %v and %dd of history\n", ref.Name, r.Options.RetentionCommitsPeriodOther)
 		}
 
 		// LOBs to keep for this ref
-		err := retainLOBs(ref.CommitSHA, util.GlobalOptions.RetentionCommitsPeriodOther, notPushedScanOnly, remoteName)
+		err := retainLOBs(ref.CommitSHA, r.Options.RetentionCommitsPeriodOther, notPushedScanOnly, remoteName)
 		if err != nil {
 			return []string{}, fmt.Errorf("Error determining LOBs to keep for %v: %v", err.Error())
 		}
@@ -357,10 +379,10 @@ func PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
 	var provider providers.SyncProvider
 	safeRemote := "origin"
 	if safeMode {
-		if util.GlobalOptions.PruneRemote != "" {
-			safeRemote = util.GlobalOptions.PruneRemote
+		if r.Options.PruneRemote != "" {
+			safeRemote = r.Options.PruneRemote
 			if safeRemote == "*" {
-				remotes, err := GetGitRemotes()
+				remotes, err := r.GetGitRemotes()
 				if err != nil {
 					return []string{}, fmt.Errorf("Can't determine remotes to check in safe mode for '*': %v", err.Error())
 				}
@@ -382,7 +404,7 @@ func PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
 			}
 		}
 		var err error
-		provider, err = providers.GetProviderForRemote(safeRemote)
+		provider, err = r.GetProvider(safeRemote)
 		if err != nil {
 			return []string{}, err
 		}
@@ -392,47 +414,109 @@ func PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
 
 	}
 	var removedList []string
-	localLOBs, err := getAllLocalLOBSHAs()
+	localLOBs, err := r.getAllLocalLOBSHAs()
 	if err == nil {
+		err = r.retainLOBsByPolicy(retainSet, localLOBs, callback)
+		if err != nil {
+			return []string{}, err
+		}
 		for sha := range localLOBs.Iter() {
 			callback(PruneWorking, "")
+			if reviewed != nil && !reviewed.Contains(sha) && !retainSet.Contains(sha) {
+				// Not what the user agreed to delete
+				retainSet.Add(sha)
+				continue
+			}
 			if !retainSet.Contains(sha) {
 				if safeMode {
 					// check with remote before deleting
-					if CheckRemoteLOBFilesForSHA(sha, provider, safeRemote) != nil {
-						util.LogDebugf("Would have deleted %v but it does not exist on the remote %v, so keeping", sha, safeRemote)
+					if r.CheckRemoteLOBFilesForSHA(sha, provider, safeRemote) != nil {
+						r.Log.Debugf("Would have deleted %v but it does not exist on the remote %v, so keeping", sha, safeRemote)
 						continue
 					}
 				}
 				removedList = append(removedList, string(sha))
 				callback(PruneDeleted, sha)
 				if !dryRun {
-					DeleteLOB(string(sha))
+					r.DeleteLOB(string(sha))
 				}
 			}
 		}
+		if !dryRun {
+			r.pruneLocalLOBDeltas(retainSet)
+			// Disposable copies, which may include binaries just deleted
+			r.purgeSmudgeCache(true)
+		}
+		if !dryRun && len(removedList) > 0 {
+			r.pruneLocalChunkObjects()
+		}
 	} else {
 		return []string{}, errors.New("Unable to get list of binary files: " + err.Error())
 	}
-	util.LogConsoleDebugf("\r") // to reset any progress spinner but don't want \r in log
-	util.LogDebugf("Also retained everything that hasn't been pushed to %v\n", remoteName)
+	r.Log.ConsoleDebugf("\r") // to reset any progress spinner but don't want \r in log
+	r.Log.Debugf("Also retained everything that hasn't been pushed to %v\n", remoteName)
 
 	return removedList, nil
 }
 
+// Delete chunk objects no longer used by any LOB in the local store, after deleting LOBs
+// Like DeleteLOB, also deletes shared copies which no other repo is using
+func (r *Repo) pruneLocalChunkObjects() {
+	// Binaries converted by a staged upgrade may still need their original chunk objects
+	keep, err := r.getUpgradeBackupReferencedChunkObjects()
+	if err != nil {
+		r.Log.Errorf("Unable to prune chunk objects: %v\n", err.Error())
+		return
+	}
+	deleted, err := r.pruneChunkObjectsInBaseDir(r.GetLocalLOBRoot(), false, keep, time.Time{})
+	if err != nil {
+		r.Log.Errorf("Unable to prune chunk objects: %v\n", err.Error())
+		return
+	}
+	if r.IsUsingSharedStorage() {
+		for _, chunksha := range deleted {
+			shared := getLOBStoreFilePath(r.GetSharedLOBRoot(), GetChunkObjectRelativePath(chunksha))
+			l, err := r.lockSharedStoreSHA(chunksha)
+			if err != nil {
+				r.Log.Errorf("Unable to prune chunk object %v: %v\n", chunksha, err.Error())
+				continue
+			}
+			links, err := GetHardLinkCount(shared)
+			if err == nil && links == 1 {
+				os.Remove(shared)
+			}
+			l.Release()
+		}
+	}
+}
+
 // Prune the shared store of all LOBs with only 1 hard link (itself)
 // DeleteLOB will do this for individual LOBs we prune, but if the user
 // manually deletes a repo then unreferenced shared LOBs may never be cleaned up
 // callback is a basic function to let caller know something is happening
-func PruneSharedStore(dryRun bool, callback PruneCallback) ([]string, error) {
-	fileSHAs, err := getAllSharedLOBSHAs()
+func (r *Repo) PruneSharedStore(dryRun bool, callback PruneCallback) ([]string, error) {
+	shas, _, err := r.pruneSharedStoreWithSize(dryRun, callback)
+	return shas, err
+}
+
+// As PruneSharedStore, also returning the bytes reclaimed (or which would be, with dryRun)
+func (r *Repo) pruneSharedStoreWithSize(dryRun bool, callback PruneCallback) ([]string, int64, error) {
+	var reclaimed int64
+	fileSHAs, err := r.getAllSharedLOBSHAs()
 	if err == nil {
 		ret := make([]string, 0, 10)
 		for sha := range fileSHAs.Iter() {
-			shareddir := GetSharedLOBDir(sha)
-			names, err := filepath.Glob(filepath.Join(shareddir, fmt.Sprintf("%v*", sha)))
+			// Another repo mustn't link it while we decide whether to delete it
+			l, err := r.lockSharedStoreSHA(sha)
+			if err != nil {
+				// don't abort for 1 failure, report & carry on
+				r.Log.Errorf("Unable to prune %v: %v\n", sha, err.Error())
+				continue
+			}
+			names, err := getLOBOwnFilesInStore(sha, r.GetSharedLOBRoot())
 			if err != nil {
-				return make([]string, 0), errors.New(fmt.Sprintf("Unable to glob shared files for %v: %v\n", sha, err))
+				l.Release()
+				return make([]string, 0), reclaimed, err
 			}
 			var deleted bool = false
 			var lastsha string
@@ -443,27 +527,166 @@ func PruneSharedStore(dryRun bool, callback PruneCallback) ([]string, error) {
 					// only 1 hard link means no other repo refers to this shared LOB
 					// so it's safe to delete it
 					deleted = true
-					sha = filepath.Base(n)[:40]
 					if lastsha != sha {
 						callback(PruneDeleted, sha)
 						lastsha = sha
 					}
+					size := getFileSize(n)
 					if !dryRun {
 						err = os.Remove(n)
 						if err != nil {
 							// don't abort for 1 failure, report & carry on
-							util.LogErrorf("Unable to delete file %v: %v\n", n, err)
+							r.Log.Errorf("Unable to delete file %v: %v\n", n, err)
+							size = 0
 						}
 					}
+					reclaimed += size
 				}
 			}
+			l.Release()
 			if deleted {
 				ret = append(ret, string(sha))
 			}
 		}
-		return ret, nil
+		// Chunk objects are shared between LOBs, but the same applies
+		err = walkChunkObjectsInBaseDir(r.GetSharedLOBRoot(), func(chunksha, path string) {
+			callback(PruneWorking, "")
+			l, err := r.lockSharedStoreSHA(chunksha)
+			if err != nil {
+				r.Log.Errorf("Unable to prune chunk object %v: %v\n", chunksha, err.Error())
+				return
+			}
+			defer l.Release()
+			links, err := GetHardLinkCount(path)
+			if err == nil && links == 1 {
+				size := getFileSize(path)
+				if !dryRun {
+					err = os.Remove(path)
+					if err != nil {
+						r.Log.Errorf("Unable to delete file %v: %v\n", path, err)
+						size = 0
+					}
+				}
+				reclaimed += size
+			}
+		})
+		if err != nil {
+			return ret, reclaimed, err
+		}
+		return ret, reclaimed, nil
 	} else {
-		return make([]string, 0), err
+		return make([]string, 0), reclaimed, err
 	}
 
 }
+
+// Get the set of LOB SHAs referenced by any commit reachable from the branches & tags
+// currently on a remote (i.e. pushed refs, not just the remote tracking branches)
+// All the commits on the remote must be present locally, otherwise we can't tell which
+// binaries they use, so this returns an error if the remote has commits we haven't fetched
+func (r *Repo) getLOBSHAsReferencedByRemote(remoteName string, callback PruneCallback) (util.StringSet, error) {
+	remoteRefs, err := r.GetGitRemoteRefs(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	referencedSHAs := util.NewStringSet()
+	if len(remoteRefs) == 0 {
+		return referencedSHAs, nil
+	}
+	commits := util.NewStringSet()
+	for ref, sha := range remoteRefs {
+		callback(PruneWorking, "")
+		if !r.GitRefOrSHAIsValid(sha) {
+			return nil, fmt.Errorf("Remote %v has commits which are not present locally (%v), run 'git fetch %v' first", remoteName, ref, remoteName)
+		}
+		commits.Add(sha)
+	}
+
+	// Pass commits on stdin, there could be a lot of refs
+	cmd := r.command("git", "log", "--no-color", "--oneline", "-p", "-G", SHALineRegexStr, "--stdin")
+	var commitList bytes.Buffer
+	for sha := range commits.Iter() {
+		commitList.WriteString(sha)
+		commitList.WriteString("\n")
+	}
+	cmd.Stdin = &commitList
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.New("Unable to query git log for binary references: " + err.Error())
+	}
+	scanner := bufio.NewScanner(stdout)
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.New("Unable to query git log for binary references: " + err.Error())
+	}
+	for scanner.Scan() {
+		callback(PruneWorking, "")
+		if sha := lobReferenceFromDiffLine(scanner.Text()); sha != "" {
+			if referencedSHAs.Add(sha) {
+				callback(PruneRetainReferenced, sha)
+			}
+		}
+	}
+	err = cmd.Wait()
+	if err != nil {
+		return nil, errors.New("Unable to query git log for binary references: " + err.Error())
+	}
+	return referencedSHAs, nil
+}
+
+// Delete binaries from a remote binary store which aren't referenced by any commit on the
+// branches & tags which have been pushed to that remote. Requires a smart server which
+// allows this user to prune (see the "prune" capability in doc/smart_protocol.md)
+// The server may retain some binaries anyway (e.g. if uploaded recently but not yet referenced
+// by a git push), these are reported as PruneRetainByDate. Remotes in write-once retention
+// mode never delete binaries until their retention period is over, these are reported as PruneRetainByHold
+// Returns a list of SHAs that were deleted (or would have been, if dryRun = true)
+func (r *Repo) PruneRemote(provider providers.SyncProvider, remoteName string, dryRun bool, callback PruneCallback) ([]string, error) {
+	smartProvider := providers.UpgradeToSmartSyncProvider(provider)
+	if smartProvider == nil {
+		return []string{}, fmt.Errorf("Remote %v uses the '%v' provider, only 'smart' remotes can be pruned", remoteName, provider.TypeID())
+	}
+
+	referencedSHAs, err := r.getLOBSHAsReferencedByRemote(remoteName, callback)
+	if err != nil {
+		return []string{}, err
+	}
+
+	remoteSHAs, err := smartProvider.ListLOBs(remoteName)
+	if err != nil {
+		return []string{}, err
+	}
+	var unreferenced []string
+	for _, sha := range remoteSHAs {
+		callback(PruneWorking, "")
+		if !referencedSHAs.Contains(sha) {
+			unreferenced = append(unreferenced, sha)
+		}
+	}
+	if len(unreferenced) == 0 {
+		return []string{}, nil
+	}
+
+	// Server makes the final decision
+	deleted, retained, held, err := smartProvider.PruneLOBs(remoteName, unreferenced, dryRun)
+	if err != nil {
+		return []string{}, err
+	}
+	for _, sha := range retained {
+		callback(PruneRetainByDate, sha)
+	}
+	for _, sha := range held {
+		callback(PruneRetainByHold, sha)
+	}
+	for _, sha := range deleted {
+		callback(PruneDeleted, sha)
+	}
+	if !dryRun && len(deleted) > 0 {
+		// Some of them may have been known to be on the remote
+		err = r.forgetRemoteKnownLOBs(remoteName)
+		if err != nil {
+			r.Log.Debugf("Unable to forget binaries known to be on %v: %v\n", remoteName, err.Error())
+		}
+	}
+	return deleted, nil
+}
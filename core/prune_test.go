@@ -1,17 +1,20 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
 	. "github.com/atlassian/git-lob/util"
+	"github.com/atlassian/git-lob/util/lock"
 )
 
 var _ = Describe("Prune", func() {
@@ -122,8 +125,8 @@ var _ = Describe("Prune", func() {
 			// Confirm all files start off existing
 			for _, c := range setupOutputs {
 				for _, l := range c.LobSHAs {
-					Expect(FileExists(GetLocalLOBMetaPath(l))).To(BeTrue(), "%v should exist prior to test")
-					Expect(FileExists(GetLocalLOBChunkPath(l, 0))).To(BeTrue(), "%v should exist prior to test")
+					Expect(FileExists(testRepo().GetLocalLOBMetaPath(l))).To(BeTrue(), "%v should exist prior to test")
+					Expect(FileExists(testRepo().GetLocalLOBChunkPath(l, 0))).To(BeTrue(), "%v should exist prior to test")
 				}
 			}
 			lobsdeleted := 0
@@ -144,7 +147,7 @@ var _ = Describe("Prune", func() {
 				filestoretain += len(out.LobSHAs)
 			}
 			//fmt.Println(setupOutputs)
-			deleted, err := PruneOld(false, false, callback)
+			deleted, err := testRepo().PruneOld(false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error pruning")
 			Expect(deleted).To(BeEmpty(), "No files should be deleted, all within range")
 			Expect(lobsdeleted).To(BeZero(), "No deletion callbacks should be made")
@@ -154,7 +157,7 @@ var _ = Describe("Prune", func() {
 
 			// Now retain no extra versions on other branches, just latest versions
 			GlobalOptions.RetentionCommitsPeriodOther = 0
-			deleted, err = PruneOld(false, false, callback)
+			deleted, err = testRepo().PruneOld(false, false, callback)
 			// However, not pushed flag should stop them being deleted
 			Expect(lobsretainednotpushed).To(BeEquivalentTo(2), "Should have kept a couple of files because not pushed")
 			Expect(err).To(BeNil(), "Should be no error pruning")
@@ -165,8 +168,8 @@ var _ = Describe("Prune", func() {
 			lobsretainednotpushed = 0
 
 			// now mark that branch as pushed so should delete
-			MarkBinariesAsPushed("origin", setupOutputs[4].Commit, "")
-			deleted, err = PruneOld(false, false, callback)
+			testRepo().MarkBinariesAsPushed("origin", setupOutputs[4].Commit, "")
+			deleted, err = testRepo().PruneOld(false, false, callback)
 			// However, not pushed flag should stop them being deleted
 			Expect(err).To(BeNil(), "Should be no error pruning")
 			Expect(lobsretainednotpushed).To(BeEquivalentTo(0), "All files that would be deleted are pushed")
@@ -177,7 +180,7 @@ var _ = Describe("Prune", func() {
 			lobsretainedbydate = 0
 			lobsdeleted = 0
 			for _, l := range setupOutputs[2].LobSHAs {
-				exists, _ := FileOrDirExists(GetLocalLOBMetaPath(l))
+				exists, _ := FileOrDirExists(testRepo().GetLocalLOBMetaPath(l))
 				Expect(exists).To(Equal(false), "File %v should have been deleted", l)
 			}
 
@@ -229,8 +232,8 @@ var _ = Describe("Prune", func() {
 			}
 			// mark master as pushed so should delete
 			// hanging branch [4] was already marked as pushed, but now other refs are not being retained also
-			MarkBinariesAsPushed("origin", setupOutputs[9].Commit, "")
-			deleted, err = PruneOld(false, false, callback)
+			testRepo().MarkBinariesAsPushed("origin", setupOutputs[9].Commit, "")
+			deleted, err = testRepo().PruneOld(false, false, callback)
 			// However, not pushed flag should stop them being deleted
 			Expect(err).To(BeNil(), "Should be no error pruning")
 			Expect(lobsretainednotpushed).To(BeEquivalentTo(0), "All files that would be deleted are pushed")
@@ -238,12 +241,106 @@ var _ = Describe("Prune", func() {
 			Expect(lobsdeleted).To(BeEquivalentTo(len(lobstodelete)), "Correct deletion callbacks should be made")
 			Expect(lobsretainedbydate).To(BeEquivalentTo(len(lobstoretain)), "Should be correct number of file SHAs retained by date")
 			for _, l := range lobstodelete {
-				Expect(FileExists(GetLocalLOBMetaPath(l))).To(BeFalse(), "%v should have been deleted")
-				Expect(FileExists(GetLocalLOBChunkPath(l, 0))).To(BeFalse(), "%v should have been deleted")
+				Expect(FileExists(testRepo().GetLocalLOBMetaPath(l))).To(BeFalse(), "%v should have been deleted")
+				Expect(FileExists(testRepo().GetLocalLOBChunkPath(l, 0))).To(BeFalse(), "%v should have been deleted")
 			}
 
 		})
 
+		It("Keeps binaries by retention policy", func() {
+			GlobalOptions.RetentionRefsPeriod = 0
+			GlobalOptions.RetentionCommitsPeriodHEAD = 0
+			GlobalOptions.RetentionCommitsPeriodOther = 0
+			testRepo().MarkBinariesAsPushed("origin", setupOutputs[4].Commit, "")
+			testRepo().MarkBinariesAsPushed("origin", setupOutputs[9].Commit, "")
+			policyRetained := NewStringSet()
+			callback := func(t PruneCallbackType, sha string) {
+				if t == PruneRetainByPolicy {
+					policyRetained.Add(sha)
+				}
+			}
+			// What goes without any policies
+			baseline, err := testRepo().PruneOld(true, false, callback)
+			Expect(err).To(BeNil(), "Should be no error pruning")
+			Expect(policyRetained.Cardinality()).To(BeZero(), "No policies configured")
+			Expect(baseline).To(ContainElement(setupOutputs[1].LobSHAs[0]), "Old data2.bin should be pruned")
+			Expect(baseline).To(ContainElement(setupOutputs[3].LobSHAs[0]), "Old branch should be pruned")
+			baselineSet := NewStringSetFromSlice(baseline)
+
+			// Versions; latest data3.bin is on the old branch, the older one goes
+			GlobalOptions.PruneKeepVersions = 1
+			deleted, err := testRepo().PruneOld(true, false, callback)
+			Expect(err).To(BeNil(), "Should be no error pruning")
+			Expect(deleted).ToNot(ContainElement(setupOutputs[3].LobSHAs[0]), "Latest version should be kept")
+			Expect(deleted).To(ContainElement(setupOutputs[2].LobSHAs[0]), "Older version should be pruned")
+			Expect(deleted).To(ContainElement(setupOutputs[1].LobSHAs[0]), "Older version should be pruned")
+			Expect(policyRetained.Difference(baselineSet).Cardinality()).To(BeZero(), "Only report what would have gone")
+			GlobalOptions.PruneKeepVersions = 2
+			deleted, err = testRepo().PruneOld(true, false, callback)
+			Expect(err).To(BeNil(), "Should be no error pruning")
+			Expect(deleted).To(BeEmpty(), "No file has more than 2 versions")
+			GlobalOptions.PruneKeepVersions = 0
+
+			// Tags
+			Expect(exec.Command("git", "tag", "release/1", setupOutputs[1].Commit).Run()).To(BeNil())
+			Expect(exec.Command("git", "tag", "other", setupOutputs[3].Commit).Run()).To(BeNil())
+			GlobalOptions.PruneKeepTags = []string{"release/*"}
+			deleted, err = testRepo().PruneOld(true, false, callback)
+			Expect(err).To(BeNil(), "Should be no error pruning")
+			Expect(deleted).ToNot(ContainElement(setupOutputs[1].LobSHAs[0]), "Tagged version should be kept")
+			Expect(deleted).ToNot(ContainElement(setupOutputs[0].LobSHAs[1]), "Files unchanged at tag should be kept")
+			Expect(deleted).To(ContainElement(setupOutputs[3].LobSHAs[0]), "Tag doesn't match")
+			GlobalOptions.PruneKeepTags = nil
+
+			// Size
+			GlobalOptions.PruneKeepSize = 1000
+			var small []string
+			for _, sha := range baseline {
+				info, err := testRepo().GetLOBInfo(sha)
+				Expect(err).To(BeNil())
+				if info.Size < 1000 {
+					small = append(small, sha)
+				}
+			}
+			Expect(small).To(ContainElement(setupOutputs[2].LobSHAs[0]), "Should be a small file to test with")
+			deleted, err = testRepo().PruneOld(true, false, callback)
+			Expect(err).To(BeNil(), "Should be no error pruning")
+			var large []string
+			for sha := range baselineSet.Difference(NewStringSetFromSlice(small)).Iter() {
+				large = append(large, sha)
+			}
+			Expect(deleted).To(ConsistOf(large), "Small files should be kept")
+			GlobalOptions.PruneKeepSize = 0
+
+			// Reviewing
+			candidates, err := testRepo().GetPruneCandidates(baseline)
+			Expect(err).To(BeNil())
+			Expect(candidates).To(HaveLen(len(baseline)))
+			for _, c := range candidates {
+				if c.SHA == setupOutputs[2].LobSHAs[1] {
+					Expect(c.Path).To(Equal("bigdata/something.dat"))
+					Expect(c.Size).To(BeEquivalentTo(2000))
+					Expect(c.Commits).To(Equal([]string{setupOutputs[2].Commit}), "Should list commit which added it")
+					Expect(c.Reason).To(Equal(PruneReasonOutOfRange))
+				}
+			}
+			orphan, err := testRepo().StoreLOB(bytes.NewReader([]byte("Not committed anywhere")), nil)
+			Expect(err).To(BeNil())
+			orphanCandidates, err := testRepo().GetPruneCandidates([]string{orphan.SHA})
+			Expect(err).To(BeNil())
+			Expect(orphanCandidates).To(HaveLen(1))
+			Expect(orphanCandidates[0].Commits).To(BeEmpty())
+			Expect(orphanCandidates[0].Reason).To(Equal(PruneReasonUnreferenced))
+			Expect(testRepo().DeleteLOB(orphan.SHA)).To(BeNil())
+			deleted, err = testRepo().PruneOldReviewed(false, baseline[:1], callback)
+			Expect(err).To(BeNil(), "Should be no error pruning")
+			Expect(deleted).To(Equal(baseline[:1]), "Should only delete what was reviewed")
+			Expect(FileExists(testRepo().GetLocalLOBMetaPath(baseline[0]))).To(BeFalse(), "Should have been deleted")
+			for _, sha := range baseline[1:] {
+				Expect(FileExists(testRepo().GetLocalLOBMetaPath(sha))).To(BeTrue(), "Should not have been deleted")
+			}
+		})
+
 	})
 
 	Describe("Prune all unreferenced", func() {
@@ -280,7 +377,7 @@ var _ = Describe("Prune", func() {
 						lobsdeleted++
 					}
 				}
-				shasToDelete, err := PruneUnreferenced(false, callback)
+				shasToDelete, err := testRepo().PruneUnreferenced(false, callback)
 				Expect(err).To(BeNil(), "PruneUnreferenced should succeed")
 				Expect(shasToDelete).To(BeEmpty(), "Should report no files to prune")
 				Expect(lobsdeleted).To(BeZero(), "Should be no deletion callbacks")
@@ -300,12 +397,12 @@ var _ = Describe("Prune", func() {
 				lobshas = GetListOfRandomSHAsForTest(20)
 				lobshaset = NewStringSetFromSlice(lobshas)
 				for _, s := range lobshas {
-					metafile := GetLocalLOBMetaPath(s)
+					metafile := testRepo().GetLocalLOBMetaPath(s)
 					ioutil.WriteFile(metafile, []byte("meta something"), 0644)
 					lobfiles = append(lobfiles, metafile)
 					numChunks := rand.Intn(3) + 1
 					for c := 0; c < numChunks; c++ {
-						chunkfile := GetLocalLOBChunkPath(s, c)
+						chunkfile := testRepo().GetLocalLOBChunkPath(s, c)
 						lobfiles = append(lobfiles, chunkfile)
 						ioutil.WriteFile(chunkfile, []byte("data something"), 0644)
 					}
@@ -330,7 +427,7 @@ var _ = Describe("Prune", func() {
 							lobsdeleted++
 						}
 					}
-					shasToDelete, err := PruneUnreferenced(true, callback)
+					shasToDelete, err := testRepo().PruneUnreferenced(true, callback)
 					Expect(err).To(BeNil(), "PruneUnreferenced should succeed")
 					Expect(lobsreferenced).To(BeZero(), "Should be no LOB referenced")
 					Expect(lobsdeleted).To(BeEquivalentTo(len(lobshas)), "Should be correct number deleted in callback")
@@ -345,7 +442,7 @@ var _ = Describe("Prune", func() {
 
 				})
 				It("deletes files when not in dry run mode", func() {
-					shasToDelete, err := PruneUnreferenced(false, func(PruneCallbackType, string) {})
+					shasToDelete, err := testRepo().PruneUnreferenced(false, func(PruneCallbackType, string) {})
 					Expect(err).To(BeNil(), "PruneUnreferenced should succeed")
 					// Use sets to compare so ordering doesn't matter
 					actualset := NewStringSetFromSlice(shasToDelete)
@@ -413,7 +510,7 @@ var _ = Describe("Prune", func() {
 							lobsdeleted++
 						}
 					}
-					deletedSlice, err := PruneUnreferenced(false, callback)
+					deletedSlice, err := testRepo().PruneUnreferenced(false, callback)
 					Expect(err).To(BeNil(), "PruneUnreferenced should succeed")
 					shasDidDelete := NewStringSetFromSlice(deletedSlice)
 
@@ -422,7 +519,7 @@ var _ = Describe("Prune", func() {
 					Expect(lobsreferenced).To(BeEquivalentTo(len(lobshas)-len(shasShouldDelete)), "Callbacks for retention should be correct")
 					// Make sure files don't exist
 					for sha := range shasShouldDelete.Iter() {
-						matches, err := filepath.Glob(fmt.Sprintf("%v*", filepath.Join(GetLocalLOBDir(sha), sha)))
+						matches, err := filepath.Glob(fmt.Sprintf("%v*", filepath.Join(testRepo().GetLocalLOBDir(sha), sha)))
 						Expect(err).To(BeNil(), "Should not be error in glob checking")
 						Expect(matches).To(BeEmpty(), "All local SHAs should be deleted")
 					}
@@ -448,20 +545,20 @@ var _ = Describe("Prune", func() {
 				lobshas = GetListOfRandomSHAsForTest(20)
 				lobshaset = NewStringSetFromSlice(lobshas)
 				for _, s := range lobshas {
-					metafile := getSharedLOBMetaPath(s)
+					metafile := testRepo().getSharedLOBMetaPath(s)
 					ioutil.WriteFile(metafile, []byte("meta something"), 0644)
 					lobfiles = append(lobfiles, metafile)
 					// link shared locally
-					metalinkfile := GetLocalLOBMetaPath(s)
+					metalinkfile := testRepo().GetLocalLOBMetaPath(s)
 					CreateHardLink(metafile, metalinkfile)
 					lobfiles = append(lobfiles, metalinkfile)
 					numChunks := rand.Intn(3) + 1
 					for c := 0; c < numChunks; c++ {
-						chunkfile := GetSharedLOBChunkPath(s, c)
+						chunkfile := testRepo().GetSharedLOBChunkPath(s, c)
 						lobfiles = append(lobfiles, chunkfile)
 						ioutil.WriteFile(chunkfile, []byte("data something"), 0644)
 						// link shared locally
-						linkfile := GetLocalLOBChunkPath(s, c)
+						linkfile := testRepo().GetLocalLOBChunkPath(s, c)
 						CreateHardLink(chunkfile, linkfile)
 						lobfiles = append(lobfiles, linkfile)
 					}
@@ -481,7 +578,7 @@ var _ = Describe("Prune", func() {
 			Context("prunes all files when no references", func() {
 				// Because we've created no commits, all LOBs should be eligible for deletion
 				It("lists files but doesn't act on it in dry run mode", func() {
-					shasToDelete, err := PruneUnreferenced(true, func(PruneCallbackType, string) {})
+					shasToDelete, err := testRepo().PruneUnreferenced(true, func(PruneCallbackType, string) {})
 					Expect(err).To(BeNil(), "PruneUnreferenced should succeed")
 					// Use sets to compare so ordering doesn't matter
 					actualset := NewStringSetFromSlice(shasToDelete)
@@ -495,7 +592,7 @@ var _ = Describe("Prune", func() {
 
 				})
 				It("deletes files when not in dry run mode", func() {
-					shasToDelete, err := PruneUnreferenced(false, func(PruneCallbackType, string) {})
+					shasToDelete, err := testRepo().PruneUnreferenced(false, func(PruneCallbackType, string) {})
 					Expect(err).To(BeNil(), "PruneUnreferenced should succeed")
 					// Use sets to compare so ordering doesn't matter
 					actualset := NewStringSetFromSlice(shasToDelete)
@@ -554,7 +651,7 @@ var _ = Describe("Prune", func() {
 					//shasShouldKeep := NewStringSetFromSlice(lobshas[0:14])
 					shasShouldDelete := NewStringSetFromSlice(lobshas[14:])
 
-					deletedSlice, err := PruneUnreferenced(false, func(PruneCallbackType, string) {})
+					deletedSlice, err := testRepo().PruneUnreferenced(false, func(PruneCallbackType, string) {})
 					Expect(err).To(BeNil(), "PruneUnreferenced should succeed")
 					shasDidDelete := NewStringSetFromSlice(deletedSlice)
 
@@ -562,11 +659,11 @@ var _ = Describe("Prune", func() {
 
 					// Make sure files don't exist
 					for sha := range shasShouldDelete.Iter() {
-						matches, err := filepath.Glob(fmt.Sprintf("%v*", filepath.Join(GetLocalLOBDir(sha), sha)))
+						matches, err := filepath.Glob(fmt.Sprintf("%v*", filepath.Join(testRepo().GetLocalLOBDir(sha), sha)))
 						Expect(err).To(BeNil(), "Should not be error in glob checking")
 						Expect(matches).To(BeEmpty(), "All local SHAs should be deleted")
 
-						matches, err = filepath.Glob(fmt.Sprintf("%v*", filepath.Join(GetSharedLOBDir(sha), sha)))
+						matches, err = filepath.Glob(fmt.Sprintf("%v*", filepath.Join(testRepo().GetSharedLOBDir(sha), sha)))
 						Expect(err).To(BeNil(), "Should not be error in glob checking")
 						Expect(matches).To(BeEmpty(), "All shared SHAs should be deleted")
 					}
@@ -591,12 +688,12 @@ var _ = Describe("Prune", func() {
 				lobshas = GetListOfRandomSHAsForTest(20)
 				lobshaset = NewStringSetFromSlice(lobshas)
 				for _, s := range lobshas {
-					metafile := getSharedLOBMetaPath(s)
+					metafile := testRepo().getSharedLOBMetaPath(s)
 					ioutil.WriteFile(metafile, []byte("meta something"), 0644)
 					sharedlobfiles = append(sharedlobfiles, metafile)
 					numChunks := rand.Intn(3) + 1
 					for c := 0; c < numChunks; c++ {
-						chunkfile := GetSharedLOBChunkPath(s, c)
+						chunkfile := testRepo().GetSharedLOBChunkPath(s, c)
 						sharedlobfiles = append(sharedlobfiles, chunkfile)
 						ioutil.WriteFile(chunkfile, []byte("data something"), 0644)
 					}
@@ -613,11 +710,17 @@ var _ = Describe("Prune", func() {
 			Context("prunes all files when no references", func() {
 				// Because we've created no hard links to the shared store, everything should be available for deletion
 				It("lists files but doesn't act on it in dry run mode", func() {
-					shasToDelete, err := PruneSharedStore(true, func(PruneCallbackType, string) {})
+					shasToDelete, err := testRepo().PruneSharedStore(true, func(PruneCallbackType, string) {})
 					Expect(err).To(BeNil(), "PruneSharedStore should succeed")
 					// Use sets to compare so ordering doesn't matter
 					actualset := NewStringSetFromSlice(shasToDelete)
 					Expect(actualset).To(Equal(lobshaset), "Should want to delete all files")
+					candidates, err := testRepo().GetSharedPruneCandidates(shasToDelete)
+					Expect(err).To(BeNil())
+					Expect(candidates).To(HaveLen(len(shasToDelete)))
+					for _, c := range candidates {
+						Expect(c.Reason).To(Equal(PruneReasonUnlinked))
+					}
 
 					// This includes both local links and shared files
 					for _, file := range sharedlobfiles {
@@ -627,7 +730,7 @@ var _ = Describe("Prune", func() {
 
 				})
 				It("deletes files when not in dry run mode", func() {
-					shasToDelete, err := PruneSharedStore(false, func(PruneCallbackType, string) {})
+					shasToDelete, err := testRepo().PruneSharedStore(false, func(PruneCallbackType, string) {})
 					Expect(err).To(BeNil(), "PruneSharedStore should succeed")
 					// Use sets to compare so ordering doesn't matter
 					actualset := NewStringSetFromSlice(shasToDelete)
@@ -640,6 +743,43 @@ var _ = Describe("Prune", func() {
 					}
 
 				})
+				It("prunes automatically when due", func() {
+					defer func() { GlobalOptions.SharedStoreGCDays = 0 }()
+					result, err := testRepo().RunSharedStoreGCIfDue(func(PruneCallbackType, string) {})
+					Expect(err).To(BeNil())
+					Expect(result).To(BeNil(), "Should not run unless enabled")
+					Expect(FileExists(sharedlobfiles[0])).To(BeTrue())
+
+					GlobalOptions.SharedStoreGCDays = 7
+					// Another repo is already doing it
+					l, err := lock.Acquire(testRepo().getSharedStoreGCLockFile(), 0)
+					Expect(err).To(BeNil())
+					result, err = testRepo().RunSharedStoreGCIfDue(func(PruneCallbackType, string) {})
+					l.Release()
+					Expect(err).To(BeNil())
+					Expect(result).To(BeNil(), "Should not run at the same time as another process")
+					Expect(FileExists(sharedlobfiles[0])).To(BeTrue())
+
+					result, err = testRepo().RunSharedStoreGCIfDue(func(PruneCallbackType, string) {})
+					Expect(err).To(BeNil())
+					Expect(result).ToNot(BeNil(), "Should run when due")
+					Expect(NewStringSetFromSlice(result.Deleted)).To(Equal(lobshaset))
+					Expect(result.Reclaimed).To(BeEquivalentTo(len(sharedlobfiles) * len("data something")))
+					for _, file := range sharedlobfiles {
+						Expect(FileExists(file)).To(BeFalse(), "File %v should have been deleted", file)
+					}
+
+					// Not due again until the period has passed
+					result, err = testRepo().RunSharedStoreGCIfDue(func(PruneCallbackType, string) {})
+					Expect(err).To(BeNil())
+					Expect(result).To(BeNil(), "Should not run again straight away")
+					old := time.Now().Add(-8 * 24 * time.Hour)
+					Expect(os.Chtimes(testRepo().getSharedStoreGCStateFile(), old, old)).To(BeNil())
+					result, err = testRepo().RunSharedStoreGCIfDue(func(PruneCallbackType, string) {})
+					Expect(err).To(BeNil())
+					Expect(result).ToNot(BeNil(), "Should run again once the period has passed")
+					Expect(result.Deleted).To(BeEmpty())
+				})
 			})
 			Context("some files referenced", func() {
 				var locallobfiles []string
@@ -666,14 +806,14 @@ var _ = Describe("Prune", func() {
 				})
 
 				It("does nothing in dry run mode", func() {
-					PruneSharedStore(true, func(PruneCallbackType, string) {})
+					testRepo().PruneSharedStore(true, func(PruneCallbackType, string) {})
 					for _, sharedfile := range sharedlobfiles {
 						exists, _ := FileOrDirExists(sharedfile)
 						Expect(exists).To(BeTrue(), "Should not have deleted %v", sharedfile)
 					}
 				})
 				It("correctly identifies referenced and unreferenced shared files", func() {
-					PruneSharedStore(false, func(PruneCallbackType, string) {})
+					testRepo().PruneSharedStore(false, func(PruneCallbackType, string) {})
 					for i, sharedfile := range sharedlobfiles {
 						exists, _ := FileOrDirExists(sharedfile)
 						if i <= referenceUpTo {
@@ -688,4 +828,54 @@ var _ = Describe("Prune", func() {
 		})
 	})
 
+	Describe("Prune remote", func() {
+		root := filepath.Join(os.TempDir(), "PruneRemoteTest")
+		remotePath := filepath.Join(os.TempDir(), "PruneRemoteTest-remote.git")
+		var oldwd string
+		var infos []*LOBInfo
+		BeforeEach(func() {
+			CreateGitRepoForTest(root)
+			CreateBareGitRepoForTest(remotePath)
+			oldwd, _ = os.Getwd()
+			os.Chdir(root)
+			RunGitCommandForTest(true, "remote", "add", "origin", remotePath)
+
+			infos = nil
+			for i, file := range []string{"pushed.dat", "tagged.dat", "local.dat"} {
+				infos = append(infos, CreateAndStoreLOBFileForTest(100, file))
+				RunGitCommandForTest(true, "add", file)
+				RunGitCommandForTest(true, "commit", "-m", fmt.Sprintf("Commit %d", i))
+				switch i {
+				case 0:
+					RunGitCommandForTest(true, "push", "origin", "HEAD:refs/heads/master")
+				case 1:
+					RunGitCommandForTest(true, "tag", "-a", "-m", "Tag", "v1")
+					RunGitCommandForTest(true, "push", "origin", "v1")
+					RunGitCommandForTest(true, "reset", "--hard", "HEAD^")
+				}
+			}
+		})
+		AfterEach(func() {
+			os.Chdir(oldwd)
+			ForceRemoveAll(root)
+			ForceRemoveAll(remotePath)
+		})
+
+		It("only counts binaries referenced by branches & tags on the remote", func() {
+			referenced, err := testRepo().getLOBSHAsReferencedByRemote("origin", func(PruneCallbackType, string) {})
+			Expect(err).To(BeNil(), "Shouldn't be an error finding referenced binaries")
+			Expect(referenced.Contains(infos[0].SHA)).To(BeTrue(), "Binary on pushed branch should be referenced")
+			Expect(referenced.Contains(infos[1].SHA)).To(BeTrue(), "Binary on pushed tag should be referenced")
+			Expect(referenced.Contains(infos[2].SHA)).To(BeFalse(), "Binary only on local branch should not be referenced")
+
+			// Remote now has a commit we don't have
+			commit := strings.TrimSpace(RunGitCommandForTest(true, "--git-dir", remotePath,
+				"commit-tree", "-m", "Someone else", "4b825dc642cb6eb9a060e54bf8d69288fbee4904"))
+			RunGitCommandForTest(true, "--git-dir", remotePath, "update-ref", "refs/heads/other", commit)
+			_, err = testRepo().getLOBSHAsReferencedByRemote("origin", func(PruneCallbackType, string) {})
+			Expect(err).ToNot(BeNil(), "Should refuse to work out references with unfetched commits")
+			Expect(err.Error()).To(ContainSubstring("git fetch origin"))
+		})
+	})
+
 })
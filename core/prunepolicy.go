@@ -0,0 +1,204 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Retention policies for pruning old binaries
+// On top of the retention periods, binaries can be kept because they're one of the latest
+// versions of a path (git-lob.prune-keep-versions), because a tag matching a pattern uses them
+// (git-lob.prune-keep-tags) or just because they're small (git-lob.prune-keep-size)
+
+// Walk every commit in the repo which adds a binary, latest first (topologically)
+func (r *Repo) walkGitAllLOBAdditions(callback func(commitLOB *CommitLOBRef) (quit bool, err error)) error {
+	cmd := r.command("git", "log", "--all", `--format=commitsha: %H %P`, "-p",
+		"--topo-order", "-G", SHALineRegexStr)
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Unable to call git-log: %v", err.Error())
+	}
+	cmd.Start()
+	_, err = walkGitLogOutputForLOBReferences(outp, true, false, nil, nil, callback)
+	// The callback may have quit early, git can't exit until everything's been read
+	io.Copy(ioutil.Discard, outp)
+	cmd.Wait()
+	return err
+}
+
+// Add binaries which the configured retention policies keep to retainSet, out of the local
+// binaries which aren't already in it
+func (r *Repo) retainLOBsByPolicy(retainSet, localLOBs util.StringSet, callback PruneCallback) error {
+	retain := func(sha string) {
+		if localLOBs.Contains(sha) && retainSet.Add(sha) {
+			callback(PruneRetainByPolicy, sha)
+		}
+	}
+
+	if r.Options.PruneKeepSize > 0 {
+		for sha := range localLOBs.Iter() {
+			callback(PruneWorking, "")
+			if retainSet.Contains(sha) {
+				continue
+			}
+			info, err := r.GetLOBInfo(sha)
+			if err == nil && info.Size < r.Options.PruneKeepSize {
+				retain(sha)
+			}
+		}
+	}
+
+	if len(r.Options.PruneKeepTags) > 0 {
+		refs, err := r.GetGitRecentRefs(-1, false, "")
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if ref.Type != GitRefTypeLocalTag || !r.pruneKeepTagMatches(ref.Name) {
+				continue
+			}
+			callback(PruneWorking, "")
+			r.Log.ConsoleDebugf("\r") // to reset any progress spinner but don't want \r in log
+			r.Log.Debugf("Retaining binaries in tag %v\n", ref.Name)
+			lobs, err := r.GetGitAllLOBsToCheckoutAtCommit(ref.CommitSHA, nil, nil)
+			if err != nil {
+				return fmt.Errorf("Error determining binaries in tag %v: %v", ref.Name, err.Error())
+			}
+			for _, l := range lobs {
+				retain(l)
+			}
+		}
+	}
+
+	if r.Options.PruneKeepVersions > 0 {
+		versions := make(map[string]util.StringSet)
+		err := r.walkGitAllLOBAdditions(func(commitLOB *CommitLOBRef) (quit bool, err error) {
+			callback(PruneWorking, "")
+			for _, filelob := range commitLOB.FileLOBs {
+				shas, ok := versions[filelob.Filename]
+				if !ok {
+					shas = util.NewStringSet()
+					versions[filelob.Filename] = shas
+				}
+				if shas.Cardinality() < r.Options.PruneKeepVersions && shas.Add(filelob.SHA) {
+					retain(filelob.SHA)
+				}
+			}
+			return false, nil
+		})
+		if err != nil {
+			return fmt.Errorf("Error determining latest versions of binaries: %v", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Whether a tag name matches any of git-lob.prune-keep-tags
+func (r *Repo) pruneKeepTagMatches(tag string) bool {
+	for _, pattern := range r.Options.PruneKeepTags {
+		if match, _ := filepath.Match(pattern, tag); match {
+			return true
+		}
+	}
+	return false
+}
+
+// Why a binary would be pruned, see PruneCandidate
+const (
+	// No reachable commit uses it
+	PruneReasonUnreferenced = "unreferenced"
+	// Only used by commits outside the retention period, which have been pushed
+	PruneReasonOutOfRange = "out of range"
+	// In the shared store, but no repo links to it any more
+	PruneReasonUnlinked = "unlinked"
+)
+
+// A binary which would be pruned, for reviewing before deleting it
+type PruneCandidate struct {
+	SHA string
+	// Size of the binary, 0 if unknown
+	Size int64
+	// Path of the binary in the latest commit which added it, blank if no commit did
+	Path string
+	// Reachable commits which added it, latest first
+	Commits []string
+	// Why it would be pruned, see PruneReason*
+	Reason string
+}
+
+type pruneCandidatesByPath []*PruneCandidate
+
+func (a pruneCandidatesByPath) Len() int      { return len(a) }
+func (a pruneCandidatesByPath) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a pruneCandidatesByPath) Less(i, j int) bool {
+	if a[i].Path != a[j].Path {
+		return a[i].Path < a[j].Path
+	}
+	return a[i].SHA < a[j].SHA
+}
+
+// Get the details of binaries which would be pruned from the local store (e.g. from a dry run),
+// in path order
+func (r *Repo) GetPruneCandidates(shas []string) ([]*PruneCandidate, error) {
+	return r.getPruneCandidates(shas, false)
+}
+
+// Get the details of binaries which would be pruned from the shared store (e.g. from a dry run
+// of PruneSharedStore), in path order. Commits are only found if this repo uses them
+func (r *Repo) GetSharedPruneCandidates(shas []string) ([]*PruneCandidate, error) {
+	return r.getPruneCandidates(shas, true)
+}
+
+func (r *Repo) getPruneCandidates(shas []string, shared bool) ([]*PruneCandidate, error) {
+	candidates := make(map[string]*PruneCandidate, len(shas))
+	for _, sha := range shas {
+		c := &PruneCandidate{SHA: sha}
+		var info *LOBInfo
+		var err error
+		if shared {
+			info, err = r.getLOBInfoInBaseDir(sha, r.GetSharedLOBRoot())
+		} else {
+			info, err = r.GetLOBInfo(sha)
+		}
+		if err == nil {
+			c.Size = info.Size
+		}
+		candidates[sha] = c
+	}
+	err := r.walkGitAllLOBAdditions(func(commitLOB *CommitLOBRef) (quit bool, err error) {
+		for _, filelob := range commitLOB.FileLOBs {
+			if c, ok := candidates[filelob.SHA]; ok {
+				if c.Path == "" {
+					c.Path = filelob.Filename
+				}
+				if len(c.Commits) == 0 || c.Commits[len(c.Commits)-1] != commitLOB.Commit {
+					c.Commits = append(c.Commits, commitLOB.Commit)
+				}
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*PruneCandidate, 0, len(candidates))
+	for _, c := range candidates {
+		switch {
+		case shared:
+			c.Reason = PruneReasonUnlinked
+		case len(c.Commits) > 0:
+			c.Reason = PruneReasonOutOfRange
+		default:
+			c.Reason = PruneReasonUnreferenced
+		}
+		ret = append(ret, c)
+	}
+	sort.Sort(pruneCandidatesByPath(ret))
+	return ret, nil
+}
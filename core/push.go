@@ -1,9 +1,11 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/util"
@@ -14,20 +16,96 @@ type PushCommitContentDetails struct {
 	CommitSHA  string      // the commit's SHA
 	Deltas     []*LOBDelta // delta uploads, items in here won't be in Files
 	Files      []string    // list of files we'll need to upload, relative path, if not doing deltas
+	ForceFiles []string    // files in Files to upload even if on the remote, because it has their LOB stored differently
 	BaseDir    string      // the base dir of the above files
 	FileBytes  int64       // total bytes for all files in the list
 	DeltaBytes int64       // total bytes for all deltas in the list
-	Incomplete bool        // File list is not complete because of missing local data, we shouldn't mark this commit as pushed
+	Incomplete bool        // File list is not complete because of missing local data or path filters, we shouldn't mark this commit as pushed
+	// Storage classes for files in Files which have one (lob-storage attribute), if the provider supports them
+	StorageClasses map[string]string
 }
 
-func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRefSpec, dryRun, force, recheck bool,
+func (r *Repo) Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRefSpec, dryRun, force, recheck bool,
 	callback util.ProgressCallback) error {
+	return r.push(provider, remoteName, refspecs, dryRun, force, recheck, nil, callback)
+}
+
+// Resume a push to a remote which was interrupted, from its push journal
+// The refspec which was in progress isn't recalculated, only files which weren't uploaded are
+// pushed; any refspecs after it are then pushed as usual. force is the same as the original push
+func (r *Repo) ResumePush(provider providers.SyncProvider, remoteName string, dryRun bool, callback util.ProgressCallback) error {
+	journal, err := r.readPushJournal(remoteName)
+	if err != nil {
+		return err
+	}
+	if journal == nil {
+		return fmt.Errorf("There is no interrupted push to %v to resume", remoteName)
+	}
+	var refspecs []*GitRefSpec
+	for _, spec := range journal.Refspecs {
+		refspecs = append(refspecs, ParseGitRefSpec(spec))
+	}
+	return r.push(provider, remoteName, refspecs, dryRun, journal.Force, false, journal, callback)
+}
+
+// Push, or resume a push if resume is not nil
+func (r *Repo) push(provider providers.SyncProvider, remoteName string, refspecs []*GitRefSpec, dryRun, force, recheck bool,
+	resume *pushJournal, callback util.ProgressCallback) (reterr error) {
 
-	util.LogDebugf("Pushing to %v via %v\n", remoteName, provider.TypeID())
+	r.Log.Debugf("Pushing to %v via %v\n", remoteName, provider.TypeID())
+	callback, recordUsage := r.trackTransferUsage(remoteName, true, util.CancellableProgressCallback(callback))
+	defer recordUsage()
 	smartProvider := providers.UpgradeToSmartSyncProvider(provider)
+	storageProvider := providers.UpgradeToStorageClassSyncProvider(provider)
+
+	// Record progress in case we're interrupted, & skip files an interrupted push already uploaded
+	var journal, prevJournal *pushJournal
+	if !dryRun {
+		if resume != nil {
+			journal = resume
+		} else {
+			var err error
+			prevJournal, err = r.readPushJournal(remoteName)
+			if err != nil {
+				r.Log.Debugf("Ignoring push journal: %v\n", err.Error())
+				prevJournal = nil
+			}
+			journal = r.newPushJournal(remoteName, refspecs, force)
+		}
+	}
+
+	// Commits marked as pushed for all refspecs are applied to the push state together
+	var pushState *PushStateTransaction
+	if !dryRun {
+		var err error
+		pushState, err = r.BeginPushStateTransaction(remoteName)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// Commits are only marked once all their binaries are on the remote, so what was
+			// marked is good even if the push failed part way through
+			err := pushState.Commit()
+			if err != nil && reterr == nil {
+				reterr = err
+			}
+			// now perform cleanup of the push state to ensure we simplify it
+			if pushState.marked > 1 {
+				r.CleanupPushState(remoteName)
+			}
+		}()
+	}
 
 	// for use when --force used
 	shasAlreadyQueued := util.NewStringSet()
+	// Binaries we don't have locally are checked for on the remote, in parallel where possible
+	remoteChecker := r.newRemoteLOBChecker(provider, remoteName, recheck, dryRun)
+
+	// When only some paths are pushed, commits can't be marked as pushed since that would mean
+	// binaries in the other paths were never pushed later (pushed state covers all ancestors too)
+	includePaths := r.Options.PushIncludePaths
+	excludePaths := r.Options.PushExcludePaths
+	filtered := len(includePaths) > 0 || len(excludePaths) > 0
 
 	for i, refspec := range refspecs {
 		// We now perform a complete push per refspec before proceeding to the nex
@@ -36,9 +114,9 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 		var refCommitsToPush []*PushCommitContentDetails
 		var anyIncomplete bool
 
-		if util.GlobalOptions.Verbose {
+		if r.Options.Verbose {
 			callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Calculating data to push for %v", refspec),
-				int64(i), int64(len(refspecs)), 0, 0})
+				int64(i), int64(len(refspecs)), 0, 0, nil})
 		}
 
 		var refFileSize, refDeltaSize int64
@@ -46,14 +124,26 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 
 		// First we walk the commits to push & build up a picture of size etc
 		walkFunc := func(commit *CommitLOBRef) (quit bool, err error) {
+			if util.IsCancelled() {
+				return true, util.ErrCancelled
+			}
 			var problemSHAs []string
 			var allfilenamesforcommit []string
+			var forcedfilenamesforcommit []string
 			var alldeltasforcommit []*LOBDelta
 			var commitFileSize int64
 			var commitDeltaSize int64
 			// Always use local LOB root since files are hardlinked there in shared case
-			basedir := GetLocalLOBRoot()
-			commitIncomplete := false
+			basedir := r.GetLocalLOBRoot()
+			commitIncomplete := filtered
+			var storageClasses map[string]string
+			if storageProvider != nil {
+				var err error
+				storageClasses, err = r.getStorageClassesForFileLOBs(commit.FileLOBs, basedir)
+				if err != nil {
+					return true, err
+				}
+			}
 			for _, filelob := range commit.FileLOBs {
 				var err error
 				filesMissing := false
@@ -67,7 +157,13 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 				}
 
 				// check size integrity but don't recalculate sha
-				filenames, filesize, err := GetLOBFilesForSHA(filelob.SHA, basedir, true, false)
+				filenames, info, err := r.getLOBFilesForSHA(filelob.SHA, basedir, true, false)
+				var filesize, storedsize int64
+				if info != nil {
+					// Deltas are calculated on content, but uploads are of the (possibly compressed) stored files
+					filesize = info.Size
+					storedsize = getLOBStoredSize(info)
+				}
 				if err != nil {
 					if IsNotFoundError(err) {
 						filesMissing = true
@@ -78,19 +174,35 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 				}
 				// Pre-check if we can/should do a delta
 				var delta *LOBDelta
-				if !filesMissing && smartProvider != nil && filesize > util.GlobalOptions.PushDeltasAboveSize {
+				if !filesMissing && smartProvider != nil &&
+					r.shouldTryDelta(filelob.Filename, filesize, storedsize, r.Options.PushDeltasAboveSize) {
 					// This will return nil if not possible
-					delta = preparePushDelta(filelob.SHA, filelob.Filename, smartProvider, remoteName, force)
+					delta = r.preparePushDelta(filelob.SHA, filelob.Filename, smartProvider, remoteName, force)
 				}
 
 				if delta != nil {
 					// We'll try this as a delta; if it fails later then we'll fall back on normal
 					alldeltasforcommit = append(alldeltasforcommit, delta)
 					commitDeltaSize += delta.DeltaSize + ApproximateMetadataSize
-					deltaSavings += filesize - (delta.DeltaSize + ApproximateMetadataSize)
+					deltaSavings += storedsize - (delta.DeltaSize + ApproximateMetadataSize)
+					r.recordDeltaSavings(filelob.Filename, storedsize, delta.DeltaSize)
 				} else {
-					allfilenamesforcommit = append(allfilenamesforcommit, filenames...)
-					commitFileSize += filesize
+					remoteStorage := remoteLOBStorageSame
+					if !filesMissing && !force {
+						remoteStorage = r.getRemoteLOBStorage(info, provider, remoteName)
+					}
+					switch remoteStorage {
+					case remoteLOBStorageDifferentComplete:
+						// Already there, just stored with other settings; ours mustn't be mixed in
+						r.Log.Debugf("%v is already on %v stored differently, not uploading\n", filelob.SHA, remoteName)
+					case remoteLOBStorageDifferentIncomplete:
+						allfilenamesforcommit = append(allfilenamesforcommit, filenames...)
+						forcedfilenamesforcommit = append(forcedfilenamesforcommit, filenames...)
+						commitFileSize += storedsize
+					default:
+						allfilenamesforcommit = append(allfilenamesforcommit, filenames...)
+						commitFileSize += storedsize
+					}
 				}
 				shasAlreadyQueued.Add(filelob.SHA)
 
@@ -105,14 +217,13 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 
 				// Check the remote for the presence of missing SHA data
 				remoteHasOurMissingSHAs := true
-				for _, sha := range problemSHAs {
-					remoteerr := CheckRemoteLOBFilesForSHA(sha, provider, remoteName)
-					if remoteerr != nil {
-						// Damn, missing
-						util.LogDebug(fmt.Sprintf("Commit %v locally missing %v, not on remote: %v", commit.Commit[:7], sha, remoteerr.Error()))
-						remoteHasOurMissingSHAs = false
-						break
-					}
+				remoteerr := remoteChecker.CheckAll(problemSHAs)
+				if remoteerr == util.ErrCancelled {
+					return true, remoteerr
+				} else if remoteerr != nil {
+					// Damn, missing
+					r.Log.Debug(fmt.Sprintf("Commit %v locally missing content, not on remote: %v", commit.Commit[:7], remoteerr.Error()))
+					remoteHasOurMissingSHAs = false
 				}
 
 				if !remoteHasOurMissingSHAs {
@@ -121,22 +232,24 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 					// push everything we can
 					commitIncomplete = true
 					anyIncomplete = true
-					util.LogDebug(fmt.Sprintf("Some content for commit %v is missing & not on remote already", commit.Commit[:7]))
+					r.Log.Debug(fmt.Sprintf("Some content for commit %v is missing & not on remote already", commit.Commit[:7]))
 					callback(&util.ProgressCallbackData{util.ProgressNotFound, fmt.Sprintf("data for commit %v", commit.Commit[:7]),
-						int64(i + 1), int64(len(refspecs)), 0, 0})
+						int64(i + 1), int64(len(refspecs)), 0, 0, nil})
 				}
 				// If we DID manage to find the missing data on the remote though, we treat this as
 				// being able to push everything
 			}
 
 			refCommitsToPush = append(refCommitsToPush, &PushCommitContentDetails{
-				CommitSHA:  commit.Commit,
-				Files:      allfilenamesforcommit,
-				BaseDir:    basedir,
-				FileBytes:  commitFileSize,
-				DeltaBytes: commitDeltaSize,
-				Incomplete: commitIncomplete,
-				Deltas:     alldeltasforcommit,
+				CommitSHA:      commit.Commit,
+				Files:          allfilenamesforcommit,
+				ForceFiles:     forcedfilenamesforcommit,
+				BaseDir:        basedir,
+				FileBytes:      commitFileSize,
+				DeltaBytes:     commitDeltaSize,
+				Incomplete:     commitIncomplete,
+				Deltas:         alldeltasforcommit,
+				StorageClasses: storageClasses,
 			})
 
 			refDeltaSize += commitDeltaSize
@@ -145,7 +258,20 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 			return false, nil
 		}
 
-		err := WalkGitCommitLOBsToPushForRefSpec(remoteName, refspec, recheck, walkFunc)
+		// When resuming, the refspec in progress was calculated already
+		resumed := resume != nil && i == 0 && len(resume.Commits) > 0
+		var err error
+		if resumed {
+			callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * %v: Resuming interrupted push", refspec),
+				int64(i), int64(len(refspecs)), 0, 0, nil})
+			refCommitsToPush = resume.remainingCommits()
+			for _, commit := range refCommitsToPush {
+				refFileSize += commit.FileBytes
+				anyIncomplete = anyIncomplete || commit.Incomplete
+			}
+		} else {
+			err = r.WalkGitCommitLOBsToPushForRefSpec(remoteName, refspec, recheck, includePaths, excludePaths, walkFunc)
+		}
 		// defer delete any delta files we created so we always clean up
 		for _, commit := range refCommitsToPush {
 			for _, delta := range commit.Deltas {
@@ -162,15 +288,16 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 
 		if len(refCommitsToPush) == 0 {
 			callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * %v: Nothing to push", refspec),
-				int64(i), int64(len(refspecs)), 0, 0})
+				int64(i), int64(len(refspecs)), 0, 0, nil})
 			// if nothing to push, then mark this ref as pushed to make querying faster next time
 			// Only for normal ref where we've checked for all ancestors to be pushed, not a manual range
-			if !dryRun && !refspec.IsRange() {
-				commitSHA, err := GitRefToFullSHA(refspec.Ref1)
+			// nor when resuming, since commits in the journal may have been incomplete, nor when filtering paths
+			if !dryRun && !refspec.IsRange() && !resumed && !filtered {
+				commitSHA, err := r.GitRefToFullSHA(refspec.Ref1)
 				if err != nil {
 					return err
 				}
-				err = MarkBinariesAsPushed(remoteName, commitSHA, "")
+				err = pushState.MarkBinariesAsPushed(commitSHA, "")
 				if err != nil {
 					return err
 				}
@@ -184,19 +311,19 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 					forcenotforcemsg = "forced upload"
 				}
 				callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * %v: %d commits with %v to push (%v)",
-					refspec, len(refCommitsToPush), util.FormatSize(refCommitsSize), forcenotforcemsg), int64(i + 1), int64(len(refspecs)), 0, 0})
+					refspec, len(refCommitsToPush), util.FormatSize(refCommitsSize), forcenotforcemsg), int64(i + 1), int64(len(refspecs)), 0, 0, nil})
 				if deltaSavings > 0 {
 					callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("   Saving %v by using binary deltas",
-						util.FormatSize(deltaSavings)), int64(i + 1), int64(len(refspecs)), 0, 0})
+						util.FormatSize(deltaSavings)), int64(i + 1), int64(len(refspecs)), 0, 0, nil})
 				}
 			} else {
 				callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf(" * %v: Nothing to push, remote is up to date", refspec),
-					int64(i + 1), int64(len(refspecs)), 0, 0})
+					int64(i + 1), int64(len(refspecs)), 0, 0, nil})
 			}
 		}
-		if util.GlobalOptions.Verbose {
+		if r.Options.Verbose {
 			callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Finished calculating data to push for %v", refspec),
-				int64(i + 1), int64(len(refspecs)), 0, 0})
+				int64(i + 1), int64(len(refspecs)), 0, 0, nil})
 		}
 
 		if !dryRun && len(refCommitsToPush) > 0 {
@@ -204,27 +331,42 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 			if refCommitsSize > 0 {
 				callback(&util.ProgressCallbackData{util.ProgressCalculate,
 					fmt.Sprintf("Uploading up to %v to %v via %v", util.FormatSize(refCommitsSize), remoteName, provider.TypeID()),
-					0, 0, 0, 0})
+					0, 0, 0, 0, nil})
+			}
+
+			if !resumed {
+				journal.startRefSpec(refCommitsToPush, prevJournal)
 			}
 
 			var bytesDoneSoFar int64
-			previousCommitIncomplete := false
+			// Commits finished before an interruption count too
+			previousCommitIncomplete := resumed && resume.anyDoneIncomplete()
 			previousCommitSHA := ""
-			basedir := GetLocalLOBRoot()
+			basedir := r.GetLocalLOBRoot()
 			for _, commit := range refCommitsToPush {
+				// Commits before this one were marked as pushed & the journal has the files uploaded
+				// so far, so stopping here loses nothing
+				if util.IsCancelled() {
+					return util.ErrCancelled
+				}
 
 				// Push this one
 				// Firstly, do any deltas (may be some deltas and some not in one commit)
 				if smartProvider != nil && len(commit.Deltas) > 0 {
 					// add any failed deltas back to the regular file-based upload for the next step
-					faileddeltas := pushCommitDeltas(commit, smartProvider, remoteName, force, bytesDoneSoFar, refCommitsSize, callback)
+					faileddeltas := r.pushCommitDeltas(commit, smartProvider, remoteName, force, bytesDoneSoFar, refCommitsSize, journal, callback)
+					if util.IsCancelled() {
+						// Deltas which didn't make it failed because of that, don't upload them in full
+						return util.ErrCancelled
+					}
 					for _, delta := range faileddeltas {
 						// Add the files for failed deltas to the standard route
-						filenames, filesize, err := GetLOBFilesForSHA(delta.TargetSHA, basedir, true, false)
+						filenames, info, err := r.getLOBFilesForSHA(delta.TargetSHA, basedir, true, false)
 						if err != nil {
 							// We already checked local files were there earlier so this is fatal
 							return fmt.Errorf("Error while trying to fall back from delta to standard push: %v", err)
 						}
+						filesize := getLOBStoredSize(info)
 						commit.Files = append(commit.Files, filenames...)
 						// Just add the filesize on, don't subtract the delta size since we'll mark that as done
 						commit.FileBytes += filesize
@@ -235,7 +377,7 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 				}
 				bytesDoneSoFar += commit.DeltaBytes
 				// Then, do any regular file-based uploads (and also any delta fallbacks)
-				err := pushCommitStandard(commit, provider, remoteName, force, bytesDoneSoFar, refCommitsSize, callback)
+				err := r.pushCommitStandard(commit, provider, remoteName, force, bytesDoneSoFar, refCommitsSize, journal, callback)
 				if err != nil {
 					// stop at commit we can't push
 					return err
@@ -243,6 +385,15 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 				// in the case of a failed delta & fallback we would have uploaded more bytes but gloss over this
 				bytesDoneSoFar += commit.FileBytes
 
+				// Read back what we pushed if asked, never mark as pushed if the remote doesn't have it right
+				if r.Options.PushVerify != PushVerifyNone {
+					err = r.verifyPushedCommit(commit, provider, remoteName, r.Options.PushVerify, callback)
+					if err != nil {
+						journal.forgetUploaded(commit.CommitSHA)
+						return err
+					}
+				}
+
 				// Otherwise mark commit as pushed IF complete
 				if commit.Incomplete {
 					previousCommitIncomplete = true
@@ -264,7 +415,7 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 					// one pushed SHA per ref, before consolidation
 					replaceSHA := ""
 					if previousCommitSHA != "" {
-						isancestor, err := GitIsAncestor(previousCommitSHA, commit.CommitSHA)
+						isancestor, err := r.GitIsAncestor(previousCommitSHA, commit.CommitSHA)
 						if err != nil {
 							return err
 						}
@@ -273,52 +424,75 @@ func Push(provider providers.SyncProvider, remoteName string, refspecs []*GitRef
 						}
 					}
 					// This writes data to disk every time and that's fine, for robustness & interruptability
-					err = MarkBinariesAsPushed(remoteName, commit.CommitSHA, replaceSHA)
+					err = pushState.MarkBinariesAsPushed(commit.CommitSHA, replaceSHA)
 					if err != nil {
 						// Stop at commit we can't mark, order is important
 						return err
 					}
 					previousCommitSHA = commit.CommitSHA
 				}
+				journal.markDone(commit.CommitSHA)
 			}
-			// now perform cleanup of the push state to ensure we simplify it
-			// do this per ref so that subsequent refs have a simpler git log call
-			CleanupPushState(remoteName)
 		}
+		journal.finishRefSpec()
 
 		if anyIncomplete {
-			util.LogDebugf("Partial push to %v for %v\n", remoteName, refspec)
+			r.Log.Debugf("Partial push to %v for %v\n", remoteName, refspec)
 		} else {
-			util.LogDebugf("Successfully pushed to %v for %v\n", remoteName, refspec)
+			r.Log.Debugf("Successfully pushed to %v for %v\n", remoteName, refspec)
 		}
 	}
+	// Previews are only a convenience, so they go last
+	if !dryRun && shasAlreadyQueued.Cardinality() > 0 {
+		shas := make([]string, 0, shasAlreadyQueued.Cardinality())
+		for sha := range shasAlreadyQueued.Iter() {
+			shas = append(shas, sha)
+		}
+		r.pushLOBPreviews(shas, provider, remoteName, force, callback)
+	}
 	return nil
 
 }
 
 // Push deltas in a commit & report those which didn't make it
-func pushCommitDeltas(commit *PushCommitContentDetails, provider providers.SmartSyncProvider, remoteName string,
-	force bool, bytesDoneSoFar, refDeltaBytes int64, callback util.ProgressCallback) []*LOBDelta {
+// Deltas whose files the journal says were uploaded already are skipped, & successful ones are recorded
+func (r *Repo) pushCommitDeltas(commit *PushCommitContentDetails, provider providers.SmartSyncProvider, remoteName string,
+	force bool, bytesDoneSoFar, refDeltaBytes int64, journal *pushJournal, callback util.ProgressCallback) []*LOBDelta {
 
 	// First add up the sizes
 	var faileddeltas []*LOBDelta
 
 	for _, delta := range commit.Deltas {
+		targetfiles, _, _ := r.getLOBFilesForSHA(delta.TargetSHA, r.GetLocalLOBRoot(), false, false)
+		alreadyUploaded := len(targetfiles) > 0
+		for _, file := range targetfiles {
+			alreadyUploaded = alreadyUploaded && journal.isUploaded(commit.CommitSHA, file)
+		}
+		if alreadyUploaded {
+			bytesDoneSoFar += ApproximateMetadataSize + delta.DeltaSize
+			callback(&util.ProgressCallbackData{util.ProgressSkip, getDeltaProgressDesc(delta), delta.DeltaSize, delta.DeltaSize,
+				bytesDoneSoFar, refDeltaBytes, nil})
+			continue
+		}
 		// Push metadata for this individually
 		metacallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
 			// Don't bother to track partial completion, only small
-			if progressType == util.ProgressSkip || progressType == util.ProgressNotFound {
+			if progressType == util.ProgressRetry {
+				return callback(&util.ProgressCallbackData{progressType, fileInProgress, 0, 0,
+					bytesDoneSoFar, refDeltaBytes,
+					retryDetail(bytesDone, totalBytes)})
+			} else if progressType == util.ProgressSkip || progressType == util.ProgressNotFound {
 				return callback(&util.ProgressCallbackData{progressType, fileInProgress, totalBytes, totalBytes,
-					bytesDoneSoFar + ApproximateMetadataSize, refDeltaBytes})
+					bytesDoneSoFar + ApproximateMetadataSize, refDeltaBytes, nil})
 				// Remote did not have this file
 			} else {
 				return callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, bytesDone, totalBytes,
-					bytesDoneSoFar + bytesDone, refDeltaBytes})
+					bytesDoneSoFar + bytesDone, refDeltaBytes, nil})
 			}
 			return false
 		}
 		metafile := GetLOBMetaRelativePath(delta.TargetSHA)
-		err := provider.Upload(remoteName, []string{metafile}, GetLocalLOBRoot(), force, metacallback)
+		err := provider.Upload(remoteName, []string{metafile}, r.GetLocalLOBRoot(), force, metacallback)
 		if err != nil {
 			faileddeltas = append(faileddeltas, delta)
 			continue
@@ -331,7 +505,7 @@ func pushCommitDeltas(commit *PushCommitContentDetails, provider providers.Smart
 				completionSeen = true
 			}
 			return callback(&util.ProgressCallbackData{util.ProgressTransferBytes, getDeltaProgressDesc(delta), bytesDone, totalBytes,
-				bytesDoneSoFar + bytesDone, refDeltaBytes})
+				bytesDoneSoFar + bytesDone, refDeltaBytes, nil})
 		}
 		in, err := os.OpenFile(delta.DeltaFilename, os.O_RDONLY, 0644)
 		if err != nil {
@@ -345,43 +519,58 @@ func pushCommitDeltas(commit *PushCommitContentDetails, provider providers.Smart
 		if err != nil {
 			faileddeltas = append(faileddeltas, delta)
 			callback(&util.ProgressCallbackData{util.ProgressError, getDeltaProgressDesc(delta), delta.DeltaSize, delta.DeltaSize,
-				bytesDoneSoFar, refDeltaBytes})
+				bytesDoneSoFar, refDeltaBytes, nil})
 			continue
 		}
 		if !completionSeen {
 			// Do a final callback to make sure 100% is there
 			callback(&util.ProgressCallbackData{util.ProgressTransferBytes, getDeltaProgressDesc(delta), delta.DeltaSize, delta.DeltaSize,
-				bytesDoneSoFar, refDeltaBytes})
+				bytesDoneSoFar, refDeltaBytes, nil})
+		}
+		for _, file := range targetfiles {
+			journal.markUploaded(commit.CommitSHA, file)
 		}
 	}
 	return faileddeltas
 }
 
 // Push a single commit using the standard approach
-func pushCommitStandard(commit *PushCommitContentDetails, provider providers.SyncProvider, remoteName string,
-	force bool, bytesDoneSoFar, refCommitsSize int64, callback util.ProgressCallback) error {
+// Files the journal says were uploaded already are skipped, & others are recorded a batch at a time
+func (r *Repo) pushCommitStandard(commit *PushCommitContentDetails, provider providers.SyncProvider, remoteName string,
+	force bool, bytesDoneSoFar, refCommitsSize int64, journal *pushJournal, callback util.ProgressCallback) error {
 	// Upload now
 	var lastFilename string
 	var lastFileBytes int64
+	var aborted bool
 	localcallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+		if progressType == util.ProgressRetry {
+			// File is being uploaded again from the start, so partial progress doesn't count
+			if lastFilename == fileInProgress {
+				lastFilename = ""
+			}
+			aborted = callback(&util.ProgressCallbackData{progressType, fileInProgress, 0, 0,
+				bytesDoneSoFar, refCommitsSize,
+				retryDetail(bytesDone, totalBytes)})
+			return aborted
+		}
 		if lastFilename != fileInProgress {
 			// New file, always callback
 			if lastFilename != "" {
 				// we obviously never got a 100% call for previous file
 				bytesDoneSoFar += lastFileBytes
 				callback(&util.ProgressCallbackData{util.ProgressTransferBytes, lastFilename, lastFileBytes, lastFileBytes,
-					bytesDoneSoFar, refCommitsSize})
+					bytesDoneSoFar, refCommitsSize, nil})
 				lastFilename = ""
 			}
 			if progressType == util.ProgressSkip || progressType == util.ProgressNotFound {
 				// 'not found' will have caused an error earlier anyway so just pass through
 				bytesDoneSoFar += totalBytes
 				callback(&util.ProgressCallbackData{progressType, fileInProgress, totalBytes, totalBytes,
-					bytesDoneSoFar, refCommitsSize})
+					bytesDoneSoFar, refCommitsSize, nil})
 			} else {
 				// Start new file
 				callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, bytesDone, totalBytes,
-					bytesDoneSoFar + bytesDone, refCommitsSize})
+					bytesDoneSoFar + bytesDone, refCommitsSize, nil})
 				lastFilename = fileInProgress
 				lastFileBytes = totalBytes
 			}
@@ -390,36 +579,88 @@ func pushCommitStandard(commit *PushCommitContentDetails, provider providers.Syn
 				// finished
 				bytesDoneSoFar += totalBytes
 				callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, bytesDone, totalBytes,
-					bytesDoneSoFar, refCommitsSize})
+					bytesDoneSoFar, refCommitsSize, nil})
 				lastFilename = ""
 			} else {
 				// Otherwise this is a progress callback
-				return callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, bytesDone, totalBytes,
-					bytesDoneSoFar + bytesDone, refCommitsSize})
+				aborted = callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, bytesDone, totalBytes,
+					bytesDoneSoFar + bytesDone, refCommitsSize, nil})
+				return aborted
 			}
 		}
-		return false
+		// Stop between files too, small files never get a progress callback
+		aborted = util.IsCancelled()
+		return aborted
 	}
+	var files []string
+	for _, file := range commit.Files {
+		if journal.isUploaded(commit.CommitSHA, file) {
+			var size int64
+			if s, err := os.Stat(getLOBStoreFilePath(commit.BaseDir, file)); err == nil {
+				size = s.Size()
+			}
+			localcallback(file, util.ProgressSkip, size, size)
+		} else {
+			files = append(files, file)
+		}
+	}
+	forceFiles := util.NewStringSetFromSlice(commit.ForceFiles)
 	// It IS possible to have a commit here with no files to upload. E.g. missing data locally (see above)
 	// which was present on remote. We still include it in the commit list for completeness
-	if len(commit.Files) > 0 {
-		err := provider.Upload(remoteName, commit.Files, commit.BaseDir, force, localcallback)
-		if err != nil {
-			return err
+	var normalFiles, forcedFiles []string
+	for _, file := range files {
+		if force || forceFiles.Contains(file) {
+			forcedFiles = append(forcedFiles, file)
+		} else {
+			normalFiles = append(normalFiles, file)
+		}
+	}
+	// With a journal, upload in batches so it can record each batch which definitely made it
+	batchSize := len(files)
+	if journal != nil {
+		batchSize = pushJournalBatchSize
+	}
+	var errs []string
+	for _, group := range []struct {
+		files  []string
+		forced bool
+	}{{normalFiles, false}, {forcedFiles, true}} {
+		for start := 0; start < len(group.files); start += batchSize {
+			end := start + batchSize
+			if end > len(group.files) {
+				end = len(group.files)
+			}
+			batch := group.files[start:end]
+			err := uploadWithStorageClasses(provider, remoteName, batch, commit.BaseDir, group.forced, commit.StorageClasses, localcallback)
+			if aborted {
+				if util.IsCancelled() {
+					return util.ErrCancelled
+				}
+				return fmt.Errorf("Push to %v was aborted", remoteName)
+			}
+			if err != nil {
+				// Which files failed isn't known, so none of the batch is recorded
+				errs = append(errs, err.Error())
+				continue
+			}
+			journal.markUploaded(commit.CommitSHA, batch...)
 		}
 	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
 	if lastFilename != "" {
 		// We obviously never got a 100% progress update from the last file
 		bytesDoneSoFar += lastFileBytes
 		callback(&util.ProgressCallbackData{util.ProgressTransferBytes, lastFilename, lastFileBytes, lastFileBytes,
-			bytesDoneSoFar, refCommitsSize})
+			bytesDoneSoFar, refCommitsSize, nil})
 		lastFilename = ""
 	}
 	return nil
 
 }
 
-func preparePushDelta(lobsha, filename string, provider providers.SmartSyncProvider, remoteName string, force bool) *LOBDelta {
+func (r *Repo) preparePushDelta(lobsha, filename string, provider providers.SmartSyncProvider, remoteName string, force bool) *LOBDelta {
 	// Don't bother to try to generate a delta if lob is already on remote & not force; will be skipped in regular upload
 	if !force {
 		exists, _ := provider.LOBExists(remoteName, lobsha)
@@ -428,16 +669,16 @@ func preparePushDelta(lobsha, filename string, provider providers.SmartSyncProvi
 		}
 	}
 
-	othershas, err := GetGitAllLOBHistoryForFile(filename, lobsha)
+	othershas, err := r.GetGitAllLOBHistoryForFile(filename, lobsha)
 	if err != nil {
-		util.LogErrorf("Unable to prepare delta for %v(%v): %v\n", lobsha, filename, err.Error())
+		r.Log.Errorf("Unable to prepare delta for %v(%v): %v\n", lobsha, filename, err.Error())
 		return nil
 	}
 	// This is all the possible base shas, but we can only use ones we have locally too
 	// Right now we're not trying to cope with ordered downloads where we might have newer ones part way through fetch (too fiddly)
 	var localbaseshas []string
 	for _, sha := range othershas {
-		if !IsLOBMissing(sha, false) {
+		if !r.IsLOBMissing(sha, false) {
 			localbaseshas = append(localbaseshas, sha)
 		}
 	}
@@ -445,10 +686,15 @@ func preparePushDelta(lobsha, filename string, provider providers.SmartSyncProvi
 		// no base shas, cannot do this
 		return nil
 	}
+	algorithm, err := getDeltaAlgorithmForRemote(provider, remoteName)
+	if err != nil {
+		r.Log.Errorf("Unable to prepare delta for %v(%v): %v\n", lobsha, filename, err.Error())
+		return nil
+	}
 	// Now ask the server to pick a sha
 	chosenbasesha, err := provider.GetFirstCompleteLOBFromList(remoteName, localbaseshas)
 	if err != nil {
-		util.LogErrorf("Unable to get common base for delta %v(%v): %v\n", lobsha, filename, err.Error())
+		r.Log.Errorf("Unable to get common base for delta %v(%v): %v\n", lobsha, filename, err.Error())
 		return nil
 	}
 	// No common base to use
@@ -458,14 +704,14 @@ func preparePushDelta(lobsha, filename string, provider providers.SmartSyncProvi
 	// Now we calculate the delta locally
 	tempf, err := ioutil.TempFile("", "uploaddelta")
 	if err != nil {
-		util.LogErrorf("Unable to open temp file for delta %v(%v): %v\n", lobsha, filename, err.Error())
+		r.Log.Errorf("Unable to open temp file for delta %v(%v): %v\n", lobsha, filename, err.Error())
 		return nil
 	}
 	defer tempf.Close()
 	tempfilename := tempf.Name()
-	sz, err := GenerateLOBDelta(chosenbasesha, lobsha, tempf)
+	sz, err := r.GenerateLOBDeltaWithAlgorithm(algorithm, chosenbasesha, lobsha, tempf)
 	if err != nil {
-		util.LogErrorf("Error calculating delta %v(%v): %v\n", lobsha, filename, err.Error())
+		r.Log.Errorf("Error calculating delta %v(%v): %v\n", lobsha, filename, err.Error())
 		tempf.Close() // have to close before remove & defer is in wrong order
 		os.Remove(tempfilename)
 		return nil
@@ -475,40 +721,121 @@ func preparePushDelta(lobsha, filename string, provider providers.SmartSyncProvi
 		TargetSHA:     lobsha,
 		DeltaSize:     sz,
 		DeltaFilename: tempfilename,
+		Algorithm:     algorithm,
+	}
+}
+
+// Try to push a single LOB as a delta, using a filename it was committed as to find base versions
+// Returns false if it wasn't worth trying or the delta failed, so it should be uploaded in full
+func (r *Repo) pushSingleDelta(info *LOBInfo, filename string, provider providers.SmartSyncProvider, remoteName string, force bool,
+	callback util.ProgressCallback) bool {
+	storedsize := getLOBStoredSize(info)
+	if filename == "" || !r.shouldTryDelta(filename, info.Size, storedsize, r.Options.PushDeltasAboveSize) {
+		return false
 	}
+	delta := r.preparePushDelta(info.SHA, filename, provider, remoteName, force)
+	if delta == nil {
+		return false
+	}
+	defer os.Remove(delta.DeltaFilename)
+	r.recordDeltaSavings(filename, storedsize, delta.DeltaSize)
+	commit := &PushCommitContentDetails{Deltas: []*LOBDelta{delta}}
+	faileddeltas := r.pushCommitDeltas(commit, provider, remoteName, force, 0, ApproximateMetadataSize+delta.DeltaSize, nil, callback)
+	return len(faileddeltas) == 0
 }
 
 // Push a single LOB to a remote
-func PushSingle(sha string, provider providers.SyncProvider, remoteName string, force bool,
+func (r *Repo) PushSingle(sha string, provider providers.SyncProvider, remoteName string, force bool,
+	callback util.ProgressCallback) error {
+	return r.PushMultiple([]string{sha}, nil, provider, remoteName, force, callback)
+}
+
+// Push a list of LOBs to a remote, stopping at the first error
+// The filenames they were committed as, to find delta bases & storage classes, are looked up in
+// one walk of history from refs (or from all heads if refs is empty) for the whole list
+func (r *Repo) PushMultiple(shas, refs []string, provider providers.SyncProvider, remoteName string, force bool,
+	callback util.ProgressCallback) error {
+	callback, recordUsage := r.trackTransferUsage(remoteName, true, callback)
+	defer recordUsage()
+	filenames := r.getLOBFilenamesForPush(shas, refs, provider)
+	for _, sha := range shas {
+		if err := r.pushSingle(sha, filenames[sha], provider, remoteName, force, callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find the filenames LOBs were committed as, if provider can make use of them
+// LOBs whose filename isn't needed or can't be found are left out, & are pushed without one
+func (r *Repo) getLOBFilenamesForPush(shas, refs []string, provider providers.SyncProvider) map[string]string {
+	if providers.UpgradeToSmartSyncProvider(provider) == nil && providers.UpgradeToStorageClassSyncProvider(provider) == nil {
+		return nil
+	}
+	filenames, err := r.GetGitFilenamesForLOBs(shas, refs)
+	if err != nil {
+		r.Log.Errorf("%v\n", err.Error())
+	}
+	return filenames
+}
+
+// Push a single LOB to a remote, filename being one it was committed as, or blank if not known
+func (r *Repo) pushSingle(sha, filename string, provider providers.SyncProvider, remoteName string, force bool,
 	callback util.ProgressCallback) error {
-	basedir := GetLocalLOBRoot()
-	filenames, totalSize, err := GetLOBFilesForSHA(basedir, sha, true, false)
+	basedir := r.GetLocalLOBRoot()
+	filenames, info, err := r.getLOBFilesForSHA(sha, basedir, true, false)
 	if err != nil {
 		return err
 	}
+	totalSize := getLOBStoredSize(info)
+	if !force {
+		switch r.getRemoteLOBStorage(info, provider, remoteName) {
+		case remoteLOBStorageDifferentComplete:
+			// Already there, just stored with other settings; ours mustn't be mixed in
+			callback(&util.ProgressCallbackData{util.ProgressSkip, sha, totalSize, totalSize, totalSize, totalSize, nil})
+			return nil
+		case remoteLOBStorageDifferentIncomplete:
+			force = true
+		}
+	}
+	// Upload a delta against a version the remote already has instead, if worthwhile
+	if smartProvider := providers.UpgradeToSmartSyncProvider(provider); smartProvider != nil {
+		if r.pushSingleDelta(info, filename, smartProvider, remoteName, force, callback) {
+			return nil
+		}
+	}
 
 	var lastFilename string
 	var lastFileBytes int64
 	var bytesFromFilesDoneSoFar int64
 	localcallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+		if progressType == util.ProgressRetry {
+			// File is being uploaded again from the start, so partial progress doesn't count
+			if lastFilename == fileInProgress {
+				lastFilename = ""
+			}
+			return callback(&util.ProgressCallbackData{progressType, fileInProgress, 0, 0,
+				bytesFromFilesDoneSoFar, totalSize,
+				retryDetail(bytesDone, totalBytes)})
+		}
 		if lastFilename != fileInProgress {
 			// New file, always callback
 			if lastFilename != "" {
 				// we obviously never got a 100% call for previous file
 				bytesFromFilesDoneSoFar += lastFileBytes
 				callback(&util.ProgressCallbackData{util.ProgressTransferBytes, lastFilename, lastFileBytes, lastFileBytes,
-					bytesFromFilesDoneSoFar, totalSize})
+					bytesFromFilesDoneSoFar, totalSize, nil})
 				lastFilename = ""
 			}
 			if progressType == util.ProgressSkip || progressType == util.ProgressNotFound {
 				// 'not found' will have caused an error earlier anyway so just pass through
 				bytesFromFilesDoneSoFar += totalBytes
 				callback(&util.ProgressCallbackData{progressType, fileInProgress, totalBytes, totalBytes,
-					bytesFromFilesDoneSoFar, totalSize})
+					bytesFromFilesDoneSoFar, totalSize, nil})
 			} else {
 				// Start new file
 				callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, bytesDone, totalBytes,
-					bytesFromFilesDoneSoFar + bytesDone, totalSize})
+					bytesFromFilesDoneSoFar + bytesDone, totalSize, nil})
 				lastFilename = fileInProgress
 				lastFileBytes = totalBytes
 			}
@@ -517,16 +844,23 @@ func PushSingle(sha string, provider providers.SyncProvider, remoteName string,
 				// finished
 				bytesFromFilesDoneSoFar += totalBytes
 				callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, bytesDone, totalBytes,
-					bytesFromFilesDoneSoFar, totalSize})
+					bytesFromFilesDoneSoFar, totalSize, nil})
 				lastFilename = ""
 			} else {
 				// Otherwise this is a progress callback
 				return callback(&util.ProgressCallbackData{util.ProgressTransferBytes, fileInProgress, bytesDone, totalBytes,
-					bytesFromFilesDoneSoFar + bytesDone, totalSize})
+					bytesFromFilesDoneSoFar + bytesDone, totalSize, nil})
 			}
 		}
 		return false
 	}
 
-	return provider.Upload(remoteName, filenames, basedir, force, localcallback)
+	var storageClasses map[string]string
+	if filename != "" && providers.UpgradeToStorageClassSyncProvider(provider) != nil {
+		storageClasses, err = r.getStorageClassesForFileLOBs([]*FileLOB{{Filename: filename, SHA: sha}}, basedir)
+		if err != nil {
+			return err
+		}
+	}
+	return uploadWithStorageClasses(provider, remoteName, filenames, basedir, force, storageClasses, localcallback)
 }
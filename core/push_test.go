@@ -145,7 +145,7 @@ var _ = Describe("Push", func() {
 	})
 
 	It("Pushes correctly (Basic)", func() {
-		originprovider, err := GetProviderForRemote("origin")
+		originprovider, err := testRepo().GetProvider("origin")
 		Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
 
 		var filesTransferred int
@@ -167,11 +167,11 @@ var _ = Describe("Push", func() {
 			}
 			return false
 		}
-		Expect(HasPushedBinaryState("origin")).To(BeFalse(), "Should not have pushed state for origin")
-		Expect(HasPushedBinaryState("fork")).To(BeFalse(), "Should not have pushed state for fork")
+		Expect(testRepo().HasPushedBinaryState("origin")).To(BeFalse(), "Should not have pushed state for origin")
+		Expect(testRepo().HasPushedBinaryState("fork")).To(BeFalse(), "Should not have pushed state for fork")
 
 		// Start by pushing up to Tag1 so that we push only first 2 commits on master
-		err = Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "Tag1"}}, false, false, false, callback)
+		err = testRepo().Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "Tag1"}}, false, false, false, callback)
 		Expect(err).To(BeNil(), "Push should succeed")
 		// Files should equal 2 for each entry (meta + one chunk)
 		expectedFileCount := (len(masterfilespercommit[0]) + len(masterfilespercommit[1])) * 2
@@ -181,12 +181,12 @@ var _ = Describe("Push", func() {
 		Expect(commitsNotFound).To(BeEquivalentTo(0), "No files should be not found")
 
 		// Should now have pushed state
-		Expect(HasPushedBinaryState("origin")).To(BeTrue(), "Should have pushed state for origin")
+		Expect(testRepo().HasPushedBinaryState("origin")).To(BeTrue(), "Should have pushed state for origin")
 		// Check it's at position expected
-		mastersha, _ := GitRefToFullSHA("master")
-		pushedSHA, err := FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		mastersha, _ := testRepo().GitRefToFullSHA("master")
+		pushedSHA, err := testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
 		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
-		tag1sha, _ := GitRefToFullSHA("Tag1")
+		tag1sha, _ := testRepo().GitRefToFullSHA("Tag1")
 		Expect(pushedSHA).To(Equal(tag1sha), "Pushed marker should be at Tag1")
 
 		// Confirm data exists on remote
@@ -195,7 +195,7 @@ var _ = Describe("Push", func() {
 
 		// Now push all of master, should skip previous & upload new
 		filesTransferred = 0
-		err = Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
+		err = testRepo().Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
 		Expect(err).To(BeNil(), "Push should succeed")
 		// Files should equal 2 for each entry (meta + one chunk)
 		expectedFileCount = len(masterfilespercommit[2]) * 2
@@ -206,14 +206,14 @@ var _ = Describe("Push", func() {
 		// Confirm data exists on remote
 		CheckLOBsExistForTest(mastershaspercommit[2], originBinStore)
 
-		pushedSHA, err = FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
 		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
 		Expect(pushedSHA).To(Equal(mastersha), "Pushed marker should be at master")
 
 		// Now push a different branch
 		// Now push all of master, should skip previous & upload new
 		filesTransferred = 0
-		err = Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "branch2"}}, false, false, false, callback)
+		err = testRepo().Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "branch2"}}, false, false, false, callback)
 		Expect(err).To(BeNil(), "Push should succeed")
 		// Files should equal 2 for each entry (meta + one chunk)
 		expectedFileCount = (len(branch2filespercommit[0]) + len(branch2filespercommit[1])) * 2
@@ -225,18 +225,18 @@ var _ = Describe("Push", func() {
 		CheckLOBsExistForTest(branch2shaspercommit[0], originBinStore)
 		CheckLOBsExistForTest(branch2shaspercommit[1], originBinStore)
 
-		branch2sha, _ := GitRefToFullSHA("branch2")
-		pushedSHA, err = FindLatestAncestorWhereBinariesPushed("origin", branch2sha)
+		branch2sha, _ := testRepo().GitRefToFullSHA("branch2")
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", branch2sha)
 		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
 		Expect(pushedSHA).To(Equal(branch2sha), "Pushed marker should be at branch2")
 
 		// Now push master to fork
-		pushedSHA, err = FindLatestAncestorWhereBinariesPushed("fork", mastersha)
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("fork", mastersha)
 		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
 		Expect(pushedSHA).To(Equal(""), "Pushed marker should not be set for fork")
 
 		filesTransferred = 0
-		err = Push(originprovider, "fork", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
+		err = testRepo().Push(originprovider, "fork", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
 		Expect(err).To(BeNil(), "Push should succeed")
 		// Files should equal 2 for each entry (meta + one chunk)
 		expectedFileCount = (len(masterfilespercommit[0]) + len(masterfilespercommit[1]) + len(masterfilespercommit[2])) * 2
@@ -247,16 +247,16 @@ var _ = Describe("Push", func() {
 		// Confirm data exists on remote
 		CheckLOBsExistForTest(mastershaspercommit[0], forkBinStore)
 		CheckLOBsExistForTest(mastershaspercommit[1], forkBinStore)
-		Expect(HasPushedBinaryState("fork")).To(BeTrue(), "Should have pushed state for fork")
-		pushedSHA, err = FindLatestAncestorWhereBinariesPushed("fork", mastersha)
+		Expect(testRepo().HasPushedBinaryState("fork")).To(BeTrue(), "Should have pushed state for fork")
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("fork", mastersha)
 		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
 		Expect(pushedSHA).To(Equal(mastersha), "Pushed marker should be at master")
 
 		// now reset all the pushed data for origin
-		err = ResetPushedBinaryState("origin")
+		err = testRepo().ResetPushedBinaryState("origin")
 		Expect(err).To(BeNil(), "Should not be error resetting pushed data")
-		Expect(HasPushedBinaryState("origin")).To(BeFalse(), "Should not have pushed state for origin")
-		pushedSHA, err = FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(testRepo().HasPushedBinaryState("origin")).To(BeFalse(), "Should not have pushed state for origin")
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
 		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
 		Expect(pushedSHA).To(Equal(""), "Pushed marker should not be set")
 
@@ -265,13 +265,13 @@ var _ = Describe("Push", func() {
 		// someone else but hasn't fetched LOBs, then tries to push their own binaries
 		// this should still succeed, and because LOBs are on the remote then it's fine to
 		// move the pushed pointer over these commits
-		RemoveLOBsForTest(mastershaspercommit[1], GetLocalLOBRoot())
+		RemoveLOBsForTest(mastershaspercommit[1], testRepo().GetLocalLOBRoot())
 		// Also delete some *other* LOBs on the remote to make sure they get pushed
 		RemoveLOBsForTest(mastershaspercommit[2], originBinStore)
 
 		// now push master again, should be OK to skip over missing LOBs since on remote
 		filesTransferred = 0
-		err = Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
+		err = testRepo().Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
 		Expect(err).To(BeNil(), "Push should succeed")
 		// Files should equal 2 for each entry (meta + one chunk)
 		// We should transfer [2] because not on remote
@@ -286,22 +286,32 @@ var _ = Describe("Push", func() {
 		// Confirm new data exists on remote
 		CheckLOBsExistForTest(mastershaspercommit[2], originBinStore)
 		// Check that push cache has been updated (because missing files were OK on remote)
-		pushedSHA, err = FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
 		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
 		Expect(pushedSHA).To(Equal(mastersha), "Pushed marker should be at master")
+		// Binaries found on the remote are remembered so they're not checked again
+		knownLOBs := testRepo().readRemoteKnownLOBs("origin")
+		Expect(knownLOBs.Cardinality()).To(Equal(len(mastershaspercommit[1])), "Should remember binaries found on remote")
+		for _, sha := range mastershaspercommit[1] {
+			Expect(knownLOBs.Contains(sha)).To(BeTrue(), "Should remember binaries found on remote")
+		}
+		// Recheck ignores them, & the remote's answer about missing ones is still correct
+		checker := testRepo().newRemoteLOBChecker(originprovider, "origin", true, true)
+		Expect(checker.CheckAll(mastershaspercommit[1])).To(BeNil())
+		Expect(checker.CheckAll(append([]string{mastershaspercommit[1][0]}, GetListOfRandomSHAsForTest(3)...))).ToNot(BeNil(), "Missing binaries should be reported")
 
 		// Reset all the state again, and this time we'll test with missing data locally that's
 		// also missing on the remote
-		err = ResetPushedBinaryState("origin")
+		err = testRepo().ResetPushedBinaryState("origin")
 		Expect(err).To(BeNil(), "Should not be error resetting pushed data")
-		Expect(HasPushedBinaryState("origin")).To(BeFalse(), "Should not have pushed state for origin")
-		pushedSHA, err = FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(testRepo().HasPushedBinaryState("origin")).To(BeFalse(), "Should not have pushed state for origin")
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
 		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
 		Expect(pushedSHA).To(Equal(""), "Pushed marker should not be set")
 
 		// now delete some of the local AND remote LOBs to create a gap in our data
 		// We should still push data we have but not update push cache state, should warn about missing
-		RemoveLOBsForTest(mastershaspercommit[1], GetLocalLOBRoot())
+		RemoveLOBsForTest(mastershaspercommit[1], testRepo().GetLocalLOBRoot())
 		RemoveLOBsForTest(mastershaspercommit[1], originBinStore)
 		// Also delete some *other* LOBs on the remote to make sure they get pushed
 		RemoveLOBsForTest(mastershaspercommit[2], originBinStore)
@@ -309,7 +319,7 @@ var _ = Describe("Push", func() {
 		// now push master again, should be OK to skip over missing LOBs since on remote
 		filesTransferred = 0
 		filesSkipped = 0
-		err = Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
+		err = testRepo().Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
 		Expect(err).To(BeNil(), "Push should succeed")
 		// Files should equal 2 for each entry (meta + one chunk)
 		// We should transfer [2] because not on remote & present locally
@@ -324,13 +334,294 @@ var _ = Describe("Push", func() {
 		// Confirm new data exists on remote
 		CheckLOBsExistForTest(mastershaspercommit[2], originBinStore)
 		// Check that push cache has been updated, but only to [0] (Tag0)
-		tag0sha, _ := GitRefToFullSHA("Tag0")
-		pushedSHA, err = FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		tag0sha, _ := testRepo().GitRefToFullSHA("Tag0")
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
 		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
 		Expect(pushedSHA).To(Equal(tag0sha), "Pushed marker should have only been moved to the point before missing files on local & remote")
 
 	})
 
+	It("Pushes & marks pushed from a bare repository", func() {
+		// e.g. a mirror kept up to date with 'git fetch --mirror', which has the binaries
+		mirrorRoot := filepath.Join(os.TempDir(), "PushMirrorTest")
+		defer ForceRemoveAll(mirrorRoot)
+		RunGitCommandForTest(true, "clone", "--bare", root, mirrorRoot)
+		for _, remote := range []struct{ name, path string }{{"origin", originBinStore}, {"fork", forkBinStore}} {
+			RunGitCommandForTest(true, "--git-dir", mirrorRoot, "config", "remote."+remote.name+".git-lob-path", strings.Replace(remote.path, "\\", "/", -1))
+			RunGitCommandForTest(true, "--git-dir", mirrorRoot, "config", "remote."+remote.name+".git-lob-provider", "filesystem")
+		}
+		gitdir, _ := filepath.EvalSymlinks(mirrorRoot)
+		err := os.MkdirAll(filepath.Join(gitdir, "git-lob"), 0755)
+		Expect(err).To(BeNil())
+		err = os.Rename(testRepo().GetLocalLOBRoot(), filepath.Join(gitdir, "git-lob", "content"))
+		Expect(err).To(BeNil(), "Should move binaries into the bare repository")
+		os.Chdir(mirrorRoot)
+		Expect(IsBareRepo()).To(BeTrue())
+		GlobalOptions = NewOptions()
+		LoadConfig(GlobalOptions)
+
+		originprovider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+		callback := func(data *ProgressCallbackData) (abort bool) {
+			Expect(data.Type).ToNot(Equal(ProgressError), "No files should fail")
+			Expect(data.Type).ToNot(Equal(ProgressNotFound), "No files should be not found")
+			return false
+		}
+		err = testRepo().Push(originprovider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
+		Expect(err).To(BeNil(), "Push should succeed from a bare repository")
+		for _, shas := range mastershaspercommit {
+			CheckLOBsExistForTest(shas, originBinStore)
+		}
+		mastersha, _ := testRepo().GitRefToFullSHA("master")
+		pushedSHA, err := testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+		Expect(pushedSHA).To(Equal(mastersha), "Pushed marker should be at master")
+		Expect(DirExists(filepath.Join(gitdir, "git-lob", "state", "remotes", "origin"))).To(BeTrue(), "Push state should be kept in the repository")
+
+		// mark-pushed
+		tag1sha, _ := testRepo().GitRefToFullSHA("Tag1")
+		Expect(testRepo().MarkBinariesAsPushed("fork", tag1sha, "")).To(BeNil(), "Should mark pushed in a bare repository")
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("fork", mastersha)
+		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+		Expect(pushedSHA).To(Equal(tag1sha), "Pushed marker should be at Tag1")
+		Expect(testRepo().MarkAllBinariesPushed("fork")).To(BeNil(), "Should mark everything pushed in a bare repository")
+		branch2sha, _ := testRepo().GitRefToFullSHA("branch2")
+		for _, sha := range []string{mastersha, branch2sha} {
+			pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("fork", sha)
+			Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+			Expect(pushedSHA).To(Equal(sha), "Every branch should be marked as pushed")
+		}
+	})
+
+	It("Pushes only selected paths", func() {
+		originprovider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+		callback := func(data *ProgressCallbackData) (abort bool) { return false }
+		master := []*GitRefSpec{&GitRefSpec{Ref1: "master"}}
+		// Check that only the binaries of master in paths with a prefix are on the remote
+		checkPushed := func(prefixes ...string) {
+			for i, files := range masterfilespercommit {
+				for j, file := range files {
+					expected := false
+					for _, prefix := range prefixes {
+						expected = expected || strings.HasPrefix(file, prefix)
+					}
+					sha := mastershaspercommit[i][j]
+					Expect(FileExists(filepath.Join(originBinStore, GetLOBMetaRelativePath(sha)))).To(Equal(expected), "%v pushed state should be correct", file)
+				}
+			}
+		}
+		mastersha, _ := testRepo().GitRefToFullSHA("master")
+
+		GlobalOptions.PushIncludePaths = []string{"movies"}
+		err = testRepo().Push(originprovider, "origin", master, false, false, false, callback)
+		Expect(err).To(BeNil(), "Push should succeed")
+		checkPushed("movies")
+		pushedSHA, err := testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+		Expect(pushedSHA).To(Equal(""), "Commits shouldn't be marked as pushed when filtering")
+
+		// Excluded binaries are still pushed later, & pushing everything marks commits as pushed
+		GlobalOptions.PushIncludePaths = []string{}
+		GlobalOptions.PushExcludePaths = []string{filepath.Join("other", "files")}
+		err = testRepo().Push(originprovider, "origin", master, false, false, false, callback)
+		Expect(err).To(BeNil(), "Push should succeed")
+		checkPushed("movies", "img")
+		pushedSHA, _ = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(pushedSHA).To(Equal(""), "Commits shouldn't be marked as pushed when filtering")
+		GlobalOptions.PushExcludePaths = []string{}
+		err = testRepo().Push(originprovider, "origin", master, false, false, false, callback)
+		Expect(err).To(BeNil(), "Push should succeed")
+		checkPushed("")
+		pushedSHA, _ = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(pushedSHA).To(Equal(mastersha), "Pushed marker should be at master")
+	})
+	It("Resumes interrupted pushes", func() {
+		originprovider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+		// Record every file as it's uploaded
+		defer func(size int) { pushJournalBatchSize = size }(pushJournalBatchSize)
+		pushJournalBatchSize = 1
+
+		var filesTransferred int
+		var filesSkipped int
+		callback := func(data *ProgressCallbackData) (abort bool) {
+			switch data.Type {
+			case ProgressTransferBytes:
+				if data.ItemBytesDone == data.ItemBytes {
+					filesTransferred++
+				}
+			case ProgressSkip:
+				filesSkipped++
+			}
+			return false
+		}
+		master := []*GitRefSpec{&GitRefSpec{Ref1: "master"}}
+		Expect(testRepo().HasPushJournal("origin")).To(BeFalse(), "Should be no journal to start with")
+		err = testRepo().ResumePush(originprovider, "origin", false, callback)
+		Expect(err).ToNot(BeNil(), "Nothing to resume")
+
+		// Connection drops after 3 files of first commit
+		err = testRepo().Push(&interruptingSyncProvider{originprovider, 3}, "origin", master, false, false, false, callback)
+		Expect(err).ToNot(BeNil(), "Push should fail")
+		Expect(testRepo().HasPushJournal("origin")).To(BeTrue(), "Should be able to resume")
+		mastersha, _ := testRepo().GitRefToFullSHA("master")
+		pushedSHA, err := testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+		Expect(pushedSHA).To(BeEmpty(), "No commits should be pushed")
+
+		// Resume, dropping after first commit & 2 files of the second
+		filesTransferred = 0
+		filesSkipped = 0
+		err = testRepo().ResumePush(&interruptingSyncProvider{originprovider, len(masterfilespercommit[0])*2 - 3 + 2}, "origin", false, callback)
+		Expect(err).ToNot(BeNil(), "Resumed push should fail")
+		Expect(filesSkipped).To(BeEquivalentTo(3), "Files already uploaded should be skipped")
+		Expect(filesTransferred).To(BeEquivalentTo(len(masterfilespercommit[0])*2-3+2), "Should transfer up to interruption")
+		tag0sha, _ := testRepo().GitRefToFullSHA("Tag0")
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+		Expect(pushedSHA).To(Equal(tag0sha), "First commit should be marked pushed")
+
+		// Normal push also uses the journal to skip files
+		filesTransferred = 0
+		filesSkipped = 0
+		err = testRepo().Push(originprovider, "origin", master, false, false, false, callback)
+		Expect(err).To(BeNil(), "Push should succeed")
+		Expect(filesSkipped).To(BeEquivalentTo(2), "Files already uploaded should be skipped")
+		Expect(filesTransferred).To(BeEquivalentTo((len(masterfilespercommit[1])+len(masterfilespercommit[2]))*2-2),
+			"Should transfer the rest")
+		Expect(testRepo().HasPushJournal("origin")).To(BeFalse(), "Journal should be removed when complete")
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+		Expect(pushedSHA).To(Equal(mastersha), "Pushed marker should be at master")
+		for _, shas := range mastershaspercommit {
+			CheckLOBsExistForTest(shas, originBinStore)
+		}
+	})
+
+	It("Records uploads to resume a batch at a time", func() {
+		originprovider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+		defer func(size int) { pushJournalBatchSize = size }(pushJournalBatchSize)
+		pushJournalBatchSize = 4
+
+		var filesSkipped int
+		callback := func(data *ProgressCallbackData) (abort bool) {
+			if data.Type == ProgressSkip {
+				filesSkipped++
+			}
+			return false
+		}
+		master := []*GitRefSpec{&GitRefSpec{Ref1: "master"}}
+		// Connection drops part way through the second batch, so only the first is recorded
+		err = testRepo().Push(&interruptingSyncProvider{originprovider, 5}, "origin", master, false, false, false, callback)
+		Expect(err).ToNot(BeNil(), "Push should fail")
+		journal, err := testRepo().readPushJournal("origin")
+		Expect(err).To(BeNil())
+		Expect(journal).ToNot(BeNil(), "Should be able to resume")
+		tag0sha, _ := testRepo().GitRefToFullSHA("Tag0")
+		Expect(journal.uploaded[tag0sha].Cardinality()).To(BeEquivalentTo(4), "Only complete batches should be recorded")
+
+		err = testRepo().ResumePush(originprovider, "origin", false, callback)
+		Expect(err).To(BeNil(), "Resumed push should succeed")
+		Expect(filesSkipped).To(BeEquivalentTo(4), "Files in complete batches should be skipped")
+		Expect(testRepo().HasPushJournal("origin")).To(BeFalse(), "Journal should be removed when complete")
+	})
+
+	It("Stops cleanly when cancelled", func() {
+		originprovider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+		defer ResetCancelled()
+
+		var filesTransferred int
+		cancelAfter := 3
+		callback := func(data *ProgressCallbackData) (abort bool) {
+			if data.Type == ProgressTransferBytes && data.ItemBytesDone == data.ItemBytes {
+				filesTransferred++
+				if filesTransferred == cancelAfter {
+					// As if interrupted
+					Cancel()
+				}
+			}
+			return false
+		}
+		master := []*GitRefSpec{&GitRefSpec{Ref1: "master"}}
+		err = testRepo().Push(originprovider, "origin", master, false, false, false, callback)
+		Expect(err).To(Equal(ErrCancelled), "Push should stop")
+		Expect(filesTransferred).To(BeEquivalentTo(3), "Should stop after the file in progress")
+		Expect(testRepo().HasPushJournal("origin")).To(BeTrue(), "Should be able to resume")
+		mastersha, _ := testRepo().GitRefToFullSHA("master")
+		pushedSHA, err := testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+		Expect(pushedSHA).To(BeEmpty(), "No commits should be pushed")
+
+		ResetCancelled()
+		cancelAfter = 0
+		err = testRepo().ResumePush(originprovider, "origin", false, callback)
+		Expect(err).To(BeNil(), "Resumed push should succeed")
+		Expect(testRepo().HasPushJournal("origin")).To(BeFalse(), "Journal should be removed when complete")
+		pushedSHA, err = testRepo().FindLatestAncestorWhereBinariesPushed("origin", mastersha)
+		Expect(err).To(BeNil(), "Should not be error finding latest pushed")
+		Expect(pushedSHA).To(Equal(mastersha), "Pushed marker should be at master")
+	})
+
+	It("Verifies pushed binaries", func() {
+		originprovider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+		defer func() { GlobalOptions.PushVerify = PushVerifyNone }()
+		var verified int
+		callback := func(data *ProgressCallbackData) (abort bool) {
+			if data.Type == ProgressVerifying && data.ItemBytesDone == data.ItemBytes {
+				verified++
+			}
+			return false
+		}
+		tag0 := []*GitRefSpec{&GitRefSpec{Ref1: "Tag0"}}
+		tag0sha, _ := testRepo().GitRefToFullSHA("Tag0")
+
+		// Content corrupted on the remote but the right size is only caught by deep verify
+		GlobalOptions.PushVerify = PushVerifyQuick
+		err = testRepo().Push(&corruptingSyncProvider{originprovider, originBinStore, false}, "origin", tag0, false, false, false, callback)
+		Expect(err).To(BeNil(), "Quick verify should only check sizes")
+		Expect(verified).To(BeEquivalentTo(len(masterfilespercommit[0])), "Should verify every binary")
+		testRepo().ResetPushedBinaryState("origin")
+
+		verified = 0
+		GlobalOptions.PushVerify = PushVerifyDeep
+		err = testRepo().Push(&corruptingSyncProvider{originprovider, originBinStore, false}, "origin", tag0, false, true, false, callback)
+		Expect(err).ToNot(BeNil(), "Deep verify should detect corrupt content")
+		Expect(err.Error()).To(ContainSubstring("corrupt"))
+		pushedSHA, _ := testRepo().FindLatestAncestorWhereBinariesPushed("origin", tag0sha)
+		Expect(pushedSHA).To(BeEmpty(), "Commit should not be marked pushed when verify fails")
+
+		// Truncated files are caught by quick verify
+		GlobalOptions.PushVerify = PushVerifyQuick
+		err = testRepo().Push(&corruptingSyncProvider{originprovider, originBinStore, true}, "origin", tag0, false, true, false, callback)
+		Expect(err).ToNot(BeNil(), "Quick verify should detect wrong size")
+		Expect(err.Error()).To(ContainSubstring("wrong size"))
+
+		// All good after a clean forced push
+		verified = 0
+		GlobalOptions.PushVerify = PushVerifyDeep
+		err = testRepo().Push(originprovider, "origin", tag0, false, true, false, callback)
+		Expect(err).To(BeNil(), "Clean push should verify")
+		Expect(verified).To(BeEquivalentTo(len(masterfilespercommit[0])))
+		pushedSHA, _ = testRepo().FindLatestAncestorWhereBinariesPushed("origin", tag0sha)
+		Expect(pushedSHA).To(Equal(tag0sha), "Commit should be marked pushed")
+
+		// The remote may store the same content differently, e.g. re-stored from a delta
+		localinfo, err := testRepo().GetLOBInfo(mastershaspercommit[0][0])
+		Expect(err).To(BeNil())
+		different := *localinfo
+		different.Compression = "zstd"
+		different.ChunkSize = 1024
+		different.Signature = "signed elsewhere"
+		Expect(testRepo().verifyPushedLOB(&different, originprovider, "origin", false)).To(BeNil(), "Only the content should have to match")
+		Expect(testRepo().verifyPushedLOB(&different, originprovider, "origin", true)).To(BeNil(), "Only the content should have to match")
+		different.Size++
+		Expect(testRepo().verifyPushedLOB(&different, originprovider, "origin", false)).ToNot(BeNil(), "Size should have to match")
+	})
+
 	Context("Delta push test", func() {
 		root := filepath.Join(os.TempDir(), "PushTest")
 		originRoot := filepath.Join(os.TempDir(), "PushOriginTest")
@@ -408,7 +699,7 @@ var _ = Describe("Push", func() {
 			sha1 := setupOutputs[0].FileLOBs[0].SHA
 			sha2 := setupOutputs[1].FileLOBs[0].SHA
 			sha3 := setupOutputs[2].FileLOBs[0].SHA
-			meta1, err := ioutil.ReadFile(GetLocalLOBMetaPath(sha1))
+			meta1, err := ioutil.ReadFile(testRepo().GetLocalLOBMetaPath(sha1))
 			Expect(err).To(BeNil(), "Should not error trying to read metafile")
 			metamap := map[string][]byte{
 				sha1: meta1,
@@ -421,7 +712,7 @@ var _ = Describe("Push", func() {
 
 			fileshas = append(fileshas, sha1, sha2, sha3)
 			// mark first commit as pushed since we included the data in the transport
-			MarkBinariesAsPushed("origin", setupOutputs[0].Commit, "")
+			testRepo().MarkBinariesAsPushed("origin", setupOutputs[0].Commit, "")
 
 		})
 		AfterEach(func() {
@@ -465,11 +756,11 @@ var _ = Describe("Push", func() {
 				}
 				return false
 			}
-			provider, err := GetProviderForRemote("origin")
+			provider, err := testRepo().GetProvider("origin")
 			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
 
 			// dry run first
-			err = Push(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, true, false, false, callback)
+			err = testRepo().Push(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, true, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error pushing")
 			Expect(filesTransferred).To(BeEquivalentTo(0), "Should be no files to transfer")
 			Expect(filesSkipped).To(BeEquivalentTo(0), "Should be no files skipped")
@@ -477,7 +768,7 @@ var _ = Describe("Push", func() {
 			Expect(filesNotFound).To(BeEquivalentTo(0), "Should be no files not found")
 
 			// Now for real
-			err = Push(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
+			err = testRepo().Push(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)
 			Expect(err).To(BeNil(), "Should be no error pushing")
 			Expect(filesTransferred).To(BeEquivalentTo(2*2), "Should be correct no of files to transfer (2 meta, 2 deltas)")
 			Expect(deltasSeen).To(BeEquivalentTo(2), "Should see 2 completed deltas")
@@ -487,6 +778,34 @@ var _ = Describe("Push", func() {
 
 		})
 
+		It("Pushes deltas for single binaries", func() {
+			var deltasSeen int
+			callback := func(data *ProgressCallbackData) (abort bool) {
+				if data.Type == ProgressTransferBytes && data.ItemBytesDone == data.ItemBytes && strings.HasPrefix(data.Desc, "Delta") {
+					deltasSeen++
+				}
+				return false
+			}
+			provider, err := testRepo().GetProvider("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			filenames, err := testRepo().GetGitFilenamesForLOBs(fileshas[:3], nil)
+			Expect(err).To(BeNil())
+			Expect(filenames).To(Equal(map[string]string{
+				fileshas[0]: "file1.txt", fileshas[1]: "file1.txt", fileshas[2]: "file1.txt"}), "Should find filenames from history")
+			missingsha := strings.Repeat("0", 40)
+			filenames, err = testRepo().GetGitFilenamesForLOBs([]string{fileshas[0], fileshas[2], missingsha}, []string{setupOutputs[1].Commit})
+			Expect(err).To(BeNil())
+			Expect(filenames).To(Equal(map[string]string{fileshas[0]: "file1.txt"}), "Should only search history of refs")
+
+			// Dummy transport can't upload chunks, so this only works as a delta
+			err = testRepo().PushSingle(fileshas[1], provider, "origin", false, callback)
+			Expect(err).To(BeNil(), "Should be no error pushing")
+			Expect(deltasSeen).To(Equal(1), "Should have pushed a delta")
+			err = testRepo().PushMultiple(fileshas[1:3], nil, provider, "origin", true, callback)
+			Expect(err).To(BeNil(), "Should be no error pushing")
+			Expect(deltasSeen).To(Equal(3), "Should have pushed deltas for every binary")
+		})
+
 	})
 
 })
@@ -595,6 +914,127 @@ type DummyPushTransportFactory struct {
 func (self *DummyPushTransportFactory) WillHandleUrl(u *url.URL) bool {
 	return u.Scheme == "dummy"
 }
-func (self *DummyPushTransportFactory) Connect(u *url.URL) (smart.Transport, error) {
+func (self *DummyPushTransportFactory) Connect(u *url.URL, root string, opts *Options, log *Logger) (smart.Transport, error) {
 	return &DummyPushTransport{self.MetaContentMap, self.ContentMap}, nil
 }
+
+// Provider which fails all uploads after a number of files, like a dropped connection
+type interruptingSyncProvider struct {
+	SyncProvider
+	filesLeft int
+}
+
+func (self *interruptingSyncProvider) Upload(remoteName string, filenames []string, fromDir string, force bool, callback SyncProgressCallback) error {
+	if self.filesLeft < len(filenames) {
+		return fmt.Errorf("Connection dropped")
+	}
+	self.filesLeft -= len(filenames)
+	return self.SyncProvider.Upload(remoteName, filenames, fromDir, force, callback)
+}
+
+// Provider which damages the first chunk of each binary in a filesystem remote after uploading it
+type corruptingSyncProvider struct {
+	SyncProvider
+	remoteRoot string
+	truncate   bool
+}
+
+func (self *corruptingSyncProvider) Upload(remoteName string, filenames []string, fromDir string, force bool, callback SyncProgressCallback) error {
+	err := self.SyncProvider.Upload(remoteName, filenames, fromDir, force, callback)
+	for _, file := range filenames {
+		if !strings.HasSuffix(file, "_0") {
+			continue
+		}
+		remotefile := filepath.Join(self.remoteRoot, file)
+		if self.truncate {
+			os.Truncate(remotefile, 1)
+		} else {
+			f, _ := os.OpenFile(remotefile, os.O_WRONLY, 0644)
+			f.WriteAt([]byte("X"), 0)
+			f.Close()
+		}
+	}
+	return err
+}
+
+var _ = Describe("Push to remotes storing binaries differently", func() {
+	root := filepath.Join(os.TempDir(), "PushStoredDifferentlyTest")
+	originBinStore := filepath.Join(os.TempDir(), "PushStoredDifferentlyOriginBinStore")
+	var oldwd string
+	var content []byte
+	callback := func(data *ProgressCallbackData) (abort bool) { return false }
+
+	BeforeEach(func() {
+		oldwd, _ = os.Getwd()
+		CreateGitRepoForTest(root)
+		os.Chdir(root)
+		os.MkdirAll(originBinStore, 0755)
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_APPEND, 0644)
+		Expect(err).To(BeNil())
+		f.WriteString(fmt.Sprintf(`
+[remote "origin"]
+    url = file:///dummy/origin
+    git-lob-path = %v
+    git-lob-provider = filesystem
+`, strings.Replace(originBinStore, "\\", "/", -1)))
+		f.Close()
+		LoadConfig(GlobalOptions)
+		InitCoreProviders()
+		CreateRandomFileForTest(1000, "content.dat")
+		content, _ = ioutil.ReadFile("content.dat")
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		for _, dir := range []string{root, originBinStore} {
+			err := ForceRemoveAll(dir)
+			if err != nil {
+				Fail(err.Error())
+			}
+		}
+		GlobalOptions = NewOptions()
+	})
+
+	// Store content on the remote with one chunk size & locally with another
+	storeBoth := func(remoteChunkSize, localChunkSize int64) *LOBInfo {
+		GlobalOptions.ChunkSize = remoteChunkSize
+		_, err := testRepo().StoreLOBInBaseDir(originBinStore, bytes.NewReader(content), nil)
+		Expect(err).To(BeNil())
+		GlobalOptions.ChunkSize = localChunkSize
+		info, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+		Expect(err).To(BeNil())
+		return info
+	}
+
+	It("Leaves complete binaries on the remote as they are", func() {
+		info := storeBoth(0, 200)
+		provider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil())
+		Expect(testRepo().PushSingle(info.SHA, provider, "origin", false, callback)).To(BeNil())
+		remoteinfo, err := testRepo().getLOBInfoInBaseDir(info.SHA, originBinStore)
+		Expect(err).To(BeNil())
+		Expect(remoteinfo.NumChunks).To(Equal(1), "Remote copy should be kept")
+		Expect(FileExists(filepath.Join(originBinStore, GetLOBChunkRelativePath(info.SHA, 1)))).To(BeFalse(), "Local chunks shouldn't be mixed in")
+		Expect(testRepo().CheckLOBFilesForSHA(info.SHA, originBinStore, true)).To(BeNil())
+	})
+
+	It("Replaces incomplete binaries on the remote", func() {
+		// Chunk 2 is 200 bytes either way, but different content
+		info := storeBoth(400, 200)
+		os.Remove(filepath.Join(originBinStore, GetLOBChunkRelativePath(info.SHA, 0)))
+		provider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil())
+		Expect(testRepo().PushSingle(info.SHA, provider, "origin", false, callback)).To(BeNil())
+		Expect(testRepo().CheckLOBFilesForSHA(info.SHA, originBinStore, true)).To(BeNil(), "Remote should be complete & intact")
+
+		// Same through a regular push of a commit
+		ioutil.WriteFile("content.dat", []byte(fmt.Sprintf("git-lob: %v", info.SHA)), 0644)
+		exec.Command("git", "add", "content.dat").Run()
+		exec.Command("git", "commit", "-m", "Add content").Run()
+		ForceRemoveAll(originBinStore)
+		storeBoth(400, 200)
+		os.Remove(filepath.Join(originBinStore, GetLOBChunkRelativePath(info.SHA, 0)))
+		refspec := &GitRefSpec{Ref1: "master"}
+		Expect(testRepo().Push(provider, "origin", []*GitRefSpec{refspec}, false, false, false, callback)).To(BeNil())
+		Expect(testRepo().CheckLOBFilesForSHA(info.SHA, originBinStore, true)).To(BeNil(), "Remote should be complete & intact")
+	})
+})
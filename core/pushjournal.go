@@ -0,0 +1,339 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// The push journal records progress through a push to a remote, so that if the push is
+// interrupted the next one doesn't upload files again, and 'push --resume' can carry on
+// without recalculating what needs pushing. It only covers the refspec in progress, which is
+// why the remaining refspecs are recorded too; it's deleted once the push is complete.
+// The file is a header line, then the plan for the refspec in progress as a single line of
+// JSON (replaced atomically), then one line appended for each file uploaded & commit completed
+// (files are appended a batch at a time, see pushJournalBatchSize).
+// Appending single lines means an interruption can at worst leave a partial last line, which
+// is ignored since it has no line ending.
+
+const (
+	// First line of push journal files
+	pushJournalHeader = "git-lob-push-journal 1"
+	// Record for a file uploaded: uploaded <commitsha> <file>
+	pushJournalUploaded = "uploaded"
+	// Record for a commit finished: done <commitsha>
+	pushJournalDone = "done"
+)
+
+// Files are uploaded in batches of this many when there's a journal, & each batch is recorded
+// once it's complete; an interruption means at most one batch is uploaded again
+var pushJournalBatchSize = 100
+
+// A commit in the plan for the refspec in progress
+type pushJournalCommit struct {
+	CommitSHA string
+	// All the files to upload for this commit, relative to the local LOB root
+	Files []string
+	// Commit had missing or filtered data & must not be marked as pushed (see PushCommitContentDetails)
+	Incomplete bool
+	// Storage classes for files which have one (see PushCommitContentDetails)
+	StorageClasses map[string]string `json:",omitempty"`
+}
+
+type pushJournal struct {
+	// Refspecs still to push, the first is the one in progress
+	Refspecs []string
+	// Whether the push was forced
+	Force bool
+	// Commits to push for the refspec in progress, in order
+	Commits []*pushJournalCommit
+
+	repo       *Repo
+	remoteName string
+	// Files uploaded, by commit
+	uploaded map[string]util.StringSet
+	// Commits finished
+	done util.StringSet
+}
+
+func (r *Repo) newPushJournal(remoteName string, refspecs []*GitRefSpec, force bool) *pushJournal {
+	j := &pushJournal{Force: force, repo: r, remoteName: remoteName}
+	for _, spec := range refspecs {
+		j.Refspecs = append(j.Refspecs, spec.String())
+	}
+	j.reset()
+	return j
+}
+
+func (j *pushJournal) reset() {
+	j.Commits = nil
+	j.uploaded = make(map[string]util.StringSet)
+	j.done = util.NewStringSet()
+}
+
+// Gets the file which holds the push journal for a remote
+// Not in the remote state cache, whose presence means we've pushed before (see HasPushedBinaryState)
+func (r *Repo) getPushJournalFile(remoteName string) string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "push_journal", remoteName)
+}
+
+// Is there an interrupted push to a remote which can be resumed?
+func (r *Repo) HasPushJournal(remoteName string) bool {
+	j, err := r.readPushJournal(remoteName)
+	return err == nil && j != nil
+}
+
+// Read the push journal for a remote, or nil if there isn't one
+func (r *Repo) readPushJournal(remoteName string) (*pushJournal, error) {
+	filename := r.getPushJournalFile(remoteName)
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read push journal %v: %v", filename, err.Error())
+	}
+	defer f.Close()
+	rdr := bufio.NewReader(f)
+	// Only complete lines count, an interruption could leave a partial last line
+	readLine := func() (string, bool) {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			return "", false
+		}
+		return strings.TrimRight(line, "\r\n"), true
+	}
+	if line, ok := readLine(); !ok || line != pushJournalHeader {
+		return nil, fmt.Errorf("Push journal %v is not valid", filename)
+	}
+	j := &pushJournal{repo: r, remoteName: remoteName}
+	plan, ok := readLine()
+	if !ok {
+		return nil, fmt.Errorf("Push journal %v is not valid", filename)
+	}
+	err = json.Unmarshal([]byte(plan), j)
+	if err != nil {
+		return nil, fmt.Errorf("Push journal %v is not valid: %v", filename, err.Error())
+	}
+	j.uploaded = make(map[string]util.StringSet)
+	j.done = util.NewStringSet()
+	for line, ok := readLine(); ok; line, ok = readLine() {
+		// Ignore anything we don't understand
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) == 3 && fields[0] == pushJournalUploaded && GitRefIsFullSHA(fields[1]) {
+			j.uploadedSet(fields[1]).Add(fields[2])
+		} else if len(fields) == 2 && fields[0] == pushJournalDone && GitRefIsFullSHA(fields[1]) {
+			j.done.Add(fields[1])
+		}
+	}
+	if len(j.Refspecs) == 0 {
+		return nil, nil
+	}
+	return j, nil
+}
+
+func (j *pushJournal) uploadedSet(commitSHA string) util.StringSet {
+	s, ok := j.uploaded[commitSHA]
+	if !ok {
+		s = util.NewStringSet()
+		j.uploaded[commitSHA] = s
+	}
+	return s
+}
+
+// Write the plan for the refspec in progress, replacing the whole journal
+func (j *pushJournal) writePlan() error {
+	planbytes, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	filename := j.repo.getPushJournalFile(j.remoteName)
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to create push journal folder: %v", err.Error()))
+	}
+	tmpfilename := filename + ".tmp"
+	f, err := os.OpenFile(tmpfilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to write push journal %v: %v", tmpfilename, err.Error()))
+	}
+	_, err = fmt.Fprintf(f, "%v\n%v\n", pushJournalHeader, string(planbytes))
+	for commitSHA, files := range j.uploaded {
+		for file := range files.Iter() {
+			if err == nil {
+				_, err = fmt.Fprintf(f, "%v %v %v\n", pushJournalUploaded, commitSHA, file)
+			}
+		}
+	}
+	for commitSHA := range j.done.Iter() {
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%v %v\n", pushJournalDone, commitSHA)
+		}
+	}
+	if err == nil {
+		// Make sure it's really on disk before we replace the old one
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpfilename)
+		return errors.New(fmt.Sprintf("Unable to write push journal %v: %v", tmpfilename, err.Error()))
+	}
+	err = os.Rename(tmpfilename, filename)
+	if err != nil {
+		os.Remove(tmpfilename)
+		return errors.New(fmt.Sprintf("Unable to write push journal %v: %v", filename, err.Error()))
+	}
+	return nil
+}
+
+// Append records to the journal, in one write
+func (j *pushJournal) appendRecords(records []string) {
+	if len(records) == 0 {
+		return
+	}
+	filename := j.repo.getPushJournalFile(j.remoteName)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = f.WriteString(strings.Join(records, "\n") + "\n")
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+	}
+	if err != nil {
+		// Not fatal, just means more work if the push is interrupted
+		j.repo.Log.Errorf("Unable to update push journal %v: %v\n", filename, err.Error())
+	}
+}
+
+// Start a refspec: record the commits & files to push for it
+// Files already uploaded for the same commits by an interrupted push (prev) are kept, so they
+// can be skipped, unless this is a forced push & that one wasn't
+func (j *pushJournal) startRefSpec(commits []*PushCommitContentDetails, prev *pushJournal) {
+	if j == nil {
+		return
+	}
+	j.reset()
+	for _, commit := range commits {
+		files := append([]string{}, commit.Files...)
+		for _, delta := range commit.Deltas {
+			filenames, _, err := j.repo.getLOBFilesForSHA(delta.TargetSHA, commit.BaseDir, false, false)
+			if err == nil {
+				files = append(files, filenames...)
+			}
+		}
+		j.Commits = append(j.Commits, &pushJournalCommit{commit.CommitSHA, files, commit.Incomplete, commit.StorageClasses})
+		if prev != nil && (!j.Force || prev.Force) {
+			for _, file := range files {
+				if prev.isUploaded(commit.CommitSHA, file) {
+					j.uploadedSet(commit.CommitSHA).Add(file)
+				}
+			}
+		}
+	}
+	if err := j.writePlan(); err != nil {
+		j.repo.Log.Errorf("%v\n", err.Error())
+	}
+}
+
+// Has a file for a commit already been uploaded?
+func (j *pushJournal) isUploaded(commitSHA, file string) bool {
+	if j == nil {
+		return false
+	}
+	s, ok := j.uploaded[commitSHA]
+	return ok && s.Contains(file)
+}
+
+// Record that files for a commit have been uploaded (or were already on the remote)
+func (j *pushJournal) markUploaded(commitSHA string, files ...string) {
+	if j == nil {
+		return
+	}
+	var records []string
+	for _, file := range files {
+		if j.uploadedSet(commitSHA).Add(file) {
+			records = append(records, fmt.Sprintf("%v %v %v", pushJournalUploaded, commitSHA, file))
+		}
+	}
+	j.appendRecords(records)
+}
+
+// Forget the files uploaded for a commit, so they're uploaded again next time
+// (e.g. because they didn't verify, see verifyPushedCommit)
+func (j *pushJournal) forgetUploaded(commitSHA string) {
+	if j == nil {
+		return
+	}
+	delete(j.uploaded, commitSHA)
+	if err := j.writePlan(); err != nil {
+		j.repo.Log.Errorf("%v\n", err.Error())
+	}
+}
+
+// Record that a commit is finished
+func (j *pushJournal) markDone(commitSHA string) {
+	if j == nil || !j.done.Add(commitSHA) {
+		return
+	}
+	j.appendRecords([]string{fmt.Sprintf("%v %v", pushJournalDone, commitSHA)})
+}
+
+// Finish the refspec in progress, deleting the journal if it was the last
+func (j *pushJournal) finishRefSpec() {
+	if j == nil || len(j.Refspecs) == 0 {
+		return
+	}
+	j.Refspecs = j.Refspecs[1:]
+	j.reset()
+	if len(j.Refspecs) == 0 {
+		os.Remove(j.repo.getPushJournalFile(j.remoteName))
+		return
+	}
+	if err := j.writePlan(); err != nil {
+		j.repo.Log.Errorf("%v\n", err.Error())
+	}
+}
+
+// Were any of the commits finished for the refspec in progress incomplete?
+func (j *pushJournal) anyDoneIncomplete() bool {
+	for _, commit := range j.Commits {
+		if commit.Incomplete && j.done.Contains(commit.CommitSHA) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the work remaining for the refspec in progress, so it can be resumed without
+// recalculating it. Files which have already been uploaded are included so that they're
+// reported as skipped, but don't count towards FileBytes
+func (j *pushJournal) remainingCommits() []*PushCommitContentDetails {
+	basedir := j.repo.GetLocalLOBRoot()
+	var ret []*PushCommitContentDetails
+	for _, commit := range j.Commits {
+		if j.done.Contains(commit.CommitSHA) {
+			continue
+		}
+		details := &PushCommitContentDetails{CommitSHA: commit.CommitSHA, BaseDir: basedir, Incomplete: commit.Incomplete,
+			StorageClasses: commit.StorageClasses}
+		for _, file := range commit.Files {
+			details.Files = append(details.Files, file)
+			if j.isUploaded(commit.CommitSHA, file) {
+				continue
+			}
+			if s, err := os.Stat(getLOBStoreFilePath(basedir, file)); err == nil {
+				details.FileBytes += s.Size()
+			}
+		}
+		ret = append(ret, details)
+	}
+	return ret
+}
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// The push queue records pushes made while offline (git-lob.offline), so that they can be made
+// with 'push --flush-queue' once the remote can be reached again. Each queued push records the
+// refspecs as given & the same refspecs with refs resolved to commits when it was queued, so that
+// what's pushed later is what was intended even if branches have moved on since. There's one
+// queue file per remote, holding JSON; it's replaced atomically & deleted once it's empty.
+
+const pushQueueVersion = 1
+
+// A push waiting in the queue for a remote
+type QueuedPush struct {
+	// When the push was queued
+	Queued time.Time
+	// Refspecs as given to push
+	Refspecs []string
+	// Refspecs with refs resolved to commit SHAs when queued, which are what's pushed
+	Commits []string
+	Force   bool
+	Recheck bool
+	// Path filters in effect when queued (see util.Options.PushIncludePaths)
+	IncludePaths []string `json:",omitempty"`
+	ExcludePaths []string `json:",omitempty"`
+}
+
+type pushQueue struct {
+	Version int
+	Pushes  []*QueuedPush
+}
+
+// Gets the folder which holds the push queues for all remotes
+func (r *Repo) getPushQueueDir() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "push_queue")
+}
+
+// Gets the file which holds the push queue for a remote
+func (r *Repo) getPushQueueFile(remoteName string) string {
+	return filepath.Join(r.getPushQueueDir(), remoteName)
+}
+
+// Get the pushes queued for a remote, oldest first
+func (r *Repo) GetQueuedPushes(remoteName string) ([]*QueuedPush, error) {
+	return readPushQueueFile(r.getPushQueueFile(remoteName))
+}
+
+// Read a file of queued pushes (the push queue, or pending replication), oldest first
+func readPushQueueFile(filename string) ([]*QueuedPush, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read push queue %v: %v", filename, err.Error())
+	}
+	var queue pushQueue
+	err = json.Unmarshal(data, &queue)
+	if err != nil {
+		return nil, fmt.Errorf("Push queue %v is not valid: %v", filename, err.Error())
+	}
+	if queue.Version > pushQueueVersion {
+		return nil, fmt.Errorf("Push queue %v was written by a newer version of git-lob", filename)
+	}
+	return queue.Pushes, nil
+}
+
+// Get the remotes which have pushes queued, in name order
+func (r *Repo) GetRemotesWithQueuedPushes() ([]string, error) {
+	return listPushQueueDir(r.getPushQueueDir())
+}
+
+// Get the remotes with a file of queued pushes in a folder, in name order
+func listPushQueueDir(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ret []string
+	for _, info := range infos {
+		if !info.IsDir() && !strings.HasSuffix(info.Name(), ".tmp") {
+			ret = append(ret, info.Name())
+		}
+	}
+	return ret, nil
+}
+
+// Replace the push queue for a remote, deleting it if there's nothing left
+func (r *Repo) writePushQueue(remoteName string, pushes []*QueuedPush) error {
+	return writePushQueueFile(r.getPushQueueFile(remoteName), pushes)
+}
+
+// Replace a file of queued pushes, deleting it if there's nothing left
+func writePushQueueFile(filename string, pushes []*QueuedPush) error {
+	if len(pushes) == 0 {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Unable to remove push queue %v: %v", filename, err.Error())
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(&pushQueue{pushQueueVersion, pushes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return fmt.Errorf("Unable to create push queue folder: %v", err.Error())
+	}
+	tmpfilename := filename + ".tmp"
+	err = ioutil.WriteFile(tmpfilename, data, 0644)
+	if err != nil {
+		os.Remove(tmpfilename)
+		return fmt.Errorf("Unable to write push queue %v: %v", tmpfilename, err.Error())
+	}
+	err = os.Rename(tmpfilename, filename)
+	if err != nil {
+		os.Remove(tmpfilename)
+		return fmt.Errorf("Unable to write push queue %v: %v", filename, err.Error())
+	}
+	return nil
+}
+
+// Resolve the refs in a refspec to commit SHAs, keeping the range operator
+func (r *Repo) resolveRefSpecToCommits(refspec *GitRefSpec) (string, error) {
+	ref1, err := r.GitRefToFullSHA(refspec.Ref1)
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve %v: %v", refspec.Ref1, err.Error())
+	}
+	if !refspec.IsRange() {
+		return ref1, nil
+	}
+	ref2, err := r.GitRefToFullSHA(refspec.Ref2)
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve %v: %v", refspec.Ref2, err.Error())
+	}
+	return fmt.Sprintf("%v%v%v", ref1, refspec.RangeOp, ref2), nil
+}
+
+// Queue a push to a remote instead of making it now, using the path filters currently
+// configured. If an identical push is already queued it isn't queued again
+func (r *Repo) QueuePush(remoteName string, refspecs []*GitRefSpec, force, recheck bool) (*QueuedPush, error) {
+	push, err := r.newQueuedPush(refspecs, force, recheck)
+	if err != nil {
+		return nil, err
+	}
+	pushes, err := r.GetQueuedPushes(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	for _, queued := range pushes {
+		if queued.isSamePush(push) {
+			return queued, nil
+		}
+	}
+	return push, r.writePushQueue(remoteName, append(pushes, push))
+}
+
+// Record a push to make later, using the path filters currently configured
+func (r *Repo) newQueuedPush(refspecs []*GitRefSpec, force, recheck bool) (*QueuedPush, error) {
+	push := &QueuedPush{
+		Queued:       time.Now(),
+		Force:        force,
+		Recheck:      recheck,
+		IncludePaths: r.Options.PushIncludePaths,
+		ExcludePaths: r.Options.PushExcludePaths,
+	}
+	for _, refspec := range refspecs {
+		commits, err := r.resolveRefSpecToCommits(refspec)
+		if err != nil {
+			return nil, err
+		}
+		push.Refspecs = append(push.Refspecs, refspec.String())
+		push.Commits = append(push.Commits, commits)
+	}
+	return push, nil
+}
+
+// Would 2 queued pushes push the same thing in the same way?
+func (p *QueuedPush) isSamePush(other *QueuedPush) bool {
+	return strings.Join(p.Commits, " ") == strings.Join(other.Commits, " ") &&
+		p.Force == other.Force && p.Recheck == other.Recheck &&
+		strings.Join(p.IncludePaths, ",") == strings.Join(other.IncludePaths, ",") &&
+		strings.Join(p.ExcludePaths, ",") == strings.Join(other.ExcludePaths, ",")
+}
+
+// Check that a remote can be reached, for providers which can do that without transferring
+// anything (others are assumed to be reachable)
+func CheckRemoteConnection(provider providers.SyncProvider, remoteName string) error {
+	if connecting := providers.UpgradeToConnectingSyncProvider(provider); connecting != nil {
+		return connecting.CheckConnection(remoteName)
+	}
+	return nil
+}
+
+// Make the pushes queued for a remote, oldest first, removing each from the queue once it has
+// succeeded. Stops at the first which fails, leaving it & the rest queued. Queued pushes whose
+// commits no longer exist (e.g. they were rebased & garbage collected) are dropped with a warning.
+// started is called before each push is made
+func (r *Repo) FlushPushQueue(provider providers.SyncProvider, remoteName string, dryRun bool,
+	started func(push *QueuedPush), callback util.ProgressCallback) error {
+
+	pushes, err := r.GetQueuedPushes(remoteName)
+	if err != nil {
+		return err
+	}
+	return r.makeQueuedPushes(provider, remoteName, pushes, dryRun, started, callback, func(remaining []*QueuedPush) error {
+		return r.writePushQueue(remoteName, remaining)
+	})
+}
+
+// Make queued pushes to a remote, oldest first, calling update with those remaining after each
+// has succeeded or been dropped (except in dry run mode); see FlushPushQueue
+func (r *Repo) makeQueuedPushes(provider providers.SyncProvider, remoteName string, pushes []*QueuedPush, dryRun bool,
+	started func(push *QueuedPush), callback util.ProgressCallback, update func(remaining []*QueuedPush) error) error {
+
+	// Path filters are per queued push
+	includePaths, excludePaths := r.Options.PushIncludePaths, r.Options.PushExcludePaths
+	defer func() {
+		r.Options.PushIncludePaths, r.Options.PushExcludePaths = includePaths, excludePaths
+	}()
+
+	for len(pushes) > 0 {
+		push := pushes[0]
+		var refspecs []*GitRefSpec
+		valid := true
+		for _, commits := range push.Commits {
+			refspec := ParseGitRefSpec(commits)
+			if !r.GitRefOrSHAIsValid(refspec.Ref1) || (refspec.IsRange() && !r.GitRefOrSHAIsValid(refspec.Ref2)) {
+				valid = false
+				break
+			}
+			refspecs = append(refspecs, refspec)
+		}
+		if valid {
+			started(push)
+			r.Options.PushIncludePaths, r.Options.PushExcludePaths = push.IncludePaths, push.ExcludePaths
+			err := r.Push(provider, remoteName, refspecs, dryRun, push.Force, push.Recheck, callback)
+			if err != nil {
+				return err
+			}
+		} else {
+			r.Log.Errorf("Warning: dropping queued push of %v to %v, its commits no longer exist\n", push.Refspecs, remoteName)
+		}
+		pushes = pushes[1:]
+		if !dryRun {
+			err := update(pushes)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Push queue", func() {
+	root := filepath.Join(os.TempDir(), "PushQueueTest")
+	remotepath, _ := GetMockRemotePath("mock://PushQueueTest")
+	var oldwd string
+	var shas [][]string
+	callback := func(data *ProgressCallbackData) (abort bool) { return false }
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		LoadConfig(GlobalOptions)
+		GlobalOptions.GitConfig["remote.origin.git-lob-provider"] = "mock"
+		GlobalOptions.GitConfig["remote.origin.git-lob-url"] = "mock://PushQueueTest"
+		GlobalOptions.GitConfig["remote.origin.git-lob-mock-offline"] = "true"
+		InitCoreProviders()
+
+		shas = CreateManyCommitsForTest([][]string{[]string{"one.png"}}, 0,
+			func(filename string, i int) int64 { return int64(500 + i*100) })
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		os.RemoveAll(remotepath)
+		GlobalOptions = NewOptions()
+	})
+
+	It("Queues pushes while offline & makes them later", func() {
+		provider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil())
+		Expect(CheckRemoteConnection(provider, "origin")).ToNot(BeNil(), "Remote should be unreachable")
+
+		refspecs := []*GitRefSpec{&GitRefSpec{Ref1: "master"}}
+		push, err := testRepo().QueuePush("origin", refspecs, false, false)
+		Expect(err).To(BeNil())
+		Expect(push.Refspecs).To(Equal([]string{"master"}))
+		Expect(GitRefIsFullSHA(push.Commits[0])).To(BeTrue(), "Should record the commit master points to")
+		_, err = testRepo().QueuePush("origin", refspecs, false, false)
+		Expect(err).To(BeNil())
+		queued, err := testRepo().GetQueuedPushes("origin")
+		Expect(err).To(BeNil())
+		Expect(queued).To(HaveLen(1), "Should not queue the same push twice")
+		remotes, err := testRepo().GetRemotesWithQueuedPushes()
+		Expect(err).To(BeNil())
+		Expect(remotes).To(Equal([]string{"origin"}))
+
+		// master moves on after the push was queued
+		later := CreateManyCommitsForTest([][]string{[]string{"two.png"}}, 1,
+			func(filename string, i int) int64 { return int64(500 + i*100) })
+
+		started := func(push *QueuedPush) {}
+		Expect(testRepo().FlushPushQueue(provider, "origin", false, started, callback)).ToNot(BeNil(), "Should fail while offline")
+		queued, _ = testRepo().GetQueuedPushes("origin")
+		Expect(queued).To(HaveLen(1), "Failed push should stay queued")
+
+		delete(GlobalOptions.GitConfig, "remote.origin.git-lob-mock-offline")
+		Expect(CheckRemoteConnection(provider, "origin")).To(BeNil())
+		Expect(testRepo().FlushPushQueue(provider, "origin", false, started, callback)).To(BeNil())
+		Expect(provider.FileExists("origin", GetLOBMetaRelativePath(shas[0][0]))).To(BeTrue(), "Queued commit should be pushed")
+		Expect(provider.FileExists("origin", GetLOBMetaRelativePath(later[0][0]))).To(BeFalse(), "Later commits should not be pushed")
+		queued, _ = testRepo().GetQueuedPushes("origin")
+		Expect(queued).To(BeEmpty())
+		remotes, _ = testRepo().GetRemotesWithQueuedPushes()
+		Expect(remotes).To(BeEmpty())
+	})
+})
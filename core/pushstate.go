@@ -0,0 +1,475 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+	"github.com/atlassian/git-lob/util/lock"
+)
+
+// Push state transactions
+// A push marks commits as pushed one at a time as their binaries are uploaded, across all the
+// refspecs being pushed. Rather than rewriting the push state for every commit, a push is a
+// single transaction: each commit marked is appended to a journal next to the push state, and
+// the transaction is only applied to the push state when it's committed at the end of the push,
+// so other processes never see part of a push. A transaction sees its own changes though, so
+// later refspecs in a push benefit from the commits marked for earlier ones.
+// A transaction is open while its process holds its lock; if the process is killed or crashes,
+// the transaction is abandoned. Its changes are still good, since commits are only marked once
+// all their binaries are on the remote, so they're rolled forward by the next transaction or by
+// 'git lob push-state verify --fix' instead of everything having to be re-checked.
+// The journal is a header line, then one line per record:
+//   begin <id>
+//   mark <id> <commitsha> <replacecommitsha or ->
+//   commit <id>
+// Each record is a single append, so an interruption can at worst leave a partial last line,
+// which is ignored since it has no line ending.
+
+const (
+	// First line of push state journal files
+	pushStateJournalHeader = "git-lob-push-state-journal 1"
+	// Suffix of the push state journal
+	pushStateJournalSuffix = ".journal"
+	// Records in the push state journal
+	pushStateJournalBegin  = "begin"
+	pushStateJournalMark   = "mark"
+	pushStateJournalCommit = "commit"
+)
+
+// A set of changes to the push state for a remote which are applied together, see above
+type PushStateTransaction struct {
+	repo       *Repo
+	remoteName string
+	id         string
+	// Held while the transaction is open
+	lock *lock.Lock
+	// Number of commits marked
+	marked int
+}
+
+// A transaction read back from the push state journal
+type pushStateJournalTx struct {
+	id string
+	// Pairs of commit SHA & the commit SHA it replaces (blank if none)
+	marks     [][2]string
+	committed bool
+}
+
+type pushStateJournal struct {
+	// In the order they were begun
+	txs []*pushStateJournalTx
+	// Number of records which were incomplete or not understood
+	invalid int
+}
+
+// Gets the file which holds the push state journal for a remote
+func (r *Repo) getPushStateJournalFile(remoteName string) string {
+	return r.getRemoteStateCacheFile(remoteName) + pushStateJournalSuffix
+}
+
+// Gets the lock file held while a transaction is open
+func (r *Repo) getPushStateTransactionLockFile(remoteName, id string) string {
+	return fmt.Sprintf("%v.%v%v", r.getRemoteStateCacheFile(remoteName), id, pushStateLockSuffix)
+}
+
+func (r *Repo) isOpenPushStateTransaction(id string) bool {
+	r.openPushStateTransactionsMutex.Lock()
+	defer r.openPushStateTransactionsMutex.Unlock()
+	return r.openPushStateTransactions.Contains(id)
+}
+
+// Start a transaction to change the push state for a remote
+// Any transactions which were abandoned are rolled forward first
+func (r *Repo) BeginPushStateTransaction(remoteName string) (*PushStateTransaction, error) {
+	id := fmt.Sprintf("%x-%d", time.Now().UnixNano(), os.Getpid())
+	txlock, err := lock.Acquire(r.getPushStateTransactionLockFile(remoteName, id), PushStateLockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to lock push state for %v: %v", remoteName, err.Error())
+	}
+	l, err := r.lockPushedState(remoteName)
+	if err != nil {
+		txlock.Release()
+		return nil, err
+	}
+	defer l.Release()
+
+	if recovered, err := r.recoverAbandonedPushStateLocked(remoteName); err != nil {
+		r.Log.Errorf("Unable to recover push state for %v from an interrupted push: %v\n", remoteName, err.Error())
+	} else if recovered > 0 {
+		r.Log.Debugf("Recovered %d commits marked as pushed to %v by an interrupted push\n", recovered, remoteName)
+	}
+	err = r.appendPushStateJournalLocked(remoteName, pushStateJournalBegin+" "+id)
+	if err != nil {
+		txlock.Release()
+		return nil, err
+	}
+	r.openPushStateTransactionsMutex.Lock()
+	if r.openPushStateTransactions == nil {
+		r.openPushStateTransactions = util.NewStringSet()
+	}
+	r.openPushStateTransactions.Add(id)
+	r.openPushStateTransactionsMutex.Unlock()
+	return &PushStateTransaction{repo: r, remoteName: remoteName, id: id, lock: txlock}, nil
+}
+
+// Record that binaries have been pushed at a commit, as part of this transaction
+// replaceCommitSHA is the same as for MarkBinariesAsPushed
+func (self *PushStateTransaction) MarkBinariesAsPushed(commitSHA, replaceCommitSHA string) error {
+	if self.lock == nil {
+		return errors.New("Push state transaction is already finished")
+	}
+	if !GitRefIsFullSHA(commitSHA) {
+		return fmt.Errorf("Invalid commit SHA, must be full 40 char SHA, not '%v'", commitSHA)
+	}
+	if replaceCommitSHA == "" {
+		replaceCommitSHA = "-"
+	}
+	l, err := self.repo.lockPushedState(self.remoteName)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	err = self.repo.appendPushStateJournalLocked(self.remoteName,
+		strings.Join([]string{pushStateJournalMark, self.id, commitSHA, replaceCommitSHA}, " "))
+	if err == nil {
+		self.marked++
+	}
+	return err
+}
+
+// Apply everything marked in this transaction to the push state, & finish it
+// Does nothing if the transaction is already finished
+func (self *PushStateTransaction) Commit() error {
+	if self.lock == nil {
+		return nil
+	}
+	defer self.finish()
+	l, err := self.repo.lockPushedState(self.remoteName)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	err = self.repo.appendPushStateJournalLocked(self.remoteName, pushStateJournalCommit+" "+self.id)
+	if err != nil {
+		return err
+	}
+	// Now committed, applying it to the push state is just tidying up
+	return self.repo.writePushedStateLocked(self.remoteName, self.repo.readPushedStateIncluding(self.remoteName, false))
+}
+
+func (self *PushStateTransaction) finish() {
+	self.repo.openPushStateTransactionsMutex.Lock()
+	self.repo.openPushStateTransactions.Remove(self.id)
+	self.repo.openPushStateTransactionsMutex.Unlock()
+	self.lock.Release()
+	self.lock = nil
+}
+
+// Has the process which began a transaction gone away without committing it?
+func (r *Repo) isAbandonedPushStateTransaction(tx *pushStateJournalTx, remoteName string) bool {
+	if tx.committed || r.isOpenPushStateTransaction(tx.id) {
+		return false
+	}
+	lockfile := r.getPushStateTransactionLockFile(remoteName, tx.id)
+	return !util.FileExists(lockfile) || lock.IsStale(lockfile)
+}
+
+// Apply the commits marked in a transaction to a sorted list of pushed commits
+func (self *pushStateJournalTx) apply(shas []string) []string {
+	for _, mark := range self.marks {
+		shas = applyPushedMark(shas, mark[0], mark[1])
+	}
+	return shas
+}
+
+// Add a line to the push state journal, when the push state lock is held
+func (r *Repo) appendPushStateJournalLocked(remoteName, record string) error {
+	filename := r.getPushStateJournalFile(remoteName)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to write push state journal %v: %v", filename, err.Error())
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err == nil {
+		if fi.Size() == 0 {
+			_, err = f.WriteString(pushStateJournalHeader + "\n")
+		} else {
+			// Don't run on from a partial line left by an interruption
+			last := make([]byte, 1)
+			if _, err = f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+				_, err = f.WriteString("\n")
+			}
+		}
+	}
+	if err == nil {
+		_, err = f.WriteString(record + "\n")
+	}
+	if err == nil {
+		// Must really be on disk before we carry on, e.g. upload the next commit
+		err = f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write push state journal %v: %v", filename, err.Error())
+	}
+	return nil
+}
+
+// Read the push state journal for a remote, or nil if there isn't one
+func (r *Repo) readPushStateJournal(remoteName string) (*pushStateJournal, error) {
+	filename := r.getPushStateJournalFile(remoteName)
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read push state journal %v: %v", filename, err.Error())
+	}
+	defer f.Close()
+	rdr := bufio.NewReader(f)
+	line, err := rdr.ReadString('\n')
+	if err != nil || strings.TrimRight(line, "\r\n") != pushStateJournalHeader {
+		return nil, fmt.Errorf("Push state journal %v is not valid", filename)
+	}
+	j := &pushStateJournal{}
+	txs := make(map[string]*pushStateJournalTx)
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			// Only complete lines count, an interruption could leave a partial last line
+			if len(line) > 0 {
+				j.invalid++
+			}
+			break
+		}
+		fields := strings.Fields(line)
+		var tx *pushStateJournalTx
+		if len(fields) > 1 {
+			tx = txs[fields[1]]
+		}
+		switch {
+		case len(fields) == 2 && fields[0] == pushStateJournalBegin && tx == nil:
+			tx = &pushStateJournalTx{id: fields[1]}
+			txs[tx.id] = tx
+			j.txs = append(j.txs, tx)
+		case len(fields) == 4 && fields[0] == pushStateJournalMark && tx != nil && !tx.committed &&
+			GitRefIsFullSHA(fields[2]) && (fields[3] == "-" || GitRefIsFullSHA(fields[3])):
+			replace := fields[3]
+			if replace == "-" {
+				replace = ""
+			}
+			tx.marks = append(tx.marks, [2]string{fields[2], replace})
+		case len(fields) == 2 && fields[0] == pushStateJournalCommit && tx != nil:
+			tx.committed = true
+		default:
+			j.invalid++
+		}
+	}
+	return j, nil
+}
+
+// Rewrite the push state journal once the push state includes its committed transactions,
+// keeping only transactions which aren't committed yet (or removing it if there are none)
+func (r *Repo) compactPushStateJournalLocked(remoteName string) error {
+	j, err := r.readPushStateJournal(remoteName)
+	if err != nil || j == nil {
+		// Nothing usable to keep
+		os.Remove(r.getPushStateJournalFile(remoteName))
+		return nil
+	}
+	var lines []string
+	for _, tx := range j.txs {
+		if tx.committed {
+			continue
+		}
+		lines = append(lines, pushStateJournalBegin+" "+tx.id)
+		for _, mark := range tx.marks {
+			replace := mark[1]
+			if replace == "" {
+				replace = "-"
+			}
+			lines = append(lines, strings.Join([]string{pushStateJournalMark, tx.id, mark[0], replace}, " "))
+		}
+	}
+	filename := r.getPushStateJournalFile(remoteName)
+	if len(lines) == 0 {
+		err = os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Unable to remove push state journal %v: %v", filename, err.Error())
+		}
+		return nil
+	}
+	tmpfilename := filename + ".tmp"
+	content := pushStateJournalHeader + "\n" + strings.Join(lines, "\n") + "\n"
+	f, err := os.OpenFile(tmpfilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err == nil {
+		_, err = f.WriteString(content)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpfilename, filename)
+	}
+	if err != nil {
+		os.Remove(tmpfilename)
+		return fmt.Errorf("Unable to write push state journal %v: %v", filename, err.Error())
+	}
+	return nil
+}
+
+// Commit transactions which were abandoned, when the push state lock is held
+// Returns the number of commits marked as pushed they contained
+func (r *Repo) recoverAbandonedPushStateLocked(remoteName string) (int, error) {
+	j, err := r.readPushStateJournal(remoteName)
+	if err != nil || j == nil {
+		return 0, err
+	}
+	recovered := 0
+	var abandoned []*pushStateJournalTx
+	for _, tx := range j.txs {
+		if r.isAbandonedPushStateTransaction(tx, remoteName) {
+			abandoned = append(abandoned, tx)
+			recovered += len(tx.marks)
+		}
+	}
+	if len(abandoned) == 0 {
+		return 0, nil
+	}
+	for _, tx := range abandoned {
+		err = r.appendPushStateJournalLocked(remoteName, pushStateJournalCommit+" "+tx.id)
+		if err != nil {
+			return 0, err
+		}
+		os.Remove(r.getPushStateTransactionLockFile(remoteName, tx.id))
+	}
+	return recovered, r.writePushedStateLocked(remoteName, r.readPushedStateIncluding(remoteName, false))
+}
+
+// Apply the push state journal to the push state read from disk: committed transactions, plus
+// those open in this process if includeOwn
+func (r *Repo) applyPushStateJournal(remoteName string, shas []string, includeOwn bool) []string {
+	j, err := r.readPushStateJournal(remoteName)
+	if err != nil {
+		r.Log.Errorf("Ignoring push state journal for %v (%v)\n", remoteName, err.Error())
+		return shas
+	}
+	if j == nil {
+		return shas
+	}
+	for _, tx := range j.txs {
+		if tx.committed || (includeOwn && r.isOpenPushStateTransaction(tx.id)) {
+			shas = tx.apply(shas)
+		}
+	}
+	return shas
+}
+
+// Insert a commit into a sorted list of pushed commits, replacing replaceCommitSHA if it's
+// present & not blank (see MarkBinariesAsPushed)
+func applyPushedMark(shas []string, commitSHA, replaceCommitSHA string) []string {
+	alreadyPresent, _ := util.StringBinarySearch(shas, commitSHA)
+	if alreadyPresent {
+		return shas
+	}
+	if replaceCommitSHA != "" {
+		found, insertAt := util.StringBinarySearch(shas, replaceCommitSHA)
+		if found {
+			shas[insertAt] = commitSHA
+		} else {
+			shas = append(shas, commitSHA)
+		}
+	} else {
+		shas = append(shas, commitSHA)
+	}
+	sort.Strings(shas)
+	return shas
+}
+
+// Check the push state for a remote for problems, & repair them if fix is true
+// Returns a description of each problem found; the push state is always usable despite these
+// (at worst, commits are re-checked on the next push), so they only need fixing to avoid that
+func (r *Repo) VerifyPushState(remoteName string, fix bool) ([]string, error) {
+	if !r.hasRemoteStateCache(remoteName) {
+		return nil, nil
+	}
+	l, err := r.lockPushedState(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Release()
+
+	var problems []string
+	rewrite := false
+	filename := r.getRemoteStateCacheFile(remoteName)
+	if util.FileExists(filename) {
+		if _, err := readPushedStateFile(filename); err != nil {
+			if _, backuperr := readPushedStateFile(filename + pushStateBackupSuffix); backuperr == nil {
+				problems = append(problems, fmt.Sprintf("Push state is corrupt (%v), the previous push state will be restored", err.Error()))
+			} else {
+				problems = append(problems, fmt.Sprintf("Push state is corrupt (%v) & there is no usable backup, all commits will be re-checked on next push", err.Error()))
+			}
+			rewrite = true
+		}
+	}
+
+	j, err := r.readPushStateJournal(remoteName)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Push state journal is unusable (%v)", err.Error()))
+		if fix {
+			os.Remove(r.getPushStateJournalFile(remoteName))
+		}
+	} else if j != nil {
+		if j.invalid > 0 {
+			problems = append(problems, fmt.Sprintf("%d incomplete or invalid records in push state journal", j.invalid))
+			rewrite = true
+		}
+		committed := 0
+		for _, tx := range j.txs {
+			if tx.committed {
+				committed += len(tx.marks)
+			} else if r.isAbandonedPushStateTransaction(tx, remoteName) {
+				problems = append(problems, fmt.Sprintf("Push %v was interrupted, %d commits it marked as pushed were not committed", tx.id, len(tx.marks)))
+				if fix {
+					err = r.appendPushStateJournalLocked(remoteName, pushStateJournalCommit+" "+tx.id)
+					if err != nil {
+						return problems, err
+					}
+					os.Remove(r.getPushStateTransactionLockFile(remoteName, tx.id))
+				}
+				rewrite = true
+			}
+		}
+		if committed > 0 {
+			problems = append(problems, fmt.Sprintf("%d commits marked as pushed were committed but not applied to push state", committed))
+			rewrite = true
+		}
+	}
+
+	shas := r.readPushedStateIncluding(remoteName, false)
+	valid := make([]string, 0, len(shas))
+	for _, sha := range shas {
+		if r.GitRefOrSHAIsValid(sha) {
+			valid = append(valid, sha)
+		}
+	}
+	if len(valid) != len(shas) {
+		problems = append(problems, fmt.Sprintf("%d commits marked as pushed no longer exist in this repository", len(shas)-len(valid)))
+		rewrite = true
+	}
+
+	if fix && rewrite {
+		err = r.writePushedStateLocked(remoteName, valid)
+		if err != nil {
+			return problems, err
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+const (
+	// Settings for git-lob.push-verify / push --verify
+	PushVerifyNone = ""
+	// Check the metadata on the remote matches & every chunk is there at the right size
+	PushVerifyQuick = "quick"
+	// Download everything again & check the content SHA
+	PushVerifyDeep = "deep"
+)
+
+// Get the SHAs of all the LOBs pushed for a commit
+// Failed deltas are added to the files too, so a SHA is only included once
+func getPushedLOBSHAs(commit *PushCommitContentDetails) []string {
+	var ret []string
+	seen := util.NewStringSet()
+	for _, delta := range commit.Deltas {
+		if seen.Add(delta.TargetSHA) {
+			ret = append(ret, delta.TargetSHA)
+		}
+	}
+	// Every LOB uploaded file by file includes its meta file, even if it was already on the remote
+	metasuffix := getLOBMetaFilename("")
+	for _, file := range commit.Files {
+		if strings.HasSuffix(file, metasuffix) {
+			sha := strings.TrimSuffix(filepath.Base(file), metasuffix)
+			if seen.Add(sha) {
+				ret = append(ret, sha)
+			}
+		}
+	}
+	return ret
+}
+
+// Read back the LOBs pushed for a commit from the remote, to catch storage-side corruption
+// before the commit is marked as pushed (see PushVerifyQuick / PushVerifyDeep)
+func (r *Repo) verifyPushedCommit(commit *PushCommitContentDetails, provider providers.SyncProvider, remoteName string,
+	mode string, callback util.ProgressCallback) error {
+
+	var errs []string
+	for _, sha := range getPushedLOBSHAs(commit) {
+		localinfo, err := r.getLOBInfoInBaseDir(sha, commit.BaseDir)
+		if err != nil {
+			// Not pushed, missing LOBs are reported when the commit is calculated
+			continue
+		}
+		// Progress must end with ItemBytes > 0
+		progressSize := localinfo.Size
+		if progressSize == 0 {
+			progressSize = 1
+		}
+		callback(&util.ProgressCallbackData{util.ProgressVerifying, sha, 0, progressSize, 0, 0, nil})
+		err = r.verifyPushedLOB(localinfo, provider, remoteName, mode == PushVerifyDeep)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		callback(&util.ProgressCallbackData{util.ProgressVerifying, sha, progressSize, progressSize, 0, 0, nil})
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Verification of binaries pushed to %v for commit %v failed:\n%v\nRun 'git lob push --force' to upload them again",
+			remoteName, commit.CommitSHA, strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Read back a single LOB from the remote & check it matches what we have locally
+func (r *Repo) verifyPushedLOB(localinfo *LOBInfo, provider providers.SyncProvider, remoteName string, deep bool) error {
+	sha := localinfo.SHA
+	tmpdir, err := ioutil.TempDir("", "git-lob-verify")
+	if err != nil {
+		return fmt.Errorf("Unable to create temporary folder to verify %v: %v", sha, err.Error())
+	}
+	defer os.RemoveAll(tmpdir)
+
+	nocallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+		return false
+	}
+	err = provider.Download(remoteName, []string{GetLOBMetaRelativePath(sha)}, tmpdir, true, nocallback)
+	if err != nil {
+		return fmt.Errorf("%v: unable to download metadata: %v", sha, err.Error())
+	}
+	remoteinfo, err := r.getLOBInfoInBaseDir(sha, tmpdir)
+	if err != nil {
+		return fmt.Errorf("%v: metadata missing or unreadable on remote: %v", sha, err.Error())
+	}
+	// The remote may store it differently, e.g. re-stored from a delta with the server's own
+	// compression & chunking, or stored earlier by someone else; only the content has to match
+	if remoteinfo.SHA != localinfo.SHA || remoteinfo.Size != localinfo.Size {
+		return fmt.Errorf("%v: metadata on remote does not match, size %d expected %d", sha, remoteinfo.Size, localinfo.Size)
+	}
+
+	if !deep {
+		for i := 0; i < remoteinfo.NumChunks; i++ {
+			relchunk := getLOBChunkRelativePathForInfo(remoteinfo, i)
+			expectedSize := getLOBExpectedChunkSize(remoteinfo, i)
+			if !provider.FileExistsAndIsOfSize(remoteName, relchunk, expectedSize) {
+				return fmt.Errorf("%v: %v is missing or the wrong size on remote, expected %d bytes", sha, relchunk, expectedSize)
+			}
+		}
+		return nil
+	}
+
+	var chunks []string
+	for i := 0; i < remoteinfo.NumChunks; i++ {
+		chunks = append(chunks, getLOBChunkRelativePathForInfo(remoteinfo, i))
+	}
+	err = provider.Download(remoteName, chunks, tmpdir, true, nocallback)
+	if err != nil {
+		return fmt.Errorf("%v: unable to download content: %v", sha, err.Error())
+	}
+	_, _, err = r.getLOBFilesForSHA(sha, tmpdir, true, true)
+	if err != nil {
+		if IsIntegrityError(err) {
+			return fmt.Errorf("%v: content on remote is corrupt", sha)
+		}
+		return fmt.Errorf("%v: %v", sha, err.Error())
+	}
+	return nil
+}
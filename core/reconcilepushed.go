@@ -0,0 +1,243 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Reconciling push state after history is rewritten
+// After a rebase, squash or amend the commits recorded as pushed may no longer be reachable from
+// any ref, or may have been removed from the repository altogether; git log fails on the ones
+// which are gone, and the rest no longer shorten the search for what to push. The rewritten
+// commit is found from the branch reflogs (the value the branch moved to from the stale one),
+// and if the binaries its history adds are all ones the stale commit's history added (so they
+// were pushed with it), it's recorded as pushed instead. Stale commits which can't be remapped
+// are kept while they still exist, since they still exclude the history they share with
+// surviving branches, and dropped once they don't.
+
+// The outcome of reconciling the push state of a remote
+type ReconcilePushedResult struct {
+	// Number of commits recorded as pushed which are still reachable from a ref
+	Current int
+	// Stale commits remapped to the rewritten commit which replaced them
+	Remapped map[string]string
+	// Stale commits kept because they still exist but couldn't be remapped
+	Kept []string
+	// Stale commits dropped because they no longer exist & couldn't be remapped
+	Dropped []string
+}
+
+// Did reconciling change the push state?
+func (self *ReconcilePushedResult) Changed() bool {
+	return len(self.Remapped) > 0 || len(self.Dropped) > 0
+}
+
+// Remap commits recorded as pushed to a remote which are no longer reachable from any ref to
+// the commits which replaced them, see above. Only reports if dryRun
+func (r *Repo) ReconcilePushedState(remoteName string, dryRun bool) (*ReconcilePushedResult, error) {
+	result := &ReconcilePushedResult{Remapped: make(map[string]string)}
+	if !r.hasRemoteStateCache(remoteName) {
+		return result, nil
+	}
+	l, err := r.lockPushedState(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Release()
+	pushed := r.readPushedStateIncluding(remoteName, false)
+
+	// Missing commits would make git rev-list fail, so check them separately
+	var existing, missing []string
+	for _, sha := range pushed {
+		if r.GitRefOrSHAIsValid(sha) {
+			existing = append(existing, sha)
+		} else {
+			missing = append(missing, sha)
+		}
+	}
+	unreachable, err := r.getGitCommitsUnreachableFromRefs(existing)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) == 0 && len(unreachable) == 0 {
+		result.Current = len(pushed)
+		return result, nil
+	}
+	successors, err := r.getGitBranchReflogSuccessors()
+	if err != nil {
+		return nil, err
+	}
+
+	var current, stale []string
+	for _, sha := range existing {
+		if unreachable.Contains(sha) {
+			stale = append(stale, sha)
+		} else {
+			current = append(current, sha)
+		}
+	}
+	result.Current = len(current)
+	newstate := append([]string{}, current...)
+	for _, sha := range append(stale, missing...) {
+		// Can only check what a commit which still exists added
+		exists := unreachable.Contains(sha)
+		survivor := r.findSurvivingCommit(sha, successors)
+		if survivor != "" && exists {
+			ok, err := r.commitAddsOnlyLOBsFrom(survivor, sha, current)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				result.Remapped[sha] = survivor
+				newstate = append(newstate, survivor)
+				continue
+			}
+		}
+		if exists {
+			result.Kept = append(result.Kept, sha)
+			newstate = append(newstate, sha)
+		} else {
+			result.Dropped = append(result.Dropped, sha)
+		}
+	}
+
+	if dryRun || !result.Changed() {
+		return result, nil
+	}
+	return result, r.writePushedStateLocked(remoteName, r.consolidateCommitsToLatestDescendants(newstate))
+}
+
+// Follow the branch reflogs from a stale commit to the first commit a branch moved to from it
+// which is still reachable, or "" if there isn't one
+func (r *Repo) findSurvivingCommit(sha string, successors map[string][]string) string {
+	visited := util.NewStringSet()
+	queue := []string{sha}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, s := range successors[next] {
+			if !visited.Add(s) {
+				continue
+			}
+			if r.GitRefOrSHAIsValid(s) {
+				unreachable, err := r.getGitCommitsUnreachableFromRefs([]string{s})
+				if err == nil && len(unreachable) == 0 {
+					return s
+				}
+			}
+			queue = append(queue, s)
+		}
+	}
+	return ""
+}
+
+// Does the history of commit only add LOBs which the history of stale added, apart from history
+// shared with each other or with commits already recorded as pushed?
+func (r *Repo) commitAddsOnlyLOBsFrom(commit, stale string, pushed []string) (bool, error) {
+	staleLOBs := util.NewStringSet()
+	err := r.walkGitLOBsAddedInRange(stale, append([]string{commit}, pushed...), func(commitLOB *CommitLOBRef) (quit bool, err error) {
+		for _, lob := range commitLOB.LobSHAs {
+			staleLOBs.Add(lob)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	ok := true
+	err = r.walkGitLOBsAddedInRange(commit, append([]string{stale}, pushed...), func(commitLOB *CommitLOBRef) (quit bool, err error) {
+		for _, lob := range commitLOB.LobSHAs {
+			if !staleLOBs.Contains(lob) {
+				ok = false
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	return ok, err
+}
+
+// Walk the commits which add LOB references in the history of ref which isn't shared with exclude
+func (r *Repo) walkGitLOBsAddedInRange(ref string, exclude []string, callback func(commitLOB *CommitLOBRef) (quit bool, err error)) error {
+	args := []string{"log", `--format=commitsha: %H %P`, "-p", "--topo-order", "--reverse",
+		"-G", SHALineRegexStr, ref}
+	for _, e := range exclude {
+		args = append(args, "^"+e)
+	}
+	cmd := r.command("git", args...)
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Unable to list commits from %v: %v", ref, err.Error())
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Unable to list commits from %v: %v", ref, err.Error())
+	}
+	quit, err := walkGitLogOutputForLOBReferences(outp, true, false, nil, nil, callback)
+	if quit || err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if procerr := cmd.Wait(); procerr != nil {
+		return fmt.Errorf("Unable to list commits from %v: %v", ref, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Of a list of commits which exist, return those which aren't reachable from any ref
+func (r *Repo) getGitCommitsUnreachableFromRefs(shas []string) (util.StringSet, error) {
+	ret := util.NewStringSet()
+	if len(shas) == 0 {
+		return ret, nil
+	}
+	// Lists the commits reachable from these but not from any ref
+	args := append([]string{"rev-list"}, shas...)
+	args = append(args, "--not", "--all")
+	outp, err := r.command("git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to call git rev-list: %v", err.Error())
+	}
+	listed := util.NewStringSet()
+	scanner := bufio.NewScanner(bytes.NewReader(outp))
+	for scanner.Scan() {
+		listed.Add(strings.TrimSpace(scanner.Text()))
+	}
+	for _, sha := range shas {
+		if listed.Contains(sha) {
+			ret.Add(sha)
+		}
+	}
+	return ret, nil
+}
+
+// Get the commits each local branch moved to from each commit, according to the branch reflogs
+func (r *Repo) getGitBranchReflogSuccessors() (map[string][]string, error) {
+	ret := make(map[string][]string)
+	seen := util.NewStringSet()
+	branches, err := r.command("git", "for-each-ref", "--format=%(refname)", "refs/heads").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list branches: %v", err.Error())
+	}
+	for _, branch := range strings.Fields(string(branches)) {
+		// Newest first; no reflog is an empty list
+		outp, err := r.command("git", "log", "-g", "--format=%H", branch, "--").Output()
+		if err != nil {
+			continue
+		}
+		values := strings.Fields(string(outp))
+		for i := 0; i+1 < len(values); i++ {
+			from, to := values[i+1], values[i]
+			if from != to && seen.Add(from+" "+to) {
+				ret[from] = append(ret[from], to)
+			}
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Reconcile pushed", func() {
+	root := filepath.Join(os.TempDir(), "ReconcilePushedTest")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		CreateInitialCommitForTest(root)
+		CreateManyCommitsForTest([][]string{[]string{"one.png"}, []string{"two.png"}}, 0,
+			func(filename string, i int) int64 { return 1000 })
+		// Tags would keep the rewritten commits reachable
+		RunGitCommandForTest(true, "tag", "-d", "Tag0", "Tag1")
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		ForceRemoveAll(root)
+	})
+	head := func() string {
+		return strings.TrimSpace(RunGitCommandForTest(true, "rev-parse", "HEAD"))
+	}
+
+	It("Remaps rewritten commits & keeps or drops those it can't", func() {
+		pushed := head()
+		Expect(testRepo().MarkBinariesAsPushed("origin", pushed, "")).To(BeNil())
+		result, err := testRepo().ReconcilePushedState("origin", false)
+		Expect(err).To(BeNil())
+		Expect(result.Changed()).To(BeFalse())
+		Expect(result.Current).To(Equal(1))
+
+		RunGitCommandForTest(true, "commit", "--amend", "-m", "Reworded")
+		rewritten := head()
+		result, err = testRepo().ReconcilePushedState("origin", true)
+		Expect(err).To(BeNil())
+		Expect(result.Remapped).To(Equal(map[string]string{pushed: rewritten}))
+		Expect(testRepo().GetPushedCommits("origin")).To(Equal([]string{pushed}), "Dry run should not change push state")
+		result, err = testRepo().ReconcilePushedState("origin", false)
+		Expect(err).To(BeNil())
+		Expect(result.Remapped).To(HaveLen(1))
+		Expect(testRepo().GetPushedCommits("origin")).To(Equal([]string{rewritten}))
+
+		// Rewritten with a binary which wasn't pushed
+		ioutil.WriteFile(filepath.Join(root, "three.png"), []byte(fmt.Sprintf("git-lob: %v", GetListOfRandomSHAsForTest(1)[0])), 0644)
+		RunGitCommandForTest(true, "add", "three.png")
+		RunGitCommandForTest(true, "commit", "--amend", "-m", "Added three")
+		result, err = testRepo().ReconcilePushedState("origin", false)
+		Expect(err).To(BeNil())
+		Expect(result.Remapped).To(BeEmpty())
+		Expect(result.Kept).To(Equal([]string{rewritten}))
+		Expect(testRepo().GetPushedCommits("origin")).To(Equal([]string{rewritten}))
+
+		missing := "1111111111222222222233333333334444444444"
+		Expect(testRepo().MarkBinariesAsPushed("origin", missing, "")).To(BeNil())
+		result, err = testRepo().ReconcilePushedState("origin", false)
+		Expect(err).To(BeNil())
+		Expect(result.Dropped).To(Equal([]string{missing}))
+		Expect(testRepo().GetPushedCommits("origin")).To(Equal([]string{rewritten}))
+	})
+})
@@ -0,0 +1,20 @@
+// +build darwin
+
+package core
+
+import (
+	"os"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/golang.org/x/sys/unix"
+)
+
+// Create a copy-on-write clone (reflink) of a file, which shares storage with the
+// original until either is modified (APFS clonefile)
+// Returns an error if the filesystem does not support it, link must not exist
+func CreateReflink(target, link string) error {
+	err := unix.Clonefile(target, link, unix.CLONE_NOFOLLOW)
+	if err != nil {
+		return &os.LinkError{Op: "clonefile", Old: target, New: link, Err: err}
+	}
+	return nil
+}
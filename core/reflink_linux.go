@@ -0,0 +1,33 @@
+// +build linux
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+// ioctl to share the extents of one file with another (btrfs, XFS & others)
+const ficlone = 0x40049409
+
+// Create a copy-on-write clone (reflink) of a file, which shares storage with the
+// original until either is modified
+// Returns an error if the filesystem does not support it, link must not exist
+func CreateReflink(target, link string) error {
+	src, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(link, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	dst.Close()
+	if errno != 0 {
+		os.Remove(link)
+		return &os.LinkError{Op: "reflink", Old: target, New: link, Err: errno}
+	}
+	return nil
+}
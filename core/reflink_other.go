@@ -0,0 +1,14 @@
+// +build !linux,!darwin
+
+package core
+
+import (
+	"errors"
+	"os"
+)
+
+// Create a copy-on-write clone (reflink) of a file
+// Not supported on this platform, always returns an error
+func CreateReflink(target, link string) error {
+	return &os.LinkError{Op: "reflink", Old: target, New: link, Err: errors.New("not supported on this platform")}
+}
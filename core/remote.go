@@ -2,28 +2,47 @@ package core
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
+	"time"
 
 	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/util"
+	"github.com/atlassian/git-lob/util/lock"
 )
 
+const (
+	// First word of the header line of push state files
+	pushStateHeader = "git-lob-push-state"
+	// Current version of the push state file format
+	pushStateVersion = 1
+	// Suffix of the backup of the previous good push state
+	pushStateBackupSuffix = ".bak"
+	// Suffix of the lock held while updating push state
+	pushStateLockSuffix = ".lock"
+)
+
+// How long to wait for another process (e.g. a concurrent push) to finish updating push state
+var PushStateLockTimeout = 30 * time.Second
+
 // Do we have a remote state cache for this remote yet?
-func hasRemoteStateCache(remoteName string) bool {
-	dir := filepath.Join(util.GetGitDir(), "git-lob", "state", "remotes", remoteName)
+func (r *Repo) hasRemoteStateCache(remoteName string) bool {
+	dir := filepath.Join(r.GitDir, "git-lob", "state", "remotes", remoteName)
 	return util.DirExists(dir)
 }
 
 // Gets the root directory of the remote state cache for a given remote
-func getRemoteStateCacheRoot(remoteName string) string {
-	ret := filepath.Join(util.GetGitDir(), "git-lob", "state", "remotes", remoteName)
+func (r *Repo) getRemoteStateCacheRoot(remoteName string) string {
+	ret := filepath.Join(r.GitDir, "git-lob", "state", "remotes", remoteName)
 	err := os.MkdirAll(ret, 0755)
 	if err != nil {
-		util.LogErrorf("Unable to create remote state cache folder at %v: %v", ret, err)
+		r.Log.Errorf("Unable to create remote state cache folder at %v: %v", ret, err)
 		panic(err)
 	}
 	return ret
@@ -32,17 +51,17 @@ func getRemoteStateCacheRoot(remoteName string) string {
 // Gets the file name which will store a given commitSHA if binaries are thought to
 // be up to date at that commit on that remote
 // REMOVE
-func getRemoteStateCacheFileForCommit(remoteName, commitSHA string) string {
+func (r *Repo) getRemoteStateCacheFileForCommit(remoteName, commitSHA string) string {
 
 	// Use a simple DB format based on commit SHA
 	// e.g. for SHA 37d1cd1e4bd8f4853002ef6a5c8211d89fc09be2
 	// cacheroot/37d/1cd/1e4/bd8/f48.txt
 	// Every commit that starts with 37d1cd1e4bd8f48 will be stored in that text file, sorted
-	dir := filepath.Join(getRemoteStateCacheRoot(remoteName),
+	dir := filepath.Join(r.getRemoteStateCacheRoot(remoteName),
 		commitSHA[:3], commitSHA[3:6], commitSHA[6:9], commitSHA[9:12])
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
-		util.LogErrorf("Unable to create remote state cache folder at %v: %v", dir, err)
+		r.Log.Errorf("Unable to create remote state cache folder at %v: %v", dir, err)
 		panic(err)
 	}
 	file := filepath.Join(dir, commitSHA[12:15])
@@ -50,16 +69,16 @@ func getRemoteStateCacheFileForCommit(remoteName, commitSHA string) string {
 }
 
 // Gets the file name which will store when we last pushed binaries
-func getRemoteStateCacheFile(remoteName string) string {
+func (r *Repo) getRemoteStateCacheFile(remoteName string) string {
 
 	// Use a simple DB format based on commit SHA
 	// e.g. for SHA 37d1cd1e4bd8f4853002ef6a5c8211d89fc09be2
 	// cacheroot/37d/1cd/1e4/bd8/f48.txt
 	// Every commit that starts with 37d1cd1e4bd8f48 will be stored in that text file, sorted
-	dir := getRemoteStateCacheRoot(remoteName)
+	dir := r.getRemoteStateCacheRoot(remoteName)
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
-		util.LogErrorf("Unable to create remote state cache folder at %v: %v", dir, err)
+		r.Log.Errorf("Unable to create remote state cache folder at %v: %v", dir, err)
 		panic(err)
 	}
 	file := filepath.Join(dir, "push_state")
@@ -69,7 +88,7 @@ func getRemoteStateCacheFile(remoteName string) string {
 // Initialise the 'pushed' markers for all recent commits, if we can be sure we can do it
 // Most common case: just after clone
 // Returns whether we met the requirements to do this
-func InitSuccessfullyPushedCacheIfAppropriate() bool {
+func (r *Repo) InitSuccessfullyPushedCacheIfAppropriate() bool {
 	// Things get complex when you can have a combination of binaries which need fetching and
 	// which might need pushing. Our push cache errs on the side of caution since binaries may
 	// have been added from multiple sources so we check we pushed (or don't need to) before
@@ -83,28 +102,28 @@ func InitSuccessfullyPushedCacheIfAppropriate() bool {
 	// We can mark all known remotes as pushed.
 
 	// Adding a new remote (e.g. a fork) will however cause everything to be checked again.
-	if IsLocalLOBStoreEmpty() {
+	if r.IsLocalLOBStoreEmpty() {
 		// No binaries locally so everything can be marked as pushed
-		remotes, err := GetGitRemotes()
+		remotes, err := r.GetGitRemotes()
 		if err != nil {
-			util.LogErrorf("Unable to get remotes to mark as pushed %v\n", err.Error())
+			r.Log.Errorf("Unable to get remotes to mark as pushed %v\n", err.Error())
 			return false
 		}
 		// Mark as pushed at all refs (local branches, remote branches, tags)
-		refs, err := GetGitAllRefs()
+		refs, err := r.GetGitAllRefs()
 		if err != nil {
-			util.LogErrorf("Unable to get refs to mark as pushed %v\n", err.Error())
+			r.Log.Errorf("Unable to get refs to mark as pushed %v\n", err.Error())
 			return false
 		}
 		var shas []string
 		for _, ref := range refs {
 			shas = append(shas, ref.CommitSHA)
 		}
-		shas = consolidateCommitsToLatestDescendants(shas)
+		shas = r.consolidateCommitsToLatestDescendants(shas)
 		for _, remote := range remotes {
-			err := WritePushedState(remote, shas)
+			err := r.WritePushedState(remote, shas)
 			if err != nil {
-				util.LogErrorf("Unable to write push state for %v: %v\n", remote, err.Error())
+				r.Log.Errorf("Unable to write push state for %v: %v\n", remote, err.Error())
 				return false
 			}
 		}
@@ -114,9 +133,9 @@ func InitSuccessfullyPushedCacheIfAppropriate() bool {
 
 }
 
-func MarkAllBinariesPushed(remoteName string) error {
+func (r *Repo) MarkAllBinariesPushed(remoteName string) error {
 	// Mark as pushed at all refs (local branches, remote branches, tags)
-	refs, err := GetGitAllRefs()
+	refs, err := r.GetGitAllRefs()
 	if err != nil {
 		return err
 	}
@@ -124,89 +143,209 @@ func MarkAllBinariesPushed(remoteName string) error {
 	for _, ref := range refs {
 		shas = append(shas, ref.CommitSHA)
 	}
-	shas = consolidateCommitsToLatestDescendants(shas)
-	return WritePushedState(remoteName, shas)
+	shas = r.consolidateCommitsToLatestDescendants(shas)
+	return r.WritePushedState(remoteName, shas)
 }
 
 // Record that binaries have been pushed to a given remote at a commit
 // replaceCommitSHA can be blank, but if provided will replace a previously inserted SHA
 // If you use replaceCommitSHA, it MUST BE an ancestor of commitSHA
-func MarkBinariesAsPushed(remoteName, commitSHA, replaceCommitSHA string) error {
+func (r *Repo) MarkBinariesAsPushed(remoteName, commitSHA, replaceCommitSHA string) error {
 	if !GitRefIsFullSHA(commitSHA) {
 		return fmt.Errorf("Invalid commit SHA, must be full 40 char SHA, not '%v'", commitSHA)
 	}
-	shas := GetPushedCommits(remoteName)
+	// Hold the lock between reading & writing so concurrent updates aren't lost
+	l, err := r.lockPushedState(remoteName)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	shas := r.readPushedStateIncluding(remoteName, false)
 
 	// confirm not there already
 	alreadyPresent, _ := util.StringBinarySearch(shas, commitSHA)
 	if alreadyPresent {
 		return nil
 	}
+	return r.writePushedStateLocked(remoteName, applyPushedMark(shas, commitSHA, replaceCommitSHA))
+}
 
-	// insert or append, then re-sort
-	if replaceCommitSHA != "" {
-		//util.LogDebugf("Updating remote state for %v to mark %v as pushed (replaces %v)\n", remoteName, commitSHA, replaceCommitSHA)
-		found, insertAt := util.StringBinarySearch(shas, replaceCommitSHA)
-		if found {
-			shas[insertAt] = commitSHA
-		} else {
-			shas = append(shas, commitSHA)
-		}
-	} else {
-		//util.LogDebugf("Updating remote state for %v to mark %v as pushed\n", remoteName, commitSHA)
-		shas = append(shas, commitSHA)
+// Lock the push state for a remote while updating it, waiting for other processes
+func (r *Repo) lockPushedState(remoteName string) (*lock.Lock, error) {
+	l, err := lock.Acquire(r.getRemoteStateCacheFile(remoteName)+pushStateLockSuffix, PushStateLockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to lock push state for %v: %v", remoteName, err.Error())
 	}
-	sort.Strings(shas)
-	return WritePushedState(remoteName, shas)
+	return l, nil
 }
 
 // Overwrite entire pushed state for a remote
-func WritePushedState(remoteName string, shas []string) error {
+// The new state is written to a temporary file & then moved into place, and the
+// previous state (if it was valid) is kept as a backup in case the new one gets corrupted
+func (r *Repo) WritePushedState(remoteName string, shas []string) error {
+	l, err := r.lockPushedState(remoteName)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	return r.writePushedStateLocked(remoteName, shas)
+}
 
-	filename := getRemoteStateCacheFile(remoteName)
+// Overwrite entire pushed state for a remote, when the push state lock is already held
+func (r *Repo) writePushedStateLocked(remoteName string, shas []string) error {
+
+	filename := r.getRemoteStateCacheFile(remoteName)
 	// we just write the whole thing, sorted
 	sort.Strings(shas)
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	tmpfilename := filename + ".tmp"
+	f, err := os.OpenFile(tmpfilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to write cache file %v: %v", tmpfilename, err.Error()))
+	}
+	_, err = f.Write(encodePushedState(shas))
+	if err == nil {
+		// Make sure it's really on disk before we replace the old one
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpfilename)
+		return errors.New(fmt.Sprintf("Unable to write cache file %v: %v", tmpfilename, err.Error()))
+	}
+
+	// Keep the previous state as the backup, but only if it's good; never replace a
+	// good backup with a corrupt file. It's linked so that the state file is always there
+	if _, err := readPushedStateFile(filename); err == nil {
+		backupfilename := filename + pushStateBackupSuffix
+		tmpbackupfilename := backupfilename + ".tmp"
+		os.Remove(tmpbackupfilename)
+		err := CreateHardLink(filename, tmpbackupfilename)
+		if err == nil {
+			err = os.Rename(tmpbackupfilename, backupfilename)
+		}
+		if err != nil {
+			os.Remove(tmpbackupfilename)
+			r.Log.Errorf("Unable to back up push state %v: %v\n", filename, err.Error())
+		}
+	}
+	err = os.Rename(tmpfilename, filename)
 	if err != nil {
+		os.Remove(tmpfilename)
 		return errors.New(fmt.Sprintf("Unable to write cache file %v: %v", filename, err.Error()))
 	}
-	defer f.Close()
+
+	// Committed transactions in the journal are now part of the state (or were replaced by it)
+	return r.compactPushStateJournalLocked(remoteName)
+}
+
+// Convert push state to the content of a push state file
+// The first line is a header containing the format version, the number of SHAs and a
+// CRC of the remainder of the file (the SHAs, one per line) so corruption can be detected
+func encodePushedState(shas []string) []byte {
+	var body bytes.Buffer
 	for _, sha := range shas {
-		// Have to re-insert the line break
-		f.WriteString(sha + "\n")
+		body.WriteString(sha + "\n")
 	}
+	header := fmt.Sprintf("%v %d %d %08x\n", pushStateHeader, pushStateVersion, len(shas), crc32.ChecksumIEEE(body.Bytes()))
+	return append([]byte(header), body.Bytes()...)
+}
 
-	return nil
+// Parse the content of a push state file, returning an error if it's corrupt
+// Files from before the header was added are accepted provided every line is a SHA
+func decodePushedState(data []byte) ([]string, error) {
+	body := data
+	expectedCount := -1
+	if bytes.HasPrefix(data, []byte(pushStateHeader+" ")) {
+		eol := bytes.IndexByte(data, '\n')
+		if eol == -1 {
+			return nil, errors.New("Header is incomplete")
+		}
+		var version, count int
+		var crc uint32
+		_, err := fmt.Sscanf(string(data[:eol]), pushStateHeader+" %d %d %x", &version, &count, &crc)
+		if err != nil {
+			return nil, fmt.Errorf("Header is invalid: %v", err.Error())
+		}
+		if version != pushStateVersion {
+			return nil, fmt.Errorf("Unsupported version %d", version)
+		}
+		body = data[eol+1:]
+		if actual := crc32.ChecksumIEEE(body); actual != crc {
+			return nil, fmt.Errorf("Checksum mismatch (expected %08x, actual %08x)", crc, actual)
+		}
+		expectedCount = count
+	}
+	shas := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !GitRefIsFullSHA(line) {
+			return nil, fmt.Errorf("Invalid commit SHA '%v'", line)
+		}
+		shas = append(shas, line)
+	}
+	if expectedCount != -1 && len(shas) != expectedCount {
+		return nil, fmt.Errorf("Expected %d commits, found %d", expectedCount, len(shas))
+	}
+	return shas, nil
+}
+
+// Read & validate a single push state file
+func readPushedStateFile(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return decodePushedState(data)
+}
+
+// Read the push state for a remote, falling back on the backup if the current state is corrupt
+// If neither is usable, returns no pushed commits; this is always safe, it just means that the
+// next push has to check the remote for everything again
+// Committed transactions in the push state journal are applied, plus those still open in this
+// process if includeOwn (see PushStateTransaction)
+func (r *Repo) readPushedStateIncluding(remoteName string, includeOwn bool) []string {
+	return r.applyPushStateJournal(remoteName, r.readPushedStateOnDisk(remoteName), includeOwn)
+}
+
+func (r *Repo) readPushedStateOnDisk(remoteName string) []string {
+	filename := r.getRemoteStateCacheFile(remoteName)
+	if !util.FileExists(filename) {
+		return []string{}
+	}
+	shas, err := readPushedStateFile(filename)
+	if err == nil {
+		return shas
+	}
+	r.Log.Errorf("Push state for %v is corrupt (%v)\n", remoteName, err.Error())
+	backupfilename := filename + pushStateBackupSuffix
+	shas, backuperr := readPushedStateFile(backupfilename)
+	if backuperr == nil {
+		r.Log.Errorf("Using previous push state for %v, some commits may be re-checked on next push\n", remoteName)
+		return shas
+	}
+	r.Log.Errorf("No usable backup of push state for %v, will re-check all commits on next push\n", remoteName)
+	return []string{}
 }
 
 // Get a list of commits that have been pushed for a remote
 // remoteName can be "*" to return pushed list for all remotes combined
-func GetPushedCommits(remoteName string) []string {
+func (r *Repo) GetPushedCommits(remoteName string) []string {
 	var shas []string
 	if remoteName == "*" {
-		remotes, err := GetGitRemotes()
+		remotes, err := r.GetGitRemotes()
 		if err != nil {
 			return []string{}
 		}
 		for _, remote := range remotes {
-			rshas := GetPushedCommits(remote)
+			rshas := r.GetPushedCommits(remote)
 			shas = append(shas, rshas...)
 		}
 
 	} else {
-		filename := getRemoteStateCacheFile(remoteName)
-		f, err := os.OpenFile(filename, os.O_RDONLY, 0644)
-		if err != nil {
-			// File missing
-			return []string{}
-		}
-		defer f.Close()
 		// Read entire file into memory and binary search
 		// Will already be sorted
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			shas = append(shas, scanner.Text())
-		}
+		shas = r.readPushedStateIncluding(remoteName, true)
 
 	}
 	return shas
@@ -216,24 +355,30 @@ func GetPushedCommits(remoteName string) []string {
 // As we add SHAs that are pushed we can create redundant records because some SHAs are
 // parents of others. This makes the subsequent retrieval of commits to push slower
 // So remove SHAs that are ancestors of others and just keep the later SHAs that are pushed
-func CleanupPushState(remoteName string) {
-	pushed := GetPushedCommits(remoteName)
+func (r *Repo) CleanupPushState(remoteName string) {
+	l, err := r.lockPushedState(remoteName)
+	if err != nil {
+		r.Log.Errorf("Unable to clean up push state: %v\n", err.Error())
+		return
+	}
+	defer l.Release()
+	pushed := r.readPushedStateIncluding(remoteName, false)
 
-	consolidated := consolidateCommitsToLatestDescendants(pushed)
+	consolidated := r.consolidateCommitsToLatestDescendants(pushed)
 
 	if len(consolidated) != len(pushed) {
-		WritePushedState(remoteName, consolidated)
+		r.writePushedStateLocked(remoteName, consolidated)
 	}
 }
 
 // Take a list of commit SHAs and consolidate them into another list which excludes
 // any commits which are ancestors of others, and those which are no longer valid
 // Note that this makes up to N^2 + N git calls so call infrequently
-func consolidateCommitsToLatestDescendants(in []string) []string {
+func (r *Repo) consolidateCommitsToLatestDescendants(in []string) []string {
 	consolidated := make([]string, 0, len(in))
 	for i, a := range in {
 		// First check this is a valid ref still (if rebased & deleted, remove)
-		if !GitRefOrSHAIsValid(a) {
+		if !r.GitRefOrSHAIsValid(a) {
 			continue
 		}
 		// If any other pushed entry is a descendent of 'a' then no reason to store 'a'
@@ -252,7 +397,7 @@ func consolidateCommitsToLatestDescendants(in []string) []string {
 					continue
 				}
 			}
-			isancestor, err := GitIsAncestor(a, b)
+			isancestor, err := r.GitIsAncestor(a, b)
 			if err != nil {
 				// play safe & keep
 				continue
@@ -272,21 +417,21 @@ func consolidateCommitsToLatestDescendants(in []string) []string {
 
 // Reset the cached information about which binaries we have cached for a given remote
 // Warning: this will make the next push expensive while it recalculates
-func ResetPushedBinaryState(remoteName string) error {
-	return os.RemoveAll(getRemoteStateCacheRoot(remoteName))
+func (r *Repo) ResetPushedBinaryState(remoteName string) error {
+	return os.RemoveAll(r.getRemoteStateCacheRoot(remoteName))
 }
 
 // Do we have any pushed binary state recorded for a remote?
-func HasPushedBinaryState(remoteName string) bool {
-	return hasRemoteStateCache(remoteName)
+func (r *Repo) HasPushedBinaryState(remoteName string) bool {
+	return r.hasRemoteStateCache(remoteName)
 }
 
 // Find the most recent ancestor of ref (or itself) at which we believe we've
 // already pushed all binaries. Returns a blank string if none have been pushed.
-func FindLatestAncestorWhereBinariesPushed(remoteName, ref string) (string, error) {
+func (r *Repo) FindLatestAncestorWhereBinariesPushed(remoteName, ref string) (string, error) {
 
 	// Use the list of pushed SHAs plus this ref to determine the best common ancestor
-	pushedSHAs := GetPushedCommits(remoteName)
+	pushedSHAs := r.GetPushedCommits(remoteName)
 	if len(pushedSHAs) == 0 {
 		return "", nil
 	}
@@ -294,7 +439,7 @@ func FindLatestAncestorWhereBinariesPushed(remoteName, ref string) (string, erro
 	var refs = make([]string, 0, len(pushedSHAs)+1)
 	refs = append(refs, ref)
 	refs = append(refs, pushedSHAs...)
-	best, err := GetGitBestAncestor(refs)
+	best, err := r.GetGitBestAncestor(refs)
 	return best, err
 }
 
@@ -305,13 +450,13 @@ func FindLatestAncestorWhereBinariesPushed(remoteName, ref string) (string, erro
 // If the refspec is a single ref, then finds the latest ancestor we think has been pushed already
 // for this remote and returns the LOBs referred to in that range. If recheck is true,
 // ignores the record of the last commit we think we pushed and scans entire history (slow)
-func GetCommitLOBsToPushForRefSpec(remoteName string, refspec *GitRefSpec, recheck bool) ([]*CommitLOBRef, error) {
+func (r *Repo) GetCommitLOBsToPushForRefSpec(remoteName string, refspec *GitRefSpec, recheck bool) ([]*CommitLOBRef, error) {
 	var ret []*CommitLOBRef
 	callback := func(commit *CommitLOBRef) (quit bool, err error) {
 		ret = append(ret, commit)
 		return false, nil
 	}
-	err := WalkGitCommitLOBsToPushForRefSpec(remoteName, refspec, recheck, callback)
+	err := r.WalkGitCommitLOBsToPushForRefSpec(remoteName, refspec, recheck, []string{}, []string{}, callback)
 	return ret, err
 }
 
@@ -321,25 +466,25 @@ func GetCommitLOBsToPushForRefSpec(remoteName string, refspec *GitRefSpec, reche
 // If the refspec is a single ref, then finds the latest ancestor we think has been pushed already
 // for this remote and returns the LOBs referred to in that range. If recheck is true,
 // ignores the record of the last commit we think we pushed and scans entire history (slow)
-func GetCommitLOBsToPushForRef(remoteName string, ref string, recheck bool) ([]*CommitLOBRef, error) {
+func (r *Repo) GetCommitLOBsToPushForRef(remoteName string, ref string, recheck bool) ([]*CommitLOBRef, error) {
 	var ret []*CommitLOBRef
 	callback := func(commit *CommitLOBRef) (quit bool, err error) {
 		ret = append(ret, commit)
 		return false, nil
 	}
-	err := WalkGitCommitLOBsToPush(remoteName, ref, recheck, callback)
+	err := r.WalkGitCommitLOBsToPush(remoteName, ref, recheck, []string{}, []string{}, callback)
 	return ret, err
 }
 
 // Check with a remote provider for the presence of all data required for a given LOB
 // Return nil if all data is there, NotFoundErr if not
-func CheckRemoteLOBFilesForSHA(sha string, provider providers.SyncProvider, remoteName string) error {
+func (r *Repo) CheckRemoteLOBFilesForSHA(sha string, provider providers.SyncProvider, remoteName string) error {
 	// Smart provider can do better
 	switch p := provider.(type) {
 	case providers.SmartSyncProvider:
 		return CheckRemoteLOBFilesForSHASmart(sha, p, remoteName)
 	case providers.SyncProvider:
-		return CheckRemoteLOBFilesForSHABasic(sha, p, remoteName)
+		return r.CheckRemoteLOBFilesForSHABasic(sha, p, remoteName)
 	}
 	return nil
 }
@@ -355,29 +500,17 @@ func CheckRemoteLOBFilesForSHASmart(sha string, provider providers.SmartSyncProv
 }
 
 // CheckRemoteLOBFilesForSHA on non-smart providers
-func CheckRemoteLOBFilesForSHABasic(sha string, provider providers.SyncProvider, remoteName string) error {
+func (r *Repo) CheckRemoteLOBFilesForSHABasic(sha string, provider providers.SyncProvider, remoteName string) error {
 
 	// We need LOB info to know size / how many chunks it had
 	var info *LOBInfo
-	info, err := GetLOBInfo(sha)
+	info, err := r.GetLOBInfo(sha)
 	meta := GetLOBMetaRelativePath(sha)
 	if err != nil {
 		// We have to actually download meta file in order to figure out what else is needed
-		// A simple helper callback you can use to do nothing
-		dummyCallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
-			return false
-		}
-		dlerr := provider.Download(remoteName, []string{meta}, os.TempDir(), false, dummyCallback)
-		if dlerr != nil {
-			return dlerr
-		}
-		metafullpath := filepath.Join(os.TempDir(), meta)
-		var parseerr error
-		info, parseerr = parseLOBInfoFromFile(metafullpath)
-		// delete from temp afterwards
-		os.Remove(metafullpath)
-		if parseerr != nil {
-			return fmt.Errorf("Unable to parse metadata from file downloaded from %v for %v: %v", remoteName, sha, parseerr.Error())
+		info, err = downloadRemoteLOBInfo(sha, provider, remoteName)
+		if err != nil {
+			return err
 		}
 	} else {
 		// We had the meta locally, so just check the file is on the remote
@@ -387,9 +520,44 @@ func CheckRemoteLOBFilesForSHABasic(sha string, provider providers.SyncProvider,
 	}
 
 	// Now we get the list of chunks & check they are present
+	return checkRemoteLOBChunks(info, provider, remoteName)
+
+}
+
+// Download & parse the metadata for a LOB from a remote, without storing it
+// Returns a NotFoundError if the remote doesn't have it
+func downloadRemoteLOBInfo(sha string, provider providers.SyncProvider, remoteName string) (*LOBInfo, error) {
+	meta := GetLOBMetaRelativePath(sha)
+	// Providers report missing files to the callback rather than as an error
+	metaNotFound := false
+	callback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+		if progressType == util.ProgressNotFound {
+			metaNotFound = true
+		}
+		return false
+	}
+	dlerr := provider.Download(remoteName, []string{meta}, os.TempDir(), false, callback)
+	if dlerr != nil {
+		return nil, dlerr
+	}
+	if metaNotFound {
+		return nil, NewNotFoundError(fmt.Sprintf("Meta file %v missing from %v", meta, remoteName), meta)
+	}
+	metafullpath := filepath.Join(os.TempDir(), meta)
+	info, parseerr := parseLOBInfoFromFile(metafullpath)
+	// delete from temp afterwards
+	os.Remove(metafullpath)
+	if parseerr != nil {
+		return nil, fmt.Errorf("Unable to parse metadata from file downloaded from %v for %v: %v", remoteName, sha, parseerr.Error())
+	}
+	return info, nil
+}
+
+// Check that all the chunks described by info are on a remote
+func checkRemoteLOBChunks(info *LOBInfo, provider providers.SyncProvider, remoteName string) error {
 	for i := 0; i < info.NumChunks; i++ {
 		expectedSize := getLOBExpectedChunkSize(info, i)
-		chunk := GetLOBChunkRelativePath(sha, i)
+		chunk := getLOBChunkRelativePathForInfo(info, i)
 		if !provider.FileExistsAndIsOfSize(remoteName, chunk, expectedSize) {
 			return NewNotFoundError(fmt.Sprintf("Chunk file %v missing from %v", chunk, remoteName), chunk)
 		}
@@ -397,5 +565,39 @@ func CheckRemoteLOBFilesForSHABasic(sha string, provider providers.SyncProvider,
 
 	// All OK
 	return nil
+}
+
+// How a LOB about to be pushed is already stored on a remote
+type remoteLOBStorage int
+
+const (
+	// Not on the remote, or stored the same way as locally
+	remoteLOBStorageSame remoteLOBStorage = iota
+	// Complete on the remote but stored differently, e.g. with another chunk size or compression
+	remoteLOBStorageDifferentComplete
+	// Partly on the remote & stored differently; its chunks may have the same names & sizes as
+	// ours but different content, so can't be skipped
+	remoteLOBStorageDifferentIncomplete
+)
 
+// Find out whether a remote already has a LOB stored differently to info, e.g. pushed by someone
+// with other storage settings, in which case its files can't be mixed with ours
+func (r *Repo) getRemoteLOBStorage(info *LOBInfo, provider providers.SyncProvider, remoteName string) remoteLOBStorage {
+	// Metadata can be the same size but describe different storage, so has to be compared
+	if !provider.FileExists(remoteName, GetLOBMetaRelativePath(info.SHA)) {
+		return remoteLOBStorageSame
+	}
+	remoteinfo, err := downloadRemoteLOBInfo(info.SHA, provider, remoteName)
+	if err != nil {
+		// Can't trust anything which is there
+		r.Log.Debugf("Unable to read metadata for %v on %v, uploading all of it: %v\n", info.SHA, remoteName, err.Error())
+		return remoteLOBStorageDifferentIncomplete
+	}
+	if isSameLOBStorage(info, remoteinfo) {
+		return remoteLOBStorageSame
+	}
+	if checkRemoteLOBChunks(remoteinfo, provider, remoteName) == nil {
+		return remoteLOBStorageDifferentComplete
+	}
+	return remoteLOBStorageDifferentIncomplete
 }
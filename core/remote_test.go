@@ -1,12 +1,16 @@
 package core
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"time"
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
 )
 
 var _ = Describe("Remote", func() {
@@ -35,41 +39,216 @@ var _ = Describe("Remote", func() {
 			sha2 := "c1234567890fdf651bb5f93ab930dd7708002341"
 			sha3 := "d3f8734986de0f0a08b5f93ab930dd7708030dde"
 
-			err := MarkBinariesAsPushed(remote1Name, sha, "")
+			err := testRepo().MarkBinariesAsPushed(remote1Name, sha, "")
 			Expect(err).To(BeNil(), "Shouldn't be an error marking pushed")
 
-			pushed := GetPushedCommits(remote1Name)
+			pushed := testRepo().GetPushedCommits(remote1Name)
 			Expect(pushed).To(Equal([]string{sha}), "Should record pushed")
 
-			err = MarkBinariesAsPushed(remote1Name, sha2, "")
+			err = testRepo().MarkBinariesAsPushed(remote1Name, sha2, "")
 			Expect(err).To(BeNil(), "Shouldn't be an error marking pushed")
 
-			pushed = GetPushedCommits(remote1Name)
+			pushed = testRepo().GetPushedCommits(remote1Name)
 			Expect(pushed).To(Equal([]string{sha, sha2}), "Should record pushed, in order")
 
 			// Add a duplicate, confirm not added but replaced
-			err = MarkBinariesAsPushed(remote1Name, sha, "")
+			err = testRepo().MarkBinariesAsPushed(remote1Name, sha, "")
 			Expect(err).To(BeNil(), "Shouldn't be an error marking pushed")
 
-			pushed = GetPushedCommits(remote1Name)
+			pushed = testRepo().GetPushedCommits(remote1Name)
 			Expect(pushed).To(Equal([]string{sha, sha2}), "Should not add duplicates")
 
 			// now replace sha with sha3
-			err = MarkBinariesAsPushed(remote1Name, sha3, sha)
+			err = testRepo().MarkBinariesAsPushed(remote1Name, sha3, sha)
 			Expect(err).To(BeNil(), "Shouldn't be an error marking pushed")
 
-			pushed = GetPushedCommits(remote1Name)
+			pushed = testRepo().GetPushedCommits(remote1Name)
 			Expect(pushed).To(Equal([]string{sha2, sha3}), "Should record pushed, replacing first one, but in order")
 
-			pushed = GetPushedCommits(remote2Name)
+			pushed = testRepo().GetPushedCommits(remote2Name)
 			Expect(pushed).To(Equal([]string{}), "Pushed should be empty for others")
 
 			// Now undo
-			err = ResetPushedBinaryState(remote1Name)
+			err = testRepo().ResetPushedBinaryState(remote1Name)
 			Expect(err).To(BeNil(), "Shouldn't be an error undoing pushed")
-			pushed = GetPushedCommits(remote1Name)
+			pushed = testRepo().GetPushedCommits(remote1Name)
 			Expect(pushed).To(Equal([]string{}), "Pushed should be empty after reset")
 		})
+
+		It("detects corrupt push state & falls back on backup", func() {
+			sha := "b09bfdf65bb51bb50307f93ab930dd7708a5b6dc"
+			sha2 := "c1234567890fdf651bb5f93ab930dd7708002341"
+			statefile := testRepo().getRemoteStateCacheFile(remote1Name)
+			backupfile := statefile + pushStateBackupSuffix
+
+			// Files from before versioning are still read
+			err := ioutil.WriteFile(statefile, []byte(sha+"\n"), 0644)
+			Expect(err).To(BeNil())
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{sha}), "Should read unversioned state")
+
+			err = testRepo().MarkBinariesAsPushed(remote1Name, sha2, "")
+			Expect(err).To(BeNil(), "Shouldn't be an error marking pushed")
+			data, err := ioutil.ReadFile(statefile)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(HavePrefix(pushStateHeader+" 1 2 "), "Should write versioned header")
+			backup, err := ioutil.ReadFile(backupfile)
+			Expect(err).To(BeNil(), "Previous state should be backed up")
+			Expect(string(backup)).To(Equal(sha+"\n"), "Backup should be previous state")
+
+			// Corrupt one character of a SHA; still a valid SHA so only the checksum catches it
+			data[len(data)-2] = 'f'
+			err = ioutil.WriteFile(statefile, data, 0644)
+			Expect(err).To(BeNil())
+			_, err = readPushedStateFile(statefile)
+			Expect(err).ToNot(BeNil(), "Corruption should be detected")
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{sha}), "Should fall back on backup")
+
+			// Writing doesn't replace the good backup with the corrupt state
+			err = testRepo().WritePushedState(remote1Name, []string{sha2})
+			Expect(err).To(BeNil())
+			backup, _ = ioutil.ReadFile(backupfile)
+			Expect(string(backup)).To(Equal(sha+"\n"), "Corrupt state should not become backup")
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{sha2}), "Should read new state")
+
+			// Truncated file & no backup means no pushed state, so everything is re-checked
+			os.Remove(backupfile)
+			data, _ = ioutil.ReadFile(statefile)
+			err = ioutil.WriteFile(statefile, data[:len(data)-10], 0644)
+			Expect(err).To(BeNil())
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{}), "Should have no pushed state if no good copy")
+		})
+
+		It("locks push state while updating", func() {
+			sha := "b09bfdf65bb51bb50307f93ab930dd7708a5b6dc"
+			sha2 := "c1234567890fdf651bb5f93ab930dd7708002341"
+			lockfile := testRepo().getRemoteStateCacheFile(remote1Name) + pushStateLockSuffix
+			err := testRepo().MarkBinariesAsPushed(remote1Name, sha, "")
+			Expect(err).To(BeNil(), "Shouldn't be an error marking pushed")
+			Expect(FileExists(lockfile)).To(BeFalse(), "Lock should be released after update")
+
+			// Another process updating push state
+			oldTimeout := PushStateLockTimeout
+			defer func() { PushStateLockTimeout = oldTimeout }()
+			PushStateLockTimeout = 100 * time.Millisecond
+			host, _ := os.Hostname()
+			err = ioutil.WriteFile(lockfile, []byte(fmt.Sprintf(`{"PID":%d,"Host":%q,"Acquired":%q}`,
+				os.Getppid(), host, time.Now().Format(time.RFC3339Nano))), 0644)
+			Expect(err).To(BeNil())
+			err = testRepo().MarkBinariesAsPushed(remote1Name, sha2, "")
+			Expect(err).ToNot(BeNil(), "Should not update push state while locked")
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{sha}), "Push state should be unchanged")
+
+			os.Remove(lockfile)
+			err = testRepo().MarkBinariesAsPushed(remote1Name, sha2, "")
+			Expect(err).To(BeNil(), "Should update push state once unlocked")
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{sha, sha2}))
+		})
+
+		It("applies push state transactions atomically", func() {
+			sha := "b09bfdf65bb51bb50307f93ab930dd7708a5b6dc"
+			sha2 := "c1234567890fdf651bb5f93ab930dd7708002341"
+			sha3 := "d3f8734986de0f0a08b5f93ab930dd7708030dde"
+			err := testRepo().MarkBinariesAsPushed(remote1Name, sha, "")
+			Expect(err).To(BeNil())
+
+			tx, err := testRepo().BeginPushStateTransaction(remote1Name)
+			Expect(err).To(BeNil())
+			err = tx.MarkBinariesAsPushed(sha2, "")
+			Expect(err).To(BeNil())
+			err = tx.MarkBinariesAsPushed(sha3, sha)
+			Expect(err).To(BeNil())
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{sha2, sha3}), "Transaction should see its own changes")
+			Expect(testRepo().readPushedStateIncluding(remote1Name, false)).To(Equal([]string{sha}), "Others should not see uncommitted changes")
+			err = tx.Commit()
+			Expect(err).To(BeNil())
+			Expect(testRepo().readPushedStateIncluding(remote1Name, false)).To(Equal([]string{sha2, sha3}), "Others should see committed changes")
+			Expect(testRepo().readPushedStateOnDisk(remote1Name)).To(Equal([]string{sha2, sha3}), "Commit should apply changes to push state")
+			Expect(FileExists(testRepo().getPushStateJournalFile(remote1Name))).To(BeFalse(), "Journal should be removed when nothing is open")
+
+			// Interrupted before committing
+			err = testRepo().ResetPushedBinaryState(remote1Name)
+			Expect(err).To(BeNil())
+			tx, err = testRepo().BeginPushStateTransaction(remote1Name)
+			Expect(err).To(BeNil())
+			err = tx.MarkBinariesAsPushed(sha, "")
+			Expect(err).To(BeNil())
+			tx.repo.openPushStateTransactions.Remove(tx.id)
+			tx.lock.Release()
+			// with a partial record too
+			f, err := os.OpenFile(testRepo().getPushStateJournalFile(remote1Name), os.O_WRONLY|os.O_APPEND, 0644)
+			Expect(err).To(BeNil())
+			f.WriteString("mark " + tx.id + " " + sha2[:20])
+			f.Close()
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{}), "Abandoned changes should not be seen")
+
+			// Next transaction recovers it
+			tx2, err := testRepo().BeginPushStateTransaction(remote1Name)
+			Expect(err).To(BeNil())
+			Expect(testRepo().readPushedStateIncluding(remote1Name, false)).To(Equal([]string{sha}), "Abandoned changes should be recovered")
+			err = tx2.MarkBinariesAsPushed(sha3, "")
+			Expect(err).To(BeNil(), "Should not be affected by partial record")
+			err = tx2.Commit()
+			Expect(err).To(BeNil())
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{sha, sha3}))
+			err = tx2.MarkBinariesAsPushed(sha2, "")
+			Expect(err).ToNot(BeNil(), "Should not be able to use a finished transaction")
+		})
+
+		It("verifies & repairs push state", func() {
+			var shas []string
+			for i := 0; i < 3; i++ {
+				err := exec.Command("git", "commit", "--allow-empty", "-m", fmt.Sprintf("Commit %d", i)).Run()
+				Expect(err).To(BeNil())
+				sha, _ := testRepo().GitRefToFullSHA("HEAD")
+				shas = append(shas, sha)
+			}
+			problems, err := testRepo().VerifyPushState(remote1Name, false)
+			Expect(err).To(BeNil())
+			Expect(problems).To(BeEmpty(), "Nothing to check without push state")
+			err = testRepo().MarkBinariesAsPushed(remote1Name, shas[0], "")
+			Expect(err).To(BeNil())
+			problems, err = testRepo().VerifyPushState(remote1Name, false)
+			Expect(err).To(BeNil())
+			Expect(problems).To(BeEmpty())
+
+			// Interrupted push, & a commit which no longer exists
+			tx, err := testRepo().BeginPushStateTransaction(remote1Name)
+			Expect(err).To(BeNil())
+			err = tx.MarkBinariesAsPushed(shas[1], shas[0])
+			Expect(err).To(BeNil())
+			tx.repo.openPushStateTransactions.Remove(tx.id)
+			tx.lock.Release()
+			err = testRepo().MarkBinariesAsPushed(remote1Name, "b09bfdf65bb51bb50307f93ab930dd7708a5b6dc", "")
+			Expect(err).To(BeNil())
+			problems, err = testRepo().VerifyPushState(remote1Name, false)
+			Expect(err).To(BeNil())
+			Expect(problems).To(HaveLen(2))
+			Expect(problems[0]).To(ContainSubstring("interrupted"))
+			Expect(problems[1]).To(ContainSubstring("no longer exist"))
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(ConsistOf(shas[0], "b09bfdf65bb51bb50307f93ab930dd7708a5b6dc"), "Should not change without fix")
+
+			problems, err = testRepo().VerifyPushState(remote1Name, true)
+			Expect(err).To(BeNil())
+			Expect(problems).To(HaveLen(2))
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{shas[1]}), "Should recover interrupted push & remove missing commits")
+			Expect(FileExists(testRepo().getPushStateJournalFile(remote1Name))).To(BeFalse())
+			problems, err = testRepo().VerifyPushState(remote1Name, false)
+			Expect(err).To(BeNil())
+			Expect(problems).To(BeEmpty(), "Should be no problems after fixing")
+
+			// Corrupt push state is restored from backup
+			err = testRepo().MarkBinariesAsPushed(remote1Name, shas[2], shas[1])
+			Expect(err).To(BeNil())
+			err = ioutil.WriteFile(testRepo().getRemoteStateCacheFile(remote1Name), []byte("corrupt"), 0644)
+			Expect(err).To(BeNil())
+			problems, err = testRepo().VerifyPushState(remote1Name, true)
+			Expect(err).To(BeNil())
+			Expect(problems).To(HaveLen(1))
+			Expect(problems[0]).To(ContainSubstring("corrupt"))
+			_, err = readPushedStateFile(testRepo().getRemoteStateCacheFile(remote1Name))
+			Expect(err).To(BeNil(), "Push state should be valid after fixing")
+			Expect(testRepo().GetPushedCommits(remote1Name)).To(Equal([]string{shas[1]}))
+		})
 	})
 
 	Context("Real git repo tests", func() {
@@ -186,58 +365,58 @@ var _ = Describe("Remote", func() {
 			remote := "origin"
 
 			// Check that no-match case works & terminates correctly
-			sha, err := FindLatestAncestorWhereBinariesPushed(remote, "master")
+			sha, err := testRepo().FindLatestAncestorWhereBinariesPushed(remote, "master")
 			Expect(err).To(BeNil())
 			Expect(sha).To(Equal(""), "Should be no pushed binaries at start")
 
 			// Mark pushed at feature/hanging but not at tip
-			err = MarkBinariesAsPushed(remote, setupOutputs[2].Commit, "")
+			err = testRepo().MarkBinariesAsPushed(remote, setupOutputs[2].Commit, "")
 			Expect(err).To(BeNil())
 			// The ancestor that's pushed should be the common parent of hanging branch & master,
 			// which is index 1
-			sha, err = FindLatestAncestorWhereBinariesPushed(remote, "master")
+			sha, err = testRepo().FindLatestAncestorWhereBinariesPushed(remote, "master")
 			Expect(err).To(BeNil())
 			Expect(sha).To(Equal(setupOutputs[1].Commit), "Should find common ancestor that's pushed")
 
 			// Mark a commit on master as pushed too
-			err = MarkBinariesAsPushed(remote, setupOutputs[4].Commit, "")
+			err = testRepo().MarkBinariesAsPushed(remote, setupOutputs[4].Commit, "")
 			Expect(err).To(BeNil())
 			// The ancestor that's pushed from master should now be this one
-			sha, err = FindLatestAncestorWhereBinariesPushed(remote, "master")
+			sha, err = testRepo().FindLatestAncestorWhereBinariesPushed(remote, "master")
 			Expect(err).To(BeNil())
 			Expect(sha).To(Equal(setupOutputs[4].Commit), "Should find latest ancestor that's pushed")
 			// but if measured from hanging branch this should be its own
-			sha, err = FindLatestAncestorWhereBinariesPushed(remote, "feature/hanging")
+			sha, err = testRepo().FindLatestAncestorWhereBinariesPushed(remote, "feature/hanging")
 			Expect(err).To(BeNil())
 			Expect(sha).To(Equal(setupOutputs[2].Commit), "Should find hanging branch ancestor that's pushed")
 
 			// Now mark a commit on the merge line as pushed, but not where it's merged
 			// Again don't mark the tip to make the test more interesting
-			err = MarkBinariesAsPushed(remote, setupOutputs[5].Commit, "")
+			err = testRepo().MarkBinariesAsPushed(remote, setupOutputs[5].Commit, "")
 			Expect(err).To(BeNil())
 			// The ancestor that's pushed from master should now be the one in the middle of the merge
-			sha, err = FindLatestAncestorWhereBinariesPushed(remote, "master")
+			sha, err = testRepo().FindLatestAncestorWhereBinariesPushed(remote, "master")
 			Expect(err).To(BeNil())
 			Expect(sha).To(Equal(setupOutputs[5].Commit), "Should find merge ancestor that's pushed")
 			// but should not affect hanging branch this should be its own
-			sha, err = FindLatestAncestorWhereBinariesPushed(remote, "feature/hanging")
+			sha, err = testRepo().FindLatestAncestorWhereBinariesPushed(remote, "feature/hanging")
 			Expect(err).To(BeNil())
 			Expect(sha).To(Equal(setupOutputs[2].Commit), "Should find hanging branch ancestor that's pushed")
 			// However even though merge ancestor is 'latest pushed' from master, we should still see commits on master in parallel with merge to push
-			commits, err := GetCommitLOBsToPushForRef(remote, "master", false)
+			commits, err := testRepo().GetCommitLOBsToPushForRef(remote, "master", false)
 			Expect(err).To(BeNil())
 			// don't include commits with no files e.g. 9(merge) & 11
 			Expect(commits).To(ConsistOf(getOutputSubset(6, 7, 8, 10)), "Should be correct list to push")
 			// now mark something in the middle on master as pushed & make sure remnants of merge branch still get picked up
 			// Also replace the previously marked SHA on master because assume we picked this up from master (since merged) but didn't finish
-			err = MarkBinariesAsPushed(remote, setupOutputs[8].Commit, setupOutputs[4].Commit)
+			err = testRepo().MarkBinariesAsPushed(remote, setupOutputs[8].Commit, setupOutputs[4].Commit)
 			Expect(err).To(BeNil())
 			// The ancestor that's pushed from master should now be this one
-			sha, err = FindLatestAncestorWhereBinariesPushed(remote, "master")
+			sha, err = testRepo().FindLatestAncestorWhereBinariesPushed(remote, "master")
 			Expect(err).To(BeNil())
 			Expect(sha).To(Equal(setupOutputs[8].Commit), "Should find master ancestor that's pushed")
 			// Now test we pick up the commits from the merge branch on master, after what was marked there
-			commits, err = GetCommitLOBsToPushForRef(remote, "master", false)
+			commits, err = testRepo().GetCommitLOBsToPushForRef(remote, "master", false)
 			Expect(err).To(BeNil())
 			// don't include commits with no files e.g. 9(merge) & 11
 			Expect(commits).To(ConsistOf(getOutputSubset(7, 10)), "Should be correct list to push")
@@ -247,29 +426,29 @@ var _ = Describe("Remote", func() {
 		It("consolidates pushed state", func() {
 			// This time we're just inserting push markers and making sure that they are consolidated correctly
 			remote := "origin"
-			err := MarkBinariesAsPushed(remote, setupOutputs[0].Commit, "") // redundant since 4 is descendent
+			err := testRepo().MarkBinariesAsPushed(remote, setupOutputs[0].Commit, "") // redundant since 4 is descendent
 			Expect(err).To(BeNil())
-			err = MarkBinariesAsPushed(remote, setupOutputs[4].Commit, "")
+			err = testRepo().MarkBinariesAsPushed(remote, setupOutputs[4].Commit, "")
 			Expect(err).To(BeNil())
-			err = MarkBinariesAsPushed(remote, setupOutputs[3].Commit, "") // 3 is on a separate branch
+			err = testRepo().MarkBinariesAsPushed(remote, setupOutputs[3].Commit, "") // 3 is on a separate branch
 			Expect(err).To(BeNil())
-			CleanupPushState(remote)
-			pushed := GetPushedCommits(remote)
+			testRepo().CleanupPushState(remote)
+			pushed := testRepo().GetPushedCommits(remote)
 			Expect(pushed).To(ConsistOf([]string{setupOutputs[4].Commit, setupOutputs[3].Commit}), "Should still record 2 pushed states")
 
-			err = MarkBinariesAsPushed(remote, setupOutputs[7].Commit, "") // on merge path
+			err = testRepo().MarkBinariesAsPushed(remote, setupOutputs[7].Commit, "") // on merge path
 			Expect(err).To(BeNil())
-			err = MarkBinariesAsPushed(remote, setupOutputs[8].Commit, "") // in parallel on master (overrides 4)
+			err = testRepo().MarkBinariesAsPushed(remote, setupOutputs[8].Commit, "") // in parallel on master (overrides 4)
 			Expect(err).To(BeNil())
-			CleanupPushState(remote)
-			pushed = GetPushedCommits(remote)
+			testRepo().CleanupPushState(remote)
+			pushed = testRepo().GetPushedCommits(remote)
 			Expect(pushed).To(ConsistOf([]string{setupOutputs[8].Commit, setupOutputs[3].Commit, setupOutputs[7].Commit}),
 				"Should record 3 pushed states; master, hanging and merge path")
 			// Now once we say pushed after merge commit point, should resolve back to 2 again
-			err = MarkBinariesAsPushed(remote, setupOutputs[10].Commit, "") // post-merge
+			err = testRepo().MarkBinariesAsPushed(remote, setupOutputs[10].Commit, "") // post-merge
 			Expect(err).To(BeNil())
-			CleanupPushState(remote)
-			pushed = GetPushedCommits(remote)
+			testRepo().CleanupPushState(remote)
+			pushed = testRepo().GetPushedCommits(remote)
 			Expect(pushed).To(ConsistOf([]string{setupOutputs[10].Commit, setupOutputs[3].Commit}),
 				"Should be nack to 2 pushed states; master & hanging")
 		})
@@ -279,17 +458,17 @@ var _ = Describe("Remote", func() {
 			// Make sure that we can recover correctly
 			remote := "origin"
 			// Add valid post-merge push point (hanging is not pushed)
-			err := MarkBinariesAsPushed(remote, setupOutputs[9].Commit, "")
+			err := testRepo().MarkBinariesAsPushed(remote, setupOutputs[9].Commit, "")
 			Expect(err).To(BeNil())
 			// Now add a completely incorrect SHA
-			err = MarkBinariesAsPushed(remote, "1111111111222222222233333333334444444444", "")
+			err = testRepo().MarkBinariesAsPushed(remote, "1111111111222222222233333333334444444444", "")
 			Expect(err).To(BeNil())
 			// Now let's check that we recover from the inevitable problem
-			commits, err := GetCommitLOBsToPushForRef(remote, "master", false)
+			commits, err := testRepo().GetCommitLOBsToPushForRef(remote, "master", false)
 			Expect(err).To(BeNil())
 			// Should report the commits on master/hanging_ahead past 9 which have LOBs
 			Expect(commits).To(ConsistOf(getOutputSubset(10)), "Should correctly identify commits to push after bad SHA")
-			commits, err = GetCommitLOBsToPushForRef(remote, "feature/hanging_ahead", false)
+			commits, err = testRepo().GetCommitLOBsToPushForRef(remote, "feature/hanging_ahead", false)
 			Expect(err).To(BeNil())
 			// Should report the commits on master/hanging_ahead past 9 which have LOBs
 			Expect(commits).To(ConsistOf(getOutputSubset(10, 12, 13)), "Should correctly identify commits to push after bad SHA")
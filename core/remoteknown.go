@@ -0,0 +1,173 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Binaries known to be on a remote
+// Working out what to push means checking the remote for binaries which aren't stored locally
+// (e.g. ones fetched by someone else's commits but outside our fetch range). The same binaries
+// come up again on every push until the commits referring to them are marked as pushed, so the
+// SHAs found on each remote are recorded in its remote state folder & not checked again. The
+// record is deleted along with the rest of the remote state (ResetPushedBinaryState), and when
+// binaries are pruned from the remote.
+
+// Gets the file which lists the binaries known to be on a remote
+func (r *Repo) getRemoteKnownLOBsFile(remoteName string) string {
+	return filepath.Join(r.getRemoteStateCacheRoot(remoteName), "known_lobs")
+}
+
+// Read the binaries known to be on a remote; empty if there's no record
+func (r *Repo) readRemoteKnownLOBs(remoteName string) util.StringSet {
+	ret := util.NewStringSet()
+	if !r.hasRemoteStateCache(remoteName) {
+		return ret
+	}
+	f, err := os.Open(r.getRemoteKnownLOBsFile(remoteName))
+	if err != nil {
+		return ret
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Ignore anything that isn't a SHA, e.g. a partial line written by a process which died
+		if sha := scanner.Text(); IsLOBSHA(sha) {
+			ret.Add(sha)
+		}
+	}
+	return ret
+}
+
+// Record more binaries as known to be on a remote
+func (r *Repo) addRemoteKnownLOBs(remoteName string, shas []string) error {
+	if len(shas) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(r.getRemoteKnownLOBsFile(remoteName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, sha := range shas {
+		fmt.Fprintln(w, sha)
+	}
+	return w.Flush()
+}
+
+// Forget which binaries are known to be on a remote, e.g. because some have been deleted
+func (r *Repo) forgetRemoteKnownLOBs(remoteName string) error {
+	if !r.hasRemoteStateCache(remoteName) {
+		return nil
+	}
+	err := os.Remove(r.getRemoteKnownLOBsFile(remoteName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Checks a remote for binaries in bulk, recording the ones it has
+// Binaries already known to be on the remote aren't checked again, unless recheck is true
+// Nothing is recorded if dryRun is true
+type remoteLOBChecker struct {
+	repo       *Repo
+	provider   providers.SyncProvider
+	remoteName string
+	dryRun     bool
+	known      util.StringSet
+}
+
+func (r *Repo) newRemoteLOBChecker(provider providers.SyncProvider, remoteName string, recheck, dryRun bool) *remoteLOBChecker {
+	known := util.NewStringSet()
+	if !recheck {
+		known = r.readRemoteKnownLOBs(remoteName)
+	}
+	return &remoteLOBChecker{repo: r, provider: provider, remoteName: remoteName, dryRun: dryRun, known: known}
+}
+
+// How many binaries to check at once
+func (self *remoteLOBChecker) concurrency() int {
+	// Smart providers talk over a single connection, so requests can't overlap
+	if providers.UpgradeToSmartSyncProvider(self.provider) != nil {
+		return 1
+	}
+	if self.repo.Options.RemoteCheckConcurrency < 1 {
+		return 1
+	}
+	return self.repo.Options.RemoteCheckConcurrency
+}
+
+// Check the remote has all the data for all of shas
+// Returns nil if it does, otherwise the error for one which is missing; once one is found to be
+// missing, the rest aren't necessarily checked
+func (self *remoteLOBChecker) CheckAll(shas []string) error {
+	var tocheck []string
+	for _, sha := range shas {
+		if !self.known.Contains(sha) {
+			tocheck = append(tocheck, sha)
+		}
+	}
+	if len(tocheck) == 0 {
+		return nil
+	}
+
+	workers := self.concurrency()
+	if workers > len(tocheck) {
+		workers = len(tocheck)
+	}
+	jobs := make(chan string, len(tocheck))
+	for _, sha := range tocheck {
+		jobs <- sha
+	}
+	close(jobs)
+
+	var mutex sync.Mutex
+	var found []string
+	var firsterr error
+	var wait sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for sha := range jobs {
+				mutex.Lock()
+				stop := firsterr != nil
+				mutex.Unlock()
+				if stop || util.IsCancelled() {
+					return
+				}
+				err := self.repo.CheckRemoteLOBFilesForSHA(sha, self.provider, self.remoteName)
+				mutex.Lock()
+				if err == nil {
+					found = append(found, sha)
+				} else if firsterr == nil {
+					firsterr = err
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wait.Wait()
+
+	for _, sha := range found {
+		self.known.Add(sha)
+	}
+	if !self.dryRun {
+		err := self.repo.addRemoteKnownLOBs(self.remoteName, found)
+		if err != nil {
+			self.repo.Log.Debugf("Unable to record binaries known to be on %v: %v\n", self.remoteName, err.Error())
+		}
+	}
+	if firsterr == nil && util.IsCancelled() {
+		return util.ErrCancelled
+	}
+	return firsterr
+}
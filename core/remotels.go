@@ -0,0 +1,135 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// A binary stored on a remote, as found by ListRemote
+type RemoteLOB struct {
+	SHA string
+	// Number of files the remote has for it (meta & chunks)
+	Files int
+	// Bytes the remote uses for it
+	Size int64
+	// Whether any commit reachable from a local branch or tag (including remote tracking
+	// branches) refers to it; if not it's an orphan, only on the remote
+	Referenced bool
+}
+
+// What's stored on a remote, as found by ListRemote
+type RemoteListing struct {
+	// Binaries on the remote, in SHA order
+	LOBs []*RemoteLOB
+	// Files which don't belong to one binary, e.g. content-defined chunks which are shared
+	// between binaries, or temporary files left behind by interrupted uploads
+	OtherFiles int
+	OtherSize  int64
+}
+
+// Total bytes used on the remote
+func (self *RemoteListing) TotalSize() int64 {
+	total := self.OtherSize
+	for _, lob := range self.LOBs {
+		total += lob.Size
+	}
+	return total
+}
+
+// Binaries on the remote which nothing refers to
+func (self *RemoteListing) Orphans() []*RemoteLOB {
+	var ret []*RemoteLOB
+	for _, lob := range self.LOBs {
+		if !lob.Referenced {
+			ret = append(ret, lob)
+		}
+	}
+	return ret
+}
+
+var remoteLOBFilenameRegex = regexp.MustCompile(`^(` + LOBSHARegexFragment + `)_(meta|preview|\d+)$`)
+
+// List everything stored on a remote & find which binaries on it aren't referenced by any commit
+// reachable from local branches & tags, i.e. orphans which only take up space on the remote. This
+// needs a provider which can list remotes (see providers.ListingSyncProvider). Fetch first so that
+// remote tracking branches are up to date, otherwise binaries only used by commits pushed by others
+// will be reported as orphans. callback is called regularly so progress can be shown
+func (r *Repo) ListRemote(provider providers.SyncProvider, remoteName string, callback func()) (*RemoteListing, error) {
+	lister := providers.UpgradeToListingSyncProvider(provider)
+	if lister == nil {
+		return nil, fmt.Errorf("Remote %v uses the '%v' provider, which can't list what it stores", remoteName, provider.TypeID())
+	}
+
+	lobsBySHA := make(map[string]*RemoteLOB)
+	listing := &RemoteListing{}
+	err := lister.List(remoteName, func(file *providers.RemoteFile) (quit bool) {
+		callback()
+		match := remoteLOBFilenameRegex.FindStringSubmatch(filepath.Base(file.Filename))
+		if match == nil {
+			listing.OtherFiles++
+			listing.OtherSize += file.Size
+			return false
+		}
+		lob, ok := lobsBySHA[match[1]]
+		if !ok {
+			lob = &RemoteLOB{SHA: match[1]}
+			lobsBySHA[lob.SHA] = lob
+			listing.LOBs = append(listing.LOBs, lob)
+		}
+		lob.Files++
+		lob.Size += file.Size
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(remoteLOBsBySHA(listing.LOBs))
+
+	referenced, err := r.getLOBSHAsReferencedByAllRefs(callback)
+	if err != nil {
+		return nil, err
+	}
+	for _, lob := range listing.LOBs {
+		lob.Referenced = referenced.Contains(lob.SHA)
+	}
+	return listing, nil
+}
+
+type remoteLOBsBySHA []*RemoteLOB
+
+func (self remoteLOBsBySHA) Len() int           { return len(self) }
+func (self remoteLOBsBySHA) Less(i, j int) bool { return self[i].SHA < self[j].SHA }
+func (self remoteLOBsBySHA) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Get the set of LOB SHAs referenced by any commit reachable from any local ref
+func (r *Repo) getLOBSHAsReferencedByAllRefs(callback func()) (util.StringSet, error) {
+	cmd := r.command("git", "log", "--all", "--no-color", "--oneline", "-p", "-G", SHALineRegexStr)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.New("Unable to query git log for binary references: " + err.Error())
+	}
+	scanner := bufio.NewScanner(stdout)
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.New("Unable to query git log for binary references: " + err.Error())
+	}
+	referencedSHAs := util.NewStringSet()
+	for scanner.Scan() {
+		callback()
+		if sha := lobReferenceFromDiffLine(scanner.Text()); sha != "" {
+			referencedSHAs.Add(sha)
+		}
+	}
+	err = cmd.Wait()
+	if err != nil {
+		return nil, errors.New("Unable to query git log for binary references: " + err.Error())
+	}
+	return referencedSHAs, nil
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Remote ls", func() {
+	root := filepath.Join(os.TempDir(), "RemoteLsTest")
+	originBinStore := filepath.Join(os.TempDir(), "RemoteLsOriginBinStoreTest")
+	var oldwd string
+	filespercommit := [][]string{
+		[]string{"img1.png", "img2.png"},
+		[]string{"img3.png"},
+	}
+	var shaspercommit [][]string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		os.MkdirAll(originBinStore, 0755)
+
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		Expect(err).To(BeNil(), "Should not error trying to open config file")
+		f.WriteString(fmt.Sprintf(`
+[remote "origin"]
+    url = file:///dummy/origin
+    git-lob-path = %v
+    git-lob-provider = filesystem
+[remote "unlisted"]
+    url = file:///dummy/unlisted
+    git-lob-url = mock://RemoteLsTest
+    git-lob-provider = mock
+`, strings.Replace(originBinStore, "\\", "/", -1)))
+		f.Close()
+		LoadConfig(GlobalOptions)
+		InitCoreProviders()
+
+		shaspercommit = CreateManyCommitsForTest(filespercommit, 0, func(filename string, i int) int64 { return 500 })
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		err = ForceRemoveAll(originBinStore)
+		if err != nil {
+			Fail(err.Error())
+		}
+		// Reset git config
+		GlobalOptions = NewOptions()
+	})
+
+	It("Lists binaries on a remote & finds orphans", func() {
+		provider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil())
+		var files []string
+		for _, shas := range shaspercommit {
+			for _, sha := range shas {
+				files = append(files, GetLOBMetaRelativePath(sha), GetLOBChunkRelativePath(sha, 0))
+			}
+		}
+		Expect(provider.Upload("origin", files, testRepo().GetLocalLOBRoot(), true, nil)).To(BeNil())
+		// A binary only on the remote, & a stray file
+		orphan, err := testRepo().StoreLOBInBaseDir(originBinStore, bytes.NewReader([]byte("Not committed anywhere")), nil)
+		Expect(err).To(BeNil())
+		Expect(ioutil.WriteFile(filepath.Join(originBinStore, "upload.tmp"), []byte("partial"), 0644)).To(BeNil())
+
+		listing, err := testRepo().ListRemote(provider, "origin", func() {})
+		Expect(err).To(BeNil())
+		Expect(listing.LOBs).To(HaveLen(4), "Should find committed binaries & orphan")
+		Expect(listing.OtherFiles).To(Equal(1))
+		Expect(listing.OtherSize).To(BeEquivalentTo(len("partial")))
+		var total int64
+		for i, lob := range listing.LOBs {
+			if i > 0 {
+				Expect(lob.SHA > listing.LOBs[i-1].SHA).To(BeTrue(), "Should be in SHA order")
+			}
+			Expect(lob.Files).To(Equal(2), "Should count meta & chunk")
+			Expect(lob.Referenced).To(Equal(lob.SHA != orphan.SHA), "Only the uncommitted binary is an orphan")
+			total += lob.Size
+		}
+		Expect(listing.TotalSize()).To(Equal(total + listing.OtherSize))
+		orphans := listing.Orphans()
+		Expect(orphans).To(HaveLen(1))
+		Expect(orphans[0].SHA).To(Equal(orphan.SHA))
+		Expect(orphans[0].Size).To(BeNumerically(">", len("Not committed anywhere")), "Should include meta size")
+	})
+
+	It("Fails for providers which can't list", func() {
+		provider, err := testRepo().GetProvider("unlisted")
+		Expect(err).To(BeNil())
+		// Mock can list, hide that
+		_, err = testRepo().ListRemote(struct{ SyncProvider }{provider}, "unlisted", func() {})
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("can't list"))
+	})
+})
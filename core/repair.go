@@ -0,0 +1,132 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Corrupt binaries (git-lob.autorepair)
+// When a binary is found to be corrupt as it's retrieved (a chunk of the wrong size, metadata which
+// can't be read, or content which doesn't match its SHA) it's recorded in the corruption report. If
+// autorepair is enabled the bad local copy is also deleted & fetched again from the remote it came
+// from (or the default remote), so that checkout can carry on rather than fail.
+
+// A binary found to be corrupt, from the corruption report
+type CorruptLOBRecord struct {
+	Time     time.Time
+	SHA      string
+	Repaired bool
+	Problem  string
+}
+
+// Get the file which records binaries found to be corrupt
+func (r *Repo) getCorruptionReportFile() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "corrupt_log")
+}
+
+// Record that a binary was found to be corrupt & whether it was repaired
+// One line per occurrence: <time> <sha> <repaired|unrepaired> <problem>
+func (r *Repo) recordCorruptLOB(sha, problem string, repaired bool) {
+	file := r.getCorruptionReportFile()
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err == nil {
+			status := "unrepaired"
+			if repaired {
+				status = "repaired"
+			}
+			// Keep to one line per record
+			problem = strings.Replace(strings.TrimSpace(problem), "\n", " ", -1)
+			_, err = fmt.Fprintf(f, "%v %v %v %v\n", time.Now().Format(time.RFC3339), sha, status, problem)
+			f.Close()
+		}
+	}
+	if err != nil {
+		r.Log.Errorf("Unable to record corrupt binary %v in %v: %v\n", sha, file, err.Error())
+	}
+}
+
+// Read the binaries recorded as corrupt, oldest first
+func (r *Repo) readCorruptionReport() ([]*CorruptLOBRecord, error) {
+	data, err := ioutil.ReadFile(r.getCorruptionReportFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ret []*CorruptLOBRecord
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) < 3 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil {
+			continue
+		}
+		rec := &CorruptLOBRecord{Time: t, SHA: fields[1], Repaired: fields[2] == "repaired"}
+		if len(fields) == 4 {
+			rec.Problem = fields[3]
+		}
+		ret = append(ret, rec)
+	}
+	return ret, nil
+}
+
+// Delete the local copy of a corrupt binary, including badfile (which may be a chunk object shared
+// with other binaries, so not deleted by DeleteLOB). The shared store copy is deleted too, since
+// other repos' hard links to it are just as corrupt, and would otherwise be linked back
+func (r *Repo) deleteCorruptLOB(sha, badfile string) error {
+	if badfile != "" {
+		if err := os.Remove(badfile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := r.DeleteLOB(sha); err != nil {
+		return err
+	}
+	if r.IsUsingSharedStorage() {
+		l, err := r.lockSharedStoreSHA(sha)
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+		return deleteLOBFilesInStore(sha, r.GetSharedLOBRoot())
+	}
+	return nil
+}
+
+// Deal with a binary found to be corrupt as it was retrieved: if git-lob.autorepair is enabled,
+// delete the local copy & fetch it again, returning the info of the repaired binary. Otherwise
+// (or if it can't be repaired) returns an error including problem. Either way it's recorded in
+// the corruption report
+func (r *Repo) repairCorruptLOB(sha, badfile string, problem error) (*LOBInfo, error) {
+	if !r.Options.AutoRepair {
+		r.recordCorruptLOB(sha, problem.Error(), false)
+		return nil, problem
+	}
+	r.Log.Errorf("git-lob: %v is corrupt, fetching it again: %v\n", sha, problem.Error())
+	info, err := func() (*LOBInfo, error) {
+		if err := r.deleteCorruptLOB(sha, badfile); err != nil {
+			return nil, fmt.Errorf("Unable to delete corrupt copy: %v", err.Error())
+		}
+		if err := r.AutoFetch(sha, true); err != nil {
+			return nil, err
+		}
+		_, info, err := r.getLOBFilesForSHA(sha, r.GetLocalLOBRoot(), true, false)
+		return info, err
+	}()
+	r.recordCorruptLOB(sha, problem.Error(), err == nil)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%v; unable to repair: %v", problem.Error(), err.Error()))
+	}
+	return info, nil
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Repair", func() {
+	root := filepath.Join(os.TempDir(), "RepairTest")
+	originBinStore := filepath.Join(os.TempDir(), "RepairOriginBinStoreTest")
+	var oldwd string
+	var info *LOBInfo
+	var content []byte
+
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		Expect(err).To(BeNil(), "Should not error trying to open config file")
+		f.WriteString(fmt.Sprintf(`
+[remote "origin"]
+    git-lob-path = %v
+    git-lob-provider = filesystem
+[git-lob]
+    fetch-remotes = origin
+`, strings.Replace(originBinStore, "\\", "/", -1)))
+		f.Close()
+		LoadConfig(GlobalOptions)
+		InitCoreProviders()
+
+		info = CreateAndStoreLOBFileForTest(5000, filepath.Join(root, "file.bin"))
+		var buf bytes.Buffer
+		_, err = testRepo().RetrieveLOB(info.SHA, &buf)
+		Expect(err).To(BeNil(), "Should be able to retrieve before corruption")
+		content = buf.Bytes()
+		err = exec.Command("cp", "-r", testRepo().GetLocalLOBRoot(), originBinStore).Run()
+		Expect(err).To(BeNil(), "Should not error copying local store to remote")
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		for _, dir := range []string{root, originBinStore} {
+			err := ForceRemoveAll(dir)
+			if err != nil {
+				Fail(err.Error())
+			}
+		}
+		// Reset any option changes
+		GlobalOptions = NewOptions()
+	})
+
+	It("Records corrupt binaries without repairing them by default", func() {
+		chunk := testRepo().getLOBChunkPathInBaseDirForInfo(testRepo().GetLocalLOBRoot(), info, 0)
+		Expect(os.Truncate(chunk, 10)).To(BeNil())
+
+		var buf bytes.Buffer
+		_, err := testRepo().RetrieveLOB(info.SHA, &buf)
+		Expect(err).ToNot(BeNil(), "Corrupt binary should not be retrieved")
+		Expect(buf.Len()).To(BeEquivalentTo(0), "Nothing should have been written")
+		Expect(FileExists(chunk)).To(BeTrue(), "Corrupt copy should be left alone")
+
+		records, err := testRepo().readCorruptionReport()
+		Expect(err).To(BeNil())
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].SHA).To(Equal(info.SHA))
+		Expect(records[0].Repaired).To(BeFalse())
+		Expect(records[0].Problem).To(ContainSubstring("wrong size"))
+	})
+
+	It("Fetches chunks of the wrong size again", func() {
+		GlobalOptions.AutoRepair = true
+		chunk := testRepo().getLOBChunkPathInBaseDirForInfo(testRepo().GetLocalLOBRoot(), info, 0)
+		Expect(os.Truncate(chunk, 10)).To(BeNil())
+
+		var buf bytes.Buffer
+		_, err := testRepo().RetrieveLOB(info.SHA, &buf)
+		Expect(err).To(BeNil(), "Corrupt binary should be repaired")
+		Expect(buf.Bytes()).To(Equal(content))
+		Expect(testRepo().CheckLOBFilesForSHA(info.SHA, testRepo().GetLocalLOBRoot(), true)).To(BeNil())
+
+		records, err := testRepo().readCorruptionReport()
+		Expect(err).To(BeNil())
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].SHA).To(Equal(info.SHA))
+		Expect(records[0].Repaired).To(BeTrue())
+	})
+
+	It("Checks out content which doesn't match its SHA after fetching it again", func() {
+		GlobalOptions.AutoRepair = true
+		// Same size, different content
+		chunk := testRepo().getLOBChunkPathInBaseDirForInfo(testRepo().GetLocalLOBRoot(), info, 0)
+		data, err := ioutil.ReadFile(chunk)
+		Expect(err).To(BeNil())
+		data[len(data)/2] ^= 0xff
+		Expect(ioutil.WriteFile(chunk, data, 0644)).To(BeNil())
+
+		path := filepath.Join(root, "file.bin")
+		err = testRepo().checkoutFile(path, info.SHA, LinkModeCopy, nil)
+		Expect(err).To(BeNil(), "Should check out after repairing")
+		checkedOut, err := ioutil.ReadFile(path)
+		Expect(err).To(BeNil())
+		Expect(checkedOut).To(Equal(content))
+
+		records, err := testRepo().readCorruptionReport()
+		Expect(err).To(BeNil())
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].Repaired).To(BeTrue())
+	})
+
+	It("Fails when a corrupt binary can't be fetched again", func() {
+		GlobalOptions.AutoRepair = true
+		Expect(testRepo().DeleteLOBInBaseDir(info.SHA, originBinStore)).To(BeNil())
+		chunk := testRepo().getLOBChunkPathInBaseDirForInfo(testRepo().GetLocalLOBRoot(), info, 0)
+		Expect(os.Truncate(chunk, 10)).To(BeNil())
+
+		var buf bytes.Buffer
+		_, err := testRepo().RetrieveLOB(info.SHA, &buf)
+		Expect(err).ToNot(BeNil(), "Should fail if not on the remote")
+		Expect(err.Error()).To(ContainSubstring("unable to repair"))
+
+		records, err := testRepo().readCorruptionReport()
+		Expect(err).To(BeNil())
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].Repaired).To(BeFalse())
+	})
+})
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+	"github.com/atlassian/git-lob/util/lock"
+)
+
+// Replication
+// A remote can have secondary remotes which everything pushed to it is mirrored to
+// (remote.<name>.git-lob-replicate-to), for redundancy. Before pushing to the primary, push
+// records what it's about to push as pending replication for each secondary, in the same format
+// as the push queue (see pushqueue.go) but in state/replication; each is removed once it's been
+// pushed to the secondary, so nothing is lost if replication fails or is interrupted, and
+// 'replicate --pending' makes whatever's left. Replication pushes from the local store, so it
+// doesn't depend on the primary being reachable. Only one process replicates to a secondary at
+// a time; it carries on until nothing is pending, so pushes recorded meanwhile aren't missed.
+
+// How long to wait to change the record of pending replication
+var ReplicationJournalLockTimeout = 30 * time.Second
+
+// Gets the folder which holds pending replication for all secondaries
+func (r *Repo) getReplicationDir() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "replication")
+}
+
+// Gets the file which holds pending replication to a secondary
+func (r *Repo) getReplicationFile(secondary string) string {
+	return filepath.Join(r.getReplicationDir(), secondary)
+}
+
+// Gets the lock held while changing the record of pending replication
+func (r *Repo) getReplicationJournalLockFile() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "replication.lock")
+}
+
+// Gets the lock held by the process replicating to a secondary
+func (r *Repo) getReplicatingLockFile(secondary string) string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "replicating", secondary+".lock")
+}
+
+// Get the secondary remotes a remote replicates to (remote.<name>.git-lob-replicate-to, separated
+// by spaces or commas), not including the remote itself
+func (r *Repo) GetReplicaRemotes(remoteName string) []string {
+	setting := r.Options.GitConfig[fmt.Sprintf("remote.%v.git-lob-replicate-to", remoteName)]
+	var ret []string
+	seen := util.NewStringSet()
+	for _, name := range strings.FieldsFunc(setting, func(c rune) bool { return c == ',' || c == ' ' || c == '\t' }) {
+		if name != remoteName && !seen.Contains(name) {
+			seen.Add(name)
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// Get the pushes waiting to be replicated to a secondary, oldest first
+func (r *Repo) GetPendingReplication(secondary string) ([]*QueuedPush, error) {
+	return readPushQueueFile(r.getReplicationFile(secondary))
+}
+
+// Get the secondaries which have replication pending, in name order
+func (r *Repo) GetRemotesWithPendingReplication() ([]string, error) {
+	return listPushQueueDir(r.getReplicationDir())
+}
+
+// Change the pushes pending replication to a secondary while holding the journal lock
+func (r *Repo) updatePendingReplication(secondary string, update func(pending []*QueuedPush) []*QueuedPush) error {
+	l, err := lock.Acquire(r.getReplicationJournalLockFile(), ReplicationJournalLockTimeout)
+	if err != nil {
+		return fmt.Errorf("Unable to lock replication journal: %v", err.Error())
+	}
+	defer l.Release()
+	pending, err := r.GetPendingReplication(secondary)
+	if err != nil {
+		return err
+	}
+	return writePushQueueFile(r.getReplicationFile(secondary), update(pending))
+}
+
+// Record a push to a remote as pending replication to each of its secondaries, using the path
+// filters currently configured. Returns the secondaries, none if it doesn't replicate
+func (r *Repo) RecordPendingReplication(remoteName string, refspecs []*GitRefSpec, force, recheck bool) ([]string, error) {
+	secondaries := r.GetReplicaRemotes(remoteName)
+	if len(secondaries) == 0 {
+		return nil, nil
+	}
+	push, err := r.newQueuedPush(refspecs, force, recheck)
+	if err != nil {
+		return nil, err
+	}
+	for _, secondary := range secondaries {
+		err = r.updatePendingReplication(secondary, func(pending []*QueuedPush) []*QueuedPush {
+			for _, p := range pending {
+				if p.isSamePush(push) {
+					return pending
+				}
+			}
+			return append(pending, push)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return secondaries, nil
+}
+
+// Push everything pending replication to a secondary, oldest first, removing each from the
+// journal once it's done; stops at the first which fails, leaving it & the rest pending.
+// Returns without doing anything (replicating false) if another process is already replicating
+// to the secondary. started is called before each push is made
+func (r *Repo) ReplicatePending(provider providers.SyncProvider, secondary string, dryRun bool,
+	started func(push *QueuedPush), callback util.ProgressCallback) (replicating bool, _err error) {
+
+	l, err := lock.Acquire(r.getReplicatingLockFile(secondary), 0)
+	if err != nil {
+		if lock.IsTimeoutError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer l.Release()
+
+	done := 0
+	for {
+		pending, err := r.GetPendingReplication(secondary)
+		if err != nil {
+			return true, err
+		}
+		if dryRun {
+			// Nothing is removed, so only go through them once
+			pending = pending[done:]
+		}
+		if len(pending) == 0 {
+			return true, nil
+		}
+		// Remove each from the journal as it's done, keeping anything recorded since
+		err = r.makeQueuedPushes(provider, secondary, pending[:1], dryRun, started, callback, func([]*QueuedPush) error {
+			return r.updatePendingReplication(secondary, func(current []*QueuedPush) []*QueuedPush {
+				for i, p := range current {
+					if p.isSamePush(pending[0]) {
+						return append(current[:i:i], current[i+1:]...)
+					}
+				}
+				return current
+			})
+		})
+		if err != nil {
+			return true, err
+		}
+		done++
+	}
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Replication", func() {
+	root := filepath.Join(os.TempDir(), "ReplicateTest")
+	remotepath, _ := GetMockRemotePath("mock://ReplicateTestBackup")
+	var oldwd string
+	var shas [][]string
+	callback := func(data *ProgressCallbackData) (abort bool) { return false }
+	started := func(push *QueuedPush) {}
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		LoadConfig(GlobalOptions)
+		GlobalOptions.GitConfig["remote.origin.git-lob-replicate-to"] = "backup, origin backup"
+		GlobalOptions.GitConfig["remote.backup.git-lob-provider"] = "mock"
+		GlobalOptions.GitConfig["remote.backup.git-lob-url"] = "mock://ReplicateTestBackup"
+		GlobalOptions.GitConfig["remote.backup.git-lob-mock-offline"] = "true"
+		InitCoreProviders()
+
+		shas = CreateManyCommitsForTest([][]string{[]string{"one.png"}}, 0,
+			func(filename string, i int) int64 { return int64(500 + i*100) })
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		os.RemoveAll(remotepath)
+		GlobalOptions = NewOptions()
+	})
+
+	It("Records pushes to replicate & keeps them until they're replicated", func() {
+		Expect(testRepo().GetReplicaRemotes("origin")).To(Equal([]string{"backup"}))
+		Expect(testRepo().GetReplicaRemotes("backup")).To(BeEmpty())
+		secondaries, err := testRepo().RecordPendingReplication("backup", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false)
+		Expect(err).To(BeNil())
+		Expect(secondaries).To(BeEmpty(), "Remotes which don't replicate shouldn't record anything")
+
+		refspecs := []*GitRefSpec{&GitRefSpec{Ref1: "master"}}
+		secondaries, err = testRepo().RecordPendingReplication("origin", refspecs, false, false)
+		Expect(err).To(BeNil())
+		Expect(secondaries).To(Equal([]string{"backup"}))
+		_, err = testRepo().RecordPendingReplication("origin", refspecs, false, false)
+		Expect(err).To(BeNil())
+		pending, err := testRepo().GetPendingReplication("backup")
+		Expect(err).To(BeNil())
+		Expect(pending).To(HaveLen(1), "Should not record the same push twice")
+		remotes, err := testRepo().GetRemotesWithPendingReplication()
+		Expect(err).To(BeNil())
+		Expect(remotes).To(Equal([]string{"backup"}))
+
+		// master moves on & is pushed again
+		later := CreateManyCommitsForTest([][]string{[]string{"two.png"}}, 1,
+			func(filename string, i int) int64 { return int64(500 + i*100) })
+		_, err = testRepo().RecordPendingReplication("origin", refspecs, false, false)
+		Expect(err).To(BeNil())
+
+		provider, err := testRepo().GetProvider("backup")
+		Expect(err).To(BeNil())
+		replicating, err := testRepo().ReplicatePending(provider, "backup", false, started, callback)
+		Expect(replicating).To(BeTrue())
+		Expect(err).ToNot(BeNil(), "Should fail while the secondary is unreachable")
+		pending, _ = testRepo().GetPendingReplication("backup")
+		Expect(pending).To(HaveLen(2), "Failed replication should stay pending")
+
+		delete(GlobalOptions.GitConfig, "remote.backup.git-lob-mock-offline")
+		replicating, err = testRepo().ReplicatePending(provider, "backup", true, started, callback)
+		Expect(err).To(BeNil())
+		Expect(replicating).To(BeTrue())
+		pending, _ = testRepo().GetPendingReplication("backup")
+		Expect(pending).To(HaveLen(2), "Dry run should not replicate anything")
+
+		replicating, err = testRepo().ReplicatePending(provider, "backup", false, started, callback)
+		Expect(err).To(BeNil())
+		Expect(replicating).To(BeTrue())
+		Expect(provider.FileExists("backup", GetLOBMetaRelativePath(shas[0][0]))).To(BeTrue())
+		Expect(provider.FileExists("backup", GetLOBMetaRelativePath(later[0][0]))).To(BeTrue())
+		pending, _ = testRepo().GetPendingReplication("backup")
+		Expect(pending).To(BeEmpty())
+		remotes, _ = testRepo().GetRemotesWithPendingReplication()
+		Expect(remotes).To(BeEmpty())
+	})
+})
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/providers/smart"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Embedding git-lob in other Go programs
+// Everything git-lob does to a repository is a method of Repo, which carries where the repository
+// is, the options to use & where to log to; nothing in core reads the working directory or
+// util.GlobalOptions. The command line tool is a wrapper which makes a Repo for the current
+// directory with util.GlobalOptions & util.DefaultLogger. Other programs (build systems, asset
+// pipelines) use OpenRepo, or NewRepo to supply their own options & logger. Operations on
+// different Repos can run at the same time; a Repo does its own locking where git-lob shares state
+// between processes, but like the command line tool shouldn't have the same operation run twice
+// at once. The binary store functions (StoreLOBInBaseDir and friends) only need Options & Log, so
+// a server can use a Repo with just those set.
+
+// A repository which git-lob operations run on
+type Repo struct {
+	// Root of the working copy, or the repository itself if it's bare
+	Root string
+	// The git dir, which isn't always Root/.git
+	GitDir string
+	// Whether the repository has no working copy, see util.IsBareRepo
+	Bare bool
+	// Where git runs & relative paths given to operations are resolved from, usually somewhere
+	// in the working copy (Root for OpenRepo, the current directory for the command line tool)
+	WorkDir string
+	// Options for operations on this repository; can be changed between operations
+	// (e.g. Options.DryRun, Options.FetchIncludePaths)
+	Options *util.Options
+	// Where operations report progress & errors
+	Log *util.Logger
+
+	// What's cached about the repository between operations
+	// Delta stats, loaded on demand
+	cachedDeltaStats *DeltaStats
+	// We never switch branches ourselves, so the current branch is only read once
+	cachedCurrentBranch string
+	// Recent history by commit SHA, only while CacheRecentHistory is in effect
+	recentHistoryCache map[string]*recentLOBHistory
+	// Walk at least this many days back when caching, if walking at all
+	recentHistoryCacheMinDays int
+	lobIgnoreCache            lobIgnorePatternCache
+	// The clean filter checks every file added against the locks, so the default push remote & the
+	// locks cached for each remote are only read once (by cache file, see getLocksCacheFile)
+	defaultLockRemote     string
+	defaultLockRemoteOnce sync.Once
+	lockCheckCache        map[string]map[string]*providers.FileLock
+	lockCheckCacheMutex   sync.Mutex
+	// Verification results so far, keyed on payload & signature; checkout verifies every binary it
+	// retrieves
+	lobSignatureResults      map[string]*LOBSignatureResult
+	lobSignatureResultsMutex sync.Mutex
+	// Unknown lob-storage values already reported, so each is only reported once
+	reportedStorageClasses util.StringSet
+	// Push state transactions open, by id
+	openPushStateTransactions      util.StringSet
+	openPushStateTransactionsMutex sync.Mutex
+}
+
+// Providers are only registered once per process
+var repoProvidersOnce sync.Once
+
+// Open the repository containing path & read its git-lob options from its git config, having
+// registered the core providers. Nothing is written to the console; set Log to a util.NewLogger
+// with writers to see progress
+func OpenRepo(path string) (*Repo, error) {
+	repoProvidersOnce.Do(func() {
+		providers.InitCoreProviders()
+		smart.InitCoreProviders()
+	})
+	opts := util.NewOptions()
+	log := util.NewLogger(opts, nil, nil)
+	repo, err := NewRepo(path, opts, log)
+	if err != nil {
+		return nil, err
+	}
+	repo.WorkDir = repo.Root
+	util.LoadRepoConfig(repo.GitDir, opts, log)
+	return repo, nil
+}
+
+// Make a Repo for the repository containing dir with opts & log, which are used as they are
+// (see util.LoadRepoConfig to read the repository's config into opts). Git runs in dir & relative
+// paths are resolved from it. Registering providers is up to the caller
+func NewRepo(dir string, opts *util.Options, log *util.Logger) (*Repo, error) {
+	workDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, isSeparate, isBare, err := util.FindRepoRoot(workDir)
+	if err != nil {
+		return nil, err
+	}
+	gitDir, err := util.FindGitDir(root, isSeparate, isBare)
+	if err != nil {
+		return nil, err
+	}
+	return &Repo{Root: root, GitDir: gitDir, Bare: isBare, WorkDir: workDir, Options: opts, Log: log}, nil
+}
+
+// Get the provider for a remote of this repository, see providers.GetProviderForRemote
+func (r *Repo) GetProvider(remoteName string) (providers.SyncProvider, error) {
+	return providers.GetProviderForRemote(r.Root, r.Options, r.Log, remoteName)
+}
+
+// Resolve a path given to an operation, which if it's relative is relative to WorkDir
+func (r *Repo) absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(r.WorkDir, path)
+}
+
+// Find files matching a glob pattern relative to WorkDir, keeping them relative if it is
+func (r *Repo) globRelativeToWorkDir(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(r.absPath(pattern))
+	if err != nil || filepath.IsAbs(pattern) {
+		return matches, err
+	}
+	for i, match := range matches {
+		if rel, err := filepath.Rel(r.WorkDir, match); err == nil {
+			matches[i] = rel
+		}
+	}
+	return matches, nil
+}
+
+// A command which runs in WorkDir
+func (r *Repo) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = r.WorkDir
+	return cmd
+}
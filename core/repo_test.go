@@ -0,0 +1,94 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Repo", func() {
+	root := filepath.Join(os.TempDir(), "RepoTest")
+	otherRoot := filepath.Join(os.TempDir(), "RepoOtherTest")
+	remotepath := filepath.Join(os.TempDir(), "RepoRemoteTest")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		CreateGitRepoForTest(otherRoot)
+		os.MkdirAll(remotepath, 0755)
+		oldwd, _ = os.Getwd()
+		// Operations shouldn't depend on where we are
+		os.Chdir(otherRoot)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		ForceRemoveAll(root)
+		ForceRemoveAll(otherRoot)
+		ForceRemoveAll(remotepath)
+	})
+
+	It("Works on a repository other than the current one", func() {
+		f, err := os.OpenFile(filepath.Join(root, ".git", "config"), os.O_WRONLY|os.O_APPEND, 0644)
+		Expect(err).To(BeNil())
+		f.WriteString("[git-lob]\n    verbose = true\n[remote \"origin\"]\n    git-lob-provider = filesystem\n    git-lob-path = " +
+			filepath.ToSlash(remotepath) + "\n")
+		f.Close()
+		globalOptions := *GlobalOptions
+
+		os.MkdirAll(filepath.Join(root, "sub"), 0755)
+		repo, err := OpenRepo(filepath.Join(root, "sub"))
+		Expect(err).To(BeNil())
+		Expect(repo.Root).To(Equal(root), "Should find the root from inside the repository")
+		Expect(repo.GitDir).To(Equal(filepath.Join(root, ".git")))
+		Expect(repo.Options.Verbose).To(BeTrue(), "Should read the repository's config")
+		Expect(GlobalOptions.Verbose).To(Equal(globalOptions.Verbose), "Global options should be left alone")
+
+		info, err := repo.StoreLOB(bytes.NewReader([]byte("Embedded content")), nil)
+		Expect(err).To(BeNil())
+		Expect(FileExists(repo.GetLocalLOBMetaPath(info.SHA))).To(BeTrue(), "Should store in the repository")
+		_, err = testRepo().GetLOBInfo(info.SHA)
+		Expect(err).ToNot(BeNil(), "Should not have stored in the current repository")
+
+		var content bytes.Buffer
+		_, err = repo.RetrieveLOB(info.SHA, &content)
+		Expect(err).To(BeNil())
+		Expect(content.String()).To(Equal("Embedded content"))
+
+		err = ioutil.WriteFile(filepath.Join(root, "embedded.bin"), []byte(fmt.Sprintf("git-lob: %v", info.SHA)), 0644)
+		Expect(err).To(BeNil())
+		Expect(exec.Command("git", "-C", root, "add", "embedded.bin").Run()).To(BeNil())
+		Expect(exec.Command("git", "-C", root, "commit", "-m", "Embedded").Run()).To(BeNil())
+		provider, err := repo.GetProvider("origin")
+		Expect(err).To(BeNil())
+		err = repo.Push(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false,
+			func(data *ProgressCallbackData) bool { return false })
+		Expect(err).To(BeNil())
+		Expect(FileExists(filepath.Join(remotepath, GetLOBMetaRelativePath(info.SHA)))).To(BeTrue(), "Should push to the repository's remote")
+		cwd, _ := os.Getwd()
+		Expect(cwd).To(Equal(otherRoot), "Should leave the working directory alone")
+	})
+
+	It("Keeps what's cached about each repository apart", func() {
+		CreateInitialCommitForTest(otherRoot)
+		CreateBranchForTest("other")
+		CheckoutForTest("other")
+		repo, err := OpenRepo(root)
+		Expect(err).To(BeNil())
+		opts := NewOptions()
+		other, err := NewRepo(".", opts, NewLogger(opts, nil, nil))
+		Expect(err).To(BeNil())
+		Expect(other.Root).To(Equal(otherRoot), "Should resolve the directory given")
+
+		Expect(repo.GetGitCurrentBranch()).To(Equal("master"))
+		Expect(other.GetGitCurrentBranch()).To(Equal("other"), "Should not use the other repository's cached branch")
+		Expect(repo.CacheRecentHistory(30)).To(BeTrue())
+		Expect(other.recentHistoryCache).To(BeNil(), "Should only cache history for one repository")
+		repo.ClearRecentHistoryCache()
+	})
+})
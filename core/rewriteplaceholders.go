@@ -0,0 +1,403 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Placeholder consistency
+// Committing from a clone where the filters aren't installed leaves things in a mess: binaries
+// which .gitattributes says belong in git-lob are committed as raw content, or placeholders are
+// committed for files git-lob doesn't store, so nothing ever fills them in. Rewriting finds both
+// in the index, stores raw content in the binary store & stages its placeholder instead, or stages
+// the content of a binary in place of its placeholder where the binary is in the local store, then
+// commits the result.
+
+type PlaceholderRewriteType int
+
+const (
+	// Raw content of a file stored by git-lob was stored & replaced by its placeholder
+	PlaceholderRewriteStored PlaceholderRewriteType = iota
+	// Placeholder of a file not stored by git-lob was replaced by the binary's content
+	PlaceholderRewriteRestored PlaceholderRewriteType = iota
+	// Placeholder of a file not stored by git-lob couldn't be replaced, the binary isn't in the local store
+	PlaceholderRewriteMissing PlaceholderRewriteType = iota
+	// File could not be rewritten
+	PlaceholderRewriteError PlaceholderRewriteType = iota
+)
+
+// A file which was (or on a dry run would be) rewritten
+type PlaceholderRewrite struct {
+	Type PlaceholderRewriteType
+	// Path of the file, relative to the root of the repo
+	Filename string
+	// The binary stored or restored (not known for PlaceholderRewriteStored on a dry run)
+	SHA string
+	// Size of the file's content
+	Size int64
+	// Error for PlaceholderRewriteError
+	Error error
+}
+
+// What rewriting placeholders did
+type RewritePlaceholdersResult struct {
+	// Files found to be inconsistent, in path order
+	Files []*PlaceholderRewrite
+	// The commit made, "" if nothing was committed
+	Commit string
+}
+
+// Count of files rewritten of a type
+func (self *RewritePlaceholdersResult) Count(t PlaceholderRewriteType) int {
+	var n int
+	for _, file := range self.Files {
+		if file.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+// An entry in the index
+type gitIndexEntry struct {
+	Mode     string
+	Object   string
+	Size     int64
+	Filename string
+}
+
+// Rewrite files in the index whose content doesn't match whether git-lob stores them, see above
+// Unless noCommit is true the rewritten index is committed with message. There mustn't be any
+// changes staged already, so that nothing else ends up in that commit
+func (r *Repo) RewritePlaceholders(message string, noCommit, dryRun bool) (*RewritePlaceholdersResult, error) {
+	root := r.Root
+	if !dryRun && !noCommit {
+		cmd := r.command("git", "diff", "--cached", "--quiet")
+		cmd.Dir = root
+		if cmd.Run() != nil {
+			return nil, fmt.Errorf("There are changes staged already; commit them first, or use --no-commit")
+		}
+	}
+	entries, err := r.getGitIndexEntries(root)
+	if err != nil {
+		return nil, err
+	}
+	filenames := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		filenames = append(filenames, entry.Filename)
+	}
+	stored, err := r.getPathsStoredInLOB(root, filenames)
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything which could be a placeholder has to be read to know; anything else can't be one
+	var maybePlaceholders []string
+	for _, entry := range entries {
+		if isLOBPlaceholderSize(entry.Size) {
+			maybePlaceholders = append(maybePlaceholders, entry.Object)
+		}
+	}
+	contents, err := r.readGitBlobs(root, maybePlaceholders)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RewritePlaceholdersResult{}
+	var indexInfo bytes.Buffer
+	var restored []*PlaceholderRewrite
+	for _, entry := range entries {
+		var placeholder *LOBPlaceholder
+		if content, ok := contents[entry.Object]; ok {
+			placeholder, _ = parseLOBPlaceholder(content)
+		}
+		var rewrite *PlaceholderRewrite
+		var object string
+		if stored.Contains(entry.Filename) {
+			if placeholder != nil || r.IsLOBIgnored(entry.Filename) {
+				continue
+			}
+			rewrite = &PlaceholderRewrite{Type: PlaceholderRewriteStored, Filename: entry.Filename, Size: entry.Size}
+			if !dryRun {
+				object, err = r.storeGitBlobAsLOB(root, entry, rewrite)
+			}
+		} else {
+			if placeholder == nil {
+				continue
+			}
+			rewrite = &PlaceholderRewrite{Type: PlaceholderRewriteRestored, Filename: entry.Filename, SHA: placeholder.SHA, Size: placeholder.Size}
+			if r.IsLOBMissing(placeholder.SHA, false) {
+				rewrite.Type = PlaceholderRewriteMissing
+			} else if !dryRun {
+				object, err = r.restoreLOBAsGitBlob(root, rewrite)
+			}
+		}
+		if err != nil {
+			rewrite.Type = PlaceholderRewriteError
+			rewrite.Error = err
+			err = nil
+		} else if object != "" {
+			fmt.Fprintf(&indexInfo, "%v %v\t%v\x00", entry.Mode, object, entry.Filename)
+			if rewrite.Type == PlaceholderRewriteRestored {
+				restored = append(restored, rewrite)
+			}
+		}
+		result.Files = append(result.Files, rewrite)
+	}
+	if dryRun || indexInfo.Len() == 0 {
+		return result, nil
+	}
+
+	cmd := r.command("git", "update-index", "-z", "--index-info")
+	cmd.Dir = root
+	cmd.Stdin = &indexInfo
+	if outp, err := cmd.CombinedOutput(); err != nil {
+		return result, fmt.Errorf("Error calling 'git update-index': %v\n%v", err.Error(), string(outp))
+	}
+	// Placeholders left in the working copy would now show as changes
+	var refresh []string
+	for _, rewrite := range restored {
+		if r.replaceWorkingCopyPlaceholder(root, rewrite) {
+			refresh = append(refresh, rewrite.Filename)
+		}
+	}
+	if len(refresh) > 0 {
+		r.GitRefreshIndexForFiles(refresh)
+	}
+	if noCommit {
+		return result, nil
+	}
+	cmd = r.command("git", "commit", "-q", "-m", message)
+	cmd.Dir = root
+	if outp, err := cmd.CombinedOutput(); err != nil {
+		return result, fmt.Errorf("Error calling 'git commit': %v\n%v", err.Error(), string(outp))
+	}
+	cmd = r.command("git", "rev-parse", "HEAD")
+	cmd.Dir = root
+	outp, err := cmd.Output()
+	if err != nil {
+		return result, fmt.Errorf("Error calling 'git rev-parse': %v", err.Error())
+	}
+	result.Commit = strings.TrimSpace(string(outp))
+	return result, nil
+}
+
+// Get the regular files in the index with the sizes of their content, in path order, optionally
+// limited to pathspecs. Merge conflicts have to be resolved first
+func (r *Repo) getGitIndexEntries(root string, pathspecs ...string) ([]*gitIndexEntry, error) {
+	cmd := r.command("git", append([]string{"ls-files", "-s", "-z", "--"}, pathspecs...)...)
+	cmd.Dir = root
+	outp, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error calling 'git ls-files': %v", err.Error())
+	}
+	var ret []*gitIndexEntry
+	var objects []string
+	// <mode> SP <object> SP <stage> TAB <path> NUL
+	for _, line := range strings.Split(string(outp), "\x00") {
+		tab := strings.Index(line, "\t")
+		if tab == -1 {
+			continue
+		}
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[2] != "0" {
+			return nil, fmt.Errorf("%v has merge conflicts, resolve them first", line[tab+1:])
+		}
+		// Symlinks & submodules are never placeholders
+		if fields[0] != "100644" && fields[0] != "100755" {
+			continue
+		}
+		ret = append(ret, &gitIndexEntry{Mode: fields[0], Object: fields[1], Filename: line[tab+1:]})
+		objects = append(objects, fields[1])
+	}
+	sizes, err := r.getGitBlobSizes(root, objects)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range ret {
+		entry.Size = sizes[entry.Object]
+	}
+	return ret, nil
+}
+
+// Run 'git cat-file' in a batch mode on objects
+func (r *Repo) runGitCatFileBatch(root, mode string, objects []string) ([]byte, error) {
+	cmd := r.command("git", "cat-file", mode)
+	cmd.Dir = root
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Write & read at the same time, or both sides can fill their pipes
+	go func() {
+		w := bufio.NewWriter(stdin)
+		for _, object := range objects {
+			fmt.Fprintln(w, object)
+		}
+		w.Flush()
+		stdin.Close()
+	}()
+	outp, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error calling 'git cat-file': %v", err.Error())
+	}
+	return outp, nil
+}
+
+// Get the sizes of git blobs
+func (r *Repo) getGitBlobSizes(root string, objects []string) (map[string]int64, error) {
+	ret := make(map[string]int64, len(objects))
+	if len(objects) == 0 {
+		return ret, nil
+	}
+	outp, err := r.runGitCatFileBatch(root, "--batch-check", objects)
+	if err != nil {
+		return nil, err
+	}
+	// <object> SP <type> SP <size> LF
+	for _, line := range strings.Split(string(outp), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err == nil {
+			ret[fields[0]] = size
+		}
+	}
+	return ret, nil
+}
+
+// Read the content of small git blobs
+func (r *Repo) readGitBlobs(root string, objects []string) (map[string][]byte, error) {
+	ret := make(map[string][]byte, len(objects))
+	if len(objects) == 0 {
+		return ret, nil
+	}
+	outp, err := r.runGitCatFileBatch(root, "--batch", objects)
+	if err != nil {
+		return nil, err
+	}
+	// <object> SP <type> SP <size> LF <content> LF
+	for len(outp) > 0 {
+		eol := bytes.IndexByte(outp, '\n')
+		if eol == -1 {
+			break
+		}
+		fields := strings.Fields(string(outp[:eol]))
+		outp = outp[eol+1:]
+		if len(fields) != 3 {
+			// e.g. '<object> missing'
+			continue
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || size+1 > len(outp) {
+			return nil, fmt.Errorf("Unexpected output from 'git cat-file' for %v", fields[0])
+		}
+		ret[fields[0]] = outp[:size]
+		outp = outp[size+1:]
+	}
+	return ret, nil
+}
+
+// Store the raw content of a file committed without the filter in the binary store, returning the
+// git blob of its placeholder & filling in the SHA
+func (r *Repo) storeGitBlobAsLOB(root string, entry *gitIndexEntry, rewrite *PlaceholderRewrite) (string, error) {
+	cmd := r.command("git", "cat-file", "blob", entry.Object)
+	cmd.Dir = root
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err = cmd.Start(); err != nil {
+		return "", fmt.Errorf("Error calling 'git cat-file': %v", err.Error())
+	}
+	info, err := r.StoreLOB(outp, nil)
+	// Drain anything left so git can exit if storing failed part way
+	io.Copy(ioutil.Discard, outp)
+	if waiterr := cmd.Wait(); err == nil && waiterr != nil {
+		err = fmt.Errorf("Error calling 'git cat-file': %v", waiterr.Error())
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to store %v: %v", entry.Filename, err.Error())
+	}
+	rewrite.SHA = info.SHA
+	r.generateLOBPreviewOrWarn(info.SHA, entry.Filename)
+	return r.writeGitBlob(root, strings.NewReader(r.getLOBPlaceholderContentForFile(info.SHA, info.Size, entry.Filename)))
+}
+
+// Write the content of a binary to git as a blob, returning the blob & filling in the size
+func (r *Repo) restoreLOBAsGitBlob(root string, rewrite *PlaceholderRewrite) (string, error) {
+	rd, w := io.Pipe()
+	go func() {
+		info, err := r.RetrieveLOB(rewrite.SHA, w)
+		if err == nil {
+			rewrite.Size = info.Size
+		}
+		w.CloseWithError(err)
+	}()
+	object, err := r.writeGitBlob(root, rd)
+	// Let the retrieval finish if git gave up early
+	io.Copy(ioutil.Discard, rd)
+	if err != nil {
+		return "", fmt.Errorf("Unable to restore %v: %v", rewrite.Filename, err.Error())
+	}
+	return object, nil
+}
+
+// Write content to git as a blob with 'git hash-object', returning the blob
+func (r *Repo) writeGitBlob(root string, in io.Reader) (string, error) {
+	cmd := r.command("git", "hash-object", "-w", "--stdin")
+	cmd.Dir = root
+	cmd.Stdin = in
+	outp, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error calling 'git hash-object': %v", err.Error())
+	}
+	return strings.TrimSpace(string(outp)), nil
+}
+
+// Write the content of a restored binary over its placeholder in the working copy, if it's
+// still there. Returns whether the file was replaced
+func (r *Repo) replaceWorkingCopyPlaceholder(root string, rewrite *PlaceholderRewrite) bool {
+	path := filepath.Join(root, filepath.FromSlash(rewrite.Filename))
+	stat, err := os.Stat(path)
+	if err != nil || !isLOBPlaceholderSize(stat.Size()) {
+		return false
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	if placeholder, ok := parseLOBPlaceholder(content); !ok || placeholder.SHA != rewrite.SHA {
+		return false
+	}
+	// Write alongside & rename over, as for import
+	tmp := path + ".gitlobrewrite"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode().Perm())
+	if err == nil {
+		_, err = r.RetrieveLOB(rewrite.SHA, f)
+		if closeerr := f.Close(); err == nil {
+			err = closeerr
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		r.Log.Errorf("Unable to write %v to the working copy: %v\n", rewrite.Filename, err.Error())
+		return false
+	}
+	return true
+}
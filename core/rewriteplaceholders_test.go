@@ -0,0 +1,101 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Rewrite placeholders", func() {
+	root := filepath.Join(os.TempDir(), "RewritePlaceholdersTest")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		LoadConfig(GlobalOptions)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		GlobalOptions = NewOptions()
+	})
+
+	It("Stores raw content & restores placeholders committed without the filter", func() {
+		// No filter is configured, so everything is committed as it is
+		Expect(ioutil.WriteFile(".gitattributes", []byte("*.png filter=lob -crlf\n"), 0644)).To(BeNil())
+		Expect(ioutil.WriteFile(LOBIgnoreFilename, []byte("ref/\n"), 0644)).To(BeNil())
+		os.MkdirAll(filepath.Join(root, "ref"), 0755)
+		CreateRandomFileForTest(2000, filepath.Join(root, "img1.png"))
+		CreateRandomFileForTest(500, filepath.Join(root, "ref", "small.png"))
+		docContent := []byte("Not really a binary\n")
+		docInfo, err := testRepo().StoreLOB(bytes.NewReader(docContent), nil)
+		Expect(err).To(BeNil())
+		Expect(ioutil.WriteFile("doc.txt", []byte(getLOBPlaceholderContent(docInfo.SHA)), 0644)).To(BeNil())
+		Expect(ioutil.WriteFile("other.txt", []byte(getLOBPlaceholderContent(strings.Repeat("1", 40))), 0644)).To(BeNil())
+		RunGitCommandForTest(true, "add", ".")
+		RunGitCommandForTest(true, "commit", "-m", "Without the filter")
+
+		result, err := testRepo().RewritePlaceholders("Rewrite", false, true)
+		Expect(err).To(BeNil())
+		Expect(result.Commit).To(BeEmpty())
+		Expect(result.Files).To(HaveLen(3))
+		Expect(result.Files[0].Filename).To(Equal("doc.txt"))
+		Expect(result.Files[0].Type).To(Equal(PlaceholderRewriteRestored))
+		Expect(result.Files[1].Filename).To(Equal("img1.png"))
+		Expect(result.Files[1].Type).To(Equal(PlaceholderRewriteStored))
+		Expect(result.Files[2].Filename).To(Equal("other.txt"))
+		Expect(result.Files[2].Type).To(Equal(PlaceholderRewriteMissing))
+		Expect(strings.TrimSpace(RunGitCommandForTest(true, "rev-list", "--count", "HEAD"))).To(Equal("1"), "Dry run should not commit")
+
+		result, err = testRepo().RewritePlaceholders("Rewrite", false, false)
+		Expect(err).To(BeNil())
+		Expect(result.Commit).ToNot(BeEmpty())
+		Expect(result.Count(PlaceholderRewriteStored)).To(Equal(1))
+		Expect(result.Count(PlaceholderRewriteRestored)).To(Equal(1))
+		Expect(result.Count(PlaceholderRewriteMissing)).To(Equal(1))
+
+		committed := RunGitCommandForTest(true, "cat-file", "blob", "HEAD:img1.png")
+		placeholder, ok := parseLOBPlaceholder([]byte(committed))
+		Expect(ok).To(BeTrue(), "Raw content should be replaced by a placeholder")
+		Expect(placeholder.SHA).To(Equal(result.Files[1].SHA))
+		Expect(testRepo().IsLOBMissing(placeholder.SHA, true)).To(BeFalse(), "Raw content should be stored")
+		Expect(RunGitCommandForTest(true, "cat-file", "blob", "HEAD:doc.txt")).To(Equal(string(docContent)))
+		content, _ := ioutil.ReadFile("doc.txt")
+		Expect(content).To(Equal(docContent), "Working copy placeholder should be replaced")
+		_, ok = parseLOBPlaceholder([]byte(RunGitCommandForTest(true, "cat-file", "blob", "HEAD:ref/small.png")))
+		Expect(ok).To(BeFalse(), "Files in .gitlobignore should be left alone")
+
+		result, err = testRepo().RewritePlaceholders("Rewrite", false, false)
+		Expect(err).To(BeNil())
+		Expect(result.Commit).To(BeEmpty(), "Nothing left to commit")
+		Expect(result.Files).To(HaveLen(1))
+	})
+
+	It("Won't commit over changes already staged", func() {
+		Expect(ioutil.WriteFile(".gitattributes", []byte("*.png filter=lob -crlf\n"), 0644)).To(BeNil())
+		RunGitCommandForTest(true, "add", ".")
+		RunGitCommandForTest(true, "commit", "-m", "Initial")
+		CreateRandomFileForTest(1000, filepath.Join(root, "img1.png"))
+		RunGitCommandForTest(true, "add", "img1.png")
+
+		_, err := testRepo().RewritePlaceholders("Rewrite", false, false)
+		Expect(err).ToNot(BeNil())
+
+		result, err := testRepo().RewritePlaceholders("", true, false)
+		Expect(err).To(BeNil())
+		Expect(result.Commit).To(BeEmpty())
+		Expect(result.Count(PlaceholderRewriteStored)).To(Equal(1))
+		_, ok := parseLOBPlaceholder([]byte(RunGitCommandForTest(true, "cat-file", "blob", ":img1.png")))
+		Expect(ok).To(BeTrue(), "Placeholder should be staged")
+	})
+})
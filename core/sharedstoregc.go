@@ -0,0 +1,88 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+	"github.com/atlassian/git-lob/util/lock"
+)
+
+// Automatic shared store maintenance (git-lob.sharedstore-gc-days)
+// Binaries in the shared store are only deleted when a repo prunes them, so a repo which is
+// deleted manually leaves all its binaries behind. 'git lob prune-shared' removes them but has
+// to be run by hand; with sharedstore-gc-days set it's done after a push or fetch completes,
+// at most every so many days. Every repo using the shared store shares the schedule, & a lock
+// stops several repos (or CI agents) from doing it at the same time.
+
+// Result of automatic shared store maintenance, see RunSharedStoreGCIfDue
+type SharedStoreGCResult struct {
+	// Binaries deleted because no repo links them any more
+	Deleted []string
+	// Bytes reclaimed, including chunk objects
+	Reclaimed int64
+}
+
+// Lock held while maintaining the shared store, in the same folder as binary locks so that
+// housekeeping cleans it up if its holder goes away
+func (r *Repo) getSharedStoreGCLockFile() string {
+	return filepath.Join(r.GetSharedLOBRoot(), sharedStoreLockDir, "gc")
+}
+
+// Records when the shared store was last maintained, for all repos using it
+func (r *Repo) getSharedStoreGCStateFile() string {
+	return filepath.Join(r.GetSharedLOBRoot(), ".last_gc")
+}
+
+// Is automatic shared store maintenance enabled & due?
+func (r *Repo) isSharedStoreGCDue() bool {
+	if r.Options.SharedStoreGCDays <= 0 || !r.IsUsingSharedStorage() {
+		return false
+	}
+	fi, err := os.Stat(r.getSharedStoreGCStateFile())
+	return err != nil || time.Since(fi.ModTime()) >= time.Duration(r.Options.SharedStoreGCDays)*24*time.Hour
+}
+
+// Prune the shared store (see PruneSharedStore) if git-lob.sharedstore-gc-days is set & it hasn't
+// been done for that long, by any repo. Returns nil if it wasn't due, or another process is
+// already doing it
+func (r *Repo) RunSharedStoreGCIfDue(callback PruneCallback) (*SharedStoreGCResult, error) {
+	if !r.isSharedStoreGCDue() {
+		return nil, nil
+	}
+	l, err := lock.Acquire(r.getSharedStoreGCLockFile(), 0)
+	if err != nil {
+		if lock.IsTimeoutError(err) || lock.IsDeadlockError(err) {
+			r.Log.Debugf("Shared store maintenance is already running: %v\n", err.Error())
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer l.Release()
+	// Check again, may have just been done by whoever had the lock
+	if !r.isSharedStoreGCDue() {
+		return nil, nil
+	}
+	// Mark as done first, so that a failure isn't retried by every push & fetch
+	statefile := r.getSharedStoreGCStateFile()
+	if err := ioutil.WriteFile(statefile, []byte(time.Now().Format(time.RFC3339)), 0644); err != nil {
+		return nil, err
+	}
+	deleted, reclaimed, err := r.pruneSharedStoreWithSize(false, callback)
+	if err != nil {
+		return nil, err
+	}
+	r.Log.Debugf("Shared store maintenance deleted %d binaries (%v)\n", len(deleted), util.FormatSize(reclaimed))
+	return &SharedStoreGCResult{Deleted: deleted, Reclaimed: reclaimed}, nil
+}
+
+// Size of a file, or 0 if it can't be read
+func getFileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
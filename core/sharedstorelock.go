@@ -0,0 +1,80 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+	"github.com/atlassian/git-lob/util/lock"
+)
+
+// Several repos, or processes in the same repo (e.g. CI agents), can use a shared store at
+// the same time. Shared files with only 1 hard link are deleted by pruning, so without
+// coordination a prune can delete a file just as another repo checks it's there & links it,
+// leaving that repo with a copy the shared store no longer knows about, or with nothing.
+// So checking a shared file & then linking, replacing or deleting it is done while holding
+// a lock for its binary (or chunk object) in the shared store. Locks are short-lived, one
+// file at a time, so that pruning never blocks storing for long. They're OS locks (see
+// util/lock), so they're never left behind & different binaries never wait for each other.
+
+// Folder under the shared store holding locks
+const sharedStoreLockDir = ".locks"
+
+// How long to wait for another process to finish with a file in the shared store
+var SharedStoreLockTimeout = 30 * time.Second
+
+// A held shared store lock, which must be released with Release()
+type sharedStoreLock struct {
+	repo *Repo
+	l    *lock.OSLock
+}
+
+// Get the lock file for a binary or chunk object in the shared store
+func (r *Repo) getSharedStoreLockFile(sha string) string {
+	return filepath.Join(r.GetSharedLOBRoot(), sharedStoreLockDir, sha)
+}
+
+// Is this the lock file for a binary or chunk object in the shared store?
+func isSharedStoreSHALockFile(path string) bool {
+	return filepath.Base(filepath.Dir(path)) == sharedStoreLockDir && IsLOBSHA(filepath.Base(path))
+}
+
+// Lock a binary or chunk object in the shared store, identified by its SHA
+func (r *Repo) lockSharedStoreSHA(sha string) (*sharedStoreLock, error) {
+	l, err := lock.AcquireOSLock(r.getSharedStoreLockFile(sha), SharedStoreLockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to lock %v in shared store: %v", sha, err.Error())
+	}
+	return &sharedStoreLock{r, l}, nil
+}
+
+// Lock the binary or chunk object which a file in the shared store belongs to
+func (r *Repo) lockSharedStoreFile(sharedfile string) (*sharedStoreLock, error) {
+	sha, ok := getLOBStoreFileSHA(sharedfile)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a binary file in the shared store", sharedfile)
+	}
+	return r.lockSharedStoreSHA(sha)
+}
+
+func (self *sharedStoreLock) Release() {
+	if err := self.l.Release(); err != nil {
+		self.repo.Log.Debugf("Unable to release shared store lock %v: %v\n", self.l.Path, err.Error())
+	}
+}
+
+// Link a file from the shared store into the local repo, provided it's there (& of size sz,
+// unless sz < 0), holding its lock so that it can't be pruned in the meantime
+// Returns whether the file was linked
+func (r *Repo) linkSharedLOBFilenameIfPresent(sharedfile string, sz int64) (bool, error) {
+	l, err := r.lockSharedStoreFile(sharedfile)
+	if err != nil {
+		return false, err
+	}
+	defer l.Release()
+	if sz < 0 && !util.FileExists(sharedfile) || sz >= 0 && !util.FileExistsAndIsOfSize(sharedfile, sz) {
+		return false, nil
+	}
+	return true, r.linkSharedLOBFilename(sharedfile)
+}
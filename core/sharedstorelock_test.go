@@ -0,0 +1,124 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+	"github.com/atlassian/git-lob/util/lock"
+)
+
+var _ = Describe("Shared store locking", func() {
+	root := filepath.Join(os.TempDir(), "SharedStoreLockTest")
+	sharedStore := filepath.Join(os.TempDir(), "SharedStoreLockTest_SharedStore")
+	var oldwd string
+	var oldTimeout time.Duration
+	var info *LOBInfo
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		os.MkdirAll(sharedStore, 0755)
+		GlobalOptions.SharedStore = sharedStore
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		oldTimeout = SharedStoreLockTimeout
+		SharedStoreLockTimeout = 100 * time.Millisecond
+
+		var err error
+		info, err = testRepo().StoreLOB(bytes.NewReader([]byte("Shared store lock test content")), nil)
+		Expect(err).To(BeNil())
+	})
+	AfterEach(func() {
+		SharedStoreLockTimeout = oldTimeout
+		os.Chdir(oldwd)
+		GlobalOptions.SharedStore = ""
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		err = ForceRemoveAll(sharedStore)
+		if err != nil {
+			Fail(err.Error())
+		}
+	})
+
+	// Simulate another process holding the lock for a binary; OS locks belong to open files, so
+	// one taken directly excludes this process's own locking
+	holdLockElsewhere := func(sha string) *lock.OSLock {
+		l, err := lock.AcquireOSLock(filepath.Join(sharedStore, sharedStoreLockDir, sha), 0)
+		Expect(err).To(BeNil())
+		return l
+	}
+	removeLocal := func() {
+		os.Remove(testRepo().GetLocalLOBMetaPath(info.SHA))
+		os.Remove(testRepo().GetLocalLOBChunkPath(info.SHA, 0))
+	}
+
+	It("Waits for other processes", func() {
+		l := holdLockElsewhere(info.SHA)
+		removeLocal()
+		Expect(testRepo().recoverLocalLOBFilesFromSharedStore(info.SHA)).To(BeFalse(), "Shouldn't link while locked elsewhere")
+
+		deleted, err := testRepo().PruneSharedStore(false, func(t PruneCallbackType, sha string) {})
+		Expect(err).To(BeNil())
+		Expect(deleted).To(BeEmpty(), "Shouldn't prune while locked elsewhere")
+		Expect(FileExists(testRepo().GetSharedLOBChunkPath(info.SHA, 0))).To(BeTrue())
+
+		// Other binaries aren't held up
+		other, err := testRepo().StoreLOB(bytes.NewReader([]byte("Other shared store lock test content")), nil)
+		Expect(err).To(BeNil(), "Should store other binaries while one is locked")
+		Expect(FileExists(testRepo().GetSharedLOBChunkPath(other.SHA, 0))).To(BeTrue())
+
+		Expect(l.Release()).To(BeNil())
+		Expect(testRepo().recoverLocalLOBFilesFromSharedStore(info.SHA)).To(BeTrue(), "Should link once released")
+		Expect(FileExists(l.Path)).To(BeFalse(), "Lock should be removed")
+		links, err := GetHardLinkCount(testRepo().GetSharedLOBChunkPath(info.SHA, 0))
+		Expect(err).To(BeNil())
+		Expect(links).To(Equal(2))
+	})
+
+	It("Stages fetched chunks in the repo & moves them in under the lock", func() {
+		Expect(testRepo().getFetchStagingRoot()).To(HavePrefix(GetGitDir()), "Repos shouldn't share a staging area")
+		rel := getLOBChunkRelativePathForInfo(info, 0)
+		staged := filepath.Join(testRepo().getFetchStagingRoot(), rel)
+		shared := testRepo().GetSharedLOBChunkPath(info.SHA, 0)
+		Expect(os.MkdirAll(filepath.Dir(staged), 0755)).To(BeNil())
+		Expect(os.Rename(shared, staged)).To(BeNil())
+		removeLocal()
+
+		l := holdLockElsewhere(info.SHA)
+		testRepo().storeFetchedLOBs([]string{info.SHA}, testRepo().getFetchStagingRoot(), sharedStore)
+		Expect(FileExists(shared)).To(BeFalse(), "Shouldn't move in while locked elsewhere")
+		Expect(FileExists(staged)).To(BeTrue(), "Should be left staged for next time")
+
+		l.Release()
+		Expect(testRepo().storeFetchedLOBs([]string{info.SHA}, testRepo().getFetchStagingRoot(), sharedStore)).To(BeEmpty())
+		Expect(FileExists(shared)).To(BeTrue(), "Should be moved into the shared store")
+		Expect(FileExists(staged)).To(BeFalse())
+	})
+
+	It("Doesn't prune files while they're being linked", func() {
+		removeLocal()
+		// Hold the lock as if recovering the binary, so prune sees it only after it's linked
+		l, err := testRepo().lockSharedStoreSHA(info.SHA)
+		Expect(err).To(BeNil())
+		pruned := make(chan []string)
+		go func() {
+			deleted, _ := testRepo().PruneSharedStore(false, func(t PruneCallbackType, sha string) {})
+			pruned <- deleted
+		}()
+		time.Sleep(50 * time.Millisecond)
+		Expect(testRepo().linkSharedLOBFilename(testRepo().getSharedLOBMetaPath(info.SHA))).To(BeNil())
+		Expect(testRepo().linkSharedLOBFilename(testRepo().GetSharedLOBChunkPath(info.SHA, 0))).To(BeNil())
+		l.Release()
+		Expect(<-pruned).To(BeEmpty(), "Linked binary shouldn't be pruned")
+		Expect(FileExists(testRepo().GetSharedLOBChunkPath(info.SHA, 0))).To(BeTrue())
+
+		// Once no repo uses it, it can go
+		Expect(testRepo().DeleteLOB(info.SHA)).To(BeNil())
+		Expect(FileExists(testRepo().GetSharedLOBChunkPath(info.SHA, 0))).To(BeFalse())
+	})
+})
@@ -0,0 +1,321 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Shrinking the local store: older versions of binaries which are safely on a remote are
+// replaced with a delta against the newest version of the same file, or removed entirely.
+// A shrunk binary looks just like a pruned one, except that when it's needed again it's
+// rebuilt from the local delta instead of being fetched (see restoreLOBFromLocalDelta)
+
+type ShrinkCallbackType int
+
+const (
+	// Shrink is working (for spinner)
+	ShrinkWorking ShrinkCallbackType = iota
+	// Binary was replaced with a delta against BaseSHA
+	ShrinkDelta ShrinkCallbackType = iota
+	// Binary was removed, it will be fetched from the remote again if needed
+	ShrinkRemoved ShrinkCallbackType = iota
+	// Binary was kept because it's not confirmed present on the remote
+	ShrinkRetainNotOnRemote ShrinkCallbackType = iota
+	// Binary could not be shrunk, but this is not fatal
+	ShrinkError ShrinkCallbackType = iota
+)
+
+// Collected callback data for a shrink operation
+// When in dry run mode the same callbacks are made even though nothing is changed
+type ShrinkCallbackData struct {
+	// What's happening
+	Type ShrinkCallbackType
+	// The binary being shrunk
+	LOBSHA string
+	// File the binary is an old version of (relative to repo root)
+	Path string
+	// Newest version of the file, which a delta is against
+	BaseSHA string
+	// Size the binary was using in the local store
+	StoredSize int64
+	// Size of the delta replacing it, for ShrinkDelta
+	DeltaSize int64
+	// Error details for ShrinkError
+	Error error
+}
+
+// An old version of a file which is a candidate for shrinking
+type shrinkCandidate struct {
+	SHA      string
+	Filename string
+	// Newest version of the same file
+	BaseSHA string
+}
+
+// Shrink the local store by replacing old versions of binaries with deltas against the newest
+// version of the same file, or removing them if removeOnly, they're bigger than
+// git-lob.delta-max-size or a delta would not be smaller.
+// Only binaries which are confirmed present on the remote are shrunk, so nothing is lost;
+// the newest version of each file & everything needed to check out HEAD are always kept intact.
+// Returns the number of bytes reclaimed (or which would have been, if dryRun)
+func (r *Repo) Shrink(provider providers.SyncProvider, remoteName string, removeOnly, dryRun bool,
+	callback func(data *ShrinkCallbackData) (quit bool)) (int64, error) {
+
+	candidates, err := r.getShrinkCandidates(callback)
+	if err != nil {
+		return 0, err
+	}
+
+	var reclaimed int64
+	var anyDeleted bool
+	for _, candidate := range candidates {
+		if callback(&ShrinkCallbackData{Type: ShrinkWorking, LOBSHA: candidate.SHA}) {
+			break
+		}
+		// Nothing to do if not complete locally (already shrunk, pruned or never fetched)
+		info, err := r.GetLOBInfo(candidate.SHA)
+		if err != nil || r.CheckLOBFilesForSHA(candidate.SHA, r.GetLocalLOBRoot(), false) != nil {
+			continue
+		}
+		storedSize := getLOBStoredSize(info)
+		if r.CheckRemoteLOBFilesForSHA(candidate.SHA, provider, remoteName) != nil {
+			if callback(&ShrinkCallbackData{Type: ShrinkRetainNotOnRemote, LOBSHA: candidate.SHA, Path: candidate.Filename,
+				StoredSize: storedSize}) {
+				break
+			}
+			continue
+		}
+
+		data := &ShrinkCallbackData{Type: ShrinkRemoved, LOBSHA: candidate.SHA, Path: candidate.Filename, StoredSize: storedSize}
+		if !removeOnly && r.isWithinDeltaMaxSize(info.Size) && r.CheckLOBFilesForSHA(candidate.BaseSHA, r.GetLocalLOBRoot(), false) == nil {
+			deltaSize, err := r.storeLocalLOBDelta(candidate.BaseSHA, candidate.SHA, storedSize, dryRun)
+			if err != nil {
+				if callback(&ShrinkCallbackData{Type: ShrinkError, LOBSHA: candidate.SHA, Path: candidate.Filename, Error: err}) {
+					break
+				}
+				continue
+			}
+			if deltaSize >= 0 {
+				data.Type = ShrinkDelta
+				data.BaseSHA = candidate.BaseSHA
+				data.DeltaSize = deltaSize
+			}
+		}
+		if !dryRun {
+			err = r.DeleteLOB(candidate.SHA)
+			if err != nil {
+				if callback(&ShrinkCallbackData{Type: ShrinkError, LOBSHA: candidate.SHA, Path: candidate.Filename, Error: err}) {
+					break
+				}
+				continue
+			}
+			anyDeleted = true
+		}
+		reclaimed += data.StoredSize - data.DeltaSize
+		if callback(data) {
+			break
+		}
+	}
+	if anyDeleted {
+		r.pruneLocalChunkObjects()
+	}
+	return reclaimed, nil
+}
+
+// Get old versions of files referenced anywhere in history, most recent first
+// The newest version of each file & anything needed to check out HEAD are never included
+func (r *Repo) getShrinkCandidates(callback func(data *ShrinkCallbackData) (quit bool)) ([]*shrinkCandidate, error) {
+	keep := util.NewStringSet()
+	headLOBs, err := r.GetGitAllLOBsToCheckoutAtCommit("HEAD", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, sha := range headLOBs {
+		keep.Add(sha)
+	}
+
+	cmd := r.command("git", "log", "--all", `--format=commitsha: %H %P`, "-p", "-G", SHALineRegexStr)
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
+	}
+	// Log is most recent first, so the first version of a file seen is the newest
+	newest := make(map[string]string)
+	var ret []*shrinkCandidate
+	seen := util.NewStringSet()
+	quit, err := walkGitLogOutputForLOBReferences(outp, true, false, nil, nil, func(commitLOB *CommitLOBRef) (bool, error) {
+		for _, filelob := range commitLOB.FileLOBs {
+			base, ok := newest[filelob.Filename]
+			if !ok {
+				newest[filelob.Filename] = filelob.SHA
+				keep.Add(filelob.SHA)
+				continue
+			}
+			if seen.Add(filelob.SHA) {
+				ret = append(ret, &shrinkCandidate{filelob.SHA, filelob.Filename, base})
+			}
+		}
+		return callback(&ShrinkCallbackData{Type: ShrinkWorking}), nil
+	})
+	if quit || err != nil {
+		// Don't leave git blocked writing output nobody is reading
+		cmd.Process.Kill()
+	}
+	cmd.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	// Binaries can be both an old version of one file & the newest of another
+	var candidates []*shrinkCandidate
+	for _, candidate := range ret {
+		if !keep.Contains(candidate.SHA) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates, nil
+}
+
+// Gets the directory where deltas for shrunk binaries are stored
+func (r *Repo) getLocalLOBDeltaDir() string {
+	return filepath.Join(r.GitDir, "git-lob", "deltas")
+}
+
+// Gets the path of a stored delta which rebuilds targetsha from basesha
+func (r *Repo) getLocalLOBDeltaPath(basesha, targetsha string) string {
+	return filepath.Join(r.getLocalLOBDeltaDir(), fmt.Sprintf("%v_%v", targetsha, basesha))
+}
+
+// Find a stored delta which rebuilds a binary, returning the path & the SHA of its base ("" if none)
+func (r *Repo) findLocalLOBDelta(sha string) (path, basesha string) {
+	matches, err := filepath.Glob(filepath.Join(r.getLocalLOBDeltaDir(), sha+"_*"))
+	if err != nil || len(matches) == 0 {
+		return "", ""
+	}
+	path = matches[0]
+	return path, strings.TrimPrefix(filepath.Base(path), sha+"_")
+}
+
+// Store a delta which rebuilds targetsha from basesha, provided it's smaller than maxSize
+// Returns the size of the delta, or -1 if it was too big & so not stored
+// If dryRun, only calculates the size
+func (r *Repo) storeLocalLOBDelta(basesha, targetsha string, maxSize int64, dryRun bool) (int64, error) {
+	if dryRun {
+		sz, err := r.GenerateLOBDelta(basesha, targetsha, ioutil.Discard)
+		if err != nil {
+			return 0, err
+		}
+		if sz >= maxSize {
+			return -1, nil
+		}
+		return sz, nil
+	}
+
+	err := os.MkdirAll(r.getLocalLOBDeltaDir(), 0755)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to create delta dir: %v", err.Error())
+	}
+	outf, err := ioutil.TempFile(r.getLocalLOBDeltaDir(), "tempdelta")
+	if err != nil {
+		return 0, fmt.Errorf("Unable to create temp file for delta: %v", err.Error())
+	}
+	sz, err := r.GenerateLOBDelta(basesha, targetsha, outf)
+	outf.Close()
+	if err != nil || sz >= maxSize {
+		os.Remove(outf.Name())
+		if err != nil {
+			return 0, err
+		}
+		return -1, nil
+	}
+	deltaPath := r.getLocalLOBDeltaPath(basesha, targetsha)
+	os.Remove(deltaPath)
+	err = os.Rename(outf.Name(), deltaPath)
+	if err != nil {
+		os.Remove(outf.Name())
+		return 0, fmt.Errorf("Unable to store delta for %v: %v", targetsha, err.Error())
+	}
+	return sz, nil
+}
+
+// Deltas can only be chained so far, to guard against cycles
+const maxLocalLOBDeltaChain = 50
+
+// Rebuild a binary which was shrunk from its stored delta
+// Returns false if there is no delta for this binary
+func (r *Repo) restoreLOBFromLocalDelta(sha string) (bool, error) {
+	return r.restoreLOBFromLocalDeltaChain(sha, 0)
+}
+
+func (r *Repo) restoreLOBFromLocalDeltaChain(sha string, depth int) (bool, error) {
+	deltaPath, basesha := r.findLocalLOBDelta(sha)
+	if deltaPath == "" {
+		return false, nil
+	}
+	if depth >= maxLocalLOBDeltaChain {
+		return false, fmt.Errorf("Too many deltas in chain restoring %v", sha)
+	}
+	// The base may itself have been shrunk since
+	if r.CheckLOBFilesForSHA(basesha, r.GetLocalLOBRoot(), false) != nil {
+		restored, err := r.restoreLOBFromLocalDeltaChain(basesha, depth+1)
+		if err != nil {
+			return false, err
+		}
+		if !restored {
+			return false, NewNotFoundError(fmt.Sprintf("Base %v of delta for %v is missing", basesha, sha), basesha)
+		}
+	}
+	r.Log.Debugf("Restoring %v from local delta against %v\n", sha, basesha)
+	f, err := os.Open(deltaPath)
+	if err != nil {
+		return false, err
+	}
+	err = r.ApplyLOBDelta(basesha, sha, f)
+	f.Close()
+	if err != nil {
+		return false, fmt.Errorf("Unable to restore %v from local delta: %v", sha, err.Error())
+	}
+	// Complete again, so the delta is no longer needed
+	os.Remove(deltaPath)
+	return true, nil
+}
+
+// Remove stored deltas which are no longer needed or can't be used: those for binaries which are
+// complete again or no longer wanted (not in keep), and those whose base has gone
+func (r *Repo) pruneLocalLOBDeltas(keep util.StringSet) {
+	dir := r.getLocalLOBDeltaDir()
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range names {
+		parts := strings.Split(fi.Name(), "_")
+		if len(parts) != 2 || !keep.Contains(parts[0]) ||
+			r.CheckLOBFilesForSHA(parts[0], r.GetLocalLOBRoot(), false) == nil {
+			os.Remove(filepath.Join(dir, fi.Name()))
+			continue
+		}
+		// Base must be complete, or itself rebuildable
+		base := parts[1]
+		for i := 0; i < maxLocalLOBDeltaChain && base != ""; i++ {
+			if r.CheckLOBFilesForSHA(base, r.GetLocalLOBRoot(), false) == nil {
+				break
+			}
+			_, base = r.findLocalLOBDelta(base)
+		}
+		if base == "" {
+			os.Remove(filepath.Join(dir, fi.Name()))
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Shrink", func() {
+	root := filepath.Join(os.TempDir(), "ShrinkTest")
+	originBinStore := filepath.Join(os.TempDir(), "ShrinkOriginBinStoreTest")
+	var oldwd string
+	// 3 similar versions of one file, 2 unrelated versions of another
+	var similar [][]byte
+	var similarSHAs, randomSHAs []string
+	commitFile := func(file string, content []byte, msg string) string {
+		Expect(ioutil.WriteFile(file, content, 0644)).To(BeNil())
+		info, err := StoreLOBForTest(file)
+		Expect(err).To(BeNil(), fmt.Sprintf("Shouldn't fail to store LOB for %v", file))
+		ioutil.WriteFile(file, []byte(getLOBPlaceholderContent(info.SHA)), 0644)
+		Expect(exec.Command("git", "add", file).Run()).To(BeNil())
+		Expect(exec.Command("git", "commit", "-m", msg).Run()).To(BeNil())
+		return info.SHA
+	}
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		os.MkdirAll(originBinStore, 0755)
+
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		Expect(err).To(BeNil(), "Should not error trying to open config file")
+		f.WriteString(fmt.Sprintf(`
+[remote "origin"]
+    url = file:///dummy/origin
+    git-lob-path = %v
+    git-lob-provider = filesystem
+`, strings.Replace(originBinStore, "\\", "/", -1)))
+		f.Close()
+		LoadConfig(GlobalOptions)
+		InitCoreProviders()
+
+		content := make([]byte, 64*1024)
+		cryptorand.Read(content)
+		similar = nil
+		similarSHAs = nil
+		randomSHAs = nil
+		for i := 0; i < 3; i++ {
+			version := make([]byte, len(content))
+			copy(version, content)
+			// Small localised edit per version
+			copy(version[i*1000:], []byte(fmt.Sprintf("Version %d", i)))
+			similar = append(similar, version)
+			similarSHAs = append(similarSHAs, commitFile("similar.bin", version, fmt.Sprintf("Similar %d", i)))
+			if i < 2 {
+				random := make([]byte, 4096)
+				cryptorand.Read(random)
+				randomSHAs = append(randomSHAs, commitFile("random.bin", random, fmt.Sprintf("Random %d", i)))
+			}
+		}
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		err = ForceRemoveAll(originBinStore)
+		if err != nil {
+			Fail(err.Error())
+		}
+		// Reset git config
+		GlobalOptions = NewOptions()
+	})
+
+	It("Shrinks old versions which are on the remote", func() {
+		provider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil())
+		pushCallback := func(data *ProgressCallbackData) (abort bool) { return false }
+		// Oldest version of similar.bin is not pushed
+		Expect(testRepo().PushSingle(similarSHAs[1], provider, "origin", false, pushCallback)).To(BeNil())
+		Expect(testRepo().PushSingle(randomSHAs[0], provider, "origin", false, pushCallback)).To(BeNil())
+
+		results := make(map[string]*ShrinkCallbackData)
+		callback := func(data *ShrinkCallbackData) (quit bool) {
+			if data.Type != ShrinkWorking {
+				results[data.LOBSHA] = data
+			}
+			return false
+		}
+		reclaimed, err := testRepo().Shrink(provider, "origin", false, true, callback)
+		Expect(err).To(BeNil())
+		Expect(results).To(HaveLen(3), "Only old versions should be considered")
+		Expect(results[similarSHAs[0]].Type).To(Equal(ShrinkRetainNotOnRemote), "Not shrunk unless on remote")
+		Expect(results[similarSHAs[1]].Type).To(Equal(ShrinkDelta), "Similar version should be a delta")
+		Expect(results[similarSHAs[1]].BaseSHA).To(Equal(similarSHAs[2]), "Delta should be against newest version")
+		Expect(results[randomSHAs[0]].Type).To(Equal(ShrinkRemoved), "Unrelated version should be removed")
+		Expect(reclaimed).To(BeNumerically(">", 4096))
+		Expect(testRepo().GetMissingLOBs(append(similarSHAs, randomSHAs...), false)).To(BeEmpty(), "Dry run should change nothing")
+
+		results = make(map[string]*ShrinkCallbackData)
+		reclaimedForReal, err := testRepo().Shrink(provider, "origin", false, false, callback)
+		Expect(err).To(BeNil())
+		Expect(reclaimedForReal).To(Equal(reclaimed), "Dry run should report the same")
+		Expect(testRepo().GetMissingLOBs(append(similarSHAs, randomSHAs...), false)).To(ConsistOf(similarSHAs[1], randomSHAs[0]))
+		deltaPath, base := testRepo().findLocalLOBDelta(similarSHAs[1])
+		Expect(base).To(Equal(similarSHAs[2]))
+		Expect(deltaPath).ToNot(BeEmpty(), "Delta should be stored")
+
+		// Shrunk version is rebuilt when needed, without fetching
+		var buf bytes.Buffer
+		_, err = testRepo().RetrieveLOB(similarSHAs[1], &buf)
+		Expect(err).To(BeNil(), "Should rebuild from delta")
+		Expect(buf.Bytes()).To(Equal(similar[1]), "Content should be rebuilt exactly")
+		Expect(testRepo().IsLOBMissing(similarSHAs[1], true)).To(BeFalse(), "Should be complete again")
+		_, err = os.Stat(deltaPath)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Delta no longer needed once rebuilt")
+
+		// Remove only
+		results = make(map[string]*ShrinkCallbackData)
+		_, err = testRepo().Shrink(provider, "origin", true, false, callback)
+		Expect(err).To(BeNil())
+		Expect(results[similarSHAs[1]].Type).To(Equal(ShrinkRemoved), "Should remove rather than use delta")
+		deltaPath, _ = testRepo().findLocalLOBDelta(similarSHAs[1])
+		Expect(deltaPath).To(BeEmpty())
+		Expect(testRepo().GetMissingLOBs([]string{similarSHAs[2], randomSHAs[1]}, false)).To(BeEmpty(), "Newest versions always kept")
+	})
+
+	It("Prunes deltas which can't be used", func() {
+		provider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil())
+		pushCallback := func(data *ProgressCallbackData) (abort bool) { return false }
+		Expect(testRepo().PushSingle(similarSHAs[1], provider, "origin", false, pushCallback)).To(BeNil())
+		_, err = testRepo().Shrink(provider, "origin", false, false, func(data *ShrinkCallbackData) (quit bool) { return false })
+		Expect(err).To(BeNil())
+		deltaPath, _ := testRepo().findLocalLOBDelta(similarSHAs[1])
+		Expect(deltaPath).ToNot(BeEmpty())
+
+		testRepo().pruneLocalLOBDeltas(NewStringSetFromSlice(similarSHAs))
+		_, err = os.Stat(deltaPath)
+		Expect(err).To(BeNil(), "Usable delta should be kept")
+		// Without its base the delta is useless
+		testRepo().DeleteLOB(similarSHAs[2])
+		testRepo().pruneLocalLOBDeltas(NewStringSetFromSlice(similarSHAs))
+		_, err = os.Stat(deltaPath)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Delta without base should be removed")
+	})
+})
@@ -0,0 +1,264 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/go-homedir"
+)
+
+// Signing binaries (git-lob.sign & git-lob.verify-signatures)
+// A binary's metadata can carry a detached signature made with the user's GPG or SSH key, set up
+// the same way as for signing git commits, so that where binaries came from can be proven. The
+// signature covers the binary's SHA & size rather than the metadata file, so that it still holds
+// when the binary is stored differently (compression, chunking, upgrade-store) & it's kept whenever
+// the metadata is rewritten. Metadata is transferred as-is, so signatures travel with the binary.
+
+// Namespace for SSH signatures, so they can't be confused with signatures for other purposes
+const lobSignatureNamespace = "git-lob"
+
+// Start of SSH signatures; anything else is treated as a GPG signature
+const sshSignatureHeader = "-----BEGIN SSH SIGNATURE-----"
+
+type LOBSignatureStatus int
+
+const (
+	// Signed by a trusted key
+	LOBSignatureGood LOBSignatureStatus = iota
+	// Not signed
+	LOBSignatureUnsigned LOBSignatureStatus = iota
+	// Signature doesn't verify, or isn't from a trusted key
+	LOBSignatureBad LOBSignatureStatus = iota
+)
+
+// Result of verifying the signature of a binary
+type LOBSignatureResult struct {
+	SHA    string
+	Status LOBSignatureStatus
+	// Who signed it as gpg or ssh-keygen reports it, for good signatures
+	Signer string
+	// Why the signature is bad
+	Problem string
+}
+
+// What a binary's signature covers
+func getLOBSignaturePayload(info *LOBInfo) []byte {
+	return []byte(fmt.Sprintf("git-lob binary\nsha %v\nsize %d\n", info.SHA, info.Size))
+}
+
+// Is the user signing with SSH rather than GPG? (gpg.format, as for git)
+func (r *Repo) isSSHSigningFormat() bool {
+	return strings.ToLower(strings.TrimSpace(r.Options.GitConfig["gpg.format"])) == "ssh"
+}
+
+func (r *Repo) getGPGProgram() string {
+	if program := strings.TrimSpace(r.Options.GitConfig["gpg.program"]); program != "" {
+		return program
+	}
+	return "gpg"
+}
+
+func (r *Repo) getSSHSigningProgram() string {
+	if program := strings.TrimSpace(r.Options.GitConfig["gpg.ssh.program"]); program != "" {
+		return program
+	}
+	return "ssh-keygen"
+}
+
+// Write content to a temporary file for a tool which only reads files; call cleanup when done
+func writeSigningTempFile(content string) (filename string, cleanup func(), err error) {
+	f, err := ioutil.TempFile("", "git-lob-sig")
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = f.WriteString(content)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }, nil
+}
+
+// Sign a binary's metadata with the user's key (user.signingkey), setting info.Signature
+// The metadata isn't stored, see StoreLOBInfo
+func (r *Repo) SignLOBInfo(info *LOBInfo) error {
+	key := strings.TrimSpace(r.Options.GitConfig["user.signingkey"])
+	var cmd *exec.Cmd
+	if r.isSSHSigningFormat() {
+		if key == "" {
+			return errors.New("user.signingkey must be set to sign binaries with SSH (git-lob.sign)")
+		}
+		// Either a key file, or the key itself like git allows
+		var keyfile string
+		if strings.HasPrefix(key, "key::") {
+			var cleanup func()
+			var err error
+			keyfile, cleanup, err = writeSigningTempFile(strings.TrimPrefix(key, "key::") + "\n")
+			if err != nil {
+				return fmt.Errorf("Unable to sign %v: %v", info.SHA, err.Error())
+			}
+			defer cleanup()
+		} else if expanded, err := homedir.Expand(key); err == nil {
+			keyfile = expanded
+		} else {
+			keyfile = key
+		}
+		cmd = r.command(r.getSSHSigningProgram(), "-Y", "sign", "-n", lobSignatureNamespace, "-f", keyfile)
+	} else {
+		args := []string{"--batch", "--detach-sign", "--armor"}
+		if key != "" {
+			args = append(args, "--local-user", key)
+		}
+		cmd = r.command(r.getGPGProgram(), args...)
+	}
+	cmd.Stdin = bytes.NewReader(getLOBSignaturePayload(info))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	outp, err := cmd.Output()
+	if err != nil || len(outp) == 0 {
+		return fmt.Errorf("Unable to sign %v with %v: %v %v", info.SHA, cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	info.Signature = string(outp)
+	return nil
+}
+
+// Verify the signature of a binary's metadata; it's good if made by a key in the user's GPG
+// keyring (unless marked as never trusted), or for SSH, a key in gpg.ssh.allowedSignersFile
+func (r *Repo) VerifyLOBSignature(info *LOBInfo) *LOBSignatureResult {
+	if info.Signature == "" {
+		return &LOBSignatureResult{SHA: info.SHA, Status: LOBSignatureUnsigned}
+	}
+	payload := getLOBSignaturePayload(info)
+	cachekey := string(payload) + info.Signature
+	r.lobSignatureResultsMutex.Lock()
+	result, ok := r.lobSignatureResults[cachekey]
+	r.lobSignatureResultsMutex.Unlock()
+	if ok {
+		return result
+	}
+	sigfile, cleanup, err := writeSigningTempFile(info.Signature)
+	result = &LOBSignatureResult{SHA: info.SHA, Status: LOBSignatureBad}
+	if err != nil {
+		result.Problem = err.Error()
+		return result
+	}
+	defer cleanup()
+	var signer string
+	if strings.HasPrefix(info.Signature, sshSignatureHeader) {
+		signer, err = r.verifySSHSignature(payload, sigfile)
+	} else {
+		signer, err = r.verifyGPGSignature(payload, sigfile)
+	}
+	if err != nil {
+		result.Problem = err.Error()
+	} else {
+		result.Status = LOBSignatureGood
+		result.Signer = signer
+	}
+	r.lobSignatureResultsMutex.Lock()
+	if r.lobSignatureResults == nil {
+		r.lobSignatureResults = make(map[string]*LOBSignatureResult)
+	}
+	r.lobSignatureResults[cachekey] = result
+	r.lobSignatureResultsMutex.Unlock()
+	return result
+}
+
+// Verify a GPG signature, returning the signer's user ID
+func (r *Repo) verifyGPGSignature(payload []byte, sigfile string) (string, error) {
+	cmd := r.command(r.getGPGProgram(), "--batch", "--status-fd=1", "--verify", sigfile, "-")
+	cmd.Stdin = bytes.NewReader(payload)
+	// Fails for bad signatures, the status output says why
+	outp, _ := cmd.Output()
+	var signer string
+	var problems []string
+	scanner := bufio.NewScanner(bytes.NewReader(outp))
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimPrefix(scanner.Text(), "[GNUPG:] "), " ", 3)
+		switch fields[0] {
+		case "GOODSIG":
+			if len(fields) > 2 {
+				signer = fields[2]
+			}
+		case "BADSIG":
+			problems = append(problems, "signature does not match")
+		case "ERRSIG", "NO_PUBKEY":
+			problems = append(problems, "signed by an unknown key")
+		case "EXPKEYSIG", "REVKEYSIG":
+			problems = append(problems, "signed by an expired or revoked key")
+		case "TRUST_NEVER":
+			problems = append(problems, "signed by a key which is never trusted")
+		}
+	}
+	if len(problems) > 0 {
+		return "", errors.New(problems[0])
+	}
+	if signer == "" {
+		return "", fmt.Errorf("%v could not verify the signature", cmd.Args[0])
+	}
+	return signer, nil
+}
+
+// Verify an SSH signature, returning the signer's principal from the allowed signers file
+func (r *Repo) verifySSHSignature(payload []byte, sigfile string) (string, error) {
+	allowed := strings.TrimSpace(r.Options.GitConfig["gpg.ssh.allowedsignersfile"])
+	if allowed == "" {
+		return "", errors.New("gpg.ssh.allowedSignersFile must be set to verify SSH signatures")
+	}
+	if expanded, err := homedir.Expand(allowed); err == nil {
+		allowed = expanded
+	}
+	program := r.getSSHSigningProgram()
+	outp, err := r.command(program, "-Y", "find-principals", "-f", allowed, "-s", sigfile).Output()
+	principals := strings.Fields(string(outp))
+	if err != nil || len(principals) == 0 {
+		return "", errors.New("signed by a key which isn't in gpg.ssh.allowedSignersFile")
+	}
+	cmd := r.command(program, "-Y", "verify", "-f", allowed, "-I", principals[0], "-n", lobSignatureNamespace, "-s", sigfile)
+	cmd.Stdin = bytes.NewReader(payload)
+	if outp, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("signature does not match: %v", strings.TrimSpace(string(outp)))
+	}
+	return principals[0], nil
+}
+
+// Check a binary's signature if git-lob.verify-signatures is set, returning an error if it isn't
+// signed by a trusted key
+func (r *Repo) checkLOBSignature(info *LOBInfo) error {
+	if !r.Options.VerifyLOBSignatures {
+		return nil
+	}
+	result := r.VerifyLOBSignature(info)
+	switch result.Status {
+	case LOBSignatureUnsigned:
+		return fmt.Errorf("Binary %v is not signed (git-lob.verify-signatures is set)", info.SHA)
+	case LOBSignatureBad:
+		return fmt.Errorf("Binary %v has a bad signature: %v", info.SHA, result.Problem)
+	}
+	return nil
+}
+
+// Verify the signatures of the binaries stored by git-lob at a ref (see ListLOBFiles), calling
+// back for each one in path order; result is nil for binaries whose metadata isn't stored locally
+func (r *Repo) VerifyLOBSignaturesAtRef(ref string, pathspecs []string, callback func(file *LOBFileInfo, result *LOBSignatureResult)) error {
+	files, err := r.ListLOBFiles(ref, pathspecs)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		info, err := r.GetLOBInfo(file.SHA)
+		if err != nil {
+			callback(file, nil)
+			continue
+		}
+		callback(file, r.VerifyLOBSignature(info))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Signing", func() {
+	root := filepath.Join(os.TempDir(), "SigningTest")
+	keydir := filepath.Join(os.TempDir(), "SigningTestKeys")
+	keyfile := filepath.Join(keydir, "id_ed25519")
+	allowedfile := filepath.Join(keydir, "allowed_signers")
+	var oldwd string
+	BeforeEach(func() {
+		os.MkdirAll(keydir, 0700)
+		err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "", "-f", keyfile).Run()
+		Expect(err).To(BeNil(), "Should create a key")
+		pubkey, _ := ioutil.ReadFile(keyfile + ".pub")
+		ioutil.WriteFile(allowedfile, []byte("artist@example.com "+strings.TrimSpace(string(pubkey))+"\n"), 0644)
+
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		LoadConfig(GlobalOptions)
+		GlobalOptions.GitConfig["gpg.format"] = "ssh"
+		GlobalOptions.GitConfig["user.signingkey"] = keyfile
+		GlobalOptions.GitConfig["gpg.ssh.allowedsignersfile"] = allowedfile
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		os.RemoveAll(keydir)
+		GlobalOptions = NewOptions()
+	})
+
+	It("Signs new binaries & verifies them", func() {
+		unsigned, err := testRepo().StoreLOB(bytes.NewReader([]byte("Unsigned content")), nil)
+		Expect(err).To(BeNil())
+		Expect(unsigned.Signature).To(Equal(""), "Should only sign with git-lob.sign")
+		Expect(testRepo().VerifyLOBSignature(unsigned).Status).To(Equal(LOBSignatureUnsigned))
+
+		GlobalOptions.SignLOBs = true
+		info, err := testRepo().StoreLOB(bytes.NewReader([]byte("Signed content")), nil)
+		Expect(err).To(BeNil())
+		Expect(info.Signature).To(HavePrefix(sshSignatureHeader))
+		stored, err := testRepo().GetLOBInfo(info.SHA)
+		Expect(err).To(BeNil())
+		Expect(stored.Signature).To(Equal(info.Signature), "Signature should be stored in the metadata")
+		result := testRepo().VerifyLOBSignature(stored)
+		Expect(result.Status).To(Equal(LOBSignatureGood), result.Problem)
+		Expect(result.Signer).To(Equal("artist@example.com"))
+
+		// Kept when metadata is rewritten without it, e.g. stored with other settings
+		rewritten := *stored
+		rewritten.Signature = ""
+		Expect(testRepo().StoreLOBInfo(&rewritten)).To(BeNil())
+		stored, _ = testRepo().GetLOBInfo(info.SHA)
+		Expect(stored.Signature).To(Equal(info.Signature))
+
+		// Doesn't vouch for anything else
+		tampered := *stored
+		tampered.Size++
+		Expect(testRepo().VerifyLOBSignature(&tampered).Status).To(Equal(LOBSignatureBad))
+		GlobalOptions.GitConfig["gpg.ssh.allowedsignersfile"] = filepath.Join(keydir, "nobody")
+		ioutil.WriteFile(filepath.Join(keydir, "nobody"), []byte(""), 0644)
+		tampered.Size--
+		tampered.Signature += "\n"
+		result = testRepo().VerifyLOBSignature(&tampered)
+		Expect(result.Status).To(Equal(LOBSignatureBad), "Keys not in allowed signers should be bad")
+		Expect(result.Problem).To(ContainSubstring("allowedSignersFile"))
+	})
+
+	It("Refuses unsigned binaries on checkout with git-lob.verify-signatures", func() {
+		unsigned, err := testRepo().StoreLOB(bytes.NewReader([]byte("Unsigned content")), nil)
+		Expect(err).To(BeNil())
+		GlobalOptions.SignLOBs = true
+		signed, err := testRepo().StoreLOB(bytes.NewReader([]byte("Signed content")), nil)
+		Expect(err).To(BeNil())
+
+		GlobalOptions.VerifyLOBSignatures = true
+		var buf bytes.Buffer
+		_, err = testRepo().RetrieveLOB(unsigned.SHA, &buf)
+		Expect(err).ToNot(BeNil(), "Unsigned binaries should be refused")
+		Expect(err.Error()).To(ContainSubstring("not signed"))
+		Expect(buf.Len()).To(Equal(0))
+		_, err = testRepo().RetrieveLOB(signed.SHA, &buf)
+		Expect(err).To(BeNil())
+		Expect(buf.String()).To(Equal("Signed content"))
+	})
+})
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Size limits
+// Repositories can set budgets for the binaries new commits add, per file
+// (git-lob.size-limit-file) & per commit (git-lob.size-limit-commit), for 'size-limit report'
+// to enforce in CI. A binary's size comes from its metadata in the local store, or the metadata
+// in its placeholder (git-lob.placeholder-metadata), or else the metadata is downloaded from a
+// remote if one is given, so CI doesn't need to fetch the content.
+
+// A binary added by a commit, see CheckSizeLimits
+type SizeLimitFile struct {
+	Commit string
+	// Path relative to the root of the repo, / separated
+	Path string
+	SHA  string
+	// Size of the content, or -1 if it couldn't be found out
+	Size int64
+}
+
+// The binaries added by a commit, see CheckSizeLimits
+type SizeLimitCommit struct {
+	Commit string
+	Files  []*SizeLimitFile
+	// Total size of the different binaries added, not including those of unknown size
+	Size int64
+}
+
+// The outcome of checking a range of commits against size limits
+type SizeLimitReport struct {
+	// Commits which add binaries, parents first
+	Commits []*SizeLimitCommit
+	// Binaries larger than the per file limit
+	FilesOverLimit []*SizeLimitFile
+	// Commits whose binaries total more than the per commit limit
+	CommitsOverLimit []*SizeLimitCommit
+	// Binaries whose size couldn't be found out, so couldn't be checked
+	Unknown []*SizeLimitFile
+}
+
+// Did everything checked fit within the limits?
+func (self *SizeLimitReport) OK() bool {
+	return len(self.FilesOverLimit) == 0 && len(self.CommitsOverLimit) == 0 && len(self.Unknown) == 0
+}
+
+// Check the binaries added by the commits in refspec (a range, or the whole history of a ref)
+// against a per file & per commit size limit (0 for no limit). Merges are not counted, only the
+// commits which actually added binaries. Metadata which isn't known locally is downloaded from
+// remoteName using provider, if provider isn't nil
+func (r *Repo) CheckSizeLimits(refspec *GitRefSpec, fileLimit, commitLimit int64, provider providers.SyncProvider, remoteName string,
+	callback util.ProgressCallback) (*SizeLimitReport, error) {
+
+	if refspec.RangeOp == "..." {
+		return nil, fmt.Errorf("'...' range operator is not supported, only '..'")
+	}
+	var ref string
+	var exclude []string
+	if refspec.IsRange() {
+		ref = refspec.Ref2
+		exclude = []string{refspec.Ref1}
+	} else {
+		ref = refspec.Ref1
+	}
+
+	report := &SizeLimitReport{}
+	err := r.walkGitLOBsAddedInRange(ref, exclude, func(commitLOB *CommitLOBRef) (quit bool, err error) {
+		commit := &SizeLimitCommit{Commit: commitLOB.Commit}
+		for _, filelob := range commitLOB.FileLOBs {
+			commit.Files = append(commit.Files, &SizeLimitFile{Commit: commitLOB.Commit, Path: filelob.Filename, SHA: filelob.SHA, Size: -1})
+		}
+		report.Commits = append(report.Commits, commit)
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sizes from local metadata, then placeholders, then the remote
+	sizes := make(map[string]int64)
+	unknown := make(map[string]string)
+	for _, commit := range report.Commits {
+		for _, file := range commit.Files {
+			if _, ok := sizes[file.SHA]; ok {
+				continue
+			}
+			if size := r.getSizeLimitLOBSize(file); size >= 0 {
+				sizes[file.SHA] = size
+				delete(unknown, file.SHA)
+			} else {
+				unknown[file.SHA] = file.Path
+			}
+		}
+	}
+	if len(unknown) > 0 && provider != nil {
+		callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Downloading metadata for %d binaries from %v", len(unknown), remoteName),
+			0, 0, 0, 0, nil})
+		err = r.fetchMetadata(unknown, provider, remoteName, false, callback)
+		if err != nil {
+			return nil, err
+		}
+		for sha, _ := range unknown {
+			if info, err := r.GetLOBInfo(sha); err == nil {
+				sizes[sha] = info.Size
+			}
+		}
+	}
+
+	for _, commit := range report.Commits {
+		counted := util.NewStringSet()
+		for _, file := range commit.Files {
+			size, ok := sizes[file.SHA]
+			if !ok {
+				report.Unknown = append(report.Unknown, file)
+				continue
+			}
+			file.Size = size
+			if fileLimit > 0 && size > fileLimit {
+				report.FilesOverLimit = append(report.FilesOverLimit, file)
+			}
+			if counted.Add(file.SHA) {
+				commit.Size += size
+			}
+		}
+		if commitLimit > 0 && commit.Size > commitLimit {
+			report.CommitsOverLimit = append(report.CommitsOverLimit, commit)
+		}
+	}
+	return report, nil
+}
+
+// Get the size of a binary from local metadata or its placeholder, -1 if neither say
+func (r *Repo) getSizeLimitLOBSize(file *SizeLimitFile) int64 {
+	if info, err := r.GetLOBInfo(file.SHA); err == nil {
+		return info.Size
+	}
+	content, err := r.command("git", "cat-file", "blob", fmt.Sprintf("%v:%v", file.Commit, file.Path)).Output()
+	if err != nil {
+		return -1
+	}
+	if placeholder, ok := parseLOBPlaceholder(content); ok && placeholder.SHA == file.SHA {
+		return placeholder.Size
+	}
+	return -1
+}
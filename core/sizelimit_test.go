@@ -0,0 +1,75 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Size limits", func() {
+	root := filepath.Join(os.TempDir(), "SizeLimitTest")
+	var oldwd string
+	callback := func(data *ProgressCallbackData) (abort bool) { return false }
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		CreateInitialCommitForTest(root)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		ForceRemoveAll(root)
+	})
+
+	It("Reports binaries & commits over the limits", func() {
+		// Before the range, too big but not checked
+		CreateManyCommitsForTest([][]string{[]string{"base.png"}}, 0,
+			func(filename string, i int) int64 { return 5000 })
+		base := strings.TrimSpace(RunGitCommandForTest(true, "rev-parse", "HEAD"))
+		shas := CreateManyCommitsForTest([][]string{
+			[]string{"small.png", "small2.png"},
+			[]string{"big.png"},
+			[]string{"one.png", "two.png", "three.png"},
+		}, 1, func(filename string, i int) int64 {
+			if filename == "big.png" {
+				return 3000
+			}
+			return 800
+		})
+		refspec := &GitRefSpec{Ref1: base, RangeOp: "..", Ref2: "HEAD"}
+
+		report, err := testRepo().CheckSizeLimits(refspec, 2000, 2000, nil, "", callback)
+		Expect(err).To(BeNil())
+		Expect(report.Commits).To(HaveLen(3))
+		Expect(report.Commits[0].Size).To(BeEquivalentTo(1600))
+		Expect(report.FilesOverLimit).To(HaveLen(1))
+		Expect(report.FilesOverLimit[0].Path).To(Equal("big.png"))
+		Expect(report.FilesOverLimit[0].SHA).To(Equal(shas[1][0]))
+		Expect(report.CommitsOverLimit).To(HaveLen(2))
+		Expect(report.CommitsOverLimit[1].Size).To(BeEquivalentTo(2400))
+		Expect(report.OK()).To(BeFalse())
+
+		report, err = testRepo().CheckSizeLimits(refspec, 0, 5000, nil, "", callback)
+		Expect(err).To(BeNil())
+		Expect(report.OK()).To(BeTrue())
+
+		// Sizes from placeholder metadata when there's no local metadata, otherwise unknown
+		sha := GetListOfRandomSHAsForTest(2)
+		ioutil.WriteFile("withmeta.png", []byte(fmt.Sprintf("git-lob: %v\ngit-lob-meta: size=9000 type=png", sha[0])), 0644)
+		ioutil.WriteFile("nometa.png", []byte(fmt.Sprintf("git-lob: %v", sha[1])), 0644)
+		RunGitCommandForTest(true, "add", "withmeta.png", "nometa.png")
+		RunGitCommandForTest(true, "commit", "-m", "Placeholders only")
+		report, err = testRepo().CheckSizeLimits(refspec, 5000, 0, nil, "", callback)
+		Expect(err).To(BeNil())
+		Expect(report.FilesOverLimit).To(HaveLen(1))
+		Expect(report.FilesOverLimit[0].Path).To(Equal("withmeta.png"))
+		Expect(report.Unknown).To(HaveLen(1))
+		Expect(report.Unknown[0].Path).To(Equal("nometa.png"))
+	})
+})
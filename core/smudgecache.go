@@ -0,0 +1,213 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// The smudge cache (git-lob.smudge-cache) keeps short-lived copies of binaries which were
+// recently in the working copy, so that when git re-runs the smudge filter for the same content
+// (e.g. 'git stash pop', or a rebase re-applying commits) it can be restored instantly instead of
+// being rebuilt from compressed / chunked / shrunk storage or fetched again.
+// Entries are copy-on-write clones of the working copy file where the filesystem supports them,
+// otherwise a copy taken while the content was streamed. Content which is stored as a plain
+// copy locally is never cached, since smudging it from the store is just as fast.
+// To stay safe, entries expire after a short time, and the content of an entry is always
+// checked against the SHA before it's used; entries which don't match are deleted.
+
+// Is the smudge cache enabled?
+func (r *Repo) smudgeCacheEnabled() bool {
+	return r.Options.SmudgeCacheTTL > 0
+}
+
+// Gets the folder which holds the smudge cache
+func (r *Repo) getSmudgeCacheDir() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "smudge_cache")
+}
+
+func (r *Repo) getSmudgeCacheFile(sha string) string {
+	return filepath.Join(r.getSmudgeCacheDir(), sha)
+}
+
+// Would smudging this LOB from the local store be slower than from the cache?
+// Only plain, single-chunk uncompressed content already in the store is as fast to copy
+func (r *Repo) isWorthSmudgeCaching(sha string) bool {
+	info, err := r.GetLOBInfo(sha)
+	if err != nil {
+		return true
+	}
+	if ok, _ := canLinkLOBContent(info); !ok {
+		return true
+	}
+	return r.CheckLOBFilesForSHA(sha, r.GetLocalLOBRoot(), false) != nil
+}
+
+// Will newly stored content be stored as a plain copy? (see isWorthSmudgeCaching)
+func (r *Repo) isStoringPlainContent() bool {
+	return r.Options.Compression == "" && r.Options.Chunking != ChunkingContentDefined
+}
+
+// An entry being added to the smudge cache, before its SHA is known
+type smudgeCacheEntry struct {
+	repo    *Repo
+	tmpfile string
+	// Non-nil if content is being written as it's streamed
+	f *os.File
+}
+
+// Start a new cache entry which will be written as content is streamed through Writer()
+// Returns nil if the cache entry can't be created, all methods are nil-safe
+func (r *Repo) newSmudgeCacheEntry() *smudgeCacheEntry {
+	err := os.MkdirAll(r.getSmudgeCacheDir(), 0755)
+	if err != nil {
+		r.Log.Debugf("Unable to create smudge cache: %v\n", err.Error())
+		return nil
+	}
+	f, err := ioutil.TempFile(r.getSmudgeCacheDir(), "tmp")
+	if err != nil {
+		r.Log.Debugf("Unable to create smudge cache entry: %v\n", err.Error())
+		return nil
+	}
+	return &smudgeCacheEntry{repo: r, tmpfile: f.Name(), f: f}
+}
+
+// Start a new cache entry from a clone of an existing file, or nil if that's not possible
+// (e.g. the filesystem doesn't support reflinks); never copies the file
+func (r *Repo) newSmudgeCacheEntryFromReflink(file string) *smudgeCacheEntry {
+	if s, err := os.Stat(file); err != nil || !s.Mode().IsRegular() {
+		return nil
+	}
+	if err := os.MkdirAll(r.getSmudgeCacheDir(), 0755); err != nil {
+		return nil
+	}
+	tmpfile := filepath.Join(r.getSmudgeCacheDir(), fmt.Sprintf("tmp-reflink-%d", os.Getpid()))
+	os.Remove(tmpfile)
+	if err := CreateReflink(file, tmpfile); err != nil {
+		r.Log.Debugf("Unable to clone %v for smudge cache: %v\n", file, err.Error())
+		return nil
+	}
+	return &smudgeCacheEntry{repo: r, tmpfile: tmpfile}
+}
+
+// Wrap a writer so that content is also written to the cache entry, if it's being streamed
+// If writing to the cache fails the entry is discarded, but the writer carries on
+func (e *smudgeCacheEntry) Writer(w io.Writer) io.Writer {
+	if e == nil || e.f == nil {
+		return w
+	}
+	return io.MultiWriter(w, &smudgeCacheEntryWriter{e})
+}
+
+type smudgeCacheEntryWriter struct {
+	e *smudgeCacheEntry
+}
+
+func (w *smudgeCacheEntryWriter) Write(p []byte) (int, error) {
+	if w.e.f != nil {
+		if _, err := w.e.f.Write(p); err != nil {
+			w.e.repo.Log.Debugf("Unable to write smudge cache entry: %v\n", err.Error())
+			w.e.Discard()
+		}
+	}
+	return len(p), nil
+}
+
+// Add the entry to the cache for a LOB of a given size
+// Entries of the wrong size are discarded (e.g. a working copy file which changed)
+func (e *smudgeCacheEntry) Commit(sha string, size int64) {
+	if e == nil || e.tmpfile == "" {
+		return
+	}
+	if e.f != nil {
+		e.f.Close()
+		e.f = nil
+	}
+	if !util.FileExistsAndIsOfSize(e.tmpfile, size) {
+		e.Discard()
+		return
+	}
+	dest := e.repo.getSmudgeCacheFile(sha)
+	if err := os.Rename(e.tmpfile, dest); err != nil {
+		e.repo.Log.Debugf("Unable to add %v to smudge cache: %v\n", sha, err.Error())
+		e.Discard()
+		return
+	}
+	e.tmpfile = ""
+	e.repo.Log.Debugf("Added %v to smudge cache\n", sha)
+	// Good time to tidy up
+	e.repo.purgeSmudgeCache(false)
+}
+
+// Abandon the entry
+func (e *smudgeCacheEntry) Discard() {
+	if e == nil || e.tmpfile == "" {
+		return
+	}
+	if e.f != nil {
+		e.f.Close()
+		e.f = nil
+	}
+	os.Remove(e.tmpfile)
+	e.tmpfile = ""
+}
+
+// Write the content of a LOB from the smudge cache, if it's there & still valid
+// Returns false if it wasn't, in which case nothing has been written to out
+func (r *Repo) restoreFromSmudgeCache(sha string, out io.Writer) (size int64, ok bool) {
+	file := r.getSmudgeCacheFile(sha)
+	s, err := os.Stat(file)
+	if err != nil {
+		return 0, false
+	}
+	if time.Since(s.ModTime()) > r.Options.SmudgeCacheTTL {
+		r.Log.Debugf("Smudge cache entry for %v has expired\n", sha)
+		os.Remove(file)
+		return 0, false
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	// Never trust the cache, check the content is what it should be before writing any of it
+	hasher := NewLOBHashForSHA(sha)
+	_, err = io.Copy(hasher, f)
+	if err != nil || fmt.Sprintf("%x", hasher.Sum(nil)) != sha {
+		r.Log.Debugf("Smudge cache entry for %v is not valid, removing\n", sha)
+		f.Close()
+		os.Remove(file)
+		return 0, false
+	}
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return 0, false
+	}
+	size, err = io.Copy(out, f)
+	if err != nil {
+		// Too late to fall back, out has been written to
+		r.Log.Errorf("Error writing %v from smudge cache: %v\n", sha, err.Error())
+		return size, true
+	}
+	return size, true
+}
+
+// Delete expired entries from the smudge cache, or all of them
+func (r *Repo) purgeSmudgeCache(all bool) {
+	dir := r.getSmudgeCacheDir()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		// Includes temp files left behind if a process died
+		if all || time.Since(entry.ModTime()) > r.Options.SmudgeCacheTTL {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
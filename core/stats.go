@@ -0,0 +1,288 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Analytics about the binaries referenced in repository history
+type LOBStats struct {
+	// Number of distinct binaries added in the history walked
+	Count int
+	// Total size of those binaries (only those stored locally, see Missing)
+	Size int64
+	// Number of binaries whose size is unknown because they're not stored locally
+	Missing int
+	// Binaries & bytes added per month, oldest first
+	Months []*LOBStatsMonth
+	// Largest binaries, largest first
+	Largest []*LOBStatsFile
+	// Paths with the most versions, most first
+	MostChanged []*LOBStatsPath
+	// Totals per directory of all binaries added under it, including subdirectories, largest first
+	Directories []*LOBStatsDirectory
+}
+
+// Binaries first added in a given month
+type LOBStatsMonth struct {
+	// Month, as YYYY-MM
+	Month string
+	Count int
+	Size  int64
+}
+
+// A single binary and the path it was (most recently) added at
+type LOBStatsFile struct {
+	Path string
+	SHA  string
+	Size int64
+}
+
+// A path which has had several binaries committed to it
+type LOBStatsPath struct {
+	Path string
+	// Number of distinct binaries committed at this path
+	Versions int
+	// Total size of all versions
+	Size int64
+}
+
+// Totals for a directory
+type LOBStatsDirectory struct {
+	// Directory relative to repo root, "." for the root itself
+	Path  string
+	Count int
+	Size  int64
+}
+
+// Walk history reachable from refspecs (or all refs if none) and report on the binaries added
+// since is passed to git log --since if not blank; top limits the number of largest files,
+// most changed paths & directories reported (0 means no limit)
+// callback is called periodically to allow progress & cancellation
+func (r *Repo) GetLOBStats(refspecs []string, since string, top int, callback func() (quit bool)) (*LOBStats, error) {
+	var logargs []string
+	if len(refspecs) == 0 {
+		logargs = append(logargs, "--all")
+	} else {
+		logargs = append(logargs, refspecs...)
+	}
+	if since != "" {
+		logargs = append(logargs, fmt.Sprintf("--since=%v", since))
+	}
+
+	dates, err := r.getGitCommitDates(logargs)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"log", `--format=commitsha: %H %P`, "-p", "-G", SHALineRegexStr}
+	args = append(args, logargs...)
+	// Make sure refspecs can't be confused with paths
+	args = append(args, "--")
+	cmd := r.command("git", args...)
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
+	}
+
+	// git log is newest first, so the last commit we see adding a binary is the oldest
+	type lobStatsRef struct {
+		path string
+		date time.Time
+	}
+	refs := make(map[string]*lobStatsRef)
+	// Ordered by first seen (most recent) so that output is stable
+	var order []string
+	pathVersions := make(map[string]util.StringSet)
+	quit, err := walkGitLogOutputForLOBReferences(outp, true, false, nil, nil, func(commitLOB *CommitLOBRef) (bool, error) {
+		date := dates[commitLOB.Commit]
+		for _, filelob := range commitLOB.FileLOBs {
+			ref, ok := refs[filelob.SHA]
+			if !ok {
+				ref = &lobStatsRef{path: filelob.Filename}
+				refs[filelob.SHA] = ref
+				order = append(order, filelob.SHA)
+			}
+			ref.date = date
+			versions, ok := pathVersions[filelob.Filename]
+			if !ok {
+				versions = util.NewStringSet()
+				pathVersions[filelob.Filename] = versions
+			}
+			versions.Add(filelob.SHA)
+		}
+		return callback(), nil
+	})
+	if quit || err != nil {
+		// Don't leave git blocked writing output nobody is reading
+		cmd.Process.Kill()
+	}
+	cmd.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &LOBStats{}
+	sizes := make(map[string]int64, len(order))
+	months := make(map[string]*LOBStatsMonth)
+	dirs := make(map[string]*LOBStatsDirectory)
+	for _, sha := range order {
+		if callback() {
+			break
+		}
+		ref := refs[sha]
+		var size int64
+		info, err := r.GetLOBInfo(sha)
+		if err == nil {
+			size = info.Size
+		} else {
+			stats.Missing++
+		}
+		sizes[sha] = size
+		stats.Count++
+		stats.Size += size
+
+		month := "unknown"
+		if !ref.date.IsZero() {
+			month = ref.date.Format("2006-01")
+		}
+		m, ok := months[month]
+		if !ok {
+			m = &LOBStatsMonth{Month: month}
+			months[month] = m
+		}
+		m.Count++
+		m.Size += size
+
+		stats.Largest = append(stats.Largest, &LOBStatsFile{Path: ref.path, SHA: sha, Size: size})
+
+		// Count towards every directory above it
+		dir := path.Dir(ref.path)
+		for {
+			d, ok := dirs[dir]
+			if !ok {
+				d = &LOBStatsDirectory{Path: dir}
+				dirs[dir] = d
+			}
+			d.Count++
+			d.Size += size
+			if dir == "." || dir == "/" {
+				break
+			}
+			dir = path.Dir(dir)
+		}
+	}
+
+	for _, m := range months {
+		stats.Months = append(stats.Months, m)
+	}
+	// "unknown" sorts after all real months
+	sort.Sort(lobStatsMonthsByMonth(stats.Months))
+	sort.Stable(lobStatsFilesBySize(stats.Largest))
+	for p, versions := range pathVersions {
+		entry := &LOBStatsPath{Path: p, Versions: versions.Cardinality()}
+		for sha := range versions {
+			entry.Size += sizes[sha]
+		}
+		stats.MostChanged = append(stats.MostChanged, entry)
+	}
+	sort.Sort(lobStatsPathsByVersions(stats.MostChanged))
+	for _, d := range dirs {
+		stats.Directories = append(stats.Directories, d)
+	}
+	sort.Sort(lobStatsDirectoriesBySize(stats.Directories))
+
+	if top > 0 {
+		if len(stats.Largest) > top {
+			stats.Largest = stats.Largest[:top]
+		}
+		if len(stats.MostChanged) > top {
+			stats.MostChanged = stats.MostChanged[:top]
+		}
+		if len(stats.Directories) > top {
+			stats.Directories = stats.Directories[:top]
+		}
+	}
+
+	return stats, nil
+}
+
+type lobStatsMonthsByMonth []*LOBStatsMonth
+
+func (s lobStatsMonthsByMonth) Len() int           { return len(s) }
+func (s lobStatsMonthsByMonth) Less(i, j int) bool { return s[i].Month < s[j].Month }
+func (s lobStatsMonthsByMonth) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type lobStatsFilesBySize []*LOBStatsFile
+
+func (s lobStatsFilesBySize) Len() int           { return len(s) }
+func (s lobStatsFilesBySize) Less(i, j int) bool { return s[i].Size > s[j].Size }
+func (s lobStatsFilesBySize) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type lobStatsPathsByVersions []*LOBStatsPath
+
+func (s lobStatsPathsByVersions) Len() int { return len(s) }
+func (s lobStatsPathsByVersions) Less(i, j int) bool {
+	if s[i].Versions != s[j].Versions {
+		return s[i].Versions > s[j].Versions
+	}
+	return s[i].Path < s[j].Path
+}
+func (s lobStatsPathsByVersions) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+type lobStatsDirectoriesBySize []*LOBStatsDirectory
+
+func (s lobStatsDirectoriesBySize) Len() int { return len(s) }
+func (s lobStatsDirectoriesBySize) Less(i, j int) bool {
+	if s[i].Size != s[j].Size {
+		return s[i].Size > s[j].Size
+	}
+	return s[i].Path < s[j].Path
+}
+func (s lobStatsDirectoriesBySize) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Get the commit date of every commit git log returns for the given arguments
+func (r *Repo) getGitCommitDates(logargs []string) (map[string]time.Time, error) {
+	args := []string{"log", "--format=%H %ct"}
+	args = append(args, logargs...)
+	args = append(args, "--")
+	cmd := r.command("git", args...)
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to call git-log: %v", err.Error()))
+	}
+	ret := make(map[string]time.Time)
+	scanner := bufio.NewScanner(outp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		ret[fields[0]] = time.Unix(secs, 0)
+	}
+	err = cmd.Wait()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error calling git-log: %v", err.Error()))
+	}
+	return ret, nil
+}
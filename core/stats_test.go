@@ -0,0 +1,90 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Stats", func() {
+	root := filepath.Join(os.TempDir(), "StatsTest")
+	var oldwd string
+	filespercommit := [][]string{
+		[]string{"img1.png", filepath.Join("movies", "movie1.mov")},
+		[]string{"img1.png"},
+		[]string{filepath.Join("movies", "hd", "movie2.mov")},
+	}
+	sizes := map[string]int64{
+		"img1.png":                                  100,
+		filepath.Join("movies", "movie1.mov"):       1000,
+		filepath.Join("movies", "hd", "movie2.mov"): 2000,
+	}
+	var shaspercommit [][]string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		shaspercommit = CreateManyCommitsForTest(filespercommit, 0, func(filename string, i int) int64 { return sizes[filename] })
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+	})
+
+	It("Reports totals, largest, most changed & directories", func() {
+		callback := func() bool { return false }
+		stats, err := testRepo().GetLOBStats(nil, "", 0, callback)
+		Expect(err).To(BeNil())
+		Expect(stats.Count).To(Equal(4))
+		Expect(stats.Size).To(BeEquivalentTo(3200))
+		Expect(stats.Missing).To(Equal(0))
+		Expect(stats.Months).To(HaveLen(1), "All added this month")
+		Expect(stats.Months[0].Count).To(Equal(4))
+		Expect(stats.Months[0].Size).To(BeEquivalentTo(3200))
+
+		Expect(stats.Largest).To(HaveLen(4))
+		Expect(stats.Largest[0].SHA).To(Equal(shaspercommit[2][0]))
+		Expect(stats.Largest[0].Path).To(Equal("movies/hd/movie2.mov"))
+		Expect(stats.Largest[1].SHA).To(Equal(shaspercommit[0][1]))
+
+		Expect(stats.MostChanged[0].Path).To(Equal("img1.png"))
+		Expect(stats.MostChanged[0].Versions).To(Equal(2))
+		Expect(stats.MostChanged[0].Size).To(BeEquivalentTo(200))
+
+		var dirs []LOBStatsDirectory
+		for _, d := range stats.Directories {
+			dirs = append(dirs, *d)
+		}
+		Expect(dirs).To(Equal([]LOBStatsDirectory{
+			{Path: ".", Count: 4, Size: 3200},
+			{Path: "movies", Count: 2, Size: 3000},
+			{Path: "movies/hd", Count: 1, Size: 2000},
+		}))
+
+		// Limited to a range & top entries
+		stats, err = testRepo().GetLOBStats([]string{"Tag0..Tag2"}, "", 1, callback)
+		Expect(err).To(BeNil())
+		Expect(stats.Count).To(Equal(2), "Only binaries added in range")
+		Expect(stats.Largest).To(HaveLen(1))
+		Expect(stats.Largest[0].SHA).To(Equal(shaspercommit[2][0]))
+		Expect(stats.Directories).To(HaveLen(1))
+
+		// Missing binaries are counted but not sized
+		testRepo().DeleteLOB(shaspercommit[2][0])
+		stats, err = testRepo().GetLOBStats(nil, "", 0, callback)
+		Expect(err).To(BeNil())
+		Expect(stats.Count).To(Equal(4))
+		Expect(stats.Missing).To(Equal(1))
+		Expect(stats.Size).To(BeEquivalentTo(1200))
+
+		// Nothing in the future
+		stats, err = testRepo().GetLOBStats(nil, "2090-01-01", 0, callback)
+		Expect(err).To(BeNil())
+		Expect(stats.Count).To(Equal(0))
+	})
+})
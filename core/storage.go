@@ -1,8 +1,8 @@
 package core
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,16 +11,16 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 
-	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/cloudflare/bm"
 	"github.com/atlassian/git-lob/util"
 )
 
 const BUFSIZE = 131072
 
-// Chunk size that we split stored data into so it's easier to resume uploads/downloads
-// This used to be configurable, but it caused too many issues if different people had different
-// settings in a shared repository
+// Default chunk size that we split stored data into so it's easier to resume uploads/downloads
+// Binaries stored with a different size (git-lob.chunk-size) record it in their metadata, since
+// mixing sizes in a shared repository used to cause problems when the size wasn't recorded
 // This is only 'var' rather than 'const' to allow tests to modify
 var ChunkSize = int64(32 * 1024 * 1024)
 
@@ -34,23 +34,39 @@ type LOBInfo struct {
 	Size int64
 	// Number of chunks that make up the whole LOB (integrity check)
 	NumChunks int
+	// Codec used to compress the stored chunks, blank if stored uncompressed
+	Compression string `json:",omitempty"`
+	// Uncompressed size of each compressed frame (compressed chunks only)
+	FrameSize int64 `json:",omitempty"`
+	// Seek index for compressed chunks; for each chunk, the compressed size of each frame
+	// Every frame holds FrameSize bytes of content except the last one in each chunk
+	Frames [][]int64 `json:",omitempty"`
+	// Format of the metadata, see LOBInfoVersion*; older versions of git-lob don't write this
+	Version int `json:",omitempty"`
+	// Content-defined chunks in order (LOBInfoVersionChunkObjects only), each stored as a chunk
+	// object which may be shared with other LOBs; see StoreLOBInBaseDirContentDefined
+	Chunks []LOBChunk `json:",omitempty"`
+	// Size of every chunk but the last (LOBInfoVersionFixedChunkSize only, otherwise ChunkSize)
+	ChunkSize int64 `json:",omitempty"`
+	// Detached GPG or SSH signature of the LOB's SHA & size (git-lob.sign), see SignLOBInfo
+	Signature string `json:",omitempty"`
 }
 
 // Gets the root directory for local LOB files & creates if necessary
-func GetLocalLOBRoot() string {
-	ret := filepath.Join(util.GetGitDir(), "git-lob", "content")
+func (r *Repo) GetLocalLOBRoot() string {
+	ret := filepath.Join(r.GitDir, "git-lob", "content")
 	err := os.MkdirAll(ret, 0755)
 	if err != nil {
-		util.LogErrorf("Unable to create LOB root folder at %v: %v", ret, err)
+		r.Log.Errorf("Unable to create LOB root folder at %v: %v", ret, err)
 		panic(err)
 	}
 	return ret
 }
 
 // Gets the root directory for shared LOB files & creates if necessary
-func GetSharedLOBRoot() string {
+func (r *Repo) GetSharedLOBRoot() string {
 	// We create shared store when loading config if specified
-	return util.GlobalOptions.SharedStore
+	return r.Options.SharedStore
 }
 
 // Get relative directory for some base dir for a given sha
@@ -68,12 +84,17 @@ func GetLOBChunkRelativePath(sha string, chunkIdx int) string {
 	return filepath.Join(getLOBRelativeDir(sha), getLOBChunkFilename(sha, chunkIdx))
 }
 
+// Get a relative file name for a preview file (no dirs created as not rooted)
+func GetLOBPreviewRelativePath(sha string) string {
+	return filepath.Join(getLOBRelativeDir(sha), getLOBPreviewFilename(sha))
+}
+
 // Get absolute directory for a sha & creates it
-func getLOBSubDir(base, sha string) string {
-	ret := filepath.Join(base, getLOBRelativeDir(sha))
+func (r *Repo) getLOBSubDir(base, sha string) string {
+	ret := util.LongPath(filepath.Join(base, getLOBRelativeDir(sha)))
 	err := os.MkdirAll(ret, 0755)
 	if err != nil {
-		util.LogErrorf("Unable to create LOB 2nd-level folder at %v: %v", ret, err)
+		r.Log.Errorf("Unable to create LOB 2nd-level folder at %v: %v", ret, err)
 		panic(err)
 	}
 	return ret
@@ -84,24 +105,24 @@ func getLOBSubDir(base, sha string) string {
 // LOBs are 'splayed' 2-levels deep based on first 6 chars of SHA (3 for each dir)
 // We splay by 2 levels and by 3 each (4096 dirs) because we don't pack like git
 // so need to ensure directory contents remain practical at high numbers of files
-func GetLocalLOBDir(sha string) string {
-	if len(sha) != 40 {
-		util.LogErrorf("Invalid SHA format: %v\n", sha)
+func (r *Repo) GetLocalLOBDir(sha string) string {
+	if len(sha) != SHALen && len(sha) != SHA256Len {
+		r.Log.Errorf("Invalid SHA format: %v\n", sha)
 		return ""
 	}
-	return getLOBSubDir(GetLocalLOBRoot(), sha)
+	return r.getLOBSubDir(r.GetLocalLOBRoot(), sha)
 }
 
 // Gets the containing shared folder for a given LOB SHA & creates if necessary
 // LOBs are 'splayed' 2-levels deep based on first 6 chars of SHA (3 for each dir)
 // We splay by 2 levels and by 3 each (4096 dirs) because we don't pack like git
 // so need to ensure directory contents remain practical at high numbers of files
-func GetSharedLOBDir(sha string) string {
-	if len(sha) != 40 {
-		util.LogErrorf("Invalid SHA format: %v\n", sha)
+func (r *Repo) GetSharedLOBDir(sha string) string {
+	if len(sha) != SHALen && len(sha) != SHA256Len {
+		r.Log.Errorf("Invalid SHA format: %v\n", sha)
 		return ""
 	}
-	return getLOBSubDir(GetSharedLOBRoot(), sha)
+	return r.getLOBSubDir(r.GetSharedLOBRoot(), sha)
 }
 
 // get the filename for a meta file (no dir)
@@ -109,46 +130,54 @@ func getLOBMetaFilename(sha string) string {
 	return sha + "_meta"
 }
 
+// get the filename for a preview file (no dir)
+func getLOBPreviewFilename(sha string) string {
+	return sha + "_preview"
+}
+
 // get the filename for a chunk file (no dir)
 func getLOBChunkFilename(sha string, chunkIdx int) string {
 	return fmt.Sprintf("%v_%d", sha, chunkIdx)
 }
 
-// Gets the absolute path to the meta file for a LOB from a base dir
-func GetLOBMetaPathInBaseDir(basedir, sha string) string {
-	fld := getLOBSubDir(basedir, sha)
-	return filepath.Join(fld, getLOBMetaFilename(sha))
+// Gets the absolute path to the meta file for a LOB from a base dir (creates the directory)
+func (r *Repo) GetLOBMetaPathInBaseDir(basedir, sha string) string {
+	return r.getLOBStoreFilePathCreatingDir(basedir, GetLOBMetaRelativePath(sha))
 }
 
-// Gets the absolute path to the chunk file for a LOB from a base dir
-func GetLOBChunkPathInBaseDir(basedir, sha string, chunkIdx int) string {
-	fld := getLOBSubDir(basedir, sha)
-	return filepath.Join(fld, getLOBChunkFilename(sha, chunkIdx))
+// Gets the absolute path to the chunk file for a LOB from a base dir (creates the directory)
+func (r *Repo) GetLOBChunkPathInBaseDir(basedir, sha string, chunkIdx int) string {
+	return r.getLOBStoreFilePathCreatingDir(basedir, GetLOBChunkRelativePath(sha, chunkIdx))
 }
 
 // Gets the absolute path to the meta file for a LOB in local store
-func GetLocalLOBMetaPath(sha string) string {
-	return GetLOBMetaPathInBaseDir(GetLocalLOBRoot(), sha)
+func (r *Repo) GetLocalLOBMetaPath(sha string) string {
+	return r.GetLOBMetaPathInBaseDir(r.GetLocalLOBRoot(), sha)
+}
+
+// Gets the absolute path to the preview file for a LOB in local store (creates the directory)
+func (r *Repo) GetLocalLOBPreviewPath(sha string) string {
+	return r.getLOBStoreFilePathCreatingDir(r.GetLocalLOBRoot(), GetLOBPreviewRelativePath(sha))
 }
 
 // Gets the absolute path to the chunk file for a LOB in local store
-func GetLocalLOBChunkPath(sha string, chunkIdx int) string {
-	return GetLOBChunkPathInBaseDir(GetLocalLOBRoot(), sha, chunkIdx)
+func (r *Repo) GetLocalLOBChunkPath(sha string, chunkIdx int) string {
+	return r.GetLOBChunkPathInBaseDir(r.GetLocalLOBRoot(), sha, chunkIdx)
 }
 
 // Gets the absolute path to the meta file for a LOB in shared store
-func getSharedLOBMetaPath(sha string) string {
-	return GetLOBMetaPathInBaseDir(GetSharedLOBRoot(), sha)
+func (r *Repo) getSharedLOBMetaPath(sha string) string {
+	return r.GetLOBMetaPathInBaseDir(r.GetSharedLOBRoot(), sha)
 }
 
 // Gets the absolute path to the chunk file for a LOB in local store
-func GetSharedLOBChunkPath(sha string, chunkIdx int) string {
-	return GetLOBChunkPathInBaseDir(GetSharedLOBRoot(), sha, chunkIdx)
+func (r *Repo) GetSharedLOBChunkPath(sha string, chunkIdx int) string {
+	return r.GetLOBChunkPathInBaseDir(r.GetSharedLOBRoot(), sha, chunkIdx)
 }
 
 // Retrieve information about an existing stored LOB, from a base dir
-func getLOBInfoInBaseDir(sha, basedir string) (*LOBInfo, error) {
-	file := GetLOBMetaPathInBaseDir(basedir, sha)
+func (r *Repo) getLOBInfoInBaseDir(sha, basedir string) (*LOBInfo, error) {
+	file := r.GetLOBMetaPathInBaseDir(basedir, sha)
 	_, err := os.Stat(file)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -165,13 +194,13 @@ func getLOBInfoInBaseDir(sha, basedir string) (*LOBInfo, error) {
 }
 
 // Retrieve information about an existing stored LOB (local)
-func GetLOBInfo(sha string) (*LOBInfo, error) {
-	info, err := getLOBInfoInBaseDir(sha, GetLocalLOBRoot())
+func (r *Repo) GetLOBInfo(sha string) (*LOBInfo, error) {
+	info, err := r.getLOBInfoInBaseDir(sha, r.GetLocalLOBRoot())
 	if err != nil {
 		if IsNotFoundError(err) {
 			// Try to recover from shared
-			if recoverLocalLOBFilesFromSharedStore(sha) {
-				info, err = getLOBInfoInBaseDir(sha, GetLocalLOBRoot())
+			if r.recoverLocalLOBFilesFromSharedStore(sha) {
+				info, err = r.getLOBInfoInBaseDir(sha, r.GetLocalLOBRoot())
 				if err != nil {
 					// Dang
 					return nil, err
@@ -202,6 +231,10 @@ func parseLOBInfoFromFile(file string) (*LOBInfo, error) {
 		// Fatal, corruption
 		return nil, errors.New(fmt.Sprintf("Unable to interpret meta file %v: %v", file, err))
 	}
+	err = validateLOBChunks(info)
+	if err != nil {
+		return nil, err
+	}
 
 	return info, nil
 
@@ -212,41 +245,39 @@ func parseLOBInfoFromFile(file string) (*LOBInfo, error) {
 // Note: this doesn't validate sizes of any files because it's assumed
 // because of hardlinking the files are either missing entirely or the
 // same as the shared store
-func recoverLocalLOBFilesFromSharedStore(sha string) bool {
-	if !IsUsingSharedStorage() {
+func (r *Repo) recoverLocalLOBFilesFromSharedStore(sha string) bool {
+	if !r.IsUsingSharedStorage() {
 		return false
 	}
 
-	metalocal := GetLocalLOBMetaPath(sha)
+	metalocal := r.GetLocalLOBMetaPath(sha)
 	if !util.FileExists(metalocal) {
-		metashared := getSharedLOBMetaPath(sha)
-		if util.FileExists(metashared) {
-			err := linkSharedLOBFilename(metashared)
-			if err != nil {
-				util.LogErrorf("Failed to link shared file %v into local repo: %v\n", metashared, err.Error())
-				return false
-			}
-		} else {
+		metashared := r.getSharedLOBMetaPath(sha)
+		linked, err := r.linkSharedLOBFilenameIfPresent(metashared, -1)
+		if err != nil {
+			r.Log.Errorf("Failed to link shared file %v into local repo: %v\n", metashared, err.Error())
+			return false
+		}
+		if !linked {
 			return false
 		}
 	}
 	// Meta should be complete & local now
-	info, err := GetLOBInfo(sha)
+	info, err := r.GetLOBInfo(sha)
 	if err != nil {
 		return false
 	}
 	for i := 0; i < info.NumChunks; i++ {
-		local := GetLocalLOBChunkPath(sha, i)
+		local := r.getLOBChunkPathInBaseDirForInfo(r.GetLocalLOBRoot(), info, i)
 		expectedSize := getLOBExpectedChunkSize(info, i)
 		if !util.FileExistsAndIsOfSize(local, expectedSize) {
-			shared := GetSharedLOBChunkPath(sha, i)
-			if util.FileExistsAndIsOfSize(shared, expectedSize) {
-				err := linkSharedLOBFilename(shared)
-				if err != nil {
-					util.LogErrorf("Failed to link shared file %v into local repo: %v\n", shared, err.Error())
-					return false
-				}
-			} else {
+			shared := r.getLOBChunkPathInBaseDirForInfo(r.GetSharedLOBRoot(), info, i)
+			linked, err := r.linkSharedLOBFilenameIfPresent(shared, expectedSize)
+			if err != nil {
+				r.Log.Errorf("Failed to link shared file %v into local repo: %v\n", shared, err.Error())
+				return false
+			}
+			if !linked {
 				return false
 			}
 		}
@@ -256,16 +287,144 @@ func recoverLocalLOBFilesFromSharedStore(sha string) bool {
 }
 
 // Retrieve LOB from storage
-func RetrieveLOB(sha string, out io.Writer) (info *LOBInfo, err error) {
-	info, err = GetLOBInfo(sha)
+func (r *Repo) RetrieveLOB(sha string, out io.Writer) (info *LOBInfo, err error) {
+	return r.RetrieveLOBWithProgress(sha, out, nil)
+}
 
+// Retrieve a LOB from storage like RetrieveLOB, reporting progress through the content to callback
+// (if not nil) as it's written, since large LOBs can take a while. Desc is the SHA, ItemBytes the
+// size of the LOB. Aborting from the callback stops writing content & returns an error
+func (r *Repo) RetrieveLOBWithProgress(sha string, out io.Writer, callback util.ProgressCallback) (info *LOBInfo, err error) {
+	info, err = r.prepareLOBForRetrieve(sha)
 	if err != nil {
-		if IsNotFoundError(err) && util.GlobalOptions.AutoFetchEnabled {
-			err = AutoFetch(sha, true)
+		return info, err
+	}
+
+	var pw *lobProgressWriter
+	if callback != nil {
+		pw = &lobProgressWriter{out: out, sha: sha, size: info.Size, callback: callback}
+		if pw.report() {
+			return info, errors.New(fmt.Sprintf("Retrieving LOB %v was aborted", sha))
+		}
+		out = pw
+	}
+	// Content is only checked against the SHA when we'd be able to repair it
+	var shaRecalc hash.Hash
+	if r.Options.AutoRepair {
+		shaRecalc = NewLOBHashForSHA(sha)
+		out = io.MultiWriter(out, shaRecalc)
+	}
+	// If all was well, start reading & streaming content
+	totalBytesRead, err := r.copyLOBContentRangeInBaseDir(r.GetLocalLOBRoot(), info, 0, info.Size, out)
+	if pw != nil && pw.aborted {
+		// Copying may not pass on the error if the last write was aborted
+		return info, errors.New(fmt.Sprintf("Retrieving LOB %v was aborted", sha))
+	}
+	if err == nil && shaRecalc != nil && fmt.Sprintf("%x", shaRecalc.Sum(nil)) != sha {
+		err = NewIntegrityError([]string{sha})
+	}
+	if err != nil && IsIntegrityError(err) {
+		// Content has already been written, so even if it's repaired this attempt has failed
+		if _, rerr := r.repairCorruptLOB(sha, "", err); rerr == nil {
+			return info, NewIntegrityErrorWithAdditionalMessage([]string{sha}, "The corrupt copy has been replaced, retrieve it again")
+		}
+	}
+	if err != nil {
+		return info, errors.New(fmt.Sprintf("I/O error while copying LOB %v, check working copy state: %v", sha, err.Error()))
+	}
+
+	// Final check
+	if totalBytesRead != info.Size {
+		err = errors.New(fmt.Sprintf("Error, file length does not match expected in LOB %v, expected %d, total size %d", sha, info.Size, totalBytesRead))
+		return info, err
+	}
+
+	r.Log.Debugf("Successfully retrieved LOB %v from %d chunks, total size %v\n", sha, info.NumChunks, util.FormatSize(totalBytesRead))
+
+	return info, nil
+
+}
+
+// Passes content through to out, reporting progress through a LOB
+type lobProgressWriter struct {
+	out      io.Writer
+	sha      string
+	size     int64
+	done     int64
+	callback util.ProgressCallback
+	aborted  bool
+}
+
+func (self *lobProgressWriter) Write(p []byte) (int, error) {
+	if self.aborted {
+		return 0, errors.New(fmt.Sprintf("Retrieving LOB %v was aborted", self.sha))
+	}
+	n, err := self.out.Write(p)
+	self.done += int64(n)
+	if self.report() {
+		self.aborted = true
+		if err == nil {
+			err = errors.New(fmt.Sprintf("Retrieving LOB %v was aborted", self.sha))
+		}
+	}
+	return n, err
+}
+
+func (self *lobProgressWriter) report() (abort bool) {
+	return self.callback(&util.ProgressCallbackData{util.ProgressTransferBytes, self.sha,
+		self.done, self.size, self.done, self.size, nil})
+}
+
+// Retrieve part of a LOB from storage, length bytes starting at offset
+// Only the chunks overlapping the range are read and for compressed LOBs
+// only the frames overlapping the range are decompressed, so this is cheap
+// even for small ranges deep inside very large LOBs
+func (r *Repo) RetrieveLOBRange(sha string, offset, length int64, out io.Writer) (info *LOBInfo, err error) {
+	info, err = r.prepareLOBForRetrieve(sha)
+	if err != nil {
+		return info, err
+	}
+
+	c, err := r.copyLOBContentRangeInBaseDir(r.GetLocalLOBRoot(), info, offset, length, out)
+	if err != nil {
+		return info, errors.New(fmt.Sprintf("Unable to retrieve range of LOB %v: %v", sha, err.Error()))
+	}
+	if c != length {
+		return info, errors.New(fmt.Sprintf("Error, range length does not match expected in LOB %v, expected %d, read %d", sha, length, c))
+	}
+
+	return info, nil
+}
+
+// Get the info for a LOB and check all its chunks are present, recovering them
+// from the shared store or fetching them if needed, prior to reading content
+func (r *Repo) prepareLOBForRetrieve(sha string) (info *LOBInfo, err error) {
+	info, err = r.GetLOBInfo(sha)
+
+	if err != nil {
+		if IsNotFoundError(err) {
+			// May have been shrunk, in which case rebuild it locally rather than fetching
+			restored, rerr := r.restoreLOBFromLocalDelta(sha)
+			if !restored && rerr == nil {
+				// Or converting it to new storage settings was interrupted
+				restored, rerr = r.restoreLOBFromUpgradeBackup(sha)
+			}
+			if restored {
+				info, err = r.GetLOBInfo(sha)
+			} else if rerr != nil {
+				r.Log.Debugf("%v\n", rerr.Error())
+			}
+		}
+		if err != nil && IsNotFoundError(err) && r.Options.AutoFetchEnabled {
+			err = r.AutoFetch(sha, true)
 			if err == nil {
-				info, err = GetLOBInfo(sha)
+				info, err = r.GetLOBInfo(sha)
 			}
 		}
+		if err != nil && IsIntegrityError(err) {
+			// Metadata is corrupt
+			info, err = r.repairCorruptLOB(sha, "", err)
+		}
 		if err != nil {
 			if IsNotFoundError(err) {
 				// Still not found after possible recovery?
@@ -277,35 +436,38 @@ func RetrieveLOB(sha string, out io.Writer) (info *LOBInfo, err error) {
 		}
 	}
 
-	var totalBytesRead = int64(0)
-	fileSize := info.Size
+	if !IsSupportedCompression(info.Compression) {
+		return info, errors.New(fmt.Sprintf("LOB %v is stored with unsupported compression '%v'", sha, info.Compression))
+	}
+	if err = r.checkLOBSignature(info); err != nil {
+		return info, err
+	}
+
 	// Pre-validate all the files BEFORE we start streaming data to out
 	// if we fail part way through we don't want to have written partial
 	// data, should be all or nothing
-	lastChunkSize := fileSize - (int64(info.NumChunks-1) * ChunkSize)
-	// Check all files
 	for i := 0; i < info.NumChunks; i++ {
-		chunkFilename := GetLocalLOBChunkPath(sha, i)
-		var expectedSize int64
-		if i+1 < info.NumChunks {
-			expectedSize = ChunkSize
-		} else {
-			if info.NumChunks == 1 {
-				expectedSize = fileSize
-			} else {
-				expectedSize = lastChunkSize
-			}
-		}
+		chunkFilename := r.getLOBChunkPathInBaseDirForInfo(r.GetLocalLOBRoot(), info, i)
+		expectedSize := getLOBExpectedChunkSize(info, i)
 		if !util.FileExistsAndIsOfSize(chunkFilename, expectedSize) {
 			// Try to recover from shared store
 			recoveredFromShared := false
-			if recoverLocalLOBFilesFromSharedStore(sha) {
+			if r.recoverLocalLOBFilesFromSharedStore(sha) {
 				recoveredFromShared = util.FileExistsAndIsOfSize(chunkFilename, expectedSize)
 			}
 
+			if !recoveredFromShared && util.FileExists(chunkFilename) {
+				// Present but the wrong size, so corrupt rather than missing
+				problem := NewWrongSizeError(fmt.Sprintf("Chunk %d of %v is the wrong size, expected %d bytes", i, sha, expectedSize), chunkFilename)
+				if r.Options.AutoRepair {
+					return r.repairCorruptLOB(sha, chunkFilename, problem)
+				}
+				r.recordCorruptLOB(sha, problem.Error(), false)
+			}
 			if !recoveredFromShared {
-				if util.GlobalOptions.AutoFetchEnabled {
-					err = AutoFetch(sha, true)
+				// Content is always fetched on demand after 'fetch --metadata-only'
+				if r.Options.AutoFetchEnabled || r.GetLazyFetchRemote() != "" {
+					err = r.AutoFetch(sha, true)
 					if err != nil {
 						if IsNotFoundError(err) {
 							return info, NewNotFoundError(fmt.Sprintf("Missing chunk %d for %v & not on remote", i, sha), chunkFilename)
@@ -319,29 +481,16 @@ func RetrieveLOB(sha string, out io.Writer) (info *LOBInfo, err error) {
 			}
 		}
 	}
-	// If all was well, start reading & streaming content
-	for i := 0; i < info.NumChunks; i++ {
-		// Check each chunk file exists
-		chunkFilename := GetLocalLOBChunkPath(info.SHA, i)
-		in, err := os.OpenFile(chunkFilename, os.O_RDONLY, 0644)
-		if err != nil {
-			return info, errors.New(fmt.Sprintf("Error reading LOB file %v: %v", chunkFilename, err))
-		}
-		c, err := io.Copy(out, in)
-		if err != nil {
-			return info, errors.New(fmt.Sprintf("I/O error while copying LOB file %v, check working copy state", chunkFilename))
+	// Content hard linked to working copy files could have been modified in place
+	if info.NumChunks > 0 {
+		chunkFilename := r.getLOBChunkPathInBaseDirForInfo(r.GetLocalLOBRoot(), info, 0)
+		if err = r.checkHardLinkedLOBContent(info, chunkFilename); err != nil {
+			if IsIntegrityError(err) {
+				return r.repairCorruptLOB(sha, chunkFilename, err)
+			}
+			return info, err
 		}
-		totalBytesRead += c
-	}
-
-	// Final check
-	if totalBytesRead != fileSize {
-		err = errors.New(fmt.Sprintf("Error, file length does not match expected in LOB %v, expected %d, total size %d", sha, fileSize, totalBytesRead))
-		return info, err
 	}
-
-	util.LogDebugf("Successfully retrieved LOB %v from %d chunks, total size %v\n", sha, info.NumChunks, util.FormatSize(totalBytesRead))
-
 	return info, nil
 
 }
@@ -350,13 +499,14 @@ func RetrieveLOB(sha string, out io.Writer) (info *LOBInfo, err error) {
 // The hard link means we only ever have one copy of the data
 // but it appears under each repo's git-lob folder
 // destFile should be a full path of shared file location
-func linkSharedLOBFilename(destSharedFile string) error {
-	// Get path relative to shared store root, then translate it to local path
-	relPath, err := filepath.Rel(util.GlobalOptions.SharedStore, destSharedFile)
+func (r *Repo) linkSharedLOBFilename(destSharedFile string) error {
+	// Get path relative to shared store root, then translate it to local path (the stores
+	// may have different layouts)
+	relPath, err := filepath.Rel(r.Options.SharedStore, util.StripLongPathPrefix(destSharedFile))
 	if err != nil {
 		return err
 	}
-	linkPath := filepath.Join(GetLocalLOBRoot(), relPath)
+	linkPath := getLOBStoreFilePath(r.GetLocalLOBRoot(), convertLOBStoreRelativePath(relPath, LOBStoreLayoutOriginal))
 
 	// Make sure path exists since we're not using utility method to link
 	os.MkdirAll(filepath.Dir(linkPath), 0755)
@@ -370,50 +520,65 @@ func linkSharedLOBFilename(destSharedFile string) error {
 }
 
 // Store the metadata for a given sha
-// If it already exists and is of the right size, will do nothing
-func StoreLOBInfo(info *LOBInfo) error {
+// If it already exists and is identical, will do nothing
+func (r *Repo) StoreLOBInfo(info *LOBInfo) error {
 	var root string
-	if IsUsingSharedStorage() {
-		root = GetSharedLOBRoot()
+	if r.IsUsingSharedStorage() {
+		root = r.GetSharedLOBRoot()
 	} else {
-		root = GetLocalLOBRoot()
+		root = r.GetLocalLOBRoot()
 	}
-	return StoreLOBInfoInBaseDir(root, info)
+	return r.StoreLOBInfoInBaseDir(root, info)
 }
 
 // Store the metadata for a given sha in a relative path
-// If it already exists and is of the right size, will do nothing
-func StoreLOBInfoInBaseDir(basedir string, info *LOBInfo) error {
+// If it already exists and is identical, will do nothing
+func (r *Repo) StoreLOBInfoInBaseDir(basedir string, info *LOBInfo) error {
+	infoFilename := r.GetLOBMetaPathInBaseDir(basedir, info.SHA)
+	if info.Signature == "" {
+		// The signature covers the content not how it's stored, so keep it if storing differently
+		if existing, err := parseLOBInfoFromFile(infoFilename); err == nil && existing.Size == info.Size {
+			info.Signature = existing.Signature
+		}
+	}
 	infoBytes, err := json.Marshal(info)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Unable to convert LOB info to JSON: %v", err))
 	}
-	infoFilename := GetLOBMetaPathInBaseDir(basedir, info.SHA)
-	if !util.FileExistsAndIsOfSize(infoFilename, int64(len(infoBytes))) {
-		// Since all the details are derived from the SHA the only variant is chunking or incomplete writes so
-		// we don't need to worry about needing to update the content (it must be correct)
-		util.LogDebugf("Writing LOB metadata file: %v\n", infoFilename)
+	if r.IsUsingSharedStorage() && basedir == r.GetSharedLOBRoot() {
+		// Don't let it be pruned before it's linked
+		l, err := r.lockSharedStoreSHA(info.SHA)
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+	}
+	// Compare content, not just size; metadata for the same SHA varies by compression
+	// codec & seek index, which could happen to produce a file of the same size
+	existingBytes, err := ioutil.ReadFile(infoFilename)
+	if err != nil || !bytes.Equal(existingBytes, infoBytes) {
+		r.Log.Debugf("Writing LOB metadata file: %v\n", infoFilename)
 		err = ioutil.WriteFile(infoFilename, infoBytes, 0644)
 		if err != nil {
 			return err
 		}
 	} else {
-		util.LogDebugf("LOB metadata file already exists & is valid: %v\n", infoFilename)
+		r.Log.Debugf("LOB metadata file already exists & is valid: %v\n", infoFilename)
 	}
 
 	// This may have stored in shared storage, so link if required
-	if IsUsingSharedStorage() && basedir == GetSharedLOBRoot() {
-		return linkSharedLOBFilename(infoFilename)
+	if r.IsUsingSharedStorage() && basedir == r.GetSharedLOBRoot() {
+		return r.linkSharedLOBFilename(infoFilename)
 	} else {
 		return nil
 	}
 
 }
 
-func IsUsingSharedStorage() bool {
-	if util.GlobalOptions.SharedStore != "" {
+func (r *Repo) IsUsingSharedStorage() bool {
+	if r.Options.SharedStore != "" {
 		// We create the folder on loading config
-		return util.DirExists(util.GlobalOptions.SharedStore)
+		return util.DirExists(r.Options.SharedStore)
 	}
 	return false
 }
@@ -422,25 +587,33 @@ func IsUsingSharedStorage() bool {
 // If file already exists and is of the right size, will do nothing
 // fromChunkFile will be moved into its final location or deleted if the data is already valid,
 // so the file will not exist after this call (renamed to final location or deleted), unless error
-func StoreLOBChunk(sha string, chunkNo int, fromChunkFile string, sz int64) error {
+func (r *Repo) StoreLOBChunk(sha string, chunkNo int, fromChunkFile string, sz int64) error {
 	var root string
-	if IsUsingSharedStorage() {
-		root = GetSharedLOBRoot()
+	if r.IsUsingSharedStorage() {
+		root = r.GetSharedLOBRoot()
 	} else {
-		root = GetLocalLOBRoot()
+		root = r.GetLocalLOBRoot()
 	}
-	return StoreLOBChunkInBaseDir(root, sha, chunkNo, fromChunkFile, sz)
+	return r.StoreLOBChunkInBaseDir(root, sha, chunkNo, fromChunkFile, sz)
 }
 
 // Write the contents of fromFile to final storage with sha, checking the size, to a relative root
 // If file already exists and is of the right size, will do nothing
 // fromChunkFile will be moved into its final location or deleted if the data is already valid,
 // so the file will not exist after this call (renamed to final location or deleted), unless error
-func StoreLOBChunkInBaseDir(basedir, sha string, chunkNo int, fromChunkFile string, sz int64) error {
-	destFile := GetLOBChunkPathInBaseDir(basedir, sha, chunkNo)
+func (r *Repo) StoreLOBChunkInBaseDir(basedir, sha string, chunkNo int, fromChunkFile string, sz int64) error {
+	destFile := r.GetLOBChunkPathInBaseDir(basedir, sha, chunkNo)
+	if r.IsUsingSharedStorage() && basedir == r.GetSharedLOBRoot() {
+		// Don't let it be pruned between checking it's there & linking it
+		l, err := r.lockSharedStoreSHA(sha)
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+	}
 
 	if !util.FileExistsAndIsOfSize(destFile, int64(sz)) {
-		util.LogDebugf("Saving final LOB metadata file: %v\n", destFile)
+		r.Log.Debugf("Saving final LOB metadata file: %v\n", destFile)
 		// delete any existing (incorrectly sized) file since will probably not be allowed to rename over it
 		// ignore any errors
 		os.Remove(destFile)
@@ -449,14 +622,14 @@ func StoreLOBChunkInBaseDir(basedir, sha string, chunkNo int, fromChunkFile stri
 			return err
 		}
 	} else {
-		util.LogDebugf("LOB chunk file already exists & is valid: %v\n", destFile)
+		r.Log.Debugf("LOB chunk file already exists & is valid: %v\n", destFile)
 		// Remove file that would have been moved
 		os.Remove(fromChunkFile)
 	}
 
 	// This may have stored in shared storage, so link if required
-	if IsUsingSharedStorage() && basedir == GetSharedLOBRoot() {
-		return linkSharedLOBFilename(destFile)
+	if r.IsUsingSharedStorage() && basedir == r.GetSharedLOBRoot() {
+		return r.linkSharedLOBFilename(destFile)
 	}
 	return nil
 
@@ -464,97 +637,165 @@ func StoreLOBChunkInBaseDir(basedir, sha string, chunkNo int, fromChunkFile stri
 
 // Read from a stream and calculate SHA, while also writing content to chunked content
 // leader is a slice of bytes that has already been read (probe for SHA)
-func StoreLOB(in io.Reader, leader []byte) (*LOBInfo, error) {
+// Chunks are split according to git-lob.chunking & compressed according to git-lob.compression
+func (r *Repo) StoreLOB(in io.Reader, leader []byte) (*LOBInfo, error) {
+	return r.storeLOB(in, leader, "", r.Options.HashAlgorithm)
+}
+
+// Store a LOB as StoreLOB, reusing the leading chunks of the LOB previous if it's not blank
+// (see StoreLOBForFile), with its SHA calculated with hashAlgorithm
+func (r *Repo) storeLOB(in io.Reader, leader []byte, previous, hashAlgorithm string) (*LOBInfo, error) {
 	var root string
-	if IsUsingSharedStorage() {
-		root = GetSharedLOBRoot()
+	if r.IsUsingSharedStorage() {
+		root = r.GetSharedLOBRoot()
 	} else {
-		root = GetLocalLOBRoot()
+		root = r.GetLocalLOBRoot()
+	}
+	var info *LOBInfo
+	var err error
+	if previous != "" {
+		info, err = r.storeLOBInBaseDirAppended(root, in, leader, previous, hashAlgorithm)
+	} else {
+		info, err = r.storeLOBInBaseDirWithSettings(root, in, leader, hashAlgorithm)
+	}
+	if err != nil || !r.Options.SignLOBs || info.Signature != "" {
+		return info, err
+	}
+	// Newly stored, or nobody signed it before
+	err = r.SignLOBInfo(info)
+	if err != nil {
+		return nil, err
 	}
-	return StoreLOBInBaseDir(root, in, leader)
+	err = r.StoreLOBInfoInBaseDir(root, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Store underneath a specified LOB root, with chunking & compression according to settings
+// The SHA is calculated with hashAlgorithm, so content already stored can keep its SHA
+func (r *Repo) storeLOBInBaseDirWithSettings(basedir string, in io.Reader, leader []byte, hashAlgorithm string) (*LOBInfo, error) {
+	if r.Options.Chunking == ChunkingContentDefined {
+		// Content-defined chunks are shared between LOBs so can't be compressed per LOB
+		return r.storeLOBInBaseDirContentDefinedWithHash(basedir, in, leader, hashAlgorithm)
+	}
+	return r.storeLOBInBaseDirWithHash(basedir, in, leader, r.Options.Compression, hashAlgorithm)
 }
 
 // Read from a stream and calculate SHA, while also writing content to chunked content
 // leader is a slice of bytes that has already been read (probe for SHA)
 // Store underneath a specified LOB root
-func StoreLOBInBaseDir(basedir string, in io.Reader, leader []byte) (*LOBInfo, error) {
-	sha := sha1.New()
+func (r *Repo) StoreLOBInBaseDir(basedir string, in io.Reader, leader []byte) (*LOBInfo, error) {
+	return r.StoreLOBInBaseDirWithCompression(basedir, in, leader, CompressionNone)
+}
+
+// Read from a stream and calculate SHA, while also writing content to chunked content
+// leader is a slice of bytes that has already been read (probe for SHA)
+// Store underneath a specified LOB root, compressing chunks with codec (CompressionNone to store as-is)
+// Compressed chunks are written as a series of independent frames, with the seek index
+// recorded in the LOBInfo so that arbitrary ranges can be read back efficiently
+func (r *Repo) StoreLOBInBaseDirWithCompression(basedir string, in io.Reader, leader []byte, codec string) (*LOBInfo, error) {
+	return r.storeLOBInBaseDirWithHash(basedir, in, leader, codec, r.Options.HashAlgorithm)
+}
+
+func (r *Repo) storeLOBInBaseDirWithHash(basedir string, in io.Reader, leader []byte, codec, hashAlgorithm string) (*LOBInfo, error) {
+	if !IsSupportedCompression(codec) {
+		return nil, errors.New(fmt.Sprintf("Unsupported compression codec '%v'", codec))
+	}
+	sha := newHash(hashAlgorithm)
 	// Write chunks to temporary files, then move based on SHA filename once calculated
 	chunkFilenames := make([]string, 0, 5)
+	// Seek index for each chunk if compressing
+	var chunkFrames [][]int64
 
 	var outf *os.File
+	var frameWriter *seekableFrameWriter
+	var chunkOut io.Writer
 	var err error
-	writeLeader := true
-	buf := make([]byte, BUFSIZE)
 	var fatalError error
 	var currentChunkSize int64 = 0
 	var totalSize int64 = 0
+	chunkSize := r.getNewLOBChunkSize()
 
-	for {
-		var dataToWrite []byte
-
-		if writeLeader && len(leader) > 0 {
-			dataToWrite = leader
-			writeLeader = false
-		} else {
-			var bytesToRead int64 = BUFSIZE
-			if BUFSIZE+currentChunkSize > ChunkSize {
-				// Read less than BUFSIZE so we stick to CHUNKLIMIT
-				bytesToRead = ChunkSize - currentChunkSize
-			}
-			c, err := in.Read(buf[:bytesToRead])
-			// Write any data to SHA & output
-			if c > 0 {
-				dataToWrite = buf[:c]
-			} else if err != nil {
-				if err == io.EOF {
-					// End of input
-					outf.Close()
-					break
-				} else {
-					outf.Close()
-					fatalError = errors.New(fmt.Sprintf("I/O error reading chunk %d: %v", len(chunkFilenames), err))
-					break
-				}
-			}
-
+	// Finish off the current chunk, if any
+	closeChunk := func() error {
+		if outf == nil {
+			return nil
 		}
+		var err error
+		if frameWriter != nil {
+			err = frameWriter.Close()
+			chunkFrames = append(chunkFrames, frameWriter.Frames)
+			frameWriter = nil
+		}
+		outf.Close()
+		outf = nil
+		return err
+	}
 
-		// Write data
-		if len(dataToWrite) > 0 {
+	// Write data to chunks, starting new ones at the chunk limit
+	writeChunks := func(dataToWrite []byte) error {
+		for len(dataToWrite) > 0 {
 			// New chunk file?
 			if outf == nil {
 				outf, err = ioutil.TempFile("", "tempchunk")
 				if err != nil {
-					fatalError = errors.New(fmt.Sprintf("Unable to create chunk %d: %v", len(chunkFilenames), err))
-					break
+					return errors.New(fmt.Sprintf("Unable to create chunk %d: %v", len(chunkFilenames), err))
 				}
 				chunkFilenames = append(chunkFilenames, outf.Name())
 				currentChunkSize = 0
+				if codec == CompressionNone {
+					chunkOut = outf
+				} else {
+					frameWriter = newSeekableFrameWriter(outf, codec, CompressionFrameSize)
+					chunkOut = frameWriter
+				}
 			}
-			sha.Write(dataToWrite)
-			c, err := outf.Write(dataToWrite)
+			// Write no more than the rest of this chunk
+			data := dataToWrite
+			if int64(len(data)) > chunkSize-currentChunkSize {
+				data = data[:chunkSize-currentChunkSize]
+			}
+			c, err := chunkOut.Write(data)
 			if err != nil {
-				fatalError = errors.New(fmt.Sprintf("I/O error writing chunk: %v wrote %d bytes of %d", err, c, len(dataToWrite)))
-				break
+				return errors.New(fmt.Sprintf("I/O error writing chunk: %v wrote %d bytes of %d", err, c, len(data)))
 			}
 			currentChunkSize += int64(c)
 			totalSize += int64(c)
+			dataToWrite = dataToWrite[c:]
 
-			// Read from incoming
 			// Deal with chunk limit
-			if currentChunkSize >= ChunkSize {
-				// Close this output, next iteration will create the next file
-				outf.Close()
-				outf = nil
+			if currentChunkSize >= chunkSize {
+				// Close this output, next write will create the next file
+				err = closeChunk()
+				if err != nil {
+					return errors.New(fmt.Sprintf("I/O error writing chunk %d: %v", len(chunkFilenames)-1, err))
+				}
 				currentChunkSize = 0
 			}
-		} else {
-			// No data to write
-			outf.Close()
+		}
+		return nil
+	}
+
+	// Input is read & hashed on other goroutines while we write it
+	pipeline := newStorePipeline(in, leader, sha)
+	for buf := range pipeline.Buffers() {
+		fatalError = writeChunks(buf.Data)
+		pipeline.Done(buf)
+		if fatalError != nil {
 			break
 		}
 	}
+	if fatalError != nil {
+		pipeline.Abort()
+	} else if err := pipeline.Wait(); err != nil {
+		closeChunk()
+		fatalError = errors.New(fmt.Sprintf("I/O error reading chunk %d: %v", len(chunkFilenames), err))
+	} else {
+		// End of input
+		fatalError = closeChunk()
+	}
 	if outf != nil {
 		// Close any dangling chunk
 		outf.Close()
@@ -576,19 +817,32 @@ func StoreLOBInBaseDir(basedir string, in io.Reader, leader []byte) (*LOBInfo, e
 	// We won't if it already exists & is the correct size
 	// Construct LOBInfo & write to final location
 	info := &LOBInfo{SHA: shaStr, Size: totalSize, NumChunks: len(chunkFilenames)}
-	err = StoreLOBInfoInBaseDir(basedir, info)
+	if chunkSize != ChunkSize {
+		info.Version = LOBInfoVersionFixedChunkSize
+		info.ChunkSize = chunkSize
+	}
+	if codec != CompressionNone && len(chunkFilenames) > 0 {
+		info.Compression = codec
+		info.FrameSize = CompressionFrameSize
+		info.Frames = chunkFrames
+	}
+
+	existing, err := r.keepExistingLOBStorage(basedir, info)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+
+	err = r.StoreLOBInfoInBaseDir(basedir, info)
 	if err != nil {
 		return nil, err
 	}
 
 	// Check each chunk file
 	for i, f := range chunkFilenames {
-		sz := ChunkSize
-		if i+1 == len(chunkFilenames) {
-			// Last chunk, get size
-			sz = currentChunkSize
-		}
-		err = StoreLOBChunkInBaseDir(basedir, shaStr, i, f, sz)
+		err = r.StoreLOBChunkInBaseDir(basedir, shaStr, i, f, getLOBExpectedChunkSize(info, i))
 		if err != nil {
 			return nil, err
 		}
@@ -598,35 +852,69 @@ func StoreLOBInBaseDir(basedir string, in io.Reader, leader []byte) (*LOBInfo, e
 
 }
 
+// Stores can be mixed, the same LOB may already be present stored differently (e.g. the
+// compression or chunking setting has changed, or it was fetched from a remote which compresses)
+// If it's complete, returns the existing info so that it can be kept as it is instead of
+// storing info; otherwise removes any old chunks so none can be mistaken for new ones & returns nil
+func (r *Repo) keepExistingLOBStorage(basedir string, info *LOBInfo) (*LOBInfo, error) {
+	existing, err := r.getLOBInfoInBaseDir(info.SHA, basedir)
+	if err != nil || isSameLOBStorage(existing, info) {
+		return nil, nil
+	}
+	if existingfiles, _, err := r.getLOBFilesForSHA(info.SHA, basedir, true, false); err == nil {
+		// Complete already, content is identical so just keep it as it is
+		r.Log.Debugf("LOB %v is already stored (compression '%v', format %d), not re-storing\n", info.SHA, existing.Compression, existing.Version)
+		if r.IsUsingSharedStorage() && basedir == r.GetSharedLOBRoot() {
+			for _, f := range existingfiles {
+				linked, err := r.linkSharedLOBFilenameIfPresent(getLOBStoreFilePath(basedir, f), -1)
+				if err != nil {
+					return nil, err
+				}
+				if !linked {
+					// Pruned in the meantime, store it again
+					return nil, nil
+				}
+			}
+		}
+		return existing, nil
+	}
+	// Incomplete; chunk objects may be used by other LOBs so are left for pruning
+	if existing.Version != LOBInfoVersionChunkObjects {
+		for i := 0; i < existing.NumChunks; i++ {
+			os.Remove(r.GetLOBChunkPathInBaseDir(basedir, info.SHA, i))
+		}
+	}
+	return nil, nil
+}
+
 // Delete all files associated with a given LOB SHA from the local store
-func DeleteLOB(sha string) error {
+func (r *Repo) DeleteLOB(sha string) error {
 	// Delete from local always (either only copy, or hard link)
-	return DeleteLOBInBaseDir(sha, GetLocalLOBRoot())
+	return r.DeleteLOBInBaseDir(sha, r.GetLocalLOBRoot())
 }
 
 // Delete all files associated with a given LOB SHA from a specified root dir
-func DeleteLOBInBaseDir(sha, basedir string) error {
+// Chunk objects may be shared with other LOBs so are not deleted, see PruneChunkObjectsInBaseDir
+func (r *Repo) DeleteLOBInBaseDir(sha, basedir string) error {
 
-	dir := getLOBSubDir(basedir, sha)
-	names, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%v*", sha)))
+	err := deleteLOBFilesInStore(sha, basedir)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Unable to glob local files for %v: %v", sha, err))
-	}
-	for _, n := range names {
-		err = os.Remove(n)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Unable to delete file %v: %v", n, err))
-		}
+		return err
 	}
 
-	if IsUsingSharedStorage() && basedir != GetSharedLOBRoot() {
+	if r.IsUsingSharedStorage() && basedir != r.GetSharedLOBRoot() {
 		// If we're using shared storage, then also check the number of links in
 		// shared storage for this SHA. See PruneSharedStore for a more general
 		// sweep for files that don't go through DeleteLOB (e.g. repo deleted manually)
-		shareddir := GetSharedLOBDir(sha)
-		names, err := filepath.Glob(filepath.Join(shareddir, fmt.Sprintf("%v*", sha)))
+		// Another repo mustn't link it while we decide whether to delete it
+		l, err := r.lockSharedStoreSHA(sha)
 		if err != nil {
-			return errors.New(fmt.Sprintf("Unable to glob shared files for %v: %v", sha, err))
+			return err
+		}
+		defer l.Release()
+		names, err := getLOBOwnFilesInStore(sha, r.GetSharedLOBRoot())
+		if err != nil {
+			return err
 		}
 		for _, n := range names {
 			links, err := GetHardLinkCount(n)
@@ -647,9 +935,24 @@ func DeleteLOBInBaseDir(sha, basedir string) error {
 
 }
 
+// Delete the files for a LOB in a single store, without touching the shared store
+func deleteLOBFilesInStore(sha, basedir string) error {
+	names, err := getLOBOwnFilesInStore(sha, basedir)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		err = os.Remove(n)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to delete file %v: %v", n, err))
+		}
+	}
+	return nil
+}
+
 // Get the local/shared storage of a LOB with a given SHA
-// Returns the list of files (relative to basedir) & checks for
-// integrity if check = true
+// Returns the list of files (relative to basedir) and the size of the LOB content
+// (uncompressed), & checks for integrity if check = true
 // If check = true and checkHash = true, reads all the data in the files and re-calculates
 // the SHA for a deep validation of content
 // If check = true and checkHash = false, just checks the presence & size of all files
@@ -657,41 +960,46 @@ func DeleteLOBInBaseDir(sha, basedir string) error {
 // In the rare case that a break has occurred between shared storage
 // and the local hardlink, this method will re-link if the shared
 // store has it
-func GetLOBFilesForSHA(sha, basedir string, check bool, checkHash bool) (files []string, size int64, _err error) {
+func (r *Repo) GetLOBFilesForSHA(sha, basedir string, check bool, checkHash bool) (files []string, size int64, _err error) {
+	files, info, err := r.getLOBFilesForSHA(sha, basedir, check, checkHash)
+	if info != nil {
+		size = info.Size
+	}
+	return files, size, err
+}
+
+// As GetLOBFilesForSHA but returns the LOBInfo (nil if the metadata could not be read), so
+// that callers can also determine the stored size of the files (see getLOBStoredSize)
+func (r *Repo) getLOBFilesForSHA(sha, basedir string, check bool, checkHash bool) (files []string, info *LOBInfo, _err error) {
 	var ret []string
-	info, err := getLOBInfoInBaseDir(sha, basedir)
+	info, err := r.getLOBInfoInBaseDir(sha, basedir)
 	if err != nil {
-		return []string{}, 0, err
+		return []string{}, nil, err
 	}
 	// add meta file (relative) - already checked by GetLOBInfo above
 	relmeta := GetLOBMetaRelativePath(sha)
 	ret = append(ret, relmeta)
 
+	// Content hard linked to working copy files could have been modified in place, so always hash it
+	if check && !checkHash && info.NumChunks > 0 &&
+		r.isLOBChunkHardLinked(info, getLOBStoreFilePath(basedir, getLOBChunkRelativePathForInfo(info, 0))) {
+		checkHash = true
+	}
 	var shaRecalc hash.Hash
 	if checkHash {
-		shaRecalc = sha1.New()
+		shaRecalc = NewLOBHashForSHA(sha)
 	}
-	lastChunkSize := info.Size - (int64(info.NumChunks-1) * ChunkSize)
 	for i := 0; i < info.NumChunks; i++ {
-		relchunk := GetLOBChunkRelativePath(sha, i)
+		relchunk := getLOBChunkRelativePathForInfo(info, i)
 		ret = append(ret, relchunk)
 		if check {
-			abschunk := filepath.Join(basedir, relchunk)
+			abschunk := getLOBStoreFilePath(basedir, relchunk)
 			// Check size first
-			var expectedSize int64
-			if i+1 < info.NumChunks {
-				expectedSize = ChunkSize
-			} else {
-				if info.NumChunks == 1 {
-					expectedSize = info.Size
-				} else {
-					expectedSize = lastChunkSize
-				}
-			}
+			expectedSize := getLOBExpectedChunkSize(info, i)
 			if !util.FileExistsAndIsOfSize(abschunk, expectedSize) {
 				// Try to recover from shared store
 				recoveredFromShared := false
-				if recoverLocalLOBFilesFromSharedStore(sha) {
+				if r.recoverLocalLOBFilesFromSharedStore(sha) {
 					recoveredFromShared = util.FileExistsAndIsOfSize(abschunk, expectedSize)
 				}
 
@@ -704,23 +1012,21 @@ func GetLOBFilesForSHA(sha, basedir string, check bool, checkHash bool) (files [
 					} else {
 						err = NewNotFoundError(msg, abschunk)
 					}
-					return ret, info.Size, err
+					return ret, info, err
 				}
 			}
 
 			// Check SHA content?
 			if checkHash {
-				f, err := os.OpenFile(abschunk, os.O_RDONLY, 0644)
-				if err != nil {
-					msg := fmt.Sprintf("Error opening LOB file %v to check SHA: %v", abschunk, err)
-					return ret, info.Size, errors.New(msg)
-				}
-				_, err = io.Copy(shaRecalc, f)
+				// Compressed chunks are decompressed, which also verifies each frame's checksum
+				_, err = copyLOBChunkContentRange(abschunk, info, i, 0, getLOBChunkContentSize(info, i), shaRecalc)
 				if err != nil {
+					if IsIntegrityError(err) {
+						return ret, info, err
+					}
 					msg := fmt.Sprintf("Error copying LOB file %v into SHA calculator: %v", abschunk, err)
-					return ret, info.Size, errors.New(msg)
+					return ret, info, errors.New(msg)
 				}
-				f.Close()
 			}
 
 		}
@@ -729,11 +1035,11 @@ func GetLOBFilesForSHA(sha, basedir string, check bool, checkHash bool) (files [
 	if check && checkHash {
 		shaRecalcStr := fmt.Sprintf("%x", string(shaRecalc.Sum(nil)))
 		if sha != shaRecalcStr {
-			return ret, info.Size, NewIntegrityError([]string{sha})
+			return ret, info, NewIntegrityError([]string{sha})
 		}
 	}
 
-	return ret, info.Size, nil
+	return ret, info, nil
 
 }
 
@@ -742,8 +1048,8 @@ func GetLOBFilesForSHA(sha, basedir string, check bool, checkHash bool) (files [
 // the SHA for a deep validation of content (slower but complete)
 // If checkHash = false, just checks the presence & size of all files (quick & most likely correct)
 // Note that if basedir is the local root, will try to recover missing files from shared store
-func CheckLOBFilesForSHA(sha, basedir string, checkHash bool) error {
-	_, _, err := GetLOBFilesForSHA(sha, basedir, true, checkHash)
+func (r *Repo) CheckLOBFilesForSHA(sha, basedir string, checkHash bool) error {
+	_, _, err := r.GetLOBFilesForSHA(sha, basedir, true, checkHash)
 	return err
 }
 
@@ -752,14 +1058,14 @@ func CheckLOBFilesForSHA(sha, basedir string, checkHash bool) error {
 // If checkHash = true, reads all the data in the files and re-calculates
 // the SHA for a deep validation of content (slower but complete)
 // If checkHash = false, just checks the presence & size of all files (quick & most likely correct)
-func GetMissingLOBs(lobshas []string, checkHash bool) []string {
-	localroot := GetLocalLOBRoot()
+func (r *Repo) GetMissingLOBs(lobshas []string, checkHash bool) []string {
+	localroot := r.GetLocalLOBRoot()
 	var missing []string
 	for _, sha := range lobshas {
-		err := CheckLOBFilesForSHA(sha, localroot, checkHash)
+		err := r.CheckLOBFilesForSHA(sha, localroot, checkHash)
 		if err != nil {
 			// Recover from shared storage if possible
-			if IsUsingSharedStorage() && recoverLocalLOBFilesFromSharedStore(sha) {
+			if r.IsUsingSharedStorage() && r.recoverLocalLOBFilesFromSharedStore(sha) {
 				// then we're OK
 			} else {
 				missing = append(missing, sha)
@@ -770,12 +1076,12 @@ func GetMissingLOBs(lobshas []string, checkHash bool) []string {
 }
 
 // Return whether a single LOB is missing
-func IsLOBMissing(sha string, checkHash bool) bool {
-	localroot := GetLocalLOBRoot()
-	err := CheckLOBFilesForSHA(sha, localroot, checkHash)
+func (r *Repo) IsLOBMissing(sha string, checkHash bool) bool {
+	localroot := r.GetLocalLOBRoot()
+	err := r.CheckLOBFilesForSHA(sha, localroot, checkHash)
 	if err != nil {
 		// Recover from shared storage if possible
-		if IsUsingSharedStorage() && recoverLocalLOBFilesFromSharedStore(sha) {
+		if r.IsUsingSharedStorage() && r.recoverLocalLOBFilesFromSharedStore(sha) {
 			// then we're OK
 		} else {
 			return true
@@ -785,23 +1091,47 @@ func IsLOBMissing(sha string, checkHash bool) bool {
 	return false
 }
 
-// Get the correct size of a given chunk
+// Returns whether 2 LOBInfos for the same LOB describe identical stored files
+func isSameLOBStorage(a, b *LOBInfo) bool {
+	return a.NumChunks == b.NumChunks && a.Compression == b.Compression &&
+		a.FrameSize == b.FrameSize && reflect.DeepEqual(a.Frames, b.Frames) &&
+		a.Version == b.Version && reflect.DeepEqual(a.Chunks, b.Chunks) && a.ChunkSize == b.ChunkSize
+}
+
+// Get the size of chunks to split newly stored binaries into (fixed size chunking)
+func (r *Repo) getNewLOBChunkSize() int64 {
+	if r.Options.ChunkSize > 0 {
+		return r.Options.ChunkSize
+	}
+	return ChunkSize
+}
+
+// Get the size of every chunk but the last of a LOB stored in fixed size chunks
+func getLOBFixedChunkSize(info *LOBInfo) int64 {
+	if info.Version == LOBInfoVersionFixedChunkSize {
+		return info.ChunkSize
+	}
+	return ChunkSize
+}
+
+// Get the correct size of a given chunk as stored (compressed size if compressed)
 func getLOBExpectedChunkSize(info *LOBInfo, chunkIdx int) int64 {
-	if chunkIdx+1 < info.NumChunks {
-		return ChunkSize
-	} else {
-		if info.NumChunks == 1 {
-			return info.Size
-		} else {
-			return info.Size - (int64(info.NumChunks-1) * ChunkSize)
+	if info.Compression == CompressionNone {
+		return getLOBChunkContentSize(info, chunkIdx)
+	}
+	var sz int64
+	if chunkIdx < len(info.Frames) {
+		for _, framesz := range info.Frames[chunkIdx] {
+			sz += framesz
 		}
 	}
+	return sz
 
 }
 
 // returns whether the local store has any binaries in it
-func IsLocalLOBStoreEmpty() bool {
-	root := GetLocalLOBRoot()
+func (r *Repo) IsLocalLOBStoreEmpty() bool {
+	root := r.GetLocalLOBRoot()
 	rootf, err := os.Open(root)
 	if err != nil {
 		return true
@@ -819,52 +1149,47 @@ func IsLocalLOBStoreEmpty() bool {
 // Generates a diff between the contents of 2 LOBs
 // Automatically copes with chunking, the diff is one file across the entire content
 // Returns the size of the compressed delta
-func GenerateLOBDelta(basesha, targetsha string, out io.Writer) (int64, error) {
-	return GenerateLOBDeltaInBaseDir(GetLocalLOBRoot(), basesha, targetsha, out)
+func (r *Repo) GenerateLOBDelta(basesha, targetsha string, out io.Writer) (int64, error) {
+	return r.GenerateLOBDeltaInBaseDir(r.GetLocalLOBRoot(), basesha, targetsha, out)
+}
+
+// As GenerateLOBDelta, but with a given delta algorithm
+func (r *Repo) GenerateLOBDeltaWithAlgorithm(algorithm, basesha, targetsha string, out io.Writer) (int64, error) {
+	return r.GenerateLOBDeltaInBaseDirWithAlgorithm(r.GetLocalLOBRoot(), algorithm, basesha, targetsha, out)
 }
 
 // Applies a diff to basesha and generates a LOB which should have targetsha (will be checked, error returned if disagrees)
-func ApplyLOBDelta(basesha, targetsha string, delta io.Reader) error {
+func (r *Repo) ApplyLOBDelta(basesha, targetsha string, delta io.Reader) error {
 	var root string
-	if IsUsingSharedStorage() {
-		root = GetSharedLOBRoot()
+	if r.IsUsingSharedStorage() {
+		root = r.GetSharedLOBRoot()
 	} else {
-		root = GetLocalLOBRoot()
+		root = r.GetLocalLOBRoot()
 	}
-	err := ApplyLOBDeltaInBaseDir(root, basesha, targetsha, delta)
+	err := r.ApplyLOBDeltaInBaseDir(root, basesha, targetsha, delta)
 	if err != nil {
 		// This may have stored in shared storage, so link if required
-		if IsUsingSharedStorage() {
-			recoverLocalLOBFilesFromSharedStore(targetsha)
+		if r.IsUsingSharedStorage() {
+			r.recoverLocalLOBFilesFromSharedStore(targetsha)
 		}
 	}
 	return err
 }
 
 // Retrieve the entire content for all chunks of a LOB and write to 'out'
-func GetLOBCompleteContent(sha string, out io.Writer) error {
-	return GetLOBCompleteContentInBaseDir(GetLocalLOBRoot(), sha, out)
+func (r *Repo) GetLOBCompleteContent(sha string, out io.Writer) error {
+	return r.GetLOBCompleteContentInBaseDir(r.GetLocalLOBRoot(), sha, out)
 }
 
 // Retrieve the entire content for all chunks of a LOB within a base root, and write to 'out'
-func GetLOBCompleteContentInBaseDir(basedir, sha string, out io.Writer) error {
-	info, err := getLOBInfoInBaseDir(sha, basedir)
+func (r *Repo) GetLOBCompleteContentInBaseDir(basedir, sha string, out io.Writer) error {
+	info, err := r.getLOBInfoInBaseDir(sha, basedir)
 	if err != nil {
 		return err
 	}
-	var bytesread int64
-	for i := 0; i < info.NumChunks; i++ {
-		chunkfile := filepath.Join(basedir, GetLOBChunkRelativePath(sha, i))
-		cf, err := os.OpenFile(chunkfile, os.O_RDONLY, 0644)
-		if err != nil {
-			return err
-		}
-		defer cf.Close()
-		n, err := io.Copy(out, cf)
-		if err != nil {
-			return fmt.Errorf("Error while copying data from content: %v", err.Error())
-		}
-		bytesread += n
+	bytesread, err := r.copyLOBContentRangeInBaseDir(basedir, info, 0, info.Size, out)
+	if err != nil {
+		return fmt.Errorf("Error while copying data from content: %v", err.Error())
 	}
 	if bytesread != info.Size {
 		return fmt.Errorf("Incorrect number of bytes read for LOB - expected %d actual %d", info.Size, bytesread)
@@ -875,101 +1200,117 @@ func GetLOBCompleteContentInBaseDir(basedir, sha string, out io.Writer) error {
 // Generates a diff between the contents of 2 LOBs, with a specified root storage
 // Automatically copes with chunking, the diff is one file across the entire content
 // Returns the size of the compressed delta
-func GenerateLOBDeltaInBaseDir(basedir, basesha, targetsha string, out io.Writer) (int64, error) {
-	// Read all of base file into memory to use as dictionary (pre-size from info)
-	baseinfo, err := getLOBInfoInBaseDir(basesha, basedir)
-	basebuf := bytes.NewBuffer(make([]byte, 0, baseinfo.Size))
+func (r *Repo) GenerateLOBDeltaInBaseDir(basedir, basesha, targetsha string, out io.Writer) (int64, error) {
+	return r.GenerateLOBDeltaInBaseDirWithAlgorithm(basedir, DeltaAlgorithmBM, basesha, targetsha, out)
+}
+
+// As GenerateLOBDeltaInBaseDir, but with a given delta algorithm
+func (r *Repo) GenerateLOBDeltaInBaseDirWithAlgorithm(basedir, algorithm, basesha, targetsha string, out io.Writer) (int64, error) {
+	alg, err := GetDeltaAlgorithm(algorithm)
 	if err != nil {
 		return 0, err
 	}
-	err = GetLOBCompleteContentInBaseDir(basedir, basesha, basebuf)
+	base, err := r.getLOBContentInBaseDir(basedir, basesha)
 	if err != nil {
-		return 0, fmt.Errorf("Error getting base file content for delta: %v", err.Error())
+		return 0, err
 	}
-	comp := bm.NewCompressor()
-	baseDict := &bm.Dictionary{Dict: basebuf.Bytes()}
-	// Use SetDictionary to set on compressor, this computes the hashes
-	comp.SetDictionary(baseDict)
-	// Set the delta buffer as the output
-	comp.SetWriter(out)
-
-	// Now we read all the targetsha's content and copy it into the compressor
-	targetinfo, err := getLOBInfoInBaseDir(targetsha, basedir)
+	target, err := r.getLOBContentInBaseDir(basedir, targetsha)
 	if err != nil {
 		return 0, err
 	}
-	var targetbytesread int64
-	for i := 0; i < targetinfo.NumChunks; i++ {
-		chunkfile := filepath.Join(basedir, GetLOBChunkRelativePath(targetsha, i))
-		cf, err := os.OpenFile(chunkfile, os.O_RDONLY, 0644)
-		if err != nil {
-			return 0, err
-		}
-		defer cf.Close()
-		n, err := io.Copy(comp, cf)
-		if err != nil {
-			return 0, fmt.Errorf("Error while copying data from target into compressor: %v", err.Error())
-		}
-		targetbytesread += n
-	}
-	if targetbytesread != targetinfo.Size {
-		return 0, fmt.Errorf("Incorrect number of bytes read for target file - expected %d actual %d", targetinfo.Size, targetbytesread)
-	}
+	return alg.Generate(base, target, out)
+}
 
-	// Now do the actual compression
-	// Maybe we can improve bm later so that it does it on the fly (less memory)
-	err = comp.Close()
-	if err != nil {
-		return 0, fmt.Errorf("Error during compression of delta: %v", err.Error())
-	}
-	// This has been written to out now so we're done
+// How often progress is reported when verifying content
+const verifyProgressBlockSize = 16 * 1024 * 1024
 
-	return int64(comp.CompressedSize()), nil
-}
+// Callback reporting progress through a phase of processing a LOB which isn't a transfer
+// (util.ProgressApplyingDelta, util.ProgressVerifying etc)
+type LOBPhaseCallback func(phase util.ProgressCallbackType, bytesDone, totalBytes int64)
 
 // Applies a diff to basesha and generates a LOB, with a specified root storage,
 // which should have targetsha (will be checked, error returned if disagrees)
-func ApplyLOBDeltaInBaseDir(basedir, basesha, targetsha string, delta io.Reader) error {
-	// Read all of base file into memory to use as dictionary (pre-size from info)
-	baseinfo, err := getLOBInfoInBaseDir(basesha, basedir)
-	basebuf := bytes.NewBuffer(make([]byte, 0, baseinfo.Size))
+func (r *Repo) ApplyLOBDeltaInBaseDir(basedir, basesha, targetsha string, delta io.Reader) error {
+	return r.ApplyLOBDeltaInBaseDirWithProgress(basedir, basesha, targetsha, delta, nil)
+}
+
+// As ApplyLOBDeltaInBaseDir, but also reports progress through applying the delta & verifying the
+// result to callback (if not nil). Applying the delta is reported against the size of the base.
+func (r *Repo) ApplyLOBDeltaInBaseDirWithProgress(basedir, basesha, targetsha string, delta io.Reader, callback LOBPhaseCallback) error {
+	return r.ApplyLOBDeltaInBaseDirWithAlgorithm(basedir, DeltaAlgorithmBM, basesha, targetsha, delta, callback)
+}
+
+// As ApplyLOBDeltaInBaseDirWithProgress, for a delta generated with a given algorithm
+func (r *Repo) ApplyLOBDeltaInBaseDirWithAlgorithm(basedir, algorithm, basesha, targetsha string, delta io.Reader, callback LOBPhaseCallback) error {
+	alg, err := GetDeltaAlgorithm(algorithm)
 	if err != nil {
 		return err
 	}
-	err = GetLOBCompleteContentInBaseDir(basedir, basesha, basebuf)
+	baseinfo, err := r.getLOBInfoInBaseDir(basesha, basedir)
+	if err != nil {
+		return err
+	}
+	reportPhase := func(phase util.ProgressCallbackType, bytesDone, totalBytes int64) {
+		// Empty content is instant, and phases need a size to report completion
+		if callback != nil && totalBytes > 0 {
+			callback(phase, bytesDone, totalBytes)
+		}
+	}
+	reportPhase(util.ProgressApplyingDelta, 0, baseinfo.Size)
+	// Base content is chunked (& maybe compressed) so extract it to a temp file to copy
+	// ranges from, rather than holding it all in memory
+	basef, err := (&LOBContent{repo: r, basedir: basedir, info: baseinfo}).CopyToTempFile()
 	if err != nil {
 		return fmt.Errorf("Error getting base file content for delta: %v", err.Error())
 	}
-
-	exp := bm.NewExpander(delta, basebuf.Bytes())
+	defer os.Remove(basef.Name())
+	defer basef.Close()
 
 	// output result to temp file
 	outf, err := ioutil.TempFile("", fmt.Sprintf("tempdelta%v_%v", basesha, targetsha))
 	if err != nil {
 		return fmt.Errorf("Error opening temp file for writing: %v\n", err)
 	}
-	defer outf.Close()
 	defer os.Remove(outf.Name()) // always remove temp file if not moved
-
-	// bm.Expander claims to support io.Reader but it doesn't
-	// so can't use the same io.Copy approach we use for Compressor
-	// Probably because it doesn't currently implement the buffering required to support arbitrary Read() calls
-	// Do it all in memory right now - we should probably enhance bm to make this more efficient
-	// Reading the code, the input to Expand is the current slice if you want it
-	// good to pre-allocate some space here, estimate same size as base
-	outbytes, err := exp.Expand(make([]byte, 0, basebuf.Len()))
+	defer outf.Close()
+	bufout := bufio.NewWriter(outf)
+	outsize, err := alg.Apply(basef, baseinfo.Size, delta, bufout)
+	if err == nil {
+		err = bufout.Flush()
+	}
 	if err != nil {
 		return fmt.Errorf("Error applying LOB delta: %v", err)
 	}
-	// Check the SHA
-	shacalc := sha1.New()
-	shacalc.Write(outbytes)
+	reportPhase(util.ProgressApplyingDelta, baseinfo.Size, baseinfo.Size)
+	// Check the SHA, reporting progress since this can take a while for big files
+	shacalc := NewLOBHashForSHA(targetsha)
+	_, err = outf.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return fmt.Errorf("Error reading applied LOB delta: %v", err)
+	}
+	reportPhase(util.ProgressVerifying, 0, outsize)
+	for done := int64(0); done < outsize; {
+		n := outsize - done
+		if n > verifyProgressBlockSize {
+			n = verifyProgressBlockSize
+		}
+		_, err = io.CopyN(shacalc, outf, n)
+		if err != nil {
+			return fmt.Errorf("Error reading applied LOB delta: %v", err)
+		}
+		done += n
+		reportPhase(util.ProgressVerifying, done, outsize)
+	}
 	testsha := fmt.Sprintf("%x", string(shacalc.Sum(nil)))
 	if testsha != targetsha {
 		return fmt.Errorf("Integrity error applying delta, SHA does not agree (expected: %v actual %v)", targetsha, testsha)
 	}
 	// Otherwise, we're good. Store this data
-	targetinfo, err := StoreLOBInBaseDir(basedir, bytes.NewReader(outbytes), nil)
+	_, err = outf.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return fmt.Errorf("Error reading applied LOB delta: %v", err)
+	}
+	targetinfo, err := r.storeLOBInBaseDirWithSettings(basedir, bufio.NewReader(outf), nil, GetLOBSHAAlgorithm(targetsha))
 	if err != nil {
 		return fmt.Errorf("Error storing target LOB %v: %v", targetsha, err.Error())
 	} else if targetinfo.SHA != targetsha {
@@ -985,4 +1326,6 @@ type LOBDelta struct {
 	DeltaSize          int64
 	// Optional already present delta filename, can be blank
 	DeltaFilename string
+	// Delta algorithm the delta is generated with (DeltaAlgorithmBM etc)
+	Algorithm string
 }
@@ -1,12 +1,15 @@
 package core
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
@@ -131,6 +134,7 @@ var _ = Describe("Storage", func() {
 					}
 					testgitdir := GetGitDir()
 					Expect(testgitdir).To(Equal(gitdir))
+					Expect(IsBareRepo()).To(BeFalse())
 				}
 			})
 
@@ -179,6 +183,42 @@ var _ = Describe("Storage", func() {
 			})
 
 		})
+
+		Context("Bare git repo", func() {
+			var oldwd string
+			BeforeEach(func() {
+				oldwd, _ = os.Getwd()
+				CreateBareGitRepoForTest(root)
+			})
+
+			AfterEach(func() {
+				os.Chdir(oldwd)
+				err := ForceRemoveAll(root)
+				if err != nil {
+					Fail(err.Error())
+				}
+			})
+
+			It("uses the repo folder as git dir & stores binaries in it", func() {
+				gitdir, _ := filepath.EvalSymlinks(root)
+
+				for _, f := range []string{root, filepath.Join(root, "refs", "heads")} {
+					err := os.Chdir(f)
+					if err != nil {
+						Fail(fmt.Sprintf("Can't chdir to %v: %v", f, err))
+					}
+					Expect(GetGitDir()).To(Equal(gitdir))
+					Expect(IsBareRepo()).To(BeTrue(), "Should detect bare repo")
+				}
+
+				os.Chdir(root)
+				info, err := testRepo().StoreLOB(bytes.NewReader([]byte("Bare repo content")), []byte(""))
+				Expect(err).To(BeNil(), "Should be able to store in a bare repo")
+				Expect(testRepo().GetLocalLOBRoot()).To(Equal(filepath.Join(gitdir, "git-lob", "content")))
+				CheckLOBsExistForTest([]string{info.SHA}, testRepo().GetLocalLOBRoot())
+			})
+
+		})
 	})
 
 	Describe("Storing a LOB", func() {
@@ -230,10 +270,10 @@ var _ = Describe("Storage", func() {
 				if err != nil {
 					Fail(fmt.Sprintf("Can't read leader of test file %v: %v", testFileName, err))
 				}
-				lobinfo, err := StoreLOB(f, leader[:c])
+				lobinfo, err := testRepo().StoreLOB(f, leader[:c])
 				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
 				Expect(lobinfo).To(Equal(correctLOBInfo))
-				fileinfo, err := os.Stat(GetLocalLOBChunkPath(lobinfo.SHA, 0))
+				fileinfo, err := os.Stat(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, 0))
 				Expect(err).To(BeNil(), "Shouldn't be error opening stored LOB")
 				Expect(fileinfo.Size()).To(Equal(lobinfo.Size), "Stored LOB should be correct size")
 			})
@@ -257,7 +297,7 @@ var _ = Describe("Storage", func() {
 				// Need TRY to read leader for consistency with real usage
 				leader := make([]byte, SHALineLen)
 				c, err := f.Read(leader)
-				lobinfo, err := StoreLOB(f, leader[:c])
+				lobinfo, err := testRepo().StoreLOB(f, leader[:c])
 				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
 				Expect(lobinfo.Size).To(BeEquivalentTo(0), "Size should be correct")
 				Expect(lobinfo.NumChunks).To(BeEquivalentTo(0), "Should only be one chunk")
@@ -299,11 +339,11 @@ var _ = Describe("Storage", func() {
 				if err != nil {
 					Fail(fmt.Sprintf("Can't read leader of test file %v: %v", exact1, err))
 				}
-				lobinfo, err := StoreLOB(f, leader[:c])
+				lobinfo, err := testRepo().StoreLOB(f, leader[:c])
 				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
 				Expect(lobinfo.Size).To(BeEquivalentTo(ChunkSize), "Size should be correct")
 				Expect(lobinfo.NumChunks).To(BeEquivalentTo(1), "Should only be one chunk")
-				fileinfo, err := os.Stat(GetLocalLOBChunkPath(lobinfo.SHA, 0))
+				fileinfo, err := os.Stat(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, 0))
 				Expect(err).To(BeNil(), "Shouldn't be error opening stored LOB")
 				Expect(fileinfo.Size()).To(Equal(lobinfo.Size), "Stored LOB should be correct size")
 
@@ -318,14 +358,14 @@ var _ = Describe("Storage", func() {
 				if err != nil {
 					Fail(fmt.Sprintf("Can't read leader of test file %v: %v", exact2, err))
 				}
-				lobinfo, err = StoreLOB(f2, leader[:c])
+				lobinfo, err = testRepo().StoreLOB(f2, leader[:c])
 				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
 				Expect(lobinfo.Size).To(BeEquivalentTo(ChunkSize*2), "Size should be correct")
 				Expect(lobinfo.NumChunks).To(BeEquivalentTo(2), "Should be 2 chunks")
-				fileinfo, err = os.Stat(GetLocalLOBChunkPath(lobinfo.SHA, 0))
+				fileinfo, err = os.Stat(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, 0))
 				Expect(err).To(BeNil(), "Shouldn't be error opening stored LOB")
 				Expect(fileinfo.Size()).To(Equal(ChunkSize), "Stored LOB should be correct size")
-				fileinfo, err = os.Stat(GetLocalLOBChunkPath(lobinfo.SHA, 1))
+				fileinfo, err = os.Stat(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, 1))
 				Expect(err).To(BeNil(), "Shouldn't be error opening stored LOB")
 				Expect(fileinfo.Size()).To(Equal(ChunkSize), "Stored LOB should be correct size")
 
@@ -333,6 +373,64 @@ var _ = Describe("Storage", func() {
 
 		})
 
+		Context("Store LOB with a custom chunk size", func() {
+			testFileName := path.Join(folders[1], "customchunks.dat")
+			var content []byte
+			BeforeEach(func() {
+				CreateRandomFileForTest(1000, testFileName)
+				content, _ = ioutil.ReadFile(testFileName)
+				GlobalOptions.ChunkSize = 300
+			})
+			AfterEach(func() {
+				os.Remove(testFileName)
+				GlobalOptions.ChunkSize = 0
+			})
+
+			It("records the chunk size & reads it back", func() {
+				lobinfo, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
+				Expect(lobinfo.Version).To(Equal(LOBInfoVersionFixedChunkSize), "Non-default chunk size needs newer format")
+				Expect(lobinfo.ChunkSize).To(BeEquivalentTo(300))
+				Expect(lobinfo.NumChunks).To(Equal(4))
+				for i, sz := range []int64{300, 300, 300, 100} {
+					fileinfo, err := os.Stat(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, i))
+					Expect(err).To(BeNil(), "Shouldn't be error opening stored LOB #%v", i)
+					Expect(fileinfo.Size()).To(Equal(sz), "Stored LOB #%v should be correct size", i)
+				}
+				Expect(testRepo().CheckLOBFilesForSHA(lobinfo.SHA, testRepo().GetLocalLOBRoot(), true)).To(BeNil(), "Should pass deep check")
+				var buf bytes.Buffer
+				_, err = testRepo().RetrieveLOB(lobinfo.SHA, &buf)
+				Expect(err).To(BeNil())
+				Expect(buf.Bytes()).To(Equal(content), "Should retrieve original content")
+
+				// Default size from now on, but the complete binary is kept as it was
+				GlobalOptions.ChunkSize = 0
+				info2, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+				Expect(err).To(BeNil())
+				Expect(info2.ChunkSize).To(BeEquivalentTo(300), "Existing storage should be kept")
+
+				// Incomplete, so re-stored with the default size & old chunks removed
+				os.Remove(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, 3))
+				info2, err = testRepo().StoreLOB(bytes.NewReader(content), nil)
+				Expect(err).To(BeNil())
+				Expect(info2.Version).To(Equal(LOBInfoVersionFixedChunks))
+				Expect(info2.NumChunks).To(Equal(1))
+				Expect(FileExists(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, 1))).To(BeFalse(), "Old chunks should be removed")
+				Expect(testRepo().CheckLOBFilesForSHA(lobinfo.SHA, testRepo().GetLocalLOBRoot(), true)).To(BeNil(), "Should pass deep check")
+			})
+
+			It("detects inconsistent chunk sizes in metadata", func() {
+				lobinfo, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+				Expect(err).To(BeNil())
+				badinfo := *lobinfo
+				badinfo.ChunkSize = 200
+				Expect(testRepo().StoreLOBInfoInBaseDir(testRepo().GetLocalLOBRoot(), &badinfo)).To(BeNil())
+				err = testRepo().CheckLOBFilesForSHA(lobinfo.SHA, testRepo().GetLocalLOBRoot(), false)
+				Expect(IsIntegrityError(err)).To(BeTrue(), "Metadata should be corrupt")
+				Expect(err.Error()).To(ContainSubstring("lists 4 chunks, expected 5"))
+			})
+		})
+
 		Context("Store large multiple chunk LOB [LONGTEST]", func() {
 
 			testFileName := path.Join(folders[2], "large.dat")
@@ -357,11 +455,11 @@ var _ = Describe("Storage", func() {
 				if err != nil {
 					Fail(fmt.Sprintf("Can't read leader of test file %v: %v", testFileName, err))
 				}
-				lobinfo, err := StoreLOB(f, leader[:c])
+				lobinfo, err := testRepo().StoreLOB(f, leader[:c])
 				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
 				Expect(lobinfo).To(Equal(correctLOBInfo))
 				for i := 0; i < lobinfo.NumChunks; i++ {
-					fileinfo, err := os.Stat(GetLocalLOBChunkPath(lobinfo.SHA, i))
+					fileinfo, err := os.Stat(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, i))
 					Expect(err).To(BeNil(), "Shouldn't be error opening stored LOB #%v", i)
 					if i+1 < lobinfo.NumChunks {
 						Expect(fileinfo.Size()).To(BeEquivalentTo(ChunkSize), "Stored LOB #%v should be chunk limit size", i)
@@ -374,6 +472,175 @@ var _ = Describe("Storage", func() {
 
 		})
 
+		Context("Store compressed LOB", func() {
+			var oldChunkSize, oldFrameSize int64
+			var data []byte
+
+			BeforeEach(func() {
+				oldChunkSize = ChunkSize
+				oldFrameSize = CompressionFrameSize
+				ChunkSize = 2000
+				CompressionFrameSize = 300
+				// Compressible but not trivially repeating content
+				var buf bytes.Buffer
+				for i := 0; buf.Len() < 5500; i++ {
+					fmt.Fprintf(&buf, "line %d of some compressible test content\n", i)
+				}
+				data = buf.Bytes()[:5500]
+			})
+			AfterEach(func() {
+				ChunkSize = oldChunkSize
+				CompressionFrameSize = oldFrameSize
+			})
+
+			It("stores chunks as seekable frames & retrieves arbitrary ranges", func() {
+				lobinfo, err := testRepo().StoreLOBInBaseDirWithCompression(testRepo().GetLocalLOBRoot(), bytes.NewReader(data), nil, CompressionZstd)
+				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
+				Expect(lobinfo.SHA).To(Equal(fmt.Sprintf("%x", sha1.Sum(data))), "SHA should be of uncompressed content")
+				Expect(lobinfo.Size).To(BeEquivalentTo(5500), "Size should be uncompressed size")
+				Expect(lobinfo.NumChunks).To(Equal(3), "Should be chunked on uncompressed size")
+				Expect(lobinfo.Compression).To(Equal(CompressionZstd), "Codec should be recorded")
+				Expect(lobinfo.FrameSize).To(BeEquivalentTo(300), "Frame size should be recorded")
+				Expect(lobinfo.Frames).To(HaveLen(3), "Should be a seek index for each chunk")
+				Expect(lobinfo.Frames[0]).To(HaveLen(7), "Full chunk should have 7 frames")
+				Expect(lobinfo.Frames[2]).To(HaveLen(5), "Last chunk should have 5 frames")
+				var storedTotal int64
+				for i := 0; i < lobinfo.NumChunks; i++ {
+					fileinfo, err := os.Stat(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, i))
+					Expect(err).To(BeNil(), "Shouldn't be error opening stored chunk #%v", i)
+					var expectedSize int64
+					for _, sz := range lobinfo.Frames[i] {
+						expectedSize += sz
+					}
+					Expect(fileinfo.Size()).To(Equal(expectedSize), "Chunk #%v should be the sum of its frames", i)
+					storedTotal += fileinfo.Size()
+				}
+				Expect(storedTotal).To(BeNumerically("<", lobinfo.Size), "Content should have been compressed")
+
+				storedinfo, err := testRepo().GetLOBInfo(lobinfo.SHA)
+				Expect(err).To(BeNil(), "Shouldn't be error reading stored metadata")
+				Expect(storedinfo).To(Equal(lobinfo), "Seek index should round-trip through metadata")
+
+				var out bytes.Buffer
+				_, err = testRepo().RetrieveLOB(lobinfo.SHA, &out)
+				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB")
+				Expect(out.Bytes()).To(Equal(data), "Retrieved content should match original")
+
+				// Ranges within a frame, across frames and across chunks
+				ranges := [][]int64{{0, 10}, {5, 300}, {299, 2}, {1990, 20}, {1234, 3000}, {5400, 100}, {5500, 0}}
+				for _, r := range ranges {
+					out.Reset()
+					_, err = testRepo().RetrieveLOBRange(lobinfo.SHA, r[0], r[1], &out)
+					Expect(err).To(BeNil(), "Shouldn't be error retrieving range %v", r)
+					Expect(out.Bytes()).To(Equal(data[r[0]:r[0]+r[1]]), "Range %v should match original", r)
+				}
+				_, err = testRepo().RetrieveLOBRange(lobinfo.SHA, 5000, 501, &out)
+				Expect(err).ToNot(BeNil(), "Range past end of LOB should be an error")
+
+				err = testRepo().CheckLOBFilesForSHA(lobinfo.SHA, testRepo().GetLocalLOBRoot(), true)
+				Expect(err).To(BeNil(), "Deep check of compressed LOB should pass")
+
+				// Corrupt a byte in the middle chunk without changing its size
+				chunk1 := testRepo().GetLocalLOBChunkPath(lobinfo.SHA, 1)
+				chunkdata, err := ioutil.ReadFile(chunk1)
+				Expect(err).To(BeNil())
+				chunkdata[len(chunkdata)/2] ^= 0xff
+				Expect(ioutil.WriteFile(chunk1, chunkdata, 0644)).To(BeNil())
+
+				err = testRepo().CheckLOBFilesForSHA(lobinfo.SHA, testRepo().GetLocalLOBRoot(), false)
+				Expect(err).To(BeNil(), "Shallow check only checks sizes")
+				err = testRepo().CheckLOBFilesForSHA(lobinfo.SHA, testRepo().GetLocalLOBRoot(), true)
+				Expect(err).ToNot(BeNil(), "Deep check should detect corruption")
+				Expect(IsIntegrityError(err)).To(BeTrue(), "Corruption should be reported as integrity error")
+				// Ranges outside the corrupt chunk can still be read
+				out.Reset()
+				_, err = testRepo().RetrieveLOBRange(lobinfo.SHA, 100, 1500, &out)
+				Expect(err).To(BeNil(), "Shouldn't be error retrieving range from intact chunk")
+				Expect(out.Bytes()).To(Equal(data[100:1600]), "Range from intact chunk should match original")
+			})
+
+			It("reports progress retrieving multi-chunk LOBs", func() {
+				lobinfo, err := testRepo().StoreLOBInBaseDirWithCompression(testRepo().GetLocalLOBRoot(), bytes.NewReader(data), nil, CompressionNone)
+				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
+				Expect(lobinfo.NumChunks).To(Equal(3))
+
+				var progress []int64
+				callback := func(data *ProgressCallbackData) (abort bool) {
+					Expect(data.Type).To(Equal(ProgressTransferBytes))
+					Expect(data.Desc).To(Equal(lobinfo.SHA))
+					Expect(data.ItemBytes).To(Equal(lobinfo.Size))
+					progress = append(progress, data.ItemBytesDone)
+					return false
+				}
+				var out bytes.Buffer
+				_, err = testRepo().RetrieveLOBWithProgress(lobinfo.SHA, &out, callback)
+				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB")
+				Expect(out.Bytes()).To(Equal(data), "Retrieved content should match original")
+				Expect(len(progress)).To(BeNumerically(">=", 4), "Should report start & each chunk")
+				Expect(progress[0]).To(BeEquivalentTo(0), "Should report start")
+				Expect(progress[len(progress)-1]).To(Equal(lobinfo.Size), "Should report completion")
+				for i := 1; i < len(progress); i++ {
+					Expect(progress[i]).To(BeNumerically(">=", progress[i-1]), "Progress should not go backwards")
+				}
+
+				// Aborting stops the content
+				out.Reset()
+				_, err = testRepo().RetrieveLOBWithProgress(lobinfo.SHA, &out, func(data *ProgressCallbackData) (abort bool) {
+					return data.ItemBytesDone > 0
+				})
+				Expect(err).ToNot(BeNil(), "Aborting should be an error")
+				Expect(int64(out.Len())).To(BeNumerically("<", lobinfo.Size), "Should stop writing content when aborted")
+			})
+
+			It("stores with gzip & according to git-lob.compression", func() {
+				oldCompression := GlobalOptions.Compression
+				defer func() { GlobalOptions.Compression = oldCompression }()
+				GlobalOptions.Compression = CompressionGzip
+
+				lobinfo, err := testRepo().StoreLOB(bytes.NewReader(data), nil)
+				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
+				Expect(lobinfo.Compression).To(Equal(CompressionGzip), "Codec should come from config")
+				Expect(getLOBStoredSize(lobinfo)).To(BeNumerically("<", lobinfo.Size), "Content should have been compressed")
+				var out bytes.Buffer
+				_, err = testRepo().RetrieveLOB(lobinfo.SHA, &out)
+				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB")
+				Expect(out.Bytes()).To(Equal(data), "Retrieved content should match original")
+				out.Reset()
+				_, err = testRepo().RetrieveLOBRange(lobinfo.SHA, 1990, 1000, &out)
+				Expect(err).To(BeNil(), "Shouldn't be error retrieving range")
+				Expect(out.Bytes()).To(Equal(data[1990:2990]), "Range should match original")
+				err = testRepo().CheckLOBFilesForSHA(lobinfo.SHA, testRepo().GetLocalLOBRoot(), true)
+				Expect(err).To(BeNil(), "Deep check of gzip LOB should pass")
+			})
+
+			It("handles LOBs already stored with a different codec", func() {
+				zinfo, err := testRepo().StoreLOBInBaseDirWithCompression(testRepo().GetLocalLOBRoot(), bytes.NewReader(data), nil, CompressionZstd)
+				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
+
+				// Complete copy is kept as-is whatever the codec now is
+				info, err := testRepo().StoreLOBInBaseDirWithCompression(testRepo().GetLocalLOBRoot(), bytes.NewReader(data), nil, CompressionNone)
+				Expect(err).To(BeNil(), "Shouldn't be error re-storing LOB")
+				Expect(info).To(Equal(zinfo), "Existing complete LOB should be kept")
+				storedinfo, _ := testRepo().GetLOBInfo(zinfo.SHA)
+				Expect(storedinfo).To(Equal(zinfo), "Metadata should be unchanged")
+				Expect(testRepo().CheckLOBFilesForSHA(zinfo.SHA, testRepo().GetLocalLOBRoot(), true)).To(BeNil(), "Existing LOB should be intact")
+
+				// Incomplete copy is replaced entirely
+				Expect(os.Remove(testRepo().GetLocalLOBChunkPath(zinfo.SHA, 2))).To(BeNil())
+				info, err = testRepo().StoreLOBInBaseDirWithCompression(testRepo().GetLocalLOBRoot(), bytes.NewReader(data), nil, CompressionGzip)
+				Expect(err).To(BeNil(), "Shouldn't be error re-storing LOB")
+				Expect(info.Compression).To(Equal(CompressionGzip), "Incomplete LOB should be re-stored with new codec")
+				storedinfo, _ = testRepo().GetLOBInfo(zinfo.SHA)
+				Expect(storedinfo).To(Equal(info), "Metadata should have been replaced")
+				Expect(testRepo().CheckLOBFilesForSHA(zinfo.SHA, testRepo().GetLocalLOBRoot(), true)).To(BeNil(), "Re-stored LOB should be intact")
+				var out bytes.Buffer
+				_, err = testRepo().RetrieveLOB(zinfo.SHA, &out)
+				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB")
+				Expect(out.Bytes()).To(Equal(data), "Retrieved content should match original")
+			})
+
+		})
+
 	})
 
 	Describe("Retrieving a LOB", func() {
@@ -415,7 +682,7 @@ var _ = Describe("Storage", func() {
 				out, err := ioutil.TempFile("", "lobsmall.dat")
 				Expect(err).To(BeNil(), "Shouldn't be error creating temp file")
 				outFilename := out.Name()
-				info, err := RetrieveLOB(correctLOBInfo.SHA, out)
+				info, err := testRepo().RetrieveLOB(correctLOBInfo.SHA, out)
 
 				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB")
 				out.Close()
@@ -443,7 +710,7 @@ var _ = Describe("Storage", func() {
 				out, err := ioutil.TempFile("", "loblarge.dat")
 				Expect(err).To(BeNil(), "Shouldn't be error creating temp file")
 				outFilename := out.Name()
-				info, err := RetrieveLOB(correctLOBInfo.SHA, out)
+				info, err := testRepo().RetrieveLOB(correctLOBInfo.SHA, out)
 
 				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB")
 				out.Close()
@@ -479,7 +746,7 @@ var _ = Describe("Storage", func() {
 				out, err := ioutil.TempFile("", "lobzerotest.dat")
 				Expect(err).To(BeNil(), "Shouldn't be error creating temp file")
 				outFilename := out.Name()
-				info, err := RetrieveLOB(shaZeroStr, out)
+				info, err := testRepo().RetrieveLOB(shaZeroStr, out)
 
 				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB")
 				out.Close()
@@ -557,26 +824,26 @@ var _ = Describe("Storage", func() {
 				if err != nil {
 					Fail(fmt.Sprintf("Can't read leader of test file %v: %v", testFileName, err))
 				}
-				lobinfo, err := StoreLOB(f, leader[:c])
+				lobinfo, err := testRepo().StoreLOB(f, leader[:c])
 				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
 				Expect(lobinfo).To(Equal(correctLOBInfo))
 
-				lobinfo, err = GetLOBInfo(correctLOBInfo.SHA)
+				lobinfo, err = testRepo().GetLOBInfo(correctLOBInfo.SHA)
 				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB info")
 				Expect(lobinfo).To(Equal(correctLOBInfo))
 
-				fileinfo, err := os.Stat(GetLocalLOBChunkPath(lobinfo.SHA, 0))
+				fileinfo, err := os.Stat(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, 0))
 				Expect(err).To(BeNil(), "Shouldn't be error opening stored LOB (local)")
 				Expect(fileinfo.Size()).To(Equal(lobinfo.Size), "Stored LOB should be correct size (local)")
 				// Also test shared
-				fileinfo, err = os.Stat(GetSharedLOBChunkPath(lobinfo.SHA, 0))
+				fileinfo, err = os.Stat(testRepo().GetSharedLOBChunkPath(lobinfo.SHA, 0))
 				Expect(err).To(BeNil(), "Shouldn't be error opening stored LOB (shared)")
 				Expect(fileinfo.Size()).To(Equal(lobinfo.Size), "Stored LOB should be correct size (shared)")
 
-				links, err := GetHardLinkCount(GetLocalLOBChunkPath(lobinfo.SHA, 0))
+				links, err := GetHardLinkCount(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, 0))
 				Expect(err).To(BeNil(), "Shouldn't be error getting local LOB hard link info")
 				Expect(links).To(Equal(2), "Should be the right number of hard links (shared)")
-				links, err = GetHardLinkCount(GetSharedLOBChunkPath(lobinfo.SHA, 0))
+				links, err = GetHardLinkCount(testRepo().GetSharedLOBChunkPath(lobinfo.SHA, 0))
 				Expect(err).To(BeNil(), "Shouldn't be error getting shared LOB hard link info")
 				Expect(links).To(Equal(2), "Should be the right number of hard links (local)")
 			})
@@ -607,15 +874,15 @@ var _ = Describe("Storage", func() {
 				if err != nil {
 					Fail(fmt.Sprintf("Can't read leader of test file %v: %v", testFileName, err))
 				}
-				lobinfo, err := StoreLOB(f, leader[:c])
+				lobinfo, err := testRepo().StoreLOB(f, leader[:c])
 				Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
 				Expect(lobinfo).To(Equal(correctLOBInfo))
-				lobinfo, err = GetLOBInfo(correctLOBInfo.SHA)
+				lobinfo, err = testRepo().GetLOBInfo(correctLOBInfo.SHA)
 				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB info")
 				Expect(lobinfo).To(Equal(correctLOBInfo))
 
 				for i := 0; i < lobinfo.NumChunks; i++ {
-					fileinfo, err := os.Stat(GetLocalLOBChunkPath(lobinfo.SHA, i))
+					fileinfo, err := os.Stat(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, i))
 					Expect(err).To(BeNil(), "Shouldn't be error opening stored LOB #%v", i)
 					if i+1 < lobinfo.NumChunks {
 						Expect(fileinfo.Size()).To(BeEquivalentTo(ChunkSize), "Stored LOB #%v should be chunk limit size", i)
@@ -623,17 +890,17 @@ var _ = Describe("Storage", func() {
 						Expect(fileinfo.Size()).To(BeEquivalentTo(lobinfo.Size%ChunkSize), "Stored LOB #%v should be correct size", i)
 					}
 					// Also check shared
-					fileinfo, err = os.Stat(GetSharedLOBChunkPath(lobinfo.SHA, i))
+					fileinfo, err = os.Stat(testRepo().GetSharedLOBChunkPath(lobinfo.SHA, i))
 					Expect(err).To(BeNil(), "Shouldn't be error opening stored LOB #%v", i)
 					if i+1 < lobinfo.NumChunks {
 						Expect(fileinfo.Size()).To(BeEquivalentTo(ChunkSize), "Stored LOB #%v should be chunk limit size", i)
 					} else {
 						Expect(fileinfo.Size()).To(BeEquivalentTo(lobinfo.Size%ChunkSize), "Stored LOB #%v should be correct size", i)
 					}
-					links, err := GetHardLinkCount(GetLocalLOBChunkPath(lobinfo.SHA, i))
+					links, err := GetHardLinkCount(testRepo().GetLocalLOBChunkPath(lobinfo.SHA, i))
 					Expect(err).To(BeNil(), "Shouldn't be error getting local LOB hard link info")
 					Expect(links).To(Equal(2), "Should be the right number of hard links (shared)")
-					links, err = GetHardLinkCount(GetSharedLOBChunkPath(lobinfo.SHA, i))
+					links, err = GetHardLinkCount(testRepo().GetSharedLOBChunkPath(lobinfo.SHA, i))
 					Expect(err).To(BeNil(), "Shouldn't be error getting shared LOB hard link info")
 					Expect(links).To(Equal(2), "Should be the right number of hard links (local)")
 
@@ -690,7 +957,7 @@ var _ = Describe("Storage", func() {
 				out, err := ioutil.TempFile("", "lobsmall.dat")
 				Expect(err).To(BeNil(), "Shouldn't be error creating temp file")
 				outFilename := out.Name()
-				info, err := RetrieveLOB(correctLOBInfo.SHA, out)
+				info, err := testRepo().RetrieveLOB(correctLOBInfo.SHA, out)
 
 				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB")
 				out.Close()
@@ -718,7 +985,7 @@ var _ = Describe("Storage", func() {
 				out, err := ioutil.TempFile("", "loblarge.dat")
 				Expect(err).To(BeNil(), "Shouldn't be error creating temp file")
 				outFilename := out.Name()
-				info, err := RetrieveLOB(correctLOBInfo.SHA, out)
+				info, err := testRepo().RetrieveLOB(correctLOBInfo.SHA, out)
 
 				Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB")
 				out.Close()
@@ -801,9 +1068,9 @@ var _ = Describe("Storage", func() {
 
 		It("Shallow checks LOB files", func() {
 			// Initial test, everything should validate (just use check)
-			basedir := GetLocalLOBRoot()
+			basedir := testRepo().GetLocalLOBRoot()
 			for _, li := range lobinfos {
-				files, sz, err := GetLOBFilesForSHA(li.SHA, basedir, true, false)
+				files, sz, err := testRepo().GetLOBFilesForSHA(li.SHA, basedir, true, false)
 				Expect(err).To(BeNil(), "Should be no error when checking LOB file for %v", li.SHA)
 				Expect(files).To(HaveLen(li.NumChunks+1), "Should have the right number of files")
 				Expect(sz).To(BeEquivalentTo(li.Size), "Total size should be correct")
@@ -812,64 +1079,64 @@ var _ = Describe("Storage", func() {
 			// Test for simple corruptions
 			// Remove a meta file
 			var err error
-			metafile := GetLocalLOBMetaPath(lobinfos[smallFileIdx[0]].SHA)
+			metafile := testRepo().GetLocalLOBMetaPath(lobinfos[smallFileIdx[0]].SHA)
 			os.Remove(metafile)
-			err = CheckLOBFilesForSHA(lobinfos[smallFileIdx[0]].SHA, basedir, false)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[smallFileIdx[0]].SHA, basedir, false)
 			Expect(err).ToNot(BeNil(), "Should detect missing meta file")
 
 			var chunkfile string
 			// Remove a chunk file (only one)
-			chunkfile = GetLocalLOBChunkPath(lobinfos[smallFileIdx[1]].SHA, 0)
+			chunkfile = testRepo().GetLocalLOBChunkPath(lobinfos[smallFileIdx[1]].SHA, 0)
 			os.Remove(chunkfile)
-			err = CheckLOBFilesForSHA(lobinfos[smallFileIdx[1]].SHA, basedir, false)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[smallFileIdx[1]].SHA, basedir, false)
 			Expect(err).ToNot(BeNil(), "Should detect missing chunk file for single-chunk file")
 			// Remove a chunk file (one of many - first)
-			chunkfile = GetLocalLOBChunkPath(lobinfos[midFileIdx[0]].SHA, 0)
+			chunkfile = testRepo().GetLocalLOBChunkPath(lobinfos[midFileIdx[0]].SHA, 0)
 			os.Remove(chunkfile)
-			err = CheckLOBFilesForSHA(lobinfos[midFileIdx[0]].SHA, basedir, false)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[midFileIdx[0]].SHA, basedir, false)
 			Expect(err).ToNot(BeNil(), "Should detect missing first chunk file for 2-chunk file")
 			// Remove a chunk file (one of many - last)
-			chunkfile = GetLocalLOBChunkPath(lobinfos[midFileIdx[1]].SHA, 1)
+			chunkfile = testRepo().GetLocalLOBChunkPath(lobinfos[midFileIdx[1]].SHA, 1)
 			os.Remove(chunkfile)
-			err = CheckLOBFilesForSHA(lobinfos[midFileIdx[1]].SHA, basedir, false)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[midFileIdx[1]].SHA, basedir, false)
 			Expect(err).ToNot(BeNil(), "Should detect missing second chunk file for 2-chunk file")
 
 			// Change the size of a chunk file (single chunk)
-			chunkfile = GetLocalLOBChunkPath(lobinfos[smallFileIdx[2]].SHA, 0)
+			chunkfile = testRepo().GetLocalLOBChunkPath(lobinfos[smallFileIdx[2]].SHA, 0)
 			f, _ := os.OpenFile(chunkfile, os.O_APPEND|os.O_RDWR, 0644)
 			f.Write([]byte("icorruptthee"))
 			f.Close()
-			err = CheckLOBFilesForSHA(lobinfos[smallFileIdx[2]].SHA, basedir, false)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[smallFileIdx[2]].SHA, basedir, false)
 			Expect(err).ToNot(BeNil(), "Should detect incorrect size chunk file for single-chunk file")
 			// Change the size of a chunk file (one of many - first)
-			chunkfile = GetLocalLOBChunkPath(lobinfos[midFileIdx[2]].SHA, 0)
+			chunkfile = testRepo().GetLocalLOBChunkPath(lobinfos[midFileIdx[2]].SHA, 0)
 			f, _ = os.OpenFile(chunkfile, os.O_APPEND|os.O_RDWR, 0644)
 			f.Write([]byte("hssss"))
 			f.Close()
-			err = CheckLOBFilesForSHA(lobinfos[midFileIdx[2]].SHA, basedir, false)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[midFileIdx[2]].SHA, basedir, false)
 			Expect(err).ToNot(BeNil(), "Should detect incorrect size chunk file for multi-chunk file (first)")
 			// Change the size of a chunk file (one of many - middle)
-			chunkfile = GetLocalLOBChunkPath(lobinfos[largeFileIdx[0]].SHA, 1)
+			chunkfile = testRepo().GetLocalLOBChunkPath(lobinfos[largeFileIdx[0]].SHA, 1)
 			f, _ = os.OpenFile(chunkfile, os.O_APPEND|os.O_RDWR, 0644)
 			f.Write([]byte("itburns"))
 			f.Close()
-			err = CheckLOBFilesForSHA(lobinfos[largeFileIdx[0]].SHA, basedir, false)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[largeFileIdx[0]].SHA, basedir, false)
 			Expect(err).ToNot(BeNil(), "Should detect incorrect size chunk file for multi-chunk file (middle)")
 			// Change the size of a chunk file (one of many - last)
-			chunkfile = GetLocalLOBChunkPath(lobinfos[largeFileIdx[1]].SHA, lobinfos[largeFileIdx[1]].NumChunks-1)
+			chunkfile = testRepo().GetLocalLOBChunkPath(lobinfos[largeFileIdx[1]].SHA, lobinfos[largeFileIdx[1]].NumChunks-1)
 			f, _ = os.OpenFile(chunkfile, os.O_APPEND|os.O_RDWR, 0644)
 			f.Write([]byte("ngggg"))
 			f.Close()
-			err = CheckLOBFilesForSHA(lobinfos[largeFileIdx[1]].SHA, basedir, false)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[largeFileIdx[1]].SHA, basedir, false)
 			Expect(err).ToNot(BeNil(), "Should detect incorrect size chunk file for multi-chunk file (last)")
 
 		})
 
 		It("Deep checks LOB files", func() {
 			// Initial test, everything should validate (just use check)
-			basedir := GetLocalLOBRoot()
+			basedir := testRepo().GetLocalLOBRoot()
 			for _, li := range lobinfos {
-				files, sz, err := GetLOBFilesForSHA(li.SHA, basedir, true, true)
+				files, sz, err := testRepo().GetLOBFilesForSHA(li.SHA, basedir, true, true)
 				Expect(err).To(BeNil(), "Should be no error when checking LOB file for %v", li.SHA)
 				Expect(files).To(HaveLen(li.NumChunks+1), "Should have the right number of files")
 				Expect(sz).To(BeEquivalentTo(li.Size), "Total size should be correct")
@@ -879,29 +1146,158 @@ var _ = Describe("Storage", func() {
 			var chunkfile string
 			var err error
 			// Change 2 bytes of a chunk file, size unchanged (single chunk)
-			chunkfile = GetLocalLOBChunkPath(lobinfos[smallFileIdx[0]].SHA, 0)
+			chunkfile = testRepo().GetLocalLOBChunkPath(lobinfos[smallFileIdx[0]].SHA, 0)
 			f, _ := os.OpenFile(chunkfile, os.O_RDWR|os.O_SYNC, 0644)
 			f.Seek(10, os.SEEK_SET)
 			f.Write([]byte("qq"))
 			f.Close()
 			// check that we wouldn't detect this without checking the SHA
-			err = CheckLOBFilesForSHA(lobinfos[smallFileIdx[0]].SHA, basedir, false)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[smallFileIdx[0]].SHA, basedir, false)
 			Expect(err).To(BeNil(), "Should not detect the corruption without deep hash check")
-			err = CheckLOBFilesForSHA(lobinfos[smallFileIdx[0]].SHA, basedir, true)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[smallFileIdx[0]].SHA, basedir, true)
 			Expect(err).ToNot(BeNil(), "Should detect the corruption with deep hash check")
 			// Change 2 bytes of a chunk file, size unchanged (multiple chunk)
-			chunkfile = GetLocalLOBChunkPath(lobinfos[midFileIdx[0]].SHA, 1)
+			chunkfile = testRepo().GetLocalLOBChunkPath(lobinfos[midFileIdx[0]].SHA, 1)
 			f, _ = os.OpenFile(chunkfile, os.O_RDWR|os.O_SYNC, 0644)
 			f.Seek(51, os.SEEK_SET)
 			f.Write([]byte("zf"))
 			f.Close()
-			err = CheckLOBFilesForSHA(lobinfos[midFileIdx[0]].SHA, basedir, false)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[midFileIdx[0]].SHA, basedir, false)
 			Expect(err).To(BeNil(), "Should not detect the corruption without deep hash check (second chunk)")
-			err = CheckLOBFilesForSHA(lobinfos[midFileIdx[0]].SHA, basedir, true)
+			err = testRepo().CheckLOBFilesForSHA(lobinfos[midFileIdx[0]].SHA, basedir, true)
 			Expect(err).ToNot(BeNil(), "Should detect the corruption with deep hash check (second chunk)")
 
 		})
 
 	})
 
+	Describe("Deltas", func() {
+		var origDir string
+		var savedChunkSize, savedWindowSize, savedZstdWindowSize int64
+		BeforeEach(func() {
+			CreateGitRepoForTest(root)
+			origDir, _ = os.Getwd()
+			os.Chdir(root)
+			// Small chunks & delta windows so that deltas span many of each
+			savedChunkSize = ChunkSize
+			ChunkSize = 16384
+			savedWindowSize = deltaWindowSize
+			deltaWindowSize = 20000
+			savedZstdWindowSize = zstdDeltaWindowSize
+			zstdDeltaWindowSize = 20000
+		})
+		AfterEach(func() {
+			os.Chdir(origDir)
+			err := ForceRemoveAll(root)
+			if err != nil {
+				Fail(err.Error())
+			}
+			ChunkSize = savedChunkSize
+			deltaWindowSize = savedWindowSize
+			zstdDeltaWindowSize = savedZstdWindowSize
+		})
+
+		It("Generates & applies deltas across windows with each algorithm", func() {
+			base := make([]byte, 100000)
+			rand.Read(base)
+			// Edit the middle, insert a little & grow it, so references move between windows
+			target := make([]byte, 0, 120000)
+			target = append(target, base[:30000]...)
+			target = append(target, []byte("Some new content in the middle")...)
+			target = append(target, base[30000:90000]...)
+			target = append(target, base[95000:]...)
+			extra := make([]byte, 15000)
+			rand.Read(extra)
+			target = append(target, extra...)
+
+			Expect(ioutil.WriteFile("base.bin", base, 0644)).To(BeNil())
+			Expect(ioutil.WriteFile("target.bin", target, 0644)).To(BeNil())
+			baseinfo, err := StoreLOBForTest("base.bin")
+			Expect(err).To(BeNil())
+			targetinfo, err := StoreLOBForTest("target.bin")
+			Expect(err).To(BeNil())
+
+			for _, alg := range GetAvailableDeltaAlgorithms() {
+				var delta bytes.Buffer
+				sz, err := testRepo().GenerateLOBDeltaWithAlgorithm(alg, baseinfo.SHA, targetinfo.SHA, &delta)
+				Expect(err).To(BeNil(), "Shouldn't fail to generate %v delta", alg)
+				Expect(sz).To(BeEquivalentTo(delta.Len()), "Should return the size of the %v delta", alg)
+				Expect(sz).To(BeNumerically("<", len(extra)+5000), "%v delta should only be about the size of the new content", alg)
+
+				Expect(testRepo().DeleteLOB(targetinfo.SHA)).To(BeNil())
+				var phases []ProgressCallbackType
+				err = testRepo().ApplyLOBDeltaInBaseDirWithAlgorithm(testRepo().GetLocalLOBRoot(), alg, baseinfo.SHA, targetinfo.SHA, &delta,
+					func(phase ProgressCallbackType, bytesDone, totalBytes int64) {
+						phases = append(phases, phase)
+					})
+				Expect(err).To(BeNil(), "Shouldn't fail to apply %v delta", alg)
+				Expect(phases).To(ContainElement(ProgressApplyingDelta))
+				Expect(phases).To(ContainElement(ProgressVerifying))
+				var content bytes.Buffer
+				Expect(testRepo().GetLOBCompleteContent(targetinfo.SHA, &content)).To(BeNil())
+				Expect(content.Bytes()).To(Equal(target), "Applied %v delta should recreate target", alg)
+			}
+			Expect(GetAvailableDeltaAlgorithms()).To(ContainElement(DeltaAlgorithmZstd), "zstd is built in")
+			_, err = GetDeltaAlgorithm("nonsense")
+			Expect(err).ToNot(BeNil(), "Unknown algorithms should fail")
+		})
+
+		It("Rejects deltas which reference outside the base", func() {
+			Expect(ioutil.WriteFile("base.bin", []byte("Base content"), 0644)).To(BeNil())
+			baseinfo, err := StoreLOBForTest("base.bin")
+			Expect(err).To(BeNil())
+			// Reference 10 bytes at offset 5
+			err = testRepo().ApplyLOBDelta(baseinfo.SHA, "0000000000000000000000000000000000000000", bytes.NewReader([]byte{0, 5, 10}))
+			Expect(err).ToNot(BeNil(), "Should fail to apply a delta outside the base")
+		})
+	})
+
+	Describe("Long paths", func() {
+		// Deeper than MAX_PATH (260 chars), which needs the extended-length form on Windows
+		longRoot := filepath.Join(os.TempDir(), "StorageLongPathTest")
+		deep := filepath.Join(longRoot, strings.Repeat("a_deeply_nested_folder"+string(filepath.Separator), 12))
+		repo := filepath.Join(deep, "repo")
+		longSharedStore := filepath.Join(deep, "shared")
+		var oldwd string
+		BeforeEach(func() {
+			oldwd, _ = os.Getwd()
+			Expect(os.MkdirAll(LongPath(repo), 0755)).To(BeNil())
+			Expect(os.MkdirAll(LongPath(longSharedStore), 0755)).To(BeNil())
+			CreateGitRepoForTest(repo)
+			os.Chdir(repo)
+			GlobalOptions.SharedStore = longSharedStore
+		})
+		AfterEach(func() {
+			os.Chdir(oldwd)
+			GlobalOptions.SharedStore = ""
+			err := ForceRemoveAll(longRoot)
+			if err != nil {
+				Fail(err.Error())
+			}
+		})
+
+		It("stores, links & retrieves binaries", func() {
+			data := bytes.Repeat([]byte("Content in a deep store "), 1000)
+			info, err := testRepo().StoreLOB(bytes.NewReader(data), nil)
+			Expect(err).To(BeNil(), "Shouldn't be error storing LOB")
+			chunk := testRepo().GetLocalLOBChunkPath(info.SHA, 0)
+			Expect(len(StripLongPathPrefix(chunk))).To(BeNumerically(">", 260))
+
+			links, err := GetHardLinkCount(chunk)
+			Expect(err).To(BeNil(), "Shouldn't be error getting hard link info")
+			Expect(links).To(Equal(2), "Should be linked to the shared store")
+			Expect(testRepo().IsLOBMissing(info.SHA, true)).To(BeFalse())
+
+			// Lose the local copy, so it's linked again from the shared store
+			Expect(os.Remove(chunk)).To(BeNil())
+			var out bytes.Buffer
+			_, err = testRepo().RetrieveLOB(info.SHA, &out)
+			Expect(err).To(BeNil(), "Shouldn't be error retrieving LOB")
+			Expect(out.Bytes()).To(Equal(data))
+			links, err = GetHardLinkCount(testRepo().GetSharedLOBChunkPath(info.SHA, 0))
+			Expect(err).To(BeNil(), "Shouldn't be error getting hard link info")
+			Expect(links).To(Equal(2), "Should be linked from the shared store again")
+		})
+	})
+
 })
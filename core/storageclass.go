@@ -0,0 +1,166 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Storage class hints (lob-storage attribute)
+// Paths can be given a storage class in .gitattributes, e.g. 'archive/** filter=lob lob-storage=cold',
+// so that remotes whose provider supports it (see providers.StorageClassSyncProvider) keep their
+// binaries in a cheaper tier. Only chunks are stored in the class; metadata is small & is
+// downloaded whenever a binary is fetched, so it stays in the default class.
+
+// The .gitattributes attribute giving a path's storage class
+const LOBStorageAttribute = "lob-storage"
+
+// Get the storage classes of paths (relative to the root of the repo) from the lob-storage attribute,
+// keyed on path. Paths without the attribute aren't included, nor are those with an unknown value
+func (r *Repo) GetLOBStorageClasses(paths []string) (map[string]string, error) {
+	ret := make(map[string]string)
+	if len(paths) == 0 {
+		return ret, nil
+	}
+	var in bytes.Buffer
+	for _, path := range paths {
+		in.WriteString(path)
+		in.WriteByte(0)
+	}
+	cmd := r.command("git", "check-attr", "-z", "--stdin", LOBStorageAttribute)
+	cmd.Dir = r.Root
+	cmd.Stdin = &in
+	outp, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error calling 'git check-attr': %v", err.Error())
+	}
+	// Output is <path> NUL <attribute> NUL <value> NUL for each path
+	fields := strings.Split(string(outp), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		path, value := fields[i], strings.ToLower(fields[i+2])
+		switch value {
+		case "unspecified", "unset", "set":
+			continue
+		}
+		if !providers.IsValidStorageClass(value) {
+			if r.reportedStorageClasses == nil {
+				r.reportedStorageClasses = util.NewStringSet()
+			}
+			if r.reportedStorageClasses.Add(value) {
+				r.Log.Errorf("Ignoring unknown %v value '%v' (for %v), should be one of %v, %v or %v\n", LOBStorageAttribute,
+					value, path, providers.StorageClassStandard, providers.StorageClassInfrequent, providers.StorageClassCold)
+			}
+			continue
+		}
+		ret[path] = value
+	}
+	return ret, nil
+}
+
+// Get the storage classes of the files to upload for binaries, keyed on their path relative to
+// the LOB root as for Upload. Only chunks are included; metadata stays in the default class
+func (r *Repo) getStorageClassesForFileLOBs(filelobs []*FileLOB, basedir string) (map[string]string, error) {
+	paths := make([]string, 0, len(filelobs))
+	for _, filelob := range filelobs {
+		paths = append(paths, filelob.Filename)
+	}
+	pathClasses, err := r.GetLOBStorageClasses(paths)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string)
+	for _, filelob := range filelobs {
+		class, ok := pathClasses[filelob.Filename]
+		if !ok {
+			continue
+		}
+		filenames, _, err := r.getLOBFilesForSHA(filelob.SHA, basedir, false, false)
+		if err != nil {
+			continue
+		}
+		meta := GetLOBMetaRelativePath(filelob.SHA)
+		for _, file := range filenames {
+			if file != meta {
+				ret[file] = class
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Upload files, those with a storage class (see getStorageClassesForFileLOBs) in that class if
+// the provider supports it
+func uploadWithStorageClasses(provider providers.SyncProvider, remoteName string, filenames []string, fromDir string,
+	force bool, storageClasses map[string]string, callback providers.SyncProgressCallback) error {
+	storageProvider := providers.UpgradeToStorageClassSyncProvider(provider)
+	if storageProvider == nil || len(storageClasses) == 0 {
+		return provider.Upload(remoteName, filenames, fromDir, force, callback)
+	}
+	// Keep the original order within each class
+	var classes []string
+	filesByClass := make(map[string][]string)
+	for _, file := range filenames {
+		class := storageClasses[file]
+		if _, ok := filesByClass[class]; !ok {
+			classes = append(classes, class)
+		}
+		filesByClass[class] = append(filesByClass[class], file)
+	}
+	var errs []string
+	for _, class := range classes {
+		var err error
+		if class == "" {
+			err = provider.Upload(remoteName, filesByClass[class], fromDir, force, callback)
+		} else {
+			err = storageProvider.UploadWithStorageClass(remoteName, filesByClass[class], fromDir, force, class, callback)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Count how many of the binaries about to be fetched are in cold storage on the remote, so the
+// user can be warned that downloading them will be slower or cost more. Only binaries whose
+// path has a storage class are checked, to avoid querying the remote for every one
+func (r *Repo) countLOBsInColdStorage(lobshas map[string]string, provider providers.SyncProvider, remoteName string) int {
+	storageProvider := providers.UpgradeToStorageClassSyncProvider(provider)
+	if storageProvider == nil {
+		return 0
+	}
+	var paths []string
+	for _, filename := range lobshas {
+		paths = append(paths, filename)
+	}
+	pathClasses, err := r.GetLOBStorageClasses(paths)
+	if err != nil {
+		r.Log.Debugf("Unable to check storage classes: %v\n", err.Error())
+		return 0
+	}
+	count := 0
+	for sha, filename := range lobshas {
+		if class, ok := pathClasses[filename]; !ok || class == providers.StorageClassStandard {
+			continue
+		}
+		info, err := r.GetLOBInfo(sha)
+		if err != nil || info.NumChunks == 0 {
+			continue
+		}
+		cold, err := storageProvider.IsInColdStorage(remoteName, getLOBChunkRelativePathForInfo(info, 0))
+		if err != nil {
+			r.Log.Debugf("Unable to check storage class of %v on %v: %v\n", sha, remoteName, err.Error())
+			continue
+		}
+		if cold {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Storage classes", func() {
+	root := filepath.Join(os.TempDir(), "StorageClassTest")
+	remotepath, _ := GetMockRemotePath("mock://StorageClassTest")
+	var oldwd string
+	var shas [][]string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		ioutil.WriteFile(".gitattributes", []byte("archive/* lob-storage=cold\nold/* lob-storage=Infrequent\nodd/* lob-storage=frozen\n"), 0644)
+		LoadConfig(GlobalOptions)
+		GlobalOptions.GitConfig["remote.origin.git-lob-provider"] = "mock"
+		GlobalOptions.GitConfig["remote.origin.git-lob-url"] = "mock://StorageClassTest"
+		InitCoreProviders()
+
+		shas = CreateManyCommitsForTest([][]string{
+			[]string{"current.png", filepath.Join("archive", "old.png")},
+		}, 0, func(filename string, i int) int64 { return int64(500 + i*100) })
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		os.RemoveAll(remotepath)
+		os.RemoveAll(remotepath + ".storage")
+		GlobalOptions = NewOptions()
+	})
+
+	It("Reads storage classes from .gitattributes", func() {
+		classes, err := testRepo().GetLOBStorageClasses([]string{"current.png", "archive/old.png", "old/a.psd", "odd/b.psd"})
+		Expect(err).To(BeNil())
+		Expect(classes).To(Equal(map[string]string{"archive/old.png": "cold", "old/a.psd": "infrequent"}),
+			"Unknown classes & paths without one should be left out")
+	})
+
+	It("Pushes chunks in their storage class & warns on fetch", func() {
+		provider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil())
+		storageProvider := UpgradeToStorageClassSyncProvider(provider)
+		Expect(storageProvider).ToNot(BeNil(), "Mock should support storage classes")
+		callback := func(data *ProgressCallbackData) (abort bool) { return false }
+		Expect(testRepo().Push(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}}, false, false, false, callback)).To(BeNil())
+
+		cold, err := storageProvider.IsInColdStorage("origin", GetLOBChunkRelativePath(shas[0][1], 0))
+		Expect(err).To(BeNil())
+		Expect(cold).To(BeTrue(), "Archived binary should be in cold storage")
+		cold, _ = storageProvider.IsInColdStorage("origin", GetLOBMetaRelativePath(shas[0][1]))
+		Expect(cold).To(BeFalse(), "Metadata should stay in the default class")
+		cold, _ = storageProvider.IsInColdStorage("origin", GetLOBChunkRelativePath(shas[0][0], 0))
+		Expect(cold).To(BeFalse(), "Other binaries should be in the default class")
+
+		lobs := map[string]string{shas[0][0]: "current.png", shas[0][1]: "archive/old.png"}
+		Expect(testRepo().countLOBsInColdStorage(lobs, provider, "origin")).To(Equal(1))
+		var messages []string
+		fetchcallback := func(data *ProgressCallbackData) (abort bool) {
+			if data.Type == ProgressCalculate {
+				messages = append(messages, data.Desc)
+			}
+			return false
+		}
+		for sha := range lobs {
+			Expect(testRepo().DeleteLOB(sha)).To(BeNil())
+		}
+		Expect(testRepo().fetchLOBs(lobs, provider, "origin", false, fetchcallback)).To(BeNil())
+		Expect(messages).To(ContainElement(ContainSubstring("1 binaries are in cold storage on origin")))
+		for sha := range lobs {
+			Expect(testRepo().IsLOBMissing(sha, false)).To(BeFalse(), "Should still fetch cold binaries")
+		}
+	})
+})
@@ -0,0 +1,318 @@
+package core
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Store layouts
+// The original layout splays binaries by the first 6 hex characters of their SHA & names files
+// <sha>_meta, <sha>_<chunk>, <sha>_preview (and chunks/<splay>/<chunksha> for chunk objects),
+// which makes for long paths, especially with SHA-256: repos in deep folders can hit the Windows
+// MAX_PATH limit. The compact layout encodes SHAs in lower case base32 instead, so names are a
+// fifth shorter & still can't collide on case-insensitive filesystems (unlike base64), splays by
+// 2 characters at each level & names files <enc>.m, <enc>.<chunk>, <enc>.p (and
+// chunks/<splay>/<enc>).
+// Remotes, downloads & everything else which refers to the files of a binary by relative path
+// always use the original layout; local & shared stores map those paths to their own layout with
+// getLOBStoreFilePath. A store's layout is recorded in a marker file at its root, stores without
+// one use the original layout. Once a store has been migrated (see MigrateLOBStoreLayout), files
+// are looked for in both layouts, so an interrupted migration leaves everything readable.
+// Paths which are still too long are given in the extended-length form, see util.LongPath.
+
+const (
+	// <sha>_meta, <sha>_<chunk> splayed by hex SHA
+	LOBStoreLayoutOriginal = 1
+	// <enc>.m, <enc>.<chunk> splayed by base32 SHA
+	LOBStoreLayoutCompact = 2
+)
+
+// Name of the file at the root of a store recording its layout
+const lobStoreLayoutFile = ".layout"
+
+var lobStoreNameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func init() {
+	// Uploads & downloads use the original layout's paths
+	providers.LocalFilePath = getLOBStoreFilePath
+}
+
+// Compact names of LOB files, SHA-1 or SHA-256
+var compactLOBFilenameRegex = regexp.MustCompile(`^([a-z2-7]{52}|[a-z2-7]{32})\.(m|p|\d+)$`)
+var originalLOBFilenameRegex = regexp.MustCompile(`^(` + LOBSHARegexFragment + `)_(meta|preview|\d+)$`)
+var compactChunkObjectFilenameRegex = regexp.MustCompile(`^(?:[a-z2-7]{52}|[a-z2-7]{32})$`)
+
+// Gets the layout of a store, & whether the store has been migrated from one to another (in
+// which case files may be in either layout)
+func getLOBStoreLayout(basedir string) (layout int, migrated bool) {
+	data, err := ioutil.ReadFile(filepath.Join(basedir, lobStoreLayoutFile))
+	if err != nil {
+		return LOBStoreLayoutOriginal, false
+	}
+	layout, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || layout != LOBStoreLayoutCompact {
+		return LOBStoreLayoutOriginal, true
+	}
+	return layout, true
+}
+
+// Gets the layout of a store (LOBStoreLayoutOriginal or LOBStoreLayoutCompact)
+func GetLOBStoreLayout(basedir string) int {
+	layout, _ := getLOBStoreLayout(basedir)
+	return layout
+}
+
+func setLOBStoreLayout(basedir string, layout int) error {
+	err := os.MkdirAll(basedir, 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(basedir, lobStoreLayoutFile), []byte(fmt.Sprintf("%d\n", layout)), 0644)
+}
+
+// Encode a SHA for the compact layout, false if it isn't a SHA
+func encodeLOBStoreName(sha string) (string, bool) {
+	b, err := hex.DecodeString(sha)
+	if err != nil || (len(b) != SHALen/2 && len(b) != SHA256Len/2) {
+		return "", false
+	}
+	return strings.ToLower(lobStoreNameEncoding.EncodeToString(b)), true
+}
+
+// Decode a SHA from a compact layout name, false if it isn't one
+func decodeLOBStoreName(name string) (string, bool) {
+	b, err := lobStoreNameEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil || (len(b) != SHALen/2 && len(b) != SHA256Len/2) {
+		return "", false
+	}
+	return hex.EncodeToString(b), true
+}
+
+// Parse the name of a file of a LOB (not a chunk object) in either layout
+// suffix is "meta", "preview" or the chunk number
+func parseLOBStoreFilename(name string) (sha, suffix string, layout int, ok bool) {
+	if match := originalLOBFilenameRegex.FindStringSubmatch(name); match != nil {
+		return match[1], match[2], LOBStoreLayoutOriginal, true
+	}
+	if match := compactLOBFilenameRegex.FindStringSubmatch(name); match != nil {
+		sha, ok := decodeLOBStoreName(match[1])
+		if !ok {
+			return "", "", 0, false
+		}
+		suffix = match[2]
+		switch suffix {
+		case "m":
+			suffix = "meta"
+		case "p":
+			suffix = "preview"
+		}
+		return sha, suffix, LOBStoreLayoutCompact, true
+	}
+	return "", "", 0, false
+}
+
+// Parse the name of a chunk object file in either layout
+func parseChunkObjectStoreFilename(name string) (sha string, layout int, ok bool) {
+	if chunkObjectFilenameRegex.MatchString(name) {
+		return name, LOBStoreLayoutOriginal, true
+	}
+	if compactChunkObjectFilenameRegex.MatchString(name) {
+		if sha, ok := decodeLOBStoreName(name); ok {
+			return sha, LOBStoreLayoutCompact, true
+		}
+	}
+	return "", 0, false
+}
+
+// Gets the SHA of the binary or chunk object which a store file belongs to, in either layout
+func getLOBStoreFileSHA(path string) (string, bool) {
+	name := filepath.Base(path)
+	if sha, _, _, ok := parseLOBStoreFilename(name); ok {
+		return sha, true
+	}
+	sha, _, ok := parseChunkObjectStoreFilename(name)
+	return sha, ok
+}
+
+// Gets the relative path of a file of a LOB (suffix "meta", "preview" or chunk number) in a layout
+func getLOBStoreRelativePathInLayout(sha, suffix string, layout int) string {
+	if layout == LOBStoreLayoutCompact {
+		if enc, ok := encodeLOBStoreName(sha); ok {
+			switch suffix {
+			case "meta":
+				suffix = "m"
+			case "preview":
+				suffix = "p"
+			}
+			return filepath.Join(enc[:2], enc[2:4], enc+"."+suffix)
+		}
+	}
+	return filepath.Join(getLOBRelativeDir(sha), sha+"_"+suffix)
+}
+
+// Gets the relative path of a chunk object in a layout
+func getChunkObjectStoreRelativePathInLayout(chunksha string, layout int) string {
+	if layout == LOBStoreLayoutCompact {
+		if enc, ok := encodeLOBStoreName(chunksha); ok {
+			return filepath.Join(ChunkObjectDir, enc[:2], enc[2:4], enc)
+		}
+	}
+	return GetChunkObjectRelativePath(chunksha)
+}
+
+// Convert a path relative to a store root from one layout to another
+// Paths which aren't files of binaries or chunk objects are returned as they are
+func convertLOBStoreRelativePath(rel string, layout int) string {
+	name := filepath.Base(rel)
+	if sha, suffix, _, ok := parseLOBStoreFilename(name); ok {
+		return getLOBStoreRelativePathInLayout(sha, suffix, layout)
+	}
+	if strings.HasPrefix(rel, ChunkObjectDir+string(filepath.Separator)) {
+		if sha, _, ok := parseChunkObjectStoreFilename(name); ok {
+			return getChunkObjectStoreRelativePathInLayout(sha, layout)
+		}
+	}
+	return rel
+}
+
+// Gets the path of a file in a store from its path relative to the store in the original layout
+// (e.g. from GetLOBMetaRelativePath), wherever the store's layout puts it
+func getLOBStoreFilePath(basedir, rel string) string {
+	layout, migrated := getLOBStoreLayout(basedir)
+	if !migrated {
+		return util.LongPath(filepath.Join(basedir, rel))
+	}
+	other := LOBStoreLayoutOriginal
+	if layout == LOBStoreLayoutOriginal {
+		other = LOBStoreLayoutCompact
+	}
+	path := filepath.Join(basedir, convertLOBStoreRelativePath(rel, layout))
+	if !util.FileExists(path) {
+		// May not have been migrated yet
+		if otherpath := filepath.Join(basedir, convertLOBStoreRelativePath(rel, other)); util.FileExists(otherpath) {
+			return util.LongPath(otherpath)
+		}
+	}
+	return util.LongPath(path)
+}
+
+// As getLOBStoreFilePath, creating the folder the file is in
+func (r *Repo) getLOBStoreFilePathCreatingDir(basedir, rel string) string {
+	ret := getLOBStoreFilePath(basedir, rel)
+	err := os.MkdirAll(filepath.Dir(ret), 0755)
+	if err != nil {
+		r.Log.Errorf("Unable to create LOB 2nd-level folder at %v: %v", filepath.Dir(ret), err)
+		panic(err)
+	}
+	return ret
+}
+
+// Get the files of a LOB itself in a store, in either layout, i.e. not chunk objects (which may
+// be shared with other LOBs)
+func getLOBOwnFilesInStore(sha, basedir string) ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(basedir, getLOBRelativeDir(sha), fmt.Sprintf("%v*", sha)))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to glob files for %v: %v", sha, err))
+	}
+	if _, migrated := getLOBStoreLayout(basedir); migrated {
+		if enc, ok := encodeLOBStoreName(sha); ok {
+			compact, err := filepath.Glob(filepath.Join(basedir, enc[:2], enc[2:4], enc+".*"))
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Unable to glob files for %v: %v", sha, err))
+			}
+			names = append(names, compact...)
+		}
+	}
+	return names, nil
+}
+
+// Move the files of all binaries & chunk objects in a store to a layout, recording it as the
+// layout of the store first so that everything can be found while they're moved
+// Files already in that layout are left alone, so an interrupted migration can just be run again
+// callback is called for each file moved (or which would be, if dryRun)
+// Returns the number of files moved (or which would be)
+func MigrateLOBStoreLayout(basedir string, layout int, dryRun bool, callback func(path string)) (int, error) {
+	if layout != LOBStoreLayoutOriginal && layout != LOBStoreLayoutCompact {
+		return 0, fmt.Errorf("Unknown store layout %d", layout)
+	}
+	if !util.DirExists(basedir) {
+		return 0, fmt.Errorf("%v does not exist", basedir)
+	}
+	if !dryRun {
+		err := setLOBStoreLayout(basedir, layout)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Collect first, moving while walking confuses Walk
+	var tomove []string
+	err := filepath.Walk(basedir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			// Shared store locks, fetches in progress etc
+			if path != basedir && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(basedir, path)
+		if err != nil {
+			return err
+		}
+		if convertLOBStoreRelativePath(rel, layout) != rel {
+			tomove = append(tomove, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	dirs := util.NewStringSet()
+	for _, rel := range tomove {
+		callback(filepath.Join(basedir, rel))
+		if dryRun {
+			continue
+		}
+		src := filepath.Join(basedir, rel)
+		dest := filepath.Join(basedir, convertLOBStoreRelativePath(rel, layout))
+		err := os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return 0, err
+		}
+		if util.FileExists(dest) {
+			// Stored again since the migration started, the content is the same
+			err = os.Remove(src)
+		} else {
+			// Renaming keeps hard links between local & shared stores
+			err = os.Rename(src, dest)
+		}
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("Unable to move %v to %v: %v", src, dest, err.Error()))
+		}
+		dirs.Add(filepath.Dir(src))
+	}
+	// Tidy up the folders of the old layout; only empty ones can be removed
+	for dir := range dirs.Iter() {
+		for ; dir != basedir && len(dir) > len(basedir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return len(tomove), nil
+}
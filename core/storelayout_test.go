@@ -0,0 +1,157 @@
+package core
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Store layout", func() {
+	getRandomData := func(sz int, seed int64) []byte {
+		data := make([]byte, sz)
+		rand.New(rand.NewSource(seed)).Read(data)
+		return data
+	}
+
+	It("Encodes & parses names in both layouts", func() {
+		sha := "0123456789abcdef0123456789abcdef01234567"
+		enc, ok := encodeLOBStoreName(sha)
+		Expect(ok).To(BeTrue())
+		Expect(enc).To(HaveLen(32))
+		Expect(enc).To(MatchRegexp("^[a-z2-7]+$"), "Should be case-insensitive safe")
+		decoded, ok := decodeLOBStoreName(enc)
+		Expect(ok).To(BeTrue())
+		Expect(decoded).To(Equal(sha))
+
+		for _, layout := range []int{LOBStoreLayoutOriginal, LOBStoreLayoutCompact} {
+			rel := getLOBStoreRelativePathInLayout(sha, "3", layout)
+			parsedsha, suffix, parsedlayout, ok := parseLOBStoreFilename(filepath.Base(rel))
+			Expect(ok).To(BeTrue())
+			Expect(parsedsha).To(Equal(sha))
+			Expect(suffix).To(Equal("3"))
+			Expect(parsedlayout).To(Equal(layout))
+			Expect(convertLOBStoreRelativePath(rel, LOBStoreLayoutOriginal)).To(Equal(GetLOBChunkRelativePath(sha, 3)))
+		}
+		compact := convertLOBStoreRelativePath(GetLOBMetaRelativePath(sha), LOBStoreLayoutCompact)
+		Expect(compact).To(Equal(filepath.Join(enc[:2], enc[2:4], enc+".m")))
+		preview := convertLOBStoreRelativePath(GetLOBPreviewRelativePath(sha), LOBStoreLayoutCompact)
+		Expect(preview).To(Equal(filepath.Join(enc[:2], enc[2:4], enc+".p")))
+		Expect(convertLOBStoreRelativePath(preview, LOBStoreLayoutOriginal)).To(Equal(GetLOBPreviewRelativePath(sha)))
+		Expect(len(compact)).To(BeNumerically("<", len(GetLOBMetaRelativePath(sha))))
+		chunkobj := convertLOBStoreRelativePath(GetChunkObjectRelativePath(sha), LOBStoreLayoutCompact)
+		Expect(chunkobj).To(Equal(filepath.Join(ChunkObjectDir, enc[:2], enc[2:4], enc)))
+		Expect(convertLOBStoreRelativePath("something/else", LOBStoreLayoutCompact)).To(Equal("something/else"))
+	})
+
+	Describe("Migrating", func() {
+		root := filepath.Join(os.TempDir(), "StoreLayoutTest")
+		var oldwd string
+		var contents [][]byte
+		var shas []string
+		BeforeEach(func() {
+			CreateGitRepoForTest(root)
+			oldwd, _ = os.Getwd()
+			os.Chdir(root)
+			contents = nil
+			shas = nil
+			for i, chunking := range []string{ChunkingFixed, ChunkingContentDefined} {
+				GlobalOptions.Chunking = chunking
+				content := getRandomData(20*1024, int64(i+1))
+				info, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+				Expect(err).To(BeNil())
+				contents = append(contents, content)
+				shas = append(shas, info.SHA)
+			}
+			GlobalOptions.Chunking = ChunkingFixed
+		})
+		AfterEach(func() {
+			os.Chdir(oldwd)
+			err := ForceRemoveAll(root)
+			if err != nil {
+				Fail(err.Error())
+			}
+		})
+
+		expectContent := func(desc string) {
+			for i, sha := range shas {
+				var buf bytes.Buffer
+				_, err := testRepo().RetrieveLOB(sha, &buf)
+				Expect(err).To(BeNil(), desc)
+				Expect(buf.Bytes()).To(Equal(contents[i]), desc)
+			}
+			all, err := getAllLOBSHAsInDir(testRepo().GetLocalLOBRoot())
+			Expect(err).To(BeNil(), desc)
+			Expect(all.Cardinality()).To(Equal(len(shas)), desc)
+		}
+
+		It("Migrates to the compact layout & back", func() {
+			lobroot := testRepo().GetLocalLOBRoot()
+			Expect(GetLOBStoreLayout(lobroot)).To(Equal(LOBStoreLayoutOriginal))
+			metapath := filepath.Join(lobroot, GetLOBMetaRelativePath(shas[0]))
+			Expect(FileExists(metapath)).To(BeTrue())
+
+			var moved []string
+			n, err := MigrateLOBStoreLayout(lobroot, LOBStoreLayoutCompact, true, func(path string) { moved = append(moved, path) })
+			Expect(err).To(BeNil())
+			Expect(n).To(BeNumerically(">", 2))
+			Expect(moved).To(HaveLen(n))
+			Expect(GetLOBStoreLayout(lobroot)).To(Equal(LOBStoreLayoutOriginal), "Dry run should not change anything")
+			Expect(FileExists(metapath)).To(BeTrue(), "Dry run should not change anything")
+
+			n2, err := MigrateLOBStoreLayout(lobroot, LOBStoreLayoutCompact, false, func(string) {})
+			Expect(err).To(BeNil())
+			Expect(n2).To(Equal(n))
+			Expect(GetLOBStoreLayout(lobroot)).To(Equal(LOBStoreLayoutCompact))
+			Expect(FileExists(metapath)).To(BeFalse(), "Original files should have been moved")
+			Expect(DirExists(filepath.Dir(metapath))).To(BeFalse(), "Empty folders should have been removed")
+			Expect(FileExists(filepath.Join(lobroot, convertLOBStoreRelativePath(GetLOBMetaRelativePath(shas[0]), LOBStoreLayoutCompact)))).To(BeTrue())
+			expectContent("Should read the compact layout")
+
+			// New binaries go in the new layout
+			content := getRandomData(1000, 10)
+			info, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+			Expect(err).To(BeNil())
+			contents = append(contents, content)
+			shas = append(shas, info.SHA)
+			Expect(FileExists(filepath.Join(lobroot, GetLOBMetaRelativePath(info.SHA)))).To(BeFalse())
+			expectContent("Should read binaries stored after migrating")
+
+			n, err = MigrateLOBStoreLayout(lobroot, LOBStoreLayoutCompact, false, func(string) {})
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(0), "Nothing left to move")
+
+			_, err = MigrateLOBStoreLayout(lobroot, LOBStoreLayoutOriginal, false, func(string) {})
+			Expect(err).To(BeNil())
+			Expect(GetLOBStoreLayout(lobroot)).To(Equal(LOBStoreLayoutOriginal))
+			Expect(FileExists(metapath)).To(BeTrue(), "Files should be back in the original layout")
+			expectContent("Should read the original layout again")
+		})
+
+		It("Reads both layouts while a migration is incomplete", func() {
+			lobroot := testRepo().GetLocalLOBRoot()
+			// As if interrupted before anything was moved
+			Expect(setLOBStoreLayout(lobroot, LOBStoreLayoutCompact)).To(BeNil())
+			expectContent("Should read files not yet moved")
+			files, err := getLOBOwnFilesInStore(shas[0], lobroot)
+			Expect(err).To(BeNil())
+			Expect(files).ToNot(BeEmpty())
+
+			_, err = MigrateLOBStoreLayout(lobroot, LOBStoreLayoutCompact, false, func(string) {})
+			Expect(err).To(BeNil())
+			movedfiles, err := getLOBOwnFilesInStore(shas[0], lobroot)
+			Expect(err).To(BeNil())
+			Expect(movedfiles).To(HaveLen(len(files)))
+			expectContent("Should read files once moved")
+
+			deleteLOBFilesInStore(shas[0], lobroot)
+			movedfiles, err = getLOBOwnFilesInStore(shas[0], lobroot)
+			Expect(err).To(BeNil())
+			Expect(movedfiles).To(BeEmpty(), "Should delete files in the compact layout")
+		})
+	})
+})
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"hash"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Pipelined storing
+// Storing a binary means reading it, calculating its SHA & writing it to chunk files. Done one
+// after the other on one goroutine, hashing limits how fast multi-GB binaries can be added from
+// fast disks, so instead the input is read on one goroutine & hashed on another while the
+// caller writes it. A fixed number of buffers are passed between them & reused once both
+// hashing & writing are done with them, so memory use doesn't depend on the size of the binary.
+
+// Number of BUFSIZE buffers in flight between reading, hashing & writing
+const storePipelineBuffers = 8
+
+// Data read from the input, shared by the hashing & writing stages
+type storeBuffer struct {
+	Data []byte
+	// Number of stages still to finish with it
+	users int32
+	// Whether to return to the pool when done (the leader isn't one of ours)
+	pooled bool
+}
+
+type storePipeline struct {
+	in       io.Reader
+	hash     hash.Hash
+	free     chan *storeBuffer
+	toHash   chan *storeBuffer
+	toWrite  chan *storeBuffer
+	stop     chan struct{}
+	stopOnce sync.Once
+	finished sync.WaitGroup
+	readErr  error
+}
+
+// Start reading in (after leader, which has already been read) & hashing it with h
+// The caller must receive every buffer from Buffers, calling Done on each after writing it,
+// then call Wait to find out whether reading succeeded; or call Abort to stop early
+func newStorePipeline(in io.Reader, leader []byte, h hash.Hash) *storePipeline {
+	p := &storePipeline{
+		in:      in,
+		hash:    h,
+		free:    make(chan *storeBuffer, storePipelineBuffers),
+		toHash:  make(chan *storeBuffer, storePipelineBuffers+1),
+		toWrite: make(chan *storeBuffer, storePipelineBuffers),
+		stop:    make(chan struct{}),
+	}
+	for i := 0; i < storePipelineBuffers; i++ {
+		p.free <- &storeBuffer{Data: make([]byte, BUFSIZE), pooled: true}
+	}
+	p.finished.Add(2)
+	go p.read(leader)
+	go p.hashAll()
+	return p
+}
+
+// Buffers of data to write, in order; closed at the end of the input or on a read error
+func (p *storePipeline) Buffers() <-chan *storeBuffer {
+	return p.toWrite
+}
+
+// Called by the writer once it's finished with a buffer
+func (p *storePipeline) Done(b *storeBuffer) {
+	p.release(b)
+}
+
+// Wait for everything read to be hashed, returning any error reading the input
+func (p *storePipeline) Wait() error {
+	p.finished.Wait()
+	return p.readErr
+}
+
+// Stop reading early, e.g. because writing failed, & wait for the other stages to stop
+func (p *storePipeline) Abort() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	// Let the reader finish sending anything in progress
+	for b := range p.toWrite {
+		p.release(b)
+	}
+	p.finished.Wait()
+}
+
+func (p *storePipeline) release(b *storeBuffer) {
+	if atomic.AddInt32(&b.users, -1) == 0 && b.pooled {
+		b.Data = b.Data[:cap(b.Data)]
+		p.free <- b
+	}
+}
+
+// Send data to both the hashing & writing stages; false if stopped
+func (p *storePipeline) send(b *storeBuffer) bool {
+	b.users = 2
+	// toHash has room for every buffer, so never blocks
+	p.toHash <- b
+	select {
+	case p.toWrite <- b:
+		return true
+	case <-p.stop:
+		p.release(b)
+		return false
+	}
+}
+
+func (p *storePipeline) read(leader []byte) {
+	defer p.finished.Done()
+	defer close(p.toHash)
+	defer close(p.toWrite)
+
+	if len(leader) > 0 && !p.send(&storeBuffer{Data: leader}) {
+		return
+	}
+	for {
+		var b *storeBuffer
+		select {
+		case b = <-p.free:
+		case <-p.stop:
+			return
+		}
+		c, err := p.in.Read(b.Data)
+		if c > 0 {
+			b.Data = b.Data[:c]
+			if !p.send(b) {
+				return
+			}
+		} else {
+			p.free <- b
+		}
+		if err != nil {
+			if err != io.EOF {
+				p.readErr = err
+			}
+			return
+		}
+	}
+}
+
+func (p *storePipeline) hashAll() {
+	defer p.finished.Done()
+	for b := range p.toHash {
+		p.hash.Write(b.Data)
+		p.release(b)
+	}
+}
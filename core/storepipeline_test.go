@@ -0,0 +1,126 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Store pipeline", func() {
+	root := filepath.Join(os.TempDir(), "StorePipelineTest")
+	var oldChunkSize int64
+	BeforeEach(func() {
+		os.MkdirAll(root, 0755)
+		oldChunkSize = ChunkSize
+		ChunkSize = 50000
+	})
+	AfterEach(func() {
+		ChunkSize = oldChunkSize
+		os.RemoveAll(root)
+	})
+
+	It("Stores input read in any size pieces", func() {
+		content := make([]byte, storePipelineBuffers*BUFSIZE*2+123)
+		rand.Read(content)
+		correctSHA := fmt.Sprintf("%x", sha1.Sum(content))
+		leader := content[:SHALineLen]
+		readers := []io.Reader{
+			bytes.NewReader(content[SHALineLen:]),
+			iotest.HalfReader(bytes.NewReader(content[SHALineLen:])),
+			iotest.DataErrReader(bytes.NewReader(content[SHALineLen:])),
+		}
+		for i, in := range readers {
+			info, err := testRepo().StoreLOBInBaseDir(root, in, leader)
+			Expect(err).To(BeNil(), "Reader %d", i)
+			Expect(info.SHA).To(Equal(correctSHA), "Reader %d", i)
+			Expect(info.Size).To(BeEquivalentTo(len(content)), "Reader %d", i)
+			Expect(info.NumChunks).To(Equal(len(content)/50000+1), "Reader %d", i)
+			var stored bytes.Buffer
+			Expect(testRepo().GetLOBCompleteContentInBaseDir(root, info.SHA, &stored)).To(BeNil(), "Reader %d", i)
+			Expect(stored.Bytes()).To(Equal(content), "Reader %d", i)
+		}
+	})
+
+	It("Stops on read errors", func() {
+		content := make([]byte, BUFSIZE*3)
+		rand.Read(content)
+		_, err := testRepo().StoreLOBInBaseDir(root, &failingReader{bytes.NewReader(content)}, nil)
+		Expect(err).ToNot(BeNil(), "Should report read error")
+		Expect(err.Error()).To(ContainSubstring("Disk fell off"))
+	})
+})
+
+// Reads the underlying reader, then fails instead of returning EOF
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	c, err := f.r.Read(p)
+	if err == io.EOF {
+		return c, errors.New("Disk fell off")
+	}
+	return c, err
+}
+
+// Content to store in benchmarks; large enough that hashing dominates
+func storeBenchmarkContent(b *testing.B) []byte {
+	content := make([]byte, 64*1024*1024)
+	rand.Read(content)
+	b.SetBytes(int64(len(content)))
+	return content
+}
+
+func BenchmarkStoreLOB(b *testing.B) {
+	content := storeBenchmarkContent(b)
+	dir, _ := ioutil.TempDir("", "StoreLOBBenchmark")
+	defer os.RemoveAll(dir)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Vary the content so it isn't already stored
+		content[0] = byte(i)
+		if _, err := testRepo().StoreLOBInBaseDir(dir, bytes.NewReader(content), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Reading, hashing & writing one after another as StoreLOB used to, for comparison
+func BenchmarkStoreLOBSerial(b *testing.B) {
+	content := storeBenchmarkContent(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		content[0] = byte(i)
+		out, err := ioutil.TempFile("", "StoreLOBBenchmark")
+		if err != nil {
+			b.Fatal(err)
+		}
+		sha := sha1.New()
+		in := bytes.NewReader(content)
+		buf := make([]byte, BUFSIZE)
+		for {
+			c, err := in.Read(buf)
+			if c > 0 {
+				sha.Write(buf[:c])
+				out.Write(buf[:c])
+			}
+			if err != nil {
+				break
+			}
+		}
+		sha.Sum(nil)
+		out.Close()
+		os.Remove(out.Name())
+	}
+}
@@ -106,14 +106,14 @@ func CreateSmallTestLOBDataForRetrieval() (correctInfo *LOBInfo) {
 	// This was calculated with 'shasum' on Mac OS X with this file content
 	correctLOBInfo := &LOBInfo{SHA: "772157c6ef480852edf921f5924b1ca582b0d78f",
 		NumChunks: 1, Size: 128 * 255 * 16}
-	err := StoreLOBInfo(correctLOBInfo)
+	err := testRepo().StoreLOBInfo(correctLOBInfo)
 	Expect(err).To(BeNil(), "Shouldn't be error creating LOB meta file")
 
 	var lobFile string
-	if IsUsingSharedStorage() {
-		lobFile = GetSharedLOBChunkPath(correctLOBInfo.SHA, 0)
+	if testRepo().IsUsingSharedStorage() {
+		lobFile = testRepo().GetSharedLOBChunkPath(correctLOBInfo.SHA, 0)
 	} else {
-		lobFile = GetLocalLOBChunkPath(correctLOBInfo.SHA, 0)
+		lobFile = testRepo().GetLocalLOBChunkPath(correctLOBInfo.SHA, 0)
 	}
 	f, err := os.OpenFile(lobFile, os.O_WRONLY|os.O_CREATE, 0644)
 	Expect(err).To(BeNil(), "Shouldn't be error creating LOB file %v", lobFile)
@@ -125,8 +125,8 @@ func CreateSmallTestLOBDataForRetrieval() (correctInfo *LOBInfo) {
 		}
 	}
 	f.Close()
-	if IsUsingSharedStorage() {
-		link := GetLocalLOBChunkPath(correctLOBInfo.SHA, 0)
+	if testRepo().IsUsingSharedStorage() {
+		link := testRepo().GetLocalLOBChunkPath(correctLOBInfo.SHA, 0)
 		CreateHardLink(lobFile, link)
 	}
 	return correctLOBInfo
@@ -140,7 +140,7 @@ func CreateLargeTestLOBDataForRetrieval() (correctInfo *LOBInfo) {
 	correctLOBInfo := &LOBInfo{SHA: "6dc61e7c7d33e87592da1e534063052a17bf8f3c",
 		NumChunks: correctNumChunks, Size: correctFileSize}
 
-	err := StoreLOBInfo(correctLOBInfo)
+	err := testRepo().StoreLOBInfo(correctLOBInfo)
 	Expect(err).To(BeNil(), "Shouldn't be error creating LOB meta file")
 
 	// Write test data into 4 chunks
@@ -156,16 +156,16 @@ func CreateLargeTestLOBDataForRetrieval() (correctInfo *LOBInfo) {
 				if outf != nil {
 					dest := outf.Name()
 					outf.Close()
-					if IsUsingSharedStorage() {
-						link := GetLocalLOBChunkPath(correctLOBInfo.SHA, chunkIdx-1)
+					if testRepo().IsUsingSharedStorage() {
+						link := testRepo().GetLocalLOBChunkPath(correctLOBInfo.SHA, chunkIdx-1)
 						CreateHardLink(dest, link)
 					}
 				}
 				var lobFile string
-				if IsUsingSharedStorage() {
-					lobFile = GetSharedLOBChunkPath(correctLOBInfo.SHA, chunkIdx)
+				if testRepo().IsUsingSharedStorage() {
+					lobFile = testRepo().GetSharedLOBChunkPath(correctLOBInfo.SHA, chunkIdx)
 				} else {
-					lobFile = GetLocalLOBChunkPath(correctLOBInfo.SHA, chunkIdx)
+					lobFile = testRepo().GetLocalLOBChunkPath(correctLOBInfo.SHA, chunkIdx)
 				}
 				chunkIdx++
 				outf, err = os.OpenFile(lobFile, os.O_WRONLY|os.O_CREATE, 0644)
@@ -180,8 +180,8 @@ func CreateLargeTestLOBDataForRetrieval() (correctInfo *LOBInfo) {
 	if outf != nil {
 		dest := outf.Name()
 		outf.Close()
-		if IsUsingSharedStorage() {
-			link := GetLocalLOBChunkPath(correctLOBInfo.SHA, chunkIdx-1)
+		if testRepo().IsUsingSharedStorage() {
+			link := testRepo().GetLocalLOBChunkPath(correctLOBInfo.SHA, chunkIdx-1)
 			CreateHardLink(dest, link)
 		}
 	}
@@ -357,7 +357,7 @@ func StoreLOBForTest(filename string) (*LOBInfo, error) {
 		return nil, err
 	}
 	defer f.Close()
-	return StoreLOB(bufio.NewReader(f), []byte(""))
+	return testRepo().StoreLOB(bufio.NewReader(f), []byte(""))
 }
 
 func CreateManyCommitsForTest(filespercommit [][]string, commitOffset int, sizeFunc func(filename string, index int) int64) (shaspercommit [][]string) {
@@ -505,7 +505,7 @@ func SetupRepoForTest(inputs []*TestCommitSetupInput) []*CommitLOBRef {
 		// Now commit
 		CommitAtDateForTest(input.CommitDate, input.CommitterName, input.CommitterEmail,
 			fmt.Sprintf("Test commit %d", i))
-		commit, err := GetGitCommitSummary("HEAD")
+		commit, err := testRepo().GetGitCommitSummary("HEAD")
 		if err != nil {
 			Fail("Error determining commit SHA: " + err.Error())
 		}
@@ -571,3 +571,32 @@ func ForceRemove(path string) error {
 	return err
 
 }
+
+// Repos tests have used, by where & with what options they were made
+var testRepos = make(map[testRepoKey]*Repo)
+
+type testRepoKey struct {
+	workDir, root, gitDir string
+	opts                  *util.Options
+}
+
+// Get a Repo for the current directory with util.GlobalOptions, as the command line tool would make;
+// the same one while neither the directory, its repository nor the options change, so what it
+// caches lasts as long as it does for the command line tool
+func testRepo() *Repo {
+	wd, err := os.Getwd()
+	if err != nil {
+		Fail(fmt.Sprintf("Can't get working dir: %v", err))
+	}
+	repo, err := NewRepo(wd, util.GlobalOptions, util.DefaultLogger)
+	if err != nil {
+		// Not in a repository; operations fail as they would for the command line tool
+		return &Repo{WorkDir: wd, Options: util.GlobalOptions, Log: util.DefaultLogger}
+	}
+	key := testRepoKey{wd, repo.Root, repo.GitDir, util.GlobalOptions}
+	if existing, ok := testRepos[key]; ok {
+		return existing
+	}
+	testRepos[key] = repo
+	return repo
+}
@@ -0,0 +1,274 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// The name of the git filter which runs git-lob, as configured in git config
+const LOBFilterName = "lob"
+
+// Attributes given to paths stored by git-lob in .gitattributes
+var trackAttributes = []string{"filter=" + LOBFilterName, "-crlf"}
+
+// Max number of paths to pass to a single git command
+const restageBatchSize = 100
+
+// Get the path of the .gitattributes file at the root of the repo
+func (r *Repo) getGitAttributesFile() (string, error) {
+	return filepath.Join(r.Root, ".gitattributes"), nil
+}
+
+// Read the lines of the root .gitattributes, empty if it doesn't exist
+func (r *Repo) readGitAttributesLines() ([]string, error) {
+	file, err := r.getGitAttributesFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// Don't preserve CRLF, git doesn't mind either
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return lines, scanner.Err()
+}
+
+func (r *Repo) writeGitAttributesLines(lines []string) error {
+	file, err := r.getGitAttributesFile()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	tmpfile := file + ".tmp"
+	err = ioutil.WriteFile(tmpfile, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, file)
+}
+
+// Split a .gitattributes line into pattern & attributes; pattern is "" for blank lines & comments
+func parseGitAttributesLine(line string) (pattern string, attrs []string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
+func isTrackAttribute(attr string) bool {
+	return attr == trackAttributes[0]
+}
+
+// Get the path patterns stored by git-lob according to the root .gitattributes, in file order
+func (r *Repo) GetTrackedPatterns() ([]string, error) {
+	lines, err := r.readGitAttributesLines()
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, line := range lines {
+		pattern, attrs := parseGitAttributesLine(line)
+		for _, attr := range attrs {
+			if isTrackAttribute(attr) {
+				ret = append(ret, pattern)
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Add path patterns to the root .gitattributes so that matching files are stored by git-lob
+// Patterns are relative to the root of the repo, with the same rules as .gitattributes
+// Returns the patterns added, patterns already tracked are left alone
+func (r *Repo) TrackPatterns(patterns []string) ([]string, error) {
+	for _, pattern := range patterns {
+		if pattern == "" || strings.IndexAny(pattern, " \t") != -1 || strings.HasPrefix(pattern, "#") {
+			return nil, fmt.Errorf("Invalid pattern %q; patterns can't be empty, contain spaces or start with #", pattern)
+		}
+	}
+	lines, err := r.readGitAttributesLines()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := r.GetTrackedPatterns()
+	if err != nil {
+		return nil, err
+	}
+	tracked := util.NewStringSet()
+	for _, pattern := range existing {
+		tracked.Add(pattern)
+	}
+	var added []string
+	for _, pattern := range patterns {
+		if tracked.Contains(pattern) {
+			continue
+		}
+		tracked.Add(pattern)
+		lines = append(lines, fmt.Sprintf("%v %v", pattern, strings.Join(trackAttributes, " ")))
+		added = append(added, pattern)
+	}
+	if len(added) == 0 {
+		return added, nil
+	}
+	return added, r.writeGitAttributesLines(lines)
+}
+
+// Remove path patterns from the root .gitattributes so that matching files are no longer stored
+// by git-lob. Other attributes for the patterns are kept.
+// Returns the patterns removed, patterns which weren't tracked are ignored
+func (r *Repo) UntrackPatterns(patterns []string) ([]string, error) {
+	lines, err := r.readGitAttributesLines()
+	if err != nil {
+		return nil, err
+	}
+	untrack := util.NewStringSet()
+	for _, pattern := range patterns {
+		untrack.Add(pattern)
+	}
+	removedSet := util.NewStringSet()
+	var removed []string
+	var newlines []string
+	for _, line := range lines {
+		pattern, attrs := parseGitAttributesLine(line)
+		if pattern == "" || !untrack.Contains(pattern) {
+			newlines = append(newlines, line)
+			continue
+		}
+		tracked := false
+		for _, attr := range attrs {
+			tracked = tracked || isTrackAttribute(attr)
+		}
+		if !tracked {
+			newlines = append(newlines, line)
+			continue
+		}
+		var keep []string
+		for _, attr := range attrs {
+			if attr != trackAttributes[0] && attr != trackAttributes[1] {
+				keep = append(keep, attr)
+			}
+		}
+		if len(keep) > 0 {
+			newlines = append(newlines, fmt.Sprintf("%v %v", pattern, strings.Join(keep, " ")))
+		}
+		if !removedSet.Contains(pattern) {
+			removedSet.Add(pattern)
+			removed = append(removed, pattern)
+		}
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	return removed, r.writeGitAttributesLines(newlines)
+}
+
+// Is the git-lob filter configured in git config, so that files tracked in .gitattributes are
+// actually stored by git-lob? If not, git silently stores them in git as normal
+func (r *Repo) IsLOBFilterConfigured() bool {
+	process := r.Options.GitConfig[fmt.Sprintf("filter.%v.process", LOBFilterName)]
+	if strings.Contains(process, "filter-process") {
+		return true
+	}
+	clean := r.Options.GitConfig[fmt.Sprintf("filter.%v.clean", LOBFilterName)]
+	smudge := r.Options.GitConfig[fmt.Sprintf("filter.%v.smudge", LOBFilterName)]
+	return strings.Contains(clean, "filter-clean") && strings.Contains(smudge, "filter-smudge")
+}
+
+// Convert a .gitattributes pattern to a git pathspec which matches the same files
+func gitAttributesPatternToPathspec(pattern string) string {
+	if strings.HasSuffix(pattern, "/") {
+		// Only matches directories, which never have attributes
+		return ""
+	}
+	if strings.Contains(pattern, "/") {
+		// Relative to the .gitattributes file
+		return ":(glob)" + strings.TrimPrefix(pattern, "/")
+	}
+	// Matches the file name in any directory
+	return ":(glob)**/" + pattern
+}
+
+// Get the files in the index which match .gitattributes path patterns, relative to the root of the repo
+func (r *Repo) GetGitFilesMatchingPatterns(patterns []string) ([]string, error) {
+	args := []string{"ls-files", "-z", "--"}
+	for _, pattern := range patterns {
+		if pathspec := gitAttributesPatternToPathspec(pattern); pathspec != "" {
+			args = append(args, pathspec)
+		}
+	}
+	if len(args) == 3 {
+		return []string{}, nil
+	}
+	cmd := r.command("git", args...)
+	cmd.Dir = r.Root
+	outp, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error calling 'git ls-files': %v", err.Error())
+	}
+	var ret []string
+	for _, file := range strings.Split(string(outp), "\x00") {
+		if file != "" {
+			ret = append(ret, file)
+		}
+	}
+	return ret, nil
+}
+
+// Add files (relative to the root of the repo) to the index again so that the clean filter is
+// run on them, e.g. to store files committed before they were tracked in git-lob. Files which
+// aren't in the working copy are skipped so that they aren't staged as deleted.
+// Returns the files which were restaged
+func (r *Repo) RestageFiles(files []string) ([]string, error) {
+	var present []string
+	for _, file := range files {
+		if util.FileExists(filepath.Join(r.Root, file)) {
+			present = append(present, file)
+		}
+	}
+	// git add alone doesn't re-run the filter if the file hasn't changed since it was staged
+	for _, args := range [][]string{{"rm", "--cached", "-q", "--"}, {"add", "--"}} {
+		err := r.runGitCommandOnFiles(r.Root, args, present)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return present, nil
+}
+
+// Run a git command in the root of the repo with files appended, restageBatchSize at a time
+func (r *Repo) runGitCommandOnFiles(root string, args []string, files []string) error {
+	for i := 0; i < len(files); i += restageBatchSize {
+		end := i + restageBatchSize
+		if end > len(files) {
+			end = len(files)
+		}
+		cmd := r.command("git", append(args, files[i:end]...)...)
+		cmd.Dir = root
+		outp, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Error calling 'git %v': %v\n%v", strings.Join(args, " "), err.Error(), string(outp))
+		}
+	}
+	return nil
+}
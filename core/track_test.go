@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Track", func() {
+	root := filepath.Join(os.TempDir(), "TrackTest")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		// Reset git config
+		GlobalOptions = NewOptions()
+	})
+
+	It("Tracks & untracks patterns in .gitattributes", func() {
+		Expect(ioutil.WriteFile(".gitattributes", []byte("# Existing\r\n*.txt text\r\n*.psd -diff\r\n"), 0644)).To(BeNil())
+		patterns, err := testRepo().GetTrackedPatterns()
+		Expect(err).To(BeNil())
+		Expect(patterns).To(BeEmpty())
+
+		added, err := testRepo().TrackPatterns([]string{"*.psd", "art/final/**", "*.psd"})
+		Expect(err).To(BeNil())
+		Expect(added).To(Equal([]string{"*.psd", "art/final/**"}))
+		added, err = testRepo().TrackPatterns([]string{"art/final/**", "*.png"})
+		Expect(err).To(BeNil())
+		Expect(added).To(Equal([]string{"*.png"}), "Already tracked patterns should be skipped")
+		patterns, err = testRepo().GetTrackedPatterns()
+		Expect(err).To(BeNil())
+		Expect(patterns).To(Equal([]string{"*.psd", "art/final/**", "*.png"}))
+		_, err = testRepo().TrackPatterns([]string{"my file.psd"})
+		Expect(err).ToNot(BeNil(), "Patterns with spaces should be rejected")
+
+		Expect(ioutil.WriteFile(".gitattributes", []byte("*.txt text\n*.psd -diff filter=lob -crlf\n*.png filter=lob -crlf\n"), 0644)).To(BeNil())
+		removed, err := testRepo().UntrackPatterns([]string{"*.psd", "*.png", "*.txt", "*.mov"})
+		Expect(err).To(BeNil())
+		Expect(removed).To(Equal([]string{"*.psd", "*.png"}), "Only tracked patterns should be removed")
+		content, _ := ioutil.ReadFile(".gitattributes")
+		Expect(string(content)).To(Equal("*.txt text\n*.psd -diff\n"), "Other attributes should be kept")
+	})
+
+	It("Checks the filter is configured & restages committed files", func() {
+		LoadConfig(GlobalOptions)
+		Expect(testRepo().IsLOBFilterConfigured()).To(BeFalse())
+
+		// Commit files before they're tracked
+		os.MkdirAll(filepath.Join("art", "final"), 0755)
+		files := map[string]string{
+			"img1.psd":                              "image one",
+			filepath.Join("art", "img2.psd"):        "image two",
+			filepath.Join("art", "final", "a.tga"):  "final art",
+			filepath.Join("art", "scratch.tga"):     "scratch art",
+			filepath.Join("art", "final", "b.psd"):  "deleted image",
+			filepath.Join("art", "final", "readme"): "not art",
+		}
+		for file, content := range files {
+			Expect(ioutil.WriteFile(file, []byte(content), 0644)).To(BeNil())
+		}
+		RunGitCommandForTest(true, "add", ".")
+		RunGitCommandForTest(true, "commit", "-m", "Initial")
+		os.Remove(filepath.Join("art", "final", "b.psd"))
+
+		// Stand-in for git-lob so that we can see which files were cleaned
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_APPEND, 0644)
+		Expect(err).To(BeNil())
+		f.WriteString(fmt.Sprintf(`
+[filter "%v"]
+    clean = "sh -c 'tr a-z A-Z' filter-clean %%f"
+    smudge = "sh -c cat filter-smudge %%f"
+`, LOBFilterName))
+		f.Close()
+		LoadConfig(GlobalOptions)
+		Expect(testRepo().IsLOBFilterConfigured()).To(BeTrue())
+
+		patterns := []string{"*.psd", "art/final/*.tga"}
+		_, err = testRepo().TrackPatterns(patterns)
+		Expect(err).To(BeNil())
+		matched, err := testRepo().GetGitFilesMatchingPatterns(patterns)
+		Expect(err).To(BeNil())
+		Expect(matched).To(ConsistOf("img1.psd", "art/img2.psd", "art/final/a.tga", "art/final/b.psd"))
+		restaged, err := testRepo().RestageFiles(matched)
+		Expect(err).To(BeNil())
+		Expect(restaged).To(ConsistOf("img1.psd", "art/img2.psd", "art/final/a.tga"), "Files not in the working copy should be skipped")
+
+		Expect(RunGitCommandForTest(true, "show", ":img1.psd")).To(Equal("IMAGE ONE"))
+		Expect(RunGitCommandForTest(true, "show", ":art/final/a.tga")).To(Equal("FINAL ART"))
+		Expect(RunGitCommandForTest(true, "show", ":art/scratch.tga")).To(Equal("scratch art"), "Unmatched files should be unchanged")
+		Expect(RunGitCommandForTest(true, "show", ":art/final/b.psd")).To(Equal("deleted image"), "Missing files shouldn't be staged as deleted")
+	})
+})
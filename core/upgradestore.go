@@ -0,0 +1,453 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Upgrading the store converts binaries already in the local store to the current storage
+// settings (git-lob.chunking, git-lob.chunk-size & git-lob.compression), which otherwise only
+// apply to binaries stored from then on. Placeholders committed to git only contain the SHA of
+// the content, so they don't change and resolve to the converted binaries transparently; stores
+// with a mix of formats are always readable, so the conversion can be staged over several runs.
+// The original files of each converted binary are kept in a backup until the upgrade is
+// finished, so it can be rolled back. A journal records the plan & each binary converted so
+// an interrupted upgrade can be resumed; a binary interrupted part way through is restored
+// from the backup when it's next needed (see restoreLOBFromUpgradeBackup).
+// The clean filter is the other side of this: placeholders committed before settings changed
+// (git-lob.hash-algorithm & git-lob.placeholder-metadata as well as the storage settings) are
+// kept exactly as they are while the content stays the same (see isPlaceholderCompatible), so
+// files don't show as modified when git cleans them again.
+
+const (
+	// First line of upgrade journal files
+	upgradeJournalHeader = "git-lob-upgrade-store 1"
+	// Record for a binary converted: converted <sha>
+	upgradeJournalConverted = "converted"
+)
+
+type UpgradeStoreCallbackType int
+
+const (
+	// Upgrade is working on LOBSHA
+	UpgradeStoreWorking UpgradeStoreCallbackType = iota
+	// Binary was converted to the new format
+	UpgradeStoreConverted UpgradeStoreCallbackType = iota
+	// Binary was not converted because it's incomplete locally
+	UpgradeStoreSkipped UpgradeStoreCallbackType = iota
+	// Binary could not be converted, it's been left in its original format
+	UpgradeStoreError UpgradeStoreCallbackType = iota
+)
+
+// Collected callback data for an upgrade
+// When in dry run mode the same callbacks are made even though nothing is changed
+type UpgradeStoreCallbackData struct {
+	// What's happening
+	Type UpgradeStoreCallbackType
+	// The binary being converted
+	LOBSHA string
+	// Number of binaries processed so far (including this one) & in total
+	Done  int
+	Total int
+	// Size stored before & after conversion, for UpgradeStoreConverted
+	OldSize int64
+	NewSize int64
+	// Error details for UpgradeStoreError
+	Error error
+}
+
+// The state of a staged upgrade
+type upgradeJournal struct {
+	// Settings being upgraded to
+	Chunking    string
+	Compression string
+	// All the binaries to convert, in order
+	SHAs []string
+
+	repo *Repo
+	// Binaries converted so far
+	converted util.StringSet
+}
+
+// Gets the folder which holds the state of a staged upgrade
+func (r *Repo) getUpgradeStoreDir() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "upgrade_store")
+}
+
+func (r *Repo) getUpgradeJournalFile() string {
+	return filepath.Join(r.getUpgradeStoreDir(), "journal")
+}
+
+// Gets the folder which holds the original files of converted binaries, laid out like the store
+func (r *Repo) getUpgradeBackupDir() string {
+	return filepath.Join(r.getUpgradeStoreDir(), "backup")
+}
+
+// Is there a staged upgrade which hasn't been finished or rolled back?
+func (r *Repo) IsUpgradeStoreInProgress() bool {
+	return util.FileExists(r.getUpgradeJournalFile())
+}
+
+// Does a LOB need converting to be stored with the current settings?
+func (r *Repo) lobNeedsUpgrade(info *LOBInfo) bool {
+	if r.Options.Chunking == ChunkingContentDefined {
+		return info.Version != LOBInfoVersionChunkObjects
+	}
+	return info.Version == LOBInfoVersionChunkObjects || info.Compression != r.Options.Compression ||
+		getLOBFixedChunkSize(info) != r.getNewLOBChunkSize()
+}
+
+// Can a placeholder committed for a file be kept as it is for content stored as info? It can if
+// it's for the same binary, whichever format it's in; only metadata which gets the size wrong
+// means it has to be rewritten
+func isPlaceholderCompatible(placeholder *LOBPlaceholder, info *LOBInfo) bool {
+	return placeholder.SHA == info.SHA && (placeholder.Size < 0 || placeholder.Size == info.Size)
+}
+
+// Read the upgrade journal, or nil if there isn't one
+func (r *Repo) readUpgradeJournal() (*upgradeJournal, error) {
+	filename := r.getUpgradeJournalFile()
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read upgrade journal %v: %v", filename, err.Error())
+	}
+	defer f.Close()
+	rdr := bufio.NewReader(f)
+	// Only complete lines count, an interruption could leave a partial last line
+	readLine := func() (string, bool) {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			return "", false
+		}
+		return strings.TrimRight(line, "\r\n"), true
+	}
+	if line, ok := readLine(); !ok || line != upgradeJournalHeader {
+		return nil, fmt.Errorf("Upgrade journal %v is not valid", filename)
+	}
+	plan, ok := readLine()
+	if !ok {
+		return nil, fmt.Errorf("Upgrade journal %v is not valid", filename)
+	}
+	j := &upgradeJournal{repo: r}
+	err = json.Unmarshal([]byte(plan), j)
+	if err != nil {
+		return nil, fmt.Errorf("Upgrade journal %v is not valid: %v", filename, err.Error())
+	}
+	j.converted = util.NewStringSet()
+	for line, ok := readLine(); ok; line, ok = readLine() {
+		// Ignore anything we don't understand
+		fields := strings.Split(line, " ")
+		if len(fields) == 2 && fields[0] == upgradeJournalConverted && IsLOBSHA(fields[1]) {
+			j.converted.Add(fields[1])
+		}
+	}
+	return j, nil
+}
+
+// Write the plan, replacing the whole journal
+func (j *upgradeJournal) writePlan() error {
+	planbytes, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	filename := j.repo.getUpgradeJournalFile()
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to create upgrade journal folder: %v", err.Error()))
+	}
+	err = ioutil.WriteFile(filename, []byte(fmt.Sprintf("%v\n%v\n", upgradeJournalHeader, string(planbytes))), 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to write upgrade journal %v: %v", filename, err.Error()))
+	}
+	return nil
+}
+
+// Record that a LOB has been converted
+func (j *upgradeJournal) markConverted(sha string) error {
+	j.converted.Add(sha)
+	filename := j.repo.getUpgradeJournalFile()
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%v %v\n", upgradeJournalConverted, sha)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to update upgrade journal %v: %v", filename, err.Error()))
+	}
+	return nil
+}
+
+// Move the files of a LOB itself from one base dir to another
+func (r *Repo) moveLOBOwnFiles(sha, fromdir, todir string) error {
+	// Chunk objects may be shared with other LOBs, so are never moved
+	names, err := getLOBOwnFilesInStore(sha, fromdir)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		rel, err := filepath.Rel(fromdir, n)
+		if err != nil {
+			return err
+		}
+		dest := r.getLOBStoreFilePathCreatingDir(todir, convertLOBStoreRelativePath(rel, LOBStoreLayoutOriginal))
+		err = os.Rename(n, dest)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to move %v to %v: %v", n, dest, err))
+		}
+	}
+	return nil
+}
+
+// Replace whatever is stored for a LOB with its original files from the upgrade backup
+// Returns false if the backup has nothing for it
+func (r *Repo) restoreLOBFromUpgradeBackupInBaseDir(sha, basedir string) (bool, error) {
+	backup := r.getUpgradeBackupDir()
+	if !util.FileExists(r.GetLOBMetaPathInBaseDir(backup, sha)) {
+		return false, nil
+	}
+	err := r.DeleteLOBInBaseDir(sha, basedir)
+	if err != nil {
+		return false, err
+	}
+	err = r.moveLOBOwnFiles(sha, backup, basedir)
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Unable to restore %v from upgrade backup: %v", sha, err.Error()))
+	}
+	return true, nil
+}
+
+// Restore a LOB which is missing from the local store because converting it was interrupted
+func (r *Repo) restoreLOBFromUpgradeBackup(sha string) (bool, error) {
+	if !r.IsUpgradeStoreInProgress() {
+		return false, nil
+	}
+	return r.restoreLOBFromUpgradeBackupInBaseDir(sha, r.GetLocalLOBRoot())
+}
+
+// Get the SHAs of chunk objects referenced by the original files of converted binaries, which
+// mustn't be pruned until the upgrade is finished
+func (r *Repo) getUpgradeBackupReferencedChunkObjects() (util.StringSet, error) {
+	backup := r.getUpgradeBackupDir()
+	if !util.DirExists(backup) {
+		return util.NewStringSet(), nil
+	}
+	return r.getReferencedChunkObjectsInBaseDir(backup)
+}
+
+// Convert a single LOB in the local store to the current settings, keeping the original files
+// in the backup. If anything goes wrong the original files are put back
+func (r *Repo) upgradeLOB(sha string, info *LOBInfo) (*LOBInfo, error) {
+	root := r.GetLocalLOBRoot()
+	// Read the content out first so the store is only changed once we know it's OK
+	tmpf, err := ioutil.TempFile("", "git-lob-upgrade")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to create temporary file: %v", err.Error()))
+	}
+	defer os.Remove(tmpf.Name())
+	defer tmpf.Close()
+	n, err := r.copyLOBContentRangeInBaseDir(root, info, 0, info.Size, tmpf)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to read %v: %v", sha, err.Error()))
+	}
+	if n != info.Size {
+		return nil, errors.New(fmt.Sprintf("Unable to read %v: read %d bytes, expected %d", sha, n, info.Size))
+	}
+	_, err = tmpf.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.moveLOBOwnFiles(sha, root, r.getUpgradeBackupDir())
+	if err != nil {
+		r.restoreLOBFromUpgradeBackupInBaseDir(sha, root)
+		return nil, err
+	}
+	newinfo, err := r.storeLOBInBaseDirWithSettings(root, tmpf, nil, GetLOBSHAAlgorithm(sha))
+	if err == nil && newinfo.SHA != sha {
+		err = NewIntegrityErrorWithAdditionalMessage([]string{sha}, "content does not match SHA, left unconverted")
+	}
+	if err != nil {
+		if newinfo != nil && newinfo.SHA != sha {
+			r.DeleteLOBInBaseDir(newinfo.SHA, root)
+		}
+		if _, rerr := r.restoreLOBFromUpgradeBackupInBaseDir(sha, root); rerr != nil {
+			r.Log.Errorf("%v\n", rerr.Error())
+		}
+		return nil, err
+	}
+	if info.Signature != "" && newinfo.Signature == "" {
+		// The original metadata is in the backup, so its signature wasn't kept
+		newinfo.Signature = info.Signature
+		if err = r.StoreLOBInfoInBaseDir(root, newinfo); err != nil {
+			return nil, err
+		}
+	}
+	return newinfo, nil
+}
+
+// Convert the binaries in the local store to the current storage settings (see above)
+// If an upgrade to the same settings was interrupted, carries on where it left off; an upgrade
+// to different settings must be finished or rolled back first
+func (r *Repo) UpgradeStore(dryRun bool, callback func(data *UpgradeStoreCallbackData) (quit bool)) error {
+	if r.IsUsingSharedStorage() {
+		return errors.New("Upgrading a shared store is not supported, every repository using it would need upgrading at once")
+	}
+	j, err := r.readUpgradeJournal()
+	if err != nil {
+		return err
+	}
+	if j != nil && (j.Chunking != r.Options.Chunking || j.Compression != r.Options.Compression) {
+		return fmt.Errorf("An upgrade to different settings (chunking '%v', compression '%v') is in progress, finish or roll it back first",
+			j.Chunking, j.Compression)
+	}
+	root := r.GetLocalLOBRoot()
+	if j == nil {
+		shas, err := getAllLOBSHAsInDir(root)
+		if err != nil {
+			return err
+		}
+		j = &upgradeJournal{Chunking: r.Options.Chunking, Compression: r.Options.Compression,
+			repo: r, converted: util.NewStringSet()}
+		for sha := range shas.Iter() {
+			info, err := r.getLOBInfoInBaseDir(sha, root)
+			if err == nil && r.lobNeedsUpgrade(info) {
+				j.SHAs = append(j.SHAs, sha)
+			}
+		}
+		sort.Strings(j.SHAs)
+		if len(j.SHAs) == 0 || dryRun {
+			// Nothing to stage
+			for i, sha := range j.SHAs {
+				info, _ := r.getLOBInfoInBaseDir(sha, root)
+				data := &UpgradeStoreCallbackData{Type: UpgradeStoreConverted, LOBSHA: sha, Done: i + 1, Total: len(j.SHAs),
+					OldSize: getLOBStoredSize(info)}
+				if r.CheckLOBFilesForSHA(sha, root, false) != nil {
+					data.Type = UpgradeStoreSkipped
+				}
+				if callback(data) {
+					break
+				}
+			}
+			return nil
+		}
+		err = j.writePlan()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, sha := range j.SHAs {
+		done := i + 1
+		if j.converted.Contains(sha) {
+			continue
+		}
+		if callback(&UpgradeStoreCallbackData{Type: UpgradeStoreWorking, LOBSHA: sha, Done: done, Total: len(j.SHAs)}) {
+			break
+		}
+		if !dryRun {
+			// Interrupted part way through last time?
+			if _, err := r.restoreLOBFromUpgradeBackupInBaseDir(sha, root); err != nil {
+				return err
+			}
+		}
+		info, err := r.getLOBInfoInBaseDir(sha, root)
+		if err != nil || r.CheckLOBFilesForSHA(sha, root, false) != nil {
+			// Pruned or incomplete, nothing to convert
+			if callback(&UpgradeStoreCallbackData{Type: UpgradeStoreSkipped, LOBSHA: sha, Done: done, Total: len(j.SHAs)}) {
+				break
+			}
+			continue
+		}
+		data := &UpgradeStoreCallbackData{Type: UpgradeStoreConverted, LOBSHA: sha, Done: done, Total: len(j.SHAs),
+			OldSize: getLOBStoredSize(info)}
+		if !dryRun && r.lobNeedsUpgrade(info) {
+			newinfo, err := r.upgradeLOB(sha, info)
+			if err != nil {
+				if callback(&UpgradeStoreCallbackData{Type: UpgradeStoreError, LOBSHA: sha, Done: done, Total: len(j.SHAs), Error: err}) {
+					break
+				}
+				continue
+			}
+			data.NewSize = getLOBStoredSize(newinfo)
+			err = j.markConverted(sha)
+			if err != nil {
+				return err
+			}
+		}
+		if callback(data) {
+			break
+		}
+	}
+	return nil
+}
+
+// Finish a staged upgrade, deleting the original files of converted binaries so that it can
+// no longer be rolled back. Returns the number of binaries converted
+func (r *Repo) FinishUpgradeStore() (int, error) {
+	j, err := r.readUpgradeJournal()
+	if err != nil {
+		return 0, err
+	}
+	if j == nil {
+		return 0, errors.New("No upgrade is in progress")
+	}
+	err = os.RemoveAll(r.getUpgradeBackupDir())
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Unable to delete upgrade backup: %v", err.Error()))
+	}
+	err = os.Remove(r.getUpgradeJournalFile())
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Unable to delete upgrade journal: %v", err.Error()))
+	}
+	// Chunk objects only the originals used aren't needed any more
+	r.pruneLocalChunkObjects()
+	return j.converted.Cardinality(), nil
+}
+
+// Roll back a staged upgrade, putting the original files of every converted binary back
+// Returns the number of binaries restored
+func (r *Repo) RollbackUpgradeStore(callback func(data *UpgradeStoreCallbackData) (quit bool)) (int, error) {
+	j, err := r.readUpgradeJournal()
+	if err != nil {
+		return 0, err
+	}
+	if j == nil {
+		return 0, errors.New("No upgrade is in progress")
+	}
+	root := r.GetLocalLOBRoot()
+	var restored int
+	var errs []string
+	for i, sha := range j.SHAs {
+		callback(&UpgradeStoreCallbackData{Type: UpgradeStoreWorking, LOBSHA: sha, Done: i + 1, Total: len(j.SHAs)})
+		// Includes one interrupted part way through, which isn't marked converted
+		ok, err := r.restoreLOBFromUpgradeBackupInBaseDir(sha, root)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else if ok {
+			restored++
+		}
+	}
+	if len(errs) > 0 {
+		// Keep the journal & backup so it can be tried again
+		return restored, fmt.Errorf("Unable to roll back the upgrade completely:\n%v", strings.Join(errs, "\n"))
+	}
+	os.RemoveAll(r.getUpgradeStoreDir())
+	// Chunk objects only the converted binaries used aren't needed any more
+	r.pruneLocalChunkObjects()
+	return restored, nil
+}
@@ -0,0 +1,222 @@
+package core
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Upgrade store", func() {
+	root := filepath.Join(os.TempDir(), "UpgradeStoreTest")
+	var oldwd string
+	var contents [][]byte
+	var shas []string
+	var oldChunking, oldCompression string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		oldChunking = GlobalOptions.Chunking
+		oldCompression = GlobalOptions.Compression
+		GlobalOptions.Chunking = ChunkingFixed
+		GlobalOptions.Compression = CompressionNone
+
+		contents = nil
+		shas = nil
+		for i := 0; i < 3; i++ {
+			// Compressible so that sizes change
+			content := bytes.Repeat([]byte{byte('a' + i)}, 100*1024)
+			cryptorand.Read(content[:100])
+			info, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+			Expect(err).To(BeNil())
+			contents = append(contents, content)
+			shas = append(shas, info.SHA)
+		}
+	})
+	AfterEach(func() {
+		GlobalOptions.Chunking = oldChunking
+		GlobalOptions.Compression = oldCompression
+		GlobalOptions.HashAlgorithm = HashAlgorithmSHA1
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+	})
+
+	countCallbacks := func(counts map[UpgradeStoreCallbackType]int) func(data *UpgradeStoreCallbackData) bool {
+		return func(data *UpgradeStoreCallbackData) bool {
+			counts[data.Type]++
+			return false
+		}
+	}
+	expectContent := func(desc string) {
+		for i, sha := range shas {
+			var buf bytes.Buffer
+			_, err := testRepo().RetrieveLOB(sha, &buf)
+			Expect(err).To(BeNil(), desc)
+			Expect(buf.Bytes()).To(Equal(contents[i]), desc)
+		}
+	}
+	expectCompression := func(codec, desc string) {
+		for _, sha := range shas {
+			info, err := testRepo().GetLOBInfo(sha)
+			Expect(err).To(BeNil(), desc)
+			Expect(info.Compression).To(Equal(codec), desc)
+		}
+	}
+
+	It("Converts, rolls back & finishes", func() {
+		GlobalOptions.Compression = CompressionZstd
+		counts := make(map[UpgradeStoreCallbackType]int)
+		Expect(testRepo().UpgradeStore(true, countCallbacks(counts))).To(BeNil())
+		Expect(counts[UpgradeStoreConverted]).To(Equal(3), "Dry run should report all binaries")
+		Expect(testRepo().IsUpgradeStoreInProgress()).To(BeFalse(), "Dry run should not stage anything")
+		expectCompression(CompressionNone, "Dry run should not change anything")
+
+		counts = make(map[UpgradeStoreCallbackType]int)
+		Expect(testRepo().UpgradeStore(false, countCallbacks(counts))).To(BeNil())
+		Expect(counts[UpgradeStoreConverted]).To(Equal(3))
+		Expect(counts[UpgradeStoreError]).To(Equal(0))
+		Expect(testRepo().IsUpgradeStoreInProgress()).To(BeTrue())
+		expectCompression(CompressionZstd, "Should be converted")
+		expectContent("Converted content should be readable")
+
+		GlobalOptions.Compression = CompressionGzip
+		Expect(testRepo().UpgradeStore(false, countCallbacks(counts))).ToNot(BeNil(), "Can't upgrade to other settings while staged")
+		GlobalOptions.Compression = CompressionZstd
+
+		n, err := testRepo().RollbackUpgradeStore(countCallbacks(counts))
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(3))
+		Expect(testRepo().IsUpgradeStoreInProgress()).To(BeFalse())
+		expectCompression(CompressionNone, "Should be restored")
+		expectContent("Restored content should be readable")
+
+		Expect(testRepo().UpgradeStore(false, countCallbacks(counts))).To(BeNil())
+		n, err = testRepo().FinishUpgradeStore()
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(3))
+		Expect(testRepo().IsUpgradeStoreInProgress()).To(BeFalse())
+		Expect(DirExists(testRepo().getUpgradeBackupDir())).To(BeFalse(), "Originals should be deleted")
+		expectCompression(CompressionZstd, "Should stay converted")
+		expectContent("Converted content should be readable")
+
+		counts = make(map[UpgradeStoreCallbackType]int)
+		Expect(testRepo().UpgradeStore(false, countCallbacks(counts))).To(BeNil())
+		Expect(counts[UpgradeStoreConverted]).To(Equal(0), "Nothing left to convert")
+		Expect(testRepo().IsUpgradeStoreInProgress()).To(BeFalse())
+	})
+
+	It("Keeps the SHAs of binaries stored with another hash", func() {
+		GlobalOptions.HashAlgorithm = HashAlgorithmSHA256
+		GlobalOptions.Compression = CompressionZstd
+		counts := make(map[UpgradeStoreCallbackType]int)
+		Expect(testRepo().UpgradeStore(false, countCallbacks(counts))).To(BeNil())
+		Expect(counts[UpgradeStoreConverted]).To(Equal(3))
+		Expect(counts[UpgradeStoreError]).To(Equal(0), "SHA-1 binaries should be re-stored with SHA-1")
+		n, err := testRepo().FinishUpgradeStore()
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(3))
+		expectCompression(CompressionZstd, "Should be converted")
+		expectContent("Converted content should be readable")
+	})
+
+	It("Resumes interrupted upgrades", func() {
+		GlobalOptions.Compression = CompressionGzip
+		// Stop after the first binary
+		var converted []string
+		err := testRepo().UpgradeStore(false, func(data *UpgradeStoreCallbackData) bool {
+			if data.Type == UpgradeStoreConverted {
+				converted = append(converted, data.LOBSHA)
+			}
+			return len(converted) > 0
+		})
+		Expect(err).To(BeNil())
+		Expect(converted).To(HaveLen(1))
+		// Simulate being interrupted part way through another, after moving its originals
+		var interrupted string
+		for _, sha := range shas {
+			if sha != converted[0] {
+				interrupted = sha
+				break
+			}
+		}
+		Expect(testRepo().moveLOBOwnFiles(interrupted, testRepo().GetLocalLOBRoot(), testRepo().getUpgradeBackupDir())).To(BeNil())
+		// Still readable meanwhile
+		expectContent("Should resolve binaries while upgrade is interrupted")
+
+		counts := make(map[UpgradeStoreCallbackType]int)
+		Expect(testRepo().UpgradeStore(false, countCallbacks(counts))).To(BeNil())
+		Expect(counts[UpgradeStoreConverted]).To(Equal(2), "Should only convert the rest")
+		expectCompression(CompressionGzip, "Should all be converted")
+		expectContent("Converted content should be readable")
+	})
+
+	It("Resumes upgrades of SHA-256 binaries", func() {
+		GlobalOptions.HashAlgorithm = HashAlgorithmSHA256
+		content := bytes.Repeat([]byte{'z'}, 100*1024)
+		info, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+		Expect(err).To(BeNil())
+		Expect(info.SHA).To(HaveLen(SHA256Len))
+		GlobalOptions.Compression = CompressionGzip
+		// Stop once the SHA-256 binary is converted
+		err = testRepo().UpgradeStore(false, func(data *UpgradeStoreCallbackData) bool {
+			return data.Type == UpgradeStoreConverted && data.LOBSHA == info.SHA
+		})
+		Expect(err).To(BeNil())
+		j, err := testRepo().readUpgradeJournal()
+		Expect(err).To(BeNil())
+		Expect(j.converted.Contains(info.SHA)).To(BeTrue(), "SHA-256 binary should be recorded as converted")
+	})
+
+	It("Keeps original chunk objects until finished", func() {
+		// Start with content-defined chunks, upgrade to fixed
+		for _, sha := range shas {
+			testRepo().DeleteLOB(sha)
+		}
+		GlobalOptions.Chunking = ChunkingContentDefined
+		for _, content := range contents {
+			_, err := testRepo().StoreLOB(bytes.NewReader(content), nil)
+			Expect(err).To(BeNil())
+		}
+		countObjects := func() int {
+			var n int
+			walkChunkObjectsInBaseDir(testRepo().GetLocalLOBRoot(), func(chunksha, path string) { n++ })
+			return n
+		}
+		objects := countObjects()
+		Expect(objects).To(BeNumerically(">", 0))
+
+		GlobalOptions.Chunking = ChunkingFixed
+		counts := make(map[UpgradeStoreCallbackType]int)
+		Expect(testRepo().UpgradeStore(false, countCallbacks(counts))).To(BeNil())
+		Expect(counts[UpgradeStoreConverted]).To(Equal(3))
+		testRepo().pruneLocalChunkObjects()
+		Expect(countObjects()).To(Equal(objects), "Chunk objects of originals should be kept while staged")
+
+		_, err := testRepo().RollbackUpgradeStore(countCallbacks(counts))
+		Expect(err).To(BeNil())
+		expectContent("Restored content should be readable")
+
+		Expect(testRepo().UpgradeStore(false, countCallbacks(counts))).To(BeNil())
+		_, err = testRepo().FinishUpgradeStore()
+		Expect(err).To(BeNil())
+		Expect(countObjects()).To(Equal(0), "Chunk objects should be pruned when finished")
+		expectContent("Converted content should be readable")
+	})
+
+	It("Keeps committed placeholders of any format for the same content", func() {
+		sha := GetListOfRandomSHAsForTest(1)[0]
+		info := &LOBInfo{SHA: sha, Size: 100}
+		Expect(isPlaceholderCompatible(&LOBPlaceholder{SHA: sha, Size: -1}, info)).To(BeTrue(), "No metadata")
+		Expect(isPlaceholderCompatible(&LOBPlaceholder{SHA: sha, Size: 100, Type: "png"}, info)).To(BeTrue(), "Correct metadata")
+		Expect(isPlaceholderCompatible(&LOBPlaceholder{SHA: sha, Size: 99}, info)).To(BeFalse(), "Wrong size")
+		Expect(isPlaceholderCompatible(&LOBPlaceholder{SHA: GetListOfRandomSHAsForTest(1)[0], Size: -1}, info)).To(BeFalse(), "Changed content")
+	})
+})
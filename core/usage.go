@@ -0,0 +1,190 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+	"github.com/atlassian/git-lob/util/lock"
+)
+
+// Transfer usage accounting ('git lob usage')
+// Bytes uploaded & downloaded by push & fetch (including auto-fetch) are added up per day &
+// remote in a small ledger in the repo, so that teams paying for transfers from cloud storage
+// can see where it's going. Only items which were fully transferred are counted, the same as
+// the totals reported at the end of a push or fetch.
+
+// Date format of days in the ledger
+const usageDayFormat = "2006-01-02"
+
+// How long to wait for another process recording usage
+var UsageLedgerLockTimeout = 10 * time.Second
+
+// Bytes transferred to & from a remote
+type TransferUsage struct {
+	Downloaded int64
+	Uploaded   int64
+}
+
+// All recorded transfers, by day (YYYY-MM-DD, local time) then remote name
+type TransferUsageLedger struct {
+	Days map[string]map[string]*TransferUsage
+}
+
+// Transfers for one period & remote, for reporting
+type TransferUsageEntry struct {
+	// Day (YYYY-MM-DD) or month (YYYY-MM)
+	Period     string
+	Remote     string
+	Downloaded int64
+	Uploaded   int64
+}
+
+type transferUsageEntriesByPeriod []*TransferUsageEntry
+
+func (a transferUsageEntriesByPeriod) Len() int      { return len(a) }
+func (a transferUsageEntriesByPeriod) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a transferUsageEntriesByPeriod) Less(i, j int) bool {
+	if a[i].Period != a[j].Period {
+		return a[i].Period < a[j].Period
+	}
+	return a[i].Remote < a[j].Remote
+}
+
+func (r *Repo) getUsageLedgerFile() string {
+	return filepath.Join(r.GitDir, "git-lob", "state", "transfer_usage")
+}
+
+// Load the transfer usage ledger from the repo (empty if nothing recorded yet)
+func (r *Repo) LoadTransferUsage() (*TransferUsageLedger, error) {
+	ledger := &TransferUsageLedger{Days: make(map[string]map[string]*TransferUsage)}
+	data, err := ioutil.ReadFile(r.getUsageLedgerFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ledger, nil
+		}
+		return ledger, err
+	}
+	err = json.Unmarshal(data, ledger)
+	if err != nil {
+		return &TransferUsageLedger{Days: make(map[string]map[string]*TransferUsage)},
+			fmt.Errorf("Unable to read transfer usage in %v: %v", r.getUsageLedgerFile(), err.Error())
+	}
+	if ledger.Days == nil {
+		ledger.Days = make(map[string]map[string]*TransferUsage)
+	}
+	return ledger, nil
+}
+
+// Add bytes transferred to & from a remote to the ledger, against the day of when
+func (r *Repo) RecordTransferUsage(remoteName string, downloaded, uploaded int64, when time.Time) error {
+	if downloaded == 0 && uploaded == 0 {
+		return nil
+	}
+	file := r.getUsageLedgerFile()
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	// Other processes (e.g. auto-fetch in filters) may be recording at the same time
+	l, err := lock.Acquire(file+".lock", UsageLedgerLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	ledger, err := r.LoadTransferUsage()
+	if err != nil {
+		// Don't let a corrupt ledger stop us recording from now on
+		r.Log.Errorf("%v, starting again\n", err.Error())
+	}
+	day := when.Format(usageDayFormat)
+	remotes, ok := ledger.Days[day]
+	if !ok {
+		remotes = make(map[string]*TransferUsage)
+		ledger.Days[day] = remotes
+	}
+	usage, ok := remotes[remoteName]
+	if !ok {
+		usage = &TransferUsage{}
+		remotes[remoteName] = usage
+	}
+	usage.Downloaded += downloaded
+	usage.Uploaded += uploaded
+
+	data, err := json.Marshal(ledger)
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first so an interrupted write can't lose the history
+	tmpfile := file + ".tmp"
+	err = ioutil.WriteFile(tmpfile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, file)
+}
+
+// Summarise transfers on or after since, per day or per month & remote, in date then remote order
+// If remoteName is not blank only that remote is included
+func (self *TransferUsageLedger) Summarise(since time.Time, remoteName string, monthly bool) []*TransferUsageEntry {
+	sinceDay := since.Format(usageDayFormat)
+	entries := make(map[string]*TransferUsageEntry)
+	for day, remotes := range self.Days {
+		if day < sinceDay {
+			continue
+		}
+		period := day
+		if monthly && len(day) >= 7 {
+			period = day[:7]
+		}
+		for remote, usage := range remotes {
+			if remoteName != "" && remote != remoteName {
+				continue
+			}
+			key := period + " " + remote
+			entry, ok := entries[key]
+			if !ok {
+				entry = &TransferUsageEntry{Period: period, Remote: remote}
+				entries[key] = entry
+			}
+			entry.Downloaded += usage.Downloaded
+			entry.Uploaded += usage.Uploaded
+		}
+	}
+	ret := make([]*TransferUsageEntry, 0, len(entries))
+	for _, entry := range entries {
+		ret = append(ret, entry)
+	}
+	sort.Sort(transferUsageEntriesByPeriod(ret))
+	return ret
+}
+
+// Wrap a progress callback to count the bytes of items transferred to or from a remote
+// Call the returned function when the transfer is over (successful or not) to record them
+func (r *Repo) trackTransferUsage(remoteName string, upload bool, callback util.ProgressCallback) (util.ProgressCallback, func()) {
+	var transferred int64
+	wrapped := func(data *util.ProgressCallbackData) (abort bool) {
+		if data.Type == util.ProgressTransferBytes && data.ItemBytes > 0 && data.ItemBytesDone == data.ItemBytes {
+			transferred += data.ItemBytes
+		}
+		return callback(data)
+	}
+	record := func() {
+		var err error
+		if upload {
+			err = r.RecordTransferUsage(remoteName, 0, transferred, time.Now())
+		} else {
+			err = r.RecordTransferUsage(remoteName, transferred, 0, time.Now())
+		}
+		if err != nil {
+			r.Log.Errorf("Unable to record transfer usage for %v: %v\n", remoteName, err.Error())
+		}
+	}
+	return wrapped, record
+}
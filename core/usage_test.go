@@ -0,0 +1,75 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Transfer usage", func() {
+	root := filepath.Join(os.TempDir(), "UsageTest")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+	})
+
+	It("Records & summarises transfers per day & remote", func() {
+		ledger, err := testRepo().LoadTransferUsage()
+		Expect(err).To(BeNil())
+		Expect(ledger.Summarise(time.Time{}, "", false)).To(BeEmpty(), "Nothing recorded yet")
+
+		// Only fully transferred items count
+		var passedOn int
+		callback := func(data *ProgressCallbackData) (abort bool) {
+			passedOn++
+			return false
+		}
+		wrapped, record := testRepo().trackTransferUsage("origin", false, callback)
+		wrapped(&ProgressCallbackData{ProgressCalculate, "Calculating", 0, 0, 0, 0, nil})
+		wrapped(&ProgressCallbackData{ProgressTransferBytes, "file1", 50, 100, 50, 300, nil})
+		wrapped(&ProgressCallbackData{ProgressTransferBytes, "file1", 100, 100, 100, 300, nil})
+		wrapped(&ProgressCallbackData{ProgressSkip, "file2", 150, 150, 250, 300, nil})
+		wrapped(&ProgressCallbackData{ProgressTransferBytes, "file3", 50, 50, 300, 300, nil})
+		record()
+		Expect(passedOn).To(Equal(5), "Should pass everything on")
+
+		wrapped, record = testRepo().trackTransferUsage("origin", true, callback)
+		wrapped(&ProgressCallbackData{ProgressTransferBytes, "file4", 1000, 1000, 1000, 1000, nil})
+		record()
+		wrapped, record = testRepo().trackTransferUsage("cache", false, callback)
+		record()
+
+		today := time.Now()
+		lastMonth := today.AddDate(0, -1, 0)
+		Expect(testRepo().RecordTransferUsage("cache", 2000, 0, lastMonth)).To(BeNil())
+		Expect(testRepo().RecordTransferUsage("cache", 500, 0, lastMonth)).To(BeNil())
+
+		ledger, err = testRepo().LoadTransferUsage()
+		Expect(err).To(BeNil())
+		day, month := today.Format("2006-01-02"), today.Format("2006-01")
+		lastDay, lastMonthStr := lastMonth.Format("2006-01-02"), lastMonth.Format("2006-01")
+		Expect(ledger.Summarise(time.Time{}, "", false)).To(Equal([]*TransferUsageEntry{
+			{Period: lastDay, Remote: "cache", Downloaded: 2500},
+			{Period: day, Remote: "origin", Downloaded: 150, Uploaded: 1000},
+		}), "Transfers of nothing shouldn't be recorded")
+		Expect(ledger.Summarise(time.Time{}, "cache", true)).To(Equal([]*TransferUsageEntry{
+			{Period: lastMonthStr, Remote: "cache", Downloaded: 2500},
+		}))
+		Expect(ledger.Summarise(today, "", true)).To(Equal([]*TransferUsageEntry{
+			{Period: month, Remote: "origin", Downloaded: 150, Uploaded: 1000},
+		}))
+	})
+})
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/providers"
+)
+
+// Where a binary is stored, see FindLOBLocations
+type LOBLocation struct {
+	// Name of the remote, or "" for the local binary store
+	RemoteName string
+	// Whether all of the binary's files are there
+	Complete bool
+	// Set if the remote couldn't be checked
+	Error error
+}
+
+// Get the git remotes which have binary storage configured (git-lob-provider)
+func (r *Repo) GetGitLOBRemotes() ([]string, error) {
+	remotes, err := r.GetGitRemotes()
+	if err != nil {
+		return []string{}, err
+	}
+	var ret []string
+	for _, remote := range remotes {
+		if providers.GetProviderNameForRemote(r.Options, remote) != "" {
+			ret = append(ret, remote)
+		}
+	}
+	return ret, nil
+}
+
+// Get the binary a file in the working copy refers to; that's its placeholder if the content
+// isn't checked out, otherwise the binary committed for it at HEAD
+func (r *Repo) GetLOBSHAForPath(path string) (string, error) {
+	if f, err := os.Open(r.absPath(path)); err == nil {
+		// Only need enough to see if it's a placeholder, files may be big
+		buf := make([]byte, MaxLOBPlaceholderLen+2)
+		n, _ := io.ReadFull(f, buf)
+		f.Close()
+		if placeholder, ok := parseLOBPlaceholder([]byte(strings.TrimSpace(string(buf[:n])))); ok {
+			return strings.ToLower(placeholder.SHA), nil
+		}
+	}
+
+	relpath, err := r.GetRepoRelativePath(path)
+	if err != nil {
+		return "", err
+	}
+	sha, err := r.getLOBSHAForPathAtCommit(relpath, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if sha == "" {
+		return "", fmt.Errorf("%v is not a binary stored by git-lob in HEAD", path)
+	}
+	return sha, nil
+}
+
+// Split <path>@<ref> into the path & ref, or return ref = HEAD if there's no @<ref>
+// Paths can contain '@' too, so it's only split at the last '@' if a valid ref follows it
+func (r *Repo) SplitPathAtRef(pathAtRef string) (path, ref string) {
+	i := strings.LastIndex(pathAtRef, "@")
+	if i > 0 && i < len(pathAtRef)-1 && r.GitRefOrSHAIsValid(pathAtRef[i+1:]) {
+		return pathAtRef[:i], pathAtRef[i+1:]
+	}
+	return pathAtRef, "HEAD"
+}
+
+// Get the binary committed for a path at a ref, given as <path>@<ref> (or just <path> for HEAD)
+// with the path relative to the current directory. The file doesn't have to exist in the working
+// copy, see SplitPathAtRef
+func (r *Repo) GetLOBSHAForPathAtRef(pathAtRef string) (sha, relpath, ref string, _err error) {
+	path, ref := r.SplitPathAtRef(pathAtRef)
+	relpath, err := r.GetRepoRelativePath(path)
+	if err != nil {
+		return "", "", "", err
+	}
+	sha, err = r.getLOBSHAForPathAtCommit(relpath, ref)
+	if err != nil {
+		return "", "", "", err
+	}
+	if sha == "" {
+		if path == pathAtRef && strings.Contains(path, "@") {
+			return "", "", "", fmt.Errorf("%v is not a binary stored by git-lob in HEAD, or the ref is unknown", path)
+		}
+		return "", "", "", fmt.Errorf("%v is not a binary stored by git-lob in %v", path, ref)
+	}
+	return sha, relpath, ref, nil
+}
+
+// Get the path of a file relative to the root of the repo, with / separators like git uses
+// Returns an error if the file is outside the repo
+func (r *Repo) GetRepoRelativePath(path string) (string, error) {
+	relpath, err := filepath.Rel(r.Root, r.absPath(path))
+	if err != nil || relpath == ".." || strings.HasPrefix(relpath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%v is outside the repository", path)
+	}
+	return filepath.ToSlash(relpath), nil
+}
+
+// Get the binary committed for a path (relative to the root of the repo, / separated) at a
+// commit, or "" if it isn't a binary stored by git-lob there
+func (r *Repo) getLOBSHAForPathAtCommit(relpath, commit string) (string, error) {
+	var sha string
+	err := r.WalkGitAllLOBsToCheckoutAtCommit(commit, []string{relpath}, nil, func(filelob *FileLOB) {
+		if filelob.Filename == relpath {
+			sha = filelob.SHA
+		}
+	})
+	return sha, err
+}
+
+// Check whether the local binary store & each of a list of remotes has the complete content of
+// a binary, using each provider's own checks. Returns the local store first, then each remote
+func (r *Repo) FindLOBLocations(sha string, remoteNames []string) []*LOBLocation {
+	ret := []*LOBLocation{&LOBLocation{Complete: r.CheckLOBFilesForSHA(sha, r.GetLocalLOBRoot(), false) == nil}}
+	for _, remoteName := range remoteNames {
+		location := &LOBLocation{RemoteName: remoteName}
+		ret = append(ret, location)
+		provider, err := r.GetProvider(remoteName)
+		if err != nil {
+			location.Error = err
+			continue
+		}
+		err = r.CheckRemoteLOBFilesForSHA(sha, provider, remoteName)
+		provider.Release()
+		if err == nil {
+			location.Complete = true
+		} else if !IsNotFoundError(err) {
+			location.Error = err
+		}
+	}
+	return ret
+}
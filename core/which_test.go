@@ -0,0 +1,155 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Which", func() {
+	root := filepath.Join(os.TempDir(), "WhichTest")
+	originBinStore := filepath.Join(os.TempDir(), "WhichOriginBinStoreTest")
+	var oldwd string
+	filespercommit := [][]string{
+		[]string{"img1.png", filepath.Join("movies", "movie1.mov")},
+	}
+	var shas []string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		os.MkdirAll(originBinStore, 0755)
+
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		Expect(err).To(BeNil(), "Should not error trying to open config file")
+		f.WriteString(fmt.Sprintf(`
+[remote "origin"]
+    url = file:///dummy/origin
+    git-lob-path = %v
+    git-lob-provider = filesystem
+[remote "broken"]
+    url = file:///dummy/broken
+    git-lob-provider = filesystem
+[remote "plain"]
+    url = http://dummy/plain
+`, strings.Replace(originBinStore, "\\", "/", -1)))
+		f.Close()
+		LoadConfig(GlobalOptions)
+		InitCoreProviders()
+
+		shas = CreateManyCommitsForTest(filespercommit, 0, func(filename string, i int) int64 { return 500 })[0]
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		err = ForceRemoveAll(originBinStore)
+		if err != nil {
+			Fail(err.Error())
+		}
+		// Reset git config
+		GlobalOptions = NewOptions()
+	})
+
+	It("Identifies binaries by path", func() {
+		sha, err := testRepo().GetLOBSHAForPath("img1.png")
+		Expect(err).To(BeNil())
+		Expect(sha).To(Equal(shas[0]), "Should read placeholder")
+
+		// Checked out content comes from HEAD instead
+		Expect(ioutil.WriteFile(filespercommit[0][1], []byte("Real content"), 0644)).To(BeNil())
+		os.Chdir("movies")
+		sha, err = testRepo().GetLOBSHAForPath("movie1.mov")
+		os.Chdir(root)
+		Expect(err).To(BeNil())
+		Expect(sha).To(Equal(shas[1]), "Should find binary committed for path")
+
+		Expect(ioutil.WriteFile("notlob.txt", []byte("Not a binary"), 0644)).To(BeNil())
+		_, err = testRepo().GetLOBSHAForPath("notlob.txt")
+		Expect(err).ToNot(BeNil(), "Files not stored by git-lob should be an error")
+		_, err = testRepo().GetLOBSHAForPath(filepath.Join("..", "outside.png"))
+		Expect(err).ToNot(BeNil(), "Files outside the repo should be an error")
+	})
+
+	It("Identifies binaries by path at a ref", func() {
+		info := CreateAndStoreLOBFileForTest(800, "img1.png")
+		exec.Command("git", "add", "img1.png").Run()
+		exec.Command("git", "commit", "-m", "Change image").Run()
+
+		sha, relpath, ref, err := testRepo().GetLOBSHAForPathAtRef("img1.png@HEAD~1")
+		Expect(err).To(BeNil())
+		Expect(sha).To(Equal(shas[0]), "Should find binary at the ref")
+		Expect(relpath).To(Equal("img1.png"))
+		Expect(ref).To(Equal("HEAD~1"))
+		sha, _, ref, err = testRepo().GetLOBSHAForPathAtRef("img1.png")
+		Expect(err).To(BeNil())
+		Expect(sha).To(Equal(info.SHA), "Should default to HEAD")
+		Expect(ref).To(Equal("HEAD"))
+
+		// Doesn't need to be in the working copy, & relative to the current dir
+		os.Remove(filespercommit[0][1])
+		os.Chdir("movies")
+		sha, relpath, _, err = testRepo().GetLOBSHAForPathAtRef("movie1.mov@master")
+		os.Chdir(root)
+		Expect(err).To(BeNil())
+		Expect(sha).To(Equal(shas[1]))
+		Expect(relpath).To(Equal("movies/movie1.mov"))
+		var buf bytes.Buffer
+		_, err = testRepo().RetrieveLOB(sha, &buf)
+		Expect(err).To(BeNil())
+		Expect(buf.Len()).To(Equal(500))
+
+		path, ref := testRepo().SplitPathAtRef("art/me@home.png@HEAD~1")
+		Expect(path).To(Equal("art/me@home.png"), "Should split at the last '@'")
+		Expect(ref).To(Equal("HEAD~1"))
+		path, ref = testRepo().SplitPathAtRef("art/me@home.png")
+		Expect(path).To(Equal("art/me@home.png"), "Shouldn't split unless a ref follows")
+		Expect(ref).To(Equal("HEAD"))
+		_, _, _, err = testRepo().GetLOBSHAForPathAtRef("img1.png@nosuchref")
+		Expect(err).ToNot(BeNil(), "Unknown refs should be an error")
+		_, _, _, err = testRepo().GetLOBSHAForPathAtRef("notthere.png@HEAD")
+		Expect(err).ToNot(BeNil(), "Paths not stored by git-lob should be an error")
+	})
+
+	It("Finds which remotes have binaries", func() {
+		remoteNames, err := testRepo().GetGitLOBRemotes()
+		Expect(err).To(BeNil())
+		Expect(remoteNames).To(ConsistOf("origin", "broken"), "Only remotes with providers (configured or detected from the URL) should be included")
+
+		provider, err := testRepo().GetProvider("origin")
+		Expect(err).To(BeNil())
+		callback := func(data *ProgressCallbackData) (abort bool) { return false }
+		Expect(testRepo().PushSingle(shas[0], provider, "origin", false, callback)).To(BeNil())
+
+		locations := testRepo().FindLOBLocations(shas[0], []string{"origin", "broken"})
+		Expect(locations).To(HaveLen(3))
+		Expect(locations[0].RemoteName).To(Equal(""), "Local store should be first")
+		Expect(locations[0].Complete).To(BeTrue())
+		Expect(locations[1].RemoteName).To(Equal("origin"))
+		Expect(locations[1].Complete).To(BeTrue())
+		Expect(locations[1].Error).To(BeNil())
+		Expect(locations[2].Complete).To(BeFalse())
+		Expect(locations[2].Error).ToNot(BeNil(), "Misconfigured remote should be an error")
+
+		// Not pushed, & once deleted locally the remote is checked without local metadata
+		locations = testRepo().FindLOBLocations(shas[1], []string{"origin"})
+		Expect(locations[1].Complete).To(BeFalse())
+		Expect(locations[1].Error).To(BeNil(), "Missing should not be an error")
+		testRepo().DeleteLOB(shas[1])
+		locations = testRepo().FindLOBLocations(shas[1], []string{"origin"})
+		Expect(locations[0].Complete).To(BeFalse())
+		Expect(locations[1].Complete).To(BeFalse())
+		Expect(locations[1].Error).To(BeNil(), "Missing metadata should not be an error")
+	})
+})
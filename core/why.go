@@ -0,0 +1,212 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Explaining why a binary is kept
+// Prune keeps a binary if HEAD or a recent ref uses it, at its tip or within the history kept
+// for it, if a commit which added it hasn't been pushed to git-lob.prune-check-remote, or if a
+// retention policy (git-lob.prune-keep-*) applies. 'why' reports each of these for one binary,
+// along with whether a dry run of prune would delete it, since the combination is hard to work
+// out by hand when prune doesn't reclaim the space expected.
+
+// A commit which added a binary
+type WhyCommit struct {
+	Commit  string
+	Subject string
+	// Path relative to the root of the repo, / separated
+	Path string
+}
+
+// A ref which uses a binary
+type WhyRef struct {
+	Name   string
+	Commit string
+	// Whether the ref's tip uses the binary
+	AtTip bool
+	// Whether the history prune keeps for the ref uses the binary (includes AtTip)
+	Recent bool
+	// Days of history prune keeps for the ref, or -1 if it's older than git-lob.retention-period-refs
+	// & only unpushed binaries are kept for it
+	Days int
+}
+
+// Why a binary is or isn't kept, see ExplainLOB
+type WhyResult struct {
+	SHA string
+	// Whether the binary is in the local store, & its size if the metadata is
+	Stored bool
+	Size   int64
+	// Commits which added the binary, latest first
+	AddedBy []*WhyCommit
+	// Refs which use the binary, as prune sees them
+	Refs []*WhyRef
+	// Whether a commit which added the binary has been pushed, by remote
+	Pushed map[string]bool
+	// The remote prune checks whether binaries are pushed to
+	PruneRemote string
+	// Why prune keeps the binary (PruneRetain*), empty if it would delete it
+	PruneRetained []PruneCallbackType
+	// Whether a dry run of prune deleted the binary
+	WouldPrune bool
+}
+
+// Explain why a binary is kept by prune, or not; see above. Calls callback with PruneWorking now
+// & again, for a spinner
+func (r *Repo) ExplainLOB(sha string, callback PruneCallback) (*WhyResult, error) {
+	result := &WhyResult{SHA: sha, Size: -1, Pushed: make(map[string]bool),
+		PruneRemote: r.Options.PruneRemote}
+	if info, err := r.GetLOBInfo(sha); err == nil {
+		result.Size = info.Size
+		result.Stored = !r.IsLOBMissing(sha, false)
+	}
+
+	var added []string
+	err := r.walkGitLOBAdditionsOfSHA(sha, func(commitLOB *CommitLOBRef) (quit bool, err error) {
+		callback(PruneWorking, "")
+		commit := &WhyCommit{Commit: commitLOB.Commit}
+		for _, filelob := range commitLOB.FileLOBs {
+			if filelob.SHA == sha {
+				commit.Path = filelob.Filename
+				break
+			}
+		}
+		if summary, err := r.GetGitCommitSummary(commitLOB.Commit); err == nil {
+			commit.Subject = summary.Subject
+		}
+		result.AddedBy = append(result.AddedBy, commit)
+		added = append(added, commitLOB.Commit)
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Refs, as prune checks them: HEAD, then others latest first
+	earliestRefDate := time.Now().AddDate(0, 0, -r.Options.RetentionRefsPeriod)
+	refs, err := r.GetGitRecentRefs(-1, true, "")
+	if err != nil {
+		return nil, err
+	}
+	headsha, _ := r.GitRefToFullSHA("HEAD")
+	refs = append([]*GitRef{&GitRef{Name: "HEAD", Type: GitRefTypeHEAD, CommitSHA: headsha}}, refs...)
+	for _, ref := range refs {
+		if ref.CommitSHA == "" {
+			continue
+		}
+		callback(PruneWorking, "")
+		whyref := &WhyRef{Name: ref.Name, Commit: ref.CommitSHA, Days: -1}
+		if ref.Type == GitRefTypeHEAD {
+			whyref.Days = r.Options.RetentionCommitsPeriodHEAD
+		} else if commit, err := r.GetGitCommitSummary(ref.CommitSHA); err != nil ||
+			!commit.CommitDate.Before(earliestRefDate) {
+			whyref.Days = r.Options.RetentionCommitsPeriodOther
+		}
+		lobs, err := r.GetGitAllLOBsToCheckoutAtCommit(ref.CommitSHA, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Error determining binaries in %v: %v", ref.Name, err.Error())
+		}
+		whyref.AtTip = util.NewStringSetFromSlice(lobs).Contains(sha)
+		whyref.Recent = whyref.AtTip
+		if !whyref.Recent && whyref.Days >= 0 {
+			lobs, _, err = r.GetGitAllLOBsToCheckoutAtCommitAndRecent(ref.CommitSHA, whyref.Days, nil, nil)
+			if err != nil {
+				return nil, fmt.Errorf("Error determining recent commits from %v: %v", ref.Name, err.Error())
+			}
+			whyref.Recent = util.NewStringSetFromSlice(lobs).Contains(sha)
+		}
+		if whyref.Recent {
+			result.Refs = append(result.Refs, whyref)
+		}
+	}
+
+	remoteNames, err := r.GetGitLOBRemotes()
+	if err != nil {
+		return nil, err
+	}
+	for _, remoteName := range remoteNames {
+		callback(PruneWorking, "")
+		pushed, err := r.isAnyGitCommitPushed(added, remoteName)
+		if err != nil {
+			return nil, err
+		}
+		result.Pushed[remoteName] = pushed
+	}
+
+	if result.Stored {
+		retained := make(map[PruneCallbackType]bool)
+		_, err = r.PruneOld(true, false, func(t PruneCallbackType, lobsha string) {
+			if t == PruneWorking {
+				callback(t, lobsha)
+				return
+			}
+			if lobsha != sha {
+				return
+			}
+			if t == PruneDeleted {
+				result.WouldPrune = true
+			} else if !retained[t] {
+				retained[t] = true
+				result.PruneRetained = append(result.PruneRetained, t)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Walk the commits in any ref's history which add a particular LOB, latest first (topologically)
+func (r *Repo) walkGitLOBAdditionsOfSHA(sha string, callback func(commitLOB *CommitLOBRef) (quit bool, err error)) error {
+	cmd := r.command("git", "log", "--all", `--format=commitsha: %H %P`, "-p",
+		"--topo-order", "-G", sha)
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Unable to call git-log: %v", err.Error())
+	}
+	cmd.Start()
+	_, err = walkGitLogOutputForLOBReferences(outp, true, false, nil, nil, func(commitLOB *CommitLOBRef) (quit bool, err error) {
+		// -G also matches commits which remove it
+		if !util.NewStringSetFromSlice(commitLOB.LobSHAs).Contains(sha) {
+			return false, nil
+		}
+		return callback(commitLOB)
+	})
+	// The callback may have quit early, git can't exit until everything's been read
+	io.Copy(ioutil.Discard, outp)
+	cmd.Wait()
+	return err
+}
+
+// Is any of a list of commits recorded as pushed to a remote, i.e. in the history of one of
+// the commits in its push state?
+func (r *Repo) isAnyGitCommitPushed(commits []string, remoteName string) (bool, error) {
+	pushed := r.GetPushedCommits(remoteName)
+	if len(commits) == 0 || len(pushed) == 0 {
+		return false, nil
+	}
+	// Lists the commits in their history which aren't in the history of a pushed commit; pushed
+	// commits which no longer exist are skipped
+	args := append([]string{"rev-list", "--ignore-missing"}, commits...)
+	args = append(args, "--not")
+	args = append(args, pushed...)
+	outp, err := r.command("git", args...).Output()
+	if err != nil {
+		return false, fmt.Errorf("Unable to call git rev-list: %v", err.Error())
+	}
+	unpushed := util.NewStringSetFromSlice(strings.Fields(string(outp)))
+	for _, commit := range commits {
+		if !unpushed.Contains(commit) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
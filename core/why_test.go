@@ -0,0 +1,81 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Why", func() {
+	root := filepath.Join(os.TempDir(), "WhyTest")
+	var oldwd string
+	var shaspercommit [][]string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		Expect(err).To(BeNil(), "Should not error trying to open config file")
+		f.WriteString(`
+[remote "origin"]
+    url = file:///dummy/origin
+    git-lob-path = /dummy/origin
+    git-lob-provider = filesystem
+`)
+		f.Close()
+		LoadConfig(GlobalOptions)
+		CreateInitialCommitForTest(root)
+		shaspercommit = CreateManyCommitsForTest([][]string{[]string{"one.png"}, []string{"two.png"}}, 0,
+			func(filename string, i int) int64 { return 500 })
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		ForceRemoveAll(root)
+		GlobalOptions = NewOptions()
+	})
+	callback := func(t PruneCallbackType, lobsha string) {}
+
+	It("Explains why binaries are kept", func() {
+		sha := shaspercommit[0][0]
+		result, err := testRepo().ExplainLOB(sha, callback)
+		Expect(err).To(BeNil())
+		Expect(result.Stored).To(BeTrue())
+		Expect(result.Size).To(BeEquivalentTo(500))
+		Expect(result.AddedBy).To(HaveLen(1))
+		Expect(result.AddedBy[0].Path).To(Equal("one.png"))
+		var names []string
+		for _, ref := range result.Refs {
+			names = append(names, ref.Name)
+			Expect(ref.AtTip).To(BeTrue(), "%v uses it at its tip", ref.Name)
+		}
+		Expect(names).To(ContainElement("HEAD"))
+		Expect(result.Pushed).To(Equal(map[string]bool{"origin": false}))
+		Expect(result.WouldPrune).To(BeFalse())
+		Expect(result.PruneRetained).To(ContainElement(PruneRetainByDate))
+
+		head := strings.TrimSpace(RunGitCommandForTest(true, "rev-parse", "HEAD"))
+		Expect(testRepo().MarkBinariesAsPushed("origin", head, "")).To(BeNil())
+		result, err = testRepo().ExplainLOB(sha, callback)
+		Expect(err).To(BeNil())
+		Expect(result.Pushed).To(Equal(map[string]bool{"origin": true}))
+	})
+
+	It("Explains that unreferenced binaries would be pruned", func() {
+		CreateRandomFileForTest(300, "unused.png")
+		info, err := StoreLOBForTest("unused.png")
+		Expect(err).To(BeNil())
+		result, err := testRepo().ExplainLOB(info.SHA, callback)
+		Expect(err).To(BeNil(), fmt.Sprintf("%v", err))
+		Expect(result.Stored).To(BeTrue())
+		Expect(result.AddedBy).To(BeEmpty())
+		Expect(result.Refs).To(BeEmpty())
+		Expect(result.WouldPrune).To(BeTrue())
+		Expect(result.PruneRetained).To(BeEmpty())
+		Expect(testRepo().IsLOBMissing(info.SHA, false)).To(BeFalse(), "Should only be a dry run")
+	})
+})
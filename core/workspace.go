@@ -0,0 +1,203 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Name of the file in the root of the repo which defines workspaces
+// This is committed so that everyone working on the repo shares the same definitions
+const WorkspaceFilename = ".gitlob"
+
+// A named subset of the binaries in a repository, so that teams working on large
+// repos can fetch & check out only the binaries they need
+// Defined in [workspace "<name>"] sections of WorkspaceFilename, see 'git lob fetch --help'
+type Workspace struct {
+	Name string
+	// Paths to include (comma separated, same wildcard rules as git-lob.fetch-include)
+	IncludePaths []string
+	// Paths to exclude (comma separated, same wildcard rules as git-lob.fetch-exclude)
+	ExcludePaths []string
+	// Binaries larger than this are not fetched (0 = no limit)
+	MaxSize int64
+	// Paths whose binaries should be downloaded first, in order of priority
+	PriorityPaths []string
+}
+
+// Get the path of the workspace definition file for the current repo
+func (r *Repo) GetWorkspaceFilePath() (string, error) {
+	return filepath.Join(r.Root, WorkspaceFilename), nil
+}
+
+// Read all the workspaces defined for the current repo, keyed by (lower case) name
+// Returns an empty map if there is no workspace definition file
+func (r *Repo) GetWorkspaces() (map[string]*Workspace, error) {
+	path, err := r.GetWorkspaceFilePath()
+	if err != nil {
+		return nil, err
+	}
+	if !util.FileExists(path) {
+		return make(map[string]*Workspace), nil
+	}
+	config, err := util.ReadConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %v: %v", path, err.Error())
+	}
+	return r.parseWorkspaces(config)
+}
+
+// Get a single named workspace for the current repo (names are case insensitive)
+func (r *Repo) GetWorkspace(name string) (*Workspace, error) {
+	workspaces, err := r.GetWorkspaces()
+	if err != nil {
+		return nil, err
+	}
+	ws, ok := workspaces[strings.ToLower(name)]
+	if !ok {
+		var names []string
+		for n, _ := range workspaces {
+			names = append(names, n)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("Workspace '%v' not found, no workspaces are defined in %v", name, WorkspaceFilename)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Workspace '%v' not found in %v, available workspaces: %v", name, WorkspaceFilename, strings.Join(names, ", "))
+	}
+	return ws, nil
+}
+
+// Parse workspace definitions from a config map as returned by util.ReadConfigStream
+func (r *Repo) parseWorkspaces(config map[string]string) (map[string]*Workspace, error) {
+	ret := make(map[string]*Workspace)
+	for key, value := range config {
+		if !strings.HasPrefix(key, "workspace.") {
+			continue
+		}
+		// Name is between the section & the setting, and may itself contain dots
+		dot := strings.LastIndex(key, ".")
+		name := key[len("workspace."):dot]
+		setting := key[dot+1:]
+		if name == "" {
+			continue
+		}
+		ws, ok := ret[name]
+		if !ok {
+			ws = &Workspace{Name: name}
+			ret[name] = ws
+		}
+		switch setting {
+		case "include":
+			ws.IncludePaths = splitWorkspacePaths(value)
+		case "exclude":
+			ws.ExcludePaths = splitWorkspacePaths(value)
+		case "priority":
+			ws.PriorityPaths = splitWorkspacePaths(value)
+		case "max-size":
+			sz, err := util.ParseSize(value)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid max-size for workspace '%v': %v", name, value))
+			}
+			ws.MaxSize = sz
+		default:
+			r.Log.Debugf("Ignoring unknown setting '%v' for workspace '%v'\n", setting, name)
+		}
+	}
+	return ret, nil
+}
+
+func splitWorkspacePaths(value string) []string {
+	var ret []string
+	for _, p := range strings.Split(value, ",") {
+		// Trailing separators would stop directories matching
+		p = strings.TrimRight(strings.TrimSpace(p), "/")
+		if p != "" {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// Returns whether a file (relative to the repo root) is part of this workspace
+func (ws *Workspace) Contains(filename string) bool {
+	return util.FilenamePassesIncludeExcludeFilter(filename, ws.IncludePaths, ws.ExcludePaths)
+}
+
+// Apply the workspace to fetch options, replacing any fetch-include & fetch-exclude settings
+func (ws *Workspace) ApplyToOptions(opts *util.Options) {
+	opts.FetchIncludePaths = ws.IncludePaths
+	opts.FetchExcludePaths = ws.ExcludePaths
+	opts.FetchMaxSize = ws.MaxSize
+	opts.FetchPriorityPaths = ws.PriorityPaths
+}
+
+func (ws *Workspace) String() string {
+	desc := ws.Name
+	var details []string
+	if len(ws.IncludePaths) > 0 {
+		details = append(details, "include "+strings.Join(ws.IncludePaths, ","))
+	}
+	if len(ws.ExcludePaths) > 0 {
+		details = append(details, "exclude "+strings.Join(ws.ExcludePaths, ","))
+	}
+	if ws.MaxSize > 0 {
+		details = append(details, "max "+util.FormatSize(ws.MaxSize))
+	}
+	if len(details) > 0 {
+		desc = fmt.Sprintf("%v (%v)", desc, strings.Join(details, "; "))
+	}
+	return desc
+}
+
+// Get the priority of a filename according to a list of priority paths
+// 0 is the highest priority, files not matching any priority path get len(priorityPaths)
+func getFetchPriority(filename string, priorityPaths []string) int {
+	for i, p := range priorityPaths {
+		if util.FilenamePassesIncludeExcludeFilter(filename, []string{p}, nil) {
+			return i
+		}
+	}
+	return len(priorityPaths)
+}
+
+// Order the LOBs to fetch (map of sha -> filename) so that those in priority paths come first
+// Order within each priority is by filename for predictability
+func orderLOBsForFetch(lobshas map[string]string, priorityPaths []string) []string {
+	shas := make([]string, 0, len(lobshas))
+	priorities := make(map[string]int, len(lobshas))
+	for sha, filename := range lobshas {
+		shas = append(shas, sha)
+		priorities[sha] = getFetchPriority(filename, priorityPaths)
+	}
+	sort.Sort(&fetchOrderSorter{shas, lobshas, priorities})
+	return shas
+}
+
+type fetchOrderSorter struct {
+	shas       []string
+	filenames  map[string]string
+	priorities map[string]int
+}
+
+func (s *fetchOrderSorter) Len() int {
+	return len(s.shas)
+}
+func (s *fetchOrderSorter) Swap(i, j int) {
+	s.shas[i], s.shas[j] = s.shas[j], s.shas[i]
+}
+func (s *fetchOrderSorter) Less(i, j int) bool {
+	pi, pj := s.priorities[s.shas[i]], s.priorities[s.shas[j]]
+	if pi != pj {
+		return pi < pj
+	}
+	fi, fj := s.filenames[s.shas[i]], s.filenames[s.shas[j]]
+	if fi != fj {
+		return fi < fj
+	}
+	return s.shas[i] < s.shas[j]
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Workspace", func() {
+
+	It("Parses workspace definitions", func() {
+		configText := `[git-lob]
+    fetch-include = ignored
+[workspace "Art"]
+    include = art/characters, art/shared/*.psd
+    exclude = art/characters/archive/
+    max-size = 500MB
+    priority = art/shared, art/characters/hero
+[workspace "code.tools"]
+    include = tools
+`
+		config, err := ReadConfigStream(bytes.NewBufferString(configText), "")
+		Expect(err).To(BeNil(), "Shouldn't encounter an error when reading config stream")
+		workspaces, err := testRepo().parseWorkspaces(config)
+		Expect(err).To(BeNil(), "Shouldn't encounter an error parsing workspaces")
+		Expect(workspaces).To(HaveLen(2))
+		art := workspaces["art"]
+		Expect(art).ToNot(BeNil(), "Names should be case insensitive")
+		Expect(art.IncludePaths).To(Equal([]string{"art/characters", "art/shared/*.psd"}))
+		Expect(art.ExcludePaths).To(Equal([]string{"art/characters/archive"}), "Trailing separator should be removed")
+		Expect(art.MaxSize).To(BeEquivalentTo(500 * 1024 * 1024))
+		Expect(art.PriorityPaths).To(Equal([]string{"art/shared", "art/characters/hero"}))
+		Expect(workspaces["code.tools"].IncludePaths).To(Equal([]string{"tools"}), "Names may contain dots")
+
+		Expect(art.Contains("art/characters/hero/model.obj")).To(BeTrue())
+		Expect(art.Contains("art/shared/sky.psd")).To(BeTrue())
+		Expect(art.Contains("art/shared/sky.png")).To(BeFalse())
+		Expect(art.Contains("art/characters/archive/old.obj")).To(BeFalse())
+		Expect(art.Contains("audio/theme.wav")).To(BeFalse())
+
+		config, _ = ReadConfigStream(bytes.NewBufferString("[workspace \"bad\"]\n    max-size = lots\n"), "")
+		_, err = testRepo().parseWorkspaces(config)
+		Expect(err).ToNot(BeNil(), "Invalid size should be an error")
+	})
+
+	It("Orders fetches by priority", func() {
+		lobshas := map[string]string{
+			"1111111111111111111111111111111111111111": "art/characters/villain/model.obj",
+			"2222222222222222222222222222222222222222": "art/characters/hero/model.obj",
+			"3333333333333333333333333333333333333333": "art/shared/sky.psd",
+			"4444444444444444444444444444444444444444": "art/characters/hero/texture.png",
+		}
+		order := orderLOBsForFetch(lobshas, []string{"art/shared", "art/characters/hero"})
+		Expect(order).To(Equal([]string{
+			"3333333333333333333333333333333333333333",
+			"2222222222222222222222222222222222222222",
+			"4444444444444444444444444444444444444444",
+			"1111111111111111111111111111111111111111",
+		}))
+		order = orderLOBsForFetch(lobshas, nil)
+		Expect(order[0]).To(Equal("2222222222222222222222222222222222222222"), "Without priorities order is by filename")
+	})
+
+	Describe("In a repo", func() {
+		root := filepath.Join(os.TempDir(), "WorkspaceTest")
+		var oldwd string
+		filenames := []string{
+			filepath.Join("art", "model.obj"),
+			filepath.Join("audio", "theme.wav"),
+		}
+		BeforeEach(func() {
+			CreateGitRepoForTest(root)
+			oldwd, _ = os.Getwd()
+			os.Chdir(root)
+			for _, file := range filenames {
+				os.MkdirAll(filepath.Dir(file), 0755)
+				CreateAndStoreLOBFileForTest(100, file)
+				RunGitCommandForTest(true, "add", file)
+			}
+			err := ioutil.WriteFile(WorkspaceFilename, []byte("[workspace \"art\"]\n    include = art\n"), 0644)
+			Expect(err).To(BeNil())
+			RunGitCommandForTest(true, "add", WorkspaceFilename)
+			RunGitCommandForTest(true, "commit", "-m", "Initial")
+		})
+		AfterEach(func() {
+			os.Chdir(oldwd)
+			err := ForceRemoveAll(root)
+			if err != nil {
+				Fail(err.Error())
+			}
+		})
+
+		It("Reads workspaces & checks out only files in the workspace", func() {
+			_, err := testRepo().GetWorkspace("audio")
+			Expect(err).ToNot(BeNil(), "Undefined workspace should be an error")
+			Expect(err.Error()).To(ContainSubstring("available workspaces: art"))
+			ws, err := testRepo().GetWorkspace("ART")
+			Expect(err).To(BeNil(), "Should find workspace")
+			Expect(ws.IncludePaths).To(Equal([]string{"art"}))
+
+			for _, file := range filenames {
+				os.Remove(file)
+			}
+			var checkedOut []string
+			err = testRepo().CheckoutWorkspace(ws, nil, false, LinkModeCopy, func(t ProgressCallbackType, filelob *FileLOB, err error) {
+				if t == ProgressTransferBytes {
+					checkedOut = append(checkedOut, filelob.Filename)
+				}
+			})
+			Expect(err).To(BeNil(), "Shouldn't fail calling checkout")
+			Expect(checkedOut).To(Equal([]string{"art/model.obj"}), "Only files in workspace should be checked out")
+			Expect(FileExists(filenames[0])).To(BeTrue())
+			Expect(FileExists(filenames[1])).To(BeFalse(), "File outside workspace should be left alone")
+		})
+	})
+
+})
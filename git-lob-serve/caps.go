@@ -3,16 +3,56 @@ package main
 import (
 	"io"
 
+	"github.com/atlassian/git-lob/core"
 	"github.com/atlassian/git-lob/providers/smart"
 )
 
-func queryCaps(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
-
-	// This server always supports binary deltas
+// Get the capabilities this server offers the connected user
+func getServerCaps(config *Config) []string {
+	// This server always supports binary deltas, chunk objects, custom chunk sizes & locking
 	// Send/receive settings may cause actual requests to be rejected
-	caps := []string{"binary_delta"}
+	caps := []string{"binary_delta", "chunk_objects", "chunk_size", "locking"}
+	// Anyone can know that files can't be modified or deleted
+	if config.RetentionDays > 0 {
+		caps = append(caps, "retention")
+	}
+	// Only admins are told they can prune
+	if isPruneAdmin(config) {
+		caps = append(caps, "prune")
+	}
+	// Clients can choose which algorithm deltas are exchanged with, bm if none
+	for _, alg := range core.GetAvailableDeltaAlgorithms() {
+		caps = append(caps, "delta_algorithm="+alg)
+	}
+	// Chunks can be compressed in transit with any of these; clients say which per request
+	for _, codec := range smart.TransferCompressionCodecs {
+		caps = append(caps, smart.CompressCapPrefix+codec)
+	}
+	// Chunk content can be checked against size+hash trailers
+	caps = append(caps, smart.ChunkHashCap)
+	// Metadata for many LOBs can be downloaded in one request
+	caps = append(caps, smart.MetadataBatchCap)
+	// Previews of LOBs can be stored alongside them
+	caps = append(caps, smart.PreviewsCap)
+	return caps
+}
 
-	result := smart.QueryCapsResponse{Caps: caps}
+// Enable capabilities the client has chosen for the rest of the session
+func enableServerCaps(config *Config, caps []string) error {
+	// Only the delta algorithm & chunk hashes affect how this reference implementation behaves
+	config.chunkHashes = smart.HasFeature(caps, smart.ChunkHashCap)
+	config.deltaAlgorithm = ""
+	if alg, ok := smart.GetFeatureValue(caps, "delta_algorithm"); ok {
+		if _, err := core.GetDeltaAlgorithm(alg); err != nil {
+			return err
+		}
+		config.deltaAlgorithm = alg
+	}
+	return nil
+}
+
+func queryCaps(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	result := smart.QueryCapsResponse{Caps: getServerCaps(config)}
 	resp, err := smart.NewJsonResponse(req.Id, result)
 	if err != nil {
 		resp = smart.NewJsonErrorResponse(req.Id, err.Error())
@@ -22,7 +62,15 @@ func queryCaps(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Conf
 }
 
 func setCaps(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
-	// Actually not required in this reference implementation yet
+	setreq := smart.SetEnabledCapsRequest{}
+	err := smart.ExtractStructFromJsonRawMessage(req.Params, &setreq)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	err = enableServerCaps(config, setreq.EnableCaps)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
 	result := smart.SetEnabledCapsResponse{}
 	resp, err := smart.NewJsonResponse(req.Id, result)
 	if err != nil {
@@ -31,3 +79,28 @@ func setCaps(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config
 
 	return resp
 }
+
+func negotiate(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	negreq := smart.NegotiateRequest{}
+	err := smart.ExtractStructFromJsonRawMessage(req.Params, &negreq)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	// Speak the older of the 2 versions, & enable the features the client prefers which we offer
+	version := negreq.ProtocolVersion
+	if version > smart.ProtocolVersion {
+		version = smart.ProtocolVersion
+	}
+	features := smart.SelectFeatures(negreq.Features, getServerCaps(config), version)
+	err = enableServerCaps(config, features)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	result := smart.NegotiateResponse{ProtocolVersion: version, Features: features}
+	resp, err := smart.NewJsonResponse(req.Id, result)
+	if err != nil {
+		resp = smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+
+	return resp
+}
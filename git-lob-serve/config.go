@@ -6,8 +6,10 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/go-homedir"
+	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/util"
 )
 
@@ -18,9 +20,62 @@ type Config struct {
 	EnableDeltaSend    bool
 	DeltaCachePath     string
 	DeltaSizeLimit     int64
+	// Users allowed to prune the store ("*" for anyone), empty to disable pruning
+	PruneAdmins []string
+	// Files modified more recently than this are never pruned, since their commits may
+	// not have been pushed to git yet
+	PruneGracePeriodDays int
+	// Users allowed to release other users' file locks ("*" for anyone), see locks.go
+	LockAdmins []string
+	// Write-once retention period; if > 0 stored files can't be modified & binaries can't be
+	// deleted until this many days after they were uploaded (see retention.go)
+	RetentionDays int
+	// Repository mapping mode; if true the requested path must be one of Repos (see repos.go)
+	RepoMapping bool
+	// Repositories served in mapping mode, by normalised name
+	Repos map[string]*RepoConfig
+	// Maximum bytes stored under BasePath in total, 0 for no limit (see quota.go)
+	Quota int64
+	// Maximum bytes stored for each repository path, 0 for no limit; in mapping mode this is
+	// set for the connection from the repository's own quota, if it has one
+	RepoQuota int64
+	// Address for 'git-lob-serve --metrics' to listen on, e.g. ":9471"; connections only record
+	// metrics if this is set (see metrics.go)
+	MetricsListen string
+	// Where connections record metrics
+	MetricsPath string
+	// Address for 'git-lob-serve --https' to listen on, e.g. ":8443", with the certificate &
+	// private key files to use (see https.go)
+	HttpsListen string
+	HttpsCert   string
+	HttpsKey    string
+	// Tokens users authenticate with over HTTPS, by user
+	UserTokens map[string]string
+	// Upstream stores for caching mode, by name ("" for the unnamed one), each holding the
+	// settings a client would have for a remote using its provider (see upstream.go)
+	Upstreams map[string]map[string]string
+	// Set for the connection rather than from config: the user may only read from the store
+	ReadOnly bool
+
+	// Bytes stored under folders, calculated as needed for quotas
+	usage map[string]int64
+	// Metrics counted by this connection since they were last added to the totals
+	metrics        *serveMetrics
+	metricsFlushed time.Time
+	// Name of the upstream store for the connection; in mapping mode set from the repository
+	upstream         string
+	upstreamProvider providers.SyncProvider
+	// Algorithm deltas are generated & applied with, if the client enabled one for the connection
+	deltaAlgorithm string
+	// Whether chunk content is followed by size+hash trailers, if the client enabled them
+	chunkHashes bool
+	// Compressed copy of the file the client last prepared to download, for DownloadFileStart
+	compressedDownload     *os.File
+	compressedDownloadFile string
 }
 
 const defaultDeltaSizeLimit int64 = 2 * 1024 * 1024 * 1024
+const defaultPruneGracePeriodDays = 7
 
 func NewConfig() *Config {
 	return &Config{
@@ -28,6 +83,8 @@ func NewConfig() *Config {
 		EnableDeltaReceive: true,
 		EnableDeltaSend:    true,
 		DeltaSizeLimit:     defaultDeltaSizeLimit, // 2GB
+
+		PruneGracePeriodDays: defaultPruneGracePeriodDays,
 	}
 }
 func LoadConfig() *Config {
@@ -106,6 +163,26 @@ func LoadConfig() *Config {
 		cfg.DeltaCachePath = filepath.Join(cfg.BasePath, ".deltacache")
 	}
 
+	if v := settings["metrics-listen"]; v != "" {
+		cfg.MetricsListen = v
+	}
+	if v := settings["metrics-path"]; v != "" {
+		cfg.MetricsPath = v
+	}
+	if cfg.MetricsPath == "" && cfg.BasePath != "" {
+		cfg.MetricsPath = filepath.Join(cfg.BasePath, ".metrics")
+	}
+
+	if v := settings["https-listen"]; v != "" {
+		cfg.HttpsListen = v
+	}
+	if v := settings["https-cert"]; v != "" {
+		cfg.HttpsCert = v
+	}
+	if v := settings["https-key"]; v != "" {
+		cfg.HttpsKey = v
+	}
+
 	if v := settings["delta-size-limit"]; v != "" {
 		var err error
 		cfg.DeltaSizeLimit, err = strconv.ParseInt(v, 0, 64)
@@ -115,5 +192,56 @@ func LoadConfig() *Config {
 		}
 	}
 
+	if v := settings["prune-admins"]; v != "" {
+		cfg.PruneAdmins = parseUserList(v)
+	}
+	if v := settings["lock-admins"]; v != "" {
+		cfg.LockAdmins = parseUserList(v)
+	}
+	if v := settings["prune-grace-days"]; v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: prune-grace-days=%v\n", v)
+		} else {
+			cfg.PruneGracePeriodDays = days
+		}
+	}
+	if v := settings["retention-days"]; v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: retention-days=%v\n", v)
+		} else {
+			cfg.RetentionDays = days
+		}
+	}
+
+	if v := settings["quota"]; v != "" {
+		quota, err := util.ParseSize(v)
+		if err != nil || quota < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: quota=%v\n", v)
+		} else {
+			cfg.Quota = quota
+		}
+	}
+	if v := settings["repo-quota"]; v != "" {
+		quota, err := util.ParseSize(v)
+		if err != nil || quota < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: repo-quota=%v\n", v)
+		} else {
+			cfg.RepoQuota = quota
+		}
+	}
+
+	if v := strings.ToLower(settings["repo-mapping"]); v != "" {
+		if v == "true" {
+			cfg.RepoMapping = true
+		} else if v == "false" {
+			cfg.RepoMapping = false
+		}
+	}
+	cfg.Repos = parseRepoConfigs(settings)
+	cfg.Upstreams = parseUpstreamConfigs(settings)
+	cfg.UserTokens = parseUserTokens(settings)
+
 	return cfg
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/providers/smart"
+)
+
+// Standalone HTTPS mode lets a small team run git-lob-serve as their binary server on its own,
+// without setting up sshd & accounts for each user. 'git-lob-serve --https' is a long-running
+// process listening on https-listen; clients use git-lob-url = https://host:port/path/to/repo.
+// Each client authenticates with a token & asks to upgrade its connection, then uses the same
+// protocol as over SSH. Like SSH, each connection is served by a separate git-lob-serve process
+// run as the token's user (--user, see identity.go), so repository mapping, read-only access & admin lists
+// work in the same way. Configured with:
+//
+//   https-listen = :8443
+//   https-cert = /etc/git-lob/server.crt
+//   https-key = /etc/git-lob/server.key
+//   [user "steve"]
+//       token = 3b9f1c0e8d6a4f27b5e1
+//
+// User names are lower case, since config file keys are. Tokens can't include '#' or ';'.
+
+// How long clients have to send their request before the connection is upgraded
+var httpsRequestTimeout = 30 * time.Second
+
+// Read user tokens from config file settings ([user "name"] sections)
+func parseUserTokens(settings map[string]string) map[string]string {
+	tokens := make(map[string]string)
+	for key, val := range settings {
+		if !strings.HasPrefix(key, "user.") {
+			continue
+		}
+		dot := strings.LastIndex(key, ".")
+		if dot <= len("user.") {
+			continue
+		}
+		user := key[len("user."):dot]
+		switch key[dot+1:] {
+		case "token":
+			if val != "" {
+				tokens[user] = val
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown configuration setting: %v\n", key)
+		}
+	}
+	return tokens
+}
+
+// Find the user a request authenticated as, from a bearer token or the password of basic auth
+func authenticateHTTPSRequest(config *Config, r *http.Request) (user string, ok bool) {
+	var token string
+	if _, password, basic := r.BasicAuth(); basic {
+		token = password
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if token == "" {
+		return "", false
+	}
+	// Compare with every token in constant time, so timing doesn't reveal anything
+	for u, t := range config.UserTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			user, ok = u, true
+		}
+	}
+	return user, ok
+}
+
+// Check that user may access the path requested, before starting a process to serve it
+// This is checked again by the process, but here the client can be told why it was refused
+func checkHTTPSPath(config *Config, requested, user string) error {
+	// The path is passed to the process as an argument, so mustn't look like an option
+	if requested == "" || strings.HasPrefix(requested, "-") {
+		return fmt.Errorf("Invalid path %v", requested)
+	}
+	if config.RepoMapping {
+		_, _, err := resolveRepoPath(config, requested, user)
+		return err
+	}
+	path := filepath.Clean(requested)
+	if filepath.IsAbs(path) {
+		if !config.AllowAbsolutePaths {
+			return fmt.Errorf("Path argument %v invalid, absolute paths are not allowed by this server", requested)
+		}
+	} else if isOutsideBasePath(path) {
+		return fmt.Errorf("Path argument %v invalid, must be a folder under base-path", requested)
+	}
+	return nil
+}
+
+// Connection upgraded from HTTPS, reading anything the client sent after its request first
+type upgradedConnection struct {
+	io.Reader
+	io.Writer
+}
+
+// Serve a connection for path in a separate git-lob-serve process, as if user had connected over SSH
+var httpsServeConnection = func(conn io.ReadWriter, user, path string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, userArgPrefix+user, path)
+	// If this server was started over SSH, the process mustn't think it was
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "SSH_") {
+			env = append(env, v)
+		}
+	}
+	cmd.Env = env
+	cmd.Stdout = conn
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// Not using conn as Stdin, since Wait would then wait for the client to close the connection
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(stdin, conn)
+		stdin.Close()
+	}()
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%v: %v", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Handler which authenticates clients, then upgrades the connection & serves it
+func newHTTPSHandler(config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := authenticateHTTPSRequest(config, r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git-lob"`)
+			http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" || !strings.EqualFold(r.Header.Get("Upgrade"), smart.HttpsUpgradeProtocol) {
+			http.Error(w, "This server only serves git-lob clients", http.StatusBadRequest)
+			return
+		}
+		// Same as SSH, paths are relative to base-path unless they start with '//'
+		requested := strings.TrimPrefix(r.URL.Path, "/")
+		if err := checkHTTPSPath(config, requested, user); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Unable to upgrade connection", http.StatusInternalServerError)
+			return
+		}
+		conn, buf, err := hijacker.Hijack()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to upgrade connection from %v: %v\n", r.RemoteAddr, err.Error())
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %v\r\n\r\n", smart.HttpsUpgradeProtocol)
+		if err = buf.Flush(); err != nil {
+			return
+		}
+		err = httpsServeConnection(&upgradedConnection{buf.Reader, conn}, user, requested)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Connection from %v (%v) for %v failed: %v\n", user, r.RemoteAddr, requested, err.Error())
+		}
+	})
+}
+
+// Serve clients over HTTPS until something goes wrong
+func serveHTTPS(config *Config) error {
+	server := &http.Server{
+		Addr:              config.HttpsListen,
+		Handler:           newHTTPSHandler(config),
+		ReadHeaderTimeout: httpsRequestTimeout,
+		// Connections are upgraded, which HTTP/2 doesn't support
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+	return server.ListenAndServeTLS(config.HttpsCert, config.HttpsKey)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// Identity of the connecting user
+// Prune & lock admins, read-only access & repository mapping all depend on who the user is, so it
+// comes only from whatever authenticated them, never from environment variables, which SSH
+// clients can set (SendEnv / PermitUserEnvironment). Each connection is served by its own process:
+//
+//   * Over SSH where everyone connects as the same OS user, each key in authorized_keys has a
+//     forced command naming its user; sshd then runs that instead of the client's command, which
+//     it puts in SSH_ORIGINAL_COMMAND, so the path is taken from there:
+//       command="git-lob-serve --user=steve",no-pty,no-port-forwarding ssh-ed25519 AAAA...
+//   * Over HTTPS, the server runs the process with --user=<the token's user>
+//   * Otherwise it's the OS user the process runs as, e.g. each user has their own SSH account
+//
+// A client running git-lob-serve over SSH without a forced command can't choose its user.
+
+const userArgPrefix = "--user="
+
+// The user this process is serving, see parseServerArgs
+var serverUser string
+
+// Get the name of the user connecting to this server
+func getServerUser() string {
+	return serverUser
+}
+
+// Work out the user being served & the arguments the client asked for (the path, or options like
+// --usage) from the arguments this process was run with
+func parseServerArgs(args []string) (username string, clientArgs []string, _err error) {
+	clientArgs = args
+	overSSH := os.Getenv("SSH_CONNECTION") != ""
+	original := os.Getenv("SSH_ORIGINAL_COMMAND")
+	if len(args) > 0 && strings.HasPrefix(args[0], userArgPrefix) {
+		username = strings.TrimPrefix(args[0], userArgPrefix)
+		if username == "" {
+			return "", nil, fmt.Errorf("%v needs a user name", userArgPrefix)
+		}
+		if overSSH && original == "" {
+			// Not a forced command, so the client chose these arguments
+			return "", nil, fmt.Errorf("%v is only accepted in a forced command in authorized_keys", userArgPrefix)
+		}
+		clientArgs = args[1:]
+	}
+	if overSSH && original != "" && len(clientArgs) == 0 {
+		// <server command> <path>, split into words as the shell would have done
+		if fields := strings.Fields(original); len(fields) > 1 {
+			clientArgs = fields[1:]
+		}
+	}
+	for _, arg := range clientArgs {
+		if strings.HasPrefix(arg, userArgPrefix) {
+			return "", nil, fmt.Errorf("The user can't be chosen by the client")
+		}
+	}
+	if username == "" {
+		var err error
+		if username, err = getOSUser(); err != nil {
+			return "", nil, err
+		}
+	}
+	return username, clientArgs, nil
+}
+
+// Get the name of the OS user this process is running as
+func getOSUser() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("Unable to identify the user: %v", err.Error())
+	}
+	// DOMAIN\name on Windows
+	name := u.Username
+	if i := strings.LastIndex(name, `\`); i != -1 {
+		name = name[i+1:]
+	}
+	return name, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/providers/smart"
+	"github.com/atlassian/git-lob/util/lock"
+)
+
+// File locking lets users take turns changing files which can't be merged, e.g. images or
+// levels. A lock is on a path in the repository rather than a binary, since each change makes a
+// new binary. The server only records who holds which locks; clients check them before
+// committing. The locks for each repository path are kept in one file, .locks/locks.json under
+// the path, which is only changed while holding a lock on it so that connections can't lose
+// each other's changes.
+
+// How long to wait for another connection to finish changing the locks
+var LockDBTimeout = 10 * time.Second
+
+// A lock as stored in the lock database
+type lockRecord struct {
+	Path     string
+	Owner    string
+	LockedAt time.Time
+}
+
+func getLockDBFile(config *Config, path string) string {
+	return filepath.Join(getLOBRoot(config, path), ".locks", "locks.json")
+}
+
+// Read the locks for a repository path, sorted by path; none if nothing has been locked yet
+func readLockDB(file string) ([]*lockRecord, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*lockRecord{}, nil
+		}
+		return nil, err
+	}
+	var locks []*lockRecord
+	err = json.Unmarshal(data, &locks)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid lock database %v: %v", file, err.Error())
+	}
+	return locks, nil
+}
+
+func writeLockDB(file string, locks []*lockRecord, config *Config) error {
+	sort.Sort(lockRecordsByPath(locks))
+	data, err := json.MarshalIndent(locks, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ensureDirExists(filepath.Dir(file), config)
+	if err != nil {
+		return err
+	}
+	tmpfile := file + ".tmp"
+	err = ioutil.WriteFile(tmpfile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, file)
+}
+
+// Change the locks for a repository path; update is given the current locks & returns the new
+// ones, or nil to leave them as they are
+func updateLockDB(config *Config, path string, update func(locks []*lockRecord) ([]*lockRecord, error)) error {
+	file := getLockDBFile(config, path)
+	l, err := lock.Acquire(file+".lock", LockDBTimeout)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	locks, err := readLockDB(file)
+	if err != nil {
+		return err
+	}
+	newlocks, err := update(locks)
+	if err != nil || newlocks == nil {
+		return err
+	}
+	return writeLockDB(file, newlocks, config)
+}
+
+type lockRecordsByPath []*lockRecord
+
+func (s lockRecordsByPath) Len() int           { return len(s) }
+func (s lockRecordsByPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s lockRecordsByPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Check a client-supplied path to lock is relative to the root of the repository & make sure
+// there's only one way of writing it
+func normaliseLockPath(p string) (string, error) {
+	cleaned := path.Clean(strings.Replace(p, "\\", "/", -1))
+	if p == "" || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "/") || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("Invalid path to lock: %v", p)
+	}
+	return cleaned, nil
+}
+
+// Is the current user allowed to release other users' locks?
+func isLockAdmin(config *Config) bool {
+	return isUserInList(getServerUser(), config.LockAdmins)
+}
+
+func toFileLock(rec *lockRecord) *providers.FileLock {
+	return &providers.FileLock{Path: rec.Path, Owner: rec.Owner, LockedAt: rec.LockedAt, Mine: rec.Owner == getServerUser()}
+}
+
+func lockFile(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	params := smart.LockFileRequest{}
+	err := smart.ExtractStructFromJsonRawMessage(req.Params, &params)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	lockpath, err := normaliseLockPath(params.Path)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	user := getServerUser()
+	if user == "" {
+		return smart.NewJsonErrorResponse(req.Id, "Unable to identify the user, so can't lock files")
+	}
+	var result *lockRecord
+	err = updateLockDB(config, path, func(locks []*lockRecord) ([]*lockRecord, error) {
+		for _, rec := range locks {
+			if rec.Path != lockpath {
+				continue
+			}
+			if rec.Owner != user {
+				return nil, fmt.Errorf("%v is already locked by %v", lockpath, rec.Owner)
+			}
+			// Already ours
+			result = rec
+			return nil, nil
+		}
+		result = &lockRecord{Path: lockpath, Owner: user, LockedAt: time.Now()}
+		return append(locks, result), nil
+	})
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	resp, err := smart.NewJsonResponse(req.Id, smart.LockFileResponse{Lock: toFileLock(result)})
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+func unlockFile(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	params := smart.UnlockFileRequest{}
+	err := smart.ExtractStructFromJsonRawMessage(req.Params, &params)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	lockpath, err := normaliseLockPath(params.Path)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	user := getServerUser()
+	err = updateLockDB(config, path, func(locks []*lockRecord) ([]*lockRecord, error) {
+		for i, rec := range locks {
+			if rec.Path != lockpath {
+				continue
+			}
+			if rec.Owner != user {
+				if !params.Force {
+					return nil, fmt.Errorf("%v is locked by %v", lockpath, rec.Owner)
+				}
+				if !isLockAdmin(config) {
+					return nil, fmt.Errorf("User '%v' is not allowed to release other users' locks", user)
+				}
+			}
+			return append(locks[:i], locks[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%v is not locked", lockpath)
+	})
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	resp, err := smart.NewJsonResponse(req.Id, smart.UnlockFileResponse{})
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+func listLocks(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	locks, err := readLockDB(getLockDBFile(config, path))
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	result := smart.ListLocksResponse{Locks: []*providers.FileLock{}}
+	for _, rec := range locks {
+		result.Locks = append(result.Locks, toFileLock(rec))
+	}
+	resp, err := smart.NewJsonResponse(req.Id, result)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
@@ -31,6 +31,13 @@ func MainImpl() int {
 	// Get set up
 	cfg := LoadConfig()
 
+	user, args, err := parseServerArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err.Error())
+		return 18
+	}
+	serverUser = user
+
 	if cfg.BasePath == "" {
 		fmt.Fprintf(os.Stderr, "Missing required configuration setting: base-path\n")
 		return 12
@@ -56,13 +63,63 @@ func MainImpl() int {
 		}
 	}
 
+	// Report usage for the server admin, rather than serving a client
+	if len(args) > 0 && args[0] == "--usage" {
+		// Over SSH this could reveal other repositories, so only for admins
+		if os.Getenv("SSH_CONNECTION") != "" && !isPruneAdmin(cfg) {
+			fmt.Fprintf(os.Stderr, "User '%v' is not allowed to report usage for this server\n", getServerUser())
+			return 18
+		}
+		reportUsage(cfg, os.Stdout)
+		return 0
+	}
+
+	// Serve metrics recorded by connections, rather than serving a client
+	if len(args) > 0 && args[0] == "--metrics" {
+		if cfg.MetricsListen == "" {
+			fmt.Fprintf(os.Stderr, "Missing required configuration setting: metrics-listen\n")
+			return 12
+		}
+		err := serveMetricsHTTP(cfg)
+		fmt.Fprintf(os.Stderr, "Unable to serve metrics on %v: %v\n", cfg.MetricsListen, err.Error())
+		return 16
+	}
+
+	// Serve clients over HTTPS, rather than serving a single client
+	if len(args) > 0 && args[0] == "--https" {
+		if cfg.HttpsListen == "" || cfg.HttpsCert == "" || cfg.HttpsKey == "" {
+			fmt.Fprintf(os.Stderr, "Missing required configuration settings: https-listen, https-cert & https-key\n")
+			return 12
+		}
+		if len(cfg.UserTokens) == 0 {
+			fmt.Fprintf(os.Stderr, "No users can connect over HTTPS, add [user \"name\"] sections with tokens\n")
+			return 12
+		}
+		err := serveHTTPS(cfg)
+		fmt.Fprintf(os.Stderr, "Unable to serve HTTPS on %v: %v\n", cfg.HttpsListen, err.Error())
+		return 16
+	}
+
 	// Get path argument
-	if len(os.Args) < 2 {
+	if len(args) < 1 {
 		fmt.Fprintf(os.Stderr, "Path argument missing, cannot continue\n")
 		return 18
 	}
-	path := filepath.Clean(os.Args[1])
-	if filepath.IsAbs(path) && !cfg.AllowAbsolutePaths {
+	path := filepath.Clean(args[0])
+	if cfg.RepoMapping {
+		mappedpath, readOnly, err := resolveRepoPath(cfg, args[0], getServerUser())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err.Error())
+			return 18
+		}
+		path = mappedpath
+		cfg.ReadOnly = readOnly
+		repo := cfg.Repos[normaliseRepoName(args[0])]
+		if repo.Quota > 0 {
+			cfg.RepoQuota = repo.Quota
+		}
+		cfg.upstream = repo.Upstream
+	} else if filepath.IsAbs(path) && !cfg.AllowAbsolutePaths {
 		fmt.Fprintf(os.Stderr, "Path argument %v invalid, absolute paths are not allowed by this server\n", path)
 		return 18
 	}
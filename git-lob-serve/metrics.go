@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/atlassian/git-lob/util/lock"
+)
+
+// Metrics are recorded when metrics-listen is set. Each connection is a separate process, so
+// connections count what they do in memory & regularly add it to the totals in
+// $metrics-path/counters.json (under a lock, since several may finish at once). Each connection
+// also holds a lock file in $metrics-path/sessions while it's running, which counts it as active;
+// the lock's heartbeat means connections which were killed stop counting once it goes stale.
+// 'git-lob-serve --metrics' is a long-running process which serves the totals over HTTP in the
+// Prometheus text format.
+
+// Counters recorded by connections, also the format of counters.json
+type serveMetrics struct {
+	Sessions int64
+	// Requests & requests which failed, by method
+	Requests map[string]int64
+	Errors   map[string]int64
+	// Files & deltas transferred, and their bytes, by direction (upload or download)
+	Transfers map[string]int64
+	Bytes     map[string]int64
+	// Requests for deltas which were already in the delta cache, or had to be generated
+	DeltaCacheHits   int64
+	DeltaCacheMisses int64
+	// Binaries fetched from the upstream store in caching mode, & those which couldn't be
+	UpstreamFetches     int64
+	UpstreamFetchErrors int64
+}
+
+const (
+	metricsUpload   = "upload"
+	metricsDownload = "download"
+)
+
+// How often a connection adds what it's counted to the totals
+var metricsFlushInterval = 5 * time.Second
+
+// How long to wait for other connections to finish updating the totals
+var metricsLockTimeout = 5 * time.Second
+
+func newServeMetrics() *serveMetrics {
+	return &serveMetrics{
+		Requests:  make(map[string]int64),
+		Errors:    make(map[string]int64),
+		Transfers: make(map[string]int64),
+		Bytes:     make(map[string]int64),
+	}
+}
+
+// The recording methods do nothing when metrics aren't enabled (nil)
+
+// Record a request handled
+func (self *serveMetrics) addRequest(method string, failed bool) {
+	if self == nil {
+		return
+	}
+	// Don't let clients create arbitrary metrics
+	if _, ok := methodMap[method]; !ok && method != "Exit" {
+		method = "unknown"
+	}
+	self.Requests[method]++
+	if failed {
+		self.Errors[method]++
+	}
+}
+
+// Record a file or delta transferred in direction metricsUpload or metricsDownload
+func (self *serveMetrics) addTransfer(direction string, size int64) {
+	if self == nil {
+		return
+	}
+	self.Transfers[direction]++
+	self.Bytes[direction] += size
+}
+
+// Record whether a delta was in the delta cache
+func (self *serveMetrics) addDeltaCacheRequest(hit bool) {
+	if self == nil {
+		return
+	}
+	if hit {
+		self.DeltaCacheHits++
+	} else {
+		self.DeltaCacheMisses++
+	}
+}
+
+// Record a binary fetched from the upstream store, or which couldn't be
+func (self *serveMetrics) addUpstreamFetch(ok bool) {
+	if self == nil {
+		return
+	}
+	if ok {
+		self.UpstreamFetches++
+	} else {
+		self.UpstreamFetchErrors++
+	}
+}
+
+// Add other counters to these
+func (self *serveMetrics) add(other *serveMetrics) {
+	self.Sessions += other.Sessions
+	addMap := func(to, from map[string]int64) {
+		for k, v := range from {
+			to[k] += v
+		}
+	}
+	addMap(self.Requests, other.Requests)
+	addMap(self.Errors, other.Errors)
+	addMap(self.Transfers, other.Transfers)
+	addMap(self.Bytes, other.Bytes)
+	self.DeltaCacheHits += other.DeltaCacheHits
+	self.DeltaCacheMisses += other.DeltaCacheMisses
+	self.UpstreamFetches += other.UpstreamFetches
+	self.UpstreamFetchErrors += other.UpstreamFetchErrors
+}
+
+func getMetricsCountersFile(config *Config) string {
+	return filepath.Join(config.MetricsPath, "counters.json")
+}
+
+func getMetricsSessionsDir(config *Config) string {
+	return filepath.Join(config.MetricsPath, "sessions")
+}
+
+// Read the totals recorded by all connections so far
+func readMetrics(config *Config) (*serveMetrics, error) {
+	totals := newServeMetrics()
+	data, err := ioutil.ReadFile(getMetricsCountersFile(config))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return totals, nil
+		}
+		return nil, err
+	}
+	var stored serveMetrics
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid metrics file %v: %v", getMetricsCountersFile(config), err.Error())
+	}
+	totals.add(&stored)
+	return totals, nil
+}
+
+// Add what this connection has counted since last time to the totals
+// If that fails the counts are kept to try again next time
+func flushMetrics(config *Config) error {
+	if config.metrics == nil {
+		return nil
+	}
+	config.metricsFlushed = time.Now()
+	filename := getMetricsCountersFile(config)
+	l, err := lock.Acquire(filename+".lock", metricsLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	totals, err := readMetrics(config)
+	if err != nil {
+		return err
+	}
+	totals.add(config.metrics)
+	data, err := json.Marshal(totals)
+	if err != nil {
+		return err
+	}
+	tmpfilename := filename + ".tmp"
+	err = ioutil.WriteFile(tmpfilename, data, 0664)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpfilename, filename)
+	if err != nil {
+		os.Remove(tmpfilename)
+		return err
+	}
+	config.metrics = newServeMetrics()
+	return nil
+}
+
+// Flush if it's been long enough since last time, so long transfers show up while they happen
+func flushMetricsIfDue(config *Config) {
+	if config.metrics != nil && time.Since(config.metricsFlushed) >= metricsFlushInterval {
+		flushMetrics(config)
+	}
+}
+
+// Start recording metrics for a connection, if enabled
+// Returns a function to call when the connection finishes
+func startMetricsSession(config *Config) func() {
+	if config.MetricsListen == "" || config.MetricsPath == "" {
+		return func() {}
+	}
+	config.metrics = newServeMetrics()
+	config.metrics.Sessions = 1
+	// Nothing is lost if this fails, the connection just won't count as active
+	var sessionLock *lock.Lock
+	dir := getMetricsSessionsDir(config)
+	if ensureDirExists(dir, config) == nil {
+		name := fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+		sessionLock, _ = lock.Acquire(filepath.Join(dir, name), 0)
+	}
+	flushMetrics(config)
+	return func() {
+		flushMetrics(config)
+		if sessionLock != nil {
+			sessionLock.Release()
+		}
+		config.metrics = nil
+	}
+}
+
+// Count the connections currently running, tidying up after any which were killed
+func countActiveSessions(config *Config) int {
+	entries, err := ioutil.ReadDir(getMetricsSessionsDir(config))
+	if err != nil {
+		return 0
+	}
+	var n int
+	for _, e := range entries {
+		if time.Since(e.ModTime()) > lock.StaleAfter {
+			os.Remove(filepath.Join(getMetricsSessionsDir(config), e.Name()))
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// Write the metrics in the Prometheus text exposition format
+func writeMetrics(out io.Writer, totals *serveMetrics, activeSessions int) {
+	header := func(name, help, metricType string) {
+		fmt.Fprintf(out, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, metricType)
+	}
+	labelled := func(name, label string, values map[string]int64) {
+		var keys []string
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(out, "%v{%v=%q} %d\n", name, label, k, values[k])
+		}
+	}
+	// Always report both directions so rates can be calculated from the start
+	for _, direction := range []string{metricsUpload, metricsDownload} {
+		totals.Transfers[direction] += 0
+		totals.Bytes[direction] += 0
+	}
+
+	header("gitlob_serve_sessions_active", "Client connections currently running.", "gauge")
+	fmt.Fprintf(out, "gitlob_serve_sessions_active %d\n", activeSessions)
+	header("gitlob_serve_sessions_total", "Client connections started.", "counter")
+	fmt.Fprintf(out, "gitlob_serve_sessions_total %d\n", totals.Sessions)
+	header("gitlob_serve_requests_total", "Requests handled, by method.", "counter")
+	labelled("gitlob_serve_requests_total", "method", totals.Requests)
+	header("gitlob_serve_errors_total", "Requests which failed, by method.", "counter")
+	labelled("gitlob_serve_errors_total", "method", totals.Errors)
+	header("gitlob_serve_transfers_total", "Files & deltas transferred, by direction.", "counter")
+	labelled("gitlob_serve_transfers_total", "direction", totals.Transfers)
+	header("gitlob_serve_bytes_total", "Bytes of files & deltas transferred, by direction.", "counter")
+	labelled("gitlob_serve_bytes_total", "direction", totals.Bytes)
+	header("gitlob_serve_delta_cache_requests_total", "Deltas requested, by whether they were already in the delta cache.", "counter")
+	labelled("gitlob_serve_delta_cache_requests_total", "result",
+		map[string]int64{"hit": totals.DeltaCacheHits, "miss": totals.DeltaCacheMisses})
+	header("gitlob_serve_delta_cache_hit_ratio", "Proportion of deltas requested which were already in the delta cache.", "gauge")
+	var ratio float64
+	if requests := totals.DeltaCacheHits + totals.DeltaCacheMisses; requests > 0 {
+		ratio = float64(totals.DeltaCacheHits) / float64(requests)
+	}
+	fmt.Fprintf(out, "gitlob_serve_delta_cache_hit_ratio %g\n", ratio)
+	header("gitlob_serve_upstream_fetches_total", "Binaries missing from the store fetched from the upstream store in caching mode, by result.", "counter")
+	labelled("gitlob_serve_upstream_fetches_total", "result",
+		map[string]int64{"ok": totals.UpstreamFetches, "error": totals.UpstreamFetchErrors})
+}
+
+// Serve metrics over HTTP at /metrics until the process is stopped, for 'git-lob-serve --metrics'
+func serveMetricsHTTP(config *Config) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		totals, err := readMetrics(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, totals, countActiveSessions(config))
+	})
+	if err := ensureDirExists(config.MetricsPath, config); err != nil {
+		return err
+	}
+	return http.ListenAndServe(config.MetricsListen, mux)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers/smart"
+)
+
+// Pruning deletes LOBs from the store on request of a client, which has worked out which
+// LOBs are no longer referenced by any pushed commit. The server has no access to the git
+// repo so it has to trust the client, which is why this is restricted to admins.
+
+var lobSHARegex = regexp.MustCompile("^(?:" + core.LOBSHARegexFragment + ")$")
+
+// Is the current user allowed to prune the store?
+func isPruneAdmin(config *Config) bool {
+	return isUserInList(getServerUser(), config.PruneAdmins)
+}
+
+// Get the latest modification time of any of the files for a LOB, and their total size
+func getLOBLatestModTime(sha, lobroot string) (time.Time, int64) {
+	var latest time.Time
+	var size int64
+	dir := filepath.Dir(filepath.Join(lobroot, core.GetLOBMetaRelativePath(sha)))
+	names, _ := filepath.Glob(filepath.Join(dir, sha+"*"))
+	for _, n := range names {
+		if s, err := os.Stat(n); err == nil {
+			if s.ModTime().After(latest) {
+				latest = s.ModTime()
+			}
+			size += s.Size()
+		}
+	}
+	return latest, size
+}
+
+func listLOBs(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	if !isPruneAdmin(config) {
+		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("User '%v' is not allowed to prune this server", getServerUser()))
+	}
+	result := smart.ListLOBsResponse{LobSHAs: []string{}}
+	lobroot := getLOBRoot(config, path)
+	// Nothing uploaded yet is not an error
+	if _, err := os.Stat(lobroot); err == nil {
+		shas, err := core.GetAllLOBSHAsInBaseDir(lobroot)
+		if err != nil {
+			return smart.NewJsonErrorResponse(req.Id, err.Error())
+		}
+		for sha := range shas.Iter() {
+			result.LobSHAs = append(result.LobSHAs, sha)
+		}
+	}
+	resp, err := smart.NewJsonResponse(req.Id, result)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+func pruneLOBs(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	if !isPruneAdmin(config) {
+		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("User '%v' is not allowed to prune this server", getServerUser()))
+	}
+	params := smart.PruneLOBsRequest{}
+	err := smart.ExtractStructFromJsonRawMessage(req.Params, &params)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	result := smart.PruneLOBsResponse{Deleted: []string{}, Retained: []string{}, Held: []string{}}
+	lobroot := getLOBRoot(config, path)
+	graceLimit := time.Now().AddDate(0, 0, -config.PruneGracePeriodDays)
+	for _, sha := range params.LobSHAs {
+		if !lobSHARegex.MatchString(sha) {
+			return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Invalid LOB SHA: %v", sha))
+		}
+		modtime, size := getLOBLatestModTime(sha, lobroot)
+		if modtime.IsZero() {
+			// Nothing to delete
+			continue
+		}
+		// LOBs under a retention hold must not be deleted, whether referenced or not
+		if isUnderRetentionHold(sha, lobroot, config) {
+			result.Held = append(result.Held, sha)
+			continue
+		}
+		// Recently uploaded LOBs may be for commits the client doesn't know about yet
+		if modtime.After(graceLimit) {
+			result.Retained = append(result.Retained, sha)
+			continue
+		}
+		if !params.DryRun {
+			err = lobStore.DeleteLOBInBaseDir(sha, lobroot)
+			if err != nil {
+				return smart.NewJsonErrorResponse(req.Id, err.Error())
+			}
+			deleteCachedDeltasForLOB(sha, config, path)
+			deleteRetentionRecord(sha, lobroot)
+		}
+		result.Deleted = append(result.Deleted, sha)
+		result.DeletedSize += size
+	}
+	// Chunk objects are shared between LOBs so aren't deleted with them
+	// Not an error if this fails, the LOBs are gone & unreferenced chunk objects just use space
+	if !params.DryRun && len(result.Deleted) > 0 {
+		lobStore.PruneChunkObjectsInBaseDir(lobroot, false, getChunkObjectRetentionStart(config))
+	}
+
+	resp, err := smart.NewJsonResponse(req.Id, result)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+// Delete any cached deltas to or from a LOB (not an error if this fails, just uses space)
+func deleteCachedDeltasForLOB(sha string, config *Config, path string) {
+	if config.DeltaCachePath == "" {
+		return
+	}
+	// Deltas made with algorithms other than bm have an extension
+	for _, pattern := range []string{fmt.Sprintf("%v_*", sha), fmt.Sprintf("*_%v", sha), fmt.Sprintf("*_%v.*", sha)} {
+		names, _ := filepath.Glob(filepath.Join(getLOBDeltaCacheDir(config, path), pattern))
+		for _, n := range names {
+			os.Remove(n)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/atlassian/git-lob/providers/smart"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Quotas limit how much can be stored, either in total under base-path (quota) or for each
+// repository path (repo-quota, or quota in a [repo] section in mapping mode). Uploads which
+// would take usage over a quota are rejected with a structured error (smart.ErrorCodeQuotaExceeded)
+// so the client can stop & report it clearly rather than retrying.
+// Usage is calculated by scanning the store the first time it's needed in a connection, then
+// kept up to date as files are uploaded, so concurrent connections can each go slightly over.
+
+// Get the number of bytes stored in all files under a folder
+func getDirUsage(dir string) int64 {
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// Get the bytes used under a folder, scanning it the first time in this connection
+func getStoredBytes(dir string, config *Config) int64 {
+	if config.usage == nil {
+		config.usage = make(map[string]int64)
+	}
+	used, ok := config.usage[dir]
+	if !ok {
+		used = getDirUsage(dir)
+		config.usage[dir] = used
+	}
+	return used
+}
+
+// Record that n bytes were added to (or removed from, if negative) the store for path
+func addStoredBytes(n int64, config *Config, path string) {
+	for _, dir := range []string{getLOBRoot(config, path), config.BasePath} {
+		if used, ok := config.usage[dir]; ok {
+			config.usage[dir] = used + n
+		}
+	}
+}
+
+// Check whether storing size more bytes for path would exceed the repository or global quota
+// Returns the error to send to the client if so, otherwise nil
+func checkQuota(size int64, config *Config, path string) *smart.ErrorDetail {
+	if size <= 0 || (config.Quota <= 0 && config.RepoQuota <= 0) {
+		return nil
+	}
+	if config.RepoQuota > 0 {
+		used := getStoredBytes(getLOBRoot(config, path), config)
+		if used+size > config.RepoQuota {
+			return newQuotaExceededError(fmt.Sprintf("repository %v", filepath.ToSlash(path)), used, config.RepoQuota, size)
+		}
+	}
+	if config.Quota > 0 {
+		used := getStoredBytes(config.BasePath, config)
+		if used+size > config.Quota {
+			return newQuotaExceededError("this server", used, config.Quota, size)
+		}
+	}
+	return nil
+}
+
+func newQuotaExceededError(what string, used, quota, size int64) *smart.ErrorDetail {
+	return &smart.ErrorDetail{
+		Code: smart.ErrorCodeQuotaExceeded,
+		Message: fmt.Sprintf("%v has used %v of its %v quota, cannot store %v more",
+			what, util.FormatSize(used), util.FormatSize(quota), util.FormatSize(size)),
+		Used:  used,
+		Quota: quota,
+	}
+}
+
+// Usage of a single store, for reportUsage
+type storeUsage struct {
+	// Repository name in mapping mode, otherwise the path under base-path
+	Name  string
+	Used  int64
+	Quota int64
+}
+
+// Folders containing binaries have 3 hex character subfolders (see core.getLOBRelativeDir)
+var lobDirRegex = regexp.MustCompile(`^[a-f0-9]{3}$`)
+
+// Is dir the root of a binary store?
+func isLOBRoot(dir string) bool {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.IsDir() && lobDirRegex.MatchString(e.Name()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the usage of every store on the server, sorted by name
+// In mapping mode these are the configured repositories, otherwise any folder under base-path
+// which contains binaries
+func getStoreUsage(config *Config) []*storeUsage {
+	var ret []*storeUsage
+	if config.RepoMapping {
+		for name, repo := range config.Repos {
+			path := repo.Path
+			if path == "" {
+				path = name
+			}
+			quota := repo.Quota
+			if quota <= 0 {
+				quota = config.RepoQuota
+			}
+			ret = append(ret, &storeUsage{name, getDirUsage(getLOBRoot(config, path)), quota})
+		}
+	} else {
+		filepath.Walk(config.BasePath, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			// Delta cache, retention records etc aren't stores
+			if path != config.BasePath && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if isLOBRoot(path) {
+				rel, _ := filepath.Rel(config.BasePath, path)
+				rel = filepath.ToSlash(rel)
+				ret = append(ret, &storeUsage{rel, getDirUsage(path), config.RepoQuota})
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
+	sort.Sort(storeUsageByName(ret))
+	return ret
+}
+
+type storeUsageByName []*storeUsage
+
+func (s storeUsageByName) Len() int           { return len(s) }
+func (s storeUsageByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s storeUsageByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Write a report of the usage of each store & the whole server, for 'git-lob-serve --usage'
+func reportUsage(config *Config, out io.Writer) {
+	formatQuota := func(used, quota int64) string {
+		if quota <= 0 {
+			return "no quota"
+		}
+		return fmt.Sprintf("of %v (%d%%)", util.FormatSize(quota), used*100/quota)
+	}
+	for _, s := range getStoreUsage(config) {
+		fmt.Fprintf(out, "%-40v %10v %v\n", s.Name, util.FormatSize(s.Used), formatQuota(s.Used, s.Quota))
+	}
+	total := getDirUsage(config.BasePath)
+	fmt.Fprintf(out, "%-40v %10v %v\n", "Total", util.FormatSize(total), formatQuota(total, config.Quota))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Repository mapping mode lets one server host binaries for many repositories securely.
+// Instead of using the requested path directly under base-path, the path must be the name of
+// a repository in the configuration, which maps it to a folder under base-path and says which
+// users may access it, and which of them may only read.
+// Configured with named sections in the config file:
+//
+//   repo-mapping = true
+//   [repo "goteam/repo1"]
+//       path = teams/go/repo1
+//       allow = steve, andy
+//       read-only = andy
+//       quota = 50GB
+//       upstream = studio
+
+// Access settings for a repository in mapping mode
+type RepoConfig struct {
+	// Folder relative to base-path (defaults to the repository name)
+	Path string
+	// Users allowed to access the repository ("*" for anyone), empty for anyone
+	Allow []string
+	// Users never allowed to access the repository, overrides Allow
+	Deny []string
+	// Users who may download but not upload or prune ("*" for everyone)
+	ReadOnly []string
+	// Maximum bytes stored for this repository, overrides repo-quota if > 0
+	Quota int64
+	// Name of the upstream store to fetch missing binaries from in caching mode, if not the
+	// unnamed one
+	Upstream string
+}
+
+// Methods which change the store, not allowed for read-only users
+var writeMethods = util.NewStringSetFromSlice([]string{
+	"UploadFile",
+	"UploadDelta",
+	"PruneLOBs",
+	"LockFile",
+	"UnlockFile",
+})
+
+// Normalise a requested repository name so it can be matched against the configuration
+// Names are case insensitive, since config file keys are
+func normaliseRepoName(name string) string {
+	name = filepath.ToSlash(filepath.Clean(name))
+	return strings.ToLower(strings.Trim(name, "/"))
+}
+
+// Is user in a list of users, where "*" matches anyone?
+func isUserInList(user string, list []string) bool {
+	for _, u := range list {
+		if u == "*" || (user != "" && u == user) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a comma-separated list of users from a setting
+func parseUserList(v string) []string {
+	var ret []string
+	for _, user := range strings.Split(v, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			ret = append(ret, user)
+		}
+	}
+	return ret
+}
+
+// Read repository mappings from config file settings ([repo "name"] sections)
+func parseRepoConfigs(settings map[string]string) map[string]*RepoConfig {
+	repos := make(map[string]*RepoConfig)
+	for key, val := range settings {
+		if !strings.HasPrefix(key, "repo.") {
+			continue
+		}
+		// Repository names may contain dots, the setting is after the last one
+		dot := strings.LastIndex(key, ".")
+		if dot <= len("repo.") {
+			continue
+		}
+		name := normaliseRepoName(key[len("repo."):dot])
+		if name == "" || name == "." {
+			continue
+		}
+		repo, ok := repos[name]
+		if !ok {
+			repo = &RepoConfig{}
+			repos[name] = repo
+		}
+		switch key[dot+1:] {
+		case "path":
+			repo.Path = val
+		case "allow":
+			repo.Allow = parseUserList(val)
+		case "deny":
+			repo.Deny = parseUserList(val)
+		case "read-only":
+			repo.ReadOnly = parseUserList(val)
+		case "quota":
+			quota, err := util.ParseSize(val)
+			if err != nil || quota < 0 {
+				fmt.Fprintf(os.Stderr, "Invalid configuration: %v=%v\n", key, val)
+			} else {
+				repo.Quota = quota
+			}
+		case "upstream":
+			// Section names are case insensitive too
+			repo.Upstream = strings.ToLower(val)
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown configuration setting: %v\n", key)
+		}
+	}
+	return repos
+}
+
+// Whether a cleaned relative path leads outside base-path
+func isOutsideBasePath(path string) bool {
+	return path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator))
+}
+
+// Resolve the path requested by a client to the store path for a repository in mapping mode,
+// checking that user is allowed access. Also returns whether user may only read
+func resolveRepoPath(config *Config, requested, user string) (path string, readOnly bool, err error) {
+	name := normaliseRepoName(requested)
+	repo, ok := config.Repos[name]
+	if !ok {
+		return "", false, fmt.Errorf("Repository %v is not served by this server", requested)
+	}
+	if isUserInList(user, repo.Deny) || (len(repo.Allow) > 0 && !isUserInList(user, repo.Allow)) {
+		return "", false, fmt.Errorf("User '%v' is not allowed to access repository %v", user, requested)
+	}
+	path = repo.Path
+	if path == "" {
+		path = name
+	}
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) {
+		if !config.AllowAbsolutePaths {
+			return "", false, fmt.Errorf("Repository %v is misconfigured, absolute paths are not allowed by this server", requested)
+		}
+	} else if path == "." || isOutsideBasePath(path) {
+		return "", false, fmt.Errorf("Repository %v is misconfigured, path must be a folder under base-path", requested)
+	}
+	return path, isUserInList(user, repo.ReadOnly), nil
+}
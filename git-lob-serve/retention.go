@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Retention (write-once) mode is for stores which must be able to show that binaries were not
+// modified or deleted for a period after they were pushed, for compliance. When retention-days
+// is set, stored files can't be overwritten with different content and binaries can't be pruned
+// until their retention period is over; prune reports these as held rather than failing.
+// The period for each binary is recorded when it's first uploaded, so that reducing or
+// disabling retention-days later doesn't shorten the hold on anything already stored.
+
+// Retention metadata recorded for each binary
+type retentionRecord struct {
+	// When the binary was first uploaded
+	Uploaded time.Time
+	// The binary can't be modified or deleted before this time
+	RetainUntil time.Time
+}
+
+// Gets the path of the retention record for a LOB
+func getRetentionRecordPath(sha, lobroot string) string {
+	return filepath.Join(lobroot, ".retention", sha[:3], sha)
+}
+
+func readRetentionRecord(sha, lobroot string) (*retentionRecord, error) {
+	data, err := ioutil.ReadFile(getRetentionRecordPath(sha, lobroot))
+	if err != nil {
+		return nil, err
+	}
+	rec := &retentionRecord{}
+	err = json.Unmarshal(data, rec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retention record for %v: %v", sha, err.Error())
+	}
+	return rec, nil
+}
+
+// Record the retention period for a LOB when it's uploaded, if retention is enabled
+// An existing record is never changed
+func recordRetention(sha string, config *Config, path string) error {
+	if config.RetentionDays <= 0 || !lobSHARegex.MatchString(sha) {
+		return nil
+	}
+	lobroot := getLOBRoot(config, path)
+	file := getRetentionRecordPath(sha, lobroot)
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+	now := time.Now()
+	data, err := json.Marshal(&retentionRecord{Uploaded: now, RetainUntil: now.AddDate(0, 0, config.RetentionDays)})
+	if err != nil {
+		return err
+	}
+	err = ensureDirExists(filepath.Dir(file), config)
+	if err != nil {
+		return fmt.Errorf("Unable to record retention for %v: %v", sha, err.Error())
+	}
+	err = ioutil.WriteFile(file, data, 0444)
+	if err != nil {
+		return fmt.Errorf("Unable to record retention for %v: %v", sha, err.Error())
+	}
+	return nil
+}
+
+// Get when the retention hold on a LOB ends, or zero time if there's no hold
+func getRetentionHoldExpiry(sha, lobroot string, config *Config) time.Time {
+	if !lobSHARegex.MatchString(sha) {
+		return time.Time{}
+	}
+	rec, err := readRetentionRecord(sha, lobroot)
+	if err == nil {
+		return rec.RetainUntil
+	}
+	// Uploaded before retention was enabled, or the record was lost; be conservative
+	if config.RetentionDays > 0 {
+		modtime, _ := getLOBLatestModTime(sha, lobroot)
+		if !modtime.IsZero() {
+			return modtime.AddDate(0, 0, config.RetentionDays)
+		}
+	}
+	return time.Time{}
+}
+
+// Is a LOB under a retention hold, i.e. must not be modified or deleted yet?
+func isUnderRetentionHold(sha, lobroot string, config *Config) bool {
+	return getRetentionHoldExpiry(sha, lobroot, config).After(time.Now())
+}
+
+// Get the time from which chunk objects are under a retention hold, or zero time if retention
+// is off; they have no records of their own, so their modification time is when they were uploaded
+func getChunkObjectRetentionStart(config *Config) time.Time {
+	if config.RetentionDays <= 0 {
+		return time.Time{}
+	}
+	return time.Now().AddDate(0, 0, -config.RetentionDays)
+}
+
+// Remove the retention record of a LOB which has been deleted
+func deleteRetentionRecord(sha, lobroot string) {
+	os.Remove(getRetentionRecordPath(sha, lobroot))
+}
+
+// Check whether an existing stored file may be replaced with newfile
+// Files under a retention hold may only be 'replaced' with identical content, in which case
+// replace is returned false because there's nothing to do
+func checkRetentionAllowsReplace(existing, newfile, sha, filetype string, config *Config, path string) (replace bool, err error) {
+	if _, err := os.Stat(existing); err != nil {
+		return true, nil
+	}
+	// Chunk objects are shared between LOBs, so are held if retention is on at all
+	held := config.RetentionDays > 0
+	if filetype != "object" {
+		held = isUnderRetentionHold(sha, getLOBRoot(config, path), config)
+	}
+	if !held {
+		return true, nil
+	}
+	if filesHaveSameContent(existing, newfile) {
+		return false, nil
+	}
+	expiry := getRetentionHoldExpiry(sha, getLOBRoot(config, path), config)
+	if filetype == "object" || expiry.IsZero() {
+		return false, fmt.Errorf("%v is already stored and the server is in write-once retention mode, it cannot be modified", filepath.Base(existing))
+	}
+	return false, fmt.Errorf("%v is under a retention hold until %v and cannot be modified", filepath.Base(existing), expiry.Format("2006-01-02"))
+}
+
+// Returns whether 2 files have identical content
+func filesHaveSameContent(file1, file2 string) bool {
+	s1, err := os.Stat(file1)
+	if err != nil {
+		return false
+	}
+	s2, err := os.Stat(file2)
+	if err != nil || s1.Size() != s2.Size() {
+		return false
+	}
+	f1, err := os.Open(file1)
+	if err != nil {
+		return false
+	}
+	defer f1.Close()
+	f2, err := os.Open(file2)
+	if err != nil {
+		return false
+	}
+	defer f2.Close()
+	buf1 := make([]byte, transferBufferSize)
+	buf2 := make([]byte, transferBufferSize)
+	for {
+		n1, err1 := io.ReadFull(f1, buf1)
+		n2, _ := io.ReadFull(f2, buf2)
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false
+		}
+		if err1 != nil {
+			// EOF on both, since sizes are equal
+			return err1 == io.EOF || err1 == io.ErrUnexpectedEOF
+		}
+	}
+}
@@ -13,18 +13,25 @@ import (
 type MethodFunc func(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse
 
 var methodMap = map[string]MethodFunc{
-	"QueryCaps":            queryCaps,
-	"SetEnabledCaps":       setCaps,
-	"FileExists":           fileExists,
-	"FileExistsOfSize":     fileExistsOfSize,
-	"LOBExists":            lobExists,
-	"UploadFile":           uploadFile,
-	"DownloadFilePrepare":  downloadFilePrepare,
-	"DownloadFileStart":    downloadFileStart,
-	"PickCompleteLOB":      pickCompleteLOB,
-	"UploadDelta":          uploadDelta,
-	"DownloadDeltaPrepare": downloadDeltaPrepare,
-	"DownloadDeltaStart":   downloadDeltaStart,
+	"Negotiate":             negotiate,
+	"QueryCaps":             queryCaps,
+	"SetEnabledCaps":        setCaps,
+	"FileExists":            fileExists,
+	"FileExistsOfSize":      fileExistsOfSize,
+	"LOBExists":             lobExists,
+	"UploadFile":            uploadFile,
+	"DownloadFilePrepare":   downloadFilePrepare,
+	"DownloadFileStart":     downloadFileStart,
+	"DownloadMetadataBatch": downloadMetadataBatch,
+	"PickCompleteLOB":       pickCompleteLOB,
+	"UploadDelta":           uploadDelta,
+	"DownloadDeltaPrepare":  downloadDeltaPrepare,
+	"DownloadDeltaStart":    downloadDeltaStart,
+	"ListLOBs":              listLOBs,
+	"PruneLOBs":             pruneLOBs,
+	"LockFile":              lockFile,
+	"UnlockFile":            unlockFile,
+	"ListLocks":             listLocks,
 }
 
 // these methods can't return any error responses
@@ -35,6 +42,11 @@ var bytestreamResponseMethods = util.NewStringSetFromSlice([]string{
 
 func Serve(in io.Reader, out io.Writer, outerr io.Writer, config *Config, path string) int {
 
+	endMetrics := startMetricsSession(config)
+	defer endMetrics()
+	defer releaseUpstreamProvider(config)
+	defer releaseCompressedDownload(config)
+
 	// Read input from client on stdin, buffered so we can detect terminators for JSON
 
 	rdr := bufio.NewReader(in)
@@ -63,6 +75,7 @@ func Serve(in io.Reader, out io.Writer, outerr io.Writer, config *Config, path s
 			result := &smart.ExitResponse{}
 			resp, _ := smart.NewJsonResponse(req.Id, result)
 			sendResponse(resp, out)
+			config.metrics.addRequest(req.Method, false)
 			return 0
 		}
 
@@ -72,10 +85,13 @@ func Serve(in io.Reader, out io.Writer, outerr io.Writer, config *Config, path s
 		if !ok {
 			// Since it was valid JSON otherwise, send error as response
 			resp = smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unknown method %v", req.Method))
+		} else if config.ReadOnly && writeMethods.Contains(req.Method) {
+			resp = smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("User '%v' has read-only access to this repository", getServerUser()))
 		} else {
 			// method found, process
 			resp = f(&req, rdr, out, config, path)
 		}
+		config.metrics.addRequest(req.Method, resp != nil && resp.Error != nil && resp.Error != "")
 		// There may not have been a JSON response; that might be because method just streams bytes
 		// in which case we just ignore this bit
 		if resp != nil {
@@ -94,6 +110,8 @@ func Serve(in io.Reader, out io.Writer, outerr io.Writer, config *Config, path s
 			}
 		}
 
+		flushMetricsIfDue(config)
+
 		// Ready for next request from client
 
 	}
@@ -4,21 +4,66 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
 	"net"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/cloudflare/bm"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
 	"github.com/atlassian/git-lob/core"
 	"github.com/atlassian/git-lob/providers/smart"
+	"github.com/atlassian/git-lob/util"
 )
 
+// Connection which corrupts a byte of the next large transfer in either direction
+type corruptingConn struct {
+	net.Conn
+	corruptNextWrite bool
+	corruptNextRead  bool
+}
+
+func (self *corruptingConn) Write(p []byte) (int, error) {
+	if self.corruptNextWrite && len(p) > 1000 {
+		self.corruptNextWrite = false
+		corrupt := append([]byte{}, p...)
+		corrupt[len(p)/2] ^= 0xff
+		return self.Conn.Write(corrupt)
+	}
+	return self.Conn.Write(p)
+}
+
+func (self *corruptingConn) Read(p []byte) (int, error) {
+	n, err := self.Conn.Read(p)
+	if self.corruptNextRead && n > 1000 {
+		self.corruptNextRead = false
+		p[n/2] ^= 0xff
+	}
+	return n, err
+}
+
+// Capabilities advertised for the delta algorithms & transfer compression codecs available here
+func algorithmCaps() []string {
+	var caps []string
+	for _, alg := range core.GetAvailableDeltaAlgorithms() {
+		caps = append(caps, "delta_algorithm="+alg)
+	}
+	for _, codec := range smart.TransferCompressionCodecs {
+		caps = append(caps, smart.CompressCapPrefix+codec)
+	}
+	return caps
+}
+
 var _ = Describe("git-lob-serve tests", func() {
 	Context("Test individual server requests with test data", func() {
 
@@ -60,11 +105,27 @@ var _ = Describe("git-lob-serve tests", func() {
 			trans := smart.NewPersistentTransport(cli)
 			caps, err := trans.QueryCaps()
 			Expect(err).To(BeNil(), "Should be no error")
-			Expect(caps).To(ConsistOf([]string{"binary_delta"}))
+			Expect(caps).To(ConsistOf(append([]string{"binary_delta", "chunk_objects", "chunk_size", "locking", "chunk_hash", "metadata_batch", "previews"}, algorithmCaps()...)))
 			Expect(outerr.String()).To(HaveLen(0), "Nothing should be written to stderr")
 
 		})
 
+		It("Negotiates protocol version & features (client + reference server)", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+
+			trans := smart.NewPersistentTransport(cli)
+			version, features, err := trans.Negotiate(smart.ProtocolVersion+1,
+				[]string{"binary_delta", "some_future_feature", "prune", "delta_algorithm=nonsense", "delta_algorithm=zstd", "delta_algorithm=bm"})
+			Expect(err).To(BeNil())
+			Expect(version).To(Equal(smart.ProtocolVersion), "Should speak the older version")
+			Expect(features).To(Equal([]string{"binary_delta", "delta_algorithm=zstd"}), "Should only enable features offered, first value of each")
+			Expect(config.deltaAlgorithm).To(Equal(core.DeltaAlgorithmZstd))
+			Expect(outerr.String()).To(HaveLen(0), "Nothing should be written to stderr")
+		})
+
 		It("Uploads & downloads simple files (client + reference server)", func() {
 			cli, srv := net.Pipe()
 			var outerr bytes.Buffer
@@ -143,6 +204,162 @@ var _ = Describe("git-lob-serve tests", func() {
 
 		})
 
+		It("Downloads metadata in batches (client + reference server)", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+
+			trans := smart.NewPersistentTransport(cli)
+			err := trans.UploadMetadata(testsha, int64(len(metacontent)), strings.NewReader(metacontent))
+			Expect(err).To(BeNil(), "Should not be an error in UploadMetadata")
+			othersha := "1111111111111111111111111111111111111111"
+			othercontent := `{"SHA":"1111111111111111111111111111111111111111","Size":3,"NumChunks":1}`
+			err = trans.UploadMetadata(othersha, int64(len(othercontent)), strings.NewReader(othercontent))
+			Expect(err).To(BeNil(), "Should not be an error in UploadMetadata")
+
+			metas, err := trans.DownloadMetadataBatch([]string{othersha, "0000000000000000000000000000000000000000", "../../etc", testsha})
+			Expect(err).To(BeNil(), "Should not be an error in DownloadMetadataBatch")
+			Expect(metas).To(HaveLen(2), "Only metadata the server has should be returned")
+			Expect(string(metas[testsha])).To(Equal(metacontent))
+			Expect(string(metas[othersha])).To(Equal(othercontent))
+
+			// Connection should still be in step afterwards
+			exists, _, err := trans.MetadataExists(testsha)
+			Expect(err).To(BeNil(), "Should not be an error in MetadataExists")
+			Expect(exists).To(BeTrue())
+
+			// Too many at once is refused but the connection is still usable
+			_, err = trans.DownloadMetadataBatch(make([]string, smart.MaxMetadataBatch+1))
+			Expect(err).ToNot(BeNil(), "Should refuse more than the maximum")
+			metas, err = trans.DownloadMetadataBatch([]string{testsha})
+			Expect(err).To(BeNil(), "Should not be an error in DownloadMetadataBatch")
+			Expect(string(metas[testsha])).To(Equal(metacontent))
+			Expect(outerr.String()).To(HaveLen(0), "Nothing should be written to stderr")
+		})
+
+		It("Uploads & downloads previews (client + reference server)", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+
+			trans := smart.NewPersistentTransport(cli)
+			exists, _, err := trans.PreviewExists(testsha)
+			Expect(err).To(BeNil(), "Should not be an error in PreviewExists")
+			Expect(exists).To(BeFalse(), "Preview should not exist yet")
+
+			preview := []byte("\x89PNG\r\n\x1a\nthumbnail")
+			err = trans.UploadPreview(testsha, int64(len(preview)), bytes.NewReader(preview))
+			Expect(err).To(BeNil(), "Should not be an error in UploadPreview")
+			Expect(util.FileExists(getLOBPreviewFilePath(testsha, config, repopath))).To(BeTrue(), "Preview should be stored alongside the LOB")
+			exists, sz, err := trans.PreviewExists(testsha)
+			Expect(err).To(BeNil(), "Should not be an error in PreviewExists")
+			Expect(exists).To(BeTrue(), "Preview should now exist")
+			Expect(sz).To(BeEquivalentTo(len(preview)))
+			exists, _, err = trans.MetadataExists(testsha)
+			Expect(err).To(BeNil(), "Should not be an error in MetadataExists")
+			Expect(exists).To(BeFalse(), "Preview should not be mistaken for metadata")
+
+			var buf bytes.Buffer
+			err = trans.DownloadPreview(testsha, &buf)
+			Expect(err).To(BeNil(), "Should not be an error in DownloadPreview")
+			Expect(buf.Bytes()).To(Equal(preview))
+
+			_, _, err = trans.PreviewExists("../../escape")
+			Expect(err).ToNot(BeNil(), "Invalid SHA should be an error")
+			Expect(outerr.String()).To(HaveLen(0), "Nothing should be written to stderr")
+		})
+
+		It("Uploads & downloads chunk objects (client + reference server)", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+
+			trans := smart.NewPersistentTransport(cli)
+			callback := func(bytesDone, totalBytes int64) {}
+			objsha := fmt.Sprintf("%x", sha1.Sum(testchunkdata))
+			exists, _, err := trans.ChunkObjectExists(objsha)
+			Expect(err).To(BeNil(), "Should not be an error in ChunkObjectExists")
+			Expect(exists).To(BeFalse(), "Chunk object should not exist yet")
+
+			// Chunk objects are shared by SHA so the server must check the content
+			wrongsha := "1111111111111111111111111111111111111111"
+			err = trans.UploadChunkObject(wrongsha, testchunkdatasz, bytes.NewReader(testchunkdata), callback)
+			Expect(err).ToNot(BeNil(), "Should reject chunk object with the wrong SHA")
+			Expect(util.FileExists(getChunkObjectFilePath(wrongsha, config, repopath))).To(BeFalse(), "Wrong content should not be stored")
+
+			err = trans.UploadChunkObject(objsha, testchunkdatasz, bytes.NewReader(testchunkdata), callback)
+			Expect(err).To(BeNil(), "Should not be an error in UploadChunkObject")
+			exists, sz, err := trans.ChunkObjectExists(objsha)
+			Expect(err).To(BeNil(), "Should not be an error in ChunkObjectExists")
+			Expect(exists).To(BeTrue(), "Chunk object should now exist")
+			Expect(sz).To(BeEquivalentTo(testchunkdatasz), "Server should report chunk object at right size")
+
+			var buf bytes.Buffer
+			err = trans.DownloadChunkObject(objsha, &buf, callback)
+			Expect(err).To(BeNil(), "Should not be an error in DownloadChunkObject")
+			Expect(buf.Bytes()).To(Equal(testchunkdata), "Should download chunk object content")
+
+			_, _, err = trans.ChunkObjectExists("../../escape")
+			Expect(err).ToNot(BeNil(), "Invalid chunk object SHA should be an error")
+		})
+
+		It("Checks chunks against size+hash trailers when enabled", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			conn := &corruptingConn{Conn: cli}
+			defer conn.Close()
+			trans := smart.NewPersistentTransport(conn)
+			_, features, err := trans.Negotiate(smart.ProtocolVersion, []string{smart.ChunkHashCap})
+			Expect(err).To(BeNil())
+			Expect(features).To(Equal([]string{smart.ChunkHashCap}))
+			Expect(config.chunkHashes).To(BeTrue())
+			trans.SetChunkHashes(true)
+			callback := func(bytesDone, totalBytes int64) {}
+			compressible := bytes.Repeat([]byte("Some very compressible content. "), 10000)
+			lobsha := "abcdef1234567890abcdef1234567890abcdef12"
+			objsha := fmt.Sprintf("%x", sha1.Sum(testchunkdata))
+
+			for _, codec := range []string{"", smart.TransferCompressionCodecs[0]} {
+				trans.SetTransferCompression(codec)
+				for i, content := range [][]byte{compressible, testchunkdata} {
+					sz := int64(len(content))
+					err = trans.UploadChunk(lobsha, i, sz, bytes.NewReader(content), callback)
+					Expect(err).To(BeNil(), "Should upload chunk %d compressed with '%v'", i, codec)
+					var buf bytes.Buffer
+					err = trans.DownloadChunk(lobsha, i, &buf, callback)
+					Expect(err).To(BeNil(), "Should download chunk %d compressed with '%v'", i, codec)
+					Expect(buf.Bytes()).To(Equal(content))
+				}
+				err = trans.UploadChunkObject(objsha, testchunkdatasz, bytes.NewReader(testchunkdata), callback)
+				Expect(err).To(BeNil(), "Should upload chunk object compressed with '%v'", codec)
+				var buf bytes.Buffer
+				err = trans.DownloadChunkObject(objsha, &buf, callback)
+				Expect(err).To(BeNil(), "Should download chunk object compressed with '%v'", codec)
+				Expect(buf.Bytes()).To(Equal(testchunkdata))
+			}
+			releaseCompressedDownload(config)
+
+			// Corruption in transit is caught straight away, & the connection can carry on
+			trans.SetTransferCompression("")
+			conn.corruptNextWrite = true
+			err = trans.UploadChunk(lobsha, 5, testchunkdatasz, bytes.NewReader(testchunkdata), callback)
+			Expect(err).ToNot(BeNil(), "Server should reject corrupt upload")
+			Expect(err.Error()).To(ContainSubstring("does not match trailer"))
+			Expect(util.FileExists(getLOBChunkFilePath(lobsha, 5, config, repopath))).To(BeFalse(), "Corrupt chunk should not be stored")
+			conn.corruptNextRead = true
+			var buf bytes.Buffer
+			err = trans.DownloadChunk(lobsha, 1, &buf, callback)
+			Expect(err).ToNot(BeNil(), "Client should reject corrupt download")
+			Expect(err.Error()).To(ContainSubstring("does not match trailer"))
+			buf.Reset()
+			err = trans.DownloadChunk(lobsha, 1, &buf, callback)
+			Expect(err).To(BeNil(), "Should still be able to download after corruption")
+			Expect(buf.Bytes()).To(Equal(testchunkdata))
+		})
 	})
 
 	Context("Delta tests which require valid binaries", func() {
@@ -331,6 +548,825 @@ var _ = Describe("git-lob-serve tests", func() {
 
 		})
 
+		It("Exchanges deltas with the algorithm the client enables", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+			trans := smart.NewPersistentTransport(cli)
+			callback := func(bytesDone, totalBytes int64) {}
+
+			// Store 2 versions directly on the server
+			lobroot := getLOBRoot(config, repopath)
+			base := bytes.Repeat([]byte("Some content to make a delta from. "), 100)
+			target := append(append([]byte{}, base[:1000]...), []byte("A change")...)
+			target = append(target, base[1000:]...)
+			baseinfo, err := lobStore.StoreLOBInBaseDirWithCompression(lobroot, bytes.NewReader(base), nil, core.CompressionNone)
+			Expect(err).To(BeNil())
+			targetinfo, err := lobStore.StoreLOBInBaseDirWithCompression(lobroot, bytes.NewReader(target), nil, core.CompressionNone)
+			Expect(err).To(BeNil())
+
+			Expect(trans.SetEnabledCaps([]string{"binary_delta", "delta_algorithm=nonsense"})).ToNot(BeNil(), "Unknown algorithms should be rejected")
+			Expect(trans.SetEnabledCaps([]string{"binary_delta", "delta_algorithm=zstd"})).To(BeNil())
+			var deltabuf bytes.Buffer
+			ok, err := trans.DownloadDelta(baseinfo.SHA, targetinfo.SHA, 9999999, &deltabuf, callback)
+			Expect(err).To(BeNil(), "Should not be an error in DownloadDelta")
+			Expect(ok).To(BeTrue(), "Delta should have happened")
+			Expect(util.FileExists(getLOBDeltaFilePath(baseinfo.SHA, targetinfo.SHA, config, repopath))).To(BeTrue(), "zstd delta should be cached separately")
+			config.deltaAlgorithm = ""
+			Expect(util.FileExists(getLOBDeltaFilePath(baseinfo.SHA, targetinfo.SHA, config, repopath))).To(BeFalse(), "bm delta shouldn't have been cached")
+			config.deltaAlgorithm = core.DeltaAlgorithmZstd
+
+			// Uploading the same delta should recreate the target
+			Expect(lobStore.DeleteLOBInBaseDir(targetinfo.SHA, lobroot)).To(BeNil())
+			deltabytes := deltabuf.Bytes()
+			ok, err = trans.UploadDelta(baseinfo.SHA, targetinfo.SHA, int64(len(deltabytes)), bytes.NewReader(deltabytes), callback)
+			Expect(err).To(BeNil(), "Should not be an error in UploadDelta")
+			Expect(ok).To(BeTrue(), "Delta should have been uploaded ok")
+			var content bytes.Buffer
+			Expect(lobStore.GetLOBCompleteContentInBaseDir(lobroot, targetinfo.SHA, &content)).To(BeNil())
+			Expect(content.Bytes()).To(Equal(target), "zstd delta should have been applied")
+		})
+
+		It("Compresses chunks in transit when enabled", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+			trans := smart.NewPersistentTransport(cli)
+			var lastDone, lastTotal int64
+			callback := func(bytesDone, totalBytes int64) {
+				lastDone, lastTotal = bytesDone, totalBytes
+			}
+			compressible := bytes.Repeat([]byte("Some very compressible content. "), 10000)
+			incompressible := make([]byte, 100000)
+			rand.Read(incompressible)
+			lobsha := "abcdef1234567890abcdef1234567890abcdef12"
+
+			for _, codec := range smart.TransferCompressionCodecs {
+				trans.SetTransferCompression(codec)
+				for i, content := range [][]byte{compressible, incompressible} {
+					sz := int64(len(content))
+					err := trans.UploadChunk(lobsha, i, sz, bytes.NewReader(content), callback)
+					Expect(err).To(BeNil(), "Should upload chunk %d with %v", i, codec)
+					Expect(lastDone).To(Equal(sz), "Progress should be in content bytes")
+					Expect(lastTotal).To(Equal(sz), "Progress should be in content bytes")
+					stored, err := ioutil.ReadFile(getLOBChunkFilePath(lobsha, i, config, repopath))
+					Expect(err).To(BeNil())
+					Expect(stored).To(Equal(content), "Chunk should be stored uncompressed")
+
+					var buf bytes.Buffer
+					err = trans.DownloadChunk(lobsha, i, &buf, callback)
+					Expect(err).To(BeNil(), "Should download chunk %d with %v", i, codec)
+					Expect(buf.Bytes()).To(Equal(content), "Downloaded chunk %d should match with %v", i, codec)
+					Expect(lastDone).To(Equal(sz), "Progress should be in content bytes")
+				}
+				// Only content worth compressing is compressed
+				var prep smart.DownloadFilePrepareResponse
+				prepreq := smart.DownloadFilePrepareRequest{LobSHA: lobsha, Type: "chunk", ChunkIdx: 0, Compression: codec}
+				req, _ := smart.NewJsonRequest("DownloadFilePrepare", &prepreq)
+				resp := downloadFilePrepare(req, nil, nil, config, repopath)
+				Expect(resp.Error).To(BeNil())
+				Expect(smart.ExtractStructFromJsonRawMessage(resp.Result, &prep)).To(BeNil())
+				Expect(prep.Compression).To(Equal(codec), "Compressible chunk should be compressed")
+				Expect(prep.TransferSize).To(BeNumerically("<", len(compressible)/10))
+				prepreq.ChunkIdx = 1
+				req, _ = smart.NewJsonRequest("DownloadFilePrepare", &prepreq)
+				resp = downloadFilePrepare(req, nil, nil, config, repopath)
+				prep = smart.DownloadFilePrepareResponse{}
+				Expect(smart.ExtractStructFromJsonRawMessage(resp.Result, &prep)).To(BeNil())
+				Expect(prep.Compression).To(Equal(""), "Incompressible chunk should be sent as it is")
+			}
+			releaseCompressedDownload(config)
+		})
+
+	})
+
+	Context("Pruning", func() {
+		var config *Config
+		var repopath string
+		oldsha := "1111111111111111111111111111111111111111"
+		newsha := "2222222222222222222222222222222222222222"
+		var olduser string
+
+		BeforeEach(func() {
+			config = NewConfig()
+			config.BasePath = filepath.Join(os.TempDir(), "git-lob-serve-test")
+			config.DeltaCachePath = filepath.Join(os.TempDir(), "git-lob-serve-test-deltacache")
+			os.MkdirAll(config.DeltaCachePath, 0755)
+			repopath = "test/repo"
+			olduser = serverUser
+			serverUser = "testadmin"
+
+			for _, sha := range []string{oldsha, newsha} {
+				for _, file := range []string{getLOBMetaFilePath(sha, config, repopath), getLOBChunkFilePath(sha, 0, config, repopath)} {
+					os.MkdirAll(filepath.Dir(file), 0755)
+					ioutil.WriteFile(file, []byte("content"), 0644)
+				}
+			}
+			ioutil.WriteFile(getLOBDeltaFilePath(newsha, oldsha, config, repopath), []byte("delta"), 0644)
+			// Make the old LOB outside the grace period
+			old := time.Now().AddDate(0, 0, -(config.PruneGracePeriodDays + 1))
+			os.Chtimes(getLOBMetaFilePath(oldsha, config, repopath), old, old)
+			os.Chtimes(getLOBChunkFilePath(oldsha, 0, config, repopath), old, old)
+		})
+		AfterEach(func() {
+			serverUser = olduser
+			os.RemoveAll(config.BasePath)
+			os.RemoveAll(config.DeltaCachePath)
+		})
+
+		It("Only allows admins to prune", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+
+			trans := smart.NewPersistentTransport(cli)
+			caps, err := trans.QueryCaps()
+			Expect(err).To(BeNil(), "Should be no error")
+			Expect(caps).To(ConsistOf(append([]string{"binary_delta", "chunk_objects", "chunk_size", "locking", "chunk_hash", "metadata_batch", "previews"}, algorithmCaps()...)), "Prune should not be offered to non-admins")
+			_, err = trans.ListLOBs()
+			Expect(err).ToNot(BeNil(), "Non-admins should not be able to list LOBs")
+			_, _, _, err = trans.PruneLOBs([]string{oldsha}, false)
+			Expect(err).ToNot(BeNil(), "Non-admins should not be able to prune")
+			Expect(util.FileExists(getLOBMetaFilePath(oldsha, config, repopath))).To(BeTrue(), "Nothing should have been deleted")
+
+			config.PruneAdmins = []string{"someone", "testadmin"}
+			caps, err = trans.QueryCaps()
+			Expect(err).To(BeNil(), "Should be no error")
+			Expect(caps).To(ConsistOf(append([]string{"binary_delta", "chunk_objects", "chunk_size", "locking", "chunk_hash", "metadata_batch", "previews", "prune"}, algorithmCaps()...)), "Prune should be offered to admins")
+		})
+
+		It("Prunes LOBs outside the grace period", func() {
+			config.PruneAdmins = []string{"testadmin"}
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+
+			trans := smart.NewPersistentTransport(cli)
+			shas, err := trans.ListLOBs()
+			Expect(err).To(BeNil(), "Should be no error listing LOBs")
+			Expect(shas).To(ConsistOf([]string{oldsha, newsha}))
+
+			missingsha := "3333333333333333333333333333333333333333"
+			deleted, retained, held, err := trans.PruneLOBs([]string{oldsha, newsha, missingsha}, true)
+			Expect(err).To(BeNil(), "Should be no error in dry run")
+			Expect(deleted).To(Equal([]string{oldsha}))
+			Expect(retained).To(Equal([]string{newsha}), "Recent LOB should be retained")
+			Expect(held).To(BeEmpty(), "Nothing held without retention")
+			Expect(util.FileExists(getLOBMetaFilePath(oldsha, config, repopath))).To(BeTrue(), "Dry run should not delete")
+
+			deleted, retained, _, err = trans.PruneLOBs([]string{oldsha, newsha, missingsha}, false)
+			Expect(err).To(BeNil(), "Should be no error pruning")
+			Expect(deleted).To(Equal([]string{oldsha}))
+			Expect(retained).To(Equal([]string{newsha}))
+			Expect(util.FileExists(getLOBMetaFilePath(oldsha, config, repopath))).To(BeFalse(), "Old LOB should be deleted")
+			Expect(util.FileExists(getLOBChunkFilePath(oldsha, 0, config, repopath))).To(BeFalse(), "Old LOB should be deleted")
+			Expect(util.FileExists(getLOBDeltaFilePath(newsha, oldsha, config, repopath))).To(BeFalse(), "Cached delta should be deleted")
+			Expect(util.FileExists(getLOBChunkFilePath(newsha, 0, config, repopath))).To(BeTrue(), "Recent LOB should be kept")
+
+			_, _, _, err = trans.PruneLOBs([]string{"../../etc/passwd"}, false)
+			Expect(err).ToNot(BeNil(), "Invalid SHAs should be rejected")
+		})
+
+		It("Holds LOBs in retention mode", func() {
+			config.PruneAdmins = []string{"testadmin"}
+			config.RetentionDays = 30
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+
+			trans := smart.NewPersistentTransport(cli)
+			caps, err := trans.QueryCaps()
+			Expect(err).To(BeNil(), "Should be no error")
+			Expect(caps).To(ContainElement("retention"), "Retention should be advertised")
+
+			// Uploading a new LOB records its retention
+			uploadsha := "4444444444444444444444444444444444444444"
+			content := []byte("original")
+			err = trans.UploadChunk(uploadsha, 0, int64(len(content)), bytes.NewReader(content), func(done, total int64) {})
+			Expect(err).To(BeNil(), "Should be no error uploading")
+			rec, err := readRetentionRecord(uploadsha, getLOBRoot(config, repopath))
+			Expect(err).To(BeNil(), "Retention should be recorded")
+			Expect(rec.RetainUntil.After(time.Now().AddDate(0, 0, 29))).To(BeTrue(), "Should be held for retention period")
+			// Same content is fine, different content is refused
+			err = trans.UploadChunk(uploadsha, 0, int64(len(content)), bytes.NewReader(content), func(done, total int64) {})
+			Expect(err).To(BeNil(), "Re-uploading identical content should be allowed")
+			changed := []byte("modified")
+			err = trans.UploadChunk(uploadsha, 0, int64(len(changed)), bytes.NewReader(changed), func(done, total int64) {})
+			Expect(err).ToNot(BeNil(), "Changing held content should be refused")
+			Expect(err.Error()).To(ContainSubstring("retention hold"))
+			stored, _ := ioutil.ReadFile(getLOBChunkFilePath(uploadsha, 0, config, repopath))
+			Expect(stored).To(Equal(content), "Content should be unchanged")
+
+			// LOBs stored before retention are held from their modification time
+			deleted, retained, held, err := trans.PruneLOBs([]string{oldsha, newsha, uploadsha}, false)
+			Expect(err).To(BeNil(), "Should be no error pruning")
+			Expect(deleted).To(BeEmpty(), "Nothing should be deleted")
+			Expect(retained).To(BeEmpty())
+			Expect(held).To(ConsistOf([]string{oldsha, newsha, uploadsha}), "All should be held")
+			Expect(util.FileExists(getLOBMetaFilePath(oldsha, config, repopath))).To(BeTrue(), "Held LOB should not be deleted")
+
+			// Once retention is over they can be pruned, and turning retention off doesn't release holds
+			config.RetentionDays = 0
+			deleted, _, held, err = trans.PruneLOBs([]string{oldsha, uploadsha}, false)
+			Expect(err).To(BeNil(), "Should be no error pruning")
+			Expect(deleted).To(Equal([]string{oldsha}))
+			Expect(held).To(Equal([]string{uploadsha}), "Recorded hold should still apply")
+		})
+	})
+
+	Context("Repository mapping", func() {
+		var config *Config
+		var olduser string
+		BeforeEach(func() {
+			config = NewConfig()
+			config.BasePath = filepath.Join(os.TempDir(), "git-lob-serve-test")
+			os.MkdirAll(config.BasePath, 0755)
+			olduser = serverUser
+			settings, err := util.ReadConfigStream(bytes.NewBufferString(`
+repo-mapping = true
+[repo "goteam/Repo1"]
+    path = teams/go/repo1
+    allow = steve, andy, bob
+    deny = bob
+    read-only = andy
+[repo "open.git"]
+    read-only = *
+[repo "escape"]
+    path = ../outside
+`), "")
+			Expect(err).To(BeNil())
+			config.RepoMapping = true
+			config.Repos = parseRepoConfigs(settings)
+		})
+		AfterEach(func() {
+			serverUser = olduser
+			os.RemoveAll(config.BasePath)
+		})
+
+		It("Maps repositories & checks access", func() {
+			Expect(config.Repos).To(HaveLen(3))
+			path, readOnly, err := resolveRepoPath(config, "/goteam/repo1", "steve")
+			Expect(err).To(BeNil(), "Allowed user should have access")
+			Expect(path).To(Equal(filepath.Join("teams", "go", "repo1")))
+			Expect(readOnly).To(BeFalse())
+			_, readOnly, err = resolveRepoPath(config, "goteam/repo1/", "andy")
+			Expect(err).To(BeNil(), "Read-only user should have access")
+			Expect(readOnly).To(BeTrue())
+			_, _, err = resolveRepoPath(config, "goteam/repo1", "bob")
+			Expect(err).ToNot(BeNil(), "Denied user should not have access")
+			_, _, err = resolveRepoPath(config, "goteam/repo1", "fred")
+			Expect(err).ToNot(BeNil(), "User not allowed should not have access")
+			_, _, err = resolveRepoPath(config, "goteam/repo2", "steve")
+			Expect(err).ToNot(BeNil(), "Unmapped repository should not be served")
+
+			path, readOnly, err = resolveRepoPath(config, "open.git", "")
+			Expect(err).To(BeNil(), "Anyone should have access")
+			Expect(path).To(Equal("open.git"), "Path should default to name")
+			Expect(readOnly).To(BeTrue())
+			_, _, err = resolveRepoPath(config, "escape", "steve")
+			Expect(err).ToNot(BeNil(), "Path outside base-path should be refused")
+		})
+
+		It("Refuses changes from read-only users", func() {
+			serverUser = "andy"
+			path, readOnly, err := resolveRepoPath(config, "goteam/repo1", "andy")
+			Expect(err).To(BeNil())
+			config.ReadOnly = readOnly
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, path)
+			defer cli.Close()
+			trans := smart.NewPersistentTransport(cli)
+
+			content := []byte("content")
+			sha := fmt.Sprintf("%x", sha1.Sum(content))
+			err = trans.UploadChunk(sha, 0, int64(len(content)), bytes.NewReader(content), func(done, total int64) {})
+			Expect(err).ToNot(BeNil(), "Upload should be refused")
+			Expect(err.Error()).To(ContainSubstring("read-only"))
+			Expect(util.FileExists(getLOBChunkFilePath(sha, 0, config, path))).To(BeFalse(), "Nothing should be stored")
+
+			// Reading is fine
+			exists, _, err := trans.ChunkExists(sha, 0)
+			Expect(err).To(BeNil(), "Should be able to query")
+			Expect(exists).To(BeFalse())
+			Expect(getLOBDeltaFilePath(sha, sha, config, path)).To(HavePrefix(filepath.Join(config.DeltaCachePath, path)),
+				"Delta cache should be per repository")
+		})
+	})
+
+	Context("Identity", func() {
+		oldconn := os.Getenv("SSH_CONNECTION")
+		oldcmd := os.Getenv("SSH_ORIGINAL_COMMAND")
+		AfterEach(func() {
+			os.Setenv("SSH_CONNECTION", oldconn)
+			os.Setenv("SSH_ORIGINAL_COMMAND", oldcmd)
+		})
+
+		It("Takes the user only from a forced command or the HTTPS server", func() {
+			os.Setenv("SSH_CONNECTION", "")
+			os.Setenv("SSH_ORIGINAL_COMMAND", "")
+			os.Setenv("GIT_LOB_USER", "admin")
+			defer os.Setenv("GIT_LOB_USER", "")
+			osuser, err := getOSUser()
+			Expect(err).To(BeNil())
+			user, args, err := parseServerArgs([]string{"goteam/repo1"})
+			Expect(err).To(BeNil())
+			Expect(user).To(Equal(osuser), "Environment should be ignored")
+			Expect(args).To(Equal([]string{"goteam/repo1"}))
+			user, args, err = parseServerArgs([]string{"--user=steve", "goteam/repo1"})
+			Expect(err).To(BeNil(), "HTTPS server names the user")
+			Expect(user).To(Equal("steve"))
+			Expect(args).To(Equal([]string{"goteam/repo1"}))
+
+			// SSH client running the server itself
+			os.Setenv("SSH_CONNECTION", "10.0.0.1 50000 10.0.0.2 22")
+			_, _, err = parseServerArgs([]string{"--user=admin", "goteam/repo1"})
+			Expect(err).ToNot(BeNil(), "Client shouldn't be able to choose the user")
+			user, _, err = parseServerArgs([]string{"goteam/repo1"})
+			Expect(err).To(BeNil())
+			Expect(user).To(Equal(osuser))
+
+			// Forced command in authorized_keys
+			os.Setenv("SSH_ORIGINAL_COMMAND", "git-lob-serve goteam/repo1")
+			user, args, err = parseServerArgs([]string{"--user=steve"})
+			Expect(err).To(BeNil())
+			Expect(user).To(Equal("steve"))
+			Expect(args).To(Equal([]string{"goteam/repo1"}), "Path should come from the client's command")
+			os.Setenv("SSH_ORIGINAL_COMMAND", "git-lob-serve --user=admin goteam/repo1")
+			_, _, err = parseServerArgs([]string{"--user=steve"})
+			Expect(err).ToNot(BeNil(), "Client shouldn't be able to choose the user")
+		})
+	})
+
+	Context("Quotas", func() {
+		var config *Config
+		BeforeEach(func() {
+			config = NewConfig()
+			config.BasePath = filepath.Join(os.TempDir(), "git-lob-serve-test")
+			os.MkdirAll(config.BasePath, 0755)
+		})
+		AfterEach(func() {
+			os.RemoveAll(config.BasePath)
+		})
+
+		uploadChunk := func(trans *smart.PersistentTransport, content []byte) (string, error) {
+			sha := fmt.Sprintf("%x", sha1.Sum(content))
+			return sha, trans.UploadChunk(sha, 0, int64(len(content)), bytes.NewReader(content), func(done, total int64) {})
+		}
+
+		It("Rejects uploads over repository quota", func() {
+			path := "test/repo"
+			// Existing content counts
+			existing := []byte("existing content")
+			existingfile := getLOBChunkFilePath(fmt.Sprintf("%x", sha1.Sum(existing)), 0, config, path)
+			os.MkdirAll(filepath.Dir(existingfile), 0755)
+			Expect(ioutil.WriteFile(existingfile, existing, 0644)).To(BeNil())
+			config.RepoQuota = 100
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, path)
+			defer cli.Close()
+			trans := smart.NewPersistentTransport(cli)
+
+			_, err := uploadChunk(trans, bytes.Repeat([]byte("a"), 50))
+			Expect(err).To(BeNil(), "Upload within quota should succeed")
+			sha, err := uploadChunk(trans, bytes.Repeat([]byte("b"), 50))
+			Expect(err).ToNot(BeNil(), "Upload over quota should be rejected")
+			Expect(smart.IsQuotaExceededError(err)).To(BeTrue(), "Should be recognised as a quota error")
+			Expect(err.Error()).To(ContainSubstring("repository test/repo has used 66B of its 100B quota"))
+			Expect(util.FileExists(getLOBChunkFilePath(sha, 0, config, path))).To(BeFalse(), "Nothing should be stored")
+			// Connection is still usable
+			_, err = uploadChunk(trans, bytes.Repeat([]byte("c"), 30))
+			Expect(err).To(BeNil(), "Upload which fits should still succeed")
+		})
+
+		It("Rejects uploads over global quota", func() {
+			other := getLOBChunkFilePath("0000000000000000000000000000000000000000", 0, config, "other")
+			os.MkdirAll(filepath.Dir(other), 0755)
+			Expect(ioutil.WriteFile(other, bytes.Repeat([]byte("x"), 80), 0644)).To(BeNil())
+			config.Quota = 100
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, "test/repo")
+			defer cli.Close()
+			trans := smart.NewPersistentTransport(cli)
+
+			_, err := uploadChunk(trans, bytes.Repeat([]byte("a"), 30))
+			Expect(err).ToNot(BeNil(), "Other repositories should count towards global quota")
+			Expect(smart.IsQuotaExceededError(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("this server has used 80B of its 100B quota"))
+		})
+
+		It("Reports usage", func() {
+			for _, path := range []string{"goteam/repo1", "goteam/repo2"} {
+				file := getLOBChunkFilePath("0000000000000000000000000000000000000000", 0, config, path)
+				os.MkdirAll(filepath.Dir(file), 0755)
+				Expect(ioutil.WriteFile(file, bytes.Repeat([]byte("x"), 1024), 0644)).To(BeNil())
+			}
+			os.MkdirAll(filepath.Join(config.BasePath, ".deltacache", "abc"), 0755)
+			config.RepoQuota = 4096
+			usage := getStoreUsage(config)
+			Expect(usage).To(HaveLen(2), "Should find stores but not delta cache")
+			Expect(usage[0]).To(Equal(&storeUsage{"goteam/repo1", 1024, 4096}))
+			Expect(usage[1]).To(Equal(&storeUsage{"goteam/repo2", 1024, 4096}))
+
+			// Mapping mode reports configured repositories with their own quotas
+			settings, err := util.ReadConfigStream(bytes.NewBufferString(`
+[repo "repo1"]
+    path = goteam/repo1
+    quota = 2KB
+[repo "empty"]
+    read-only = *
+`), "")
+			Expect(err).To(BeNil())
+			config.RepoMapping = true
+			config.Repos = parseRepoConfigs(settings)
+			usage = getStoreUsage(config)
+			Expect(usage).To(HaveLen(2))
+			Expect(usage[0]).To(Equal(&storeUsage{"empty", 0, 4096}))
+			Expect(usage[1]).To(Equal(&storeUsage{"repo1", 1024, 2048}))
+
+			var out bytes.Buffer
+			reportUsage(config, &out)
+			Expect(out.String()).To(MatchRegexp(`repo1\s+1KB of 2KB \(50%\)`))
+			Expect(out.String()).To(MatchRegexp(`Total\s+2KB no quota`))
+		})
 	})
 
+	Context("Metrics", func() {
+		var config *Config
+		BeforeEach(func() {
+			config = NewConfig()
+			config.BasePath = filepath.Join(os.TempDir(), "git-lob-serve-test")
+			config.MetricsListen = "127.0.0.1:0"
+			config.MetricsPath = filepath.Join(config.BasePath, ".metrics")
+			config.DeltaCachePath = filepath.Join(config.BasePath, ".deltacache")
+			os.MkdirAll(config.BasePath, 0755)
+		})
+		AfterEach(func() {
+			os.RemoveAll(config.BasePath)
+		})
+
+		It("Records metrics across connections", func() {
+			content := []byte("content to count")
+			sha := fmt.Sprintf("%x", sha1.Sum(content))
+			missing := "0000000000000000000000000000000000000000"
+			deltafile := getLOBDeltaFilePath(missing, sha, config, "test/repo")
+			os.MkdirAll(filepath.Dir(deltafile), 0755)
+			Expect(ioutil.WriteFile(deltafile, []byte("delta"), 0644)).To(BeNil())
+			for i := 0; i < 2; i++ {
+				cli, srv := net.Pipe()
+				var outerr bytes.Buffer
+				done := make(chan int)
+				go func() {
+					done <- Serve(srv, srv, &outerr, config, "test/repo")
+				}()
+				trans := smart.NewPersistentTransport(cli)
+				err := trans.UploadChunk(sha, 0, int64(len(content)), bytes.NewReader(content), func(done, total int64) {})
+				Expect(err).To(BeNil())
+				var buf bytes.Buffer
+				err = trans.DownloadChunk(sha, 0, &buf, func(done, total int64) {})
+				Expect(err).To(BeNil())
+				err = trans.DownloadChunk(missing, 0, &buf, func(done, total int64) {})
+				Expect(err).ToNot(BeNil(), "Missing binary should fail")
+				_, err = trans.DownloadDeltaPrepare(missing, sha)
+				Expect(err).To(BeNil(), "Delta should come from the cache")
+				Expect(countActiveSessions(config)).To(Equal(1), "Connection should be active")
+				cli.Close()
+				<-done
+			}
+			Expect(countActiveSessions(config)).To(Equal(0), "Finished connections shouldn't be active")
+
+			totals, err := readMetrics(config)
+			Expect(err).To(BeNil())
+			Expect(totals.Sessions).To(BeEquivalentTo(2))
+			Expect(totals.Requests["UploadFile"]).To(BeEquivalentTo(2))
+			Expect(totals.Errors["DownloadFilePrepare"]).To(BeEquivalentTo(2))
+			Expect(totals.Errors["UploadFile"]).To(BeEquivalentTo(0))
+			Expect(totals.Transfers[metricsUpload]).To(BeEquivalentTo(2))
+			Expect(totals.Bytes[metricsDownload]).To(BeEquivalentTo(2 * len(content)))
+			Expect(totals.DeltaCacheHits).To(BeEquivalentTo(2))
+
+			var out bytes.Buffer
+			writeMetrics(&out, totals, 0)
+			Expect(out.String()).To(ContainSubstring("# TYPE gitlob_serve_sessions_total counter\ngitlob_serve_sessions_total 2\n"))
+			Expect(out.String()).To(ContainSubstring(fmt.Sprintf("gitlob_serve_bytes_total{direction=\"upload\"} %d\n", 2*len(content))))
+			Expect(out.String()).To(ContainSubstring("gitlob_serve_errors_total{method=\"DownloadFilePrepare\"} 2\n"))
+			Expect(out.String()).To(ContainSubstring("gitlob_serve_delta_cache_requests_total{result=\"hit\"} 2\n"))
+			Expect(out.String()).To(ContainSubstring("gitlob_serve_delta_cache_hit_ratio 1\n"))
+		})
+
+		It("Doesn't record metrics unless enabled", func() {
+			config.MetricsListen = ""
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, "test/repo")
+			defer cli.Close()
+			trans := smart.NewPersistentTransport(cli)
+			_, err := trans.QueryCaps()
+			Expect(err).To(BeNil())
+			Expect(util.DirExists(config.MetricsPath)).To(BeFalse())
+		})
+	})
+
+	Context("Caching mode", func() {
+		var config *Config
+		upstreamPath := filepath.Join(os.TempDir(), "git-lob-serve-test-upstream")
+		BeforeEach(func() {
+			config = NewConfig()
+			config.BasePath = filepath.Join(os.TempDir(), "git-lob-serve-test")
+			config.MetricsListen = "127.0.0.1:0"
+			config.MetricsPath = filepath.Join(config.BasePath, ".metrics")
+			os.MkdirAll(config.BasePath, 0755)
+			os.MkdirAll(upstreamPath, 0755)
+			settings, err := util.ReadConfigStream(bytes.NewBufferString(fmt.Sprintf(`
+[upstream]
+    git-lob-provider = filesystem
+    git-lob-path = %v
+[upstream "Elsewhere"]
+    git-lob-provider = filesystem
+    git-lob-path = %v
+`, upstreamPath, filepath.Join(os.TempDir(), "git-lob-serve-test-nonexistent"))), "")
+			Expect(err).To(BeNil())
+			config.Upstreams = parseUpstreamConfigs(settings)
+		})
+		AfterEach(func() {
+			os.RemoveAll(config.BasePath)
+			os.RemoveAll(upstreamPath)
+		})
+
+		It("Fetches missing binaries from upstream", func() {
+			content := bytes.Repeat([]byte("Content only upstream has\n"), 1000)
+			info, err := lobStore.StoreLOBInBaseDir(upstreamPath, bytes.NewReader(content), nil)
+			Expect(err).To(BeNil())
+			missing := "0000000000000000000000000000000000000000"
+
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			done := make(chan int)
+			go func() {
+				done <- Serve(srv, srv, &outerr, config, "test/repo")
+			}()
+			trans := smart.NewPersistentTransport(cli)
+			exists, sz, err := trans.LOBExists(info.SHA)
+			Expect(err).To(BeNil())
+			Expect(exists).To(BeTrue(), "Should fetch from upstream")
+			Expect(sz).To(BeEquivalentTo(len(content)))
+			var buf bytes.Buffer
+			err = trans.DownloadChunk(info.SHA, 0, &buf, func(done, total int64) {})
+			Expect(err).To(BeNil(), "Should serve fetched binary")
+
+			exists, _, err = trans.MetadataExists(missing)
+			Expect(err).To(BeNil())
+			Expect(exists).To(BeFalse(), "Binary upstream doesn't have should be missing")
+			err = trans.DownloadChunk(missing, 0, &buf, func(done, total int64) {})
+			Expect(err).ToNot(BeNil())
+			cli.Close()
+			<-done
+
+			var stored bytes.Buffer
+			err = lobStore.GetLOBCompleteContentInBaseDir(getLOBRoot(config, "test/repo"), info.SHA, &stored)
+			Expect(err).To(BeNil(), "Binary should be stored in cache")
+			Expect(stored.Bytes()).To(Equal(content))
+			totals, err := readMetrics(config)
+			Expect(err).To(BeNil())
+			Expect(totals.UpstreamFetches).To(BeEquivalentTo(1), "Should only fetch once")
+			Expect(totals.UpstreamFetchErrors).To(BeEquivalentTo(2))
+		})
+
+		It("Doesn't cache corrupt content from upstream", func() {
+			content := bytes.Repeat([]byte("Content upstream has corrupted\n"), 1000)
+			info, err := lobStore.StoreLOBInBaseDir(upstreamPath, bytes.NewReader(content), nil)
+			Expect(err).To(BeNil())
+			chunkfile := lobStore.GetLOBChunkPathInBaseDir(upstreamPath, info.SHA, 0)
+			corrupt := bytes.Repeat([]byte("X"), int(info.Size))
+			Expect(ioutil.WriteFile(chunkfile, corrupt, 0644)).To(BeNil())
+			lobroot := getLOBRoot(config, "test/repo")
+			err = fetchFromUpstream(info.SHA, "meta", config, "test/repo")
+			Expect(err).ToNot(BeNil(), "Corrupt binary should fail to fetch")
+			Expect(util.FileExists(getLOBMetaFilePath(info.SHA, config, "test/repo"))).To(BeFalse(),
+				"Metadata of corrupt binary shouldn't be left in the cache")
+			Expect(util.FileExists(getLOBChunkFilePath(info.SHA, 0, config, "test/repo"))).To(BeFalse(),
+				"Corrupt chunk shouldn't be cached")
+
+			objectcontent := bytes.Repeat([]byte("Content upstream stores as chunk objects\n"), 1000)
+			objectinfo, err := lobStore.StoreLOBInBaseDirContentDefined(upstreamPath, bytes.NewReader(objectcontent), nil)
+			Expect(err).To(BeNil())
+			chunksha := objectinfo.Chunks[0].SHA
+			objectfile := lobStore.GetChunkObjectPathInBaseDir(upstreamPath, chunksha)
+			data, err := ioutil.ReadFile(objectfile)
+			Expect(err).To(BeNil())
+			Expect(ioutil.WriteFile(objectfile, bytes.Repeat([]byte("X"), len(data)), 0644)).To(BeNil())
+			err = fetchFromUpstream(chunksha, "object", config, "test/repo")
+			Expect(err).ToNot(BeNil(), "Corrupt chunk object should fail to fetch")
+			Expect(util.FileExists(getChunkObjectFilePath(chunksha, config, "test/repo"))).To(BeFalse(),
+				"Corrupt chunk object shouldn't be cached")
+			Expect(ioutil.WriteFile(objectfile, data, 0644)).To(BeNil())
+			Expect(fetchFromUpstream(chunksha, "object", config, "test/repo")).To(BeNil())
+			Expect(util.FileExists(getChunkObjectFilePath(chunksha, config, "test/repo"))).To(BeTrue(),
+				"Chunk object should be cached once upstream is fixed")
+
+			entries, _ := ioutil.ReadDir(filepath.Join(lobroot, ".incoming"))
+			Expect(entries).To(BeEmpty(), "Staged files should be cleaned up")
+			releaseUpstreamProvider(config)
+		})
+
+		It("Uses the repository's upstream", func() {
+			Expect(config.Upstreams).To(HaveLen(2))
+			Expect(isCachingMode(NewConfig())).To(BeFalse())
+			config.upstream = "elsewhere"
+			Expect(isCachingMode(config)).To(BeTrue())
+			_, err := getUpstreamProvider(config)
+			Expect(err).ToNot(BeNil(), "Nonexistent upstream path should be invalid")
+			Expect(err.Error()).To(ContainSubstring("git-lob-serve-test-nonexistent"))
+			config.upstream = "unknown"
+			Expect(isCachingMode(config)).To(BeTrue())
+			Expect(fetchFromUpstream(strings.Repeat("1", 40), "meta", config, "test/repo")).ToNot(BeNil(),
+				"Unconfigured upstream should be an error")
+		})
+	})
+
+	Context("Locking", func() {
+		var config *Config
+		var olduser string
+		repopath := "test/repo"
+		BeforeEach(func() {
+			config = NewConfig()
+			config.BasePath = filepath.Join(os.TempDir(), "git-lob-serve-test")
+			os.MkdirAll(config.BasePath, 0755)
+			olduser = serverUser
+			serverUser = "steve"
+		})
+		AfterEach(func() {
+			serverUser = olduser
+			os.RemoveAll(config.BasePath)
+		})
+
+		It("Locks & unlocks files for each user", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+			trans := smart.NewPersistentTransport(cli)
+
+			lock, err := trans.LockFile("art/../art/level1.psd")
+			Expect(err).To(BeNil(), "Should be no error locking")
+			Expect(lock.Path).To(Equal("art/level1.psd"), "Path should be normalised")
+			Expect(lock.Owner).To(Equal("steve"))
+			Expect(lock.Mine).To(BeTrue())
+			again, err := trans.LockFile("art/level1.psd")
+			Expect(err).To(BeNil(), "Locking a file again should be allowed")
+			Expect(again.LockedAt.Equal(lock.LockedAt)).To(BeTrue(), "Existing lock should be returned")
+			_, err = trans.LockFile("../outside.psd")
+			Expect(err).ToNot(BeNil(), "Paths outside the repository should be rejected")
+			_, err = trans.LockFile("img.psd")
+			Expect(err).To(BeNil(), "Should be no error locking")
+
+			serverUser = "andy"
+			_, err = trans.LockFile("art/level1.psd")
+			Expect(err).ToNot(BeNil(), "Should not be able to lock a file locked by someone else")
+			Expect(err.Error()).To(ContainSubstring("locked by steve"))
+			locks, err := trans.ListLocks()
+			Expect(err).To(BeNil(), "Should be no error listing locks")
+			Expect(locks).To(HaveLen(2))
+			Expect(locks[0].Path).To(Equal("art/level1.psd"))
+			Expect(locks[1].Path).To(Equal("img.psd"))
+			Expect(locks[0].Mine).To(BeFalse(), "Other users' locks should not be marked as mine")
+			err = trans.UnlockFile("img.psd", false)
+			Expect(err).ToNot(BeNil(), "Should not be able to unlock a file locked by someone else")
+			err = trans.UnlockFile("img.psd", true)
+			Expect(err).ToNot(BeNil(), "Only admins should be able to force unlock")
+			config.LockAdmins = []string{"andy"}
+			err = trans.UnlockFile("img.psd", true)
+			Expect(err).To(BeNil(), "Admins should be able to force unlock")
+
+			serverUser = "steve"
+			err = trans.UnlockFile("art/level1.psd", false)
+			Expect(err).To(BeNil(), "Should be no error unlocking")
+			err = trans.UnlockFile("art/level1.psd", false)
+			Expect(err).ToNot(BeNil(), "Should be an error unlocking a file which isn't locked")
+			locks, err = trans.ListLocks()
+			Expect(err).To(BeNil(), "Should be no error listing locks")
+			Expect(locks).To(BeEmpty())
+		})
+	})
+
+	Context("HTTPS mode", func() {
+		var config *Config
+		var server *httptest.Server
+		var serverURL *url.URL
+		var served []string
+		var oldServeConnection func(io.ReadWriter, string, string) error
+		oldtoken := os.Getenv("GIT_LOB_TOKEN")
+		oldcainfo := os.Getenv("GIT_SSL_CAINFO")
+		cafile := filepath.Join(os.TempDir(), "git-lob-serve-test-ca.pem")
+		factory := &smart.HttpsTransportFactory{}
+		BeforeEach(func() {
+			config = NewConfig()
+			config.BasePath = filepath.Join(os.TempDir(), "git-lob-serve-test")
+			os.MkdirAll(config.BasePath, 0755)
+			settings, err := util.ReadConfigStream(bytes.NewBufferString(`
+[user "steve"]
+    token = s3cr3t
+[user "andy"]
+    token = an0ther
+[repo "goteam/repo1"]
+    allow = steve
+`), "")
+			Expect(err).To(BeNil())
+			config.UserTokens = parseUserTokens(settings)
+			config.Repos = parseRepoConfigs(settings)
+
+			// Serve in this process rather than starting git-lob-serve
+			served = nil
+			oldServeConnection = httpsServeConnection
+			httpsServeConnection = func(conn io.ReadWriter, user, path string) error {
+				served = append(served, user+":"+path)
+				var outerr bytes.Buffer
+				Serve(conn, conn, &outerr, config, path)
+				return nil
+			}
+			server = httptest.NewUnstartedServer(newHTTPSHandler(config))
+			// Refused certificates are expected
+			server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+			server.StartTLS()
+			serverURL, _ = url.Parse(server.URL)
+			// Trust the test server's certificate
+			ioutil.WriteFile(cafile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+			os.Setenv("GIT_SSL_CAINFO", cafile)
+		})
+		AfterEach(func() {
+			server.Close()
+			httpsServeConnection = oldServeConnection
+			os.Setenv("GIT_LOB_TOKEN", oldtoken)
+			os.Setenv("GIT_SSL_CAINFO", oldcainfo)
+			os.Remove(cafile)
+			os.RemoveAll(config.BasePath)
+		})
+
+		It("Reads user tokens", func() {
+			Expect(config.UserTokens).To(Equal(map[string]string{"steve": "s3cr3t", "andy": "an0ther"}))
+		})
+
+		It("Serves authenticated clients", func() {
+			os.Setenv("GIT_LOB_TOKEN", "s3cr3t")
+			u, _ := url.Parse(fmt.Sprintf("https://%v/test/repo", serverURL.Host))
+			Expect(factory.WillHandleUrl(u)).To(BeTrue(), "Should handle HTTPS URL")
+			trans, err := factory.Connect(u, "", util.GlobalOptions, util.DefaultLogger)
+			Expect(err).To(BeNil(), "Should connect")
+			caps, err := trans.QueryCaps()
+			Expect(err).To(BeNil(), "Should be able to talk to the server")
+			Expect(caps).To(ContainElement("binary_delta"))
+			content := []byte("content")
+			sha := fmt.Sprintf("%x", sha1.Sum(content))
+			err = trans.UploadChunk(sha, 0, int64(len(content)), bytes.NewReader(content), func(done, total int64) {})
+			Expect(err).To(BeNil(), "Should be able to upload")
+			trans.Release()
+			Expect(served).To(Equal([]string{"steve:test/repo"}), "Should serve requested path as token's user")
+			Expect(util.FileExists(getLOBChunkFilePath(sha, 0, config, "test/repo"))).To(BeTrue(), "Should have stored upload")
+		})
+
+		It("Refuses unauthenticated or unauthorised clients", func() {
+			os.Setenv("GIT_LOB_TOKEN", "wrong")
+			u, _ := url.Parse(fmt.Sprintf("https://%v/test/repo", serverURL.Host))
+			_, err := factory.Connect(u, "", util.GlobalOptions, util.DefaultLogger)
+			Expect(err).ToNot(BeNil(), "Should refuse invalid token")
+			Expect(err.Error()).To(ContainSubstring("Invalid or missing token"))
+
+			os.Setenv("GIT_LOB_TOKEN", "an0ther")
+			u, _ = url.Parse(fmt.Sprintf("https://%v/--usage", serverURL.Host))
+			_, err = factory.Connect(u, "", util.GlobalOptions, util.DefaultLogger)
+			Expect(err).ToNot(BeNil(), "Should refuse paths which look like options")
+			config.RepoMapping = true
+			u, _ = url.Parse(fmt.Sprintf("https://%v/goteam/repo1", serverURL.Host))
+			_, err = factory.Connect(u, "", util.GlobalOptions, util.DefaultLogger)
+			Expect(err).ToNot(BeNil(), "Should refuse users without access")
+			Expect(err.Error()).To(ContainSubstring("not allowed"))
+			Expect(served).To(BeEmpty(), "Nothing should have been served")
+
+			// Must trust the certificate
+			os.Setenv("GIT_SSL_CAINFO", "")
+			_, err = factory.Connect(u, "", util.GlobalOptions, util.DefaultLogger)
+			Expect(err).ToNot(BeNil(), "Should not trust unknown certificate")
+		})
+
+		It("Refuses paths outside base-path", func() {
+			for _, p := range []string{"..", "../x", "../../x", "test/../../x", "./../x"} {
+				Expect(checkHTTPSPath(config, p, "steve")).ToNot(BeNil(), "Should refuse %v", p)
+			}
+			Expect(checkHTTPSPath(config, "test/../repo", "steve")).To(BeNil(), "Should allow paths which stay under base-path")
+			Expect(checkHTTPSPath(config, "/abs/repo", "steve")).ToNot(BeNil(), "Should refuse absolute paths")
+
+			os.Setenv("GIT_LOB_TOKEN", "s3cr3t")
+			u := &url.URL{Scheme: "https", Host: serverURL.Host, Path: "/../../x"}
+			_, err := factory.Connect(u, "", util.GlobalOptions, util.DefaultLogger)
+			Expect(err).ToNot(BeNil(), "Should refuse traversal in the URL")
+			Expect(served).To(BeEmpty(), "Nothing should have been served")
+		})
+	})
 })
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/atlassian/git-lob/core"
 	"github.com/atlassian/git-lob/providers/smart"
@@ -22,6 +23,10 @@ import (
 // implement the smart protocol. The re-use here is simply to avoid code duplication given that we're storing
 // in the same structure, and is not a requirement for any alternative server implementations.
 
+// The client's storage functions only need options & somewhere to log, not a repository; LOBs are
+// stored with the default settings
+var lobStore = &core.Repo{Options: util.NewOptions(), Log: util.DefaultLogger}
+
 // Get the absolute path to the root directory containing LOB files for the config & path
 // Does not create the directory nor validate that config is correct
 func getLOBRoot(config *Config, path string) string {
@@ -40,21 +45,59 @@ func getLOBMetaFilePath(sha string, config *Config, path string) string {
 	return filepath.Join(getLOBRoot(config, path), core.GetLOBMetaRelativePath(sha))
 }
 
-// Generic method to get file path based on type (meta/chunk)
+// Get the absolute path of a chunk object (a content-defined chunk shared between LOBs)
+// Does not create the directory nor validate that config is correct
+func getChunkObjectFilePath(chunksha string, config *Config, path string) string {
+	return filepath.Join(getLOBRoot(config, path), core.GetChunkObjectRelativePath(chunksha))
+}
+
+// Get the absolute path of the preview of a LOB
+// Does not create the directory nor validate that config is correct
+func getLOBPreviewFilePath(sha string, config *Config, path string) string {
+	return filepath.Join(getLOBRoot(config, path), core.GetLOBPreviewRelativePath(sha))
+}
+
+// Generic method to get file path based on type (meta/chunk/object/preview)
 // Does not create the directory nor validate that config is correct
 func getLOBFilePath(sha, filetype string, chunk int, config *Config, path string) string {
 	if filetype == "chunk" {
 		return getLOBChunkFilePath(sha, chunk, config, path)
 	} else if filetype == "meta" {
 		return getLOBMetaFilePath(sha, config, path)
+	} else if filetype == "object" && lobSHARegex.MatchString(sha) {
+		return getChunkObjectFilePath(sha, config, path)
+	} else if filetype == "preview" && lobSHARegex.MatchString(sha) {
+		return getLOBPreviewFilePath(sha, config, path)
 	}
 	// error
 	return ""
 }
 
+// Gets the folder which holds cached deltas
+// In repository mapping mode each repository has its own, so deltas can't leak between them
+func getLOBDeltaCacheDir(config *Config, path string) string {
+	if config.RepoMapping {
+		return filepath.Join(config.DeltaCachePath, path)
+	}
+	return config.DeltaCachePath
+}
+
+// Gets the algorithm deltas are exchanged with on this connection
+func getDeltaAlgorithm(config *Config) string {
+	if config.deltaAlgorithm == "" {
+		return core.DeltaAlgorithmBM
+	}
+	return config.deltaAlgorithm
+}
+
 // Gets the path to a file which contains delta from one sha to another
+// Deltas made with algorithms other than bm have the algorithm as an extension
 func getLOBDeltaFilePath(basesha, targetsha string, config *Config, path string) string {
-	return filepath.Join(config.DeltaCachePath, fmt.Sprintf("%v_%v", basesha, targetsha))
+	name := fmt.Sprintf("%v_%v", basesha, targetsha)
+	if alg := getDeltaAlgorithm(config); alg != core.DeltaAlgorithmBM {
+		name = name + "." + alg
+	}
+	return filepath.Join(getLOBDeltaCacheDir(config, path), name)
 }
 
 func fileExists(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
@@ -69,6 +112,11 @@ func fileExists(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Con
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unsupported file type: %v", freq.Type))
 	}
 	s, err := os.Stat(file)
+	if err != nil && isCachingMode(config) {
+		// Errors just mean it's missing as far as the client is concerned
+		fetchFromUpstream(freq.LobSHA, freq.Type, config, path)
+		s, err = os.Stat(file)
+	}
 	if err == nil {
 		result.Exists = true
 		result.Size = s.Size()
@@ -92,6 +140,10 @@ func fileExistsOfSize(req *smart.JsonRequest, in io.Reader, out io.Writer, confi
 	if file == "" {
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unsupported file type: %v", freq.Type))
 	}
+	if !util.FileExists(file) {
+		// Errors just mean it's missing as far as the client is concerned
+		fetchFromUpstream(freq.LobSHA, freq.Type, config, path)
+	}
 
 	result.Result = util.FileExistsAndIsOfSize(file, freq.Size)
 
@@ -123,6 +175,21 @@ func uploadFile(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Con
 	if err != nil {
 		return smart.NewJsonErrorResponse(req.Id, err.Error())
 	}
+	file := getLOBFilePath(upreq.LobSHA, upreq.Type, upreq.ChunkIdx, config, path)
+	if file == "" {
+		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unsupported file type: %v", upreq.Type))
+	}
+	// Replacing a file only uses the difference in size
+	addedBytes := upreq.Size
+	if s, err := os.Stat(file); err == nil {
+		addedBytes -= s.Size()
+	}
+	if quotaerr := checkQuota(addedBytes, config, path); quotaerr != nil {
+		return smart.NewJsonErrorResponse(req.Id, quotaerr)
+	}
+	if upreq.Compression != "" && !smart.IsSupportedTransferCompression(upreq.Compression) {
+		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unsupported transfer compression: %v", upreq.Compression))
+	}
 	startresult := smart.UploadFileStartResponse{}
 	startresult.OKToSend = true
 	// Send start response immediately
@@ -136,19 +203,40 @@ func uploadFile(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Con
 	}
 	// Next from client should be byte stream of exactly the stated number of bytes
 	// Write to temporary file then move to final on success
-	file := getLOBFilePath(upreq.LobSHA, upreq.Type, upreq.ChunkIdx, config, path)
-	if file == "" {
-		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unsupported file type: %v", upreq.Type))
-	}
 
 	// Now open temp file to write to
 	outf, err := ioutil.TempFile("", "tempchunk")
 	defer outf.Close()
-	n, err := io.CopyN(outf, in, upreq.Size)
-	if err != nil {
-		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unable to read data: %v", err.Error()))
-	} else if n != upreq.Size {
-		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Received wrong number of bytes %d (expected %d)", n, upreq.Size))
+	// With chunk hashes the content is checked against the trailer the client sends after it
+	var content io.Writer = outf
+	th := getTransferHash(upreq.LobSHA, upreq.Type, config)
+	if th != nil {
+		content = io.MultiWriter(outf, th)
+	}
+	transferSize := upreq.Size
+	if upreq.Compression != "" {
+		// Compressed in transit, content is stored as it was sent
+		transferSize = upreq.TransferSize
+		err = smart.DecompressTransfer(upreq.Compression, in, upreq.TransferSize, upreq.Size, content)
+		if err != nil {
+			outf.Close()
+			os.Remove(outf.Name())
+			return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unable to read data: %v", err.Error()))
+		}
+	} else {
+		n, err := io.CopyN(content, in, upreq.Size)
+		if err != nil {
+			return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unable to read data: %v", err.Error()))
+		} else if n != upreq.Size {
+			return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Received wrong number of bytes %d (expected %d)", n, upreq.Size))
+		}
+	}
+	if th != nil {
+		if err := receiveTransferTrailer(in, th); err != nil {
+			outf.Close()
+			os.Remove(outf.Name())
+			return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Content received for %v %v is corrupt: %v", upreq.Type, upreq.LobSHA, err.Error()))
+		}
 	}
 
 	receivedresult := smart.UploadFileCompleteResponse{}
@@ -159,6 +247,18 @@ func uploadFile(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Con
 	if err != nil {
 		receivedresult.ReceivedOK = false
 		receiveerr = fmt.Sprintf("Error when closing temp file: %v", err.Error())
+	} else if upreq.Type == "object" && !fileHasSHA(outf.Name(), upreq.LobSHA) {
+		// Chunk objects are shared between LOBs by SHA, so must not be stored with the wrong content
+		os.Remove(outf.Name())
+		receivedresult.ReceivedOK = false
+		receiveerr = fmt.Sprintf("Content received for chunk object %v does not match its SHA", upreq.LobSHA)
+	} else if replace, err := checkRetentionAllowsReplace(file, outf.Name(), upreq.LobSHA, upreq.Type, config, path); !replace {
+		// Under retention hold, OK if it's the same content since nothing is modified
+		os.Remove(outf.Name())
+		if err != nil {
+			receivedresult.ReceivedOK = false
+			receiveerr = err.Error()
+		}
 	} else {
 		// ensure final directory exists
 		ensureDirExists(filepath.Dir(file), config)
@@ -167,6 +267,16 @@ func uploadFile(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Con
 		if err != nil {
 			receivedresult.ReceivedOK = false
 			receiveerr = fmt.Sprintf("Error when closing temp file: %v", err.Error())
+		} else {
+			addStoredBytes(addedBytes, config, path)
+			config.metrics.addTransfer(metricsUpload, transferSize)
+			if upreq.Type != "object" {
+				err = recordRetention(upreq.LobSHA, config, path)
+				if err != nil {
+					receivedresult.ReceivedOK = false
+					receiveerr = err.Error()
+				}
+			}
 		}
 
 	}
@@ -180,6 +290,51 @@ func uploadFile(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Con
 
 }
 
+// Get a hash to send or check a trailer for content of a file type with, if the client enabled
+// chunk hashes & it's chunk content (nil otherwise)
+func getTransferHash(sha, filetype string, config *Config) *smart.TransferHash {
+	if !config.chunkHashes || (filetype != "chunk" && filetype != "object") {
+		return nil
+	}
+	return smart.NewTransferHash(sha)
+}
+
+// Read the trailer the client sent after content & check it against what was received
+func receiveTransferTrailer(in io.Reader, th *smart.TransferHash) error {
+	br, ok := in.(io.ByteReader)
+	if !ok {
+		return fmt.Errorf("Unable to read trailer from %T", in)
+	}
+	trailer, err := smart.ReadTransferTrailer(br)
+	if err != nil {
+		return err
+	}
+	return th.Verify(trailer)
+}
+
+// Write the content of a file to a hash
+func hashFile(file string, th *smart.TransferHash) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(th, f)
+	return err
+}
+
+// Returns whether the content of a file has a given SHA
+func fileHasSHA(file, sha string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	shacalc := core.NewLOBHashForSHA(sha)
+	_, err = io.Copy(shacalc, f)
+	return err == nil && fmt.Sprintf("%x", shacalc.Sum(nil)) == strings.ToLower(sha)
+}
+
 func downloadFilePrepare(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
 	downreq := smart.DownloadFilePrepareRequest{}
 	err := smart.ExtractStructFromJsonRawMessage(req.Params, &downreq)
@@ -192,11 +347,22 @@ func downloadFilePrepare(req *smart.JsonRequest, in io.Reader, out io.Writer, co
 	}
 	result := smart.DownloadFilePrepareResponse{}
 	s, err := os.Stat(file)
+	if err != nil {
+		if upstreamerr := fetchFromUpstream(downreq.LobSHA, downreq.Type, config, path); upstreamerr != nil {
+			return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("File doesn't exist (%v)", upstreamerr.Error()))
+		}
+		s, err = os.Stat(file)
+	}
 	if err != nil {
 		// file doesn't exist, this should not have been called
 		return smart.NewJsonErrorResponse(req.Id, "File doesn't exist")
 	}
 	result.Size = s.Size()
+	releaseCompressedDownload(config)
+	if downreq.Compression != "" && (downreq.Type == "chunk" || downreq.Type == "object") &&
+		smart.IsSupportedTransferCompression(downreq.Compression) {
+		result.Compression, result.TransferSize = prepareCompressedDownload(file, s.Size(), downreq.Compression, config)
+	}
 	resp, err := smart.NewJsonResponse(req.Id, result)
 	if err != nil {
 		return smart.NewJsonErrorResponse(req.Id, err.Error())
@@ -205,6 +371,42 @@ func downloadFilePrepare(req *smart.JsonRequest, in io.Reader, out io.Writer, co
 
 }
 
+// Compress a file the client is about to download if it's worth it, keeping the compressed copy
+// for DownloadFileStart. Returns the codec & compressed size, or "" to send the file as it is
+func prepareCompressedDownload(file string, size int64, codec string, config *Config) (string, int64) {
+	f, err := os.OpenFile(file, os.O_RDONLY, 0644)
+	if err != nil {
+		return "", 0
+	}
+	defer f.Close()
+	if !smart.IsFileWorthCompressing(f, size) {
+		return "", 0
+	}
+	cf, csz, err := smart.CompressToTempFile(codec, f)
+	if err != nil {
+		return "", 0
+	}
+	if csz >= size {
+		// Sampling isn't perfect
+		cf.Close()
+		os.Remove(cf.Name())
+		return "", 0
+	}
+	config.compressedDownload = cf
+	config.compressedDownloadFile = file
+	return codec, csz
+}
+
+// Remove the compressed copy of a file prepared for download, if any
+func releaseCompressedDownload(config *Config) {
+	if config.compressedDownload != nil {
+		config.compressedDownload.Close()
+		os.Remove(config.compressedDownload.Name())
+		config.compressedDownload = nil
+		config.compressedDownloadFile = ""
+	}
+}
+
 func downloadFileStart(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
 	downreq := smart.DownloadFileStartRequest{}
 	err := smart.ExtractStructFromJsonRawMessage(req.Params, &downreq)
@@ -226,6 +428,9 @@ func downloadFileStart(req *smart.JsonRequest, in io.Reader, out io.Writer, conf
 		// This won't work!
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("File sizes disagree (client: %d server: %d)", downreq.Size, s.Size()))
 	}
+	if downreq.Compression != "" {
+		return downloadCompressedFile(req, out, &downreq, file, config)
+	}
 
 	f, err := os.OpenFile(file, os.O_RDONLY, 0644)
 	if err != nil {
@@ -233,7 +438,13 @@ func downloadFileStart(req *smart.JsonRequest, in io.Reader, out io.Writer, conf
 	}
 	defer f.Close()
 
-	n, err := io.Copy(out, f)
+	// With chunk hashes the content is followed by a trailer for the client to check it against
+	var content io.Reader = f
+	th := getTransferHash(downreq.LobSHA, downreq.Type, config)
+	if th != nil {
+		content = io.TeeReader(f, th)
+	}
+	n, err := io.Copy(out, content)
 	if err != nil {
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error copying data to output: %v", err.Error()))
 	}
@@ -246,11 +457,99 @@ func downloadFileStart(req *smart.JsonRequest, in io.Reader, out io.Writer, conf
 	if n != s.Size() {
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Amount of data copied disagrees (expected: %d actual: %d)", s.Size(), n))
 	}
+	if th != nil {
+		err = smart.WriteTransferTrailer(out, th.Trailer())
+		if err != nil {
+			return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error sending trailer: %v", err.Error()))
+		}
+	}
+	config.metrics.addTransfer(metricsDownload, n)
 
 	// Don't return a response, only response is byte stream above except in error cases
 	return nil
 }
 
+// Send the compressed copy of a file made by DownloadFilePrepare
+func downloadCompressedFile(req *smart.JsonRequest, out io.Writer, downreq *smart.DownloadFileStartRequest, file string, config *Config) *smart.JsonResponse {
+	defer releaseCompressedDownload(config)
+	if config.compressedDownload == nil || config.compressedDownloadFile != file {
+		return smart.NewJsonErrorResponse(req.Id, "File was not prepared for compressed download")
+	}
+	n, err := io.Copy(out, config.compressedDownload)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error copying data to output: %v", err.Error()))
+	}
+	if n != downreq.TransferSize {
+		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Amount of data copied disagrees (expected: %d actual: %d)", downreq.TransferSize, n))
+	}
+	// The trailer is for the content as stored, not as compressed
+	if th := getTransferHash(downreq.LobSHA, downreq.Type, config); th != nil {
+		err = hashFile(file, th)
+		if err == nil {
+			err = smart.WriteTransferTrailer(out, th.Trailer())
+		}
+		if err != nil {
+			return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error sending trailer: %v", err.Error()))
+		}
+	}
+	config.metrics.addTransfer(metricsDownload, n)
+
+	// Don't return a response, only response is byte stream above except in error cases
+	return nil
+}
+
+func downloadMetadataBatch(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	downreq := smart.DownloadMetadataBatchRequest{}
+	err := smart.ExtractStructFromJsonRawMessage(req.Params, &downreq)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	if len(downreq.LobSHAs) > smart.MaxMetadataBatch {
+		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Too many LOBs in one batch (%d, maximum %d)", len(downreq.LobSHAs), smart.MaxMetadataBatch))
+	}
+	// Read everything first, so that any error can still be sent as a response
+	result := smart.DownloadMetadataBatchResponse{Sizes: make([]int64, len(downreq.LobSHAs))}
+	var data bytes.Buffer
+	for i, sha := range downreq.LobSHAs {
+		result.Sizes[i] = -1
+		// Client-supplied, so make sure it can't refer to anything but a binary
+		if !lobSHARegex.MatchString(sha) {
+			continue
+		}
+		file := getLOBMetaFilePath(sha, config, path)
+		if !util.FileExists(file) {
+			if upstreamerr := fetchFromUpstream(sha, "meta", config, path); upstreamerr != nil {
+				continue
+			}
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unable to read metadata for %v: %v", sha, err.Error()))
+		}
+		result.Sizes[i] = int64(len(content))
+		data.Write(content)
+	}
+	resp, err := smart.NewJsonResponse(req.Id, result)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	err = sendResponse(resp, out)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	n, err := io.Copy(out, &data)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error copying data to output: %v", err.Error()))
+	}
+	config.metrics.addTransfer(metricsDownload, n)
+
+	// Response has been sent, followed by the data
+	return nil
+}
+
 func pickCompleteLOB(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
 	params := smart.GetFirstCompleteLOBFromListRequest{}
 	err := smart.ExtractStructFromJsonRawMessage(req.Params, &params)
@@ -261,7 +560,7 @@ func pickCompleteLOB(req *smart.JsonRequest, in io.Reader, out io.Writer, config
 	for _, candidatesha := range params.LobSHAs {
 		// We need to stop on the first valid & complete SHA
 		// Only checking presence & size here, not checking hash
-		if core.CheckLOBFilesForSHA(candidatesha, getLOBRoot(config, path), false) == nil {
+		if lobStore.CheckLOBFilesForSHA(candidatesha, getLOBRoot(config, path), false) == nil {
 			result.FirstSHA = candidatesha
 			break
 		}
@@ -282,7 +581,11 @@ func lobExists(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Conf
 		return smart.NewJsonErrorResponse(req.Id, err.Error())
 	}
 	result := smart.LOBExistsResponse{}
-	_, sz, err := core.GetLOBFilesForSHA(params.LobSHA, getLOBRoot(config, path), true, false)
+	_, sz, err := lobStore.GetLOBFilesForSHA(params.LobSHA, getLOBRoot(config, path), true, false)
+	if err != nil && isCachingMode(config) {
+		fetchFromUpstream(params.LobSHA, "meta", config, path)
+		_, sz, err = lobStore.GetLOBFilesForSHA(params.LobSHA, getLOBRoot(config, path), true, false)
+	}
 	// in the case of error, assume missing so return default false
 	if err == nil {
 		result.Exists = true
@@ -303,7 +606,16 @@ func uploadDelta(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Co
 	}
 	startresult := smart.UploadDeltaStartResponse{}
 	startresult.OKToSend = true
-	if upreq.Size > config.DeltaSizeLimit {
+	// Applying a delta would write over any existing chunks for the target, so if it's under a
+	// retention hold cause client to fall back to uploading files, which only allows identical content
+	// (meta is always uploaded first so that isn't enough to tell)
+	heldChunks := lobSHARegex.MatchString(upreq.TargetLobSHA) &&
+		util.FileExists(getLOBChunkFilePath(upreq.TargetLobSHA, 0, config, path)) &&
+		isUnderRetentionHold(upreq.TargetLobSHA, getLOBRoot(config, path), config)
+	// The size of the result isn't known until the delta is applied, so if even the delta
+	// would exceed a quota fall back to files, which will be rejected with the quota error
+	overQuota := checkQuota(upreq.Size, config, path) != nil
+	if upreq.Size > config.DeltaSizeLimit || heldChunks || overQuota {
 		// reject this, cause client to fall back
 		startresult.OKToSend = false
 		resp, err := smart.NewJsonResponse(req.Id, startresult)
@@ -359,10 +671,18 @@ func uploadDelta(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Co
 	defer indeltaf.Close()
 	lobroot := getLOBRoot(config, path)
 	ensureDirExists(lobroot, config)
-	err = core.ApplyLOBDeltaInBaseDir(lobroot, upreq.BaseLobSHA, upreq.TargetLobSHA, indeltaf)
+	_, sizebefore := getLOBLatestModTime(upreq.TargetLobSHA, lobroot)
+	err = lobStore.ApplyLOBDeltaInBaseDirWithAlgorithm(lobroot, getDeltaAlgorithm(config), upreq.BaseLobSHA, upreq.TargetLobSHA, indeltaf, nil)
 	if err != nil {
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error when applying delta: %v", err.Error()))
 	}
+	_, sizeafter := getLOBLatestModTime(upreq.TargetLobSHA, lobroot)
+	addStoredBytes(sizeafter-sizebefore, config, path)
+	config.metrics.addTransfer(metricsUpload, upreq.Size)
+	err = recordRetention(upreq.TargetLobSHA, config, path)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
 
 	// Now save the delta so we can use it later on in DownloadDelta for other clients
 	// Ignore any errors on renaming, just means it won't be in the cache (inconvenient but not fatal, temp will be deleted on return)
@@ -394,13 +714,18 @@ func downloadDeltaPrepare(req *smart.JsonRequest, in io.Reader, out io.Writer, c
 	// First see if we have this delta in the cache already
 	deltafile := getLOBDeltaFilePath(downreq.BaseLobSHA, downreq.TargetLobSHA, config, path)
 	s, err := os.Stat(deltafile)
+	config.metrics.addDeltaCacheRequest(err == nil)
 	if err == nil {
 		result.Size = s.Size()
 	} else {
 		// either there was no cache file or we need to regen
+		// The base is one the client found here with PickCompleteLOB, but the target may need fetching
+		if upstreamerr := fetchFromUpstream(downreq.TargetLobSHA, "meta", config, path); upstreamerr != nil {
+			return smart.NewJsonErrorResponse(req.Id, upstreamerr.Error())
+		}
 		lobroot := getLOBRoot(config, path)
 		var deltabuf bytes.Buffer
-		sz, err := core.GenerateLOBDeltaInBaseDir(lobroot, downreq.BaseLobSHA, downreq.TargetLobSHA, &deltabuf)
+		sz, err := lobStore.GenerateLOBDeltaInBaseDirWithAlgorithm(lobroot, getDeltaAlgorithm(config), downreq.BaseLobSHA, downreq.TargetLobSHA, &deltabuf)
 		if err != nil {
 			return smart.NewJsonErrorResponse(req.Id, err.Error())
 		}
@@ -415,6 +740,7 @@ func downloadDeltaPrepare(req *smart.JsonRequest, in io.Reader, out io.Writer, c
 			if err == nil && n == deltabuf.Len() {
 				// only rename to final if correct size & no errors (don't want to bake incorrect delta
 				// don't check error here, if it doesn't work we just don't store in cache (and defer deletes))
+				ensureDirExists(filepath.Dir(deltafile), config)
 				os.Rename(tempf.Name(), deltafile)
 			}
 		}
@@ -450,6 +776,7 @@ func downloadDeltaStart(req *smart.JsonRequest, in io.Reader, out io.Writer, con
 	if n != downreq.Size {
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Amount of delta data copied disagrees (expected: %d actual: %d)", downreq.Size, n))
 	}
+	config.metrics.addTransfer(metricsDownload, n)
 
 	// There is no response, just data above
 	return nil
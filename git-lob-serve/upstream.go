@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/providers/smart"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Caching mode lets a server act as a cache in front of another binary store, e.g. a server in
+// a studio's office in front of a cloud store. When a client asks for a binary the server doesn't
+// have, it's downloaded from the upstream store (using any provider a client could use), stored
+// & then served as normal. Uploads are only stored on the server, so clients should push to the
+// upstream store themselves, e.g. by listing the cache then the upstream in git-lob.fetch-remotes.
+// The upstream is configured in the same way as a remote in a client's git config:
+//
+//   [upstream]
+//       git-lob-provider = smart
+//       git-lob-url = ssh://git-lob@cloud.example.com/studio/game
+//
+// In repository mapping mode each repository can use its own named upstream:
+//
+//   [upstream "art"]
+//       git-lob-provider = s3
+//       git-lob-s3-bucket = studio-art
+//   [repo "art"]
+//       upstream = art
+
+// Read upstream store settings from config file settings ([upstream] & [upstream "name"] sections)
+// Returns settings by upstream name ("" for the unnamed section)
+func parseUpstreamConfigs(settings map[string]string) map[string]map[string]string {
+	upstreams := make(map[string]map[string]string)
+	for key, val := range settings {
+		if !strings.HasPrefix(key, "upstream.") {
+			continue
+		}
+		// Upstream names may contain dots, the setting is after the last one
+		var name, setting string
+		rest := key[len("upstream."):]
+		if dot := strings.LastIndex(rest, "."); dot >= 0 {
+			name, setting = rest[:dot], rest[dot+1:]
+		} else {
+			setting = rest
+		}
+		if setting == "" {
+			continue
+		}
+		upstream, ok := upstreams[name]
+		if !ok {
+			upstream = make(map[string]string)
+			upstreams[name] = upstream
+		}
+		upstream[setting] = val
+	}
+	return upstreams
+}
+
+// Is caching mode enabled for this connection?
+func isCachingMode(config *Config) bool {
+	_, ok := config.Upstreams[config.upstream]
+	// A repository naming an upstream which isn't configured is an error when fetching
+	return ok || config.upstream != ""
+}
+
+// Get the name the upstream for this connection is known by to providers
+func getUpstreamRemoteName(config *Config) string {
+	if config.upstream == "" {
+		return "upstream"
+	}
+	return "upstream " + config.upstream
+}
+
+// Get the provider for the connection's upstream store, connecting to it the first time
+// Returns nil if caching mode isn't enabled for this connection
+func getUpstreamProvider(config *Config) (providers.SyncProvider, error) {
+	if config.upstreamProvider != nil {
+		return config.upstreamProvider, nil
+	}
+	settings, ok := config.Upstreams[config.upstream]
+	if !ok {
+		if config.upstream != "" {
+			return nil, fmt.Errorf("Upstream %v is not configured", config.upstream)
+		}
+		return nil, nil
+	}
+	// Providers read their settings from a remote in git config, so present the upstream as one
+	remoteName := getUpstreamRemoteName(config)
+	opts := util.NewOptions()
+	for setting, val := range settings {
+		opts.GitConfig[fmt.Sprintf("remote.%v.%v", remoteName, setting)] = val
+	}
+	providers.InitCoreProviders()
+	smart.InitCoreProviders()
+	provider, err := providers.GetProviderForRemote("", opts, util.DefaultLogger, remoteName)
+	if err != nil {
+		return nil, fmt.Errorf("Upstream store is misconfigured: %v", err.Error())
+	}
+	config.upstreamProvider = provider
+	return provider, nil
+}
+
+// Release the connection's upstream provider, if it was used
+func releaseUpstreamProvider(config *Config) {
+	if config.upstreamProvider != nil {
+		config.upstreamProvider.Release()
+		config.upstreamProvider = nil
+	}
+}
+
+// Make sure the files of a binary are in the store for path, downloading them from the
+// upstream store if they're missing & caching mode is enabled. For filetype "object" sha is a
+// chunk object, which is downloaded on its own; otherwise the whole binary is downloaded, since
+// clients which ask for one of its files will ask for the rest.
+// Does nothing if the files are already here or there's no upstream; returns an error if they
+// couldn't be downloaded, but callers just treat them as missing, so that clients can fall back
+// on another remote
+func fetchFromUpstream(sha, filetype string, config *Config, path string) error {
+	// Client-supplied, so make sure it can't refer to anything but a binary; previews are optional
+	// so not worth fetching
+	if !isCachingMode(config) || !lobSHARegex.MatchString(sha) || filetype == "preview" {
+		return nil
+	}
+	lobroot := getLOBRoot(config, path)
+	if filetype == "object" {
+		if util.FileExists(getChunkObjectFilePath(sha, config, path)) {
+			return nil
+		}
+	} else if lobStore.CheckLOBFilesForSHA(sha, lobroot, false) == nil {
+		return nil
+	}
+	provider, err := getUpstreamProvider(config)
+	if err != nil || provider == nil {
+		return err
+	}
+	err = downloadFromUpstream(sha, filetype, provider, config, path)
+	config.metrics.addUpstreamFetch(err == nil)
+	return err
+}
+
+// Files are downloaded to a staging folder in the store & only moved into it once their content
+// has been checked against its SHA (see core/fetchverify.go), so that a corrupt upstream can't
+// poison the cache
+func downloadFromUpstream(sha, filetype string, provider providers.SyncProvider, config *Config, path string) error {
+	remoteName := getUpstreamRemoteName(config)
+	lobroot := getLOBRoot(config, path)
+	stagingParent := filepath.Join(lobroot, ".incoming")
+	if err := ensureDirExists(stagingParent, config); err != nil {
+		return err
+	}
+	// Each connection has its own, so they never move each other's partly downloaded files
+	stagingRoot, err := ioutil.TempDir(stagingParent, "")
+	if err != nil {
+		return fmt.Errorf("Unable to create staging folder for %v: %v", sha, err.Error())
+	}
+	defer os.RemoveAll(stagingRoot)
+	_, sizebefore := getLOBLatestModTime(sha, lobroot)
+	var notFound bool
+	callback := func(filename string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+		if progressType == util.ProgressNotFound {
+			notFound = true
+		}
+		return false
+	}
+	download := func(files []string, toDir string) error {
+		err := provider.Download(remoteName, files, toDir, false, callback)
+		if err == nil && notFound {
+			err = fmt.Errorf("Not found in upstream store")
+		}
+		return err
+	}
+
+	if filetype == "object" {
+		err := download([]string{core.GetChunkObjectRelativePath(sha)}, stagingRoot)
+		if err == nil {
+			err = lobStore.StoreFetchedChunkObjectInBaseDir(sha, stagingRoot, lobroot)
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to fetch %v from upstream store: %v", sha, err.Error())
+		}
+		if s, staterr := os.Stat(getChunkObjectFilePath(sha, config, path)); staterr == nil {
+			addStoredBytes(s.Size(), config, path)
+		}
+		return nil
+	}
+	// Need the metadata to know which other files there are; it's checked along with them
+	metafile := getLOBMetaFilePath(sha, config, path)
+	hadMeta := util.FileExists(metafile)
+	err = download([]string{core.GetLOBMetaRelativePath(sha)}, lobroot)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch %v from upstream store: %v", sha, err.Error())
+	}
+	files, _, err := lobStore.GetLOBFilesForSHA(sha, lobroot, false, false)
+	if err == nil {
+		var missing []string
+		for _, file := range files {
+			if !util.FileExists(filepath.Join(lobroot, file)) {
+				missing = append(missing, file)
+			}
+		}
+		if len(missing) > 0 {
+			err = download(missing, stagingRoot)
+			if err == nil {
+				err = lobStore.StoreFetchedLOBInBaseDir(sha, stagingRoot, lobroot)
+			}
+		}
+	}
+	if err != nil {
+		if !hadMeta {
+			// Don't leave a binary behind which looks like it's here but can't be served
+			os.Remove(metafile)
+		}
+		return fmt.Errorf("Unable to fetch %v from upstream store: %v", sha, err.Error())
+	}
+	_, sizeafter := getLOBLatestModTime(sha, lobroot)
+	addStoredBytes(sizeafter-sizebefore, config, path)
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
@@ -118,11 +119,11 @@ var _ = Describe("Integration", func() {
 		}
 		moveAsideLOBs := func(shas []string) {
 			for _, sha := range shas {
-				meta := GetLocalLOBMetaPath(sha)
+				meta := testRepo().GetLocalLOBMetaPath(sha)
 				err := os.Rename(meta, meta+"_bak")
 				Expect(err).To(BeNil(), fmt.Sprintf("Rename should succeed for %v", meta))
 				// Assuming only one chunk for this test
-				chunk := GetLocalLOBChunkPath(sha, 0)
+				chunk := testRepo().GetLocalLOBChunkPath(sha, 0)
 				err = os.Rename(chunk, chunk+"_bak")
 				Expect(err).To(BeNil(), fmt.Sprintf("Rename should succeed for %v", chunk))
 			}
@@ -130,11 +131,11 @@ var _ = Describe("Integration", func() {
 		}
 		restoreLOBs := func(shas []string) {
 			for _, sha := range shas {
-				meta := GetLocalLOBMetaPath(sha)
+				meta := testRepo().GetLocalLOBMetaPath(sha)
 				err := os.Rename(meta+"_bak", meta)
 				Expect(err).To(BeNil(), fmt.Sprintf("Rename should succeed for %v", meta))
 				// Assuming only one chunk for this test
-				chunk := GetLocalLOBChunkPath(sha, 0)
+				chunk := testRepo().GetLocalLOBChunkPath(sha, 0)
 				err = os.Rename(chunk+"_bak", chunk)
 				Expect(err).To(BeNil(), fmt.Sprintf("Rename should succeed for %v", chunk))
 			}
@@ -179,7 +180,7 @@ var _ = Describe("Integration", func() {
 					sha := match[1]
 
 					// confirm that the file is stored correctly
-					err = CheckLOBFilesForSHA(sha, GetLocalLOBRoot(), false)
+					err = testRepo().CheckLOBFilesForSHA(sha, testRepo().GetLocalLOBRoot(), false)
 					Expect(err).To(BeNil(), fmt.Sprintf("Shouldn't fail checking storage for %v", file))
 				}
 				// Commit & tag
@@ -287,5 +288,87 @@ var _ = Describe("Integration", func() {
 
 		})
 
+		It("leaves unchanged files unmodified when placeholder metadata is enabled", func() {
+			files := filespercommit[0]
+			for i, file := range files {
+				err := os.MkdirAll(filepath.Dir(file), 0755)
+				Expect(err).To(BeNil(), "Shouldn't fail creating dir")
+				CreateRandomFileForTest(sizeForFile(file, i), file)
+			}
+			err := exec.Command("git", "add", ".").Run()
+			Expect(err).To(BeNil(), "Shouldn't fail in git add")
+			err = exec.Command("git", "commit", "-m", "Without metadata").Run()
+			Expect(err).To(BeNil(), "Shouldn't fail commit")
+			checkGitStatusNotModified()
+
+			err = exec.Command("git", "config", "git-lob.placeholder-metadata", "true").Run()
+			Expect(err).To(BeNil(), "Shouldn't fail to set config")
+			// Touching files makes git clean them again
+			later := time.Now().Add(time.Minute)
+			for _, file := range files {
+				os.Chtimes(file, later, later)
+			}
+			checkGitStatusNotModified()
+
+			// Changed files get metadata
+			CreateRandomFileForTest(sizeForFile(files[0], 0), files[0])
+			err = exec.Command("git", "add", files[0]).Run()
+			Expect(err).To(BeNil(), "Shouldn't fail in git add")
+			diffout, err := exec.Command("git", "diff", "--cached", files[0]).CombinedOutput()
+			Expect(err).To(BeNil(), "Shouldn't fail in git diff")
+			Expect(string(diffout)).To(ContainSubstring(fmt.Sprintf("+git-lob-meta: size=%d type=png", sizeForFile(files[0], 0))))
+		})
+
+		It("keeps old format placeholders for unchanged files after upgrading", func() {
+			files := filespercommit[0]
+			for i, file := range files {
+				err := os.MkdirAll(filepath.Dir(file), 0755)
+				Expect(err).To(BeNil(), "Shouldn't fail creating dir")
+				CreateRandomFileForTest(sizeForFile(file, i), file)
+			}
+			err := exec.Command("git", "add", ".").Run()
+			Expect(err).To(BeNil(), "Shouldn't fail in git add")
+			err = exec.Command("git", "commit", "-m", "Old format").Run()
+			Expect(err).To(BeNil(), "Shouldn't fail commit")
+			committed, err := exec.Command("git", "ls-files", "-s").CombinedOutput()
+			Expect(err).To(BeNil(), "Shouldn't fail in git ls-files")
+
+			// Change every format setting & convert what's stored
+			for key, value := range map[string]string{
+				"git-lob.hash-algorithm":       "sha256",
+				"git-lob.placeholder-metadata": "true",
+				"git-lob.compression":          "zstd",
+			} {
+				err = exec.Command("git", "config", key, value).Run()
+				Expect(err).To(BeNil(), "Shouldn't fail to set config")
+			}
+			outp, err := exec.Command(gitlobbinarypath, "upgrade-store").CombinedOutput()
+			Expect(err).To(BeNil(), fmt.Sprintf("Shouldn't fail to upgrade store: %v", string(outp)))
+			outp, err = exec.Command(gitlobbinarypath, "upgrade-store", "--finish").CombinedOutput()
+			Expect(err).To(BeNil(), fmt.Sprintf("Shouldn't fail to finish upgrade: %v", string(outp)))
+
+			// Touching files makes git clean them again
+			later := time.Now().Add(time.Minute)
+			for _, file := range files {
+				os.Chtimes(file, later, later)
+			}
+			checkGitStatusNotModified()
+			err = exec.Command("git", "add", "--renormalize", ".").Run()
+			Expect(err).To(BeNil(), "Shouldn't fail in git add")
+			checkGitStatusNotModified()
+			recleaned, err := exec.Command("git", "ls-files", "-s").CombinedOutput()
+			Expect(err).To(BeNil(), "Shouldn't fail in git ls-files")
+			Expect(string(recleaned)).To(Equal(string(committed)), "Placeholders should be byte for byte the same")
+
+			// And the converted binaries are still what they refer to
+			for _, file := range files {
+				os.Remove(file)
+			}
+			err = exec.Command("git", "checkout", "--", ".").Run()
+			Expect(err).To(BeNil(), "Shouldn't fail to checkout")
+			checkExistsAndRightSize(0)
+			checkGitStatusNotModified()
+		})
+
 	})
 })
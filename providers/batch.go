@@ -0,0 +1,71 @@
+package providers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Batched metadata downloads
+// Before fetching a binary's chunks git-lob downloads its meta file, usually under 100 bytes of
+// JSON. With many small binaries the time goes on round trips rather than data, since Download
+// transfers one file at a time, so providers which can fetch many meta files at once implement
+// BatchMetadataSyncProvider, then save what they received with SaveDownloadedFile.
+
+// Save the content of a file received in a batch to toDir, as Download would have: skipped if a
+// file of the same size is there already (unless force), written to a temporary file which is
+// then moved into place, calling back with ProgressSkip or ProgressTransferBytes
+// Downloads are limited by git-lob.max-download-rate in opts
+// Returns the errors & whether the callback asked to abort
+func SaveDownloadedFile(opts *util.Options, filename, toDir string, data []byte, force bool,
+	callback SyncProgressCallback) (errorList []string, abort bool) {
+
+	sz := int64(len(data))
+	destfilename := LocalFilePath(toDir, filename)
+	if !force {
+		if destfi, err := os.Stat(destfilename); err == nil && destfi.Size() == sz {
+			// File already present and correct size, skip
+			if callback != nil && callback(filename, util.ProgressSkip, sz, sz) {
+				return errorList, true
+			}
+			return errorList, false
+		}
+	}
+
+	parentDir := filepath.Dir(destfilename)
+	err := os.MkdirAll(parentDir, 0755)
+	if err != nil {
+		errorList = append(errorList, fmt.Sprintf("Unable to create dir %v: %v", parentDir, err))
+		return errorList, false
+	}
+	outf, err := ioutil.TempFile(parentDir, "tempdownload")
+	if err != nil {
+		errorList = append(errorList, fmt.Sprintf("Unable to create temp file for download in %v: %v", parentDir, err))
+		return errorList, false
+	}
+	tmpfilename := outf.Name()
+	defer func() {
+		outf.Close()
+		os.Remove(tmpfilename)
+	}()
+	_, err = io.Copy(util.ThrottleDownloadWriter(opts, outf), bytes.NewReader(data))
+	if err == nil {
+		err = outf.Close()
+	}
+	if err != nil {
+		errorList = append(errorList, fmt.Sprintf("Unable to write %v: %v", destfilename, err))
+		return errorList, false
+	}
+	// Remove before to deal with force or bad size cases
+	os.Remove(destfilename)
+	os.Rename(tmpfilename, destfilename)
+	if callback != nil && callback(filename, util.ProgressTransferBytes, sz, sz) {
+		return errorList, true
+	}
+	return errorList, false
+}
@@ -0,0 +1,197 @@
+package providers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Read-through cache for remotes
+// Setting remote.<name>.git-lob-cache-path puts a local or network directory between the remote
+// & its provider; downloads come from the cache when it has the file, & everything downloaded
+// from the remote is written back to it. Files are stored by the same relative paths as on the
+// remote, & since binaries are stored by SHA, one cache can serve many repos & remotes on a
+// machine or build farm, without them having to share a store.
+
+// Get the cache directory configured for a remote, blank if none
+func GetCachePathForRemote(opts *util.Options, remoteName string) string {
+	return opts.GitConfig[fmt.Sprintf("remote.%v.git-lob-cache-path", remoteName)]
+}
+
+// Wraps a provider so that downloads go through a cache directory, see GetCachePathForRemote
+// Everything but Download goes straight to the provider
+type CachingSyncProvider struct {
+	SyncProvider
+	CachePath string
+	log       *util.Logger
+}
+
+// Smart providers have to stay smart when they're cached
+type cachingSmartSyncProvider struct {
+	SmartSyncProvider
+	cache *CachingSyncProvider
+}
+
+// Wrap a provider with a cache in cachePath, keeping its smart abilities if it has them
+func NewCachingSyncProvider(provider SyncProvider, cachePath string, log *util.Logger) SyncProvider {
+	cache := &CachingSyncProvider{provider, filepath.Clean(cachePath), log}
+	if smart := UpgradeToSmartSyncProvider(provider); smart != nil {
+		return &cachingSmartSyncProvider{smart, cache}
+	}
+	return cache
+}
+
+func (self *CachingSyncProvider) ForRepo(root string, opts *util.Options, log *util.Logger) SyncProvider {
+	return NewCachingSyncProvider(self.SyncProvider.ForRepo(root, opts, log), self.CachePath, log)
+}
+
+func (self *cachingSmartSyncProvider) ForRepo(root string, opts *util.Options, log *util.Logger) SyncProvider {
+	return self.cache.ForRepo(root, opts, log)
+}
+
+func (self *cachingSmartSyncProvider) Download(remoteName string, filenames []string, toDir string,
+	force bool, callback SyncProgressCallback) error {
+	return self.cache.Download(remoteName, filenames, toDir, force, callback)
+}
+
+func (self *CachingSyncProvider) ValidateConfig(remoteName string) error {
+	if err := self.SyncProvider.ValidateConfig(remoteName); err != nil {
+		return err
+	}
+	err := os.MkdirAll(self.CachePath, 0755)
+	if err != nil {
+		return fmt.Errorf("git-lob-cache-path '%v' for remote '%v' is not a usable directory: %v",
+			self.CachePath, remoteName, err.Error())
+	}
+	return nil
+}
+
+func (self *cachingSmartSyncProvider) ValidateConfig(remoteName string) error {
+	return self.cache.ValidateConfig(remoteName)
+}
+
+// Download files from the cache where it has them, the rest from the remote, then write what was
+// downloaded back to the cache. force means always download from the remote (e.g. when what was
+// downloaded before was corrupt), which also replaces what's in the cache
+func (self *CachingSyncProvider) Download(remoteName string, filenames []string, toDir string,
+	force bool, callback SyncProgressCallback) error {
+
+	var remaining []string
+	if force {
+		remaining = filenames
+	} else {
+		for _, filename := range filenames {
+			found, abort := self.downloadFromCache(filename, toDir, callback)
+			if abort {
+				return nil
+			}
+			if !found {
+				remaining = append(remaining, filename)
+			}
+		}
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	err := self.SyncProvider.Download(remoteName, remaining, toDir, force, callback)
+	// Even if some failed, keep the ones which didn't
+	for _, filename := range remaining {
+		self.writeToCache(filename, toDir, force)
+	}
+	return err
+}
+
+// Copy a file from the cache to toDir if the cache has it, returning whether it did
+func (self *CachingSyncProvider) downloadFromCache(filename, toDir string,
+	callback SyncProgressCallback) (found, abort bool) {
+	cachefilename := filepath.Join(self.CachePath, filename)
+	cachefi, err := os.Stat(cachefilename)
+	if err != nil || !cachefi.Mode().IsRegular() {
+		return false, false
+	}
+	destfilename := LocalFilePath(toDir, filename)
+	if util.FileExistsAndIsOfSize(destfilename, cachefi.Size()) {
+		// Already present and correct size, skip
+		if callback != nil {
+			abort = callback(filename, util.ProgressSkip, cachefi.Size(), cachefi.Size())
+		}
+		return true, abort
+	}
+	if callback != nil {
+		if callback(filename, util.ProgressTransferBytes, 0, cachefi.Size()) {
+			return true, true
+		}
+	}
+	err = copyFileForCache(cachefilename, destfilename, "tempdownload")
+	if err != nil {
+		// Let the remote provide it instead
+		self.log.Debugf("Unable to copy %v from cache: %v\n", cachefilename, err.Error())
+		return false, false
+	}
+	self.log.Debugf("Copied %v from cache %v\n", filename, self.CachePath)
+	if callback != nil {
+		abort = callback(filename, util.ProgressTransferBytes, cachefi.Size(), cachefi.Size())
+	}
+	return true, abort
+}
+
+// Copy a file which was downloaded to toDir into the cache, unless it's already there (replace
+// forces it to be copied anyway). Failures are only logged, the cache is just a bonus
+func (self *CachingSyncProvider) writeToCache(filename, toDir string, replace bool) {
+	srcfilename := LocalFilePath(toDir, filename)
+	srcfi, err := os.Stat(srcfilename)
+	if err != nil {
+		// Not found on the remote or failed
+		return
+	}
+	cachefilename := filepath.Join(self.CachePath, filename)
+	if !replace && util.FileExistsAndIsOfSize(cachefilename, srcfi.Size()) {
+		return
+	}
+	err = copyFileForCache(srcfilename, cachefilename, "tempcache")
+	if err != nil {
+		self.log.Debugf("Unable to write %v to cache: %v\n", cachefilename, err.Error())
+	}
+}
+
+// Copy a file via a temporary file in the destination folder, so that other processes sharing
+// the cache never see a partial file
+func copyFileForCache(from, to, tempPrefix string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	err = os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+	outf, err := ioutil.TempFile(filepath.Dir(to), tempPrefix)
+	if err != nil {
+		return err
+	}
+	tmpfilename := outf.Name()
+	// Both no-ops if we succeed
+	defer func() {
+		outf.Close()
+		os.Remove(tmpfilename)
+	}()
+	_, err = io.Copy(outf, in)
+	if closeerr := outf.Close(); err == nil {
+		err = closeerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpfilename, to); err != nil {
+		// Windows won't replace an existing file
+		os.Remove(to)
+		err = os.Rename(tmpfilename, to)
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package providers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+// Only needs to look smart
+type testSmartSyncProvider struct {
+	SmartSyncProvider
+}
+
+var _ = Describe("Cache", func() {
+	root := filepath.Join(os.TempDir(), "CacheProviderTest")
+	remotepath := filepath.Join(root, "remote")
+	cachepath := filepath.Join(root, "cache")
+	var oldOptions Options
+	BeforeEach(func() {
+		oldOptions = *GlobalOptions
+		GlobalOptions.GitConfig = map[string]string{
+			"remote.origin.git-lob-provider":   "filesystem",
+			"remote.origin.git-lob-path":       remotepath,
+			"remote.origin.git-lob-cache-path": cachepath,
+		}
+		os.MkdirAll(remotepath, 0755)
+		InitCoreProviders()
+	})
+	AfterEach(func() {
+		*GlobalOptions = oldOptions
+		os.RemoveAll(root)
+	})
+
+	It("Wraps providers for remotes with a cache", func() {
+		provider, err := GetProviderForRemote(root, GlobalOptions, DefaultLogger, "origin")
+		Expect(err).To(BeNil())
+		cached, ok := provider.(*CachingSyncProvider)
+		Expect(ok).To(BeTrue(), "Should be wrapped with a cache")
+		Expect(cached.TypeID()).To(Equal("filesystem"))
+		Expect(DirExists(cachepath)).To(BeTrue(), "Should create the cache")
+
+		delete(GlobalOptions.GitConfig, "remote.origin.git-lob-cache-path")
+		provider, err = GetProviderForRemote(root, GlobalOptions, DefaultLogger, "origin")
+		Expect(err).To(BeNil())
+		_, ok = provider.(*FileSystemSyncProvider)
+		Expect(ok).To(BeTrue(), "Should not be wrapped without a cache")
+
+		smart := NewCachingSyncProvider(&testSmartSyncProvider{}, cachepath, DefaultLogger)
+		Expect(UpgradeToSmartSyncProvider(smart)).ToNot(BeNil(), "Should still be smart")
+	})
+
+	It("Downloads through the cache", func() {
+		files := GetRandomListOfFilesForTest(3, 1, 1)
+		for _, file := range files {
+			CreateRandomFileForTest(1000, filepath.Join(remotepath, file))
+		}
+		provider, err := GetProviderForRemote(root, GlobalOptions, DefaultLogger, "origin")
+		Expect(err).To(BeNil())
+		var transferred, notFound []string
+		callback := func(filename string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+			switch {
+			case progressType == ProgressNotFound:
+				notFound = append(notFound, filename)
+			case progressType == ProgressTransferBytes && bytesDone == totalBytes:
+				transferred = append(transferred, filename)
+			}
+			return false
+		}
+
+		// First download comes from the remote & fills the cache
+		err = provider.Download("origin", files, filepath.Join(root, "local1"), false, callback)
+		Expect(err).To(BeNil())
+		Expect(transferred).To(Equal(files))
+		for _, file := range files {
+			remote, _ := ioutil.ReadFile(filepath.Join(remotepath, file))
+			cache, err := ioutil.ReadFile(filepath.Join(cachepath, file))
+			Expect(err).To(BeNil(), "Should have written %v to cache", file)
+			Expect(cache).To(Equal(remote))
+		}
+
+		// Cache provides everything after that, even if the remote doesn't have it any more
+		os.Remove(filepath.Join(remotepath, files[0]))
+		transferred = nil
+		err = provider.Download("origin", files, filepath.Join(root, "local2"), false, callback)
+		Expect(err).To(BeNil())
+		Expect(transferred).To(Equal(files))
+		Expect(notFound).To(BeEmpty())
+		for _, file := range files {
+			cache, _ := ioutil.ReadFile(filepath.Join(cachepath, file))
+			local, err := ioutil.ReadFile(filepath.Join(root, "local2", file))
+			Expect(err).To(BeNil(), "Should have copied %v from cache", file)
+			Expect(local).To(Equal(cache))
+		}
+
+		// Force goes to the remote & replaces what's in the cache
+		ioutil.WriteFile(filepath.Join(cachepath, files[1]), []byte("corrupt"), 0644)
+		transferred = nil
+		err = provider.Download("origin", files, filepath.Join(root, "local3"), true, callback)
+		Expect(err).To(BeNil())
+		Expect(transferred).To(Equal(files[1:]))
+		Expect(notFound).To(Equal(files[:1]), "Should not use cache when forced")
+		remote, _ := ioutil.ReadFile(filepath.Join(remotepath, files[1]))
+		cache, _ := ioutil.ReadFile(filepath.Join(cachepath, files[1]))
+		Expect(cache).To(Equal(remote), "Should replace cache content when forced")
+	})
+})
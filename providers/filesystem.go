@@ -14,6 +14,14 @@ import (
 
 // FileSystemSyncProvider implements the basic SyncProvider interface
 type FileSystemSyncProvider struct {
+	// The repository this instance is for, see ForRepo
+	root string
+	opts *util.Options
+	log  *util.Logger
+}
+
+func (*FileSystemSyncProvider) ForRepo(root string, opts *util.Options, log *util.Logger) SyncProvider {
+	return &FileSystemSyncProvider{root: root, opts: opts, log: log}
 }
 
 func (*FileSystemSyncProvider) TypeID() string {
@@ -38,6 +46,15 @@ Example configuration:
         git-lob-provider = filesystem
         git-lob-path = /Volumes/shared/your/remote/binary/store
 
+Optional parameters in the remote section:
+    git-lob-retention-days  Write-once retention: files on the remote can't be
+                            replaced or deleted until this many days after
+                            they were uploaded
+
+Remotes whose url is a file:// URL or a local path use this provider without
+any configuration, storing binaries inside the git repo they refer to (in
+git-lob/content in its git dir), unless git-lob-path is set.
+
 When uploading & downloading, to avoid partially written files when interrupted
 a temporary file is created first, then moved to the final location on 
 completion. While we clean up files on error and exit, if forcibly interrupted
@@ -48,12 +65,57 @@ in the target file structure and can be safely deleted if older than 24h.
 
 const FileSystemBufferSize = 131072
 
-func (*FileSystemSyncProvider) ValidateConfig(remoteName string) error {
+// Get the path of the binary store for a remote: git-lob-path if it's set, otherwise if the
+// remote's URL is a file:// URL or local path, the binary store inside the git repo it refers
+// to (as it would be if that repo used git-lob itself). Returns "" if neither applies
+// root is the root of the repository whose config is in opts, which relative paths are from
+func GetFilesystemPathForRemote(root string, opts *util.Options, remoteName string) (path string, fromURL bool) {
+	if path := opts.GitConfig[fmt.Sprintf("remote.%v.git-lob-path", remoteName)]; path != "" {
+		return util.NormalizeUNCPath(path), false
+	}
+	urlstr := GetGitURLForRemote(opts, remoteName)
+	if GetProviderNameForURL(urlstr) != "filesystem" {
+		return "", false
+	}
+	repopath := urlstr
+	if strings.HasPrefix(strings.ToLower(urlstr), "file://") {
+		repopath = urlstr[len("file://"):]
+		// file:///C:/path on Windows
+		if windowsDrivePathRegex.MatchString(strings.TrimPrefix(repopath, "/")) {
+			repopath = strings.TrimPrefix(repopath, "/")
+		} else if util.IsWindows() && !strings.HasPrefix(repopath, "/") {
+			// file://server/share/path is a share, as git for Windows has it
+			repopath = "//" + repopath
+		}
+	}
+	repopath = util.NormalizeUNCPath(filepath.FromSlash(repopath))
+	if !filepath.IsAbs(repopath) {
+		// git resolves relative paths from the root of the working copy
+		repopath = filepath.Join(root, repopath)
+	}
+	// Bare repos are the git dir themselves
+	gitdir := filepath.Join(repopath, ".git")
+	if !util.DirExists(gitdir) {
+		gitdir = repopath
+	}
+	return filepath.Join(gitdir, "git-lob", "content"), true
+}
+
+func (self *FileSystemSyncProvider) ValidateConfig(remoteName string) error {
 	pathsetting := fmt.Sprintf("remote.%v.git-lob-path", remoteName)
-	path := util.GlobalOptions.GitConfig[pathsetting]
+	path, fromURL := GetFilesystemPathForRemote(self.root, self.opts, remoteName)
 	if path == "" {
 		return fmt.Errorf("Configuration invalid for 'filesystem', missing setting %v", pathsetting)
 	}
+	if fromURL && !util.DirExists(path) {
+		// Create the store in the remote repo, provided there is a repo there
+		if !util.DirExists(filepath.Dir(filepath.Dir(path))) {
+			return fmt.Errorf("Configuration invalid for 'filesystem', remote '%v' is not a git repo on this file system and %v is not set", remoteName, pathsetting)
+		}
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return fmt.Errorf("Unable to create binary store for remote '%v' in %v: %v", remoteName, path, err.Error())
+		}
+	}
 	// Check it exists
 	exists, isdir := util.FileOrDirExists(path)
 	if !exists {
@@ -69,39 +131,46 @@ func (*FileSystemSyncProvider) Release() {
 	// Nothing to do here
 }
 
-func (*FileSystemSyncProvider) uploadSingleFile(remoteName, filename, fromDir, toDir string, fileMode os.FileMode,
-	force bool, callback SyncProgressCallback) (errorList []string, abort bool) {
+func (self *FileSystemSyncProvider) uploadSingleFile(remoteName, filename, fromDir, toDir string, fileMode os.FileMode,
+	force bool, callback SyncProgressCallback) (errorList []string, abort, retry bool) {
 	// Check to see if the file is already there, right size
-	srcfilename := filepath.Join(fromDir, filename)
+	srcfilename := LocalFilePath(fromDir, filename)
 	srcfi, err := os.Stat(srcfilename)
 	if err != nil {
 		if callback != nil {
 			if callback(filename, util.ProgressNotFound, 0, 0) {
-				return errorList, true
+				return errorList, true, false
 			}
 		}
 		msg := fmt.Sprintf("Unable to stat %v: %v", srcfilename, err)
 		errorList = append(errorList, msg)
 		// Keep going with other files
-		return errorList, false
+		return errorList, false, false
 	}
 
-	destfilename := filepath.Join(toDir, filename)
-	if !force {
+	destfilename := getFilesystemFilePath(toDir, filename)
+	destfi, desterr := os.Stat(destfilename)
+	// Files under a retention hold are never replaced, even if forced
+	var holderr error
+	if desterr == nil {
+		holderr = checkRetentionHold(self.opts, self.log, remoteName, filename, destfi.ModTime())
+	}
+	if !force || holderr != nil {
 		// Check existence & size before uploading
-		if destfi, err := os.Stat(destfilename); err == nil {
-			// File exists on remote, check the size
-			if destfi.Size() == srcfi.Size() {
-				// File already present and correct size, skip
-				if callback != nil {
-					if callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
-						return errorList, true
-					}
+		if desterr == nil && destfi.Size() == srcfi.Size() {
+			// File already present and correct size, skip
+			if callback != nil {
+				if callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
+					return errorList, true, false
 				}
-				return errorList, false
 			}
+			return errorList, false, false
 		}
 	}
+	if holderr != nil {
+		errorList = append(errorList, holderr.Error())
+		return errorList, false, false
+	}
 
 	// Make sure dest dir exists
 	// Copy the permissions of root dest path
@@ -110,7 +179,7 @@ func (*FileSystemSyncProvider) uploadSingleFile(remoteName, filename, fromDir, t
 	if err != nil {
 		msg := fmt.Sprintf("Unable to create dir %v: %v", parentDir, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	// Create a temporary file to copy, avoid issues with interruptions
 	// Note this isn't a valid thing to do in security conscious cases but this isn't one
@@ -119,7 +188,7 @@ func (*FileSystemSyncProvider) uploadSingleFile(remoteName, filename, fromDir, t
 	if err != nil {
 		msg := fmt.Sprintf("Unable to create temp file for upload in %v: %v", parentDir, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	tmpfilename := outf.Name()
 	// This is safe to do even though we manually close & rename because both calls are no-ops if we succeed
@@ -131,24 +200,25 @@ func (*FileSystemSyncProvider) uploadSingleFile(remoteName, filename, fromDir, t
 	if err != nil {
 		msg := fmt.Sprintf("Unable to read input file for upload %v: %v", srcfilename, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	defer inf.Close()
+	in := util.ThrottleUploadReader(self.opts, inf)
 
 	// Initial callback
 	if callback != nil {
 		if callback(filename, util.ProgressTransferBytes, 0, srcfi.Size()) {
-			return errorList, true
+			return errorList, true, false
 		}
 	}
 	var copysize int64 = 0
 	for {
 		var n int64
-		n, err = io.CopyN(outf, inf, FileSystemBufferSize)
+		n, err = io.CopyN(outf, in, FileSystemBufferSize)
 		copysize += n
 		if n > 0 && callback != nil && srcfi.Size() > 0 {
 			if callback(filename, util.ProgressTransferBytes, copysize, srcfi.Size()) {
-				return errorList, true
+				return errorList, true, false
 			}
 		}
 		if err != nil {
@@ -167,13 +237,14 @@ func (*FileSystemSyncProvider) uploadSingleFile(remoteName, filename, fromDir, t
 				remoteName, srcfilename, copysize, srcfi.Size())
 		}
 		errorList = append(errorList, msg)
-		return errorList, false
+		// Network filesystems can drop out temporarily
+		return errorList, false, IsRetriableError(err)
 	}
 	// Otherwise, file data is ok on remote
 	// Move to correct location - remove before to deal with force or bad size cases
 	os.Remove(destfilename)
 	os.Rename(tmpfilename, destfilename)
-	return errorList, false
+	return errorList, false, false
 
 }
 
@@ -194,8 +265,10 @@ func (self *FileSystemSyncProvider) Upload(remoteName string, filenames []string
 	var errorList []string
 	for _, filename := range filenames {
 		// Allow aborting
-		newerrs, abort := self.uploadSingleFile(remoteName, filename, fromDir, destpath,
-			destpathfi.Mode(), force, callback)
+		newerrs, abort := RetryFile(self.opts, self.log, filename, callback, func() ([]string, bool, bool) {
+			return self.uploadSingleFile(remoteName, filename, fromDir, destpath,
+				destpathfi.Mode(), force, callback)
+		})
 		errorList = append(errorList, newerrs...)
 		if abort {
 			break
@@ -209,15 +282,15 @@ func (self *FileSystemSyncProvider) Upload(remoteName string, filenames []string
 	return nil
 }
 
-func (*FileSystemSyncProvider) downloadSingleFile(remoteName, filename, fromDir, toDir string,
-	force bool, callback SyncProgressCallback) (errorList []string, abort bool) {
+func (self *FileSystemSyncProvider) downloadSingleFile(remoteName, filename, fromDir, toDir string,
+	force bool, callback SyncProgressCallback) (errorList []string, abort, retry bool) {
 	// Check to see if the file is already there, right size
-	srcfilename := filepath.Join(fromDir, filename)
+	srcfilename := getFilesystemFilePath(fromDir, filename)
 	srcfi, err := os.Stat(srcfilename)
 	if err != nil {
 		if callback != nil {
 			if callback(filename, util.ProgressNotFound, 0, 0) {
-				return errorList, true
+				return errorList, true, false
 			}
 		}
 		// Note how we don't add an error to the returned error list
@@ -225,10 +298,10 @@ func (*FileSystemSyncProvider) downloadSingleFile(remoteName, filename, fromDir,
 		// as a skipped item otherwise, since caller can only request files & not know
 		// if they're on the remote or not
 		// Keep going with other files
-		return errorList, false
+		return errorList, false, false
 	}
 
-	destfilename := filepath.Join(toDir, filename)
+	destfilename := LocalFilePath(toDir, filename)
 	if !force {
 		// Check existence & size before downloading
 		if destfi, err := os.Stat(destfilename); err == nil {
@@ -237,10 +310,10 @@ func (*FileSystemSyncProvider) downloadSingleFile(remoteName, filename, fromDir,
 				// File already present and correct size, skip
 				if callback != nil {
 					if callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
-						return errorList, true
+						return errorList, true, false
 					}
 				}
-				return errorList, false
+				return errorList, false, false
 			}
 		}
 	}
@@ -251,7 +324,7 @@ func (*FileSystemSyncProvider) downloadSingleFile(remoteName, filename, fromDir,
 	if err != nil {
 		msg := fmt.Sprintf("Unable to create dir %v: %v", parentDir, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	// Create a temporary file to copy, avoid issues with interruptions
 	// Note this isn't a valid thing to do in security conscious cases but this isn't one
@@ -260,7 +333,7 @@ func (*FileSystemSyncProvider) downloadSingleFile(remoteName, filename, fromDir,
 	if err != nil {
 		msg := fmt.Sprintf("Unable to create temp file for download in %v: %v", parentDir, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	tmpfilename := outf.Name()
 	// This is safe to do even though we manually close & rename because both calls are no-ops if we succeed
@@ -272,24 +345,25 @@ func (*FileSystemSyncProvider) downloadSingleFile(remoteName, filename, fromDir,
 	if err != nil {
 		msg := fmt.Sprintf("Unable to read input file for download %v: %v", srcfilename, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	defer inf.Close()
+	in := util.ThrottleDownloadReader(self.opts, inf)
 
 	// Initial callback
 	if callback != nil {
 		if callback(filename, util.ProgressTransferBytes, 0, srcfi.Size()) {
-			return errorList, true
+			return errorList, true, false
 		}
 	}
 	var copysize int64 = 0
 	for {
 		var n int64
-		n, err = io.CopyN(outf, inf, FileSystemBufferSize)
+		n, err = io.CopyN(outf, in, FileSystemBufferSize)
 		copysize += n
 		if n > 0 && callback != nil && srcfi.Size() > 0 {
 			if callback(filename, util.ProgressTransferBytes, copysize, srcfi.Size()) {
-				return errorList, true
+				return errorList, true, false
 			}
 		}
 		if err != nil {
@@ -308,13 +382,14 @@ func (*FileSystemSyncProvider) downloadSingleFile(remoteName, filename, fromDir,
 				remoteName, srcfilename, copysize, srcfi.Size())
 		}
 		errorList = append(errorList, msg)
-		return errorList, false
+		// Network filesystems can drop out temporarily
+		return errorList, false, IsRetriableError(err)
 	}
 	// Otherwise, file data is ok on remote
 	// Move to correct location - remove before to deal with force or bad size cases
 	os.Remove(destfilename)
 	os.Rename(tmpfilename, destfilename)
-	return errorList, false
+	return errorList, false, false
 
 }
 
@@ -335,7 +410,9 @@ func (self *FileSystemSyncProvider) Download(remoteName string, filenames []stri
 	var errorList []string
 	for _, filename := range filenames {
 		// Allow aborting
-		newerrs, abort := self.downloadSingleFile(remoteName, filename, srcpath, toDir, force, callback)
+		newerrs, abort := RetryFile(self.opts, self.log, filename, callback, func() ([]string, bool, bool) {
+			return self.downloadSingleFile(remoteName, filename, srcpath, toDir, force, callback)
+		})
 		errorList = append(errorList, newerrs...)
 		if abort {
 			break
@@ -349,25 +426,134 @@ func (self *FileSystemSyncProvider) Download(remoteName string, filenames []stri
 	return nil
 }
 
-func (*FileSystemSyncProvider) getRemoteRootPath(remoteName string) (string, error) {
+// Number of meta files read from a filesystem remote at once
+const FileSystemMetadataReaders = 8
+
+// Download meta files, reading several at once since on network volumes the time goes on
+// round trips rather than data; files are written locally in order as for Download
+func (self *FileSystemSyncProvider) DownloadMetadataBatch(remoteName string, filenames []string, toDir string,
+	force bool, callback SyncProgressCallback) error {
+
+	srcpath, err := self.getRemoteRootPath(remoteName)
+	if err != nil {
+		return err
+	}
+	srcpathfi, err := os.Stat(srcpath)
+	if err != nil || !srcpathfi.IsDir() {
+		return fmt.Errorf("git-lob-path '%v' for remote '%v' is not a valid directory", srcpath, remoteName)
+	}
+
+	// Anything else is downloaded as usual afterwards, chunks can be large
+	var otherFiles []string
+	var metafiles []string
+	for _, filename := range filenames {
+		if strings.HasSuffix(filename, "_meta") {
+			metafiles = append(metafiles, filename)
+		} else {
+			otherFiles = append(otherFiles, filename)
+		}
+	}
+	filenames = metafiles
+
+	type metaRead struct {
+		data []byte
+		err  error
+		done chan struct{}
+	}
+	reads := make([]*metaRead, len(filenames))
+	for i := range reads {
+		reads[i] = &metaRead{done: make(chan struct{})}
+	}
+	next := make(chan int)
+	go func() {
+		for i := range filenames {
+			next <- i
+		}
+		close(next)
+	}()
+	for w := 0; w < FileSystemMetadataReaders; w++ {
+		go func() {
+			for i := range next {
+				reads[i].data, reads[i].err = ioutil.ReadFile(getFilesystemFilePath(srcpath, filenames[i]))
+				close(reads[i].done)
+			}
+		}()
+	}
+
+	var errorList []string
+	var abort bool
+	for i, filename := range filenames {
+		read := reads[i]
+		<-read.done
+		if abort {
+			// Let the readers finish
+			continue
+		}
+		var newerrs []string
+		switch {
+		case os.IsNotExist(read.err):
+			abort = callback != nil && callback(filename, util.ProgressNotFound, 0, 0)
+		case read.err != nil:
+			// Download retries if it's worth it & reports the error if not
+			otherFiles = append(otherFiles, filename)
+		default:
+			newerrs, abort = SaveDownloadedFile(self.opts, filename, toDir, read.data, force, callback)
+		}
+		errorList = append(errorList, newerrs...)
+	}
+	if !abort && len(otherFiles) > 0 {
+		if err := self.Download(remoteName, otherFiles, toDir, force, callback); err != nil {
+			errorList = append(errorList, err.Error())
+		}
+	}
+
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+	return nil
+}
+
+func (self *FileSystemSyncProvider) getRemoteRootPath(remoteName string) (string, error) {
 	// Check config
-	path, ok := util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-path", remoteName)]
-	if !ok {
+	path, _ := GetFilesystemPathForRemote(self.root, self.opts, remoteName)
+	if path == "" {
 		return "", fmt.Errorf("Missing git-lob-path config parameter for remote '%v'", remoteName)
 	}
 
 	// clean up the path
-	path = filepath.Clean(path)
+	path = util.NormalizeUNCPath(filepath.Clean(path))
 
 	return path, nil
 }
 
+// Get the path of a file in a filesystem remote; splayed binaries on a share can easily go over
+// MAX_PATH on Windows
+func getFilesystemFilePath(root, filename string) string {
+	return util.LongPath(filepath.Join(root, filename))
+}
+
+// The remote can be reached if its folder exists, e.g. a network share is mounted
+func (self *FileSystemSyncProvider) CheckConnection(remoteName string) error {
+	root, err := self.getRemoteRootPath(remoteName)
+	if err != nil {
+		return err
+	}
+	s, err := os.Stat(root)
+	if err != nil {
+		return fmt.Errorf("Unable to reach remote '%v': %v", remoteName, err.Error())
+	}
+	if !s.IsDir() {
+		return fmt.Errorf("Unable to reach remote '%v': %v is not a folder", remoteName, root)
+	}
+	return nil
+}
+
 func (self *FileSystemSyncProvider) FileExists(remoteName, filename string) bool {
 	root, err := self.getRemoteRootPath(remoteName)
 	if err != nil {
 		return false
 	}
-	fullpath := filepath.Join(root, filename)
+	fullpath := getFilesystemFilePath(root, filename)
 	_, err = os.Stat(fullpath)
 
 	return err == nil
@@ -377,9 +563,90 @@ func (self *FileSystemSyncProvider) FileExistsAndIsOfSize(remoteName, filename s
 	if err != nil {
 		return false
 	}
-	fullpath := filepath.Join(root, filename)
+	fullpath := getFilesystemFilePath(root, filename)
 	stat, err := os.Stat(fullpath)
 
 	return err == nil && stat.Size() == sz
 
 }
+
+func (self *FileSystemSyncProvider) Delete(remoteName string, filenames []string) error {
+	root, err := self.getRemoteRootPath(remoteName)
+	if err != nil {
+		return err
+	}
+	var errorList []string
+	var unheld []string
+	for _, filename := range filenames {
+		if fi, err := os.Stat(getFilesystemFilePath(root, filename)); err == nil {
+			if holderr := checkRetentionHold(self.opts, self.log, remoteName, filename, fi.ModTime()); holderr != nil {
+				errorList = append(errorList, holderr.Error())
+				continue
+			}
+		}
+		unheld = append(unheld, filename)
+	}
+	if err := self.deleteFiles(root, unheld); err != nil {
+		errorList = append(errorList, err.Error())
+	}
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+	return nil
+}
+
+// Delete files under root, & the folders they were in if that leaves them empty
+func (*FileSystemSyncProvider) deleteFiles(root string, filenames []string) error {
+	var errorList []string
+	for _, filename := range filenames {
+		fullpath := getFilesystemFilePath(root, filename)
+		err := os.Remove(fullpath)
+		if err != nil && !os.IsNotExist(err) {
+			errorList = append(errorList, fmt.Sprintf("Unable to delete %v: %v", fullpath, err.Error()))
+			continue
+		}
+		// Fails harmlessly if not empty
+		for dir := filepath.Dir(filename); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+			if os.Remove(getFilesystemFilePath(root, dir)) != nil {
+				break
+			}
+		}
+	}
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+	return nil
+}
+
+func (self *FileSystemSyncProvider) List(remoteName string, callback func(file *RemoteFile) (quit bool)) error {
+	root, err := self.getRemoteRootPath(remoteName)
+	if err != nil {
+		return err
+	}
+	return self.listFiles(root, callback)
+}
+
+// List all the files under root
+func (*FileSystemSyncProvider) listFiles(root string, callback func(file *RemoteFile) (quit bool)) error {
+	errQuit := errors.New("quit")
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relpath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if callback(&RemoteFile{Filename: relpath, Size: info.Size()}) {
+			return errQuit
+		}
+		return nil
+	})
+	if err != nil && err != errQuit {
+		return fmt.Errorf("Unable to list files in %v: %v", root, err.Error())
+	}
+	return nil
+}
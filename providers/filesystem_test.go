@@ -2,9 +2,12 @@ package providers
 
 import (
 	"bytes"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
@@ -38,7 +41,7 @@ var _ = Describe("Filesystem", func() {
 		// Hack the git config to mock destination
 		GlobalOptions.GitConfig["remote.origin.git-lob-path"] = toDir
 
-		fsync := FileSystemSyncProvider{}
+		fsync := FileSystemSyncProvider{opts: GlobalOptions, log: DefaultLogger}
 		// Record of callbacks for files
 		var filesUploaded []string = make([]string, 0, len(files))
 		var filesSkipped []string
@@ -110,7 +113,7 @@ var _ = Describe("Filesystem", func() {
 		// Hack the git config to mock destination
 		GlobalOptions.GitConfig["remote.origin.git-lob-path"] = fromDir
 
-		fsync := FileSystemSyncProvider{}
+		fsync := FileSystemSyncProvider{opts: GlobalOptions, log: DefaultLogger}
 		// Record of callbacks for files
 		var filesDownloaded []string = make([]string, 0, len(files))
 		var filesSkipped []string
@@ -201,6 +204,182 @@ var _ = Describe("Filesystem", func() {
 			})
 		})
 
+		Context("Long paths", func() {
+			// Deeper than MAX_PATH (260 chars), e.g. a store on a share deep in a project folder
+			longremoteroot := filepath.Join(os.TempDir(), "MockFileSystemLongPath")
+			longremotepath := filepath.Join(longremoteroot, strings.Repeat("a_deeply_nested_folder"+string(filepath.Separator), 12), "store")
+			BeforeEach(func() {
+				os.MkdirAll(LongPath(longremotepath), 0755)
+				os.RemoveAll(localpath)
+				os.MkdirAll(localpath, 0755)
+			})
+			AfterEach(func() {
+				os.RemoveAll(LongPath(longremoteroot))
+				os.RemoveAll(localpath)
+			})
+
+			It("successfully uploads & downloads", func() {
+				Expect(len(longremotepath)).To(BeNumerically(">", 260))
+				testCreateFiles(localpath)
+				testUpload(testfiles, localpath, longremotepath)
+				os.RemoveAll(localpath)
+				os.MkdirAll(localpath, 0755)
+				testDownload(testfiles, longremotepath, localpath)
+			})
+		})
+
+		Context("Delete", func() {
+			BeforeEach(func() {
+				os.MkdirAll(mockremotepath, 0755)
+				testCreateFiles(mockremotepath)
+				GlobalOptions.GitConfig["remote.origin.git-lob-path"] = mockremotepath
+			})
+			AfterEach(func() {
+				os.RemoveAll(mockremotepath)
+			})
+
+			It("successfully deletes", func() {
+				fsync := FileSystemSyncProvider{opts: GlobalOptions, log: DefaultLogger}
+				half := len(testfiles) / 2
+				err := fsync.Delete("origin", testfiles[:half])
+				Expect(err).To(BeNil(), "Should not have error deleting")
+				for i, file := range testfiles {
+					Expect(fsync.FileExists("origin", file)).To(Equal(i >= half), "Only deleted files should be gone")
+				}
+				// Already deleted is fine
+				err = fsync.Delete("origin", testfiles)
+				Expect(err).To(BeNil(), "Should not have error deleting missing files")
+				Expect(DirExists(mockremotepath)).To(BeTrue(), "Should not delete the remote root")
+				var leftover []string
+				filepath.Walk(mockremotepath, func(path string, info os.FileInfo, err error) error {
+					if err == nil && path != mockremotepath {
+						leftover = append(leftover, path)
+					}
+					return nil
+				})
+				Expect(leftover).To(BeEmpty(), "Should have removed empty folders")
+			})
+			It("keeps files under a retention hold", func() {
+				GlobalOptions.GitConfig["remote.origin.git-lob-retention-days"] = "30"
+				defer delete(GlobalOptions.GitConfig, "remote.origin.git-lob-retention-days")
+				fsync := FileSystemSyncProvider{opts: GlobalOptions, log: DefaultLogger}
+				old := time.Now().AddDate(0, 0, -31)
+				os.Chtimes(filepath.Join(mockremotepath, testfiles[0]), old, old)
+				err := fsync.Delete("origin", testfiles[:2])
+				Expect(err).ToNot(BeNil(), "Should refuse to delete held files")
+				Expect(err.Error()).To(ContainSubstring("retention hold"))
+				Expect(fsync.FileExists("origin", testfiles[0])).To(BeFalse(), "Hold should have expired")
+				Expect(fsync.FileExists("origin", testfiles[1])).To(BeTrue(), "Held file should be kept")
+
+				// Can't be replaced with different content, even if forced
+				os.MkdirAll(filepath.Dir(filepath.Join(localpath, testfiles[1])), 0755)
+				// Test files are smaller than this
+				ioutil.WriteFile(filepath.Join(localpath, testfiles[1]), bytes.Repeat([]byte{1}, 10000), 0644)
+				defer os.RemoveAll(localpath)
+				err = fsync.Upload("origin", testfiles[1:2], localpath, true, nil)
+				Expect(err).ToNot(BeNil(), "Should refuse to replace held file")
+				Expect(err.Error()).To(ContainSubstring("retention hold"))
+				Expect(fsync.FileExistsAndIsOfSize("origin", testfiles[1], 10000)).To(BeFalse())
+			})
+		})
+		Context("List", func() {
+			BeforeEach(func() {
+				os.MkdirAll(mockremotepath, 0755)
+				testCreateFiles(mockremotepath)
+				GlobalOptions.GitConfig["remote.origin.git-lob-path"] = mockremotepath
+			})
+			AfterEach(func() {
+				os.RemoveAll(mockremotepath)
+			})
+
+			It("lists all files with sizes", func() {
+				fsync := FileSystemSyncProvider{opts: GlobalOptions, log: DefaultLogger}
+				listed := make(map[string]int64)
+				err := fsync.List("origin", func(file *RemoteFile) (quit bool) {
+					listed[file.Filename] = file.Size
+					return false
+				})
+				Expect(err).To(BeNil(), "Should not have error listing")
+				Expect(listed).To(HaveLen(len(testfiles)), "Should list every file & no folders")
+				for _, file := range testfiles {
+					stat, err := os.Stat(filepath.Join(mockremotepath, file))
+					Expect(err).To(BeNil())
+					Expect(listed).To(HaveKeyWithValue(file, stat.Size()), "Should list relative path & size")
+				}
+
+				count := 0
+				err = fsync.List("origin", func(file *RemoteFile) (quit bool) {
+					count++
+					return true
+				})
+				Expect(err).To(BeNil(), "Quitting early is not an error")
+				Expect(count).To(Equal(1), "Should stop when callback quits")
+			})
+		})
+		Context("Metadata batch", func() {
+			metafiles := []string{
+				"123/456/1234567890123456789012345678901234567890_meta",
+				"abc/def/abcdefabcdefabcdefabcdefabcdefabcdefabcd_meta",
+				"fed/cba/fedcbafedcbafedcbafedcbafedcbafedcbafedc_meta",
+			}
+			chunkfile := "abc/def/abcdefabcdefabcdefabcdefabcdefabcdefabcd_0"
+			missingfile := "000/111/0001112223334445556667778889990001112223_meta"
+			BeforeEach(func() {
+				for i, file := range append(metafiles, chunkfile) {
+					fullpath := filepath.Join(mockremotepath, file)
+					os.MkdirAll(filepath.Dir(fullpath), 0755)
+					ioutil.WriteFile(fullpath, bytes.Repeat([]byte{'x'}, 50+i), 0644)
+				}
+				os.RemoveAll(localpath)
+				os.MkdirAll(localpath, 0755)
+				GlobalOptions.GitConfig["remote.origin.git-lob-path"] = mockremotepath
+			})
+			AfterEach(func() {
+				os.RemoveAll(mockremotepath)
+				os.RemoveAll(localpath)
+			})
+
+			It("downloads meta files & anything else requested", func() {
+				fsync := FileSystemSyncProvider{opts: GlobalOptions, log: DefaultLogger}
+				Expect(UpgradeToBatchMetadataSyncProvider(&fsync)).ToNot(BeNil(), "Should support batches")
+				var downloaded, skipped, notFound []string
+				callback := func(filename string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+					switch {
+					case progressType == ProgressSkip:
+						skipped = append(skipped, filename)
+					case progressType == ProgressNotFound:
+						notFound = append(notFound, filename)
+					case bytesDone == totalBytes:
+						downloaded = append(downloaded, filename)
+					}
+					return false
+				}
+				files := append([]string{missingfile, chunkfile}, metafiles...)
+				err := fsync.DownloadMetadataBatch("origin", files, localpath, false, callback)
+				Expect(err).To(BeNil(), "Should not have error downloading")
+				Expect(notFound).To(Equal([]string{missingfile}))
+				Expect(downloaded).To(Equal(append(metafiles, chunkfile)), "Meta files should be downloaded first, in order")
+				for _, file := range append(metafiles, chunkfile) {
+					remotecontent, _ := ioutil.ReadFile(filepath.Join(mockremotepath, file))
+					localcontent, err := ioutil.ReadFile(filepath.Join(localpath, file))
+					Expect(err).To(BeNil(), "Local file should exist")
+					Expect(localcontent).To(Equal(remotecontent), "Content should match")
+				}
+
+				// Repeating skips them unless forced
+				downloaded, skipped = nil, nil
+				err = fsync.DownloadMetadataBatch("origin", metafiles, localpath, false, callback)
+				Expect(err).To(BeNil(), "Should not have error downloading")
+				Expect(downloaded).To(BeEmpty())
+				Expect(skipped).To(Equal(metafiles))
+				skipped = nil
+				err = fsync.DownloadMetadataBatch("origin", metafiles, localpath, true, callback)
+				Expect(err).To(BeNil(), "Should not have error downloading")
+				Expect(downloaded).To(Equal(metafiles))
+				Expect(skipped).To(BeEmpty())
+			})
+		})
+
 	})
 
 	Context("Real remote tests [REMOTETEST]", func() {
@@ -0,0 +1,339 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// MockSyncProvider simulates a remote in a local temp directory, so that configuration
+// & hooks can be tested end-to-end without network access or a real server
+// Latency & errors can be injected via config to test how things behave on a bad connection
+type MockSyncProvider struct {
+	// Stores the files, the mock just adds the simulated behaviour around it; also has the
+	// repository this instance is for
+	fs FileSystemSyncProvider
+	// For simulated errors
+	random *rand.Rand
+}
+
+// Settings for a mock remote
+type mockRemoteConfig struct {
+	// Where the simulated remote stores files
+	Path string
+	// Delay before every operation
+	Latency time.Duration
+	// Percentage chance (0-100) that each file transfer will fail
+	ErrorRate int
+	// Whether the remote is unreachable
+	Offline bool
+}
+
+func (*MockSyncProvider) ForRepo(root string, opts *util.Options, log *util.Logger) SyncProvider {
+	return &MockSyncProvider{fs: FileSystemSyncProvider{root: root, opts: opts, log: log}}
+}
+
+func (*MockSyncProvider) TypeID() string {
+	return "mock"
+}
+
+func (*MockSyncProvider) HelpTextSummary() string {
+	return `mock: simulates a remote in a local temp directory, for testing configuration`
+}
+
+func (*MockSyncProvider) HelpTextDetail() string {
+	return `The "mock" provider simulates a remote by storing files in a local temporary
+directory, so that you can test your remote configuration, workspaces & hooks
+end-to-end without network access or a real server (e.g. in CI). Latency and
+errors can be injected to see how things behave over a bad connection.
+
+Required parameters in remote section of .gitconfig:
+    git-lob-url    mock://<name> where <name> identifies the simulated remote;
+                   remotes with the same name share the same files. Stored
+                   in git-lob-mock/<name> in your temp directory.
+
+Optional parameters in remote section of .gitconfig:
+    git-lob-mock-latency     Delay before each operation, e.g. 200ms or 2s
+                             (plain numbers are milliseconds)
+    git-lob-mock-error-rate  Percentage chance (0-100) that each file
+                             transfer will fail
+    git-lob-mock-offline     Set to true to make the remote unreachable
+
+Storage classes requested with the lob-storage attribute are recorded in
+git-lob-mock/<name>.storage, so that fetch warns about 'cold' binaries.
+
+Example configuration:
+    [remote "origin"]
+        url = git@blah.com/your/usual/git/repo
+        git-lob-provider = mock
+        git-lob-url = mock://ci-test
+        git-lob-mock-latency = 500ms
+        git-lob-mock-error-rate = 10
+
+The simulated remote is never cleaned up automatically; delete the directory
+to start again.
+`
+}
+
+// Get the local directory used by a mock:// URL
+func GetMockRemotePath(mockurl string) (string, error) {
+	u, err := url.Parse(mockurl)
+	if err != nil {
+		return "", fmt.Errorf("Invalid mock URL %v: %v", mockurl, err.Error())
+	}
+	if u.Scheme != "mock" {
+		return "", fmt.Errorf("Invalid mock URL %v: must start with mock://", mockurl)
+	}
+	name := strings.Trim(u.Host+u.Path, "/")
+	if name == "" || strings.Contains(name, "..") {
+		return "", fmt.Errorf("Invalid mock URL %v: must include a name, e.g. mock://test", mockurl)
+	}
+	return filepath.Join(os.TempDir(), "git-lob-mock", filepath.FromSlash(name)), nil
+}
+
+func (self *MockSyncProvider) getConfig(remoteName string) (*mockRemoteConfig, error) {
+	urlsetting := fmt.Sprintf("remote.%v.git-lob-url", remoteName)
+	mockurl := self.fs.opts.GitConfig[urlsetting]
+	if mockurl == "" {
+		return nil, fmt.Errorf("Configuration invalid for 'mock', missing setting %v", urlsetting)
+	}
+	path, err := GetMockRemotePath(mockurl)
+	if err != nil {
+		return nil, fmt.Errorf("Configuration invalid for 'mock': %v", err.Error())
+	}
+	config := &mockRemoteConfig{Path: path}
+
+	latencysetting := fmt.Sprintf("remote.%v.git-lob-mock-latency", remoteName)
+	if latency := strings.TrimSpace(self.fs.opts.GitConfig[latencysetting]); latency != "" {
+		if ms, err := strconv.Atoi(latency); err == nil {
+			config.Latency = time.Duration(ms) * time.Millisecond
+		} else if config.Latency, err = time.ParseDuration(latency); err != nil {
+			return nil, fmt.Errorf("Configuration invalid for 'mock', %v is not a valid duration: %v", latencysetting, latency)
+		}
+		if config.Latency < 0 {
+			return nil, fmt.Errorf("Configuration invalid for 'mock', %v must not be negative", latencysetting)
+		}
+	}
+	ratesetting := fmt.Sprintf("remote.%v.git-lob-mock-error-rate", remoteName)
+	if rate := strings.TrimSpace(self.fs.opts.GitConfig[ratesetting]); rate != "" {
+		config.ErrorRate, err = strconv.Atoi(strings.TrimSuffix(rate, "%"))
+		if err != nil || config.ErrorRate < 0 || config.ErrorRate > 100 {
+			return nil, fmt.Errorf("Configuration invalid for 'mock', %v must be a percentage from 0 to 100: %v", ratesetting, rate)
+		}
+	}
+	offlinesetting := fmt.Sprintf("remote.%v.git-lob-mock-offline", remoteName)
+	config.Offline = strings.ToLower(self.fs.opts.GitConfig[offlinesetting]) == "true"
+
+	return config, nil
+}
+
+func (self *MockSyncProvider) ValidateConfig(remoteName string) error {
+	_, err := self.getConfig(remoteName)
+	return err
+}
+
+func (*MockSyncProvider) Release() {
+	// Nothing to do here
+}
+
+// Apply latency & check whether the remote is reachable, returning the config if so
+func (self *MockSyncProvider) connect(remoteName string) (*mockRemoteConfig, error) {
+	config, err := self.getConfig(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(config.Latency)
+	if config.Offline {
+		return nil, fmt.Errorf("Unable to connect to remote '%v' (simulated by git-lob-mock-offline)", remoteName)
+	}
+	// Simulated remote is created on demand like a real one would already exist
+	err = os.MkdirAll(config.Path, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create mock remote directory %v: %v", config.Path, err.Error())
+	}
+	return config, nil
+}
+
+func (self *MockSyncProvider) CheckConnection(remoteName string) error {
+	_, err := self.connect(remoteName)
+	return err
+}
+
+// Decide whether to simulate a failure for a file transfer
+func (self *MockSyncProvider) shouldFail(config *mockRemoteConfig) bool {
+	if config.ErrorRate <= 0 {
+		return false
+	}
+	if self.random == nil {
+		self.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return self.random.Intn(100) < config.ErrorRate
+}
+
+func (self *MockSyncProvider) Upload(remoteName string, filenames []string, fromDir string,
+	force bool, callback SyncProgressCallback) error {
+
+	config, err := self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+	destpathfi, err := os.Stat(config.Path)
+	if err != nil {
+		return err
+	}
+
+	var errorList []string
+	for i, filename := range filenames {
+		if i > 0 {
+			time.Sleep(config.Latency)
+		}
+		newerrs, abort := RetryFile(self.fs.opts, self.fs.log, filename, callback, func() ([]string, bool, bool) {
+			if self.shouldFail(config) {
+				// Simulates a dropped connection, so can be retried
+				return []string{fmt.Sprintf("Problem while uploading %v to %v: simulated error (git-lob-mock-error-rate)", filename, remoteName)},
+					false, true
+			}
+			return self.fs.uploadSingleFile(remoteName, filename, fromDir, config.Path,
+				destpathfi.Mode(), force, callback)
+		})
+		errorList = append(errorList, newerrs...)
+		if abort {
+			break
+		}
+	}
+
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+
+	return nil
+}
+
+func (self *MockSyncProvider) UploadWithStorageClass(remoteName string, filenames []string, fromDir string, force bool,
+	storageClass string, callback SyncProgressCallback) error {
+
+	if !IsValidStorageClass(storageClass) {
+		return fmt.Errorf("Unknown storage class '%v'", storageClass)
+	}
+	config, err := self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+	// Files which are skipped keep the class they're in
+	var upload []string
+	for _, filename := range filenames {
+		if force || !util.FileExists(filepath.Join(config.Path, filename)) {
+			upload = append(upload, filename)
+		}
+	}
+	err = self.Upload(remoteName, filenames, fromDir, force, callback)
+	for _, filename := range upload {
+		if !util.FileExists(filepath.Join(config.Path, filename)) {
+			continue
+		}
+		classfile := getMockStorageClassFile(config, filename)
+		if storageClass == StorageClassStandard {
+			os.Remove(classfile)
+			continue
+		}
+		if mkerr := os.MkdirAll(filepath.Dir(classfile), 0755); mkerr == nil {
+			ioutil.WriteFile(classfile, []byte(storageClass), 0644)
+		}
+	}
+	return err
+}
+
+func (self *MockSyncProvider) IsInColdStorage(remoteName, filename string) (bool, error) {
+	config, err := self.connect(remoteName)
+	if err != nil {
+		return false, err
+	}
+	class, err := ioutil.ReadFile(getMockStorageClassFile(config, filename))
+	return err == nil && string(class) == StorageClassCold, nil
+}
+
+// Records the storage class of a file on a mock remote, outside its files so that they can be listed
+func getMockStorageClassFile(config *mockRemoteConfig, filename string) string {
+	return filepath.Join(config.Path+".storage", filename)
+}
+
+func (self *MockSyncProvider) Download(remoteName string, filenames []string, toDir string,
+	force bool, callback SyncProgressCallback) error {
+
+	config, err := self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+
+	var errorList []string
+	for i, filename := range filenames {
+		if i > 0 {
+			time.Sleep(config.Latency)
+		}
+		newerrs, abort := RetryFile(self.fs.opts, self.fs.log, filename, callback, func() ([]string, bool, bool) {
+			if self.shouldFail(config) {
+				// Simulates a dropped connection, so can be retried
+				return []string{fmt.Sprintf("Problem while downloading %v from %v: simulated error (git-lob-mock-error-rate)", filename, remoteName)},
+					false, true
+			}
+			return self.fs.downloadSingleFile(remoteName, filename, config.Path, toDir, force, callback)
+		})
+		errorList = append(errorList, newerrs...)
+		if abort {
+			break
+		}
+	}
+
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+
+	return nil
+}
+
+func (self *MockSyncProvider) FileExists(remoteName, filename string) bool {
+	config, err := self.connect(remoteName)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(config.Path, filename))
+
+	return err == nil
+}
+func (self *MockSyncProvider) FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool {
+	config, err := self.connect(remoteName)
+	if err != nil {
+		return false
+	}
+	stat, err := os.Stat(filepath.Join(config.Path, filename))
+
+	return err == nil && stat.Size() == sz
+}
+
+func (self *MockSyncProvider) Delete(remoteName string, filenames []string) error {
+	config, err := self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		os.Remove(getMockStorageClassFile(config, filename))
+	}
+	return self.fs.deleteFiles(config.Path, filenames)
+}
+
+func (self *MockSyncProvider) List(remoteName string, callback func(file *RemoteFile) (quit bool)) error {
+	config, err := self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+	return self.fs.listFiles(config.Path, callback)
+}
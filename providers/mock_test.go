@@ -0,0 +1,108 @@
+package providers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Mock", func() {
+
+	localpath := filepath.Join(os.TempDir(), "MockProviderLocal")
+	downloadpath := filepath.Join(os.TempDir(), "MockProviderDownload")
+	remotepath, _ := GetMockRemotePath("mock://MockProviderTest")
+	files := []string{"one.bin", filepath.Join("sub", "two.bin")}
+	settings := []string{"git-lob-url", "git-lob-mock-latency", "git-lob-mock-error-rate", "git-lob-mock-offline"}
+
+	BeforeEach(func() {
+		for _, file := range files {
+			fullpath := filepath.Join(localpath, file)
+			os.MkdirAll(filepath.Dir(fullpath), 0755)
+			ioutil.WriteFile(fullpath, []byte("some content for "+file), 0644)
+		}
+		GlobalOptions.GitConfig["remote.origin.git-lob-url"] = "mock://MockProviderTest"
+	})
+	AfterEach(func() {
+		for _, s := range settings {
+			delete(GlobalOptions.GitConfig, "remote.origin."+s)
+		}
+		os.RemoveAll(localpath)
+		os.RemoveAll(downloadpath)
+		os.RemoveAll(remotepath)
+	})
+
+	It("Validates config", func() {
+		mock := (&MockSyncProvider{}).ForRepo("", GlobalOptions, DefaultLogger).(*MockSyncProvider)
+		Expect(mock.ValidateConfig("origin")).To(BeNil(), "Should be valid")
+		for _, bad := range []struct{ setting, value string }{
+			{"git-lob-url", ""},
+			{"git-lob-url", "ssh://host/path"},
+			{"git-lob-url", "mock://"},
+			{"git-lob-mock-latency", "slow"},
+			{"git-lob-mock-error-rate", "101"},
+		} {
+			GlobalOptions.GitConfig["remote.origin.git-lob-url"] = "mock://MockProviderTest"
+			GlobalOptions.GitConfig["remote.origin."+bad.setting] = bad.value
+			Expect(mock.ValidateConfig("origin")).ToNot(BeNil(), "%v = %q should be invalid", bad.setting, bad.value)
+			delete(GlobalOptions.GitConfig, "remote.origin."+bad.setting)
+		}
+		GlobalOptions.GitConfig["remote.origin.git-lob-mock-latency"] = "250"
+		config, err := mock.getConfig("origin")
+		Expect(err).To(BeNil())
+		Expect(config.Latency).To(Equal(250*time.Millisecond), "Plain numbers should be milliseconds")
+		Expect(config.Path).To(Equal(remotepath))
+	})
+
+	It("Uploads & downloads via a temp directory", func() {
+		mock := (&MockSyncProvider{}).ForRepo("", GlobalOptions, DefaultLogger).(*MockSyncProvider)
+		GlobalOptions.GitConfig["remote.origin.git-lob-mock-latency"] = "20ms"
+		start := time.Now()
+		err := mock.Upload("origin", files, localpath, false, nil)
+		Expect(err).To(BeNil(), "Should upload")
+		Expect(time.Since(start) >= 40*time.Millisecond).To(BeTrue(), "Latency should apply to each file")
+		for _, file := range files {
+			Expect(FileExists(filepath.Join(remotepath, file))).To(BeTrue(), "File should be stored in temp dir")
+			Expect(mock.FileExists("origin", file)).To(BeTrue())
+		}
+		err = mock.Download("origin", files, downloadpath, false, nil)
+		Expect(err).To(BeNil(), "Should download")
+		for _, file := range files {
+			Expect(FileExists(filepath.Join(downloadpath, file))).To(BeTrue(), "File should be downloaded")
+		}
+	})
+
+	It("Simulates errors", func() {
+		mock := (&MockSyncProvider{}).ForRepo("", GlobalOptions, DefaultLogger).(*MockSyncProvider)
+		GlobalOptions.GitConfig["remote.origin.git-lob-mock-offline"] = "true"
+		Expect(mock.ValidateConfig("origin")).To(BeNil(), "Offline should still be valid config")
+		err := mock.Upload("origin", files, localpath, false, nil)
+		Expect(err).ToNot(BeNil(), "Should fail when offline")
+		Expect(mock.FileExists("origin", files[0])).To(BeFalse())
+
+		delete(GlobalOptions.GitConfig, "remote.origin.git-lob-mock-offline")
+		GlobalOptions.GitConfig["remote.origin.git-lob-mock-error-rate"] = "100"
+		oldSleep := retrySleep
+		defer func() { retrySleep = oldSleep }()
+		retrySleep = func(time.Duration) {}
+		var retries int
+		callback := func(fileInProgress string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+			if progressType == ProgressRetry {
+				retries++
+			}
+			return false
+		}
+		err = mock.Upload("origin", files, localpath, false, callback)
+		Expect(err).ToNot(BeNil(), "Should fail every file")
+		Expect(err.Error()).To(ContainSubstring("simulated error"))
+		Expect(retries).To(Equal(len(files)*GlobalOptions.RetryAttempts), "Simulated errors should be retried")
+		for _, file := range files {
+			Expect(FileExists(filepath.Join(remotepath, file))).To(BeFalse(), "No files should be uploaded")
+		}
+	})
+
+})
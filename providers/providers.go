@@ -4,6 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/atlassian/git-lob/util"
 )
@@ -22,6 +26,11 @@ type SyncProvider interface {
 	// 'git-lob provider <TypeID>'
 	HelpTextDetail() string
 
+	// Return a new instance of this provider for the repository at root (its git dir if bare),
+	// which reads the settings of remotes from opts & logs to log. The registered instances are
+	// only for the calls above
+	ForRepo(root string, opts *util.Options, log *util.Logger) SyncProvider
+
 	// Return whether the configuration for a given remote is valid
 	ValidateConfig(remoteName string) error
 
@@ -53,6 +62,13 @@ type SyncProvider interface {
 	FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool
 }
 
+// Gets the path of a file in the local folder which Upload reads files from or Download writes
+// them to. Filenames are always relative to the root of a remote store; git-lob's own stores may
+// lay their files out differently, so git-lob replaces this to find them
+var LocalFilePath = func(dir, filename string) string {
+	return util.LongPath(filepath.Join(dir, filename))
+}
+
 // Smart sync provider interface with more options
 type SmartSyncProvider interface {
 	// Everything from core SyncProvider
@@ -66,6 +82,11 @@ type SmartSyncProvider interface {
 	PrepareDeltaForDownload(remoteName, sha string, candidateBaseSHAs []string) (sz int64, base string, e error)
 	// Download delta of LOB content (must be applied later)
 	DownloadDelta(remoteName, basesha, targetsha string, out io.Writer, callback SyncProgressCallback) error
+	// The algorithm deltas exchanged with the remote are generated with; git-lob.delta-algorithm
+	// if the remote supports it, otherwise "bm"
+	DeltaAlgorithm(remoteName string) (string, error)
+	// The version of the smart protocol agreed with the remote
+	ProtocolVersion(remoteName string) (int, error)
 	// Return the LOB which the server has a complete copy of, from a list of candidates
 	// Server must test in the order provided & return the earliest one which is complete on the server
 	// Server doesn't have to test full integrity of LOB, just completeness (check size against meta)
@@ -73,6 +94,118 @@ type SmartSyncProvider interface {
 	GetFirstCompleteLOBFromList(remoteName string, candidateSHAs []string) (string, error)
 	// Upload delta of LOB content (must be calculated first)
 	UploadDelta(remoteName, basesha, targetsha string, in io.Reader, size int64, callback SyncProgressCallback) error
+	// List all the LOBs the remote has any files for (complete or not)
+	// Returns an error if the remote doesn't allow this user to prune
+	ListLOBs(remoteName string) ([]string, error)
+	// Ask the remote to delete LOBs; it may choose to retain some (e.g. if uploaded recently)
+	// Returns the SHAs deleted (or which would be on dryRun), those retained & those held
+	// because the remote is in write-once retention mode & their retention period isn't over
+	// Returns an error if the remote doesn't allow this user to prune
+	PruneLOBs(remoteName string, shas []string, dryRun bool) (deleted, retained, held []string, e error)
+	// Lock a file path (relative to the root of the repo, / separated) so that only this user
+	// can commit changes to it. Returns the lock, which is the existing one if this user already
+	// held it; returns an error if another user holds it or the remote doesn't support locking
+	LockFile(remoteName, path string) (*FileLock, error)
+	// Release the lock on a file path. Only the user who holds a lock can release it, unless
+	// force is true and the remote allows this user to break other users' locks
+	UnlockFile(remoteName, path string, force bool) error
+	// List all the locks held on the remote, by any user
+	ListLocks(remoteName string) ([]*FileLock, error)
+}
+
+// Optional interface for providers which can delete files from a remote (smart providers delete
+// whole LOBs with PruneLOBs instead)
+type DeletingSyncProvider interface {
+	SyncProvider
+
+	// Delete a list of files from the remote, paths relative as for Upload
+	// Files which don't exist are not an error
+	Delete(remoteName string, filenames []string) error
+}
+
+// Optional interface for providers which can check that a remote is reachable without
+// transferring anything, e.g. so that a push can be queued while offline
+type ConnectingSyncProvider interface {
+	SyncProvider
+
+	// Connect to the remote, returning an error describing why it can't be reached if not
+	CheckConnection(remoteName string) error
+}
+
+// A file stored on a remote, as listed by ListingSyncProvider
+type RemoteFile struct {
+	// Path relative to the root of the store, as for Upload
+	Filename string
+	// Bytes stored
+	Size int64
+}
+
+// Optional interface for providers which can list what's stored on a remote
+type ListingSyncProvider interface {
+	SyncProvider
+
+	// List all the files stored on the remote, calling back for each one in no particular order;
+	// return true from the callback to stop. Smart providers don't expose the files a server uses,
+	// so list each binary the server has as its meta file, with the size of its content (0 if the
+	// server only has part of it)
+	// Returns an error if the remote can't be listed, e.g. the user isn't allowed to
+	List(remoteName string, callback func(file *RemoteFile) (quit bool)) error
+}
+
+// Optional interface for providers which can download the meta files of many binaries in far
+// fewer round trips than Download, which fetches them one at a time. See batch.go
+type BatchMetadataSyncProvider interface {
+	SyncProvider
+
+	// Download meta files as for Download, with the same skipping, callbacks & errors
+	// Files which aren't meta files are downloaded individually
+	DownloadMetadataBatch(remoteName string, filenames []string, toDir string, force bool,
+		callback SyncProgressCallback) error
+}
+
+// Storage classes which can be requested for files with the lob-storage attribute in .gitattributes;
+// providers map them to their own tiers. Files without the attribute use the provider's default
+const (
+	// The provider's default storage
+	StorageClassStandard = "standard"
+	// Cheaper to store, more expensive to download, e.g. S3 Standard-IA
+	StorageClassInfrequent = "infrequent"
+	// Cheapest to store for rarely needed history, slowest or most expensive to download, e.g. S3 Glacier Instant Retrieval
+	StorageClassCold = "cold"
+)
+
+// Is a lob-storage attribute value one of the storage classes above?
+func IsValidStorageClass(class string) bool {
+	switch class {
+	case StorageClassStandard, StorageClassInfrequent, StorageClassCold:
+		return true
+	}
+	return false
+}
+
+// Optional interface for providers which can store files in cheaper storage classes
+type StorageClassSyncProvider interface {
+	SyncProvider
+
+	// Upload files as for Upload, storing them in a storage class (StorageClassCold etc)
+	// Files already on the remote are skipped as for Upload, whatever storage class they're in
+	UploadWithStorageClass(remoteName string, filenames []string, fromDir string, force bool, storageClass string,
+		callback SyncProgressCallback) error
+	// Whether a file on the remote is stored in a cold tier, which is slower or more expensive
+	// to download from. filename is relative to the root of the store
+	IsInColdStorage(remoteName, filename string) (bool, error)
+}
+
+// A lock on a file path held on a remote, so that only one user changes an unmergeable file
+type FileLock struct {
+	// Path of the file relative to the root of the repo, / separated
+	Path string
+	// The user holding the lock, as the remote identifies them
+	Owner string
+	// When the lock was taken
+	LockedAt time.Time
+	// Whether the lock is held by the user asking for it
+	Mine bool
 }
 
 // Callback when progress is made uploading / downloading
@@ -119,21 +252,133 @@ func UpgradeToSmartSyncProvider(provider SyncProvider) SmartSyncProvider {
 
 }
 
+// 'Upgrade' a pointer to a SyncProvider to a DeletingSyncProvider, if possible (returns nil if not)
+// Cached providers delete from the remote, not the cache
+func UpgradeToDeletingSyncProvider(provider SyncProvider) DeletingSyncProvider {
+	switch p := provider.(type) {
+	case DeletingSyncProvider:
+		return p
+	case *CachingSyncProvider:
+		return UpgradeToDeletingSyncProvider(p.SyncProvider)
+	default:
+		return nil
+	}
+}
+
+// 'Upgrade' a pointer to a SyncProvider to a ConnectingSyncProvider, if possible (returns nil if not)
+// Cached providers connect to the remote, not the cache
+func UpgradeToConnectingSyncProvider(provider SyncProvider) ConnectingSyncProvider {
+	switch p := provider.(type) {
+	case ConnectingSyncProvider:
+		return p
+	case *CachingSyncProvider:
+		return UpgradeToConnectingSyncProvider(p.SyncProvider)
+	case *cachingSmartSyncProvider:
+		return UpgradeToConnectingSyncProvider(p.SmartSyncProvider)
+	default:
+		return nil
+	}
+}
+
+// 'Upgrade' a pointer to a SyncProvider to a ListingSyncProvider, if possible (returns nil if not)
+// Cached providers list the remote, not the cache
+func UpgradeToListingSyncProvider(provider SyncProvider) ListingSyncProvider {
+	switch p := provider.(type) {
+	case ListingSyncProvider:
+		return p
+	case *CachingSyncProvider:
+		return UpgradeToListingSyncProvider(p.SyncProvider)
+	case *cachingSmartSyncProvider:
+		return UpgradeToListingSyncProvider(p.SmartSyncProvider)
+	default:
+		return nil
+	}
+}
+
+// 'Upgrade' a pointer to a SyncProvider to a StorageClassSyncProvider, if possible (returns nil if not)
+// Cached providers store files on the remote, which is what storage classes apply to
+func UpgradeToStorageClassSyncProvider(provider SyncProvider) StorageClassSyncProvider {
+	switch p := provider.(type) {
+	case StorageClassSyncProvider:
+		return p
+	case *CachingSyncProvider:
+		return UpgradeToStorageClassSyncProvider(p.SyncProvider)
+	default:
+		return nil
+	}
+}
+
+// 'Upgrade' a pointer to a SyncProvider to a BatchMetadataSyncProvider, if possible (returns nil if not)
+// Cached providers download through the cache, one file at a time
+func UpgradeToBatchMetadataSyncProvider(provider SyncProvider) BatchMetadataSyncProvider {
+	switch p := provider.(type) {
+	case *CachingSyncProvider, *cachingSmartSyncProvider:
+		return nil
+	case BatchMetadataSyncProvider:
+		return p
+	default:
+		return nil
+	}
+}
+
 // Install the core providers
 func InitCoreProviders() {
 	RegisterSyncProvider(&FileSystemSyncProvider{})
 	RegisterSyncProvider(&S3SyncProvider{})
+	RegisterSyncProvider(&SftpSyncProvider{})
+	RegisterSyncProvider(&MockSyncProvider{})
+}
+
+// Get the provider name for the named remote in the repo whose config is in opts; git-lob-provider
+// if it's specified, otherwise chosen from the remote's URL (see GetProviderNameForURL)
+// May return "" if not specified & the URL isn't one git-lob can use
+func GetProviderNameForRemote(opts *util.Options, remoteName string) string {
+	if name := opts.GitConfig[fmt.Sprintf("remote.%v.git-lob-provider", remoteName)]; name != "" {
+		return name
+	}
+	return GetProviderNameForURL(GetGitURLForRemote(opts, remoteName))
 }
 
-// Get the provider name specified for the named remote in the current git repo
-// May return "" if not specified
-func GetProviderNameForRemote(remoteName string) string {
-	return util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-provider", remoteName)]
+// Get the URL of the named remote's git repo
+func GetGitURLForRemote(opts *util.Options, remoteName string) string {
+	return strings.TrimSpace(opts.GitConfig[fmt.Sprintf("remote.%v.url", remoteName)])
 }
 
-// Get the provider for a given remote, and validate that it's configured correctly
-func GetProviderForRemote(remoteName string) (SyncProvider, error) {
-	providerName := GetProviderNameForRemote(remoteName)
+// URLs with a scheme, e.g. https://host/path
+var urlSchemeRegex = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*)://`)
+
+// Windows paths starting with a drive, which would otherwise look like scp-like URLs
+var windowsDrivePathRegex = regexp.MustCompile(`^[a-zA-Z]:[\\/]`)
+
+// scp-like SSH URLs, [user@]host:path; like git, only if there's no '/' before the ':'
+var scpLikeURLRegex = regexp.MustCompile(`^(?:[^@/]+@)?[^@/:]+:`)
+
+// Choose the provider for a git remote URL, so that remotes work without git-lob-provider:
+// ssh:// & scp-like [user@]host:path URLs and https:// use 'smart' (git-lob-serve), file://
+// URLs & local paths use 'filesystem'. Returns "" for anything else, e.g. plain http://
+func GetProviderNameForURL(urlstr string) string {
+	if urlstr == "" {
+		return ""
+	}
+	if match := urlSchemeRegex.FindStringSubmatch(urlstr); match != nil {
+		switch strings.ToLower(match[1]) {
+		case "ssh", "git+ssh", "ssh+git", "https":
+			return "smart"
+		case "file":
+			return "filesystem"
+		}
+		return ""
+	}
+	if !windowsDrivePathRegex.MatchString(urlstr) && scpLikeURLRegex.MatchString(urlstr) {
+		return "smart"
+	}
+	return "filesystem"
+}
+
+// Get the provider for a given remote of the repository at root whose config is in opts, and
+// validate that it's configured correctly. The provider logs to log
+func GetProviderForRemote(root string, opts *util.Options, log *util.Logger, remoteName string) (SyncProvider, error) {
+	providerName := GetProviderNameForRemote(opts, remoteName)
 	if providerName == "" {
 		return nil, fmt.Errorf("Config parameter 'git-lob-provider' is missing from remote '%v'", remoteName)
 	}
@@ -141,6 +386,10 @@ func GetProviderForRemote(remoteName string) (SyncProvider, error) {
 	if err != nil {
 		return nil, err
 	}
+	provider = provider.ForRepo(root, opts, log)
+	if cachePath := GetCachePathForRemote(opts, remoteName); cachePath != "" {
+		provider = NewCachingSyncProvider(provider, cachePath, log)
+	}
 	err = provider.ValidateConfig(remoteName)
 	if err != nil {
 		return nil, err
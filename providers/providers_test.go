@@ -0,0 +1,91 @@
+package providers
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Providers", func() {
+	root := filepath.Join(os.TempDir(), "ProvidersTest")
+	var oldOptions Options
+	BeforeEach(func() {
+		oldOptions = *GlobalOptions
+		GlobalOptions.GitConfig = make(map[string]string)
+		InitCoreProviders()
+	})
+	AfterEach(func() {
+		*GlobalOptions = oldOptions
+		os.RemoveAll(root)
+	})
+
+	It("Chooses providers from remote URLs", func() {
+		for urlstr, expected := range map[string]string{
+			"ssh://git@example.com/team/repo.git": "smart",
+			"git+ssh://example.com/team/repo.git": "smart",
+			"git@example.com:team/repo.git":       "smart",
+			"example.com:repo.git":                "smart",
+			"https://example.com:8443/team/repo":  "smart",
+			"file:///srv/git/repo.git":            "filesystem",
+			"/srv/git/repo.git":                   "filesystem",
+			"../repo":                             "filesystem",
+			"C:\\git\\repo":                       "filesystem",
+			"./dir:with/colon":                    "filesystem",
+			"http://example.com/team/repo":        "",
+			"git://example.com/team/repo.git":     "",
+			"":                                    "",
+		} {
+			Expect(GetProviderNameForURL(urlstr)).To(Equal(expected), "Provider for %v", urlstr)
+		}
+	})
+
+	It("Uses remote URLs unless configured otherwise", func() {
+		GlobalOptions.GitConfig["remote.origin.url"] = "git@example.com:team/repo.git"
+		Expect(GetProviderNameForRemote(GlobalOptions, "origin")).To(Equal("smart"))
+		GlobalOptions.GitConfig["remote.origin.git-lob-provider"] = "filesystem"
+		Expect(GetProviderNameForRemote(GlobalOptions, "origin")).To(Equal("filesystem"), "Setting should win")
+		Expect(GetProviderNameForRemote(GlobalOptions, "nosuchremote")).To(Equal(""))
+	})
+
+	It("Stores binaries in local remote repos", func() {
+		bare := filepath.Join(root, "bare.git")
+		nonbare := filepath.Join(root, "nonbare")
+		os.MkdirAll(bare, 0755)
+		os.MkdirAll(filepath.Join(nonbare, ".git"), 0755)
+		GlobalOptions.GitConfig["remote.bare.url"] = bare
+		GlobalOptions.GitConfig["remote.nonbare.url"] = "file://" + filepath.ToSlash(nonbare)
+		GlobalOptions.GitConfig["remote.missing.url"] = filepath.Join(root, "missing")
+		GlobalOptions.GitConfig["remote.ssh.url"] = "git@example.com:team/repo.git"
+
+		path, fromURL := GetFilesystemPathForRemote(root, GlobalOptions, "bare")
+		Expect(path).To(Equal(filepath.Join(bare, "git-lob", "content")))
+		Expect(fromURL).To(BeTrue())
+		provider, err := GetProviderForRemote(root, GlobalOptions, DefaultLogger, "bare")
+		Expect(err).To(BeNil())
+		Expect(provider.TypeID()).To(Equal("filesystem"))
+		Expect(DirExists(path)).To(BeTrue(), "Should create the store in the remote repo")
+
+		path, _ = GetFilesystemPathForRemote(root, GlobalOptions, "nonbare")
+		Expect(path).To(Equal(filepath.Join(nonbare, ".git", "git-lob", "content")))
+		_, err = GetProviderForRemote(root, GlobalOptions, DefaultLogger, "nonbare")
+		Expect(err).To(BeNil())
+
+		_, err = GetProviderForRemote(root, GlobalOptions, DefaultLogger, "missing")
+		Expect(err).ToNot(BeNil(), "Should not create a store where there's no repo")
+		Expect(DirExists(filepath.Join(root, "missing"))).To(BeFalse())
+
+		GlobalOptions.GitConfig["remote.relative.url"] = "bare.git"
+		path, _ = GetFilesystemPathForRemote(root, GlobalOptions, "relative")
+		Expect(path).To(Equal(filepath.Join(bare, "git-lob", "content")), "Relative paths should be from the root of the repo")
+
+		path, _ = GetFilesystemPathForRemote(root, GlobalOptions, "ssh")
+		Expect(path).To(Equal(""))
+		GlobalOptions.GitConfig["remote.bare.git-lob-path"] = "/elsewhere"
+		path, fromURL = GetFilesystemPathForRemote(root, GlobalOptions, "bare")
+		Expect(path).To(Equal("/elsewhere"))
+		Expect(fromURL).To(BeFalse())
+	})
+})
@@ -0,0 +1,63 @@
+package providers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Write-once retention for providers which store files directly (filesystem, s3)
+// Setting remote.<name>.git-lob-retention-days means files on the remote can't be replaced with
+// different content or deleted until that many days after they were uploaded. The time each
+// file was uploaded is its modification time on the remote, so nothing else is recorded.
+// This is enforced by git-lob, so it only protects against mistakes; for a store which must be
+// able to show nothing was modified, use git-lob-serve's retention-days or the storage's own
+// locking (e.g. S3 Object Lock) as well.
+
+// Get the write-once retention period configured for a remote in days, 0 if none
+func GetRetentionDaysForRemote(opts *util.Options, log *util.Logger, remoteName string) int {
+	setting := opts.GitConfig[fmt.Sprintf("remote.%v.git-lob-retention-days", remoteName)]
+	if setting == "" {
+		return 0
+	}
+	days, err := strconv.Atoi(strings.TrimSpace(setting))
+	if err != nil || days < 0 {
+		log.Errorf("Invalid remote.%v.git-lob-retention-days '%v', ignoring\n", remoteName, setting)
+		return 0
+	}
+	return days
+}
+
+// A file on the remote can't be replaced or deleted because it's under a retention hold
+type RetentionHoldError struct {
+	Filename string
+	// The hold ends at this time
+	Until time.Time
+}
+
+func (self *RetentionHoldError) Error() string {
+	return fmt.Sprintf("%v is under a retention hold until %v and cannot be modified or deleted",
+		self.Filename, self.Until.Format("2006-01-02"))
+}
+
+func IsRetentionHoldError(err error) bool {
+	_, ok := err.(*RetentionHoldError)
+	return ok
+}
+
+// Check whether a file on a remote which was uploaded at modtime is under a retention hold,
+// returning a RetentionHoldError if so
+func checkRetentionHold(opts *util.Options, log *util.Logger, remoteName, filename string, modtime time.Time) error {
+	days := GetRetentionDaysForRemote(opts, log, remoteName)
+	if days <= 0 {
+		return nil
+	}
+	until := modtime.AddDate(0, 0, days)
+	if until.After(time.Now()) {
+		return &RetentionHoldError{filename, until}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package providers
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/goamz/s3"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Shared retry behaviour for providers
+// Transferring lots of large files over a network means transient failures (timeouts,
+// dropped connections, overloaded servers) are likely at some point, and a single one
+// shouldn't mean having to run the whole push or fetch again. Providers transfer files
+// one at a time via RetryFile, which retries failures they identify as transient
+// with exponential backoff (git-lob.retry-attempts, git-lob.retry-backoff).
+
+// Longest we'll ever wait between retries, however many there are
+var RetryMaxBackoff = time.Minute
+
+// Used to wait between retries; replaceable so that tests don't have to wait
+var retrySleep = util.CancellableSleep
+
+// Error which a provider knows is transient, so the operation should be retried
+type RetriableError struct {
+	Err error
+}
+
+func (e *RetriableError) Error() string {
+	return e.Err.Error()
+}
+
+// Wrap an error to indicate that the operation which caused it should be retried
+func NewRetriableError(err error) error {
+	return &RetriableError{err}
+}
+
+// Determine whether an error is likely to be transient, such that retrying the
+// operation which caused it may succeed
+func IsRetriableError(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *RetriableError:
+		return true
+	case *os.PathError:
+		// Errors relating to local files are never transient, but network errors
+		// are sometimes wrapped in these
+		return isRetriableErrno(e.Err)
+	case *os.SyscallError:
+		return isRetriableErrno(e.Err)
+	case syscall.Errno:
+		return isRetriableErrno(e) || e.Timeout()
+	case *net.OpError:
+		// Network operation failed (connection refused, reset etc)
+		return true
+	case net.Error:
+		return e.Timeout() || e.Temporary()
+	case *s3.Error:
+		// Server errors & throttling are worth retrying, client errors (e.g. permissions) aren't
+		return e.StatusCode >= 500 || e.StatusCode == 429 ||
+			e.Code == "RequestTimeout" || e.Code == "SlowDown"
+	}
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, io.ErrClosedPipe:
+		// Connection closed before we were done with it
+		return true
+	}
+	if isRetriableErrno(err) {
+		return true
+	}
+	// Providers add context to the errors they return
+	if inner := errors.Unwrap(err); inner != nil {
+		return IsRetriableError(inner)
+	}
+	return false
+}
+
+// Whether a low-level error is a network error which may be transient
+func isRetriableErrno(err error) bool {
+	switch err {
+	case syscall.EPIPE, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.ETIMEDOUT:
+		return true
+	}
+	return false
+}
+
+// Get the delay before a given retry (1-based), doubling each time up to RetryMaxBackoff
+// git-lob.retry-backoff in opts is the first delay
+func GetRetryBackoff(opts *util.Options, retry int) time.Duration {
+	backoff := opts.RetryBackoff
+	for i := 1; i < retry && backoff < RetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > RetryMaxBackoff {
+		backoff = RetryMaxBackoff
+	}
+	return backoff
+}
+
+// Transfer a single file, retrying it if it fails for a transient reason
+// transfer should attempt the whole transfer of the file each time it is called, and
+// return retry = true if it failed in a way which may succeed if tried again (it
+// should not call the callback with ProgressError in that case). Before each retry
+// the callback is called with ProgressRetry, the number of this retry & the maximum
+// number of retries (git-lob.retry-attempts)
+// Returns the errors from the last attempt only, & whether to abort
+func RetryFile(opts *util.Options, log *util.Logger, filename string, callback SyncProgressCallback,
+	transfer func() (errorList []string, abort, retry bool)) (errorList []string, abort bool) {
+
+	maxRetries := opts.RetryAttempts
+	for retries := 0; ; {
+		var retry bool
+		errorList, abort, retry = transfer()
+		if abort || !retry || retries >= maxRetries {
+			return errorList, abort
+		}
+		if util.IsCancelled() {
+			return errorList, true
+		}
+		retries++
+		log.Debugf("Retrying %v after error (retry %d of %d): %v\n", filename, retries, maxRetries, errorList)
+		if callback != nil {
+			if callback(filename, util.ProgressRetry, int64(retries), int64(maxRetries)) {
+				return errorList, true
+			}
+		}
+		retrySleep(GetRetryBackoff(opts, retries))
+		if util.IsCancelled() {
+			return errorList, true
+		}
+	}
+}
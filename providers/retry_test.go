@@ -0,0 +1,145 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/goamz/s3"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Retry", func() {
+	var oldSleep func(time.Duration)
+	var oldAttempts int
+	var oldBackoff time.Duration
+	var sleeps []time.Duration
+	BeforeEach(func() {
+		oldSleep, oldAttempts, oldBackoff = retrySleep, GlobalOptions.RetryAttempts, GlobalOptions.RetryBackoff
+		sleeps = nil
+		retrySleep = func(d time.Duration) {
+			sleeps = append(sleeps, d)
+		}
+		GlobalOptions.RetryAttempts = 3
+		GlobalOptions.RetryBackoff = time.Second
+	})
+	AfterEach(func() {
+		retrySleep, GlobalOptions.RetryAttempts, GlobalOptions.RetryBackoff = oldSleep, oldAttempts, oldBackoff
+	})
+
+	It("Identifies transient errors", func() {
+		for _, err := range []error{
+			NewRetriableError(errors.New("dropped")),
+			io.EOF,
+			io.ErrUnexpectedEOF,
+			syscall.ECONNRESET,
+			&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET},
+			&os.PathError{Op: "write", Path: "/mnt/remote/file", Err: syscall.ETIMEDOUT},
+			&s3.Error{StatusCode: 503, Code: "ServiceUnavailable"},
+			&s3.Error{StatusCode: 400, Code: "RequestTimeout"},
+			fmt.Errorf("Error while uploading: %w", io.ErrUnexpectedEOF),
+		} {
+			Expect(IsRetriableError(err)).To(BeTrue(), "%#v should be retriable", err)
+		}
+		for _, err := range []error{
+			nil,
+			errors.New("some other problem"),
+			&os.PathError{Op: "open", Path: "/local/file", Err: syscall.ENOENT},
+			&s3.Error{StatusCode: 403, Code: "AccessDenied"},
+		} {
+			Expect(IsRetriableError(err)).To(BeFalse(), "%#v should not be retriable", err)
+		}
+	})
+
+	It("Backs off exponentially", func() {
+		Expect(GetRetryBackoff(GlobalOptions, 1)).To(Equal(time.Second))
+		Expect(GetRetryBackoff(GlobalOptions, 2)).To(Equal(2 * time.Second))
+		Expect(GetRetryBackoff(GlobalOptions, 3)).To(Equal(4 * time.Second))
+		Expect(GetRetryBackoff(GlobalOptions, 100)).To(Equal(RetryMaxBackoff), "Should not wait longer than maximum")
+	})
+
+	It("Retries transient failures", func() {
+		var retries []int64
+		callback := func(fileInProgress string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+			Expect(progressType).To(Equal(ProgressRetry))
+			Expect(fileInProgress).To(Equal("file"))
+			Expect(totalBytes).To(BeEquivalentTo(3), "Should report maximum retries")
+			retries = append(retries, bytesDone)
+			return false
+		}
+		var attempts int
+		errs, abort := RetryFile(GlobalOptions, DefaultLogger, "file", callback, func() ([]string, bool, bool) {
+			attempts++
+			if attempts < 3 {
+				return []string{"dropped"}, false, true
+			}
+			return nil, false, false
+		})
+		Expect(errs).To(BeEmpty(), "Should succeed after retrying")
+		Expect(abort).To(BeFalse())
+		Expect(attempts).To(Equal(3))
+		Expect(retries).To(Equal([]int64{1, 2}), "Should report each retry")
+		Expect(sleeps).To(Equal([]time.Duration{time.Second, 2 * time.Second}), "Should back off between retries")
+
+		// Gives up after configured attempts, with errors from the last attempt
+		attempts = 0
+		retries = nil
+		errs, abort = RetryFile(GlobalOptions, DefaultLogger, "file", callback, func() ([]string, bool, bool) {
+			attempts++
+			return []string{"dropped again"}, false, true
+		})
+		Expect(errs).To(Equal([]string{"dropped again"}))
+		Expect(abort).To(BeFalse())
+		Expect(attempts).To(Equal(4), "Should try once & retry 3 times")
+
+		// Doesn't retry errors which aren't transient, or if disabled
+		attempts = 0
+		errs, _ = RetryFile(GlobalOptions, DefaultLogger, "file", callback, func() ([]string, bool, bool) {
+			attempts++
+			return []string{"permission denied"}, false, false
+		})
+		Expect(errs).To(HaveLen(1))
+		Expect(attempts).To(Equal(1), "Should not retry permanent errors")
+		GlobalOptions.RetryAttempts = 0
+		attempts = 0
+		RetryFile(GlobalOptions, DefaultLogger, "file", callback, func() ([]string, bool, bool) {
+			attempts++
+			return []string{"dropped"}, false, true
+		})
+		Expect(attempts).To(Equal(1), "Should not retry when disabled")
+	})
+
+	It("Allows aborting between retries", func() {
+		var attempts int
+		_, abort := RetryFile(GlobalOptions, DefaultLogger, "file", func(fileInProgress string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+			return true
+		}, func() ([]string, bool, bool) {
+			attempts++
+			return []string{"dropped"}, false, true
+		})
+		Expect(abort).To(BeTrue(), "Should abort")
+		Expect(attempts).To(Equal(1), "Should not retry after abort")
+		Expect(sleeps).To(BeEmpty())
+	})
+
+	It("Stops retrying when cancelled", func() {
+		defer ResetCancelled()
+		retrySleep = func(d time.Duration) {
+			// Interrupted while waiting
+			Cancel()
+		}
+		var attempts int
+		_, abort := RetryFile(GlobalOptions, DefaultLogger, "file", nil, func() ([]string, bool, bool) {
+			attempts++
+			return []string{"dropped"}, false, true
+		})
+		Expect(abort).To(BeTrue(), "Should abort")
+		Expect(attempts).To(Equal(1), "Should not retry after cancelling")
+	})
+})
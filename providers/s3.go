@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/go-homedir"
 	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/goamz/aws"
@@ -19,6 +21,13 @@ import (
 type S3SyncProvider struct {
 	S3Connection *s3.S3
 	Buckets      []string
+	// The repository this instance is for, see ForRepo
+	opts *util.Options
+	log  *util.Logger
+}
+
+func (*S3SyncProvider) ForRepo(root string, opts *util.Options, log *util.Logger) SyncProvider {
+	return &S3SyncProvider{opts: opts, log: log}
 }
 
 func (*S3SyncProvider) TypeID() string {
@@ -40,6 +49,18 @@ Optional parameters in the remote section:
                         from your ~/.aws/config. If no region is specified, uses US East.
     git-lob-s3-profile  The profile to use to authenticate for this remote. Can also 
                         be set in other ways, see global settings below.
+    git-lob-retention-days  Write-once retention: objects can't be replaced or
+                        deleted until this many days after they were uploaded.
+                        Enable S3 Object Lock on the bucket too, since this is
+                        only enforced by git-lob.
+
+Storage classes:
+  Binaries for paths with the lob-storage attribute in .gitattributes are
+  stored in a cheaper S3 storage class (metadata always uses the default):
+    lob-storage=infrequent  STANDARD_IA
+    lob-storage=cold        GLACIER_IR (Glacier Instant Retrieval)
+  e.g. 'archive/** filter=lob -text lob-storage=cold'. Downloads from these
+  classes cost more, so fetch warns when binaries requested are in cold storage.
 
 Example configuration:
     [remote "origin"]
@@ -70,6 +91,13 @@ Global AWS settings:
 
 const S3BufferSize = 131072
 
+// S3 storage classes used for each storage class hint (lob-storage attribute)
+var s3StorageClasses = map[string]string{
+	StorageClassStandard:   "",
+	StorageClassInfrequent: "STANDARD_IA",
+	StorageClassCold:       "GLACIER_IR",
+}
+
 // Configure the profile to use for a given remote. Preferences in order:
 // Git setting remote.REMOTENAME.git-lob-s3-profile
 // Git setting git-lob.s3-profile
@@ -79,10 +107,10 @@ func (self *S3SyncProvider) configureProfile(remoteName string) {
 	// so s3 library will pick it up
 	// this allows per-repo credential profiles which is useful
 	profilesetting := fmt.Sprintf("remote.%v.git-lob-s3-profile", remoteName)
-	profile := strings.TrimSpace(util.GlobalOptions.GitConfig[profilesetting])
+	profile := strings.TrimSpace(self.opts.GitConfig[profilesetting])
 	if profile == "" {
 		profilesetting = "git-lob.s3-profile"
-		profile = strings.TrimSpace(util.GlobalOptions.GitConfig[profilesetting])
+		profile = strings.TrimSpace(self.opts.GitConfig[profilesetting])
 	}
 	if profile != "" {
 		// If we've retrieved the setting from our git config,
@@ -147,6 +175,9 @@ func (self *S3SyncProvider) initS3() error {
 		return err
 	}
 	self.S3Connection = s3.New(auth, region)
+	// Honour git-lob.proxy & all_proxy as well as the usual https_proxy
+	client := util.NewProxyHTTPClient(self.opts)
+	self.S3Connection.HTTPClient = func() *http.Client { return client }
 
 	// Read bucket list right now since we have no way to probe whether a bucket exists
 	self.S3Connection.ListBuckets()
@@ -170,7 +201,7 @@ func (self *S3SyncProvider) Release() {
 
 func (self *S3SyncProvider) getBucketName(remoteName string) (string, error) {
 	bucketsetting := fmt.Sprintf("remote.%v.git-lob-s3-bucket", remoteName)
-	bucket := strings.TrimSpace(util.GlobalOptions.GitConfig[bucketsetting])
+	bucket := strings.TrimSpace(self.opts.GitConfig[bucketsetting])
 	if bucket == "" {
 		return "", fmt.Errorf("Configuration invalid for 'filesystem', missing setting %v", bucketsetting)
 	}
@@ -198,6 +229,19 @@ func (self *S3SyncProvider) ValidateConfig(remoteName string) error {
 	return nil
 }
 
+// The remote can be reached if we can list (at most one key of) its bucket
+func (self *S3SyncProvider) CheckConnection(remoteName string) error {
+	bucket, err := self.getBucket(remoteName)
+	if err != nil {
+		return err
+	}
+	_, err = bucket.List("", "", "", 1)
+	if err != nil {
+		return fmt.Errorf("Unable to reach remote '%v': %v", remoteName, err.Error())
+	}
+	return nil
+}
+
 func (self *S3SyncProvider) FileExists(remoteName, filename string) bool {
 	bucket, err := self.getBucket(remoteName)
 	if err != nil {
@@ -215,24 +259,26 @@ func (self *S3SyncProvider) FileExistsAndIsOfSize(remoteName, filename string, s
 	return err == nil && key != nil && key.Size == sz
 }
 
-func (*S3SyncProvider) uploadSingleFile(remoteName, filename, fromDir string, destBucket *s3.Bucket,
-	force bool, callback SyncProgressCallback) (errorList []string, abort bool) {
+func (self *S3SyncProvider) uploadSingleFile(remoteName, filename, fromDir string, destBucket *s3.Bucket,
+	force bool, s3StorageClass string, callback SyncProgressCallback) (errorList []string, abort, retry bool) {
 	// Check to see if the file is already there, right size
-	srcfilename := filepath.Join(fromDir, filename)
+	srcfilename := LocalFilePath(fromDir, filename)
 	srcfi, err := os.Stat(srcfilename)
 	if err != nil {
 		if callback != nil {
 			if callback(filename, util.ProgressNotFound, 0, 0) {
-				return errorList, true
+				return errorList, true, false
 			}
 		}
 		msg := fmt.Sprintf("Unable to stat %v: %v", srcfilename, err)
 		errorList = append(errorList, msg)
 		// Keep going with other files
-		return errorList, false
+		return errorList, false, false
 	}
 
-	if !force {
+	// Files under a retention hold are never replaced, even if forced
+	held := GetRetentionDaysForRemote(self.opts, self.log, remoteName) > 0
+	if !force || held {
 		// Check if already there before uploading
 		if key, err := destBucket.GetKey(filename); key != nil && err == nil {
 			// File exists on remote, check the size
@@ -240,12 +286,17 @@ func (*S3SyncProvider) uploadSingleFile(remoteName, filename, fromDir string, de
 				// File already present and correct size, skip
 				if callback != nil {
 					if callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
-						return errorList, true
+						return errorList, true, false
 					}
 				}
-				return errorList, false
+				return errorList, false, false
+			}
+			if held {
+				if holderr := checkRetentionHold(self.opts, self.log, remoteName, filename, getS3KeyModTime(key)); holderr != nil {
+					errorList = append(errorList, holderr.Error())
+					return errorList, false, false
+				}
 			}
-
 		}
 	}
 
@@ -255,38 +306,62 @@ func (*S3SyncProvider) uploadSingleFile(remoteName, filename, fromDir string, de
 	if err != nil {
 		msg := fmt.Sprintf("Unable to read input file for upload %v: %v", srcfilename, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	defer inf.Close()
 
 	// Initial callback
 	if callback != nil {
 		if callback(filename, util.ProgressTransferBytes, 0, srcfi.Size()) {
-			return errorList, true
+			return errorList, true, false
 		}
 	}
 
 	// Create a Reader which reports progress as it is read from
-	progressReader := NewSyncProgressReader(inf, filename, srcfi.Size(), callback)
+	progressReader := NewSyncProgressReader(util.ThrottleUploadReader(self.opts, inf), filename, srcfi.Size(), callback)
 	// Note default ACL
-	err = destBucket.PutReader(filename, progressReader, srcfi.Size(), "binary/octet-stream", "")
+	if s3StorageClass != "" {
+		headers := map[string][]string{
+			"Content-Type":        {"binary/octet-stream"},
+			"x-amz-storage-class": {s3StorageClass},
+		}
+		err = destBucket.PutReaderHeader(filename, progressReader, srcfi.Size(), headers, "")
+	} else {
+		err = destBucket.PutReader(filename, progressReader, srcfi.Size(), "binary/octet-stream", "")
+	}
 	if err != nil {
 		errorList = append(errorList, fmt.Sprintf("Problem while uploading %v to %v: %v", filename, remoteName, err))
+		return errorList, progressReader.Aborted, IsRetriableError(err)
 	}
 
-	return errorList, progressReader.Aborted
+	return errorList, progressReader.Aborted, false
 
 }
 
 func (self *S3SyncProvider) Upload(remoteName string, filenames []string, fromDir string,
 	force bool, callback SyncProgressCallback) error {
+	return self.upload(remoteName, filenames, fromDir, force, "", callback)
+}
+
+func (self *S3SyncProvider) UploadWithStorageClass(remoteName string, filenames []string, fromDir string, force bool,
+	storageClass string, callback SyncProgressCallback) error {
+	s3StorageClass, ok := s3StorageClasses[storageClass]
+	if !ok {
+		return fmt.Errorf("Unknown storage class '%v'", storageClass)
+	}
+	return self.upload(remoteName, filenames, fromDir, force, s3StorageClass, callback)
+}
+
+// Upload files in an S3 storage class, or the bucket's default if ""
+func (self *S3SyncProvider) upload(remoteName string, filenames []string, fromDir string, force bool,
+	s3StorageClass string, callback SyncProgressCallback) error {
 
 	bucket, err := self.getBucket(remoteName)
 	if err != nil {
 		return err
 	}
 
-	util.LogDebug("Uploading to S3 bucket", bucket.Name)
+	self.log.Debug("Uploading to S3 bucket", bucket.Name)
 
 	// Check bucket exists (via HEAD endpoint)
 	// This saves us failing on every file
@@ -298,7 +373,9 @@ func (self *S3SyncProvider) Upload(remoteName string, filenames []string, fromDi
 	var errorList []string
 	for _, filename := range filenames {
 		// Allow aborting
-		newerrs, abort := self.uploadSingleFile(remoteName, filename, fromDir, bucket, force, callback)
+		newerrs, abort := RetryFile(self.opts, self.log, filename, callback, func() ([]string, bool, bool) {
+			return self.uploadSingleFile(remoteName, filename, fromDir, bucket, force, s3StorageClass, callback)
+		})
 		errorList = append(errorList, newerrs...)
 		if abort {
 			break
@@ -312,16 +389,22 @@ func (self *S3SyncProvider) Upload(remoteName string, filenames []string, fromDi
 	return nil
 }
 
-func (*S3SyncProvider) downloadSingleFile(remoteName, filename string, bucket *s3.Bucket, toDir string,
-	force bool, callback SyncProgressCallback) (errorList []string, abort bool) {
+func (self *S3SyncProvider) downloadSingleFile(remoteName, filename string, bucket *s3.Bucket, toDir string,
+	force bool, callback SyncProgressCallback) (errorList []string, abort, retry bool) {
 
 	// Query for existence & size first; we need the size either way to report d/l progress
 	key, err := bucket.GetKey(filename)
+	if err != nil && IsRetriableError(err) {
+		// Couldn't tell whether it's there, rather than it being missing
+		msg := fmt.Sprintf("Unable to query file %v in S3 bucket %v for download: %v", filename, bucket.Name, err)
+		errorList = append(errorList, msg)
+		return errorList, false, true
+	}
 	if err != nil {
 		// File missing on remote
 		if callback != nil {
 			if callback(filename, util.ProgressNotFound, 0, 0) {
-				return errorList, true
+				return errorList, true, false
 			}
 		}
 		// Note how we don't add an error to the returned error list
@@ -329,11 +412,11 @@ func (*S3SyncProvider) downloadSingleFile(remoteName, filename string, bucket *s
 		// as a skipped item otherwise, since caller can only request files & not know
 		// if they're on the remote or not
 		// Keep going with other files
-		return errorList, false
+		return errorList, false, false
 	}
 
 	// Check to see if the file is already there, right size
-	destfilename := filepath.Join(toDir, filename)
+	destfilename := LocalFilePath(toDir, filename)
 	if !force {
 		if destfi, err := os.Stat(destfilename); err == nil {
 			// File exists locally, check the size
@@ -341,10 +424,10 @@ func (*S3SyncProvider) downloadSingleFile(remoteName, filename string, bucket *s
 				// File already present and correct size, skip
 				if callback != nil {
 					if callback(filename, util.ProgressSkip, destfi.Size(), destfi.Size()) {
-						return errorList, true
+						return errorList, true, false
 					}
 				}
-				return errorList, false
+				return errorList, false, false
 			}
 		}
 	}
@@ -355,7 +438,7 @@ func (*S3SyncProvider) downloadSingleFile(remoteName, filename string, bucket *s
 	if err != nil {
 		msg := fmt.Sprintf("Unable to create dir %v: %v", parentDir, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	// Create a temporary file to download, avoid issues with interruptions
 	// Note this isn't a valid thing to do in security conscious cases but this isn't one
@@ -364,7 +447,7 @@ func (*S3SyncProvider) downloadSingleFile(remoteName, filename string, bucket *s
 	if err != nil {
 		msg := fmt.Sprintf("Unable to create temp file for download in %v: %v", parentDir, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	tmpfilename := outf.Name()
 	// This is safe to do even though we manually close & rename because both calls are no-ops if we succeed
@@ -377,24 +460,25 @@ func (*S3SyncProvider) downloadSingleFile(remoteName, filename string, bucket *s
 	if err != nil {
 		msg := fmt.Sprintf("Unable to read file %v from S3 bucket %v for download: %v", filename, bucket.Name, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, IsRetriableError(err)
 	}
 	defer inf.Close()
+	in := util.ThrottleDownloadReader(self.opts, inf)
 
 	// Initial callback
 	if callback != nil {
 		if callback(filename, util.ProgressTransferBytes, 0, key.Size) {
-			return errorList, true
+			return errorList, true, false
 		}
 	}
 	var copysize int64 = 0
 	for {
 		var n int64
-		n, err = io.CopyN(outf, inf, S3BufferSize)
+		n, err = io.CopyN(outf, in, S3BufferSize)
 		copysize += n
 		if n > 0 && callback != nil && key.Size > 0 {
 			if callback(filename, util.ProgressTransferBytes, copysize, key.Size) {
-				return errorList, true
+				return errorList, true, false
 			}
 		}
 		if err != nil {
@@ -413,13 +497,13 @@ func (*S3SyncProvider) downloadSingleFile(remoteName, filename string, bucket *s
 				bucket.Name, filename, copysize, key.Size)
 		}
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, IsRetriableError(err)
 	}
 	// Otherwise, file data is ok on remote
 	// Move to correct location - remove before to deal with force or bad size cases
 	os.Remove(destfilename)
 	os.Rename(tmpfilename, destfilename)
-	return errorList, false
+	return errorList, false, false
 
 }
 
@@ -430,7 +514,7 @@ func (self *S3SyncProvider) Download(remoteName string, filenames []string, toDi
 		return err
 	}
 
-	util.LogDebug("Downloading from S3 bucket", bucket.Name)
+	self.log.Debug("Downloading from S3 bucket", bucket.Name)
 
 	// Check bucket exists (via HEAD endpoint)
 	// This saves us failing on every file
@@ -442,7 +526,9 @@ func (self *S3SyncProvider) Download(remoteName string, filenames []string, toDi
 	var errorList []string
 	for _, filename := range filenames {
 		// Allow aborting
-		newerrs, abort := self.downloadSingleFile(remoteName, filename, bucket, toDir, force, callback)
+		newerrs, abort := RetryFile(self.opts, self.log, filename, callback, func() ([]string, bool, bool) {
+			return self.downloadSingleFile(remoteName, filename, bucket, toDir, force, callback)
+		})
 		errorList = append(errorList, newerrs...)
 		if abort {
 			break
@@ -455,3 +541,83 @@ func (self *S3SyncProvider) Download(remoteName string, filenames []string, toDi
 
 	return nil
 }
+
+func (self *S3SyncProvider) Delete(remoteName string, filenames []string) error {
+	bucket, err := self.getBucket(remoteName)
+	if err != nil {
+		return err
+	}
+	checkHold := GetRetentionDaysForRemote(self.opts, self.log, remoteName) > 0
+	var errorList []string
+	for _, filename := range filenames {
+		if checkHold {
+			if key, err := bucket.GetKey(filename); err == nil && key != nil {
+				if holderr := checkRetentionHold(self.opts, self.log, remoteName, filename, getS3KeyModTime(key)); holderr != nil {
+					errorList = append(errorList, holderr.Error())
+					continue
+				}
+			}
+		}
+		// S3 doesn't complain about keys which don't exist
+		err = bucket.Del(filename)
+		if err != nil {
+			errorList = append(errorList, fmt.Sprintf("Unable to delete %v from S3 bucket '%v': %v", filename, bucket.Name, err.Error()))
+		}
+	}
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+	return nil
+}
+
+// Get when an S3 object was uploaded; if S3 didn't say, it's assumed to be now so that
+// retention holds err on the side of keeping it
+func getS3KeyModTime(key *s3.Key) time.Time {
+	// HTTP date from GetKey, ISO 8601 from List
+	if modtime, err := http.ParseTime(key.LastModified); err == nil {
+		return modtime
+	}
+	if modtime, err := time.Parse(time.RFC3339, key.LastModified); err == nil {
+		return modtime
+	}
+	return time.Now()
+}
+
+func (self *S3SyncProvider) List(remoteName string, callback func(file *RemoteFile) (quit bool)) error {
+	bucket, err := self.getBucket(remoteName)
+	if err != nil {
+		return err
+	}
+	// Listed a page at a time
+	marker := ""
+	for {
+		resp, err := bucket.List("", "", marker, 1000)
+		if err != nil {
+			return fmt.Errorf("Unable to list S3 bucket '%v' for remote '%v': %v", bucket.Name, remoteName, err.Error())
+		}
+		for _, key := range resp.Contents {
+			if callback(&RemoteFile{Filename: key.Key, Size: key.Size}) {
+				return nil
+			}
+			marker = key.Key
+		}
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return nil
+		}
+	}
+}
+
+func (self *S3SyncProvider) IsInColdStorage(remoteName, filename string) (bool, error) {
+	bucket, err := self.getBucket(remoteName)
+	if err != nil {
+		return false, err
+	}
+	// Only reported by HEAD for classes other than STANDARD
+	resp, err := bucket.Head(filename)
+	if err != nil {
+		return false, fmt.Errorf("Unable to query %v in S3 bucket '%v': %v", filename, bucket.Name, err.Error())
+	}
+	resp.Body.Close()
+	class := resp.Header.Get("x-amz-storage-class")
+	return strings.HasPrefix(class, "GLACIER") || class == "DEEP_ARCHIVE", nil
+}
@@ -30,7 +30,7 @@ var _ = Describe("S3", func() {
 			// Hack the git config to mock destination
 			GlobalOptions.GitConfig["remote.origin.git-lob-s3-bucket"] = "thebucket"
 			// Manually configure provider to use test server
-			s3sync = &S3SyncProvider{}
+			s3sync = &S3SyncProvider{opts: GlobalOptions, log: DefaultLogger}
 			s3sync.S3Connection = s3.New(auth, aws.Region{Name: "test-region-1", S3Endpoint: testServer.URL})
 		})
 		AfterEach(func() {
@@ -227,7 +227,7 @@ var _ = Describe("S3", func() {
 
 	/*
 		It("Simple S3 smoke tests", func() {
-			sync := S3SyncProvider{}
+			sync := S3SyncProvider{opts: GlobalOptions, log: DefaultLogger}
 			sync.initS3()
 			bucket := sync.S3Connection.Bucket("git-lob.test")
 			key, err := bucket.GetKey("test.txt")
@@ -0,0 +1,626 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// SftpSyncProvider stores files in a folder on any server which allows SFTP, over an SSH
+// connection; unlike 'smart' it doesn't need git-lob-serve installed on the server
+// One connection is kept open & reused for a remote until Release
+type SftpSyncProvider struct {
+	// The remote we're connected to
+	remoteName string
+	// The connection to it
+	client *sftpClient
+	// Path of the binary store on the server
+	root string
+	// Remote folders known to exist, so they aren't checked again for every file
+	dirsExist map[string]bool
+	// The repository this instance is for, see ForRepo
+	opts *util.Options
+	log  *util.Logger
+}
+
+func (*SftpSyncProvider) ForRepo(root string, opts *util.Options, log *util.Logger) SyncProvider {
+	return &SftpSyncProvider{opts: opts, log: log}
+}
+
+// Location of a binary store on an SFTP server
+type sftpLocation struct {
+	Host string
+	Port string
+	// Path of the store; relative paths are relative to the user's home folder
+	Path string
+}
+
+func (*SftpSyncProvider) TypeID() string {
+	return "sftp"
+}
+
+func (*SftpSyncProvider) HelpTextSummary() string {
+	return `sftp: transfers binaries to a folder on any server over SFTP`
+}
+
+func (*SftpSyncProvider) HelpTextDetail() string {
+	return `The "sftp" provider stores binaries in a folder on any server you can reach with
+SFTP over SSH, so unlike the "smart" provider nothing needs to be installed on
+the server. Binaries are transferred whole, there are no deltas.
+
+ssh is used to connect (or GIT_SSH, e.g. plink), exactly as for the "smart"
+provider, so your usual SSH keys, agent & config apply, as does git-lob.proxy.
+
+Required parameters in remote section of .gitconfig:
+    git-lob-url    sftp://[user@]host[:port]/path or [user@]host:path
+                   Like git's SSH URLs, the path is relative to your home
+                   folder on the server; use sftp://host//path or host:/path
+                   for an absolute path. The folder must already exist.
+
+Example configuration:
+    [remote "origin"]
+        url = git@blah.com/your/usual/git/repo
+        git-lob-provider = sftp
+        git-lob-url = me@files.example.com:binaries/myrepo
+
+Files are uploaded to a temporary file next to their final location, then
+renamed into place, so other users never see partial files. The rename is
+atomic if the server supports the OpenSSH posix-rename extension. Interrupted
+uploads leave files called 'tempupload*' in the store, which can safely be
+deleted if older than 24h. Interrupted downloads are kept locally as
+'tempdownload-*' & resumed from where they left off next time.
+`
+}
+
+// Get the location of the store for a remote from git-lob-url
+func (self *SftpSyncProvider) getLocation(remoteName string) (*sftpLocation, error) {
+	urlsetting := fmt.Sprintf("remote.%v.git-lob-url", remoteName)
+	urlstr := strings.TrimSpace(self.opts.GitConfig[urlsetting])
+	if urlstr == "" {
+		return nil, fmt.Errorf("Configuration invalid for 'sftp', missing setting %v", urlsetting)
+	}
+	return parseSftpURL(urlstr)
+}
+
+// Parse sftp://[user@]host[:port]/path or [user@]host:path; in the former the first / just
+// separates the path from the host, as with git's ssh:// URLs
+func parseSftpURL(urlstr string) (*sftpLocation, error) {
+	if strings.HasPrefix(strings.ToLower(urlstr), "sftp://") {
+		u, err := url.Parse(urlstr)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("Invalid sftp URL %v", urlstr)
+		}
+		loc := &sftpLocation{Host: u.Hostname(), Port: u.Port(), Path: strings.TrimPrefix(u.Path, "/")}
+		if u.User != nil {
+			loc.Host = u.User.Username() + "@" + loc.Host
+		}
+		return loc, nil
+	}
+	if urlSchemeRegex.MatchString(urlstr) || !scpLikeURLRegex.MatchString(urlstr) {
+		return nil, fmt.Errorf("Invalid sftp URL %v, must be sftp://[user@]host[:port]/path or [user@]host:path", urlstr)
+	}
+	i := strings.Index(urlstr, ":")
+	return &sftpLocation{Host: urlstr[:i], Path: urlstr[i+1:]}, nil
+}
+
+func (self *SftpSyncProvider) ValidateConfig(remoteName string) error {
+	_, err := self.getLocation(remoteName)
+	return err
+}
+
+func (self *SftpSyncProvider) Release() {
+	if self.client != nil {
+		self.client.Close()
+		self.client = nil
+	}
+	self.remoteName = ""
+	self.dirsExist = nil
+}
+
+// Connection to an SFTP server through a command, e.g. ssh
+type sftpCommandConnection struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (c *sftpCommandConnection) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+func (c *sftpCommandConnection) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+func (c *sftpCommandConnection) Close() error {
+	// Closing stdin ends the session
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+// Connect to the SFTP server at a location, with the SSH settings in opts; replaceable so tests
+// can use a server in-process
+var sftpConnect = func(opts *util.Options, log *util.Logger, loc *sftpLocation) (io.ReadWriteCloser, error) {
+	cmd, err := util.GetSSHCommand(opts, log, loc.Host, loc.Port, true, "sftp")
+	if err != nil {
+		return nil, err
+	}
+	// ssh's own messages & prompts go straight to the user
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to ssh stdout: %v", err.Error())
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to ssh stdin: %v", err.Error())
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start ssh command: %v", err.Error())
+	}
+	return &sftpCommandConnection{cmd, stdin, stdout}, nil
+}
+
+// Make sure we're connected to a remote, reusing the connection if we already are
+func (self *SftpSyncProvider) connect(remoteName string) error {
+	if remoteName == self.remoteName && self.client != nil {
+		return nil
+	}
+	self.Release()
+	loc, err := self.getLocation(remoteName)
+	if err != nil {
+		return err
+	}
+	self.log.Debugf("Connecting to %v over SFTP...\n", loc.Host)
+	conn, err := sftpConnect(self.opts, self.log, loc)
+	if err != nil {
+		return err
+	}
+	client, err := newSftpClient(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Unable to connect to remote '%v': %v", remoteName, err.Error())
+	}
+	self.client = client
+	self.remoteName = remoteName
+	self.root = loc.Path
+	if self.root == "" {
+		self.root = "."
+	}
+	self.dirsExist = make(map[string]bool)
+	return nil
+}
+
+// Drop the connection after it failed, so that the next operation reconnects
+func (self *SftpSyncProvider) resetConnection() {
+	self.Release()
+}
+
+// Get the path on the server of a file relative to the root of the store
+func (self *SftpSyncProvider) remotePath(filename string) string {
+	return path.Join(self.root, filepath.ToSlash(filename))
+}
+
+// The remote can be reached if we can connect & the store's folder exists
+func (self *SftpSyncProvider) CheckConnection(remoteName string) error {
+	err := self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+	attrs, err := self.client.Stat(self.root)
+	if err != nil {
+		if isSftpConnectionError(err) {
+			self.resetConnection()
+		}
+		return fmt.Errorf("Unable to reach remote '%v': %v", remoteName, err.Error())
+	}
+	if !attrs.IsDir() {
+		return fmt.Errorf("Unable to reach remote '%v': %v is not a folder", remoteName, self.root)
+	}
+	return nil
+}
+
+func (self *SftpSyncProvider) uploadSingleFile(remoteName, filename, fromDir string,
+	force bool, callback SyncProgressCallback) (errorList []string, abort, retry bool) {
+	// Check to see if the file is already there, right size
+	srcfilename := LocalFilePath(fromDir, filename)
+	srcfi, err := os.Stat(srcfilename)
+	if err != nil {
+		if callback != nil {
+			if callback(filename, util.ProgressNotFound, 0, 0) {
+				return errorList, true, false
+			}
+		}
+		msg := fmt.Sprintf("Unable to stat %v: %v", srcfilename, err)
+		errorList = append(errorList, msg)
+		// Keep going with other files
+		return errorList, false, false
+	}
+
+	// On failure, retry on a new connection if this one has failed
+	failed := func(err error) ([]string, bool, bool) {
+		errorList = append(errorList, fmt.Sprintf("Problem while uploading %v to %v: %v", srcfilename, remoteName, err))
+		if isSftpConnectionError(err) {
+			self.resetConnection()
+			return errorList, false, true
+		}
+		return errorList, false, false
+	}
+	err = self.connect(remoteName)
+	if err != nil {
+		return failed(err)
+	}
+
+	destfilename := self.remotePath(filename)
+	if !force {
+		// Check existence & size before uploading
+		if attrs, err := self.client.Stat(destfilename); err == nil {
+			if attrs.Size == srcfi.Size() {
+				// File already present and correct size, skip
+				if callback != nil {
+					if callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
+						return errorList, true, false
+					}
+				}
+				return errorList, false, false
+			}
+		} else if !isSftpNotExist(err) {
+			return failed(err)
+		}
+	}
+
+	parentDir := path.Dir(destfilename)
+	err = self.client.MkdirAll(parentDir, self.dirsExist)
+	if err != nil {
+		return failed(err)
+	}
+	inf, err := os.OpenFile(srcfilename, os.O_RDONLY, 0644)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to read input file for upload %v: %v", srcfilename, err)
+		errorList = append(errorList, msg)
+		return errorList, false, false
+	}
+	defer inf.Close()
+
+	// Upload to a temporary file & rename it into place, so nobody sees a partial file
+	tmpfilename := path.Join(parentDir, fmt.Sprintf("tempupload%d-%d", os.Getpid(), time.Now().UnixNano()))
+	handle, err := self.client.Open(tmpfilename, sftpOpenWrite|sftpOpenCreate|sftpOpenTrunc|sftpOpenExcl)
+	if err != nil {
+		return failed(err)
+	}
+
+	// Initial callback
+	if callback != nil {
+		if callback(filename, util.ProgressTransferBytes, 0, srcfi.Size()) {
+			self.client.CloseHandle(handle)
+			self.client.Remove(tmpfilename)
+			return errorList, true, false
+		}
+	}
+	var aborted bool
+	progress := func(done int64) bool {
+		if callback != nil && srcfi.Size() > 0 {
+			aborted = callback(filename, util.ProgressTransferBytes, done, srcfi.Size())
+		}
+		return aborted
+	}
+	copysize, err := self.client.WriteFrom(handle, 0, util.ThrottleUploadReader(self.opts, inf), progress)
+	closeerr := self.client.CloseHandle(handle)
+	if err == nil {
+		err = closeerr
+	}
+	if err == nil && copysize != srcfi.Size() {
+		err = fmt.Errorf("number of bytes written does not agree (%d/%d)", copysize, srcfi.Size())
+	}
+	if err == nil {
+		// Move to correct location, replacing any existing file (force or bad size cases)
+		err = self.client.Rename(tmpfilename, destfilename)
+	}
+	if err != nil {
+		if aborted || !isSftpConnectionError(err) {
+			self.client.Remove(tmpfilename)
+		}
+		if aborted {
+			return errorList, true, false
+		}
+		return failed(err)
+	}
+	return errorList, false, false
+}
+
+func (self *SftpSyncProvider) Upload(remoteName string, filenames []string, fromDir string,
+	force bool, callback SyncProgressCallback) error {
+
+	err := self.CheckConnection(remoteName)
+	if err != nil {
+		return err
+	}
+
+	var errorList []string
+	for _, filename := range filenames {
+		// Allow aborting
+		newerrs, abort := RetryFile(self.opts, self.log, filename, callback, func() ([]string, bool, bool) {
+			return self.uploadSingleFile(remoteName, filename, fromDir, force, callback)
+		})
+		errorList = append(errorList, newerrs...)
+		if abort {
+			break
+		}
+	}
+
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+
+	return nil
+}
+
+func (self *SftpSyncProvider) downloadSingleFile(remoteName, filename, toDir string,
+	force bool, callback SyncProgressCallback) (errorList []string, abort, retry bool) {
+
+	failed := func(err error) ([]string, bool, bool) {
+		errorList = append(errorList, fmt.Sprintf("Problem while downloading %v from %v: %v", filename, remoteName, err))
+		if isSftpConnectionError(err) {
+			self.resetConnection()
+			return errorList, false, true
+		}
+		return errorList, false, false
+	}
+	err := self.connect(remoteName)
+	if err != nil {
+		return failed(err)
+	}
+
+	srcfilename := self.remotePath(filename)
+	attrs, err := self.client.Stat(srcfilename)
+	if err != nil {
+		if !isSftpNotExist(err) {
+			return failed(err)
+		}
+		if callback != nil {
+			if callback(filename, util.ProgressNotFound, 0, 0) {
+				return errorList, true, false
+			}
+		}
+		// Note how we don't add an error to the returned error list
+		// As per provider docs, we simply tell callback it happened & treat it
+		// as a skipped item otherwise, since caller can only request files & not know
+		// if they're on the remote or not
+		// Keep going with other files
+		return errorList, false, false
+	}
+	sz := attrs.Size
+
+	destfilename := LocalFilePath(toDir, filename)
+	if !force {
+		// Check existence & size before downloading
+		if destfi, err := os.Stat(destfilename); err == nil {
+			// File exists locally, check the size
+			if destfi.Size() == sz {
+				// File already present and correct size, skip
+				if callback != nil {
+					if callback(filename, util.ProgressSkip, sz, sz) {
+						return errorList, true, false
+					}
+				}
+				return errorList, false, false
+			}
+		}
+	}
+
+	// Make sure dest dir exists
+	parentDir := filepath.Dir(destfilename)
+	err = os.MkdirAll(parentDir, 0755)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create dir %v: %v", parentDir, err)
+		errorList = append(errorList, msg)
+		return errorList, false, false
+	}
+	// Download to a temporary file, which is kept if the connection fails so that the download can
+	// resume where it left off; files in the store never change, so what's there is still valid
+	tmpfilename := filepath.Join(parentDir, "tempdownload-"+filepath.Base(destfilename))
+	outf, err := os.OpenFile(tmpfilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create temp file for download in %v: %v", parentDir, err)
+		errorList = append(errorList, msg)
+		return errorList, false, false
+	}
+	keepTemp := false
+	defer func() {
+		outf.Close()
+		if !keepTemp {
+			os.Remove(tmpfilename)
+		}
+	}()
+	offset, err := outf.Seek(0, os.SEEK_END)
+	if err == nil && (offset > sz || force) {
+		offset = 0
+		err = outf.Truncate(0)
+		if err == nil {
+			_, err = outf.Seek(0, os.SEEK_SET)
+		}
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Unable to write temp file for download %v: %v", tmpfilename, err)
+		errorList = append(errorList, msg)
+		return errorList, false, false
+	}
+	if offset > 0 {
+		self.log.Debugf("Resuming download of %v from %d bytes\n", filename, offset)
+	}
+
+	handle, err := self.client.Open(srcfilename, sftpOpenRead)
+	if err != nil {
+		return failed(err)
+	}
+	// Initial callback
+	if callback != nil {
+		if callback(filename, util.ProgressTransferBytes, offset, sz) {
+			self.client.CloseHandle(handle)
+			keepTemp = true
+			return errorList, true, false
+		}
+	}
+	var aborted bool
+	progress := func(done int64) bool {
+		if callback != nil && sz > 0 {
+			aborted = callback(filename, util.ProgressTransferBytes, offset+done, sz)
+		}
+		return aborted
+	}
+	_, err = self.client.ReadTo(handle, offset, sz, util.ThrottleDownloadWriter(self.opts, outf), progress)
+	closeerr := self.client.CloseHandle(handle)
+	if err == nil {
+		err = closeerr
+	}
+	outf.Close()
+	if err != nil {
+		// Anything already downloaded is worth keeping if we're going to try again
+		keepTemp = aborted || isSftpConnectionError(err)
+		if aborted {
+			return errorList, true, false
+		}
+		return failed(err)
+	}
+	// Move to correct location - remove before to deal with force or bad size cases
+	os.Remove(destfilename)
+	err = os.Rename(tmpfilename, destfilename)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to move downloaded file to %v: %v", destfilename, err)
+		errorList = append(errorList, msg)
+	}
+	return errorList, false, false
+}
+
+func (self *SftpSyncProvider) Download(remoteName string, filenames []string, toDir string,
+	force bool, callback SyncProgressCallback) error {
+
+	err := self.CheckConnection(remoteName)
+	if err != nil {
+		return err
+	}
+
+	var errorList []string
+	for _, filename := range filenames {
+		// Allow aborting
+		newerrs, abort := RetryFile(self.opts, self.log, filename, callback, func() ([]string, bool, bool) {
+			return self.downloadSingleFile(remoteName, filename, toDir, force, callback)
+		})
+		errorList = append(errorList, newerrs...)
+		if abort {
+			break
+		}
+	}
+
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+
+	return nil
+}
+
+// Get the attributes of a file in the store, reconnecting once if the connection has failed
+func (self *SftpSyncProvider) stat(remoteName, filename string) (*sftpAttrs, error) {
+	var attrs *sftpAttrs
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		err = self.connect(remoteName)
+		if err != nil {
+			return nil, err
+		}
+		attrs, err = self.client.Stat(self.remotePath(filename))
+		if !isSftpConnectionError(err) {
+			break
+		}
+		self.resetConnection()
+	}
+	return attrs, err
+}
+
+func (self *SftpSyncProvider) FileExists(remoteName, filename string) bool {
+	_, err := self.stat(remoteName, filename)
+	return err == nil
+}
+
+func (self *SftpSyncProvider) FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool {
+	attrs, err := self.stat(remoteName, filename)
+	return err == nil && attrs.Size == sz
+}
+
+// Delete files from the store, & the folders they were in if that leaves them empty
+func (self *SftpSyncProvider) Delete(remoteName string, filenames []string) error {
+	err := self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+	var errorList []string
+	for _, filename := range filenames {
+		fullpath := self.remotePath(filename)
+		err := self.client.Remove(fullpath)
+		if err != nil && !isSftpNotExist(err) {
+			if isSftpConnectionError(err) {
+				self.resetConnection()
+				return fmt.Errorf("Unable to delete %v: %v", fullpath, err.Error())
+			}
+			errorList = append(errorList, fmt.Sprintf("Unable to delete %v: %v", fullpath, err.Error()))
+			continue
+		}
+		// Fails harmlessly if not empty
+		for dir := path.Dir(filepath.ToSlash(filename)); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if self.client.Rmdir(self.remotePath(dir)) != nil {
+				break
+			}
+			delete(self.dirsExist, self.remotePath(dir))
+		}
+	}
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+	return nil
+}
+
+// List all the files in the store
+func (self *SftpSyncProvider) List(remoteName string, callback func(file *RemoteFile) (quit bool)) error {
+	err := self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+	errQuit := errors.New("quit")
+	var listDir func(rel string) error
+	listDir = func(rel string) error {
+		entries, err := self.client.ReadDir(self.remotePath(rel))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			entryrel := path.Join(rel, entry.Name)
+			if entry.Attrs.IsDir() {
+				err = listDir(entryrel)
+				if err != nil {
+					return err
+				}
+			} else if entry.Attrs.IsRegular() {
+				if callback(&RemoteFile{Filename: filepath.FromSlash(entryrel), Size: entry.Attrs.Size}) {
+					return errQuit
+				}
+			}
+		}
+		return nil
+	}
+	err = listDir("")
+	if err != nil && err != errQuit {
+		if isSftpConnectionError(err) {
+			self.resetConnection()
+		}
+		return fmt.Errorf("Unable to list files in %v: %v", self.root, err.Error())
+	}
+	return nil
+}
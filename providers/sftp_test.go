@@ -0,0 +1,376 @@
+package providers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+// Just enough of an SFTP server, serving the local file system, to test the client against
+type testSftpServer struct {
+	// Whether to offer the posix-rename extension
+	posixRename bool
+	// Most bytes returned by each READ, 0 for as many as asked for
+	maxRead int
+	// Drop the connection when this many READs have been received, 0 for never
+	dropAfterReads int
+
+	lock sync.Mutex
+	// Offsets of the READs received
+	readOffsets []uint64
+	// Number of connections made
+	connections int
+}
+
+func (s *testSftpServer) connect(opts *Options, log *Logger, loc *sftpLocation) (io.ReadWriteCloser, error) {
+	client, server := net.Pipe()
+	s.lock.Lock()
+	s.connections++
+	s.lock.Unlock()
+	go s.serve(server)
+	return client, nil
+}
+
+func (s *testSftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	handles := make(map[string]interface{})
+	nextHandle := 0
+	reply := func(typ byte, id uint32, b *sftpBuffer) error {
+		return writeSftpPacket(conn, typ, append((&sftpBuffer{}).uint32(id).b, b.b...))
+	}
+	status := func(id uint32, err error) error {
+		code := uint32(sftpStatusOK)
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+			switch {
+			case os.IsNotExist(err):
+				code = sftpStatusNoSuchFile
+			case os.IsPermission(err):
+				code = sftpStatusPermission
+			default:
+				code = sftpStatusFailure
+			}
+		}
+		return reply(sftpPacketStatus, id, (&sftpBuffer{}).uint32(code).string(msg).string(""))
+	}
+	attrs := func(fi os.FileInfo) *sftpAttrs {
+		perms := uint32(fi.Mode().Perm())
+		if fi.IsDir() {
+			perms |= 0040000
+		} else if fi.Mode().IsRegular() {
+			perms |= 0100000
+		}
+		return &sftpAttrs{Flags: sftpAttrSize | sftpAttrPermissions, Size: fi.Size(), Permissions: perms}
+	}
+	reads := 0
+
+	for {
+		pkt, err := readSftpPacket(conn)
+		if err != nil {
+			return
+		}
+		r := &sftpReader{b: pkt.data}
+		switch pkt.typ {
+		case sftpPacketInit:
+			// INIT has no id, so reread its content
+			r = &sftpReader{b: append((&sftpBuffer{}).uint32(pkt.id).b, pkt.data...)}
+			version := &sftpBuffer{}
+			version.uint32(sftpProtocolVersion)
+			if s.posixRename {
+				version.string(sftpPosixRenameExtension).string("1")
+			}
+			err = writeSftpPacket(conn, sftpPacketVersion, version.b)
+		case sftpPacketStat, sftpPacketLstat:
+			fi, staterr := os.Stat(r.string())
+			if staterr != nil {
+				err = status(pkt.id, staterr)
+			} else {
+				err = reply(sftpPacketAttrs, pkt.id, (&sftpBuffer{}).attrs(attrs(fi)))
+			}
+		case sftpPacketMkdir:
+			err = status(pkt.id, os.Mkdir(r.string(), 0755))
+		case sftpPacketRmdir, sftpPacketRemove:
+			err = status(pkt.id, os.Remove(r.string()))
+		case sftpPacketRename:
+			oldpath, newpath := r.string(), r.string()
+			if _, staterr := os.Stat(newpath); staterr == nil {
+				err = status(pkt.id, fmt.Errorf("%v already exists", newpath))
+			} else {
+				err = status(pkt.id, os.Rename(oldpath, newpath))
+			}
+		case sftpPacketExtended:
+			if name := r.string(); name == sftpPosixRenameExtension && s.posixRename {
+				err = status(pkt.id, os.Rename(r.string(), r.string()))
+			} else {
+				err = reply(sftpPacketStatus, pkt.id, (&sftpBuffer{}).uint32(sftpStatusUnsupported).string("Unsupported").string(""))
+			}
+		case sftpPacketOpen:
+			p, flags := r.string(), r.uint32()
+			osflags := os.O_RDONLY
+			if flags&sftpOpenWrite != 0 {
+				osflags = os.O_WRONLY
+			}
+			if flags&sftpOpenCreate != 0 {
+				osflags |= os.O_CREATE
+			}
+			if flags&sftpOpenTrunc != 0 {
+				osflags |= os.O_TRUNC
+			}
+			if flags&sftpOpenExcl != 0 {
+				osflags |= os.O_EXCL
+			}
+			f, openerr := os.OpenFile(p, osflags, 0644)
+			if openerr != nil {
+				err = status(pkt.id, openerr)
+			} else {
+				nextHandle++
+				handle := fmt.Sprintf("%d", nextHandle)
+				handles[handle] = f
+				err = reply(sftpPacketHandle, pkt.id, (&sftpBuffer{}).string(handle))
+			}
+		case sftpPacketOpendir:
+			infos, direrr := ioutil.ReadDir(r.string())
+			if direrr != nil {
+				err = status(pkt.id, direrr)
+			} else {
+				nextHandle++
+				handle := fmt.Sprintf("%d", nextHandle)
+				handles[handle] = infos
+				err = reply(sftpPacketHandle, pkt.id, (&sftpBuffer{}).string(handle))
+			}
+		case sftpPacketReaddir:
+			handle := r.string()
+			infos, _ := handles[handle].([]os.FileInfo)
+			if len(infos) == 0 {
+				err = reply(sftpPacketStatus, pkt.id, (&sftpBuffer{}).uint32(sftpStatusEOF).string("").string(""))
+			} else {
+				names := (&sftpBuffer{}).uint32(uint32(len(infos) + 1))
+				// Servers include . & .. which should be ignored
+				names.string(".").string(".").attrs(&sftpAttrs{Flags: sftpAttrPermissions, Permissions: 0040755})
+				for _, fi := range infos {
+					names.string(fi.Name()).string(fi.Name()).attrs(attrs(fi))
+				}
+				handles[handle] = []os.FileInfo{}
+				err = reply(sftpPacketName, pkt.id, names)
+			}
+		case sftpPacketRead:
+			f, _ := handles[r.string()].(*os.File)
+			offset, length := r.uint64(), int(r.uint32())
+			s.lock.Lock()
+			s.readOffsets = append(s.readOffsets, offset)
+			s.lock.Unlock()
+			reads++
+			if s.dropAfterReads > 0 && reads >= s.dropAfterReads {
+				return
+			}
+			if s.maxRead > 0 && length > s.maxRead {
+				length = s.maxRead
+			}
+			buf := make([]byte, length)
+			n, readerr := f.ReadAt(buf, int64(offset))
+			if n == 0 && readerr == io.EOF {
+				err = reply(sftpPacketStatus, pkt.id, (&sftpBuffer{}).uint32(sftpStatusEOF).string("").string(""))
+			} else if n == 0 {
+				err = status(pkt.id, readerr)
+			} else {
+				err = reply(sftpPacketData, pkt.id, (&sftpBuffer{}).bytes(buf[:n]))
+			}
+		case sftpPacketWrite:
+			f, _ := handles[r.string()].(*os.File)
+			offset, data := r.uint64(), r.bytes()
+			_, writeerr := f.WriteAt(data, int64(offset))
+			err = status(pkt.id, writeerr)
+		case sftpPacketClose:
+			handle := r.string()
+			if f, ok := handles[handle].(*os.File); ok {
+				f.Close()
+			}
+			delete(handles, handle)
+			err = status(pkt.id, nil)
+		default:
+			err = reply(sftpPacketStatus, pkt.id, (&sftpBuffer{}).uint32(sftpStatusUnsupported).string("Unsupported").string(""))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+var _ = Describe("Sftp", func() {
+	localpath := filepath.Join(os.TempDir(), "SftpTestLocal")
+	remotepath := filepath.Join(os.TempDir(), "SftpTestRemote")
+	testfiles := GetRandomListOfFilesForTest(3, 2, 2)
+	var server *testSftpServer
+	var provider *SftpSyncProvider
+	var oldConnect func(*Options, *Logger, *sftpLocation) (io.ReadWriteCloser, error)
+	var oldSleep func(time.Duration)
+
+	BeforeEach(func() {
+		os.MkdirAll(localpath, 0755)
+		os.MkdirAll(remotepath, 0755)
+		for i, file := range testfiles {
+			CreateRandomFileForTest(int64(i*10000+100), filepath.Join(localpath, file))
+		}
+		server = &testSftpServer{posixRename: true}
+		oldConnect, oldSleep = sftpConnect, retrySleep
+		sftpConnect = server.connect
+		retrySleep = func(time.Duration) {}
+		GlobalOptions.GitConfig["remote.origin.git-lob-url"] = "sftp://me@testhost:2222/" + filepath.ToSlash(remotepath)
+		provider = &SftpSyncProvider{opts: GlobalOptions, log: DefaultLogger}
+	})
+	AfterEach(func() {
+		provider.Release()
+		sftpConnect, retrySleep = oldConnect, oldSleep
+		delete(GlobalOptions.GitConfig, "remote.origin.git-lob-url")
+		os.RemoveAll(localpath)
+		os.RemoveAll(remotepath)
+	})
+
+	It("Parses URLs", func() {
+		loc, err := parseSftpURL("sftp://me@host.com:2222/store/path")
+		Expect(err).To(BeNil())
+		Expect(*loc).To(Equal(sftpLocation{Host: "me@host.com", Port: "2222", Path: "store/path"}))
+		loc, err = parseSftpURL("sftp://host.com//abs/store")
+		Expect(err).To(BeNil())
+		Expect(*loc).To(Equal(sftpLocation{Host: "host.com", Path: "/abs/store"}))
+		loc, err = parseSftpURL("me@host.com:store/path")
+		Expect(err).To(BeNil())
+		Expect(*loc).To(Equal(sftpLocation{Host: "me@host.com", Path: "store/path"}))
+		_, err = parseSftpURL("https://host.com/store")
+		Expect(err).ToNot(BeNil())
+		_, err = parseSftpURL("local/path")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("Uploads, downloads, lists & deletes files", func() {
+		var uploaded, skipped []string
+		callback := func(filename string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+			if bytesDone == totalBytes {
+				if progressType == ProgressSkip {
+					skipped = append(skipped, filename)
+				} else if progressType == ProgressTransferBytes {
+					uploaded = append(uploaded, filename)
+				}
+			}
+			return false
+		}
+		Expect(provider.ValidateConfig("origin")).To(BeNil())
+		Expect(provider.CheckConnection("origin")).To(BeNil())
+		Expect(provider.Upload("origin", testfiles, localpath, false, callback)).To(BeNil())
+		Expect(uploaded).To(Equal(testfiles))
+		for _, file := range testfiles {
+			local, _ := ioutil.ReadFile(filepath.Join(localpath, file))
+			remote, err := ioutil.ReadFile(filepath.Join(remotepath, file))
+			Expect(err).To(BeNil(), "Should create folders as needed")
+			Expect(bytes.Equal(local, remote)).To(BeTrue(), "Content should be uploaded")
+			Expect(provider.FileExistsAndIsOfSize("origin", file, int64(len(local)))).To(BeTrue())
+		}
+		Expect(provider.FileExists("origin", "missing.bin")).To(BeFalse())
+
+		uploaded = nil
+		Expect(provider.Upload("origin", testfiles, localpath, false, callback)).To(BeNil())
+		Expect(uploaded).To(BeEmpty())
+		Expect(skipped).To(Equal(testfiles), "Files already uploaded should be skipped")
+		// Force overwrites in place, with & without the posix-rename extension
+		Expect(provider.Upload("origin", testfiles[:1], localpath, true, callback)).To(BeNil())
+		provider.Release()
+		server.posixRename = false
+		Expect(provider.Upload("origin", testfiles[:1], localpath, true, callback)).To(BeNil())
+		Expect(uploaded).To(Equal([]string{testfiles[0], testfiles[0]}))
+
+		var listed []string
+		Expect(provider.List("origin", func(file *RemoteFile) bool {
+			listed = append(listed, file.Filename)
+			return false
+		})).To(BeNil())
+		sort.Strings(listed)
+		expected := append([]string{}, testfiles...)
+		sort.Strings(expected)
+		Expect(listed).To(Equal(expected), "Should list all files & no temporary files")
+
+		downloadpath := filepath.Join(localpath, "download")
+		notfound := 0
+		downloadCallback := func(filename string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+			if progressType == ProgressNotFound {
+				notfound++
+			}
+			return false
+		}
+		Expect(provider.Download("origin", append(testfiles, "missing.bin"), downloadpath, false, downloadCallback)).To(BeNil())
+		Expect(notfound).To(Equal(1), "Missing files should be reported but not fail")
+		for _, file := range testfiles {
+			local, _ := ioutil.ReadFile(filepath.Join(localpath, file))
+			downloaded, err := ioutil.ReadFile(filepath.Join(downloadpath, file))
+			Expect(err).To(BeNil())
+			Expect(bytes.Equal(local, downloaded)).To(BeTrue(), "Content should be downloaded")
+		}
+
+		Expect(provider.Delete("origin", testfiles)).To(BeNil())
+		infos, _ := ioutil.ReadDir(remotepath)
+		Expect(infos).To(BeEmpty(), "Should delete files & the folders they leave empty")
+		Expect(server.connections).To(Equal(2), "Should reuse the connection")
+	})
+
+	It("Resumes interrupted downloads", func() {
+		file := testfiles[len(testfiles)-1]
+		content, _ := ioutil.ReadFile(filepath.Join(localpath, file))
+		Expect(len(content)).To(BeNumerically(">", 3*sftpTransferSize), "Test file should need several reads")
+		os.MkdirAll(filepath.Dir(filepath.Join(remotepath, file)), 0755)
+		ioutil.WriteFile(filepath.Join(remotepath, file), content, 0644)
+
+		// Left over from an earlier attempt; servers may also return less than asked for
+		downloadpath := filepath.Join(localpath, "download")
+		destfile := filepath.Join(downloadpath, file)
+		os.MkdirAll(filepath.Dir(destfile), 0755)
+		ioutil.WriteFile(filepath.Join(filepath.Dir(destfile), "tempdownload-"+filepath.Base(destfile)), content[:50000], 0644)
+		server.maxRead = 10000
+		Expect(provider.Download("origin", []string{file}, downloadpath, false, nil)).To(BeNil())
+		downloaded, err := ioutil.ReadFile(destfile)
+		Expect(err).To(BeNil())
+		Expect(bytes.Equal(content, downloaded)).To(BeTrue(), "Content should be complete after resuming")
+		Expect(server.readOffsets[0]).To(BeEquivalentTo(50000), "Should resume from what was downloaded")
+		tempfiles, _ := filepath.Glob(filepath.Join(filepath.Dir(destfile), "tempdownload*"))
+		Expect(tempfiles).To(BeEmpty())
+
+		// Connection drops part way through, so it's retried
+		os.Remove(destfile)
+		server.dropAfterReads = 3
+		oldAttempts := GlobalOptions.RetryAttempts
+		defer func() { GlobalOptions.RetryAttempts = oldAttempts }()
+		GlobalOptions.RetryAttempts = 1
+		retries := 0
+		callback := func(filename string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+			if progressType == ProgressRetry {
+				retries++
+				server.dropAfterReads = 0
+			}
+			return false
+		}
+		Expect(provider.Download("origin", []string{file}, downloadpath, false, callback)).To(BeNil())
+		Expect(retries).To(Equal(1))
+		downloaded, err = ioutil.ReadFile(destfile)
+		Expect(err).To(BeNil())
+		Expect(bytes.Equal(content, downloaded)).To(BeTrue(), "Content should be complete after retrying")
+	})
+
+	It("Fails to connect to missing stores", func() {
+		GlobalOptions.GitConfig["remote.origin.git-lob-url"] = "sftp://testhost/" + filepath.ToSlash(filepath.Join(remotepath, "missing"))
+		err := provider.CheckConnection("origin")
+		Expect(err).ToNot(BeNil())
+		Expect(strings.Contains(err.Error(), "Unable to reach remote 'origin'")).To(BeTrue())
+		Expect(provider.Upload("origin", testfiles, localpath, false, nil)).ToNot(BeNil())
+	})
+})
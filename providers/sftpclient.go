@@ -0,0 +1,713 @@
+package providers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+)
+
+// Minimal SFTP client, speaking protocol version 3 (draft-ietf-secsh-filexfer-02) which is what
+// OpenSSH & most other servers use, over any connection e.g. the stdin/stdout of 'ssh -s host sftp'
+// Only what the sftp provider needs is implemented. Responses are read in the background &
+// matched to requests by id, so reads & writes of file content can be pipelined; otherwise
+// requests are made one at a time
+
+const sftpProtocolVersion = 3
+
+// Packet types
+const (
+	sftpPacketInit          = 1
+	sftpPacketVersion       = 2
+	sftpPacketOpen          = 3
+	sftpPacketClose         = 4
+	sftpPacketRead          = 5
+	sftpPacketWrite         = 6
+	sftpPacketLstat         = 7
+	sftpPacketOpendir       = 11
+	sftpPacketReaddir       = 12
+	sftpPacketRemove        = 13
+	sftpPacketMkdir         = 14
+	sftpPacketRmdir         = 15
+	sftpPacketStat          = 17
+	sftpPacketRename        = 18
+	sftpPacketStatus        = 101
+	sftpPacketHandle        = 102
+	sftpPacketData          = 103
+	sftpPacketName          = 104
+	sftpPacketAttrs         = 105
+	sftpPacketExtended      = 200
+	sftpPacketExtendedReply = 201
+)
+
+// Status codes
+const (
+	sftpStatusOK          = 0
+	sftpStatusEOF         = 1
+	sftpStatusNoSuchFile  = 2
+	sftpStatusPermission  = 3
+	sftpStatusFailure     = 4
+	sftpStatusUnsupported = 8
+)
+
+// Flags for opening files
+const (
+	sftpOpenRead   = 0x01
+	sftpOpenWrite  = 0x02
+	sftpOpenCreate = 0x08
+	sftpOpenTrunc  = 0x10
+	sftpOpenExcl   = 0x20
+)
+
+// Which attributes are present
+const (
+	sftpAttrSize        = 0x00000001
+	sftpAttrUIDGID      = 0x00000002
+	sftpAttrPermissions = 0x00000004
+	sftpAttrACModTime   = 0x00000008
+	sftpAttrExtended    = 0x80000000
+)
+
+// Rename which replaces an existing file atomically, as rename(2) does
+const sftpPosixRenameExtension = "posix-rename@openssh.com"
+
+// Size of each read or write of file content; servers must support at least this
+const sftpTransferSize = 32768
+
+// Number of reads or writes of file content in flight at once
+const sftpMaxRequestsInFlight = 64
+
+// Packets larger than this are rejected as corrupt (content is sent in sftpTransferSize pieces)
+const sftpMaxPacketSize = 1024 * 1024
+
+// A packet received from the server; data is what follows the id
+type sftpPacket struct {
+	typ  byte
+	id   uint32
+	data []byte
+}
+
+// Attributes of a remote file
+type sftpAttrs struct {
+	Flags       uint32
+	Size        int64
+	Permissions uint32
+}
+
+func (a *sftpAttrs) IsDir() bool {
+	return a.Flags&sftpAttrPermissions != 0 && a.Permissions&0170000 == 0040000
+}
+
+func (a *sftpAttrs) IsRegular() bool {
+	return a.Flags&sftpAttrPermissions != 0 && a.Permissions&0170000 == 0100000
+}
+
+// An entry in a remote directory
+type sftpDirEntry struct {
+	Name  string
+	Attrs *sftpAttrs
+}
+
+// Error status the server responded to a request with
+type sftpStatusError struct {
+	Code uint32
+	Msg  string
+}
+
+func (e *sftpStatusError) Error() string {
+	if e.Msg != "" {
+		return e.Msg
+	}
+	return fmt.Sprintf("SFTP error %d", e.Code)
+}
+
+// Did the server report that a file doesn't exist?
+func isSftpNotExist(err error) bool {
+	if s, ok := err.(*sftpStatusError); ok {
+		return s.Code == sftpStatusNoSuchFile
+	}
+	return false
+}
+
+// Anything other than the server responding with an error status means the connection has
+// failed, so the request may succeed on a new one
+func isSftpConnectionError(err error) bool {
+	_, isStatus := err.(*sftpStatusError)
+	return err != nil && !isStatus
+}
+
+// Builds the content of a packet
+type sftpBuffer struct {
+	b []byte
+}
+
+func (b *sftpBuffer) byte(v byte) *sftpBuffer {
+	b.b = append(b.b, v)
+	return b
+}
+func (b *sftpBuffer) uint32(v uint32) *sftpBuffer {
+	b.b = append(b.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	return b
+}
+func (b *sftpBuffer) uint64(v uint64) *sftpBuffer {
+	return b.uint32(uint32(v >> 32)).uint32(uint32(v))
+}
+func (b *sftpBuffer) string(s string) *sftpBuffer {
+	b.uint32(uint32(len(s)))
+	b.b = append(b.b, s...)
+	return b
+}
+func (b *sftpBuffer) bytes(s []byte) *sftpBuffer {
+	b.uint32(uint32(len(s)))
+	b.b = append(b.b, s...)
+	return b
+}
+func (b *sftpBuffer) attrs(a *sftpAttrs) *sftpBuffer {
+	if a == nil {
+		return b.uint32(0)
+	}
+	b.uint32(a.Flags)
+	if a.Flags&sftpAttrSize != 0 {
+		b.uint64(uint64(a.Size))
+	}
+	if a.Flags&sftpAttrPermissions != 0 {
+		b.uint32(a.Permissions)
+	}
+	return b
+}
+
+// Reads the content of a packet; the first problem is kept in err & later reads return zero values
+type sftpReader struct {
+	b   []byte
+	err error
+}
+
+var errSftpShortPacket = errors.New("SFTP packet is too short")
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.err = errSftpShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+func (r *sftpReader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.err = errSftpShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+func (r *sftpReader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.b)) < n {
+		r.err = errSftpShortPacket
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+func (r *sftpReader) string() string {
+	return string(r.bytes())
+}
+func (r *sftpReader) attrs() *sftpAttrs {
+	a := &sftpAttrs{Flags: r.uint32()}
+	if a.Flags&sftpAttrSize != 0 {
+		a.Size = int64(r.uint64())
+	}
+	if a.Flags&sftpAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if a.Flags&sftpAttrPermissions != 0 {
+		a.Permissions = r.uint32()
+	}
+	if a.Flags&sftpAttrACModTime != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if a.Flags&sftpAttrExtended != 0 {
+		count := r.uint32()
+		for i := uint32(0); i < count && r.err == nil; i++ {
+			r.string()
+			r.string()
+		}
+	}
+	return a
+}
+
+// Read a packet, which is preceded by its length; all but VERSION have an id after the type
+func readSftpPacket(in io.Reader) (*sftpPacket, error) {
+	var lenbuf [4]byte
+	_, err := io.ReadFull(in, lenbuf[:])
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lenbuf[:])
+	if length < 1 || length > sftpMaxPacketSize {
+		return nil, fmt.Errorf("Invalid SFTP packet length %d", length)
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(in, buf)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	pkt := &sftpPacket{typ: buf[0], data: buf[1:]}
+	if pkt.typ != sftpPacketInit && pkt.typ != sftpPacketVersion {
+		if len(pkt.data) < 4 {
+			return nil, errSftpShortPacket
+		}
+		pkt.id = binary.BigEndian.Uint32(pkt.data)
+		pkt.data = pkt.data[4:]
+	}
+	return pkt, nil
+}
+
+// Write a packet with its length
+func writeSftpPacket(out io.Writer, typ byte, content []byte) error {
+	buf := (&sftpBuffer{make([]byte, 0, len(content)+5)}).uint32(uint32(len(content) + 1)).byte(typ)
+	_, err := out.Write(append(buf.b, content...))
+	return err
+}
+
+type sftpClient struct {
+	conn io.ReadWriteCloser
+	// Extensions the server supports, with their data
+	extensions map[string]string
+
+	lock    sync.Mutex
+	nextId  uint32
+	waiting map[uint32]chan *sftpPacket
+	// Why responses can no longer be read
+	readErr error
+}
+
+// A request which has been sent, whose response can be waited for
+type sftpRequest struct {
+	id       uint32
+	response chan *sftpPacket
+}
+
+// Start an SFTP session on a connection; conn is closed by Close
+func newSftpClient(conn io.ReadWriteCloser) (*sftpClient, error) {
+	err := writeSftpPacket(conn, sftpPacketInit, (&sftpBuffer{}).uint32(sftpProtocolVersion).b)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start SFTP session: %v", err.Error())
+	}
+	pkt, err := readSftpPacket(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start SFTP session: %v", err.Error())
+	}
+	if pkt.typ != sftpPacketVersion {
+		return nil, fmt.Errorf("Unable to start SFTP session: unexpected response type %d", pkt.typ)
+	}
+	r := &sftpReader{b: pkt.data}
+	version := r.uint32()
+	if r.err != nil || version < sftpProtocolVersion {
+		return nil, fmt.Errorf("Unable to start SFTP session: unsupported protocol version %d", version)
+	}
+	client := &sftpClient{
+		conn:       conn,
+		extensions: make(map[string]string),
+		waiting:    make(map[uint32]chan *sftpPacket),
+	}
+	for len(r.b) > 0 && r.err == nil {
+		name, data := r.string(), r.string()
+		client.extensions[name] = data
+	}
+	go client.readResponses()
+	return client, nil
+}
+
+// Close the session & the connection it's on
+func (c *sftpClient) Close() error {
+	return c.conn.Close()
+}
+
+// Runs in the background delivering responses to whoever is waiting for them
+func (c *sftpClient) readResponses() {
+	for {
+		pkt, err := readSftpPacket(c.conn)
+		c.lock.Lock()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			c.readErr = fmt.Errorf("SFTP connection failed: %v", err.Error())
+			for _, ch := range c.waiting {
+				close(ch)
+			}
+			c.waiting = nil
+			c.lock.Unlock()
+			return
+		}
+		ch := c.waiting[pkt.id]
+		delete(c.waiting, pkt.id)
+		c.lock.Unlock()
+		if ch != nil {
+			// Buffered, never blocks
+			ch <- pkt
+		}
+	}
+}
+
+// Send a request, content being what follows the id
+func (c *sftpClient) send(typ byte, content *sftpBuffer) (*sftpRequest, error) {
+	c.lock.Lock()
+	if c.waiting == nil {
+		err := c.readErr
+		c.lock.Unlock()
+		return nil, err
+	}
+	req := &sftpRequest{c.nextId, make(chan *sftpPacket, 1)}
+	c.nextId++
+	c.waiting[req.id] = req.response
+	c.lock.Unlock()
+
+	buf := (&sftpBuffer{make([]byte, 0, len(content.b)+4)}).uint32(req.id)
+	err := writeSftpPacket(c.conn, typ, append(buf.b, content.b...))
+	if err != nil {
+		c.lock.Lock()
+		if c.waiting != nil {
+			delete(c.waiting, req.id)
+		}
+		c.lock.Unlock()
+		return nil, err
+	}
+	return req, nil
+}
+
+// Wait for the response to a request
+func (c *sftpClient) wait(req *sftpRequest) (*sftpPacket, error) {
+	pkt, ok := <-req.response
+	if !ok {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return nil, c.readErr
+	}
+	return pkt, nil
+}
+
+// Send a request & wait for the response
+func (c *sftpClient) request(typ byte, content *sftpBuffer) (*sftpPacket, error) {
+	req, err := c.send(typ, content)
+	if err != nil {
+		return nil, err
+	}
+	return c.wait(req)
+}
+
+// Get the error a STATUS response represents, nil for OK
+func sftpStatusToError(pkt *sftpPacket) error {
+	r := &sftpReader{b: pkt.data}
+	code := r.uint32()
+	msg := r.string()
+	if r.err != nil {
+		return r.err
+	}
+	if code == sftpStatusOK {
+		return nil
+	}
+	return &sftpStatusError{code, msg}
+}
+
+// Get the error for a response which wasn't the type expected
+func sftpUnexpectedResponse(pkt *sftpPacket) error {
+	if pkt.typ == sftpPacketStatus {
+		if err := sftpStatusToError(pkt); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("Unexpected SFTP response type %d", pkt.typ)
+}
+
+// Make a request which just responds with a status
+func (c *sftpClient) requestStatus(typ byte, content *sftpBuffer) error {
+	pkt, err := c.request(typ, content)
+	if err != nil {
+		return err
+	}
+	if pkt.typ != sftpPacketStatus {
+		return sftpUnexpectedResponse(pkt)
+	}
+	return sftpStatusToError(pkt)
+}
+
+// Get the attributes of a remote file, following symlinks
+func (c *sftpClient) Stat(p string) (*sftpAttrs, error) {
+	pkt, err := c.request(sftpPacketStat, (&sftpBuffer{}).string(p))
+	if err != nil {
+		return nil, err
+	}
+	if pkt.typ != sftpPacketAttrs {
+		return nil, sftpUnexpectedResponse(pkt)
+	}
+	r := &sftpReader{b: pkt.data}
+	attrs := r.attrs()
+	return attrs, r.err
+}
+
+// Create a remote folder
+func (c *sftpClient) Mkdir(p string) error {
+	return c.requestStatus(sftpPacketMkdir, (&sftpBuffer{}).string(p).attrs(nil))
+}
+
+// Create a remote folder & any of its parents which don't exist, unless known to exist
+// (which is updated with the folders which do)
+func (c *sftpClient) MkdirAll(p string, known map[string]bool) error {
+	p = path.Clean(p)
+	if known[p] || p == "." || p == "/" {
+		return nil
+	}
+	attrs, err := c.Stat(p)
+	if err == nil {
+		if !attrs.IsDir() {
+			return fmt.Errorf("%v is not a folder", p)
+		}
+		known[p] = true
+		return nil
+	}
+	if !isSftpNotExist(err) {
+		return err
+	}
+	err = c.MkdirAll(path.Dir(p), known)
+	if err != nil {
+		return err
+	}
+	err = c.Mkdir(p)
+	if err != nil {
+		// Someone else may have created it meanwhile
+		if attrs, staterr := c.Stat(p); staterr != nil || !attrs.IsDir() {
+			return err
+		}
+	}
+	known[p] = true
+	return nil
+}
+
+// Delete a remote file
+func (c *sftpClient) Remove(p string) error {
+	return c.requestStatus(sftpPacketRemove, (&sftpBuffer{}).string(p))
+}
+
+// Delete an empty remote folder
+func (c *sftpClient) Rmdir(p string) error {
+	return c.requestStatus(sftpPacketRmdir, (&sftpBuffer{}).string(p))
+}
+
+// Rename a remote file, replacing newpath if it exists. This is atomic if the server supports
+// the posix-rename extension; otherwise newpath is deleted first since plain SFTP renames fail
+// if it exists, so newpath briefly doesn't exist
+func (c *sftpClient) Rename(oldpath, newpath string) error {
+	if _, ok := c.extensions[sftpPosixRenameExtension]; ok {
+		return c.requestStatus(sftpPacketExtended, (&sftpBuffer{}).string(sftpPosixRenameExtension).string(oldpath).string(newpath))
+	}
+	err := c.Remove(newpath)
+	if err != nil && !isSftpNotExist(err) {
+		return err
+	}
+	return c.requestStatus(sftpPacketRename, (&sftpBuffer{}).string(oldpath).string(newpath))
+}
+
+// Get a handle from the response to OPEN or OPENDIR
+func (c *sftpClient) handleResponse(pkt *sftpPacket, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if pkt.typ != sftpPacketHandle {
+		return "", sftpUnexpectedResponse(pkt)
+	}
+	r := &sftpReader{b: pkt.data}
+	handle := r.string()
+	return handle, r.err
+}
+
+// Open a remote file with sftpOpen* flags, returning its handle
+func (c *sftpClient) Open(p string, flags uint32) (string, error) {
+	attrs := &sftpAttrs{Flags: sftpAttrPermissions, Permissions: 0644}
+	return c.handleResponse(c.request(sftpPacketOpen, (&sftpBuffer{}).string(p).uint32(flags).attrs(attrs)))
+}
+
+// Close a file or folder handle
+func (c *sftpClient) CloseHandle(handle string) error {
+	return c.requestStatus(sftpPacketClose, (&sftpBuffer{}).string(handle))
+}
+
+// List the entries in a remote folder, excluding . & ..
+func (c *sftpClient) ReadDir(p string) ([]*sftpDirEntry, error) {
+	handle, err := c.handleResponse(c.request(sftpPacketOpendir, (&sftpBuffer{}).string(p)))
+	if err != nil {
+		return nil, err
+	}
+	defer c.CloseHandle(handle)
+	var ret []*sftpDirEntry
+	for {
+		pkt, err := c.request(sftpPacketReaddir, (&sftpBuffer{}).string(handle))
+		if err != nil {
+			return nil, err
+		}
+		if pkt.typ == sftpPacketStatus {
+			err = sftpStatusToError(pkt)
+			if s, ok := err.(*sftpStatusError); ok && s.Code == sftpStatusEOF {
+				return ret, nil
+			}
+			return nil, sftpUnexpectedResponse(pkt)
+		}
+		if pkt.typ != sftpPacketName {
+			return nil, sftpUnexpectedResponse(pkt)
+		}
+		r := &sftpReader{b: pkt.data}
+		count := r.uint32()
+		for i := uint32(0); i < count && r.err == nil; i++ {
+			name := r.string()
+			r.string() // long name, for display
+			attrs := r.attrs()
+			if name != "." && name != ".." {
+				ret = append(ret, &sftpDirEntry{name, attrs})
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+}
+
+// Wait for all the requests in flight, ignoring the responses
+func (c *sftpClient) drain(inflight []*sftpRequest) {
+	for _, req := range inflight {
+		c.wait(req)
+	}
+}
+
+// Write everything from in to an open remote file from offset, calling progress with the total
+// bytes written so far as the server confirms them; stop if it returns true (abort)
+// Returns the number of bytes written
+func (c *sftpClient) WriteFrom(handle string, offset int64, in io.Reader, progress func(done int64) (abort bool)) (int64, error) {
+	var inflight []*sftpRequest
+	var inflightSizes []int64
+	defer func() { c.drain(inflight) }()
+	var written int64
+	waitOldest := func() error {
+		pkt, err := c.wait(inflight[0])
+		inflight = inflight[1:]
+		if err != nil {
+			return err
+		}
+		if pkt.typ != sftpPacketStatus {
+			return sftpUnexpectedResponse(pkt)
+		}
+		if err = sftpStatusToError(pkt); err != nil {
+			return err
+		}
+		written += inflightSizes[0]
+		inflightSizes = inflightSizes[1:]
+		if progress != nil && progress(written) {
+			return errSftpAborted
+		}
+		return nil
+	}
+
+	buf := make([]byte, sftpTransferSize)
+	for eof := false; !eof; {
+		n, err := io.ReadFull(in, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return written, err
+		}
+		if n > 0 {
+			req, err := c.send(sftpPacketWrite, (&sftpBuffer{}).string(handle).uint64(uint64(offset)).bytes(buf[:n]))
+			if err != nil {
+				return written, err
+			}
+			inflight = append(inflight, req)
+			inflightSizes = append(inflightSizes, int64(n))
+			offset += int64(n)
+		}
+		for len(inflight) >= sftpMaxRequestsInFlight || (eof && len(inflight) > 0) {
+			if err := waitOldest(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+var errSftpAborted = errors.New("SFTP transfer aborted")
+
+// Read an open remote file from offset up to size to out, calling progress with the total bytes
+// read so far; stop if it returns true (abort). Returns the number of bytes read, & an error if
+// the file is shorter than size
+func (c *sftpClient) ReadTo(handle string, offset, size int64, out io.Writer, progress func(done int64) (abort bool)) (int64, error) {
+	var inflight []*sftpRequest
+	defer func() { c.drain(inflight) }()
+	var read int64
+	next := offset
+	for offset < size {
+		for len(inflight) < sftpMaxRequestsInFlight && next < size {
+			length := size - next
+			if length > sftpTransferSize {
+				length = sftpTransferSize
+			}
+			req, err := c.send(sftpPacketRead, (&sftpBuffer{}).string(handle).uint64(uint64(next)).uint32(uint32(length)))
+			if err != nil {
+				return read, err
+			}
+			inflight = append(inflight, req)
+			next += length
+		}
+
+		pkt, err := c.wait(inflight[0])
+		inflight = inflight[1:]
+		if err != nil {
+			return read, err
+		}
+		if pkt.typ != sftpPacketData {
+			if pkt.typ == sftpPacketStatus {
+				if s, ok := sftpStatusToError(pkt).(*sftpStatusError); ok && s.Code == sftpStatusEOF {
+					return read, fmt.Errorf("File is shorter than expected (%d/%d)", offset, size)
+				}
+			}
+			return read, sftpUnexpectedResponse(pkt)
+		}
+		r := &sftpReader{b: pkt.data}
+		data := r.bytes()
+		if r.err != nil {
+			return read, r.err
+		}
+		expected := size - offset
+		if expected > sftpTransferSize {
+			expected = sftpTransferSize
+		}
+		if int64(len(data)) > expected {
+			return read, fmt.Errorf("SFTP server sent more data than requested")
+		}
+		_, err = out.Write(data)
+		if err != nil {
+			return read, err
+		}
+		offset += int64(len(data))
+		read += int64(len(data))
+		if progress != nil && progress(read) {
+			return read, errSftpAborted
+		}
+		if int64(len(data)) < expected {
+			// Servers may return less than asked for; the requests in flight are for later
+			// offsets, so discard them & carry on from here
+			c.drain(inflight)
+			inflight = nil
+			next = offset
+		}
+	}
+	return read, nil
+}
@@ -0,0 +1,77 @@
+package smart
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// Underlying connection to smart server, for use with PersistentTransport
+// Works by invoking a command (e.g. ssh/plink/tortoise_plink) and connecting stdout/stdin
+type CommandConnection struct {
+	// Description of the command for messages, e.g. "ssh"
+	desc string
+	// The command which is running
+	cmd *exec.Cmd
+	// Streams for communicating
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+}
+
+// Start a command & connect to its stdin/stdout, ready for use with NewPersistentTransport
+// desc is used to describe the command in messages
+func StartCommandConnection(cmd *exec.Cmd, desc string) (*CommandConnection, error) {
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %v stdout: %v", desc, err.Error())
+	}
+	errp, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %v stderr: %v", desc, err.Error())
+	}
+	inp, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %v stdin: %v", desc, err.Error())
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start %v command: %v", desc, err.Error())
+	}
+
+	return &CommandConnection{
+		desc:   desc,
+		cmd:    cmd,
+		stdin:  inp,
+		stdout: outp,
+		stderr: errp,
+	}, nil
+}
+
+// Connection implementation
+func (self *CommandConnection) Read(p []byte) (n int, err error) {
+	return self.stdout.Read(p)
+}
+func (self *CommandConnection) Write(p []byte) (n int, err error) {
+	return self.stdin.Write(p)
+}
+func (self *CommandConnection) Close() error {
+	// Closing stdin lets the command know we're done if it didn't get an Exit request
+	self.stdin.Close()
+	// Docs say "It is incorrect to call Wait before all writes to the pipe have completed."
+	// But that actually means in parallel https://github.com/golang/go/issues/9307 so we're ok here
+	errbytes, readerr := ioutil.ReadAll(self.stderr)
+	if readerr == nil && len(errbytes) > 0 {
+		// Copy to our stderr for info
+		fmt.Fprintf(os.Stderr, "Messages from %v server:\n%v", self.desc, string(errbytes))
+	}
+	err := self.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("Error closing %v connection: %v\nstderr: %v", self.desc, err.Error(), string(errbytes))
+	}
+
+	return nil
+
+}
@@ -0,0 +1,148 @@
+package smart
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/klauspost/compress"
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/klauspost/compress/zstd"
+)
+
+// Compression of chunk payloads in transit (the "compress=<codec>" capability)
+// When the client enables a codec the server offers, chunks & chunk objects which look
+// compressible are sent compressed in both directions, stating the codec & the number of bytes
+// on the wire alongside the usual content size. How they're stored at each end is unchanged.
+
+// Codecs payloads can be compressed with in transit
+var TransferCompressionCodecs = []string{"zstd", "gzip"}
+
+// Prefix of the capability for each codec, e.g. "compress=zstd"
+const CompressCapPrefix = "compress="
+
+// Payloads smaller than this aren't worth compressing
+var TransferCompressionMinSize int64 = 4096
+
+// Bytes sampled to decide whether a payload is worth compressing
+const transferCompressionSampleSize = 64 * 1024
+
+// Payloads whose samples are estimated (see compress.Estimate) below this are treated as
+// already compressed, e.g. images, video & chunks compressed at rest, so CPU isn't wasted
+const transferCompressionMinEstimate = 0.1
+
+// Whether a codec can be used to compress payloads in transit
+func IsSupportedTransferCompression(codec string) bool {
+	for _, c := range TransferCompressionCodecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// Decide from samples of content whether it's worth compressing
+func isWorthCompressing(samples ...[]byte) bool {
+	for _, sample := range samples {
+		if len(sample) > 0 && compress.Estimate(sample) >= transferCompressionMinEstimate {
+			return true
+		}
+	}
+	return false
+}
+
+// Decide whether a file is worth compressing from samples at its start, middle & end
+func IsFileWorthCompressing(f io.ReaderAt, size int64) bool {
+	if size < TransferCompressionMinSize {
+		return false
+	}
+	var samples [][]byte
+	for _, offset := range []int64{0, size / 2, size - transferCompressionSampleSize} {
+		if offset < 0 {
+			offset = 0
+		}
+		sample := make([]byte, transferCompressionSampleSize)
+		n, _ := f.ReadAt(sample, offset)
+		samples = append(samples, sample[:n])
+	}
+	return isWorthCompressing(samples...)
+}
+
+// Compress everything from in to a new temp file, returning it positioned at the start & the
+// compressed size. The caller must close & remove the file
+func CompressToTempFile(codec string, in io.Reader) (*os.File, int64, error) {
+	f, err := ioutil.TempFile("", "tempcompress")
+	if err != nil {
+		return nil, 0, err
+	}
+	fail := func(err error) (*os.File, int64, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	var w io.WriteCloser
+	switch codec {
+	case "zstd":
+		w, err = zstd.NewWriter(f, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return fail(err)
+		}
+	case "gzip":
+		w = gzip.NewWriter(f)
+	default:
+		return fail(fmt.Errorf("Unsupported transfer compression '%v'", codec))
+	}
+	if _, err = io.Copy(w, in); err != nil {
+		return fail(err)
+	}
+	if err = w.Close(); err != nil {
+		return fail(err)
+	}
+	sz, err := f.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err = f.Seek(0, os.SEEK_SET); err != nil {
+		return fail(err)
+	}
+	return f, sz, nil
+}
+
+// Decompress a payload of exactly transferSize bytes from in to out, checking that it produces
+// contentSize bytes. All transferSize bytes are always consumed from in, so that the stream is
+// still usable for the next request even if the payload was bad
+func DecompressTransfer(codec string, in io.Reader, transferSize, contentSize int64, out io.Writer) error {
+	limited := io.LimitReader(in, transferSize)
+	// Whatever happens, don't leave any of the payload behind
+	defer io.Copy(ioutil.Discard, limited)
+
+	var r io.Reader
+	switch codec {
+	case "zstd":
+		dec, err := zstd.NewReader(limited, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		r = dec
+	case "gzip":
+		gz, err := gzip.NewReader(limited)
+		if err != nil {
+			return fmt.Errorf("Unable to decompress gzip payload: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	default:
+		return fmt.Errorf("Unsupported transfer compression '%v'", codec)
+	}
+	// Read 1 more than expected to detect too much content
+	n, err := io.Copy(out, io.LimitReader(r, contentSize+1))
+	if err != nil {
+		return fmt.Errorf("Unable to decompress %v payload: %w", codec, err)
+	}
+	if n != contentSize {
+		return &ConnectionError{fmt.Errorf("Decompressed size %d did not match expected size %d", n, contentSize)}
+	}
+	return nil
+}
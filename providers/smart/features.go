@@ -0,0 +1,163 @@
+package smart
+
+import (
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Protocol versions & features
+// Client & server agree which protocol features to use when the client connects. The client
+// sends the version of the protocol it speaks & the features it would like to use, in order of
+// preference, and the server replies with the version both speak & the features it has enabled;
+// anything either side doesn't know about is simply not enabled. New features are added to the
+// registry here, so older servers & clients keep working with newer ones. Servers which predate
+// negotiation (protocol version 1) are asked for their capabilities with QueryCaps & told which
+// to enable with SetEnabledCaps instead. See doc/smart_protocol.md.
+
+const (
+	// QueryCaps & SetEnabledCaps only
+	ProtocolVersionOriginal = 1
+	// Negotiate
+	ProtocolVersionNegotiate = 2
+	// The version this client & server speak
+	ProtocolVersion = ProtocolVersionNegotiate
+)
+
+// A protocol feature which client & server can agree to use
+type Feature struct {
+	// Name exchanged in negotiation; features with values are exchanged as "<name>=<value>" and
+	// at most one value of each is enabled
+	Name string
+	// Protocol version which introduced the feature; it's only enabled if both sides speak it
+	Since int
+	// The values of the feature a client asks for, in order of preference, given the transport
+	// it's using & the client's options (nil not to ask for it); just the name for features
+	// without values
+	Request func(transport Transport, opts *util.Options) []string
+}
+
+var featureRegistry []*Feature
+
+// Register a protocol feature, replacing any registered with the same name
+func RegisterFeature(feature *Feature) {
+	for i, f := range featureRegistry {
+		if f.Name == feature.Name {
+			featureRegistry[i] = feature
+			return
+		}
+	}
+	featureRegistry = append(featureRegistry, feature)
+}
+
+// Get a registered protocol feature by name, nil if there isn't one
+func GetFeature(name string) *Feature {
+	for _, f := range featureRegistry {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Split a feature as exchanged in negotiation into its name & value ("" if it doesn't have one)
+func ParseFeature(feature string) (name, value string) {
+	if i := strings.Index(feature, "="); i >= 0 {
+		return feature[:i], feature[i+1:]
+	}
+	return feature, ""
+}
+
+// Get the value of a feature in a list of those enabled, false if it isn't enabled
+func GetFeatureValue(features []string, name string) (string, bool) {
+	for _, f := range features {
+		if n, v := ParseFeature(f); n == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Whether a feature is in a list of those enabled
+func HasFeature(features []string, name string) bool {
+	_, ok := GetFeatureValue(features, name)
+	return ok
+}
+
+// The features a client asks for over a transport, in registry order
+func requestedFeatures(transport Transport, opts *util.Options) []string {
+	var ret []string
+	for _, f := range featureRegistry {
+		if f.Request != nil {
+			ret = append(ret, f.Request(transport, opts)...)
+		}
+	}
+	return ret
+}
+
+// Choose the features to enable from those requested, given those offered & the protocol version
+// agreed: only features offered, introduced by then & the first requested value of each
+func SelectFeatures(requested, offered []string, version int) []string {
+	offeredSet := util.NewStringSetFromSlice(offered)
+	chosen := util.NewStringSet()
+	var ret []string
+	for _, feature := range requested {
+		name, _ := ParseFeature(feature)
+		if !offeredSet.Contains(feature) || chosen.Contains(name) {
+			continue
+		}
+		if f := GetFeature(name); f != nil && f.Since > version {
+			continue
+		}
+		chosen.Add(name)
+		ret = append(ret, feature)
+	}
+	return ret
+}
+
+// Request a feature without a value
+func requestAlways(name string) func(Transport, *util.Options) []string {
+	return func(Transport, *util.Options) []string {
+		return []string{name}
+	}
+}
+
+func init() {
+	// Always enable deltas, chunk objects & chunk sizes if available, pruning (server only offers
+	// that to admins), retention (so server knows we understand retention holds) and locking
+	for _, name := range []string{"binary_delta", "chunk_objects", "chunk_size", "prune", "retention", "locking"} {
+		RegisterFeature(&Feature{Name: name, Since: ProtocolVersionOriginal, Request: requestAlways(name)})
+	}
+	// Deltas use the configured algorithm if the server offers it, otherwise the original bm
+	RegisterFeature(&Feature{Name: "delta_algorithm", Since: ProtocolVersionOriginal, Request: func(transport Transport, opts *util.Options) []string {
+		return []string{"delta_algorithm=" + opts.DeltaAlgorithm}
+	}})
+	// Compress chunks in transit with the configured codec if the server offers it too
+	RegisterFeature(&Feature{Name: strings.TrimSuffix(CompressCapPrefix, "="), Since: ProtocolVersionOriginal, Request: func(transport Transport, opts *util.Options) []string {
+		if _, ok := transport.(CompressionTransport); !ok || !IsSupportedTransferCompression(opts.TransferCompression) {
+			return nil
+		}
+		return []string{CompressCapPrefix + opts.TransferCompression}
+	}})
+	// Check chunk content against size+hash trailers if the transport can
+	RegisterFeature(&Feature{Name: ChunkHashCap, Since: ProtocolVersionNegotiate, Request: func(transport Transport, opts *util.Options) []string {
+		if _, ok := transport.(ChunkHashTransport); !ok {
+			return nil
+		}
+		return []string{ChunkHashCap}
+	}})
+	// Download metadata in batches if the transport can
+	RegisterFeature(&Feature{Name: MetadataBatchCap, Since: ProtocolVersionNegotiate, Request: func(transport Transport, opts *util.Options) []string {
+		if _, ok := transport.(BatchMetadataTransport); !ok {
+			return nil
+		}
+		return []string{MetadataBatchCap}
+	}})
+	// Transfer previews of LOBs if the transport can
+	RegisterFeature(&Feature{Name: PreviewsCap, Since: ProtocolVersionNegotiate, Request: func(transport Transport, opts *util.Options) []string {
+		if _, ok := transport.(PreviewTransport); !ok {
+			return nil
+		}
+		return []string{PreviewsCap}
+	}})
+}
@@ -0,0 +1,227 @@
+package smart
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// factory for creating connections to git-lob-serve running as a standalone HTTPS server
+// URLs are of the form https://host[:port]/path/to/repo. The client makes one request to upgrade
+// the connection, authenticating with a token, then uses the same protocol as over SSH.
+// The token is taken from GIT_LOB_TOKEN, or else from git's credential helpers (as the password
+// for the URL) like git's own HTTPS authentication. The server's certificate is checked using
+// git's http.sslCAInfo & http.sslVerify settings (or GIT_SSL_CAINFO / GIT_SSL_NO_VERIFY)
+type HttpsTransportFactory struct {
+}
+
+// Protocol named in the Upgrade header when connecting to git-lob-serve over HTTPS
+const HttpsUpgradeProtocol = "git-lob"
+
+// Connection upgraded from HTTPS; reads from a buffer first, in case the server started
+// talking straight after its response
+type httpsConnection struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (self *httpsConnection) Read(b []byte) (int, error) {
+	return self.reader.Read(b)
+}
+
+// Username & token to authenticate with, and whether they came from git's credential helpers
+type httpsCredential struct {
+	username   string
+	token      string
+	fromHelper bool
+}
+
+// Get the host:port to connect to from an https: URL
+func (*HttpsTransportFactory) getAddress(u *url.URL) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return u.Host
+}
+
+// Get the TLS settings for connecting to serverName, from git's own settings in opts
+func (*HttpsTransportFactory) getTLSConfig(opts *util.Options, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName}
+	if os.Getenv("GIT_SSL_NO_VERIFY") != "" || strings.EqualFold(opts.GitConfig["http.sslverify"], "false") {
+		cfg.InsecureSkipVerify = true
+	}
+	cainfo := os.Getenv("GIT_SSL_CAINFO")
+	if cainfo == "" {
+		cainfo = opts.GitConfig["http.sslcainfo"]
+	}
+	if cainfo != "" {
+		pem, err := ioutil.ReadFile(cainfo)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA certificates for HTTPS: %v", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No valid CA certificates found in %v", cainfo)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// Build the input for 'git credential' describing the URL, plus any credential already known
+func (*HttpsTransportFactory) describeCredential(u *url.URL, cred *httpsCredential) string {
+	desc := fmt.Sprintf("protocol=https\nhost=%v\npath=%v\n", u.Host, strings.TrimPrefix(u.Path, "/"))
+	if cred != nil {
+		desc += fmt.Sprintf("username=%v\npassword=%v\n", cred.username, cred.token)
+	} else if u.User != nil {
+		desc += fmt.Sprintf("username=%v\n", u.User.Username())
+	}
+	return desc + "\n"
+}
+
+// Get the token to authenticate with, from the environment or the credential helpers of the
+// repository at root
+func (self *HttpsTransportFactory) getCredential(u *url.URL, root string) (*httpsCredential, error) {
+	if token := os.Getenv("GIT_LOB_TOKEN"); token != "" {
+		return &httpsCredential{token: token}, nil
+	}
+	cmd := exec.Command("git", "credential", "fill")
+	cmd.Dir = root
+	cmd.Stdin = strings.NewReader(self.describeCredential(u, nil))
+	cmd.Stderr = os.Stderr
+	outp, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get a token for %v, set GIT_LOB_TOKEN or configure a git credential helper: %v", u.Host, err.Error())
+	}
+	cred := &httpsCredential{fromHelper: true}
+	for _, line := range strings.Split(string(outp), "\n") {
+		if strings.HasPrefix(line, "username=") {
+			cred.username = strings.TrimPrefix(line, "username=")
+		} else if strings.HasPrefix(line, "password=") {
+			cred.token = strings.TrimPrefix(line, "password=")
+		}
+	}
+	if cred.token == "" {
+		return nil, fmt.Errorf("No token found for %v, set GIT_LOB_TOKEN or configure a git credential helper", u.Host)
+	}
+	return cred, nil
+}
+
+// Tell git's credential helpers whether a credential they provided worked ("approve" or "reject")
+func (self *HttpsTransportFactory) reportCredential(u *url.URL, root string, log *util.Logger, cred *httpsCredential, action string) {
+	if !cred.fromHelper {
+		return
+	}
+	cmd := exec.Command("git", "credential", action)
+	cmd.Dir = root
+	cmd.Stdin = strings.NewReader(self.describeCredential(u, cred))
+	if err := cmd.Run(); err != nil {
+		log.Debugf("Unable to %v credential for %v: %v", action, u.Host, err.Error())
+	}
+}
+
+// Ask the server to upgrade the connection to the git-lob protocol for the URL's path
+// Returns the upgraded connection, or the HTTP status code & an error if refused
+func (self *HttpsTransportFactory) upgrade(conn net.Conn, u *url.URL, cred *httpsCredential) (net.Conn, int, error) {
+	// Don't send any credentials in the URL itself
+	requrl := *u
+	requrl.User = nil
+	req, err := http.NewRequest("POST", requrl.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", HttpsUpgradeProtocol)
+	req.SetBasicAuth(cred.username, cred.token)
+	if err = req.Write(conn); err != nil {
+		return nil, 0, fmt.Errorf("Unable to send request to %v: %v", u.Host, err.Error())
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to read response from %v: %v", u.Host, err.Error())
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Include the server's explanation, if it's short
+		body, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
+		resp.Body.Close()
+		msg := strings.TrimSpace(string(body))
+		if msg == "" {
+			msg = resp.Status
+		}
+		return nil, resp.StatusCode, fmt.Errorf("Server %v refused connection: %v", u.Host, msg)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), HttpsUpgradeProtocol) {
+		return nil, resp.StatusCode, fmt.Errorf("Server %v is not a git-lob server", u.Host)
+	}
+	return &httpsConnection{conn, reader}, resp.StatusCode, nil
+}
+
+func (self *HttpsTransportFactory) WillHandleUrl(u *url.URL) bool {
+	return u.Scheme == "https"
+}
+func (self *HttpsTransportFactory) Connect(u *url.URL, root string, opts *util.Options, log *util.Logger) (Transport, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("No valid host found in url %v", u.String())
+	}
+	if strings.TrimPrefix(u.Path, "/") == "" {
+		return nil, fmt.Errorf("No path found in url %v", u.String())
+	}
+	addr := self.getAddress(u)
+	tlsconfig, err := self.getTLSConfig(opts, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	cred, err := self.getCredential(u, root)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := util.GetProxyURL(opts, "https", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Connecting to %v over HTTPS...", addr)
+
+	rawconn, err := util.DialProxy(proxy, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Don't wait forever for a server which accepts the connection but never responds
+	rawconn.SetDeadline(time.Now().Add(util.ProxyConnectTimeout))
+	tlsconn := tls.Client(rawconn, tlsconfig)
+	if err = tlsconn.Handshake(); err != nil {
+		rawconn.Close()
+		return nil, fmt.Errorf("Unable to establish a secure connection to %v: %v", addr, err.Error())
+	}
+	conn, status, err := self.upgrade(tlsconn, u, cred)
+	if err != nil {
+		if status == http.StatusUnauthorized {
+			self.reportCredential(u, root, log, cred, "reject")
+		}
+		tlsconn.Close()
+		return nil, err
+	}
+	self.reportCredential(u, root, log, cred, "approve")
+	conn.SetDeadline(time.Time{})
+
+	log.Debugf("HTTPS connection successful to %v", addr)
+
+	return NewPersistentTransport(conn), nil
+}
+
+func RegisterHttpsTransportFactory() {
+	RegisterTransportFactory(&HttpsTransportFactory{})
+}
@@ -2,10 +2,15 @@ package smart
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strings"
+
+	"github.com/atlassian/git-lob/providers"
 )
 
 // Transport implementation that uses a persistent connection to perform many
@@ -17,6 +22,10 @@ type PersistentTransport struct {
 	Connection io.ReadWriteCloser
 	// Buffered reader we use to scan for ends of JSON
 	BufferedReader *bufio.Reader
+	// Codec chunk payloads are compressed with in transit where worthwhile, if enabled
+	Compression string
+	// Whether chunk payloads are followed by size+hash trailers, see trailer.go
+	ChunkHashes bool
 }
 
 // Note *not* using net/rpc and net/rpc/jsonrpc because we want more control
@@ -43,6 +52,58 @@ type JsonResponse struct {
 	Result *json.RawMessage
 }
 
+// Structured error which a server can send in JsonResponse.Error instead of a string, so
+// that the client can recognise particular problems (older clients just print it)
+type ErrorDetail struct {
+	// Identifies the problem, see ErrorCode*
+	Code    string
+	Message string
+	// For ErrorCodeQuotaExceeded, the bytes stored & the quota
+	Used  int64 `json:",omitempty"`
+	Quota int64 `json:",omitempty"`
+}
+
+const (
+	// Upload rejected because it would take the store over a quota
+	ErrorCodeQuotaExceeded = "quota_exceeded"
+)
+
+func (e *ErrorDetail) Error() string {
+	switch e.Code {
+	case ErrorCodeQuotaExceeded:
+		return fmt.Sprintf("%v: %v", quotaExceededMessage, e.Message)
+	default:
+		return e.Message
+	}
+}
+
+// Included in errors when the server rejected an upload because of a quota
+const quotaExceededMessage = "Server storage quota exceeded"
+
+// Returns whether an error was because the server's storage quota would be exceeded
+// Nothing more can be uploaded until the server admin frees up space, so don't retry
+func IsQuotaExceededError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), quotaExceededMessage)
+}
+
+// Get the structured detail from the Error of a response, or nil if it's not structured
+func getErrorDetail(resperr interface{}) *ErrorDetail {
+	m, ok := resperr.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	// Simplest to round-trip through JSON to get the struct
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	detail := &ErrorDetail{}
+	if json.Unmarshal(b, detail) != nil || detail.Code == "" {
+		return nil
+	}
+	return detail
+}
+
 var (
 	latestRequestId int = 1
 )
@@ -96,10 +157,36 @@ func embedStructInJsonRawMessage(in interface{}) (*json.RawMessage, error) {
 
 // Create a new persistent transport & connect
 func NewPersistentTransport(conn io.ReadWriteCloser) *PersistentTransport {
+	wrapped := &connectionErrorWrapper{conn}
 	return &PersistentTransport{
-		Connection:     conn,
-		BufferedReader: bufio.NewReader(conn),
+		Connection:     wrapped,
+		BufferedReader: bufio.NewReader(wrapped),
+	}
+}
+
+// Reports failures reading from or writing to a connection as ConnectionErrors, so they can be
+// told apart from failures reading or writing local files while transferring
+type connectionErrorWrapper struct {
+	conn io.ReadWriteCloser
+}
+
+func (self *connectionErrorWrapper) Read(p []byte) (int, error) {
+	n, err := self.conn.Read(p)
+	if err != nil && err != io.EOF {
+		// EOF is left alone as readers rely on it, & it's retriable anyway
+		err = &ConnectionError{err}
 	}
+	return n, err
+}
+func (self *connectionErrorWrapper) Write(p []byte) (int, error) {
+	n, err := self.conn.Write(p)
+	if err != nil {
+		err = &ConnectionError{err}
+	}
+	return n, err
+}
+func (self *connectionErrorWrapper) Close() error {
+	return self.conn.Close()
 }
 
 type ExitRequest struct {
@@ -165,6 +252,133 @@ func (self *PersistentTransport) doJSONRequestDownload(method string, params int
 
 }
 
+// Perform a JSON request that results in a chunk payload as a response, which may be compressed
+// as agreed in prep, & download the content to out (with callbacks in content bytes if required)
+// With chunk hashes enabled the content is checked against the trailer which follows it
+func (self *PersistentTransport) doJSONRequestDownloadPayload(method string, params interface{},
+	sha string, prep *DownloadFilePrepareResponse, out io.Writer, callback TransportProgressCallback) error {
+
+	var th *TransferHash
+	if self.ChunkHashes {
+		th = NewTransferHash(sha)
+		out = io.MultiWriter(out, th)
+	}
+	if prep.Compression == "" {
+		err := self.doJSONRequestDownload(method, params, prep.Size, out, callback)
+		if err != nil {
+			return err
+		}
+		return self.receiveTransferTrailer(th)
+	}
+	req, err := NewJsonRequest(method, params)
+	if err != nil {
+		return err
+	}
+	err = self.sendJSONRequest(req)
+	if err != nil {
+		return err
+	}
+	in := &transferProgressReader{r: self.BufferedReader, transferSize: prep.TransferSize,
+		contentSize: prep.Size, callback: callback}
+	err = DecompressTransfer(prep.Compression, in, prep.TransferSize, prep.Size, out)
+	if err != nil {
+		return err
+	}
+	return self.receiveTransferTrailer(th)
+}
+
+// Hash chunk content as it's read for upload, if chunk hashes are enabled (nil hash otherwise)
+func (self *PersistentTransport) hashUploadContent(sha string, data io.Reader) (io.Reader, *TransferHash) {
+	if !self.ChunkHashes {
+		return data, nil
+	}
+	th := NewTransferHash(sha)
+	return io.TeeReader(data, th), th
+}
+
+// Send the trailer for uploaded content, if it was hashed
+func (self *PersistentTransport) sendTransferTrailer(th *TransferHash) error {
+	if th == nil {
+		return nil
+	}
+	return WriteTransferTrailer(self.Connection, th.Trailer())
+}
+
+// Read the trailer which follows downloaded content & check it, if it was hashed
+func (self *PersistentTransport) receiveTransferTrailer(th *TransferHash) error {
+	if th == nil {
+		return nil
+	}
+	trailer, err := ReadTransferTrailer(self.BufferedReader)
+	if err != nil {
+		return err
+	}
+	return th.Verify(trailer)
+}
+
+// Get the payload to upload for content, compressing it if enabled & worthwhile, in which case
+// params are updated to say so. The callback returned reports progress in content bytes.
+// Call cleanup once the payload has been sent
+func (self *PersistentTransport) prepareUploadPayload(params *UploadFileRequest, data io.Reader,
+	callback TransportProgressCallback) (payload io.Reader, payloadSize int64,
+	payloadCallback TransportProgressCallback, cleanup func(), err error) {
+
+	nothing := func() {}
+	if self.Compression == "" || params.Size < TransferCompressionMinSize {
+		return data, params.Size, callback, nothing, nil
+	}
+	// Only the start of a stream can be sampled
+	sample := make([]byte, transferCompressionSampleSize)
+	if int64(len(sample)) > params.Size {
+		sample = sample[:params.Size]
+	}
+	n, err := io.ReadFull(data, sample)
+	if err != nil {
+		return nil, 0, nil, nothing, err
+	}
+	data = io.MultiReader(bytes.NewReader(sample[:n]), data)
+	if !isWorthCompressing(sample[:n]) {
+		return data, params.Size, callback, nothing, nil
+	}
+	f, sz, err := CompressToTempFile(self.Compression, io.LimitReader(data, params.Size))
+	if err != nil {
+		return nil, 0, nil, nothing, err
+	}
+	params.Compression = self.Compression
+	params.TransferSize = sz
+	contentSize := params.Size
+	payloadCallback = func(bytesDone, totalBytes int64) {
+		if callback != nil && totalBytes > 0 {
+			callback(bytesDone*contentSize/totalBytes, contentSize)
+		}
+	}
+	cleanup = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return f, sz, payloadCallback, cleanup, nil
+}
+
+// Reader which reports progress through a compressed payload in content bytes
+type transferProgressReader struct {
+	r            io.Reader
+	transferSize int64
+	contentSize  int64
+	done         int64
+	callback     TransportProgressCallback
+}
+
+func (self *transferProgressReader) Read(p []byte) (int, error) {
+	n, err := self.r.Read(p)
+	if n > 0 {
+		self.done += int64(n)
+		if self.callback != nil && self.transferSize > 0 {
+			self.callback(self.done*self.contentSize/self.transferSize, self.contentSize)
+		}
+	}
+	return n, err
+}
+
 // Late-bind a method-specific structure from the raw message
 func ExtractStructFromJsonRawMessage(raw *json.RawMessage, out interface{}) error {
 	nestedbytes, err := raw.MarshalJSON()
@@ -193,7 +407,7 @@ func (self *PersistentTransport) sendJSONRequest(req interface{}) error {
 	reqbytes = append(reqbytes, byte(0))
 	_, err = self.Connection.Write(reqbytes)
 	if err != nil {
-		return fmt.Errorf("Error writing request bytes to connection: %v", err.Error())
+		return fmt.Errorf("Error writing request bytes to connection: %w", err)
 	}
 
 	return nil
@@ -202,14 +416,14 @@ func (self *PersistentTransport) sendJSONRequest(req interface{}) error {
 func (self *PersistentTransport) readJSONResponse() (*JsonResponse, error) {
 	jsonbytes, err := self.BufferedReader.ReadBytes(byte(0))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to read response from server: %v", err.Error())
+		return nil, &ConnectionError{fmt.Errorf("Unable to read response from server: %w", err)}
 	}
 	// remove terminator before unmarshalling
 	jsonbytes = jsonbytes[:len(jsonbytes)-1]
 	response := &JsonResponse{}
 	err = json.Unmarshal(jsonbytes, response)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to decode JSON response from server: %v\n%v", string(jsonbytes), err.Error())
+		return nil, &ConnectionError{fmt.Errorf("Unable to decode JSON response from server: %v\n%v", string(jsonbytes), err.Error())}
 	}
 	return response, nil
 }
@@ -217,10 +431,14 @@ func (self *PersistentTransport) readJSONResponse() (*JsonResponse, error) {
 // Check a response object; req can be nil, if so doesn't check that Ids match
 func (self *PersistentTransport) checkJSONResponse(req *JsonRequest, resp *JsonResponse) error {
 	if resp.Error != nil {
-		return fmt.Errorf("Error response from server: %v", resp.Error)
+		if detail := getErrorDetail(resp.Error); detail != nil {
+			return &ServerError{fmt.Sprintf("Error response from server: %v", detail.Error())}
+		}
+		return &ServerError{fmt.Sprintf("Error response from server: %v", resp.Error)}
 	}
 	if req != nil && req.Id != resp.Id {
-		return fmt.Errorf("Response from server has wrong Id, request: %d response: %d", req.Id, resp.Id)
+		// Out of step with the server, so this connection is no use
+		return &ConnectionError{fmt.Errorf("Response from server has wrong Id, request: %d response: %d", req.Id, resp.Id)}
 	}
 	return nil
 }
@@ -274,7 +492,7 @@ func (self *PersistentTransport) sendRawData(sz int64, source io.Reader, callbac
 		}
 	}
 	if copysize != sz {
-		return fmt.Errorf("Transferred bytes did not match expected size; transferred %d, expected %d", copysize, sz)
+		return &ConnectionError{fmt.Errorf("Transferred bytes did not match expected size; transferred %d, expected %d", copysize, sz)}
 	}
 
 	return nil
@@ -306,14 +524,34 @@ func (self *PersistentTransport) receiveRawData(sz int64, out io.Writer, callbac
 		}
 	}
 	if copysize != sz {
-		return fmt.Errorf("Transferred bytes did not match expected size; transferred %d, expected %d", copysize, sz)
+		return &ConnectionError{fmt.Errorf("Transferred bytes did not match expected size; transferred %d, expected %d", copysize, sz)}
 	}
 
 	return nil
 }
 
-// Just a specially identified persistent connection error so we can re-try
-type ConnectionError error
+// The connection failed, or what was sent over it didn't arrive intact, so the request may
+// succeed if tried again on a new connection
+type ConnectionError struct {
+	Err error
+}
+
+func (self *ConnectionError) Error() string {
+	return self.Err.Error()
+}
+func (self *ConnectionError) Unwrap() error {
+	return self.Err
+}
+
+// An error the server deliberately responded with (e.g. permissions), which won't be any
+// different if the request is tried again
+type ServerError struct {
+	Message string
+}
+
+func (self *ServerError) Error() string {
+	return self.Message
+}
 
 type QueryCapsRequest struct {
 }
@@ -333,6 +571,30 @@ func (self *PersistentTransport) QueryCaps() ([]string, error) {
 	return resp.Caps, nil
 }
 
+type NegotiateRequest struct {
+	// Protocol version the client speaks
+	ProtocolVersion int
+	// Features the client would like to use, in order of preference
+	Features []string
+}
+type NegotiateResponse struct {
+	// Protocol version both speak
+	ProtocolVersion int
+	// Features the server has enabled
+	Features []string
+}
+
+// Agree a protocol version & which features to use with the server
+func (self *PersistentTransport) Negotiate(version int, features []string) (int, []string, error) {
+	params := NegotiateRequest{ProtocolVersion: version, Features: features}
+	resp := NegotiateResponse{}
+	err := self.doFullJSONRequestResponse("Negotiate", &params, &resp)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.ProtocolVersion, resp.Features, nil
+}
+
 type SetEnabledCapsRequest struct {
 	EnableCaps []string
 }
@@ -350,6 +612,16 @@ func (self *PersistentTransport) SetEnabledCaps(caps []string) error {
 	return nil
 }
 
+// Compress chunk & chunk object payloads with this codec where worthwhile ("" to stop)
+func (self *PersistentTransport) SetTransferCompression(codec string) {
+	self.Compression = codec
+}
+
+// Send & expect trailers with chunk & chunk object content (or stop)
+func (self *PersistentTransport) SetChunkHashes(enabled bool) {
+	self.ChunkHashes = enabled
+}
+
 type FileExistsRequest struct {
 	LobSHA   string
 	Type     string
@@ -441,6 +713,9 @@ type UploadFileRequest struct {
 	Type     string
 	ChunkIdx int
 	Size     int64
+	// If set the content is sent compressed with this codec, in TransferSize bytes
+	Compression  string `json:",omitempty"`
+	TransferSize int64  `json:",omitempty"`
 }
 type UploadFileStartResponse struct {
 	OKToSend bool
@@ -459,26 +734,26 @@ func (self *PersistentTransport) UploadMetadata(lobsha string, sz int64, data io
 	resp := UploadFileStartResponse{}
 	err := self.doFullJSONRequestResponse("UploadFile", &params, &resp)
 	if err != nil {
-		return fmt.Errorf("Error while uploading metadata for %v (while sending UploadFile JSON request): %v", lobsha, err.Error())
+		return fmt.Errorf("Error while uploading metadata for %v (while sending UploadFile JSON request): %w", lobsha, err)
 	}
 	if resp.OKToSend {
 		// Send that data (all at once, metafiles aren't big)
 		err = self.sendRawData(sz, data, nil)
 		if err != nil {
-			return fmt.Errorf("Error while uploading metadata for %v (while sending raw content): %v", lobsha, err.Error())
+			return fmt.Errorf("Error while uploading metadata for %v (while sending raw content): %w", lobsha, err)
 		}
 		// Now read response to sent data
 		received := UploadFileCompleteResponse{}
 		err = self.readFullJSONResponse(nil, &received)
 		if err != nil {
-			return fmt.Errorf("Error while uploading metadata for %v (response to raw content): %v", lobsha, err.Error())
+			return fmt.Errorf("Error while uploading metadata for %v (response to raw content): %w", lobsha, err)
 		}
 		if !received.ReceivedOK {
-			return fmt.Errorf("Data not fully received while uploading metadata for %v: Unknown server error", lobsha)
+			return &ConnectionError{fmt.Errorf("Data not fully received while uploading metadata for %v: Unknown server error", lobsha)}
 		}
 
 	} else {
-		return fmt.Errorf("Server rejected request to upload metadata for %v (no other error)", lobsha)
+		return &ServerError{fmt.Sprintf("Server rejected request to upload metadata for %v (no other error)", lobsha)}
 	}
 	return nil
 }
@@ -491,29 +766,39 @@ func (self *PersistentTransport) UploadChunk(lobsha string, chunk int, sz int64,
 		ChunkIdx: chunk,
 		Size:     sz,
 	}
+	data, th := self.hashUploadContent(lobsha, data)
+	payload, payloadSize, callback, cleanup, err := self.prepareUploadPayload(&params, data, callback)
+	if err != nil {
+		return fmt.Errorf("Error while uploading chunk %d for %v (while compressing): %w", chunk, lobsha, err)
+	}
+	defer cleanup()
 	resp := UploadFileStartResponse{}
-	err := self.doFullJSONRequestResponse("UploadFile", &params, &resp)
+	err = self.doFullJSONRequestResponse("UploadFile", &params, &resp)
 	if err != nil {
-		return fmt.Errorf("Error while uploading chunk %d for %v (while sending UploadFile JSON request): %v", chunk, lobsha, err.Error())
+		return fmt.Errorf("Error while uploading chunk %d for %v (while sending UploadFile JSON request): %w", chunk, lobsha, err)
 	}
 	if resp.OKToSend {
 		// Send data, this does it in batches and calls back
-		err = self.sendRawData(sz, data, callback)
+		err = self.sendRawData(payloadSize, payload, callback)
+		if err != nil {
+			return fmt.Errorf("Error while uploading chunk %d for %v (while sending raw content): %w", chunk, lobsha, err)
+		}
+		err = self.sendTransferTrailer(th)
 		if err != nil {
-			return fmt.Errorf("Error while uploading chunk %d for %v (while sending raw content): %v", chunk, lobsha, err.Error())
+			return fmt.Errorf("Error while uploading chunk %d for %v (while sending trailer): %w", chunk, lobsha, err)
 		}
 		// Now read response to sent data
 		received := UploadFileCompleteResponse{}
 		err = self.readFullJSONResponse(nil, &received)
 		if err != nil {
-			return fmt.Errorf("Error while uploading chunk %d for %v (response to raw content): %v", chunk, lobsha, err.Error())
+			return fmt.Errorf("Error while uploading chunk %d for %v (response to raw content): %w", chunk, lobsha, err)
 		}
 		if !received.ReceivedOK {
-			return fmt.Errorf("Data not fully received while uploading chunk %d for %v: Unknown server error", chunk, lobsha)
+			return &ConnectionError{fmt.Errorf("Data not fully received while uploading chunk %d for %v: Unknown server error", chunk, lobsha)}
 		}
 
 	} else {
-		return fmt.Errorf("Server rejected request to upload chunk %d for %v (no other error)", chunk, lobsha)
+		return &ServerError{fmt.Sprintf("Server rejected request to upload chunk %d for %v (no other error)", chunk, lobsha)}
 	}
 	return nil
 }
@@ -522,15 +807,23 @@ type DownloadFilePrepareRequest struct {
 	LobSHA   string
 	Type     string
 	ChunkIdx int
+	// Codec the client would like the content compressed with, if the server thinks it's worth it
+	Compression string `json:",omitempty"`
 }
 type DownloadFilePrepareResponse struct {
 	Size int64
+	// If set the content will be sent compressed with this codec, in TransferSize bytes
+	Compression  string `json:",omitempty"`
+	TransferSize int64  `json:",omitempty"`
 }
 type DownloadFileStartRequest struct {
 	LobSHA   string
 	Type     string
 	ChunkIdx int
 	Size     int64
+	// As returned from DownloadFilePrepare
+	Compression  string `json:",omitempty"`
+	TransferSize int64  `json:",omitempty"`
 }
 
 // Download metadata for a LOB (to a stream); no progress callback as very small
@@ -542,7 +835,7 @@ func (self *PersistentTransport) DownloadMetadata(lobsha string, out io.Writer)
 	resp := DownloadFilePrepareResponse{}
 	err := self.doFullJSONRequestResponse("DownloadFilePrepare", &prepparams, &resp)
 	if err != nil {
-		return fmt.Errorf("Error while downloading metadata for %v (while sending DownloadFilePrepare JSON request): %v", lobsha, err.Error())
+		return fmt.Errorf("Error while downloading metadata for %v (while sending DownloadFilePrepare JSON request): %w", lobsha, err)
 	}
 	startparams := DownloadFileStartRequest{
 		LobSHA: lobsha,
@@ -553,42 +846,241 @@ func (self *PersistentTransport) DownloadMetadata(lobsha string, out io.Writer)
 	// Response is just raw byte data - no callback as small enough not to need one
 	err = self.doJSONRequestDownload("DownloadFileStart", &startparams, resp.Size, out, nil)
 	if err != nil {
-		return fmt.Errorf("Error while downloading metadata for %v (during download): %v", lobsha, err.Error())
+		return fmt.Errorf("Error while downloading metadata for %v (during download): %w", lobsha, err)
 	}
 
 	return nil
 }
 
+type DownloadMetadataBatchRequest struct {
+	LobSHAs []string
+}
+type DownloadMetadataBatchResponse struct {
+	// Size of the metadata for each LOB in the order requested, -1 if the server doesn't have it
+	// The metadata follows the response as raw bytes, concatenated in the same order
+	Sizes []int64
+}
+
+// Download the metadata for many LOBs in one request, keyed by SHA; those the server doesn't
+// have are left out
+func (self *PersistentTransport) DownloadMetadataBatch(lobshas []string) (map[string][]byte, error) {
+	params := DownloadMetadataBatchRequest{lobshas}
+	req, err := NewJsonRequest("DownloadMetadataBatch", &params)
+	if err != nil {
+		return nil, err
+	}
+	err = self.sendJSONRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error while downloading metadata batch (while sending JSON request): %w", err)
+	}
+	resp := DownloadMetadataBatchResponse{}
+	err = self.readFullJSONResponse(req, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Error while downloading metadata batch: %w", err)
+	}
+	if len(resp.Sizes) != len(lobshas) {
+		// Can't tell how much data follows, so the connection can't be used any more
+		return nil, fmt.Errorf("Error while downloading metadata batch: server sent %d sizes for %d LOBs", len(resp.Sizes), len(lobshas))
+	}
+	ret := make(map[string][]byte, len(lobshas))
+	for i, sz := range resp.Sizes {
+		if sz < 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		err = self.receiveRawData(sz, &buf, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Error while downloading metadata for %v (during batch download): %w", lobshas[i], err)
+		}
+		ret[lobshas[i]] = buf.Bytes()
+	}
+	return ret, nil
+}
+
 // Download chunk content for a LOB (from a stream); must call back progress
 // This is a non-delta download operation, just provide entire chunk content
 func (self *PersistentTransport) DownloadChunk(lobsha string, chunk int, out io.Writer, callback TransportProgressCallback) error {
 	prepparams := DownloadFilePrepareRequest{
-		LobSHA:   lobsha,
-		Type:     "chunk",
-		ChunkIdx: chunk,
+		LobSHA:      lobsha,
+		Type:        "chunk",
+		ChunkIdx:    chunk,
+		Compression: self.Compression,
 	}
 	resp := DownloadFilePrepareResponse{}
 	err := self.doFullJSONRequestResponse("DownloadFilePrepare", &prepparams, &resp)
 	if err != nil {
-		return fmt.Errorf("Error while downloading chunk %d for %v (while sending DownloadFilePrepare JSON request): %v", chunk, lobsha, err.Error())
+		return fmt.Errorf("Error while downloading chunk %d for %v (while sending DownloadFilePrepare JSON request): %w", chunk, lobsha, err)
 	}
 	startparams := DownloadFileStartRequest{
-		LobSHA:   lobsha,
-		Type:     "chunk",
-		ChunkIdx: chunk,
-		Size:     resp.Size,
+		LobSHA:       lobsha,
+		Type:         "chunk",
+		ChunkIdx:     chunk,
+		Size:         resp.Size,
+		Compression:  resp.Compression,
+		TransferSize: resp.TransferSize,
 	}
 
-	// Response is just raw byte data - no callback as small enough not to need one
-	err = self.doJSONRequestDownload("DownloadFileStart", &startparams, resp.Size, out, callback)
+	// Response is just raw byte data
+	err = self.doJSONRequestDownloadPayload("DownloadFileStart", &startparams, lobsha, &resp, out, callback)
 	if err != nil {
-		return fmt.Errorf("Error while downloading chunk %d for %v (during download): %v", chunk, lobsha, err.Error())
+		return fmt.Errorf("Error while downloading chunk %d for %v (during download): %w", chunk, lobsha, err)
 	}
 
 	return nil
 
 }
 
+// Return whether a chunk object exists on the server
+// Chunk objects use the same requests as other files, with Type "object" & the chunk SHA in LobSHA
+func (self *PersistentTransport) ChunkObjectExists(chunksha string) (bool, int64, error) {
+	params := FileExistsRequest{
+		LobSHA: chunksha,
+		Type:   "object",
+	}
+	resp := FileExistsResponse{}
+	err := self.doFullJSONRequestResponse("FileExists", &params, &resp)
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.Exists, resp.Size, nil
+}
+
+// Upload a chunk object (from a stream); must call back progress
+func (self *PersistentTransport) UploadChunkObject(chunksha string, sz int64, data io.Reader, callback TransportProgressCallback) error {
+	params := UploadFileRequest{
+		LobSHA: chunksha,
+		Type:   "object",
+		Size:   sz,
+	}
+	data, th := self.hashUploadContent(chunksha, data)
+	payload, payloadSize, callback, cleanup, err := self.prepareUploadPayload(&params, data, callback)
+	if err != nil {
+		return fmt.Errorf("Error while uploading chunk object %v (while compressing): %w", chunksha, err)
+	}
+	defer cleanup()
+	resp := UploadFileStartResponse{}
+	err = self.doFullJSONRequestResponse("UploadFile", &params, &resp)
+	if err != nil {
+		return fmt.Errorf("Error while uploading chunk object %v (while sending UploadFile JSON request): %w", chunksha, err)
+	}
+	if !resp.OKToSend {
+		return &ServerError{fmt.Sprintf("Server rejected request to upload chunk object %v (no other error)", chunksha)}
+	}
+	// Send data, this does it in batches and calls back
+	err = self.sendRawData(payloadSize, payload, callback)
+	if err != nil {
+		return fmt.Errorf("Error while uploading chunk object %v (while sending raw content): %w", chunksha, err)
+	}
+	err = self.sendTransferTrailer(th)
+	if err != nil {
+		return fmt.Errorf("Error while uploading chunk object %v (while sending trailer): %w", chunksha, err)
+	}
+	// Now read response to sent data
+	received := UploadFileCompleteResponse{}
+	err = self.readFullJSONResponse(nil, &received)
+	if err != nil {
+		return fmt.Errorf("Error while uploading chunk object %v (response to raw content): %w", chunksha, err)
+	}
+	if !received.ReceivedOK {
+		return &ConnectionError{fmt.Errorf("Data not fully received while uploading chunk object %v: Unknown server error", chunksha)}
+	}
+	return nil
+}
+
+// Download a chunk object (to a stream); must call back progress
+func (self *PersistentTransport) DownloadChunkObject(chunksha string, out io.Writer, callback TransportProgressCallback) error {
+	prepparams := DownloadFilePrepareRequest{
+		LobSHA:      chunksha,
+		Type:        "object",
+		Compression: self.Compression,
+	}
+	resp := DownloadFilePrepareResponse{}
+	err := self.doFullJSONRequestResponse("DownloadFilePrepare", &prepparams, &resp)
+	if err != nil {
+		return fmt.Errorf("Error while downloading chunk object %v (while sending DownloadFilePrepare JSON request): %w", chunksha, err)
+	}
+	startparams := DownloadFileStartRequest{
+		LobSHA:       chunksha,
+		Type:         "object",
+		Size:         resp.Size,
+		Compression:  resp.Compression,
+		TransferSize: resp.TransferSize,
+	}
+	err = self.doJSONRequestDownloadPayload("DownloadFileStart", &startparams, chunksha, &resp, out, callback)
+	if err != nil {
+		return fmt.Errorf("Error while downloading chunk object %v (during download): %w", chunksha, err)
+	}
+	return nil
+}
+
+// Return whether there's a preview of a LOB on the server
+// Previews use the same requests as metadata, with Type "preview"
+func (self *PersistentTransport) PreviewExists(lobsha string) (bool, int64, error) {
+	params := FileExistsRequest{
+		LobSHA: lobsha,
+		Type:   "preview",
+	}
+	resp := FileExistsResponse{}
+	err := self.doFullJSONRequestResponse("FileExists", &params, &resp)
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.Exists, resp.Size, nil
+}
+
+// Upload the preview of a LOB (from a stream); no progress callback as small
+func (self *PersistentTransport) UploadPreview(lobsha string, sz int64, data io.Reader) error {
+	params := UploadFileRequest{
+		LobSHA: lobsha,
+		Type:   "preview",
+		Size:   sz,
+	}
+	resp := UploadFileStartResponse{}
+	err := self.doFullJSONRequestResponse("UploadFile", &params, &resp)
+	if err != nil {
+		return fmt.Errorf("Error while uploading preview for %v (while sending UploadFile JSON request): %w", lobsha, err)
+	}
+	if !resp.OKToSend {
+		return &ServerError{fmt.Sprintf("Server rejected request to upload preview for %v (no other error)", lobsha)}
+	}
+	err = self.sendRawData(sz, data, nil)
+	if err != nil {
+		return fmt.Errorf("Error while uploading preview for %v (while sending raw content): %w", lobsha, err)
+	}
+	received := UploadFileCompleteResponse{}
+	err = self.readFullJSONResponse(nil, &received)
+	if err != nil {
+		return fmt.Errorf("Error while uploading preview for %v (response to raw content): %w", lobsha, err)
+	}
+	if !received.ReceivedOK {
+		return &ConnectionError{fmt.Errorf("Data not fully received while uploading preview for %v: Unknown server error", lobsha)}
+	}
+	return nil
+}
+
+// Download the preview of a LOB (to a stream); no progress callback as small
+func (self *PersistentTransport) DownloadPreview(lobsha string, out io.Writer) error {
+	prepparams := DownloadFilePrepareRequest{
+		LobSHA: lobsha,
+		Type:   "preview",
+	}
+	resp := DownloadFilePrepareResponse{}
+	err := self.doFullJSONRequestResponse("DownloadFilePrepare", &prepparams, &resp)
+	if err != nil {
+		return fmt.Errorf("Error while downloading preview for %v (while sending DownloadFilePrepare JSON request): %w", lobsha, err)
+	}
+	startparams := DownloadFileStartRequest{
+		LobSHA: lobsha,
+		Type:   "preview",
+		Size:   resp.Size,
+	}
+	err = self.doJSONRequestDownload("DownloadFileStart", &startparams, resp.Size, out, nil)
+	if err != nil {
+		return fmt.Errorf("Error while downloading preview for %v (during download): %w", lobsha, err)
+	}
+	return nil
+}
+
 type GetFirstCompleteLOBFromListRequest struct {
 	LobSHAs []string
 }
@@ -605,11 +1097,111 @@ func (self *PersistentTransport) GetFirstCompleteLOBFromList(candidateSHAs []str
 	resp := GetFirstCompleteLOBFromListResponse{}
 	err := self.doFullJSONRequestResponse("PickCompleteLOB", &params, &resp)
 	if err != nil {
-		return "", fmt.Errorf("Error asking server for first LOB from list %v: %v", candidateSHAs, err.Error())
+		return "", fmt.Errorf("Error asking server for first LOB from list %v: %w", candidateSHAs, err)
 	}
 	return resp.FirstSHA, nil
 }
 
+type ListLOBsRequest struct {
+}
+type ListLOBsResponse struct {
+	LobSHAs []string
+}
+
+// Return the SHAs of all LOBs the server has any files for (complete or not)
+func (self *PersistentTransport) ListLOBs() ([]string, error) {
+	params := ListLOBsRequest{}
+	resp := ListLOBsResponse{}
+	err := self.doFullJSONRequestResponse("ListLOBs", &params, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Error asking server for list of LOBs: %w", err)
+	}
+	return resp.LobSHAs, nil
+}
+
+type PruneLOBsRequest struct {
+	LobSHAs []string
+	DryRun  bool
+}
+type PruneLOBsResponse struct {
+	// LOBs which were deleted (or would have been, if DryRun)
+	Deleted []string
+	// LOBs which the server chose to keep
+	Retained []string
+	// LOBs which the server must keep because they're under a retention hold
+	Held []string
+	// Total size of the files deleted
+	DeletedSize int64
+}
+
+// Ask the server to delete LOBs. Server may retain some anyway (e.g. uploaded recently), and
+// must keep those under a retention hold
+func (self *PersistentTransport) PruneLOBs(shas []string, dryRun bool) (deleted, retained, held []string, e error) {
+	params := PruneLOBsRequest{shas, dryRun}
+	resp := PruneLOBsResponse{}
+	err := self.doFullJSONRequestResponse("PruneLOBs", &params, &resp)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Error asking server to prune LOBs: %w", err)
+	}
+	return resp.Deleted, resp.Retained, resp.Held, nil
+}
+
+type LockFileRequest struct {
+	Path string
+}
+type LockFileResponse struct {
+	Lock *providers.FileLock
+}
+
+// Lock a file path for the connected user
+func (self *PersistentTransport) LockFile(path string) (*providers.FileLock, error) {
+	params := LockFileRequest{path}
+	resp := LockFileResponse{}
+	err := self.doFullJSONRequestResponse("LockFile", &params, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Error locking %v: %w", path, err)
+	}
+	if resp.Lock == nil {
+		return nil, fmt.Errorf("Error locking %v: server did not return the lock", path)
+	}
+	return resp.Lock, nil
+}
+
+type UnlockFileRequest struct {
+	Path  string
+	Force bool
+}
+type UnlockFileResponse struct {
+}
+
+// Release a lock on a file path
+func (self *PersistentTransport) UnlockFile(path string, force bool) error {
+	params := UnlockFileRequest{path, force}
+	resp := UnlockFileResponse{}
+	err := self.doFullJSONRequestResponse("UnlockFile", &params, &resp)
+	if err != nil {
+		return fmt.Errorf("Error unlocking %v: %w", path, err)
+	}
+	return nil
+}
+
+type ListLocksRequest struct {
+}
+type ListLocksResponse struct {
+	Locks []*providers.FileLock
+}
+
+// Return all the locks held on the server
+func (self *PersistentTransport) ListLocks() ([]*providers.FileLock, error) {
+	params := ListLocksRequest{}
+	resp := ListLocksResponse{}
+	err := self.doFullJSONRequestResponse("ListLocks", &params, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Error asking server for list of locks: %w", err)
+	}
+	return resp.Locks, nil
+}
+
 type UploadDeltaRequest struct {
 	BaseLobSHA   string
 	TargetLobSHA string
@@ -638,7 +1230,7 @@ func (self *PersistentTransport) UploadDelta(baseSHA, targetSHA string, deltaSiz
 	resp := UploadDeltaStartResponse{}
 	err := self.doFullJSONRequestResponse("UploadDelta", &params, &resp)
 	if err != nil {
-		return false, fmt.Errorf("Error calling UploadDelta JSON request from %v to %v: %v", baseSHA, targetSHA, err.Error())
+		return false, fmt.Errorf("Error calling UploadDelta JSON request from %v to %v: %w", baseSHA, targetSHA, err)
 	}
 	// Server can opt not to accept the delta, caller should fall back to simpler upload if so
 	var sentOK bool
@@ -646,16 +1238,16 @@ func (self *PersistentTransport) UploadDelta(baseSHA, targetSHA string, deltaSiz
 		// Send data, this does it in batches and calls back
 		err = self.sendRawData(deltaSize, data, callback)
 		if err != nil {
-			return false, fmt.Errorf("Error uploading delta content from %v to %v: %v", baseSHA, targetSHA, err.Error())
+			return false, fmt.Errorf("Error uploading delta content from %v to %v: %w", baseSHA, targetSHA, err)
 		}
 		// Now read response to sent data
 		received := UploadDeltaCompleteResponse{}
 		err = self.readFullJSONResponse(nil, &received)
 		if err != nil {
-			return false, fmt.Errorf("Error in UploadDelta from %v to %v (response to raw content): %v", baseSHA, targetSHA, err.Error())
+			return false, fmt.Errorf("Error in UploadDelta from %v to %v (response to raw content): %w", baseSHA, targetSHA, err)
 		}
 		if !received.ReceivedOK {
-			return false, fmt.Errorf("Data not fully received in UploadDelta from %v to %v: Unknown server error", baseSHA, targetSHA)
+			return false, &ConnectionError{fmt.Errorf("Data not fully received in UploadDelta from %v to %v: Unknown server error", baseSHA, targetSHA)}
 		}
 		sentOK = true
 
@@ -685,7 +1277,7 @@ func (self *PersistentTransport) DownloadDeltaPrepare(baseSHA, targetSHA string)
 	resp := DownloadDeltaPrepareResponse{}
 	err := self.doFullJSONRequestResponse("DownloadDeltaPrepare", &prepparams, &resp)
 	if err != nil {
-		return 0, fmt.Errorf("Error in DownloadDeltaPrepare from %v to %v: %v", baseSHA, targetSHA, err.Error())
+		return 0, fmt.Errorf("Error in DownloadDeltaPrepare from %v to %v: %w", baseSHA, targetSHA, err)
 	}
 	return resp.Size, nil
 }
@@ -712,7 +1304,7 @@ func (self *PersistentTransport) DownloadDelta(baseSHA, targetSHA string, sizeLi
 	// Response is just raw byte data - no callback as small enough not to need one
 	err = self.doJSONRequestDownload("DownloadDeltaStart", &startparams, sz, out, callback)
 	if err != nil {
-		return false, fmt.Errorf("Error while downloading LOB delta from %v to %v: %v", baseSHA, targetSHA, err.Error())
+		return false, fmt.Errorf("Error while downloading LOB delta from %v to %v: %w", baseSHA, targetSHA, err)
 	}
 	// It's up to the caller to apply the delta
 	return true, nil
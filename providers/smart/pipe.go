@@ -0,0 +1,90 @@
+package smart
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// factory for creating connections through a custom command, for tunnels which aren't SSH
+// URLs are of the form pipe:path/to/repo; the command is taken from GIT_LOB_PIPE or
+// git-lob.pipe-command and is called with the path as its last argument. The command
+// must connect its stdin/stdout to a smart server serving that path, e.g. git-lob-serve
+type PipeTransportFactory struct {
+}
+
+// Get the path to pass to the command from a pipe: URL
+func (*PipeTransportFactory) getPath(u *url.URL) string {
+	// pipe:path/to/repo is stored in Opaque, pipe://host/path in Host & Path
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
+
+// Get the command to run for pipe: URLs, GIT_LOB_PIPE overrides config like GIT_SSH
+func (*PipeTransportFactory) getCommand(opts *util.Options) string {
+	if cmd := os.Getenv("GIT_LOB_PIPE"); cmd != "" {
+		return cmd
+	}
+	return opts.PipeCommand
+}
+
+// Build the command line; the command is run through the shell so it can include arguments,
+// but the path is passed as a separate argument so it isn't interpreted by the shell
+func (self *PipeTransportFactory) buildCommand(command, path string) (*exec.Cmd, error) {
+	if runtime.GOOS == "windows" {
+		if err := checkWindowsShellArg(path); err != nil {
+			return nil, err
+		}
+	}
+	return newShellCommandWithArg(command, path), nil
+}
+
+// Check that an argument can be passed safely in double quotes to cmd.exe, which still expands
+// %VAR% within them & has no way to escape a double quote
+func checkWindowsShellArg(arg string) error {
+	if strings.ContainsAny(arg, "\"%\r\n") {
+		return fmt.Errorf("Path %q contains characters which can't be passed to the pipe command", arg)
+	}
+	return nil
+}
+
+func (self *PipeTransportFactory) WillHandleUrl(u *url.URL) bool {
+	return u.Scheme == "pipe"
+}
+func (self *PipeTransportFactory) Connect(u *url.URL, root string, opts *util.Options, log *util.Logger) (Transport, error) {
+	command := strings.TrimSpace(self.getCommand(opts))
+	if command == "" {
+		return nil, fmt.Errorf("No command configured for %v, set git-lob.pipe-command or GIT_LOB_PIPE", u.String())
+	}
+	path := self.getPath(u)
+	if path == "" {
+		return nil, fmt.Errorf("No path found in url %v", u.String())
+	}
+
+	log.Debugf("Pipe command is: %v %v", command, path)
+
+	cmd, err := self.buildCommand(command, path)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := StartCommandConnection(cmd, "pipe")
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Pipe command started for %v", path)
+
+	return NewPersistentTransport(conn), nil
+
+}
+
+func RegisterPipeTransportFactory() {
+	RegisterTransportFactory(&PipeTransportFactory{})
+}
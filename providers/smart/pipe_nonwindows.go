@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package smart
+
+import (
+	"os/exec"
+)
+
+// Run command through the shell with arg after it
+func newShellCommandWithArg(command, arg string) *exec.Cmd {
+	// "$@" passes arg without any further interpretation by the shell
+	return exec.Command("sh", "-c", command+` "$@"`, command, arg)
+}
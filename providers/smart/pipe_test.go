@@ -0,0 +1,79 @@
+package smart
+
+import (
+	"net/url"
+	"os"
+	"runtime"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Pipe", func() {
+
+	factory := &PipeTransportFactory{}
+	It("Handles pipe URLs", func() {
+		u, err := url.Parse("pipe:team/binaries")
+		Expect(err).To(BeNil())
+		Expect(factory.WillHandleUrl(u)).To(BeTrue(), "Should handle pipe URL")
+		Expect(factory.getPath(u)).To(Equal("team/binaries"))
+		u, _ = url.Parse("pipe://team/binaries")
+		Expect(factory.WillHandleUrl(u)).To(BeTrue(), "Should handle pipe URL")
+		Expect(factory.getPath(u)).To(Equal("team/binaries"))
+		u, _ = url.Parse("ssh://git@host.com/team/binaries")
+		Expect(factory.WillHandleUrl(u)).To(BeFalse(), "Should not handle SSH URL")
+	})
+
+	It("Gets the command from the environment or config", func() {
+		oldcmd := util.GlobalOptions.PipeCommand
+		oldenv := os.Getenv("GIT_LOB_PIPE")
+		defer func() {
+			util.GlobalOptions.PipeCommand = oldcmd
+			os.Setenv("GIT_LOB_PIPE", oldenv)
+		}()
+		os.Setenv("GIT_LOB_PIPE", "")
+		util.GlobalOptions.PipeCommand = ""
+		u, _ := url.Parse("pipe:team/binaries")
+		_, err := factory.Connect(u, "", util.GlobalOptions, util.DefaultLogger)
+		Expect(err).ToNot(BeNil(), "Should fail with no command")
+		util.GlobalOptions.PipeCommand = "fromconfig"
+		Expect(factory.getCommand(util.GlobalOptions)).To(Equal("fromconfig"))
+		os.Setenv("GIT_LOB_PIPE", "fromenv")
+		Expect(factory.getCommand(util.GlobalOptions)).To(Equal("fromenv"), "Environment should override config")
+	})
+
+	It("Refuses paths cmd.exe would interpret", func() {
+		Expect(checkWindowsShellArg(`team/binaries with space & more`)).To(BeNil(), "Quoted path is safe")
+		Expect(checkWindowsShellArg(`team/" & calc & "`)).ToNot(BeNil(), "Quotes would end the argument")
+		Expect(checkWindowsShellArg(`team/%PATH%`)).ToNot(BeNil(), "Variables are expanded inside quotes")
+		Expect(checkWindowsShellArg("team/a\nb")).ToNot(BeNil())
+	})
+
+	It("Talks to the command over stdin/stdout", func() {
+		if runtime.GOOS == "windows" {
+			// Needs a POSIX shell
+			return
+		}
+		oldcmd := util.GlobalOptions.PipeCommand
+		defer func() { util.GlobalOptions.PipeCommand = oldcmd }()
+		os.Setenv("GIT_LOB_PIPE", "")
+		// Echo the path back, then echo everything we send
+		util.GlobalOptions.PipeCommand = `f() { echo "$1"; cat; }; f`
+		u, _ := url.Parse("pipe:team/binaries with space")
+		trans, err := factory.Connect(u, "", util.GlobalOptions, util.DefaultLogger)
+		Expect(err).To(BeNil(), "Should start command")
+		conn := trans.(*PersistentTransport).Connection
+		buf := make([]byte, 256)
+		n, err := conn.Read(buf)
+		Expect(err).To(BeNil())
+		Expect(string(buf[:n])).To(Equal("team/binaries with space\n"), "Path should be passed as a single argument")
+		_, err = conn.Write([]byte("hello\n"))
+		Expect(err).To(BeNil())
+		n, err = conn.Read(buf)
+		Expect(err).To(BeNil())
+		Expect(string(buf[:n])).To(Equal("hello\n"))
+		Expect(conn.Close()).To(BeNil(), "Command should exit cleanly when stdin closed")
+	})
+
+})
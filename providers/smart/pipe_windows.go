@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package smart
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Run command through cmd.exe with arg (already checked by checkWindowsShellArg) quoted after it
+// The command line is given verbatim, since Go escapes quotes in arguments with backslashes,
+// which cmd.exe doesn't understand; /S strips just the outer quotes & runs the rest as it is
+func newShellCommandWithArg(command, arg string) *exec.Cmd {
+	cmd := exec.Command("cmd")
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `cmd /S /C "` + command + ` "` + arg + `""`}
+	return cmd
+}
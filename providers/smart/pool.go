@@ -0,0 +1,77 @@
+package smart
+
+import (
+	"sync"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Connection pool
+// Commands often use the same remote several times, e.g. push then replicate, or fetch for
+// each of a list of remotes, and the provider is released after each. Setting up a connection
+// (SSH login, then agreeing features with the server) takes far longer than small operations,
+// so released connections are kept, along with what was agreed with the server, and reused the
+// next time the remote is connected to in this process. git-lob.reuse-connections disables it.
+// Sharing connections between processes is left to SSH, see util.GetSSHMultiplexing
+
+var (
+	transportPool      = make(map[transportPoolKey]SmartSyncProviderImpl)
+	transportPoolMutex sync.Mutex
+)
+
+// Connections are only reused for the same server, with the same settings (i.e. repository)
+type transportPoolKey struct {
+	opts       *util.Options
+	remoteName string
+	urlstr     string
+}
+
+// Keep the current connection to reuse later, or release it if connections aren't reused
+func (self *SmartSyncProviderImpl) poolTransport() {
+	if self.transport == nil {
+		return
+	}
+	if !self.opts.ReuseConnections {
+		self.transport.Release()
+		self.transport = nil
+		return
+	}
+	transportPoolMutex.Lock()
+	defer transportPoolMutex.Unlock()
+	key := transportPoolKey{self.opts, self.remoteName, self.transportUrl}
+	if existing, ok := transportPool[key]; ok && existing.transport != self.transport {
+		existing.transport.Release()
+	}
+	transportPool[key] = *self
+	self.transport = nil
+}
+
+// Take a kept connection for a remote, returns false if there isn't one
+func (self *SmartSyncProviderImpl) takePooledTransport(remoteName string) bool {
+	if self.serverUrl == nil {
+		return false
+	}
+	transportPoolMutex.Lock()
+	defer transportPoolMutex.Unlock()
+	key := transportPoolKey{self.opts, remoteName, self.serverUrl.String()}
+	pooled, ok := transportPool[key]
+	if !ok {
+		return false
+	}
+	delete(transportPool, key)
+	serverUrl, log := self.serverUrl, self.log
+	*self = pooled
+	self.serverUrl, self.log = serverUrl, log
+	self.log.Debugf("Reusing connection to %v", self.serverUrl)
+	return true
+}
+
+// Release all the connections kept for reuse; call before exiting
+func ReleasePooledTransports() {
+	transportPoolMutex.Lock()
+	defer transportPoolMutex.Unlock()
+	for key, pooled := range transportPool {
+		pooled.transport.Release()
+		delete(transportPool, key)
+	}
+}
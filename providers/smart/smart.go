@@ -1,12 +1,14 @@
 package smart
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -29,10 +31,25 @@ type SmartSyncProviderImpl struct {
 
 	// The transport which is providing the underlying operations
 	transport Transport
+	// The URL the transport is connected to (serverUrl may already be for the next remote)
+	transportUrl string
 	// capabilities which the server has indicated it supports
 	serverCaps []string
 	// capabilities which are enabled
 	enabledCaps []string
+	// algorithm deltas are exchanged with
+	deltaAlgorithm string
+	// protocol version agreed with the server
+	protocolVersion int
+
+	// The repository this instance is for, see ForRepo
+	root string
+	opts *util.Options
+	log  *util.Logger
+}
+
+func (*SmartSyncProviderImpl) ForRepo(root string, opts *util.Options, log *util.Logger) providers.SyncProvider {
+	return &SmartSyncProviderImpl{root: root, opts: opts, log: log}
 }
 
 // See doc/smart_protocol.md for protocol definition
@@ -49,7 +66,9 @@ func (*SmartSyncProviderImpl) HelpTextDetail() string {
 	return `The "smart" provider transfers files by talking to service hosted on
 the remote binary store which can communicate using a git-lob protocol. Many
 transports are supportable so long as client and server can establish comms. 
-The reference implementation git-lob-server supports communicating over SSH.
+The reference implementation git-lob-server supports communicating over SSH,
+through any command which connects its stdin/stdout to the server (pipe:), or
+over HTTPS when git-lob-serve is run as a standalone server.
 
 The smart provider is capable of optimising uploads and downloads by exchanging
 binary deltas with the server. Smart servers can also implement other features
@@ -57,7 +76,15 @@ like proxy caching.
 
 Required parameters in remote section of .gitconfig:
     git-lob-url    URL which can be used to establish a connection
-                   (SSH URLs only for now - more options in future)
+                   (SSH URLs, or pipe:path/to/store to run the command
+                   in git-lob.pipe-command / GIT_LOB_PIPE with the path as
+                   its last argument, for custom tunnels, or
+                   https://host:port/path/to/store for git-lob-serve --https)
+
+HTTPS connections authenticate with a token issued by the server admin, taken
+from GIT_LOB_TOKEN or else from git's credential helpers (as the password for
+the URL). The server's certificate is checked using git's http.sslCAInfo and
+http.sslVerify settings.
 
 Example configuration:
     [remote "origin"]
@@ -65,6 +92,16 @@ Example configuration:
         git-lob-provider = smart
         git-lob-url = me@someserver.com/path/to/binary/store
 
+Remotes whose url is an SSH URL (ssh://, or user@host:path) or an https://
+URL use this provider without any configuration, connecting to git-lob-serve
+at the same URL as the git repo, unless git-lob-url is set.
+
+Connections are reused for later operations on the same remote while git-lob
+runs (git-lob.reuse-connections). To share SSH connections between git-lob
+processes too, e.g. for many small fetches in CI, set git-lob-ssh-multiplex
+to true in the remote section to use an OpenSSH control master; see
+'git lob help config' for the related settings.
+
 When uploading & downloading, to avoid partially written files when interrupted
 a temporary file is created first, then moved to the final location on 
 completion. While we clean up files on error and exit, if forcibly interrupted
@@ -78,18 +115,38 @@ func (self *SmartSyncProviderImpl) ValidateConfig(remoteName string) error {
 }
 
 func (self *SmartSyncProviderImpl) Release() {
-	if self.transport != nil {
-		self.transport.Release()
-		self.transport = nil
-	}
+	// Kept for reuse, see pool.go
+	self.poolTransport()
 	self.serverCaps = nil
 	self.serverUrl = nil
 	self.remoteName = ""
 }
 
+// Get the URL of the server for a remote: git-lob-url if it's set, otherwise the remote's own
+// URL if it's an SSH or HTTPS URL, with scp-like user@host:path URLs converted to ssh:// form
+// Returns "" if neither applies
+func GetSmartURLForRemote(opts *util.Options, remoteName string) string {
+	if urlstr := opts.GitConfig[fmt.Sprintf("remote.%v.git-lob-url", remoteName)]; urlstr != "" {
+		return urlstr
+	}
+	urlstr := providers.GetGitURLForRemote(opts, remoteName)
+	if providers.GetProviderNameForURL(urlstr) != "smart" {
+		return ""
+	}
+	if i := strings.Index(urlstr, "://"); i >= 0 {
+		// git+ssh:// & ssh+git:// are just ssh://
+		if scheme := strings.ToLower(urlstr[:i]); scheme == "git+ssh" || scheme == "ssh+git" {
+			return "ssh" + urlstr[i:]
+		}
+		return urlstr
+	}
+	// user@host:path, the path is relative to the user's home dir just as it would be for git
+	return "ssh://" + strings.Replace(urlstr, ":", "/", 1)
+}
+
 func (self *SmartSyncProviderImpl) retrieveUrl(remoteName string) error {
 	urlsetting := fmt.Sprintf("remote.%v.git-lob-url", remoteName)
-	urlstr := util.GlobalOptions.GitConfig[urlsetting]
+	urlstr := GetSmartURLForRemote(self.opts, remoteName)
 	if urlstr == "" {
 		return fmt.Errorf("Configuration invalid for 'smart', missing setting %v", urlsetting)
 	}
@@ -103,32 +160,40 @@ func (self *SmartSyncProviderImpl) retrieveUrl(remoteName string) error {
 }
 
 // Internal method to make sure we've established a connection
-// we re-use connections where possible (TODO disconnection issues?)
+// we re-use connections where possible, including those kept from earlier, see pool.go;
+// dropped connections are reset & retried when transferring files
 func (self *SmartSyncProviderImpl) connect(remoteName string) error {
 	if remoteName != self.remoteName || self.transport == nil {
-		if self.transport != nil {
-			self.transport.Release()
-			self.transport = nil
-		}
+		self.poolTransport()
 		self.serverCaps = nil
 		self.enabledCaps = nil
+		self.deltaAlgorithm = ""
+		self.protocolVersion = 0
 		if self.serverUrl == nil {
 			err := self.retrieveUrl(remoteName)
 			if err != nil {
 				return err
 			}
 		}
+		if self.takePooledTransport(remoteName) {
+			return nil
+		}
 		// use serverURL to establish transport
 		tf := GetTransportFactory(self.serverUrl)
 		if tf == nil {
 			return fmt.Errorf("Unsupported URL: %v", self.serverUrl)
 		}
 		var err error
-		self.transport, err = tf.Connect(self.serverUrl)
+		if rtf, ok := tf.(RemoteTransportFactory); ok {
+			self.transport, err = rtf.ConnectRemote(remoteName, self.serverUrl, self.root, self.opts, self.log)
+		} else {
+			self.transport, err = tf.Connect(self.serverUrl, self.root, self.opts, self.log)
+		}
 		if err != nil {
 			return err
 		}
 		self.remoteName = remoteName
+		self.transportUrl = self.serverUrl.String()
 
 		err = self.determineCaps()
 		if err != nil {
@@ -138,26 +203,76 @@ func (self *SmartSyncProviderImpl) connect(remoteName string) error {
 	return nil
 }
 
+// Drop the connection after a transport failure, so that the next operation reconnects
+func (self *SmartSyncProviderImpl) resetTransport() {
+	if self.transport != nil {
+		self.transport.Release()
+		self.transport = nil
+	}
+}
+
+// Whether a transport error is worth retrying on a new connection; errors the server
+// deliberately responded with (e.g. permissions) won't be any different next time, but
+// failures of the connection or of the command providing it may not happen again
+func isRetriableTransportError(err error) bool {
+	var servererr *ServerError
+	var connerr *ConnectionError
+	var exiterr *exec.ExitError
+	switch {
+	case errors.As(err, &servererr):
+		return false
+	case errors.As(err, &connerr), errors.As(err, &exiterr):
+		return true
+	}
+	return providers.IsRetriableError(err)
+}
+
 // Negotiate with the server to determine capabilities
 func (self *SmartSyncProviderImpl) determineCaps() error {
-	var err error
-	self.serverCaps, err = self.transport.QueryCaps()
-	if err != nil {
-		return err
-	}
-	// Always enable deltas if available
+	requested := requestedFeatures(self.transport, self.opts)
+	self.protocolVersion = ProtocolVersionOriginal
 	self.enabledCaps = nil
-	for _, c := range self.serverCaps {
-		if c == "binary_delta" {
-			self.enabledCaps = append(self.enabledCaps, c)
+	negotiated := false
+	if nt, ok := self.transport.(NegotiatingTransport); ok {
+		version, features, err := nt.Negotiate(ProtocolVersion, requested)
+		if err == nil {
+			self.protocolVersion = version
+			self.serverCaps = features
+			self.enabledCaps = features
+			negotiated = true
+		} else if strings.Contains(err.Error(), "Unknown method") {
+			self.log.Debugf("Server does not support protocol negotiation, using protocol version %d\n", ProtocolVersionOriginal)
+		} else {
+			return err
 		}
-		// nothing else for now
 	}
-	err = self.transport.SetEnabledCaps(self.enabledCaps)
-	if err != nil {
-		return err
+	if !negotiated {
+		var err error
+		self.serverCaps, err = self.transport.QueryCaps()
+		if err != nil {
+			return err
+		}
+		self.enabledCaps = SelectFeatures(requested, self.serverCaps, ProtocolVersionOriginal)
+		err = self.transport.SetEnabledCaps(self.enabledCaps)
+		if err != nil {
+			return err
+		}
 	}
 
+	self.deltaAlgorithm = "bm"
+	if alg, ok := GetFeatureValue(self.enabledCaps, "delta_algorithm"); ok {
+		self.deltaAlgorithm = alg
+	}
+	if self.deltaAlgorithm != self.opts.DeltaAlgorithm {
+		self.log.Debugf("Server does not support delta algorithm %v, using bm\n", self.opts.DeltaAlgorithm)
+	}
+	if ct, ok := self.transport.(CompressionTransport); ok {
+		compression, _ := GetFeatureValue(self.enabledCaps, strings.TrimSuffix(CompressCapPrefix, "="))
+		ct.SetTransferCompression(compression)
+	}
+	if ht, ok := self.transport.(ChunkHashTransport); ok {
+		ht.SetChunkHashes(HasFeature(self.enabledCaps, ChunkHashCap))
+	}
 	return nil
 }
 
@@ -174,7 +289,14 @@ func (self *SmartSyncProviderImpl) Upload(remoteName string, filenames []string,
 	var errorList []string
 	for _, filename := range filenames {
 		// Allow aborting
-		newerrs, abort := self.uploadSingleFile(remoteName, filename, fromDir, force, callback)
+		newerrs, abort := providers.RetryFile(self.opts, self.log, filename, callback, func() ([]string, bool, bool) {
+			// Reconnect if a previous attempt dropped the connection
+			err := self.connect(remoteName)
+			if err != nil {
+				return []string{err.Error()}, false, true
+			}
+			return self.uploadSingleFile(remoteName, filename, fromDir, force, callback)
+		})
 		errorList = append(errorList, newerrs...)
 		if abort {
 			break
@@ -201,7 +323,14 @@ func (self *SmartSyncProviderImpl) Download(remoteName string, filenames []strin
 	var errorList []string
 	for _, filename := range filenames {
 		// Allow aborting
-		newerrs, abort := self.downloadSingleFile(remoteName, filename, toDir, force, callback)
+		newerrs, abort := providers.RetryFile(self.opts, self.log, filename, callback, func() ([]string, bool, bool) {
+			// Reconnect if a previous attempt dropped the connection
+			err := self.connect(remoteName)
+			if err != nil {
+				return []string{err.Error()}, false, true
+			}
+			return self.downloadSingleFile(remoteName, filename, toDir, force, callback)
+		})
 		errorList = append(errorList, newerrs...)
 		if abort {
 			break
@@ -215,6 +344,72 @@ func (self *SmartSyncProviderImpl) Download(remoteName string, filenames []strin
 	return nil
 }
 
+// Download meta files up to MaxMetadataBatch at a time if the server supports it; anything else,
+// or anything a batch fails for, is downloaded as usual with Download
+func (self *SmartSyncProviderImpl) DownloadMetadataBatch(remoteName string, filenames []string, toDir string,
+	force bool, callback providers.SyncProgressCallback) error {
+
+	err := self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+	bt, ok := self.transport.(BatchMetadataTransport)
+	if !ok || !HasFeature(self.enabledCaps, MetadataBatchCap) {
+		return self.Download(remoteName, filenames, toDir, force, callback)
+	}
+
+	var otherFiles []string
+	var metafiles []string
+	var shas []string
+	for _, filename := range filenames {
+		sha, ischunk, _ := self.parseFilename(filename)
+		if ischunk || sha == "" || self.parseChunkObjectFilename(filename) != "" || self.parsePreviewFilename(filename) != "" {
+			otherFiles = append(otherFiles, filename)
+		} else {
+			metafiles = append(metafiles, filename)
+			shas = append(shas, sha)
+		}
+	}
+
+	var errorList []string
+	var abort bool
+	for start := 0; start < len(shas) && !abort; start += MaxMetadataBatch {
+		end := start + MaxMetadataBatch
+		if end > len(shas) {
+			end = len(shas)
+		}
+		metas, err := bt.DownloadMetadataBatch(shas[start:end])
+		if err != nil {
+			self.log.Debugf("Batch metadata download from %v failed, downloading individually: %v\n", remoteName, err)
+			if isRetriableTransportError(err) {
+				self.resetTransport()
+			}
+			otherFiles = append(otherFiles, metafiles[start:]...)
+			break
+		}
+		for i := start; i < end && !abort; i++ {
+			var newerrs []string
+			if data, ok := metas[shas[i]]; ok {
+				newerrs, abort = providers.SaveDownloadedFile(self.opts, metafiles[i], toDir, data, force, callback)
+			} else if callback != nil {
+				// As for Download, not an error
+				abort = callback(metafiles[i], util.ProgressNotFound, 0, 0)
+			}
+			errorList = append(errorList, newerrs...)
+		}
+	}
+	if !abort && len(otherFiles) > 0 {
+		if err := self.Download(remoteName, otherFiles, toDir, force, callback); err != nil {
+			errorList = append(errorList, err.Error())
+		}
+	}
+
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+	return nil
+}
+
 func (self *SmartSyncProviderImpl) parseFilename(filename string) (sha string, ischunk bool, chunk int) {
 	parts := strings.FieldsFunc(filename, func(r rune) bool {
 		switch r {
@@ -239,12 +434,84 @@ func (self *SmartSyncProviderImpl) parseFilename(filename string) (sha string, i
 	}
 }
 
+// Get the SHA of a chunk object from its filename (chunks/<aaa>/<bbb>/<sha>), or "" if
+// filename isn't a chunk object
+func (self *SmartSyncProviderImpl) parseChunkObjectFilename(filename string) string {
+	parts := strings.FieldsFunc(filename, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+	if len(parts) != 4 || parts[0] != "chunks" || (len(parts[3]) != 40 && len(parts[3]) != 64) {
+		return ""
+	}
+	return parts[3]
+}
+
+// Get the transport for chunk objects, if the server supports them
+func (self *SmartSyncProviderImpl) getChunkObjectTransport(remoteName string) (ChunkObjectTransport, error) {
+	err := self.connect(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	var allowed bool
+	for _, c := range self.enabledCaps {
+		if c == "chunk_objects" {
+			allowed = true
+			break
+		}
+	}
+	ot, ok := self.transport.(ChunkObjectTransport)
+	if !allowed || !ok {
+		return nil, fmt.Errorf("Server for remote %v does not support content-defined chunks (git-lob.chunking), it needs upgrading", remoteName)
+	}
+	return ot, nil
+}
+
+// Get the SHA of the LOB a preview file belongs to (<sha>_preview), or "" if filename isn't a
+// preview
+func (self *SmartSyncProviderImpl) parsePreviewFilename(filename string) string {
+	name := filename[strings.LastIndexAny(filename, "/\\")+1:]
+	sha := strings.TrimSuffix(name, "_preview")
+	if sha == name || (len(sha) != 40 && len(sha) != 64) {
+		return ""
+	}
+	return sha
+}
+
+// Get the transport for previews, if the server supports them
+func (self *SmartSyncProviderImpl) getPreviewTransport(remoteName string) (PreviewTransport, error) {
+	err := self.connect(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	pt, ok := self.transport.(PreviewTransport)
+	if !ok || !HasFeature(self.enabledCaps, PreviewsCap) {
+		return nil, fmt.Errorf("Server for remote %v does not store previews", remoteName)
+	}
+	return pt, nil
+}
+
 func (self *SmartSyncProviderImpl) FileExists(remoteName, filename string) bool {
 	err := self.connect(remoteName)
 	if err != nil {
 		return false
 	}
 
+	if objsha := self.parseChunkObjectFilename(filename); objsha != "" {
+		ot, err := self.getChunkObjectTransport(remoteName)
+		if err != nil {
+			return false
+		}
+		exists, _, _ := ot.ChunkObjectExists(objsha)
+		return exists
+	}
+	if previewsha := self.parsePreviewFilename(filename); previewsha != "" {
+		pt, err := self.getPreviewTransport(remoteName)
+		if err != nil {
+			return false
+		}
+		exists, _, _ := pt.PreviewExists(previewsha)
+		return exists
+	}
 	sha, ischunk, chunk := self.parseFilename(filename)
 	var exists bool
 	if ischunk {
@@ -260,6 +527,22 @@ func (self *SmartSyncProviderImpl) FileExistsAndIsOfSize(remoteName, filename st
 	if err != nil {
 		return false
 	}
+	if objsha := self.parseChunkObjectFilename(filename); objsha != "" {
+		ot, err := self.getChunkObjectTransport(remoteName)
+		if err != nil {
+			return false
+		}
+		exists, objsz, _ := ot.ChunkObjectExists(objsha)
+		return exists && objsz == sz
+	}
+	if previewsha := self.parsePreviewFilename(filename); previewsha != "" {
+		pt, err := self.getPreviewTransport(remoteName)
+		if err != nil {
+			return false
+		}
+		exists, previewsz, _ := pt.PreviewExists(previewsha)
+		return exists && previewsz == sz
+	}
 	sha, ischunk, chunk := self.parseFilename(filename)
 	var exists bool
 	if ischunk {
@@ -272,20 +555,49 @@ func (self *SmartSyncProviderImpl) FileExistsAndIsOfSize(remoteName, filename st
 }
 
 func (self *SmartSyncProviderImpl) downloadSingleFile(remoteName, filename, toDir string,
-	force bool, callback providers.SyncProgressCallback) (errorList []string, abort bool) {
+	force bool, callback providers.SyncProgressCallback) (errorList []string, abort, retry bool) {
 
 	sha, ischunk, chunk := self.parseFilename(filename)
+	objsha := self.parseChunkObjectFilename(filename)
+	previewsha := self.parsePreviewFilename(filename)
+	var objtransport ChunkObjectTransport
+	var previewtransport PreviewTransport
 	var exists bool
 	var sz int64
-	if ischunk {
-		exists, sz, _ = self.transport.ChunkExists(sha, chunk)
+	var existserr error
+	if objsha != "" {
+		var err error
+		objtransport, err = self.getChunkObjectTransport(remoteName)
+		if err != nil {
+			errorList = append(errorList, err.Error())
+			return errorList, false, false
+		}
+		exists, sz, existserr = objtransport.ChunkObjectExists(objsha)
+	} else if previewsha != "" {
+		var err error
+		previewtransport, err = self.getPreviewTransport(remoteName)
+		if err != nil {
+			// Previews are optional, so a server without them just doesn't have this one
+			self.log.Debugf("%v\n", err)
+		} else {
+			exists, sz, existserr = previewtransport.PreviewExists(previewsha)
+		}
+	} else if ischunk {
+		exists, sz, existserr = self.transport.ChunkExists(sha, chunk)
 	} else {
-		exists, sz, _ = self.transport.MetadataExists(sha)
+		exists, sz, existserr = self.transport.MetadataExists(sha)
+	}
+	if existserr != nil && isRetriableTransportError(existserr) {
+		// Couldn't tell whether it's there, rather than it being missing
+		self.resetTransport()
+		msg := fmt.Sprintf("Problem while downloading %v from %v: %v", filename, remoteName, existserr)
+		errorList = append(errorList, msg)
+		return errorList, false, true
 	}
 	if !exists {
 		if callback != nil {
 			if callback(filename, util.ProgressNotFound, 0, 0) {
-				return errorList, true
+				return errorList, true, false
 			}
 		}
 		// Note how we don't add an error to the returned error list
@@ -293,10 +605,10 @@ func (self *SmartSyncProviderImpl) downloadSingleFile(remoteName, filename, toDi
 		// as a skipped item otherwise, since caller can only request files & not know
 		// if they're on the remote or not
 		// Keep going with other files
-		return errorList, false
+		return errorList, false, false
 	}
 
-	destfilename := filepath.Join(toDir, filename)
+	destfilename := providers.LocalFilePath(toDir, filename)
 	if !force {
 		// Check existence & size before downloading
 		if destfi, err := os.Stat(destfilename); err == nil {
@@ -305,10 +617,10 @@ func (self *SmartSyncProviderImpl) downloadSingleFile(remoteName, filename, toDi
 				// File already present and correct size, skip
 				if callback != nil {
 					if callback(filename, util.ProgressSkip, sz, sz) {
-						return errorList, true
+						return errorList, true, false
 					}
 				}
-				return errorList, false
+				return errorList, false, false
 			}
 		}
 	}
@@ -319,7 +631,7 @@ func (self *SmartSyncProviderImpl) downloadSingleFile(remoteName, filename, toDi
 	if err != nil {
 		msg := fmt.Sprintf("Unable to create dir %v: %v", parentDir, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	// Create a temporary file to copy, avoid issues with interruptions
 	// Note this isn't a valid thing to do in security conscious cases but this isn't one
@@ -328,7 +640,7 @@ func (self *SmartSyncProviderImpl) downloadSingleFile(remoteName, filename, toDi
 	if err != nil {
 		msg := fmt.Sprintf("Unable to create temp file for download in %v: %v", parentDir, err)
 		errorList = append(errorList, msg)
-		return errorList, false
+		return errorList, false, false
 	}
 	tmpfilename := outf.Name()
 	// This is safe to do even though we manually close & rename because both calls are no-ops if we succeed
@@ -352,49 +664,58 @@ func (self *SmartSyncProviderImpl) downloadSingleFile(remoteName, filename, toDi
 	// Initial callback
 	if callback != nil {
 		if callback(filename, util.ProgressTransferBytes, 0, sz) {
-			return errorList, true
+			return errorList, true, false
 		}
 	}
-	if ischunk {
-		err = self.transport.DownloadChunk(sha, chunk, outf, localcallback)
+	out := util.ThrottleDownloadWriter(self.opts, outf)
+	if objtransport != nil {
+		err = objtransport.DownloadChunkObject(objsha, out, localcallback)
+	} else if previewtransport != nil {
+		err = previewtransport.DownloadPreview(previewsha, out)
+	} else if ischunk {
+		err = self.transport.DownloadChunk(sha, chunk, out, localcallback)
 	} else {
-		err = self.transport.DownloadMetadata(sha, outf)
+		err = self.transport.DownloadMetadata(sha, out)
 	}
 	outf.Close()
 	if err != nil {
 		os.Remove(tmpfilename)
 		msg := fmt.Sprintf("Problem while downloading %v from %v: %v", filename, remoteName, err)
 		errorList = append(errorList, msg)
-		return errorList, abortAfterThisFile
+		retry := isRetriableTransportError(err)
+		if retry {
+			self.resetTransport()
+		}
+		return errorList, abortAfterThisFile, retry
 	}
 	// Make sure we do completion
 	if callback != nil && !completecallbackdone {
 		if callback(filename, util.ProgressTransferBytes, sz, sz) {
-			return errorList, true
+			return errorList, true, false
 		}
 	}
 	// Move to correct location - remove before to deal with force or bad size cases
 	os.Remove(destfilename)
 	os.Rename(tmpfilename, destfilename)
-	return errorList, abortAfterThisFile
+	return errorList, abortAfterThisFile, false
 }
 
 func (self *SmartSyncProviderImpl) uploadSingleFile(remoteName, filename, fromDir string,
-	force bool, callback providers.SyncProgressCallback) (errorList []string, abort bool) {
+	force bool, callback providers.SyncProgressCallback) (errorList []string, abort, retry bool) {
 
 	// Check to see if the file is already there, right size
-	srcfilename := filepath.Join(fromDir, filename)
+	srcfilename := providers.LocalFilePath(fromDir, filename)
 	srcfi, err := os.Stat(srcfilename)
 	if err != nil {
 		if callback != nil {
 			if callback(filename, util.ProgressNotFound, 0, 0) {
-				return errorList, true
+				return errorList, true, false
 			}
 		}
 		msg := fmt.Sprintf("Unable to stat %v: %v", srcfilename, err)
 		errorList = append(errorList, msg)
 		// Keep going with other files
-		return errorList, false
+		return errorList, false, false
 	}
 
 	if !force {
@@ -403,19 +724,46 @@ func (self *SmartSyncProviderImpl) uploadSingleFile(remoteName, filename, fromDi
 			// File already present and correct size, skip
 			if callback != nil {
 				if callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
-					return errorList, true
+					return errorList, true, false
 				}
 			}
-			return errorList, false
+			return errorList, false, false
 		}
 	}
 
 	sha, ischunk, chunk := self.parseFilename(filename)
+	objsha := self.parseChunkObjectFilename(filename)
+	previewsha := self.parsePreviewFilename(filename)
+	var objtransport ChunkObjectTransport
+	var previewtransport PreviewTransport
+	if objsha != "" {
+		objtransport, err = self.getChunkObjectTransport(remoteName)
+		if err != nil {
+			errorList = append(errorList, err.Error())
+			return errorList, false, false
+		}
+	} else if previewsha != "" {
+		previewtransport, err = self.getPreviewTransport(remoteName)
+		if err != nil {
+			// Previews are optional, so they're just left out for servers which don't store them
+			self.log.Debugf("Not uploading %v: %v\n", filename, err)
+			if callback != nil && callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
+				return errorList, true, false
+			}
+			return errorList, false, false
+		}
+	} else if !ischunk {
+		err = self.checkMetadataSupported(remoteName, srcfilename)
+		if err != nil {
+			errorList = append(errorList, err.Error())
+			return errorList, false, false
+		}
+	}
 
 	// Initial callback
 	if callback != nil {
 		if callback(filename, util.ProgressTransferBytes, 0, srcfi.Size()) {
-			return errorList, true
+			return errorList, true, false
 		}
 	}
 	var abortAfterThisFile bool
@@ -435,26 +783,39 @@ func (self *SmartSyncProviderImpl) uploadSingleFile(remoteName, filename, fromDi
 	if err != nil {
 		msg := fmt.Sprintf("Unable to read input file for upload %v: %v", srcfilename, err)
 		errorList = append(errorList, msg)
-		return errorList, abortAfterThisFile
+		return errorList, abortAfterThisFile, false
 	}
 	defer inf.Close()
-	if ischunk {
-		err = self.transport.UploadChunk(sha, chunk, srcfi.Size(), inf, localcallback)
+	in := util.ThrottleUploadReader(self.opts, inf)
+	if objtransport != nil {
+		err = objtransport.UploadChunkObject(objsha, srcfi.Size(), in, localcallback)
+	} else if previewtransport != nil {
+		err = previewtransport.UploadPreview(previewsha, srcfi.Size(), in)
+	} else if ischunk {
+		err = self.transport.UploadChunk(sha, chunk, srcfi.Size(), in, localcallback)
 	} else {
-		err = self.transport.UploadMetadata(sha, srcfi.Size(), inf)
+		err = self.transport.UploadMetadata(sha, srcfi.Size(), in)
 	}
 	if err != nil {
 		msg := fmt.Sprintf("Problem while uploading %v to %v: %v", srcfilename, remoteName, err)
 		errorList = append(errorList, msg)
+		if IsQuotaExceededError(err) {
+			// Everything else would be rejected too
+			return errorList, true, false
+		}
+		if isRetriableTransportError(err) {
+			self.resetTransport()
+			return errorList, abortAfterThisFile, true
+		}
 	}
 	// Make sure we do completion
 	if callback != nil && !completecallbackdone {
 		if callback(filename, util.ProgressTransferBytes, srcfi.Size(), srcfi.Size()) {
-			return errorList, true
+			return errorList, true, false
 		}
 	}
 
-	return errorList, abortAfterThisFile
+	return errorList, abortAfterThisFile, false
 
 }
 
@@ -499,13 +860,36 @@ func (self *SmartSyncProviderImpl) DownloadDelta(remoteName, basesha, targetsha
 	localcallback := func(bytesDone, totalBytes int64) {
 		callback(description, util.ProgressTransferBytes, bytesDone, totalBytes)
 	}
-	ok, err := self.transport.DownloadDelta(basesha, targetsha, 1024*1024*1024, out, localcallback)
+	ok, err := self.transport.DownloadDelta(basesha, targetsha, 1024*1024*1024, util.ThrottleDownloadWriter(self.opts, out), localcallback)
 	if !ok {
 		return fmt.Errorf("Server chose not to provide a delta for %v", targetsha)
 	}
 	return err
 }
 
+// The algorithm deltas exchanged with the remote are generated with
+func (self *SmartSyncProviderImpl) DeltaAlgorithm(remoteName string) (string, error) {
+	err := self.connect(remoteName)
+	if err != nil {
+		return "", err
+	}
+	return self.deltaAlgorithm, nil
+}
+
+// The version of the smart protocol agreed with the remote
+func (self *SmartSyncProviderImpl) ProtocolVersion(remoteName string) (int, error) {
+	err := self.connect(remoteName)
+	if err != nil {
+		return 0, err
+	}
+	return self.protocolVersion, nil
+}
+
+// Connect & negotiate with the remote, so that it's known to be reachable
+func (self *SmartSyncProviderImpl) CheckConnection(remoteName string) error {
+	return self.connect(remoteName)
+}
+
 func (self *SmartSyncProviderImpl) GetFirstCompleteLOBFromList(remoteName string, candidateSHAs []string) (string, error) {
 	err := self.connect(remoteName)
 	if err != nil {
@@ -524,17 +908,152 @@ func (self *SmartSyncProviderImpl) UploadDelta(remoteName, basesha, targetsha st
 	localcallback := func(bytesDone, totalBytes int64) {
 		callback(description, util.ProgressTransferBytes, bytesDone, totalBytes)
 	}
-	ok, err := self.transport.UploadDelta(basesha, targetsha, size, in, localcallback)
+	ok, err := self.transport.UploadDelta(basesha, targetsha, size, util.ThrottleUploadReader(self.opts, in), localcallback)
 	if !ok {
 		return fmt.Errorf("Server chose not to accept a delta for %v", targetsha)
 	}
 	return err
 }
 
+// Check that the server understands a metadata file before uploading it; binaries stored with
+// a chunk size other than the default (git-lob.chunk-size) need a server which supports that,
+// since older ones would read their chunks with the wrong size
+func (self *SmartSyncProviderImpl) checkMetadataSupported(remoteName, metafilename string) error {
+	metabytes, err := ioutil.ReadFile(metafilename)
+	if err != nil {
+		return err
+	}
+	var meta struct {
+		ChunkSize int64
+	}
+	if json.Unmarshal(metabytes, &meta) != nil || meta.ChunkSize == 0 {
+		// Server will validate anything else
+		return nil
+	}
+	err = self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+	for _, c := range self.enabledCaps {
+		if c == "chunk_size" {
+			return nil
+		}
+	}
+	return fmt.Errorf("Server for remote %v does not support binaries stored with a custom chunk size (git-lob.chunk-size), it needs upgrading", remoteName)
+}
+
+// Get the transport if the server has allowed us to prune (not an error to call otherwise)
+func (self *SmartSyncProviderImpl) getPruneTransport(remoteName string) (PruneTransport, error) {
+	err := self.connect(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	var allowed bool
+	for _, c := range self.enabledCaps {
+		if c == "prune" {
+			allowed = true
+			break
+		}
+	}
+	pt, ok := self.transport.(PruneTransport)
+	if !allowed || !ok {
+		return nil, fmt.Errorf("Server for remote %v does not allow you to prune binaries", remoteName)
+	}
+	return pt, nil
+}
+
+// List all the LOBs the remote has any files for (complete or not)
+func (self *SmartSyncProviderImpl) ListLOBs(remoteName string) ([]string, error) {
+	pt, err := self.getPruneTransport(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	return pt.ListLOBs()
+}
+
+// Ask the remote to delete LOBs; it may choose to retain some
+func (self *SmartSyncProviderImpl) List(remoteName string, callback func(file *providers.RemoteFile) (quit bool)) error {
+	shas, err := self.ListLOBs(remoteName)
+	if err != nil {
+		return err
+	}
+	for _, sha := range shas {
+		if len(sha) < 6 {
+			continue
+		}
+		// Only complete LOBs have a size
+		_, sz := self.LOBExists(remoteName, sha)
+		metafile := filepath.Join(sha[:3], sha[3:6], sha+"_meta")
+		if callback(&providers.RemoteFile{Filename: metafile, Size: sz}) {
+			break
+		}
+	}
+	return nil
+}
+
+func (self *SmartSyncProviderImpl) PruneLOBs(remoteName string, shas []string, dryRun bool) (deleted, retained, held []string, e error) {
+	pt, err := self.getPruneTransport(remoteName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return pt.PruneLOBs(shas, dryRun)
+}
+
+// Get the transport if the server supports locking (not an error to call otherwise)
+func (self *SmartSyncProviderImpl) getLockTransport(remoteName string) (LockTransport, error) {
+	err := self.connect(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	var supported bool
+	for _, c := range self.enabledCaps {
+		if c == "locking" {
+			supported = true
+			break
+		}
+	}
+	lt, ok := self.transport.(LockTransport)
+	if !supported || !ok {
+		return nil, fmt.Errorf("Server for remote %v does not support locking files", remoteName)
+	}
+	return lt, nil
+}
+
+// Lock a file path so that only this user can commit changes to it
+func (self *SmartSyncProviderImpl) LockFile(remoteName, path string) (*providers.FileLock, error) {
+	lt, err := self.getLockTransport(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	return lt.LockFile(path)
+}
+
+// Release the lock on a file path
+func (self *SmartSyncProviderImpl) UnlockFile(remoteName, path string, force bool) error {
+	lt, err := self.getLockTransport(remoteName)
+	if err != nil {
+		return err
+	}
+	return lt.UnlockFile(path, force)
+}
+
+// List all the locks held on the remote
+func (self *SmartSyncProviderImpl) ListLocks(remoteName string) ([]*providers.FileLock, error) {
+	lt, err := self.getLockTransport(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	return lt.ListLocks()
+}
+
 // Init core smart providers
 func InitCoreProviders() {
 	// SSH transport
 	RegisterSshTransportFactory()
+	// Custom command transport for tunnels
+	RegisterPipeTransportFactory()
+	// git-lob-serve's standalone HTTPS mode
+	RegisterHttpsTransportFactory()
 	// Smart sync provider is a single instance which uses the transports to figure out concrete connection
 	// from a URL. Only implementation right now is persistent/SSH but can have different modes (e.g. transient)
 	// and different underlying network protocols (e.g. REST)
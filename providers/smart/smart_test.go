@@ -0,0 +1,399 @@
+package smart
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Protocol features", func() {
+	It("Selects features both sides support", func() {
+		RegisterFeature(&Feature{Name: "future_test_feature", Since: ProtocolVersion + 1})
+		requested := []string{"binary_delta", "delta_algorithm=zstd", "delta_algorithm=bm", "future_test_feature", "unknown"}
+		offered := []string{"delta_algorithm=bm", "delta_algorithm=zstd", "binary_delta", "future_test_feature"}
+		Expect(SelectFeatures(requested, offered, ProtocolVersion)).To(Equal([]string{"binary_delta", "delta_algorithm=zstd"}),
+			"Should pick the first value of each & skip features the version doesn't have")
+		Expect(SelectFeatures(requested, offered, ProtocolVersion+1)).To(ContainElement("future_test_feature"))
+		Expect(SelectFeatures(requested, nil, ProtocolVersion)).To(BeEmpty())
+
+		value, ok := GetFeatureValue([]string{"binary_delta", "compress=gzip"}, "compress")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("gzip"))
+		Expect(HasFeature([]string{"binary_delta"}, "compress")).To(BeFalse())
+	})
+
+	It("Falls back to capabilities with servers which predate negotiation", func() {
+		// Other tests expect request ids to start from 1
+		defer func(id int) { latestRequestId = id }(latestRequestId)
+		cli, srv := net.Pipe()
+		defer cli.Close()
+		var enabled []string
+		// Server which only knows QueryCaps & SetEnabledCaps
+		go func() {
+			rdr := bufio.NewReader(srv)
+			for {
+				jsonbytes, err := rdr.ReadBytes(byte(0))
+				if err != nil {
+					return
+				}
+				var req JsonRequest
+				json.Unmarshal(jsonbytes[:len(jsonbytes)-1], &req)
+				var resp *JsonResponse
+				switch req.Method {
+				case "QueryCaps":
+					resp, _ = NewJsonResponse(req.Id, QueryCapsResponse{Caps: []string{"binary_delta", "delta_algorithm=bm", "locking"}})
+				case "SetEnabledCaps":
+					capsreq := SetEnabledCapsRequest{}
+					ExtractStructFromJsonRawMessage(req.Params, &capsreq)
+					enabled = capsreq.EnableCaps
+					resp, _ = NewJsonResponse(req.Id, SetEnabledCapsResponse{})
+				default:
+					resp = NewJsonErrorResponse(req.Id, fmt.Sprintf("Unknown method %v", req.Method))
+				}
+				responseBytes, _ := json.Marshal(resp)
+				srv.Write(append(responseBytes, byte(0)))
+			}
+		}()
+
+		oldAlgorithm := util.GlobalOptions.DeltaAlgorithm
+		defer func() { util.GlobalOptions.DeltaAlgorithm = oldAlgorithm }()
+		util.GlobalOptions.DeltaAlgorithm = "zstd"
+		provider := &SmartSyncProviderImpl{transport: NewPersistentTransport(cli), opts: util.GlobalOptions, log: util.DefaultLogger}
+		Expect(provider.determineCaps()).To(BeNil())
+		Expect(provider.protocolVersion).To(Equal(ProtocolVersionOriginal))
+		Expect(provider.enabledCaps).To(Equal([]string{"binary_delta", "locking"}))
+		Expect(enabled).To(Equal(provider.enabledCaps), "Server should have been told what's enabled")
+		Expect(provider.deltaAlgorithm).To(Equal("bm"), "Algorithm the server doesn't offer should not be used")
+	})
+})
+
+// Transport which only agrees capabilities, for testing connection handling
+type poolTestTransport struct {
+	Transport
+	released *int
+}
+
+func (self *poolTestTransport) Release() {
+	*self.released++
+}
+func (*poolTestTransport) QueryCaps() ([]string, error) {
+	return []string{"binary_delta"}, nil
+}
+func (*poolTestTransport) SetEnabledCaps(caps []string) error {
+	return nil
+}
+
+type poolTestTransportFactory struct {
+	connected, released int
+}
+
+func (*poolTestTransportFactory) WillHandleUrl(u *url.URL) bool {
+	return u.Scheme == "pooltest"
+}
+func (self *poolTestTransportFactory) Connect(u *url.URL, root string, opts *util.Options, log *util.Logger) (Transport, error) {
+	self.connected++
+	return &poolTestTransport{released: &self.released}, nil
+}
+
+var _ = Describe("Connection pool", func() {
+	var oldOptions util.Options
+	var factory *poolTestTransportFactory
+	BeforeEach(func() {
+		oldOptions = *util.GlobalOptions
+		util.GlobalOptions.GitConfig = map[string]string{
+			"remote.one.git-lob-url": "pooltest://host/one",
+			"remote.two.git-lob-url": "pooltest://host/two",
+		}
+		factory = &poolTestTransportFactory{}
+		RegisterTransportFactory(factory)
+	})
+	AfterEach(func() {
+		ReleasePooledTransports()
+		*util.GlobalOptions = oldOptions
+	})
+	use := func(provider *SmartSyncProviderImpl, remoteName string) {
+		Expect(provider.ValidateConfig(remoteName)).To(BeNil())
+		Expect(provider.connect(remoteName)).To(BeNil())
+		Expect(provider.enabledCaps).To(Equal([]string{"binary_delta"}))
+	}
+
+	It("Reuses released connections to the same remote", func() {
+		provider := &SmartSyncProviderImpl{opts: util.GlobalOptions, log: util.DefaultLogger}
+		use(provider, "one")
+		provider.Release()
+		use(provider, "one")
+		Expect(factory.connected).To(Equal(1))
+		use(provider, "two")
+		use(provider, "one")
+		provider.Release()
+		use(provider, "two")
+		Expect(factory.connected).To(Equal(2), "Switching remotes should keep the other connection")
+		Expect(factory.released).To(Equal(0))
+
+		provider.Release()
+		ReleasePooledTransports()
+		Expect(factory.released).To(Equal(2))
+		use(provider, "one")
+		Expect(factory.connected).To(Equal(3))
+	})
+
+	It("Releases connections when reuse is disabled", func() {
+		util.GlobalOptions.ReuseConnections = false
+		provider := &SmartSyncProviderImpl{opts: util.GlobalOptions, log: util.DefaultLogger}
+		use(provider, "one")
+		provider.Release()
+		use(provider, "one")
+		Expect(factory.connected).To(Equal(2))
+		Expect(factory.released).To(Equal(1))
+	})
+})
+
+// Transport which serves metadata, in batches if the feature is enabled
+type batchTestTransport struct {
+	Transport
+	metas      map[string][]byte
+	fail       bool
+	batches    int
+	individual []string
+}
+
+func (*batchTestTransport) Release() {
+}
+func (*batchTestTransport) Negotiate(version int, features []string) (int, []string, error) {
+	return ProtocolVersion, SelectFeatures(features, []string{MetadataBatchCap}, ProtocolVersion), nil
+}
+func (self *batchTestTransport) DownloadMetadataBatch(lobshas []string) (map[string][]byte, error) {
+	self.batches++
+	if self.fail {
+		return nil, fmt.Errorf("Connection dropped")
+	}
+	ret := make(map[string][]byte)
+	for _, sha := range lobshas {
+		if data, ok := self.metas[sha]; ok {
+			ret[sha] = data
+		}
+	}
+	return ret, nil
+}
+func (self *batchTestTransport) MetadataExists(lobsha string) (bool, int64, error) {
+	data, ok := self.metas[lobsha]
+	return ok, int64(len(data)), nil
+}
+func (self *batchTestTransport) DownloadMetadata(lobsha string, out io.Writer) error {
+	self.individual = append(self.individual, lobsha)
+	_, err := out.Write(self.metas[lobsha])
+	return err
+}
+
+type batchTestTransportFactory struct {
+	transport *batchTestTransport
+}
+
+func (*batchTestTransportFactory) WillHandleUrl(u *url.URL) bool {
+	return u.Scheme == "batchtest"
+}
+func (self *batchTestTransportFactory) Connect(u *url.URL, root string, opts *util.Options, log *util.Logger) (Transport, error) {
+	return self.transport, nil
+}
+
+var _ = Describe("Metadata batches", func() {
+	var oldOptions util.Options
+	var transport *batchTestTransport
+	var toDir string
+	sha1 := "1111111111111111111111111111111111111111"
+	sha2 := "2222222222222222222222222222222222222222"
+	missingsha := "3333333333333333333333333333333333333333"
+	metafile := func(sha string) string {
+		return filepath.Join(sha[:3], sha[3:6], sha+"_meta")
+	}
+	BeforeEach(func() {
+		oldOptions = *util.GlobalOptions
+		util.GlobalOptions.GitConfig = map[string]string{"remote.batch.git-lob-url": "batchtest://host/batch"}
+		util.GlobalOptions.RetryAttempts = 0
+		transport = &batchTestTransport{metas: map[string][]byte{
+			sha1: []byte(`{"SHA":"1111111111111111111111111111111111111111","Size":1,"NumChunks":1}`),
+			sha2: []byte(`{"SHA":"2222222222222222222222222222222222222222","Size":22,"NumChunks":1}`),
+		}}
+		RegisterTransportFactory(&batchTestTransportFactory{transport})
+		toDir, _ = ioutil.TempDir("", "metabatchtest")
+	})
+	AfterEach(func() {
+		ReleasePooledTransports()
+		*util.GlobalOptions = oldOptions
+		os.RemoveAll(toDir)
+	})
+	download := func() (downloaded, notFound []string) {
+		provider := &SmartSyncProviderImpl{opts: util.GlobalOptions, log: util.DefaultLogger}
+		defer provider.Release()
+		Expect(provider.ValidateConfig("batch")).To(BeNil())
+		files := []string{metafile(sha1), metafile(missingsha), metafile(sha2)}
+		err := provider.DownloadMetadataBatch("batch", files, toDir, false, func(filename string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+			if progressType == util.ProgressNotFound {
+				notFound = append(notFound, filename)
+			} else if progressType == util.ProgressTransferBytes && bytesDone == totalBytes {
+				downloaded = append(downloaded, filename)
+			}
+			return false
+		})
+		Expect(err).To(BeNil())
+		for sha, data := range transport.metas {
+			content, err := ioutil.ReadFile(filepath.Join(toDir, metafile(sha)))
+			Expect(err).To(BeNil(), "Metadata should have been saved")
+			Expect(content).To(Equal(data))
+		}
+		return downloaded, notFound
+	}
+
+	It("Downloads metadata in one request", func() {
+		downloaded, notFound := download()
+		Expect(downloaded).To(Equal([]string{metafile(sha1), metafile(sha2)}))
+		Expect(notFound).To(Equal([]string{metafile(missingsha)}))
+		Expect(transport.batches).To(Equal(1))
+		Expect(transport.individual).To(BeEmpty())
+	})
+
+	It("Falls back to individual downloads if a batch fails", func() {
+		transport.fail = true
+		downloaded, notFound := download()
+		Expect(downloaded).To(Equal([]string{metafile(sha1), metafile(sha2)}))
+		Expect(notFound).To(Equal([]string{metafile(missingsha)}))
+		Expect(transport.individual).To(Equal([]string{sha1, sha2}))
+	})
+})
+
+// Transport which stores previews, if the server is to support them
+type previewTestTransport struct {
+	Transport
+	supported bool
+	previews  map[string][]byte
+}
+
+func (*previewTestTransport) Release() {
+}
+func (self *previewTestTransport) Negotiate(version int, features []string) (int, []string, error) {
+	var caps []string
+	if self.supported {
+		caps = append(caps, PreviewsCap)
+	}
+	return ProtocolVersion, SelectFeatures(features, caps, ProtocolVersion), nil
+}
+func (self *previewTestTransport) PreviewExists(lobsha string) (bool, int64, error) {
+	data, ok := self.previews[lobsha]
+	return ok, int64(len(data)), nil
+}
+func (self *previewTestTransport) UploadPreview(lobsha string, sz int64, data io.Reader) error {
+	content, err := ioutil.ReadAll(data)
+	self.previews[lobsha] = content
+	return err
+}
+func (self *previewTestTransport) DownloadPreview(lobsha string, out io.Writer) error {
+	_, err := out.Write(self.previews[lobsha])
+	return err
+}
+
+type previewTestTransportFactory struct {
+	transport *previewTestTransport
+}
+
+func (*previewTestTransportFactory) WillHandleUrl(u *url.URL) bool {
+	return u.Scheme == "previewtest"
+}
+func (self *previewTestTransportFactory) Connect(u *url.URL, root string, opts *util.Options, log *util.Logger) (Transport, error) {
+	return self.transport, nil
+}
+
+var _ = Describe("Previews", func() {
+	var oldOptions util.Options
+	var transport *previewTestTransport
+	var fromDir, toDir string
+	sha := "1111111111111111111111111111111111111111"
+	previewfile := filepath.Join(sha[:3], sha[3:6], sha+"_preview")
+	content := []byte("thumbnail")
+	BeforeEach(func() {
+		oldOptions = *util.GlobalOptions
+		util.GlobalOptions.GitConfig = map[string]string{"remote.preview.git-lob-url": "previewtest://host/preview"}
+		util.GlobalOptions.RetryAttempts = 0
+		transport = &previewTestTransport{previews: make(map[string][]byte)}
+		RegisterTransportFactory(&previewTestTransportFactory{transport})
+		fromDir, _ = ioutil.TempDir("", "previewtestfrom")
+		toDir, _ = ioutil.TempDir("", "previewtestto")
+		os.MkdirAll(filepath.Dir(filepath.Join(fromDir, previewfile)), 0755)
+		ioutil.WriteFile(filepath.Join(fromDir, previewfile), content, 0644)
+	})
+	AfterEach(func() {
+		ReleasePooledTransports()
+		*util.GlobalOptions = oldOptions
+		os.RemoveAll(fromDir)
+		os.RemoveAll(toDir)
+	})
+	transfer := func() (progress []util.ProgressCallbackType) {
+		provider := &SmartSyncProviderImpl{opts: util.GlobalOptions, log: util.DefaultLogger}
+		defer provider.Release()
+		Expect(provider.ValidateConfig("preview")).To(BeNil())
+		callback := func(filename string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+			if progressType != util.ProgressTransferBytes || bytesDone == totalBytes {
+				progress = append(progress, progressType)
+			}
+			return false
+		}
+		Expect(provider.Upload("preview", []string{previewfile}, fromDir, false, callback)).To(BeNil())
+		Expect(provider.Download("preview", []string{previewfile}, toDir, false, callback)).To(BeNil())
+		return progress
+	}
+
+	It("Transfers previews with servers which store them", func() {
+		transport.supported = true
+		Expect(transfer()).To(Equal([]util.ProgressCallbackType{util.ProgressTransferBytes, util.ProgressTransferBytes}))
+		Expect(transport.previews[sha]).To(Equal(content))
+		downloaded, err := ioutil.ReadFile(filepath.Join(toDir, previewfile))
+		Expect(err).To(BeNil())
+		Expect(downloaded).To(Equal(content))
+	})
+
+	It("Skips previews quietly with servers which don't", func() {
+		// Anything but preview requests would reach the nil Transport & panic
+		Expect(transfer()).To(Equal([]util.ProgressCallbackType{util.ProgressSkip, util.ProgressNotFound}))
+		Expect(transport.previews).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Transport errors", func() {
+	It("Retries connection failures but not errors the server responds with", func() {
+		defer func(id int) { latestRequestId = id }(latestRequestId)
+		cli, srv := net.Pipe()
+		go func() {
+			rdr := bufio.NewReader(srv)
+			rdr.ReadBytes(byte(0))
+			respbytes, _ := json.Marshal(NewJsonErrorResponse(1, "Permission denied"))
+			srv.Write(append(respbytes, byte(0)))
+			// Then drop the connection
+			rdr.ReadBytes(byte(0))
+			srv.Close()
+		}()
+		trans := NewPersistentTransport(cli)
+		defer cli.Close()
+		_, err := trans.QueryCaps()
+		Expect(err).ToNot(BeNil())
+		Expect(isRetriableTransportError(err)).To(BeFalse(), "Server responses shouldn't be retried: %v", err)
+		_, err = trans.QueryCaps()
+		Expect(err).ToNot(BeNil())
+		Expect(isRetriableTransportError(err)).To(BeTrue(), "Dropped connections should be retried: %v", err)
+
+		Expect(isRetriableTransportError(fmt.Errorf("Error while uploading chunk 0 for abc: %w",
+			&ConnectionError{fmt.Errorf("Content hash does not match trailer")}))).To(BeTrue())
+		Expect(isRetriableTransportError(fmt.Errorf("Error while downloading: %w", &exec.ExitError{}))).To(BeTrue(),
+			"The ssh or pipe command exiting should be retried")
+		Expect(isRetriableTransportError(fmt.Errorf("Unable to open local file"))).To(BeFalse())
+	})
+})
@@ -2,12 +2,7 @@ package smart
 
 import (
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/url"
-	"os"
-	"os/exec"
-	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -67,18 +62,10 @@ func (self *SshTransportFactory) WillHandleUrl(u *url.URL) bool {
 	newu := self.cleanupBareUrl(u)
 	return newu.Scheme == "ssh"
 }
-func (self *SshTransportFactory) Connect(u *url.URL) (Transport, error) {
-	ssh := os.Getenv("GIT_SSH")
-	basessh := filepath.Base(ssh)
-	// Strip extension for easier comparison
-	if ext := filepath.Ext(basessh); len(ext) > 0 {
-		basessh = basessh[:len(basessh)-len(ext)]
-	}
-	isPlink := strings.EqualFold(basessh, "plink")
-	isTortoise := strings.EqualFold(basessh, "tortoiseplink")
-	if ssh == "" {
-		ssh = "ssh"
-	}
+func (self *SshTransportFactory) Connect(u *url.URL, root string, opts *util.Options, log *util.Logger) (Transport, error) {
+	return self.ConnectRemote("", u, root, opts, log)
+}
+func (self *SshTransportFactory) ConnectRemote(remoteName string, u *url.URL, root string, opts *util.Options, log *util.Logger) (Transport, error) {
 	// Clean up bare git@blah.com:port:path styles
 	// we want to identify host & port, easiest to pull out of URL than parsing ourselves
 	urlCleaned := self.cleanupBareUrl(u)
@@ -91,26 +78,9 @@ func (self *SshTransportFactory) Connect(u *url.URL) (Transport, error) {
 		return nil, fmt.Errorf("No valid host found in url %v", u.String())
 	}
 
-	util.LogDebugf("Connecting to %v over SSH...", host)
-
-	// Let's invoke ssh
-	args := make([]string, 0, 2)
-	if isTortoise {
-		// TortoisePlink requires the -batch argument to behave like ssh/plink
-		args = append(args, "-batch")
-	}
-	if port != "" {
-		if isPlink || isTortoise {
-			args = append(args, "-P")
-		} else {
-			args = append(args, "-p")
-		}
-		args = append(args, port)
-	}
-	args = append(args, host)
+	log.Debugf("Connecting to %v over SSH...", host)
 
-	// Now add remote program and path
-	args = append(args, util.GlobalOptions.SSHServerCommand)
+	// Remote program and path
 	// u.Path includes a preceding '/', strip off manually
 	// rooted paths in the URL will be '//path/to/blah'
 	// this is just how Go's URL parsing works
@@ -118,37 +88,16 @@ func (self *SshTransportFactory) Connect(u *url.URL) (Transport, error) {
 	if len(path) > 0 && strings.HasPrefix(path, "/") {
 		path = path[1:]
 	}
-	args = append(args, path)
-
-	util.LogDebugf("SSH command is: %v %v", ssh, strings.Join(args, " "))
-
-	cmd := exec.Command(ssh, args...)
-
-	outp, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("Unable to connect to ssh stdout: %v", err.Error())
-	}
-	errp, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, fmt.Errorf("Unable to connect to ssh stderr: %v", err.Error())
-	}
-	inp, err := cmd.StdinPipe()
+	cmd, err := util.GetSSHCommandForRemote(opts, log, remoteName, host, port, false, opts.SSHServerCommand, path)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to connect to ssh stdin: %v", err.Error())
+		return nil, err
 	}
-	err = cmd.Start()
+	conn, err := StartCommandConnection(cmd, "ssh")
 	if err != nil {
-		return nil, fmt.Errorf("Unable to start ssh command: %v", err.Error())
-	}
-
-	conn := &SshConnection{
-		cmd:    cmd,
-		stdin:  inp,
-		stdout: outp,
-		stderr: errp,
+		return nil, err
 	}
 
-	util.LogDebugf("SSH connection successful to %v", host)
+	log.Debugf("SSH connection successful to %v", host)
 
 	return NewPersistentTransport(conn), nil
 
@@ -157,38 +106,3 @@ func (self *SshTransportFactory) Connect(u *url.URL) (Transport, error) {
 func RegisterSshTransportFactory() {
 	RegisterTransportFactory(&SshTransportFactory{})
 }
-
-// Underlying SSH connection to smart server, for use with PersistentTransport
-// Works by invoking ssh/plink/tortoise_plink and connecting stdout/stdin
-type SshConnection struct {
-	// The command which is running ssh
-	cmd *exec.Cmd
-	// Streams for communicating
-	stdin  io.WriteCloser
-	stdout io.ReadCloser
-	stderr io.ReadCloser
-}
-
-// SSH Connection implementation
-func (self *SshConnection) Read(p []byte) (n int, err error) {
-	return self.stdout.Read(p)
-}
-func (self *SshConnection) Write(p []byte) (n int, err error) {
-	return self.stdin.Write(p)
-}
-func (self *SshConnection) Close() error {
-	// Docs say "It is incorrect to call Wait before all writes to the pipe have completed."
-	// But that actually means in parallel https://github.com/golang/go/issues/9307 so we're ok here
-	errbytes, readerr := ioutil.ReadAll(self.stderr)
-	if readerr == nil && len(errbytes) > 0 {
-		// Copy to our stderr for info
-		fmt.Fprintf(os.Stderr, "Messages from SSH server:\n%v", string(errbytes))
-	}
-	err := self.cmd.Wait()
-	if err != nil {
-		return fmt.Errorf("Error closing ssh connection: %v\nstderr: %v", err.Error(), string(errbytes))
-	}
-
-	return nil
-
-}
@@ -5,6 +5,7 @@ import (
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/atlassian/git-lob/util"
 )
 
 var _ = Describe("SSH", func() {
@@ -12,6 +13,33 @@ var _ = Describe("SSH", func() {
 	Context("Low level URL tests", func() {
 
 		factory := &SshTransportFactory{}
+		It("Uses remote URLs when git-lob-url isn't set", func() {
+			oldOptions := *util.GlobalOptions
+			defer func() { *util.GlobalOptions = oldOptions }()
+			util.GlobalOptions.GitConfig = map[string]string{
+				"remote.bare.url":        "git@host.com:path/to/repo",
+				"remote.rooted.url":      "git@host.com:/rooted/repo",
+				"remote.gitssh.url":      "git+ssh://host.com/path/to/repo",
+				"remote.https.url":       "https://host.com/path/to/repo",
+				"remote.local.url":       "/path/to/repo",
+				"remote.set.url":         "git@host.com:path/to/repo",
+				"remote.set.git-lob-url": "ssh://other.com/store",
+			}
+			for remoteName, expected := range map[string]string{
+				"bare":   "ssh://git@host.com/path/to/repo",
+				"rooted": "ssh://git@host.com//rooted/repo",
+				"gitssh": "ssh://host.com/path/to/repo",
+				"https":  "https://host.com/path/to/repo",
+				"local":  "",
+				"set":    "ssh://other.com/store",
+			} {
+				Expect(GetSmartURLForRemote(util.GlobalOptions, remoteName)).To(Equal(expected), "URL for %v", remoteName)
+			}
+			u, err := url.Parse(GetSmartURLForRemote(util.GlobalOptions, "rooted"))
+			Expect(err).To(BeNil())
+			Expect(factory.WillHandleUrl(u)).To(BeTrue(), "Should handle URL")
+			Expect(u.Path).To(Equal("//rooted/repo"), "Should still be rooted")
+		})
 		It("Correctly parses bare URLs", func() {
 			// Make sure we can handle all forms of SSH URL
 			// Bare url with no port and relative path
@@ -0,0 +1,99 @@
+package smart
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Chunk hash trailers
+// With the "chunk_hash" feature enabled, whichever side sends chunk or chunk object content
+// follows it with a trailer giving the size & hash of the content (as stored, so after
+// decompressing if it was compressed in transit). The receiver checks it before keeping the
+// content, so a transfer corrupted on the way is rejected straight away rather than being found
+// by fsck later. The hash uses the same algorithm as the LOB's SHA.
+
+const ChunkHashCap = "chunk_hash"
+
+// Sent straight after chunk content, as JSON terminated by a binary 0 like requests & responses
+type TransferTrailer struct {
+	// Bytes of content
+	Size int64
+	// Hex hash of the content
+	Hash string
+}
+
+// Calculates the size & hash of content as it's written, to send or check a trailer
+type TransferHash struct {
+	h    hash.Hash
+	Size int64
+}
+
+// Hash content of a LOB chunk or chunk object with the same algorithm as its SHA
+func NewTransferHash(sha string) *TransferHash {
+	if len(sha) == sha256.Size*2 {
+		return &TransferHash{h: sha256.New()}
+	}
+	return &TransferHash{h: sha1.New()}
+}
+
+func (self *TransferHash) Write(p []byte) (int, error) {
+	self.Size += int64(len(p))
+	return self.h.Write(p)
+}
+
+// The trailer for the content written so far
+func (self *TransferHash) Trailer() *TransferTrailer {
+	return &TransferTrailer{Size: self.Size, Hash: fmt.Sprintf("%x", self.h.Sum(nil))}
+}
+
+// Check the content written so far against the trailer the sender sent
+func (self *TransferHash) Verify(trailer *TransferTrailer) error {
+	mine := self.Trailer()
+	if trailer.Size != mine.Size {
+		return &ConnectionError{fmt.Errorf("Content size does not match trailer (received: %d trailer: %d)", mine.Size, trailer.Size)}
+	}
+	if strings.ToLower(trailer.Hash) != mine.Hash {
+		return &ConnectionError{fmt.Errorf("Content hash does not match trailer (received: %v trailer: %v)", mine.Hash, trailer.Hash)}
+	}
+	return nil
+}
+
+// Send a trailer after content
+func WriteTransferTrailer(out io.Writer, trailer *TransferTrailer) error {
+	trailerbytes, err := json.Marshal(trailer)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(trailerbytes, byte(0)))
+	return err
+}
+
+// Read the trailer sent after content; reads no further than its terminator
+func ReadTransferTrailer(in io.ByteReader) (*TransferTrailer, error) {
+	var trailerbytes []byte
+	for {
+		b, err := in.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read trailer: %w", err)
+		}
+		if b == 0 {
+			break
+		}
+		trailerbytes = append(trailerbytes, b)
+	}
+	trailer := &TransferTrailer{}
+	err := json.Unmarshal(trailerbytes, trailer)
+	if err != nil {
+		return nil, &ConnectionError{fmt.Errorf("Unable to decode trailer: %v\n%v", string(trailerbytes), err.Error())}
+	}
+	if trailer.Hash == "" {
+		return nil, errors.New("Trailer has no hash")
+	}
+	return trailer, nil
+}
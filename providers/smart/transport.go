@@ -3,6 +3,9 @@ package smart
 import (
 	"io"
 	"net/url"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
 )
 
 type TransportProgressCallback func(bytesDone, totalBytes int64)
@@ -59,12 +62,110 @@ type Transport interface {
 	DownloadDelta(baseSHA, targetSHA string, sizeLimit int64, out io.Writer, callback TransportProgressCallback) (bool, error)
 }
 
+// Optional interface for transports which can agree a protocol version & features with the
+// server in one request, see features.go; servers which predate it (protocol version 1) reply
+// with an "Unknown method" error, in which case QueryCaps & SetEnabledCaps are used instead
+type NegotiatingTransport interface {
+	// Send the protocol version & features the client would like to use, in order of preference
+	// Returns the version both speak & the features the server has enabled
+	Negotiate(version int, features []string) (int, []string, error)
+}
+
+// Optional interface for transports which can ask the server to garbage collect LOBs
+// Only used if the server advertises the "prune" capability, which it should only do for
+// users allowed to administer the store
+type PruneTransport interface {
+	// Return the SHAs of all LOBs the server has any files for (complete or not)
+	ListLOBs() ([]string, error)
+	// Ask the server to delete LOBs. Server may retain some anyway (e.g. uploaded recently)
+	// Returns the SHAs deleted (or which would be, if dryRun), those retained & those
+	// which can't be deleted yet because they're under a retention hold
+	PruneLOBs(shas []string, dryRun bool) (deleted, retained, held []string, e error)
+}
+
+// Optional interface for transports which can transfer chunk objects, the content-defined
+// chunks shared between LOBs, which are stored by the SHA of their own content
+// Only used if the server advertises the "chunk_objects" capability
+type ChunkObjectTransport interface {
+	// Return whether a chunk object exists on the server (also returns size)
+	ChunkObjectExists(chunksha string) (ex bool, sz int64, e error)
+	// Upload a chunk object (from a stream); must call back progress
+	UploadChunkObject(chunksha string, sz int64, data io.Reader, callback TransportProgressCallback) error
+	// Download a chunk object (to a stream); must call back progress
+	DownloadChunkObject(chunksha string, out io.Writer, callback TransportProgressCallback) error
+}
+
+// Optional interface for transports which can lock file paths so that only one user changes
+// an unmergeable file at a time
+// Only used if the server advertises the "locking" capability
+type LockTransport interface {
+	// Lock a file path for the connected user; return the existing lock if they already hold it
+	// & an error if someone else does
+	LockFile(path string) (*providers.FileLock, error)
+	// Release a lock; force allows breaking another user's lock, if the server permits it
+	UnlockFile(path string, force bool) error
+	// Return all the locks held on the server, marking those held by the connected user
+	ListLocks() ([]*providers.FileLock, error)
+}
+
+// Optional interface for transports which can compress chunk payloads in transit
+// Only used if the server advertises the "compress=<codec>" capability for the configured codec
+type CompressionTransport interface {
+	// Compress chunk & chunk object payloads with this codec where worthwhile ("" to stop)
+	SetTransferCompression(codec string)
+}
+
+// Optional interface for transports which can send & check size+hash trailers with chunk
+// payloads, see trailer.go
+// Only used if the server enables the "chunk_hash" feature
+type ChunkHashTransport interface {
+	// Send & expect trailers with chunk & chunk object content (or stop)
+	SetChunkHashes(enabled bool)
+}
+
+// Feature enabling DownloadMetadataBatch
+const MetadataBatchCap = "metadata_batch"
+
+// Most LOBs whose metadata can be requested in one DownloadMetadataBatch
+const MaxMetadataBatch = 500
+
+// Optional interface for transports which can download the metadata for many LOBs in one request
+// Only used if the server enables the "metadata_batch" feature
+type BatchMetadataTransport interface {
+	// Download the metadata for up to MaxMetadataBatch LOBs, keyed by SHA; LOBs the server
+	// doesn't have metadata for are left out
+	DownloadMetadataBatch(lobshas []string) (map[string][]byte, error)
+}
+
+// Feature enabling previews of LOBs
+const PreviewsCap = "previews"
+
+// Optional interface for transports which can transfer the small previews of LOBs which
+// git-lob.preview.<ext> commands generate
+// Only used if the server enables the "previews" feature
+type PreviewTransport interface {
+	// Return whether there's a preview of a LOB on the server (also returns size)
+	PreviewExists(lobsha string) (ex bool, sz int64, e error)
+	// Upload the preview of a LOB (from a stream); no progress callback as small
+	UploadPreview(lobsha string, sz int64, data io.Reader) error
+	// Download the preview of a LOB (to a stream); no progress callback as small
+	DownloadPreview(lobsha string, out io.Writer) error
+}
+
 // Interface for a factory which creates persistent transports for use by SmartSyncProvider
 type TransportFactory interface {
 	// Does this factory want to handle the URL passed in?
 	WillHandleUrl(u *url.URL) bool
 	// Provide a new, connected (may not be persistent, but if not test connection/auth) transport for given URL
-	Connect(u *url.URL) (Transport, error)
+	// for the repository at root, using the settings in opts & logging to log
+	Connect(u *url.URL, root string, opts *util.Options, log *util.Logger) (Transport, error)
+}
+
+// Optional interface for transport factories which use settings of the remote being connected
+// to, e.g. SSH connection sharing
+type RemoteTransportFactory interface {
+	// As Connect, for the named remote
+	ConnectRemote(remoteName string, u *url.URL, root string, opts *util.Options, log *util.Logger) (Transport, error)
 }
 
 var (
@@ -76,6 +177,8 @@ var (
 // Later factories registered will take precedence over earlier ones (including core)
 func RegisterTransportFactory(f TransportFactory) {
 	transportFactories = append(transportFactories, f)
+	// Pooled connections may have come from a factory which no longer takes precedence
+	ReleasePooledTransports()
 }
 
 // Retrieve the best ConnectionFactory for a given URL (or nil)
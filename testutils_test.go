@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	"github.com/atlassian/git-lob/core"
 	"github.com/atlassian/git-lob/util"
 )
 
@@ -73,3 +74,16 @@ func ForceRemoveAll(path string) error {
 
 	return err
 }
+
+// Get a Repo for the current directory with util.GlobalOptions, as the git-lob binary would make
+func testRepo() *core.Repo {
+	wd, err := os.Getwd()
+	if err != nil {
+		Fail(fmt.Sprintf("Can't get working dir: %v", err))
+	}
+	repo, err := core.NewRepo(wd, util.GlobalOptions, util.DefaultLogger)
+	if err != nil {
+		Fail(fmt.Sprintf("Not in a repository: %v", err))
+	}
+	return repo
+}
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Cancelling transfers
+// When the user presses Ctrl+C (or the process is sent SIGTERM) during a push or fetch, the
+// transfer is stopped cleanly rather than the process being killed while it writes files:
+// progress callbacks return abort, providers stop after removing the temporary file for the
+// file in progress, & push & fetch record what was completed before returning ErrCancelled.
+// Interrupting a second time kills the process as usual.
+
+// Returned by operations which stopped because they were cancelled
+var ErrCancelled = errors.New("Interrupted, stopped before finishing")
+
+var (
+	cancelled      bool
+	cancelledChan  = make(chan struct{})
+	cancelledMutex sync.Mutex
+)
+
+// Cancel whatever is running, as if interrupted
+func Cancel() {
+	cancelledMutex.Lock()
+	defer cancelledMutex.Unlock()
+	if !cancelled {
+		cancelled = true
+		close(cancelledChan)
+	}
+}
+
+// Has the process been cancelled, so operations should stop as soon as they safely can?
+func IsCancelled() bool {
+	cancelledMutex.Lock()
+	defer cancelledMutex.Unlock()
+	return cancelled
+}
+
+// Allow operations to run again after a cancellation, e.g. between tests
+func ResetCancelled() {
+	cancelledMutex.Lock()
+	defer cancelledMutex.Unlock()
+	if cancelled {
+		cancelled = false
+		cancelledChan = make(chan struct{})
+	}
+}
+
+// Sleep, waking up early if cancelled
+func CancellableSleep(d time.Duration) {
+	cancelledMutex.Lock()
+	ch := cancelledChan
+	cancelledMutex.Unlock()
+	select {
+	case <-ch:
+	case <-time.After(d):
+	}
+}
+
+// Cancel (see Cancel) on the first SIGINT or SIGTERM until release is called, after which
+// signals have their usual effect again. A second signal after cancelling also has its
+// usual effect, so that the user can still kill a process which doesn't stop
+func CancelOnInterrupt() (release func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			signal.Stop(signals)
+			LogConsoleError("\nInterrupted, stopping after the current file (interrupt again to stop immediately)")
+			Cancel()
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+	}
+}
+
+// Wrap a progress callback so that it aborts once cancelled
+func CancellableProgressCallback(callback ProgressCallback) ProgressCallback {
+	return func(data *ProgressCallbackData) (abort bool) {
+		return callback(data) || IsCancelled()
+	}
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
@@ -11,10 +12,21 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/go-homedir"
 )
 
+// Default lifetime of smudge cache entries when git-lob.smudge-cache is just 'true'
+const DefaultSmudgeCacheTTL = 10 * time.Minute
+
+// Limits for git-lob.chunk-size; smaller chunks mean more files & requests, larger ones make
+// interrupted transfers more costly to resume
+const (
+	MinChunkSize = int64(1024 * 1024)
+	MaxChunkSize = int64(1024 * 1024 * 1024)
+)
+
 // Options (command line or config file)
 // Only general options, command-specific ones dealt with in commands
 type Options struct {
@@ -44,8 +56,28 @@ type Options struct {
 	VerboseLog bool
 	// Shared folder in which to store binary files for all repos
 	SharedStore string
+	// Prune the shared store automatically after push & fetch, at most every this many days (0 = never)
+	SharedStoreGCDays int
 	// Auto fetch (download) on checkout?
 	AutoFetchEnabled bool
+	// Replace corrupt binaries found on checkout by fetching them again?
+	AutoRepair bool
+	// Sign the metadata of new binaries with the user's GPG or SSH key?
+	SignLOBs bool
+	// Refuse binaries whose metadata isn't signed by a trusted key on fetch & checkout?
+	VerifyLOBSignatures bool
+	// Commands to run before & after transfers as well as any scripts in .git/hooks, keyed on
+	// hook name e.g. "post-push" (git-lob.hook.<name>)
+	TransferHooks map[string]string
+	// Commands which generate a preview of a new binary from its content, keyed on lower case file
+	// extension without the dot e.g. "png" (git-lob.preview.<ext>)
+	PreviewCommands map[string]string
+	// Previews larger than this are discarded
+	PreviewMaxSize int64
+	// Command 'git lob preview' displays previews with, instead of the platform's default
+	PreviewViewer string
+	// Download previews of binaries when fetching?
+	FetchPreviews bool
 	// 'Recent' window in days for fetching all refs (branches/tags) compared to current date
 	FetchRefsPeriodDays int
 	// 'Recent' window in days for fetching commits on HEAD compared to latest commit date
@@ -62,16 +94,119 @@ type Options struct {
 	PruneRemote string
 	// Whether to always operate prune old in safe mode
 	PruneSafeMode bool
+	// Number of latest versions of each path to keep when pruning old binaries (0 = no policy)
+	PruneKeepVersions int
+	// Patterns of tag names whose binaries are kept when pruning old binaries
+	PruneKeepTags []string
+	// Size below which binaries are kept when pruning old binaries (0 = no policy)
+	PruneKeepSize int64
 	// List of paths to include when fetching
 	FetchIncludePaths []string
 	// List of paths to exclude when fetching
 	FetchExcludePaths []string
+	// List of paths to include when pushing
+	PushIncludePaths []string
+	// List of paths to exclude when pushing
+	PushExcludePaths []string
+	// Size above which binaries are not fetched (0 = no limit, only set by workspaces)
+	FetchMaxSize int64
+	// Paths to fetch before any others, in order of priority (only set by workspaces)
+	FetchPriorityPaths []string
+	// Remotes to fetch from in order of priority when no remote is specified, each only being
+	// asked for binaries the ones before didn't have (e.g. a LAN cache then the main remote)
+	FetchRemotes []string
+	// Only download metadata on fetch, content is fetched when first checked out (only set by --metadata-only)
+	FetchMetadataOnly bool
+	// Fetch binaries for commits in this window instead of recent commits, zero for no limit
+	// (only set by --since & --until)
+	FetchSince time.Time
+	FetchUntil time.Time
+	// Fetch binaries for at most this many commits on each ref, 0 for no limit (only set by --max-commits)
+	FetchMaxCommits int
+	// Prune old binaries after every fetch & pull, as if --prune were used
+	FetchPrune bool
+	// When fetch records commits as pushed to the remote it fetched from ("never", "safe" when
+	// their binaries are known to be on the remote, or "always")
+	FetchUpdatesPushState string
 	// Size above which we'll try to download deltas on fetch (smart servers only)
 	FetchDeltasAboveSize int64
 	// Size above which we'll try to upload deltas on push (smart servers only)
 	PushDeltasAboveSize int64
+	// Whether to learn delta size thresholds per file extension from observed savings
+	// (instead of only using FetchDeltasAboveSize / PushDeltasAboveSize)
+	AdaptiveDeltaSize bool
+	// Size above which deltas are never tried on push, fetch or shrink, however they'd be
+	// generated (0 = unlimited)
+	DeltaMaxSize int64
+	// Delta algorithm to use on push & fetch, if the smart server supports it (default "bm")
+	DeltaAlgorithm string
 	// The command to run over SSH on a remote smart server to push/pull (default "git-lob-server")
 	SSHServerCommand string
+	// Size above which the clean filter warns that a file may have been added by mistake (0 = never)
+	WarnAboveSize int64
+	// Size above which the clean filter refuses to store a file (0 = no limit)
+	RejectAboveSize int64
+	// Size below which the clean filter hints that a file may be better stored in git (0 = never)
+	HintBelowSize int64
+	// Largest binary a commit may add according to 'size-limit report' (0 = no limit)
+	SizeLimitFile int64
+	// Largest total size of the binaries a commit may add according to 'size-limit report' (0 = no limit)
+	SizeLimitCommit int64
+	// Command to run for 'pipe:' smart URLs, which must connect its stdin/stdout to a smart server
+	PipeCommand string
+	// Proxy for connections to remotes, overriding the environment ("none" = never use a proxy)
+	Proxy string
+	// Limit on the total upload rate to remotes in bytes per second (0 = unlimited)
+	MaxUploadRate int64
+	// Limit on the total download rate from remotes in bytes per second (0 = unlimited)
+	MaxDownloadRate int64
+	// Number of times to retry a file transfer after a transient failure (0 = never retry)
+	RetryAttempts int
+	// Delay before the first retry of a file transfer, doubling for each subsequent retry
+	RetryBackoff time.Duration
+	// Number of binaries to check for on a remote at once when working out what to push
+	// (smart remotes are always checked one at a time)
+	RemoteCheckConcurrency int
+	// Codec to compress newly stored binaries with ("" for none, "zstd" or "gzip")
+	Compression string
+	// Codec to compress chunks with in transit to & from smart servers which support it, where
+	// worthwhile ("" for none, "zstd" or "gzip")
+	TransferCompression string
+	// How to split newly stored binaries into chunks ("" for fixed size, "content" for content-defined)
+	Chunking string
+	// Size of the chunks newly stored binaries are split into with fixed size chunking (0 = the
+	// default 32MB, which is what older versions of git-lob always use)
+	ChunkSize int64
+	// Store new versions of a file which have grown by appending by reusing the leading chunks of
+	// the version in the index, rather than writing them again
+	AppendChunking bool
+	// Whether to read back binaries after pushing them ("" for no, "quick" or "deep")
+	PushVerify string
+	// Whether push queues what it would push instead of connecting to the remote ("" for never,
+	// "true" for always or "auto" when the remote can't be reached), see 'push --flush-queue'
+	Offline string
+	// Replicate pushes to secondary remotes (remote.<name>.git-lob-replicate-to) in the background
+	ReplicateBackground bool
+	// Keep smart provider connections open to reuse for later operations on the same remote
+	// within a process, rather than reconnecting each time
+	ReuseConnections bool
+	// How long to keep binaries recently in the working copy for the smudge filter to restore
+	// quickly, e.g. for 'git stash' (0 = disabled)
+	SmudgeCacheTTL time.Duration
+	// What the clean filter does when a file locked by someone else is changed ("warn", "refuse" or "off")
+	LockCheck string
+	// The remote whose file locks are used, "" for the default push remote
+	LockRemote string
+	// Hash used to identify new binaries ("sha1" or "sha256"); binaries already stored keep their hash
+	HashAlgorithm string
+	// Add the size & type of content to placeholders written by the clean filter
+	PlaceholderMetadata bool
+	// Automatically remove stale temporaries & locks left by interrupted processes now & again
+	Housekeeping bool
+	// Limit on the download rate of 'prefetch' in bytes per second (0 = unlimited)
+	PrefetchRate int64
+	// How often 'prefetch --daemon' checks for binaries to download
+	PrefetchInterval time.Duration
 	// Combination of root .gitconfig and repository config as map
 	GitConfig map[string]string
 }
@@ -82,29 +217,82 @@ func NewOptions() *Options {
 		BoolOpts:                    NewStringSet(),
 		Args:                        make([]string, 0, 5),
 		GitConfig:                   make(map[string]string),
+		TransferHooks:               make(map[string]string),
+		PreviewCommands:             make(map[string]string),
+		PreviewMaxSize:              256 * 1024,
 		FetchRefsPeriodDays:         30,
 		FetchCommitsPeriodHEAD:      7,
 		FetchCommitsPeriodOther:     0,
 		FetchIncludePaths:           []string{},
 		FetchExcludePaths:           []string{},
+		PushIncludePaths:            []string{},
+		PushExcludePaths:            []string{},
+		FetchUpdatesPushState:       "safe",
 		FetchDeltasAboveSize:        1024 * 1024,
 		PushDeltasAboveSize:         1024 * 1024,
+		DeltaMaxSize:                2 * 1024 * 1024 * 1024,
+		DeltaAlgorithm:              "bm",
 		RetentionRefsPeriod:         30,
 		RetentionCommitsPeriodHEAD:  7,
 		RetentionCommitsPeriodOther: 0,
 		PruneRemote:                 "origin",
 		SSHServerCommand:            "git-lob-serve",
+		WarnAboveSize:               1024 * 1024 * 1024,
+		RetryAttempts:               3,
+		TransferCompression:         "zstd",
+		RetryBackoff:                time.Second,
+		RemoteCheckConcurrency:      8,
+		LockCheck:                   "warn",
+		HashAlgorithm:               "sha1",
+		Housekeeping:                true,
+		ReplicateBackground:         true,
+		ReuseConnections:            true,
+		PrefetchRate:                1024 * 1024,
+		PrefetchInterval:            10 * time.Minute,
 	}
 }
 
+// Remove the quotes & escapes from a config value the way git does, since values are read raw
+func unquoteConfigValue(value string) string {
+	var buf bytes.Buffer
+	escaped := false
+	for _, c := range value {
+		switch {
+		case escaped:
+			switch c {
+			case 'n':
+				buf.WriteRune('\n')
+			case 't':
+				buf.WriteRune('\t')
+			default:
+				buf.WriteRune(c)
+			}
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			// Quotes only stop whitespace & comment characters being special
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
 // Load config from gitconfig and populate opts
 func LoadConfig(opts *Options) {
-	configmap := ReadConfig()
-	parseConfig(configmap, opts)
+	LoadRepoConfig(GetGitDir(), opts, DefaultLogger)
+}
+
+// Load config from gitconfig and the repository with git dir gitDir and populate opts,
+// reporting invalid settings to log
+func LoadRepoConfig(gitDir string, opts *Options, log *Logger) {
+	configmap := ReadRepoConfig(gitDir, log)
+	parseConfig(configmap, opts, log)
 }
 
 // Parse a loaded config map and populate opts
-func parseConfig(configmap map[string]string, opts *Options) {
+func parseConfig(configmap map[string]string, opts *Options, log *Logger) {
 	opts.GitConfig = configmap
 
 	// Translate our settings to config
@@ -125,15 +313,15 @@ func parseConfig(configmap map[string]string, opts *Options) {
 		opts.VerboseLog = true
 	}
 	if sharedStore := configmap["git-lob.sharedstore"]; sharedStore != "" {
-		sharedStore = filepath.Clean(sharedStore)
+		sharedStore = NormalizeUNCPath(filepath.Clean(sharedStore))
 		exists, isDir := FileOrDirExists(sharedStore)
 		if exists && !isDir {
-			LogErrorf("Invalid path for git-lob.sharedstore: %v\n", sharedStore)
+			log.Errorf("Invalid path for git-lob.sharedstore: %v\n", sharedStore)
 		} else {
 			if !exists {
 				err := os.MkdirAll(sharedStore, 0755)
 				if err != nil {
-					LogErrorf("Unable to create path for git-lob.sharedstore: %v\n", sharedStore)
+					log.Errorf("Unable to create path for git-lob.sharedstore: %v\n", sharedStore)
 				} else {
 					exists = true
 					isDir = true
@@ -145,9 +333,49 @@ func parseConfig(configmap map[string]string, opts *Options) {
 			}
 		}
 	}
+	if gcdays := configmap["git-lob.sharedstore-gc-days"]; gcdays != "" {
+		n, err := strconv.ParseInt(gcdays, 10, 0)
+		if err == nil && n >= 0 {
+			opts.SharedStoreGCDays = int(n)
+		} else {
+			log.Errorf("Invalid value for git-lob.sharedstore-gc-days: %v\n", gcdays)
+		}
+	}
 	if strings.ToLower(configmap["git-lob.autofetch"]) == "true" {
 		opts.AutoFetchEnabled = true
 	}
+	if strings.ToLower(configmap["git-lob.autorepair"]) == "true" {
+		opts.AutoRepair = true
+	}
+	if strings.ToLower(configmap["git-lob.sign"]) == "true" {
+		opts.SignLOBs = true
+	}
+	if strings.ToLower(configmap["git-lob.verify-signatures"]) == "true" {
+		opts.VerifyLOBSignatures = true
+	}
+	for key, command := range configmap {
+		if hook := strings.TrimPrefix(key, "git-lob.hook."); hook != key && strings.TrimSpace(command) != "" {
+			// Commands usually need quotes, which git escapes
+			opts.TransferHooks[hook] = unquoteConfigValue(command)
+		}
+		if ext := strings.TrimPrefix(key, "git-lob.preview."); ext != key && strings.TrimSpace(command) != "" {
+			opts.PreviewCommands[strings.ToLower(strings.TrimPrefix(ext, "."))] = unquoteConfigValue(command)
+		}
+	}
+	if size := configmap["git-lob.preview-max-size"]; size != "" {
+		n, err := ParseSize(size)
+		if err == nil {
+			opts.PreviewMaxSize = n
+		} else {
+			log.Errorf("Invalid value for git-lob.preview-max-size: %v (must be a size, e.g. 100K or 2MB)\n", size)
+		}
+	}
+	if strings.ToLower(configmap["git-lob.fetch-previews"]) == "true" {
+		opts.FetchPreviews = true
+	}
+	if viewer := configmap["git-lob.preview-viewer"]; strings.TrimSpace(viewer) != "" {
+		opts.PreviewViewer = unquoteConfigValue(viewer)
+	}
 
 	//git-lob.fetch-refs
 	//git-lob.fetch-commits-head
@@ -205,15 +433,126 @@ func parseConfig(configmap map[string]string, opts *Options) {
 			opts.FetchExcludePaths = append(opts.FetchExcludePaths, ex)
 		}
 	}
+	if pushincludes := configmap["git-lob.push-include"]; pushincludes != "" {
+		// Split on comma
+		for _, inc := range strings.Split(pushincludes, ",") {
+			inc = strings.TrimSpace(inc)
+			opts.PushIncludePaths = append(opts.PushIncludePaths, inc)
+		}
+	}
+	if pushexcludes := configmap["git-lob.push-exclude"]; pushexcludes != "" {
+		// Split on comma
+		for _, ex := range strings.Split(pushexcludes, ",") {
+			ex = strings.TrimSpace(ex)
+			opts.PushExcludePaths = append(opts.PushExcludePaths, ex)
+		}
+	}
+	if fetchremotes := configmap["git-lob.fetch-remotes"]; fetchremotes != "" {
+		// Split on comma
+		for _, remote := range strings.Split(fetchremotes, ",") {
+			if remote = strings.TrimSpace(remote); remote != "" {
+				opts.FetchRemotes = append(opts.FetchRemotes, remote)
+			}
+		}
+	}
+	if strings.ToLower(configmap["git-lob.fetch-prune"]) == "true" {
+		opts.FetchPrune = true
+	}
+	if pushstate := strings.ToLower(strings.TrimSpace(configmap["git-lob.fetch-updates-push-state"])); pushstate != "" {
+		switch pushstate {
+		case "never", "safe", "always":
+			opts.FetchUpdatesPushState = pushstate
+		case "false":
+			opts.FetchUpdatesPushState = "never"
+		case "true":
+			opts.FetchUpdatesPushState = "safe"
+		default:
+			log.Errorf("Invalid value for git-lob.fetch-updates-push-state: %v (must be never, safe or always)\n", pushstate)
+		}
+	}
 	if pruneremote := strings.TrimSpace(configmap["git-lob.prune-check-remote"]); pruneremote != "" {
 		opts.PruneRemote = pruneremote
 	}
 	if strings.ToLower(configmap["git-lob.prune-safe"]) == "true" {
 		opts.PruneSafeMode = true
 	}
+	if keep := configmap["git-lob.prune-keep-versions"]; keep != "" {
+		n, err := strconv.ParseInt(keep, 10, 0)
+		if err == nil && n >= 0 {
+			opts.PruneKeepVersions = int(n)
+		} else {
+			log.Errorf("Invalid value for git-lob.prune-keep-versions: %v (must be a number)\n", keep)
+		}
+	}
+	if keeptags := configmap["git-lob.prune-keep-tags"]; keeptags != "" {
+		// Split on comma
+		for _, pattern := range strings.Split(keeptags, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				opts.PruneKeepTags = append(opts.PruneKeepTags, pattern)
+			}
+		}
+	}
+	if keepsize := configmap["git-lob.prune-keep-size"]; keepsize != "" {
+		n, err := ParseSize(keepsize)
+		if err == nil {
+			opts.PruneKeepSize = n
+		} else {
+			log.Errorf("Invalid value for git-lob.prune-keep-size: %v (must be a size, e.g. 100K or 2MB)\n", keepsize)
+		}
+	}
 	if sshserver := configmap["git-lob.ssh-server"]; sshserver != "" {
 		opts.SSHServerCommand = sshserver
 	}
+	if size := configmap["git-lob.warn-above-size"]; size != "" {
+		n, err := ParseSize(size)
+		if err == nil {
+			opts.WarnAboveSize = n
+		} else {
+			log.Errorf("Invalid value for git-lob.warn-above-size: %v (must be a size, e.g. 100K or 2GB)\n", size)
+		}
+	}
+	if size := configmap["git-lob.reject-above-size"]; size != "" {
+		n, err := ParseSize(size)
+		if err == nil {
+			opts.RejectAboveSize = n
+		} else {
+			log.Errorf("Invalid value for git-lob.reject-above-size: %v (must be a size, e.g. 100K or 2GB)\n", size)
+		}
+	}
+	if size := configmap["git-lob.hint-below-size"]; size != "" {
+		n, err := ParseSize(size)
+		if err == nil {
+			opts.HintBelowSize = n
+		} else {
+			log.Errorf("Invalid value for git-lob.hint-below-size: %v (must be a size, e.g. 100K or 2GB)\n", size)
+		}
+	}
+	if size := configmap["git-lob.size-limit-file"]; size != "" {
+		n, err := ParseSize(size)
+		if err == nil {
+			opts.SizeLimitFile = n
+		} else {
+			log.Errorf("Invalid value for git-lob.size-limit-file: %v (must be a size, e.g. 100K or 2GB)\n", size)
+		}
+	}
+	if size := configmap["git-lob.size-limit-commit"]; size != "" {
+		n, err := ParseSize(size)
+		if err == nil {
+			opts.SizeLimitCommit = n
+		} else {
+			log.Errorf("Invalid value for git-lob.size-limit-commit: %v (must be a size, e.g. 100K or 2GB)\n", size)
+		}
+	}
+	if pipecmd := strings.TrimSpace(configmap["git-lob.pipe-command"]); pipecmd != "" {
+		opts.PipeCommand = pipecmd
+	}
+	if proxy := strings.TrimSpace(configmap["git-lob.proxy"]); proxy != "" {
+		if _, err := ParseProxyURL(proxy); err == nil || strings.EqualFold(proxy, "none") {
+			opts.Proxy = proxy
+		} else {
+			log.Errorf("Invalid value for git-lob.proxy: %v\n", err.Error())
+		}
+	}
 
 	if recent := configmap["git-lob.fetch-delta-size"]; recent != "" {
 		n, err := strconv.ParseInt(recent, 10, 64)
@@ -227,6 +566,211 @@ func parseConfig(configmap map[string]string, opts *Options) {
 			opts.PushDeltasAboveSize = int64(n)
 		}
 	}
+	if strings.ToLower(configmap["git-lob.delta-size-adaptive"]) == "true" {
+		opts.AdaptiveDeltaSize = true
+	}
+	if alg := strings.ToLower(strings.TrimSpace(configmap["git-lob.delta-algorithm"])); alg != "" {
+		opts.DeltaAlgorithm = alg
+	}
+	if maxsize := configmap["git-lob.delta-max-size"]; maxsize != "" {
+		n, err := ParseSize(maxsize)
+		if err == nil {
+			opts.DeltaMaxSize = n
+		}
+	}
+	if rate := configmap["git-lob.max-upload-rate"]; rate != "" {
+		n, err := ParseTransferRate(rate)
+		if err == nil {
+			opts.MaxUploadRate = n
+		} else {
+			log.Errorf("Invalid value for git-lob.max-upload-rate: %v (must be a rate, e.g. 500K or 2MB)\n", rate)
+		}
+	}
+	if rate := configmap["git-lob.max-download-rate"]; rate != "" {
+		n, err := ParseTransferRate(rate)
+		if err == nil {
+			opts.MaxDownloadRate = n
+		} else {
+			log.Errorf("Invalid value for git-lob.max-download-rate: %v (must be a rate, e.g. 500K or 2MB)\n", rate)
+		}
+	}
+	if retries := strings.TrimSpace(configmap["git-lob.retry-attempts"]); retries != "" {
+		n, err := strconv.Atoi(retries)
+		if err == nil && n >= 0 {
+			opts.RetryAttempts = n
+		} else {
+			log.Errorf("Invalid value for git-lob.retry-attempts: %v (must be a number, 0 or more)\n", retries)
+		}
+	}
+	if concurrency := strings.TrimSpace(configmap["git-lob.remote-check-concurrency"]); concurrency != "" {
+		n, err := strconv.Atoi(concurrency)
+		if err == nil && n >= 1 {
+			opts.RemoteCheckConcurrency = n
+		} else {
+			log.Errorf("Invalid value for git-lob.remote-check-concurrency: %v (must be a number, 1 or more)\n", concurrency)
+		}
+	}
+	if backoff := strings.TrimSpace(configmap["git-lob.retry-backoff"]); backoff != "" {
+		// Plain numbers are milliseconds
+		var d time.Duration
+		ms, err := strconv.Atoi(backoff)
+		if err == nil {
+			d = time.Duration(ms) * time.Millisecond
+		} else {
+			d, err = time.ParseDuration(backoff)
+		}
+		if err == nil && d >= 0 {
+			opts.RetryBackoff = d
+		} else {
+			log.Errorf("Invalid value for git-lob.retry-backoff: %v (must be a duration, e.g. 500ms or 2s)\n", backoff)
+		}
+	}
+	if verify := strings.ToLower(strings.TrimSpace(configmap["git-lob.push-verify"])); verify != "" {
+		switch verify {
+		case "false", "none":
+			opts.PushVerify = ""
+		case "true", "quick":
+			opts.PushVerify = "quick"
+		case "deep":
+			opts.PushVerify = verify
+		default:
+			log.Errorf("Invalid value for git-lob.push-verify: %v (must be false, quick or deep)\n", verify)
+		}
+	}
+	if offline := strings.ToLower(strings.TrimSpace(configmap["git-lob.offline"])); offline != "" {
+		switch offline {
+		case "false":
+			opts.Offline = ""
+		case "true", "auto":
+			opts.Offline = offline
+		default:
+			log.Errorf("Invalid value for git-lob.offline: %v (must be true, auto or false)\n", offline)
+		}
+	}
+	if strings.ToLower(configmap["git-lob.replicate-background"]) == "false" {
+		opts.ReplicateBackground = false
+	}
+	if strings.ToLower(configmap["git-lob.reuse-connections"]) == "false" {
+		opts.ReuseConnections = false
+	}
+	if lockcheck := strings.ToLower(strings.TrimSpace(configmap["git-lob.lock-check"])); lockcheck != "" {
+		switch lockcheck {
+		case "false", "off":
+			opts.LockCheck = "off"
+		case "true", "warn":
+			opts.LockCheck = "warn"
+		case "refuse":
+			opts.LockCheck = lockcheck
+		default:
+			log.Errorf("Invalid value for git-lob.lock-check: %v (must be warn, refuse or off)\n", lockcheck)
+		}
+	}
+	if lockremote := strings.TrimSpace(configmap["git-lob.lock-remote"]); lockremote != "" {
+		opts.LockRemote = lockremote
+	}
+	if hashalg := strings.ToLower(strings.TrimSpace(configmap["git-lob.hash-algorithm"])); hashalg != "" {
+		switch hashalg {
+		case "sha1", "sha256":
+			opts.HashAlgorithm = hashalg
+		case "sha-1", "sha-256":
+			opts.HashAlgorithm = strings.Replace(hashalg, "-", "", 1)
+		default:
+			log.Errorf("Invalid value for git-lob.hash-algorithm: %v (must be sha1 or sha256)\n", hashalg)
+		}
+	}
+	if strings.ToLower(configmap["git-lob.placeholder-metadata"]) == "true" {
+		opts.PlaceholderMetadata = true
+	}
+	if strings.ToLower(configmap["git-lob.housekeeping"]) == "false" {
+		opts.Housekeeping = false
+	}
+	if smudgecache := strings.ToLower(strings.TrimSpace(configmap["git-lob.smudge-cache"])); smudgecache != "" {
+		// true for the default lifetime, or a duration; plain numbers are seconds
+		var d time.Duration
+		var err error
+		switch smudgecache {
+		case "true":
+			d = DefaultSmudgeCacheTTL
+		case "false":
+			d = 0
+		default:
+			secs, interr := strconv.Atoi(smudgecache)
+			if interr == nil {
+				d = time.Duration(secs) * time.Second
+			} else {
+				d, err = time.ParseDuration(smudgecache)
+			}
+		}
+		if err == nil && d >= 0 {
+			opts.SmudgeCacheTTL = d
+		} else {
+			log.Errorf("Invalid value for git-lob.smudge-cache: %v (must be true, false or a duration, e.g. 10m)\n", smudgecache)
+		}
+	}
+	if compression := strings.ToLower(strings.TrimSpace(configmap["git-lob.compression"])); compression != "" {
+		switch compression {
+		case "none", "false":
+			opts.Compression = ""
+		case "zstd", "gzip":
+			opts.Compression = compression
+		default:
+			log.Errorf("Invalid value for git-lob.compression: %v (must be none, zstd or gzip)\n", compression)
+		}
+	}
+	if compression := strings.ToLower(strings.TrimSpace(configmap["git-lob.transfer-compression"])); compression != "" {
+		switch compression {
+		case "none", "false":
+			opts.TransferCompression = ""
+		case "zstd", "gzip":
+			opts.TransferCompression = compression
+		default:
+			log.Errorf("Invalid value for git-lob.transfer-compression: %v (must be none, zstd or gzip)\n", compression)
+		}
+	}
+	if chunking := strings.ToLower(strings.TrimSpace(configmap["git-lob.chunking"])); chunking != "" {
+		switch chunking {
+		case "fixed":
+			opts.Chunking = ""
+		case "content":
+			opts.Chunking = chunking
+		default:
+			log.Errorf("Invalid value for git-lob.chunking: %v (must be fixed or content)\n", chunking)
+		}
+	}
+	if size := strings.TrimSpace(configmap["git-lob.chunk-size"]); size != "" {
+		n, err := ParseSize(size)
+		if err == nil && n >= MinChunkSize && n <= MaxChunkSize {
+			opts.ChunkSize = n
+		} else {
+			log.Errorf("Invalid value for git-lob.chunk-size: %v (must be between %v and %v)\n", size, FormatSize(MinChunkSize), FormatSize(MaxChunkSize))
+		}
+	}
+	if strings.ToLower(configmap["git-lob.append-chunking"]) == "true" {
+		opts.AppendChunking = true
+	}
+	if rate := strings.TrimSpace(configmap["git-lob.prefetch-rate"]); rate != "" {
+		n, err := ParseTransferRate(rate)
+		if err == nil {
+			opts.PrefetchRate = n
+		} else {
+			log.Errorf("Invalid value for git-lob.prefetch-rate: %v (must be a rate, e.g. 500K or 2MB)\n", rate)
+		}
+	}
+	if interval := strings.TrimSpace(configmap["git-lob.prefetch-interval"]); interval != "" {
+		// Plain numbers are seconds
+		var d time.Duration
+		secs, err := strconv.Atoi(interval)
+		if err == nil {
+			d = time.Duration(secs) * time.Second
+		} else {
+			d, err = time.ParseDuration(interval)
+		}
+		if err == nil && d > 0 {
+			opts.PrefetchInterval = d
+		} else {
+			log.Errorf("Invalid value for git-lob.prefetch-interval: %v (must be a duration, e.g. 5m or 1h)\n", interval)
+		}
+	}
 
 }
 
@@ -235,6 +779,11 @@ func parseConfig(configmap map[string]string, opts *Options) {
 // e.g. git-lob.logfile=blah
 // all keys are converted to lower case for easier matching
 func ReadConfig() map[string]string {
+	return ReadRepoConfig(GetGitDir(), DefaultLogger)
+}
+
+// Read .gitconfig & the config of the repository with git dir gitDir, see ReadConfig
+func ReadRepoConfig(gitDir string, log *Logger) map[string]string {
 	// Don't call out to 'git config' to read file, that's slower and forces a dependency on git
 	// which we may not want to have (e.g. support for libgit clients)
 	// Read files directly, it's a simple format anyway
@@ -246,7 +795,7 @@ func ReadConfig() map[string]string {
 	// User config
 	home, err := homedir.Dir()
 	if err != nil {
-		LogError("Unable to access user home directory: ", err.Error())
+		log.Error("Unable to access user home directory: ", err.Error())
 		// continue anyway
 	} else {
 		userConfigFile := path.Join(home, ".gitconfig")
@@ -263,7 +812,6 @@ func ReadConfig() map[string]string {
 	}
 
 	// repo config
-	gitDir := GetGitDir()
 	repoConfigFile := path.Join(gitDir, "config")
 	repoConfig, err := ReadConfigFile(repoConfigFile)
 	if err == nil {
@@ -0,0 +1,291 @@
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Advisory locks between git-lob processes, for state which is read & written in
+// several steps, e.g. push state. A lock is a file created exclusively next
+// to the thing being protected, recording which process holds it. This behaves the same
+// on all platforms, unlike OS file locks (flock / LockFileEx), which have different
+// semantics & don't work on some network filesystems.
+// While held, the lock file's modification time is updated regularly (a heartbeat), so
+// locks left behind by processes which crashed or were killed can be detected as stale
+// & broken, either because the holder is no longer running on this machine, or because
+// the heartbeat stopped (holders on other machines, e.g. a shared store).
+
+// How often a held lock's heartbeat is updated
+var HeartbeatInterval = 5 * time.Second
+
+// A lock whose heartbeat is older than this is considered abandoned
+var StaleAfter = 30 * time.Second
+
+// How often to check whether a lock has been released while waiting for it
+var PollInterval = 50 * time.Millisecond
+
+// Details of the holder of a lock, stored in the lock file
+type LockInfo struct {
+	// Process ID of the holder
+	PID int
+	// Host name of the machine the holder is running on
+	Host string
+	// When the lock was acquired
+	Acquired time.Time
+}
+
+func (self *LockInfo) String() string {
+	return fmt.Sprintf("process %d on %v since %v", self.PID, self.Host, self.Acquired.Format(time.RFC3339))
+}
+
+// Is this the same holder (times from lock files have no monotonic clock reading)
+func (self *LockInfo) sameHolder(other *LockInfo) bool {
+	return self.PID == other.PID && self.Host == other.Host && self.Acquired.Equal(other.Acquired)
+}
+
+// A held lock, which must be released with Release()
+type Lock struct {
+	// Path of the lock file
+	Path string
+	// Details of this holder
+	Info LockInfo
+	// Closed to stop the heartbeat
+	stop chan struct{}
+	// Closed when the heartbeat has stopped
+	stopped chan struct{}
+}
+
+// Returned when a lock could not be acquired before the timeout
+type TimeoutError struct {
+	Path string
+	// Who held the lock when we gave up (nil if unknown)
+	Holder *LockInfo
+}
+
+func (self *TimeoutError) Error() string {
+	if self.Holder != nil {
+		return fmt.Sprintf("Timed out waiting for lock %v, held by %v", self.Path, self.Holder)
+	}
+	return fmt.Sprintf("Timed out waiting for lock %v", self.Path)
+}
+
+// Returned when this process tries to acquire a lock it already holds, which would
+// otherwise wait forever (or until the timeout). Locks belong to the process, so
+// goroutines sharing one must also synchronise between themselves
+type DeadlockError struct {
+	Path string
+}
+
+func (self *DeadlockError) Error() string {
+	return fmt.Sprintf("Deadlock: lock %v is already held by this process", self.Path)
+}
+
+// Is this error the result of a lock not being acquired in time?
+func IsTimeoutError(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
+// Is this error the result of a process trying to acquire a lock it already holds?
+func IsDeadlockError(err error) bool {
+	_, ok := err.(*DeadlockError)
+	return ok
+}
+
+// Locks held by this process, by absolute path
+var heldLocks = make(map[string]*Lock)
+var heldLocksMutex sync.Mutex
+
+// Acquire the lock at path (a file which will be created, along with its parent dirs),
+// waiting up to timeout for another holder to release it (0 to try only once)
+// Stale locks are broken automatically
+func Acquire(path string, timeout time.Duration) (*Lock, error) {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(abspath), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create dir for lock %v: %v", abspath, err.Error())
+	}
+	host, _ := os.Hostname()
+	info := LockInfo{PID: os.Getpid(), Host: host}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		heldLocksMutex.Lock()
+		_, held := heldLocks[abspath]
+		heldLocksMutex.Unlock()
+		if held {
+			return nil, &DeadlockError{abspath}
+		}
+
+		info.Acquired = time.Now()
+		created, err := createLockFile(abspath, &info)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			l := &Lock{Path: abspath, Info: info, stop: make(chan struct{}), stopped: make(chan struct{})}
+			heldLocksMutex.Lock()
+			heldLocks[abspath] = l
+			heldLocksMutex.Unlock()
+			go l.heartbeat()
+			return l, nil
+		}
+
+		// Someone else has it, break it if they've gone away
+		holder, exists, stale := checkStale(abspath)
+		if !exists {
+			// Released in the meantime, try again straight away
+			continue
+		}
+		if stale {
+			breakStaleLock(abspath, holder)
+			continue
+		}
+		if !time.Now().Before(deadline) {
+			return nil, &TimeoutError{abspath, holder}
+		}
+		time.Sleep(PollInterval)
+	}
+}
+
+// Release a held lock; safe to call more than once
+func (self *Lock) Release() error {
+	heldLocksMutex.Lock()
+	if heldLocks[self.Path] != self {
+		heldLocksMutex.Unlock()
+		return nil
+	}
+	delete(heldLocks, self.Path)
+	heldLocksMutex.Unlock()
+
+	close(self.stop)
+	<-self.stopped
+	// Only remove if it's still ours, in case it was broken while we weren't looking
+	current, err := ReadInfo(self.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !current.sameHolder(&self.Info) {
+		return fmt.Errorf("Lock %v was taken over by %v while held", self.Path, current)
+	}
+	err = os.Remove(self.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Read the details of the holder of a lock
+func ReadInfo(path string) (*LockInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info := &LockInfo{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid lock file %v: %v", path, err.Error())
+	}
+	return info, nil
+}
+
+// Update the lock's modification time regularly until released
+func (self *Lock) heartbeat() {
+	defer close(self.stopped)
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			// If this fails the lock may eventually be broken, Release will report that
+			os.Chtimes(self.Path, now, now)
+		}
+	}
+}
+
+// Create the lock file exclusively, returning false if it already exists
+func createLockFile(path string, info *LockInfo) (bool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		// Windows reports access denied for a file which is being deleted
+		if _, staterr := os.Stat(path); staterr == nil {
+			return false, nil
+		}
+		return false, fmt.Errorf("Unable to create lock %v: %v", path, err.Error())
+	}
+	data, _ := json.Marshal(info)
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		os.Remove(path)
+		return false, fmt.Errorf("Unable to write lock %v: %v", path, err.Error())
+	}
+	return true, nil
+}
+
+// Has the lock at path been abandoned by its holder? False if there's no lock
+func IsStale(path string) bool {
+	_, exists, stale := checkStale(path)
+	return exists && stale
+}
+
+// Remove the lock at path if it has been abandoned by its holder (Acquire does this
+// automatically, this is for cleaning up locks nobody is waiting for)
+// Returns whether a stale lock was removed
+func BreakIfStale(path string) bool {
+	holder, exists, stale := checkStale(path)
+	if !exists || !stale {
+		return false
+	}
+	breakStaleLock(path, holder)
+	_, err := os.Stat(path)
+	return os.IsNotExist(err)
+}
+
+// Determine whether an existing lock has been abandoned, returning its holder (if readable)
+// exists is false if the lock was released in the meantime
+func checkStale(path string) (holder *LockInfo, exists, stale bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, !os.IsNotExist(err), false
+	}
+	holder, err = ReadInfo(path)
+	if err != nil {
+		// Either being written right now, or the holder died while writing it
+		return nil, true, time.Since(fi.ModTime()) > StaleAfter
+	}
+	if host, _ := os.Hostname(); holder.Host == host && holder.PID != os.Getpid() && !isProcessRunning(holder.PID) {
+		return holder, true, true
+	}
+	return holder, true, time.Since(fi.ModTime()) > StaleAfter
+}
+
+// Remove a stale lock, provided it hasn't been replaced by someone else in the meantime
+func breakStaleLock(path string, holder *LockInfo) {
+	if holder != nil {
+		current, err := ReadInfo(path)
+		if err != nil || !current.sameHolder(holder) {
+			return
+		}
+	} else if fi, err := os.Stat(path); err != nil || time.Since(fi.ModTime()) <= StaleAfter {
+		return
+	}
+	os.Remove(path)
+}
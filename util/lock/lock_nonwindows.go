@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package lock
+
+import (
+	"syscall"
+)
+
+// Whether a process with this ID is running on this machine
+func isProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	// Signal 0 checks existence without actually sending anything
+	err := syscall.Kill(pid, syscall.Signal(0))
+	// EPERM means it exists but belongs to someone else
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,24 @@
+package lock
+
+import (
+	"testing"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+func TestAll(t *testing.T) {
+	// Connect Ginkgo to Gomega
+	RegisterFailHandler(Fail)
+
+	// Set manual logging off
+	loggingOff := true
+	//loggingOff = false
+	if loggingOff {
+		LogSuppressAllConsoleOutput()
+	}
+
+	// Run everything
+	RunSpecs(t, "Git Lob Lock Test Suite")
+}
@@ -0,0 +1,139 @@
+package lock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Lock", func() {
+	root := filepath.Join(os.TempDir(), "LockTest")
+	lockfile := filepath.Join(root, "sub", "state.lock")
+	var oldHeartbeat, oldStale time.Duration
+	BeforeEach(func() {
+		oldHeartbeat, oldStale = HeartbeatInterval, StaleAfter
+		HeartbeatInterval = 20 * time.Millisecond
+		StaleAfter = time.Second
+	})
+	AfterEach(func() {
+		HeartbeatInterval, StaleAfter = oldHeartbeat, oldStale
+		os.RemoveAll(root)
+	})
+	// Write a lock file as if another process held it
+	writeOtherLock := func(info LockInfo, age time.Duration) {
+		os.MkdirAll(filepath.Dir(lockfile), 0755)
+		data, _ := json.Marshal(info)
+		Expect(ioutil.WriteFile(lockfile, data, 0644)).To(BeNil())
+		t := time.Now().Add(-age)
+		os.Chtimes(lockfile, t, t)
+	}
+	host, _ := os.Hostname()
+
+	It("Acquires & releases", func() {
+		l, err := Acquire(lockfile, 0)
+		Expect(err).To(BeNil(), "Should acquire")
+		info, err := ReadInfo(lockfile)
+		Expect(err).To(BeNil(), "Lock file should be readable")
+		Expect(info.PID).To(Equal(os.Getpid()))
+		Expect(info.Host).To(Equal(host))
+
+		_, err = Acquire(lockfile, time.Second)
+		Expect(IsDeadlockError(err)).To(BeTrue(), "Acquiring again in the same process should fail straight away")
+
+		Expect(l.Release()).To(BeNil(), "Should release")
+		_, err = os.Stat(lockfile)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Lock file should be removed")
+		Expect(l.Release()).To(BeNil(), "Releasing again should be harmless")
+
+		l, err = Acquire(lockfile, 0)
+		Expect(err).To(BeNil(), "Should acquire again after release")
+		l.Release()
+	})
+
+	It("Updates heartbeat while held", func() {
+		l, err := Acquire(lockfile, 0)
+		Expect(err).To(BeNil())
+		defer l.Release()
+		old := time.Now().Add(-time.Hour)
+		os.Chtimes(lockfile, old, old)
+		time.Sleep(100 * time.Millisecond)
+		fi, err := os.Stat(lockfile)
+		Expect(err).To(BeNil())
+		Expect(time.Since(fi.ModTime())).To(BeNumerically("<", time.Minute), "Heartbeat should update modification time")
+	})
+
+	It("Waits for other holders", func() {
+		// Parent process is running on this host
+		other := LockInfo{PID: os.Getppid(), Host: host, Acquired: time.Now()}
+		writeOtherLock(other, 0)
+		start := time.Now()
+		_, err := Acquire(lockfile, 200*time.Millisecond)
+		Expect(IsTimeoutError(err)).To(BeTrue(), "Should time out while held by a running process")
+		Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond), "Should wait for timeout")
+		Expect(err.(*TimeoutError).Holder.PID).To(Equal(other.PID), "Should report holder")
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			os.Remove(lockfile)
+		}()
+		l, err := Acquire(lockfile, 5*time.Second)
+		Expect(err).To(BeNil(), "Should acquire once released")
+		l.Release()
+	})
+
+	It("Breaks stale locks", func() {
+		// Process which has exited on this host
+		cmd := exec.Command("git", "--version")
+		Expect(cmd.Run()).To(BeNil())
+		writeOtherLock(LockInfo{PID: cmd.Process.Pid, Host: host, Acquired: time.Now()}, 0)
+		l, err := Acquire(lockfile, 0)
+		Expect(err).To(BeNil(), "Should break lock held by a process which has exited")
+		l.Release()
+
+		// Heartbeat stopped on another host
+		writeOtherLock(LockInfo{PID: 1, Host: "some-other-host", Acquired: time.Now().Add(-time.Hour)}, time.Hour)
+		l, err = Acquire(lockfile, 0)
+		Expect(err).To(BeNil(), "Should break lock with no recent heartbeat")
+		info, _ := ReadInfo(lockfile)
+		Expect(info.PID).To(Equal(os.Getpid()), "Should now be held by us")
+		l.Release()
+
+		// Recent heartbeat on another host is respected
+		writeOtherLock(LockInfo{PID: 1, Host: "some-other-host", Acquired: time.Now()}, 0)
+		_, err = Acquire(lockfile, 0)
+		Expect(IsTimeoutError(err)).To(BeTrue(), "Should not break lock with recent heartbeat")
+
+		// Unreadable lock is broken only once old
+		Expect(ioutil.WriteFile(lockfile, []byte("{garbage"), 0644)).To(BeNil())
+		_, err = Acquire(lockfile, 0)
+		Expect(IsTimeoutError(err)).To(BeTrue(), "Should not break lock being written")
+		old := time.Now().Add(-time.Hour)
+		os.Chtimes(lockfile, old, old)
+		l, err = Acquire(lockfile, 0)
+		Expect(err).To(BeNil(), "Should break old unreadable lock")
+		l.Release()
+	})
+
+	It("Breaks stale locks on request", func() {
+		Expect(IsStale(lockfile)).To(BeFalse(), "No lock isn't stale")
+		Expect(BreakIfStale(lockfile)).To(BeFalse())
+
+		writeOtherLock(LockInfo{PID: 1, Host: "some-other-host", Acquired: time.Now()}, 0)
+		Expect(IsStale(lockfile)).To(BeFalse(), "Recent heartbeat isn't stale")
+		Expect(BreakIfStale(lockfile)).To(BeFalse())
+		_, err := os.Stat(lockfile)
+		Expect(err).To(BeNil(), "Lock should still be there")
+
+		writeOtherLock(LockInfo{PID: 1, Host: "some-other-host", Acquired: time.Now().Add(-time.Hour)}, time.Hour)
+		Expect(IsStale(lockfile)).To(BeTrue())
+		Expect(BreakIfStale(lockfile)).To(BeTrue())
+		_, err = os.Stat(lockfile)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Stale lock should be removed")
+	})
+})
@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package lock
+
+import (
+	"syscall"
+)
+
+// Exit code reported by GetExitCodeProcess for processes which haven't exited
+const windowsStillActive = 259
+
+// Whether a process with this ID is running on this machine
+func isProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// Access denied means it exists but belongs to someone else
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	err = syscall.GetExitCodeProcess(h, &code)
+	if err != nil {
+		// Can't tell, so assume it's running & rely on the heartbeat
+		return true
+	}
+	return code == windowsStillActive
+}
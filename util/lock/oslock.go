@@ -0,0 +1,83 @@
+package lock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// OS advisory locks (flock / LockFileEx), for many short-lived locks taken by several processes
+// at once, e.g. one for each binary in a shared store. The OS releases them however the holder
+// exits, so there's no heartbeat & nothing is ever left stale, but they don't work on some
+// network filesystems; Acquire is for longer-lived locks on state.
+// Holders are open files rather than processes, so goroutines exclude each other as well.
+
+// A held OS lock, which must be released with Release()
+type OSLock struct {
+	// Path of the lock file
+	Path string
+	f    *os.File
+}
+
+// Acquire an OS lock on path (a file which will be created, along with its parent dirs),
+// waiting up to timeout for another holder to release it (0 to try only once)
+func AcquireOSLock(path string, timeout time.Duration) (*OSLock, error) {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(abspath), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create dir for lock %v: %v", abspath, err.Error())
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(abspath, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open lock %v: %v", abspath, err.Error())
+		}
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Unable to lock %v: %v", abspath, err.Error())
+		}
+		if locked {
+			// The previous holder removes the file when releasing, which may have been after
+			// we opened it, in which case whoever opens the new file won't see our lock
+			fi, staterr := f.Stat()
+			pathfi, pathstaterr := os.Stat(abspath)
+			if staterr == nil && pathstaterr == nil && os.SameFile(fi, pathfi) {
+				return &OSLock{Path: abspath, f: f}, nil
+			}
+			f.Close()
+			continue
+		}
+		f.Close()
+		if !time.Now().Before(deadline) {
+			return nil, &TimeoutError{abspath, nil}
+		}
+		time.Sleep(PollInterval)
+	}
+}
+
+// Release a held OS lock, removing the lock file; safe to call more than once
+func (self *OSLock) Release() error {
+	if self.f == nil {
+		return nil
+	}
+	f := self.f
+	self.f = nil
+	return releaseLockFile(f, self.Path)
+}
+
+// Remove the lock file at path if nobody holds it, e.g. one left behind by a crashed holder on
+// Windows, where lock files can't be removed while they're open
+// Returns whether it was removed
+func RemoveOSLockIfUnheld(path string) bool {
+	l, err := AcquireOSLock(path, 0)
+	if err != nil {
+		return false
+	}
+	return l.Release() == nil
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package lock
+
+import (
+	"os"
+	"syscall"
+)
+
+// Try to take an exclusive flock on an open file without waiting
+func tryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Remove the lock file while still holding it, so that anyone waiting opens a new file rather
+// than locking the one we removed, then close it to release the lock
+func releaseLockFile(f *os.File, path string) error {
+	err := os.Remove(path)
+	closeerr := f.Close()
+	if err == nil || os.IsNotExist(err) {
+		err = closeerr
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("OS lock", func() {
+	root := filepath.Join(os.TempDir(), "OSLockTest")
+	lockfile := filepath.Join(root, "sub", "0123456789abcdef")
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("Acquires, waits & releases", func() {
+		l, err := AcquireOSLock(lockfile, 0)
+		Expect(err).To(BeNil(), "Should acquire")
+		_, err = AcquireOSLock(lockfile, 100*time.Millisecond)
+		Expect(IsTimeoutError(err)).To(BeTrue(), "Should time out while held")
+		other, err := AcquireOSLock(lockfile+"2", 0)
+		Expect(err).To(BeNil(), "Other locks should be independent")
+		other.Release()
+
+		acquired := make(chan *OSLock)
+		go func() {
+			l2, _ := AcquireOSLock(lockfile, 5*time.Second)
+			acquired <- l2
+		}()
+		time.Sleep(100 * time.Millisecond)
+		Expect(l.Release()).To(BeNil(), "Should release")
+		Expect(l.Release()).To(BeNil(), "Releasing again should be harmless")
+		l2 := <-acquired
+		Expect(l2).ToNot(BeNil(), "Waiter should get the lock once released")
+		_, err = os.Stat(lockfile)
+		Expect(err).To(BeNil(), "Waiter should hold a lock file")
+		Expect(RemoveOSLockIfUnheld(lockfile)).To(BeFalse(), "Shouldn't remove a held lock")
+		Expect(l2.Release()).To(BeNil())
+		_, err = os.Stat(lockfile)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Lock file should be removed")
+	})
+
+	It("Removes lock files nobody holds", func() {
+		// As if the holder crashed
+		os.MkdirAll(filepath.Dir(lockfile), 0755)
+		Expect(ioutil.WriteFile(lockfile, nil, 0644)).To(BeNil())
+		l, err := AcquireOSLock(lockfile, 0)
+		Expect(err).To(BeNil(), "Should acquire a lock file left behind")
+		l.Release()
+		Expect(ioutil.WriteFile(lockfile, nil, 0644)).To(BeNil())
+		Expect(RemoveOSLockIfUnheld(lockfile)).To(BeTrue())
+		_, err = os.Stat(lockfile)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
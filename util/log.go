@@ -15,39 +15,72 @@ import (
 	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/go-homedir"
 )
 
-var (
-	// Console output (can be overridden by changing)
-	consoleErr io.Writer = os.Stderr
-	consoleOut io.Writer = os.Stdout
-	// Loggers for file output
+// Where output goes: the console (or other writers) & the log file, filtered by the verbose &
+// quiet options. The command line tool uses DefaultLogger; programs embedding git-lob give
+// each repository its own, see NewLogger
+type Logger struct {
+	// Options which decide what's output (Verbose, Quiet, VerboseLog); GlobalOptions if nil
+	Options *Options
+	// Root of the repository, to prefix lines in the log file; the working dir's if blank
+	Root string
+	// Console output
+	out io.Writer
+	err io.Writer
+	// Loggers for file output, nil if not enabled
 	debugLog  *log.Logger
 	errorLog  *log.Logger
 	outputLog *log.Logger
-	logFile   *os.File
-)
+}
+
+// Logger for the command line tool, which follows GlobalOptions & writes to stdout & stderr
+var DefaultLogger = &Logger{out: os.Stdout, err: os.Stderr}
+
+var logFile *os.File
+
+// Create a logger which sends console output to other writers (nil to discard it) according to
+// opts, e.g. for programs which embed git-lob to capture its output; it doesn't write a log file
+func NewLogger(opts *Options, out, err io.Writer) *Logger {
+	if out == nil {
+		out = ioutil.Discard
+	}
+	if err == nil {
+		err = ioutil.Discard
+	}
+	return &Logger{Options: opts, out: out, err: err}
+}
+
+func (l *Logger) options() *Options {
+	if l.Options != nil {
+		return l.Options
+	}
+	return GlobalOptions
+}
 
 // Always send all console output to stderr, including info/debug messages
 // This is mostly useful when stdout is reserved for piping content
 func LogAllConsoleOutputToStdErr() {
-	consoleOut = os.Stderr
-	consoleErr = os.Stderr
+	DefaultLogger.out = os.Stderr
+	DefaultLogger.err = os.Stderr
 }
 
 // Suppress all console output
 func LogSuppressAllConsoleOutput() {
-	consoleOut = ioutil.Discard
-	consoleErr = ioutil.Discard
-	errorLog = log.New(ioutil.Discard, "", 0)
-	debugLog = log.New(ioutil.Discard, "", 0)
-	outputLog = log.New(ioutil.Discard, "", 0)
+	DefaultLogger.out = ioutil.Discard
+	DefaultLogger.err = ioutil.Discard
+	DefaultLogger.errorLog = log.New(ioutil.Discard, "", 0)
+	DefaultLogger.debugLog = log.New(ioutil.Discard, "", 0)
+	DefaultLogger.outputLog = log.New(ioutil.Discard, "", 0)
 }
 
-func writeToLog(log *log.Logger, addNewline bool, includeStack bool, msgs ...interface{}) {
+func (l *Logger) writeToLog(log *log.Logger, addNewline bool, includeStack bool, msgs ...interface{}) {
 	if log != nil {
 		// Prefix message with repo root (this is cached for efficiency)
 		// We don't add this to the Logger prefix in New() because this prefixes before the timestamp & other
 		// flag-based fields, which means things don't line up nicely in the log
-		root, _, _ := GetRepoRoot() // ignore failure, just use blank string
+		root := l.Root
+		if root == "" {
+			root, _, _ = GetRepoRoot() // ignore failure, just use blank string
+		}
 		buf := bytes.NewBufferString(fmt.Sprintf("[%v]: ", root))
 		fmt.Fprint(buf, msgs...)
 		if addNewline {
@@ -62,112 +95,172 @@ func writeToLog(log *log.Logger, addNewline bool, includeStack bool, msgs ...int
 }
 
 // Log error to console and log with format (no implicit newline)
-func LogErrorf(format string, v ...interface{}) {
+func (l *Logger) Errorf(format string, v ...interface{}) {
 	msg := fmt.Sprintf(format, v...)
-	fmt.Fprint(consoleErr, msg)
-	writeToLog(errorLog, false, true, msg)
+	fmt.Fprint(l.err, msg)
+	l.writeToLog(l.errorLog, false, true, msg)
 }
 
 // Log debug message to console and log with format (if verbose)
-func LogDebugf(format string, v ...interface{}) {
-	if GlobalOptions.Verbose {
-		fmt.Fprintf(consoleOut, format, v...)
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	if l.options().Verbose {
+		fmt.Fprintf(l.out, format, v...)
 	}
 
-	if GlobalOptions.VerboseLog {
-		writeToLog(debugLog, false, false, fmt.Sprintf(format, v...))
+	if l.options().VerboseLog {
+		l.writeToLog(l.debugLog, false, false, fmt.Sprintf(format, v...))
 	}
 
 }
 
 // Log output message to console and log with format (if not quiet)
 // You probably don't want to use this since most info messages are for
-// an interactive user only; see LogConsolef instead for that
-func Logf(format string, v ...interface{}) {
-	if !GlobalOptions.Quiet {
+// an interactive user only; see Consolef instead for that
+func (l *Logger) Logf(format string, v ...interface{}) {
+	if !l.options().Quiet {
 		msg := fmt.Sprintf(format, v...)
-		fmt.Fprint(consoleOut, msg)
-		writeToLog(outputLog, false, false, msg)
+		fmt.Fprint(l.out, msg)
+		l.writeToLog(l.outputLog, false, false, msg)
 	}
 }
 
 // Log error message to console and log with newline & spaces in between
-func LogError(msgs ...interface{}) {
-	fmt.Fprintln(consoleErr, msgs...)
-	writeToLog(errorLog, true, true, msgs...)
+func (l *Logger) Error(msgs ...interface{}) {
+	fmt.Fprintln(l.err, msgs...)
+	l.writeToLog(l.errorLog, true, true, msgs...)
 }
 
 // Log debug message to console and log with newline (if verbose)
-func LogDebug(msgs ...interface{}) {
-	if GlobalOptions.Verbose {
-		fmt.Fprintln(consoleOut, msgs...)
+func (l *Logger) Debug(msgs ...interface{}) {
+	if l.options().Verbose {
+		fmt.Fprintln(l.out, msgs...)
 	}
 
-	if GlobalOptions.VerboseLog {
-		writeToLog(debugLog, true, false, msgs...)
+	if l.options().VerboseLog {
+		l.writeToLog(l.debugLog, true, false, msgs...)
 	}
 }
 
 // Log output message to console and log with newline (if not quiet)
 // You probably don't want to use this since most info messages are for
-// an interactive user only; see util.LogConsole instead for that
-func Log(msgs ...interface{}) {
-	if !GlobalOptions.Quiet {
-		fmt.Fprintln(consoleOut, msgs...)
-		writeToLog(outputLog, true, false, msgs...)
+// an interactive user only; see Console instead for that
+func (l *Logger) Log(msgs ...interface{}) {
+	if !l.options().Quiet {
+		fmt.Fprintln(l.out, msgs...)
+		l.writeToLog(l.outputLog, true, false, msgs...)
 	}
 }
 
 // Write an informational message to the console with newline (if not quiet), and not the log
-func LogConsole(msgs ...interface{}) {
-	if !GlobalOptions.Quiet {
-		fmt.Fprintln(consoleOut, msgs...)
+func (l *Logger) Console(msgs ...interface{}) {
+	if !l.options().Quiet {
+		fmt.Fprintln(l.out, msgs...)
 	}
 }
 
 // Overwrite the current line in the console (e.g. for progressive update), if not quiet
 // Requires the previous line length so that it can clear it with spaces
 // Does not add a newline after writing
-func LogConsoleOverwrite(newString string, lastLineLength int) {
+func (l *Logger) ConsoleOverwrite(newString string, lastLineLength int) {
 	if len(newString) < lastLineLength {
-		LogConsolef("\r%v%v", newString, strings.Repeat(" ", lastLineLength-len(newString)))
+		l.Consolef("\r%v%v", newString, strings.Repeat(" ", lastLineLength-len(newString)))
 	} else {
-		LogConsolef("\r%v", newString)
+		l.Consolef("\r%v", newString)
 	}
 
 }
 
+// Write a final summary of an operation to the console with newline, even if quiet, and not the log
+func (l *Logger) ConsoleSummary(msgs ...interface{}) {
+	fmt.Fprintln(l.out, msgs...)
+}
+
+// Whether console output is going to a terminal, rather than being redirected to a file or pipe
+func (l *Logger) consoleIsTerminal() bool {
+	f, ok := l.out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 // Write an informational message to the console (if not quiet), and not the log
-func LogConsolef(format string, v ...interface{}) {
-	if !GlobalOptions.Quiet {
-		fmt.Fprintf(consoleOut, format, v...)
+func (l *Logger) Consolef(format string, v ...interface{}) {
+	if !l.options().Quiet {
+		fmt.Fprintf(l.out, format, v...)
 	}
 }
 
 // Write an error message to the console with newline and not the log
-func LogConsoleError(msgs ...interface{}) {
-	fmt.Fprintln(consoleErr, msgs...)
+func (l *Logger) ConsoleError(msgs ...interface{}) {
+	fmt.Fprintln(l.err, msgs...)
 }
 
 // Write an error message to the console and not the log
-func LogConsoleErrorf(format string, v ...interface{}) {
-	fmt.Fprintf(consoleErr, format, v...)
+func (l *Logger) ConsoleErrorf(format string, v ...interface{}) {
+	fmt.Fprintf(l.err, format, v...)
 }
 
 // Write a debug message to the console with newline (if verbose), and not the log
-func LogConsoleDebug(msgs ...interface{}) {
-	if GlobalOptions.Verbose {
-		fmt.Fprintln(consoleOut, msgs...)
+func (l *Logger) ConsoleDebug(msgs ...interface{}) {
+	if l.options().Verbose {
+		fmt.Fprintln(l.out, msgs...)
 	}
 }
 
 // Write a debug message to the console (if verbose), and not the log
-func LogConsoleDebugf(format string, v ...interface{}) {
-	if GlobalOptions.Verbose {
-		fmt.Fprintf(consoleOut, format, v...)
+func (l *Logger) ConsoleDebugf(format string, v ...interface{}) {
+	if l.options().Verbose {
+		fmt.Fprintf(l.out, format, v...)
 	}
 }
 
+// The functions below write to DefaultLogger, see the Logger methods of the same names
+
+func LogErrorf(format string, v ...interface{}) {
+	DefaultLogger.Errorf(format, v...)
+}
+func LogDebugf(format string, v ...interface{}) {
+	DefaultLogger.Debugf(format, v...)
+}
+func Logf(format string, v ...interface{}) {
+	DefaultLogger.Logf(format, v...)
+}
+func LogError(msgs ...interface{}) {
+	DefaultLogger.Error(msgs...)
+}
+func LogDebug(msgs ...interface{}) {
+	DefaultLogger.Debug(msgs...)
+}
+func Log(msgs ...interface{}) {
+	DefaultLogger.Log(msgs...)
+}
+func LogConsole(msgs ...interface{}) {
+	DefaultLogger.Console(msgs...)
+}
+func LogConsoleOverwrite(newString string, lastLineLength int) {
+	DefaultLogger.ConsoleOverwrite(newString, lastLineLength)
+}
+func LogConsoleSummary(msgs ...interface{}) {
+	DefaultLogger.ConsoleSummary(msgs...)
+}
+func LogConsolef(format string, v ...interface{}) {
+	DefaultLogger.Consolef(format, v...)
+}
+func LogConsoleError(msgs ...interface{}) {
+	DefaultLogger.ConsoleError(msgs...)
+}
+func LogConsoleErrorf(format string, v ...interface{}) {
+	DefaultLogger.ConsoleErrorf(format, v...)
+}
+func LogConsoleDebug(msgs ...interface{}) {
+	DefaultLogger.ConsoleDebug(msgs...)
+}
+func LogConsoleDebugf(format string, v ...interface{}) {
+	DefaultLogger.ConsoleDebugf(format, v...)
+}
+
 func getLogFileHandle() *os.File {
 	var logFileName string
 	if GlobalOptions.LogFile != "" {
@@ -193,9 +286,9 @@ func InitLogging() {
 	if GlobalOptions.LogEnabled {
 		const logFlags = log.Ldate | log.Ltime
 		f := getLogFileHandle()
-		outputLog = log.New(f, "", logFlags)
-		errorLog = log.New(f, "ERROR: ", logFlags)
-		debugLog = log.New(f, "", logFlags)
+		DefaultLogger.outputLog = log.New(f, "", logFlags)
+		DefaultLogger.errorLog = log.New(f, "ERROR: ", logFlags)
+		DefaultLogger.debugLog = log.New(f, "", logFlags)
 	}
 }
 func ShutDownLogging() {
@@ -210,7 +303,7 @@ var spinnerChars = []byte{'|', '/', '-', '\\'}
 
 // Render a 'spinner' in the console, with optional prefix (which must stay constant between calls unless you clear the line)
 func LogConsoleSpinner(prefix string) {
-	LogConsoleOverwrite(fmt.Sprintf("%v%c", prefix, spinnerChars[spinnerCycle]), len(prefix)+1)
+	DefaultLogger.ConsoleOverwrite(fmt.Sprintf("%v%c", prefix, spinnerChars[spinnerCycle]), len(prefix)+1)
 	spinnerCycle = (spinnerCycle + 1) % len(spinnerChars)
 }
 
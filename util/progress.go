@@ -3,6 +3,7 @@ package util
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -19,8 +20,30 @@ const (
 	ProgressNotFound ProgressCallbackType = iota
 	// Non-fatal error
 	ProgressError ProgressCallbackType = iota
+	// Process is verifying the integrity of data it already has (e.g. recalculating a SHA)
+	ProgressVerifying ProgressCallbackType = iota
+	// Process is applying a binary delta to generate new content
+	ProgressApplyingDelta ProgressCallbackType = iota
+	// Process is linking content into place (e.g. from the shared store)
+	ProgressLinking ProgressCallbackType = iota
+	// Process is about to retry an item after a transient failure (e.g. a dropped connection)
+	// Retry has the details
+	ProgressRetry ProgressCallbackType = iota
 )
 
+// Get a description of a phase which isn't transferring data (Verifying, ApplyingDelta, Linking)
+func progressPhaseName(t ProgressCallbackType) string {
+	switch t {
+	case ProgressVerifying:
+		return "Verifying"
+	case ProgressApplyingDelta:
+		return "Applying delta"
+	case ProgressLinking:
+		return "Linking"
+	}
+	return ""
+}
+
 // Collected callback data for a progress operation
 type ProgressCallbackData struct {
 	// What stage of the process this is for, preparing, transferring or skipping something
@@ -28,6 +51,8 @@ type ProgressCallbackData struct {
 	// Either a general message or an item name (e.g. file name in download stage)
 	Desc string
 	// If applicable, how many bytes transferred for this item
+	// For Verifying, ApplyingDelta & Linking this is progress through that phase for the item, which
+	// must be reported with ItemBytesDone = 0 at the start & ItemBytesDone = ItemBytes (> 0) at the end
 	ItemBytesDone int64
 	// If applicable, how many bytes comprise this item
 	ItemBytes int64
@@ -35,149 +60,431 @@ type ProgressCallbackData struct {
 	TotalBytesDone int64
 	// The number of bytes needed to transfer all of this process
 	TotalBytes int64
+	// For ProgressRetry, which retry this is; nil otherwise
+	Retry *ProgressRetryDetail
+}
+
+// Which retry of an item a ProgressRetry callback is for
+type ProgressRetryDetail struct {
+	// Number of this retry, starting at 1
+	Attempt int
+	// Maximum number of retries (git-lob.retry-attempts)
+	MaxAttempts int
 }
 
 // Summarised results of some progress action
 type ProgressResults struct {
 	// Items transferred fully
 	TransferredCount int
+	// Bytes in the items transferred fully
+	TransferredBytes int64
 	// Items skipped (not needed)
 	SkippedCount int
 	// Items that failed (but did not stop process)
 	ErrorCount int
 	// Items which were not found in source
 	NotFoundCount int
+	// Retries of items after transient failures (whether or not they then succeeded)
+	RetryCount int
+	// Time spent in phases other than transferring (Verifying, ApplyingDelta, Linking)
+	PhaseDurations map[ProgressCallbackType]time.Duration
+	// Time the whole process took
+	Duration time.Duration
 }
 
 // Callback when progress is made during process
 // return true to abort the (entire) process
 type ProgressCallback func(data *ProgressCallbackData) (abort bool)
 
+// Estimates a transfer rate from the progress made over a rolling window of time, so that it
+// follows changes in rate but isn't thrown off by a single slow or fast moment
+type RollingRateEstimator struct {
+	window time.Duration
+	times  []time.Time
+	totals []int64
+}
+
+func NewRollingRateEstimator(window time.Duration) *RollingRateEstimator {
+	return &RollingRateEstimator{window: window}
+}
+
+// Record the total number of bytes transferred so far, at a point in time
+func (r *RollingRateEstimator) AddSample(t time.Time, totalBytesDone int64) {
+	if n := len(r.totals); n > 0 && totalBytesDone < r.totals[n-1] {
+		// Process has moved on to something else (e.g. metadata to content), start again
+		r.times = nil
+		r.totals = nil
+	}
+	r.times = append(r.times, t)
+	r.totals = append(r.totals, totalBytesDone)
+	// Drop samples which are out of the window, but keep the last one before it as the baseline
+	drop := 0
+	for drop < len(r.times)-2 && t.Sub(r.times[drop+1]) >= r.window {
+		drop++
+	}
+	r.times = r.times[drop:]
+	r.totals = r.totals[drop:]
+}
+
+// Get the transfer rate over the window in bytes per second, or 0 if not known yet
+func (r *RollingRateEstimator) Rate() int64 {
+	n := len(r.times)
+	if n < 2 {
+		return 0
+	}
+	elapsed := r.times[n-1].Sub(r.times[0]).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(r.totals[n-1]-r.totals[0]) / elapsed)
+}
+
+// Estimate how long it will take to transfer a number of bytes at the current rate
+// Returns false if the rate isn't known (or nothing is being transferred)
+func (r *RollingRateEstimator) ETA(bytesRemaining int64) (time.Duration, bool) {
+	rate := r.Rate()
+	if rate <= 0 {
+		return 0, false
+	}
+	return time.Duration(bytesRemaining/rate) * time.Second, true
+}
+
+// Progress lines being updated in place on the console
+// On a terminal these are redrawn over several lines, otherwise they're joined onto one line
+// which is overwritten (with a carriage return) as before
+type progressDisplay struct {
+	log       *Logger
+	multiLine bool
+	// Lines currently drawn, in multi-line mode
+	lineCount int
+	// Length of the current line, in single line mode
+	lineLen int
+}
+
+func newProgressDisplay(log *Logger) *progressDisplay {
+	return &progressDisplay{log: log, multiLine: log.consoleSupportsCursorMovement()}
+}
+
+// Draw lines of progress over what was drawn last
+func (d *progressDisplay) show(lines ...string) {
+	if !d.multiLine {
+		msg := strings.Join(lines, " ")
+		d.log.ConsoleOverwrite(msg, d.lineLen)
+		d.lineLen = len(msg)
+		return
+	}
+	buf := bytes.NewBufferString(d.moveToStart())
+	for i, line := range lines {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(line)
+		// Clear whatever was left of the line drawn before
+		buf.WriteString("\x1b[K")
+	}
+	// Clear any lines drawn before which aren't needed now
+	buf.WriteString("\x1b[J")
+	d.log.Consolef("%v", buf.String())
+	d.lineCount = len(lines)
+}
+
+// Remove the progress lines, so that other messages can be written in their place
+func (d *progressDisplay) clear() {
+	if d.multiLine {
+		if d.lineCount > 0 {
+			d.log.Consolef("%v\x1b[J", d.moveToStart())
+			d.lineCount = 0
+		}
+	} else if d.lineLen > 0 {
+		d.log.ConsoleOverwrite("", d.lineLen)
+		d.log.Consolef("\r")
+		d.lineLen = 0
+	}
+}
+
+// Leave the progress lines as they are & move on to the next line
+func (d *progressDisplay) finish() {
+	if d.lineCount > 0 || d.lineLen > 0 {
+		d.log.Console("")
+	}
+	d.lineCount = 0
+	d.lineLen = 0
+}
+
+// Get escape codes to move the cursor to the start of the first line drawn (multi-line mode)
+func (d *progressDisplay) moveToStart() string {
+	if d.lineCount > 1 {
+		return fmt.Sprintf("\x1b[%dA\r", d.lineCount-1)
+	}
+	return "\r"
+}
+
+// Format overall progress, e.g. "Fetching: 45% of 30MB (2.1MB/s, ETA 1m5s)"
+func formatOverallProgress(op string, progress *ProgressCallbackData, rate *RollingRateEstimator) string {
+	buf := bytes.NewBufferString(fmt.Sprintf("%ving: ", op))
+	if progress.TotalBytes > 0 {
+		buf.WriteString(fmt.Sprintf("%d%% of %v", int((100*progress.TotalBytesDone)/progress.TotalBytes), FormatSize(progress.TotalBytes)))
+		if eta, ok := rate.ETA(progress.TotalBytes - progress.TotalBytesDone); ok {
+			buf.WriteString(fmt.Sprintf(" (%v, ETA %v)", FormatTransferRate(rate.Rate()), eta))
+		}
+	}
+	return buf.String()
+}
+
+// Format progress of the item being transferred, e.g. "level1.psd 67% of 12MB"
+func formatItemProgress(progress *ProgressCallbackData) string {
+	return fmt.Sprintf("%v %d%% of %v", progress.Desc, int((100*progress.ItemBytesDone)/progress.ItemBytes), FormatSize(progress.ItemBytes))
+}
+
+// Format a summary of the results of a process, e.g. "Fetched 3 files (12MB) in 4.1s (2.9MB/s), 1 up to date"
+func formatProgressSummary(op string, results *ProgressResults) string {
+	buf := bytes.NewBufferString(fmt.Sprintf("%ved %d files", op, results.TransferredCount))
+	if results.TransferredCount > 0 {
+		buf.WriteString(fmt.Sprintf(" (%v)", FormatSize(results.TransferredBytes)))
+	}
+	buf.WriteString(fmt.Sprintf(" in %v", formatPhaseDuration(results.Duration)))
+	if seconds := results.Duration.Seconds(); results.TransferredBytes > 0 && seconds > 0 {
+		buf.WriteString(fmt.Sprintf(" (%v)", FormatTransferRate(int64(float64(results.TransferredBytes)/seconds))))
+	}
+	if results.SkippedCount > 0 {
+		buf.WriteString(fmt.Sprintf(", %d up to date", results.SkippedCount))
+	}
+	if results.NotFoundCount > 0 {
+		buf.WriteString(fmt.Sprintf(", %d not found", results.NotFoundCount))
+	}
+	if results.RetryCount > 0 {
+		buf.WriteString(fmt.Sprintf(", %d retried", results.RetryCount))
+	}
+	return buf.String()
+}
+
 // Function to periodically (based on freq) report progress of a transfer process to the console
 // callbackChan must be a channel of updates which is being populated with ProgressCallbackData
 // from a goroutine at an unknown frequency. This function will then print updates every freq seconds
 // of the updates received so far, collapsing duplicates (in the case of very frequent transfer updates)
 // and filling in the blanks with an updated transfer rate in the case of no updates in the time.
-func ReportProgressToConsole(callbackChan <-chan *ProgressCallbackData, op string, freq time.Duration) *ProgressResults {
+// Overall progress & ETA are shown along with the progress of the current file, on separate lines
+// which are updated in place if the console is a terminal.
+// Phases other than transferring (e.g. verifying) are shown while they happen, and the time spent
+// in each is summarised at the end. A summary of the results is always printed at the end, even
+// if quiet (which suppresses everything else).
+func (l *Logger) ReportProgressToConsole(callbackChan <-chan *ProgressCallbackData, op string, freq time.Duration) *ProgressResults {
 	// Update the console once every half second regardless of how many callbacks
 	// (or zero callbacks, so we can reduce xfer rate)
 	tickChan := time.Tick(freq)
-	// samples of data transferred over the last 4 ticks (2s average)
-	transferRate := NewTransferRateCalculator(4)
+	// Rate over the last 5s, for the ETA
+	transferRate := NewRollingRateEstimator(5 * time.Second)
 
-	var lastTotalBytesDone int64
-	var lastTime = time.Now()
 	var lastProgress *ProgressCallbackData
+	// Phase currently in progress, & start times of phases by type & item
+	var currentPhase *ProgressCallbackData
+	phaseStarts := make(map[string]time.Time)
+	startTime := time.Now()
 	complete := false
-	lastConsoleLineLen := 0
-	results := &ProgressResults{}
-	for _ = range tickChan {
-		// We run this every 0.5s
-		var finalDownloadProgress *ProgressCallbackData
-		for stop := false; !stop && !complete; {
-			select {
-			case data := <-callbackChan:
-				if data == nil {
-					// channel was closed, we've finished
-					stop = true
-					complete = true
-					break
+	display := newProgressDisplay(l)
+	results := &ProgressResults{PhaseDurations: make(map[ProgressCallbackType]time.Duration)}
+	for !complete {
+		// Process updates as they arrive so that phases are timed accurately, but only
+		// write progress to the console every tick
+		ticked := false
+		select {
+		case data := <-callbackChan:
+			if data == nil {
+				// channel was closed, we've finished
+				complete = true
+				break
+			}
+			// May get many of these and we only want to display the last one
+			// unless it's general infoo or we're in verbose mode
+			switch data.Type {
+			case ProgressCalculate:
+				display.clear()
+				l.Console(data.Desc)
+			case ProgressError:
+				display.clear()
+				l.Console(data.Desc)
+			case ProgressSkip:
+				results.SkippedCount++
+				// Only print if verbose
+				if l.options().Verbose {
+					display.clear()
+					l.ConsoleDebugf("Skipped: %v (Up to date)\n", data.Desc)
+				}
+			case ProgressNotFound:
+				results.NotFoundCount++
+				display.clear()
+				l.Consolef("Not found: %v (Continuing)\n", data.Desc)
+			case ProgressRetry:
+				results.RetryCount++
+				display.clear()
+				if data.Retry != nil {
+					l.Consolef("Retrying: %v (retry %d of %d)\n", data.Desc, data.Retry.Attempt, data.Retry.MaxAttempts)
+				} else {
+					l.Consolef("Retrying: %v\n", data.Desc)
 				}
-				// Some progress data is available
-				// May get many of these and we only want to display the last one
-				// unless it's general infoo or we're in verbose mode
-				switch data.Type {
-				case ProgressCalculate:
-					finalDownloadProgress = nil
-					LogConsole(data.Desc)
-				case ProgressError:
-					finalDownloadProgress = nil
-					LogConsole(data.Desc)
-				case ProgressSkip:
-					finalDownloadProgress = nil
-					results.SkippedCount++
-					// Only print if verbose
-					LogConsoleDebugf("Skipped: %v (Up to date)\n", data.Desc)
-				case ProgressNotFound:
-					finalDownloadProgress = nil
-					results.NotFoundCount++
-					LogConsolef("Not found: %v (Continuing)\n", data.Desc)
-				case ProgressTransferBytes:
-					finalDownloadProgress = data
+			case ProgressTransferBytes:
+				if data.ItemBytes != 0 || data.TotalBytes != 0 {
+					lastProgress = data
+				}
+				if data.ItemBytesDone == data.ItemBytes {
+					results.TransferredCount++
+					results.TransferredBytes += data.ItemBytes
 					// Print completion in verbose mode
-					if data.ItemBytesDone == data.ItemBytes {
-						results.TransferredCount++
-						if GlobalOptions.Verbose {
-							msg := fmt.Sprintf("%ved: %v 100%%", op, data.Desc)
-							LogConsoleOverwrite(msg, lastConsoleLineLen)
-							lastConsoleLineLen = len(msg)
-							// Clear line on completion in verbose mode
-							// Don't do this as \n in string above since we need to clear spaces after
-							LogConsole("")
-							finalDownloadProgress = nil
-							lastProgress = nil
-						}
+					if l.options().Verbose {
+						display.clear()
+						l.Consolef("%ved: %v 100%%\n", op, data.Desc)
 					}
 				}
-			default:
-				// No (more) progress data
-				stop = true
-			}
-		}
-		// Write progress data for this 0.5s if relevant
-		// If either we have new progress data, or unfinished progress data from previous
-		if finalDownloadProgress != nil || lastProgress != nil {
-			var bytesPerSecond int64
-			if finalDownloadProgress != nil && finalDownloadProgress.ItemBytes != 0 && finalDownloadProgress.TotalBytes != 0 {
-				lastProgress = finalDownloadProgress
-				bytesDoneThisTick := finalDownloadProgress.TotalBytesDone - lastTotalBytesDone
-				lastTotalBytesDone = finalDownloadProgress.TotalBytesDone
-				seconds := float32(time.Since(lastTime).Seconds())
-				if seconds > 0 {
-					bytesPerSecond = int64(float32(bytesDoneThisTick) / seconds)
+			case ProgressVerifying, ProgressApplyingDelta, ProgressLinking:
+				key := fmt.Sprintf("%d %v", data.Type, data.Desc)
+				start, ok := phaseStarts[key]
+				if !ok {
+					start = time.Now()
+					phaseStarts[key] = start
 				}
-			} else {
-				// Actually the default but lets be specific
-				bytesPerSecond = 0
-			}
-			// Calculate transfer rate
-			transferRate.AddSample(bytesPerSecond)
-			avgRate := transferRate.Average()
-			lastTime = time.Now()
-
-			if lastProgress.ItemBytes != 0 || lastProgress.TotalBytes != 0 {
-				buf := bytes.NewBufferString(fmt.Sprintf("%ving: ", op))
-				if lastProgress.ItemBytes > 0 && GlobalOptions.Verbose {
-					itemPercent := int((100 * lastProgress.ItemBytesDone) / lastProgress.ItemBytes)
-					buf.WriteString(fmt.Sprintf("%v %d%%", lastProgress.Desc, itemPercent))
-					if lastProgress.TotalBytes != 0 {
-						buf.WriteString(" Overall: ")
+				if data.ItemBytesDone >= data.ItemBytes {
+					// Phase finished for this item
+					elapsed := time.Since(start)
+					delete(phaseStarts, key)
+					results.PhaseDurations[data.Type] += elapsed
+					currentPhase = nil
+					if l.options().Verbose {
+						display.clear()
+						l.Consolef("%v: %v done (%v)\n", progressPhaseName(data.Type), data.Desc, formatPhaseDuration(elapsed))
 					}
+				} else {
+					currentPhase = data
 				}
-				if lastProgress.TotalBytes > 0 && avgRate > 0 {
-					overallPercent := int((100 * lastProgress.TotalBytesDone) / lastProgress.TotalBytes)
-					bytesRemaining := lastProgress.TotalBytes - lastProgress.TotalBytesDone
-					secondsRemaining := bytesRemaining / avgRate
-					timeRemaining := time.Duration(secondsRemaining) * time.Second
+			}
+		case <-tickChan:
+			ticked = true
+		}
+		if !ticked && !complete {
+			continue
+		}
 
-					buf.WriteString(fmt.Sprintf("%d%% (%v ETA %v)", overallPercent, FormatTransferRate(avgRate), timeRemaining))
-				}
-				msg := buf.String()
-				LogConsoleOverwrite(msg, lastConsoleLineLen)
-				lastConsoleLineLen = len(msg)
+		if currentPhase != nil && !complete {
+			// Transfers are paused, so show the phase instead of a stalled transfer
+			buf := bytes.NewBufferString(fmt.Sprintf("%v: %v", progressPhaseName(currentPhase.Type), currentPhase.Desc))
+			if currentPhase.ItemBytesDone > 0 {
+				buf.WriteString(fmt.Sprintf(" %d%%", int((100*currentPhase.ItemBytesDone)/currentPhase.ItemBytes)))
 			}
+			start := phaseStarts[fmt.Sprintf("%d %v", currentPhase.Type, currentPhase.Desc)]
+			buf.WriteString(fmt.Sprintf(" (%v)", formatPhaseDuration(time.Since(start))))
+			display.show(buf.String())
+			continue
 		}
 
-		if complete {
-			break
+		// Write progress for this tick, including when nothing new has arrived so that the
+		// rate & ETA fall if the transfer stalls
+		if lastProgress != nil && !complete {
+			transferRate.AddSample(time.Now(), lastProgress.TotalBytesDone)
+			overall := formatOverallProgress(op, lastProgress, transferRate)
+			if lastProgress.ItemBytes > 0 && lastProgress.ItemBytesDone < lastProgress.ItemBytes &&
+				(display.multiLine || l.options().Verbose) {
+				display.show(overall, "  "+formatItemProgress(lastProgress))
+			} else {
+				display.show(overall)
+			}
 		}
 
 	}
-	if !GlobalOptions.Verbose && lastConsoleLineLen > 0 {
-		// Write final line with newline
-		LogConsoleOverwrite(fmt.Sprintf("%ving: 100%%", op), lastConsoleLineLen)
-		LogConsole("")
+	if lastProgress != nil {
+		// Write final line
+		display.show(fmt.Sprintf("%ving: 100%%", op))
+	}
+	display.finish()
+	results.Duration = time.Since(startTime)
+	if len(results.PhaseDurations) > 0 {
+		// Break down where the time went, since phases other than transfer can take a while on big files
+		var phaseTotal time.Duration
+		var phases []string
+		for _, t := range []ProgressCallbackType{ProgressApplyingDelta, ProgressVerifying, ProgressLinking} {
+			if d, ok := results.PhaseDurations[t]; ok {
+				phaseTotal += d
+				phases = append(phases, fmt.Sprintf("%v %v", strings.ToLower(progressPhaseName(t)), formatPhaseDuration(d)))
+			}
+		}
+		transferring := fmt.Sprintf("%ving %v", strings.ToLower(op), formatPhaseDuration(results.Duration-phaseTotal))
+		l.Consolef("Time spent: %v, %v\n", transferring, strings.Join(phases, ", "))
 	}
+	l.ConsoleSummary(formatProgressSummary(op, results))
 	return results
 
 }
+
+// Format a duration for progress reporting (to 1/10th second)
+// Report progress to DefaultLogger's console, see Logger.ReportProgressToConsole
+func ReportProgressToConsole(callbackChan <-chan *ProgressCallbackData, op string, freq time.Duration) *ProgressResults {
+	return DefaultLogger.ReportProgressToConsole(callbackChan, op, freq)
+}
+
+func formatPhaseDuration(d time.Duration) string {
+	return (d - d%(100*time.Millisecond)).String()
+}
+
+var (
+	// How long a single item has to take before ItemProgressReporter shows anything
+	ItemProgressDelay = 2 * time.Second
+	// How often ItemProgressReporter updates what it shows
+	ItemProgressInterval = 500 * time.Millisecond
+)
+
+// Reports progress through one item (e.g. restoring a large file) on a single console line, the
+// way git reports its own progress so that it sits well alongside it (e.g. when smudging):
+// only if the console is a terminal, only once the item has taken longer than ItemProgressDelay
+// so that quick items don't flicker, and ending with ", done."
+// e.g. "Checking out level1.psd: 45% (1.8GB/4GB)"
+type ItemProgressReporter struct {
+	log       *Logger
+	op        string
+	Desc      string
+	start     time.Time
+	lastShown time.Time
+	lineLen   int
+	last      *ProgressCallbackData
+}
+
+func (l *Logger) NewItemProgressReporter(op, desc string) *ItemProgressReporter {
+	return &ItemProgressReporter{log: l, op: op, Desc: desc, start: time.Now()}
+}
+
+// Report progress through one item to DefaultLogger's console
+func NewItemProgressReporter(op, desc string) *ItemProgressReporter {
+	return DefaultLogger.NewItemProgressReporter(op, desc)
+}
+
+// Use as the ProgressCallback for the item; never aborts
+func (r *ItemProgressReporter) Callback(data *ProgressCallbackData) (abort bool) {
+	r.last = data
+	now := time.Now()
+	if now.Sub(r.start) < ItemProgressDelay || now.Sub(r.lastShown) < ItemProgressInterval || !r.log.consoleIsTerminal() {
+		return false
+	}
+	r.show("")
+	r.lastShown = now
+	return false
+}
+
+// End the progress line if anything was shown, with ", done." if the item succeeded
+func (r *ItemProgressReporter) Finish(success bool) {
+	if r.lineLen == 0 {
+		return
+	}
+	if success {
+		r.show(", done.")
+	}
+	r.log.Console("")
+	r.lineLen = 0
+}
+
+func (r *ItemProgressReporter) show(suffix string) {
+	msg := fmt.Sprintf("%v %v", r.op, r.Desc)
+	if r.last != nil && r.last.ItemBytes > 0 {
+		msg += fmt.Sprintf(": %d%% (%v/%v)", int((100*r.last.ItemBytesDone)/r.last.ItemBytes),
+			FormatSize(r.last.ItemBytesDone), FormatSize(r.last.ItemBytes))
+	}
+	msg += suffix
+	r.log.ConsoleOverwrite(msg, r.lineLen)
+	r.lineLen = len(msg)
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Progress", func() {
+
+	It("reports results & times phases", func() {
+		callbackChan := make(chan *ProgressCallbackData, 100)
+		go func() {
+			callbackChan <- &ProgressCallbackData{ProgressCalculate, "Starting", 0, 0, 0, 0, nil}
+			callbackChan <- &ProgressCallbackData{ProgressSkip, "skipped", 10, 10, 10, 30, nil}
+			callbackChan <- &ProgressCallbackData{ProgressTransferBytes, "file", 5, 20, 15, 30, nil}
+			callbackChan <- &ProgressCallbackData{ProgressApplyingDelta, "file", 0, 100, 15, 30, nil}
+			time.Sleep(50 * time.Millisecond)
+			callbackChan <- &ProgressCallbackData{ProgressApplyingDelta, "file", 100, 100, 15, 30, nil}
+			callbackChan <- &ProgressCallbackData{ProgressVerifying, "file", 0, 100, 15, 30, nil}
+			callbackChan <- &ProgressCallbackData{ProgressVerifying, "file", 50, 100, 15, 30, nil}
+			time.Sleep(20 * time.Millisecond)
+			callbackChan <- &ProgressCallbackData{ProgressVerifying, "file", 100, 100, 15, 30, nil}
+			callbackChan <- &ProgressCallbackData{ProgressTransferBytes, "file", 20, 20, 30, 30, nil}
+			close(callbackChan)
+		}()
+		results := ReportProgressToConsole(callbackChan, "Fetch", 10*time.Millisecond)
+		Expect(results.TransferredCount).To(Equal(1))
+		Expect(results.TransferredBytes).To(BeEquivalentTo(20))
+		Expect(results.SkippedCount).To(Equal(1))
+		Expect(results.PhaseDurations).To(HaveLen(2), "Only phases which happened should be timed")
+		Expect(results.PhaseDurations[ProgressApplyingDelta] >= 50*time.Millisecond).To(BeTrue(), "Applying delta should be timed")
+		Expect(results.PhaseDurations[ProgressVerifying] >= 20*time.Millisecond).To(BeTrue(), "Verifying should be timed")
+	})
+
+	It("estimates rate over a rolling window", func() {
+		start := time.Now()
+		rate := NewRollingRateEstimator(5 * time.Second)
+		Expect(rate.Rate()).To(BeEquivalentTo(0), "No rate from a single sample")
+		_, ok := rate.ETA(1000)
+		Expect(ok).To(BeFalse(), "No ETA without a rate")
+		rate.AddSample(start, 0)
+		for i := 1; i <= 4; i++ {
+			rate.AddSample(start.Add(time.Duration(i)*time.Second), int64(i*1000))
+		}
+		Expect(rate.Rate()).To(BeEquivalentTo(1000))
+		eta, ok := rate.ETA(10000)
+		Expect(ok).To(BeTrue())
+		Expect(eta).To(Equal(10 * time.Second))
+
+		// Faster for longer than the window, the earlier rate should be forgotten
+		for i := 1; i <= 6; i++ {
+			rate.AddSample(start.Add(time.Duration(4+i)*time.Second), int64(4000+i*3000))
+		}
+		Expect(rate.Rate()).To(BeEquivalentTo(3000))
+		// Stalled, rate should fall
+		rate.AddSample(start.Add(12*time.Second), 22000)
+		Expect(rate.Rate()).To(BeEquivalentTo(1800))
+
+		// Starting again from a lower total discards earlier samples
+		rate.AddSample(start.Add(13*time.Second), 100)
+		Expect(rate.Rate()).To(BeEquivalentTo(0))
+	})
+
+	It("summarises results", func() {
+		results := &ProgressResults{TransferredCount: 3, TransferredBytes: 12 * 1024 * 1024, SkippedCount: 1, Duration: 4 * time.Second}
+		Expect(formatProgressSummary("Fetch", results)).To(Equal("Fetched 3 files (12MB) in 4s (3MB/s), 1 up to date"))
+		results = &ProgressResults{NotFoundCount: 2, RetryCount: 1, Duration: 1500 * time.Millisecond}
+		Expect(formatProgressSummary("Push", results)).To(Equal("Pushed 0 files in 1.5s, 2 not found, 1 retried"))
+	})
+
+})
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Get the command which runs ssh to connect to host & run remoteArgs there. GIT_SSH is used
+// instead of ssh if set, which may be plink or TortoisePlink. port may be blank for the default.
+// If subsystem is true remoteArgs is just the name of an SSH subsystem to start, e.g. sftp
+// Connections go through the proxy configured for host if there is one, see GetProxyURL
+func GetSSHCommand(opts *Options, log *Logger, host, port string, subsystem bool, remoteArgs ...string) (*exec.Cmd, error) {
+	return GetSSHCommandForRemote(opts, log, "", host, port, subsystem, remoteArgs...)
+}
+
+// As GetSSHCommand, but also using the SSH settings of a git remote (blank for none), i.e. to
+// share connections through an SSH control master, see GetSSHMultiplexing
+func GetSSHCommandForRemote(opts *Options, log *Logger, remoteName, host, port string, subsystem bool, remoteArgs ...string) (*exec.Cmd, error) {
+	ssh := os.Getenv("GIT_SSH")
+	basessh := filepath.Base(ssh)
+	// Strip extension for easier comparison
+	if ext := filepath.Ext(basessh); len(ext) > 0 {
+		basessh = basessh[:len(basessh)-len(ext)]
+	}
+	isPlink := strings.EqualFold(basessh, "plink")
+	isTortoise := strings.EqualFold(basessh, "tortoiseplink")
+	if ssh == "" {
+		ssh = "ssh"
+	}
+
+	args := make([]string, 0, 2)
+	if isTortoise {
+		// TortoisePlink requires the -batch argument to behave like ssh/plink
+		args = append(args, "-batch")
+	}
+	if port != "" {
+		if isPlink || isTortoise {
+			args = append(args, "-P")
+		} else {
+			args = append(args, "-p")
+		}
+		args = append(args, port)
+	}
+	// Connect through a proxy if one is configured; this overrides any ProxyCommand in ssh's own
+	// config, set git-lob.proxy to 'none' to use that instead
+	proxy, err := GetProxyURL(opts, "ssh", host)
+	if err != nil {
+		return nil, err
+	}
+	var proxyEnv []string
+	if proxy != nil {
+		proxyArgs, err := getSSHProxyArgs(isPlink, isTortoise)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Connecting to %v through proxy %v", host, proxy.Host)
+		args = append(args, proxyArgs...)
+		// Credentials go in the environment, not on the command line
+		proxyEnv = append(os.Environ(), fmt.Sprintf("%v=%v", ProxyEnvVar, proxy.String()))
+	}
+	if mux := GetSSHMultiplexing(opts, remoteName); mux != nil {
+		if isPlink || isTortoise {
+			// Plink shares connections via PuTTY's own 'share' setting instead
+			log.Debugf("Not multiplexing SSH connections to %v, not supported with %v", host, basessh)
+		} else {
+			args = append(args, "-o", "ControlMaster=auto", "-o", "ControlPath="+mux.ControlPath,
+				"-o", "ControlPersist="+mux.ControlPersist)
+		}
+	}
+	if subsystem {
+		// Same option for ssh & plink
+		args = append(args, "-s")
+	}
+	args = append(args, host)
+	args = append(args, remoteArgs...)
+
+	log.Debugf("SSH command is: %v %v", ssh, strings.Join(args, " "))
+
+	cmd := exec.Command(ssh, args...)
+	cmd.Env = proxyEnv
+	return cmd, nil
+}
+
+// Get the arguments which make ssh connect through 'git lob proxy-connect', which reads the proxy
+// from the environment
+func getSSHProxyArgs(isPlink, isTortoise bool) ([]string, error) {
+	if isTortoise {
+		return nil, fmt.Errorf("Proxies aren't supported with TortoisePlink, configure the proxy in PuTTY instead")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to locate git-lob to use as a proxy command: %v", err.Error())
+	}
+	if isPlink {
+		// Plink's own substitutions
+		return []string{"-proxycmd", fmt.Sprintf(`"%v" proxy-connect %%host %%port`, exe)}, nil
+	}
+	return []string{"-o", fmt.Sprintf(`ProxyCommand="%v" proxy-connect %%h %%p`, exe)}, nil
+}
+
+// Settings for sharing SSH connections to a remote through a control master
+type SSHMultiplexing struct {
+	// Socket of the control master, may include ssh's % tokens
+	ControlPath string
+	// How long the control master stays around after the last connection closes, e.g. 10m
+	ControlPersist string
+}
+
+// Get the SSH connection sharing settings for a remote, or nil if it doesn't use it
+// Enabled with remote.<name>.git-lob-ssh-multiplex, with remote.<name>.git-lob-ssh-control-path
+// & remote.<name>.git-lob-ssh-control-persist overriding the defaults
+func GetSSHMultiplexing(opts *Options, remoteName string) *SSHMultiplexing {
+	if remoteName == "" {
+		return nil
+	}
+	setting := func(name string) string {
+		return strings.TrimSpace(opts.GitConfig[fmt.Sprintf("remote.%v.git-lob-ssh-%v", remoteName, name)])
+	}
+	if !strings.EqualFold(setting("multiplex"), "true") {
+		return nil
+	}
+	// %C is a hash of the local host, remote host, port & user, so paths stay short enough for a socket
+	ret := &SSHMultiplexing{ControlPath: "~/.ssh/git-lob-%C", ControlPersist: "10m"}
+	if path := setting("control-path"); path != "" {
+		ret.ControlPath = path
+	}
+	if persist := setting("control-persist"); persist != "" {
+		ret.ControlPersist = persist
+	}
+	return ret
+}
@@ -0,0 +1,171 @@
+package util
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth throttling (git-lob.max-upload-rate / git-lob.max-download-rate / --limit-rate)
+// Providers wrap the readers & writers they transfer content through, which then share
+// a token bucket per direction, so the limit applies to the total rate however many
+// files are transferred, rather than to each one.
+
+// Limits a rate of transfer to a number of bytes per second using a token bucket
+// Up to a short burst can be transferred at once, after that transfers wait for tokens
+type RateLimiter struct {
+	mutex sync.Mutex
+	// Bytes per second
+	rate int64
+	// Most bytes which can be transferred at once
+	burst int64
+	// Bytes which can be transferred now
+	tokens float64
+	// When tokens were last added
+	last time.Time
+}
+
+// Fraction of a second's worth of bytes which can be transferred in one go; small enough
+// to keep the rate smooth, large enough not to slow transfers down with tiny reads
+const rateLimiterBurstFraction = 4
+
+// Smallest burst, so that very low rates don't result in tiny reads
+const rateLimiterMinBurst = 1024
+
+// Create a limiter for a rate in bytes per second
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	burst := bytesPerSecond / rateLimiterBurstFraction
+	if burst < rateLimiterMinBurst {
+		burst = rateLimiterMinBurst
+	}
+	return &RateLimiter{rate: bytesPerSecond, burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// Wait until n bytes (no more than the burst size) may be transferred
+func (self *RateLimiter) Wait(n int) {
+	self.mutex.Lock()
+	now := time.Now()
+	self.tokens += now.Sub(self.last).Seconds() * float64(self.rate)
+	if self.tokens > float64(self.burst) {
+		self.tokens = float64(self.burst)
+	}
+	self.last = now
+	// Take the tokens now, even if that goes negative, so that concurrent transfers queue
+	// up behind each other rather than all waking at once
+	self.tokens -= float64(n)
+	var wait time.Duration
+	if self.tokens < 0 {
+		wait = time.Duration(-self.tokens / float64(self.rate) * float64(time.Second))
+	}
+	self.mutex.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Reader which limits the rate at which it can be read
+type ThrottledReader struct {
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func NewThrottledReader(r io.Reader, limiter *RateLimiter) *ThrottledReader {
+	return &ThrottledReader{r, limiter}
+}
+
+func (self *ThrottledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > self.limiter.burst {
+		p = p[:self.limiter.burst]
+	}
+	n, err := self.reader.Read(p)
+	if n > 0 {
+		self.limiter.Wait(n)
+	}
+	return n, err
+}
+
+// Writer which limits the rate at which it can be written
+type ThrottledWriter struct {
+	writer  io.Writer
+	limiter *RateLimiter
+}
+
+func NewThrottledWriter(w io.Writer, limiter *RateLimiter) *ThrottledWriter {
+	return &ThrottledWriter{w, limiter}
+}
+
+func (self *ThrottledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > self.limiter.burst {
+			chunk = chunk[:self.limiter.burst]
+		}
+		self.limiter.Wait(len(chunk))
+		n, err := self.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Shared limiters for each direction & rate, so that all transfers with the same limit share it
+var uploadRateLimiters = make(map[int64]*RateLimiter)
+var downloadRateLimiters = make(map[int64]*RateLimiter)
+var rateLimitersMutex sync.Mutex
+
+// Get the shared limiter for a rate, or nil if unlimited
+func getSharedRateLimiter(limiters map[int64]*RateLimiter, rate int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	rateLimitersMutex.Lock()
+	defer rateLimitersMutex.Unlock()
+	limiter := limiters[rate]
+	if limiter == nil {
+		limiter = NewRateLimiter(rate)
+		limiters[rate] = limiter
+	}
+	return limiter
+}
+
+// Wrap a reader of content being uploaded to a remote so it's limited by git-lob.max-upload-rate
+func ThrottleUploadReader(opts *Options, r io.Reader) io.Reader {
+	limiter := getSharedRateLimiter(uploadRateLimiters, opts.MaxUploadRate)
+	if limiter == nil {
+		return r
+	}
+	return NewThrottledReader(r, limiter)
+}
+
+// Wrap a reader of content being downloaded from a remote so it's limited by git-lob.max-download-rate
+func ThrottleDownloadReader(opts *Options, r io.Reader) io.Reader {
+	limiter := getSharedRateLimiter(downloadRateLimiters, opts.MaxDownloadRate)
+	if limiter == nil {
+		return r
+	}
+	return NewThrottledReader(r, limiter)
+}
+
+// Wrap a writer of content being downloaded from a remote so it's limited by git-lob.max-download-rate
+func ThrottleDownloadWriter(opts *Options, w io.Writer) io.Writer {
+	limiter := getSharedRateLimiter(downloadRateLimiters, opts.MaxDownloadRate)
+	if limiter == nil {
+		return w
+	}
+	return NewThrottledWriter(w, limiter)
+}
+
+// Parse a transfer rate from config or the command line, e.g. 500K or 2MB/s, into bytes per second
+// Rates are in bytes not bits, consistent with sizes elsewhere
+func ParseTransferRate(str string) (int64, error) {
+	str = strings.TrimSpace(str)
+	if len(str) > 2 && strings.HasSuffix(strings.ToLower(str), "/s") {
+		str = str[:len(str)-2]
+	}
+	return ParseSize(str)
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Throttle", func() {
+	data := make([]byte, 64*1024)
+
+	It("Limits read rate", func() {
+		// 128KB/s with a 32KB burst; 64KB should take (64-32)/128 = 0.25s
+		limiter := NewRateLimiter(128 * 1024)
+		start := time.Now()
+		out, err := ioutil.ReadAll(NewThrottledReader(bytes.NewReader(data), limiter))
+		Expect(err).To(BeNil())
+		Expect(out).To(Equal(data), "Content should be unchanged")
+		elapsed := time.Since(start)
+		Expect(elapsed).To(BeNumerically(">=", 200*time.Millisecond), "Should be slowed to limit")
+		Expect(elapsed).To(BeNumerically("<", 2*time.Second), "Should not be slowed too much")
+	})
+
+	It("Limits write rate", func() {
+		limiter := NewRateLimiter(128 * 1024)
+		var buf bytes.Buffer
+		start := time.Now()
+		n, err := io.Copy(NewThrottledWriter(&buf, limiter), bytes.NewReader(data))
+		Expect(err).To(BeNil())
+		Expect(n).To(BeEquivalentTo(len(data)))
+		Expect(buf.Bytes()).To(Equal(data), "Content should be unchanged")
+		elapsed := time.Since(start)
+		Expect(elapsed).To(BeNumerically(">=", 200*time.Millisecond), "Should be slowed to limit")
+		Expect(elapsed).To(BeNumerically("<", 2*time.Second), "Should not be slowed too much")
+	})
+
+	It("Shares limits between transfers in one direction", func() {
+		opts := NewOptions()
+		r := bytes.NewReader(data)
+		Expect(ThrottleUploadReader(opts, r)).To(Equal(r), "Should not wrap when unlimited")
+
+		opts.MaxUploadRate = 128 * 1024
+		start := time.Now()
+		// 2 x 64KB at 128KB/s with a 32KB burst is at least 0.75s in total
+		for i := 0; i < 2; i++ {
+			_, err := ioutil.ReadAll(ThrottleUploadReader(opts, bytes.NewReader(data)))
+			Expect(err).To(BeNil())
+		}
+		Expect(time.Since(start)).To(BeNumerically(">=", 700*time.Millisecond), "Limit should apply across transfers")
+		start = time.Now()
+		var buf bytes.Buffer
+		io.Copy(ThrottleDownloadWriter(opts, &buf), bytes.NewReader(data))
+		Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond), "Downloads should not be limited")
+	})
+
+	It("Parses transfer rates", func() {
+		for _, c := range []struct {
+			str  string
+			rate int64
+		}{
+			{"1000", 1000},
+			{"500K", 500 * 1024},
+			{"2MB/s", 2 * 1024 * 1024},
+			{" 1.5m/S ", 1536 * 1024},
+		} {
+			rate, err := ParseTransferRate(c.str)
+			Expect(err).To(BeNil(), "Should parse %v", c.str)
+			Expect(rate).To(Equal(c.rate), "Should parse %v", c.str)
+		}
+		_, err := ParseTransferRate("fast")
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -12,73 +12,138 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	parseSizeRegex *regexp.Regexp
+	parseAgeRegex  *regexp.Regexp
 )
 
 var cachedRepoRoot string
 var cachedRepoRootIsSeparate bool
 var cachedRepoRootWorkingDir string
+var cachedRepoRootIsBare bool
 
 // Gets the root folder of this git repository (the one containing .git)
+// For a bare repository this is the git dir itself, see IsBareRepo
 func GetRepoRoot() (path string, isSeparateGitDir bool, reterr error) {
-	// We could call 'git rev-parse --git-dir' but this requires shelling out = slow, especially on Windows
-	// We should try to avoid that whenever we can
-	// So let's just find it ourselves; first containing folder with a .git folder/file
 	curDir, err := os.Getwd()
 	if err != nil {
 		return "", false, err
 	}
-	origCurDir := curDir
 	// Use the cached value if known
 	if cachedRepoRootWorkingDir == curDir && cachedRepoRoot != "" {
 		return cachedRepoRoot, cachedRepoRootIsSeparate, nil
 	}
+	root, isSeparate, isBare, err := FindRepoRoot(curDir)
+	if err != nil {
+		return "", false, err
+	}
+	// Store in cache to speed up
+	cachedRepoRoot = root
+	cachedRepoRootWorkingDir = curDir
+	cachedRepoRootIsSeparate = isSeparate
+	cachedRepoRootIsBare = isBare
+	return root, isSeparate, nil
+}
 
+// Finds the root folder of the git repository containing dir (the one containing .git), whether
+// .git is a file pointing to a separate git dir, and whether the repository is bare, in which
+// case the root is the git dir itself
+func FindRepoRoot(dir string) (root string, isSeparateGitDir, isBare bool, reterr error) {
+	// We could call 'git rev-parse --git-dir' but this requires shelling out = slow, especially on Windows
+	// We should try to avoid that whenever we can
+	// So let's just find it ourselves; first containing folder with a .git folder/file
+	curDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false, false, err
+	}
 	for {
 		exists, isDir := FileOrDirExists(filepath.Join(curDir, ".git"))
 		if exists {
-			// Store in cache to speed up
-			cachedRepoRoot = curDir
-			cachedRepoRootWorkingDir = origCurDir
-			cachedRepoRootIsSeparate = !isDir
-			return curDir, !isDir, nil
+			return curDir, !isDir, false, nil
+		}
+		if isBareGitDir(curDir) {
+			return curDir, false, true, nil
 		}
 		curDir = filepath.Dir(curDir)
 		if len(curDir) == 0 || curDir[len(curDir)-1] == filepath.Separator || curDir == "." {
 			// Not a repo
-			return "", false, errors.New("Couldn't find repo root, not a git folder")
+			return "", false, false, errors.New("Couldn't find repo root, not a git folder")
 		}
 	}
 }
 
+// Forget the repository GetRepoRoot found, so it's found again even from the same working directory
+func ClearRepoRootCache() {
+	cachedRepoRoot = ""
+	cachedRepoRootWorkingDir = ""
+	cachedRepoRootIsSeparate = false
+	cachedRepoRootIsBare = false
+}
+
+// Does a folder look like a bare git repository (what git itself checks for)
+func isBareGitDir(dir string) bool {
+	if exists, isDir := FileOrDirExists(filepath.Join(dir, "HEAD")); !exists || isDir {
+		return false
+	}
+	if !DirExists(filepath.Join(dir, "objects")) {
+		return false
+	}
+	return DirExists(filepath.Join(dir, "refs"))
+}
+
+// Is the current git repository bare, i.e. has no working copy
+// Binaries are still stored under <gitdir>/git-lob so they can be fetched & pushed, but
+// nothing which needs a working copy (checkout, track etc) is possible
+func IsBareRepo() bool {
+	_, _, err := GetRepoRoot()
+	return err == nil && cachedRepoRootIsBare
+}
+
 // Gets the git data dir of git repository (the .git dir, or where .git file points)
+// For a bare repository this is the repository folder itself
 func GetGitDir() string {
 	root, isSeparate, err := GetRepoRoot()
 	if err != nil {
 		return ""
 	}
+	gitDir, err := FindGitDir(root, isSeparate, IsBareRepo())
+	if err != nil {
+		LogErrorf("%v\n", err.Error())
+		return ""
+	}
+	return gitDir
+}
+
+// Gets the git data dir of the repository at root, as found by FindRepoRoot
+func FindGitDir(root string, isSeparateGitDir, isBare bool) (string, error) {
+	if isBare {
+		return root, nil
+	}
 	git := filepath.Join(root, ".git")
-	if isSeparate {
+	if isSeparateGitDir {
 		// Git repo folder is separate, read location from file
 		filebytes, err := ioutil.ReadFile(git)
 		if err != nil {
-			LogErrorf("Can't read .git file %v: %v\n", git, err)
-			return ""
+			return "", fmt.Errorf("Can't read .git file %v: %v", git, err)
 		}
 		filestr := string(filebytes)
 		match := regexp.MustCompile("gitdir:[\\s]+([^\\r\\n]+)").FindStringSubmatch(filestr)
 		if match == nil {
-			LogErrorf("Unexpected contents of .git file %v: %v\n", git, filestr)
-			return ""
+			return "", fmt.Errorf("Unexpected contents of .git file %v: %v", git, filestr)
 		}
 		// The text in the git dir will use cygwin-style separators, so normalise
-		return filepath.Clean(match[1])
+		gitDir := filepath.Clean(match[1])
+		if !filepath.IsAbs(gitDir) {
+			// Relative paths are relative to the folder containing .git
+			gitDir = filepath.Join(root, gitDir)
+		}
+		return gitDir, nil
 	} else {
 		// Regular git dir
-		return git
+		return git, nil
 	}
 
 }
@@ -151,6 +216,41 @@ func ParseSize(str string) (int64, error) {
 
 }
 
+// Parse a string representing a point in time, either a date (2006-01-02, optionally followed by
+// a time of 15:04 or 15:04:05, local time unless RFC 3339) or an age relative to now, a number
+// followed by h (hours), d (days) or w (weeks), e.g. 48h
+func ParseDateOrAge(str string, now time.Time) (time.Time, error) {
+	if parseAgeRegex == nil {
+		parseAgeRegex = regexp.MustCompile(`(?i)^\s*(\d+)\s*([HDW])\s*$`)
+	}
+
+	if match := parseAgeRegex.FindStringSubmatch(str); match != nil {
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch strings.ToUpper(match[2]) {
+		case "H":
+			return now.Add(-time.Duration(n) * time.Hour), nil
+		case "D":
+			return now.AddDate(0, 0, -n), nil
+		default:
+			return now.AddDate(0, 0, -7*n), nil
+		}
+	}
+
+	str = strings.TrimSpace(str)
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, str, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid date: %v, must be YYYY-MM-DD [hh:mm[:ss]] or an age like 48h, 2d or 1w", str)
+}
+
 func FormatBytes(sz int64) (suffix string, scaled float32) {
 	switch {
 	case sz >= (1 << 50):
@@ -307,7 +407,8 @@ func FilenamePassesIncludeExcludeFilter(filename string, includePaths, excludePa
 // get too long. name is the command name as per exec.Command
 // Files are appended to the end of the argument list
 // errorCallback is called for any errors so caller can decide whether to abort
-func ExecForManyFilesSplitIfRequired(files []string,
+// The commands run in dir, or the working dir if blank
+func ExecForManyFilesSplitIfRequired(dir string, files []string,
 	errorCallback func(args []string, output string, err error) (abort bool),
 	name string, baseargs ...string) {
 
@@ -346,6 +447,7 @@ func ExecForManyFilesSplitIfRequired(files []string,
 		}
 		// Issue this command
 		cmd := exec.Command(name, newargs...)
+		cmd.Dir = dir
 		outp, err := cmd.CombinedOutput()
 		if err != nil {
 			abort := errorCallback(newargs, string(outp), err)
@@ -365,31 +467,20 @@ func ExecForManyFilesSplitIfRequired(files []string,
 }
 
 // Make a list of filenames expressed relative to the root of the repo relative to the
-// current working dir. This is useful when needing to call out to git, but the user
-// may be in a subdir of their repo
-func MakeRepoFileListRelativeToCwd(repofiles []string) []string {
-	root, _, err := GetRepoRoot()
-	if err != nil {
-		LogError("Unable to get repo root: ", err.Error())
-		return repofiles
-	}
-	wd, err := os.Getwd()
-	if err != nil {
-		LogError("Unable to get working dir: ", err.Error())
-		return repofiles
-	}
-
+// dir instead. This is useful when needing to call out to git, but the user may be in a
+// subdir of their repo
+func MakeRepoFileListRelativeToDir(repofiles []string, root, dir string, log *Logger) []string {
 	// Early-out if working dir is root dir, same result
-	if root == wd {
+	if root == dir {
 		return repofiles
 	}
 
 	var ret []string
 	for _, f := range repofiles {
 		abs := filepath.Join(root, f)
-		rel, err := filepath.Rel(wd, abs)
+		rel, err := filepath.Rel(dir, abs)
 		if err != nil {
-			LogErrorf("Unable to convert %v to path relative to working dir %v: %v\n", abs, wd, err.Error())
+			log.Errorf("Unable to convert %v to path relative to working dir %v: %v\n", abs, dir, err.Error())
 			// Use absolute file instead (longer)
 			ret = append(ret, abs)
 		} else {
@@ -405,3 +496,65 @@ func MakeRepoFileListRelativeToCwd(repofiles []string) []string {
 func IsWindows() bool {
 	return runtime.GOOS == "windows"
 }
+
+// Windows paths
+// Windows APIs reject paths longer than MAX_PATH (260 chars) unless they're in the extended-length
+// form, \\?\C:\... or \\?\UNC\server\share\..., and the splayed folders of a store deep in a repo,
+// or a shared store on a network drive, easily go over that. Paths of files in stores go through
+// LongPath, which does nothing on other platforms. Shares are also written many ways (//server/share,
+// mixed slashes), which NormalizeUNCPath tidies up.
+
+// Length beyond which a Windows path needs the extended-length form; creating a folder needs room
+// for an 8.3 file name in it as well, hence less than MAX_PATH
+const windowsMaxPathLen = 248
+
+const windowsLongPathPrefix = `\\?\`
+const windowsLongUNCPrefix = `\\?\UNC\`
+
+// Convert an absolute, clean Windows path to the extended-length form if it's too long to use
+// otherwise. Relative paths can't be extended-length so are returned unchanged
+func toWindowsLongPath(path string) string {
+	if len(path) < windowsMaxPathLen || strings.HasPrefix(path, windowsLongPathPrefix) {
+		return path
+	}
+	path = strings.Replace(path, "/", `\`, -1)
+	if strings.HasPrefix(path, `\\`) {
+		return windowsLongUNCPrefix + path[2:]
+	}
+	if len(path) >= 3 && path[1] == ':' && path[2] == '\\' {
+		return windowsLongPathPrefix + path
+	}
+	return path
+}
+
+// Strip the extended-length prefix from a path if it has one, e.g. to compare it with other paths
+func StripLongPathPrefix(path string) string {
+	if strings.HasPrefix(path, windowsLongUNCPrefix) {
+		return `\\` + path[len(windowsLongUNCPrefix):]
+	}
+	return strings.TrimPrefix(path, windowsLongPathPrefix)
+}
+
+// Tidy up a Windows UNC path to \\server\share\path with single backslashes; the root of a share
+// keeps a trailing backslash, since Windows can't stat it without. Other paths are returned unchanged
+func normalizeWindowsUNCPath(path string) string {
+	path = strings.Replace(path, "/", `\`, -1)
+	if !strings.HasPrefix(path, `\\`) || strings.HasPrefix(path, windowsLongPathPrefix) || strings.HasPrefix(path, `\\.\`) {
+		return path
+	}
+	var parts []string
+	for _, part := range strings.Split(path[2:], `\`) {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) < 2 {
+		// Not a share, just a server
+		return path
+	}
+	ret := `\\` + strings.Join(parts, `\`)
+	if len(parts) == 2 {
+		ret += `\`
+	}
+	return ret
+}
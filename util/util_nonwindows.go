@@ -5,6 +5,7 @@ package util
 import (
 	"os"
 	"strconv"
+	"syscall"
 )
 
 // Get the maximum number of arguments we want to try passing to the command line
@@ -25,3 +26,29 @@ func GetMaxCommandLineLength() int {
 	// from experience, safe limit
 	return 128000
 }
+
+// Whether progress can be redrawn over several lines of the console (using ANSI escape codes)
+func (l *Logger) consoleSupportsCursorMovement() bool {
+	return l.consoleIsTerminal() && os.Getenv("TERM") != "dumb"
+}
+
+// Get the number of bytes available to this user on the filesystem containing path
+func GetFreeDiskSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Get the form of a path Windows APIs accept whatever its length; paths are fine as they are
+// on other platforms
+func LongPath(path string) string {
+	return path
+}
+
+// Tidy up a UNC path; there are none on other platforms, where // is just a path
+func NormalizeUNCPath(path string) string {
+	return path
+}
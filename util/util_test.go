@@ -1,6 +1,9 @@
 package util
 
 import (
+	"strings"
+	"time"
+
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
 )
@@ -76,6 +79,31 @@ var _ = Describe("Util", func() {
 			Expect(err).To(BeNil(), "Should parse without error")
 			Expect(val).To(BeEquivalentTo(1688849860263936))
 		})
+		It("parses dates & ages", func() {
+			now := time.Date(2015, 6, 10, 12, 30, 0, 0, time.Local)
+			t, err := ParseDateOrAge("48h", now)
+			Expect(err).To(BeNil(), "Should parse without error")
+			Expect(t).To(Equal(time.Date(2015, 6, 8, 12, 30, 0, 0, time.Local)))
+			t, err = ParseDateOrAge(" 3D ", now)
+			Expect(err).To(BeNil(), "Should parse without error")
+			Expect(t).To(Equal(time.Date(2015, 6, 7, 12, 30, 0, 0, time.Local)))
+			t, err = ParseDateOrAge("2w", now)
+			Expect(err).To(BeNil(), "Should parse without error")
+			Expect(t).To(Equal(time.Date(2015, 5, 27, 12, 30, 0, 0, time.Local)))
+			t, err = ParseDateOrAge("2015-06-01", now)
+			Expect(err).To(BeNil(), "Should parse without error")
+			Expect(t).To(Equal(time.Date(2015, 6, 1, 0, 0, 0, 0, time.Local)))
+			t, err = ParseDateOrAge("2015-06-01 09:15", now)
+			Expect(err).To(BeNil(), "Should parse without error")
+			Expect(t).To(Equal(time.Date(2015, 6, 1, 9, 15, 0, 0, time.Local)))
+			t, err = ParseDateOrAge("2015-06-01T09:15:30Z", now)
+			Expect(err).To(BeNil(), "Should parse without error")
+			Expect(t.Equal(time.Date(2015, 6, 1, 9, 15, 30, 0, time.UTC))).To(BeTrue())
+			_, err = ParseDateOrAge("yesterday", now)
+			Expect(err).ToNot(BeNil(), "Should reject unknown formats")
+			_, err = ParseDateOrAge("48", now)
+			Expect(err).ToNot(BeNil(), "Should require a unit")
+		})
 
 	})
 
@@ -219,4 +247,32 @@ var _ = Describe("Util", func() {
 
 	})
 
+	Describe("Windows paths", func() {
+		It("converts long paths to the extended-length form", func() {
+			short := `C:\Users\steve\repo\.git\git-lob\content\abc\def\abcdef_0`
+			Expect(toWindowsLongPath(short)).To(Equal(short), "Short paths should be unchanged")
+
+			deep := `C:\Users\steve\` + strings.Repeat(`a_deeply_nested_folder\`, 12) + `abcdef_0`
+			Expect(len(deep)).To(BeNumerically(">", 260))
+			Expect(toWindowsLongPath(deep)).To(Equal(`\\?\` + deep))
+			Expect(toWindowsLongPath(strings.Replace(deep, `\`, "/", -1))).To(Equal(`\\?\`+deep), "Should use backslashes")
+			Expect(toWindowsLongPath(`\\?\`+deep)).To(Equal(`\\?\`+deep), "Should only be converted once")
+
+			share := `\\server\share\` + strings.Repeat(`a_deeply_nested_folder\`, 12) + `abcdef_0`
+			Expect(toWindowsLongPath(share)).To(Equal(`\\?\UNC\` + share[2:]))
+			Expect(StripLongPathPrefix(toWindowsLongPath(share))).To(Equal(share))
+			Expect(StripLongPathPrefix(toWindowsLongPath(deep))).To(Equal(deep))
+
+			relative := strings.Repeat(`a_deeply_nested_folder\`, 12)
+			Expect(toWindowsLongPath(relative)).To(Equal(relative), "Relative paths can't be extended-length")
+		})
+		It("normalizes UNC paths", func() {
+			Expect(normalizeWindowsUNCPath(`//server/share/store`)).To(Equal(`\\server\share\store`))
+			Expect(normalizeWindowsUNCPath(`\\server/share\\store\`)).To(Equal(`\\server\share\store`))
+			Expect(normalizeWindowsUNCPath(`\\server\share`)).To(Equal(`\\server\share\`), "Root of a share needs a trailing backslash")
+			Expect(normalizeWindowsUNCPath(`C:\store`)).To(Equal(`C:\store`))
+			Expect(normalizeWindowsUNCPath(`\\?\UNC\server\share\store`)).To(Equal(`\\?\UNC\server\share\store`))
+		})
+	})
+
 })
@@ -1,6 +1,13 @@
 // +build windows
 package util
 
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
 // Get the maximum number of arguments we want to try passing to the command line
 func GetMaxCommandLineArguments() int {
 	// Git doesn't allow more than 4096 file arguments so use that as a low-water mark
@@ -14,3 +21,44 @@ func GetMaxCommandLineLength() int {
 	// >= Win7 = 32768 (sub a a little for padding)
 	return 32000
 }
+
+// Whether progress can be redrawn over several lines of the console (using ANSI escape codes)
+func (l *Logger) consoleSupportsCursorMovement() bool {
+	// Not all Windows consoles understand escape codes, so stick to a single line
+	return false
+}
+
+// Get the number of bytes available to this user on the volume containing path
+func GetFreeDiskSpace(path string) (int64, error) {
+	kern32 := syscall.NewLazyDLL("kernel32.dll")
+	proc := kern32.NewProc("GetDiskFreeSpaceExW")
+	path16, err := syscall.UTF16PtrFromString(LongPath(path))
+	if err != nil {
+		return 0, err
+	}
+	var freeBytesAvailable uint64
+	ret, _, err := proc.Call(uintptr(unsafe.Pointer(path16)),
+		uintptr(unsafe.Pointer(&freeBytesAvailable)), 0, 0)
+	if ret == 0 {
+		// zero return means failure in Win API, err contains result of GetLastError
+		return 0, err
+	}
+	return int64(freeBytesAvailable), nil
+}
+
+// Get the form of a path Windows APIs accept whatever its length, see toWindowsLongPath
+func LongPath(path string) string {
+	if strings.HasPrefix(path, windowsLongPathPrefix) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return toWindowsLongPath(abs)
+}
+
+// Tidy up a UNC path, see normalizeWindowsUNCPath
+func NormalizeUNCPath(path string) string {
+	return normalizeWindowsUNCPath(path)
+}